@@ -0,0 +1,35 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package stock
+
+// BatchDeleter is an optional extension of a Stock supporting the removal of
+// a list of indexes in a single operation. Implementations may use this to
+// amortize per-operation costs like lock acquisitions.
+type BatchDeleter[I Index] interface {
+	// DeleteAll removes all the given indexes. The same restrictions as for
+	// individual Delete calls apply to each index.
+	DeleteAll([]I) error
+}
+
+// DeleteAll removes all the given indexes from the given stock. If the stock
+// implements the BatchDeleter interface, the indexes are removed in a single
+// operation. Otherwise, they are deleted one-by-one.
+func DeleteAll[I Index, V any](stock Stock[I, V], indexes []I) error {
+	if deleter, ok := stock.(BatchDeleter[I]); ok {
+		return deleter.DeleteAll(indexes)
+	}
+	for _, index := range indexes {
+		if err := stock.Delete(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package stock
+
+import (
+	"errors"
+	"testing"
+
+	"go.uber.org/mock/gomock"
+)
+
+func TestDeleteAll_IndexesAreDeletedIndividuallyIfBatchesAreNotSupported(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	stock := NewMockStock[int, int](ctrl)
+
+	gomock.InOrder(
+		stock.EXPECT().Delete(1),
+		stock.EXPECT().Delete(3),
+		stock.EXPECT().Delete(2),
+	)
+
+	if err := DeleteAll[int, int](stock, []int{1, 3, 2}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDeleteAll_FirstErrorIsReturned(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	stock := NewMockStock[int, int](ctrl)
+
+	injectedErr := errors.New("injected error")
+	gomock.InOrder(
+		stock.EXPECT().Delete(1),
+		stock.EXPECT().Delete(2).Return(injectedErr),
+	)
+
+	if err := DeleteAll[int, int](stock, []int{1, 2, 3}); !errors.Is(err, injectedErr) {
+		t.Errorf("unexpected error, wanted %v, got %v", injectedErr, err)
+	}
+}
+
+func TestDeleteAll_BatchDeletersAreUsedIfSupported(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	stock := &batchDeletingStock{MockStock: NewMockStock[int, int](ctrl)}
+
+	if err := DeleteAll[int, int](stock, []int{1, 2, 3}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(stock.batches) != 1 || len(stock.batches[0]) != 3 {
+		t.Errorf("unexpected batches: %v", stock.batches)
+	}
+}
+
+type batchDeletingStock struct {
+	*MockStock[int, int]
+	batches [][]int
+}
+
+func (s *batchDeletingStock) DeleteAll(indexes []int) error {
+	s.batches = append(s.batches, indexes)
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package bounded
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+type boundedStock[I stock.Index, V any] struct {
+	nested   stock.Stock[I, V]
+	capacity I
+}
+
+// Limit wraps the given stock into a wrapper refusing to allocate indexes
+// greater than or equal to the given capacity. If the nested stock provides
+// such an index, it is released again and stock.ErrIdSpaceExhausted is
+// returned. This way, clients encoding indexes using a limited number of bits
+// are protected from silently truncated indexes.
+func Limit[I stock.Index, V any](stock stock.Stock[I, V], capacity I) stock.Stock[I, V] {
+	return &boundedStock[I, V]{nested: stock, capacity: capacity}
+}
+
+func (s *boundedStock[I, V]) New() (I, error) {
+	index, err := s.nested.New()
+	if err != nil || index < s.capacity {
+		return index, err
+	}
+	return 0, errors.Join(
+		fmt.Errorf("%w: index %d exceeds capacity of %d", stock.ErrIdSpaceExhausted, index, s.capacity),
+		s.nested.Delete(index),
+	)
+}
+
+func (s *boundedStock[I, V]) Get(index I) (V, error) {
+	return s.nested.Get(index)
+}
+
+func (s *boundedStock[I, V]) Set(index I, value V) error {
+	return s.nested.Set(index, value)
+}
+
+func (s *boundedStock[I, V]) Delete(index I) error {
+	return s.nested.Delete(index)
+}
+
+func (s *boundedStock[I, V]) DeleteAll(indexes []I) error {
+	return stock.DeleteAll(s.nested, indexes)
+}
+
+func (s *boundedStock[I, V]) GetIds() (stock.IndexSet[I], error) {
+	return s.nested.GetIds()
+}
+
+func (s *boundedStock[I, V]) GetMemoryFootprint() *common.MemoryFootprint {
+	return s.nested.GetMemoryFootprint()
+}
+
+func (s *boundedStock[I, V]) Flush() error {
+	return s.nested.Flush()
+}
+
+func (s *boundedStock[I, V]) Close() error {
+	return s.nested.Close()
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package bounded
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+	"github.com/Fantom-foundation/Carmen/go/backend/stock/file"
+	"github.com/Fantom-foundation/Carmen/go/backend/stock/memory"
+)
+
+func TestBoundedStock(t *testing.T) {
+	stock.RunStockTests(t, stock.NamedStockFactory{
+		ImplementationName: "boundedMemory",
+		Open: func(t *testing.T, directory string) (stock.Stock[int, int], error) {
+			nested, err := memory.OpenStock[int, int](stock.IntEncoder{}, directory)
+			if err != nil {
+				return nil, err
+			}
+			return Limit(nested, 1<<30), nil
+		},
+	})
+	stock.RunStockTests(t, stock.NamedStockFactory{
+		ImplementationName: "boundedFile",
+		Open: func(t *testing.T, directory string) (stock.Stock[int, int], error) {
+			nested, err := file.OpenStock[int, int](stock.IntEncoder{}, directory)
+			if err != nil {
+				return nil, err
+			}
+			return Limit(nested, 1<<30), nil
+		},
+	})
+}
+
+func TestBoundedStock_IndexesBeyondCapacityAreRefused(t *testing.T) {
+	factories := map[string]func(string) (stock.Stock[int, int], error){
+		"memory": func(dir string) (stock.Stock[int, int], error) {
+			return memory.OpenStock[int, int](stock.IntEncoder{}, dir)
+		},
+		"file": func(dir string) (stock.Stock[int, int], error) {
+			return file.OpenStock[int, int](stock.IntEncoder{}, dir)
+		},
+	}
+	for name, open := range factories {
+		t.Run(name, func(t *testing.T) {
+			nested, err := open(t.TempDir())
+			if err != nil {
+				t.Fatalf("failed to open stock: %v", err)
+			}
+			s := Limit(nested, 3)
+			defer s.Close()
+
+			for want := 0; want < 3; want++ {
+				got, err := s.New()
+				if err != nil || got != want {
+					t.Fatalf("unexpected index, wanted %d, got %d, err %v", want, got, err)
+				}
+			}
+			if _, err := s.New(); !errors.Is(err, stock.ErrIdSpaceExhausted) {
+				t.Fatalf("allocating index beyond capacity should fail, got %v", err)
+			}
+
+			// Released indexes within the capacity can be reused.
+			if err := s.Delete(1); err != nil {
+				t.Fatalf("failed to delete index: %v", err)
+			}
+			if got, err := s.New(); err != nil || got != 1 {
+				t.Fatalf("unexpected index, wanted 1, got %d, err %v", got, err)
+			}
+			if _, err := s.New(); !errors.Is(err, stock.ErrIdSpaceExhausted) {
+				t.Fatalf("allocating index beyond capacity should fail, got %v", err)
+			}
+		})
+	}
+}
@@ -25,10 +25,20 @@ import (
 type inMemoryStock[I stock.Index, V any] struct {
 	values    []V
 	freeList  []I
-	directory string
+	directory string // empty for volatile stocks
 	encoder   stock.ValueEncoder[V]
 }
 
+// CreateVolatileStock creates an empty in-memory stock not backed by any
+// directory. Flush and Close are no-ops and the content of the stock is lost
+// once it is no longer referenced.
+func CreateVolatileStock[I stock.Index, V any]() stock.Stock[I, V] {
+	return &inMemoryStock[I, V]{
+		values:   make([]V, 0, 10),
+		freeList: make([]I, 0, 10),
+	}
+}
+
 func OpenStock[I stock.Index, V any](encoder stock.ValueEncoder[V], directory string) (stock.Stock[I, V], error) {
 	res := &inMemoryStock[I, V]{
 		values:    make([]V, 0, 10),
@@ -188,6 +198,10 @@ func (s *inMemoryStock[I, V]) GetMemoryFootprint() *common.MemoryFootprint {
 }
 
 func (s *inMemoryStock[I, V]) Flush() error {
+	if len(s.directory) == 0 {
+		return nil
+	}
+
 	// Write metadata.
 	var index I
 	indexSize := int(unsafe.Sizeof(index))
@@ -50,3 +50,43 @@ func FuzzMemoryStock_RandomOps(f *testing.F) {
 
 	stock.FuzzStockRandomOps(f, open, false)
 }
+
+func TestVolatileStock_ValuesCanBeStoredAndRetrieved(t *testing.T) {
+	s := CreateVolatileStock[int, int]()
+	index, err := s.New()
+	if err != nil {
+		t.Fatalf("failed to create new element: %v", err)
+	}
+	if err := s.Set(index, 12); err != nil {
+		t.Fatalf("failed to set value: %v", err)
+	}
+	if value, err := s.Get(index); err != nil || value != 12 {
+		t.Errorf("unexpected value, wanted 12, got %d, err %v", value, err)
+	}
+	if err := s.Delete(index); err != nil {
+		t.Fatalf("failed to delete value: %v", err)
+	}
+	if reused, err := s.New(); err != nil || reused != index {
+		t.Errorf("deleted index should be reused, wanted %d, got %d, err %v", index, reused, err)
+	}
+}
+
+func TestVolatileStock_FlushAndCloseAreNoOps(t *testing.T) {
+	s := CreateVolatileStock[int, int]()
+	index, err := s.New()
+	if err != nil {
+		t.Fatalf("failed to create new element: %v", err)
+	}
+	if err := s.Set(index, 12); err != nil {
+		t.Fatalf("failed to set value: %v", err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Errorf("failed to flush stock: %v", err)
+	}
+	if value, err := s.Get(index); err != nil || value != 12 {
+		t.Errorf("unexpected value after flush, wanted 12, got %d, err %v", value, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("failed to close stock: %v", err)
+	}
+}
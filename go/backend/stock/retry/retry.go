@@ -0,0 +1,124 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package retry
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// Policy defines how read operations on a stock are retried in case of
+// transient IO errors.
+type Policy struct {
+	// The maximum number of attempts for a single read operation. Values
+	// less than 2 disable retries.
+	Attempts int
+	// The delay before the first retry. The delay is doubled for each
+	// subsequent retry.
+	Backoff time.Duration
+	// The upper limit for delays between retries, no limit if zero.
+	MaxBackoff time.Duration
+	// A classifier identifying transient errors. If nil, IsTransientError is
+	// used. Only errors classified as transient are retried.
+	IsTransient func(error) bool
+}
+
+// IsEnabled returns true if the policy retries failed operations.
+func (p Policy) IsEnabled() bool {
+	return p.Attempts > 1
+}
+
+// IsTransientError is the default classifier for transient errors. It accepts
+// errors signaling temporary unavailability or timeouts reported by the
+// operating system, as they are encountered on networked file systems. Any
+// other error, in particular the failure to decode corrupted data, is
+// considered permanent.
+func IsTransientError(err error) bool {
+	if errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EBUSY) ||
+		errors.Is(err, syscall.ETIMEDOUT) ||
+		errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
+
+type retryStock[I stock.Index, V any] struct {
+	nested stock.Stock[I, V]
+	policy Policy
+}
+
+// Wrap wraps the given stock into a wrapper retrying failed read operations
+// according to the given policy. If the policy does not enable retries, the
+// given stock is returned unmodified.
+func Wrap[I stock.Index, V any](stock stock.Stock[I, V], policy Policy) stock.Stock[I, V] {
+	if !policy.IsEnabled() {
+		return stock
+	}
+	if policy.IsTransient == nil {
+		policy.IsTransient = IsTransientError
+	}
+	return &retryStock[I, V]{nested: stock, policy: policy}
+}
+
+func (s *retryStock[I, V]) New() (I, error) {
+	return s.nested.New()
+}
+
+func (s *retryStock[I, V]) Get(index I) (V, error) {
+	delay := s.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		res, err := s.nested.Get(index)
+		if err == nil || attempt >= s.policy.Attempts || !s.policy.IsTransient(err) {
+			return res, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+		if s.policy.MaxBackoff > 0 && delay > s.policy.MaxBackoff {
+			delay = s.policy.MaxBackoff
+		}
+	}
+}
+
+func (s *retryStock[I, V]) Set(index I, value V) error {
+	return s.nested.Set(index, value)
+}
+
+func (s *retryStock[I, V]) Delete(index I) error {
+	return s.nested.Delete(index)
+}
+
+func (s *retryStock[I, V]) DeleteAll(indexes []I) error {
+	return stock.DeleteAll(s.nested, indexes)
+}
+
+func (s *retryStock[I, V]) GetIds() (stock.IndexSet[I], error) {
+	return s.nested.GetIds()
+}
+
+func (s *retryStock[I, V]) GetMemoryFootprint() *common.MemoryFootprint {
+	return s.nested.GetMemoryFootprint()
+}
+
+func (s *retryStock[I, V]) Flush() error {
+	return s.nested.Flush()
+}
+
+func (s *retryStock[I, V]) Close() error {
+	return s.nested.Close()
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+	"github.com/Fantom-foundation/Carmen/go/backend/stock/file"
+	"github.com/Fantom-foundation/Carmen/go/backend/stock/memory"
+)
+
+var testPolicy = Policy{Attempts: 3, Backoff: time.Millisecond}
+
+func TestRetryStock(t *testing.T) {
+	stock.RunStockTests(t, stock.NamedStockFactory{
+		ImplementationName: "retryMemory",
+		Open: func(t *testing.T, directory string) (stock.Stock[int, int], error) {
+			nested, err := memory.OpenStock[int, int](stock.IntEncoder{}, directory)
+			if err != nil {
+				return nil, err
+			}
+			return Wrap(nested, testPolicy), nil
+		},
+	})
+	stock.RunStockTests(t, stock.NamedStockFactory{
+		ImplementationName: "retryFile",
+		Open: func(t *testing.T, directory string) (stock.Stock[int, int], error) {
+			nested, err := file.OpenStock[int, int](stock.IntEncoder{}, directory)
+			if err != nil {
+				return nil, err
+			}
+			return Wrap(nested, testPolicy), nil
+		},
+	})
+}
+
+func TestRetryStock_DisabledPolicyDoesNotWrapStock(t *testing.T) {
+	nested, err := memory.OpenStock[int, int](stock.IntEncoder{}, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open stock: %v", err)
+	}
+	if got := Wrap(nested, Policy{Attempts: 1}); got != nested {
+		t.Errorf("stock should not be wrapped")
+	}
+}
+
+func TestRetryStock_TransientErrorsAreRetried(t *testing.T) {
+	for _, injected := range []error{
+		syscall.EAGAIN,
+		syscall.ETIMEDOUT,
+		&os.PathError{Op: "read", Path: "values.dat", Err: syscall.EINTR},
+		fmt.Errorf("read failed: %w", os.ErrDeadlineExceeded),
+	} {
+		flaky := openFlakyStock(t, injected, 2)
+		id, err := flaky.New()
+		if err != nil {
+			t.Fatalf("failed to create element: %v", err)
+		}
+		if err := flaky.Set(id, 12); err != nil {
+			t.Fatalf("failed to set element: %v", err)
+		}
+
+		stock := Wrap[int, int](flaky, testPolicy)
+		if got, err := stock.Get(id); err != nil || got != 12 {
+			t.Errorf("failed to recover from %v, got %d, err %v", injected, got, err)
+		}
+		if got, want := flaky.reads, 3; got != want {
+			t.Errorf("unexpected number of reads, wanted %d, got %d", want, got)
+		}
+	}
+}
+
+func TestRetryStock_FinalErrorIsReturnedIfRetriesAreExhausted(t *testing.T) {
+	flaky := openFlakyStock(t, syscall.EAGAIN, 5)
+	stock := Wrap[int, int](flaky, testPolicy)
+	if _, err := stock.Get(0); !errors.Is(err, syscall.EAGAIN) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got, want := flaky.reads, testPolicy.Attempts; got != want {
+		t.Errorf("unexpected number of reads, wanted %d, got %d", want, got)
+	}
+}
+
+func TestRetryStock_CorruptionErrorsAreNotRetried(t *testing.T) {
+	injected := fmt.Errorf("invalid encoding: checksum mismatch")
+	flaky := openFlakyStock(t, injected, 1)
+	stock := Wrap[int, int](flaky, testPolicy)
+	if _, err := stock.Get(0); !errors.Is(err, injected) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got, want := flaky.reads, 1; got != want {
+		t.Errorf("unexpected number of reads, wanted %d, got %d", want, got)
+	}
+}
+
+func TestRetryStock_CustomClassifierIsUsed(t *testing.T) {
+	injected := fmt.Errorf("custom")
+	flaky := openFlakyStock(t, injected, 1)
+	policy := testPolicy
+	policy.IsTransient = func(err error) bool { return errors.Is(err, injected) }
+	stock := Wrap[int, int](flaky, policy)
+	if _, err := stock.Get(0); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got, want := flaky.reads, 2; got != want {
+		t.Errorf("unexpected number of reads, wanted %d, got %d", want, got)
+	}
+}
+
+func TestRetryStock_BackoffIsLimited(t *testing.T) {
+	flaky := openFlakyStock(t, syscall.EAGAIN, 5)
+	stock := Wrap[int, int](flaky, Policy{
+		Attempts:   5,
+		Backoff:    time.Millisecond,
+		MaxBackoff: 2 * time.Millisecond,
+	})
+	start := time.Now()
+	if _, err := stock.Get(0); err == nil {
+		t.Errorf("expected error")
+	}
+	// With the limit, the delays sum up to 1+2+2+2 ms instead of 1+2+4+8 ms.
+	if got, want := time.Since(start), 7*time.Millisecond; got < want || got > time.Second {
+		t.Errorf("unexpected total delay, wanted about %v, got %v", want, got)
+	}
+}
+
+// flakyStock is a stock failing a given number of read operations with an
+// injected error before succeeding.
+type flakyStock struct {
+	stock.Stock[int, int]
+	err      error
+	failures int
+	reads    int
+}
+
+func openFlakyStock(t *testing.T, err error, failures int) *flakyStock {
+	t.Helper()
+	nested, e := memory.OpenStock[int, int](stock.IntEncoder{}, t.TempDir())
+	if e != nil {
+		t.Fatalf("failed to open stock: %v", e)
+	}
+	return &flakyStock{Stock: nested, err: err, failures: failures}
+}
+
+func (s *flakyStock) Get(index int) (int, error) {
+	s.reads++
+	if s.reads <= s.failures {
+		return 0, s.err
+	}
+	return s.Stock.Get(index)
+}
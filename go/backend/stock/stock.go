@@ -12,6 +12,7 @@ package stock
 
 import (
 	"encoding/binary"
+	"errors"
 	"github.com/Fantom-foundation/Carmen/go/common"
 	"golang.org/x/exp/constraints"
 	"unsafe"
@@ -28,6 +29,12 @@ import (
 // the allocation function and the `Delete` method the free function. The `Get`
 // function corresponds to pointer dereferencing.
 //
+// Stock implementations are not required to be thread safe. Clients accessing
+// a stock concurrently may use the wrapper provided by the synced package.
+// Errors returned by any operation indicate a failure of the underlying
+// storage or a value that can not be encoded or decoded; the stock's content
+// may be inconsistent afterwards.
+//
 // I ... the type used to address values in the stock (=index space)
 // V ... the type of values stored in the stock
 type Stock[I Index, V any] interface {
@@ -68,6 +75,10 @@ type Stock[I Index, V any] interface {
 	common.FlushAndCloser
 }
 
+// ErrIdSpaceExhausted is returned by stocks restricting the range of indexes
+// if no further index can be allocated without exceeding this range.
+var ErrIdSpaceExhausted = errors.New("id space exhausted")
+
 // Index defines the type constraints on Stock index types.
 type Index interface {
 	constraints.Integer
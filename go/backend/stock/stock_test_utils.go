@@ -60,6 +60,7 @@ func RunStockTests(t *testing.T, factory NamedStockFactory) {
 	t.Run("CanBeClosedAndReopened", wrap(testCanBeClosedAndReopened))
 	t.Run("GetIdsProducesAllIdsInTheStock", wrap(testGetIdsProducesAllIdsInTheStock))
 	t.Run("GetDeleteIndexOutOfRange", wrap(testDeleteIndexOutOfRange))
+	t.Run("DeleteAllRemovesAllIndexes", wrap(testDeleteAllRemovesAllIndexes))
 }
 
 func testNewCreatesFreshIndexValues(t *testing.T, factory NamedStockFactory) {
@@ -396,3 +397,35 @@ func testDeleteIndexOutOfRange(t *testing.T, factory NamedStockFactory) {
 		t.Errorf("deleting index above range should be no-op")
 	}
 }
+
+func testDeleteAllRemovesAllIndexes(t *testing.T, factory NamedStockFactory) {
+	stock, err := factory.Open(t, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create empty stock: %v", err)
+	}
+	defer stock.Close()
+
+	const N = 100
+	indexes := []int{}
+	for i := 0; i < N; i++ {
+		index, err := stock.New()
+		if err != nil {
+			t.Fatalf("failed to create new element: %v", err)
+		}
+		indexes = append(indexes, index)
+	}
+
+	if err := DeleteAll(stock, indexes[:N/2]); err != nil {
+		t.Fatalf("failed to delete elements: %v", err)
+	}
+
+	set, err := stock.GetIds()
+	if err != nil {
+		t.Fatalf("failed to produce an index set: %v", err)
+	}
+	for i, index := range indexes {
+		if got, want := set.Contains(index), i >= N/2; got != want {
+			t.Errorf("unexpected membership of %d, wanted %t, got %t", index, want, got)
+		}
+	}
+}
@@ -55,6 +55,12 @@ func (s *syncedStock[I, V]) Delete(index I) error {
 	return s.nested.Delete(index)
 }
 
+func (s *syncedStock[I, V]) DeleteAll(indexes []I) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return stock.DeleteAll(s.nested, indexes)
+}
+
 func (s *syncedStock[I, V]) GetIds() (stock.IndexSet[I], error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
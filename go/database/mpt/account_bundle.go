@@ -0,0 +1,152 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// StorageProof is the proof of the value of a single storage slot, matching
+// the entries of the storage proof list reported by eth_getProof.
+type StorageProof struct {
+	Key   common.Key
+	Value common.Value
+	// Proof lists the RLP encoded nodes on the path from the storage root
+	// towards the slot, starting with the root. Nodes embedded in their
+	// parents are not listed. The list is empty if the storage is empty.
+	Proof [][]byte
+}
+
+// GetAccountBundle obtains the information and the storage root hash of the
+// given account together with proofs of the given storage slots, as needed
+// for answering eth_getProof requests. The trie is descended only once to the
+// account, and the storage proofs are produced from the account's storage
+// trie while the account node is held. Proofs are encoded as hashed under
+// EthereumLikeHashing. If the account does not exist, empty information, the
+// hash of the empty storage, and empty proofs of zero values are returned.
+// Hashes of the trie are required to be up-to-date.
+func GetAccountBundle(source NodeSource, root *NodeReference, address common.Address, keys []common.Key) (AccountInfo, common.Hash, []StorageProof, error) {
+	config := source.getConfig()
+	if config.Hashing.Name != EthereumLikeHashing.Name {
+		return AccountInfo{}, common.Hash{}, nil, fmt.Errorf("storage proofs require %s, got %s", EthereumLikeHashing.Name, config.Hashing.Name)
+	}
+
+	emptyStorageHash := EmptyNodeEthereumHash
+	if hash := config.HashFunction; hash != nil {
+		emptyStorageHash = getEmptyNodeHash(hash)
+	}
+
+	info := AccountInfo{}
+	storageHash := emptyStorageHash
+	proofs := make([]StorageProof, len(keys))
+	for i, key := range keys {
+		proofs[i].Key = key
+	}
+
+	var innerErr error
+	_, err := VisitPathToAccount(source, root, address, MakeVisitor(func(node Node, _ NodeInfo) VisitResponse {
+		account, ok := node.(*AccountNode)
+		if !ok {
+			return VisitResponseContinue
+		}
+		if account.address != address {
+			return VisitResponseAbort
+		}
+		info = account.info
+		if account.storage.Id().IsEmpty() {
+			return VisitResponseAbort
+		}
+		storageHash, innerErr = getStorageHash(source, account)
+		if innerErr != nil {
+			return VisitResponseAbort
+		}
+		for i := range proofs {
+			if innerErr = collectStorageProof(source, &account.storage, &proofs[i]); innerErr != nil {
+				return VisitResponseAbort
+			}
+		}
+		return VisitResponseAbort
+	}))
+	if err == nil {
+		err = innerErr
+	}
+	if err != nil {
+		return AccountInfo{}, common.Hash{}, nil, fmt.Errorf("failed to collect account bundle of %v: %w", address, err)
+	}
+	return info, storageHash, proofs, nil
+}
+
+// getStorageHash obtains the hash of the storage trie of the given account,
+// resolved from the storage trie if it is not retained by the account node.
+func getStorageHash(source NodeSource, account *AccountNode) (common.Hash, error) {
+	if !account.storageHashDirty {
+		return account.storageHash, nil
+	}
+	handle, err := source.getViewAccess(&account.storage)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	defer handle.Release()
+	hash, dirty := handle.Get().GetHash()
+	if dirty {
+		return common.Hash{}, fmt.Errorf("hash of storage of account %v is not up-to-date", account.address)
+	}
+	return hash, nil
+}
+
+// collectStorageProof fills in the value and the proof of the slot described
+// by the given storage proof, starting at the given storage root.
+func collectStorageProof(source NodeSource, storageRoot *NodeReference, proof *StorageProof) error {
+	var encodingErr error
+	_, err := VisitPathToStorage(source, storageRoot, proof.Key, MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+		if value, ok := node.(*ValueNode); ok && value.key == proof.Key {
+			proof.Value = value.value
+		}
+		if info.Embedded.True() {
+			return VisitResponseContinue
+		}
+		rlp, err := encodeToRlp(node, source, nil)
+		if err != nil {
+			encodingErr = err
+			return VisitResponseAbort
+		}
+		proof.Proof = append(proof.Proof, rlp)
+		return VisitResponseContinue
+	}))
+	if err != nil {
+		return err
+	}
+	return encodingErr
+}
+
+// GetAccountBundle obtains the information, the storage root hash, and
+// proofs of the given storage slots of an account. See the GetAccountBundle
+// function for details.
+func (s *LiveTrie) GetAccountBundle(addr common.Address, keys []common.Key) (AccountInfo, common.Hash, []StorageProof, error) {
+	source, ok := s.forest.(NodeSource)
+	if !ok {
+		return AccountInfo{}, common.Hash{}, nil, fmt.Errorf("node access is not supported by %T", s.forest)
+	}
+	return GetAccountBundle(source, &s.root, addr, keys)
+}
+
+// GetAccountBundle obtains the information, the storage root hash, and
+// proofs of the given storage slots of an account in the current state.
+// Hashes are updated before the proofs are produced. See the
+// GetAccountBundle function for details.
+func (s *MptState) GetAccountBundle(addr common.Address, keys []common.Key) (AccountInfo, common.Hash, []StorageProof, error) {
+	if _, err := s.GetHash(); err != nil {
+		return AccountInfo{}, common.Hash{}, nil, err
+	}
+	return s.trie.GetAccountBundle(addr, keys)
+}
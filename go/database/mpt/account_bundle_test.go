@@ -0,0 +1,177 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// The storage hash and the storage proof of slot 0x01 reported by Geth's
+// eth_getProof for the state created by accountLeafRlpTestUpdate. The storage
+// trie consists of a single leaf, which is also the proof of absent slots, so
+// the hash of the leaf is the storage hash of the account.
+const (
+	accountBundleTestStorageHash = "c33452a49b253420076b3e5a56a97717351e52c267dc01a1d1a17c48dad0bdbb"
+	accountBundleTestSlotProof   = "f844a12048078cfed56339ea54962e72c37c7f588fc4f8e5bc173827ba75cb10a63a96a5a1a00200000000000000000000000000000000000000000000000000000000000000"
+)
+
+func TestGetAccountBundle_MatchesGethProof(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	update := accountLeafRlpTestUpdate()
+	if err := update.ApplyTo(state); err != nil {
+		t.Fatalf("failed to apply update: %v", err)
+	}
+
+	info, storageHash, proofs, err := state.GetAccountBundle(common.Address{1}, []common.Key{{1}, {2}})
+	if err != nil {
+		t.Fatalf("failed to get account bundle: %v", err)
+	}
+	if info.Nonce != common.ToNonce(10) || info.Balance != update.Balances[0].Balance {
+		t.Errorf("unexpected account information: %v", info)
+	}
+	if got := fmt.Sprintf("%x", storageHash); got != accountBundleTestStorageHash {
+		t.Errorf("unexpected storage hash, wanted %s, got %s", accountBundleTestStorageHash, got)
+	}
+	if len(proofs) != 2 {
+		t.Fatalf("unexpected number of proofs, wanted 2, got %d", len(proofs))
+	}
+	wantValues := []common.Value{{2}, {}}
+	for i, proof := range proofs {
+		if proof.Value != wantValues[i] {
+			t.Errorf("unexpected value of slot %v, wanted %v, got %v", proof.Key, wantValues[i], proof.Value)
+		}
+		if len(proof.Proof) != 1 {
+			t.Fatalf("unexpected length of proof of slot %v, wanted 1, got %d", proof.Key, len(proof.Proof))
+		}
+		if got := fmt.Sprintf("%x", proof.Proof[0]); got != accountBundleTestSlotProof {
+			t.Errorf("unexpected proof of slot %v\nwanted %s\n   got %s", proof.Key, accountBundleTestSlotProof, got)
+		}
+		if got := common.Keccak256(proof.Proof[0]); got != storageHash {
+			t.Errorf("hash of proof of slot %v does not match storage hash, got %x", proof.Key, got)
+		}
+	}
+}
+
+func TestGetAccountBundle_ProofsAreConsistentWithWitnessProofs(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	addr := common.Address{1}
+	if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+	var keys []common.Key
+	for i := 0; i < 200; i++ {
+		key := common.Key{byte(i), byte(i * 7)}
+		if err := trie.SetValue(addr, key, common.Value{byte(i + 1)}); err != nil {
+			t.Fatalf("failed to set value: %v", err)
+		}
+		keys = append(keys, key, common.Key{byte(i), 1, 2, 3})
+	}
+	rootHash, _, err := trie.UpdateHashes()
+	if err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+
+	info, storageHash, proofs, err := trie.GetAccountBundle(addr, keys)
+	if err != nil {
+		t.Fatalf("failed to get account bundle: %v", err)
+	}
+	if info.Nonce != common.ToNonce(1) {
+		t.Errorf("unexpected account information: %v", info)
+	}
+
+	witness, err := CreateWitnessProof(trie.forest.(*Forest), &trie.root, addr, keys...)
+	if err != nil {
+		t.Fatalf("failed to create witness proof: %v", err)
+	}
+	for _, proof := range proofs {
+		want, err := trie.GetValue(addr, proof.Key)
+		if err != nil {
+			t.Fatalf("failed to get value: %v", err)
+		}
+		if proof.Value != want {
+			t.Errorf("unexpected value of slot %v, wanted %v, got %v", proof.Key, want, proof.Value)
+		}
+		if value, complete, err := witness.GetState(rootHash, addr, proof.Key); err != nil || !complete || value != want {
+			t.Errorf("unexpected value in witness proof, wanted %v, got %v, %t, %v", want, value, complete, err)
+		}
+
+		// Each node of a proof is referenced by its predecessor by its hash.
+		next := storageHash
+		for i, node := range proof.Proof {
+			hash := common.Keccak256(node)
+			if hash != next {
+				t.Fatalf("unexpected hash of node %d of proof of slot %v, wanted %x, got %x", i, proof.Key, next, hash)
+			}
+			if _, found := witness.proofDb[hash]; !found {
+				t.Errorf("node %d of proof of slot %v is not in witness proof", i, proof.Key)
+			}
+			if i+1 < len(proof.Proof) {
+				next = common.Keccak256(proof.Proof[i+1])
+				if !bytes.Contains(node, next[:]) {
+					t.Errorf("node %d of proof of slot %v does not reference its successor", i, proof.Key)
+				}
+			}
+		}
+	}
+}
+
+func TestGetAccountBundle_MissingAccountHasEmptyStorage(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	if err := trie.SetAccountInfo(common.Address{1}, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+	if _, _, err := trie.UpdateHashes(); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+
+	for _, addr := range []common.Address{{1}, {2}} {
+		info, storageHash, proofs, err := trie.GetAccountBundle(addr, []common.Key{{1}})
+		if err != nil {
+			t.Fatalf("failed to get account bundle: %v", err)
+		}
+		if addr == (common.Address{2}) && info != (AccountInfo{}) {
+			t.Errorf("unexpected information of missing account: %v", info)
+		}
+		if storageHash != EmptyNodeEthereumHash {
+			t.Errorf("unexpected storage hash, wanted %x, got %x", EmptyNodeEthereumHash, storageHash)
+		}
+		if len(proofs) != 1 || proofs[0].Key != (common.Key{1}) || proofs[0].Value != (common.Value{}) || len(proofs[0].Proof) != 0 {
+			t.Errorf("unexpected proofs: %v", proofs)
+		}
+	}
+}
+
+func TestGetAccountBundle_RequiresEthereumLikeHashing(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S4LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	if _, _, _, err := trie.GetAccountBundle(common.Address{1}, nil); err == nil {
+		t.Errorf("producing proofs should fail for direct hashing")
+	}
+}
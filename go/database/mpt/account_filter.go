@@ -0,0 +1,206 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync/atomic"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+const (
+	// accountFilterFile is the file the account filter of a LiveTrie is
+	// persisted in when the trie is flushed.
+	accountFilterFile = "accounts.filter"
+
+	accountFilterNumHashes      = 7       // the number of bits set per account
+	accountFilterBitsPerAccount = 20      // the size of rebuilt filters per account, leaving room for growth
+	accountFilterMinBits        = 1 << 16 // the minimum size of filters in bits
+
+	// The estimated false-positive rate beyond which filters are rebuilt.
+	accountFilterMaxFalsePositiveRate = 0.02
+)
+
+// accountFilter is a bloom filter over the addresses of the accounts of a
+// LiveTrie, allowing lookups of missing accounts to be answered without
+// descending into the trie. Accounts are added when being created, but are
+// not removed when being deleted. Thus, the filter may report deleted
+// accounts to be present, but never misses an existing account. Since
+// deletions and growth increase the rate of false positives, filters are
+// rebuilt once their estimated false-positive rate exceeds a threshold.
+//
+// Filters are thread safe, yet may only be replaced while no accounts are
+// created concurrently.
+type accountFilter struct {
+	words   []atomic.Uint64 // the bits of the filter, the number of bits is a power of 2
+	setBits atomic.Int64    // the number of bits set in the filter
+	deleted atomic.Int64    // the number of deletions since the filter got built
+}
+
+// newAccountFilter creates an empty filter sized for the given number of
+// accounts.
+func newAccountFilter(numAccounts uint64) *accountFilter {
+	bits := uint64(accountFilterMinBits)
+	for bits < numAccounts*accountFilterBitsPerAccount {
+		bits <<= 1
+	}
+	return &accountFilter{words: make([]atomic.Uint64, bits/64)}
+}
+
+// buildAccountFilter creates a filter covering all accounts of the trie
+// rooted by the given node, sized for the given number of accounts.
+func buildAccountFilter(source NodeSource, root *NodeReference, numAccounts uint64) (*accountFilter, error) {
+	res := newAccountFilter(numAccounts)
+	iter := newAccountIterator(source, root, 0)
+	defer iter.Close()
+	for iter.Next() {
+		res.add(iter.Current().Address)
+	}
+	return res, iter.Err()
+}
+
+// add records the existence of the given account.
+func (f *accountFilter) add(address common.Address) {
+	h1, h2 := hashForAccountFilter(address)
+	mask := uint64(len(f.words)*64 - 1)
+	for i := uint64(0); i < accountFilterNumHashes; i++ {
+		pos := (h1 + i*h2) & mask
+		word := &f.words[pos/64]
+		bit := uint64(1) << (pos % 64)
+		for {
+			old := word.Load()
+			if old&bit != 0 {
+				break
+			}
+			if word.CompareAndSwap(old, old|bit) {
+				f.setBits.Add(1)
+				break
+			}
+		}
+	}
+}
+
+// markDeleted records the deletion of an account, which is not removed from
+// the filter but accounted for when estimating its false-positive rate.
+func (f *accountFilter) markDeleted() {
+	f.deleted.Add(1)
+}
+
+// mayContain returns false if the given account definitely does not exist.
+func (f *accountFilter) mayContain(address common.Address) bool {
+	h1, h2 := hashForAccountFilter(address)
+	mask := uint64(len(f.words)*64 - 1)
+	for i := uint64(0); i < accountFilterNumHashes; i++ {
+		pos := (h1 + i*h2) & mask
+		if f.words[pos/64].Load()&(uint64(1)<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// getFalsePositiveRate estimates the probability of a missing account being
+// reported as present, based on the share of set bits and the share of the
+// accounts in the filter being deleted.
+func (f *accountFilter) getFalsePositiveRate() float64 {
+	numBits := float64(len(f.words) * 64)
+	setBits := float64(f.setBits.Load())
+	res := math.Pow(setBits/numBits, accountFilterNumHashes)
+	if entries := setBits / accountFilterNumHashes; entries > 0 {
+		res += math.Min(1, float64(f.deleted.Load())/entries)
+	}
+	return math.Min(1, res)
+}
+
+// needsRebuild returns true if the estimated false-positive rate exceeds the
+// threshold at which the filter should be rebuilt.
+func (f *accountFilter) needsRebuild() bool {
+	return f.getFalsePositiveRate() > accountFilterMaxFalsePositiveRate
+}
+
+func (f *accountFilter) GetMemoryFootprint() *common.MemoryFootprint {
+	return common.NewMemoryFootprint(uintptr(len(f.words)) * 8)
+}
+
+// hashForAccountFilter derives the two hashes used for locating the bits of
+// an account in the filter by double hashing. The second hash is odd, such
+// that all bits of power-of-two sized filters can be reached.
+func hashForAccountFilter(address common.Address) (uint64, uint64) {
+	a := binary.LittleEndian.Uint64(address[0:8])
+	b := binary.LittleEndian.Uint64(address[8:16])
+	c := uint64(binary.LittleEndian.Uint32(address[16:20]))
+	h1 := mix64(a ^ mix64(b^mix64(c)))
+	h2 := mix64(h1^0x9e3779b97f4a7c15) | 1
+	return h1, h2
+}
+
+// mix64 is the finalizer of the SplitMix64 generator, scrambling all bits of
+// the input.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// The persisted filter is prefixed by the hash of the trie it was taken of
+// and the number of set bits, followed by the words of the filter.
+const accountFilterHeaderSize = len(common.Hash{}) + 8
+
+// writeAccountFilter persists the given filter of the trie with the given
+// root hash in the given file. The file is replaced atomically, such that an
+// interrupted write does not leave a truncated filter behind.
+func writeAccountFilter(filename string, root common.Hash, filter *accountFilter) error {
+	data := make([]byte, accountFilterHeaderSize+len(filter.words)*8)
+	copy(data, root[:])
+	binary.BigEndian.PutUint64(data[len(root):], uint64(filter.setBits.Load()))
+	for i := range filter.words {
+		binary.BigEndian.PutUint64(data[accountFilterHeaderSize+i*8:], filter.words[i].Load())
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// readAccountFilter restores the filter persisted in the given file if it was
+// taken of the trie with the given root hash. If the file is missing or was
+// taken of a different trie, nil is returned.
+func readAccountFilter(filename string, root common.Hash) (*accountFilter, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < accountFilterHeaderSize || common.Hash(data[:len(root)]) != root {
+		return nil, nil
+	}
+	numWords := (len(data) - accountFilterHeaderSize) / 8
+	if numWords*8 != len(data)-accountFilterHeaderSize || numWords == 0 || numWords&(numWords-1) != 0 {
+		return nil, fmt.Errorf("invalid size of account filter in %s: %d bytes", filename, len(data))
+	}
+	res := &accountFilter{words: make([]atomic.Uint64, numWords)}
+	res.setBits.Store(int64(binary.BigEndian.Uint64(data[len(root):])))
+	for i := range res.words {
+		res.words[i].Store(binary.BigEndian.Uint64(data[accountFilterHeaderSize+i*8:]))
+	}
+	return res, nil
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestAccountFilter_AddedAccountsAreNeverMissed(t *testing.T) {
+	filter := newAccountFilter(10_000)
+	r := rand.New(rand.NewSource(42))
+	added := make([]common.Address, 10_000)
+	for i := range added {
+		r.Read(added[i][:])
+		filter.add(added[i])
+	}
+	for _, addr := range added {
+		if !filter.mayContain(addr) {
+			t.Fatalf("added account %x is missed", addr)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10_000; i++ {
+		addr := common.Address{}
+		r.Read(addr[:])
+		if filter.mayContain(addr) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 100 {
+		t.Errorf("too many false positives, got %d of 10000", falsePositives)
+	}
+	if rate := filter.getFalsePositiveRate(); rate <= 0 || rate > accountFilterMaxFalsePositiveRate {
+		t.Errorf("unexpected estimated false-positive rate %f", rate)
+	}
+}
+
+func TestAccountFilter_DegradedFiltersNeedToBeRebuilt(t *testing.T) {
+	filter := newAccountFilter(0)
+	for i := 0; i < 1000; i++ {
+		filter.add(common.Address{byte(i), byte(i >> 8)})
+	}
+	if filter.needsRebuild() {
+		t.Fatalf("filter should not need to be rebuilt, estimated rate %f", filter.getFalsePositiveRate())
+	}
+
+	// Deletions increase the rate of false positives.
+	for i := 0; i < 100; i++ {
+		filter.markDeleted()
+	}
+	if !filter.needsRebuild() {
+		t.Errorf("filter with many deletions should be rebuilt, estimated rate %f", filter.getFalsePositiveRate())
+	}
+
+	// Growth beyond the size of the filter increases the rate of false positives.
+	filter = newAccountFilter(0)
+	for i := 0; i < 20_000; i++ {
+		filter.add(common.Address{byte(i), byte(i >> 8)})
+	}
+	if !filter.needsRebuild() {
+		t.Errorf("overfull filter should be rebuilt, estimated rate %f", filter.getFalsePositiveRate())
+	}
+}
+
+func TestAccountFilter_PersistedFiltersAreOnlyRestoredForTheirTrie(t *testing.T) {
+	filename := t.TempDir() + "/" + accountFilterFile
+	if filter, err := readAccountFilter(filename, common.Hash{1}); err != nil || filter != nil {
+		t.Fatalf("missing filter should not be restored, got %v, %v", filter, err)
+	}
+
+	filter := newAccountFilter(100)
+	for i := 0; i < 100; i++ {
+		filter.add(common.Address{byte(i)})
+	}
+	if err := writeAccountFilter(filename, common.Hash{1}, filter); err != nil {
+		t.Fatalf("failed to write filter: %v", err)
+	}
+
+	restored, err := readAccountFilter(filename, common.Hash{1})
+	if err != nil || restored == nil {
+		t.Fatalf("failed to restore filter: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if !restored.mayContain(common.Address{byte(i)}) {
+			t.Errorf("restored filter misses account %d", i)
+		}
+	}
+	if want, got := filter.getFalsePositiveRate(), restored.getFalsePositiveRate(); want != got {
+		t.Errorf("unexpected estimated false-positive rate of restored filter, wanted %f, got %f", want, got)
+	}
+
+	if filter, err := readAccountFilter(filename, common.Hash{2}); err != nil || filter != nil {
+		t.Errorf("filter of a different trie should not be restored, got %v, %v", filter, err)
+	}
+
+	truncated := append(common.Hash{1}.ToBytes(), make([]byte, 8+3)...)
+	if err := os.WriteFile(filename, truncated, 0600); err != nil {
+		t.Fatalf("failed to corrupt filter: %v", err)
+	}
+	if _, err := readAccountFilter(filename, common.Hash{1}); err == nil {
+		t.Errorf("corrupted filter should be reported")
+	}
+}
+
+func TestAccountFilter_CreateDeleteReopenSequencesNeverMissAccounts(t *testing.T) {
+	dir := t.TempDir()
+	r := rand.New(rand.NewSource(42))
+	existing := map[common.Address]AccountInfo{}
+	addresses := make([]common.Address, 300)
+	for i := range addresses {
+		r.Read(addresses[i][:])
+	}
+
+	check := func(t *testing.T, trie *LiveTrie) {
+		t.Helper()
+		for _, addr := range addresses {
+			want, wantFound := existing[addr]
+			info, found, err := trie.GetAccountInfo(addr)
+			if err != nil {
+				t.Fatalf("failed to get account: %v", err)
+			}
+			if found != wantFound || info != want {
+				t.Fatalf("unexpected info of account %x, wanted %v/%t, got %v/%t", addr, want, wantFound, info, found)
+			}
+			if exists, err := trie.HasAccount(addr); err != nil || exists != wantFound {
+				t.Fatalf("unexpected existence of account %x, wanted %t, got %t, %v", addr, wantFound, exists, err)
+			}
+		}
+	}
+
+	for round, filterEnabled := range []bool{true, true, false, true} {
+		trie, err := OpenFileLiveTrieWithConfig(dir, S5LiveConfig, ForestConfig{CacheCapacity: 1024, AccountFilter: filterEnabled})
+		if err != nil {
+			t.Fatalf("failed to open trie: %v", err)
+		}
+		if filterEnabled != (trie.accountFilter != nil) {
+			t.Fatalf("unexpected state of account filter, wanted enabled %t", filterEnabled)
+		}
+		check(t, trie)
+		for i := 0; i < 500; i++ {
+			addr := addresses[r.Intn(len(addresses))]
+			info := AccountInfo{Nonce: common.ToNonce(uint64(round*1000 + i + 1))}
+			switch r.Intn(3) {
+			case 0:
+				info = AccountInfo{}
+				delete(existing, addr)
+			case 1:
+				if _, err := trie.RecreateAccount(addr, info); err != nil {
+					t.Fatalf("failed to recreate account: %v", err)
+				}
+				existing[addr] = info
+				continue
+			default:
+				existing[addr] = info
+			}
+			if err := trie.SetAccountInfo(addr, info); err != nil {
+				t.Fatalf("failed to update account: %v", err)
+			}
+		}
+		check(t, trie)
+		if err := trie.Close(); err != nil {
+			t.Fatalf("failed to close trie: %v", err)
+		}
+	}
+}
+
+func TestAccountFilter_PersistedFilterIsRestoredOnReopen(t *testing.T) {
+	dir := t.TempDir()
+	config := ForestConfig{CacheCapacity: 1024, AccountFilter: true}
+	trie, err := OpenFileLiveTrieWithConfig(dir, S5LiveConfig, config)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := trie.SetAccountInfo(common.Address{byte(i)}, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+	}
+	if err := trie.Close(); err != nil {
+		t.Fatalf("failed to close trie: %v", err)
+	}
+	if _, err := os.Stat(dir + "/" + accountFilterFile); err != nil {
+		t.Fatalf("filter should be persisted: %v", err)
+	}
+
+	// The restored filter retains the accounts even if the trie is not
+	// visited, as is the case for the corrupted filter below.
+	filename := dir + "/" + accountFilterFile
+	metadata, _, err := readMetadata(dir + "/meta.json")
+	if err != nil {
+		t.Fatalf("failed to read metadata: %v", err)
+	}
+	filter := newAccountFilter(0)
+	filter.add(common.Address{0xAA})
+	if err := writeAccountFilter(filename, metadata.RootHash, filter); err != nil {
+		t.Fatalf("failed to write filter: %v", err)
+	}
+	trie, err = OpenFileLiveTrieWithConfig(dir, S5LiveConfig, config)
+	if err != nil {
+		t.Fatalf("failed to reopen trie: %v", err)
+	}
+	if !trie.accountFilter.mayContain(common.Address{0xAA}) {
+		t.Errorf("persisted filter should be restored")
+	}
+	if err := trie.Close(); err != nil {
+		t.Fatalf("failed to close trie: %v", err)
+	}
+}
+
+func TestAccountFilter_LookupsOfMissingAccountsDoNotAccessTheTrie(t *testing.T) {
+	config := ForestConfig{CacheCapacity: 1024, AccountFilter: true, MetricsEnabled: true}
+	trie, err := OpenFileLiveTrieWithConfig(t.TempDir(), S5LiveConfig, config)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	for i := 0; i < 10; i++ {
+		if err := trie.SetAccountInfo(common.Address{byte(i)}, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if _, found, err := trie.GetAccountInfo(common.Address{byte(i), 1}); err != nil || found {
+			t.Fatalf("account should not exist, got %t, %v", found, err)
+		}
+	}
+	stats, err := trie.forest.(*Forest).GetOperationStats()
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	if got := stats.GetAccountInfo.Visits.Count(); got > 5 {
+		t.Errorf("lookups of missing accounts should be answered by the filter, got %d lookups", got)
+	}
+
+	mf := trie.GetMemoryFootprint()
+	if child := mf.GetChild("accountFilter"); child == nil || child.Value() == 0 {
+		t.Errorf("memory footprint should cover the account filter, got %v", mf)
+	}
+}
+
+func TestAccountFilter_DegradedFilterIsRebuiltOnFlush(t *testing.T) {
+	trie, err := OpenFileLiveTrieWithConfig(t.TempDir(), S5LiveConfig, ForestConfig{CacheCapacity: 1024, AccountFilter: true})
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	for i := 0; i < 100; i++ {
+		if err := trie.SetAccountInfo(common.Address{byte(i)}, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		if err := trie.SetAccountInfo(common.Address{byte(i)}, AccountInfo{}); err != nil {
+			t.Fatalf("failed to delete account: %v", err)
+		}
+	}
+	degraded := trie.accountFilter
+	if !degraded.needsRebuild() {
+		t.Fatalf("filter should be degraded by deletions")
+	}
+	if err := trie.Flush(); err != nil {
+		t.Fatalf("failed to flush trie: %v", err)
+	}
+	if trie.accountFilter == degraded || trie.accountFilter.needsRebuild() {
+		t.Errorf("degraded filter should be rebuilt")
+	}
+	for i := 0; i < 100; i++ {
+		if want, got := i >= 50, trie.accountFilter.mayContain(common.Address{byte(i)}); want && !got {
+			t.Errorf("rebuilt filter misses account %d", i)
+		}
+	}
+}
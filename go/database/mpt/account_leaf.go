@@ -0,0 +1,76 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// GetAccountLeafRlp produces the RLP encoding of the leaf node of the given
+// account in the trie rooted by the given node, as hashed under
+// EthereumLikeHashing. The encoding is a list of the compact encoded remainder
+// of the account's key path and the RLP encoded account state, matching the
+// encoding of account leaves in Ethereum's state trie. If the account does not
+// exist, false is returned. Hashes of the trie are required to be up-to-date.
+func GetAccountLeafRlp(source NodeSource, root *NodeReference, address common.Address) ([]byte, bool, error) {
+	config := source.getConfig()
+	if config.Hashing.Name != EthereumLikeHashing.Name {
+		return nil, false, fmt.Errorf("account leaf encoding requires %s, got %s", EthereumLikeHashing.Name, config.Hashing.Name)
+	}
+
+	account, found, err := getAccountNode(source, root, address)
+	if err != nil || !found {
+		return nil, false, err
+	}
+
+	res, err := encodeAccountToRlp(&account, source, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	return res, true, nil
+}
+
+// getAccountNode obtains a copy of the node of the given account in the trie
+// rooted by the given node, with its storage hash resolved from the storage
+// trie if it is not retained by the account node itself. If the account does
+// not exist, false is returned.
+func getAccountNode(source NodeSource, root *NodeReference, address common.Address) (AccountNode, bool, error) {
+	var account AccountNode
+	found, err := VisitPathToAccount(source, root, address, MakeVisitor(func(node Node, _ NodeInfo) VisitResponse {
+		if n, ok := node.(*AccountNode); ok && n.address == address {
+			account = *n
+		}
+		return VisitResponseContinue
+	}))
+	if err != nil || !found {
+		return AccountNode{}, false, err
+	}
+
+	// If hashes are stored with nodes, the storage hash needs to be obtained
+	// from the root of the storage trie.
+	if account.storageHashDirty && !account.storage.Id().IsEmpty() {
+		handle, err := source.getViewAccess(&account.storage)
+		if err != nil {
+			return AccountNode{}, false, err
+		}
+		hash, dirty := handle.Get().GetHash()
+		handle.Release()
+		if dirty {
+			return AccountNode{}, false, fmt.Errorf("hash of storage of account %v is not up-to-date", address)
+		}
+		account.storageHash = hash
+		account.storageHashDirty = false
+	}
+
+	return account, true, nil
+}
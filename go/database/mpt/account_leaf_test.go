@@ -0,0 +1,166 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// accountLeafRlpTestUpdate creates account 0x01 with nonce 10, balance 12, and
+// slot 0x01 set to 0x02, which is the state of TestS5RootHash_SingleAccountWithSingleValue.
+func accountLeafRlpTestUpdate() common.Update {
+	balance, _ := common.ToBalance(big.NewInt(12))
+	return common.Update{
+		CreatedAccounts: []common.Address{{1}},
+		Balances:        []common.BalanceUpdate{{Account: common.Address{1}, Balance: balance}},
+		Nonces:          []common.NonceUpdate{{Account: common.Address{1}, Nonce: common.ToNonce(10)}},
+		Slots:           []common.SlotUpdate{{Account: common.Address{1}, Key: common.Key{1}, Value: common.Value{2}}},
+	}
+}
+
+// The RLP encoding of the account leaf produced by Geth for the state created
+// by accountLeafRlpTestUpdate. Since the trie consists of this leaf only, its
+// hash is the state root a175fd37774a9f29ce92f6ded173ed65340434c22af8d480a688f0dfd3980446.
+const accountLeafRlpTestWant = "f86aa120f22bb46edf31af855938befaa870ed3d86a4ad93a9ecf7c63ceaa80daea9ac4db846f8440a0ca0c33452a49b253420076b3e5a56a97717351e52c267dc01a1d1a17c48dad0bdbba0c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470"
+
+func TestGetAccountLeafRlp_MatchesGethEncodingInLiveTrie(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	update := accountLeafRlpTestUpdate()
+	if err := update.ApplyTo(state); err != nil {
+		t.Fatalf("failed to apply update: %v", err)
+	}
+	if _, err := state.GetHash(); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+
+	got, found, err := state.trie.GetAccountLeafRlp(common.Address{1})
+	if err != nil || !found {
+		t.Fatalf("failed to get account leaf, found: %t, err: %v", found, err)
+	}
+	if want := accountLeafRlpTestWant; fmt.Sprintf("%x", got) != want {
+		t.Errorf("unexpected encoding\nwanted %s\n   got %x", want, got)
+	}
+}
+
+func TestGetAccountLeafRlp_MatchesGethEncodingInReopenedArchive(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := OpenArchiveTrie(dir, S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	if err := archive.Add(0, accountLeafRlpTestUpdate(), nil); err != nil {
+		t.Fatalf("failed to add block: %v", err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+
+	// After re-opening, the storage hash is only retained by the storage root.
+	archive, err = OpenArchiveTrie(dir, S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+
+	got, found, err := archive.GetAccountLeafRlp(0, common.Address{1})
+	if err != nil || !found {
+		t.Fatalf("failed to get account leaf, found: %t, err: %v", found, err)
+	}
+	if want := accountLeafRlpTestWant; fmt.Sprintf("%x", got) != want {
+		t.Errorf("unexpected encoding\nwanted %s\n   got %x", want, got)
+	}
+
+	if _, _, err := archive.GetAccountLeafRlp(1, common.Address{1}); err == nil {
+		t.Errorf("getting account leaf of a missing block should fail")
+	}
+}
+
+func TestGetAccountLeafRlp_HashOfLeafIsHashOfAccountNode(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	for i := 0; i < 20; i++ {
+		addr := common.Address{byte(i)}
+		if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(uint64(i + 1))}); err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+		if err := trie.SetValue(addr, common.Key{byte(i)}, common.Value{1}); err != nil {
+			t.Fatalf("failed to set value: %v", err)
+		}
+	}
+	if _, _, err := trie.UpdateHashes(); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+
+	forest := trie.forest.(*Forest)
+	for i := 0; i < 20; i++ {
+		addr := common.Address{byte(i)}
+		var account NodeReference
+		_, err := VisitPathToAccount(forest, &trie.root, addr, MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+			account = NewNodeReference(info.Id)
+			return VisitResponseContinue
+		}))
+		if err != nil {
+			t.Fatalf("failed to locate account: %v", err)
+		}
+		want, err := forest.getHashFor(&account)
+		if err != nil {
+			t.Fatalf("failed to get hash of account: %v", err)
+		}
+
+		rlp, found, err := trie.GetAccountLeafRlp(addr)
+		if err != nil || !found {
+			t.Fatalf("failed to get account leaf, found: %t, err: %v", found, err)
+		}
+		if got := common.Keccak256(rlp); got != want {
+			t.Errorf("unexpected hash of leaf of account %v, wanted %x, got %x", addr, want, got)
+		}
+	}
+}
+
+func TestGetAccountLeafRlp_MissingAccountIsNotFound(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	if err := trie.SetAccountInfo(common.Address{1}, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+	rlp, found, err := trie.GetAccountLeafRlp(common.Address{2})
+	if err != nil || found || rlp != nil {
+		t.Errorf("missing account should not be found, got %x, %t, %v", rlp, found, err)
+	}
+}
+
+func TestGetAccountLeafRlp_RequiresEthereumLikeHashing(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S4LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	if err := trie.SetAccountInfo(common.Address{1}, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+	if _, _, err := trie.GetAccountLeafRlp(common.Address{1}); err == nil {
+		t.Errorf("encoding account leaves should fail for direct hashing")
+	}
+}
@@ -0,0 +1,602 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/rlp"
+)
+
+// Account ranges are consecutive accounts of a trie in the order of the
+// hashes of their addresses, as served to clients synchronizing the state
+// in the style of Ethereum's snap protocol. A range is accompanied by a proof
+// consisting of the RLP encoded nodes on the path to the start of the range
+// and on the path to the last account of the range. The proof allows clients
+// to verify that the range is complete, i.e. that no account between the
+// start and the last account has been omitted, using VerifyAccountRange.
+
+// AccountRangeEntry is a single account of an account range. Unlike
+// AccountEntry, it identifies the account by the hash of its address, since
+// this is all the trie reveals to clients verifying the range.
+type AccountRangeEntry struct {
+	Hash        common.Hash // the hash of the address of the account
+	Info        AccountInfo
+	StorageRoot common.Hash // the root hash of the storage trie of the account
+}
+
+// encodeBody produces the RLP encoding of the account as stored in the leaf
+// node of the account in Ethereum's state trie.
+func (e *AccountRangeEntry) encodeBody() []byte {
+	return rlp.Encode(rlp.List{Items: []rlp.Item{
+		rlp.Uint64{Value: e.Info.Nonce.ToUint64()},
+		rlp.BigInt{Value: e.Info.Balance.ToBigInt()},
+		rlp.Hash{Hash: &e.StorageRoot},
+		rlp.Hash{Hash: &e.Info.CodeHash},
+	}})
+}
+
+// size is the number of bytes an entry is accounted for in the byte budget
+// of account ranges.
+func (e *AccountRangeEntry) size() int {
+	return len(e.Hash) + len(e.encodeBody())
+}
+
+// GetAccountRangeWithProof collects the accounts of the trie rooted by the
+// given node with an address hash not less than the given start hash in the
+// order of their address hashes. Accounts are collected until the sizes of
+// the collected entries reach the given byte budget. At least one account is
+// reported if there is any, even if its size exceeds the budget. Besides the
+// accounts, the RLP encoded nodes on the path to the start hash and on the
+// path to the last reported account are returned as a proof of the range,
+// which can be verified using VerifyAccountRange. The function requires
+// hashed paths and EthereumLikeHashing; hashes of the trie are required to be
+// up-to-date.
+func GetAccountRangeWithProof(source NodeSource, root *NodeReference, startHash common.Hash, limitBytes int) ([]AccountRangeEntry, [][]byte, error) {
+	config := source.getConfig()
+	if config.Hashing.Name != EthereumLikeHashing.Name {
+		return nil, nil, fmt.Errorf("account range proofs require %s, got %s", EthereumLikeHashing.Name, config.Hashing.Name)
+	}
+	if !config.UseHashedPaths {
+		return nil, nil, fmt.Errorf("account range proofs require hashed paths, not supported by %s", config.Name)
+	}
+
+	start := make([]Nibble, 2*len(startHash))
+	parseNibbles(start, startHash[:])
+	collector := accountRangeCollector{
+		source:    source,
+		startHash: startHash,
+		start:     start,
+		limit:     limitBytes,
+	}
+	if _, err := collector.collect(root, 0, true); err != nil {
+		return nil, nil, err
+	}
+
+	proof := accountRangeProof{source: source, seen: map[common.Hash]bool{}}
+	if err := proof.addPath(root, start); err != nil {
+		return nil, nil, err
+	}
+	if len(collector.accounts) > 0 {
+		last := collector.accounts[len(collector.accounts)-1].Hash
+		path := make([]Nibble, 2*len(last))
+		parseNibbles(path, last[:])
+		if err := proof.addPath(root, path); err != nil {
+			return nil, nil, err
+		}
+	}
+	return collector.accounts, proof.nodes, nil
+}
+
+// accountRangeCollector gathers the accounts of an account range by a
+// depth-first traversal of the trie.
+type accountRangeCollector struct {
+	source    NodeSource
+	startHash common.Hash
+	start     []Nibble // the nibbles of the start hash
+	limit     int
+	size      int
+	accounts  []AccountRangeEntry
+}
+
+// collect adds the accounts of the sub-trie rooted by the given node at the
+// given depth in the order of their paths. If bounded is set, the path leading
+// to the node is a prefix of the start path and accounts before the start are
+// skipped. The result is true if the byte budget got exhausted.
+func (c *accountRangeCollector) collect(ref *NodeReference, depth int, bounded bool) (bool, error) {
+	handle, err := c.source.getViewAccess(ref)
+	if err != nil {
+		return false, err
+	}
+	defer handle.Release()
+	switch n := handle.Get().(type) {
+	case *BranchNode:
+		if err := checkRemainingPath("branch", 1, len(c.start)-depth); err != nil {
+			return false, err
+		}
+		first := 0
+		if bounded {
+			first = int(c.start[depth])
+		}
+		for i := first; i < len(n.children); i++ {
+			if n.children[i].Id().IsEmpty() {
+				continue
+			}
+			done, err := c.collect(&n.children[i], depth+1, bounded && i == first)
+			if err != nil || done {
+				return done, err
+			}
+		}
+	case *ExtensionNode:
+		if err := checkRemainingPath("extension", n.path.Length(), len(c.start)-depth); err != nil {
+			return false, err
+		}
+		for i := 0; bounded && i < n.path.Length(); i++ {
+			want, got := c.start[depth+i], n.path.Get(i)
+			if got < want {
+				return false, nil
+			}
+			if got > want {
+				bounded = false
+			}
+		}
+		return c.collect(&n.next, depth+n.path.Length(), bounded)
+	case *AccountNode:
+		hash := c.source.hashAddress(n.address)
+		if bounded && bytes.Compare(hash[:], c.startHash[:]) < 0 {
+			return false, nil
+		}
+		storageRoot := EmptyNodeEthereumHash
+		if !n.storage.Id().IsEmpty() {
+			storageRoot, err = getStorageHash(c.source, n)
+			if err != nil {
+				return false, err
+			}
+		}
+		entry := AccountRangeEntry{Hash: hash, Info: n.info, StorageRoot: storageRoot}
+		c.accounts = append(c.accounts, entry)
+		c.size += entry.size()
+		return c.size >= c.limit, nil
+	}
+	return false, nil
+}
+
+// accountRangeProof gathers the RLP encoded nodes on paths through a trie,
+// listing nodes shared by multiple paths only once.
+type accountRangeProof struct {
+	source NodeSource
+	nodes  [][]byte
+	seen   map[common.Hash]bool
+}
+
+// addPath adds the non-embedded nodes on the given path to the proof.
+func (p *accountRangeProof) addPath(root *NodeReference, path []Nibble) error {
+	var encodingErr error
+	_, err := visitPathTo(p.source, root, path, nil, nil, MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+		if info.Embedded.True() {
+			return VisitResponseAbort
+		}
+		encoded, err := encodeToRlp(node, p.source, nil)
+		if err != nil {
+			encodingErr = err
+			return VisitResponseAbort
+		}
+		if hash := common.Keccak256(encoded); !p.seen[hash] {
+			p.seen[hash] = true
+			p.nodes = append(p.nodes, encoded)
+		}
+		return VisitResponseContinue
+	}))
+	if err != nil {
+		return err
+	}
+	return encodingErr
+}
+
+// GetAccountRangeWithProof collects accounts in the order of their address
+// hashes, starting at the given hash, together with a proof of the range.
+// See the GetAccountRangeWithProof function for details.
+func (s *LiveTrie) GetAccountRangeWithProof(startHash common.Hash, limitBytes int) ([]AccountRangeEntry, [][]byte, error) {
+	source, ok := s.forest.(NodeSource)
+	if !ok {
+		return nil, nil, fmt.Errorf("node access is not supported by %T", s.forest)
+	}
+	return GetAccountRangeWithProof(source, &s.root, startHash, limitBytes)
+}
+
+// GetAccountRangeWithProof collects accounts of the current state in the
+// order of their address hashes, starting at the given hash, together with a
+// proof of the range. Hashes are updated before the range is collected. See
+// the GetAccountRangeWithProof function for details.
+func (s *MptState) GetAccountRangeWithProof(startHash common.Hash, limitBytes int) ([]AccountRangeEntry, [][]byte, error) {
+	if _, err := s.GetHash(); err != nil {
+		return nil, nil, err
+	}
+	return s.trie.GetAccountRangeWithProof(startHash, limitBytes)
+}
+
+// GetAccountRangeWithProof collects accounts of the given block in the order
+// of their address hashes, starting at the given hash, together with a proof
+// of the range. See the GetAccountRangeWithProof function for details.
+func (a *ArchiveTrie) GetAccountRangeWithProof(block uint64, startHash common.Hash, limitBytes int) ([]AccountRangeEntry, [][]byte, error) {
+	if a.filter != nil {
+		return nil, nil, fmt.Errorf("account ranges are not supported by partial archives: %w", ErrNotArchived)
+	}
+	a.rootsMutex.Lock()
+	if block >= uint64(a.roots.length()) {
+		a.rootsMutex.Unlock()
+		return nil, nil, fmt.Errorf("block %d not present in archive, highest block is %d", block, a.roots.length()-1)
+	}
+	root := a.roots.get(block).NodeRef
+	a.rootsMutex.Unlock()
+	return GetAccountRangeWithProof(a.nodeSource, &root, startHash, limitBytes)
+}
+
+// VerifyAccountRange checks that the given accounts are all the accounts of
+// the state trie with the given root hash having an address hash in the range
+// from the given start hash to the hash of the last given account. Accounts
+// are required to be sorted by their hashes. The proof is required to list
+// the RLP encoded nodes on the path to the start hash and, if there are any
+// accounts, on the path to the last account, as produced by
+// GetAccountRangeWithProof. To verify the range, a partial trie is built from
+// the proof, with the parts of the trie covered by the range left out, and
+// completed by inserting the given accounts. The range is valid if the hash of
+// the resulting trie matches the given root hash. The result is true if
+// there are accounts in the trie beyond the verified range.
+func VerifyAccountRange(root, startHash common.Hash, accounts []AccountRangeEntry, proof [][]byte) (bool, error) {
+	for i := range accounts {
+		if i == 0 && bytes.Compare(accounts[i].Hash[:], startHash[:]) < 0 {
+			return false, fmt.Errorf("account %x precedes start of range %x", accounts[i].Hash, startHash)
+		}
+		if i > 0 && bytes.Compare(accounts[i-1].Hash[:], accounts[i].Hash[:]) >= 0 {
+			return false, fmt.Errorf("accounts are not in strictly increasing order, %x is followed by %x", accounts[i-1].Hash, accounts[i].Hash)
+		}
+	}
+
+	if root == EmptyNodeEthereumHash {
+		if len(accounts) > 0 {
+			return false, fmt.Errorf("empty trie can not contain %d accounts", len(accounts))
+		}
+		return false, nil
+	}
+
+	nodes := make(map[common.Hash][]byte, len(proof))
+	for _, node := range proof {
+		nodes[common.Keccak256(node)] = node
+	}
+	builder := rangeTrieBuilder{nodes: nodes}
+	left := make([]Nibble, 2*len(startHash))
+	parseNibbles(left, startHash[:])
+	var right []Nibble
+	if len(accounts) > 0 {
+		last := accounts[len(accounts)-1].Hash
+		right = make([]Nibble, 2*len(last))
+		parseNibbles(right, last[:])
+	}
+	trie, err := builder.build(root, 0, left, right)
+	if err != nil {
+		return false, err
+	}
+
+	for i := range accounts {
+		path := make([]Nibble, 2*len(accounts[i].Hash))
+		parseNibbles(path, accounts[i].Hash[:])
+		trie, err = insertIntoRangeTrie(trie, path, accounts[i].encodeBody())
+		if err != nil {
+			return false, fmt.Errorf("account %x: %w", accounts[i].Hash, err)
+		}
+	}
+
+	hash := EmptyNodeEthereumHash
+	if trie != nil {
+		hash = common.Keccak256(trie.encode())
+	}
+	if hash != root {
+		return false, fmt.Errorf("account range does not match root hash, wanted %x, got %x", root, hash)
+	}
+	return builder.more, nil
+}
+
+// rangeTrieNode is a node of the in-memory trie reconstructed for verifying
+// account ranges. A nil node represents an empty sub-trie.
+type rangeTrieNode interface {
+	// encode produces the RLP encoding of the node under Ethereum's hashing.
+	encode() []byte
+}
+
+type rangeBranchNode struct {
+	children [16]rangeTrieNode
+}
+
+type rangeExtensionNode struct {
+	path []Nibble
+	next rangeTrieNode
+}
+
+type rangeLeafNode struct {
+	path  []Nibble
+	value []byte
+}
+
+// rangeHashNode is a sub-trie outside the verified range only known by its hash.
+type rangeHashNode struct {
+	hash common.Hash
+}
+
+func (n *rangeBranchNode) encode() []byte {
+	items := make([]rlp.Item, len(n.children)+1)
+	for i, child := range n.children {
+		items[i] = encodeRangeTrieReference(child)
+	}
+	items[len(n.children)] = rlp.String{}
+	return rlp.Encode(rlp.List{Items: items})
+}
+
+func (n *rangeExtensionNode) encode() []byte {
+	return rlp.Encode(rlp.List{Items: []rlp.Item{
+		rlp.String{Str: encodeNibbles(n.path, false)},
+		encodeRangeTrieReference(n.next),
+	}})
+}
+
+func (n *rangeLeafNode) encode() []byte {
+	return rlp.Encode(rlp.List{Items: []rlp.Item{
+		rlp.String{Str: encodeNibbles(n.path, true)},
+		rlp.String{Str: n.value},
+	}})
+}
+
+func (n *rangeHashNode) encode() []byte {
+	panic("encoding of nodes only known by their hash is not supported")
+}
+
+// encodeRangeTrieReference produces the RLP item referencing the given node
+// from its parent. Nodes with an encoding of less than 32 bytes are embedded.
+func encodeRangeTrieReference(node rangeTrieNode) rlp.Item {
+	switch n := node.(type) {
+	case nil:
+		return rlp.String{}
+	case *rangeHashNode:
+		return rlp.Hash{Hash: &n.hash}
+	}
+	encoded := node.encode()
+	if len(encoded) < common.HashSize {
+		return rlp.Encoded{Data: encoded}
+	}
+	hash := common.Keccak256(encoded)
+	return rlp.Hash{Hash: &hash}
+}
+
+// encodeNibbles produces the compact encoding of the given partial path.
+func encodeNibbles(nibbles []Nibble, targetsValue bool) []byte {
+	path := CreatePathFromNibbles(nibbles)
+	return encodePartialPath(path.GetPackedNibbles(), len(nibbles), targetsValue, make([]byte, getEncodedPartialPathSize(len(nibbles))))
+}
+
+func pathToNibbles(path *Path) []Nibble {
+	res := make([]Nibble, path.Length())
+	for i := range res {
+		res[i] = path.Get(i)
+	}
+	return res
+}
+
+// comparePathSegment compares the given nibbles with the segment of the
+// given boundary path starting at the given depth. Nibbles beyond the end of
+// the boundary path are considered to be greater.
+func comparePathSegment(nibbles []Nibble, boundary []Nibble, depth int) int {
+	for i, cur := range nibbles {
+		if depth+i >= len(boundary) {
+			return 1
+		}
+		if want := boundary[depth+i]; cur != want {
+			if cur < want {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// rangeTrieBuilder reconstructs the part of a trie covered by the proof of an
+// account range, excluding the sub-tries within the range.
+type rangeTrieBuilder struct {
+	nodes map[common.Hash][]byte // the proof nodes indexed by their hashes
+	more  bool                   // set if content beyond the right boundary was encountered
+}
+
+// build reconstructs the sub-trie with the given hash at the given depth. The
+// given boundary paths, if not nil, are the paths of the left and right end of
+// the range the path leading to the sub-trie is a prefix of. Sub-tries outside
+// the boundaries are retained by their hash, sub-tries within the boundaries
+// are left out.
+func (b *rangeTrieBuilder) build(hash common.Hash, depth int, left, right []Nibble) (rangeTrieNode, error) {
+	if hash == EmptyNodeEthereumHash {
+		return nil, nil
+	}
+	if left == nil && right == nil {
+		return nil, nil
+	}
+	data, found := b.nodes[hash]
+	if !found {
+		return nil, fmt.Errorf("proof is missing node %x at depth %d", hash, depth)
+	}
+	node, err := DecodeFromRlp(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proof node %x: %w", hash, err)
+	}
+
+	switch n := node.(type) {
+	case *BranchNode:
+		if depth >= 64 {
+			return nil, fmt.Errorf("branch node %x exceeds the maximum path length", hash)
+		}
+		res := &rangeBranchNode{}
+		for i := 0; i < len(n.hashes); i++ {
+			child := n.hashes[i]
+			if child == EmptyNodeEthereumHash {
+				continue
+			}
+			if n.isEmbedded(byte(i)) {
+				return nil, fmt.Errorf("embedded nodes are not supported in account tries, found in node %x", hash)
+			}
+			pos := Nibble(i)
+			switch {
+			case left != nil && pos < left[depth]:
+				res.children[i] = &rangeHashNode{child}
+			case right != nil && pos > right[depth]:
+				res.children[i] = &rangeHashNode{child}
+				b.more = true
+			default:
+				var l, r []Nibble
+				if left != nil && pos == left[depth] {
+					l = left
+				}
+				if right != nil && pos == right[depth] {
+					r = right
+				}
+				if res.children[i], err = b.build(child, depth+1, l, r); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return res, nil
+
+	case *ExtensionNode:
+		if n.nextIsEmbedded {
+			return nil, fmt.Errorf("embedded nodes are not supported in account tries, found in node %x", hash)
+		}
+		path := pathToNibbles(&n.path)
+		if depth+len(path) >= 64 {
+			return nil, fmt.Errorf("extension node %x exceeds the maximum path length", hash)
+		}
+		res := &rangeExtensionNode{path: path}
+		toLeft, toRight := 0, 0
+		if left != nil {
+			toLeft = comparePathSegment(path, left, depth)
+		}
+		if right != nil {
+			toRight = comparePathSegment(path, right, depth)
+		}
+		switch {
+		case left != nil && toLeft < 0:
+			res.next = &rangeHashNode{n.nextHash}
+		case right != nil && toRight > 0:
+			res.next = &rangeHashNode{n.nextHash}
+			b.more = true
+		default:
+			if toLeft != 0 {
+				left = nil
+			}
+			if toRight != 0 {
+				right = nil
+			}
+			if left == nil && right == nil {
+				// The extension is covered by the range.
+				return nil, nil
+			}
+			if res.next, err = b.build(n.nextHash, depth+len(path), left, right); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+
+	case *decodedAccountNode:
+		path := pathToNibbles(&n.suffix)
+		if depth+len(path) != 64 {
+			return nil, fmt.Errorf("account node %x at depth %d has a path of invalid length %d", hash, depth, len(path))
+		}
+		entry := AccountRangeEntry{Info: n.info, StorageRoot: n.storageHash}
+		leaf := &rangeLeafNode{path: path, value: entry.encodeBody()}
+		if left != nil && comparePathSegment(path, left, depth) < 0 {
+			return leaf, nil
+		}
+		if right != nil && comparePathSegment(path, right, depth) > 0 {
+			b.more = true
+			return leaf, nil
+		}
+		// The account is covered by the range.
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unexpected node in account trie proof: %T", node)
+}
+
+// insertIntoRangeTrie adds a leaf with the given path and value to the given
+// sub-trie, replacing the value of an existing leaf with the same path.
+func insertIntoRangeTrie(node rangeTrieNode, path []Nibble, value []byte) (rangeTrieNode, error) {
+	switch n := node.(type) {
+	case nil:
+		return &rangeLeafNode{path: path, value: value}, nil
+
+	case *rangeHashNode:
+		return nil, fmt.Errorf("path is not covered by the proof")
+
+	case *rangeBranchNode:
+		if len(path) == 0 {
+			return nil, fmt.Errorf("path ends at branch node")
+		}
+		child, err := insertIntoRangeTrie(n.children[path[0]], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		n.children[path[0]] = child
+		return n, nil
+
+	case *rangeExtensionNode:
+		prefix := GetCommonPrefixLength(n.path, path)
+		if prefix == len(n.path) {
+			next, err := insertIntoRangeTrie(n.next, path[prefix:], value)
+			if err != nil {
+				return nil, err
+			}
+			n.next = next
+			return n, nil
+		}
+		if prefix == len(path) {
+			return nil, fmt.Errorf("path ends within extension node")
+		}
+		branch := &rangeBranchNode{}
+		if rest := n.path[prefix+1:]; len(rest) > 0 {
+			branch.children[n.path[prefix]] = &rangeExtensionNode{path: rest, next: n.next}
+		} else {
+			branch.children[n.path[prefix]] = n.next
+		}
+		branch.children[path[prefix]] = &rangeLeafNode{path: path[prefix+1:], value: value}
+		return wrapInRangeExtension(path[:prefix], branch), nil
+
+	case *rangeLeafNode:
+		prefix := GetCommonPrefixLength(n.path, path)
+		if prefix == len(n.path) && prefix == len(path) {
+			n.value = value
+			return n, nil
+		}
+		if prefix == len(n.path) || prefix == len(path) {
+			return nil, fmt.Errorf("paths of different lengths in account trie")
+		}
+		branch := &rangeBranchNode{}
+		branch.children[n.path[prefix]] = &rangeLeafNode{path: n.path[prefix+1:], value: n.value}
+		branch.children[path[prefix]] = &rangeLeafNode{path: path[prefix+1:], value: value}
+		return wrapInRangeExtension(path[:prefix], branch), nil
+	}
+	return nil, fmt.Errorf("unexpected node type %T", node)
+}
+
+// wrapInRangeExtension prefixes the given branch by an extension node covering
+// the given path, if the path is not empty.
+func wrapInRangeExtension(path []Nibble, branch *rangeBranchNode) rangeTrieNode {
+	if len(path) == 0 {
+		return branch
+	}
+	return &rangeExtensionNode{path: path, next: branch}
+}
@@ -0,0 +1,380 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// accountRangeTestUpdate creates the given number of accounts with distinct
+// nonces, where every third account has a storage slot.
+func accountRangeTestUpdate(numAccounts int) common.Update {
+	update := common.Update{}
+	for i, addr := range getTestAddresses(numAccounts) {
+		update.CreatedAccounts = append(update.CreatedAccounts, addr)
+		update.Nonces = append(update.Nonces, common.NonceUpdate{Account: addr, Nonce: common.ToNonce(uint64(i + 1))})
+		if i%3 == 0 {
+			update.Slots = append(update.Slots, common.SlotUpdate{Account: addr, Key: common.Key{byte(i)}, Value: common.Value{1, byte(i)}})
+		}
+	}
+	return update
+}
+
+func openAccountRangeTestState(t *testing.T, numAccounts int) *MptState {
+	t.Helper()
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	update := accountRangeTestUpdate(numAccounts)
+	if err := update.ApplyTo(state); err != nil {
+		t.Fatalf("failed to apply update: %v", err)
+	}
+	return state
+}
+
+func TestAccountRange_PagesCoverAllAccountsAndAreVerified(t *testing.T) {
+	const numAccounts = 100
+	state := openAccountRangeTestState(t, numAccounts)
+	defer state.Close()
+	root, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+
+	var want []common.Hash
+	for _, addr := range getTestAddresses(numAccounts) {
+		want = append(want, common.Keccak256(addr[:]))
+	}
+	sort.Slice(want, func(i, j int) bool { return bytes.Compare(want[i][:], want[j][:]) < 0 })
+
+	var got []common.Hash
+	start := common.Hash{}
+	for pages := 0; ; pages++ {
+		if pages > numAccounts {
+			t.Fatalf("too many pages")
+		}
+		accounts, proof, err := state.GetAccountRangeWithProof(start, 1000)
+		if err != nil {
+			t.Fatalf("failed to get account range: %v", err)
+		}
+		if len(accounts) == 0 {
+			t.Fatalf("range starting at %x should not be empty", start)
+		}
+		more, err := VerifyAccountRange(root, start, accounts, proof)
+		if err != nil {
+			t.Fatalf("failed to verify range starting at %x: %v", start, err)
+		}
+		for _, account := range accounts {
+			got = append(got, account.Hash)
+			nonce, err := state.GetNonce(findAddress(t, numAccounts, account.Hash))
+			if err != nil {
+				t.Fatalf("failed to get nonce: %v", err)
+			}
+			if want, got := nonce, account.Info.Nonce; want != got {
+				t.Errorf("unexpected nonce, wanted %v, got %v", want, got)
+			}
+		}
+		if !more {
+			break
+		}
+		start = accounts[len(accounts)-1].Hash
+		start[31]++
+	}
+
+	if !slices.Equal(want, got) {
+		t.Errorf("pages do not cover all accounts in order, wanted %d accounts, got %d", len(want), len(got))
+	}
+}
+
+func TestAccountRange_SingleRangeCoversAllAccountsWithinBudget(t *testing.T) {
+	state := openAccountRangeTestState(t, 20)
+	defer state.Close()
+	root, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+	accounts, proof, err := state.GetAccountRangeWithProof(common.Hash{}, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to get account range: %v", err)
+	}
+	if want, got := 20, len(accounts); want != got {
+		t.Fatalf("unexpected number of accounts, wanted %d, got %d", want, got)
+	}
+	more, err := VerifyAccountRange(root, common.Hash{}, accounts, proof)
+	if err != nil {
+		t.Fatalf("failed to verify range: %v", err)
+	}
+	if more {
+		t.Errorf("complete range should not report more accounts")
+	}
+	withStorage := 0
+	for _, account := range accounts {
+		if account.StorageRoot != EmptyNodeEthereumHash {
+			withStorage++
+		}
+	}
+	if want, got := 7, withStorage; want != got {
+		t.Errorf("unexpected number of accounts with storage, wanted %d, got %d", want, got)
+	}
+}
+
+func TestAccountRange_AtLeastOneAccountIsReported(t *testing.T) {
+	state := openAccountRangeTestState(t, 20)
+	defer state.Close()
+	root, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+	accounts, proof, err := state.GetAccountRangeWithProof(common.Hash{}, 0)
+	if err != nil {
+		t.Fatalf("failed to get account range: %v", err)
+	}
+	if want, got := 1, len(accounts); want != got {
+		t.Fatalf("unexpected number of accounts, wanted %d, got %d", want, got)
+	}
+	more, err := VerifyAccountRange(root, common.Hash{}, accounts, proof)
+	if err != nil {
+		t.Fatalf("failed to verify range: %v", err)
+	}
+	if !more {
+		t.Errorf("partial range should report more accounts")
+	}
+}
+
+func TestAccountRange_RangeBeyondLastAccountIsEmptyAndVerified(t *testing.T) {
+	state := openAccountRangeTestState(t, 20)
+	defer state.Close()
+	root, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+	all, _, err := state.GetAccountRangeWithProof(common.Hash{}, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to get account range: %v", err)
+	}
+	start := all[len(all)-1].Hash
+	start[31]++
+
+	accounts, proof, err := state.GetAccountRangeWithProof(start, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to get account range: %v", err)
+	}
+	if len(accounts) != 0 {
+		t.Fatalf("range beyond last account should be empty, got %d accounts", len(accounts))
+	}
+	more, err := VerifyAccountRange(root, start, accounts, proof)
+	if err != nil {
+		t.Fatalf("failed to verify empty range: %v", err)
+	}
+	if more {
+		t.Errorf("empty range at the end should not report more accounts")
+	}
+
+	// Claiming the range to be empty is detected if it is not.
+	start = all[len(all)-3].Hash
+	if _, err := VerifyAccountRange(root, start, nil, proof); err == nil {
+		t.Errorf("non-empty range claimed to be empty should be detected")
+	}
+}
+
+func TestAccountRange_EmptyTrieHasEmptyRange(t *testing.T) {
+	state := openAccountRangeTestState(t, 0)
+	defer state.Close()
+	root, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+	accounts, proof, err := state.GetAccountRangeWithProof(common.Hash{}, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to get account range: %v", err)
+	}
+	if len(accounts) != 0 || len(proof) != 0 {
+		t.Errorf("empty trie should produce empty range, got %d accounts and %d proof nodes", len(accounts), len(proof))
+	}
+	if more, err := VerifyAccountRange(root, common.Hash{}, accounts, proof); err != nil || more {
+		t.Errorf("failed to verify empty range, more: %t, err: %v", more, err)
+	}
+}
+
+func TestAccountRange_ModifiedRangesAreDetected(t *testing.T) {
+	state := openAccountRangeTestState(t, 50)
+	defer state.Close()
+	root, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+	all, _, err := state.GetAccountRangeWithProof(common.Hash{}, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to get account range: %v", err)
+	}
+	start := all[10].Hash
+	start[31]-- // not an account, so the proof of the start proves its absence
+	accounts, proof, err := state.GetAccountRangeWithProof(start, 10*all[0].size())
+	if err != nil {
+		t.Fatalf("failed to get account range: %v", err)
+	}
+	if more, err := VerifyAccountRange(root, start, accounts, proof); err != nil || !more {
+		t.Fatalf("failed to verify range, more: %t, err: %v", more, err)
+	}
+
+	modifications := map[string]func(accounts []AccountRangeEntry, proof [][]byte) ([]AccountRangeEntry, [][]byte){
+		"modified nonce": func(accounts []AccountRangeEntry, proof [][]byte) ([]AccountRangeEntry, [][]byte) {
+			accounts[3].Info.Nonce = common.ToNonce(1234)
+			return accounts, proof
+		},
+		"modified storage root": func(accounts []AccountRangeEntry, proof [][]byte) ([]AccountRangeEntry, [][]byte) {
+			accounts[0].StorageRoot = common.Hash{1}
+			return accounts, proof
+		},
+		"missing first account": func(accounts []AccountRangeEntry, proof [][]byte) ([]AccountRangeEntry, [][]byte) {
+			return accounts[1:], proof
+		},
+		"missing middle account": func(accounts []AccountRangeEntry, proof [][]byte) ([]AccountRangeEntry, [][]byte) {
+			return append(accounts[:4], accounts[5:]...), proof
+		},
+		"missing last account": func(accounts []AccountRangeEntry, proof [][]byte) ([]AccountRangeEntry, [][]byte) {
+			return accounts[:len(accounts)-1], proof
+		},
+		"extra account": func(accounts []AccountRangeEntry, proof [][]byte) ([]AccountRangeEntry, [][]byte) {
+			extra := accounts[4]
+			extra.Hash[31]++
+			return slices.Insert(accounts, 5, extra), proof
+		},
+		"duplicated account": func(accounts []AccountRangeEntry, proof [][]byte) ([]AccountRangeEntry, [][]byte) {
+			return slices.Insert(accounts, 5, accounts[4]), proof
+		},
+		"unordered accounts": func(accounts []AccountRangeEntry, proof [][]byte) ([]AccountRangeEntry, [][]byte) {
+			accounts[2], accounts[3] = accounts[3], accounts[2]
+			return accounts, proof
+		},
+		"missing proof node": func(accounts []AccountRangeEntry, proof [][]byte) ([]AccountRangeEntry, [][]byte) {
+			return accounts, proof[1:]
+		},
+		"modified proof node": func(accounts []AccountRangeEntry, proof [][]byte) ([]AccountRangeEntry, [][]byte) {
+			proof[len(proof)-1][len(proof[len(proof)-1])-1]++
+			return accounts, proof
+		},
+	}
+
+	for name, modify := range modifications {
+		t.Run(name, func(t *testing.T) {
+			copied := make([][]byte, len(proof))
+			for i, node := range proof {
+				copied[i] = bytes.Clone(node)
+			}
+			accounts, proof := modify(slices.Clone(accounts), copied)
+			if _, err := VerifyAccountRange(root, start, accounts, proof); err == nil {
+				t.Errorf("modification should be detected")
+			}
+		})
+	}
+}
+
+func TestAccountRange_AccountsBeforeStartAreRejected(t *testing.T) {
+	state := openAccountRangeTestState(t, 20)
+	defer state.Close()
+	root, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+	accounts, proof, err := state.GetAccountRangeWithProof(common.Hash{}, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to get account range: %v", err)
+	}
+	start := accounts[1].Hash
+	if _, err := VerifyAccountRange(root, start, accounts, proof); err == nil {
+		t.Errorf("accounts before the start should be rejected")
+	}
+}
+
+func TestAccountRange_ArchiveServesRangesOfPastBlocks(t *testing.T) {
+	archive, err := OpenArchiveTrie(t.TempDir(), S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+	if err := archive.Add(0, accountRangeTestUpdate(10), nil); err != nil {
+		t.Fatalf("failed to add block: %v", err)
+	}
+	addr := common.Address{0xAB}
+	if err := archive.Add(1, common.Update{CreatedAccounts: []common.Address{addr}, Nonces: []common.NonceUpdate{{Account: addr, Nonce: common.ToNonce(1)}}}, nil); err != nil {
+		t.Fatalf("failed to add block: %v", err)
+	}
+
+	for block, want := range []int{10, 11} {
+		root, err := archive.GetHash(uint64(block))
+		if err != nil {
+			t.Fatalf("failed to get hash: %v", err)
+		}
+		accounts, proof, err := archive.GetAccountRangeWithProof(uint64(block), common.Hash{}, 1<<20)
+		if err != nil {
+			t.Fatalf("failed to get account range: %v", err)
+		}
+		if got := len(accounts); want != got {
+			t.Errorf("unexpected number of accounts in block %d, wanted %d, got %d", block, want, got)
+		}
+		if _, err := VerifyAccountRange(root, common.Hash{}, accounts, proof); err != nil {
+			t.Errorf("failed to verify range of block %d: %v", block, err)
+		}
+	}
+
+	if _, _, err := archive.GetAccountRangeWithProof(2, common.Hash{}, 1<<20); err == nil {
+		t.Errorf("range of missing block should fail")
+	}
+}
+
+func TestAccountRange_PartialArchivesAreNotSupported(t *testing.T) {
+	filter := func(common.Address) bool { return true }
+	archive, err := OpenPartialArchiveTrie(t.TempDir(), S5ArchiveConfig, ForestConfig{CacheCapacity: 1024}, filter)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+	if _, _, err := archive.GetAccountRangeWithProof(0, common.Hash{}, 1<<20); !errors.Is(err, ErrNotArchived) {
+		t.Errorf("unexpected error, wanted %v, got %v", ErrNotArchived, err)
+	}
+}
+
+func TestAccountRange_RequiresEthereumHashing(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer trie.Close()
+			_, _, err = trie.GetAccountRangeWithProof(common.Hash{}, 1<<20)
+			if supported := config.Hashing.Name == EthereumLikeHashing.Name; supported != (err == nil) {
+				t.Errorf("unexpected result, supported: %t, err: %v", supported, err)
+			}
+		})
+	}
+}
+
+// findAddress locates the test address with the given hash among the test
+// addresses of the given number.
+func findAddress(t *testing.T, numAccounts int, hash common.Hash) common.Address {
+	t.Helper()
+	for _, addr := range getTestAddresses(numAccounts) {
+		if common.Keccak256(addr[:]) == hash {
+			return addr
+		}
+	}
+	t.Fatalf("no test address with hash %x", hash)
+	return common.Address{}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// BloomParams defines the dimensions of an AddressBloom.
+type BloomParams struct {
+	NumBits   uint64 // the number of bits of the filter, rounded up to a power of 2
+	NumHashes int    // the number of bits set per address
+}
+
+// DefaultBloomParams are used for building address blooms if no parameters
+// are given. They are sized for about 100,000 addresses at a false-positive
+// rate of 1%.
+var DefaultBloomParams = BloomParams{NumBits: 1 << 20, NumHashes: 7}
+
+// GetBloomParams computes the dimensions of a bloom filter covering the given
+// number of addresses with the given false-positive rate.
+func GetBloomParams(numAddresses uint64, falsePositiveRate float64) BloomParams {
+	if numAddresses == 0 || falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return DefaultBloomParams
+	}
+	bits := math.Ceil(-float64(numAddresses) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Round(bits / float64(numAddresses) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return BloomParams{NumBits: uint64(bits), NumHashes: hashes}
+}
+
+// AddressBloom is a bloom filter over a set of account addresses, answering
+// whether an address may be contained in the set. Addresses of the set are
+// never reported missing, while addresses not in the set are reported to be
+// contained with a probability depending on the filter's dimensions. Filters
+// can be serialized using MarshalBinary and UnmarshalBinary for being shared
+// with other services.
+type AddressBloom struct {
+	words     []uint64 // the bits of the filter, the number of bits is a power of 2
+	numHashes int      // the number of bits set per address
+}
+
+// NewAddressBloom creates an empty filter with the given dimensions. Zero
+// dimensions are replaced by those of DefaultBloomParams.
+func NewAddressBloom(params BloomParams) *AddressBloom {
+	if params.NumBits == 0 {
+		params.NumBits = DefaultBloomParams.NumBits
+	}
+	if params.NumHashes <= 0 {
+		params.NumHashes = DefaultBloomParams.NumHashes
+	}
+	bits := uint64(64)
+	for bits < params.NumBits {
+		bits <<= 1
+	}
+	return &AddressBloom{
+		words:     make([]uint64, bits/64),
+		numHashes: params.NumHashes,
+	}
+}
+
+// BuildAddressBloom creates a filter with the given dimensions covering the
+// addresses of all accounts in the trie rooted by the given node. The filter
+// is populated in a single traversal of the trie, skipping storage tries.
+func (s *Forest) BuildAddressBloom(root *NodeReference, params BloomParams) (*AddressBloom, error) {
+	res := NewAddressBloom(params)
+	err := s.VisitTrie(root, MakeVisitor(func(node Node, _ NodeInfo) VisitResponse {
+		if account, ok := node.(*AccountNode); ok {
+			res.Add(account.address)
+			return VisitResponsePrune
+		}
+		return VisitResponseContinue
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// BuildAddressBloom creates a filter with the given dimensions covering the
+// addresses of all accounts of this trie. See Forest.BuildAddressBloom.
+func (s *LiveTrie) BuildAddressBloom(params BloomParams) (*AddressBloom, error) {
+	forest, ok := s.forest.(*Forest)
+	if !ok {
+		return nil, fmt.Errorf("building address blooms is not supported by %T", s.forest)
+	}
+	return forest.BuildAddressBloom(&s.root, params)
+}
+
+// Add adds the given address to the filter.
+func (b *AddressBloom) Add(address common.Address) {
+	h1, h2 := hashForAccountFilter(address)
+	mask := uint64(len(b.words)*64 - 1)
+	for i := uint64(0); i < uint64(b.numHashes); i++ {
+		pos := (h1 + i*h2) & mask
+		b.words[pos/64] |= uint64(1) << (pos % 64)
+	}
+}
+
+// MayContain returns false if the given address is definitely not covered by
+// the filter.
+func (b *AddressBloom) MayContain(address common.Address) bool {
+	h1, h2 := hashForAccountFilter(address)
+	mask := uint64(len(b.words)*64 - 1)
+	for i := uint64(0); i < uint64(b.numHashes); i++ {
+		pos := (h1 + i*h2) & mask
+		if b.words[pos/64]&(uint64(1)<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// The serialized filter is prefixed by the number of hashes, followed by the
+// words of the filter.
+const addressBloomHeaderSize = 8
+
+// MarshalBinary serializes the filter.
+func (b *AddressBloom) MarshalBinary() ([]byte, error) {
+	data := make([]byte, addressBloomHeaderSize+len(b.words)*8)
+	binary.BigEndian.PutUint64(data, uint64(b.numHashes))
+	for i, word := range b.words {
+		binary.BigEndian.PutUint64(data[addressBloomHeaderSize+i*8:], word)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary restores a filter serialized by MarshalBinary.
+func (b *AddressBloom) UnmarshalBinary(data []byte) error {
+	if len(data) < addressBloomHeaderSize {
+		return fmt.Errorf("invalid size of address bloom: %d bytes", len(data))
+	}
+	numHashes := binary.BigEndian.Uint64(data)
+	numWords := (len(data) - addressBloomHeaderSize) / 8
+	if numWords*8 != len(data)-addressBloomHeaderSize || numWords == 0 || numWords&(numWords-1) != 0 {
+		return fmt.Errorf("invalid size of address bloom: %d bytes", len(data))
+	}
+	if numHashes == 0 || numHashes > 64 {
+		return fmt.Errorf("invalid number of hashes of address bloom: %d", numHashes)
+	}
+	b.numHashes = int(numHashes)
+	b.words = make([]uint64, numWords)
+	for i := range b.words {
+		b.words[i] = binary.BigEndian.Uint64(data[addressBloomHeaderSize+i*8:])
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestAddressBloom_ContainsAllAccountsAndRarelyMissingOnes(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 10_000)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer trie.Close()
+
+			const numAccounts = 1000
+			addresses := getTestAddresses(numAccounts)
+			present := map[common.Address]bool{}
+			for i, addr := range addresses {
+				if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+					t.Fatalf("failed to set account: %v", err)
+				}
+				if err := trie.SetValue(addr, common.Key{byte(i)}, common.Value{1}); err != nil {
+					t.Fatalf("failed to set value: %v", err)
+				}
+				present[addr] = true
+			}
+
+			bloom, err := trie.BuildAddressBloom(GetBloomParams(numAccounts, 0.01))
+			if err != nil {
+				t.Fatalf("failed to build bloom: %v", err)
+			}
+			for _, addr := range addresses {
+				if !bloom.MayContain(addr) {
+					t.Fatalf("address %v of existing account is missed", addr)
+				}
+			}
+
+			r := rand.New(rand.NewSource(42))
+			falsePositives, tested := 0, 0
+			for tested < 10_000 {
+				var addr common.Address
+				r.Read(addr[:])
+				if present[addr] {
+					continue
+				}
+				tested++
+				if bloom.MayContain(addr) {
+					falsePositives++
+				}
+			}
+			if rate := float64(falsePositives) / float64(tested); rate > 0.05 {
+				t.Errorf("too many false positives, got rate %f", rate)
+			}
+		})
+	}
+}
+
+func TestAddressBloom_SerializedBloomsCanBeRestored(t *testing.T) {
+	bloom := NewAddressBloom(BloomParams{NumBits: 1000, NumHashes: 5})
+	addresses := getTestAddresses(100)
+	for _, addr := range addresses {
+		bloom.Add(addr)
+	}
+	data, err := bloom.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to serialize bloom: %v", err)
+	}
+
+	var restored AddressBloom
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatalf("failed to restore bloom: %v", err)
+	}
+	for _, addr := range addresses {
+		if !restored.MayContain(addr) {
+			t.Errorf("address %v is missed by restored bloom", addr)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		addr := common.Address{0xFF, byte(i), byte(i >> 8)}
+		if want, got := bloom.MayContain(addr), restored.MayContain(addr); want != got {
+			t.Errorf("restored bloom differs for %v, wanted %t, got %t", addr, want, got)
+		}
+	}
+
+	for _, data := range [][]byte{nil, data[:7], data[:len(data)-1], data[:8+3*8]} {
+		if err := restored.UnmarshalBinary(data); err == nil {
+			t.Errorf("restoring bloom from %d bytes should fail", len(data))
+		}
+	}
+}
+
+func TestAddressBloom_EmptyTrieProducesEmptyBloom(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	bloom, err := trie.BuildAddressBloom(BloomParams{})
+	if err != nil {
+		t.Fatalf("failed to build bloom: %v", err)
+	}
+	for _, addr := range getTestAddresses(100) {
+		if bloom.MayContain(addr) {
+			t.Errorf("empty bloom should not contain %v", addr)
+		}
+	}
+}
@@ -15,10 +15,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
+	"slices"
 	"sync"
 	"unsafe"
 
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
 	"github.com/Fantom-foundation/Carmen/go/common"
 )
 
@@ -33,29 +36,97 @@ type ArchiveTrie struct {
 	head         LiveState // the current head-state
 	forest       Database  // global forest with all versions of LiveState
 	nodeSource   NodeSource
-	roots        rootList   // the roots of individual blocks indexed by block height
-	rootsMutex   sync.Mutex // protecting access to the roots list
-	rootFile     string     // the file storing the list of roots
-	addMutex     sync.Mutex // a mutex to make sure that at any time only one thread is adding new blocks
+	roots        rootList     // the roots of individual blocks indexed by block height
+	rootsMutex   sync.Mutex   // protecting access to the roots list
+	rootFile     string       // the file storing the list of roots
+	rootIndex    *rootIndex   // the blocks of each root hash, protected by the rootsMutex
+	addMutex     sync.Mutex   // a mutex to make sure that at any time only one thread is adding new blocks
+	syncer       commitSyncer // decides when added blocks are synced to disk, protected by the addMutex
 	errorMutex   sync.RWMutex
-	archiveError error // a non-nil error will be stored here should it occur during any archive operation
+	archiveError error          // a non-nil error will be stored here should it occur during any archive operation
+	filter       *archiveFilter // the accounts retained by a partial archive, nil for full archives
+	rejectGaps   bool           // whether blocks skipping ahead of the next block height are rejected
+	rootsIssues  error          // inconsistencies of the list of roots detected on open, reported by Check
+	updates      rootNotifier   // subscribers informed about added blocks
+}
+
+// ErrNonMonotonicBlock is reported by ArchiveTrie.Add for blocks not higher
+// than the current block height of the archive. The reported errors are of
+// type *NonMonotonicBlockError, providing the involved block numbers.
+const ErrNonMonotonicBlock = common.ConstError("block is not higher than the block height of the archive")
+
+// ErrBlockGap is reported by ArchiveTrie.Add for blocks skipping ahead of the
+// next block of the archive if gaps are rejected by the ForestConfig.
+const ErrBlockGap = common.ConstError("block is skipping blocks of the archive")
+
+// NonMonotonicBlockError is the error reported when adding a block to an
+// archive already containing this or a later block.
+type NonMonotonicBlockError struct {
+	Block  uint64 // the block that was to be added
+	Height uint64 // the block height of the archive at that time
+}
+
+func (e *NonMonotonicBlockError) Error() string {
+	return fmt.Sprintf("%v: got block %d, block height is %d", ErrNonMonotonicBlock, e.Block, e.Height)
+}
+
+func (e *NonMonotonicBlockError) Unwrap() error {
+	return ErrNonMonotonicBlock
 }
 
 func OpenArchiveTrie(directory string, config MptConfig, cacheCapacity int) (*ArchiveTrie, error) {
+	return OpenArchiveTrieWithConfig(directory, config, ForestConfig{CacheCapacity: cacheCapacity})
+}
+
+// OpenArchiveTrieWithConfig is a variant of OpenArchiveTrie enabling the
+// customization of the underlying forest, e.g. to select a durability mode.
+// The forest is always opened in Immutable mode.
+func OpenArchiveTrieWithConfig(directory string, config MptConfig, forestConfig ForestConfig) (*ArchiveTrie, error) {
+	return openArchiveTrie(directory, config, forestConfig, nil)
+}
+
+// openArchiveTrie opens a full archive if the given filter is nil, and a
+// partial archive retaining the accounts accepted by the filter otherwise.
+func openArchiveTrie(directory string, config MptConfig, forestConfig ForestConfig, accept AccountFilter) (*ArchiveTrie, error) {
+	rootfile := directory + "/roots.dat"
+	partial, err := isPartialArchive(directory)
+	if err != nil {
+		return nil, err
+	}
+	if partial && accept == nil {
+		return nil, fmt.Errorf("directory %s contains a partial archive, which requires an account filter", directory)
+	}
+	if info, err := os.Stat(rootfile); err == nil && info.Size() > 0 && !partial && accept != nil {
+		return nil, fmt.Errorf("directory %s contains a full archive, which can not be opened as a partial archive", directory)
+	}
+
 	lock, err := openStateDirectory(directory)
 	if err != nil {
 		return nil, err
 	}
-	rootfile := directory + "/roots.dat"
-	roots, err := loadRoots(rootfile)
+	roots, err := loadRoots(rootfile, getNodeIdEncoder(config))
 	if err != nil {
 		return nil, err
 	}
-	forestConfig := ForestConfig{Mode: Immutable, CacheCapacity: cacheCapacity}
+	index, err := loadRootIndex(directory+"/"+rootIndexFile, roots.roots)
+	if err != nil {
+		return nil, err
+	}
+	var filter *archiveFilter
+	if accept != nil {
+		filter, err = loadArchiveFilter(directory, accept)
+		if err != nil {
+			return nil, err
+		}
+	}
+	forestConfig.Mode = Immutable
 	forest, err := OpenFileForest(directory, config, forestConfig)
 	if err != nil {
 		return nil, err
 	}
+	if filter != nil {
+		forest.archivedAccounts = filter.getRegisteredAccounts
+	}
 	head, err := makeTrie(directory, forest)
 	if err != nil {
 		forest.Close()
@@ -67,11 +138,16 @@ func OpenArchiveTrie(directory string, config MptConfig, cacheCapacity int) (*Ar
 		return nil, err
 	}
 	return &ArchiveTrie{
-		head:       state,
-		forest:     forest,
-		nodeSource: forest,
-		roots:      roots,
-		rootFile:   rootfile,
+		head:        state,
+		forest:      forest,
+		nodeSource:  forest,
+		roots:       roots,
+		rootFile:    rootfile,
+		rootIndex:   index,
+		syncer:      makeCommitSyncer(forestConfig),
+		filter:      filter,
+		rejectGaps:  forestConfig.RejectGaps,
+		rootsIssues: checkRoots(roots.roots),
 	}, nil
 }
 
@@ -79,13 +155,20 @@ func OpenArchiveTrie(directory string, config MptConfig, cacheCapacity int) (*Ar
 // If the test passes, the data stored in the respective directory
 // can be considered a valid archive database of the given configuration.
 func VerifyArchiveTrie(directory string, config MptConfig, observer VerificationObserver) error {
-	roots, err := loadRoots(directory + "/roots.dat")
+	roots, err := loadRoots(directory+"/roots.dat", getNodeIdEncoder(config))
 	if err != nil {
 		return err
 	}
 	if roots.length() == 0 {
 		return nil
 	}
+	partial, err := isPartialArchive(directory)
+	if err != nil {
+		return err
+	}
+	if partial {
+		return fmt.Errorf("verification of partial archives is not supported: %w", ErrNotArchived)
+	}
 	return VerifyMptState(directory, config, roots.roots, observer)
 }
 
@@ -100,9 +183,12 @@ func (a *ArchiveTrie) Add(block uint64, update common.Update, hint any) error {
 	defer a.addMutex.Unlock()
 
 	a.rootsMutex.Lock()
-	if uint64(a.roots.length()) > block {
+	if length := uint64(a.roots.length()); length > block {
+		a.rootsMutex.Unlock()
+		return &NonMonotonicBlockError{Block: block, Height: length - 1}
+	} else if length < block && a.rejectGaps {
 		a.rootsMutex.Unlock()
-		return fmt.Errorf("block %d already present", block)
+		return fmt.Errorf("%w: got block %d, next block is %d", ErrBlockGap, block, length)
 	}
 
 	// Mark skipped blocks as having no changes.
@@ -114,18 +200,23 @@ func (a *ArchiveTrie) Add(block uint64, update common.Update, hint any) error {
 		}
 		for uint64(a.roots.length()) < block {
 			a.roots.append(Root{a.head.Root(), lastHash})
+			a.rootIndex.append(lastHash)
 		}
 	}
 	a.rootsMutex.Unlock()
 
-	// Apply all the changes of the update.
+	// Apply all the changes of the update in canonical order.
+	update = sortUpdate(update)
+	if a.filter != nil {
+		a.filter.register(block, &update)
+	}
 	if err := update.ApplyTo(a.head); err != nil {
 		return a.addError(err)
 	}
 
 	// Freeze new state.
 	root := a.head.Root()
-	if err := a.forest.Freeze(&root); err != nil {
+	if err := a.freeze(&root); err != nil {
 		return a.addError(err)
 	}
 
@@ -151,10 +242,31 @@ func (a *ArchiveTrie) Add(block uint64, update common.Update, hint any) error {
 	// Save new root node.
 	a.rootsMutex.Lock()
 	a.roots.append(Root{a.head.Root(), hash})
+	a.rootIndex.append(hash)
 	a.rootsMutex.Unlock()
+	a.updates.notify(RootUpdate{Block: block, Hash: hash})
+	if logger := getLogger(a.forest); logger != nil {
+		logger.Log(LogDebug, "added block to archive", "block", block, "hash", hash)
+	}
+
+	if a.syncer.isSyncDue() {
+		if err := a.Flush(); err != nil {
+			return a.addError(err)
+		}
+	}
 	return nil
 }
 
+// SubscribeRootUpdates registers a subscriber informed about the root hash of
+// each block added to this archive. Blocks skipped by an added block are not
+// reported. Like for MptState.SubscribeRootUpdates, adding blocks is never
+// blocked by slow consumers, whose oldest pending updates are dropped if their
+// buffer is full. The returned function ends the subscription. Closing the
+// archive ends all subscriptions.
+func (a *ArchiveTrie) SubscribeRootUpdates(buffer int) (<-chan RootUpdate, func()) {
+	return a.updates.subscribe(buffer)
+}
+
 func (a *ArchiveTrie) GetBlockHeight() (block uint64, empty bool, err error) {
 	a.rootsMutex.Lock()
 	length := uint64(a.roots.length())
@@ -166,11 +278,11 @@ func (a *ArchiveTrie) GetBlockHeight() (block uint64, empty bool, err error) {
 }
 
 func (a *ArchiveTrie) Exists(block uint64, account common.Address) (exists bool, err error) {
-	view, err := a.getView(block)
+	view, err := a.getAccountView(block, account)
 	if err != nil {
 		return false, err
 	}
-	_, exists, err = view.GetAccountInfo(account)
+	exists, err = view.HasAccount(account)
 	if err != nil {
 		return false, a.addError(err)
 	}
@@ -178,7 +290,7 @@ func (a *ArchiveTrie) Exists(block uint64, account common.Address) (exists bool,
 }
 
 func (a *ArchiveTrie) GetBalance(block uint64, account common.Address) (balance common.Balance, err error) {
-	view, err := a.getView(block)
+	view, err := a.getAccountView(block, account)
 	if err != nil {
 		return common.Balance{}, err
 	}
@@ -190,7 +302,7 @@ func (a *ArchiveTrie) GetBalance(block uint64, account common.Address) (balance
 }
 
 func (a *ArchiveTrie) GetCode(block uint64, account common.Address) (code []byte, err error) {
-	view, err := a.getView(block)
+	view, err := a.getAccountView(block, account)
 	if err != nil {
 		return nil, err
 	}
@@ -206,7 +318,7 @@ func (a *ArchiveTrie) GetCodes() (map[common.Hash][]byte, error) {
 }
 
 func (a *ArchiveTrie) GetNonce(block uint64, account common.Address) (nonce common.Nonce, err error) {
-	view, err := a.getView(block)
+	view, err := a.getAccountView(block, account)
 	if err != nil {
 		return common.Nonce{}, err
 	}
@@ -218,13 +330,83 @@ func (a *ArchiveTrie) GetNonce(block uint64, account common.Address) (nonce comm
 }
 
 func (a *ArchiveTrie) GetStorage(block uint64, account common.Address, slot common.Key) (value common.Value, err error) {
-	view, err := a.getView(block)
+	view, err := a.getAccountView(block, account)
+	if errors.Is(err, ErrNotArchived) {
+		return common.Value{}, err
+	}
 	if err != nil {
 		return common.Value{}, a.addError(err)
 	}
 	return view.GetValue(account, slot)
 }
 
+// GetAccountInfoRange returns the information of the given account for each
+// block in the range [fromBlock, toBlock]. The result is identical to querying
+// the blocks individually, yet the path to the account is only re-visited for
+// blocks in which a node on the path differs from the previous block.
+func (a *ArchiveTrie) GetAccountInfoRange(account common.Address, fromBlock, toBlock uint64) ([]AccountInfo, error) {
+	if a.filter != nil {
+		return getRangeByBlock(a, account, fromBlock, toBlock, func(view *LiveTrie) (AccountInfo, error) {
+			info, _, err := view.GetAccountInfo(account)
+			return info, err
+		})
+	}
+	roots, err := a.getRoots(fromBlock, toBlock)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]AccountInfo, 0, len(roots))
+	var path pathTracker
+	var info AccountInfo
+	for i := range roots {
+		reused, found, err := path.lookupAccount(a.nodeSource, &roots[i], account)
+		if err != nil {
+			return nil, a.addError(err)
+		}
+		if !reused {
+			info = AccountInfo{}
+			if found {
+				info = path.info
+			}
+		}
+		res = append(res, info)
+	}
+	return res, nil
+}
+
+// GetStorageRange returns the value of the given storage slot for each block
+// in the range [fromBlock, toBlock]. Like GetAccountInfoRange, paths are only
+// re-visited for blocks in which a node on the path to the slot differs from
+// the previous block.
+func (a *ArchiveTrie) GetStorageRange(account common.Address, slot common.Key, fromBlock, toBlock uint64) ([]common.Value, error) {
+	if a.filter != nil {
+		return getRangeByBlock(a, account, fromBlock, toBlock, func(view *LiveTrie) (common.Value, error) {
+			return view.GetValue(account, slot)
+		})
+	}
+	roots, err := a.getRoots(fromBlock, toBlock)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]common.Value, 0, len(roots))
+	var path pathTracker
+	var value common.Value
+	for i := range roots {
+		reused, found, err := path.lookupValue(a.nodeSource, &roots[i], account, slot)
+		if err != nil {
+			return nil, a.addError(err)
+		}
+		if !reused {
+			value = common.Value{}
+			if found {
+				value = path.value
+			}
+		}
+		res = append(res, value)
+	}
+	return res, nil
+}
+
 func (a *ArchiveTrie) GetAccountHash(block uint64, account common.Address) (common.Hash, error) {
 	return common.Hash{}, fmt.Errorf("not implemented")
 }
@@ -241,8 +423,48 @@ func (a *ArchiveTrie) GetHash(block uint64) (hash common.Hash, err error) {
 	return res, nil
 }
 
+// GetBlockByRoot returns the blocks of which the given hash is the root hash
+// in ascending order, or an empty list if there is no such block. Multiple
+// blocks may share a root hash, e.g. if blocks do not modify the state. The
+// lookup is served by an index and does not access any trie nodes.
+func (a *ArchiveTrie) GetBlockByRoot(hash common.Hash) ([]uint64, error) {
+	if err := a.CheckErrors(); err != nil {
+		return nil, err
+	}
+	a.rootsMutex.Lock()
+	defer a.rootsMutex.Unlock()
+	return a.rootIndex.getBlocks(hash), nil
+}
+
+// GetRoots returns the root hashes of the blocks in the range [fromBlock,
+// toBlock] as recorded by the archive, without accessing any trie nodes. The
+// range has to be covered by the archive, ranges exceeding the block height
+// are rejected instead of being truncated.
+func (a *ArchiveTrie) GetRoots(fromBlock, toBlock uint64) (map[uint64]common.Hash, error) {
+	if err := a.CheckErrors(); err != nil {
+		return nil, err
+	}
+	if fromBlock > toBlock {
+		return nil, fmt.Errorf("invalid block range: %d > %d", fromBlock, toBlock)
+	}
+	a.rootsMutex.Lock()
+	defer a.rootsMutex.Unlock()
+	length := uint64(a.roots.length())
+	if toBlock >= length {
+		return nil, fmt.Errorf("invalid block range: [%d, %d] exceeds block height, archive contains %d blocks", fromBlock, toBlock, length)
+	}
+	res := make(map[uint64]common.Hash, toBlock-fromBlock+1)
+	for block := fromBlock; block <= toBlock; block++ {
+		res[block] = a.roots.get(block).Hash
+	}
+	return res, nil
+}
+
 // GetDiff computes the difference between the given source and target blocks.
 func (a *ArchiveTrie) GetDiff(srcBlock, trgBlock uint64) (Diff, error) {
+	if a.filter != nil {
+		return Diff{}, fmt.Errorf("diffs are not supported by partial archives: %w", ErrNotArchived)
+	}
 	a.rootsMutex.Lock()
 	if srcBlock >= uint64(a.roots.length()) {
 		a.rootsMutex.Unlock()
@@ -262,6 +484,9 @@ func (a *ArchiveTrie) GetDiff(srcBlock, trgBlock uint64) (Diff, error) {
 // predecessor. Note that this enables access to the changes introduced by block 0.
 func (a *ArchiveTrie) GetDiffForBlock(block uint64) (Diff, error) {
 	if block == 0 {
+		if a.filter != nil {
+			return Diff{}, fmt.Errorf("diffs are not supported by partial archives: %w", ErrNotArchived)
+		}
 		a.rootsMutex.Lock()
 		if a.roots.length() == 0 {
 			a.rootsMutex.Unlock()
@@ -274,12 +499,111 @@ func (a *ArchiveTrie) GetDiffForBlock(block uint64) (Diff, error) {
 	return a.GetDiff(block-1, block)
 }
 
+// DiffStorage compares the storage of the two given accounts at the given block.
+func (a *ArchiveTrie) DiffStorage(block uint64, addrA, addrB common.Address) (DiffResult, error) {
+	a.rootsMutex.Lock()
+	if block >= uint64(a.roots.length()) {
+		a.rootsMutex.Unlock()
+		return DiffResult{}, fmt.Errorf("block %d not present in archive, highest block is %d", block, a.roots.length()-1)
+	}
+	root := a.roots.get(block).NodeRef
+	a.rootsMutex.Unlock()
+	if a.filter == nil {
+		return DiffStorage(a.nodeSource, &root, addrA, addrB)
+	}
+	viewA, err := a.filter.restrict(getTrieView(root, a.forest), block, addrA)
+	if err != nil {
+		return DiffResult{}, err
+	}
+	viewB, err := a.filter.restrict(getTrieView(root, a.forest), block, addrB)
+	if err != nil {
+		return DiffResult{}, err
+	}
+	return diffStorage(a.nodeSource, &viewA.root, addrA, &viewB.root, addrB)
+}
+
+// GetIdSpaceUsage reports the utilization of the node ID space of the forest
+// maintaining this archive.
+func (a *ArchiveTrie) GetIdSpaceUsage() (IdSpaceUsage, error) {
+	return getIdSpaceUsage(a.forest)
+}
+
+// GetAccountLeafRlp returns the RLP encoding of the leaf node of the given
+// account at the given block. See the GetAccountLeafRlp function for details.
+func (a *ArchiveTrie) GetAccountLeafRlp(block uint64, account common.Address) ([]byte, bool, error) {
+	a.rootsMutex.Lock()
+	if block >= uint64(a.roots.length()) {
+		a.rootsMutex.Unlock()
+		return nil, false, fmt.Errorf("block %d not present in archive, highest block is %d", block, a.roots.length()-1)
+	}
+	root := a.roots.get(block).NodeRef
+	a.rootsMutex.Unlock()
+	if a.filter != nil {
+		view, err := a.filter.restrict(getTrieView(root, a.forest), block, account)
+		if err != nil {
+			return nil, false, err
+		}
+		root = view.root
+	}
+	return GetAccountLeafRlp(a.nodeSource, &root, account)
+}
+
+// VisitTrie visits the nodes of the trie of the given block in depth-first
+// order using the given visitor.
+func (a *ArchiveTrie) VisitTrie(block uint64, visitor NodeVisitor) error {
+	view, err := a.getView(block)
+	if err != nil {
+		return err
+	}
+	return view.VisitTrie(visitor)
+}
+
+// VisitAccountsWithStorage visits all accounts of the trie of the given block
+// together with their storage. See the package-level VisitAccountsWithStorage
+// for details.
+func (a *ArchiveTrie) VisitAccountsWithStorage(block uint64, visit func(common.Address, AccountInfo, StorageVisitor) error) error {
+	view, err := a.getView(block)
+	if err != nil {
+		return err
+	}
+	return view.VisitAccountsWithStorage(visit)
+}
+
+// SelfCheck re-computes the hashes of the given number of randomly sampled
+// nodes and compares them to the stored hashes. Each node is sampled from
+// the trie of a randomly chosen block. See Forest.SelfCheck for details.
+func (a *ArchiveTrie) SelfCheck(sampleSize int) (SelfCheckReport, error) {
+	report := SelfCheckReport{}
+	forest, ok := a.forest.(*Forest)
+	if !ok {
+		return report, selfCheckUnsupportedErr
+	}
+	for i := 0; i < sampleSize; i++ {
+		a.rootsMutex.Lock()
+		length := a.roots.length()
+		if length == 0 {
+			a.rootsMutex.Unlock()
+			break
+		}
+		root := a.roots.get(uint64(rand.Intn(length))).NodeRef
+		a.rootsMutex.Unlock()
+		if err := forest.selfCheckSample(&root, &report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
 func (a *ArchiveTrie) GetMemoryFootprint() *common.MemoryFootprint {
 	mf := common.NewMemoryFootprint(unsafe.Sizeof(*a))
 	mf.AddChild("head", a.head.GetMemoryFootprint())
 	a.rootsMutex.Lock()
 	mf.AddChild("roots", common.NewMemoryFootprint(uintptr(a.roots.length())*unsafe.Sizeof(NodeId(0))))
+	mf.AddChild("rootIndex", a.rootIndex.GetMemoryFootprint())
 	a.rootsMutex.Unlock()
+	if a.filter != nil {
+		mf.AddChild("archivedAccounts", a.filter.GetMemoryFootprint())
+	}
 	return mf
 }
 
@@ -288,8 +612,14 @@ func (a *ArchiveTrie) Check() error {
 	for i := 0; i < a.roots.length(); i++ {
 		roots[i] = &a.roots.roots[i].NodeRef
 	}
+	// Past tries of partial archives are only retained along the paths to
+	// archived accounts, so only the head can be checked.
+	if a.filter != nil && len(roots) > 0 {
+		roots = roots[len(roots)-1:]
+	}
 	return errors.Join(
 		a.CheckErrors(),
+		a.rootsIssues,
 		a.forest.CheckAll(roots))
 }
 
@@ -298,6 +628,10 @@ func (a *ArchiveTrie) Dump() {
 	defer a.rootsMutex.Unlock()
 	for i, root := range a.roots.roots {
 		fmt.Printf("\nBlock %d: %x\n", i, root.Hash)
+		if a.filter != nil && i < len(a.roots.roots)-1 {
+			fmt.Printf("  not retained by partial archive\n")
+			continue
+		}
 		view := getTrieView(root.NodeRef, a.forest)
 		view.Dump()
 		fmt.Printf("\n")
@@ -307,14 +641,21 @@ func (a *ArchiveTrie) Dump() {
 func (a *ArchiveTrie) Flush() error {
 	a.rootsMutex.Lock()
 	defer a.rootsMutex.Unlock()
+	var filterErr error
+	if a.filter != nil {
+		filterErr = a.filter.store()
+	}
 	return errors.Join(
 		a.CheckErrors(),
 		a.head.Flush(),
 		a.roots.storeRoots(),
+		a.rootIndex.store(), // stored after the roots it is derived from
+		filterErr,
 	)
 }
 
 func (a *ArchiveTrie) Close() error {
+	a.updates.close()
 	return errors.Join(
 		a.CheckErrors(),
 		a.head.closeWithError(a.Flush()))
@@ -336,6 +677,176 @@ func (a *ArchiveTrie) getView(block uint64) (*LiveTrie, error) {
 	return getTrieView(rootRef, a.forest), nil
 }
 
+// getAccountView returns a view on the trie of the given block for querying
+// the given account. For partial archives, the view is restricted to the
+// accounts retained by the archive.
+func (a *ArchiveTrie) getAccountView(block uint64, account common.Address) (*LiveTrie, error) {
+	view, err := a.getView(block)
+	if err != nil || a.filter == nil {
+		return view, err
+	}
+	return a.filter.restrict(view, block, account)
+}
+
+// getRoots returns the roots of the blocks in the range [fromBlock, toBlock].
+func (a *ArchiveTrie) getRoots(fromBlock, toBlock uint64) ([]NodeReference, error) {
+	if err := a.CheckErrors(); err != nil {
+		return nil, err
+	}
+	if fromBlock > toBlock {
+		return nil, fmt.Errorf("invalid block range: %d > %d", fromBlock, toBlock)
+	}
+
+	a.rootsMutex.Lock()
+	defer a.rootsMutex.Unlock()
+	length := uint64(a.roots.length())
+	if toBlock >= length {
+		return nil, fmt.Errorf("invalid block: %d >= %d", toBlock, length)
+	}
+	res := make([]NodeReference, 0, toBlock-fromBlock+1)
+	for _, root := range a.roots.roots[fromBlock : toBlock+1] {
+		res = append(res, NewNodeReference(root.NodeRef.Id()))
+	}
+	return res, nil
+}
+
+// getRangeByBlock evaluates the given query on the views of the given account
+// for each block in the range [fromBlock, toBlock] individually.
+func getRangeByBlock[T any](a *ArchiveTrie, account common.Address, fromBlock, toBlock uint64, query func(*LiveTrie) (T, error)) ([]T, error) {
+	if fromBlock > toBlock {
+		return nil, fmt.Errorf("invalid block range: %d > %d", fromBlock, toBlock)
+	}
+	res := make([]T, 0, toBlock-fromBlock+1)
+	for block := fromBlock; block <= toBlock; block++ {
+		view, err := a.getAccountView(block, account)
+		if err != nil {
+			return nil, err
+		}
+		value, err := query(view)
+		if err != nil {
+			return nil, a.addError(err)
+		}
+		res = append(res, value)
+	}
+	return res, nil
+}
+
+// pathTracker is a NodeVisitor recording the IDs of the nodes on the path
+// visited for a lookup, to be compared with the path of the next lookup in a
+// different trie. Since archive nodes are immutable, a node shared by both
+// paths at the same position roots identical sub-tries. Thus, the rest of the
+// path does not need to be visited and the result of the previous lookup can
+// be reused.
+type pathTracker struct {
+	previous []NodeId         // the path of the previous lookup
+	current  []NodeId         // the path of the current lookup
+	path     []Nibble         // the remaining navigation path of the current lookup
+	buffer   nibblePathBuffer // the buffer the navigation path is converted into
+	address  common.Address   // the account targeted by the current lookup
+	storage  bool             // set if the current lookup continues in the storage trie of the account
+	reused   bool             // set if the current lookup reached a node of the previous path
+	info     AccountInfo      // the information of the last visited account node
+	root     NodeReference    // the storage root of the last visited account node
+	value    common.Value     // the value of the last visited value node
+}
+
+// lookupAccount visits the path to the given account in the trie rooted by
+// the given node. If the path reaches a node of the previous lookup, the
+// result is reused. Otherwise, found indicates whether the account exists and
+// its information is recorded in the tracker.
+func (t *pathTracker) lookupAccount(source NodeSource, root *NodeReference, address common.Address) (reused, found bool, err error) {
+	if t.begin(root, address, false) {
+		return true, false, nil
+	}
+	t.path = t.buffer.setAddress(address, source)
+	found, err = VisitPathToAccount(source, root, address, t)
+	return t.reused, found, err
+}
+
+// lookupValue is the counterpart of lookupAccount for storage slots, recording
+// the value of the slot in the tracker if it exists.
+func (t *pathTracker) lookupValue(source NodeSource, root *NodeReference, address common.Address, key common.Key) (reused, found bool, err error) {
+	if t.begin(root, address, true) {
+		return true, false, nil
+	}
+	t.path = t.buffer.setAddress(address, source)
+	found, err = VisitPathToAccount(source, root, address, t)
+	if err != nil || !found || t.reused {
+		return t.reused, false, err
+	}
+	t.path = t.buffer.setKey(key, source)
+	storage := t.root
+	found, err = VisitPathToStorage(source, &storage, key, t)
+	return t.reused, found, err
+}
+
+// begin starts a new lookup in the trie rooted by the given node. The result
+// is true if the root is shared with the previous lookup, in which case the
+// previous result can be reused without visiting any nodes.
+func (t *pathTracker) begin(root *NodeReference, address common.Address, storage bool) bool {
+	t.previous, t.current = t.current, t.previous[:0]
+	t.address = address
+	t.storage = storage
+	t.reused = false
+	return t.reuseIfShared(root)
+}
+
+// reuseIfShared checks whether the given node, which is to be visited next, is
+// on the previous path at the same position. If so, the rest of the previous
+// path is adopted and the lookup is marked as reused.
+func (t *pathTracker) reuseIfShared(next *NodeReference) bool {
+	pos := len(t.current)
+	if pos < len(t.previous) && t.previous[pos] == next.Id() {
+		t.current = append(t.current, t.previous[pos:]...)
+		t.reused = true
+	}
+	return t.reused
+}
+
+func (t *pathTracker) Visit(node Node, info NodeInfo) VisitResponse {
+	t.current = append(t.current, info.Id)
+	var next *NodeReference
+	switch n := node.(type) {
+	case *BranchNode:
+		if len(t.path) > 0 {
+			next = &n.children[t.path[0]]
+			t.path = t.path[1:]
+		}
+	case *ExtensionNode:
+		if n.path.IsPrefixOf(t.path) {
+			next = &n.next
+			t.path = t.path[n.path.Length():]
+		}
+	case *AccountNode:
+		t.info = n.info
+		t.root = NewNodeReference(n.storage.Id())
+		if t.storage && n.address == t.address {
+			next = &n.storage
+		}
+	case *ValueNode:
+		t.value = n.value
+	}
+	// Shared nodes are detected before descending to avoid fetching them.
+	if next != nil && t.reuseIfShared(next) {
+		return VisitResponseAbort
+	}
+	return VisitResponseContinue
+}
+
+// freeze freezes the trie rooted by the given node after a block has been
+// applied. Partial archives only freeze the parts needed for retaining the
+// history of archived accounts.
+func (a *ArchiveTrie) freeze(root *NodeReference) error {
+	if a.filter == nil {
+		return a.forest.Freeze(root)
+	}
+	freezing, ok := a.forest.(accountPathFreezing)
+	if !ok {
+		return fmt.Errorf("partial freezing is not supported by %T", a.forest)
+	}
+	return freezing.freezeAccountPaths(root, a.filter.getRegisteredAccounts())
+}
+
 // CheckErrors returns a non-nil error should any error
 // happen during any operation in this archive.
 // In particular, updating this archive or getting
@@ -364,6 +875,7 @@ type rootList struct {
 	roots          []Root
 	filename       string
 	numRootsInFile int
+	encoder        nodeIdEncoder // the encoding of root IDs in the file
 }
 
 func (l *rootList) length() int {
@@ -378,10 +890,10 @@ func (l *rootList) append(r Root) {
 	l.roots = append(l.roots, r)
 }
 
-func loadRoots(filename string) (rootList, error) {
+func loadRoots(filename string, encoder nodeIdEncoder) (rootList, error) {
 	// If there is no file, initialize and return an empty list.
 	if _, err := os.Stat(filename); err != nil {
-		return rootList{filename: filename}, nil
+		return rootList{filename: filename, encoder: encoder}, nil
 	}
 
 	f, err := os.Open(filename)
@@ -390,7 +902,7 @@ func loadRoots(filename string) (rootList, error) {
 	}
 	defer f.Close()
 	reader := bufio.NewReader(f)
-	roots, err := loadRootsFrom(reader)
+	roots, err := loadRootsFrom(reader, encoder)
 	if err != nil {
 		return rootList{}, err
 	}
@@ -398,12 +910,12 @@ func loadRoots(filename string) (rootList, error) {
 		roots:          roots,
 		filename:       filename,
 		numRootsInFile: len(roots),
+		encoder:        encoder,
 	}, nil
 }
 
-func loadRootsFrom(reader io.Reader) ([]Root, error) {
+func loadRootsFrom(reader io.Reader, encoder nodeIdEncoder) ([]Root, error) {
 	res := []Root{}
-	encoder := NodeIdEncoder{}
 	buffer := make([]byte, encoder.GetEncodedSize())
 	var hash common.Hash
 	for {
@@ -424,8 +936,58 @@ func loadRootsFrom(reader io.Reader) ([]Root, error) {
 	}
 }
 
+// checkRoots validates the consistency of a list of roots loaded from disk.
+// Since roots are indexed by their position, blocks are implicitly ordered.
+// However, since archive nodes are immutable, a root may only re-appear in
+// directly succeeding blocks, which did not modify the state, and thus with
+// the same hash. Roots re-appearing after a different root indicate a block
+// which was recorded out of order.
+func checkRoots(roots []Root) error {
+	var errs []error
+	starts := make([]NodeId, 0, len(roots))
+	for i, root := range roots {
+		id := root.NodeRef.Id()
+		if i > 0 && roots[i-1].NodeRef.Id() == id {
+			if roots[i-1].Hash != root.Hash {
+				errs = append(errs, fmt.Errorf("inconsistent roots: blocks %d and %d share root %v but have hashes %x and %x", i-1, i, id, roots[i-1].Hash, root.Hash))
+			}
+			continue
+		}
+		if !id.IsEmpty() {
+			starts = append(starts, id)
+		}
+	}
+
+	// Sorting the IDs is used instead of a set to keep the memory overhead low
+	// for archives with a large number of blocks.
+	slices.Sort(starts)
+	duplicates := map[NodeId]struct{}{}
+	for i := 1; i < len(starts); i++ {
+		if starts[i-1] == starts[i] {
+			duplicates[starts[i]] = struct{}{}
+		}
+	}
+	if len(duplicates) > 0 {
+		first := map[NodeId]int{}
+		for i, root := range roots {
+			id := root.NodeRef.Id()
+			if _, found := duplicates[id]; !found || (i > 0 && roots[i-1].NodeRef.Id() == id) {
+				continue
+			}
+			if prev, found := first[id]; found {
+				errs = append(errs, fmt.Errorf("non-monotonic roots: root %v of block %d is a duplicate of the root of block %d", id, i, prev))
+			} else {
+				first[id] = i
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// StoreRoots writes the given roots to the given file using the encoding of
+// root IDs of archives not using wide node references.
 func StoreRoots(filename string, roots []Root) error {
-	list := rootList{roots: roots, filename: filename}
+	list := rootList{roots: roots, filename: filename, encoder: NodeIdEncoder{}}
 	return list.storeRoots()
 }
 
@@ -441,7 +1003,7 @@ func (l *rootList) storeRoots() error {
 	}
 	writer := bufio.NewWriter(f)
 	res := errors.Join(
-		storeRootsTo(writer, toBeWritten),
+		storeRootsTo(writer, toBeWritten, l.encoder),
 		writer.Flush(),
 		f.Close(),
 	)
@@ -451,11 +1013,14 @@ func (l *rootList) storeRoots() error {
 	return res
 }
 
-func storeRootsTo(writer io.Writer, roots []Root) error {
+func storeRootsTo(writer io.Writer, roots []Root, encoder nodeIdEncoder) error {
 	// Simple file format: [<node-id><state-hash>]*
-	encoder := NodeIdEncoder{}
-	buffer := make([]byte, encoder.GetEncodedSize())
+	size := encoder.GetEncodedSize()
+	buffer := make([]byte, size)
 	for _, root := range roots {
+		if size < 8 && uint64(root.NodeRef.id)>>(size*8) != 0 {
+			return fmt.Errorf("%w: root %v can not be encoded using %d bytes", stock.ErrIdSpaceExhausted, root.NodeRef.id, size)
+		}
 		encoder.Store(buffer, &root.NodeRef.id)
 		if _, err := writer.Write(buffer[:]); err != nil {
 			return err
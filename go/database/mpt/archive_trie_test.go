@@ -23,6 +23,7 @@ import (
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/Fantom-foundation/Carmen/go/backend/archive"
@@ -30,8 +31,10 @@ import (
 
 	"go.uber.org/mock/gomock"
 
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
 	"github.com/Fantom-foundation/Carmen/go/backend/utils"
 	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
 )
 
 // Note: most properties of the ArchiveTrie are tested through the common
@@ -458,6 +461,71 @@ func TestArchiveTrie_VerificationOfFreshArchivePasses(t *testing.T) {
 	}
 }
 
+func TestArchiveTrie_GetRoots_ListsHashesOfBlocksInRange(t *testing.T) {
+	archive, err := OpenArchiveTrie(t.TempDir(), S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to create empty archive, err %v", err)
+	}
+	defer archive.Close()
+
+	const numBlocks = 5
+	for i := 0; i < numBlocks; i++ {
+		if err := archive.Add(uint64(i), common.Update{
+			CreatedAccounts: []common.Address{{byte(i)}},
+			Nonces:          []common.NonceUpdate{{Account: common.Address{byte(i)}, Nonce: common.ToNonce(1)}},
+		}, nil); err != nil {
+			t.Fatalf("failed to add block %d: %v", i, err)
+		}
+	}
+
+	for from := uint64(0); from < numBlocks; from++ {
+		for to := from; to < numBlocks; to++ {
+			roots, err := archive.GetRoots(from, to)
+			if err != nil {
+				t.Fatalf("failed to get roots of [%d, %d]: %v", from, to, err)
+			}
+			if got, want := len(roots), int(to-from+1); got != want {
+				t.Errorf("unexpected number of roots for [%d, %d], wanted %d, got %d", from, to, want, got)
+			}
+			for block := from; block <= to; block++ {
+				want, err := archive.GetHash(block)
+				if err != nil {
+					t.Fatalf("failed to get hash of block %d: %v", block, err)
+				}
+				if got, found := roots[block]; !found || got != want {
+					t.Errorf("unexpected root of block %d, wanted %x, got %x, found %t", block, want, got, found)
+				}
+			}
+		}
+	}
+}
+
+func TestArchiveTrie_GetRoots_RejectsInvalidRanges(t *testing.T) {
+	archive, err := OpenArchiveTrie(t.TempDir(), S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to create empty archive, err %v", err)
+	}
+	defer archive.Close()
+
+	if _, err := archive.GetRoots(0, 0); err == nil {
+		t.Errorf("getting roots of an empty archive should fail")
+	}
+	for i := 0; i < 3; i++ {
+		if err := archive.Add(uint64(i), common.Update{}, nil); err != nil {
+			t.Fatalf("failed to add block %d: %v", i, err)
+		}
+	}
+	if _, err := archive.GetRoots(2, 1); err == nil {
+		t.Errorf("getting roots of an inverted range should fail")
+	}
+	if _, err := archive.GetRoots(1, 3); err == nil {
+		t.Errorf("getting roots of a range exceeding the block height should fail")
+	}
+	if _, err := archive.GetRoots(5, 7); err == nil {
+		t.Errorf("getting roots of a range beyond the block height should fail")
+	}
+}
+
 func TestArchiveTrie_Add_DuplicatedBlock(t *testing.T) {
 	for _, config := range allMptConfigs {
 		t.Run(config.Name, func(t *testing.T) {
@@ -467,6 +535,7 @@ func TestArchiveTrie_Add_DuplicatedBlock(t *testing.T) {
 			if err != nil {
 				t.Fatalf("failed to create empty archive, err %v", err)
 			}
+			defer archive.Close()
 
 			if err = archive.Add(2, common.Update{
 				CreatedAccounts: []common.Address{{1}, {2}},
@@ -476,13 +545,256 @@ func TestArchiveTrie_Add_DuplicatedBlock(t *testing.T) {
 
 			if err = archive.Add(2, common.Update{
 				CreatedAccounts: []common.Address{{1}, {2}},
-			}, nil); err == nil {
-				t.Errorf("adding duplicate block should fail")
+			}, nil); !errors.Is(err, ErrNonMonotonicBlock) {
+				t.Errorf("adding duplicate block should fail with %v, got %v", ErrNonMonotonicBlock, err)
 			}
 		})
 	}
 }
 
+func TestArchiveTrie_Add_NonMonotonicBlockIsRejectedWithBlockNumbers(t *testing.T) {
+	archive, err := OpenArchiveTrie(t.TempDir(), S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to create empty archive, err %v", err)
+	}
+	defer archive.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := archive.Add(uint64(i), common.Update{}, nil); err != nil {
+			t.Fatalf("failed to add block %d: %v", i, err)
+		}
+	}
+
+	err = archive.Add(1, common.Update{}, nil)
+	var issue *NonMonotonicBlockError
+	if !errors.As(err, &issue) {
+		t.Fatalf("unexpected error, wanted %T, got %v", issue, err)
+	}
+	if issue.Block != 1 || issue.Height != 2 {
+		t.Errorf("unexpected block numbers, wanted 1 and 2, got %d and %d", issue.Block, issue.Height)
+	}
+	if !errors.Is(err, ErrNonMonotonicBlock) {
+		t.Errorf("error should be %v, got %v", ErrNonMonotonicBlock, err)
+	}
+	if err := archive.CheckErrors(); err != nil {
+		t.Errorf("rejected blocks should not invalidate the archive, got %v", err)
+	}
+	if height, _, err := archive.GetBlockHeight(); err != nil || height != 2 {
+		t.Errorf("unexpected block height, wanted 2, got %d, err %v", height, err)
+	}
+}
+
+func TestArchiveTrie_Add_GapsAreAcceptedByDefault(t *testing.T) {
+	archive, err := OpenArchiveTrie(t.TempDir(), S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to create empty archive, err %v", err)
+	}
+	defer archive.Close()
+
+	if err := archive.Add(2, common.Update{}, nil); err != nil {
+		t.Fatalf("failed to add block 2: %v", err)
+	}
+	if err := archive.Add(5, common.Update{}, nil); err != nil {
+		t.Fatalf("failed to add block 5: %v", err)
+	}
+	if err := archive.Add(5, common.Update{}, nil); !errors.Is(err, ErrNonMonotonicBlock) {
+		t.Errorf("adding duplicate block should fail with %v, got %v", ErrNonMonotonicBlock, err)
+	}
+	if height, _, err := archive.GetBlockHeight(); err != nil || height != 5 {
+		t.Errorf("unexpected block height, wanted 5, got %d, err %v", height, err)
+	}
+}
+
+func TestArchiveTrie_Add_GapsAreRejectedIfEnabled(t *testing.T) {
+	archive, err := OpenArchiveTrieWithConfig(t.TempDir(), S5ArchiveConfig, ForestConfig{CacheCapacity: 1024, RejectGaps: true})
+	if err != nil {
+		t.Fatalf("failed to create empty archive, err %v", err)
+	}
+	defer archive.Close()
+
+	if err := archive.Add(1, common.Update{}, nil); !errors.Is(err, ErrBlockGap) {
+		t.Errorf("skipping block 0 should fail with %v, got %v", ErrBlockGap, err)
+	}
+	if err := archive.Add(0, common.Update{}, nil); err != nil {
+		t.Fatalf("failed to add block 0: %v", err)
+	}
+	if err := archive.Add(2, common.Update{}, nil); !errors.Is(err, ErrBlockGap) {
+		t.Errorf("skipping block 1 should fail with %v, got %v", ErrBlockGap, err)
+	}
+	if err := archive.Add(1, common.Update{}, nil); err != nil {
+		t.Fatalf("failed to add block 1: %v", err)
+	}
+	if err := archive.Add(1, common.Update{}, nil); !errors.Is(err, ErrNonMonotonicBlock) {
+		t.Errorf("adding duplicate block should fail with %v, got %v", ErrNonMonotonicBlock, err)
+	}
+	if err := archive.CheckErrors(); err != nil {
+		t.Errorf("rejected blocks should not invalidate the archive, got %v", err)
+	}
+	if height, _, err := archive.GetBlockHeight(); err != nil || height != 1 {
+		t.Errorf("unexpected block height, wanted 1, got %d, err %v", height, err)
+	}
+}
+
+func TestArchiveTrie_Add_SkippedBlocksAreRecordedAsUnchangedIfGapsAreAccepted(t *testing.T) {
+	archive, err := OpenArchiveTrie(t.TempDir(), S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to create empty archive, err %v", err)
+	}
+	defer archive.Close()
+
+	addr := common.Address{1}
+	if err := archive.Add(1, common.Update{
+		CreatedAccounts: []common.Address{addr},
+		Balances:        []common.BalanceUpdate{{Account: addr, Balance: common.Balance{12}}},
+	}, nil); err != nil {
+		t.Fatalf("failed to add block 1: %v", err)
+	}
+	if err := archive.Add(4, common.Update{}, nil); err != nil {
+		t.Fatalf("failed to add block 4: %v", err)
+	}
+
+	want, err := archive.GetHash(1)
+	if err != nil {
+		t.Fatalf("failed to get hash of block 1: %v", err)
+	}
+	for block := uint64(2); block <= 4; block++ {
+		if got, err := archive.GetHash(block); err != nil || got != want {
+			t.Errorf("unexpected hash of block %d, wanted %x, got %x, err %v", block, want, got, err)
+		}
+		if balance, err := archive.GetBalance(block, addr); err != nil || balance != (common.Balance{12}) {
+			t.Errorf("unexpected balance in block %d, wanted 12, got %v, err %v", block, balance, err)
+		}
+	}
+}
+
+func TestArchiveTrie_Add_OnlyOneOfConcurrentAddsOfTheSameBlockSucceeds(t *testing.T) {
+	archive, err := OpenArchiveTrie(t.TempDir(), S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to create empty archive, err %v", err)
+	}
+	defer archive.Close()
+
+	const N = 8
+	var wg sync.WaitGroup
+	errs := make([]error, N)
+	for i := 0; i < N; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = archive.Add(0, common.Update{
+				CreatedAccounts: []common.Address{{byte(i)}},
+				Nonces:          []common.NonceUpdate{{Account: common.Address{byte(i)}, Nonce: common.ToNonce(1)}},
+			}, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, err := range errs {
+		var issue *NonMonotonicBlockError
+		if err == nil {
+			succeeded++
+		} else if !errors.As(err, &issue) || issue.Block != 0 || issue.Height != 0 {
+			t.Errorf("unexpected error, wanted %T for block 0, got %v", issue, err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("exactly one add should succeed, got %d", succeeded)
+	}
+	if err := archive.Check(); err != nil {
+		t.Errorf("archive should be valid, got %v", err)
+	}
+}
+
+func TestArchiveTrie_Check_ReportsDuplicatedRootsOfBlocks(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := OpenArchiveTrie(dir, S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to create empty archive, err %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := archive.Add(uint64(i), common.Update{
+			CreatedAccounts: []common.Address{{byte(i)}},
+			Nonces:          []common.NonceUpdate{{Account: common.Address{byte(i)}, Nonce: common.ToNonce(1)}},
+		}, nil); err != nil {
+			t.Fatalf("failed to add block %d: %v", i, err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+
+	// Record the root of block 0 again, as if it was added out of order.
+	rootFile := filepath.Join(dir, "roots.dat")
+	roots, err := loadRoots(rootFile, NodeIdEncoder{})
+	if err != nil {
+		t.Fatalf("failed to load roots: %v", err)
+	}
+	if err := os.Remove(rootFile); err != nil {
+		t.Fatalf("failed to remove roots: %v", err)
+	}
+	if err := StoreRoots(rootFile, append(roots.roots, roots.roots[0])); err != nil {
+		t.Fatalf("failed to store roots: %v", err)
+	}
+
+	archive, err = OpenArchiveTrie(dir, S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+	if err := archive.Check(); err == nil || !strings.Contains(err.Error(), "non-monotonic roots") {
+		t.Errorf("duplicated roots should be reported, got %v", err)
+	}
+}
+
+func TestArchiveTrie_checkRoots(t *testing.T) {
+	root := func(id NodeId, hash byte) Root {
+		return Root{NewNodeReference(id), common.Hash{hash}}
+	}
+	tests := map[string]struct {
+		roots []Root
+		issue string
+	}{
+		"empty":            {},
+		"distinct roots":   {roots: []Root{root(BranchId(1), 1), root(BranchId(2), 2), root(AccountId(1), 3)}},
+		"unchanged blocks": {roots: []Root{root(BranchId(1), 1), root(BranchId(1), 1), root(BranchId(2), 2)}},
+		"empty roots":      {roots: []Root{root(EmptyId(), 1), root(BranchId(1), 2), root(EmptyId(), 1)}},
+		"duplicated root": {
+			roots: []Root{root(BranchId(1), 1), root(BranchId(2), 2), root(BranchId(1), 1)},
+			issue: "root B-1 of block 2 is a duplicate of the root of block 0",
+		},
+		"inconsistent hashes": {
+			roots: []Root{root(BranchId(1), 1), root(BranchId(1), 2)},
+			issue: "blocks 0 and 1 share root B-1",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := checkRoots(test.roots)
+			if test.issue == "" && err != nil {
+				t.Errorf("unexpected issue: %v", err)
+			}
+			if test.issue != "" && (err == nil || !strings.Contains(err.Error(), test.issue)) {
+				t.Errorf("expected issue %q, got %v", test.issue, err)
+			}
+		})
+	}
+}
+
+// closeArchiveOnCleanup closes the given archive once the test is done. The
+// head and forest replaced by mocks to inject failures are restored before,
+// such that the resources of the archive are released.
+func closeArchiveOnCleanup(t *testing.T, archive *ArchiveTrie) {
+	t.Helper()
+	head, forest := archive.head, archive.forest
+	t.Cleanup(func() {
+		archive.head, archive.forest = head, forest
+		if err := archive.Close(); err != nil {
+			t.Logf("failed to close archive: %v", err)
+		}
+	})
+}
+
 func TestArchiveTrie_Add_UpdateFailsHashing(t *testing.T) {
 	for _, config := range allMptConfigs {
 		t.Run(config.Name, func(t *testing.T) {
@@ -492,6 +804,7 @@ func TestArchiveTrie_Add_UpdateFailsHashing(t *testing.T) {
 			if err != nil {
 				t.Fatalf("failed to create empty archive, err %v", err)
 			}
+			closeArchiveOnCleanup(t, archive)
 
 			// inject a failing hasher
 			var injectedError = errors.New("injectedError")
@@ -568,6 +881,7 @@ func TestArchiveTrie_Add_LiveStateFailsHashing(t *testing.T) {
 			if err != nil {
 				t.Fatalf("failed to create empty archive, err %v", err)
 			}
+			closeArchiveOnCleanup(t, archive)
 
 			// inject a failing hasher
 			var injectedError = errors.New("injectedError")
@@ -595,6 +909,7 @@ func TestArchiveTrie_Add_LiveStateFailsCreateAccount(t *testing.T) {
 			if err != nil {
 				t.Fatalf("failed to create empty archive, err %v", err)
 			}
+			closeArchiveOnCleanup(t, archive)
 
 			// inject a failing hasher
 			var injectedError = errors.New("injectedError")
@@ -622,6 +937,7 @@ func TestArchiveTrie_Add_FreezingFails(t *testing.T) {
 			if err != nil {
 				t.Fatalf("failed to openarchive, err %v", err)
 			}
+			closeArchiveOnCleanup(t, archive)
 
 			// inject failing stock to trigger an error applying the update
 			var injectedErr = errors.New("failed to get value from stock")
@@ -650,6 +966,7 @@ func TestArchiveTrie_GettingView_Block_OutOfRange(t *testing.T) {
 			if err != nil {
 				t.Fatalf("failed to create empty archive, err %v", err)
 			}
+			defer archive.Close()
 
 			if _, err := archive.Exists(100, common.Address{1}); err == nil {
 				t.Errorf("block out of range should fail")
@@ -749,6 +1066,7 @@ func TestArchiveTrie_GetHash(t *testing.T) {
 			if err != nil {
 				t.Fatalf("failed to create empty archive, err %v", err)
 			}
+			defer archive.Close()
 
 			hash, err := archive.GetHash(0)
 			if err != nil {
@@ -774,6 +1092,7 @@ func TestArchiveTrie_CannotGet_AccountHash(t *testing.T) {
 			if err != nil {
 				t.Fatalf("failed to create empty archive, err %v", err)
 			}
+			defer archive.Close()
 			if _, err := archive.GetAccountHash(0, common.Address{1}); err == nil {
 				t.Errorf("getting account hash should always fail")
 			}
@@ -1017,6 +1336,7 @@ func TestArchiveTrie_GetMemoryFootprint(t *testing.T) {
 			if err != nil {
 				t.Fatalf("failed to create empty archive, err %v", err)
 			}
+			defer archive.Close()
 
 			mf := archive.GetMemoryFootprint()
 			if child := mf.GetChild("head"); child == nil {
@@ -1037,6 +1357,7 @@ func TestArchiveTrie_Dump(t *testing.T) {
 			if err != nil {
 				t.Fatalf("failed to create empty archive, err %v", err)
 			}
+			defer archive.Close()
 
 			if err = archive.Add(0, common.Update{
 				CreatedAccounts: []common.Address{{1}},
@@ -1145,12 +1466,12 @@ func TestArchiveTrie_CanLoadRootsFromJunkySource(t *testing.T) {
 
 	var b bytes.Buffer
 	writer := bufio.NewWriter(&b)
-	storeRootsTo(writer, roots)
+	storeRootsTo(writer, roots, NodeIdEncoder{})
 	writer.Flush()
 
 	for _, size := range []int{1, 2, 4, 1024} {
 		reader := utils.NewChunkReader(b.Bytes(), size)
-		res, err := loadRootsFrom(reader)
+		res, err := loadRootsFrom(reader, NodeIdEncoder{})
 		if err != nil {
 			t.Fatalf("error loading roots: %v", err)
 		}
@@ -1162,7 +1483,7 @@ func TestArchiveTrie_CanLoadRootsFromJunkySource(t *testing.T) {
 
 func TestArchiveTrie_StoreLoadRoots(t *testing.T) {
 	file := filepath.Join(t.TempDir(), "roots.dat")
-	original, err := loadRoots(file)
+	original, err := loadRoots(file, NodeIdEncoder{})
 	if err != nil {
 		t.Fatalf("failed to load roots: %v", err)
 	}
@@ -1180,7 +1501,7 @@ func TestArchiveTrie_StoreLoadRoots(t *testing.T) {
 		t.Fatalf("failed to store roots: %v", err)
 	}
 
-	restored, err := loadRoots(file)
+	restored, err := loadRoots(file, NodeIdEncoder{})
 	if err != nil {
 		t.Fatalf("failed to load roots: %v", err)
 	}
@@ -1199,7 +1520,7 @@ func TestArchiveTrie_StoreLoadRoots(t *testing.T) {
 
 func TestArchiveTrie_RootListStoreOnlyWritesNewRoots(t *testing.T) {
 	file := filepath.Join(t.TempDir(), "roots.dat")
-	list, err := loadRoots(file)
+	list, err := loadRoots(file, NodeIdEncoder{})
 	if err != nil {
 		t.Fatalf("failed to load roots: %v", err)
 	}
@@ -1221,7 +1542,7 @@ func TestArchiveTrie_RootListStoreOnlyWritesNewRoots(t *testing.T) {
 	}
 
 	// Loading the second file should only produce 2 roots.
-	restored, err := loadRoots(list.filename)
+	restored, err := loadRoots(list.filename, NodeIdEncoder{})
 	if err != nil {
 		t.Fatalf("failed to load roots: %v", err)
 	}
@@ -1232,7 +1553,7 @@ func TestArchiveTrie_RootListStoreOnlyWritesNewRoots(t *testing.T) {
 
 func TestArchiveTrie_IncrementalRootListUpdates(t *testing.T) {
 	file := filepath.Join(t.TempDir(), "roots.dat")
-	list, err := loadRoots(file)
+	list, err := loadRoots(file, NodeIdEncoder{})
 	if err != nil {
 		t.Fatalf("failed to load roots: %v", err)
 	}
@@ -1251,7 +1572,7 @@ func TestArchiveTrie_IncrementalRootListUpdates(t *testing.T) {
 			t.Fatalf("failed to store roots: %v", err)
 		}
 
-		restored, err := loadRoots(file)
+		restored, err := loadRoots(file, NodeIdEncoder{})
 		if err != nil {
 			t.Fatalf("failed to reload roots: %v", err)
 		}
@@ -1272,7 +1593,7 @@ func TestArchiveTrie_DirectlyStoredRootsCanBeRestored(t *testing.T) {
 	if err := StoreRoots(file, roots); err != nil {
 		t.Fatalf("failed to store roots: %v", err)
 	}
-	restored, err := loadRoots(file)
+	restored, err := loadRoots(file, NodeIdEncoder{})
 	if err != nil {
 		t.Fatalf("failed to load roots: %v", err)
 	}
@@ -1283,7 +1604,7 @@ func TestArchiveTrie_DirectlyStoredRootsCanBeRestored(t *testing.T) {
 
 func TestArchiveTrie_FileAccessErrorWhenStoringRootsIsDetected(t *testing.T) {
 	file := filepath.Join(t.TempDir(), "roots.dat")
-	list, err := loadRoots(file)
+	list, err := loadRoots(file, NodeIdEncoder{})
 	if err != nil {
 		t.Fatalf("failed to load roots: %v", err)
 	}
@@ -1427,7 +1748,7 @@ func TestStoreRootsTo_WriterFailures(t *testing.T) {
 	osfile := utils.NewMockOsFile(ctrl)
 	osfile.EXPECT().Write(gomock.Any()).Return(0, injectedErr)
 
-	if err := storeRootsTo(osfile, roots); !errors.Is(err, injectedErr) {
+	if err := storeRootsTo(osfile, roots, NodeIdEncoder{}); !errors.Is(err, injectedErr) {
 		t.Errorf("writing roots should fail")
 	}
 }
@@ -1447,7 +1768,7 @@ func TestStoreRootsTo_SecondWriterFailures(t *testing.T) {
 		osfile.EXPECT().Write(gomock.Any()).Return(0, injectedErr),
 	)
 
-	if err := storeRootsTo(osfile, roots); !errors.Is(err, injectedErr) {
+	if err := storeRootsTo(osfile, roots, NodeIdEncoder{}); !errors.Is(err, injectedErr) {
 		t.Errorf("writing roots should fail")
 	}
 }
@@ -1488,6 +1809,7 @@ func TestArchiveTrie_FailingGetterOperation_InvalidatesArchive(t *testing.T) {
 			db.EXPECT().Freeze(gomock.Any())
 			db.EXPECT().CheckAll(gomock.Any())
 			db.EXPECT().GetAccountInfo(gomock.Any(), gomock.Any()).Return(AccountInfo{}, false, injectedErr).MaxTimes(1)
+			db.EXPECT().HasAccount(gomock.Any(), gomock.Any()).Return(false, injectedErr).MaxTimes(1)
 			db.EXPECT().GetValue(gomock.Any(), gomock.Any(), gomock.Any()).Return(common.Value{}, injectedErr).MaxTimes(1)
 
 			archive, err := OpenArchiveTrie(t.TempDir(), S4ArchiveConfig, 1000)
@@ -1579,6 +1901,8 @@ func TestArchiveTrie_FailingLiveStateUpdate_InvalidatesArchive(t *testing.T) {
 			if err != nil {
 				t.Fatalf("cannot open archive: %v", err)
 			}
+			head := archive.head
+			defer head.closeWithError(nil)
 			archive.head = liveState
 			archive.forest = db
 
@@ -1664,3 +1988,272 @@ func BenchmarkArchiveFlush_Roots(b *testing.B) {
 		}
 	}
 }
+
+// fillArchiveWithSparseChanges adds the given number of blocks to the given
+// archive. Every period-th block updates a few random accounts and slots of a
+// small set, all other blocks are empty.
+func fillArchiveWithSparseChanges(t testing.TB, archive *ArchiveTrie, numBlocks int, period int) {
+	t.Helper()
+	r := rand.New(rand.NewSource(42))
+	for block := 0; block < numBlocks; block++ {
+		update := common.Update{}
+		if block%period != 0 {
+			if err := archive.Add(uint64(block), update, nil); err != nil {
+				t.Fatalf("failed to add block %d: %v", block, err)
+			}
+			continue
+		}
+		if block == 0 {
+			for i := 0; i < 16; i++ {
+				update.AppendCreateAccount(common.Address{byte(i)})
+				update.AppendNonceUpdate(common.Address{byte(i)}, common.ToNonce(1))
+			}
+		}
+		seen := map[common.Address]bool{}
+		for i := 0; i < 2; i++ {
+			addr := common.Address{byte(r.Intn(16))}
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			switch r.Intn(10) {
+			case 0:
+				if block > 0 {
+					update.AppendDeleteAccount(addr)
+				}
+			case 1, 2, 3:
+				update.AppendBalanceUpdate(addr, common.Balance{byte(block), byte(block >> 8)})
+			default:
+				update.AppendSlotUpdate(addr, common.Key{byte(r.Intn(4))}, common.Value{byte(block), byte(block >> 8), 1})
+			}
+		}
+		if err := archive.Add(uint64(block), update, nil); err != nil {
+			t.Fatalf("failed to add block %d: %v", block, err)
+		}
+	}
+}
+
+func TestArchiveTrie_RangeQueriesMatchSingleBlockQueries(t *testing.T) {
+	const numBlocks = 200
+	for _, config := range []MptConfig{S4ArchiveConfig, S5ArchiveConfig} {
+		for _, period := range []int{1, 3} {
+			t.Run(fmt.Sprintf("%s/period=%d", config.Name, period), func(t *testing.T) {
+				archive, err := OpenArchiveTrie(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open archive: %v", err)
+				}
+				defer archive.Close()
+				fillArchiveWithSparseChanges(t, archive, numBlocks, period)
+
+				for _, addr := range []common.Address{{0}, {3}, {15}, {16}} {
+					infos, err := archive.GetAccountInfoRange(addr, 10, numBlocks-1)
+					if err != nil {
+						t.Fatalf("failed to get account info range: %v", err)
+					}
+					if want, got := numBlocks-10, len(infos); want != got {
+						t.Fatalf("unexpected number of results, wanted %d, got %d", want, got)
+					}
+					for i, got := range infos {
+						view, err := archive.getView(uint64(10 + i))
+						if err != nil {
+							t.Fatalf("failed to get view: %v", err)
+						}
+						want, _, err := view.GetAccountInfo(addr)
+						if err != nil {
+							t.Fatalf("failed to get account info: %v", err)
+						}
+						if want != got {
+							t.Errorf("unexpected info of account %v in block %d, wanted %v, got %v", addr, 10+i, want, got)
+						}
+					}
+
+					for _, key := range []common.Key{{0}, {3}, {4}} {
+						values, err := archive.GetStorageRange(addr, key, 0, numBlocks-1)
+						if err != nil {
+							t.Fatalf("failed to get storage range: %v", err)
+						}
+						if want, got := numBlocks, len(values); want != got {
+							t.Fatalf("unexpected number of results, wanted %d, got %d", want, got)
+						}
+						for block, got := range values {
+							want, err := archive.GetStorage(uint64(block), addr, key)
+							if err != nil {
+								t.Fatalf("failed to get storage: %v", err)
+							}
+							if want != got {
+								t.Errorf("unexpected value of slot %v/%v in block %d, wanted %v, got %v", addr, key, block, want, got)
+							}
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestArchiveTrie_RangeQueriesOfPartialArchivesMatchSingleBlockQueries(t *testing.T) {
+	const numBlocks = 50
+	archive, err := OpenPartialArchiveTrie(t.TempDir(), S5ArchiveConfig, ForestConfig{CacheCapacity: 1024}, NewAccountListFilter(common.Address{1}))
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+	fillArchiveWithSparseChanges(t, archive, numBlocks, 1)
+
+	values, err := archive.GetStorageRange(common.Address{1}, common.Key{1}, 0, numBlocks-1)
+	if err != nil {
+		t.Fatalf("failed to get storage range: %v", err)
+	}
+	for block, got := range values {
+		want, err := archive.GetStorage(uint64(block), common.Address{1}, common.Key{1})
+		if err != nil {
+			t.Fatalf("failed to get storage: %v", err)
+		}
+		if want != got {
+			t.Errorf("unexpected value in block %d, wanted %v, got %v", block, want, got)
+		}
+	}
+
+	if _, err := archive.GetAccountInfoRange(common.Address{2}, 0, numBlocks-1); !errors.Is(err, ErrNotArchived) {
+		t.Errorf("querying an account not retained by the archive should fail, got %v", err)
+	}
+}
+
+func TestArchiveTrie_RangeQueriesDetectInvalidRanges(t *testing.T) {
+	archive, err := OpenArchiveTrie(t.TempDir(), S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+	fillArchiveWithSparseChanges(t, archive, 10, 1)
+
+	for _, r := range [][2]uint64{{5, 4}, {0, 10}, {10, 12}} {
+		if _, err := archive.GetAccountInfoRange(common.Address{1}, r[0], r[1]); err == nil {
+			t.Errorf("range %v should be rejected for account infos", r)
+		}
+		if _, err := archive.GetStorageRange(common.Address{1}, common.Key{1}, r[0], r[1]); err == nil {
+			t.Errorf("range %v should be rejected for storage values", r)
+		}
+	}
+}
+
+// lookupCountingNodeCache counts the number of nodes resolved through a cache.
+type lookupCountingNodeCache struct {
+	NodeCache
+	lookups atomic.Int64
+}
+
+func (c *lookupCountingNodeCache) Get(r *NodeReference) (*shared.Shared[Node], bool) {
+	c.lookups.Add(1)
+	return c.NodeCache.Get(r)
+}
+
+func BenchmarkArchiveTrie_AccountInfoOfManyBlocks(b *testing.B) {
+	const numBlocks = 10_000
+	archive, err := OpenArchiveTrie(b.TempDir(), S5ArchiveConfig, 1<<16)
+	if err != nil {
+		b.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+	fillArchiveWithSparseChanges(b, archive, numBlocks, 10)
+
+	forest := archive.forest.(*Forest)
+	cache := &lookupCountingNodeCache{NodeCache: forest.nodeCache}
+	forest.nodeCache = cache
+	defer func() { forest.nodeCache = cache.NodeCache }()
+
+	addr := common.Address{7}
+	b.Run("single", func(b *testing.B) {
+		cache.lookups.Store(0)
+		for i := 0; i < b.N; i++ {
+			for block := uint64(0); block < numBlocks; block++ {
+				if _, err := archive.GetBalance(block, addr); err != nil {
+					b.Fatalf("failed to get balance: %v", err)
+				}
+			}
+		}
+		b.ReportMetric(float64(cache.lookups.Load())/float64(b.N), "node-lookups/op")
+	})
+	b.Run("range", func(b *testing.B) {
+		cache.lookups.Store(0)
+		for i := 0; i < b.N; i++ {
+			if _, err := archive.GetAccountInfoRange(addr, 0, numBlocks-1); err != nil {
+				b.Fatalf("failed to get account info range: %v", err)
+			}
+		}
+		b.ReportMetric(float64(cache.lookups.Load())/float64(b.N), "node-lookups/op")
+	})
+}
+
+func TestArchiveTrie_RootsWithWideIdsCanOnlyBeStoredUsingWideEncoding(t *testing.T) {
+	roots := []Root{
+		{NewNodeReference(BranchId(12)), common.Hash{12}},
+		{NewNodeReference(BranchId(1<<50 + 14)), common.Hash{14}},
+	}
+
+	var b bytes.Buffer
+	if err := storeRootsTo(&b, roots, NodeIdEncoder{}); !errors.Is(err, stock.ErrIdSpaceExhausted) {
+		t.Errorf("storing roots exceeding the narrow encoding should fail, got %v", err)
+	}
+
+	b.Reset()
+	if err := storeRootsTo(&b, roots, WideNodeIdEncoder{}); err != nil {
+		t.Fatalf("failed to store roots: %v", err)
+	}
+	res, err := loadRootsFrom(&b, WideNodeIdEncoder{})
+	if err != nil {
+		t.Fatalf("error loading roots: %v", err)
+	}
+	if !reflect.DeepEqual(roots, res) {
+		t.Errorf("failed to restore roots, wanted %v, got %v", roots, res)
+	}
+}
+
+func TestArchiveTrie_WideNodeReferencesProduceSameHashesAndCanBeReopened(t *testing.T) {
+	dirs := map[string]string{}
+	hashes := map[string]common.Hash{}
+	for _, config := range []MptConfig{S5ArchiveConfig, S5ArchiveWideReferencesConfig} {
+		dir := t.TempDir()
+		dirs[config.Name] = dir
+		archive, err := OpenArchiveTrie(dir, config, 1024)
+		if err != nil {
+			t.Fatalf("failed to open archive: %v", err)
+		}
+		for block := uint64(0); block < 5; block++ {
+			update := common.Update{
+				CreatedAccounts: []common.Address{{byte(block)}},
+				Nonces:          []common.NonceUpdate{{Account: common.Address{byte(block)}, Nonce: common.ToNonce(block + 1)}},
+				Slots:           []common.SlotUpdate{{Account: common.Address{byte(block)}, Key: common.Key{1}, Value: common.Value{byte(block + 1)}}},
+			}
+			if err := archive.Add(block, update, nil); err != nil {
+				t.Fatalf("failed to add block %d: %v", block, err)
+			}
+		}
+		hash, err := archive.GetHash(4)
+		if err != nil {
+			t.Fatalf("failed to get hash: %v", err)
+		}
+		hashes[config.Name] = hash
+		if err := archive.Close(); err != nil {
+			t.Fatalf("failed to close archive: %v", err)
+		}
+	}
+	if want, got := hashes[S5ArchiveConfig.Name], hashes[S5ArchiveWideReferencesConfig.Name]; want != got {
+		t.Errorf("width of node references should not affect hashes, wanted %x, got %x", want, got)
+	}
+
+	archive, err := OpenArchiveTrie(dirs[S5ArchiveWideReferencesConfig.Name], S5ArchiveWideReferencesConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to reopen archive: %v", err)
+	}
+	defer archive.Close()
+	for block := uint64(0); block < 5; block++ {
+		value, err := archive.GetStorage(block, common.Address{byte(block)}, common.Key{1})
+		if err != nil || value != (common.Value{byte(block + 1)}) {
+			t.Errorf("unexpected value in block %d, got %v, %v", block, value, err)
+		}
+	}
+	if _, err := OpenArchiveTrie(dirs[S5ArchiveWideReferencesConfig.Name], S5ArchiveConfig, 1024); err == nil {
+		t.Errorf("opening archive using narrow node references should fail")
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// Deleting accounts or slots may leave branch nodes with a single child,
+// which are then collapsed into an extension or leaf node. If siblings are
+// deleted and re-created within the same block, the affected part of the trie
+// is restructured repeatedly. To avoid this, the collapse of branch nodes may
+// be deferred to the end of a batch update. Within the batch, branch nodes
+// with less than two children are retained. At the end of the batch, all
+// such branches are collapsed in a single pass, producing the same trie
+// structure as if collapses had been conducted eagerly.
+
+// branchCollapseDeferral is an optional interface of node managers
+// supporting the deferral of branch collapses to the end of batch updates.
+type branchCollapseDeferral interface {
+	// tryDeferBranchCollapse is called by branch nodes left with less than
+	// two children. If true is returned, the branch is to be retained and
+	// collapsed at the end of the ongoing batch update. If false is
+	// returned, the branch needs to be collapsed immediately.
+	tryDeferBranchCollapse() bool
+}
+
+// branchCollapseDeferring is an optional interface of databases supporting
+// batch updates deferring the collapse of branch nodes.
+type branchCollapseDeferring interface {
+	// beginDeferredCollapse starts a batch update. It returns the batch
+	// through which all updates of the batch are to be applied, or false if
+	// deferring collapses is not enabled, in which case no batch is started.
+	beginDeferredCollapse() (collapseDeferringBatch, bool)
+}
+
+// collapseDeferringBatch is a database retaining the state of a batch update
+// deferring the collapse of branch nodes. Since the state is kept by the
+// batch, batch updates of different tries sharing a forest are independent.
+type collapseDeferringBatch interface {
+	Database
+	// endDeferredCollapse ends this batch, collapsing all retained branches
+	// in the trie with the given root. The new root of the trie is returned.
+	endDeferredCollapse(rootRef *NodeReference) (NodeReference, error)
+}
+
+// runBatch runs the given operation as a batch update on this trie. If
+// enabled by the forest, collapses of branch nodes and deletions of slots are
+// deferred until all modifications of the batch have been applied.
+func (s *LiveTrie) runBatch(apply func() error) error {
+	if deleting, ok := s.forest.(slotDeletionDeferring); ok && deleting.beginDeferredSlotDeletion() {
+		inner := apply
+		apply = func() error {
+			err := inner()
+			root, deletionErr := deleting.endDeferredSlotDeletion(&s.root)
+			if deletionErr != nil {
+				return errors.Join(err, deletionErr)
+			}
+			s.root = root
+			return err
+		}
+	}
+	deferring, ok := s.forest.(branchCollapseDeferring)
+	if !ok || s.batch != nil {
+		return apply()
+	}
+	batch, ok := deferring.beginDeferredCollapse()
+	if !ok {
+		return apply()
+	}
+	s.batch = batch
+	err := apply()
+	s.batch = nil
+	root, collapseErr := batch.endDeferredCollapse(&s.root)
+	if collapseErr != nil {
+		return errors.Join(err, collapseErr)
+	}
+	s.root = root
+	return err
+}
+
+// getUpdateTarget returns the database updates of this trie are applied to,
+// which is the ongoing batch deferring branch collapses, if any.
+func (s *LiveTrie) getUpdateTarget() Database {
+	if s.batch != nil {
+		return s.batch
+	}
+	return s.forest
+}
+
+func (s *Forest) beginDeferredCollapse() (collapseDeferringBatch, bool) {
+	if !s.deferBranchCollapse {
+		return nil, false
+	}
+	return &deferredCollapseBatch{Forest: s}, true
+}
+
+// deferredCollapseBatch is the collapseDeferringBatch of forests. It is used
+// as the node manager for the updates of the batch, such that branch nodes
+// can retain themselves for being collapsed at the end of the batch. Node
+// visits of these updates are not covered by operation statistics.
+type deferredCollapseBatch struct {
+	*Forest
+	// Set if a branch node has been retained for being collapsed later.
+	pending atomic.Bool
+}
+
+func (b *deferredCollapseBatch) tryDeferBranchCollapse() bool {
+	b.pending.Store(true)
+	return true
+}
+
+func (b *deferredCollapseBatch) SetAccountInfo(rootRef *NodeReference, addr common.Address, info AccountInfo) (NodeReference, error) {
+	defer b.timer.stop(descentPhase, b.timer.start())
+	return b.setAccountInfo(b, rootRef, addr, info)
+}
+
+func (b *deferredCollapseBatch) SetValue(rootRef *NodeReference, addr common.Address, key common.Key, value common.Value) (NodeReference, error) {
+	defer b.timer.stop(descentPhase, b.timer.start())
+	return b.setValue(b, rootRef, addr, key, value)
+}
+
+func (b *deferredCollapseBatch) SetSlots(rootRef *NodeReference, addr common.Address, updates []SlotUpdate) (NodeReference, bool, error) {
+	defer b.timer.stop(descentPhase, b.timer.start())
+	return b.setSlots(b, rootRef, addr, updates)
+}
+
+func (b *deferredCollapseBatch) endDeferredCollapse(rootRef *NodeReference) (NodeReference, error) {
+	if !b.pending.Swap(false) {
+		return *rootRef, nil
+	}
+	pathLength := byte(2 * len(common.Address{}))
+	if b.config.UseHashedPaths {
+		pathLength = byte(2 * len(common.Hash{}))
+	}
+	newRoot, err := collapseBranches(b.Forest, rootRef, pathLength)
+	if err != nil {
+		err = fmt.Errorf("failed to collapse branch nodes: %w", err)
+		b.errors = append(b.errors, err)
+	}
+	return newRoot, err
+}
+
+// collapseBranches collapses all branch nodes with less than two children in
+// the trie rooted by the given node, which is at the given number of nibbles
+// from the end of its path. Since branches retained by deferred collapses
+// have been modified in the ongoing batch, only nodes reachable through
+// dirty hashes are visited. The new root of the trie is returned.
+func collapseBranches(manager NodeManager, ref *NodeReference, pathLength byte) (NodeReference, error) {
+	if ref.Id().IsEmpty() || ref.Id().IsValue() {
+		return *ref, nil
+	}
+	handle, err := manager.getWriteAccess(ref)
+	if err != nil {
+		return NodeReference{}, err
+	}
+	defer handle.Release()
+	if handle.Get().IsFrozen() {
+		return *ref, nil
+	}
+	switch node := handle.Get().(type) {
+	case *BranchNode:
+		return node.collapseBranches(manager, ref, pathLength)
+	case *ExtensionNode:
+		return node.collapseBranches(manager, ref, pathLength)
+	case *AccountNode:
+		return node.collapseBranches(manager, ref)
+	}
+	return *ref, nil
+}
+
+func (n *BranchNode) collapseBranches(manager NodeManager, thisRef *NodeReference, pathLength byte) (NodeReference, error) {
+	for i, child := range n.children {
+		if child.Id().IsEmpty() || !n.isChildHashDirty(byte(i)) {
+			continue
+		}
+		newChild, err := collapseBranches(manager, &child, pathLength-1)
+		if err != nil {
+			return NodeReference{}, err
+		}
+		if newChild == child {
+			continue
+		}
+		n.children[i] = newChild
+		n.setChildFrozen(byte(i), false)
+		if newChild.Id().IsEmpty() {
+			n.markChildHashClean(byte(i))
+		}
+		n.markDirty(manager, thisRef)
+	}
+	if n.getNumChildren() < 2 {
+		return n.collapse(manager, thisRef, pathLength)
+	}
+	return *thisRef, nil
+}
+
+func (n *ExtensionNode) collapseBranches(manager NodeManager, thisRef *NodeReference, pathLength byte) (NodeReference, error) {
+	if !n.nextHashDirty {
+		return *thisRef, nil
+	}
+	next, err := collapseBranches(manager, &n.next, pathLength-byte(n.path.Length()))
+	if err != nil {
+		return NodeReference{}, err
+	}
+	if next == n.next {
+		return *thisRef, nil
+	}
+	newRoot, _, err := n.replaceNext(manager, thisRef, next, pathLength)
+	return newRoot, err
+}
+
+func (n *AccountNode) collapseBranches(manager NodeManager, thisRef *NodeReference) (NodeReference, error) {
+	if !n.storageHashDirty || n.storage.Id().IsEmpty() {
+		return *thisRef, nil
+	}
+	storage, err := collapseBranches(manager, &n.storage, byte(2*len(common.Key{})))
+	if err != nil {
+		return NodeReference{}, err
+	}
+	if storage != n.storage {
+		n.storage = storage
+		n.markDirty(manager, thisRef)
+	}
+	return *thisRef, nil
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestDeferredBranchCollapse_ProducesSameTrieAsEagerCollapse(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig, S5LiveNoExtensionsConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			eager, err := OpenGoFileStateWithConfig(t.TempDir(), config, ForestConfig{CacheCapacity: 1024})
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer eager.Close()
+			deferred, err := OpenGoFileStateWithConfig(t.TempDir(), config, ForestConfig{CacheCapacity: 1024, DeferBranchCollapse: true})
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer deferred.Close()
+
+			r := rand.New(rand.NewSource(42))
+			for block := uint64(0); block < 200; block++ {
+				update := getRandomUpdateWithDeletions(r)
+				if _, err := eager.Apply(block, update); err != nil {
+					t.Fatalf("failed to apply update to eager state: %v", err)
+				}
+				if _, err := deferred.Apply(block, update); err != nil {
+					t.Fatalf("failed to apply update to deferred state: %v", err)
+				}
+
+				if err := deferred.trie.Check(); err != nil {
+					t.Fatalf("invalid trie after block %d: %v", block, err)
+				}
+				want, err := eager.GetHash()
+				if err != nil {
+					t.Fatalf("failed to get hash: %v", err)
+				}
+				got, err := deferred.GetHash()
+				if err != nil {
+					t.Fatalf("failed to get hash: %v", err)
+				}
+				if want != got {
+					t.Fatalf("unexpected hash after block %d, wanted %x, got %x", block, want, got)
+				}
+				if want, got := getTrieShape(t, eager), getTrieShape(t, deferred); !slices.Equal(want, got) {
+					t.Fatalf("unexpected trie structure after block %d, wanted %v, got %v", block, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDeferredBranchCollapse_BranchesAreRetainedUntilEndOfBatch(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			forest, err := OpenVolatileForest(config, ForestConfig{Mode: Mutable, CacheCapacity: 1024, DeferBranchCollapse: true})
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+			trie := &LiveTrie{forest: forest}
+			defer trie.Close()
+
+			addr1 := common.Address{1}
+			addr2 := common.Address{2}
+			info := AccountInfo{Nonce: common.Nonce{1}}
+			for _, addr := range []common.Address{addr1, addr2} {
+				if err := trie.SetAccountInfo(addr, info); err != nil {
+					t.Fatalf("failed to set account: %v", err)
+				}
+			}
+
+			err = trie.runBatch(func() error {
+				if err := trie.SetAccountInfo(addr1, AccountInfo{}); err != nil {
+					return err
+				}
+				if trie.root.Id().IsAccount() {
+					t.Errorf("branch should be retained within batch")
+				}
+				if err := trie.Check(); err == nil {
+					t.Errorf("branch with a single child should be reported within batch")
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("failed to run batch: %v", err)
+			}
+
+			if !trie.root.Id().IsAccount() {
+				t.Errorf("branch should be collapsed at end of batch, got %v", trie.root.Id())
+			}
+			if err := trie.Check(); err != nil {
+				t.Errorf("invalid trie after batch: %v", err)
+			}
+		})
+	}
+}
+
+func TestDeferredBranchCollapse_BatchesDoNotAffectOtherTriesOfForest(t *testing.T) {
+	forest, err := OpenVolatileForest(S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024, DeferBranchCollapse: true})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	trie := &LiveTrie{forest: forest}
+	defer trie.Close()
+	other := &LiveTrie{forest: forest}
+
+	addr1 := common.Address{1}
+	addr2 := common.Address{2}
+	info := AccountInfo{Nonce: common.Nonce{1}}
+	for _, addr := range []common.Address{addr1, addr2} {
+		if err := other.SetAccountInfo(addr, info); err != nil {
+			t.Fatalf("failed to set account: %v", err)
+		}
+	}
+
+	err = trie.runBatch(func() error {
+		if err := other.SetAccountInfo(addr1, AccountInfo{}); err != nil {
+			return err
+		}
+		if !other.root.Id().IsAccount() {
+			t.Errorf("branch of other trie should be collapsed immediately, got %v", other.root.Id())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to run batch: %v", err)
+	}
+	if err := other.Check(); err != nil {
+		t.Errorf("invalid trie: %v", err)
+	}
+}
+
+func TestDeferredBranchCollapse_OperationsOutsideOfBatchesCollapseImmediately(t *testing.T) {
+	forest, err := OpenVolatileForest(S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024, DeferBranchCollapse: true})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	trie := &LiveTrie{forest: forest}
+	defer trie.Close()
+
+	addr1 := common.Address{1}
+	addr2 := common.Address{2}
+	info := AccountInfo{Nonce: common.Nonce{1}}
+	for _, addr := range []common.Address{addr1, addr2} {
+		if err := trie.SetAccountInfo(addr, info); err != nil {
+			t.Fatalf("failed to set account: %v", err)
+		}
+	}
+	if err := trie.SetAccountInfo(addr1, AccountInfo{}); err != nil {
+		t.Fatalf("failed to delete account: %v", err)
+	}
+	if !trie.root.Id().IsAccount() {
+		t.Errorf("branch should be collapsed immediately, got %v", trie.root.Id())
+	}
+	if err := trie.Check(); err != nil {
+		t.Errorf("invalid trie: %v", err)
+	}
+}
+
+// getRandomUpdateWithDeletions creates a random update on a small set of
+// accounts and keys sharing long prefixes, such that accounts and slots are
+// frequently deleted and re-created next to each other.
+func getRandomUpdateWithDeletions(r *rand.Rand) common.Update {
+	getAddress := func() common.Address {
+		return common.Address{byte(r.Intn(3)), byte(r.Intn(3) << 4), byte(r.Intn(3))}
+	}
+	getKey := func() common.Key {
+		return common.Key{byte(r.Intn(3)), byte(r.Intn(3) << 4)}
+	}
+
+	update := common.Update{}
+	deleted := map[common.Address]bool{}
+	for i := 0; i < r.Intn(8); i++ {
+		deleted[getAddress()] = true
+	}
+	created := map[common.Address]bool{}
+	for i := 0; i < r.Intn(4); i++ {
+		if addr := getAddress(); !deleted[addr] {
+			created[addr] = true
+		}
+	}
+	balances := map[common.Address]common.Balance{}
+	for i := 0; i < r.Intn(8); i++ {
+		balances[getAddress()] = common.Balance{byte(r.Intn(2))}
+	}
+	nonces := map[common.Address]common.Nonce{}
+	for i := 0; i < r.Intn(8); i++ {
+		nonces[getAddress()] = common.Nonce{byte(r.Intn(2))}
+	}
+	type slot struct {
+		addr common.Address
+		key  common.Key
+	}
+	slots := map[slot]common.Value{}
+	for i := 0; i < r.Intn(32); i++ {
+		slots[slot{getAddress(), getKey()}] = common.Value{byte(r.Intn(2))}
+	}
+
+	for addr := range deleted {
+		update.AppendDeleteAccount(addr)
+	}
+	for addr := range created {
+		update.AppendCreateAccount(addr)
+	}
+	for addr, balance := range balances {
+		update.AppendBalanceUpdate(addr, balance)
+	}
+	for addr, nonce := range nonces {
+		update.AppendNonceUpdate(addr, nonce)
+	}
+	for slot, value := range slots {
+		update.AppendSlotUpdate(slot.addr, slot.key, value)
+	}
+	if err := update.Normalize(); err != nil {
+		panic(fmt.Sprintf("failed to normalize update: %v", err))
+	}
+	return update
+}
+
+// getTrieShape summarizes the structure of the trie of the given state by
+// listing the types and depths of its nodes in visiting order.
+func getTrieShape(t *testing.T, state *MptState) []string {
+	t.Helper()
+	res := []string{}
+	err := state.Visit(MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+		res = append(res, fmt.Sprintf("%d:%T", *info.Depth, node))
+		return VisitResponseContinue
+	}))
+	if err != nil {
+		t.Fatalf("failed to visit trie: %v", err)
+	}
+	return res
+}
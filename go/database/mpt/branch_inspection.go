@@ -0,0 +1,64 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import "fmt"
+
+// BranchInspection is a snapshot of the fan-out related properties of a
+// branch node. In all bit masks, bit i describes the child at position i.
+type BranchInspection struct {
+	Children         [16]NodeId // the IDs of the children, empty for missing children
+	ChildMask        uint16     // marks present children
+	FrozenChildren   uint16     // marks children known to be frozen, all bits are set for frozen branches; not persisted
+	DirtyChildHashes uint16     // marks children whose hash needs to be recomputed
+	EmbeddedChildren uint16     // marks children small enough to be embedded in the RLP encoding of the branch
+	Frozen           bool       // whether the branch itself is frozen
+}
+
+// NumChildren returns the number of present children of the inspected branch.
+func (i *BranchInspection) NumChildren() int {
+	res := 0
+	for mask := i.ChildMask; mask != 0; mask &= mask - 1 {
+		res++
+	}
+	return res
+}
+
+// InspectBranch provides a snapshot of the children and child bit masks of
+// the branch node referenced by the given reference. The node is only read,
+// and an error is returned if it is not a branch node.
+func (s *Forest) InspectBranch(ref NodeReference) (BranchInspection, error) {
+	if !ref.Id().IsBranch() {
+		return BranchInspection{}, fmt.Errorf("node %v is not a branch node", ref.Id())
+	}
+	handle, err := s.getReadAccess(&ref)
+	if err != nil {
+		return BranchInspection{}, err
+	}
+	defer handle.Release()
+	branch, ok := handle.Get().(*BranchNode)
+	if !ok {
+		return BranchInspection{}, fmt.Errorf("node %v is not a branch node", ref.Id())
+	}
+	res := BranchInspection{
+		FrozenChildren:   branch.frozenChildren,
+		DirtyChildHashes: branch.dirtyHashes,
+		EmbeddedChildren: branch.embeddedChildren,
+		Frozen:           branch.IsFrozen(),
+	}
+	for i, child := range branch.children {
+		res.Children[i] = child.Id()
+		if !child.Id().IsEmpty() {
+			res.ChildMask |= 1 << i
+		}
+	}
+	return res, nil
+}
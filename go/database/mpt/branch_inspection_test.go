@@ -0,0 +1,100 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"testing"
+)
+
+func TestForest_InspectBranch_ReportsMasksOfMixedChildren(t *testing.T) {
+	forest, err := OpenVolatileForest(S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	defer forest.Close()
+
+	ref, handle, err := forest.createBranch()
+	if err != nil {
+		t.Fatalf("failed to create branch: %v", err)
+	}
+	branch := handle.Get().(*BranchNode)
+	branch.children[1] = NewNodeReference(AccountId(1))
+	branch.children[4] = NewNodeReference(BranchId(7))
+	branch.children[9] = NewNodeReference(ValueId(3))
+	branch.setEmbedded(9, true)
+	branch.setChildFrozen(4, true)
+	branch.setChildFrozen(9, true)
+	branch.markChildHashDirty(1)
+	handle.Release()
+
+	got, err := forest.InspectBranch(ref)
+	if err != nil {
+		t.Fatalf("failed to inspect branch: %v", err)
+	}
+	want := BranchInspection{
+		ChildMask:        1<<1 | 1<<4 | 1<<9,
+		FrozenChildren:   1<<4 | 1<<9,
+		DirtyChildHashes: 1 << 1,
+		EmbeddedChildren: 1 << 9,
+	}
+	want.Children[1] = AccountId(1)
+	want.Children[4] = BranchId(7)
+	want.Children[9] = ValueId(3)
+	if want != got {
+		t.Errorf("unexpected inspection, wanted %+v, got %+v", want, got)
+	}
+	if want, got := 3, got.NumChildren(); want != got {
+		t.Errorf("unexpected number of children, wanted %d, got %d", want, got)
+	}
+
+	// Modifying the inspection does not affect the node.
+	got.Children[2] = AccountId(5)
+	if again, err := forest.InspectBranch(ref); err != nil || again.Children[2] != EmptyId() {
+		t.Errorf("inspection should be a copy, got %v, %v", again.Children[2], err)
+	}
+
+	// Once the branch is frozen, all of its children are frozen.
+	handle, err = forest.getWriteAccess(&ref)
+	if err != nil {
+		t.Fatalf("failed to access branch: %v", err)
+	}
+	handle.Get().MarkFrozen()
+	handle.Release()
+	got, err = forest.InspectBranch(ref)
+	if err != nil {
+		t.Fatalf("failed to inspect branch: %v", err)
+	}
+	if !got.Frozen || got.FrozenChildren != ^uint16(0) {
+		t.Errorf("unexpected frozen state, got %t, %016b", got.Frozen, got.FrozenChildren)
+	}
+	if got.ChildMask != want.ChildMask || got.EmbeddedChildren != want.EmbeddedChildren {
+		t.Errorf("freezing should not affect other masks, got %+v", got)
+	}
+}
+
+func TestForest_InspectBranch_NonBranchNodesAreRejected(t *testing.T) {
+	forest, err := OpenVolatileForest(S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	defer forest.Close()
+
+	ref, handle, err := forest.createAccount()
+	if err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+	handle.Release()
+	for _, ref := range []NodeReference{ref, NewNodeReference(EmptyId())} {
+		if _, err := forest.InspectBranch(ref); err == nil {
+			t.Errorf("inspecting node %v should fail", ref.Id())
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// CodeStore is the storage of contract codes referenced through the code
+// hashes of accounts. Codes are not part of tries, thus tries can only check
+// the referential integrity of code hashes if they are provided with access
+// to the store holding the codes. Implementations must be thread safe.
+type CodeStore interface {
+	// HasCode returns true if the code with the given hash is present.
+	HasCode(hash common.Hash) (bool, error)
+}
+
+// ErrMissingCode is returned if an account references a code not present
+// in the code store.
+const ErrMissingCode = common.ConstError("code referenced by account is missing")
+
+// CodeMap is a CodeStore backed by a map of codes indexed by their hashes,
+// as it is produced by GetCodes of states.
+type CodeMap map[common.Hash][]byte
+
+func (m CodeMap) HasCode(hash common.Hash) (bool, error) {
+	_, found := m[hash]
+	return found, nil
+}
+
+// checkCodeReference checks that the code with the given hash referenced by
+// the given account is present in the code store. Accounts without code,
+// which have an empty or a zero code hash, are not checked.
+func checkCodeReference(store CodeStore, address common.Address, hash common.Hash) error {
+	if hash == (common.Hash{}) || hash == emptyCodeHash {
+		return nil
+	}
+	found, err := store.HasCode(hash)
+	if err != nil {
+		return fmt.Errorf("failed to check presence of code %x of account %x: %w", hash, address, err)
+	}
+	if !found {
+		return fmt.Errorf("%w: code %x of account %x", ErrMissingCode, hash, address)
+	}
+	return nil
+}
+
+// VerifyCodeReferences checks that all codes referenced by the accounts
+// stored in the forest in the given directory are present in the given code
+// store. All missing codes are reported, wrapping ErrMissingCode.
+func VerifyCodeReferences(directory string, config MptConfig, store CodeStore, observer VerificationObserver) (res error) {
+	if observer == nil {
+		observer = NilVerificationObserver{}
+	}
+
+	observer.StartVerification()
+	defer func() {
+		observer.EndVerification(res)
+	}()
+
+	observer.Progress("Obtaining read access to files ...")
+	source, err := openVerificationNodeSource(directory, config)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	return verifyCodeReferences(source, store, observer)
+}
+
+func verifyCodeReferences(source *verificationNodeSource, store CodeStore, observer VerificationObserver) error {
+	observer.Progress("Checking code references of accounts ...")
+	return source.forAccountNodes(func(account *AccountNode) error {
+		return checkCodeReference(store, account.address, account.info.CodeHash)
+	})
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestCodeMap_HasCode(t *testing.T) {
+	codes := CodeMap{common.Hash{1}: {1, 2, 3}}
+	if found, err := codes.HasCode(common.Hash{1}); err != nil || !found {
+		t.Errorf("code should be present, got %v, err %v", found, err)
+	}
+	if found, err := codes.HasCode(common.Hash{2}); err != nil || found {
+		t.Errorf("code should not be present, got %v, err %v", found, err)
+	}
+}
+
+func TestLiveTrie_CodeStore_ReferencesToCodesAreChecked(t *testing.T) {
+	present := common.Keccak256([]byte{1, 2, 3})
+	missing := common.Keccak256([]byte{4, 5, 6})
+	codes := CodeMap{present: {1, 2, 3}}
+
+	tests := map[string]struct {
+		hash    common.Hash
+		missing bool
+	}{
+		"present code": {hash: present},
+		"missing code": {hash: missing, missing: true},
+		"empty code":   {hash: emptyCodeHash},
+		"zero hash":    {hash: common.Hash{}},
+	}
+
+	for _, config := range allMptConfigs {
+		for name, test := range tests {
+			t.Run(config.Name+"/"+name, func(t *testing.T) {
+				trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer trie.Close()
+				trie.SetCodeStore(codes)
+
+				addr := common.Address{1}
+				err = trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1), CodeHash: test.hash})
+				if got, want := errors.Is(err, ErrMissingCode), test.missing; got != want {
+					t.Fatalf("unexpected result, wanted missing code %t, got error %v", want, err)
+				}
+				_, exists, err := trie.GetAccountInfo(addr)
+				if err != nil {
+					t.Fatalf("failed to get account: %v", err)
+				}
+				if exists == test.missing {
+					t.Errorf("account should only be created if its code is present")
+				}
+			})
+		}
+	}
+}
+
+func TestLiveTrie_CodeStore_ChecksAreDisabledByDefault(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+
+	info := AccountInfo{Nonce: common.ToNonce(1), CodeHash: common.Hash{1}}
+	if err := trie.SetAccountInfo(common.Address{1}, info); err != nil {
+		t.Errorf("missing codes should not be detected without code store, got %v", err)
+	}
+
+	trie.SetCodeStore(CodeMap{})
+	if err := trie.SetAccountInfo(common.Address{2}, info); !errors.Is(err, ErrMissingCode) {
+		t.Errorf("missing code should be detected, got %v", err)
+	}
+
+	trie.SetCodeStore(nil)
+	if err := trie.SetAccountInfo(common.Address{2}, info); err != nil {
+		t.Errorf("missing codes should not be detected after disabling checks, got %v", err)
+	}
+}
+
+func TestLiveTrie_CodeStore_ErrorsOfStoreAreForwarded(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+
+	injectedErr := errors.New("injected error")
+	trie.SetCodeStore(failingCodeStore{injectedErr})
+	info := AccountInfo{Nonce: common.ToNonce(1), CodeHash: common.Hash{1}}
+	if err := trie.SetAccountInfo(common.Address{1}, info); !errors.Is(err, injectedErr) {
+		t.Errorf("unexpected error, wanted %v, got %v", injectedErr, err)
+	}
+}
+
+func TestMptState_CodeReferenceChecks_CodesSetThroughStateArePresent(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	state.SetCodeReferenceChecks(true)
+
+	addr := common.Address{1}
+	if err := state.SetCode(addr, []byte{1, 2, 3}); err != nil {
+		t.Fatalf("failed to set code: %v", err)
+	}
+	if err := state.SetCode(addr, []byte{}); err != nil {
+		t.Fatalf("failed to clear code: %v", err)
+	}
+	if err := state.SetNonce(common.Address{2}, common.ToNonce(1)); err != nil {
+		t.Fatalf("failed to create account without code: %v", err)
+	}
+
+	info := AccountInfo{Nonce: common.ToNonce(1), CodeHash: common.Keccak256([]byte{4, 5, 6})}
+	if err := state.trie.SetAccountInfo(addr, info); !errors.Is(err, ErrMissingCode) {
+		t.Errorf("missing code should be detected, got %v", err)
+	}
+}
+
+func TestVerifyCodeReferences_MissingCodesAreDetected(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			state, err := OpenGoFileState(dir, config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			for i := 0; i < 10; i++ {
+				if err := state.SetCode(common.Address{byte(i)}, []byte{byte(i), 1}); err != nil {
+					t.Fatalf("failed to set code: %v", err)
+				}
+			}
+			if err := state.SetNonce(common.Address{0xFF}, common.ToNonce(1)); err != nil {
+				t.Fatalf("failed to create account without code: %v", err)
+			}
+			codes, err := state.GetCodes()
+			if err != nil {
+				t.Fatalf("failed to get codes: %v", err)
+			}
+			if _, err := state.GetHash(); err != nil {
+				t.Fatalf("failed to get hash: %v", err)
+			}
+			if err := state.Close(); err != nil {
+				t.Fatalf("failed to close state: %v", err)
+			}
+
+			if err := VerifyCodeReferences(dir, config, CodeMap(codes), nil); err != nil {
+				t.Errorf("verification with all codes should pass, got %v", err)
+			}
+
+			delete(codes, common.Keccak256([]byte{3, 1}))
+			if err := VerifyCodeReferences(dir, config, CodeMap(codes), nil); !errors.Is(err, ErrMissingCode) {
+				t.Errorf("missing code should be detected, got %v", err)
+			}
+		})
+	}
+}
+
+type failingCodeStore struct {
+	err error
+}
+
+func (s failingCodeStore) HasCode(common.Hash) (bool, error) {
+	return false, s.err
+}
@@ -10,6 +10,18 @@
 
 package mpt
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+)
+
 // MptConfig defines a set of configuration options for customizing the MPT
 // implementation. It is mainly intended to facilitate the accurate modeling
 // of Ethereum's MPT implementation (see schema 5) but may also be used for
@@ -33,8 +45,60 @@ type MptConfig struct {
 	// The hashing algorithm to be used in the MPT implementation.
 	Hashing hashAlgorithm
 
+	// The 32-byte hash function applied on encoded nodes by the hashing
+	// algorithm. If nil, keccak256 is used. Besides Keccak256, Blake2b256 is
+	// provided for chains not requiring Ethereum compatible hashes. Only
+	// EthereumLikeHashing is supporting alternative hash functions. The name
+	// of the hash function is recorded in the meta-data of MPT directories
+	// and directories can only be re-opened using the same function.
+	HashFunction HashFunction
+
 	// Determines whether hashes are stored with nodes or with the parents.
+	// This also selects the family of encoders used for storing nodes, which
+	// are the `...WithNodeHash` encoders for hashes stored with nodes and the
+	// `...WithChildHash` encoders for hashes stored with parents. Existing
+	// directories are always accessed using the family of encoders they were
+	// created with, as recorded in the directory.
 	HashStorageLocation HashStorageLocation
+
+	// If set to true, common prefixes of paths are represented by chains of
+	// branch nodes with a single child each instead of being compressed into
+	// extension nodes, as it is required for Ethereum's MPT variant. Since
+	// this changes the structure of tries and thus their hashes,
+	// configurations disabling extension nodes need to use a distinct name.
+	DisableExtensionNodes bool
+
+	// If set to true, value nodes retain the keccak256 hash of their key,
+	// which is computed on first use and persisted with the node. This way,
+	// hashing and proof generation do not need to re-hash keys at the cost
+	// of 32 extra bytes per value node on disk. It requires hashed paths
+	// and the tracking of suffix lengths in leaf nodes.
+	StoreHashedKeysInValueNodes bool
+
+	// If set to true, branch nodes maintain the number of leaf nodes in the
+	// sub-trie rooted by them, which is persisted with the node at the cost
+	// of 8 extra bytes per branch node on disk. This way, the number of
+	// accounts in a trie or slots in a storage trie can be obtained without
+	// traversing it. Counts not known yet, e.g. of nodes created without this
+	// option, are computed on demand.
+	TrackSubtreeLeafCounts bool
+
+	// If set to true, references between nodes are stored using 8 bytes
+	// instead of 6 bytes, at the cost of 2 extra bytes per reference on disk.
+	// Narrow references limit the number of nodes of each type to 2^45 for
+	// accounts and extensions, 2^46 for values, and 2^47-1 for branches,
+	// which very large archives may exceed. Since the on-disk format differs,
+	// this option can only be chosen for fresh databases. Existing LiveDBs
+	// may be converted using the migrate command.
+	UseWideNodeReferences bool
+
+	// If positive, slot updates creating nodes in storage tries deeper than
+	// the given number of nibbles are refused with an ErrDepthLimitExceeded,
+	// leaving the trie unmodified. The depth includes the paths of extension
+	// nodes, with the root of a storage trie at depth 0. This limit does not
+	// affect the on-disk format and is not recorded in the meta-data. A value
+	// of zero disables the limit.
+	MaxStorageDepth int
 }
 
 var S4LiveConfig = MptConfig{
@@ -69,14 +133,59 @@ var S5ArchiveConfig = MptConfig{
 	HashStorageLocation:           HashStoredWithNode,
 }
 
+// S5LiveNoExtensionsConfig is an experimental variant of the S5 LiveDB
+// configuration representing common path prefixes by chains of branch nodes
+// instead of extension nodes. The resulting hashes are not compatible with
+// Ethereum's MPT.
+var S5LiveNoExtensionsConfig = MptConfig{
+	Name:                          "S5-Live-NoExtensions",
+	UseHashedPaths:                true,
+	TrackSuffixLengthsInLeafNodes: true,
+	Hashing:                       EthereumLikeHashing, // requires tracking of suffix lengths
+	HashStorageLocation:           HashStoredWithParent,
+	DisableExtensionNodes:         true,
+}
+
+// S5LiveWideReferencesConfig is a variant of the S5 LiveDB configuration
+// using wide node references for databases exceeding the capacity of the
+// default 6-byte references. Hashes are not affected.
+var S5LiveWideReferencesConfig = MptConfig{
+	Name:                          "S5-Live-WideReferences",
+	UseHashedPaths:                true,
+	TrackSuffixLengthsInLeafNodes: true,
+	Hashing:                       EthereumLikeHashing, // requires tracking of suffix lengths
+	HashStorageLocation:           HashStoredWithParent,
+	UseWideNodeReferences:         true,
+}
+
+// S5ArchiveWideReferencesConfig is a variant of the S5 Archive configuration
+// using wide node references for archives exceeding the capacity of the
+// default 6-byte references. Hashes are not affected.
+var S5ArchiveWideReferencesConfig = MptConfig{
+	Name:                          "S5-Archive-WideReferences",
+	UseHashedPaths:                true,
+	TrackSuffixLengthsInLeafNodes: true,
+	Hashing:                       EthereumLikeHashing, // requires tracking of suffix lengths
+	HashStorageLocation:           HashStoredWithNode,
+	UseWideNodeReferences:         true,
+}
+
 var allMptConfigs = []MptConfig{
 	S4LiveConfig, S4ArchiveConfig,
 	S5LiveConfig, S5ArchiveConfig,
 }
 
+// experimentalMptConfigs lists configurations which may be located by name
+// but are not part of the officially supported configurations.
+var experimentalMptConfigs = []MptConfig{
+	S5LiveNoExtensionsConfig,
+	S5LiveWideReferencesConfig,
+	S5ArchiveWideReferencesConfig,
+}
+
 // GetConfigByName attempts to locate a configuration with the given name.
 func GetConfigByName(name string) (MptConfig, bool) {
-	for _, config := range allMptConfigs {
+	for _, config := range append(allMptConfigs, experimentalMptConfigs...) {
 		if config.Name == name {
 			return config, true
 		}
@@ -113,3 +222,243 @@ func (l HashStorageLocation) String() string {
 		return "?"
 	}
 }
+
+// mptConfigFile is the name of the file in forest directories recording the
+// MPT configuration the contained forest was created with.
+const mptConfigFile = "mpt_config.json"
+
+// mptConfigJson is the on-disk representation of an MptConfig.
+type mptConfigJson struct {
+	Name                          string
+	UseHashedPaths                bool
+	TrackSuffixLengthsInLeafNodes bool
+	Hashing                       string
+	HashStorageLocation           string
+	DisableExtensionNodes         bool   `json:",omitempty"`
+	StoreHashedKeysInValueNodes   bool   `json:",omitempty"`
+	TrackSubtreeLeafCounts        bool   `json:",omitempty"`
+	UseWideNodeReferences         bool   `json:",omitempty"`
+	HashFunction                  string `json:",omitempty"`
+	NodeEncoders                  []string
+}
+
+func (c MptConfig) MarshalJSON() ([]byte, error) {
+	// The default hash function is not recorded to retain the format of
+	// configurations created before hash functions were configurable.
+	hashFunction := ""
+	if c.HashFunction != nil {
+		hashFunction = getHashFunctionName(c.HashFunction)
+	}
+	return json.Marshal(mptConfigJson{
+		Name:                          c.Name,
+		UseHashedPaths:                c.UseHashedPaths,
+		TrackSuffixLengthsInLeafNodes: c.TrackSuffixLengthsInLeafNodes,
+		Hashing:                       c.Hashing.Name,
+		HashStorageLocation:           c.HashStorageLocation.String(),
+		DisableExtensionNodes:         c.DisableExtensionNodes,
+		StoreHashedKeysInValueNodes:   c.StoreHashedKeysInValueNodes,
+		TrackSubtreeLeafCounts:        c.TrackSubtreeLeafCounts,
+		UseWideNodeReferences:         c.UseWideNodeReferences,
+		HashFunction:                  hashFunction,
+		NodeEncoders:                  getEncoderNames(c),
+	})
+}
+
+func (c *MptConfig) UnmarshalJSON(data []byte) error {
+	var raw mptConfigJson
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	var res MptConfig
+	res.Name = raw.Name
+	res.UseHashedPaths = raw.UseHashedPaths
+	res.TrackSuffixLengthsInLeafNodes = raw.TrackSuffixLengthsInLeafNodes
+	res.DisableExtensionNodes = raw.DisableExtensionNodes
+	res.StoreHashedKeysInValueNodes = raw.StoreHashedKeysInValueNodes
+	res.TrackSubtreeLeafCounts = raw.TrackSubtreeLeafCounts
+	res.UseWideNodeReferences = raw.UseWideNodeReferences
+	if raw.HashFunction != "" {
+		res.HashFunction = getHashFunctionByName(raw.HashFunction)
+	}
+
+	switch raw.Hashing {
+	case DirectHashing.Name:
+		res.Hashing = DirectHashing
+	case EthereumLikeHashing.Name:
+		res.Hashing = EthereumLikeHashing
+	default:
+		return fmt.Errorf("unknown hashing algorithm: %v", raw.Hashing)
+	}
+
+	switch raw.HashStorageLocation {
+	case HashStoredWithNode.String():
+		res.HashStorageLocation = HashStoredWithNode
+	case HashStoredWithParent.String():
+		res.HashStorageLocation = HashStoredWithParent
+	default:
+		return fmt.Errorf("unknown hash storage location: %v", raw.HashStorageLocation)
+	}
+
+	// The encoders are implied by the other properties, but are recorded to
+	// detect directories written by implementations using different encoders.
+	if want, got := getEncoderNames(res), raw.NodeEncoders; !slices.Equal(want, got) {
+		return fmt.Errorf("unsupported node encoders, wanted %v, got %v", want, got)
+	}
+
+	*c = res
+	return nil
+}
+
+// getEncoderNames lists the names of the node encoders used for the given
+// configuration in the order accounts, branches, extensions, and values.
+func getEncoderNames(config MptConfig) []string {
+	accounts, branches, extensions, values := getEncoder(config)
+	return []string{
+		getEncoderName(accounts),
+		getEncoderName(branches),
+		getEncoderName(extensions),
+		getEncoderName(values),
+	}
+}
+
+// getEncoderName returns the name of the given encoder, which is the name of
+// its type unless the encoder provides a name itself.
+func getEncoderName(encoder any) string {
+	if named, ok := encoder.(interface{ encoderName() string }); ok {
+		return named.encoderName()
+	}
+	return reflect.TypeOf(encoder).Name()
+}
+
+// getEncoderFamily determines the family of node encoders the given list of
+// encoder names, as recorded in MPT directories, is belonging to. The family
+// is identified by the HashStorageLocation selecting it. If the encoders are
+// not of a single known family, false is returned.
+func getEncoderFamily(names []string) (HashStorageLocation, bool) {
+	withNode, withParent := 0, 0
+	for _, name := range names {
+		// Wide references are wrapping the encoders of a family.
+		name = strings.TrimSuffix(strings.TrimPrefix(name, "WideReferences["), "]")
+		switch {
+		case strings.HasSuffix(name, "WithNodeHash"):
+			withNode++
+		case strings.HasSuffix(name, "WithChildHash"),
+			strings.HasSuffix(name, "WithChildHashes"),
+			strings.HasSuffix(name, "WithoutNodeHash"):
+			withParent++
+		}
+	}
+	if withNode == len(names) && withNode > 0 {
+		return HashStoredWithNode, true
+	}
+	if withParent == len(names) && withParent > 0 {
+		return HashStoredWithParent, true
+	}
+	return false, false
+}
+
+// resolveNodeEncoders adapts the given configuration to use the family of
+// node encoders the forest in the given directory was created with. Thus,
+// nodes are always decoded by the encoders they were encoded with, no matter
+// which family is selected by the given configuration. Since the family only
+// affects the on-disk format, but not the hashes of tries, a forest may be
+// accessed using either family. Configurations for directories not recording
+// their encoders are returned unchanged.
+func resolveNodeEncoders(directory string, config MptConfig) (MptConfig, error) {
+	data, err := os.ReadFile(filepath.Join(directory, mptConfigFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	var raw mptConfigJson
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return config, fmt.Errorf("invalid MPT configuration in %s: %w", directory, err)
+	}
+	family, ok := getEncoderFamily(raw.NodeEncoders)
+	if !ok {
+		return config, fmt.Errorf("unsupported node encoders in %s: %v", directory, raw.NodeEncoders)
+	}
+	config.HashStorageLocation = family
+	return config, nil
+}
+
+// getConfigMismatches lists the differences of the given configurations that
+// affect the on-disk format or the hashes of forests. An empty result
+// indicates that the configurations are compatible.
+func getConfigMismatches(want, got MptConfig) []string {
+	var res []string
+	check := func(property string, want, got any) {
+		if want != got {
+			res = append(res, fmt.Sprintf("%s: wanted %v, got %v", property, want, got))
+		}
+	}
+	check("UseHashedPaths", want.UseHashedPaths, got.UseHashedPaths)
+	check("TrackSuffixLengthsInLeafNodes", want.TrackSuffixLengthsInLeafNodes, got.TrackSuffixLengthsInLeafNodes)
+	check("Hashing", want.Hashing.Name, got.Hashing.Name)
+	check("HashStorageLocation", want.HashStorageLocation, got.HashStorageLocation)
+	check("DisableExtensionNodes", want.DisableExtensionNodes, got.DisableExtensionNodes)
+	check("StoreHashedKeysInValueNodes", want.StoreHashedKeysInValueNodes, got.StoreHashedKeysInValueNodes)
+	check("TrackSubtreeLeafCounts", want.TrackSubtreeLeafCounts, got.TrackSubtreeLeafCounts)
+	check("UseWideNodeReferences", want.UseWideNodeReferences, got.UseWideNodeReferences)
+	check("HashFunction", getHashFunctionName(want.HashFunction), getHashFunctionName(got.HashFunction))
+	return res
+}
+
+// readMptConfig parses the MPT configuration recorded in the given directory.
+// If there is no such record, false is returned.
+func readMptConfig(directory string) (MptConfig, bool, error) {
+	data, err := os.ReadFile(filepath.Join(directory, mptConfigFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return MptConfig{}, false, nil
+	}
+	if err != nil {
+		return MptConfig{}, false, err
+	}
+	var config MptConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return MptConfig{}, false, fmt.Errorf("invalid MPT configuration in %s: %w", directory, err)
+	}
+	return config, true, nil
+}
+
+// writeMptConfig records the given MPT configuration in the given directory.
+func writeMptConfig(directory string, config MptConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(directory, mptConfigFile), data, 0600)
+}
+
+// ReadConfigFromDirectory obtains the MPT configuration of the forest stored
+// in the given directory. Directories created before configurations were
+// recorded are resolved by the configuration name listed in their forest
+// metadata.
+func ReadConfigFromDirectory(directory string) (MptConfig, error) {
+	config, found, err := readMptConfig(directory)
+	if err != nil {
+		return config, err
+	}
+	if found {
+		if hash, ok := config.HashFunction.(unresolvedHashFunction); ok {
+			return MptConfig{}, fmt.Errorf("unknown hash function in %s: %v", directory, string(hash))
+		}
+		return config, nil
+	}
+
+	meta, present, err := ReadForestMetadata(filepath.Join(directory, "forest.json"))
+	if err != nil {
+		return MptConfig{}, err
+	}
+	if !present {
+		return MptConfig{}, fmt.Errorf("invalid directory content: missing forest.json")
+	}
+	config, found = GetConfigByName(meta.Configuration)
+	if !found {
+		return MptConfig{}, fmt.Errorf("unknown MPT configuration: %v", meta.Configuration)
+	}
+	return config, nil
+}
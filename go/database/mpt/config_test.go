@@ -0,0 +1,428 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestMptConfig_JsonEncodingRoundTrip(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			data, err := json.Marshal(config)
+			if err != nil {
+				t.Fatalf("failed to encode config: %v", err)
+			}
+			var restored MptConfig
+			if err := json.Unmarshal(data, &restored); err != nil {
+				t.Fatalf("failed to decode config: %v", err)
+			}
+			if restored.Name != config.Name || len(getConfigMismatches(config, restored)) != 0 {
+				t.Errorf("unexpected restored config, wanted %v, got %v", config, restored)
+			}
+		})
+	}
+}
+
+func TestMptConfig_JsonEncodingListsNodeEncoders(t *testing.T) {
+	data, err := json.Marshal(S5ArchiveConfig)
+	if err != nil {
+		t.Fatalf("failed to encode config: %v", err)
+	}
+	for _, encoder := range getEncoderNames(S5ArchiveConfig) {
+		if !strings.Contains(string(data), encoder) {
+			t.Errorf("encoder %s missing in %s", encoder, data)
+		}
+	}
+}
+
+func TestMptConfig_InvalidJsonEncodingsAreDetected(t *testing.T) {
+	data, err := json.Marshal(S5LiveConfig)
+	if err != nil {
+		t.Fatalf("failed to encode config: %v", err)
+	}
+	tests := map[string]string{
+		"hashing":  strings.Replace(string(data), EthereumLikeHashing.Name, "UnknownHashing", 1),
+		"location": strings.Replace(string(data), HashStoredWithParent.String(), "HashStoredSomewhere", 1),
+		"encoders": strings.Replace(string(data), "BranchNodeEncoderWithChildHashes", "BranchNodeEncoderWithNodeHash", 1),
+		"syntax":   string(data[1:]),
+	}
+	for name, encoded := range tests {
+		t.Run(name, func(t *testing.T) {
+			var config MptConfig
+			if err := json.Unmarshal([]byte(encoded), &config); err == nil {
+				t.Errorf("decoding %s should fail", encoded)
+			}
+		})
+	}
+}
+
+func TestMptConfig_MismatchesListDifferingProperties(t *testing.T) {
+	if got := getConfigMismatches(S5LiveConfig, S5LiveConfig); len(got) != 0 {
+		t.Errorf("unexpected mismatches of identical configs: %v", got)
+	}
+	got := getConfigMismatches(S5LiveConfig, S4ArchiveConfig)
+	for _, property := range []string{"UseHashedPaths", "TrackSuffixLengthsInLeafNodes", "Hashing", "HashStorageLocation"} {
+		found := false
+		for _, mismatch := range got {
+			found = found || strings.HasPrefix(mismatch, property)
+		}
+		if !found {
+			t.Errorf("mismatch of %s not reported: %v", property, got)
+		}
+	}
+}
+
+func TestReadConfigFromDirectory_ReadsRecordedConfig(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			forest, err := OpenFileForest(dir, config, ForestConfig{Mode: Immutable, CacheCapacity: 1024})
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+			if err := forest.Close(); err != nil {
+				t.Fatalf("failed to close forest: %v", err)
+			}
+
+			got, err := ReadConfigFromDirectory(dir)
+			if err != nil {
+				t.Fatalf("failed to read config: %v", err)
+			}
+			if got.Name != config.Name || len(getConfigMismatches(config, got)) != 0 {
+				t.Errorf("unexpected config, wanted %v, got %v", config, got)
+			}
+		})
+	}
+}
+
+func TestReadConfigFromDirectory_FallsBackToConfigurationName(t *testing.T) {
+	dir := t.TempDir()
+	meta := "{\"Configuration\":\"S4-Archive\",\"Mutable\":false}"
+	if err := os.WriteFile(filepath.Join(dir, "forest.json"), []byte(meta), 0644); err != nil {
+		t.Fatalf("cannot prepare for test: %s", err)
+	}
+	got, err := ReadConfigFromDirectory(dir)
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	if got.Name != S4ArchiveConfig.Name {
+		t.Errorf("unexpected config, wanted %v, got %v", S4ArchiveConfig.Name, got.Name)
+	}
+}
+
+func TestReadConfigFromDirectory_InvalidDirectoriesAreDetected(t *testing.T) {
+	tests := map[string]map[string]string{
+		"empty":            {},
+		"unknown name":     {"forest.json": "{\"Configuration\":\"S150-Dead\",\"Mutable\":true}"},
+		"corrupted":        {"forest.json": "{\"Configuration\":\"S4-Live\",\"Mutable\":true}", mptConfigFile: "Hello"},
+		"corrupted forest": {"forest.json": "Hello"},
+	}
+	for name, files := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			for file, content := range files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+					t.Fatalf("cannot prepare for test: %s", err)
+				}
+			}
+			if _, err := ReadConfigFromDirectory(dir); err == nil {
+				t.Errorf("reading config should fail")
+			}
+		})
+	}
+}
+
+func TestMptConfig_ExperimentalConfigsCanBeFoundByName(t *testing.T) {
+	for _, config := range experimentalMptConfigs {
+		got, found := GetConfigByName(config.Name)
+		if !found {
+			t.Fatalf("config %v not found", config.Name)
+		}
+		if mismatches := getConfigMismatches(config, got); len(mismatches) != 0 {
+			t.Errorf("unexpected config for %v: %v", config.Name, mismatches)
+		}
+	}
+}
+
+func TestMptConfig_JsonEncodingRecordsUseOfExtensionNodes(t *testing.T) {
+	data, err := json.Marshal(S5LiveNoExtensionsConfig)
+	if err != nil {
+		t.Fatalf("failed to encode config: %v", err)
+	}
+	var restored MptConfig
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("failed to decode config: %v", err)
+	}
+	if !restored.DisableExtensionNodes {
+		t.Errorf("disabled extension nodes should be restored")
+	}
+}
+
+func TestMptConfig_ExtensionNodesAreNotRecordedIfEnabled(t *testing.T) {
+	// Directories recorded before extension nodes became optional lack the
+	// property, thus it must only be present if extension nodes are disabled.
+	data, err := json.Marshal(S5LiveConfig)
+	if err != nil {
+		t.Fatalf("failed to encode config: %v", err)
+	}
+	if strings.Contains(string(data), "DisableExtensionNodes") {
+		t.Errorf("encoding %s should not contain the DisableExtensionNodes property", data)
+	}
+	var restored MptConfig
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("failed to decode config: %v", err)
+	}
+	if restored.DisableExtensionNodes {
+		t.Errorf("extension nodes should be enabled by default")
+	}
+}
+
+func TestMptConfig_JsonEncodingRecordsHashFunction(t *testing.T) {
+	config := withHashFunction(S5LiveConfig, sha256Function{})
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatalf("failed to encode config: %v", err)
+	}
+	if want := getHashFunctionName(sha256Function{}); !strings.Contains(string(data), want) {
+		t.Errorf("encoding %s should contain the hash function %s", data, want)
+	}
+	var restored MptConfig
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("failed to decode config: %v", err)
+	}
+	if mismatches := getConfigMismatches(config, restored); len(mismatches) != 0 {
+		t.Errorf("unexpected mismatches of restored config: %v", mismatches)
+	}
+}
+
+func TestMptConfig_DefaultHashFunctionIsNotRecorded(t *testing.T) {
+	// Directories recorded before hash functions became configurable lack
+	// the property, thus it must only be present if a function is selected.
+	data, err := json.Marshal(S5LiveConfig)
+	if err != nil {
+		t.Fatalf("failed to encode config: %v", err)
+	}
+	if strings.Contains(string(data), "HashFunction") {
+		t.Errorf("encoding %s should not contain the HashFunction property", data)
+	}
+	var restored MptConfig
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("failed to decode config: %v", err)
+	}
+	if restored.HashFunction != nil {
+		t.Errorf("the default hash function should be restored, got %v", restored.HashFunction)
+	}
+}
+
+func TestMptConfig_MismatchesListDifferingHashFunctions(t *testing.T) {
+	got := getConfigMismatches(S5LiveConfig, withHashFunction(S5LiveConfig, sha256Function{}))
+	if len(got) != 1 || !strings.HasPrefix(got[0], "HashFunction") {
+		t.Errorf("mismatch of hash functions not reported: %v", got)
+	}
+	if got := getConfigMismatches(S5LiveConfig, withHashFunction(S5LiveConfig, Keccak256)); len(got) != 0 {
+		t.Errorf("keccak256 should be compatible with the default hash function, got %v", got)
+	}
+}
+
+func TestMptConfig_DirectoriesCanOnlyBeOpenedUsingTheirHashFunction(t *testing.T) {
+	config := withHashFunction(S5LiveConfig, sha256Function{})
+	dir := t.TempDir()
+	forest, err := OpenFileForest(dir, config, ForestConfig{Mode: Immutable, CacheCapacity: 1024})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	if err := forest.Close(); err != nil {
+		t.Fatalf("failed to close forest: %v", err)
+	}
+
+	if forest, err := OpenFileForest(dir, S5LiveConfig, ForestConfig{Mode: Immutable, CacheCapacity: 1024}); err == nil {
+		forest.Close()
+		t.Errorf("opening a directory using a different hash function should fail")
+	}
+
+	forest, err = OpenFileForest(dir, config, ForestConfig{Mode: Immutable, CacheCapacity: 1024})
+	if err != nil {
+		t.Fatalf("failed to re-open forest using the same hash function: %v", err)
+	}
+	if err := forest.Close(); err != nil {
+		t.Fatalf("failed to close forest: %v", err)
+	}
+
+	// Custom hash functions can not be restored from the directory.
+	if _, err := ReadConfigFromDirectory(dir); err == nil {
+		t.Errorf("reading a configuration with a custom hash function should fail")
+	}
+}
+
+func TestMptConfig_JsonEncodingRecordsStorageOfHashedKeys(t *testing.T) {
+	config := S5LiveConfig
+	config.StoreHashedKeysInValueNodes = true
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatalf("failed to encode config: %v", err)
+	}
+	var restored MptConfig
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("failed to decode config: %v", err)
+	}
+	if !restored.StoreHashedKeysInValueNodes {
+		t.Errorf("storage of hashed keys should be restored")
+	}
+	if got := getConfigMismatches(S5LiveConfig, restored); len(got) != 1 || !strings.HasPrefix(got[0], "StoreHashedKeysInValueNodes") {
+		t.Errorf("storage of hashed keys should be reported as mismatch, got %v", got)
+	}
+}
+
+func TestMptConfig_JsonEncodingRecordsTrackingOfLeafCounts(t *testing.T) {
+	config := S5LiveConfig
+	config.TrackSubtreeLeafCounts = true
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatalf("failed to encode config: %v", err)
+	}
+	var restored MptConfig
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("failed to decode config: %v", err)
+	}
+	if !restored.TrackSubtreeLeafCounts {
+		t.Errorf("tracking of leaf counts should be restored")
+	}
+	if got := getConfigMismatches(S5LiveConfig, restored); len(got) != 1 || !strings.HasPrefix(got[0], "TrackSubtreeLeafCounts") {
+		t.Errorf("tracking of leaf counts should be reported as mismatch, got %v", got)
+	}
+}
+
+func TestMptConfig_JsonEncodingRecordsWidthOfNodeReferences(t *testing.T) {
+	data, err := json.Marshal(S5LiveWideReferencesConfig)
+	if err != nil {
+		t.Fatalf("failed to encode config: %v", err)
+	}
+	var restored MptConfig
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("failed to decode config: %v", err)
+	}
+	if !restored.UseWideNodeReferences {
+		t.Errorf("use of wide node references should be restored")
+	}
+	if got := getConfigMismatches(S5LiveConfig, restored); len(got) != 1 || !strings.HasPrefix(got[0], "UseWideNodeReferences") {
+		t.Errorf("width of node references should be reported as mismatch, got %v", got)
+	}
+	if want, got := getEncoderNames(S5LiveWideReferencesConfig), getEncoderNames(S5LiveConfig); reflect.DeepEqual(want, got) {
+		t.Errorf("encoders of narrow and wide references should differ, got %v", got)
+	}
+}
+
+func TestMptConfig_EncoderFamilyIsDerivedFromEncoderNames(t *testing.T) {
+	configs := append(append([]MptConfig{}, allMptConfigs...), experimentalMptConfigs...)
+	for _, config := range configs {
+		for _, leafCounts := range []bool{false, true} {
+			config.TrackSubtreeLeafCounts = leafCounts
+			t.Run(fmt.Sprintf("%s-%t", config.Name, leafCounts), func(t *testing.T) {
+				family, ok := getEncoderFamily(getEncoderNames(config))
+				if !ok || family != config.HashStorageLocation {
+					t.Errorf("unexpected encoder family, wanted %v, got %v, %t", config.HashStorageLocation, family, ok)
+				}
+			})
+		}
+	}
+
+	mixed := []string{"AccountNodeEncoderWithNodeHash", "BranchNodeEncoderWithChildHashes"}
+	if _, ok := getEncoderFamily(mixed); ok {
+		t.Errorf("mixed encoder families should not be accepted")
+	}
+	if _, ok := getEncoderFamily(nil); ok {
+		t.Errorf("missing encoders should not be accepted")
+	}
+}
+
+func TestMptConfig_StoresAreReadUsingTheEncodersTheyWereCreatedWith(t *testing.T) {
+	withNodeHash := S5LiveConfig
+	withNodeHash.HashStorageLocation = HashStoredWithNode
+	withChildHash := S5LiveConfig
+	families := map[string]MptConfig{
+		"WithNodeHash":  withNodeHash,
+		"WithChildHash": withChildHash,
+	}
+
+	for createdName, created := range families {
+		for openedName, opened := range families {
+			t.Run(fmt.Sprintf("created%s-opened%s", createdName, openedName), func(t *testing.T) {
+				dir := t.TempDir()
+				trie, err := OpenFileLiveTrie(dir, created, 1024)
+				if err != nil {
+					t.Fatalf("failed to create trie: %v", err)
+				}
+				for i := 0; i < 100; i++ {
+					addr := common.Address{byte(i)}
+					if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(uint64(i + 1))}); err != nil {
+						t.Fatalf("failed to set account: %v", err)
+					}
+					if err := trie.SetValue(addr, common.Key{byte(i)}, common.Value{byte(i + 1)}); err != nil {
+						t.Fatalf("failed to set value: %v", err)
+					}
+				}
+				want, _, err := trie.UpdateHashes()
+				if err != nil {
+					t.Fatalf("failed to update hashes: %v", err)
+				}
+				if err := trie.Close(); err != nil {
+					t.Fatalf("failed to close trie: %v", err)
+				}
+
+				// The store is read using the encoders recorded in the
+				// directory, no matter which family is selected.
+				trie, err = OpenFileLiveTrie(dir, opened, 1024)
+				if err != nil {
+					t.Fatalf("failed to reopen trie: %v", err)
+				}
+				if got := trie.forest.(*Forest).config.HashStorageLocation; got != created.HashStorageLocation {
+					t.Errorf("unexpected encoder family, wanted %v, got %v", created.HashStorageLocation, got)
+				}
+				for i := 0; i < 100; i++ {
+					addr := common.Address{byte(i)}
+					info, found, err := trie.GetAccountInfo(addr)
+					if err != nil || !found || info.Nonce != common.ToNonce(uint64(i+1)) {
+						t.Errorf("unexpected account %d, got %v, %t, %v", i, info, found, err)
+					}
+					if value, err := trie.GetValue(addr, common.Key{byte(i)}); err != nil || value != (common.Value{byte(i + 1)}) {
+						t.Errorf("unexpected value of account %d, got %v, %v", i, value, err)
+					}
+				}
+				if got, _, err := trie.UpdateHashes(); err != nil || got != want {
+					t.Errorf("unexpected hash, wanted %x, got %x, %v", want, got, err)
+				}
+				if err := trie.Close(); err != nil {
+					t.Fatalf("failed to close trie: %v", err)
+				}
+
+				if err := VerifyFileLiveTrie(dir, opened, NilVerificationObserver{}); err != nil {
+					t.Errorf("verification of trie failed: %v", err)
+				}
+				recorded, err := ReadConfigFromDirectory(dir)
+				if err != nil {
+					t.Fatalf("failed to read config: %v", err)
+				}
+				if recorded.HashStorageLocation != created.HashStorageLocation {
+					t.Errorf("recorded encoder family should not change, wanted %v, got %v", created.HashStorageLocation, recorded.HashStorageLocation)
+				}
+			})
+		}
+	}
+}
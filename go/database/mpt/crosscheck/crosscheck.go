@@ -0,0 +1,172 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+// Package crosscheck provides utilities for cross-checking the hashes of
+// Carmen's MPT implementation against the reference implementation of
+// go-ethereum. It is intended to be used by tests and tools tracking down
+// hash mismatches, and is kept in a module of its own such that Carmen does
+// not depend on go-ethereum. Run its tests from within this directory using
+//
+//	go test ./...
+package crosscheck
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ethereum/go-ethereum/triedb"
+	"github.com/holiman/uint256"
+)
+
+// Entry is the content of a single account of a state to be cross-checked.
+type Entry struct {
+	Address common.Address
+	Info    mpt.AccountInfo
+	Storage map[common.Key]common.Value
+}
+
+// CrossCheckWithGeth builds the state described by the given entries in a
+// Carmen MPT using EthereumLikeHashing and in a go-ethereum trie, and returns
+// the root hashes of both. For a correct implementation, the hashes are equal.
+// Since empty accounts and zero values are implicitly present in Carmen's
+// MPTs, those are not added to either of the tries. Later entries of the same
+// account replace the content of earlier ones.
+func CrossCheckWithGeth(entries []Entry) (carmenRoot, gethRoot common.Hash, err error) {
+	carmenRoot, err = getCarmenRoot(entries)
+	if err != nil {
+		return common.Hash{}, common.Hash{}, fmt.Errorf("failed to compute Carmen root: %w", err)
+	}
+	gethRoot, err = getGethRoot(entries)
+	if err != nil {
+		return common.Hash{}, common.Hash{}, fmt.Errorf("failed to compute go-ethereum root: %w", err)
+	}
+	return carmenRoot, gethRoot, nil
+}
+
+func getCarmenRoot(entries []Entry) (res common.Hash, err error) {
+	live, err := mpt.OpenVolatileLiveTrie(mpt.S5LiveConfig, 1024)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	defer func() {
+		err = errors.Join(err, live.Close())
+	}()
+	for _, entry := range getEffectiveEntries(entries) {
+		if err := live.SetAccountInfo(entry.Address, entry.Info); err != nil {
+			return common.Hash{}, err
+		}
+		for key, value := range entry.Storage {
+			if err := live.SetValue(entry.Address, key, value); err != nil {
+				return common.Hash{}, err
+			}
+		}
+	}
+	hash, _, err := live.UpdateHashes()
+	return hash, err
+}
+
+func getGethRoot(entries []Entry) (common.Hash, error) {
+	db := triedb.NewDatabase(rawdb.NewMemoryDatabase(), nil)
+	accounts, err := trie.NewStateTrie(trie.TrieID(types.EmptyRootHash), db)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	for _, entry := range getEffectiveEntries(entries) {
+		address := geth.Address(entry.Address)
+		owner := crypto.Keccak256Hash(address[:])
+		storage, err := trie.NewStateTrie(trie.StorageTrieID(types.EmptyRootHash, owner, types.EmptyRootHash), db)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		for key, value := range entry.Storage {
+			// Values are stored without leading zeros, as done by go-ethereum's StateDB.
+			if err := storage.UpdateStorage(address, key[:], geth.TrimLeftZeroes(value[:])); err != nil {
+				return common.Hash{}, err
+			}
+		}
+		balance := entry.Info.Balance.ToBigInt()
+		account := &types.StateAccount{
+			Nonce:    entry.Info.Nonce.ToUint64(),
+			Balance:  uint256.MustFromBig(balance),
+			Root:     storage.Hash(),
+			CodeHash: entry.Info.CodeHash[:],
+		}
+		if err := accounts.UpdateAccount(address, account); err != nil {
+			return common.Hash{}, err
+		}
+	}
+	return common.Hash(accounts.Hash()), nil
+}
+
+// getEffectiveEntries resolves the given list of entries to the non-empty
+// accounts of the described state, omitting zero storage values.
+func getEffectiveEntries(entries []Entry) []Entry {
+	positions := map[common.Address]int{}
+	res := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		storage := make(map[common.Key]common.Value, len(entry.Storage))
+		for key, value := range entry.Storage {
+			if value != (common.Value{}) {
+				storage[key] = value
+			}
+		}
+		entry.Storage = storage
+		if pos, found := positions[entry.Address]; found {
+			res[pos] = entry
+		} else {
+			positions[entry.Address] = len(res)
+			res = append(res, entry)
+		}
+	}
+	// Accounts are filtered after resolving duplicates, such that empty
+	// entries delete earlier entries of the same account.
+	filtered := res[:0]
+	for _, entry := range res {
+		if !entry.Info.IsEmpty() {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
+
+// GetRandomEntries creates a random state of the given number of accounts for
+// cross-checks. Accounts have random balances and nonces, some of them code,
+// and up to the given number of storage slots.
+func GetRandomEntries(r *rand.Rand, numAccounts int, maxSlots int) []Entry {
+	res := make([]Entry, numAccounts)
+	for i := range res {
+		entry := &res[i]
+		r.Read(entry.Address[:])
+		entry.Info.Nonce = common.ToNonce(r.Uint64())
+		r.Read(entry.Info.Balance[common.BalanceSize-8:])
+		if r.Intn(2) == 0 {
+			r.Read(entry.Info.CodeHash[:])
+		} else {
+			entry.Info.CodeHash = common.Hash(types.EmptyCodeHash)
+		}
+		entry.Storage = map[common.Key]common.Value{}
+		for j := r.Intn(maxSlots + 1); j > 0; j-- {
+			key, value := common.Key{}, common.Value{}
+			r.Read(key[:])
+			// Short values cover the trimming of leading zeros.
+			r.Read(value[r.Intn(len(value)):])
+			entry.Storage[key] = value
+		}
+	}
+	return res
+}
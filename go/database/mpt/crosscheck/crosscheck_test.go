@@ -0,0 +1,75 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package crosscheck
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestCrossCheckWithGeth_EmptyStateHasEmptyRoot(t *testing.T) {
+	carmen, geth, err := CrossCheckWithGeth(nil)
+	if err != nil {
+		t.Fatalf("failed to cross-check: %v", err)
+	}
+	if want := common.Hash(types.EmptyRootHash); carmen != want || geth != want {
+		t.Errorf("unexpected roots of empty state, wanted %x, got %x and %x", want, carmen, geth)
+	}
+}
+
+func TestCrossCheckWithGeth_RandomStatesProduceSameRoots(t *testing.T) {
+	for _, numAccounts := range []int{1, 2, 10, 100} {
+		for seed := int64(0); seed < 5; seed++ {
+			t.Run(fmt.Sprintf("accounts=%d/seed=%d", numAccounts, seed), func(t *testing.T) {
+				entries := GetRandomEntries(rand.New(rand.NewSource(seed)), numAccounts, 10)
+				carmen, geth, err := CrossCheckWithGeth(entries)
+				if err != nil {
+					t.Fatalf("failed to cross-check: %v", err)
+				}
+				if carmen != geth {
+					t.Errorf("root hashes differ, Carmen %x, go-ethereum %x", carmen, geth)
+				}
+			})
+		}
+	}
+}
+
+func TestCrossCheckWithGeth_EmptyAccountsAndZeroValuesAreIgnored(t *testing.T) {
+	entries := GetRandomEntries(rand.New(rand.NewSource(42)), 5, 5)
+	want, _, err := CrossCheckWithGeth(entries)
+	if err != nil {
+		t.Fatalf("failed to cross-check: %v", err)
+	}
+
+	padded := append([]Entry{}, entries...)
+	padded[0].Storage = map[common.Key]common.Value{}
+	for key, value := range entries[0].Storage {
+		padded[0].Storage[key] = value
+	}
+	padded[0].Storage[common.Key{1, 2, 3}] = common.Value{}
+	padded = append(padded,
+		Entry{Address: common.Address{1}},
+		Entry{Address: common.Address{2}, Info: mpt.AccountInfo{Nonce: common.ToNonce(1)}},
+		Entry{Address: common.Address{2}}, // deletes the previous entry
+	)
+	carmen, geth, err := CrossCheckWithGeth(padded)
+	if err != nil {
+		t.Fatalf("failed to cross-check: %v", err)
+	}
+	if carmen != want || geth != want {
+		t.Errorf("empty accounts and zero values should be ignored, wanted %x, got %x and %x", want, carmen, geth)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/crosscheck"
+	"github.com/urfave/cli/v2"
+)
+
+var CrossCheck = cli.Command{
+	Action: crossCheck,
+	Name:   "crosscheck",
+	Usage:  "compares the root hashes of random states computed by Carmen and go-ethereum",
+	Flags: []cli.Flag{
+		&crossCheckStatesFlag,
+		&crossCheckAccountsFlag,
+		&crossCheckSlotsFlag,
+		&crossCheckSeedFlag,
+	},
+}
+
+var (
+	crossCheckStatesFlag = cli.IntFlag{
+		Name:  "states",
+		Usage: "the number of random states to be checked",
+		Value: 100,
+	}
+	crossCheckAccountsFlag = cli.IntFlag{
+		Name:  "accounts",
+		Usage: "the number of accounts of each state",
+		Value: 100,
+	}
+	crossCheckSlotsFlag = cli.IntFlag{
+		Name:  "slots",
+		Usage: "the maximum number of storage slots per account",
+		Value: 10,
+	}
+	crossCheckSeedFlag = cli.Int64Flag{
+		Name:  "seed",
+		Usage: "the seed of the first random state, incremented for each state",
+		Value: 0,
+	}
+)
+
+func crossCheck(context *cli.Context) error {
+	return runCrossCheck(
+		os.Stdout,
+		context.Int(crossCheckStatesFlag.Name),
+		context.Int(crossCheckAccountsFlag.Name),
+		context.Int(crossCheckSlotsFlag.Name),
+		context.Int64(crossCheckSeedFlag.Name),
+	)
+}
+
+// runCrossCheck compares the root hashes of the given number of random
+// states, each created with its own seed, and prints the seeds of mismatching
+// states. An error is returned if any state produces a mismatch.
+func runCrossCheck(out io.Writer, numStates, numAccounts, maxSlots int, seed int64) error {
+	mismatches := 0
+	for i := 0; i < numStates; i++ {
+		entries := crosscheck.GetRandomEntries(rand.New(rand.NewSource(seed)), numAccounts, maxSlots)
+		carmen, geth, err := crosscheck.CrossCheckWithGeth(entries)
+		if err != nil {
+			return fmt.Errorf("failed to check state with seed %d: %w", seed, err)
+		}
+		if carmen != geth {
+			mismatches++
+			if _, err := fmt.Fprintf(out, "Mismatch for seed %d: Carmen %x, go-ethereum %x\n", seed, carmen, geth); err != nil {
+				return err
+			}
+		}
+		seed++
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("%d of %d states produced different root hashes", mismatches, numStates)
+	}
+	_, err := fmt.Fprintf(out, "All %d states produced the same root hashes\n", numStates)
+	return err
+}
@@ -0,0 +1,26 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCrossCheck_RandomStatesMatch(t *testing.T) {
+	var out bytes.Buffer
+	if err := runCrossCheck(&out, 5, 20, 5, 42); err != nil {
+		t.Fatalf("cross-check failed: %v, output: %s", err, out.String())
+	}
+	if want, got := "All 5 states produced the same root hashes\n", out.String(); want != got {
+		t.Errorf("unexpected output, wanted %q, got %q", want, got)
+	}
+}
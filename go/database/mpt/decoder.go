@@ -41,6 +41,9 @@ func DecodeFromRlp(data []byte) (Node, error) {
 		if !ok {
 			return nil, fmt.Errorf("invalid prefix type: got: %T, wanted: String", list.Items[0])
 		}
+		if err := checkCompactPath(path.Str); err != nil {
+			return nil, err
+		}
 		nibbles := compactPathToNibbles(path.Str)
 		if len(nibbles) > 64 {
 			return nil, fmt.Errorf("invalid path length: got: %v, wanted: <= 64", len(nibbles))
@@ -58,6 +61,26 @@ func DecodeFromRlp(data []byte) (Node, error) {
 	return nil, fmt.Errorf("invalid number of list elements: got: %v, wanted: either 2 or 17", len(list.Items))
 }
 
+// DecodeEthereumNode decodes a node of a standard Ethereum proof, as reported
+// for instance by eth_getProof, into Carmen's node representation. Branch
+// nodes are decoded into BranchNodes, and two-item nodes are decoded into
+// ExtensionNodes, or, if the hex-prefix flag marks them as leaves, into
+// AccountNodes or ValueNodes depending on the payload. References to child
+// nodes are not resolved; decoded nodes only retain the hashes of their
+// children or, for embedded children, their RLP encoding. Since addresses
+// and keys are hashed in Ethereum tries, decoded AccountNodes and ValueNodes
+// only retain the remainder of the hashed path of the leaf.
+func DecodeEthereumNode(data []byte) (Node, error) {
+	node, err := DecodeFromRlp(data)
+	if err != nil {
+		return nil, err
+	}
+	if account, ok := node.(*decodedAccountNode); ok {
+		return &account.AccountNode, nil
+	}
+	return node, nil
+}
+
 // decodeExtensionNodeFromRlp decodes an extension node from RLP-encoded data.
 // It checks for malformed data and returns an error if the data is not valid.
 // Otherwise, it returns the decoded extension node.
@@ -230,6 +253,23 @@ func isEncodedLeafNode(path []byte) bool {
 	return path[0]&0b_0010_0000>>5 == 1
 }
 
+// checkCompactPath checks that the given path is a valid compact encoded
+// path, i.e. it is not empty, its flag nibble marks a leaf or an extension
+// with an even or odd path, and the padding of even paths is zero.
+func checkCompactPath(path []byte) error {
+	if len(path) == 0 {
+		return fmt.Errorf("invalid path: compact encoded path is empty")
+	}
+	flag := path[0] >> 4
+	if flag > 0b_0011 {
+		return fmt.Errorf("invalid path: unknown flag %d", flag)
+	}
+	if flag&0b_0001 == 0 && path[0]&0xF != 0 {
+		return fmt.Errorf("invalid path: non-zero padding of even path %x", path[0])
+	}
+	return nil
+}
+
 // compactPathToNibbles converts a compact path to nibbles.
 // The compact path packs two nibbles into a single byte.
 // The higher nibble of first byte contains the oddness of the path and if the node is a leaf node.
@@ -610,3 +610,109 @@ func matchNodesRlpDecoded(t *testing.T, a, b Node) {
 	}
 
 }
+
+func TestDecoder_InvalidCompactPathsAreRejected(t *testing.T) {
+	hash := common.Keccak256([]byte{1})
+	tests := map[string][]byte{
+		"empty path":             {},
+		"unknown flag":           {0x40, 0x12},
+		"non-zero padding":       {0x05, 0x12},
+		"non-zero leaf padding":  {0x2F, 0x12},
+		"unknown flag, odd path": {0xF1, 0x23},
+		"unknown flag, high bit": {0x71, 0x23},
+	}
+	for name, path := range tests {
+		t.Run(name, func(t *testing.T) {
+			data := rlp.Encode(rlp.List{Items: []rlp.Item{rlp.String{Str: path}, rlp.String{Str: hash[:]}}})
+			if _, err := DecodeEthereumNode(data); err == nil {
+				t.Errorf("expected error for path %x", path)
+			}
+		})
+	}
+}
+
+func TestDecoder_DecodeEthereumNode_LeafAndExtensionAreDistinguishedByFlag(t *testing.T) {
+	hash := common.Keccak256([]byte{1})
+	value := rlp.String{Str: rlp.Encode(rlp.String{Str: []byte{0x12, 0x34}})}
+	account := rlp.String{Str: rlp.Encode(rlp.List{Items: []rlp.Item{
+		rlp.Uint64{Value: 5},
+		rlp.Uint64{Value: 7},
+		rlp.String{Str: hash[:]},
+		rlp.String{Str: emptyCodeHash[:]},
+	}})}
+
+	tests := map[string]struct {
+		path    []byte
+		payload rlp.Item
+		check   func(*testing.T, Node)
+	}{
+		"even extension": {[]byte{0x00, 0x12}, rlp.String{Str: hash[:]}, func(t *testing.T, node Node) {
+			ext, ok := node.(*ExtensionNode)
+			if !ok || ext.path.Length() != 2 || ext.nextHash != hash || ext.nextIsEmbedded {
+				t.Errorf("unexpected node: %v", node)
+			}
+		}},
+		"odd extension": {[]byte{0x11, 0x23}, rlp.String{Str: hash[:]}, func(t *testing.T, node Node) {
+			ext, ok := node.(*ExtensionNode)
+			if !ok || ext.path.Length() != 3 || ext.nextHash != hash {
+				t.Errorf("unexpected node: %v", node)
+			}
+		}},
+		"value leaf": {[]byte{0x20, 0x12}, value, func(t *testing.T, node Node) {
+			leaf, ok := node.(*ValueNode)
+			if !ok || leaf.pathLength != 2 || leaf.value != (common.Value{30: 0x12, 31: 0x34}) {
+				t.Errorf("unexpected node: %v", node)
+			}
+		}},
+		"account leaf": {[]byte{0x31, 0x23}, account, func(t *testing.T, node Node) {
+			leaf, ok := node.(*AccountNode)
+			if !ok || leaf.pathLength != 3 || leaf.info.Nonce != common.ToNonce(5) || leaf.storageHash != hash || leaf.info.CodeHash != emptyCodeHash {
+				t.Errorf("unexpected node: %v", node)
+			}
+		}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			node, err := DecodeEthereumNode(rlp.Encode(rlp.List{Items: []rlp.Item{rlp.String{Str: test.path}, test.payload}}))
+			if err != nil {
+				t.Fatalf("failed to decode node: %v", err)
+			}
+			test.check(t, node)
+		})
+	}
+}
+
+func TestDecoder_DecodeEthereumNode_BranchRetainsEmbeddedChildren(t *testing.T) {
+	hash := common.Keccak256([]byte{1})
+	embedded := rlp.List{Items: []rlp.Item{rlp.String{Str: []byte{0x3A}}, rlp.String{Str: []byte{0x01}}}}
+	items := make([]rlp.Item, 17)
+	for i := range items {
+		items[i] = rlp.String{}
+	}
+	items[2] = rlp.String{Str: hash[:]}
+	items[5] = embedded
+	node, err := DecodeEthereumNode(rlp.Encode(rlp.List{Items: items}))
+	if err != nil {
+		t.Fatalf("failed to decode node: %v", err)
+	}
+	branch, ok := node.(*BranchNode)
+	if !ok {
+		t.Fatalf("unexpected node type: %T", node)
+	}
+	for i := 0; i < 16; i++ {
+		want := EmptyNodeEthereumHash
+		switch i {
+		case 2:
+			want = hash
+		case 5:
+			want = common.Hash{}
+			copy(want[:], rlp.Encode(embedded))
+		}
+		if branch.hashes[i] != want {
+			t.Errorf("unexpected hash of child %d, wanted %x, got %x", i, want, branch.hashes[i])
+		}
+		if got, want := branch.isEmbedded(byte(i)), i == 5; got != want {
+			t.Errorf("unexpected embedded flag of child %d, wanted %t, got %t", i, want, got)
+		}
+	}
+}
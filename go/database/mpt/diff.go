@@ -11,7 +11,11 @@
 package mpt
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"reflect"
 	"sort"
 	"strings"
@@ -78,6 +82,198 @@ func (d *AccountDiff) Empty() bool {
 	return !d.Reset && d.Balance == nil && d.Nonce == nil && d.Code == nil && len(d.Storage) == 0
 }
 
+// Diffs are serialized for transportation using the format
+//
+//	[<magic>, <version>, <count>, <account>*, <checksum>]
+//
+// where magic is a 4-byte marker, version and count are 4-byte integers, and
+// the checksum is a CRC32 checksum of all account entries. Accounts are
+// ordered by their address and each account is encoded as
+//
+//	[<address>, <flags>, <balance>?, <nonce>?, <code hash>?, <count>, (<key>, <value>)*]
+//
+// where flags is a single byte marking the reset of the account and the
+// presence of the optional balance, nonce, and code hash fields. Slots are
+// ordered by their key.
+const (
+	diffMagic   = "CDIF"
+	diffVersion = 1
+
+	diffFlagReset   = 1 << 0
+	diffFlagBalance = 1 << 1
+	diffFlagNonce   = 1 << 2
+	diffFlagCode    = 1 << 3
+)
+
+// Write serializes this diff to the given writer. The encoding is
+// deterministic, thus equal diffs are encoded identically.
+func (d Diff) Write(writer io.Writer) error {
+	var header [12]byte
+	copy(header[0:4], diffMagic)
+	binary.BigEndian.PutUint32(header[4:8], diffVersion)
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(d)))
+	if _, err := writer.Write(header[:]); err != nil {
+		return err
+	}
+
+	checksum := crc32.NewIEEE()
+	out := io.MultiWriter(writer, checksum)
+	addresses := maps.Keys(d)
+	sort.Slice(addresses, func(i, j int) bool {
+		return bytes.Compare(addresses[i][:], addresses[j][:]) < 0
+	})
+	for _, address := range addresses {
+		if err := d[address].write(address, out); err != nil {
+			return err
+		}
+	}
+
+	var buffer [4]byte
+	binary.BigEndian.PutUint32(buffer[:], checksum.Sum32())
+	_, err := writer.Write(buffer[:])
+	return err
+}
+
+func (d *AccountDiff) write(address common.Address, writer io.Writer) error {
+	buffer := make([]byte, 0, len(address)+1+len(common.Balance{})+len(common.Nonce{})+len(common.Hash{})+4)
+	buffer = append(buffer, address[:]...)
+	flags := byte(0)
+	if d.Reset {
+		flags |= diffFlagReset
+	}
+	if d.Balance != nil {
+		flags |= diffFlagBalance
+	}
+	if d.Nonce != nil {
+		flags |= diffFlagNonce
+	}
+	if d.Code != nil {
+		flags |= diffFlagCode
+	}
+	buffer = append(buffer, flags)
+	if d.Balance != nil {
+		buffer = append(buffer, d.Balance[:]...)
+	}
+	if d.Nonce != nil {
+		buffer = append(buffer, d.Nonce[:]...)
+	}
+	if d.Code != nil {
+		buffer = append(buffer, d.Code[:]...)
+	}
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(d.Storage)))
+	if _, err := writer.Write(buffer); err != nil {
+		return err
+	}
+
+	keys := maps.Keys(d.Storage)
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+	var slot [len(common.Key{}) + len(common.Value{})]byte
+	for _, key := range keys {
+		value := d.Storage[key]
+		copy(slot[:len(key)], key[:])
+		copy(slot[len(key):], value[:])
+		if _, err := writer.Write(slot[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadDiff parses a diff serialized by Diff.Write from the given reader.
+func ReadDiff(reader io.Reader) (Diff, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read diff header: %w", err)
+	}
+	if got := string(header[0:4]); got != diffMagic {
+		return nil, fmt.Errorf("invalid diff marker %q", got)
+	}
+	if got := binary.BigEndian.Uint32(header[4:8]); got != diffVersion {
+		return nil, fmt.Errorf("unsupported diff version %d", got)
+	}
+	count := int(binary.BigEndian.Uint32(header[8:12]))
+
+	checksum := crc32.NewIEEE()
+	in := io.TeeReader(reader, checksum)
+	res := Diff{}
+	for i := 0; i < count; i++ {
+		address, diff, err := readAccountDiff(in)
+		if err != nil {
+			return nil, err
+		}
+		if _, found := res[address]; found {
+			return nil, fmt.Errorf("duplicated diff entry for account %x", address)
+		}
+		res[address] = diff
+	}
+
+	var buffer [4]byte
+	if _, err := io.ReadFull(reader, buffer[:]); err != nil {
+		return nil, fmt.Errorf("failed to read checksum: %w", err)
+	}
+	if want, got := checksum.Sum32(), binary.BigEndian.Uint32(buffer[:]); want != got {
+		return nil, fmt.Errorf("invalid diff checksum, wanted %x, got %x", want, got)
+	}
+	return res, nil
+}
+
+func readAccountDiff(reader io.Reader) (common.Address, *AccountDiff, error) {
+	var address common.Address
+	var flags [1]byte
+	if _, err := io.ReadFull(reader, address[:]); err != nil {
+		return address, nil, fmt.Errorf("failed to read account address: %w", err)
+	}
+	if _, err := io.ReadFull(reader, flags[:]); err != nil {
+		return address, nil, fmt.Errorf("failed to read flags of account %x: %w", address, err)
+	}
+	if flags[0]&^(diffFlagReset|diffFlagBalance|diffFlagNonce|diffFlagCode) != 0 {
+		return address, nil, fmt.Errorf("invalid flags of account %x: %x", address, flags[0])
+	}
+
+	diff := &AccountDiff{Reset: flags[0]&diffFlagReset != 0}
+	if flags[0]&diffFlagBalance != 0 {
+		diff.Balance = new(common.Balance)
+		if _, err := io.ReadFull(reader, diff.Balance[:]); err != nil {
+			return address, nil, fmt.Errorf("failed to read balance of account %x: %w", address, err)
+		}
+	}
+	if flags[0]&diffFlagNonce != 0 {
+		diff.Nonce = new(common.Nonce)
+		if _, err := io.ReadFull(reader, diff.Nonce[:]); err != nil {
+			return address, nil, fmt.Errorf("failed to read nonce of account %x: %w", address, err)
+		}
+	}
+	if flags[0]&diffFlagCode != 0 {
+		diff.Code = new(common.Hash)
+		if _, err := io.ReadFull(reader, diff.Code[:]); err != nil {
+			return address, nil, fmt.Errorf("failed to read code hash of account %x: %w", address, err)
+		}
+	}
+
+	var length [4]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		return address, nil, fmt.Errorf("failed to read slot count of account %x: %w", address, err)
+	}
+	count := int(binary.BigEndian.Uint32(length[:]))
+	if count > 0 {
+		diff.Storage = map[common.Key]common.Value{}
+	}
+	for i := 0; i < count; i++ {
+		var key common.Key
+		var value common.Value
+		if _, err := io.ReadFull(reader, key[:]); err != nil {
+			return address, nil, fmt.Errorf("failed to read slot key of account %x: %w", address, err)
+		}
+		if _, err := io.ReadFull(reader, value[:]); err != nil {
+			return address, nil, fmt.Errorf("failed to read slot value of account %x: %w", address, err)
+		}
+		diff.Storage[key] = value
+	}
+	return address, diff, nil
+}
+
 func GetDiff(
 	source NodeSource,
 	before *NodeReference,
@@ -131,7 +327,8 @@ func (p *triePosition) getChild(source NodeSource, nibble Nibble) (triePosition,
 	defer handle.Release()
 
 	if p.ref.Id().IsAccount() {
-		path := AddressToNibblePath(handle.Get().(*AccountNode).address, source)
+		var buffer nibblePathBuffer
+		path := buffer.setAddress(handle.Get().(*AccountNode).address, source)
 		if path[p.depth] == nibble {
 			return triePosition{ref: p.ref, depth: p.depth + 1}, nil
 		}
@@ -139,7 +336,8 @@ func (p *triePosition) getChild(source NodeSource, nibble Nibble) (triePosition,
 	}
 
 	if p.ref.Id().IsValue() {
-		path := KeyToNibblePath(handle.Get().(*ValueNode).key, source)
+		var buffer nibblePathBuffer
+		path := buffer.setKey(handle.Get().(*ValueNode).key, source)
 		if path[p.depth] == nibble {
 			return triePosition{ref: p.ref, depth: p.depth + 1}, nil
 		}
@@ -394,3 +592,173 @@ func recordValueUpdate(
 	}
 	diff.Storage[key] = value
 }
+
+// ----------------------------------------------------------------------------
+//                               Storage Diffs
+// ----------------------------------------------------------------------------
+
+// SlotDiff describes the values of a storage slot differing between the
+// storage tries of two accounts. A zero value marks a slot not present in
+// the respective storage trie.
+type SlotDiff struct {
+	A common.Value
+	B common.Value
+}
+
+// DiffResult lists all storage slots with different values in the storage
+// tries of two accounts.
+type DiffResult map[common.Key]SlotDiff
+
+func (d DiffResult) Equal(other DiffResult) bool {
+	return reflect.DeepEqual(d, other)
+}
+
+func (d DiffResult) String() string {
+	keys := maps.Keys(d)
+	sort.Slice(keys, func(i, j int) bool {
+		return string(keys[i][:]) < string(keys[j][:])
+	})
+
+	builder := strings.Builder{}
+	builder.WriteString("DiffResult {\n")
+	for _, key := range keys {
+		diff := d[key]
+		builder.WriteString(fmt.Sprintf("\t%x: %x <-> %x\n", key[:], diff.A[:], diff.B[:]))
+	}
+	builder.WriteString("}")
+	return builder.String()
+}
+
+// DiffStorage compares the storage tries of the accounts addrA and addrB in
+// the trie rooted by the given node. Accounts not present in the trie are
+// treated like accounts with an empty storage. Both storage tries are walked
+// in lockstep, skipping sub-tries with equal hashes. Thus, hashes of the trie
+// are required to be up-to-date.
+func DiffStorage(
+	source NodeSource,
+	root *NodeReference,
+	addrA, addrB common.Address,
+) (DiffResult, error) {
+	return diffStorage(source, root, addrA, root, addrB)
+}
+
+// diffStorage is a generalization of DiffStorage locating the two accounts
+// in the tries rooted by the given nodes.
+func diffStorage(
+	source NodeSource,
+	rootA *NodeReference,
+	addrA common.Address,
+	rootB *NodeReference,
+	addrB common.Address,
+) (DiffResult, error) {
+	storageA, err := getStorageRoot(source, rootA, addrA)
+	if err != nil {
+		return nil, err
+	}
+	storageB, err := getStorageRoot(source, rootB, addrB)
+	if err != nil {
+		return nil, err
+	}
+	result := DiffResult{}
+	if err := collectStorageDiff(source, result, triePosition{ref: storageA}, triePosition{ref: storageB}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// getStorageRoot locates the root of the storage trie of the given account.
+// If the account does not exist, a reference to the empty node is returned.
+func getStorageRoot(source NodeSource, root *NodeReference, address common.Address) (NodeReference, error) {
+	storage := emptyNodeReference
+	_, err := VisitPathToAccount(source, root, address, MakeVisitor(func(node Node, _ NodeInfo) VisitResponse {
+		if account, ok := node.(*AccountNode); ok && account.address == address {
+			storage = account.storage
+		}
+		return VisitResponseContinue
+	}))
+	return storage, err
+}
+
+func collectStorageDiff(
+	source NodeSource,
+	result DiffResult,
+	a triePosition,
+	b triePosition,
+) error {
+	if a.id() == b.id() {
+		return nil
+	}
+
+	// Sub-tries at the same position with equal hashes have equal content.
+	// Positions within extension nodes have no hash of their own.
+	if a.offset == 0 && b.offset == 0 {
+		hashA, err := source.getHashFor(&a.ref)
+		if err != nil {
+			return err
+		}
+		hashB, err := source.getHashFor(&b.ref)
+		if err != nil {
+			return err
+		}
+		if hashA == hashB {
+			return nil
+		}
+	}
+
+	if a.isLeaf() && b.isLeaf() {
+		return collectStorageDiffFromLeafs(source, result, a, b)
+	}
+
+	for i := Nibble(0); i < Nibble(16); i++ {
+		lhs, err := a.getChild(source, i)
+		if err != nil {
+			return err
+		}
+		rhs, err := b.getChild(source, i)
+		if err != nil {
+			return err
+		}
+		if err := collectStorageDiff(source, result, lhs, rhs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func collectStorageDiffFromLeafs(source NodeSource, result DiffResult, a triePosition, b triePosition) error {
+	var valueA, valueB *ValueNode
+	if a.id().IsValue() {
+		handle, err := a.getReadAccess(source)
+		if err != nil {
+			return err
+		}
+		defer handle.Release()
+		valueA = handle.Get().(*ValueNode)
+	}
+	if b.id().IsValue() {
+		handle, err := b.getReadAccess(source)
+		if err != nil {
+			return err
+		}
+		defer handle.Release()
+		valueB = handle.Get().(*ValueNode)
+	}
+
+	if valueA != nil && valueB != nil && valueA.key == valueB.key {
+		if valueA.value != valueB.value {
+			result[valueA.key] = SlotDiff{A: valueA.value, B: valueB.value}
+		}
+		return nil
+	}
+	if valueA != nil {
+		diff := result[valueA.key]
+		diff.A = valueA.value
+		result[valueA.key] = diff
+	}
+	if valueB != nil {
+		diff := result[valueB.key]
+		diff.B = valueB.value
+		result[valueB.key] = diff
+	}
+	return nil
+}
@@ -11,6 +11,7 @@
 package mpt
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"testing"
@@ -493,3 +494,214 @@ func TestDiff_DiffsCanBePrinted(t *testing.T) {
 		})
 	}
 }
+
+func TestDiff_DiffsCanBeSerializedAndParsed(t *testing.T) {
+	for name, test := range getDiffScenarios() {
+		t.Run(name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			if err := test.diff.Write(&buffer); err != nil {
+				t.Fatalf("failed to serialize diff: %v", err)
+			}
+			restored, err := ReadDiff(&buffer)
+			if err != nil {
+				t.Fatalf("failed to parse diff: %v", err)
+			}
+			if want, got := test.diff, restored; !want.Equal(got) {
+				t.Errorf("unexpected diff, wanted %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestDiff_SerializationIsDeterministic(t *testing.T) {
+	diff := Diff{
+		common.Address{1}: &AccountDiff{Reset: true},
+		common.Address{2}: &AccountDiff{
+			Balance: &common.Balance{1},
+			Storage: map[common.Key]common.Value{
+				{1}: {2},
+				{3}: {4},
+				{5}: {},
+			},
+		},
+		common.Address{3}: &AccountDiff{Nonce: &common.Nonce{2}, Code: &common.Hash{3}},
+	}
+	var first, second bytes.Buffer
+	if err := diff.Write(&first); err != nil {
+		t.Fatalf("failed to serialize diff: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		second.Reset()
+		if err := diff.Write(&second); err != nil {
+			t.Fatalf("failed to serialize diff: %v", err)
+		}
+		if !bytes.Equal(first.Bytes(), second.Bytes()) {
+			t.Fatalf("serialization is not deterministic")
+		}
+	}
+}
+
+func TestDiff_CorruptedSerializationsAreDetected(t *testing.T) {
+	diff := Diff{
+		common.Address{1}: &AccountDiff{Reset: true},
+		common.Address{2}: &AccountDiff{
+			Nonce:   &common.Nonce{1},
+			Storage: map[common.Key]common.Value{{1}: {2}},
+		},
+	}
+	var buffer bytes.Buffer
+	if err := diff.Write(&buffer); err != nil {
+		t.Fatalf("failed to serialize diff: %v", err)
+	}
+	data := buffer.Bytes()
+
+	for i := 0; i < len(data); i++ {
+		if _, err := ReadDiff(bytes.NewReader(data[:i])); err == nil {
+			t.Errorf("truncation to %d bytes not detected", i)
+		}
+		corrupted := bytes.Clone(data)
+		corrupted[i]++
+		if _, err := ReadDiff(bytes.NewReader(corrupted)); err == nil {
+			t.Errorf("modification of byte %d not detected", i)
+		}
+	}
+}
+
+func TestDiffStorage_StorageOfAccountsIsCompared(t *testing.T) {
+	addrA := common.Address{1}
+	addrB := common.Address{2}
+	addrC := common.Address{3} // < an account without storage
+	addrD := common.Address{4} // < an account not present in the trie
+	addrE := common.Address{5} // < an account with the same storage as A
+
+	slots := func(address common.Address, values map[byte]byte) []common.SlotUpdate {
+		res := []common.SlotUpdate{}
+		for key, value := range values {
+			res = append(res, common.SlotUpdate{Account: address, Key: common.Key{key}, Value: common.Value{value}})
+		}
+		return res
+	}
+
+	update := common.Update{
+		CreatedAccounts: []common.Address{addrA, addrB, addrC, addrE},
+		Nonces: []common.NonceUpdate{
+			{Account: addrA, Nonce: common.ToNonce(1)},
+			{Account: addrB, Nonce: common.ToNonce(1)},
+			{Account: addrC, Nonce: common.ToNonce(1)},
+			{Account: addrE, Nonce: common.ToNonce(1)},
+		},
+	}
+	update.Slots = append(update.Slots, slots(addrA, map[byte]byte{1: 1, 2: 2, 3: 3})...)
+	update.Slots = append(update.Slots, slots(addrB, map[byte]byte{2: 2, 3: 4, 5: 5})...)
+	update.Slots = append(update.Slots, slots(addrE, map[byte]byte{1: 1, 2: 2, 3: 3})...)
+
+	tests := map[string]struct {
+		a, b common.Address
+		want DiffResult
+	}{
+		"partial_overlap": {addrA, addrB, DiffResult{
+			{1}: {A: common.Value{1}},
+			{3}: {A: common.Value{3}, B: common.Value{4}},
+			{5}: {B: common.Value{5}},
+		}},
+		"reversed": {addrB, addrA, DiffResult{
+			{1}: {B: common.Value{1}},
+			{3}: {A: common.Value{4}, B: common.Value{3}},
+			{5}: {A: common.Value{5}},
+		}},
+		"same_account":    {addrA, addrA, DiffResult{}},
+		"equal_storage":   {addrA, addrE, DiffResult{}},
+		"a_without_slots": {addrC, addrB, DiffResult{{2}: {B: common.Value{2}}, {3}: {B: common.Value{4}}, {5}: {B: common.Value{5}}}},
+		"b_without_slots": {addrA, addrC, DiffResult{{1}: {A: common.Value{1}}, {2}: {A: common.Value{2}}, {3}: {A: common.Value{3}}}},
+		"both_empty":      {addrC, addrD, DiffResult{}},
+		"a_missing":       {addrD, addrA, DiffResult{{1}: {B: common.Value{1}}, {2}: {B: common.Value{2}}, {3}: {B: common.Value{3}}}},
+	}
+
+	for _, config := range []MptConfig{S4ArchiveConfig, S5ArchiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			archive, err := OpenArchiveTrie(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open archive: %v", err)
+			}
+			defer archive.Close()
+			if err := archive.Add(0, update, nil); err != nil {
+				t.Fatalf("failed to add block: %v", err)
+			}
+
+			for name, test := range tests {
+				t.Run(name, func(t *testing.T) {
+					got, err := archive.DiffStorage(0, test.a, test.b)
+					if err != nil {
+						t.Fatalf("failed to diff storage: %v", err)
+					}
+					if !got.Equal(test.want) {
+						t.Errorf("unexpected diff, wanted %v, got %v", test.want, got)
+					}
+				})
+			}
+
+			if _, err := archive.DiffStorage(1, addrA, addrB); err == nil {
+				t.Errorf("diffing storage of a missing block should fail")
+			}
+		})
+	}
+}
+
+func TestDiffStorage_EqualSubTriesAreSkipped(t *testing.T) {
+	addrA := common.Address{1}
+	addrB := common.Address{2}
+
+	update := common.Update{
+		CreatedAccounts: []common.Address{addrA, addrB},
+		Nonces: []common.NonceUpdate{
+			{Account: addrA, Nonce: common.ToNonce(1)},
+			{Account: addrB, Nonce: common.ToNonce(1)},
+		},
+	}
+	for i := 0; i < 100; i++ {
+		key := common.Key{byte(i)}
+		update.Slots = append(update.Slots,
+			common.SlotUpdate{Account: addrA, Key: key, Value: common.Value{1}},
+			common.SlotUpdate{Account: addrB, Key: key, Value: common.Value{1}},
+		)
+	}
+	// A single slot is different.
+	update.Slots = append(update.Slots, common.SlotUpdate{Account: addrB, Key: common.Key{0xFF, 1}, Value: common.Value{2}})
+
+	archive, err := OpenArchiveTrie(t.TempDir(), S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+	if err := archive.Add(0, update, nil); err != nil {
+		t.Fatalf("failed to add block: %v", err)
+	}
+
+	source := &readCountingNodeSource{NodeSource: archive.nodeSource}
+	root := archive.roots.get(0).NodeRef
+	got, err := DiffStorage(source, &root, addrA, addrB)
+	if err != nil {
+		t.Fatalf("failed to diff storage: %v", err)
+	}
+	if want := (DiffResult{{0xFF, 1}: {B: common.Value{2}}}); !got.Equal(want) {
+		t.Errorf("unexpected diff, wanted %v, got %v", want, got)
+	}
+
+	// Only nodes on the path to the differing slot should be visited. A full
+	// comparison would need to read each of the 201 value nodes.
+	if source.reads == 0 || source.reads > 100 {
+		t.Errorf("unexpected number of node reads: %d", source.reads)
+	}
+}
+
+// readCountingNodeSource is a NodeSource counting the number of requested
+// read accesses.
+type readCountingNodeSource struct {
+	NodeSource
+	reads int
+}
+
+func (s *readCountingNodeSource) getReadAccess(ref *NodeReference) (shared.ReadHandle[Node], error) {
+	s.reads++
+	return s.NodeSource.getReadAccess(ref)
+}
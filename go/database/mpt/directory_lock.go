@@ -11,29 +11,206 @@
 package mpt
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/Fantom-foundation/Carmen/go/common"
 )
 
 const lockFileName = "~lock"
 
-// LockDirectory acquires a lock on the given directory. If needed,
-// the directory is implicitly created. The operation fails if the
-// lock can not be acquired due to some other thread or process holding
-// the lock or due to an IO error.
+// readerLockFilePrefix is the prefix of the names of files registering
+// read-only lock holders of a directory, one file per holder.
+const readerLockFilePrefix = "~lock-reader-"
+
+// DirectoryAccess defines the kind of access granted by a directory lock.
+type DirectoryAccess int
+
+const (
+	// ReadWriteAccess grants exclusive access to a directory. It can only be
+	// obtained if no other read-write or read-only lock is held.
+	ReadWriteAccess DirectoryAccess = iota
+	// ReadOnlyAccess grants read access shared with other readers. It can
+	// only be obtained if no read-write lock is held and prevents read-write
+	// locks from being obtained while being held.
+	ReadOnlyAccess
+	// SharedReadOnlyAccess grants read access regardless of other lock
+	// holders and does not prevent others from obtaining any lock. Since a
+	// writer may modify the directory at any time, readers may observe
+	// inconsistent content, e.g. partially written files or references to
+	// nodes not flushed yet. It is thus only suitable for diagnostics.
+	SharedReadOnlyAccess
+)
+
+func (a DirectoryAccess) String() string {
+	switch a {
+	case ReadWriteAccess:
+		return "read-write"
+	case ReadOnlyAccess:
+		return "read-only"
+	case SharedReadOnlyAccess:
+		return "shared-read-only"
+	}
+	return fmt.Sprintf("DirectoryAccess(%d)", int(a))
+}
+
+// lockHolder is the content of lock files, identifying the process holding
+// a lock for error messages and the detection of stale locks.
+type lockHolder struct {
+	Pid    int
+	Access string
+}
+
+// readerLockCounter provides unique names for reader lock files of this
+// process, allowing multiple readers of the same directory in one process.
+var readerLockCounter atomic.Uint64
+
+// LockDirectory acquires a lock on the given directory for read-write
+// access. See LockDirectoryWithAccess for details.
+func LockDirectory(directory string) (common.LockFile, error) {
+	return LockDirectoryWithAccess(directory, ReadWriteAccess)
+}
+
+// LockDirectoryWithAccess acquires a lock on the given directory granting
+// the given kind of access. If needed, the directory is implicitly created.
+// The operation fails if the lock can not be acquired due to some other
+// thread or process holding a conflicting lock or due to an IO error. The
+// error names the process holding a conflicting lock.
+//
+// Locks are represented by files in the directory recording the ID of the
+// holding process. Locks are not automatically released when a process gets
+// terminated. However, locks of processes no longer alive are considered
+// stale and are taken over. Lock files not naming a process, e.g. created
+// by older versions, are considered held and need to be removed manually.
 //
 // Note: if successful, the acquired lock needs to be explicitly released.
-// The lock is not automatically released when the process is terminated.
-func LockDirectory(directory string) (common.LockFile, error) {
+func LockDirectoryWithAccess(directory string, access DirectoryAccess) (common.LockFile, error) {
 	if err := os.MkdirAll(directory, 0700); err != nil {
 		return nil, err
 	}
-	lock, err := common.CreateLockFile(filepath.Join(directory, lockFileName))
+	if access == SharedReadOnlyAccess {
+		return &sharedDirectoryLock{valid: true}, nil
+	}
+	if access != ReadWriteAccess && access != ReadOnlyAccess {
+		return nil, fmt.Errorf("unsupported directory access: %v", access)
+	}
+
+	// The inspection of present locks and the creation of a new one are
+	// serialized among all lockers by a lock on the directory itself, such
+	// that stale locks can be safely removed.
+	guard, err := syscall.Open(directory, syscall.O_RDONLY, 0)
 	if err != nil {
-		return nil, fmt.Errorf("unable to gain exclusive access to %s: %w", directory, err)
+		return nil, fmt.Errorf("unable to open directory %s for locking: %w", directory, err)
+	}
+	defer syscall.Close(guard)
+	if err := syscall.Flock(guard, syscall.LOCK_EX); err != nil {
+		return nil, fmt.Errorf("unable to lock directory %s: %w", directory, err)
+	}
+	defer syscall.Flock(guard, syscall.LOCK_UN)
+
+	request := "exclusive"
+	if access == ReadOnlyAccess {
+		request = "read"
+	}
+	if err := checkNoConflictingLocks(directory, access); err != nil {
+		return nil, fmt.Errorf("unable to gain %s access to %s: %w", request, directory, err)
+	}
+
+	path := filepath.Join(directory, lockFileName)
+	if access == ReadOnlyAccess {
+		name := fmt.Sprintf("%s%d-%d", readerLockFilePrefix, os.Getpid(), readerLockCounter.Add(1))
+		path = filepath.Join(directory, name)
+	}
+	lock, err := common.CreateLockFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to gain %s access to %s: %w", request, directory, err)
+	}
+	data, err := json.Marshal(lockHolder{Pid: os.Getpid(), Access: access.String()})
+	if err == nil {
+		err = os.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		return nil, errors.Join(err, lock.Release())
 	}
 	return lock, nil
 }
+
+// checkNoConflictingLocks checks that no lock conflicting with the given kind
+// of access is held on the given directory. Stale locks are removed. Must
+// only be called while holding the guard of the directory.
+func checkNoConflictingLocks(directory string, access DirectoryAccess) error {
+	if err := checkLockFile(filepath.Join(directory, lockFileName)); err != nil {
+		return err
+	}
+	if access == ReadOnlyAccess {
+		return nil // readers do not exclude each other
+	}
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), readerLockFilePrefix) {
+			if err := checkLockFile(filepath.Join(directory, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkLockFile checks whether the given lock file is held by a live process.
+// If the file exists but the recorded process is no longer alive, the file
+// is removed. An error describing the holder is returned for held locks.
+func checkLockFile(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var holder lockHolder
+	if err := json.Unmarshal(data, &holder); err != nil || holder.Pid <= 0 {
+		return fmt.Errorf("directory is locked by an unknown process, remove %s if no process is using the directory", path)
+	}
+	if isProcessAlive(holder.Pid) {
+		return fmt.Errorf("directory is locked for %s access by process %d", holder.Access, holder.Pid)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale lock of process %d: %w", holder.Pid, err)
+	}
+	return nil
+}
+
+// isProcessAlive checks whether a process with the given ID exists. Since
+// process IDs may be reused, a stale lock may be considered held if another
+// process got assigned the ID of the terminated holder.
+func isProcessAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// sharedDirectoryLock is the lock granting SharedReadOnlyAccess. Since it
+// does not exclude anybody, no resources are held.
+type sharedDirectoryLock struct {
+	valid bool
+}
+
+func (l *sharedDirectoryLock) Release() error {
+	if !l.valid {
+		return fmt.Errorf("unable to release invalid lock")
+	}
+	l.valid = false
+	return nil
+}
+
+func (l *sharedDirectoryLock) Valid() bool {
+	return l.valid
+}
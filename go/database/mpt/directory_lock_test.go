@@ -11,9 +11,17 @@
 package mpt
 
 import (
+	"bufio"
+	"flag"
 	"fmt"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 )
 
@@ -43,7 +51,7 @@ func TestDirectoryLock_LockIsExclusive(t *testing.T) {
 		t.Fatalf("should not be able to acquire a second lock")
 	}
 
-	want := fmt.Sprintf("unable to gain exclusive access to %s: failed to acquire file lock: file exists", dir)
+	want := fmt.Sprintf("unable to gain exclusive access to %s: directory is locked for read-write access by process %d", dir, os.Getpid())
 	if got := err.Error(); want != got {
 		t.Errorf("unexpected error message, wanted '%s', got '%s'", want, got)
 	}
@@ -64,5 +72,215 @@ func TestDirectoryLock_CannotLockFile(t *testing.T) {
 	if _, err := LockDirectory(file); err == nil {
 		t.Errorf("should not be able to lock a file")
 	}
+}
+
+func TestDirectoryLock_ConcurrentWritersAreExcluded(t *testing.T) {
+	const N = 8
+	dir := t.TempDir()
+	timesAcquired := atomic.Int32{}
+	numOwners := atomic.Int32{}
+
+	var wg sync.WaitGroup
+	wg.Add(N)
+	for i := 0; i < N; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				lock, err := LockDirectory(dir)
+				if err != nil {
+					continue
+				}
+				timesAcquired.Add(1)
+				if owners := numOwners.Add(1); owners > 1 {
+					t.Errorf("invalid number of lock owners: %d", owners)
+				}
+				numOwners.Add(-1)
+				if err := lock.Release(); err != nil {
+					t.Errorf("failed to release lock: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if timesAcquired.Load() < 1 {
+		t.Errorf("lock was never acquired")
+	}
+}
+
+func TestDirectoryLock_ReadersAndWritersExcludeEachOther(t *testing.T) {
+	dir := t.TempDir()
+
+	readerA, err := LockDirectoryWithAccess(dir, ReadOnlyAccess)
+	if err != nil {
+		t.Fatalf("failed to acquire read lock: %v", err)
+	}
+	readerB, err := LockDirectoryWithAccess(dir, ReadOnlyAccess)
+	if err != nil {
+		t.Fatalf("readers should not exclude each other: %v", err)
+	}
+
+	_, err = LockDirectory(dir)
+	want := fmt.Sprintf("directory is locked for read-only access by process %d", os.Getpid())
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("writer should be excluded by readers, wanted error containing '%s', got %v", want, err)
+	}
+
+	if err := readerA.Release(); err != nil {
+		t.Fatalf("failed to release read lock: %v", err)
+	}
+	if err := readerB.Release(); err != nil {
+		t.Fatalf("failed to release read lock: %v", err)
+	}
+
+	writer, err := LockDirectory(dir)
+	if err != nil {
+		t.Fatalf("failed to acquire write lock after readers left: %v", err)
+	}
+	defer writer.Release()
+
+	_, err = LockDirectoryWithAccess(dir, ReadOnlyAccess)
+	want = fmt.Sprintf("unable to gain read access to %s: directory is locked for read-write access by process %d", dir, os.Getpid())
+	if err == nil || err.Error() != want {
+		t.Errorf("reader should be excluded by writer, wanted error '%s', got %v", want, err)
+	}
+}
 
+func TestDirectoryLock_SharedReadersAreAllowedAlongsideWriter(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := LockDirectory(dir)
+	if err != nil {
+		t.Fatalf("failed to acquire write lock: %v", err)
+	}
+	shared, err := LockDirectoryWithAccess(dir, SharedReadOnlyAccess)
+	if err != nil {
+		t.Fatalf("shared reader should not be excluded by writer: %v", err)
+	}
+	if err := writer.Release(); err != nil {
+		t.Fatalf("failed to release write lock: %v", err)
+	}
+
+	// Shared readers do not exclude writers.
+	writer, err = LockDirectory(dir)
+	if err != nil {
+		t.Fatalf("writer should not be excluded by shared reader: %v", err)
+	}
+	if err := writer.Release(); err != nil {
+		t.Fatalf("failed to release write lock: %v", err)
+	}
+
+	if !shared.Valid() {
+		t.Errorf("shared lock should be valid before being released")
+	}
+	if err := shared.Release(); err != nil {
+		t.Fatalf("failed to release shared lock: %v", err)
+	}
+	if shared.Valid() || shared.Release() == nil {
+		t.Errorf("shared lock should only be released once")
+	}
+}
+
+func TestDirectoryLock_StaleLocksOfTerminatedProcessesAreTakenOver(t *testing.T) {
+	// Obtain the ID of a process that is no longer alive.
+	cmd := exec.Command(os.Args[0], "-test.run", "^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("failed to run sub-process: %v", err)
+	}
+	pid := cmd.Process.Pid
+
+	for _, name := range []string{lockFileName, readerLockFilePrefix + "1"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			content := fmt.Sprintf(`{"Pid":%d,"Access":"read-write"}`, pid)
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+				t.Fatalf("failed to create stale lock: %v", err)
+			}
+			lock, err := LockDirectory(dir)
+			if err != nil {
+				t.Fatalf("stale lock should be taken over: %v", err)
+			}
+			if err := lock.Release(); err != nil {
+				t.Fatalf("failed to release lock: %v", err)
+			}
+			if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+				t.Errorf("no lock files should remain, got %v, err %v", entries, err)
+			}
+		})
+	}
+}
+
+func TestDirectoryLock_LockFilesWithoutHolderAreNotTakenOver(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, lockFileName), nil, 0600); err != nil {
+		t.Fatalf("failed to create lock file: %v", err)
+	}
+	if _, err := LockDirectory(dir); err == nil || !strings.Contains(err.Error(), "unknown process") {
+		t.Errorf("lock file without holder should be considered held, got %v", err)
+	}
+}
+
+func TestDirectoryLock_LocksAreRespectedAcrossProcesses(t *testing.T) {
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run", "^TestDirectoryLock_HoldLock$", "-directory_lock_path="+dir)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatalf("failed to create stdin pipe: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("failed to create stdout pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start sub-process: %v", err)
+	}
+	defer stdin.Close()
+
+	// Wait for the sub-process to acquire the lock.
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() && scanner.Text() != "locked" {
+	}
+
+	_, err = LockDirectory(dir)
+	want := fmt.Sprintf("directory is locked for read-write access by process %d", cmd.Process.Pid)
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("lock of other process should be respected, wanted error containing '%s', got %v", want, err)
+	}
+	_, err = LockDirectoryWithAccess(dir, ReadOnlyAccess)
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("lock of other process should exclude readers, wanted error containing '%s', got %v", want, err)
+	}
+
+	// Once the holder crashed, its lock is stale and can be taken over.
+	if err := cmd.Process.Signal(syscall.SIGKILL); err != nil {
+		t.Fatalf("failed to kill sub-process: %v", err)
+	}
+	cmd.Wait()
+	lock, err := LockDirectory(dir)
+	if err != nil {
+		t.Fatalf("lock of crashed process should be taken over: %v", err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatalf("failed to release lock: %v", err)
+	}
+}
+
+var directoryLockPath = flag.String("directory_lock_path", "", "the directory to be locked by a sub-process")
+
+func TestDirectoryLock_HoldLock(t *testing.T) {
+	// This test is a helper for the test above. It is processed in the
+	// sub-process spawned by the main test, holding the lock until the
+	// standard input is closed.
+	dir := *directoryLockPath
+	if dir == "" {
+		return
+	}
+	lock, err := LockDirectory(dir)
+	if err != nil {
+		t.Fatalf("failed to acquire lock: %v", err)
+	}
+	fmt.Println("locked")
+	bufio.NewReader(os.Stdin).ReadString('\n')
+	if err := lock.Release(); err != nil {
+		t.Errorf("failed to release lock: %v", err)
+	}
 }
@@ -0,0 +1,138 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import "sync/atomic"
+
+// dirtyNodeCounter counts the dirty nodes of a single node type in a forest.
+// The forest updates the counter of the respective type whenever the dirty
+// state of a node changes, such that the amount of unflushed data is known
+// without scanning the node cache.
+type dirtyNodeCounter struct {
+	nodes       atomic.Int64
+	encodedSize int64 // the number of bytes of a node of this type on disk
+}
+
+func (c *dirtyNodeCounter) add(delta int64) {
+	c.nodes.Add(delta)
+}
+
+// dirtyNodeCounters are the counters of dirty nodes of all node types of a
+// forest. Dirty nodes are counted from their creation or modification until
+// they are written to disk or released, including the time they spend in the
+// write buffer after being evicted from the node cache.
+type dirtyNodeCounters struct {
+	accounts   dirtyNodeCounter
+	branches   dirtyNodeCounter
+	extensions dirtyNodeCounter
+	values     dirtyNodeCounter
+}
+
+func (c *dirtyNodeCounters) setEncodedSizes(accounts, branches, extensions, values int) {
+	c.accounts.encodedSize = int64(accounts)
+	c.branches.encodedSize = int64(branches)
+	c.extensions.encodedSize = int64(extensions)
+	c.values.encodedSize = int64(values)
+}
+
+func (c *dirtyNodeCounters) all() []*dirtyNodeCounter {
+	return []*dirtyNodeCounter{&c.accounts, &c.branches, &c.extensions, &c.values}
+}
+
+func (c *dirtyNodeCounters) getCount() int {
+	res := int64(0)
+	for _, counter := range c.all() {
+		res += counter.nodes.Load()
+	}
+	return int(res)
+}
+
+func (c *dirtyNodeCounters) getBytes() int64 {
+	res := int64(0)
+	for _, counter := range c.all() {
+		res += counter.nodes.Load() * counter.encodedSize
+	}
+	return res
+}
+
+// forId returns the counter of the type of the given node.
+func (c *dirtyNodeCounters) forId(id NodeId) *dirtyNodeCounter {
+	switch {
+	case id.IsAccount():
+		return &c.accounts
+	case id.IsBranch():
+		return &c.branches
+	case id.IsExtension():
+		return &c.extensions
+	default:
+		return &c.values
+	}
+}
+
+// trackDirtyNode accounts for the referenced node becoming dirty or clean.
+func (s *Forest) trackDirtyNode(ref *NodeReference, dirty bool) {
+	if id := ref.Id(); !id.IsEmpty() {
+		if dirty {
+			s.dirtyNodes.forId(id).add(1)
+		} else {
+			s.dirtyNodes.forId(id).add(-1)
+		}
+	}
+}
+
+// GetDirtyNodeCount returns the number of nodes modified in memory and not
+// yet written to disk.
+func (s *Forest) GetDirtyNodeCount() int {
+	return s.dirtyNodes.getCount()
+}
+
+// GetDirtyNodeBytes returns the number of bytes the nodes modified in memory
+// occupy on disk once written.
+func (s *Forest) GetDirtyNodeBytes() int64 {
+	return s.dirtyNodes.getBytes()
+}
+
+// FlushIfAbove flushes the forest if the number of bytes of dirty nodes
+// exceeds the given watermark. Otherwise, it is a no-op.
+func (s *Forest) FlushIfAbove(bytes int64) error {
+	if s.GetDirtyNodeBytes() <= bytes {
+		return nil
+	}
+	return s.Flush()
+}
+
+// GetDirtyNodeCount returns the number of nodes modified in memory and not
+// yet written to disk. Tries not backed by a forest report no dirty nodes.
+func (s *LiveTrie) GetDirtyNodeCount() int {
+	if forest, ok := s.forest.(*Forest); ok {
+		return forest.GetDirtyNodeCount()
+	}
+	return 0
+}
+
+// GetDirtyNodeBytes returns the number of bytes the nodes modified in memory
+// occupy on disk once written. Tries not backed by a forest report no dirty
+// nodes.
+func (s *LiveTrie) GetDirtyNodeBytes() int64 {
+	if forest, ok := s.forest.(*Forest); ok {
+		return forest.GetDirtyNodeBytes()
+	}
+	return 0
+}
+
+// FlushIfAbove flushes the trie if the number of bytes of dirty nodes exceeds
+// the given watermark. Otherwise, it is a no-op.
+func (s *LiveTrie) FlushIfAbove(bytes int64) error {
+	if s.GetDirtyNodeBytes() <= bytes {
+		return nil
+	}
+	return s.Flush()
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
+)
+
+func TestDirtyNodeCounter_ControlledOperationsProduceExactCounts(t *testing.T) {
+	forest, err := OpenFileForest(t.TempDir(), S4LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	defer forest.Close()
+
+	accountSize, branchSize, extensionSize, valueSize := getEncodedNodeSizes(S4LiveConfig)
+	check := func(wantCount int, wantBytes int64) {
+		t.Helper()
+		if got := forest.GetDirtyNodeCount(); got != wantCount {
+			t.Errorf("unexpected number of dirty nodes, wanted %d, got %d", wantCount, got)
+		}
+		if got := forest.GetDirtyNodeBytes(); got != wantBytes {
+			t.Errorf("unexpected number of dirty bytes, wanted %d, got %d", wantBytes, got)
+		}
+	}
+	check(0, 0)
+
+	// A single account is the root of the trie.
+	root := NewNodeReference(EmptyId())
+	root, err = forest.SetAccountInfo(&root, common.Address{0x10}, AccountInfo{Nonce: common.ToNonce(1)})
+	if err != nil {
+		t.Fatalf("failed to set account: %v", err)
+	}
+	check(1, accountSize)
+
+	// A slot adds a value node.
+	root, err = forest.SetValue(&root, common.Address{0x10}, common.Key{1}, common.Value{1})
+	if err != nil {
+		t.Fatalf("failed to set value: %v", err)
+	}
+	check(2, accountSize+valueSize)
+
+	// A second account sharing the first nibble adds an extension, a branch,
+	// and an account node.
+	root, err = forest.SetAccountInfo(&root, common.Address{0x12}, AccountInfo{Nonce: common.ToNonce(1)})
+	if err != nil {
+		t.Fatalf("failed to set account: %v", err)
+	}
+	check(5, 2*accountSize+branchSize+extensionSize+valueSize)
+
+	if _, _, err := forest.updateHashesFor(&root); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+	check(5, 2*accountSize+branchSize+extensionSize+valueSize)
+
+	if err := forest.Flush(); err != nil {
+		t.Fatalf("failed to flush forest: %v", err)
+	}
+	check(0, 0)
+
+	// Modifying a flushed account dirties the nodes on its path.
+	root, err = forest.SetAccountInfo(&root, common.Address{0x12}, AccountInfo{Nonce: common.ToNonce(2)})
+	if err != nil {
+		t.Fatalf("failed to set account: %v", err)
+	}
+	check(3, accountSize+branchSize+extensionSize)
+
+	// Deleting the first account releases its dirty value and clean account,
+	// and collapses the branch and the extension into the second account.
+	root, err = forest.SetAccountInfo(&root, common.Address{0x10}, AccountInfo{})
+	if err != nil {
+		t.Fatalf("failed to delete account: %v", err)
+	}
+	if err := forest.Flush(); err != nil {
+		t.Fatalf("failed to flush forest: %v", err)
+	}
+	check(0, 0)
+
+	// Releasing dirty nodes removes them from the count.
+	root, err = forest.SetValue(&root, common.Address{0x12}, common.Key{1}, common.Value{1})
+	if err != nil {
+		t.Fatalf("failed to set value: %v", err)
+	}
+	check(2, accountSize+valueSize)
+	root, err = forest.SetValue(&root, common.Address{0x12}, common.Key{1}, common.Value{})
+	if err != nil {
+		t.Fatalf("failed to delete value: %v", err)
+	}
+	check(1, accountSize)
+
+	// Hashes need to be up-to-date for closing the forest.
+	if _, _, err := forest.updateHashesFor(&root); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+}
+
+func TestDirtyNodeCounter_CountsMatchDirtyNodesOfForest(t *testing.T) {
+	tests := map[string]struct {
+		config MptConfig
+		mode   StorageMode
+	}{
+		"S4-Live":    {S4LiveConfig, Mutable},
+		"S5-Live":    {S5LiveConfig, Mutable},
+		"S4-Archive": {S4ArchiveConfig, Immutable},
+		"S5-Archive": {S5ArchiveConfig, Immutable},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			// The small cache causes dirty nodes to be evicted.
+			forest, err := OpenFileForest(t.TempDir(), test.config, ForestConfig{Mode: test.mode, CacheCapacity: 64})
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+			defer forest.Close()
+
+			root := NewNodeReference(EmptyId())
+			addresses := getTestAddresses(50)
+			for round := 0; round < 3; round++ {
+				for i, addr := range addresses {
+					root, err = forest.SetAccountInfo(&root, addr, AccountInfo{Nonce: common.ToNonce(uint64(round + 1))})
+					if err != nil {
+						t.Fatalf("failed to set account: %v", err)
+					}
+					root, err = forest.SetValue(&root, addr, common.Key{byte(i % 3)}, common.Value{byte(round + 1)})
+					if err != nil {
+						t.Fatalf("failed to set value: %v", err)
+					}
+					// Only nodes with clean hashes can be written when evicted.
+					if _, _, err := forest.updateHashesFor(&root); err != nil {
+						t.Fatalf("failed to update hashes: %v", err)
+					}
+				}
+				root, err = forest.SetAccountInfo(&root, addresses[round], AccountInfo{})
+				if err != nil {
+					t.Fatalf("failed to delete account: %v", err)
+				}
+				if _, _, err := forest.updateHashesFor(&root); err != nil {
+					t.Fatalf("failed to update hashes: %v", err)
+				}
+				checkDirtyNodeCount(t, forest)
+				if test.mode == Immutable {
+					// Frozen nodes are copied by subsequent updates.
+					if err := forest.Freeze(&root); err != nil {
+						t.Fatalf("failed to freeze trie: %v", err)
+					}
+				}
+			}
+			if err := forest.Flush(); err != nil {
+				t.Fatalf("failed to flush forest: %v", err)
+			}
+			if got := forest.GetDirtyNodeCount(); got != 0 {
+				t.Errorf("flushed forest should have no dirty nodes, got %d", got)
+			}
+		})
+	}
+}
+
+func TestDirtyNodeCounter_ReopenedForestHasNoDirtyNodes(t *testing.T) {
+	dir := t.TempDir()
+	trie, err := OpenFileLiveTrie(dir, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	for _, addr := range getTestAddresses(10) {
+		if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+			t.Fatalf("failed to set account: %v", err)
+		}
+	}
+	if err := trie.Close(); err != nil {
+		t.Fatalf("failed to close trie: %v", err)
+	}
+
+	trie, err = OpenFileLiveTrie(dir, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to reopen trie: %v", err)
+	}
+	defer trie.Close()
+	if got := trie.GetDirtyNodeCount(); got != 0 {
+		t.Errorf("reopened trie should have no dirty nodes, got %d", got)
+	}
+
+	// Nodes loaded from disk are counted once modified.
+	if err := trie.SetAccountInfo(getTestAddresses(10)[0], AccountInfo{Nonce: common.ToNonce(2)}); err != nil {
+		t.Fatalf("failed to set account: %v", err)
+	}
+	if got := trie.GetDirtyNodeCount(); got == 0 {
+		t.Errorf("modified nodes should be counted")
+	}
+	checkDirtyNodeCount(t, trie.forest.(*Forest))
+}
+
+func TestDirtyNodeCounter_FlushIfAboveOnlyFlushesAboveWatermark(t *testing.T) {
+	trie, err := OpenFileLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+
+	for _, addr := range getTestAddresses(10) {
+		if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+			t.Fatalf("failed to set account: %v", err)
+		}
+	}
+	count, bytes := trie.GetDirtyNodeCount(), trie.GetDirtyNodeBytes()
+	if count == 0 || bytes == 0 {
+		t.Fatalf("trie should have dirty nodes, got %d nodes with %d bytes", count, bytes)
+	}
+
+	for _, watermark := range []int64{bytes, bytes + 1} {
+		if err := trie.FlushIfAbove(watermark); err != nil {
+			t.Fatalf("failed to flush trie: %v", err)
+		}
+		if got := trie.GetDirtyNodeCount(); got != count {
+			t.Errorf("watermark %d not exceeded by %d bytes should not flush, dirty nodes before %d, after %d", watermark, bytes, count, got)
+		}
+	}
+
+	if err := trie.FlushIfAbove(bytes - 1); err != nil {
+		t.Fatalf("failed to flush trie: %v", err)
+	}
+	if got, gotBytes := trie.GetDirtyNodeCount(), trie.GetDirtyNodeBytes(); got != 0 || gotBytes != 0 {
+		t.Errorf("exceeded watermark should flush the trie, got %d dirty nodes with %d bytes", got, gotBytes)
+	}
+}
+
+// checkDirtyNodeCount compares the dirty node counters of the given forest
+// with the number of dirty nodes in its node cache, after writing the nodes
+// evicted from the cache.
+func checkDirtyNodeCount(t *testing.T, forest *Forest) {
+	t.Helper()
+	if err := forest.writeBuffer.Flush(); err != nil {
+		t.Fatalf("failed to flush write buffer: %v", err)
+	}
+	want := 0
+	forest.nodeCache.ForEach(func(_ NodeId, node *shared.Shared[Node]) {
+		handle := node.GetViewHandle()
+		if handle.Get().IsDirty() {
+			want++
+		}
+		handle.Release()
+	})
+	if got := forest.GetDirtyNodeCount(); got != want {
+		t.Errorf("unexpected number of dirty nodes, wanted %d, got %d", want, got)
+	}
+}
+
+func getEncodedNodeSizes(config MptConfig) (accounts, branches, extensions, values int64) {
+	accountEncoder, branchEncoder, extensionEncoder, valueEncoder := getEncoder(config)
+	return int64(accountEncoder.GetEncodedSize()),
+		int64(branchEncoder.GetEncodedSize()),
+		int64(extensionEncoder.GetEncodedSize()),
+		int64(valueEncoder.GetEncodedSize())
+}
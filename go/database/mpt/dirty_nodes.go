@@ -0,0 +1,92 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+const dirtyNodesUnsupportedErr = common.ConstError("listing dirty nodes is only supported by forests")
+
+// DirtyNodes returns the IDs of all nodes in the trie rooted by the given
+// node modified or created since the last update of the trie's hashes. Nodes
+// are listed in the order they are visited by Visit. Released nodes are not
+// included. Since updating hashes clears the dirty-hash markers followed by
+// this function, the set is empty after each hash update.
+func (s *Forest) DirtyNodes(rootRef *NodeReference) ([]NodeId, error) {
+	res := []NodeId{}
+	if err := s.collectDirtyNodes(rootRef, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// collectDirtyNodes adds the referenced node to the given list if its hash is
+// dirty and descends into all children with dirty hashes. Like the hasher,
+// it only follows children marked dirty by their parents, such that clean
+// parts of the trie are never visited.
+func (s *Forest) collectDirtyNodes(ref *NodeReference, res *[]NodeId) error {
+	if ref.Id().IsEmpty() {
+		return nil
+	}
+	handle, err := s.getViewAccess(ref)
+	if err != nil {
+		return err
+	}
+	defer handle.Release()
+
+	if node, ok := handle.Get().(interface{ getHashStatus() hashStatus }); ok {
+		if node.getHashStatus() == hashStatusDirty {
+			*res = append(*res, ref.Id())
+		}
+	}
+
+	var next []NodeReference
+	switch node := handle.Get().(type) {
+	case *AccountNode:
+		if node.storageHashDirty {
+			next = append(next, node.storage)
+		}
+	case *BranchNode:
+		for i, child := range node.children {
+			if !child.Id().IsEmpty() && node.isChildHashDirty(byte(i)) {
+				next = append(next, child)
+			}
+		}
+	case *ExtensionNode:
+		if node.nextHashDirty {
+			next = append(next, node.next)
+		}
+	}
+
+	for i := range next {
+		if err := s.collectDirtyNodes(&next[i], res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DirtyNodes returns the IDs of the nodes modified since the last hash update.
+// See Forest.DirtyNodes for details.
+func (s *LiveTrie) DirtyNodes() ([]NodeId, error) {
+	forest, ok := s.forest.(*Forest)
+	if !ok {
+		return nil, dirtyNodesUnsupportedErr
+	}
+	return forest.DirtyNodes(&s.root)
+}
+
+// DirtyNodes returns the IDs of the nodes modified since the last hash update.
+// See Forest.DirtyNodes for details.
+func (s *MptState) DirtyNodes() ([]NodeId, error) {
+	return s.trie.DirtyNodes()
+}
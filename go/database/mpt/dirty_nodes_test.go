@@ -0,0 +1,126 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestDirtyNodes_MatchNodesOnModifiedPath(t *testing.T) {
+	configs := []MptConfig{S4LiveConfig, S5LiveConfig, S5LiveNoExtensionsConfig}
+	for _, config := range configs {
+		t.Run(config.Name, func(t *testing.T) {
+			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer trie.Close()
+			forest := trie.forest.(*Forest)
+
+			for i := 0; i < 50; i++ {
+				addr := common.Address{byte(i), byte(i * 7)}
+				if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+					t.Fatalf("failed to create account: %v", err)
+				}
+				for j := 0; j < 10; j++ {
+					if err := trie.SetValue(addr, common.Key{byte(j)}, common.Value{1}); err != nil {
+						t.Fatalf("failed to set value: %v", err)
+					}
+				}
+			}
+			if _, _, err := trie.UpdateHashes(); err != nil {
+				t.Fatalf("failed to update hashes: %v", err)
+			}
+			checkDirtyNodes(t, trie, nil)
+
+			// Modify the storage of one account, which does not change the
+			// structure of the trie.
+			addr := common.Address{12, 12 * 7}
+			key := common.Key{4}
+			if err := trie.SetValue(addr, key, common.Value{2}); err != nil {
+				t.Fatalf("failed to set value: %v", err)
+			}
+
+			want := []NodeId{}
+			var storage NodeReference
+			collect := func(res *[]NodeId) NodeVisitor {
+				return MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+					*res = append(*res, info.Id)
+					if account, ok := node.(*AccountNode); ok {
+						storage = account.storage
+					}
+					return VisitResponseContinue
+				})
+			}
+			if found, err := VisitPathToAccount(forest, &trie.root, addr, collect(&want)); err != nil || !found {
+				t.Fatalf("failed to visit path to account: %t, %v", found, err)
+			}
+			if found, err := VisitPathToStorage(forest, &storage, key, collect(&want)); err != nil || !found {
+				t.Fatalf("failed to visit path to slot: %t, %v", found, err)
+			}
+			checkDirtyNodes(t, trie, want)
+
+			// Updating the hashes clears the set of dirty nodes.
+			if _, _, err := trie.UpdateHashes(); err != nil {
+				t.Fatalf("failed to update hashes: %v", err)
+			}
+			checkDirtyNodes(t, trie, nil)
+		})
+	}
+}
+
+func TestDirtyNodes_NewNodesAreIncluded(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	checkDirtyNodes(t, trie, nil)
+
+	addr := common.Address{1}
+	if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+	checkDirtyNodes(t, trie, []NodeId{trie.root.Id()})
+
+	if err := trie.SetAccountInfo(common.Address{2}, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+	ids, err := trie.DirtyNodes()
+	if err != nil {
+		t.Fatalf("failed to get dirty nodes: %v", err)
+	}
+	if want, got := 3, len(ids); want != got {
+		t.Errorf("unexpected number of dirty nodes, wanted %d, got %d: %v", want, got, ids)
+	}
+	for _, id := range ids {
+		if !id.IsBranch() && !id.IsAccount() {
+			t.Errorf("unexpected dirty node %v", id)
+		}
+	}
+}
+
+func checkDirtyNodes(t *testing.T, trie *LiveTrie, want []NodeId) {
+	t.Helper()
+	got, err := trie.DirtyNodes()
+	if err != nil {
+		t.Fatalf("failed to get dirty nodes: %v", err)
+	}
+	if len(want) == 0 && len(got) == 0 {
+		return
+	}
+	if !slices.Equal(want, got) {
+		t.Errorf("unexpected dirty nodes, wanted %v, got %v", want, got)
+	}
+}
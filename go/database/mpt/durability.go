@@ -0,0 +1,97 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import "time"
+
+// DurabilityMode defines when the state of committed blocks is synced to
+// disk. A block is committed by applying its update to a live state or by
+// adding it to an archive. Syncing a block flushes all dirty nodes through
+// the write buffer into the node stocks, forces the stocks to disk, and
+// persists the meta data (root of the live state, roots of the archive)
+// describing the block.
+//
+// Independently of the mode, an MPT directory remains marked as dirty and
+// locked while it is opened. After a crash, both marks are retained and the
+// directory is refused when being re-opened. Recovering it requires removing
+// the lock file and the dirty mark manually, followed by a verification of
+// the content (see VerifyFileLiveTrie and VerifyArchiveTrie).
+//
+// For LiveDBs, blocks committed since the last sync can additionally be
+// recovered by enabling an update journal (see ForestConfig.UpdateJournal),
+// which is replayed when re-opening the recovered directory.
+type DurabilityMode int
+
+const (
+	// Periodic is the default mode, favoring throughput over durability. The
+	// state is only synced when the time since the last sync exceeds the
+	// configured period, when it is explicitly flushed or committed, or when
+	// it is closed. After a crash, the directory may contain an arbitrary mix of
+	// nodes of blocks committed since the last sync. Only the state of the
+	// last synced block can be recovered, and only if the crash did not
+	// happen while writing to disk; otherwise the directory has to be
+	// rebuilt from a backup or the archive.
+	Periodic DurabilityMode = iota
+	// Eager syncs the state after each block is committed, before the commit
+	// operation returns. This limits the throughput, but after a crash the
+	// state of the last committed block is retained on disk and can be
+	// recovered, unless the crash occurred during the commit itself.
+	Eager
+)
+
+func (m DurabilityMode) String() string {
+	if m == Eager {
+		return "Eager"
+	} else {
+		return "Periodic"
+	}
+}
+
+// commitSyncer decides when the state of committed blocks needs to be synced
+// according to a configured durability mode. It is not thread safe, commits
+// are expected to be serialized by its owner.
+type commitSyncer struct {
+	mode     DurabilityMode
+	period   time.Duration
+	lastSync time.Time
+}
+
+func makeCommitSyncer(config ForestConfig) commitSyncer {
+	return commitSyncer{
+		mode:     config.Durability,
+		period:   config.DurabilitySyncPeriod,
+		lastSync: time.Now(),
+	}
+}
+
+// isSyncDue is called after each committed block and reports whether the
+// committed state should be synced to disk. If so, the time of the sync is
+// recorded for subsequent decisions.
+func (s *commitSyncer) isSyncDue() bool {
+	if s.mode == Eager {
+		return true
+	}
+	if s.period <= 0 {
+		return false
+	}
+	now := time.Now()
+	if now.Sub(s.lastSync) < s.period {
+		return false
+	}
+	s.lastSync = now
+	return true
+}
+
+// markSynced records a sync of the state triggered outside of committing
+// blocks, e.g. by an explicit commit, restarting the current period.
+func (s *commitSyncer) markSynced() {
+	s.lastSync = time.Now()
+}
@@ -0,0 +1,639 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestDurabilityMode_String(t *testing.T) {
+	if got, want := Periodic.String(), "Periodic"; got != want {
+		t.Errorf("unexpected name, wanted %s, got %s", want, got)
+	}
+	if got, want := Eager.String(), "Eager"; got != want {
+		t.Errorf("unexpected name, wanted %s, got %s", want, got)
+	}
+}
+
+func TestDurabilityMode_DefaultIsPeriodic(t *testing.T) {
+	if got, want := (ForestConfig{}).Durability, Periodic; got != want {
+		t.Errorf("unexpected default durability mode, wanted %v, got %v", want, got)
+	}
+}
+
+func TestCommitSyncer_EagerModeSyncsEveryCommit(t *testing.T) {
+	syncer := makeCommitSyncer(ForestConfig{Durability: Eager, DurabilitySyncPeriod: time.Hour})
+	for i := 0; i < 5; i++ {
+		if !syncer.isSyncDue() {
+			t.Fatalf("eager mode should sync after commit %d", i)
+		}
+	}
+}
+
+func TestCommitSyncer_PeriodicModeWithoutPeriodNeverSyncs(t *testing.T) {
+	syncer := makeCommitSyncer(ForestConfig{Durability: Periodic})
+	for i := 0; i < 5; i++ {
+		if syncer.isSyncDue() {
+			t.Fatalf("periodic mode without period should not sync after commit %d", i)
+		}
+	}
+}
+
+func TestCommitSyncer_PeriodicModeSyncsOnlyAfterPeriodHasPassed(t *testing.T) {
+	const period = 50 * time.Millisecond
+	syncer := makeCommitSyncer(ForestConfig{Durability: Periodic, DurabilitySyncPeriod: period})
+	if syncer.isSyncDue() {
+		t.Fatalf("sync should not be due before the period has passed")
+	}
+	time.Sleep(period)
+	if !syncer.isSyncDue() {
+		t.Fatalf("sync should be due after the period has passed")
+	}
+	if syncer.isSyncDue() {
+		t.Fatalf("sync should not be due right after a sync")
+	}
+}
+
+func TestMptState_EagerDurability_CrashAfterApplyRetainsLatestRoot(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			forestConfig := ForestConfig{CacheCapacity: 1024, Durability: Eager}
+			state, err := OpenGoFileStateWithConfig(dir, config, forestConfig)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer state.Close()
+
+			want := applyDurabilityTestBlocks(t, state)
+
+			recovered := simulateCrash(t, dir)
+			if err := VerifyFileLiveTrie(recovered, config, nil); err != nil {
+				t.Fatalf("recovered state is invalid: %v", err)
+			}
+			state, err = OpenGoFileStateWithConfig(recovered, config, forestConfig)
+			if err != nil {
+				t.Fatalf("failed to re-open state after crash: %v", err)
+			}
+			defer state.Close()
+
+			got, err := state.GetHash()
+			if err != nil {
+				t.Fatalf("failed to get hash: %v", err)
+			}
+			if want != got {
+				t.Errorf("latest root not retained, wanted hash %x, got %x", want, got)
+			}
+		})
+	}
+}
+
+func TestMptState_PeriodicDurability_CrashAfterApplyLosesUnsyncedBlocks(t *testing.T) {
+	dir := t.TempDir()
+	forestConfig := ForestConfig{CacheCapacity: 1024, Durability: Periodic, DurabilitySyncPeriod: time.Hour}
+	state, err := OpenGoFileStateWithConfig(dir, S5LiveConfig, forestConfig)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+
+	applyDurabilityTestBlocks(t, state)
+
+	metadata, _, err := readMetadata(filepath.Join(simulateCrash(t, dir), "meta.json"))
+	if err != nil {
+		t.Fatalf("failed to read metadata: %v", err)
+	}
+	if want, got := EmptyId(), metadata.RootNode; want != got {
+		t.Errorf("unsynced blocks should not be visible on disk, wanted root %v, got %v", want, got)
+	}
+}
+
+func TestMptState_Commit_CrashAfterCommitRetainsCommittedRoot(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			forestConfig := ForestConfig{CacheCapacity: 1024, Durability: Periodic, DurabilitySyncPeriod: time.Hour}
+			state, err := OpenGoFileStateWithConfig(dir, config, forestConfig)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer state.Close()
+
+			want := applyDurabilityTestBlocks(t, state)
+			if err := state.SetCode(common.Address{1}, []byte{1, 2, 3}); err != nil {
+				t.Fatalf("failed to set code: %v", err)
+			}
+			want, err = state.GetHash()
+			if err != nil {
+				t.Fatalf("failed to get hash: %v", err)
+			}
+			committed, err := state.Commit()
+			if err != nil {
+				t.Fatalf("failed to commit state: %v", err)
+			}
+			if want != committed {
+				t.Errorf("unexpected committed hash, wanted %x, got %x", want, committed)
+			}
+			if got, err := state.GetHash(); err != nil || got != committed {
+				t.Errorf("hash does not match committed hash, wanted %x, got %x, err %v", committed, got, err)
+			}
+
+			// Updates after the commit are not durable.
+			if err := state.SetNonce(common.Address{1}, common.ToNonce(12)); err != nil {
+				t.Fatalf("failed to set nonce: %v", err)
+			}
+
+			recovered := simulateCrash(t, dir)
+			if err := VerifyFileLiveTrie(recovered, config, nil); err != nil {
+				t.Fatalf("recovered state is invalid: %v", err)
+			}
+			state, err = OpenGoFileStateWithConfig(recovered, config, forestConfig)
+			if err != nil {
+				t.Fatalf("failed to re-open state after crash: %v", err)
+			}
+			defer state.Close()
+
+			if got, err := state.GetHash(); err != nil || got != committed {
+				t.Errorf("committed root not retained, wanted hash %x, got %x, err %v", committed, got, err)
+			}
+			if code, err := state.GetCode(common.Address{1}); err != nil || !bytes.Equal(code, []byte{1, 2, 3}) {
+				t.Errorf("committed code not retained, got %x, err %v", code, err)
+			}
+		})
+	}
+}
+
+func TestMptState_UpdateJournal_CrashBetweenApplyAndFlushReplaysBlocks(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			forestConfig := getUpdateJournalTestConfig()
+			state, err := OpenGoFileStateWithConfig(dir, config, forestConfig)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer state.Close()
+
+			applyDurabilityTestBlockRange(t, state, 0, 3)
+			if _, err := state.Commit(); err != nil {
+				t.Fatalf("failed to commit state: %v", err)
+			}
+			want := applyDurabilityTestBlockRange(t, state, 3, 5)
+
+			recovered := simulateCrash(t, dir)
+			if err := VerifyFileLiveTrie(recovered, config, nil); err != nil {
+				t.Fatalf("recovered state is invalid: %v", err)
+			}
+			state, err = OpenGoFileStateWithConfig(recovered, config, forestConfig)
+			if err != nil {
+				t.Fatalf("failed to re-open state after crash: %v", err)
+			}
+			defer state.Close()
+
+			if got, err := state.GetHash(); err != nil || want != got {
+				t.Errorf("journaled blocks not replayed, wanted hash %x, got %x, err %v", want, got, err)
+			}
+			if want, got := getDurabilityTestHash(t, config, 5), want; want != got {
+				t.Errorf("unexpected hash of replayed state, wanted %x, got %x", want, got)
+			}
+			if size := getUpdateJournalSize(t, recovered); size != 0 {
+				t.Errorf("journal should be truncated after the replay, got size %d", size)
+			}
+		})
+	}
+}
+
+func TestMptState_UpdateJournal_CrashBetweenJournalAndApplyReplaysBlock(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			forestConfig := getUpdateJournalTestConfig()
+			state, err := OpenGoFileStateWithConfig(dir, config, forestConfig)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer state.Close()
+
+			applyDurabilityTestBlockRange(t, state, 0, 2)
+			if _, err := state.Commit(); err != nil {
+				t.Fatalf("failed to commit state: %v", err)
+			}
+			applyDurabilityTestBlockRange(t, state, 2, 3)
+			update := durabilityTestUpdate(3)
+			if err := state.journal.appendUpdate(3, &update); err != nil {
+				t.Fatalf("failed to journal update: %v", err)
+			}
+
+			recovered := simulateCrash(t, dir)
+			state, err = OpenGoFileStateWithConfig(recovered, config, forestConfig)
+			if err != nil {
+				t.Fatalf("failed to re-open state after crash: %v", err)
+			}
+			defer state.Close()
+
+			want := getDurabilityTestHash(t, config, 4)
+			if got, err := state.GetHash(); err != nil || want != got {
+				t.Errorf("journaled block not replayed, wanted hash %x, got %x, err %v", want, got, err)
+			}
+		})
+	}
+}
+
+func TestMptState_UpdateJournal_BlocksCoveredBySyncedStateAreSkipped(t *testing.T) {
+	dir := t.TempDir()
+	forestConfig := getUpdateJournalTestConfig()
+	state, err := OpenGoFileStateWithConfig(dir, S5LiveConfig, forestConfig)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+
+	want := applyDurabilityTestBlocks(t, state)
+	journal, err := os.ReadFile(filepath.Join(dir, updateJournalFile))
+	if err != nil {
+		t.Fatalf("failed to read journal: %v", err)
+	}
+	if _, err := state.Commit(); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+
+	// Simulates a crash after syncing the state but before truncating the journal.
+	recovered := simulateCrash(t, dir)
+	if err := os.WriteFile(filepath.Join(recovered, updateJournalFile), journal, 0600); err != nil {
+		t.Fatalf("failed to restore journal: %v", err)
+	}
+	state, err = OpenGoFileStateWithConfig(recovered, S5LiveConfig, forestConfig)
+	if err != nil {
+		t.Fatalf("failed to re-open state after crash: %v", err)
+	}
+	defer state.Close()
+
+	if got, err := state.GetHash(); err != nil || want != got {
+		t.Errorf("unexpected hash after crash, wanted %x, got %x, err %v", want, got, err)
+	}
+}
+
+func TestMptState_UpdateJournal_ReplayVerifiesRecordedHashes(t *testing.T) {
+	dir := t.TempDir()
+	forestConfig := getUpdateJournalTestConfig()
+	state, err := OpenGoFileStateWithConfig(dir, S5LiveConfig, forestConfig)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	applyDurabilityTestBlocks(t, state)
+
+	recovered := simulateCrash(t, dir)
+	filename := filepath.Join(recovered, updateJournalFile)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read journal: %v", err)
+	}
+	blocks, err := parseUpdateJournal(data)
+	if err != nil {
+		t.Fatalf("failed to parse journal: %v", err)
+	}
+	blocks[1].hash[0]++
+	data = nil
+	for _, block := range blocks {
+		data = append(data, encodeUpdateJournalRecord(updateJournalUpdateRecord, block.block, block.update.ToBytes())...)
+		data = append(data, encodeUpdateJournalRecord(updateJournalRootRecord, block.block, block.hash[:])...)
+	}
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		t.Fatalf("failed to write journal: %v", err)
+	}
+
+	if _, err := OpenGoFileStateWithConfig(recovered, S5LiveConfig, forestConfig); err == nil {
+		t.Fatalf("replay of block with mismatching hash should fail")
+	}
+	if dirty, err := isDirty(recovered); !dirty || err != nil {
+		t.Errorf("directory should remain dirty after failed replay: %t, %v", dirty, err)
+	}
+}
+
+func TestMptState_UpdateJournal_IsTruncatedWhenStateIsSynced(t *testing.T) {
+	dir := t.TempDir()
+	state, err := OpenGoFileStateWithConfig(dir, S5LiveConfig, getUpdateJournalTestConfig())
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+
+	applyDurabilityTestBlocks(t, state)
+	if size := getUpdateJournalSize(t, dir); size == 0 {
+		t.Errorf("journal should record applied blocks")
+	}
+	if err := state.Flush(); err != nil {
+		t.Fatalf("failed to flush state: %v", err)
+	}
+	if size := getUpdateJournalSize(t, dir); size != 0 {
+		t.Errorf("journal should be truncated by flush, got size %d", size)
+	}
+}
+
+func TestMptState_UpdateJournal_SizeLimitForcesSync(t *testing.T) {
+	dir := t.TempDir()
+	forestConfig := getUpdateJournalTestConfig()
+	forestConfig.UpdateJournalSizeLimit = 1
+	state, err := OpenGoFileStateWithConfig(dir, S5LiveConfig, forestConfig)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+
+	want := applyDurabilityTestBlocks(t, state)
+	if size := getUpdateJournalSize(t, dir); size != 0 {
+		t.Errorf("journal exceeding its limit should be truncated, got size %d", size)
+	}
+	metadata, _, err := readMetadata(filepath.Join(simulateCrash(t, dir), "meta.json"))
+	if err != nil {
+		t.Fatalf("failed to read metadata: %v", err)
+	}
+	if got := metadata.RootHash; want != got {
+		t.Errorf("state should be synced when journal is full, wanted root %x, got %x", want, got)
+	}
+}
+
+// getUpdateJournalTestConfig returns a forest configuration with an update
+// journal where modified nodes are only written to disk when syncing the
+// state, such that the synced state is retained on disk after a crash.
+func getUpdateJournalTestConfig() ForestConfig {
+	return ForestConfig{
+		CacheCapacity:         1024,
+		BackgroundFlushPeriod: -1,
+		Durability:            Periodic,
+		DurabilitySyncPeriod:  time.Hour,
+		UpdateJournal:         true,
+	}
+}
+
+func getUpdateJournalSize(t *testing.T, directory string) int64 {
+	t.Helper()
+	info, err := os.Stat(filepath.Join(directory, updateJournalFile))
+	if err != nil {
+		t.Fatalf("failed to get journal size: %v", err)
+	}
+	return info.Size()
+}
+
+func TestRecoverFileLiveTrie_CrashedStateIsRecovered(t *testing.T) {
+	dir := t.TempDir()
+	state, err := OpenGoFileStateWithConfig(dir, S5LiveConfig, ForestConfig{CacheCapacity: 1024})
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	want := applyDurabilityTestBlocks(t, state)
+	if _, err := state.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	recovered := simulateCrash(t, dir)
+	if err := markDirty(recovered); err != nil {
+		t.Fatalf("failed to restore dirty mark: %v", err)
+	}
+	if _, err := OpenGoFileState(recovered, S5LiveConfig, 1024); err == nil {
+		t.Fatalf("opening a crashed state should fail")
+	}
+
+	if err := RecoverFileLiveTrie(recovered, S5LiveConfig, nil); err != nil {
+		t.Fatalf("failed to recover state: %v", err)
+	}
+	state, err = OpenGoFileState(recovered, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open recovered state: %v", err)
+	}
+	defer state.Close()
+	if got, err := state.GetHash(); err != nil || want != got {
+		t.Errorf("unexpected hash of recovered state, wanted %x, got %x, err %v", want, got, err)
+	}
+}
+
+func TestRecoverFileLiveTrie_CorruptedStateRemainsDirty(t *testing.T) {
+	dir := t.TempDir()
+	state, err := OpenGoFileStateWithConfig(dir, S5LiveConfig, ForestConfig{CacheCapacity: 1024})
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	applyDurabilityTestBlocks(t, state)
+	if _, err := state.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	recovered := simulateCrash(t, dir)
+	if err := markDirty(recovered); err != nil {
+		t.Fatalf("failed to restore dirty mark: %v", err)
+	}
+	// The recorded root hash no longer matches the content of the state.
+	file := filepath.Join(recovered, "meta.json")
+	data, _, err := readMetadata(file)
+	if err != nil {
+		t.Fatalf("failed to read metadata: %v", err)
+	}
+	data.RootHash[0]++
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		t.Fatalf("failed to encode metadata: %v", err)
+	}
+	if err := os.WriteFile(file, encoded, 0600); err != nil {
+		t.Fatalf("failed to corrupt metadata: %v", err)
+	}
+
+	if err := RecoverFileLiveTrie(recovered, S5LiveConfig, nil); err == nil {
+		t.Errorf("recovery of corrupted state should fail")
+
+	}
+	if dirty, err := isDirty(recovered); !dirty || err != nil {
+		t.Errorf("directory of unrecovered state should remain dirty: %t, %v", dirty, err)
+	}
+}
+
+func TestRecoverFileLiveTrie_CleanDirectoriesAreNotModified(t *testing.T) {
+	dir := t.TempDir()
+	state, err := OpenGoFileState(dir, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	applyDurabilityTestBlocks(t, state)
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+	if err := RecoverFileLiveTrie(dir, S5LiveConfig, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if dirty, err := isDirty(dir); dirty || err != nil {
+		t.Errorf("clean directory should remain clean: %t, %v", dirty, err)
+	}
+}
+
+func TestArchiveTrie_EagerDurability_CrashAfterAddRetainsLatestRoot(t *testing.T) {
+	for _, config := range []MptConfig{S4ArchiveConfig, S5ArchiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			forestConfig := ForestConfig{CacheCapacity: 1024, Durability: Eager}
+			archive, err := OpenArchiveTrieWithConfig(dir, config, forestConfig)
+			if err != nil {
+				t.Fatalf("failed to open archive: %v", err)
+			}
+			defer archive.Close()
+
+			const numBlocks = 3
+			for block := uint64(0); block < numBlocks; block++ {
+				addr := common.Address{byte(block)}
+				err := archive.Add(block, common.Update{
+					CreatedAccounts: []common.Address{addr},
+					Balances:        []common.BalanceUpdate{{Account: addr, Balance: common.Balance{1}}},
+				}, nil)
+				if err != nil {
+					t.Fatalf("failed to add block %d: %v", block, err)
+				}
+			}
+			want, err := archive.GetHash(numBlocks - 1)
+			if err != nil {
+				t.Fatalf("failed to get hash: %v", err)
+			}
+
+			recovered := simulateCrash(t, dir)
+			if err := VerifyArchiveTrie(recovered, config, nil); err != nil {
+				t.Fatalf("recovered archive is invalid: %v", err)
+			}
+			archive, err = OpenArchiveTrieWithConfig(recovered, config, forestConfig)
+			if err != nil {
+				t.Fatalf("failed to re-open archive after crash: %v", err)
+			}
+			defer archive.Close()
+
+			height, empty, err := archive.GetBlockHeight()
+			if err != nil || empty || height != numBlocks-1 {
+				t.Fatalf("unexpected block height after crash, wanted %d, got %d, empty %t, err %v", numBlocks-1, height, empty, err)
+			}
+			got, err := archive.GetHash(height)
+			if err != nil {
+				t.Fatalf("failed to get hash: %v", err)
+			}
+			if want != got {
+				t.Errorf("latest root not retained, wanted hash %x, got %x", want, got)
+			}
+		})
+	}
+}
+
+// applyDurabilityTestBlocks applies a few blocks to the given state and
+// returns the hash of the resulting state.
+func applyDurabilityTestBlocks(t *testing.T, state *MptState) common.Hash {
+	t.Helper()
+	return applyDurabilityTestBlockRange(t, state, 0, 3)
+}
+
+// applyDurabilityTestBlockRange applies the blocks in the range [from, to)
+// to the given state and returns the hash of the resulting state.
+func applyDurabilityTestBlockRange(t *testing.T, state *MptState, from, to uint64) common.Hash {
+	t.Helper()
+	for block := from; block < to; block++ {
+		hints, err := state.Apply(block, durabilityTestUpdate(block))
+		if err != nil {
+			t.Fatalf("failed to apply block %d: %v", block, err)
+		}
+		if hints != nil {
+			hints.Release()
+		}
+	}
+	hash, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+	return hash
+}
+
+// durabilityTestUpdate returns the update of the given block applied by the
+// durability tests.
+func durabilityTestUpdate(block uint64) common.Update {
+	addr := common.Address{byte(block)}
+	return common.Update{
+		CreatedAccounts: []common.Address{addr},
+		Balances:        []common.BalanceUpdate{{Account: addr, Balance: common.Balance{1}}},
+		Slots:           []common.SlotUpdate{{Account: addr, Key: common.Key{1}, Value: common.Value{1}}},
+	}
+}
+
+// getDurabilityTestHash computes the hash of a state of the given
+// configuration after applying the first blocks of the durability tests.
+func getDurabilityTestHash(t *testing.T, config MptConfig, blocks uint64) common.Hash {
+	t.Helper()
+	state, err := OpenGoMemoryState(t.TempDir(), config, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	return applyDurabilityTestBlockRange(t, state, 0, blocks)
+}
+
+// simulateCrash creates a copy of the given directory of an opened MPT as it
+// would be found on disk if the process was killed at this point and
+// performs the manual recovery steps by removing the lock and dirty marks.
+// The path of the recovered copy is returned.
+func simulateCrash(t *testing.T, directory string) string {
+	t.Helper()
+	target := t.TempDir()
+	err := filepath.WalkDir(directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return os.MkdirAll(filepath.Join(target, rel), 0700)
+		}
+		return copyFile(path, filepath.Join(target, rel))
+	})
+	if err != nil {
+		t.Fatalf("failed to copy directory: %v", err)
+	}
+	if dirty, err := isDirty(target); !dirty || err != nil {
+		t.Fatalf("directory of crashed MPT should be dirty: %t, %v", dirty, err)
+	}
+	if err := os.Remove(filepath.Join(target, lockFileName)); err != nil {
+		t.Fatalf("failed to remove lock file: %v", err)
+	}
+	if err := markClean(target); err != nil {
+		t.Fatalf("failed to remove dirty mark: %v", err)
+	}
+	return target
+}
+
+func copyFile(source, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
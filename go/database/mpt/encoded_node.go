@@ -0,0 +1,46 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+)
+
+// GetEncodedNode returns the encoding of the given node as held by the stock
+// of its type, which can be decoded using the node encoders of the forest's
+// configuration. Since stocks encode nodes deterministically, the result is
+// obtained by re-encoding the node fetched from the stock. Modifications of
+// the node not yet flushed are not covered. Empty nodes are not stored, and
+// thus have no encoding.
+func (s *Forest) GetEncodedNode(id NodeId) ([]byte, error) {
+	accounts, branches, extensions, values := getEncoder(s.config)
+	switch {
+	case id.IsAccount():
+		return getEncodedNode(s.accounts, accounts, id.Index())
+	case id.IsBranch():
+		return getEncodedNode(s.branches, branches, id.Index())
+	case id.IsExtension():
+		return getEncodedNode(s.extensions, extensions, id.Index())
+	case id.IsValue():
+		return getEncodedNode(s.values, values, id.Index())
+	}
+	return nil, fmt.Errorf("node %v has no encoding", id)
+}
+
+func getEncodedNode[V any](source stock.Stock[uint64, V], encoder stock.ValueEncoder[V], index uint64) ([]byte, error) {
+	node, err := source.Get(index)
+	if err != nil {
+		return nil, err
+	}
+	return encodeNode(encoder, &node)
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestForest_GetEncodedNode_ReturnsBytesHeldByStocks(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			forest, err := OpenFileForest(dir, config, ForestConfig{Mode: Mutable, CacheCapacity: 1024})
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+			defer forest.Close()
+
+			root := NewNodeReference(EmptyId())
+			for i, addr := range getTestAddresses(20) {
+				root, err = forest.SetAccountInfo(&root, addr, AccountInfo{Nonce: common.ToNonce(uint64(i + 1))})
+				if err != nil {
+					t.Fatalf("failed to set account: %v", err)
+				}
+				root, err = forest.SetValue(&root, addr, common.Key{byte(i)}, common.Value{byte(i + 1)})
+				if err != nil {
+					t.Fatalf("failed to set value: %v", err)
+				}
+			}
+			if _, _, err := forest.updateHashesFor(&root); err != nil {
+				t.Fatalf("failed to update hashes: %v", err)
+			}
+			if err := forest.Flush(); err != nil {
+				t.Fatalf("failed to flush forest: %v", err)
+			}
+
+			accounts, branches, extensions, values := getEncoder(config)
+			counts := map[string]int{}
+			err = forest.VisitTrie(&root, MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+				encoded, err := forest.GetEncodedNode(info.Id)
+				if err != nil {
+					t.Fatalf("failed to get encoding of node %v: %v", info.Id, err)
+				}
+				switch node := node.(type) {
+				case *AccountNode:
+					checkEncodedNode(t, dir+"/accounts", info.Id, encoded, accounts, node)
+					counts["accounts"]++
+				case *BranchNode:
+					checkEncodedNode(t, dir+"/branches", info.Id, encoded, branches, node)
+					counts["branches"]++
+				case *ExtensionNode:
+					checkEncodedNode(t, dir+"/extensions", info.Id, encoded, extensions, node)
+					counts["extensions"]++
+				case *ValueNode:
+					decoded := checkEncodedNode(t, dir+"/values", info.Id, encoded, values, node)
+					if decoded.key != node.key || decoded.value != node.value {
+						t.Errorf("unexpected decoded value node, wanted %v/%v, got %v/%v", node.key, node.value, decoded.key, decoded.value)
+					}
+					counts["values"]++
+				}
+				return VisitResponseContinue
+			}))
+			if err != nil {
+				t.Fatalf("failed to visit trie: %v", err)
+			}
+			if counts["accounts"] == 0 || counts["branches"] == 0 || counts["values"] == 0 {
+				t.Errorf("not all node types were covered: %v", counts)
+			}
+		})
+	}
+}
+
+func TestForest_GetEncodedNode_EmptyNodesHaveNoEncoding(t *testing.T) {
+	forest, err := OpenInMemoryForest(t.TempDir(), S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	defer forest.Close()
+	if _, err := forest.GetEncodedNode(EmptyId()); err == nil {
+		t.Errorf("empty nodes should have no encoding")
+	}
+}
+
+// checkEncodedNode checks that the given encoding of a node matches the bytes
+// in the values file of the given stock directory, and that it decodes to a
+// node with the same encoding as the given node. The decoded node is returned.
+func checkEncodedNode[V any](t *testing.T, directory string, id NodeId, encoded []byte, encoder stock.ValueEncoder[V], node *V) V {
+	t.Helper()
+	size := encoder.GetEncodedSize()
+	if len(encoded) != size {
+		t.Fatalf("unexpected size of encoding of node %v, wanted %d, got %d", id, size, len(encoded))
+	}
+
+	file, err := os.Open(directory + "/values.dat")
+	if err != nil {
+		t.Fatalf("failed to open stock file: %v", err)
+	}
+	defer file.Close()
+	stored := make([]byte, size)
+	if _, err := file.ReadAt(stored, int64(id.Index())*int64(size)); err != nil {
+		t.Fatalf("failed to read stock file: %v", err)
+	}
+	if !bytes.Equal(encoded, stored) {
+		t.Errorf("encoding of node %v differs from stored bytes\nwanted %x\n   got %x", id, stored, encoded)
+	}
+
+	var decoded V
+	if err := encoder.Load(encoded, &decoded); err != nil {
+		t.Fatalf("failed to decode node %v: %v", id, err)
+	}
+	want := make([]byte, size)
+	if err := encoder.Store(want, node); err != nil {
+		t.Fatalf("failed to encode node %v: %v", id, err)
+	}
+	got := make([]byte, size)
+	if err := encoder.Store(got, &decoded); err != nil {
+		t.Fatalf("failed to encode decoded node %v: %v", id, err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("decoded node %v differs from original node\nwanted %x\n   got %x", id, want, got)
+	}
+	return decoded
+}
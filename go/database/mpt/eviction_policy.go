@@ -0,0 +1,284 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import "math"
+
+// EvictionPolicy decides which node to evict from a full node cache. Instead
+// of node IDs, policies refer to nodes by the slot they occupy in the cache,
+// ranging from 0 to the capacity of the cache. This way, policies may manage
+// their state in plain arrays, like the cache itself. Unused slots are
+// occupied in increasing order, so all slots below the number of distinct
+// slots inserted so far are in use. Calls are serialized by the cache.
+type EvictionPolicy interface {
+	// OnInsert is called whenever a new node is placed in the given slot,
+	// which was either unused so far or freed by evicting its node.
+	OnInsert(slot uint32)
+
+	// OnAccess is called whenever the node in the given slot is used. It is
+	// also called for rejected victims, see PickVictim.
+	OnAccess(slot uint32)
+
+	// OnRelease is called for nodes which are unlikely to be used again in
+	// the near future and should thus be evicted next.
+	OnRelease(slot uint32)
+
+	// PickVictim proposes the slot of the next node to be evicted. It is only
+	// called if all slots are in use. The cache may reject the proposed node,
+	// e.g. if it is pinned, by calling OnAccess for its slot before asking
+	// for another victim. Policies must not propose the same slot forever.
+	PickVictim() uint32
+
+	// GetMostRecentlyUsed lists up to limit slots in use, starting with the
+	// slot of the node which would be evicted last.
+	GetMostRecentlyUsed(limit int) []uint32
+}
+
+// EvictionPolicyFactory creates an eviction policy for a node cache with the
+// given capacity.
+type EvictionPolicyFactory func(capacity int) EvictionPolicy
+
+// NewLruEvictionPolicy creates a policy evicting the least recently used
+// node. It is the default policy of node caches.
+func NewLruEvictionPolicy(capacity int) EvictionPolicy {
+	return newLruEvictionPolicy(capacity)
+}
+
+// lruEvictionPolicy implements the EvictionPolicy interface by a double-linked
+// list of slots ordered by their last use.
+type lruEvictionPolicy struct {
+	links slotLinks
+	list  slotList
+}
+
+func newLruEvictionPolicy(capacity int) *lruEvictionPolicy {
+	return &lruEvictionPolicy{
+		links: makeSlotLinks(capacity),
+		list:  makeSlotList(),
+	}
+}
+
+func (p *lruEvictionPolicy) OnInsert(slot uint32) {
+	if int(slot) < p.list.size {
+		p.links.remove(&p.list, slot)
+	}
+	p.links.pushFront(&p.list, slot)
+}
+
+func (p *lruEvictionPolicy) OnAccess(slot uint32) {
+	if p.list.head == slot || int(slot) >= p.list.size {
+		return
+	}
+	p.links.remove(&p.list, slot)
+	p.links.pushFront(&p.list, slot)
+}
+
+func (p *lruEvictionPolicy) OnRelease(slot uint32) {
+	if p.list.tail == slot || int(slot) >= p.list.size {
+		return
+	}
+	p.links.remove(&p.list, slot)
+	p.links.pushBack(&p.list, slot)
+}
+
+func (p *lruEvictionPolicy) PickVictim() uint32 {
+	return p.list.tail
+}
+
+func (p *lruEvictionPolicy) GetMostRecentlyUsed(limit int) []uint32 {
+	return p.links.appendSlots(nil, &p.list, limit)
+}
+
+// NewTwoQueueEvictionPolicy creates a policy following a simplified variant of
+// the 2Q algorithm. Inserted nodes enter a FIFO queue and are only promoted to
+// an LRU queue when being used again. Victims are taken from the FIFO queue
+// as long as it exceeds a quarter of the capacity. This way, frequently used
+// nodes, e.g. of hot contracts, are protected from being evicted by a long
+// tail of nodes used only once. Unlike the original algorithm, there is no
+// queue of the IDs of recently evicted nodes, since policies only see slots.
+func NewTwoQueueEvictionPolicy(capacity int) EvictionPolicy {
+	return newTwoQueueEvictionPolicy(capacity)
+}
+
+const (
+	twoQueueNone     = iota // the slot is not in use
+	twoQueueRecent          // the slot is in the FIFO queue of recently inserted nodes
+	twoQueueFrequent        // the slot is in the LRU queue of frequently used nodes
+	twoQueueReleased        // the slot is in the queue of released nodes
+)
+
+// twoQueueEvictionPolicy implements the EvictionPolicy interface by three
+// lists of slots, one for recently inserted, one for frequently used, and one
+// for released nodes. Released nodes are evicted first.
+type twoQueueEvictionPolicy struct {
+	links     slotLinks
+	queues    []byte // the queue of each slot
+	recent    slotList
+	frequent  slotList
+	released  slotList
+	maxRecent int // the size of the recent queue beyond which its nodes are evicted first
+}
+
+func newTwoQueueEvictionPolicy(capacity int) *twoQueueEvictionPolicy {
+	if capacity < 1 {
+		capacity = 1
+	}
+	maxRecent := capacity / 4
+	if maxRecent < 1 {
+		maxRecent = 1
+	}
+	return &twoQueueEvictionPolicy{
+		links:     makeSlotLinks(capacity),
+		queues:    make([]byte, capacity),
+		recent:    makeSlotList(),
+		frequent:  makeSlotList(),
+		released:  makeSlotList(),
+		maxRecent: maxRecent,
+	}
+}
+
+func (p *twoQueueEvictionPolicy) getQueue(queue byte) *slotList {
+	switch queue {
+	case twoQueueRecent:
+		return &p.recent
+	case twoQueueFrequent:
+		return &p.frequent
+	case twoQueueReleased:
+		return &p.released
+	}
+	return nil
+}
+
+// moveTo moves the given slot to the front of the given queue, or its back if
+// back is set.
+func (p *twoQueueEvictionPolicy) moveTo(slot uint32, queue byte, back bool) {
+	if current := p.getQueue(p.queues[slot]); current != nil {
+		p.links.remove(current, slot)
+	}
+	p.queues[slot] = queue
+	if back {
+		p.links.pushBack(p.getQueue(queue), slot)
+	} else {
+		p.links.pushFront(p.getQueue(queue), slot)
+	}
+}
+
+func (p *twoQueueEvictionPolicy) OnInsert(slot uint32) {
+	p.moveTo(slot, twoQueueRecent, false)
+}
+
+func (p *twoQueueEvictionPolicy) OnAccess(slot uint32) {
+	if p.queues[slot] == twoQueueNone {
+		return
+	}
+	p.moveTo(slot, twoQueueFrequent, false)
+}
+
+func (p *twoQueueEvictionPolicy) OnRelease(slot uint32) {
+	if p.queues[slot] == twoQueueNone {
+		return
+	}
+	p.moveTo(slot, twoQueueReleased, true)
+}
+
+func (p *twoQueueEvictionPolicy) PickVictim() uint32 {
+	if p.released.size > 0 {
+		return p.released.tail
+	}
+	if p.recent.size > p.maxRecent || (p.recent.size > 0 && p.frequent.size == 0) {
+		return p.recent.tail
+	}
+	return p.frequent.tail
+}
+
+func (p *twoQueueEvictionPolicy) GetMostRecentlyUsed(limit int) []uint32 {
+	res := p.links.appendSlots(nil, &p.frequent, limit)
+	res = p.links.appendSlots(res, &p.recent, limit)
+	return p.links.appendSlots(res, &p.released, limit)
+}
+
+// noSlot marks the end of slot lists.
+const noSlot = uint32(math.MaxUint32)
+
+// slotList is a double-linked list of slots, of which the links are stored in
+// a slotLinks instance shared by all lists of a policy.
+type slotList struct {
+	head, tail uint32
+	size       int
+}
+
+func makeSlotList() slotList {
+	return slotList{head: noSlot, tail: noSlot}
+}
+
+// slotLinks retains the predecessor and successor of each slot in the list
+// the slot is part of. Each slot may be part of at most one list.
+type slotLinks struct {
+	prev, next []uint32
+}
+
+func makeSlotLinks(capacity int) slotLinks {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return slotLinks{
+		prev: make([]uint32, capacity),
+		next: make([]uint32, capacity),
+	}
+}
+
+func (l *slotLinks) pushFront(list *slotList, slot uint32) {
+	l.prev[slot] = noSlot
+	l.next[slot] = list.head
+	if list.head == noSlot {
+		list.tail = slot
+	} else {
+		l.prev[list.head] = slot
+	}
+	list.head = slot
+	list.size++
+}
+
+func (l *slotLinks) pushBack(list *slotList, slot uint32) {
+	l.next[slot] = noSlot
+	l.prev[slot] = list.tail
+	if list.tail == noSlot {
+		list.head = slot
+	} else {
+		l.next[list.tail] = slot
+	}
+	list.tail = slot
+	list.size++
+}
+
+func (l *slotLinks) remove(list *slotList, slot uint32) {
+	prev, next := l.prev[slot], l.next[slot]
+	if prev == noSlot {
+		list.head = next
+	} else {
+		l.next[prev] = next
+	}
+	if next == noSlot {
+		list.tail = prev
+	} else {
+		l.prev[next] = prev
+	}
+	list.size--
+}
+
+// appendSlots appends the slots of the given list, starting at its head, to
+// the given result until it contains limit elements.
+func (l *slotLinks) appendSlots(res []uint32, list *slotList, limit int) []uint32 {
+	for cur := list.head; cur != noSlot && len(res) < limit; cur = l.next[cur] {
+		res = append(res, cur)
+	}
+	return res
+}
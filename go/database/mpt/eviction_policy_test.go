@@ -0,0 +1,369 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
+)
+
+var evictionPolicies = map[string]EvictionPolicyFactory{
+	"LRU": NewLruEvictionPolicy,
+	"2Q":  NewTwoQueueEvictionPolicy,
+}
+
+func TestEvictionPolicy_VictimsAreSlotsInUse(t *testing.T) {
+	const capacity = 16
+	for name, factory := range evictionPolicies {
+		t.Run(name, func(t *testing.T) {
+			policy := factory(capacity)
+			for i := uint32(0); i < capacity; i++ {
+				policy.OnInsert(i)
+			}
+			r := rand.New(rand.NewSource(42))
+			for i := 0; i < 1000; i++ {
+				slot := uint32(r.Intn(capacity))
+				switch r.Intn(3) {
+				case 0:
+					victim := policy.PickVictim()
+					if victim >= capacity {
+						t.Fatalf("invalid victim %d", victim)
+					}
+					policy.OnInsert(victim)
+				case 1:
+					policy.OnAccess(slot)
+				case 2:
+					policy.OnRelease(slot)
+				}
+
+				slots := policy.GetMostRecentlyUsed(capacity)
+				if len(slots) != capacity {
+					t.Fatalf("unexpected number of slots in use, wanted %d, got %d", capacity, len(slots))
+				}
+				slices.Sort(slots)
+				for i, slot := range slots {
+					if uint32(i) != slot {
+						t.Fatalf("unexpected slots in use: %v", slots)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEvictionPolicy_ReleasedSlotsAreEvictedFirst(t *testing.T) {
+	const capacity = 8
+	for name, factory := range evictionPolicies {
+		t.Run(name, func(t *testing.T) {
+			policy := factory(capacity)
+			for i := uint32(0); i < capacity; i++ {
+				policy.OnInsert(i)
+				policy.OnAccess(i)
+			}
+			policy.OnRelease(5)
+			if got := policy.PickVictim(); got != 5 {
+				t.Errorf("released slot should be evicted first, got %d", got)
+			}
+		})
+	}
+}
+
+func TestEvictionPolicy_LruEvictsLeastRecentlyUsedSlot(t *testing.T) {
+	policy := NewLruEvictionPolicy(4)
+	for i := uint32(0); i < 4; i++ {
+		policy.OnInsert(i)
+	}
+	if got := policy.PickVictim(); got != 0 {
+		t.Errorf("unexpected victim, wanted 0, got %d", got)
+	}
+	policy.OnAccess(0)
+	if got := policy.PickVictim(); got != 1 {
+		t.Errorf("unexpected victim, wanted 1, got %d", got)
+	}
+	if want, got := []uint32{0, 3, 2, 1}, policy.GetMostRecentlyUsed(4); !slices.Equal(want, got) {
+		t.Errorf("unexpected order, wanted %v, got %v", want, got)
+	}
+}
+
+func TestEvictionPolicy_TwoQueueProtectsFrequentlyUsedSlotsFromScans(t *testing.T) {
+	const capacity = 16
+	const hot = 8
+	policies := map[string]EvictionPolicy{
+		"LRU": NewLruEvictionPolicy(capacity),
+		"2Q":  NewTwoQueueEvictionPolicy(capacity),
+	}
+	for name, policy := range policies {
+		t.Run(name, func(t *testing.T) {
+			// Slots are used by the IDs stored in them, hot IDs are used twice.
+			content := make([]int, capacity)
+			for i := 0; i < capacity; i++ {
+				policy.OnInsert(uint32(i))
+				content[i] = i
+				if i < hot {
+					policy.OnAccess(uint32(i))
+				}
+			}
+			// A scan over a long tail of IDs, each used once.
+			for id := capacity; id < 10*capacity; id++ {
+				victim := policy.PickVictim()
+				policy.OnInsert(victim)
+				content[victim] = id
+			}
+			retained := 0
+			for _, id := range content {
+				if id < hot {
+					retained++
+				}
+			}
+			if name == "2Q" && retained != hot {
+				t.Errorf("all hot IDs should be retained, got %d of %d", retained, hot)
+			}
+			if name == "LRU" && retained != 0 {
+				t.Errorf("LRU is expected to evict all hot IDs, got %d of %d retained", retained, hot)
+			}
+		})
+	}
+}
+
+func TestNodeCache_UsesGivenEvictionPolicy(t *testing.T) {
+	const capacity = 8
+	cache := NewNodeCacheWithEvictionPolicy(capacity, NewTwoQueueEvictionPolicy)
+	hotRefs := []NodeReference{}
+	for i := 0; i < capacity; i++ {
+		ref := NewNodeReference(ValueId(uint64(i)))
+		cache.GetOrSet(&ref, shared.MakeShared[Node](&ValueNode{}))
+		if i < capacity/2 {
+			cache.Touch(&ref)
+			hotRefs = append(hotRefs, ref)
+		}
+	}
+	for i := capacity; i < 10*capacity; i++ {
+		ref := NewNodeReference(ValueId(uint64(i)))
+		cache.GetOrSet(&ref, shared.MakeShared[Node](&ValueNode{}))
+	}
+	for _, ref := range hotRefs {
+		if _, found := cache.Get(&ref); !found {
+			t.Errorf("frequently used node %v should be retained", ref.Id())
+		}
+	}
+}
+
+func TestNodeCache_PinnedVictimsAreRejected(t *testing.T) {
+	for name, factory := range evictionPolicies {
+		t.Run(name, func(t *testing.T) {
+			cache := NewNodeCacheWithEvictionPolicy(4, factory)
+			refs := []NodeReference{}
+			for i := 0; i < 4; i++ {
+				ref := NewNodeReference(ValueId(uint64(i)))
+				cache.GetOrSet(&ref, nil)
+				refs = append(refs, ref)
+			}
+			for i := 0; i < 2; i++ {
+				if !cache.Pin(&refs[i]) {
+					t.Fatalf("failed to pin node %d", i)
+				}
+			}
+			for i := 4; i < 20; i++ {
+				ref := NewNodeReference(ValueId(uint64(i)))
+				_, _, evictedId, _, evicted := cache.GetOrSet(&ref, nil)
+				if !evicted {
+					t.Fatalf("expected eviction")
+				}
+				if evictedId == refs[0].Id() || evictedId == refs[1].Id() {
+					t.Fatalf("pinned node %v was evicted", evictedId)
+				}
+			}
+		})
+	}
+}
+
+func TestNodeCache_NodesWithOutdatedHashesAreNotEvictedIfAlternativesExist(t *testing.T) {
+	for name, factory := range evictionPolicies {
+		t.Run(name, func(t *testing.T) {
+			cache := NewNodeCacheWithEvictionPolicy(3, factory)
+			modified := &ValueNode{}
+			modified.setDirty()
+			hashed := &ValueNode{}
+			hashed.setDirty()
+			hashed.SetHash(common.Hash{1})
+
+			refs := []NodeReference{
+				NewNodeReference(ValueId(1)),
+				NewNodeReference(ValueId(2)),
+				NewNodeReference(ValueId(3)),
+			}
+			cache.GetOrSet(&refs[0], shared.MakeShared[Node](modified))
+			cache.GetOrSet(&refs[1], shared.MakeShared[Node](hashed))
+			cache.GetOrSet(&refs[2], shared.MakeShared[Node](hashed))
+
+			ref := NewNodeReference(ValueId(4))
+			_, _, evictedId, _, evicted := cache.GetOrSet(&ref, nil)
+			if !evicted || evictedId == refs[0].Id() {
+				t.Errorf("node with outdated hash should not be evicted, got %v, evicted %t", evictedId, evicted)
+			}
+		})
+	}
+}
+
+func TestNodeCache_NodesWithOutdatedHashesAreEvictedIfNoAlternativeExists(t *testing.T) {
+	for name, factory := range evictionPolicies {
+		t.Run(name, func(t *testing.T) {
+			cache := NewNodeCacheWithEvictionPolicy(2, factory)
+			for i := 0; i < 2; i++ {
+				node := &ValueNode{}
+				node.setDirty()
+				ref := NewNodeReference(ValueId(uint64(i)))
+				cache.GetOrSet(&ref, shared.MakeShared[Node](node))
+			}
+			ref := NewNodeReference(ValueId(2))
+			if _, _, _, _, evicted := cache.GetOrSet(&ref, nil); !evicted {
+				t.Errorf("a node should have been evicted")
+			}
+		})
+	}
+}
+
+func TestForest_EvictionPolicyDoesNotAffectHashes(t *testing.T) {
+	var want common.Hash
+	for _, name := range []string{"LRU", "2Q"} {
+		state, err := OpenGoFileStateWithConfig(t.TempDir(), S5LiveConfig, ForestConfig{
+			CacheCapacity:  128,
+			EvictionPolicy: evictionPolicies[name],
+		})
+		if err != nil {
+			t.Fatalf("failed to open state: %v", err)
+		}
+		fillTestState(t, state, false)
+		hash, err := state.GetHash()
+		if err != nil {
+			t.Fatalf("failed to get hash: %v", err)
+		}
+		if err := state.trie.Check(); err != nil {
+			t.Errorf("invalid trie using %s: %v", name, err)
+		}
+		if err := state.Close(); err != nil {
+			t.Fatalf("failed to close state: %v", err)
+		}
+		if want == (common.Hash{}) {
+			want = hash
+		} else if want != hash {
+			t.Errorf("unexpected hash using %s, wanted %x, got %x", name, want, hash)
+		}
+	}
+}
+
+// BenchmarkEvictionPolicy_ReplayTrace replays a recorded trace with a bimodal
+// access pattern, where a small set of hot accounts is updated in every block
+// while a long tail of accounts is updated only once, using a node cache
+// too small to retain all nodes.
+func BenchmarkEvictionPolicy_ReplayTrace(b *testing.B) {
+	trace := recordBimodalTrace(b, 200)
+	for _, name := range []string{"LRU", "2Q"} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				state, err := OpenGoFileStateWithConfig(b.TempDir(), S5LiveConfig, ForestConfig{
+					CacheCapacity:  4096,
+					EvictionPolicy: evictionPolicies[name],
+				})
+				if err != nil {
+					b.Fatalf("failed to open state: %v", err)
+				}
+				reader, err := OpenTraceReader(bytes.NewReader(trace))
+				if err != nil {
+					b.Fatalf("failed to open trace: %v", err)
+				}
+				b.StartTimer()
+				for {
+					block, err := reader.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						b.Fatalf("failed to read trace: %v", err)
+					}
+					if _, err := state.ReplayTraceBlock(block); err != nil {
+						b.Fatalf("failed to replay block %d: %v", block.Block, err)
+					}
+				}
+				b.StopTimer()
+				if err := state.Close(); err != nil {
+					b.Fatalf("failed to close state: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// recordBimodalTrace records a trace of the given number of blocks updating
+// the storage of a few hot accounts in each block and creating a batch of
+// cold accounts never touched again.
+func recordBimodalTrace(b *testing.B, numBlocks int) []byte {
+	b.Helper()
+	state, err := OpenGoMemoryState(b.TempDir(), S5LiveConfig, 1<<20)
+	if err != nil {
+		b.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	buffer := bytes.Buffer{}
+	recorder, err := NewTraceRecorder(&buffer)
+	if err != nil {
+		b.Fatalf("failed to create recorder: %v", err)
+	}
+	state.SetTraceRecorder(recorder)
+
+	const numHot = 16
+	const numColdPerBlock = 100
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < numBlocks; i++ {
+		update := common.Update{}
+		for j := 0; j < numHot; j++ {
+			addr := common.Address{0xFF, byte(j)}
+			if i == 0 {
+				update.AppendCreateAccount(addr)
+				update.AppendNonceUpdate(addr, common.ToNonce(1))
+			}
+			update.AppendSlotUpdate(addr, common.Key{byte(r.Intn(64))}, common.Value{byte(i + 1)})
+		}
+		for j := 0; j < numColdPerBlock; j++ {
+			addr := common.Address{byte(i), byte(i >> 8), byte(j)}
+			update.AppendCreateAccount(addr)
+			update.AppendNonceUpdate(addr, common.ToNonce(1))
+		}
+		if err := update.Normalize(); err != nil {
+			b.Fatalf("failed to normalize update: %v", err)
+		}
+		if _, err := state.Apply(uint64(i), update); err != nil {
+			b.Fatalf("failed to apply block %d: %v", i, err)
+		}
+	}
+	if err := recorder.Flush(); err != nil {
+		b.Fatalf("failed to flush recorder: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+func ExampleNewTwoQueueEvictionPolicy() {
+	policy := NewTwoQueueEvictionPolicy(4)
+	for i := uint32(0); i < 4; i++ {
+		policy.OnInsert(i)
+	}
+	policy.OnAccess(0) // slot 0 is used again and promoted
+	fmt.Println(policy.GetMostRecentlyUsed(4))
+	// Output: [0 3 2 1]
+}
@@ -15,17 +15,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
 
 	"github.com/Fantom-foundation/Carmen/go/backend/stock"
-	"github.com/Fantom-foundation/Carmen/go/backend/stock/file"
+	"github.com/Fantom-foundation/Carmen/go/backend/stock/bounded"
 	"github.com/Fantom-foundation/Carmen/go/backend/stock/memory"
+	"github.com/Fantom-foundation/Carmen/go/backend/stock/retry"
 	"github.com/Fantom-foundation/Carmen/go/backend/stock/synced"
 	"github.com/Fantom-foundation/Carmen/go/common"
 	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
@@ -66,10 +67,44 @@ type Root struct {
 // the functional and non-functional properties of a forest but do not change
 // the on-disk format.
 type ForestConfig struct {
-	Mode                   StorageMode   // whether to perform destructive or constructive updates
-	CacheCapacity          int           // the maximum number of nodes retained in memory
-	BackgroundFlushPeriod  time.Duration // the time between background flushes, default if zero, disabled if negative
-	writeBufferChannelSize int           // the maximum number of elements retained in the write buffer channel
+	Mode                   StorageMode           // whether to perform destructive or constructive updates
+	CacheCapacity          int                   // the maximum number of nodes retained in memory
+	CacheShares            NodeCacheShares       // the shares of the cache capacity reserved per node type, a single LRU cache for all types if zero
+	EvictionPolicy         EvictionPolicyFactory // the policy deciding which nodes to evict from the node cache, LRU if nil
+	BackgroundFlushPeriod  time.Duration         // the time between background flushes, default if zero, disabled if negative
+	ReadRetryPolicy        retry.Policy          // the policy for retrying transient read errors of node stocks, disabled if zero
+	TrackStorageWeights    bool                  // whether to account the depth and number of nodes created in storage tries
+	VerifyHashesOnRead     bool                  // whether to check the hashes of nodes loaded from disk, for testing only due to its costs
+	CheckLeafPathLengths   bool                  // whether the path lengths stored in leaf nodes are checked against their depth when being hashed, for debugging
+	SkipCorruptedNodes     bool                  // whether account lookups treat nodes failing to load as missing instead of failing, for read-only analysis only
+	ReleaseBatchSize       int                   // the number of nodes released together when releasing sub-tries, default if zero
+	ReleaseWorkers         int                   // the number of background workers releasing tries concurrently, 1 if zero
+	ReleaseQueueSize       int                   // the maximum number of tries waiting for being released in the background, default if zero
+	ReleaseSoftLimit       int                   // the number of pending tries beyond which further tries are released synchronously, disabled if zero
+	ReleaseNodeSoftLimit   int                   // the estimated number of nodes of pending tries beyond which further tries are released synchronously, disabled if zero
+	ReleaseDrainTimeout    time.Duration         // the maximum time Close waits for pending tries to be released before abandoning them, no limit if zero
+	ForceConfig            bool                  // whether to open directories even if they were created with a different MPT configuration
+	HashObserver           NodeHashObserver      // an optional callback informed about each node hashed, calls are serialized
+	Durability             DurabilityMode        // when the state of committed blocks is synced to disk, Periodic if zero
+	DurabilitySyncPeriod   time.Duration         // the minimum time between syncs of committed blocks in Periodic mode, only explicit flushes if zero
+	UpdateJournal          bool                  // whether updates of blocks applied to a LiveDB are journaled for being replayed after a crash
+	UpdateJournalSizeLimit int64                 // the size of the update journal in bytes beyond which the state is synced, default if zero
+	DeferBranchCollapse    bool                  // whether branch nodes emptied by deletions are collapsed at the end of blocks instead of immediately
+	DeferSlotDeletion      bool                  // whether slots deleted within blocks are retained as tombstones until the end of blocks, avoiding restructuring if they are re-set
+	PinnedLevels           int                   // the number of upper trie levels never evicted from the node cache, counted against its capacity, disabled if zero
+	CacheManifestSize      int                   // the maximum number of cached node IDs recorded on close to warm up the node cache when re-opened, disabled if zero
+	AccountFilter          bool                  // whether LiveDBs maintain a bloom filter of existing accounts answering most lookups of missing accounts without accessing the trie
+	MetricsEnabled         bool                  // whether to collect statistics on the number of nodes visited by lookups and updates
+	TimingsEnabled         bool                  // whether to collect histograms on the time spent on descents, hashing, node encoding, and stock IO
+	CheckWorkers           int                   // the number of workers checking nodes concurrently in Check and CheckAll, 1 if zero
+	ClearedSlotCountLimit  int                   // the maximum number of slots counted when clearing storage with a count if leaf counts are not tracked, default if zero
+	RejectGaps             bool                  // whether archives reject blocks skipping ahead of their next block instead of recording the skipped blocks as unchanged
+	Logger                 Logger                // receives messages on lifecycle events, events are not reported if nil
+	GuardFrozenNodes       bool                  // whether write accesses to frozen nodes are checked for in-place modifications, for tests and canary deployments due to its costs
+	FrozenNodeHandler      FrozenNodeHandler     // an optional callback informed about modified frozen nodes if guarded, modifications cause a panic if nil
+	writeBufferChannelSize int                   // the maximum number of elements retained in the write buffer channel
+	crossCheckCachedHashes bool                  // whether hash information taken from caches is verified while hashing, for testing only
+	timer                  *operationTimer       // the timer shared with the encoders of the stocks if timings are enabled
 }
 
 // Forest is a utility node managing nodes for one or more Tries.
@@ -107,15 +142,126 @@ type Forest struct {
 	// A buffer for asynchronously writing nodes to files.
 	writeBuffer WriteBuffer
 
+	// An optional tracker of storage trie weights, nil if disabled.
+	storageWeights *storageWeightTracker
+
+	// An optional checker of hashes of nodes loaded from disk, nil if disabled.
+	readHashVerifier *readHashVerifier
+
+	// An optional collector of per-operation node visit statistics, nil if
+	// disabled.
+	operationStats *operationStatsCollector
+
+	// An optional timer of the phases of operations, nil if disabled.
+	timer *operationTimer
+
+	// An optional observer of hashed nodes, synchronized since tries may be
+	// hashed concurrently, nil if disabled.
+	hashObserver NodeHashObserver
+
+	// The maximum number of slots counted by ClearStorageWithCount.
+	clearedSlotCountLimit int
+
+	// If enabled, account lookups reaching nodes that can not be loaded log
+	// and skip those nodes instead of failing.
+	skipCorruptedNodes bool
+
+	// An optional receiver of messages on lifecycle events, nil if disabled.
+	logger Logger
+
 	// A mutex synchronizing the transfer of elements between the cache, the
 	// write buffer, and stocks (=disks).
 	nodeTransferMutex sync.Mutex
 
+	// Counters of nodes modified in memory and not yet written to disk.
+	dirtyNodes dirtyNodeCounters
+
+	// The number of nodes written to the stocks since the forest got opened.
+	writtenNodes atomic.Uint64
+
 	// Utilities to manage a background worker releasing nodes.
 	releaseQueue chan<- NodeId   // send EmptyId to trigger sync signal
 	releaseSync  <-chan struct{} // signaled whenever the release worker reaches a sync point
 	releaseError <-chan error    // errors detected by the release worker
 	releaseDone  <-chan struct{} // closed when the release worker is done
+	releaseAbort chan struct{}   // closed to make the release worker skip pending tries
+	abortOnce    sync.Once       // guards the closing of the release abort channel
+
+	// The number of nodes collected before being released in a single batch.
+	releaseBatchSize int
+
+	// Limits of the release queue beyond which tries are released
+	// synchronously to apply back-pressure, disabled if zero.
+	releaseSoftLimit     int
+	releaseNodeSoftLimit int
+	releaseDrainTimeout  time.Duration
+
+	// Counters on queued and released tries for providing release queue
+	// statistics and estimating the number of nodes of pending tries.
+	releasePending      atomic.Int64
+	releasedTries       atomic.Int64
+	releasedNodes       atomic.Int64
+	synchronousReleases atomic.Int64
+
+	// Errors encountered while releasing tries synchronously.
+	releaseErrors      []error
+	releaseErrorsMutex sync.Mutex
+
+	// The number of upper trie levels pinned in the node cache and the IDs of
+	// the nodes currently pinned, protected by the pinnedNodesMutex.
+	pinnedLevels     int
+	pinnedNodes      []NodeId
+	pinnedNodesMutex sync.Mutex
+
+	// The number of workers used for checking the invariants of tries.
+	checkWorkers int
+
+	// Whether batch updates defer the collapse of branch nodes to their end.
+	deferBranchCollapse bool
+
+	// Whether batch updates retain deleted slots as tombstones until their end.
+	deferSlotDeletion bool
+	// Set while a batch update with deferred slot deletions is ongoing.
+	deletionDeferred atomic.Bool
+	// The slots deleted within the ongoing batch update, protected by the
+	// tombstonesMutex.
+	tombstones      []slotTombstone
+	tombstonesMutex sync.Mutex
+
+	// An optional guard detecting in-place modifications of frozen nodes
+	// through write handles, nil if disabled.
+	frozenNodeGuard *frozenNodeGuard
+
+	// The file the IDs of cached nodes are recorded in when closing the
+	// forest and the maximum number of recorded IDs, empty if disabled.
+	cacheManifestFile string
+	cacheManifestSize int
+	// A background worker warming up the node cache, nil if not running.
+	cacheWarmer *cacheWarmer
+
+	// Set if only the paths to the accounts it returns are frozen, as done by
+	// partial archives, nil if tries are frozen entirely.
+	archivedAccounts func() []common.Address
+
+	// The nodes frozen for being shared by LiveDB tries and their forks and
+	// the number of open forks, protected by the forkMutex. Other than in
+	// archives, these nodes are not implicitly frozen when being reloaded.
+	forkedNodes map[NodeId]forkedNode
+	numForks    int
+	forkMutex   sync.Mutex
+	// Set while forked nodes exist, avoiding the lookup of loaded nodes in
+	// the set of forked nodes otherwise.
+	hasForkedNodes atomic.Bool
+
+	// The directory of the forest if its MPT configuration is not yet recorded
+	// and should be written when the forest is closed cleanly, empty otherwise.
+	pendingConfigDirectory string
+
+	// The directory corruptions detected at runtime are recorded in, empty
+	// if the forest is not backed by a directory. Only the first detected
+	// corruption is recorded, tracked by the tainted flag.
+	taintDirectory string
+	tainted        atomic.Bool
 
 	// A list of issues encountered while performing operations on the forest.
 	// If this list is non-empty, no guarantees are provided on the correctness
@@ -127,56 +273,28 @@ type Forest struct {
 }
 
 func OpenInMemoryForest(directory string, mptConfig MptConfig, forestConfig ForestConfig) (*Forest, error) {
-	if _, err := checkForestMetadata(directory, mptConfig, forestConfig.Mode); err != nil {
-		return nil, err
-	}
-
-	success := false
-	var err error
-	closers := make(closers, 0, 4)
-	defer func() {
-		// if opening the forest was not successful, close all opened stocks.
-		if !success {
-			err = errors.Join(err, closers.CloseAll())
-		}
-	}()
-
-	accountEncoder, branchEncoder, extensionEncoder, valueEncoder := getEncoder(mptConfig)
-	branches, err := memory.OpenStock[uint64, BranchNode](branchEncoder, directory+"/branches")
-	if err != nil {
-		return nil, err
-	}
-	closers = append(closers, branches)
+	return OpenForestWithBackend(directory, InMemoryStockFactory{}, mptConfig, forestConfig)
+}
 
-	extensions, err := memory.OpenStock[uint64, ExtensionNode](extensionEncoder, directory+"/extensions")
-	if err != nil {
-		return nil, err
-	}
-	closers = append(closers, extensions)
+func OpenFileForest(directory string, mptConfig MptConfig, forestConfig ForestConfig) (*Forest, error) {
+	return OpenForestWithBackend(directory, FileStockFactory{}, mptConfig, forestConfig)
+}
 
-	accounts, err := memory.OpenStock[uint64, AccountNode](accountEncoder, directory+"/accounts")
+// OpenForestWithBackend opens a forest in the given directory whose nodes are
+// retained by the stocks of the given backend. The directory still holds the
+// metadata of the forest, while the location of nodes is up to the backend.
+func OpenForestWithBackend(directory string, backend StockFactory, mptConfig MptConfig, forestConfig ForestConfig) (*Forest, error) {
+	// Nodes are decoded using the encoders the directory was created with.
+	mptConfig, err := resolveNodeEncoders(directory, mptConfig)
 	if err != nil {
 		return nil, err
 	}
-	closers = append(closers, accounts)
-
-	values, err := memory.OpenStock[uint64, ValueNode](valueEncoder, directory+"/values")
+	_, configFilePending, err := checkForestMetadata(directory, mptConfig, forestConfig)
 	if err != nil {
 		return nil, err
 	}
-	closers = append(closers, values)
-
-	success = true
-	return makeForest(mptConfig, directory, branches, extensions, accounts, values, forestConfig)
-}
-
-func OpenFileForest(directory string, mptConfig MptConfig, forestConfig ForestConfig) (*Forest, error) {
-	if _, err := checkForestMetadata(directory, mptConfig, forestConfig.Mode); err != nil {
-		return nil, err
-	}
 
 	success := false
-	var err error
 	closers := make(closers, 0, 4)
 	defer func() {
 		// if opening the forest was not successful, close all opened stocks.
@@ -185,33 +303,66 @@ func OpenFileForest(directory string, mptConfig MptConfig, forestConfig ForestCo
 		}
 	}()
 
+	// The timer is shared with the forest to account encoding times.
+	if forestConfig.TimingsEnabled {
+		forestConfig.timer = &operationTimer{}
+	}
+	timer := forestConfig.timer
+
 	accountEncoder, branchEncoder, extensionEncoder, valueEncoder := getEncoder(mptConfig)
-	branches, err := file.OpenStock[uint64, BranchNode](branchEncoder, directory+"/branches")
+	branches, err := backend.OpenBranches(directory+"/branches", timeEncoder(branchEncoder, timer))
 	if err != nil {
 		return nil, err
 	}
 	closers = append(closers, branches)
 
-	extensions, err := file.OpenStock[uint64, ExtensionNode](extensionEncoder, directory+"/extensions")
+	extensions, err := backend.OpenExtensions(directory+"/extensions", timeEncoder(extensionEncoder, timer))
 	if err != nil {
 		return nil, err
 	}
 	closers = append(closers, extensions)
 
-	accounts, err := file.OpenStock[uint64, AccountNode](accountEncoder, directory+"/accounts")
+	accounts, err := backend.OpenAccounts(directory+"/accounts", timeEncoder(accountEncoder, timer))
 	if err != nil {
 		return nil, err
 	}
 	closers = append(closers, accounts)
 
-	values, err := file.OpenStock[uint64, ValueNode](valueEncoder, directory+"/values")
+	values, err := backend.OpenValues(directory+"/values", timeEncoder(valueEncoder, timer))
 	if err != nil {
 		return nil, err
 	}
 	closers = append(closers, values)
 
 	success = true
-	return makeForest(mptConfig, directory, branches, extensions, accounts, values, forestConfig)
+	forest, err := makeForest(mptConfig, directory, branches, extensions, accounts, values, forestConfig)
+	if err != nil {
+		return nil, err
+	}
+	if configFilePending {
+		forest.pendingConfigDirectory = directory
+	}
+	return forest, nil
+}
+
+// OpenVolatileForest creates an empty forest retaining all nodes in memory
+// without being backed by any directory. Flushing and closing the forest does
+// not persist any data, so the content of the forest is lost once it is
+// closed. Volatile forests are intended for tests and light workloads not
+// requiring durability. Tracking storage weights is not supported.
+func OpenVolatileForest(mptConfig MptConfig, forestConfig ForestConfig) (*Forest, error) {
+	if forestConfig.TrackStorageWeights {
+		return nil, fmt.Errorf("storage weights can not be tracked by volatile forests")
+	}
+	return makeForest(
+		mptConfig,
+		"",
+		memory.CreateVolatileStock[uint64, BranchNode](),
+		memory.CreateVolatileStock[uint64, ExtensionNode](),
+		memory.CreateVolatileStock[uint64, AccountNode](),
+		memory.CreateVolatileStock[uint64, ValueNode](),
+		forestConfig,
+	)
 }
 
 // closers is a shortcut for the list of io.Closer.
@@ -226,33 +377,59 @@ func (c closers) CloseAll() error {
 	return errors.Join(errs...)
 }
 
-func checkForestMetadata(directory string, config MptConfig, mode StorageMode) (ForestMetadata, error) {
+// checkForestMetadata verifies that the forest stored in the given directory
+// was created with the given configuration and storage mode. For new forests,
+// the metadata is written to the directory. The returned flag is set if the
+// directory lacks a record of its MPT configuration, which should be written
+// once the forest gets closed cleanly.
+func checkForestMetadata(directory string, config MptConfig, forestConfig ForestConfig) (ForestMetadata, bool, error) {
+	if config.StoreHashedKeysInValueNodes && !(config.UseHashedPaths && config.TrackSuffixLengthsInLeafNodes) {
+		return ForestMetadata{}, false, fmt.Errorf("storing hashed keys in value nodes requires hashed paths and tracked suffix lengths")
+	}
+
 	path := directory + "/forest.json"
 	meta, present, err := ReadForestMetadata(path)
 	if err != nil {
-		return meta, err
+		return meta, false, err
 	}
 
 	// Check present metadata to match expected configuration.
 	if present {
-		if want, got := config.Name, meta.Configuration; want != got {
-			return meta, fmt.Errorf("unexpected MPT configuration in directory, wanted %v, got %v", want, got)
+		if want, got := StorageMode(forestConfig.Mode == Mutable), StorageMode(meta.Mutable); want != got {
+			return meta, false, fmt.Errorf("unexpected MPT storage mode in directory, wanted %v, got %v", want, got)
+		}
+		stored, found, err := readMptConfig(directory)
+		if err != nil {
+			return meta, false, err
+		}
+		if !found {
+			// Directories created before configurations were recorded can
+			// only be checked by the name of the configuration.
+			if want, got := config.Name, meta.Configuration; want != got {
+				if !forestConfig.ForceConfig {
+					return meta, false, fmt.Errorf("unexpected MPT configuration in directory, wanted %v, got %v", want, got)
+				}
+				logWarning(forestConfig.Logger, fmt.Sprintf("forcing MPT configuration %v on directory %s created with %v", want, directory, got))
+				return meta, false, nil
+			}
+			logWarning(forestConfig.Logger, fmt.Sprintf("MPT configuration not recorded in %s, it will be written when closing the forest", directory))
+			return meta, true, nil
 		}
-		if want, got := StorageMode(mode == Mutable), StorageMode(meta.Mutable); want != got {
-			return meta, fmt.Errorf("unexpected MPT storage mode in directory, wanted %v, got %v", want, got)
+		if mismatches := getConfigMismatches(config, stored); len(mismatches) > 0 && !forestConfig.ForceConfig {
+			return meta, false, fmt.Errorf("unexpected MPT configuration in directory, wanted %v, got %v: %s", config.Name, stored.Name, strings.Join(mismatches, "; "))
 		}
-		return meta, nil
+		return meta, false, nil
 	}
 
 	// Write metadata to disk to create new forest.
 	meta = ForestMetadata{
 		Configuration: config.Name,
-		Mutable:       mode == Mutable,
+		Mutable:       forestConfig.Mode == Mutable,
 	}
 
 	// Update on-disk meta-data.
 	metadata, err := json.Marshal(meta)
-	return meta, errors.Join(err, os.WriteFile(path, metadata, 0600))
+	return meta, false, errors.Join(err, os.WriteFile(path, metadata, 0600), writeMptConfig(directory, config))
 }
 
 func makeForest(
@@ -264,28 +441,134 @@ func makeForest(
 	values stock.Stock[uint64, ValueNode],
 	forestConfig ForestConfig,
 ) (*Forest, error) {
-	releaseQueue := make(chan NodeId, 1<<16) // NodeIds are small and a large buffer increases resilience.
+	releaseQueueSize := forestConfig.ReleaseQueueSize
+	if releaseQueueSize <= 0 {
+		releaseQueueSize = 1 << 16 // NodeIds are small and a large buffer increases resilience.
+	}
+	releaseQueue := make(chan NodeId, releaseQueueSize)
 	releaseSync := make(chan struct{})
 	releaseError := make(chan error, 1)
 	releaseDone := make(chan struct{})
+	releaseAbort := make(chan struct{})
+
+	var storageWeights *storageWeightTracker
+	if forestConfig.TrackStorageWeights {
+		tracker, err := openStorageWeightTracker(directory + "/storage-weights.dat")
+		if err != nil {
+			return nil, err
+		}
+		storageWeights = tracker
+	}
+
+	var readHashVerifier *readHashVerifier
+	if forestConfig.VerifyHashesOnRead {
+		readHashVerifier = newReadHashVerifier()
+	}
+
+	var operationStats *operationStatsCollector
+	if forestConfig.MetricsEnabled {
+		operationStats = &operationStatsCollector{}
+	}
+
+	timer := forestConfig.timer
+	if timer == nil && forestConfig.TimingsEnabled {
+		timer = &operationTimer{}
+	}
+
+	var hashObserver NodeHashObserver
+	if observer := forestConfig.HashObserver; observer != nil {
+		var mutex sync.Mutex
+		hashObserver = func(id NodeId, hash common.Hash) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			observer(id, hash)
+		}
+	}
+
+	clearedSlotCountLimit := forestConfig.ClearedSlotCountLimit
+	if clearedSlotCountLimit <= 0 {
+		clearedSlotCountLimit = defaultClearedSlotCountLimit
+	}
+
+	releaseBatchSize := forestConfig.ReleaseBatchSize
+	if releaseBatchSize <= 0 {
+		releaseBatchSize = 1024 // the default value
+	}
+
+	var nodeCache NodeCache
+	if forestConfig.CacheShares.IsEnabled() {
+		nodeCache = NewTypeAwareNodeCacheWithEvictionPolicy(forestConfig.CacheCapacity, forestConfig.CacheShares, forestConfig.EvictionPolicy)
+	} else {
+		nodeCache = NewNodeCacheWithEvictionPolicy(forestConfig.CacheCapacity, forestConfig.EvictionPolicy)
+	}
+
+	hasher := mptConfig.Hashing.createHasher(mptConfig.HashFunction)
+	if forestConfig.crossCheckCachedHashes {
+		enableCachedHashCrossChecks(hasher)
+	}
+	if forestConfig.CheckLeafPathLengths {
+		enableLeafPathLengthChecks(hasher)
+	}
+	if mptConfig.StoreHashedKeysInValueNodes {
+		enableHashedKeyRetention(hasher)
+	}
+
+	// Indexes exceeding the capacity of node references would be truncated
+	// when being stored, and are thus refused.
+	capacity := getIdSpaceCapacity(getNodeIdEncoder(mptConfig).GetEncodedSize())
+	branches = bounded.Limit(branches, capacity.Branches)
+	extensions = bounded.Limit(extensions, capacity.Extensions)
+	accounts = bounded.Limit(accounts, capacity.Accounts)
+	values = bounded.Limit(values, capacity.Values)
 
 	res := &Forest{
-		config:        mptConfig,
-		branches:      synced.Sync(branches),
-		extensions:    synced.Sync(extensions),
-		accounts:      synced.Sync(accounts),
-		values:        synced.Sync(values),
-		storageMode:   forestConfig.Mode,
-		nodeCache:     NewNodeCache(forestConfig.CacheCapacity),
-		hasher:        mptConfig.Hashing.createHasher(),
-		keyHasher:     NewKeyHasher(),
-		addressHasher: NewAddressHasher(),
-		releaseQueue:  releaseQueue,
-		releaseSync:   releaseSync,
-		releaseError:  releaseError,
-		releaseDone:   releaseDone,
+		config:                mptConfig,
+		branches:              retry.Wrap(synced.Sync(branches), forestConfig.ReadRetryPolicy),
+		extensions:            retry.Wrap(synced.Sync(extensions), forestConfig.ReadRetryPolicy),
+		accounts:              retry.Wrap(synced.Sync(accounts), forestConfig.ReadRetryPolicy),
+		values:                retry.Wrap(synced.Sync(values), forestConfig.ReadRetryPolicy),
+		storageMode:           forestConfig.Mode,
+		nodeCache:             nodeCache,
+		hasher:                hasher,
+		keyHasher:             NewKeyHasher(),
+		addressHasher:         NewAddressHasher(),
+		storageWeights:        storageWeights,
+		readHashVerifier:      readHashVerifier,
+		operationStats:        operationStats,
+		timer:                 timer,
+		hashObserver:          hashObserver,
+		skipCorruptedNodes:    forestConfig.SkipCorruptedNodes,
+		clearedSlotCountLimit: clearedSlotCountLimit,
+		logger:                forestConfig.Logger,
+		releaseQueue:          releaseQueue,
+		releaseSync:           releaseSync,
+		releaseError:          releaseError,
+		releaseDone:           releaseDone,
+		releaseAbort:          releaseAbort,
+		releaseBatchSize:      releaseBatchSize,
+
+		releaseSoftLimit:     forestConfig.ReleaseSoftLimit,
+		releaseNodeSoftLimit: forestConfig.ReleaseNodeSoftLimit,
+		releaseDrainTimeout:  forestConfig.ReleaseDrainTimeout,
+
+		pinnedLevels:        forestConfig.PinnedLevels,
+		checkWorkers:        forestConfig.CheckWorkers,
+		deferBranchCollapse: forestConfig.DeferBranchCollapse,
+		deferSlotDeletion:   forestConfig.DeferSlotDeletion,
+	}
+
+	if forestConfig.GuardFrozenNodes {
+		res.frozenNodeGuard = newFrozenNodeGuard(mptConfig, forestConfig.FrozenNodeHandler)
 	}
 
+	accountEncoder, branchEncoder, extensionEncoder, valueEncoder := getEncoder(mptConfig)
+	res.dirtyNodes.setEncodedSizes(
+		accountEncoder.GetEncodedSize(),
+		branchEncoder.GetEncodedSize(),
+		extensionEncoder.GetEncodedSize(),
+		valueEncoder.GetEncodedSize(),
+	)
+
 	sink := writeBufferSink{res}
 
 	// Start a background worker flushing dirty nodes to disk.
@@ -293,30 +576,12 @@ func makeForest(
 		period: forestConfig.BackgroundFlushPeriod,
 	})
 
-	// Run a background worker releasing entire tries of nodes on demand.
-	go func() {
-		defer close(releaseDone)
-		defer close(releaseError)
-		defer close(releaseSync)
-		for id := range releaseQueue {
-			if id.IsEmpty() {
-				releaseSync <- struct{}{}
-			} else {
-				ref := NewNodeReference(id)
-				handle, err := res.getWriteAccess(&ref)
-				if err != nil {
-					releaseError <- err
-					return
-				}
-				err = handle.Get().Release(res, &ref, handle)
-				handle.Release()
-				if err != nil {
-					releaseError <- err
-					return
-				}
-			}
-		}
-	}()
+	// Run background workers releasing entire tries of nodes on demand.
+	releaseWorkers := forestConfig.ReleaseWorkers
+	if releaseWorkers <= 0 {
+		releaseWorkers = 1 // the default value
+	}
+	go runReleaseWorkers(res, releaseWorkers, releaseQueue, releaseSync, releaseError, releaseDone, releaseAbort)
 
 	channelSize := forestConfig.writeBufferChannelSize
 	if channelSize <= 0 {
@@ -324,36 +589,117 @@ func makeForest(
 	}
 
 	res.writeBuffer = makeWriteBuffer(sink, channelSize)
+
+	// Warm up the node cache using the manifest recorded when the forest was
+	// closed the last time. The manifest is removed such that it can not be
+	// re-used after an unclean shutdown.
+	if directory != "" && forestConfig.CacheManifestSize > 0 {
+		res.cacheManifestFile = directory + "/" + nodeCacheManifestFile
+		res.cacheManifestSize = forestConfig.CacheManifestSize
+		// Loading more nodes than the cache can hold would only evict some of them again.
+		limit := res.cacheManifestSize
+		if limit > forestConfig.CacheCapacity {
+			limit = forestConfig.CacheCapacity
+		}
+		ids, err := readNodeCacheManifest(res.cacheManifestFile, limit)
+		if err != nil {
+			logWarning(res.logger, fmt.Sprintf("skipping node cache warm-up, failed to read manifest %s: %v", res.cacheManifestFile, err))
+		}
+		if len(ids) > 0 {
+			res.cacheWarmer = startCacheWarmer(res, ids)
+		}
+		if err := os.Remove(res.cacheManifestFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logWarning(res.logger, fmt.Sprintf("failed to remove node cache manifest %s: %v", res.cacheManifestFile, err))
+		}
+	}
+	// Tainted directories remain usable, yet their content is not trusted
+	// until the next successful verification.
+	if directory != "" {
+		res.taintDirectory = directory
+		status, err := GetVerificationStatus(directory)
+		if err != nil {
+			logWarning(res.logger, fmt.Sprintf("failed to read verification status of %s: %v", directory, err))
+		} else if status.IsTainted() {
+			res.tainted.Store(true)
+			logWarning(res.logger, fmt.Sprintf("directory %s is tainted by a corruption detected at %v: %s", directory, status.Taint.Time, status.Taint.Error))
+		}
+	}
+	res.log(LogInfo, "opened forest", "directory", directory, "mode", forestConfig.Mode, "cacheCapacity", forestConfig.CacheCapacity)
 	return res, nil
 }
 
 func (s *Forest) GetAccountInfo(rootRef *NodeReference, addr common.Address) (AccountInfo, bool, error) {
-	handle, err := s.getReadAccess(rootRef)
+	defer s.timer.stop(descentPhase, s.timer.start())
+	if s.operationStats == nil {
+		return s.getAccountInfo(s, rootRef, addr)
+	}
+	counter := &nodeVisitCounter{Forest: s}
+	info, exists, err := s.getAccountInfo(counter, rootRef, addr)
+	s.operationStats.record(getAccountInfoOperation, counter)
+	return info, exists, err
+}
+
+func (s *Forest) getAccountInfo(source NodeSource, rootRef *NodeReference, addr common.Address) (AccountInfo, bool, error) {
+	handle, err := source.getReadAccess(rootRef)
 	if err != nil {
+		if s.skipCorruptedNode(addr, err) {
+			return AccountInfo{}, false, nil
+		}
 		err = fmt.Errorf("failed to obtain read access to node %v: %w", rootRef.Id(), err)
 		s.errors = append(s.errors, err)
 		return AccountInfo{}, false, err
 	}
 	defer handle.Release()
-	path := AddressToNibblePath(addr, s)
-	info, exists, err := handle.Get().GetAccount(s, addr, path[:])
+	buffer := getNibblePathBuffer()
+	defer buffer.release()
+	path := buffer.setAddress(addr, s)
+	info, exists, err := handle.Get().GetAccount(source, addr, path[:])
 	if err != nil {
+		if s.skipCorruptedNode(addr, err) {
+			return AccountInfo{}, false, nil
+		}
 		err = fmt.Errorf("failed to fetch account information for account %v: %w", addr, err)
 		s.errors = append(s.errors, err)
 	}
 	return info, exists, err
 }
 
+// skipCorruptedNode reports whether the given error encountered while looking
+// up the given account is caused by a node failing to load and should be
+// ignored, treating the account as missing. Such errors are only skipped if
+// enabled by ForestConfig.SkipCorruptedNodes, in which case they are logged.
+func (s *Forest) skipCorruptedNode(addr common.Address, err error) bool {
+	var corrupted corruptedNodeErr
+	if !s.skipCorruptedNodes || !errors.As(err, &corrupted) {
+		return false
+	}
+	s.log(LogWarning, "skipped corrupted node", "account", addr, "node", corrupted.id, "error", corrupted.err)
+	return true
+}
+
 func (s *Forest) SetAccountInfo(rootRef *NodeReference, addr common.Address, info AccountInfo) (NodeReference, error) {
-	root, err := s.getWriteAccess(rootRef)
+	defer s.timer.stop(descentPhase, s.timer.start())
+	if s.operationStats == nil {
+		return s.setAccountInfo(s, rootRef, addr, info)
+	}
+	counter := &nodeVisitCounter{Forest: s}
+	newRoot, err := s.setAccountInfo(counter, rootRef, addr, info)
+	s.operationStats.record(setAccountInfoOperation, counter)
+	return newRoot, err
+}
+
+func (s *Forest) setAccountInfo(manager NodeManager, rootRef *NodeReference, addr common.Address, info AccountInfo) (NodeReference, error) {
+	root, err := manager.getWriteAccess(rootRef)
 	if err != nil {
 		err = fmt.Errorf("failed to obtain write access to node %v: %w", rootRef.Id(), err)
 		s.errors = append(s.errors, err)
 		return NodeReference{}, err
 	}
 	defer root.Release()
-	path := AddressToNibblePath(addr, s)
-	newRoot, _, err := root.Get().SetAccount(s, rootRef, root, addr, path[:], info)
+	buffer := getNibblePathBuffer()
+	defer buffer.release()
+	path := buffer.setAddress(addr, s)
+	newRoot, _, err := root.Get().SetAccount(manager, rootRef, root, addr, path[:], info)
 	if err != nil {
 		err = fmt.Errorf("failed to update account information for account %v: %w", addr, err)
 		s.errors = append(s.errors, err)
@@ -362,15 +708,28 @@ func (s *Forest) SetAccountInfo(rootRef *NodeReference, addr common.Address, inf
 }
 
 func (s *Forest) GetValue(rootRef *NodeReference, addr common.Address, key common.Key) (common.Value, error) {
-	root, err := s.getReadAccess(rootRef)
+	defer s.timer.stop(descentPhase, s.timer.start())
+	if s.operationStats == nil {
+		return s.getValue(s, rootRef, addr, key)
+	}
+	counter := &nodeVisitCounter{Forest: s}
+	value, err := s.getValue(counter, rootRef, addr, key)
+	s.operationStats.record(getValueOperation, counter)
+	return value, err
+}
+
+func (s *Forest) getValue(source NodeSource, rootRef *NodeReference, addr common.Address, key common.Key) (common.Value, error) {
+	root, err := source.getReadAccess(rootRef)
 	if err != nil {
 		err = fmt.Errorf("failed to obtain read access to node %v: %w", rootRef.Id(), err)
 		s.errors = append(s.errors, err)
 		return common.Value{}, err
 	}
 	defer root.Release()
-	path := AddressToNibblePath(addr, s)
-	value, _, err := root.Get().GetSlot(s, addr, path[:], key)
+	buffer := getNibblePathBuffer()
+	defer buffer.release()
+	path := buffer.setAddress(addr, s)
+	value, _, err := root.Get().GetSlot(source, addr, path[:], key)
 	if err != nil {
 		err = fmt.Errorf("failed to fetch value for %v/%v: %w", addr, key, err)
 		s.errors = append(s.errors, err)
@@ -379,22 +738,145 @@ func (s *Forest) GetValue(rootRef *NodeReference, addr common.Address, key commo
 }
 
 func (s *Forest) SetValue(rootRef *NodeReference, addr common.Address, key common.Key, value common.Value) (NodeReference, error) {
-	root, err := s.getWriteAccess(rootRef)
+	defer s.timer.stop(descentPhase, s.timer.start())
+	if s.operationStats == nil {
+		return s.setValue(s, rootRef, addr, key, value)
+	}
+	counter := &nodeVisitCounter{Forest: s}
+	newRoot, err := s.setValue(counter, rootRef, addr, key, value)
+	s.operationStats.record(setValueOperation, counter)
+	return newRoot, err
+}
+
+func (s *Forest) setValue(manager NodeManager, rootRef *NodeReference, addr common.Address, key common.Key, value common.Value) (NodeReference, error) {
+	root, err := manager.getWriteAccess(rootRef)
 	if err != nil {
 		err = fmt.Errorf("failed to obtain write access to node %v: %w", rootRef.Id(), err)
 		s.errors = append(s.errors, err)
 		return NodeReference{}, err
 	}
+	buffer := getNibblePathBuffer()
+	defer buffer.release()
+	path := buffer.setAddress(addr, s)
+	if value == (common.Value{}) {
+		s.recordSlotDeletion(addr, key)
+	}
+	if s.storageWeights != nil {
+		return s.setValueAndTrackWeight(manager, rootRef, root, addr, path[:], key, value)
+	}
 	defer root.Release()
-	path := AddressToNibblePath(addr, s)
-	newRoot, _, err := root.Get().SetSlot(s, rootRef, root, addr, path[:], key, value)
+	newRoot, _, err := root.Get().SetSlot(manager, rootRef, root, addr, path[:], key, value)
 	if err != nil {
 		err = fmt.Errorf("failed to update value for %v/%v: %w", addr, key, err)
-		s.errors = append(s.errors, err)
+		s.recordUpdateError(err)
 	}
 	return newRoot, err
 }
 
+func (s *Forest) SetSlots(rootRef *NodeReference, addr common.Address, updates []SlotUpdate) (NodeReference, bool, error) {
+	defer s.timer.stop(descentPhase, s.timer.start())
+	if s.operationStats == nil {
+		return s.setSlots(s, rootRef, addr, updates)
+	}
+	counter := &nodeVisitCounter{Forest: s}
+	newRoot, changed, err := s.setSlots(counter, rootRef, addr, updates)
+	s.operationStats.record(setValueOperation, counter)
+	return newRoot, changed, err
+}
+
+func (s *Forest) setSlots(manager NodeManager, rootRef *NodeReference, addr common.Address, updates []SlotUpdate) (NodeReference, bool, error) {
+	// The weights of storage tries are tracked per value, thus the values are
+	// set one by one if tracking is enabled.
+	if s.storageWeights != nil {
+		root := *rootRef
+		for _, update := range updates {
+			newRoot, err := s.setValue(manager, &root, addr, update.Key, update.Value)
+			if err != nil {
+				return newRoot, false, err
+			}
+			root = newRoot
+		}
+		// Without the changes reported by the nodes, only modified roots are detected.
+		return root, root != *rootRef, nil
+	}
+	root, err := manager.getWriteAccess(rootRef)
+	if err != nil {
+		err = fmt.Errorf("failed to obtain write access to node %v: %w", rootRef.Id(), err)
+		s.errors = append(s.errors, err)
+		return NodeReference{}, false, err
+	}
+	defer root.Release()
+	for _, update := range updates {
+		if update.Value == (common.Value{}) {
+			s.recordSlotDeletion(addr, update.Key)
+		}
+	}
+	buffer := getNibblePathBuffer()
+	defer buffer.release()
+	path := buffer.setAddress(addr, s)
+	newRoot, changed, err := root.Get().SetSlots(manager, rootRef, root, addr, path[:], updates)
+	if err != nil {
+		err = fmt.Errorf("failed to update values of %v: %w", addr, err)
+		s.recordUpdateError(err)
+	}
+	return newRoot, changed || newRoot != *rootRef, err
+}
+
+// recordUpdateError records an error encountered while updating the forest.
+// Refused updates exceeding the depth limit of storage tries leave the forest
+// unmodified and are thus not recorded as failures of the forest.
+func (s *Forest) recordUpdateError(err error) {
+	if !errors.Is(err, ErrDepthLimitExceeded) {
+		s.errors = append(s.errors, err)
+	}
+}
+
+// setValueAndTrackWeight is a variant of setValue recording the number of
+// nodes created in the modified storage trie and the depth of new values.
+// The write access to the root is released by this function.
+func (s *Forest) setValueAndTrackWeight(manager NodeManager, rootRef *NodeReference, root shared.WriteHandle[Node], addr common.Address, path []Nibble, key common.Key, value common.Value) (NodeReference, error) {
+	counter := &nodeCreationCounter{NodeManager: manager}
+	defer root.Release()
+	newRoot, _, err := root.Get().SetSlot(counter, rootRef, root, addr, path, key, value)
+	if err != nil {
+		err = fmt.Errorf("failed to update value for %v/%v: %w", addr, key, err)
+		s.recordUpdateError(err)
+		return newRoot, err
+	}
+	s.storageWeights.record(addr, counter.maxDepth, counter.nodes, counter.values)
+	return newRoot, nil
+}
+
+// GetHeaviestStorageTries returns the weights of up to k accounts with the
+// heaviest storage tries, ordered by decreasing weight. Only blocks committed
+// while storage weight tracking was enabled are covered.
+func (s *Forest) GetHeaviestStorageTries(k int) ([]StorageTrieWeight, error) {
+	if s.storageWeights == nil {
+		return nil, storageWeightTrackingDisabledErr
+	}
+	return s.storageWeights.getHeaviest(k), nil
+}
+
+func (s *Forest) commitStorageWeights(block uint64) {
+	if s.storageWeights != nil {
+		s.storageWeights.commit(block)
+	}
+}
+
+// HasAccount checks whether the given account exists by descending along the
+// path of the account until the first leaf node. Since no account information
+// needs to be retrieved, this is cheaper than calling GetAccountInfo.
+func (s *Forest) HasAccount(rootRef *NodeReference, addr common.Address) (bool, error) {
+	exists, err := VisitPathToAccount(s, rootRef, addr, MakeVisitor(func(Node, NodeInfo) VisitResponse {
+		return VisitResponseContinue
+	}))
+	if err != nil {
+		err = fmt.Errorf("failed to check existence of account %v: %w", addr, err)
+		s.errors = append(s.errors, err)
+	}
+	return exists, err
+}
+
 func (s *Forest) HasEmptyStorage(rootRef *NodeReference, addr common.Address) (isEmpty bool, err error) {
 	v := MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
 		if a, ok := node.(*AccountNode); ok {
@@ -407,6 +889,29 @@ func (s *Forest) HasEmptyStorage(rootRef *NodeReference, addr common.Address) (i
 	return isEmpty || !exists, err
 }
 
+// getAccountState obtains the information and the root of the storage trie of
+// the given account in the trie rooted by the given node. The returned flag is
+// false if the account does not exist.
+func (s *Forest) getAccountState(rootRef *NodeReference, addr common.Address) (AccountInfo, NodeReference, bool, error) {
+	var info AccountInfo
+	var storage NodeReference
+	v := MakeVisitor(func(node Node, _ NodeInfo) VisitResponse {
+		if a, ok := node.(*AccountNode); ok {
+			info = a.info
+			storage = a.storage
+			return VisitResponseAbort
+		}
+		return VisitResponseContinue
+	})
+	// The search path of a missing account may end at the leaf of another
+	// account, whose state must not be reported.
+	exists, err := VisitPathToAccount(s, rootRef, addr, v)
+	if err != nil || !exists {
+		return AccountInfo{}, NodeReference{}, false, err
+	}
+	return info, storage, true, nil
+}
+
 func (s *Forest) ClearStorage(rootRef *NodeReference, addr common.Address) (NodeReference, error) {
 	root, err := s.getWriteAccess(rootRef)
 	if err != nil {
@@ -415,7 +920,9 @@ func (s *Forest) ClearStorage(rootRef *NodeReference, addr common.Address) (Node
 		return NodeReference{}, err
 	}
 	defer root.Release()
-	path := AddressToNibblePath(addr, s)
+	buffer := getNibblePathBuffer()
+	defer buffer.release()
+	path := buffer.setAddress(addr, s)
 	newRoot, _, err := root.Get().ClearStorage(s, rootRef, root, addr, path[:])
 	if err != nil {
 		err = fmt.Errorf("failed to clear storage for %v: %w", addr, err)
@@ -424,6 +931,37 @@ func (s *Forest) ClearStorage(rootRef *NodeReference, addr common.Address) (Node
 	return newRoot, err
 }
 
+// RecreateAccount replaces the given account by a freshly created account with
+// the given information, as needed for accounts re-created after being
+// destroyed in the same block. The storage of an existing account is cleared
+// and its information replaced, producing the same trie as if the account had
+// been created from scratch. Empty information deletes the account. The
+// returned flag indicates whether the trie was modified.
+func (s *Forest) RecreateAccount(rootRef *NodeReference, addr common.Address, info AccountInfo) (NodeReference, bool, error) {
+	old, storage, exists, err := s.getAccountState(rootRef, addr)
+	if err != nil {
+		return NodeReference{}, false, err
+	}
+	hasStorage := exists && !storage.Id().IsEmpty()
+	if !hasStorage && old == info {
+		return *rootRef, false, nil
+	}
+	newRoot := *rootRef
+	// Deleting the account by setting empty information also releases its
+	// storage, thus the storage only needs to be cleared if retained.
+	if hasStorage && !info.IsEmpty() {
+		newRoot, err = s.ClearStorage(&newRoot, addr)
+		if err != nil {
+			return NodeReference{}, false, err
+		}
+	}
+	newRoot, err = s.SetAccountInfo(&newRoot, addr, info)
+	if err != nil {
+		return NodeReference{}, false, err
+	}
+	return newRoot, true, nil
+}
+
 func (s *Forest) VisitTrie(rootRef *NodeReference, visitor NodeVisitor) error {
 	root, err := s.getViewAccess(rootRef)
 	if err != nil {
@@ -440,15 +978,58 @@ func (s *Forest) VisitTrie(rootRef *NodeReference, visitor NodeVisitor) error {
 	return err
 }
 
+// VisitToDepth visits the nodes of the trie rooted by the given node up to the
+// given depth, with the root being at depth 0, in the order of VisitTrie. The
+// descendants of nodes at the maximum depth are pruned. The returned flag
+// indicates whether any node was pruned this way.
+func (s *Forest) VisitToDepth(rootRef *NodeReference, maxDepth int, visitor NodeVisitor) (bool, error) {
+	limiter := &depthLimitingVisitor{nested: visitor, maxDepth: maxDepth}
+	err := s.VisitTrie(rootRef, limiter)
+	return limiter.truncated, err
+}
+
 func (s *Forest) updateHashesFor(ref *NodeReference) (common.Hash, *NodeHashes, error) {
-	hash, hints, err := s.hasher.updateHashes(ref, s)
+	start := s.timer.start()
+	hash, hints, err := s.hasher.updateHashes(ref, s, s.hashObserver)
+	s.timer.stop(hashingPhase, start)
 	if err != nil {
 		err = fmt.Errorf("error during hash update: %w", err)
 		s.errors = append(s.errors, err)
+		return hash, hints, err
+	}
+	if s.pinnedLevels > 0 {
+		err = s.updatePinnedNodes(ref)
 	}
 	return hash, hints, err
 }
 
+// updatePinnedNodes pins the nodes of the upper levels of the trie rooted by
+// the given node in the node cache, replacing the previously pinned nodes.
+// Since tries are hashed at the end of each block, this is called whenever
+// the structure of the upper levels may have changed.
+func (s *Forest) updatePinnedNodes(root *NodeReference) error {
+	s.pinnedNodesMutex.Lock()
+	defer s.pinnedNodesMutex.Unlock()
+	for _, id := range s.pinnedNodes {
+		ref := NewNodeReference(id)
+		s.nodeCache.Unpin(&ref)
+	}
+	s.pinnedNodes = s.pinnedNodes[:0]
+	return s.VisitTrie(root, MakeVisitor(func(_ Node, info NodeInfo) VisitResponse {
+		if info.Id.IsEmpty() {
+			return VisitResponsePrune
+		}
+		ref := NewNodeReference(info.Id)
+		if s.nodeCache.Pin(&ref) {
+			s.pinnedNodes = append(s.pinnedNodes, info.Id)
+		}
+		if *info.Depth+1 >= s.pinnedLevels {
+			return VisitResponsePrune
+		}
+		return VisitResponseContinue
+	}))
+}
+
 func (s *Forest) setHashesFor(root *NodeReference, hashes *NodeHashes) error {
 	for _, cur := range hashes.GetHashes() {
 		write, err := s.getMutableNodeByPath(root, cur.Path)
@@ -486,21 +1067,134 @@ func (f *Forest) Freeze(ref *NodeReference) error {
 	if f.storageMode != Immutable {
 		return fmt.Errorf("node-freezing only supported in archive mode")
 	}
-	root, err := f.getWriteAccess(ref)
-	if err != nil {
-		err = fmt.Errorf("failed to obtain write access to node %v: %w", ref.Id(), err)
+	if err := f.freeze(ref); err != nil {
+		err = fmt.Errorf("error while freezing trie rooted by %v: %w", ref.Id(), err)
 		f.errors = append(f.errors, err)
 		return err
 	}
-	defer root.Release()
-	err = root.Get().Freeze(f, root)
-	if err != nil {
-		err = fmt.Errorf("error while freezing trie rooted by %v: %w", ref.Id(), err)
-		f.errors = append(f.errors, err)
+	return nil
+}
+
+// freeze freezes the sub-trie rooted by the given node. See freezeTrie for
+// details.
+func (f *Forest) freeze(ref *NodeReference) error {
+	return freezeTrie(f, ref)
+}
+
+// freezeTrie freezes the sub-trie rooted by the given node bottom-up such
+// that concurrent readers of the sub-trie, which may be shared with the tries
+// of other blocks, are not blocked for the duration of the freeze and never
+// observe a half-frozen node. Children are enumerated using read access only,
+// and each node is marked frozen -- including the frozen flags of its
+// children -- within a single short write access, after its entire sub-trie
+// has been frozen. Thus, any node observed as frozen is the root of a fully
+// frozen sub-trie. Nodes are only accessed one at a time.
+//
+// The operation is transactional: if it fails, e.g. since a node can not be
+// loaded, all nodes frozen by this call are reverted to their previous state
+// in reverse order, such that the invariant above is retained throughout.
+// Since frozen flags are not persisted, but implied for all nodes loaded by
+// archives, nodes written to disk in the meantime can not be reverted.
+func freezeTrie(manager NodeManager, ref *NodeReference) error {
+	var frozen []frozenNode
+	err := freezeSubTrie(manager, ref, &frozen)
+	if err == nil {
+		return nil
+	}
+	if revertErr := revertFreeze(manager, frozen); revertErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to revert freeze: %w", revertErr))
 	}
 	return err
 }
 
+// frozenNode records a node frozen by freezeTrie and the frozen flags of its
+// children before it got frozen, which are only maintained by branch nodes.
+type frozenNode struct {
+	ref            NodeReference
+	frozenChildren uint16
+}
+
+func freezeSubTrie(manager NodeManager, ref *NodeReference, frozen *[]frozenNode) error {
+	handle, err := manager.getReadAccess(ref)
+	if err != nil {
+		return fmt.Errorf("failed to obtain read access to node %v: %w", ref.Id(), err)
+	}
+	if handle.Get().IsFrozen() {
+		handle.Release()
+		return nil
+	}
+	children := getNonFrozenChildren(handle.Get())
+	handle.Release()
+
+	for i := range children {
+		if err := freezeSubTrie(manager, &children[i], frozen); err != nil {
+			return err
+		}
+	}
+
+	write, err := manager.getWriteAccess(ref)
+	if err != nil {
+		return fmt.Errorf("failed to obtain write access to node %v: %w", ref.Id(), err)
+	}
+	record := frozenNode{ref: *ref}
+	if branch, ok := write.Get().(*BranchNode); ok {
+		record.frozenChildren = branch.frozenChildren
+	}
+	write.Get().MarkFrozen()
+	write.Release()
+	*frozen = append(*frozen, record)
+	return nil
+}
+
+// revertFreeze un-freezes the given nodes in reverse order, thus parents
+// before their children.
+func revertFreeze(manager NodeManager, frozen []frozenNode) error {
+	var errs []error
+	for i := len(frozen) - 1; i >= 0; i-- {
+		write, err := manager.getWriteAccess(&frozen[i].ref)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to obtain write access to node %v: %w", frozen[i].ref.Id(), err))
+			continue
+		}
+		switch node := write.Get().(type) {
+		case *BranchNode:
+			node.markMutable()
+			node.frozenChildren = frozen[i].frozenChildren
+		case *ExtensionNode:
+			node.markMutable()
+		case *AccountNode:
+			node.markMutable()
+		case *ValueNode:
+			node.markMutable()
+		}
+		write.Release()
+	}
+	return errors.Join(errs...)
+}
+
+// getNonFrozenChildren lists the references to the non-empty children of
+// the given node that may not be frozen yet.
+func getNonFrozenChildren(node Node) []NodeReference {
+	switch n := node.(type) {
+	case *BranchNode:
+		res := make([]NodeReference, 0, len(n.children))
+		for i, child := range n.children {
+			if !child.Id().IsEmpty() && !n.isChildFrozen(byte(i)) {
+				res = append(res, child)
+			}
+		}
+		return res
+	case *ExtensionNode:
+		return []NodeReference{n.next}
+	case *AccountNode:
+		if n.storage.Id().IsEmpty() {
+			return nil
+		}
+		return []NodeReference{n.storage}
+	}
+	return nil
+}
+
 // CheckErrors returns an error that might have been
 // encountered on this forest in the past.
 // If the result is not empty, this
@@ -510,6 +1204,8 @@ func (s *Forest) CheckErrors() error {
 }
 
 func (s *Forest) Flush() error {
+	start := time.Now()
+
 	// Wait for releaser to finish its current tasks.
 	s.releaseQueue <- EmptyId() // signals a sync request
 	<-s.releaseSync
@@ -533,7 +1229,11 @@ func (s *Forest) Flush() error {
 
 	errs = append(errs, s.flushDirtyIds(ids))
 
-	return errors.Join(
+	if s.storageWeights != nil {
+		errs = append(errs, s.storageWeights.flush())
+	}
+
+	err := errors.Join(
 		errors.Join(errs...),
 		s.writeBuffer.Flush(),
 		s.accounts.Flush(),
@@ -541,6 +1241,12 @@ func (s *Forest) Flush() error {
 		s.extensions.Flush(),
 		s.values.Flush(),
 	)
+	if err != nil {
+		s.log(LogError, "failed to flush forest", "error", err)
+	} else {
+		s.log(LogDebug, "flushed forest", "nodes", len(ids), "duration", time.Since(start))
+	}
+	return err
 }
 
 func (s *Forest) flushDirtyIds(ids []NodeId) error {
@@ -553,10 +1259,7 @@ func (s *Forest) flushDirtyIds(ids []NodeId) error {
 		if present {
 			handle := node.GetWriteHandle()
 			node := handle.Get()
-			err := s.flushNode(id, node)
-			if err == nil {
-				node.MarkClean()
-			} else {
+			if err := s.flushNode(id, node); err != nil {
 				errs = append(errs, err)
 			}
 			handle.Release()
@@ -569,12 +1272,32 @@ func (s *Forest) flushDirtyIds(ids []NodeId) error {
 }
 
 func (s *Forest) Close() error {
+	return s.close(true)
+}
+
+// closeWithoutFlush closes this forest without writing modified nodes retained
+// in the node cache to the stocks. This is intended for volatile forests,
+// whose content is lost when being closed anyway.
+func (s *Forest) closeWithoutFlush() error {
+	return s.close(false)
+}
+
+func (s *Forest) close(flush bool) error {
 	// Ensure that the forest is only closed once.
 	if !s.closed.CompareAndSwap(false, true) {
 		return forestClosedErr
 	}
 
-	errs := []error{s.flusher.Stop(), s.Flush()}
+	if s.cacheWarmer != nil {
+		s.cacheWarmer.Stop()
+	}
+
+	s.drainReleaseQueue()
+
+	errs := []error{s.flusher.Stop()}
+	if flush {
+		errs = append(errs, s.Flush())
+	}
 
 	// shut down release worker
 	close(s.releaseQueue)
@@ -583,7 +1306,14 @@ func (s *Forest) Close() error {
 	// Consume potential release errors.
 	errs = append(errs, s.collectReleaseWorkerErrors())
 
-	return errors.Join(
+	// Record the content of the node cache for the next start if the forest
+	// is in a consistent state.
+	if flush && s.cacheManifestFile != "" && errors.Join(errs...) == nil {
+		ids := s.nodeCache.GetMostRecentlyUsed(s.cacheManifestSize)
+		errs = append(errs, writeNodeCacheManifest(s.cacheManifestFile, ids))
+	}
+
+	err := errors.Join(
 		errors.Join(errs...),
 		s.writeBuffer.Close(),
 		s.accounts.Close(),
@@ -591,10 +1321,36 @@ func (s *Forest) Close() error {
 		s.extensions.Close(),
 		s.values.Close(),
 	)
+
+	// Record the configuration of directories lacking it once they are in a
+	// consistent state.
+	if err == nil && s.pendingConfigDirectory != "" {
+		err = writeMptConfig(s.pendingConfigDirectory, s.config)
+	}
+	if err != nil {
+		s.log(LogError, "failed to close forest", "error", err)
+	} else {
+		s.log(LogInfo, "closed forest")
+	}
+	return err
+}
+
+// log reports the given message to the configured logger, if any.
+func (s *Forest) log(level LogLevel, msg string, keysAndValues ...any) {
+	if s.logger != nil {
+		s.logger.Log(level, msg, keysAndValues...)
+	}
+}
+
+func (s *Forest) getLogger() Logger {
+	return s.logger
 }
 
 func (s *Forest) collectReleaseWorkerErrors() error {
-	var errs []error
+	s.releaseErrorsMutex.Lock()
+	errs := s.releaseErrors
+	s.releaseErrors = nil
+	s.releaseErrorsMutex.Unlock()
 loop:
 	for {
 		select {
@@ -612,6 +1368,37 @@ loop:
 	return errors.Join(errs...)
 }
 
+// GetIdSpaceUsage reports the number of node IDs allocated for each type of
+// node and the capacity of the node references of this forest.
+func (s *Forest) GetIdSpaceUsage() (IdSpaceUsage, error) {
+	var used NodeIdCounts
+	var errs []error
+	getUpperBound := func(ids stock.IndexSet[uint64], err error) uint64 {
+		if err != nil {
+			errs = append(errs, err)
+			return 0
+		}
+		return ids.GetUpperBound()
+	}
+	used.Accounts = getUpperBound(s.accounts.GetIds())
+	used.Branches = getUpperBound(s.branches.GetIds())
+	used.Extensions = getUpperBound(s.extensions.GetIds())
+	used.Values = getUpperBound(s.values.GetIds())
+	if err := errors.Join(errs...); err != nil {
+		return IdSpaceUsage{}, err
+	}
+	return IdSpaceUsage{
+		Used:     used,
+		Capacity: getIdSpaceCapacity(getNodeIdEncoder(s.config).GetEncodedSize()),
+	}, nil
+}
+
+// GetNumberOfWrittenNodes returns the number of nodes written to disk since
+// the forest got opened.
+func (s *Forest) GetNumberOfWrittenNodes() uint64 {
+	return s.writtenNodes.Load()
+}
+
 // GetMemoryFootprint provides sizes of individual components of the state in the memory
 func (s *Forest) GetMemoryFootprint() *common.MemoryFootprint {
 	mf := common.NewMemoryFootprint(unsafe.Sizeof(*s))
@@ -622,6 +1409,12 @@ func (s *Forest) GetMemoryFootprint() *common.MemoryFootprint {
 	mf.AddChild("cache", s.nodeCache.GetMemoryFootprint())
 	mf.AddChild("hashedKeysCache", s.keyHasher.GetMemoryFootprint())
 	mf.AddChild("hashedAddressesCache", s.addressHasher.GetMemoryFootprint())
+	if s.storageWeights != nil {
+		mf.AddChild("storageWeights", s.storageWeights.getMemoryFootprint())
+	}
+	if s.readHashVerifier != nil {
+		mf.AddChild("readHashVerifier", s.readHashVerifier.getMemoryFootprint())
+	}
 	return mf
 }
 
@@ -636,6 +1429,55 @@ func (s *Forest) Dump(rootRef *NodeReference) {
 	root.Get().Dump(os.Stdout, s, rootRef, "")
 }
 
+// InspectReferences reports diagnostic information on the node with the given
+// ID: the number of currently active access handles on the node, and whether
+// it is frozen and dirty. Handles that are never released block the eviction
+// and modification of nodes, thus a non-zero count outside of an ongoing
+// operation indicates a leak. Nodes not retained in the cache have no active
+// handles and are reported as neither frozen nor dirty. The same is true for
+// the flags of nodes currently locked for writing, since inspecting those
+// would block.
+func (s *Forest) InspectReferences(id NodeId) (refCount int, frozen bool, dirty bool) {
+	ref := NewNodeReference(id)
+	node, found := s.nodeCache.Get(&ref)
+	if !found {
+		return 0, false, false
+	}
+	return inspectReferences(node)
+}
+
+func inspectReferences(node *shared.Shared[Node]) (refCount int, frozen bool, dirty bool) {
+	// The count is obtained first to exclude the handle used for inspection.
+	refCount = node.NumHandles()
+	handle, succ := node.TryGetReadHandle()
+	if !succ {
+		return refCount, false, false
+	}
+	defer handle.Release()
+	return refCount, handle.Get().IsFrozen(), handle.Get().IsDirty()
+}
+
+// DumpPinnedNodes lists all nodes in the cache with active access handles on
+// the given writer, one node per line. Mainly intended for debugging leaked
+// handles, in which case the list remains non-empty while the forest is idle.
+func (s *Forest) DumpPinnedNodes(w io.Writer) {
+	type pinnedNode struct {
+		id            NodeId
+		refCount      int
+		frozen, dirty bool
+	}
+	var pinned []pinnedNode
+	s.nodeCache.ForEach(func(id NodeId, node *shared.Shared[Node]) {
+		if refCount, frozen, dirty := inspectReferences(node); refCount > 0 {
+			pinned = append(pinned, pinnedNode{id, refCount, frozen, dirty})
+		}
+	})
+	sort.Slice(pinned, func(i, j int) bool { return pinned[i].id < pinned[j].id })
+	for _, cur := range pinned {
+		fmt.Fprintf(w, "%v: handles=%d, frozen=%t, dirty=%t\n", cur.id, cur.refCount, cur.frozen, cur.dirty)
+	}
+}
+
 // Check verifies internal invariants of the Trie instance. If the trie is
 // self-consistent, nil is returned and the Trie is ready to be accessed. If
 // errors are detected, the Trie is to be considered in an invalid state and
@@ -647,7 +1489,7 @@ func (s *Forest) Check(rootRef *NodeReference) error {
 // CheckAll verifies internal invariants of a set of Trie instances rooted by
 // the given nodes. It is a generalization of the Check() function.
 func (s *Forest) CheckAll(rootRefs []*NodeReference) error {
-	return CheckForest(s, rootRefs)
+	return CheckForestInParallel(s, rootRefs, s.checkWorkers)
 }
 
 // -- NodeManager interface --
@@ -662,6 +1504,66 @@ func (s *Forest) getSharedNode(ref *NodeReference) (*shared.Shared[Node], error)
 		return res, nil
 	}
 
+	res, loaded, err := s.fetchSharedNode(ref)
+	if err != nil {
+		s.markTainted(ref.Id(), err)
+		return nil, s.wrapCorruptedNodeErr(ref.Id(), err)
+	}
+	if !loaded || s.readHashVerifier == nil {
+		return res, nil
+	}
+
+	// The verification is performed after releasing the transfer mutex since
+	// the re-computation of hashes may require access to other nodes.
+	if err := s.readHashVerifier.verify(s, ref.Id(), res); err != nil {
+		s.markTainted(ref.Id(), err)
+		return nil, s.wrapCorruptedNodeErr(ref.Id(), err)
+	}
+	return res, nil
+}
+
+// markTainted records the failure of loading the given node in the directory
+// of this forest, such that the corruption is reported until the directory
+// gets verified successfully. Failures of closed forests are not recorded,
+// since they are caused by accessing the closed stocks.
+func (s *Forest) markTainted(id NodeId, err error) {
+	if s.taintDirectory == "" || s.closed.Load() || s.tainted.Swap(true) {
+		return
+	}
+	cause := fmt.Errorf("failed to load node %v: %w", id, err)
+	if err := markTainted(s.taintDirectory, cause); err != nil {
+		s.log(LogWarning, "failed to record corruption", "directory", s.taintDirectory, "cause", cause, "err", err)
+	}
+}
+
+// corruptedNodeErr marks errors caused by a node that could not be loaded.
+type corruptedNodeErr struct {
+	id  NodeId
+	err error
+}
+
+func (e corruptedNodeErr) Error() string {
+	return fmt.Sprintf("failed to load node %v: %v", e.id, e.err)
+}
+
+func (e corruptedNodeErr) Unwrap() error {
+	return e.err
+}
+
+// wrapCorruptedNodeErr marks the given error of loading the given node as a
+// corrupted node error if those are to be skipped by account lookups. In the
+// default fail-fast mode, errors are returned unchanged.
+func (s *Forest) wrapCorruptedNodeErr(id NodeId, err error) error {
+	if !s.skipCorruptedNodes {
+		return err
+	}
+	return corruptedNodeErr{id: id, err: err}
+}
+
+// fetchSharedNode obtains the node referenced by the given reference from the
+// write buffer or the disk and adds it to the node cache. The returned flag
+// indicates whether the node has been loaded from the disk.
+func (s *Forest) fetchSharedNode(ref *NodeReference) (*shared.Shared[Node], bool, error) {
 	// Check whether the node is in the write buffer.
 	// Note: although Cancel is thread safe, it is important to make sure
 	// that this part is only run by a single thread to avoid one thread
@@ -677,18 +1579,22 @@ func (s *Forest) getSharedNode(ref *NodeReference) (*shared.Shared[Node], error)
 	defer s.nodeTransferMutex.Unlock()
 
 	id := ref.Id()
-	res, found = s.writeBuffer.Cancel(id)
+	res, found := s.writeBuffer.Cancel(id)
 	if found {
+		if s.readHashVerifier != nil {
+			s.readHashVerifier.forget(id)
+		}
 		masterCopy, _ := s.addToCacheHoldingTransferMutex(ref, res)
 		if masterCopy != res {
 			panic("failed to reinstate element from write buffer")
 		}
-		return res, nil
+		return res, false, nil
 	}
 
 	// Load the node from persistent storage.
 	var node Node
 	var err error
+	start := s.timer.start()
 	if id.IsValue() {
 		value, e := s.values.Get(id.Index())
 		node, err = &value, e
@@ -704,23 +1610,46 @@ func (s *Forest) getSharedNode(ref *NodeReference) (*shared.Shared[Node], error)
 	} else if id.IsEmpty() {
 		node = EmptyNode{}
 	}
+	s.timer.stop(stockReadPhase, start)
 
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	// Everything loaded from the stock is in sync and thus clean.
 	node.MarkClean()
 
 	// Everything that is loaded from an archive is to be considered
-	// frozen, and thus immutable.
+	// frozen, and thus immutable. In LiveDBs, this applies to nodes shared
+	// with forks. Frozen flags are not persisted, yet stocks may retain
+	// them, so they are reset for all other nodes.
 	if s.storageMode == Immutable {
 		node.MarkFrozen()
+	} else {
+		unfreezeLoadedNode(node)
+		s.refreezeForkedNode(id, node)
 	}
 
 	// if there has been a concurrent fetch, use the other value
-	instance, _ := s.addToCacheHoldingTransferMutex(ref, shared.MakeShared[Node](node))
-	return instance, nil
+	instance, present := s.addToCacheHoldingTransferMutex(ref, shared.MakeShared[Node](node))
+	return instance, !present, nil
+}
+
+// unfreezeLoadedNode resets the frozen flags of a node loaded from a stock,
+// which may have been retained by stocks keeping nodes in memory or by
+// buffers reused for decoding nodes.
+func unfreezeLoadedNode(node Node) {
+	switch node := node.(type) {
+	case *BranchNode:
+		node.markMutable()
+		node.frozenChildren = 0
+	case *ExtensionNode:
+		node.markMutable()
+	case *AccountNode:
+		node.markMutable()
+	case *ValueNode:
+		node.markMutable()
+	}
 }
 
 func getAccess[H any](
@@ -789,6 +1718,27 @@ func (s *Forest) getHashAccess(ref *NodeReference) (shared.HashHandle[Node], err
 }
 
 func (f *Forest) getWriteAccess(ref *NodeReference) (shared.WriteHandle[Node], error) {
+	res, err := f.getUnexpandedWriteAccess(ref)
+	if err != nil {
+		return res, err
+	}
+	// Nodes shared with forks are frozen lazily, such that the children of
+	// frozen nodes need to be frozen before the nodes get copied.
+	if f.hasForkedNodes.Load() && res.Get().IsFrozen() {
+		if err := f.freezeForkedChildren(ref, res.Get()); err != nil {
+			res.Release()
+			return shared.WriteHandle[Node]{}, err
+		}
+	}
+	if f.frozenNodeGuard == nil {
+		return res, nil
+	}
+	return f.frozenNodeGuard.guard(ref.Id(), res), nil
+}
+
+// getUnexpandedWriteAccess obtains write access to the referenced node without
+// freezing the children of nodes shared with forks.
+func (f *Forest) getUnexpandedWriteAccess(ref *NodeReference) (shared.WriteHandle[Node], error) {
 	return getAccess(f, ref,
 		func(s *shared.Shared[Node]) shared.WriteHandle[Node] {
 			// When gaining write access to nodes, they need to be touched to make sure
@@ -844,6 +1794,9 @@ func (s *Forest) getMutableNodeByPath(root *NodeReference, path NodePath) (share
 func (s *Forest) addToCache(ref *NodeReference, node *shared.Shared[Node]) (value *shared.Shared[Node], present bool) {
 	s.nodeTransferMutex.Lock()
 	defer s.nodeTransferMutex.Unlock()
+	if s.readHashVerifier != nil {
+		s.readHashVerifier.forget(ref.Id())
+	}
 	return s.addToCacheHoldingTransferMutex(ref, node)
 }
 
@@ -873,6 +1826,9 @@ func (s *Forest) addToCacheHoldingTransferMutex(ref *NodeReference, node *shared
 
 	// Enqueue evicted node for asynchronous write to file.
 	s.writeBuffer.Add(evictedId, evictedNode)
+	if s.logger != nil { // avoids the boxing of arguments on this hot path if disabled
+		s.logger.Log(LogDebug, "evicted modified node", "node", evictedId)
+	}
 	return current, present
 }
 
@@ -885,19 +1841,31 @@ func (s *Forest) flushNode(id NodeId, node Node) error {
 	// large, such cases should be rare. Nevertheless, a warning is
 	// printed here to get informed if this changes in the future.
 	if printWarningDefaultNodeFreezing && s.storageMode == Immutable && !node.IsFrozen() {
-		log.Printf("WARNING: non-frozen node flushed to disk causing implicit freeze")
+		logWarning(s.logger, "non-frozen node flushed to disk causing implicit freeze")
 	}
 
+	defer s.timer.stop(stockWritePhase, s.timer.start())
+	var err error
 	if id.IsValue() {
-		return s.values.Set(id.Index(), *node.(*ValueNode))
+		err = s.values.Set(id.Index(), *node.(*ValueNode))
 	} else if id.IsAccount() {
-		return s.accounts.Set(id.Index(), *node.(*AccountNode))
+		err = s.accounts.Set(id.Index(), *node.(*AccountNode))
 	} else if id.IsBranch() {
-		return s.branches.Set(id.Index(), *node.(*BranchNode))
+		err = s.branches.Set(id.Index(), *node.(*BranchNode))
 	} else if id.IsExtension() {
-		return s.extensions.Set(id.Index(), *node.(*ExtensionNode))
+		err = s.extensions.Set(id.Index(), *node.(*ExtensionNode))
+	} else {
+		return nil
 	}
-	return nil
+	if err == nil {
+		s.writtenNodes.Add(1)
+		// Written nodes are in sync with their on-disk version.
+		if node.IsDirty() {
+			s.dirtyNodes.forId(id).add(-1)
+		}
+		node.MarkClean()
+	}
+	return err
 }
 
 func (s *Forest) createAccount() (NodeReference, shared.WriteHandle[Node], error) {
@@ -907,6 +1875,7 @@ func (s *Forest) createAccount() (NodeReference, shared.WriteHandle[Node], error
 	}
 	ref := NewNodeReference(AccountId(i))
 	node := new(AccountNode)
+	s.dirtyNodes.accounts.add(1) // new nodes are dirty
 	instance, present := s.addToCache(&ref, shared.MakeShared[Node](node))
 	if present {
 		write := instance.GetWriteHandle()
@@ -923,6 +1892,7 @@ func (s *Forest) createBranch() (NodeReference, shared.WriteHandle[Node], error)
 	}
 	ref := NewNodeReference(BranchId(i))
 	node := new(BranchNode)
+	s.dirtyNodes.branches.add(1) // new nodes are dirty
 	instance, present := s.addToCache(&ref, shared.MakeShared[Node](node))
 	if present {
 		write := instance.GetWriteHandle()
@@ -939,6 +1909,7 @@ func (s *Forest) createExtension() (NodeReference, shared.WriteHandle[Node], err
 	}
 	ref := NewNodeReference(ExtensionId(i))
 	node := new(ExtensionNode)
+	s.dirtyNodes.extensions.add(1) // new nodes are dirty
 	instance, present := s.addToCache(&ref, shared.MakeShared[Node](node))
 	if present {
 		write := instance.GetWriteHandle()
@@ -955,6 +1926,7 @@ func (s *Forest) createValue() (NodeReference, shared.WriteHandle[Node], error)
 	}
 	ref := NewNodeReference(ValueId(i))
 	node := new(ValueNode)
+	s.dirtyNodes.values.add(1) // new nodes are dirty
 	instance, present := s.addToCache(&ref, shared.MakeShared[Node](node))
 	if present {
 		write := instance.GetWriteHandle()
@@ -992,40 +1964,276 @@ func (s *Forest) release(ref *NodeReference) error {
 	return fmt.Errorf("unable to release node %v", id)
 }
 
+// releaseBatch releases all referenced nodes. Compared to releasing nodes
+// individually, the cache and each stock is only locked once per batch.
+func (s *Forest) releaseBatch(refs []NodeReference) error {
+	var accounts, branches, extensions, values []uint64
+	for _, ref := range refs {
+		id := ref.Id()
+		switch {
+		case id.IsAccount():
+			accounts = append(accounts, id.Index())
+		case id.IsBranch():
+			branches = append(branches, id.Index())
+		case id.IsExtension():
+			extensions = append(extensions, id.Index())
+		case id.IsValue():
+			values = append(values, id.Index())
+		default:
+			return fmt.Errorf("unable to release node %v", id)
+		}
+	}
+
+	// See the release function above for the motivation of this call.
+	s.nodeCache.ReleaseAll(refs)
+
+	// Deleting sorted indexes improves the locality of freelist updates.
+	for _, indexes := range [][]uint64{accounts, branches, extensions, values} {
+		sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	}
+	return errors.Join(
+		stock.DeleteAll(s.accounts, accounts),
+		stock.DeleteAll(s.branches, branches),
+		stock.DeleteAll(s.extensions, extensions),
+		stock.DeleteAll(s.values, values),
+	)
+}
+
+// releaseTrie synchronously releases all non-frozen nodes of the trie rooted
+// by the given node. Released nodes are collected in batches.
+func (s *Forest) releaseTrie(ref NodeReference) error {
+	released, err := releaseSubTrie(s, &ref, s.releaseBatchSize)
+	s.releasedTries.Add(1)
+	s.releasedNodes.Add(int64(released))
+	if err != nil {
+		s.log(LogError, "failed to release trie", "root", ref.Id(), "error", err)
+	} else {
+		s.log(LogDebug, "released trie", "root", ref.Id(), "nodes", released)
+	}
+	return err
+}
+
+// runReleaseWorkers dispatches the tries received through the given queue to
+// the given number of workers releasing them concurrently. Sync requests are
+// answered once all tries queued before have been released. After the first
+// error, no further tries are released and the error is reported. Once the
+// abort channel is closed, pending tries are skipped without being released.
+func runReleaseWorkers(
+	forest *Forest,
+	numWorkers int,
+	queue <-chan NodeId,
+	syncs chan<- struct{},
+	errs chan<- error,
+	done chan<- struct{},
+	abort <-chan struct{},
+) {
+	defer close(done)
+	defer close(errs)
+	defer close(syncs)
+
+	var workers, pending sync.WaitGroup
+	var failOnce sync.Once
+	failed := make(chan struct{})
+	tasks := make(chan NodeId)
+	for i := 0; i < numWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for id := range tasks {
+				select {
+				case <-abort:
+				default:
+					if err := forest.releaseTrie(NewNodeReference(id)); err != nil {
+						failOnce.Do(func() {
+							errs <- err
+							close(failed)
+						})
+					}
+				}
+				forest.releasePending.Add(-1)
+				pending.Done()
+			}
+		}()
+	}
+	defer workers.Wait()
+	defer close(tasks)
+
+	for {
+		select {
+		case <-failed:
+			return
+		case id, open := <-queue:
+			if !open {
+				return
+			}
+			if id.IsEmpty() {
+				pending.Wait()
+				select {
+				case <-failed:
+					return
+				default:
+					syncs <- struct{}{}
+				}
+			} else {
+				pending.Add(1)
+				select {
+				case <-failed:
+					pending.Done()
+					return
+				case tasks <- id:
+				}
+			}
+		}
+	}
+}
+
 func (s *Forest) releaseTrieAsynchronous(ref NodeReference) {
 	id := ref.Id()
-	if !id.IsEmpty() { // empty Id is used for signalling sync requests
-		s.releaseQueue <- id
+	if id.IsEmpty() { // empty Id is used for signalling sync requests
+		return
+	}
+	// If the queue is overloaded, the trie is released by the caller to slow
+	// down the production of further release work. Otherwise the queue would
+	// grow without limit under deletion-heavy workloads, and with it the
+	// number of nodes retained in the cache.
+	if s.isReleaseQueueOverloaded() {
+		s.synchronousReleases.Add(1)
+		if err := s.releaseTrie(ref); err != nil {
+			s.releaseErrorsMutex.Lock()
+			s.releaseErrors = append(s.releaseErrors, err)
+			s.releaseErrorsMutex.Unlock()
+		}
+		return
+	}
+	s.releasePending.Add(1)
+	s.releaseQueue <- id
+}
+
+// isReleaseQueueOverloaded returns true if any of the soft limits of the
+// release queue is exceeded.
+func (s *Forest) isReleaseQueueOverloaded() bool {
+	stats := s.GetReleaseQueueStats()
+	return (s.releaseSoftLimit > 0 && stats.PendingTries >= s.releaseSoftLimit) ||
+		(s.releaseNodeSoftLimit > 0 && stats.EstimatedPendingNodes >= s.releaseNodeSoftLimit)
+}
+
+// ReleaseQueueStats summarizes the state of the queue of tries waiting to be
+// released in the background.
+type ReleaseQueueStats struct {
+	PendingTries          int // the number of tries queued but not yet released
+	EstimatedPendingNodes int // the number of nodes of pending tries, estimated by the average size of released tries
+	ReleasedTries         int // the total number of released tries
+	ReleasedNodes         int // the total number of nodes of released tries
+	SynchronousReleases   int // the number of tries released synchronously due to exceeded soft limits
+}
+
+// GetReleaseQueueStats provides statistics on the background release of tries.
+func (s *Forest) GetReleaseQueueStats() ReleaseQueueStats {
+	pending := int(s.releasePending.Load())
+	tries := int(s.releasedTries.Load())
+	nodes := int(s.releasedNodes.Load())
+	// Until the first trie is released, each trie is assumed to be a single node.
+	estimated := pending
+	if tries > 0 {
+		estimated = int(int64(pending) * int64(nodes) / int64(tries))
+	}
+	return ReleaseQueueStats{
+		PendingTries:          pending,
+		EstimatedPendingNodes: estimated,
+		ReleasedTries:         tries,
+		ReleasedNodes:         nodes,
+		SynchronousReleases:   int(s.synchronousReleases.Load()),
 	}
 }
 
+// drainReleaseQueue waits for pending tries to be released. If this takes
+// longer than the configured drain timeout, the remaining tries are logged
+// and skipped. The nodes of skipped tries remain allocated in the stocks,
+// which wastes disk space but does not affect the integrity of the forest.
+func (s *Forest) drainReleaseQueue() {
+	if s.releaseDrainTimeout <= 0 {
+		return // the subsequent flush waits for all pending tries
+	}
+	deadline := time.Now().Add(s.releaseDrainTimeout)
+	for s.releasePending.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := s.GetReleaseQueueStats(); stats.PendingTries > 0 {
+		logWarning(s.logger, fmt.Sprintf("release queue not drained within %v, skipping release of %d tries with an estimated %d nodes", s.releaseDrainTimeout, stats.PendingTries, stats.EstimatedPendingNodes))
+		s.abortPendingReleases()
+	}
+}
+
+// abortPendingReleases makes the release workers skip the tries pending to be
+// released. Like for tries skipped by drainReleaseQueue, their nodes remain
+// allocated in the stocks.
+func (s *Forest) abortPendingReleases() {
+	s.abortOnce.Do(func() {
+		close(s.releaseAbort)
+	})
+}
+
 func getEncoder(config MptConfig) (
 	stock.ValueEncoder[AccountNode],
 	stock.ValueEncoder[BranchNode],
 	stock.ValueEncoder[ExtensionNode],
 	stock.ValueEncoder[ValueNode],
 ) {
+	accounts, branches, extensions, values := getNarrowReferenceEncoder(config)
+	if !config.UseWideNodeReferences {
+		return accounts, branches, extensions, values
+	}
+	// Value nodes do not reference other nodes.
+	return makeWideReferenceAccountEncoder(accounts),
+		makeWideReferenceBranchEncoder(branches),
+		makeWideReferenceExtensionEncoder(extensions),
+		values
+}
+
+// getNarrowReferenceEncoder returns the encoders of the given configuration
+// storing node references using the 6-byte NodeIdEncoder.
+func getNarrowReferenceEncoder(config MptConfig) (
+	stock.ValueEncoder[AccountNode],
+	stock.ValueEncoder[BranchNode],
+	stock.ValueEncoder[ExtensionNode],
+	stock.ValueEncoder[ValueNode],
+) {
+	// Hashed keys are only retained by configurations hashing paths and
+	// tracking suffix lengths, as validated when opening forests.
+	storeHashedKeys := config.StoreHashedKeysInValueNodes && config.TrackSuffixLengthsInLeafNodes
 	switch config.HashStorageLocation {
 	case HashStoredWithParent:
+		if storeHashedKeys {
+			return AccountNodeWithPathLengthEncoderWithChildHash{},
+				getBranchEncoder(config),
+				ExtensionNodeEncoderWithChildHash{},
+				ValueNodeWithPathLengthAndHashedKeyEncoderWithoutNodeHash{}
+		}
 		if config.TrackSuffixLengthsInLeafNodes {
 			return AccountNodeWithPathLengthEncoderWithChildHash{},
-				BranchNodeEncoderWithChildHashes{},
+				getBranchEncoder(config),
 				ExtensionNodeEncoderWithChildHash{},
 				ValueNodeWithPathLengthEncoderWithoutNodeHash{}
 		}
 		return AccountNodeEncoderWithChildHash{},
-			BranchNodeEncoderWithChildHashes{},
+			getBranchEncoder(config),
 			ExtensionNodeEncoderWithChildHash{},
 			ValueNodeEncoderWithoutNodeHash{}
 	case HashStoredWithNode:
+		if storeHashedKeys {
+			return AccountNodeWithPathLengthEncoderWithNodeHash{},
+				getBranchEncoder(config),
+				ExtensionNodeEncoderWithNodeHash{},
+				ValueNodeWithPathLengthAndHashedKeyEncoderWithNodeHash{}
+		}
 		if config.TrackSuffixLengthsInLeafNodes {
 			return AccountNodeWithPathLengthEncoderWithNodeHash{},
-				BranchNodeEncoderWithNodeHash{},
+				getBranchEncoder(config),
 				ExtensionNodeEncoderWithNodeHash{},
 				ValueNodeWithPathLengthEncoderWithNodeHash{}
 		}
 		return AccountNodeEncoderWithNodeHash{},
-			BranchNodeEncoderWithNodeHash{},
+			getBranchEncoder(config),
 			ExtensionNodeEncoderWithNodeHash{},
 			ValueNodeEncoderWithNodeHash{}
 	default:
@@ -1033,6 +2241,21 @@ func getEncoder(config MptConfig) (
 	}
 }
 
+// getBranchEncoder returns the encoder of branch nodes for the given
+// configuration, which is independent of the encoding of other nodes.
+func getBranchEncoder(config MptConfig) stock.ValueEncoder[BranchNode] {
+	if config.HashStorageLocation == HashStoredWithNode {
+		if config.TrackSubtreeLeafCounts {
+			return BranchNodeWithLeafCountEncoderWithNodeHash{}
+		}
+		return BranchNodeEncoderWithNodeHash{}
+	}
+	if config.TrackSubtreeLeafCounts {
+		return BranchNodeWithLeafCountEncoderWithChildHashes{}
+	}
+	return BranchNodeEncoderWithChildHashes{}
+}
+
 type writeBufferSink struct {
 	forest *Forest
 }
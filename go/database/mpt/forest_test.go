@@ -13,15 +13,20 @@ package mpt
 import (
 	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 
 	"github.com/Fantom-foundation/Carmen/go/backend/stock"
 	"github.com/Fantom-foundation/Carmen/go/backend/stock/file"
 	"github.com/Fantom-foundation/Carmen/go/backend/stock/memory"
+	"github.com/Fantom-foundation/Carmen/go/backend/stock/retry"
 	"github.com/Fantom-foundation/Carmen/go/backend/stock/shadow"
 	"github.com/Fantom-foundation/Carmen/go/common"
 	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
@@ -37,6 +42,15 @@ var variants = []variant{
 	{"InMemory", OpenInMemoryForest},
 	{"FileBased", OpenFileForest},
 	{"FileShadow", openFileShadowForest},
+	{"Volatile", openVolatileForest},
+}
+
+// persistentVariants are the variants retaining their content when being
+// closed and re-opened on the same directory.
+var persistentVariants = []variant{
+	{"InMemory", OpenInMemoryForest},
+	{"FileBased", OpenFileForest},
+	{"FileShadow", openFileShadowForest},
 }
 
 var fileAndMemVariants = []variant{
@@ -45,10 +59,11 @@ var fileAndMemVariants = []variant{
 }
 
 var forestConfigs = map[string]ForestConfig{
-	"mutable_1k":     {Mode: Mutable, CacheCapacity: 1024},
-	"mutable_128k":   {Mode: Mutable, CacheCapacity: 128 * 1024},
-	"immutable_1k":   {Mode: Immutable, CacheCapacity: 1024},
-	"immutable_128k": {Mode: Immutable, CacheCapacity: 128 * 1024},
+	"mutable_1k":       {Mode: Mutable, CacheCapacity: 1024},
+	"mutable_128k":     {Mode: Mutable, CacheCapacity: 128 * 1024, crossCheckCachedHashes: true, CheckLeafPathLengths: true},
+	"immutable_1k":     {Mode: Immutable, CacheCapacity: 1024},
+	"immutable_128k":   {Mode: Immutable, CacheCapacity: 128 * 1024, crossCheckCachedHashes: true, CheckLeafPathLengths: true},
+	"mutable_1k_typed": {Mode: Mutable, CacheCapacity: 1024, CacheShares: NodeCacheShares{Accounts: 4, Branches: 4, Extensions: 1, Values: 1}},
 }
 
 func TestForest_Cannot_Open_Corrupted_Stock_Meta(t *testing.T) {
@@ -129,6 +144,120 @@ func TestForest_Cannot_Open_Meta_DoesNot_Match(t *testing.T) {
 	}
 }
 
+func TestForest_NewForestRecordsMptConfig(t *testing.T) {
+	for _, variant := range fileAndMemVariants {
+		for _, config := range allMptConfigs {
+			t.Run(fmt.Sprintf("%s-%s", variant.name, config.Name), func(t *testing.T) {
+				dir := t.TempDir()
+				forest, err := variant.factory(dir, config, ForestConfig{Mode: Immutable, CacheCapacity: 1024})
+				if err != nil {
+					t.Fatalf("failed to open forest: %v", err)
+				}
+				defer forest.Close()
+
+				got, found, err := readMptConfig(dir)
+				if err != nil || !found {
+					t.Fatalf("failed to read recorded config, found: %t, err: %v", found, err)
+				}
+				if got.Name != config.Name || len(getConfigMismatches(config, got)) != 0 {
+					t.Errorf("unexpected recorded config, wanted %v, got %v", config, got)
+				}
+			})
+		}
+	}
+}
+
+func TestForest_Cannot_Open_RecordedMptConfig_DoesNot_Match(t *testing.T) {
+	for _, variant := range fileAndMemVariants {
+		t.Run(variant.name, func(t *testing.T) {
+			dir := t.TempDir()
+			forest, err := variant.factory(dir, S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024})
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+			if err := forest.Close(); err != nil {
+				t.Fatalf("failed to close forest: %v", err)
+			}
+
+			// A config with the same name and node encoding but a different
+			// hashing scheme is rejected.
+			modified := S5LiveConfig
+			modified.Hashing = DirectHashing
+			_, err = variant.factory(dir, modified, ForestConfig{Mode: Mutable, CacheCapacity: 1024})
+			if err == nil || !strings.Contains(err.Error(), "Hashing") {
+				t.Errorf("opening forest should fail with a description of the mismatch, got %v", err)
+			}
+
+			// Forcing the config overrides the check.
+			forest, err = variant.factory(dir, modified, ForestConfig{Mode: Mutable, CacheCapacity: 1024, ForceConfig: true})
+			if err != nil {
+				t.Fatalf("forcing config should succeed, got %v", err)
+			}
+			if err := forest.Close(); err != nil {
+				t.Fatalf("failed to close forest: %v", err)
+			}
+
+			// The recorded config is not changed by forcing a different config.
+			got, found, err := readMptConfig(dir)
+			if err != nil || !found {
+				t.Fatalf("failed to read recorded config, found: %t, err: %v", found, err)
+			}
+			if mismatches := getConfigMismatches(S5LiveConfig, got); len(mismatches) != 0 {
+				t.Errorf("recorded config should not be modified: %v", mismatches)
+			}
+		})
+	}
+}
+
+func TestForest_MptConfigOfLegacyDirectoryIsRecordedOnClose(t *testing.T) {
+	for _, variant := range fileAndMemVariants {
+		t.Run(variant.name, func(t *testing.T) {
+			dir := t.TempDir()
+			meta := "{\"Configuration\":\"S5-Live\",\"Mutable\":true}"
+			if err := os.WriteFile(filepath.Join(dir, "forest.json"), []byte(meta), 0644); err != nil {
+				t.Fatalf("cannot prepare for test: %s", err)
+			}
+
+			forest, err := variant.factory(dir, S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024})
+			if err != nil {
+				t.Fatalf("failed to open legacy forest: %v", err)
+			}
+			if _, found, _ := readMptConfig(dir); found {
+				t.Errorf("config should not be recorded before closing the forest")
+			}
+			if err := forest.Close(); err != nil {
+				t.Fatalf("failed to close forest: %v", err)
+			}
+			got, found, err := readMptConfig(dir)
+			if err != nil || !found {
+				t.Fatalf("config should be recorded on close, found: %t, err: %v", found, err)
+			}
+			if got.Name != S5LiveConfig.Name || len(getConfigMismatches(S5LiveConfig, got)) != 0 {
+				t.Errorf("unexpected recorded config, wanted %v, got %v", S5LiveConfig, got)
+			}
+		})
+	}
+}
+
+func TestForest_MptConfigOfLegacyDirectoryIsNotRecordedWhenForced(t *testing.T) {
+	dir := t.TempDir()
+	meta := "{\"Configuration\":\"S4-Live\",\"Mutable\":true}"
+	if err := os.WriteFile(filepath.Join(dir, "forest.json"), []byte(meta), 0644); err != nil {
+		t.Fatalf("cannot prepare for test: %s", err)
+	}
+
+	forest, err := OpenFileForest(dir, S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024, ForceConfig: true})
+	if err != nil {
+		t.Fatalf("forcing config should succeed, got %v", err)
+	}
+	if err := forest.Close(); err != nil {
+		t.Fatalf("failed to close forest: %v", err)
+	}
+	if _, found, _ := readMptConfig(dir); found {
+		t.Errorf("forced config should not be recorded")
+	}
+}
+
 func TestForest_OpenAndClose(t *testing.T) {
 	for _, variant := range variants {
 		for _, config := range allMptConfigs {
@@ -148,7 +277,7 @@ func TestForest_OpenAndClose(t *testing.T) {
 }
 
 func TestForest_ClosedAndReOpened(t *testing.T) {
-	for _, variant := range variants {
+	for _, variant := range persistentVariants {
 		for _, config := range allMptConfigs {
 			for forestConfigName, forestConfig := range forestConfigs {
 				t.Run(fmt.Sprintf("%s-%s-%s", variant.name, config.Name, forestConfigName), func(t *testing.T) {
@@ -205,6 +334,7 @@ func TestForest_GettingAccountInfo_Fails(t *testing.T) {
 					if err != nil {
 						t.Fatalf("failed to open forest: %v", err)
 					}
+					closeOnCleanup(t, forest)
 
 					// inject failing stock to trigger an error applying the update
 					var injectedErr = errors.New("failed to get value from stock")
@@ -239,6 +369,85 @@ func TestForest_GettingAccountInfo_Fails(t *testing.T) {
 	}
 }
 
+func TestForest_GettingAccountInfo_CorruptedNodesFailOrAreSkipped(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skip=%t", skip), func(t *testing.T) {
+			logger := &recordingLogger{}
+			forest, err := OpenInMemoryForest(t.TempDir(), S5LiveConfig, ForestConfig{
+				Mode:               Mutable,
+				CacheCapacity:      1024,
+				SkipCorruptedNodes: skip,
+				Logger:             logger,
+			})
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+			closeOnCleanup(t, forest)
+
+			// Build a branch node referencing a valid account and an account
+			// which can not be loaded from the stock.
+			valid := common.Address{1}
+			corrupted := common.Address{2}
+			for AddressToNibblePath(valid, forest)[0] == AddressToNibblePath(corrupted, forest)[0] {
+				corrupted[0]++
+			}
+			validRef, handle, err := forest.createAccount()
+			if err != nil {
+				t.Fatalf("failed to create account: %v", err)
+			}
+			account := handle.Get().(*AccountNode)
+			account.address = valid
+			account.info = AccountInfo{Nonce: common.ToNonce(1)}
+			handle.Release()
+
+			root, handle, err := forest.createBranch()
+			if err != nil {
+				t.Fatalf("failed to create branch: %v", err)
+			}
+			branch := handle.Get().(*BranchNode)
+			branch.children[AddressToNibblePath(valid, forest)[0]] = validRef
+			branch.children[AddressToNibblePath(corrupted, forest)[0]] = NewNodeReference(AccountId(123))
+			handle.Release()
+
+			injectedErr := errors.New("failed to decode node")
+			ctrl := gomock.NewController(t)
+			accounts := stock.NewMockStock[uint64, AccountNode](ctrl)
+			accounts.EXPECT().Get(uint64(123)).AnyTimes().Return(AccountNode{}, injectedErr)
+			// the background flusher may write dirty nodes at any time
+			accounts.EXPECT().Set(gomock.Any(), gomock.Any()).AnyTimes()
+			forest.accounts = accounts
+
+			info, found, err := forest.GetAccountInfo(&root, valid)
+			if err != nil || !found || info.Nonce != common.ToNonce(1) {
+				t.Errorf("failed to get valid account: %v, %t, %v", info, found, err)
+			}
+
+			_, found, err = forest.GetAccountInfo(&root, corrupted)
+			if !skip {
+				if !errors.Is(err, injectedErr) {
+					t.Errorf("getting account with corrupted node should fail, got %v", err)
+				}
+				if err := forest.CheckErrors(); !errors.Is(err, injectedErr) {
+					t.Errorf("failure should be recorded, got %v", err)
+				}
+				if len(logger.find("skipped corrupted node")) != 0 {
+					t.Errorf("no nodes should be skipped in fail-fast mode")
+				}
+				return
+			}
+			if err != nil || found {
+				t.Errorf("corrupted node should be treated as missing, got %t, %v", found, err)
+			}
+			if err := forest.CheckErrors(); err != nil {
+				t.Errorf("skipped nodes should not be recorded as errors, got %v", err)
+			}
+			if want, got := 1, len(logger.find("skipped corrupted node")); want != got {
+				t.Errorf("unexpected number of skipped nodes logged, wanted %d, got %d", want, got)
+			}
+		})
+	}
+}
+
 func TestForest_CreatingAccountInfo_Fails(t *testing.T) {
 	for _, variant := range variants {
 		for _, config := range allMptConfigs {
@@ -250,6 +459,7 @@ func TestForest_CreatingAccountInfo_Fails(t *testing.T) {
 					if err != nil {
 						t.Fatalf("failed to open forest: %v", err)
 					}
+					closeOnCleanup(t, forest)
 
 					// inject failing stock to trigger an error applying the update
 					var injectedErr = errors.New("failed to call New")
@@ -289,6 +499,7 @@ func TestForest_setHashesFor_Getting_Node_Fails(t *testing.T) {
 					if err != nil {
 						t.Fatalf("failed to open forest: %v", err)
 					}
+					closeOnCleanup(t, forest)
 
 					// inject failing stock to trigger an error applying the update
 					var injectedErr = errors.New("failed to call Get")
@@ -318,6 +529,7 @@ func TestForest_Freeze_Fails(t *testing.T) {
 				if err != nil {
 					t.Fatalf("failed to open forest: %v", err)
 				}
+				closeOnCleanup(t, forest)
 
 				// inject failing stock to trigger an error applying the update
 				var injectedErr = errors.New("failed to call Get")
@@ -335,6 +547,116 @@ func TestForest_Freeze_Fails(t *testing.T) {
 	}
 }
 
+func TestForest_Freeze_FailedFreezeIsReverted(t *testing.T) {
+	forest, err := OpenInMemoryForest(t.TempDir(), S5ArchiveConfig, ForestConfig{Mode: Immutable, CacheCapacity: 1024})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	defer forest.Close()
+
+	// The first trie is frozen, the second shares some of its nodes.
+	first := NewNodeReference(EmptyId())
+	for i, addr := range getTestAddresses(20) {
+		first, err = forest.SetAccountInfo(&first, addr, AccountInfo{Nonce: common.ToNonce(1)})
+		if err != nil {
+			t.Fatalf("failed to set account: %v", err)
+		}
+		first, err = forest.SetValue(&first, addr, common.Key{byte(i)}, common.Value{1})
+		if err != nil {
+			t.Fatalf("failed to set value: %v", err)
+		}
+	}
+	if _, _, err := forest.updateHashesFor(&first); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+	if err := forest.Freeze(&first); err != nil {
+		t.Fatalf("failed to freeze trie: %v", err)
+	}
+	second := first
+	for i, addr := range getTestAddresses(40)[15:] {
+		second, err = forest.SetValue(&second, addr, common.Key{byte(i)}, common.Value{2})
+		if err != nil {
+			t.Fatalf("failed to set value: %v", err)
+		}
+	}
+	if _, _, err := forest.updateHashesFor(&second); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+	frozenBefore := getFrozenNodes(t, forest, &second)
+
+	// Freezing is retried on the same trie, failing on ever later accesses.
+	injectedErr := errors.New("injected error")
+	for failAt := 0; ; failAt++ {
+		manager := &failingNodeManager{NodeManager: forest, failAt: failAt, err: injectedErr}
+		err := freezeTrie(manager, &second)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, injectedErr) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := forest.CheckAll([]*NodeReference{&first, &second}); err != nil {
+			t.Fatalf("forest is inconsistent after freeze failing at access %d: %v", failAt, err)
+		}
+		if got := getFrozenNodes(t, forest, &second); !maps.Equal(frozenBefore, got) {
+			t.Fatalf("freeze failing at access %d was not reverted, frozen nodes before: %d, after: %d", failAt, len(frozenBefore), len(got))
+		}
+	}
+
+	if err := forest.CheckAll([]*NodeReference{&first, &second}); err != nil {
+		t.Errorf("forest is inconsistent after successful freeze: %v", err)
+	}
+	handle, err := forest.getViewAccess(&second)
+	if err != nil {
+		t.Fatalf("failed to access root: %v", err)
+	}
+	defer handle.Release()
+	if !handle.Get().IsFrozen() {
+		t.Errorf("root should be frozen after successful freeze")
+	}
+}
+
+// getFrozenNodes collects the IDs of all frozen nodes of the given trie.
+func getFrozenNodes(t *testing.T, forest *Forest, root *NodeReference) map[NodeId]bool {
+	t.Helper()
+	res := map[NodeId]bool{}
+	err := forest.VisitTrie(root, MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+		if node.IsFrozen() {
+			res[info.Id] = true
+		}
+		return VisitResponseContinue
+	}))
+	if err != nil {
+		t.Fatalf("failed to visit trie: %v", err)
+	}
+	return res
+}
+
+// failingNodeManager is a NodeManager failing the read or write access with
+// the given index, counted from zero, while all other accesses succeed.
+type failingNodeManager struct {
+	NodeManager
+	failAt   int
+	accesses int
+	err      error
+}
+
+func (m *failingNodeManager) getReadAccess(ref *NodeReference) (shared.ReadHandle[Node], error) {
+	m.accesses++
+	if m.accesses-1 == m.failAt {
+		return shared.ReadHandle[Node]{}, m.err
+	}
+	return m.NodeManager.getReadAccess(ref)
+}
+
+func (m *failingNodeManager) getWriteAccess(ref *NodeReference) (shared.WriteHandle[Node], error) {
+	m.accesses++
+	if m.accesses-1 == m.failAt {
+		return shared.WriteHandle[Node]{}, m.err
+	}
+	return m.NodeManager.getWriteAccess(ref)
+}
+
 func TestForest_CreatingNodes_Fails(t *testing.T) {
 	for _, variant := range variants {
 		for _, config := range allMptConfigs {
@@ -346,6 +668,7 @@ func TestForest_CreatingNodes_Fails(t *testing.T) {
 					if err != nil {
 						t.Fatalf("failed to open forest: %v", err)
 					}
+					closeOnCleanup(t, forest)
 
 					// inject failing stock to trigger an error applying the update
 					var injectedErr = errors.New("failed to call New")
@@ -400,6 +723,7 @@ func TestForest_Cannot_Release_Node(t *testing.T) {
 					if err != nil {
 						t.Fatalf("failed to open forest: %v", err)
 					}
+					closeOnCleanup(t, forest)
 
 					// empty ID cannot be released
 					ref := NewNodeReference(EmptyId())
@@ -423,6 +747,7 @@ func TestForest_Release_Queue_Error_Get_Node(t *testing.T) {
 					if err != nil {
 						t.Fatalf("failed to open forest: %v", err)
 					}
+					closeOnCleanup(t, forest)
 
 					// inject failing stock to trigger an error applying the update
 					var injectedErr = errors.New("failed to call Get")
@@ -454,6 +779,7 @@ func TestForest_Release_Queue_Error_Release_Node(t *testing.T) {
 				if err != nil {
 					t.Fatalf("failed to open forest: %v", err)
 				}
+				closeOnCleanup(t, forest)
 
 				// inject failing stock to trigger an error applying the update
 				var injectedErr = errors.New("failed to call Delete")
@@ -486,6 +812,7 @@ func TestForest_getAccess_Fails(t *testing.T) {
 					if err != nil {
 						t.Fatalf("failed to open forest: %v", err)
 					}
+					closeOnCleanup(t, forest)
 
 					// inject failing stock to trigger an error applying the update
 					var injectedErr = errors.New("failed to call Get")
@@ -538,6 +865,7 @@ func TestForest_getSharedNode_Fails_Get_Copy(t *testing.T) {
 					if err != nil {
 						t.Fatalf("failed to open forest: %v", err)
 					}
+					closeOnCleanup(t, forest)
 
 					// inject failing stock to trigger an error applying the update
 					ctrl := gomock.NewController(t)
@@ -579,6 +907,7 @@ func TestForest_Flush_Fail_MissingCachedNode(t *testing.T) {
 					if err != nil {
 						t.Fatalf("failed to open forest: %v", err)
 					}
+					closeOnCleanup(t, forest)
 
 					// inject failing stock to trigger an error applying the update
 					ctrl := gomock.NewController(t)
@@ -607,6 +936,7 @@ func TestForest_Flush_Fail_CannotReadNode(t *testing.T) {
 					if err != nil {
 						t.Fatalf("failed to open forest: %v", err)
 					}
+					closeOnCleanup(t, forest)
 
 					// inject failing stock to trigger an error applying the update
 					var injectedErr = errors.New("failed to call Set")
@@ -630,6 +960,41 @@ func TestForest_Flush_Fail_CannotReadNode(t *testing.T) {
 	}
 }
 
+func TestForest_Flush_CountsWrittenNodes(t *testing.T) {
+	forest, err := OpenFileForest(t.TempDir(), S5LiveConfig, ForestConfig{CacheCapacity: 1024})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	defer forest.Close()
+
+	root := NewNodeReference(EmptyId())
+	for _, address := range getTestAddresses(10) {
+		root, err = forest.SetAccountInfo(&root, address, AccountInfo{Nonce: common.ToNonce(1)})
+		if err != nil {
+			t.Fatalf("cannot update account: %v", err)
+		}
+	}
+	if got := forest.GetNumberOfWrittenNodes(); got != 0 {
+		t.Errorf("no nodes should be written before flushing, got %d", got)
+	}
+	if _, _, err := forest.updateHashesFor(&root); err != nil {
+		t.Fatalf("cannot update hashes: %v", err)
+	}
+	if err := forest.Flush(); err != nil {
+		t.Fatalf("cannot flush: %v", err)
+	}
+	written := forest.GetNumberOfWrittenNodes()
+	if written < 10 {
+		t.Errorf("at least the nodes of all accounts should be written, got %d", written)
+	}
+	if err := forest.Flush(); err != nil {
+		t.Fatalf("cannot flush: %v", err)
+	}
+	if got := forest.GetNumberOfWrittenNodes(); got != written {
+		t.Errorf("flushing clean nodes should not write any nodes, wanted %d, got %d", written, got)
+	}
+}
+
 func TestForest_Flush_Makes_Node_Clean(t *testing.T) {
 	for _, variant := range fileAndMemVariants {
 		for _, config := range allMptConfigs {
@@ -697,6 +1062,7 @@ func TestForest_flushNode_EmptyId(t *testing.T) {
 					if err != nil {
 						t.Fatalf("failed to open forest: %v", err)
 					}
+					closeOnCleanup(t, forest)
 
 					if err := forest.flushNode(EmptyId(), nil); err != nil {
 						t.Errorf("cannot flush empty node: %s", err)
@@ -718,6 +1084,7 @@ func TestForest_getMutableNodeByPath_CannotReadNode(t *testing.T) {
 					if err != nil {
 						t.Fatalf("failed to open forest: %v", err)
 					}
+					closeOnCleanup(t, forest)
 
 					// inject failing stock to trigger an error applying the update
 					var injectedErr = errors.New("failed to call Get")
@@ -747,6 +1114,7 @@ func TestForest_getMutableNodeByPath_TypeOfNodesReachable(t *testing.T) {
 					if err != nil {
 						t.Fatalf("failed to open forest: %v", err)
 					}
+					closeOnCleanup(t, forest)
 
 					// inject failing stock to trigger an error applying the update
 					ctrl := gomock.NewController(t)
@@ -802,6 +1170,7 @@ func TestForest_Dump(t *testing.T) {
 					if err != nil {
 						t.Fatalf("failed to open forest: %v", err)
 					}
+					closeOnCleanup(t, forest)
 
 					root := NewNodeReference(AccountId(1))
 					forest.Dump(&root) // ok case
@@ -919,6 +1288,80 @@ func TestForest_ValueCanBeSetAndRetrieved(t *testing.T) {
 	}
 }
 
+func TestForest_SetValue_NonExistingAccount_IsNoOp(t *testing.T) {
+	roots := map[string][]common.Address{
+		"empty":     {},
+		"account":   {{0x13}},
+		"branch":    {{0x13}, {0x21}, {0x31}},
+		"extension": {{0x12, 0x31}, {0x12, 0x32}},
+	}
+	for _, variant := range fileAndMemVariants {
+		for _, config := range allMptConfigs {
+			for _, mode := range []StorageMode{Mutable, Immutable} {
+				for name, accounts := range roots {
+					t.Run(fmt.Sprintf("%s-%s-%v-%s", variant.name, config.Name, mode, name), func(t *testing.T) {
+						forest, err := variant.factory(t.TempDir(), config, ForestConfig{Mode: mode, CacheCapacity: 1024})
+						if err != nil {
+							t.Fatalf("failed to open forest: %v", err)
+						}
+						defer forest.Close()
+
+						root := NewNodeReference(EmptyId())
+						for _, addr := range accounts {
+							if root, err = forest.SetAccountInfo(&root, addr, AccountInfo{Nonce: common.Nonce{1}}); err != nil {
+								t.Fatalf("failed to create account: %v", err)
+							}
+							if root, err = forest.SetValue(&root, addr, common.Key{1}, common.Value{1}); err != nil {
+								t.Fatalf("failed to set value: %v", err)
+							}
+						}
+						if mode == Immutable {
+							if err := forest.Freeze(&root); err != nil {
+								t.Fatalf("failed to freeze trie: %v", err)
+							}
+						}
+
+						hash, _, err := forest.updateHashesFor(&root)
+						if err != nil {
+							t.Fatalf("failed to compute hash: %v", err)
+						}
+
+						addr := common.Address{0x12}
+						for _, value := range []common.Value{{}, {1}} {
+							newRoot, err := forest.SetValue(&root, addr, common.Key{1}, value)
+							if err != nil {
+								t.Fatalf("setting a value of a missing account failed: %v", err)
+							}
+							if newRoot != root {
+								t.Errorf("setting a value of a missing account should not change the root, wanted %v, got %v", root, newRoot)
+							}
+
+							got, _, err := forest.updateHashesFor(&root)
+							if err != nil {
+								t.Fatalf("failed to compute hash: %v", err)
+							}
+							if got != hash {
+								t.Errorf("setting a value of a missing account changed the hash, wanted %x, got %x", hash, got)
+							}
+
+							if _, found, err := forest.GetAccountInfo(&root, addr); found || err != nil {
+								t.Errorf("account should not exist, found %t, err %v", found, err)
+							}
+							if value, err := forest.GetValue(&root, addr, common.Key{1}); value != (common.Value{}) || err != nil {
+								t.Errorf("value of missing account should be zero, got %v, err %v", value, err)
+							}
+						}
+
+						if err := forest.Check(&root); err != nil {
+							t.Errorf("inconsistent trie: %v", err)
+						}
+					})
+				}
+			}
+		}
+	}
+}
+
 func TestForest_TreesCanBeHashedAndNavigatedInParallel(t *testing.T) {
 	for _, variant := range variants {
 		for _, config := range allMptConfigs {
@@ -966,6 +1409,156 @@ func TestForest_TreesCanBeHashedAndNavigatedInParallel(t *testing.T) {
 	}
 }
 
+func TestForest_HashObserver_IsInformedAboutAllDirtyNodes(t *testing.T) {
+	for _, variant := range fileAndMemVariants {
+		for _, config := range allMptConfigs {
+			t.Run(fmt.Sprintf("%s-%s", variant.name, config.Name), func(t *testing.T) {
+				observed := map[NodeId]common.Hash{}
+				forestConfig := ForestConfig{Mode: Immutable, CacheCapacity: 1024}
+				forestConfig.HashObserver = func(id NodeId, hash common.Hash) {
+					if _, found := observed[id]; found {
+						t.Errorf("node %v reported multiple times", id)
+					}
+					observed[id] = hash
+				}
+				forest, err := variant.factory(t.TempDir(), config, forestConfig)
+				if err != nil {
+					t.Fatalf("failed to open forest: %v", err)
+				}
+				defer forest.Close()
+
+				reference, err := variant.factory(t.TempDir(), config, ForestConfig{Mode: Immutable, CacheCapacity: 1024})
+				if err != nil {
+					t.Fatalf("failed to open forest: %v", err)
+				}
+				defer reference.Close()
+
+				getDirtyNodes := func(root *NodeReference) map[NodeId]bool {
+					t.Helper()
+					res := map[NodeId]bool{}
+					err := forest.VisitTrie(root, MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+						if _, dirty := node.GetHash(); dirty {
+							res[info.Id] = true
+						}
+						return VisitResponseContinue
+					}))
+					if err != nil {
+						t.Fatalf("failed to visit trie: %v", err)
+					}
+					return res
+				}
+
+				update := func(forest *Forest, root *NodeReference, step int) {
+					t.Helper()
+					for j := 0; j < 20; j++ {
+						addr := common.Address{byte(j)}
+						info := AccountInfo{Nonce: common.ToNonce(uint64(step + 1))}
+						var err error
+						if *root, err = forest.SetAccountInfo(root, addr, info); err != nil {
+							t.Fatalf("failed to set account: %v", err)
+						}
+						if *root, err = forest.SetValue(root, addr, common.Key{byte(step)}, common.Value{byte(step + 1)}); err != nil {
+							t.Fatalf("failed to set value: %v", err)
+						}
+					}
+				}
+
+				root := NewNodeReference(EmptyId())
+				ref := NewNodeReference(EmptyId())
+				for i := 0; i < 3; i++ {
+					update(forest, &root, i)
+					update(reference, &ref, i)
+
+					dirty := getDirtyNodes(&root)
+					if len(dirty) == 0 {
+						t.Fatalf("no dirty nodes in trie")
+					}
+					observed = map[NodeId]common.Hash{}
+
+					hash, _, err := forest.updateHashesFor(&root)
+					if err != nil {
+						t.Fatalf("failed to update hashes: %v", err)
+					}
+
+					if got, want := len(observed), len(dirty); got != want {
+						t.Errorf("unexpected number of observed nodes, wanted %d, got %d", want, got)
+					}
+					for id := range dirty {
+						if _, found := observed[id]; !found {
+							t.Errorf("dirty node %v not observed", id)
+						}
+					}
+
+					want, _, err := reference.updateHashesFor(&ref)
+					if err != nil {
+						t.Fatalf("failed to update hashes: %v", err)
+					}
+					if hash != want {
+						t.Errorf("observer altered root hash, wanted %x, got %x", want, hash)
+					}
+					if got, want := observed[root.Id()], hash; got != want {
+						t.Errorf("unexpected hash reported for root, wanted %x, got %x", want, got)
+					}
+
+					if err := forest.Freeze(&root); err != nil {
+						t.Fatalf("failed to freeze trie: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestForest_HashObserver_CallsAreSerialized(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			active := atomic.Int32{}
+			calls := atomic.Int32{}
+			forestConfig := ForestConfig{Mode: Immutable, CacheCapacity: 1024}
+			forestConfig.HashObserver = func(NodeId, common.Hash) {
+				if active.Add(1) != 1 {
+					t.Errorf("observer called concurrently")
+				}
+				calls.Add(1)
+				active.Add(-1)
+			}
+			forest, err := OpenInMemoryForest(t.TempDir(), config, forestConfig)
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+			defer forest.Close()
+
+			const numTries = 8
+			roots := make([]NodeReference, numTries)
+			for i := range roots {
+				roots[i] = NewNodeReference(EmptyId())
+				for j := 0; j < 50; j++ {
+					addr := common.Address{byte(i), byte(j)}
+					if roots[i], err = forest.SetAccountInfo(&roots[i], addr, AccountInfo{Nonce: common.Nonce{1}}); err != nil {
+						t.Fatalf("failed to set account: %v", err)
+					}
+				}
+			}
+
+			var wg sync.WaitGroup
+			wg.Add(numTries)
+			for i := range roots {
+				go func(root *NodeReference) {
+					defer wg.Done()
+					if _, _, err := forest.updateHashesFor(root); err != nil {
+						t.Errorf("failed to update hashes: %v", err)
+					}
+				}(&roots[i])
+			}
+			wg.Wait()
+
+			if calls.Load() == 0 {
+				t.Errorf("observer was not called")
+			}
+		})
+	}
+}
+
 func TestForest_InLiveModeHistoryIsOverridden(t *testing.T) {
 	for _, variant := range variants {
 		for _, config := range allMptConfigs {
@@ -1068,16 +1661,148 @@ func TestForest_InArchiveModeHistoryIsPreserved(t *testing.T) {
 	}
 }
 
-func TestForest_ProvidesMemoryFoodPrint(t *testing.T) {
+func TestForest_FreezingIsSafeUnderConcurrentReads(t *testing.T) {
 	for _, variant := range variants {
-		for _, config := range allMptConfigs {
-			for forestConfigName, forestConfig := range forestConfigs {
-				t.Run(fmt.Sprintf("%s-%s-%s", variant.name, config.Name, forestConfigName), func(t *testing.T) {
-					forest, err := variant.factory(t.TempDir(), config, forestConfig)
+		for _, config := range []MptConfig{S4ArchiveConfig, S5ArchiveConfig} {
+			t.Run(fmt.Sprintf("%s-%s", variant.name, config.Name), func(t *testing.T) {
+				const N = 64
+				forest, err := variant.factory(t.TempDir(), config, ForestConfig{Mode: Immutable, CacheCapacity: 1024})
+				if err != nil {
+					t.Fatalf("failed to open forest: %v", err)
+				}
+
+				root := NewNodeReference(EmptyId())
+				for i := 0; i < N; i++ {
+					addr := common.Address{byte(i)}
+					root, err = forest.SetAccountInfo(&root, addr, AccountInfo{Nonce: common.ToNonce(uint64(i + 1))})
 					if err != nil {
-						t.Fatalf("failed to open forest: %v", err)
+						t.Fatalf("failed to insert account %d: %v", i, err)
 					}
-					defer forest.Close()
+					root, err = forest.SetValue(&root, addr, common.Key{byte(i)}, common.Value{byte(i + 1)})
+					if err != nil {
+						t.Fatalf("failed to set value of account %d: %v", i, err)
+					}
+				}
+				if _, _, err := forest.updateHashesFor(&root); err != nil {
+					t.Fatalf("failed to update hashes: %v", err)
+				}
+
+				// Read the trie concurrently while it is frozen.
+				const numReaders = 4
+				var done atomic.Bool
+				var errs [numReaders]error
+				var wg sync.WaitGroup
+				wg.Add(numReaders)
+				for r := 0; r < numReaders; r++ {
+					go func(r int) {
+						defer wg.Done()
+						for finished := false; !finished; {
+							finished = done.Load()
+							for i := 0; i < N; i++ {
+								addr := common.Address{byte(i)}
+								info, _, err := forest.GetAccountInfo(&root, addr)
+								if err == nil && info.Nonce.ToUint64() != uint64(i+1) {
+									err = fmt.Errorf("unexpected nonce for account %d: %v", i, info.Nonce)
+								}
+								if err != nil {
+									errs[r] = err
+									return
+								}
+							}
+							if err := checkNoHalfFrozenNodes(forest, &root); err != nil {
+								errs[r] = err
+								return
+							}
+						}
+					}(r)
+				}
+
+				if err := forest.Freeze(&root); err != nil {
+					t.Errorf("failed to freeze trie: %v", err)
+				}
+				done.Store(true)
+				wg.Wait()
+
+				for r, err := range errs {
+					if err != nil {
+						t.Errorf("error in reader %d: %v", r, err)
+					}
+				}
+
+				handle, err := forest.getReadAccess(&root)
+				if err != nil {
+					t.Fatalf("failed to access root: %v", err)
+				}
+				if !handle.Get().IsFrozen() {
+					t.Errorf("root should be frozen")
+				}
+				handle.Release()
+
+				if err := forest.Close(); err != nil {
+					t.Fatalf("failed to close forest: %v", err)
+				}
+			})
+		}
+	}
+}
+
+// checkNoHalfFrozenNodes checks that no node in the given trie is marked
+// frozen while having non-frozen children or child flags.
+func checkNoHalfFrozenNodes(forest *Forest, ref *NodeReference) error {
+	handle, err := forest.getReadAccess(ref)
+	if err != nil {
+		return err
+	}
+	defer handle.Release()
+	node := handle.Get()
+
+	children := []NodeReference{}
+	switch n := node.(type) {
+	case *BranchNode:
+		for i, child := range n.children {
+			if child.Id().IsEmpty() {
+				continue
+			}
+			if n.IsFrozen() && !n.isChildFrozen(byte(i)) {
+				return fmt.Errorf("frozen branch node %v has non-frozen child flag %d", ref.Id(), i)
+			}
+			children = append(children, child)
+		}
+	case *ExtensionNode:
+		children = append(children, n.next)
+	case *AccountNode:
+		if !n.storage.Id().IsEmpty() {
+			children = append(children, n.storage)
+		}
+	}
+
+	for i := range children {
+		child, err := forest.getReadAccess(&children[i])
+		if err != nil {
+			return err
+		}
+		childIsFrozen := child.Get().IsFrozen()
+		child.Release()
+		if node.IsFrozen() && !childIsFrozen {
+			return fmt.Errorf("frozen node %v has non-frozen child %v", ref.Id(), children[i].Id())
+		}
+		if err := checkNoHalfFrozenNodes(forest, &children[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestForest_ProvidesMemoryFoodPrint(t *testing.T) {
+	for _, variant := range variants {
+		for _, config := range allMptConfigs {
+			for forestConfigName, forestConfig := range forestConfigs {
+				t.Run(fmt.Sprintf("%s-%s-%s", variant.name, config.Name, forestConfigName), func(t *testing.T) {
+					forest, err := variant.factory(t.TempDir(), config, forestConfig)
+					if err != nil {
+						t.Fatalf("failed to open forest: %v", err)
+					}
+					defer forest.Close()
 
 					footprint := forest.GetMemoryFootprint()
 					if footprint.Total() <= uintptr(0) {
@@ -1458,6 +2183,72 @@ func openFileShadowForest(directory string, mptConfig MptConfig, forestConfig Fo
 	return makeForest(mptConfig, directory, branches, extensions, accounts, values, forestConfig)
 }
 
+// openVolatileForest adapts OpenVolatileForest to the factory signature of
+// forest variants. The directory is ignored.
+func openVolatileForest(_ string, mptConfig MptConfig, forestConfig ForestConfig) (*Forest, error) {
+	return OpenVolatileForest(mptConfig, forestConfig)
+}
+
+// closeOnCleanup closes the given forest once the test is done. Components
+// replaced by mocks to inject failures are restored before, since forests
+// using them could not be closed. Otherwise, the forests of such tests would
+// retain their caches and background workers for the rest of the test run.
+// Modified nodes are not flushed, since they may be inconsistent with the
+// restored components.
+func closeOnCleanup(t *testing.T, forest *Forest) {
+	t.Helper()
+	accounts, branches, extensions, values := forest.accounts, forest.branches, forest.extensions, forest.values
+	nodeCache, writeBuffer := forest.nodeCache, forest.writeBuffer
+	t.Cleanup(func() {
+		forest.accounts, forest.branches, forest.extensions, forest.values = accounts, branches, extensions, values
+		forest.nodeCache, forest.writeBuffer = nodeCache, writeBuffer
+		if err := forest.closeWithoutFlush(); err != nil {
+			t.Logf("failed to close forest: %v", err)
+		}
+	})
+}
+
+// closeMockedOnCleanup closes the given forest based on the given mocked
+// stocks once the test is done. Closing the stocks is permitted for this.
+func closeMockedOnCleanup(
+	t *testing.T,
+	forest *Forest,
+	branches *stock.MockStock[uint64, BranchNode],
+	extensions *stock.MockStock[uint64, ExtensionNode],
+	accounts *stock.MockStock[uint64, AccountNode],
+	values *stock.MockStock[uint64, ValueNode],
+) {
+	t.Helper()
+	branches.EXPECT().Close().AnyTimes()
+	extensions.EXPECT().Close().AnyTimes()
+	accounts.EXPECT().Close().AnyTimes()
+	values.EXPECT().Close().AnyTimes()
+	closeOnCleanup(t, forest)
+}
+
+func TestForest_CloseWithoutFlushDoesNotWriteNodesToStocks(t *testing.T) {
+	forest, err := OpenVolatileForest(S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	ctrl := gomock.NewController(t)
+	accounts := stock.NewMockStock[uint64, AccountNode](ctrl)
+	accounts.EXPECT().New().Return(uint64(0), nil)
+	accounts.EXPECT().Close()
+	forest.accounts = accounts
+
+	root := NewNodeReference(EmptyId())
+	if _, err := forest.SetAccountInfo(&root, common.Address{1}, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+		t.Fatalf("failed to set account: %v", err)
+	}
+	if err := forest.closeWithoutFlush(); err != nil {
+		t.Fatalf("failed to close forest: %v", err)
+	}
+	if err := forest.closeWithoutFlush(); !errors.Is(err, forestClosedErr) {
+		t.Errorf("closing a closed forest should fail, got %v", err)
+	}
+}
+
 func TestForest_NodeHandlingDoesNotDeadlock(t *testing.T) {
 	// This test used to trigger a bug leading to a deadlock as reported in
 	// https://github.com/Fantom-foundation/Carmen/issues/724
@@ -1631,6 +2422,60 @@ func TestForest_ReadForestMetadata_Fails(t *testing.T) {
 	}
 }
 
+func TestForest_ReadRetryPolicy_TransientStockErrorsAreRetried(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	branches := stock.NewMockStock[uint64, BranchNode](ctrl)
+	extensions := stock.NewMockStock[uint64, ExtensionNode](ctrl)
+	accounts := stock.NewMockStock[uint64, AccountNode](ctrl)
+	values := stock.NewMockStock[uint64, ValueNode](ctrl)
+
+	branches.EXPECT().Flush()
+	branches.EXPECT().Close()
+	extensions.EXPECT().Flush()
+	extensions.EXPECT().Close()
+	accounts.EXPECT().Flush()
+	accounts.EXPECT().Close()
+	values.EXPECT().Flush()
+	values.EXPECT().Close()
+
+	forest, err := makeForest(
+		MptConfig{Hashing: DirectHashing},
+		t.TempDir(),
+		branches,
+		extensions,
+		accounts,
+		values,
+		ForestConfig{
+			CacheCapacity:   1024,
+			ReadRetryPolicy: retry.Policy{Attempts: 3},
+		},
+	)
+	if err != nil {
+		t.Fatalf("failed to create test forest: %v", err)
+	}
+
+	addr := common.Address{1}
+	info := AccountInfo{Nonce: common.Nonce{1}}
+	gomock.InOrder(
+		accounts.EXPECT().Get(uint64(7)).Return(AccountNode{}, syscall.EAGAIN),
+		accounts.EXPECT().Get(uint64(7)).Return(AccountNode{}, syscall.ETIMEDOUT),
+		accounts.EXPECT().Get(uint64(7)).Return(AccountNode{address: addr, info: info}, nil),
+	)
+
+	root := NewNodeReference(AccountId(7))
+	got, found, err := forest.GetAccountInfo(&root, addr)
+	if err != nil {
+		t.Fatalf("failed to read account: %v", err)
+	}
+	if !found || got != info {
+		t.Errorf("unexpected account info, wanted %v, got %v", info, got)
+	}
+
+	if err := forest.Close(); err != nil {
+		t.Fatalf("failed to close forest: %v", err)
+	}
+}
+
 func TestForest_ErrorsAreForwardedAndCollected(t *testing.T) {
 	type mocks struct {
 		branches   *stock.MockStock[uint64, BranchNode]
@@ -1811,6 +2656,7 @@ func TestForest_ErrorsAreForwardedAndCollected(t *testing.T) {
 			if err != nil {
 				t.Fatalf("failed to create test forest: %v", err)
 			}
+			closeMockedOnCleanup(t, forest, branches, extensions, accounts, values)
 
 			test.setExpectations(&mocks{branches, extensions, accounts, values})
 			err = test.runOperation(forest)
@@ -1850,6 +2696,7 @@ func TestForest_MultipleErrorsCanBeCollected(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to create test forest: %v", err)
 	}
+	closeMockedOnCleanup(t, forest, branches, extensions, accounts, values)
 
 	gomock.InOrder(
 		branches.EXPECT().Get(gomock.Any()).Return(BranchNode{}, injectedErrorA),
@@ -2270,6 +3117,109 @@ func TestForest_HasEmptyStorage(t *testing.T) {
 	}
 }
 
+func TestForest_HasAccount(t *testing.T) {
+	addresses := getTestAddresses(50)
+	present, absent := addresses[:25], addresses[25:]
+
+	for _, variant := range variants {
+		for _, config := range allMptConfigs {
+			t.Run(fmt.Sprintf("%s-%s", variant.name, config.Name), func(t *testing.T) {
+				forest, err := variant.factory(t.TempDir(), config, forestConfigs["mutable_1k"])
+				if err != nil {
+					t.Fatalf("failed to open forest: %v", err)
+				}
+				defer func() {
+					if err := forest.Close(); err != nil {
+						t.Fatalf("cannot close db: %v", err)
+					}
+				}()
+
+				root := NewNodeReference(EmptyId())
+				check := func(addresses []common.Address, want bool) {
+					t.Helper()
+					for _, address := range addresses {
+						exists, err := forest.HasAccount(&root, address)
+						if err != nil {
+							t.Fatalf("unexpected error: %v", err)
+						}
+						if exists != want {
+							t.Errorf("unexpected existence of account %x: got %v, want %v", address, exists, want)
+						}
+						if _, found, err := forest.GetAccountInfo(&root, address); err != nil || found != exists {
+							t.Errorf("inconsistent existence of account %x: HasAccount %v, GetAccountInfo %v, err %v", address, exists, found, err)
+						}
+					}
+				}
+
+				// no accounts in an empty trie
+				check(addresses, false)
+
+				// with a single account, the search for any other account ends at
+				// the leaf of the present account, sharing a (possibly empty) prefix
+				root, err = forest.SetAccountInfo(&root, present[0], AccountInfo{Nonce: common.ToNonce(1)})
+				if err != nil {
+					t.Fatalf("cannot update account: %v", err)
+				}
+				check(present[:1], true)
+				check(present[1:], false)
+				check(absent, false)
+
+				for _, address := range present {
+					root, err = forest.SetAccountInfo(&root, address, AccountInfo{Nonce: common.ToNonce(1)})
+					if err != nil {
+						t.Fatalf("cannot update account: %v", err)
+					}
+				}
+				check(present, true)
+				check(absent, false)
+
+				// deleted accounts are no longer present
+				for _, address := range present[:10] {
+					root, err = forest.SetAccountInfo(&root, address, AccountInfo{})
+					if err != nil {
+						t.Fatalf("cannot delete account: %v", err)
+					}
+				}
+				check(present[:10], false)
+				check(present[10:], true)
+
+				if _, _, err := forest.updateHashesFor(&root); err != nil {
+					t.Fatalf("cannot update hashes: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestForest_HasAccount_AccountsSharingPathPrefixAreDistinguished(t *testing.T) {
+	// Without hashed paths, the addresses below share the first 39 nibbles
+	// of their paths and end up in leaves of a branch at the deepest level.
+	first := common.Address{}
+	second := common.Address{19: 0x01}
+	third := common.Address{19: 0x02}
+	forest, err := OpenInMemoryForest(t.TempDir(), S4LiveConfig, forestConfigs["mutable_1k"])
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	defer forest.Close()
+
+	root := NewNodeReference(EmptyId())
+	for _, address := range []common.Address{first, second} {
+		root, err = forest.SetAccountInfo(&root, address, AccountInfo{Nonce: common.ToNonce(1)})
+		if err != nil {
+			t.Fatalf("cannot update account: %v", err)
+		}
+	}
+	for address, want := range map[common.Address]bool{first: true, second: true, third: false} {
+		if got, err := forest.HasAccount(&root, address); err != nil || got != want {
+			t.Errorf("unexpected existence of account %x: got %v, want %v, err %v", address, got, want, err)
+		}
+	}
+	if _, _, err := forest.updateHashesFor(&root); err != nil {
+		t.Fatalf("cannot update hashes: %v", err)
+	}
+}
+
 // testVisitPathToStorage iterates over the keys and checks if the value nodes are correct.
 func testVisitPathToStorage(t *testing.T, forest *Forest, keys []common.Key, storageRoot NodeReference) {
 	var lastNode Node
@@ -2295,3 +3245,330 @@ func testVisitPathToStorage(t *testing.T, forest *Forest, keys []common.Key, sto
 		}
 	}
 }
+
+func TestForest_InspectReferences_ReportsHandlesAndFlags(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			forest, err := OpenInMemoryForest(t.TempDir(), config, ForestConfig{Mode: Immutable, CacheCapacity: 1024})
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+			defer forest.Close()
+
+			root := NewNodeReference(EmptyId())
+			root, err = forest.SetAccountInfo(&root, common.Address{1}, AccountInfo{Nonce: common.ToNonce(1)})
+			if err != nil {
+				t.Fatalf("failed to set account: %v", err)
+			}
+
+			type inspection struct {
+				refCount      int
+				frozen, dirty bool
+			}
+			inspect := func() inspection {
+				refCount, frozen, dirty := forest.InspectReferences(root.Id())
+				return inspection{refCount, frozen, dirty}
+			}
+
+			if want, got := (inspection{0, false, true}), inspect(); want != got {
+				t.Errorf("unexpected inspection result, wanted %v, got %v", want, got)
+			}
+
+			view1, err := forest.getViewAccess(&root)
+			if err != nil {
+				t.Fatalf("failed to get view access: %v", err)
+			}
+			view2, err := forest.getViewAccess(&root)
+			if err != nil {
+				t.Fatalf("failed to get view access: %v", err)
+			}
+			if want, got := (inspection{2, false, true}), inspect(); want != got {
+				t.Errorf("unexpected inspection result, wanted %v, got %v", want, got)
+			}
+			view1.Release()
+			view2.Release()
+
+			// Nodes locked for writing report handles only.
+			write, err := forest.getWriteAccess(&root)
+			if err != nil {
+				t.Fatalf("failed to get write access: %v", err)
+			}
+			if want, got := (inspection{1, false, false}), inspect(); want != got {
+				t.Errorf("unexpected inspection result, wanted %v, got %v", want, got)
+			}
+			write.Release()
+
+			if err := forest.Freeze(&root); err != nil {
+				t.Fatalf("failed to freeze trie: %v", err)
+			}
+			if _, _, err := forest.updateHashesFor(&root); err != nil {
+				t.Fatalf("failed to update hashes: %v", err)
+			}
+			if err := forest.Flush(); err != nil {
+				t.Fatalf("failed to flush forest: %v", err)
+			}
+			if want, got := (inspection{0, true, false}), inspect(); want != got {
+				t.Errorf("unexpected inspection result, wanted %v, got %v", want, got)
+			}
+
+			missing := NewNodeReference(ValueId(1 << 40))
+			if refCount, frozen, dirty := forest.InspectReferences(missing.Id()); refCount != 0 || frozen || dirty {
+				t.Errorf("unexpected inspection result for missing node: %d, %t, %t", refCount, frozen, dirty)
+			}
+		})
+	}
+}
+
+func TestForest_DumpPinnedNodes_PinnedSetReturnsToEmptyAfterRelease(t *testing.T) {
+	for _, variant := range fileAndMemVariants {
+		for _, config := range allMptConfigs {
+			t.Run(fmt.Sprintf("%s-%s", variant.name, config.Name), func(t *testing.T) {
+				forest, err := variant.factory(t.TempDir(), config, ForestConfig{Mode: Mutable, CacheCapacity: 1024})
+				if err != nil {
+					t.Fatalf("failed to open forest: %v", err)
+				}
+				defer forest.Close()
+
+				getPinnedNodes := func() string {
+					var out strings.Builder
+					forest.DumpPinnedNodes(&out)
+					return out.String()
+				}
+
+				// Regular operations do not leave nodes pinned.
+				root := NewNodeReference(EmptyId())
+				for i := 0; i < 50; i++ {
+					address := common.Address{byte(i)}
+					root, err = forest.SetAccountInfo(&root, address, AccountInfo{Nonce: common.ToNonce(1)})
+					if err != nil {
+						t.Fatalf("failed to set account: %v", err)
+					}
+					root, err = forest.SetValue(&root, address, common.Key{byte(i)}, common.Value{1})
+					if err != nil {
+						t.Fatalf("failed to set value: %v", err)
+					}
+				}
+				if _, err := forest.getSlotHandle(&root, common.Address{1}, common.Key{1}); err != nil {
+					t.Fatalf("failed to get slot handle: %v", err)
+				}
+				root, err = forest.ClearStorage(&root, common.Address{2})
+				if err != nil {
+					t.Fatalf("failed to clear storage: %v", err)
+				}
+				if _, _, err := forest.updateHashesFor(&root); err != nil {
+					t.Fatalf("failed to update hashes: %v", err)
+				}
+				if err := forest.Flush(); err != nil {
+					t.Fatalf("failed to flush forest: %v", err)
+				}
+				if pinned := getPinnedNodes(); pinned != "" {
+					t.Fatalf("nodes pinned after regular operations:\n%s", pinned)
+				}
+
+				// Take handles on all nodes of the trie, similar to a snapshot.
+				var handles []shared.ViewHandle[Node]
+				err = forest.VisitTrie(&root, MakeVisitor(func(_ Node, info NodeInfo) VisitResponse {
+					ref := NewNodeReference(info.Id)
+					handle, err := forest.getViewAccess(&ref)
+					if err != nil {
+						t.Fatalf("failed to get view access: %v", err)
+					}
+					handles = append(handles, handle)
+					return VisitResponseContinue
+				}))
+				if err != nil {
+					t.Fatalf("failed to visit trie: %v", err)
+				}
+
+				pinned := getPinnedNodes()
+				if got, want := strings.Count(pinned, "\n"), len(handles); got != want {
+					t.Errorf("unexpected number of pinned nodes, wanted %d, got %d:\n%s", want, got, pinned)
+				}
+				rootLine := fmt.Sprintf("%v: handles=1, frozen=false, dirty=false\n", root.Id())
+				if !strings.Contains(pinned, rootLine) {
+					t.Errorf("missing root %v in pinned nodes:\n%s", root.Id(), pinned)
+				}
+
+				for i := range handles {
+					handles[i].Release()
+				}
+				if pinned := getPinnedNodes(); pinned != "" {
+					t.Errorf("nodes pinned after releasing all handles:\n%s", pinned)
+				}
+			})
+		}
+	}
+}
+
+func TestForest_VolatileForestCanNotTrackStorageWeights(t *testing.T) {
+	_, err := OpenVolatileForest(S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024, TrackStorageWeights: true})
+	if err == nil {
+		t.Errorf("tracking storage weights should not be supported")
+	}
+}
+
+func TestForest_PinnedLevelsAreNeverEvicted(t *testing.T) {
+	const Capacity = 200
+	for _, variant := range fileAndMemVariants {
+		t.Run(variant.name, func(t *testing.T) {
+			forest, err := variant.factory(t.TempDir(), S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: Capacity, PinnedLevels: 2})
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+			defer forest.Close()
+
+			root := NewNodeReference(EmptyId())
+			addresses := getTestAddresses(1000)
+			for i, addr := range addresses {
+				root, err = forest.SetAccountInfo(&root, addr, AccountInfo{Nonce: common.ToNonce(1)})
+				if err != nil {
+					t.Fatalf("failed to set account: %v", err)
+				}
+				// Nodes with outdated hashes can not be written to disk, so
+				// hashes are refreshed before the cache runs out of space.
+				if i%20 == 19 {
+					if _, _, err := forest.updateHashesFor(&root); err != nil {
+						t.Fatalf("failed to update hashes: %v", err)
+					}
+				}
+			}
+			if _, _, err := forest.updateHashesFor(&root); err != nil {
+				t.Fatalf("failed to update hashes: %v", err)
+			}
+
+			// The root and its 16 children are pinned.
+			pinned := slices.Clone(forest.pinnedNodes)
+			if want, got := 17, len(pinned); want != got {
+				t.Fatalf("unexpected number of pinned nodes, wanted %d, got %d", want, got)
+			}
+			if pinned[0] != root.Id() {
+				t.Errorf("root node should be pinned")
+			}
+
+			// Accessing all accounts puts the cache under pressure.
+			for _, addr := range addresses {
+				if _, _, err := forest.GetAccountInfo(&root, addr); err != nil {
+					t.Fatalf("failed to get account: %v", err)
+				}
+			}
+
+			for _, id := range pinned {
+				ref := NewNodeReference(id)
+				if _, found := forest.nodeCache.Get(&ref); !found {
+					t.Errorf("pinned node %v got evicted", id)
+				}
+			}
+			evicted := 0
+			for i := 0; i < len(addresses) && evicted == 0; i++ {
+				ref := NewNodeReference(AccountId(uint64(i)))
+				if _, found := forest.nodeCache.Get(&ref); !found {
+					evicted++
+				}
+			}
+			if evicted == 0 {
+				t.Errorf("lower levels should be evicted")
+			}
+		})
+	}
+}
+
+func TestForest_NodeIdsBeyondCapacityAreRefused(t *testing.T) {
+	for _, config := range []MptConfig{S5LiveConfig, S5LiveWideReferencesConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			branches := stock.NewMockStock[uint64, BranchNode](ctrl)
+			extensions := stock.NewMockStock[uint64, ExtensionNode](ctrl)
+			accounts := stock.NewMockStock[uint64, AccountNode](ctrl)
+			values := stock.NewMockStock[uint64, ValueNode](ctrl)
+
+			forest, err := makeForest(config, t.TempDir(), branches, extensions, accounts, values, ForestConfig{})
+			if err != nil {
+				t.Fatalf("failed to create test forest: %v", err)
+			}
+			closeMockedOnCleanup(t, forest, branches, extensions, accounts, values)
+
+			capacity := getIdSpaceCapacity(getNodeIdEncoder(config).GetEncodedSize())
+			accounts.EXPECT().New().Return(capacity.Accounts, nil)
+			accounts.EXPECT().Delete(capacity.Accounts)
+
+			root := NewNodeReference(EmptyId())
+			_, err = forest.SetAccountInfo(&root, common.Address{}, AccountInfo{Nonce: common.ToNonce(1)})
+			if !errors.Is(err, stock.ErrIdSpaceExhausted) {
+				t.Errorf("exhaustion of ID space should be reported, got %v", err)
+			}
+		})
+	}
+}
+
+func TestForest_GetIdSpaceUsage_ReportsAllocatedIdsAndCapacity(t *testing.T) {
+	for _, config := range []MptConfig{S5LiveConfig, S5LiveWideReferencesConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			forest, err := OpenInMemoryForest(t.TempDir(), config, ForestConfig{Mode: Mutable, CacheCapacity: 1024})
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+			defer forest.Close()
+
+			root := NewNodeReference(EmptyId())
+			for i := 0; i < 10; i++ {
+				root, err = forest.SetAccountInfo(&root, common.Address{byte(i)}, AccountInfo{Nonce: common.ToNonce(1)})
+				if err != nil {
+					t.Fatalf("failed to create account: %v", err)
+				}
+			}
+
+			if _, _, err := forest.updateHashesFor(&root); err != nil {
+				t.Fatalf("failed to update hashes: %v", err)
+			}
+
+			usage, err := forest.GetIdSpaceUsage()
+			if err != nil {
+				t.Fatalf("failed to get ID space usage: %v", err)
+			}
+			if want, got := uint64(10), usage.Used.Accounts; want != got {
+				t.Errorf("unexpected number of used account IDs, wanted %d, got %d", want, got)
+			}
+			if want, got := getIdSpaceCapacity(getNodeIdEncoder(config).GetEncodedSize()), usage.Capacity; want != got {
+				t.Errorf("unexpected capacity, wanted %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func BenchmarkForest_LookupsInCachedTrie(b *testing.B) {
+	const numAccounts = 1000
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		b.Run(config.Name, func(b *testing.B) {
+			forest, err := OpenVolatileForest(config, ForestConfig{Mode: Mutable, CacheCapacity: 10 * numAccounts})
+			if err != nil {
+				b.Fatalf("failed to open forest: %v", err)
+			}
+			defer forest.Close()
+
+			root := NewNodeReference(EmptyId())
+			for i := 0; i < numAccounts; i++ {
+				addr := common.Address{byte(i), byte(i >> 8)}
+				if root, err = forest.SetAccountInfo(&root, addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+					b.Fatalf("failed to create account: %v", err)
+				}
+				if root, err = forest.SetValue(&root, addr, common.Key{byte(i)}, common.Value{1}); err != nil {
+					b.Fatalf("failed to set value: %v", err)
+				}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				j := i % numAccounts
+				addr := common.Address{byte(j), byte(j >> 8)}
+				if _, _, err := forest.GetAccountInfo(&root, addr); err != nil {
+					b.Fatalf("failed to get account: %v", err)
+				}
+				if _, err := forest.GetValue(&root, addr, common.Key{byte(j)}); err != nil {
+					b.Fatalf("failed to get value: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
+)
+
+// forkableDatabase is implemented by databases supporting the sharing of
+// the nodes of LiveDB tries with forks of those tries.
+type forkableDatabase interface {
+	// openFork freezes the trie rooted by the given node such that it can be
+	// shared copy-on-write by the trie it belongs to and a new fork.
+	openFork(root *NodeReference) error
+	// closeFork releases the nodes exclusively owned by the fork with the
+	// given root. Once the last fork is closed, shared nodes no longer used
+	// by the trie with the given origin root the forks were created from are
+	// released, and the remaining ones become mutable again.
+	closeFork(root NodeReference, origin NodeReference) error
+}
+
+// forkedNode records a node frozen for being shared by a LiveDB trie and its
+// forks. Tries are frozen lazily: the children of a forked node are only
+// frozen once the node is accessed for being modified, such that only the
+// paths modified while forks are open get frozen.
+type forkedNode struct {
+	frozenNode
+	// Set once all children of the node are frozen as well.
+	childrenFrozen bool
+	// Set if the node was created while forks were open, in which case its
+	// descendants may be forked nodes even if its children are not frozen.
+	createdWhileForked bool
+}
+
+// openFork freezes the trie rooted by the given node for being shared by a
+// fork. In archives, all nodes are frozen anyway. In LiveDBs, only the root is
+// frozen, while its descendants are frozen lazily when their parents are
+// modified. Frozen flags are not persisted, so the IDs of frozen nodes are
+// recorded for being frozen again when being reloaded.
+func (s *Forest) openFork(root *NodeReference) error {
+	handle, err := s.getUnexpandedWriteAccess(root)
+	if err != nil {
+		return fmt.Errorf("failed to freeze trie rooted by %v: %w", root.Id(), err)
+	}
+	defer handle.Release()
+
+	s.forkMutex.Lock()
+	defer s.forkMutex.Unlock()
+	if node := handle.Get(); !node.IsFrozen() {
+		// While forks are open, the mutable root of a trie has been created
+		// by an update of the trie since the first fork.
+		s.freezeForkedNode(root, node, s.numForks > 0)
+	}
+	s.numForks++
+	return nil
+}
+
+// freezeForkedNode freezes the given node without its children and records it
+// as being shared by forks. The forkMutex needs to be held by the caller.
+func (s *Forest) freezeForkedNode(ref *NodeReference, node Node, createdWhileForked bool) {
+	record := forkedNode{
+		frozenNode:         frozenNode{ref: *ref},
+		createdWhileForked: createdWhileForked,
+	}
+	if branch, ok := node.(*BranchNode); ok {
+		record.frozenChildren = branch.frozenChildren
+	}
+	markFrozenWithoutChildren(node)
+	if s.forkedNodes == nil {
+		s.forkedNodes = map[NodeId]forkedNode{}
+	}
+	s.forkedNodes[ref.Id()] = record
+	s.hasForkedNodes.Store(true)
+}
+
+// freezeForkedChildren freezes the children of the given node before it gets
+// accessed for being modified, if it is a forked node whose children are not
+// frozen yet. This way, the children are shared by the node and its copies.
+func (s *Forest) freezeForkedChildren(ref *NodeReference, node Node) error {
+	s.forkMutex.Lock()
+	record, found := s.forkedNodes[ref.Id()]
+	open := s.numForks > 0
+	s.forkMutex.Unlock()
+	if !found || !open || record.childrenFrozen {
+		return nil
+	}
+
+	for _, childRef := range appendChildren(nil, node) {
+		handle, err := s.getUnexpandedWriteAccess(&childRef)
+		if err != nil {
+			return fmt.Errorf("failed to freeze child %v of node %v: %w", childRef.Id(), ref.Id(), err)
+		}
+		if child := handle.Get(); !child.IsFrozen() {
+			s.forkMutex.Lock()
+			// Mutable children of nodes created while forks are open have
+			// been created while forks are open as well.
+			s.freezeForkedNode(&childRef, child, record.createdWhileForked)
+			s.forkMutex.Unlock()
+		}
+		handle.Release()
+	}
+
+	node.MarkFrozen()
+	record.childrenFrozen = true
+	s.forkMutex.Lock()
+	s.forkedNodes[ref.Id()] = record
+	s.forkMutex.Unlock()
+	return nil
+}
+
+// refreezeForkedNode freezes the given node loaded from a stock again if it is
+// recorded as being shared by forks.
+func (s *Forest) refreezeForkedNode(id NodeId, node Node) {
+	if !s.hasForkedNodes.Load() {
+		return
+	}
+	s.forkMutex.Lock()
+	record, found := s.forkedNodes[id]
+	s.forkMutex.Unlock()
+	if !found {
+		return
+	}
+	if record.childrenFrozen {
+		node.MarkFrozen()
+	} else {
+		markFrozenWithoutChildren(node)
+	}
+}
+
+// markFrozenWithoutChildren marks the given node as frozen, without marking
+// the children of branch nodes as frozen.
+func markFrozenWithoutChildren(node Node) {
+	if branch, ok := node.(*BranchNode); ok {
+		branch.nodeBase.MarkFrozen()
+	} else {
+		node.MarkFrozen()
+	}
+}
+
+// closeFork releases the nodes of the fork with the given root which are not
+// shared with other tries. If this was the last open fork, the forked nodes no
+// longer reachable from the given origin root have been replaced by updates of
+// the trie the forks were created from and are released. All other forked
+// nodes are un-frozen, such that the LiveDB trie may be updated in place
+// again.
+func (s *Forest) closeFork(root NodeReference, origin NodeReference) error {
+	var errs []error
+	if !root.Id().IsEmpty() {
+		errs = append(errs, s.releaseTrie(root))
+	}
+	// Tries released by the fork in the background need to be released
+	// before shared nodes become mutable and would be released as well.
+	s.releaseQueue <- EmptyId() // signals a sync request
+	<-s.releaseSync
+	errs = append(errs, s.collectReleaseWorkerErrors())
+
+	s.forkMutex.Lock()
+	s.numForks--
+	if s.numForks > 0 {
+		s.forkMutex.Unlock()
+		return errors.Join(errs...)
+	}
+	forked := make(map[NodeId]forkedNode, len(s.forkedNodes))
+	for id, node := range s.forkedNodes {
+		forked[id] = node
+	}
+	s.forkMutex.Unlock()
+
+	// Replaced nodes are released while all forked nodes are still recorded
+	// and thus remain frozen when being reloaded.
+	reachable, err := getReachableForkedNodes(s, origin, forked)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		errs = append(errs, s.releaseReplacedForkedNodes(forked, reachable))
+	}
+
+	s.forkMutex.Lock()
+	s.forkedNodes = nil
+	s.hasForkedNodes.Store(false)
+	s.forkMutex.Unlock()
+
+	// Un-freezing the remaining nodes leaves branches created since the fork
+	// with flags marking their unmodified children as frozen. Since these
+	// flags are not persisted, only branches in memory need to be reset.
+	// Those in the write buffer are written to disk for this purpose.
+	remaining := make([]frozenNode, 0, len(reachable))
+	for id := range reachable {
+		remaining = append(remaining, forked[id].frozenNode)
+	}
+	errs = append(errs, revertFreeze(s, remaining))
+	errs = append(errs, s.writeBuffer.Flush())
+	s.nodeCache.ForEach(func(_ NodeId, node *shared.Shared[Node]) {
+		handle := node.GetWriteHandle()
+		if branch, ok := handle.Get().(*BranchNode); ok && !branch.IsFrozen() {
+			branch.frozenChildren = 0
+		}
+		handle.Release()
+	})
+	return errors.Join(errs...)
+}
+
+// getReachableForkedNodes collects the IDs of the given forked nodes reachable
+// from the given root. Sub-tries rooted by forked nodes whose children have
+// not been frozen are not entered, since they have not been modified while
+// forks were open, unless the roots have been created while forks were open.
+func getReachableForkedNodes(source NodeSource, root NodeReference, forked map[NodeId]forkedNode) (map[NodeId]struct{}, error) {
+	reachable := map[NodeId]struct{}{}
+	stack := []NodeReference{root}
+	for len(stack) > 0 {
+		ref := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if ref.Id().IsEmpty() {
+			continue
+		}
+		if node, found := forked[ref.Id()]; found {
+			reachable[ref.Id()] = struct{}{}
+			if !node.childrenFrozen && !node.createdWhileForked {
+				continue
+			}
+		}
+		handle, err := source.getViewAccess(&ref)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load node %v: %w", ref.Id(), err)
+		}
+		stack = appendChildren(stack, handle.Get())
+		handle.Release()
+	}
+	return reachable, nil
+}
+
+// releaseReplacedForkedNodes releases the given forked nodes not contained in
+// the given set of reachable nodes, together with their descendants up to the
+// next forked nodes. Descendants of forked nodes are only released along with
+// them, since they are not shared by any trie. Other forked nodes are never
+// accessed, since they may have been released already.
+func (s *Forest) releaseReplacedForkedNodes(forked map[NodeId]forkedNode, reachable map[NodeId]struct{}) error {
+	var released []NodeReference
+	for id, node := range forked {
+		if _, found := reachable[id]; found {
+			continue
+		}
+		released = append(released, node.ref)
+		stack := []NodeReference{node.ref}
+		for len(stack) > 0 {
+			ref := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			handle, err := s.getWriteAccess(&ref)
+			if err != nil {
+				return fmt.Errorf("failed to release node %v: %w", ref.Id(), err)
+			}
+			for _, child := range appendChildren(nil, handle.Get()) {
+				if _, found := forked[child.Id()]; !found {
+					stack = append(stack, child)
+					released = append(released, child)
+				}
+			}
+			releaseNodeBase(s, &ref, handle.Get())
+			handle.Release()
+		}
+	}
+
+	batcher := newReleaseBatcher(s, s.releaseBatchSize)
+	for i := range released {
+		if err := batcher.release(&released[i]); err != nil {
+			return err
+		}
+	}
+	s.log(LogDebug, "released replaced forked nodes", "nodes", len(released))
+	return batcher.flush()
+}
+
+// releaseNodeBase marks the given node as released, without releasing any of
+// its children.
+func releaseNodeBase(manager NodeManager, ref *NodeReference, node Node) {
+	switch n := node.(type) {
+	case *BranchNode:
+		n.nodeBase.Release(manager, ref)
+	case *ExtensionNode:
+		n.nodeBase.Release(manager, ref)
+	case *AccountNode:
+		n.nodeBase.Release(manager, ref)
+	case *ValueNode:
+		n.nodeBase.Release(manager, ref)
+	}
+}
+
+// hasOpenForks checks whether forks of LiveDB tries are open, in which case
+// frozen nodes may have non-frozen descendants, since tries are frozen lazily.
+func (s *Forest) hasOpenForks() bool {
+	return s.hasForkedNodes.Load()
+}
@@ -0,0 +1,358 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestMptState_Fork_UpdatesOfForkDoNotAffectOriginal(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			state, err := OpenGoFileState(dir, config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			fillForkTestState(t, state, 0, 1)
+			want, err := state.GetHash()
+			if err != nil {
+				t.Fatalf("failed to get hash: %v", err)
+			}
+
+			fork, err := state.Fork()
+			if err != nil {
+				t.Fatalf("failed to fork state: %v", err)
+			}
+			if got, err := fork.GetHash(); err != nil || got != want {
+				t.Errorf("unexpected hash of fork, wanted %x, got %x, err %v", want, got, err)
+			}
+			fillForkTestState(t, fork, 1, 2)
+			if err := fork.DeleteAccount(common.Address{7}); err != nil {
+				t.Fatalf("failed to delete account: %v", err)
+			}
+			forked, err := fork.GetHash()
+			if err != nil {
+				t.Fatalf("failed to get hash of fork: %v", err)
+			}
+			if forked == want {
+				t.Errorf("hash of fork should have changed")
+			}
+
+			if got, err := state.GetHash(); err != nil || got != want {
+				t.Errorf("unexpected hash of original, wanted %x, got %x, err %v", want, got, err)
+			}
+			checkForkTestState(t, state, 1)
+			if err := state.trie.Check(); err != nil {
+				t.Errorf("original trie is inconsistent: %v", err)
+			}
+
+			// Updates of the original do not affect the fork either.
+			fillForkTestState(t, state, 0, 3)
+			if got, err := fork.GetHash(); err != nil || got != forked {
+				t.Errorf("unexpected hash of fork, wanted %x, got %x, err %v", forked, got, err)
+			}
+			if exists, err := fork.Exists(common.Address{7}); err != nil || exists {
+				t.Errorf("account deleted in fork should not exist, got %t, err %v", exists, err)
+			}
+
+			if err := fork.Close(); err != nil {
+				t.Fatalf("failed to close fork: %v", err)
+			}
+			checkForkTestState(t, state, 3)
+			if err := state.trie.Check(); err != nil {
+				t.Errorf("original trie is inconsistent after closing fork: %v", err)
+			}
+			want, err = state.GetHash()
+			if err != nil {
+				t.Fatalf("failed to get hash: %v", err)
+			}
+			if err := state.Close(); err != nil {
+				t.Fatalf("failed to close state: %v", err)
+			}
+
+			state, err = OpenGoFileState(dir, config, 1024)
+			if err != nil {
+				t.Fatalf("failed to reopen state: %v", err)
+			}
+			defer state.Close()
+			if got, err := state.GetHash(); err != nil || got != want {
+				t.Errorf("unexpected hash of reopened state, wanted %x, got %x, err %v", want, got, err)
+			}
+			checkForkTestState(t, state, 3)
+		})
+	}
+}
+
+func TestMptState_Fork_NodesOfClosedForksAreReleased(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	fillForkTestState(t, state, 0, 1)
+	forest := state.trie.forest.(*Forest)
+
+	var used []NodeIdCounts
+	for i := 0; i < 3; i++ {
+		fork, err := state.Fork()
+		if err != nil {
+			t.Fatalf("failed to fork state: %v", err)
+		}
+		fillForkTestState(t, fork, 0, byte(i+2))
+		if err := fork.Close(); err != nil {
+			t.Fatalf("failed to close fork: %v", err)
+		}
+		usage, err := forest.GetIdSpaceUsage()
+		if err != nil {
+			t.Fatalf("failed to get ID space usage: %v", err)
+		}
+		used = append(used, usage.Used)
+	}
+
+	// IDs released by closed forks are reused by later forks.
+	if used[0] != used[1] || used[1] != used[2] {
+		t.Errorf("nodes of forks should be released, allocated IDs after each fork: %v", used)
+	}
+	if forest.hasForkedNodes.Load() || len(forest.forkedNodes) != 0 {
+		t.Errorf("no nodes should be recorded as forked after closing all forks")
+	}
+}
+
+func TestMptState_Fork_ForksCanNotBeForked(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	fork, err := state.Fork()
+	if err != nil {
+		t.Fatalf("failed to fork state: %v", err)
+	}
+	defer fork.Close()
+	if _, err := fork.(*MptState).Fork(); err == nil {
+		t.Errorf("forking a fork should fail")
+	}
+}
+
+func TestLiveTrie_Fork_OnlyTheRootIsFrozenWhenForking(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	fillForkTestState(t, state, 0, 1)
+	forest := state.trie.forest.(*Forest)
+
+	fork, err := state.Fork()
+	if err != nil {
+		t.Fatalf("failed to fork state: %v", err)
+	}
+	defer fork.Close()
+
+	root := state.trie.root
+	if _, found := forest.forkedNodes[root.Id()]; !found || len(forest.forkedNodes) != 1 {
+		t.Errorf("only the root should be recorded as forked, got %d nodes", len(forest.forkedNodes))
+	}
+	handle, err := forest.getViewAccess(&root)
+	if err != nil {
+		t.Fatalf("failed to access root: %v", err)
+	}
+	defer handle.Release()
+	if !handle.Get().IsFrozen() {
+		t.Errorf("root should be frozen")
+	}
+	for _, child := range appendChildren(nil, handle.Get()) {
+		childHandle, err := forest.getViewAccess(&child)
+		if err != nil {
+			t.Fatalf("failed to access child: %v", err)
+		}
+		if childHandle.Get().IsFrozen() {
+			t.Errorf("child %v of root should not be frozen", child.Id())
+		}
+		childHandle.Release()
+	}
+}
+
+func TestLiveTrie_Fork_OnlyModifiedPathsAreFrozen(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	fillForkTestState(t, state, 0, 1)
+	forest := state.trie.forest.(*Forest)
+
+	fork, err := state.Fork()
+	if err != nil {
+		t.Fatalf("failed to fork state: %v", err)
+	}
+	defer fork.Close()
+	if err := fork.SetStorage(common.Address{7}, common.Key{1}, common.Value{2}); err != nil {
+		t.Fatalf("failed to set storage: %v", err)
+	}
+	if err := state.SetBalance(common.Address{8}, common.Balance{2}); err != nil {
+		t.Fatalf("failed to set balance: %v", err)
+	}
+	for _, trie := range []LiveState{state, fork} {
+		if _, err := trie.GetHash(); err != nil {
+			t.Fatalf("failed to get hash: %v", err)
+		}
+	}
+
+	usage, err := forest.GetIdSpaceUsage()
+	if err != nil {
+		t.Fatalf("failed to get ID space usage: %v", err)
+	}
+	total := usage.Used.Accounts + usage.Used.Branches + usage.Used.Extensions + usage.Used.Values
+	// The root, the branches on the modified paths and their children.
+	if got := uint64(len(forest.forkedNodes)); got == 0 || got > total/10 {
+		t.Errorf("only nodes on modified paths should be frozen, got %d of %d nodes", got, total)
+	}
+	if err := state.trie.Check(); err != nil {
+		t.Errorf("original trie is inconsistent: %v", err)
+	}
+	if err := fork.(*MptState).trie.Check(); err != nil {
+		t.Errorf("forked trie is inconsistent: %v", err)
+	}
+}
+
+func TestMptState_Fork_ReplacedNodesAreReleasedWhenLastForkIsClosed(t *testing.T) {
+	// Updates of the original trie, applied in phases while forks are opened
+	// and closed in between.
+	updateOriginal := func(t *testing.T, state *MptState, phase int) {
+		switch phase {
+		case 0:
+			fillForkTestState(t, state, 100, 2)
+		case 1:
+			for i := 20; i < 30; i++ {
+				if err := state.DeleteAccount(common.Address{byte(i)}); err != nil {
+					t.Fatalf("failed to delete account: %v", err)
+				}
+			}
+			fillForkTestState(t, state, 180, 3)
+		case 2:
+			fillForkTestState(t, state, 190, 4)
+		}
+	}
+
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			reference, err := OpenGoMemoryState(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer reference.Close()
+			fillForkTestState(t, reference, 0, 1)
+			for phase := 0; phase < 3; phase++ {
+				updateOriginal(t, reference, phase)
+			}
+
+			state, err := OpenGoMemoryState(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer state.Close()
+			fillForkTestState(t, state, 0, 1)
+
+			first, err := state.Fork()
+			if err != nil {
+				t.Fatalf("failed to fork state: %v", err)
+			}
+			fillForkTestState(t, first, 50, 5)
+			updateOriginal(t, state, 0)
+
+			// The second fork shares nodes created since the first fork.
+			second, err := state.Fork()
+			if err != nil {
+				t.Fatalf("failed to fork state: %v", err)
+			}
+			updateOriginal(t, state, 1)
+			fillForkTestState(t, second, 120, 6)
+			if err := first.Close(); err != nil {
+				t.Fatalf("failed to close fork: %v", err)
+			}
+			updateOriginal(t, state, 2)
+			if err := second.Close(); err != nil {
+				t.Fatalf("failed to close fork: %v", err)
+			}
+
+			want, err := reference.GetHash()
+			if err != nil {
+				t.Fatalf("failed to get hash: %v", err)
+			}
+			if got, err := state.GetHash(); err != nil || got != want {
+				t.Errorf("unexpected hash, wanted %x, got %x, err %v", want, got, err)
+			}
+			if err := state.trie.Check(); err != nil {
+				t.Errorf("trie is inconsistent after closing forks: %v", err)
+			}
+
+			// All nodes replaced in the original trie are released.
+			orphans, err := state.trie.forest.(*Forest).FindOrphans([]*NodeReference{&state.trie.root})
+			if err != nil {
+				t.Fatalf("failed to find orphans: %v", err)
+			}
+			if len(orphans) != 0 {
+				t.Errorf("replaced nodes should be released, found %d orphaned nodes", len(orphans))
+			}
+		})
+	}
+}
+
+// fillForkTestState creates a set of accounts with storage in the given
+// state, exceeding the capacity of the node cache of the tests, and sets the
+// balance and storage values of accounts starting at the given one to the
+// given version. Hashes are updated regularly such that nodes can be evicted.
+func fillForkTestState(t *testing.T, state LiveState, from int, version byte) {
+	t.Helper()
+	for i := from; i <= 200; i++ {
+		if i%20 == 0 {
+			if _, err := state.GetHash(); err != nil {
+				t.Fatalf("failed to get hash: %v", err)
+			}
+		}
+		if i == 200 {
+			break
+		}
+		addr := common.Address{byte(i)}
+		if err := state.SetNonce(addr, common.ToNonce(1)); err != nil {
+			t.Fatalf("failed to set nonce: %v", err)
+		}
+		if err := state.SetBalance(addr, common.Balance{version}); err != nil {
+			t.Fatalf("failed to set balance: %v", err)
+		}
+		for j := 0; j < 10; j++ {
+			if err := state.SetStorage(addr, common.Key{byte(j)}, common.Value{version}); err != nil {
+				t.Fatalf("failed to set storage: %v", err)
+			}
+		}
+	}
+}
+
+// checkForkTestState checks that all accounts created by fillForkTestState
+// are present with the given version.
+func checkForkTestState(t *testing.T, state LiveState, version byte) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		addr := common.Address{byte(i)}
+		if balance, err := state.GetBalance(addr); err != nil || balance != (common.Balance{version}) {
+			t.Fatalf("unexpected balance of %v, wanted %d, got %v, err %v", addr, version, balance, err)
+		}
+		for j := 0; j < 10; j++ {
+			if value, err := state.GetStorage(addr, common.Key{byte(j)}); err != nil || value != (common.Value{version}) {
+				t.Fatalf("unexpected value of slot %d of %v, wanted %d, got %v, err %v", j, addr, version, value, err)
+			}
+		}
+	}
+}
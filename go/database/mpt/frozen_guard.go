@@ -0,0 +1,173 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
+)
+
+// Frozen nodes may be shared by multiple tries, in particular by the tries of
+// the blocks of an archive. Thus, they must never be modified in place, but
+// copied before being modified. Code paths violating this rule corrupt tries
+// sharing the modified node. To detect such violations, forests may be
+// configured to guard frozen nodes: whenever write access to a frozen node is
+// granted, the encoding of the node is recorded and compared to the encoding
+// of the node when the write access is released. Mismatches are reported to
+// a FrozenNodeHandler, or cause a panic if there is none.
+
+// ErrFrozenNodeModified is the error reported for frozen nodes modified in place.
+const ErrFrozenNodeModified = common.ConstError("frozen node modified")
+
+// FrozenNodeHandler is a callback informed about frozen nodes detected to be
+// modified in place. Calls may be issued concurrently.
+type FrozenNodeHandler func(*FrozenNodeModificationError)
+
+// FrozenNodeModificationError describes an in-place modification of a frozen
+// node detected when releasing write access to it.
+type FrozenNodeModificationError struct {
+	Id     NodeId
+	Before []byte // the encoding of the node when write access was granted
+	After  []byte // the encoding of the node when write access was released
+}
+
+func (e *FrozenNodeModificationError) Error() string {
+	return fmt.Sprintf("%v: node %v, %s", ErrFrozenNodeModified, e.Id, diffEncodings(e.Before, e.After))
+}
+
+func (e *FrozenNodeModificationError) Unwrap() error {
+	return ErrFrozenNodeModified
+}
+
+// diffEncodings lists the ranges of bytes differing in the given encodings.
+func diffEncodings(before, after []byte) string {
+	var diffs []string
+	for i := 0; i < len(before) || i < len(after); {
+		if i < len(before) && i < len(after) && before[i] == after[i] {
+			i++
+			continue
+		}
+		start := i
+		for i < len(before) && i < len(after) && before[i] != after[i] {
+			i++
+		}
+		if i == start {
+			// One encoding is a prefix of the other.
+			i = len(before)
+			if len(after) > i {
+				i = len(after)
+			}
+		}
+		diffs = append(diffs, fmt.Sprintf("[%d:%d] %x -> %x", start, i, getRange(before, start, i), getRange(after, start, i)))
+	}
+	if len(diffs) == 0 {
+		return "no difference"
+	}
+	return strings.Join(diffs, ", ")
+}
+
+func getRange(data []byte, from, to int) []byte {
+	if from > len(data) {
+		from = len(data)
+	}
+	if to > len(data) {
+		to = len(data)
+	}
+	return data[from:to]
+}
+
+// frozenNodeGuard attaches checks for in-place modifications to write handles
+// of frozen nodes.
+type frozenNodeGuard struct {
+	accounts   stock.ValueEncoder[AccountNode]
+	branches   stock.ValueEncoder[BranchNode]
+	extensions stock.ValueEncoder[ExtensionNode]
+	values     stock.ValueEncoder[ValueNode]
+	handler    FrozenNodeHandler
+}
+
+func newFrozenNodeGuard(config MptConfig, handler FrozenNodeHandler) *frozenNodeGuard {
+	accounts, branches, extensions, values := getEncoder(config)
+	if handler == nil {
+		handler = func(err *FrozenNodeModificationError) {
+			panic(err)
+		}
+	}
+	return &frozenNodeGuard{
+		accounts:   accounts,
+		branches:   branches,
+		extensions: extensions,
+		values:     values,
+		handler:    handler,
+	}
+}
+
+// guard returns the given write handle of the node with the given ID extended
+// by a check for modifications if the node is frozen.
+func (g *frozenNodeGuard) guard(id NodeId, handle shared.WriteHandle[Node]) shared.WriteHandle[Node] {
+	node := handle.Get()
+	if !node.IsFrozen() {
+		return handle
+	}
+	before, err := g.encode(node)
+	if err != nil || before == nil {
+		return handle
+	}
+	return handle.WithReleaseHook(func(node Node) {
+		after, err := g.encode(node)
+		if err != nil || !bytes.Equal(before, after) {
+			g.handler(&FrozenNodeModificationError{Id: id, Before: before, After: after})
+		}
+	})
+}
+
+// encode produces the encoding of the given node as it would be stored in the
+// stock of its type. Empty nodes have no encoding, for which nil is returned.
+// Since encoders refuse to store nodes with dirty hashes, a copy of the node
+// with its hash flags cleared is encoded. Stale hashes are covered as they are,
+// modifications of the content of the node are detected regardless.
+func (g *frozenNodeGuard) encode(node Node) ([]byte, error) {
+	switch n := node.(type) {
+	case *AccountNode:
+		c := *n
+		c.hashStatus = hashStatusClean
+		c.storageHashDirty = false
+		return encodeNode(g.accounts, &c)
+	case *BranchNode:
+		c := *n
+		c.hashStatus = hashStatusClean
+		c.dirtyHashes = 0
+		return encodeNode(g.branches, &c)
+	case *ExtensionNode:
+		c := *n
+		c.hashStatus = hashStatusClean
+		c.nextHashDirty = false
+		return encodeNode(g.extensions, &c)
+	case *ValueNode:
+		c := *n
+		c.hashStatus = hashStatusClean
+		return encodeNode(g.values, &c)
+	}
+	return nil, nil
+}
+
+func encodeNode[V any](encoder stock.ValueEncoder[V], node *V) ([]byte, error) {
+	res := make([]byte, encoder.GetEncodedSize())
+	if err := encoder.Store(res, node); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
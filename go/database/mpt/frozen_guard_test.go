@@ -0,0 +1,209 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestFrozenNodeGuard_RegularArchiveUpdatesDoNotModifyFrozenNodes(t *testing.T) {
+	for _, config := range []MptConfig{S5ArchiveConfig, S5ArchiveWideReferencesConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			var mutex sync.Mutex
+			var detected []error
+			archive, err := OpenArchiveTrieWithConfig(t.TempDir(), config, ForestConfig{
+				CacheCapacity:    1024,
+				GuardFrozenNodes: true,
+				FrozenNodeHandler: func(err *FrozenNodeModificationError) {
+					mutex.Lock()
+					defer mutex.Unlock()
+					detected = append(detected, err)
+				},
+			})
+			if err != nil {
+				t.Fatalf("failed to open archive: %v", err)
+			}
+			defer archive.Close()
+
+			addresses := getTestAddresses(20)
+			for block := uint64(0); block < 20; block++ {
+				update := common.Update{}
+				if block == 0 {
+					update.CreatedAccounts = addresses
+				}
+				for i, addr := range addresses {
+					if (int(block)+i)%3 != 0 {
+						continue
+					}
+					update.Nonces = append(update.Nonces, common.NonceUpdate{Account: addr, Nonce: common.ToNonce(block + 1)})
+					update.Slots = append(update.Slots, common.SlotUpdate{Account: addr, Key: common.Key{byte(block % 4)}, Value: common.Value{byte(block), byte(i)}})
+				}
+				if err := archive.Add(block, update, nil); err != nil {
+					t.Fatalf("failed to add block %d: %v", block, err)
+				}
+			}
+			if err := archive.Check(); err != nil {
+				t.Errorf("invalid archive: %v", err)
+			}
+			if len(detected) != 0 {
+				t.Errorf("unexpected modifications of frozen nodes: %v", errors.Join(detected...))
+			}
+		})
+	}
+}
+
+func TestFrozenNodeGuard_InPlaceModificationOfFrozenNodeIsReported(t *testing.T) {
+	var detected []*FrozenNodeModificationError
+	archive, forest := openArchiveWithFrozenAccount(t, ForestConfig{
+		CacheCapacity:    1024,
+		GuardFrozenNodes: true,
+		FrozenNodeHandler: func(err *FrozenNodeModificationError) {
+			detected = append(detected, err)
+		},
+	})
+	defer archive.Close()
+	root := archive.roots.roots[0].NodeRef
+
+	// Write access without modifications is fine.
+	handle, err := forest.getWriteAccess(&root)
+	if err != nil {
+		t.Fatalf("failed to get write access: %v", err)
+	}
+	handle.Release()
+	if len(detected) != 0 {
+		t.Fatalf("unmodified frozen node should not be reported, got %v", detected)
+	}
+
+	defer violateFrozenNodeInvariant(t, forest, &root)()
+	if len(detected) != 1 {
+		t.Fatalf("modification of frozen node should be reported once, got %d reports", len(detected))
+	}
+	err = detected[0]
+	if !errors.Is(err, ErrFrozenNodeModified) {
+		t.Errorf("unexpected error type, got %v", err)
+	}
+	if want, got := root.Id(), detected[0].Id; want != got {
+		t.Errorf("unexpected node ID, wanted %v, got %v", want, got)
+	}
+	if before, after := detected[0].Before, detected[0].After; len(before) == 0 || string(before) == string(after) {
+		t.Errorf("encodings should differ, got %x and %x", before, after)
+	}
+	if !strings.Contains(err.Error(), root.Id().String()) || !strings.Contains(err.Error(), " -> ") {
+		t.Errorf("error should name the node and the difference, got %v", err)
+	}
+}
+
+func TestFrozenNodeGuard_InPlaceModificationCausesPanicWithoutHandler(t *testing.T) {
+	archive, forest := openArchiveWithFrozenAccount(t, ForestConfig{CacheCapacity: 1024, GuardFrozenNodes: true})
+	defer archive.Close()
+	root := archive.roots.roots[0].NodeRef
+
+	handle, err := forest.getWriteAccess(&root)
+	if err != nil {
+		t.Fatalf("failed to get write access: %v", err)
+	}
+	handle.Get().(*AccountNode).info.Nonce = common.ToNonce(2)
+	defer func() {
+		err, ok := recover().(error)
+		if !ok || !errors.Is(err, ErrFrozenNodeModified) {
+			t.Errorf("modification of frozen node should cause panic, got %v", err)
+		}
+	}()
+	handle.Release()
+}
+
+func TestFrozenNodeGuard_ModificationsAreNotDetectedIfDisabled(t *testing.T) {
+	archive, forest := openArchiveWithFrozenAccount(t, ForestConfig{
+		CacheCapacity: 1024,
+		FrozenNodeHandler: func(err *FrozenNodeModificationError) {
+			t.Errorf("unexpected report of modification: %v", err)
+		},
+	})
+	defer archive.Close()
+	root := archive.roots.roots[0].NodeRef
+	violateFrozenNodeInvariant(t, forest, &root)()
+}
+
+func TestFrozenNodeGuard_CheckReportsDirtyNodesReachableFromArchivedRoots(t *testing.T) {
+	archive, forest := openArchiveWithFrozenAccount(t, ForestConfig{CacheCapacity: 1024})
+	defer archive.Close()
+	if err := archive.Check(); err != nil {
+		t.Fatalf("unexpected error in unmodified archive: %v", err)
+	}
+
+	root := archive.roots.roots[0].NodeRef
+	defer violateFrozenNodeInvariant(t, forest, &root)()
+	err := archive.Check()
+	if err == nil || !strings.Contains(err.Error(), "is marked dirty") {
+		t.Errorf("modified frozen node should be detected, got %v", err)
+	}
+}
+
+// openArchiveWithFrozenAccount creates an archive of two blocks where the
+// trie of the first block consists of a single account node.
+func openArchiveWithFrozenAccount(t *testing.T, config ForestConfig) (*ArchiveTrie, *Forest) {
+	t.Helper()
+	archive, err := OpenArchiveTrieWithConfig(t.TempDir(), S5ArchiveConfig, config)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	addr1, addr2 := common.Address{1}, common.Address{2}
+	updates := []common.Update{
+		{CreatedAccounts: []common.Address{addr1}, Nonces: []common.NonceUpdate{{Account: addr1, Nonce: common.ToNonce(1)}}},
+		{CreatedAccounts: []common.Address{addr2}, Nonces: []common.NonceUpdate{{Account: addr2, Nonce: common.ToNonce(1)}}},
+	}
+	for block, update := range updates {
+		if err := archive.Add(uint64(block), update, nil); err != nil {
+			t.Fatalf("failed to add block %d: %v", block, err)
+		}
+	}
+	forest, ok := archive.forest.(*Forest)
+	if !ok {
+		t.Fatalf("unexpected type of forest: %T", archive.forest)
+	}
+	return archive, forest
+}
+
+// violateFrozenNodeInvariant modifies the frozen account node referenced by
+// the given reference in place, as done by code paths failing to copy frozen
+// nodes before modifying them. The resulting function restores the hash of the
+// node, such that it can be flushed when closing the forest.
+func violateFrozenNodeInvariant(t *testing.T, forest *Forest, ref *NodeReference) (restore func()) {
+	t.Helper()
+	handle, err := forest.getWriteAccess(ref)
+	if err != nil {
+		t.Fatalf("failed to get write access: %v", err)
+	}
+	defer handle.Release()
+	account, ok := handle.Get().(*AccountNode)
+	if !ok || !account.IsFrozen() {
+		t.Fatalf("expected frozen account node, got %v", handle.Get())
+	}
+	hash := account.hash
+	account.info.Nonce = common.ToNonce(2)
+	account.markDirty(forest, ref)
+	target := *ref
+	return func() {
+		// The node is accessed bypassing the guard of the forest.
+		node, err := forest.getSharedNode(&target)
+		if err != nil {
+			t.Fatalf("failed to get node: %v", err)
+		}
+		handle := node.GetWriteHandle()
+		defer handle.Release()
+		handle.Get().SetHash(hash)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// ExportGenesisJSON writes the content of the state in the JSON format of
+// genesis files used by go-ethereum (core.Genesis). Only the allocation of
+// the genesis, listing all accounts with their balance, nonce, code, and
+// storage, is written:
+//
+//	{"alloc":{"0x<address>":{"balance":"0x..","nonce":"0x..","code":"0x..","storage":{"0x<key>":"0x<value>"}}}}
+//
+// Nonces, codes, and storage are omitted if empty. Since codes are not part
+// of the trie, they are taken from the code store of this state. Accounts
+// referencing a code not present in the code store cause an error.
+// Uncommitted modifications of the state are included in the output.
+func (s *MptState) ExportGenesisJSON(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	exporter := genesisExporter{state: s, out: out}
+	out.WriteString(`{"alloc":{`)
+	if err := s.Visit(&exporter); err != nil || exporter.err != nil {
+		return fmt.Errorf("failed exporting genesis: %w", errors.Join(err, exporter.err))
+	}
+	if exporter.numAccounts > 0 {
+		exporter.closeAccount()
+	}
+	out.WriteString("}}\n")
+	return out.Flush()
+}
+
+// genesisExporter is a visitor writing the accounts and values of a state in
+// the order of the trie. Since values are visited right after the account
+// owning them, each account is kept open until the next account is reached.
+type genesisExporter struct {
+	state       *MptState
+	out         *bufio.Writer
+	numAccounts int
+	numValues   int
+	err         error
+}
+
+func (e *genesisExporter) Visit(node Node, _ NodeInfo) VisitResponse {
+	switch n := node.(type) {
+	case *AccountNode:
+		if e.numAccounts > 0 {
+			e.closeAccount()
+			e.out.WriteByte(',')
+		}
+		e.numAccounts++
+		e.numValues = 0
+
+		address, info := n.Address(), n.Info()
+		fmt.Fprintf(e.out, `"0x%x":{"balance":"0x%x"`, address[:], info.Balance.ToBigInt())
+		if nonce := info.Nonce.ToUint64(); nonce != 0 {
+			fmt.Fprintf(e.out, `,"nonce":"0x%x"`, nonce)
+		}
+		if info.CodeHash != emptyCodeHash && info.CodeHash != (common.Hash{}) {
+			code := e.state.GetCodeForHash(info.CodeHash)
+			if code == nil {
+				e.err = fmt.Errorf("missing code with hash %x of account %x", info.CodeHash[:], address[:])
+				return VisitResponseAbort
+			}
+			fmt.Fprintf(e.out, `,"code":"0x%x"`, code)
+		}
+	case *ValueNode:
+		if e.numValues == 0 {
+			e.out.WriteString(`,"storage":{`)
+		} else {
+			e.out.WriteByte(',')
+		}
+		e.numValues++
+		key, value := n.Key(), n.Value()
+		fmt.Fprintf(e.out, `"0x%x":"0x%x"`, key[:], value[:])
+	}
+	return VisitResponseContinue
+}
+
+// closeAccount terminates the output of the most recently visited account.
+func (e *genesisExporter) closeAccount() {
+	if e.numValues > 0 {
+		e.out.WriteByte('}')
+	}
+	e.out.WriteByte('}')
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// genesisJSON mirrors the JSON encoding of go-ethereum's core.Genesis type,
+// restricted to the allocation of accounts.
+type genesisJSON struct {
+	Alloc map[string]struct {
+		Balance string            `json:"balance"`
+		Nonce   string            `json:"nonce"`
+		Code    string            `json:"code"`
+		Storage map[string]string `json:"storage"`
+	} `json:"alloc"`
+}
+
+func TestExportGenesisJSON_ExportedAllocationMatchesState(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			state, err := OpenGoMemoryState(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer state.Close()
+
+			r := rand.New(rand.NewSource(42))
+			for block := uint64(0); block < 20; block++ {
+				update := getRandomUpdateWithDeletions(r)
+				if _, err := state.Apply(block, update); err != nil {
+					t.Fatalf("failed to apply update: %v", err)
+				}
+			}
+			addresses := []common.Address{}
+			for i := byte(0); i < 3; i++ {
+				for j := byte(0); j < 3; j++ {
+					for k := byte(0); k < 3; k++ {
+						addresses = append(addresses, common.Address{i, j << 4, k})
+					}
+				}
+			}
+			for i, address := range addresses {
+				if exists, err := state.Exists(address); err != nil || !exists {
+					continue
+				}
+				if err := state.SetCode(address, []byte{byte(i), 1, 2}); err != nil {
+					t.Fatalf("failed to set code: %v", err)
+				}
+				break
+			}
+
+			var buffer bytes.Buffer
+			if err := state.ExportGenesisJSON(&buffer); err != nil {
+				t.Fatalf("failed to export genesis: %v", err)
+			}
+			var genesis genesisJSON
+			if err := json.Unmarshal(buffer.Bytes(), &genesis); err != nil {
+				t.Fatalf("failed to parse exported genesis: %v\n%s", err, buffer.String())
+			}
+
+			numAccounts := 0
+			for _, address := range addresses {
+				exists, err := state.Exists(address)
+				if err != nil {
+					t.Fatalf("failed to check existence: %v", err)
+				}
+				account, found := genesis.Alloc["0x"+hex.EncodeToString(address[:])]
+				if exists != found {
+					t.Fatalf("unexpected presence of %v, wanted %t, got %t", address, exists, found)
+				}
+				if !exists {
+					continue
+				}
+				numAccounts++
+
+				balance, err := state.GetBalance(address)
+				if err != nil {
+					t.Fatalf("failed to get balance: %v", err)
+				}
+				if want, got := balance.ToBigInt(), parseHexBigInt(t, account.Balance); want.Cmp(got) != 0 {
+					t.Errorf("unexpected balance of %v, wanted %v, got %v", address, want, got)
+				}
+				nonce, err := state.GetNonce(address)
+				if err != nil {
+					t.Fatalf("failed to get nonce: %v", err)
+				}
+				if want, got := nonce.ToUint64(), parseHexUint64(t, account.Nonce); want != got {
+					t.Errorf("unexpected nonce of %v, wanted %d, got %d", address, want, got)
+				}
+				code, err := state.GetCode(address)
+				if err != nil {
+					t.Fatalf("failed to get code: %v", err)
+				}
+				if want, got := code, parseHexBytes(t, account.Code); !bytes.Equal(want, got) {
+					t.Errorf("unexpected code of %v, wanted %x, got %x", address, want, got)
+				}
+
+				numValues := 0
+				for i := byte(0); i < 3; i++ {
+					for j := byte(0); j < 3; j++ {
+						key := common.Key{i, j << 4}
+						value, err := state.GetStorage(address, key)
+						if err != nil {
+							t.Fatalf("failed to get storage: %v", err)
+						}
+						got, found := account.Storage["0x"+hex.EncodeToString(key[:])]
+						if found != (value != common.Value{}) {
+							t.Fatalf("unexpected presence of %v/%v, wanted %x, got %s", address, key, value, got)
+						}
+						if found {
+							numValues++
+							if want := "0x" + hex.EncodeToString(value[:]); want != got {
+								t.Errorf("unexpected value of %v/%v, wanted %s, got %s", address, key, want, got)
+							}
+						}
+					}
+				}
+				if numValues != len(account.Storage) {
+					t.Errorf("unexpected number of slots of %v, wanted %d, got %d", address, numValues, len(account.Storage))
+				}
+			}
+			if numAccounts != len(genesis.Alloc) {
+				t.Errorf("unexpected number of accounts, wanted %d, got %d", numAccounts, len(genesis.Alloc))
+			}
+		})
+	}
+}
+
+func TestExportGenesisJSON_EmptyStateProducesEmptyAllocation(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+
+	var buffer bytes.Buffer
+	if err := state.ExportGenesisJSON(&buffer); err != nil {
+		t.Fatalf("failed to export genesis: %v", err)
+	}
+	if want, got := "{\"alloc\":{}}\n", buffer.String(); want != got {
+		t.Errorf("unexpected output, wanted %q, got %q", want, got)
+	}
+}
+
+func TestExportGenesisJSON_MissingCodeIsReported(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+
+	address := common.Address{1}
+	if err := state.SetNonce(address, common.ToNonce(1)); err != nil {
+		t.Fatalf("failed to set nonce: %v", err)
+	}
+	if err := state.SetCode(address, []byte{1, 2, 3}); err != nil {
+		t.Fatalf("failed to set code: %v", err)
+	}
+	state.code = map[common.Hash][]byte{}
+
+	if err := state.ExportGenesisJSON(&bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "missing code") {
+		t.Errorf("missing code should be reported, got %v", err)
+	}
+}
+
+func parseHexBigInt(t *testing.T, value string) *big.Int {
+	t.Helper()
+	res, ok := new(big.Int).SetString(strings.TrimPrefix(value, "0x"), 16)
+	if !ok {
+		t.Fatalf("invalid hex number: %q", value)
+	}
+	return res
+}
+
+func parseHexUint64(t *testing.T, value string) uint64 {
+	t.Helper()
+	if value == "" {
+		return 0
+	}
+	res, err := strconv.ParseUint(strings.TrimPrefix(value, "0x"), 16, 64)
+	if err != nil {
+		t.Fatalf("invalid hex number %q: %v", value, err)
+	}
+	return res
+}
+
+func parseHexBytes(t *testing.T, value string) []byte {
+	t.Helper()
+	if value == "" {
+		return nil
+	}
+	res, err := hex.DecodeString(strings.TrimPrefix(value, "0x"))
+	if err != nil {
+		t.Fatalf("invalid hex bytes %q: %v", value, err)
+	}
+	return res
+}
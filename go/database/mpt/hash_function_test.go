@@ -0,0 +1,439 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/rlp"
+	"golang.org/x/crypto/blake2b"
+)
+
+// The tests in this file cover the use of alternative hash functions in the
+// EthereumLikeHashing algorithm. Since there are no reference hashes for
+// alternative functions, tests check structural properties of the resulting
+// hashes instead of golden values.
+
+// sha256Function is an alternative hash function used for testing.
+type sha256Function struct{}
+
+func (sha256Function) Sum(data []byte) common.Hash {
+	return sha256.Sum256(data)
+}
+
+func withHashFunction(config MptConfig, hash HashFunction) MptConfig {
+	config.Name = config.Name + "-Custom-Hash"
+	config.HashFunction = hash
+	return config
+}
+
+func TestHashFunction_Keccak256IsDefault(t *testing.T) {
+	for _, config := range []MptConfig{S5LiveConfig, S5ArchiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			want := getHashOfTestState(t, config, false)
+			got := getHashOfTestState(t, withHashFunction(config, Keccak256), false)
+			if want != got {
+				t.Errorf("explicit use of keccak256 should not change hashes, wanted %x, got %x", want, got)
+			}
+		})
+	}
+}
+
+func TestEmptyStateRootHash_EthereumLikeHashingUsesEthereumEmptyRoot(t *testing.T) {
+	// The value of types.EmptyRootHash of geth.
+	want := "56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421"
+	if got := fmt.Sprintf("%x", EmptyStateRootHash(S5LiveConfig)); got != want {
+		t.Errorf("unexpected empty root hash, wanted %v, got %v", want, got)
+	}
+	if got := fmt.Sprintf("%x", EmptyStateRootHash(withHashFunction(S5LiveConfig, Keccak256))); got != want {
+		t.Errorf("unexpected empty root hash with explicit keccak256, wanted %v, got %v", want, got)
+	}
+}
+
+func TestEmptyStateRootHash_MatchesHashOfEmptyState(t *testing.T) {
+	configs := append([]MptConfig{withHashFunction(S5LiveConfig, sha256Function{})}, allMptConfigs...)
+	for _, config := range configs {
+		t.Run(config.Name, func(t *testing.T) {
+			state, err := OpenGoMemoryState(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer state.Close()
+			want, err := state.GetHash()
+			if err != nil {
+				t.Fatalf("failed to get hash of empty state: %v", err)
+			}
+			if got := EmptyStateRootHash(config); got != want {
+				t.Errorf("unexpected empty root hash, wanted %x, got %x", want, got)
+			}
+		})
+	}
+}
+
+func TestHashFunction_EmptyNodeHashIsDerivedFromHashFunction(t *testing.T) {
+	if got, want := getEmptyNodeHash(nil), EmptyNodeEthereumHash; got != want {
+		t.Errorf("unexpected default empty node hash, wanted %x, got %x", want, got)
+	}
+	if got, want := getEmptyNodeHash(Keccak256), common.Keccak256(rlp.Encode(rlp.String{})); got != want {
+		t.Errorf("unexpected keccak256 empty node hash, wanted %x, got %x", want, got)
+	}
+	custom := getEmptyNodeHash(sha256Function{})
+	if want := (sha256Function{}).Sum(rlp.Encode(rlp.String{})); custom != want {
+		t.Errorf("unexpected custom empty node hash, wanted %x, got %x", want, custom)
+	}
+	if custom == EmptyNodeEthereumHash {
+		t.Errorf("empty node hash should depend on hash function")
+	}
+
+	for _, config := range []MptConfig{S5LiveConfig, S5ArchiveConfig} {
+		state, err := OpenGoMemoryState(t.TempDir(), withHashFunction(config, sha256Function{}), 1024)
+		if err != nil {
+			t.Fatalf("failed to open state: %v", err)
+		}
+		if got, err := state.GetHash(); err != nil || got != custom {
+			t.Errorf("unexpected hash of empty state, wanted %x, got %x, err %v", custom, got, err)
+		}
+		if err := state.Close(); err != nil {
+			t.Fatalf("failed to close state: %v", err)
+		}
+	}
+}
+
+func TestHashFunction_AlternativeFunctionProducesDifferentHashes(t *testing.T) {
+	for _, config := range []MptConfig{S5LiveConfig, S5ArchiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			keccak := getHashOfTestState(t, config, false)
+			custom := getHashOfTestState(t, withHashFunction(config, sha256Function{}), false)
+			if keccak == custom {
+				t.Errorf("hashes should depend on the hash function, got %x for both", custom)
+			}
+		})
+	}
+}
+
+func TestHashFunction_AlternativeFunctionHashesAreIndependentOfInsertionOrder(t *testing.T) {
+	for _, config := range []MptConfig{S5LiveConfig, S5ArchiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			config := withHashFunction(config, sha256Function{})
+			forward := getHashOfTestState(t, config, false)
+			backward := getHashOfTestState(t, config, true)
+			if forward != backward {
+				t.Errorf("hashes should not depend on insertion order, got %x and %x", forward, backward)
+			}
+		})
+	}
+}
+
+func TestHashFunction_Blake2b256ComputesBlake2bHashes(t *testing.T) {
+	for _, data := range [][]byte{nil, {}, {1, 2, 3}, []byte("some longer input to be hashed")} {
+		if got, want := Blake2b256.Sum(data), common.Hash(blake2b.Sum256(data)); got != want {
+			t.Errorf("unexpected hash of %x, wanted %x, got %x", data, want, got)
+		}
+	}
+	if getEmptyNodeHash(Blake2b256) == EmptyNodeEthereumHash {
+		t.Errorf("empty node hash of blake2b should differ from keccak256")
+	}
+}
+
+func TestHashFunction_Blake2b256HashesAreDeterministic(t *testing.T) {
+	for _, config := range []MptConfig{S5LiveConfig, S5ArchiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			config := withHashFunction(config, Blake2b256)
+			first := getHashOfTestState(t, config, false)
+			second := getHashOfTestState(t, config, false)
+			if first != second {
+				t.Errorf("hashes should be reproducible, got %x and %x", first, second)
+			}
+			if reversed := getHashOfTestState(t, config, true); first != reversed {
+				t.Errorf("hashes should not depend on insertion order, got %x and %x", first, reversed)
+			}
+			if keccak := getHashOfTestState(t, withHashFunction(config, Keccak256), false); first == keccak {
+				t.Errorf("hashes should depend on the hash function, got %x for both", first)
+			}
+		})
+	}
+}
+
+func TestHashFunction_Blake2b256TriesPassChecks(t *testing.T) {
+	for _, config := range []MptConfig{S5LiveConfig, S5ArchiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			config := withHashFunction(config, Blake2b256)
+			state, err := OpenGoMemoryState(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer state.Close()
+			fillTestState(t, state, false)
+			if _, err := state.GetHash(); err != nil {
+				t.Fatalf("failed to get hash: %v", err)
+			}
+			if err := state.trie.Check(); err != nil {
+				t.Errorf("trie hashed using blake2b should be valid, got %v", err)
+			}
+		})
+	}
+}
+
+func TestHashFunction_Blake2b256HashesCanBeVerified(t *testing.T) {
+	config := withHashFunction(S5LiveConfig, Blake2b256)
+	directory := t.TempDir()
+	state, err := OpenGoFileState(directory, config, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	fillTestState(t, state, false)
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+
+	if err := VerifyFileLiveTrie(directory, config, nil); err != nil {
+		t.Errorf("verification with blake2b should pass, got %v", err)
+	}
+	if err := VerifyFileLiveTrie(directory, withHashFunction(S5LiveConfig, sha256Function{}), nil); err == nil {
+		t.Errorf("verification with a different hash function should fail")
+	}
+}
+
+func TestHashFunction_Blake2b256IsRestoredFromJsonEncoding(t *testing.T) {
+	config := withHashFunction(S5LiveConfig, Blake2b256)
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatalf("failed to encode config: %v", err)
+	}
+	var restored MptConfig
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("failed to decode config: %v", err)
+	}
+	if restored.HashFunction != Blake2b256 {
+		t.Errorf("unexpected restored hash function, wanted %v, got %v", Blake2b256, restored.HashFunction)
+	}
+}
+
+func TestHashFunction_Blake2b256DirectoriesCanNotBeOpenedUsingKeccak256(t *testing.T) {
+	config := withHashFunction(S5LiveConfig, Blake2b256)
+	directory := t.TempDir()
+	state, err := OpenGoFileState(directory, config, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	fillTestState(t, state, false)
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+
+	for _, other := range []MptConfig{S5LiveConfig, withHashFunction(S5LiveConfig, Keccak256)} {
+		if trie, err := OpenFileLiveTrie(directory, other, 1024); err == nil {
+			trie.Close()
+			t.Errorf("opening a blake2b directory using keccak256 should fail")
+		}
+	}
+
+	restored, err := ReadConfigFromDirectory(directory)
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	if restored.HashFunction != Blake2b256 {
+		t.Errorf("unexpected hash function recorded in directory, wanted %v, got %v", Blake2b256, restored.HashFunction)
+	}
+	state, err = OpenGoFileState(directory, restored, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state using the recorded config: %v", err)
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+}
+
+func TestHashFunction_AlternativeFunctionHashesTrackModifications(t *testing.T) {
+	for _, config := range []MptConfig{S5LiveConfig, S5ArchiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			state, err := OpenGoMemoryState(t.TempDir(), withHashFunction(config, sha256Function{}), 1024)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer state.Close()
+			fillTestState(t, state, false)
+
+			getHash := func() common.Hash {
+				t.Helper()
+				hash, err := state.GetHash()
+				if err != nil {
+					t.Fatalf("failed to get hash: %v", err)
+				}
+				return hash
+			}
+
+			original := getHash()
+			if err := state.SetStorage(common.Address{1}, common.Key{1}, common.Value{42}); err != nil {
+				t.Fatalf("failed to set storage: %v", err)
+			}
+			if modified := getHash(); modified == original {
+				t.Errorf("modification should change the hash")
+			}
+			if err := state.SetStorage(common.Address{1}, common.Key{1}, common.Value{1}); err != nil {
+				t.Fatalf("failed to set storage: %v", err)
+			}
+			if restored := getHash(); restored != original {
+				t.Errorf("reverting a modification should restore the hash, wanted %x, got %x", original, restored)
+			}
+
+			// An account with cleared storage hashes like one never having storage.
+			withoutStorage := common.Address{0xFF}
+			if err := state.SetNonce(withoutStorage, common.ToNonce(1)); err != nil {
+				t.Fatalf("failed to set nonce: %v", err)
+			}
+			want := getHash()
+			if err := state.SetStorage(withoutStorage, common.Key{1}, common.Value{1}); err != nil {
+				t.Fatalf("failed to set storage: %v", err)
+			}
+			if err := state.SetStorage(withoutStorage, common.Key{1}, common.Value{}); err != nil {
+				t.Fatalf("failed to clear storage: %v", err)
+			}
+			if got := getHash(); want != got {
+				t.Errorf("account with cleared storage should hash like account without storage, wanted %x, got %x", want, got)
+			}
+		})
+	}
+}
+
+func TestHashFunction_AlternativeFunctionIsAppliedOnEncodedRoot(t *testing.T) {
+	for _, config := range []MptConfig{S5LiveConfig, S5ArchiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			state, err := OpenGoMemoryState(t.TempDir(), withHashFunction(config, sha256Function{}), 1024)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer state.Close()
+			fillTestState(t, state, false)
+
+			hash, err := state.GetHash()
+			if err != nil {
+				t.Fatalf("failed to get hash: %v", err)
+			}
+
+			forest := state.trie.forest.(*Forest)
+			root := state.Root()
+			handle, err := forest.getViewAccess(&root)
+			if err != nil {
+				t.Fatalf("failed to get root node: %v", err)
+			}
+			encoded, err := encodeToRlp(handle.Get(), forest, nil)
+			handle.Release()
+			if err != nil {
+				t.Fatalf("failed to encode root node: %v", err)
+			}
+			if want := (sha256Function{}).Sum(encoded); want != hash {
+				t.Errorf("root hash should be the hash of the encoded root, wanted %x, got %x", want, hash)
+			}
+		})
+	}
+}
+
+func TestHashFunction_AlternativeFunctionHashesCanBeVerified(t *testing.T) {
+	config := withHashFunction(S5LiveConfig, sha256Function{})
+	directory := t.TempDir()
+	state, err := OpenGoFileState(directory, config, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	fillTestState(t, state, false)
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+
+	if err := VerifyFileLiveTrie(directory, config, nil); err != nil {
+		t.Errorf("verification with the same hash function should pass, got %v", err)
+	}
+	if err := VerifyFileLiveTrie(directory, S5LiveConfig, nil); err == nil {
+		t.Errorf("verification with a different hash function should fail")
+	}
+}
+
+func TestHashFunction_StreamingStateBuilderUsesAlternativeFunction(t *testing.T) {
+	config := withHashFunction(S5LiveConfig, sha256Function{})
+	reference, err := OpenGoMemoryState(t.TempDir(), config, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer reference.Close()
+	fillTestState(t, reference, false)
+	want, err := reference.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+
+	builder, err := NewStreamingStateBuilder(t.TempDir(), config)
+	if err != nil {
+		t.Fatalf("failed to create builder: %v", err)
+	}
+	if err := addTrieContentToBuilder(reference, builder); err != nil {
+		t.Fatalf("failed to add content to builder: %v", err)
+	}
+	if _, got, err := builder.Finish(); err != nil || want != got {
+		t.Errorf("unexpected hash of built state, wanted %x, got %x, err %v", want, got, err)
+	}
+}
+
+func TestHashFunction_WitnessRecordingRequiresDefaultFunction(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), withHashFunction(S5LiveConfig, sha256Function{}), 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	if err := state.SetWitnessRecording(true); err == nil {
+		t.Errorf("witness recording should not be supported for alternative hash functions")
+	}
+}
+
+// fillTestState adds a set of accounts and storage slots to the given state.
+// If reverse is set, entries are added in reverse order.
+func fillTestState(t *testing.T, state *MptState, reverse bool) {
+	t.Helper()
+	const numAccounts = 50
+	const numSlots = 5
+	for n := 0; n < numAccounts; n++ {
+		i := n
+		if reverse {
+			i = numAccounts - n - 1
+		}
+		address := common.Address{byte(i)}
+		if err := state.SetNonce(address, common.ToNonce(uint64(i+1))); err != nil {
+			t.Fatalf("failed to set nonce: %v", err)
+		}
+		if err := state.SetBalance(address, common.Balance{byte(i)}); err != nil {
+			t.Fatalf("failed to set balance: %v", err)
+		}
+		for j := 0; j < numSlots*(i%3); j++ {
+			if err := state.SetStorage(address, common.Key{byte(j)}, common.Value{byte(i)}); err != nil {
+				t.Fatalf("failed to set storage: %v", err)
+			}
+		}
+	}
+}
+
+func getHashOfTestState(t *testing.T, config MptConfig, reverse bool) common.Hash {
+	t.Helper()
+	state, err := OpenGoMemoryState(t.TempDir(), config, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	fillTestState(t, state, reverse)
+	hash, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+	return hash
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
+)
+
+// hashOverlay is a copy-on-write overlay of a forest used for computing the
+// hash of a trie after an update without modifying the trie. Nodes of the
+// forest are copied into the overlay when being modified or re-hashed, such
+// that only the paths touched by the update are copied. Nodes created by the
+// update are only kept by the overlay, using temporary IDs not allocated in
+// the stocks of the forest. Releasing nodes has no effect, since all nodes of
+// the overlay are discarded with it. Nodes not modified by the update are read
+// from the forest, loading missing nodes into the node cache as for lookups.
+type hashOverlay struct {
+	*Forest
+	mutex     sync.Mutex                      // protecting the overlay nodes, which may be accessed by concurrent hashing
+	nodes     map[NodeId]*shared.Shared[Node] // copies of nodes of the forest and new nodes, by their ID
+	nextIndex uint64                          // the index of the next temporary node ID
+}
+
+// overlayIndexOffset is the first index of the temporary IDs of nodes created
+// in overlays. It exceeds the number of nodes of any stock, while IDs of all
+// node types can be formed from it.
+const overlayIndexOffset = uint64(1) << 59
+
+func newHashOverlay(forest *Forest) *hashOverlay {
+	return &hashOverlay{
+		Forest:    forest,
+		nodes:     map[NodeId]*shared.Shared[Node]{},
+		nextIndex: overlayIndexOffset,
+	}
+}
+
+// lookup returns the overlay's version of the referenced node, nil if the
+// node is not present in the overlay.
+func (o *hashOverlay) lookup(ref *NodeReference) *shared.Shared[Node] {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.nodes[ref.Id()]
+}
+
+// getCopy returns the overlay's version of the referenced node, copying the
+// node of the forest into the overlay if it is not yet present.
+func (o *hashOverlay) getCopy(ref *NodeReference) (*shared.Shared[Node], error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if node, found := o.nodes[ref.Id()]; found {
+		return node, nil
+	}
+	view, err := o.Forest.getViewAccess(ref)
+	if err != nil {
+		return nil, err
+	}
+	defer view.Release()
+	var node Node
+	switch original := view.Get().(type) {
+	case *AccountNode:
+		clone := *original
+		node = &clone
+	case *BranchNode:
+		clone := *original
+		node = &clone
+	case *ExtensionNode:
+		clone := *original
+		node = &clone
+	case *ValueNode:
+		clone := *original
+		node = &clone
+	default:
+		return nil, fmt.Errorf("unable to copy node %v of type %T", ref.Id(), original)
+	}
+	res := shared.MakeShared(node)
+	o.nodes[ref.Id()] = res
+	return res, nil
+}
+
+func (o *hashOverlay) getReadAccess(ref *NodeReference) (shared.ReadHandle[Node], error) {
+	if node := o.lookup(ref); node != nil {
+		return node.GetReadHandle(), nil
+	}
+	return o.Forest.getReadAccess(ref)
+}
+
+func (o *hashOverlay) getViewAccess(ref *NodeReference) (shared.ViewHandle[Node], error) {
+	if node := o.lookup(ref); node != nil {
+		return node.GetViewHandle(), nil
+	}
+	return o.Forest.getViewAccess(ref)
+}
+
+// Empty nodes are immutable and thus shared with the forest, all other nodes
+// are copied before being modified.
+
+func (o *hashOverlay) getHashAccess(ref *NodeReference) (shared.HashHandle[Node], error) {
+	if ref.Id().IsEmpty() {
+		return o.Forest.getHashAccess(ref)
+	}
+	node, err := o.getCopy(ref)
+	if err != nil {
+		return shared.HashHandle[Node]{}, err
+	}
+	return node.GetHashHandle(), nil
+}
+
+func (o *hashOverlay) getWriteAccess(ref *NodeReference) (shared.WriteHandle[Node], error) {
+	if ref.Id().IsEmpty() {
+		return o.Forest.getWriteAccess(ref)
+	}
+	node, err := o.getCopy(ref)
+	if err != nil {
+		return shared.WriteHandle[Node]{}, err
+	}
+	return node.GetWriteHandle(), nil
+}
+
+func (o *hashOverlay) getHashFor(ref *NodeReference) (common.Hash, error) {
+	return o.hasher.getHash(ref, o)
+}
+
+func (o *hashOverlay) createAccount() (NodeReference, shared.WriteHandle[Node], error) {
+	return o.createNode(AccountId, new(AccountNode))
+}
+
+func (o *hashOverlay) createBranch() (NodeReference, shared.WriteHandle[Node], error) {
+	return o.createNode(BranchId, new(BranchNode))
+}
+
+func (o *hashOverlay) createExtension() (NodeReference, shared.WriteHandle[Node], error) {
+	return o.createNode(ExtensionId, new(ExtensionNode))
+}
+
+func (o *hashOverlay) createValue() (NodeReference, shared.WriteHandle[Node], error) {
+	return o.createNode(ValueId, new(ValueNode))
+}
+
+func (o *hashOverlay) createNode(toId func(uint64) NodeId, node Node) (NodeReference, shared.WriteHandle[Node], error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	ref := NewNodeReference(toId(o.nextIndex))
+	o.nextIndex++
+	instance := shared.MakeShared(node)
+	o.nodes[ref.Id()] = instance
+	return ref, instance.GetWriteHandle(), nil
+}
+
+func (o *hashOverlay) release(*NodeReference) error {
+	return nil
+}
+
+func (o *hashOverlay) releaseBatch([]NodeReference) error {
+	return nil
+}
+
+func (o *hashOverlay) releaseTrieAsynchronous(NodeReference) {}
+
+func (o *hashOverlay) trackDirtyNode(*NodeReference, bool) {}
+
+// tryDeferSlotDeletion makes deleted slots being removed immediately, since
+// overlays are not updated in batches.
+func (o *hashOverlay) tryDeferSlotDeletion() bool {
+	return false
+}
+
+func (o *hashOverlay) GetAccountInfo(rootRef *NodeReference, addr common.Address) (AccountInfo, bool, error) {
+	return o.getAccountInfo(o, rootRef, addr)
+}
+
+func (o *hashOverlay) GetValue(rootRef *NodeReference, addr common.Address, key common.Key) (common.Value, error) {
+	return o.getValue(o, rootRef, addr, key)
+}
+
+func (o *hashOverlay) SetAccountInfo(rootRef *NodeReference, addr common.Address, info AccountInfo) (NodeReference, error) {
+	return o.setAccountInfo(o, rootRef, addr, info)
+}
+
+// Unlike the forest, the overlay does not record the deletion of slots or the
+// weights of storage tries, since updates are not applied to the forest.
+
+func (o *hashOverlay) SetValue(rootRef *NodeReference, addr common.Address, key common.Key, value common.Value) (NodeReference, error) {
+	root, err := o.getWriteAccess(rootRef)
+	if err != nil {
+		return NodeReference{}, err
+	}
+	defer root.Release()
+	buffer := getNibblePathBuffer()
+	defer buffer.release()
+	path := buffer.setAddress(addr, o)
+	newRoot, _, err := root.Get().SetSlot(o, rootRef, root, addr, path[:], key, value)
+	if err != nil {
+		return NodeReference{}, fmt.Errorf("failed to update value for %v/%v: %w", addr, key, err)
+	}
+	return newRoot, nil
+}
+
+func (o *hashOverlay) SetSlots(rootRef *NodeReference, addr common.Address, updates []SlotUpdate) (NodeReference, bool, error) {
+	root, err := o.getWriteAccess(rootRef)
+	if err != nil {
+		return NodeReference{}, false, err
+	}
+	defer root.Release()
+	buffer := getNibblePathBuffer()
+	defer buffer.release()
+	path := buffer.setAddress(addr, o)
+	newRoot, changed, err := root.Get().SetSlots(o, rootRef, root, addr, path[:], updates)
+	if err != nil {
+		return NodeReference{}, false, fmt.Errorf("failed to update values of %v: %w", addr, err)
+	}
+	return newRoot, changed || newRoot != *rootRef, nil
+}
+
+func (o *hashOverlay) ClearStorage(rootRef *NodeReference, addr common.Address) (NodeReference, error) {
+	root, err := o.getWriteAccess(rootRef)
+	if err != nil {
+		return NodeReference{}, err
+	}
+	defer root.Release()
+	buffer := getNibblePathBuffer()
+	defer buffer.release()
+	path := buffer.setAddress(addr, o)
+	newRoot, _, err := root.Get().ClearStorage(o, rootRef, root, addr, path[:])
+	if err != nil {
+		return NodeReference{}, fmt.Errorf("failed to clear storage for %v: %w", addr, err)
+	}
+	return newRoot, nil
+}
+
+func (o *hashOverlay) HasEmptyStorage(rootRef *NodeReference, addr common.Address) (isEmpty bool, err error) {
+	v := MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+		if a, ok := node.(*AccountNode); ok {
+			isEmpty = a.storage.Id().IsEmpty()
+			return VisitResponseAbort
+		}
+		return VisitResponseContinue
+	})
+	exists, err := VisitPathToAccount(o, rootRef, addr, v)
+	return isEmpty || !exists, err
+}
+
+func (o *hashOverlay) HasAccount(rootRef *NodeReference, addr common.Address) (bool, error) {
+	return VisitPathToAccount(o, rootRef, addr, MakeVisitor(func(Node, NodeInfo) VisitResponse {
+		return VisitResponseContinue
+	}))
+}
+
+func (o *hashOverlay) updateHashesFor(ref *NodeReference) (common.Hash, *NodeHashes, error) {
+	return o.hasher.updateHashes(ref, o, nil)
+}
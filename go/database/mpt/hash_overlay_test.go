@@ -0,0 +1,253 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"maps"
+	"math/rand"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
+)
+
+func TestLiveTrie_HashAfterUpdate_ProducesHashOfAppliedUpdateWithoutModifyingTrie(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			state, err := OpenGoMemoryState(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer state.Close()
+			fillForkTestState(t, state, 0, 1)
+			if err := state.SetCode(common.Address{3}, []byte{1, 2, 3}); err != nil {
+				t.Fatalf("failed to set code: %v", err)
+			}
+
+			update := common.Update{}
+			update.AppendDeleteAccount(common.Address{1})
+			update.AppendCreateAccount(common.Address{2})
+			update.AppendCreateAccount(common.Address{0, 1})
+			update.AppendBalanceUpdate(common.Address{0, 1}, common.Balance{12})
+			update.AppendNonceUpdate(common.Address{4}, common.ToNonce(7))
+			update.AppendCodeUpdate(common.Address{3}, []byte{4, 5})
+			update.AppendSlotUpdate(common.Address{0, 1}, common.Key{1}, common.Value{1})
+			update.AppendSlotUpdate(common.Address{5}, common.Key{1}, common.Value{2})
+			update.AppendSlotUpdate(common.Address{5}, common.Key{2}, common.Value{})
+			update.AppendSlotUpdate(common.Address{6}, common.Key{20}, common.Value{3})
+			if err := update.Normalize(); err != nil {
+				t.Fatalf("failed to normalize update: %v", err)
+			}
+
+			before, err := state.GetHash()
+			if err != nil {
+				t.Fatalf("failed to get hash: %v", err)
+			}
+			dirty := state.trie.GetDirtyNodeCount()
+
+			want := common.Hash{}
+			for i := 0; i < 3; i++ {
+				got, err := state.trie.HashAfterUpdate(update)
+				if err != nil {
+					t.Fatalf("failed to compute hash after update: %v", err)
+				}
+				if i > 0 && got != want {
+					t.Errorf("hash after update is not deterministic, wanted %x, got %x", want, got)
+				}
+				want = got
+			}
+			if want == before {
+				t.Errorf("hash after update should differ from current hash")
+			}
+
+			// The trie and its nodes are not modified.
+			if got, err := state.GetHash(); err != nil || got != before {
+				t.Errorf("unexpected hash after computing hash of update, wanted %x, got %x, err %v", before, got, err)
+			}
+			if got := state.trie.GetDirtyNodeCount(); got != dirty {
+				t.Errorf("unexpected number of dirty nodes, wanted %d, got %d", dirty, got)
+			}
+			checkForkTestState(t, state, 1)
+			if err := state.trie.Check(); err != nil {
+				t.Errorf("trie is inconsistent: %v", err)
+			}
+
+			// The predicted hash is the hash obtained by applying the update.
+			if _, err := state.Apply(1, update); err != nil {
+				t.Fatalf("failed to apply update: %v", err)
+			}
+			if got, err := state.GetHash(); err != nil || got != want {
+				t.Errorf("unexpected hash after applying update, wanted %x, got %x, err %v", want, got, err)
+			}
+		})
+	}
+}
+
+func TestLiveTrie_HashAfterUpdate_EmptyUpdateProducesCurrentHash(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	fillForkTestState(t, state, 0, 1)
+	want, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+	if got, err := state.trie.HashAfterUpdate(common.Update{}); err != nil || got != want {
+		t.Errorf("unexpected hash after empty update, wanted %x, got %x, err %v", want, got, err)
+	}
+}
+
+func TestLiveTrie_HashAfterUpdate_NodeCacheAndStocksAreNotModified(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 100_000)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	fillForkTestState(t, state, 0, 1)
+	// Deleting accounts puts the IDs of their nodes on the freelists.
+	for i := 100; i < 120; i++ {
+		if err := state.DeleteAccount(common.Address{byte(i)}); err != nil {
+			t.Fatalf("failed to delete account: %v", err)
+		}
+	}
+	// Dirty hashes of the trie are not updated in place either.
+	if err := state.SetBalance(common.Address{7}, common.Balance{2}); err != nil {
+		t.Fatalf("failed to set balance: %v", err)
+	}
+
+	update := common.Update{}
+	update.AppendDeleteAccount(common.Address{1})
+	update.AppendCreateAccount(common.Address{0, 1})
+	update.AppendBalanceUpdate(common.Address{0, 1}, common.Balance{12})
+	update.AppendSlotUpdate(common.Address{0, 1}, common.Key{1}, common.Value{1})
+	update.AppendSlotUpdate(common.Address{5}, common.Key{1}, common.Value{})
+	update.AppendSlotUpdate(common.Address{6}, common.Key{20}, common.Value{3})
+	if err := update.Normalize(); err != nil {
+		t.Fatalf("failed to normalize update: %v", err)
+	}
+
+	// The storage of deleted accounts is released in the background.
+	forest := state.trie.forest.(*Forest)
+	forest.releaseQueue <- EmptyId()
+	<-forest.releaseSync
+
+	before := getForestContent(t, forest)
+	if _, err := state.trie.HashAfterUpdate(update); err != nil {
+		t.Fatalf("failed to compute hash after update: %v", err)
+	}
+	after := getForestContent(t, forest)
+
+	if !maps.Equal(before.cached, after.cached) {
+		t.Errorf("content of node cache has changed, %d nodes before, %d nodes after", len(before.cached), len(after.cached))
+	}
+	for i := range before.ids {
+		if before.sizes[i] != after.sizes[i] {
+			t.Errorf("size of stock %d has changed from %d to %d", i, before.sizes[i], after.sizes[i])
+		}
+		if !maps.Equal(before.ids[i], after.ids[i]) {
+			t.Errorf("allocated IDs of stock %d have changed, freelist was modified", i)
+		}
+	}
+	if want, got := before.dirty, after.dirty; want != got {
+		t.Errorf("unexpected number of dirty nodes, wanted %d, got %d", want, got)
+	}
+}
+
+func TestLiveTrie_HashAfterUpdate_MatchesHashOfAppliedRandomUpdates(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			state, err := OpenGoMemoryState(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer state.Close()
+
+			r := rand.New(rand.NewSource(42))
+			for block := uint64(0); block < 20; block++ {
+				update := common.Update{}
+				accounts := map[common.Address]bool{}
+				for i := 0; i < 20; i++ {
+					addr := common.Address{byte(r.Intn(32))}
+					if accounts[addr] {
+						continue
+					}
+					accounts[addr] = true
+					switch r.Intn(4) {
+					case 0:
+						update.AppendDeleteAccount(addr)
+					case 1:
+						update.AppendCreateAccount(addr)
+						update.AppendNonceUpdate(addr, common.ToNonce(block+1))
+					default:
+						update.AppendBalanceUpdate(addr, common.Balance{byte(r.Intn(4))})
+					}
+					for key := 0; key < 16; key++ {
+						if r.Intn(4) == 0 {
+							update.AppendSlotUpdate(addr, common.Key{byte(key)}, common.Value{byte(r.Intn(3))})
+						}
+					}
+				}
+				if err := update.Normalize(); err != nil {
+					t.Fatalf("failed to normalize update: %v", err)
+				}
+
+				want, err := state.trie.HashAfterUpdate(update)
+				if err != nil {
+					t.Fatalf("failed to compute hash after update of block %d: %v", block, err)
+				}
+				if _, err := state.Apply(block, update); err != nil {
+					t.Fatalf("failed to apply update of block %d: %v", block, err)
+				}
+				if got, err := state.GetHash(); err != nil || got != want {
+					t.Fatalf("unexpected hash after applying update of block %d, wanted %x, got %x, err %v", block, want, got, err)
+				}
+			}
+		})
+	}
+}
+
+// forestContent summarizes the state of a forest affected by updates.
+type forestContent struct {
+	dirty  int
+	cached map[NodeId]bool
+	sizes  [4]uint64
+	ids    [4]map[uint64]bool
+}
+
+func getForestContent(t *testing.T, forest *Forest) forestContent {
+	t.Helper()
+	res := forestContent{dirty: forest.GetDirtyNodeCount(), cached: map[NodeId]bool{}}
+	forest.nodeCache.ForEach(func(id NodeId, _ *shared.Shared[Node]) {
+		res.cached[id] = true
+	})
+	for i, ids := range []func() (stock.IndexSet[uint64], error){
+		forest.accounts.GetIds,
+		forest.branches.GetIds,
+		forest.extensions.GetIds,
+		forest.values.GetIds,
+	} {
+		set, err := ids()
+		if err != nil {
+			t.Fatalf("failed to get IDs of stock: %v", err)
+		}
+		res.sizes[i] = set.GetUpperBound()
+		res.ids[i] = map[uint64]bool{}
+		for id := set.GetLowerBound(); id < set.GetUpperBound(); id++ {
+			if set.Contains(id) {
+				res.ids[i][id] = true
+			}
+		}
+	}
+	return res
+}
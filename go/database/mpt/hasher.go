@@ -21,6 +21,7 @@ import (
 	"github.com/Fantom-foundation/Carmen/go/common"
 	"github.com/Fantom-foundation/Carmen/go/database/mpt/rlp"
 	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
+	"golang.org/x/crypto/blake2b"
 )
 
 // ----------------------------------------------------------------------------
@@ -32,29 +33,111 @@ import (
 // configuration parameter in the MPT Config.
 type hashAlgorithm struct {
 	Name         string
-	createHasher func() hasher
+	createHasher func(HashFunction) hasher
 }
 
 // DirectHashing is a simple, fast hashing algorithm which is taking a simple
 // serialization of node content or the hashes of referenced nodes to compute
-// the hash of individual nodes.
+// the hash of individual nodes. It is always using SHA256 and ignores the
+// hash function of the MptConfig.
 var DirectHashing = hashAlgorithm{
 	Name:         "DirectHashing",
-	createHasher: makeDirectHasher,
+	createHasher: func(HashFunction) hasher { return makeDirectHasher() },
 }
 
 // EthereumLikeHashing is an implementation following the specification of the
-// State and Storage Trie hashing as defined in Ethereum's yellow paper.
+// State and Storage Trie hashing as defined in Ethereum's yellow paper. The
+// 32-byte hash function applied on encoded nodes is taken from the MptConfig,
+// defaulting to keccak256 as used by Ethereum.
 var EthereumLikeHashing = hashAlgorithm{
 	Name:         "EthereumLikeHashing",
-	createHasher: makeEthereumLikeHasher,
+	createHasher: makeEthereumLikeHasherWith,
 }
 
+// HashFunction is a 32-byte hash function used for computing the hashes of
+// nodes from their encoding.
+type HashFunction interface {
+	Sum(data []byte) common.Hash
+}
+
+// Keccak256 is the hash function used by Ethereum and the default for all
+// MPT configurations.
+var Keccak256 HashFunction = keccak256{}
+
+type keccak256 struct{}
+
+func (keccak256) Sum(data []byte) common.Hash {
+	return common.Keccak256(data)
+}
+
+func (keccak256) hashFunctionName() string {
+	return "Keccak256"
+}
+
+// Blake2b256 is an alternative hash function for chains not requiring
+// compatibility with Ethereum's state root hashes. The resulting hashes
+// differ from Ethereum's, but tries remain internally consistent.
+var Blake2b256 HashFunction = blake2b256{}
+
+type blake2b256 struct{}
+
+func (blake2b256) Sum(data []byte) common.Hash {
+	return blake2b.Sum256(data)
+}
+
+func (blake2b256) hashFunctionName() string {
+	return "Blake2b256"
+}
+
+// getHashFunctionName returns the name of the given hash function as recorded
+// in the meta-data of MPT directories. Hash functions provided by this package
+// are named explicitly, others by the name of their type. A nil function is
+// named like the default, Keccak256.
+func getHashFunctionName(hash HashFunction) string {
+	if hash == nil {
+		hash = Keccak256
+	}
+	if named, ok := hash.(interface{ hashFunctionName() string }); ok {
+		return named.hashFunctionName()
+	}
+	return reflect.TypeOf(hash).String()
+}
+
+// getHashFunctionByName resolves the hash function of the given name. Since
+// custom hash functions can not be resolved, a placeholder retaining the name
+// is returned for those, which can not be used for hashing.
+func getHashFunctionByName(name string) HashFunction {
+	for _, hash := range []HashFunction{Keccak256, Blake2b256} {
+		if getHashFunctionName(hash) == name {
+			return hash
+		}
+	}
+	return unresolvedHashFunction(name)
+}
+
+// unresolvedHashFunction is a placeholder for a custom hash function recorded
+// in the meta-data of an MPT directory.
+type unresolvedHashFunction string
+
+func (f unresolvedHashFunction) Sum([]byte) common.Hash {
+	panic(fmt.Sprintf("hash function %s is not available", string(f)))
+}
+
+func (f unresolvedHashFunction) hashFunctionName() string {
+	return string(f)
+}
+
+// NodeHashObserver is a callback informed about the new hash of each node
+// hashed while refreshing the hashes of a trie. Observers are intended for
+// progress reporting and telemetry and have no effect on computed hashes.
+type NodeHashObserver func(id NodeId, hash common.Hash)
+
 // hasher is an entity retaining hashing information for individual nodes,
 // computing them as required.
 type hasher interface {
 	// updateHash refreshes the hash of the given node and all nested nodes.
-	updateHashes(root *NodeReference, nodes NodeManager) (common.Hash, *NodeHashes, error)
+	// If the given observer is not nil, it is called for each hashed node.
+	updateHashes(root *NodeReference, nodes NodeManager, observer NodeHashObserver) (common.Hash, *NodeHashes, error)
 
 	// getHash computes the hash of the node without modifying it. It is used
 	// for debugging, when checking a trie without the intend of modifying it.
@@ -80,8 +163,8 @@ type directHasher struct{}
 
 // updateHashes implements the DirectHasher's hashing algorithm to refresh
 // the hashes stored within all nodes reachable from the given node.
-func (h directHasher) updateHashes(ref *NodeReference, source NodeManager) (common.Hash, *NodeHashes, error) {
-	hashCollector := &nodeHashCollector{hashes: NewNodeHashes()}
+func (h directHasher) updateHashes(ref *NodeReference, source NodeManager, observer NodeHashObserver) (common.Hash, *NodeHashes, error) {
+	hashCollector := &nodeHashCollector{hashes: NewNodeHashes(), observer: observer}
 	hash, err := h.updateHashesInternal(ref, source, EmptyPath(), hashCollector)
 	return hash, hashCollector.GetHashes(), err
 }
@@ -222,7 +305,7 @@ func (h directHasher) hash(
 	}
 	hasher.Sum(hash[0:0])
 	if hashCollector != nil {
-		hashCollector.Add(path, hash)
+		hashCollector.Add(ref.Id(), path, hash)
 	}
 	return hash, nil
 }
@@ -239,18 +322,100 @@ func (h directHasher) isEmbedded(Node, NodeSource) (bool, error) {
 // Ethereum's State and Storage Trie specification.
 // See Appendix D of https://ethereum.github.io/yellowpaper/paper.pdf
 func makeEthereumLikeHasher() hasher {
-	return &ethHasher{}
+	return makeEthereumLikeHasherWith(Keccak256)
+}
+
+// makeEthereumLikeHasherWith is a variant of makeEthereumLikeHasher using the
+// given hash function instead of keccak256. If nil, keccak256 is used.
+func makeEthereumLikeHasherWith(hash HashFunction) hasher {
+	if hash == nil {
+		hash = Keccak256
+	}
+	return &ethHasher{
+		hash:          hash,
+		emptyNodeHash: getEmptyNodeHash(hash),
+	}
+}
+
+type ethHasher struct {
+	hash          HashFunction // the function hashing encoded nodes
+	emptyNodeHash common.Hash  // the hash of the empty node using the hash function above
+
+	// If enabled, hash information taken from caches while updating hashes,
+	// like the hashes and embedded flags of clean child nodes, is verified by
+	// re-computing it. Since this is expensive and defeats the purpose of the
+	// caches, it is only intended to be used in tests.
+	crossCheckCachedHashes bool
+
+	// If enabled, value nodes lacking the hash of their key retain it when
+	// being hashed, such that it is persisted with the node and does not
+	// need to be re-computed by subsequent hashing or proof operations.
+	retainHashedKeys bool
+
+	// If enabled, the path lengths stored in leaf nodes, determining the
+	// encoding of the leaves, are checked against the depth at which the
+	// leaves are hashed. Mismatches are reported as errors instead of
+	// producing wrong hashes. Intended for debugging.
+	checkLeafPathLengths bool
+}
+
+const cachedHashMismatchErr = common.ConstError("cached hash information does not match node content")
+const leafPathLengthMismatchErr = common.ConstError("path length of leaf does not match its depth")
+
+// enableCachedHashCrossChecks enables the verification of cached hash
+// information in the given hasher, if supported. For testing only.
+func enableCachedHashCrossChecks(h hasher) {
+	if h, ok := h.(*ethHasher); ok {
+		h.crossCheckCachedHashes = true
+	}
+}
+
+// enableLeafPathLengthChecks enables the verification of the path lengths
+// of leaf nodes in the given hasher, if supported.
+func enableLeafPathLengthChecks(h hasher) {
+	if h, ok := h.(*ethHasher); ok {
+		h.checkLeafPathLengths = true
+	}
+}
+
+// enableHashedKeyRetention enables the retention of hashed keys in value
+// nodes by the given hasher, if supported.
+func enableHashedKeyRetention(h hasher) {
+	if h, ok := h.(*ethHasher); ok {
+		h.retainHashedKeys = true
+	}
 }
 
-type ethHasher struct{}
+// EmptyNodeEthereumHash is the hash of an empty trie in Ethereum, as produced
+// by EthereumLikeHashing using the default hash function.
+var EmptyNodeEthereumHash = getEmptyNodeHash(Keccak256)
+
+// EmptyStateRootHash returns the root hash of an empty state in the given
+// configuration. For EthereumLikeHashing, this is the hash of the empty node
+// using the configured hash function, which for the default keccak256 is the
+// empty root hash of Ethereum. DirectHashing uses the zero hash.
+func EmptyStateRootHash(config MptConfig) common.Hash {
+	if config.Hashing.Name == EthereumLikeHashing.Name {
+		return getEmptyNodeHash(config.HashFunction)
+	}
+	return common.Hash{}
+}
 
-var EmptyNodeEthereumHash = common.Keccak256(rlp.Encode(rlp.String{}))
+// getEmptyNodeHash computes the hash of the empty node, and thus of empty
+// tries, produced by EthereumLikeHashing using the given hash function.
+func getEmptyNodeHash(hash HashFunction) common.Hash {
+	if hash == nil {
+		hash = Keccak256
+	}
+	return hash.Sum(rlp.Encode(rlp.String{}))
+}
 
 func (h ethHasher) updateHashes(
 	ref *NodeReference,
 	manager NodeManager,
+	observer NodeHashObserver,
 ) (common.Hash, *NodeHashes, error) {
-	hashCollector := &nodeHashCollector{hashes: NewNodeHashes()}
+	hashCollector := &nodeHashCollector{hashes: NewNodeHashes(), observer: observer}
 	hash, err := h.updateHashesInternal(ref, manager, hashCollector)
 	return hash, hashCollector.GetHashes(), err
 }
@@ -261,7 +426,7 @@ func (h ethHasher) updateHashesInternal(
 	hashCollector *nodeHashCollector,
 ) (common.Hash, error) {
 	if ref.Id().IsEmpty() {
-		return EmptyNodeEthereumHash, nil
+		return h.emptyNodeHash, nil
 	}
 
 	type task struct {
@@ -269,12 +434,9 @@ func (h ethHasher) updateHashesInternal(
 		handle shared.HashHandle[Node]
 		step   int
 		path   NodePath
+		depth  int // the number of nibbles of the path to the node in its trie
 	}
 
-	storesHashesInNodes := manager.getConfig().HashStorageLocation == HashStoredWithNode
-
-	embedded := map[NodeId]bool{}
-
 	tasks := make([]task, 0, 128)
 
 	var err error
@@ -298,51 +460,62 @@ func (h ethHasher) updateHashesInternal(
 			dirty := false
 			hash, dirty = node.GetHash()
 			if !dirty {
-
-				if storesHashesInNodes {
-					// If the hashes are stored in nodes, not with the parents, embedded
-					// flags in parent nodes may not be valid even for child nodes with
-					// up-to-date hashes. Thus, whether the nodes is embedded or not
-					// needs to be computed for all child nodes.
-					if res, e := h.isEmbedded(handle.Get(), manager); err != nil {
-						cur.handle.Release()
+				// The embedded state of nodes is derived from their hashes by
+				// parents, without re-evaluating the node's encoding, which may
+				// require loading its own children (see isEmbeddedHash).
+				if h.crossCheckCachedHashes {
+					if want, e := h.isEmbedded(node, manager); e != nil {
+						handle.Release()
 						err = e
 						break
-					} else if res {
-						embedded[cur.node.Id()] = true
+					} else if got := isEmbeddedHash(hash); want != got {
+						handle.Release()
+						err = fmt.Errorf("%w: embedded flag of node %v derived from its hash is %t, should be %t", cachedHashMismatchErr, cur.node.Id(), got, want)
+						break
 					}
 				}
-
 				handle.Release()
 				continue
 			}
 
+			if h.checkLeafPathLengths {
+				if e := checkLeafPathLength(cur.node.Id(), node, cur.depth, manager); e != nil {
+					handle.Release()
+					err = e
+					break
+				}
+			}
+
 			// The node's hash needs to be refreshed. To do so, schedule
 			// the re-hashing of all children with dirty hashes followed
 			// by a second pass of this node. Note: the task list is a
 			// last-in-first-out stack.
-			tasks = append(tasks, task{cur.node, handle, 1, cur.path})
+			tasks = append(tasks, task{cur.node, handle, 1, cur.path, cur.depth})
 
 			switch node := node.(type) {
 			case *BranchNode:
 				for i := 0; i < len(node.children); i++ {
 					if !node.children[i].Id().IsEmpty() && node.isChildHashDirty(byte(i)) {
-						tasks = append(tasks, task{node: &node.children[i], path: cur.path.Child(Nibble(i))})
+						tasks = append(tasks, task{node: &node.children[i], path: cur.path.Child(Nibble(i)), depth: cur.depth + 1})
 					}
 				}
 			case *ExtensionNode:
 				if node.nextHashDirty {
-					tasks = append(tasks, task{node: &node.next, path: cur.path.Next()})
+					tasks = append(tasks, task{node: &node.next, path: cur.path.Next(), depth: cur.depth + node.path.Length()})
 				}
 			case *AccountNode:
 				if node.storageHashDirty {
 					if node.storage.Id().IsEmpty() {
-						node.storageHash = EmptyNodeEthereumHash
+						node.storageHash = h.emptyNodeHash
 						node.storageHashDirty = false
 					} else {
 						tasks = append(tasks, task{node: &node.storage, path: cur.path.Next()})
 					}
 				}
+			case *ValueNode:
+				if h.retainHashedKeys {
+					node.retainHashedKey(manager)
+				}
 			}
 		} else {
 			// At this point the hashes of all children are up-to-date.
@@ -362,8 +535,15 @@ func (h ethHasher) updateHashesInternal(
 							panic("FATAL: detected dirty child of branch node\n")
 						}
 						cur.hashes[i] = hash
-						cur.setEmbedded(byte(i), embedded[cur.children[i].Id()])
+						cur.setEmbedded(byte(i), isEmbeddedHash(hash))
 						handle.Release()
+					} else if h.crossCheckCachedHashes && !cur.children[i].Id().IsEmpty() {
+						// The cached hash and embedded flag of clean children are
+						// used without loading the child. Make sure this is valid.
+						if e := h.checkCachedChildHash(cur, i, manager); e != nil {
+							err = e
+							break
+						}
 					}
 				}
 				cur.clearChildHashDirtyFlags()
@@ -378,7 +558,7 @@ func (h ethHasher) updateHashesInternal(
 					if dirty {
 						panic("FATAL: detected dirty child of extension node\n")
 					}
-					cur.nextIsEmbedded = embedded[cur.next.Id()]
+					cur.nextIsEmbedded = isEmbeddedHash(hash)
 					cur.nextHash = hash
 					handle.Release()
 					cur.nextHashDirty = false
@@ -401,14 +581,13 @@ func (h ethHasher) updateHashesInternal(
 			}
 
 			// Test whether this node is to be embedded.
-			if res, e := h.isEmbedded(cur.handle.Get(), manager); err != nil {
+			if res, e := h.isEmbedded(cur.handle.Get(), manager); e != nil {
 				cur.handle.Release()
 				err = e
 				break
 			} else if res {
-				// Fix hash of embedded nodes to be 0.
+				// Fix hash of embedded nodes to be 0 (see isEmbeddedHash).
 				hash = common.Hash{}
-				embedded[cur.node.Id()] = true
 			} else {
 				// Encode the node using RLP and compute its hash.
 				data, e := encodeToRlp(node, manager, data)
@@ -417,13 +596,13 @@ func (h ethHasher) updateHashesInternal(
 					err = e
 					break
 				}
-				hash = common.Keccak256(data)
+				hash = h.hash.Sum(data)
 			}
 
 			node.SetHash(hash)
 
 			if hashCollector != nil {
-				hashCollector.Add(cur.path, hash)
+				hashCollector.Add(cur.node.Id(), cur.path, hash)
 			}
 
 			cur.handle.Release()
@@ -439,9 +618,87 @@ func (h ethHasher) updateHashesInternal(
 	return hash, err
 }
 
+// checkLeafPathLength checks that the path length stored in the given node,
+// if it is a leaf, matches the depth at which it is located in its trie. Only
+// configurations tracking suffix lengths in leaf nodes are checked.
+func checkLeafPathLength(id NodeId, node Node, depth int, source NodeSource) error {
+	config := source.getConfig()
+	if !config.TrackSuffixLengthsInLeafNodes {
+		return nil
+	}
+	var stored byte
+	var want int
+	switch node := node.(type) {
+	case *AccountNode:
+		stored, want = node.pathLength, 2*len(common.Address{})-depth
+		if config.UseHashedPaths {
+			want = 2*len(common.Hash{}) - depth
+		}
+	case *ValueNode:
+		stored, want = node.pathLength, 2*len(common.Key{})-depth
+	default:
+		return nil
+	}
+	if int(stored) != want {
+		return fmt.Errorf("%w: node %v hashed at depth %d, expected path length %d, stored %d", leafPathLengthMismatchErr, id, depth, want, stored)
+	}
+	return nil
+}
+
+// isEmbeddedHash determines whether a node with the given up-to-date hash is
+// embedded in its parent. When updating hashes, embedded nodes get a zero
+// hash assigned, which is not a valid hash of any other node. By deriving the
+// embedded flags of parents from the hashes of their children, the flags get
+// flipped whenever the encoding of a child crosses the 32-byte limit -- e.g.
+// a value node with a growing or shrinking value -- no matter whether the
+// child got re-hashed during the current update or before -- for instance,
+// a clean child may have been moved to a new parent while restructuring the
+// trie.
+func isEmbeddedHash(hash common.Hash) bool {
+	return hash == common.Hash{}
+}
+
+// checkCachedChildHash verifies that the hash and embedded flag cached in the
+// given branch node for the child at the given position match the child. If
+// the child has an up-to-date hash, this hash is used as a reference, since
+// nodes loaded from disk may lack the hashes of their own children. Otherwise,
+// the hash is re-computed from the content of the child. It is only used if
+// cross-checks of cached hashes are enabled.
+func (h ethHasher) checkCachedChildHash(node *BranchNode, i int, source NodeSource) error {
+	child := &node.children[i]
+	handle, err := source.getViewAccess(child)
+	if err != nil {
+		return err
+	}
+	want, dirty := handle.Get().GetHash()
+	embedded := isEmbeddedHash(want)
+	if dirty {
+		embedded, err = h.isEmbedded(handle.Get(), source)
+	}
+	handle.Release()
+	if err != nil {
+		return err
+	}
+	if got := node.isEmbedded(byte(i)); embedded != got {
+		return fmt.Errorf("%w: embedded flag of child %v is %t, should be %t", cachedHashMismatchErr, child.Id(), got, embedded)
+	}
+	if embedded {
+		return nil
+	}
+	if dirty {
+		if want, err = h.getHash(child, source); err != nil {
+			return err
+		}
+	}
+	if got := node.hashes[i]; want != got {
+		return fmt.Errorf("%w: hash of child %v is %x, should be %x", cachedHashMismatchErr, child.Id(), got, want)
+	}
+	return nil
+}
+
 func (h ethHasher) getHash(ref *NodeReference, source NodeSource) (common.Hash, error) {
 	if ref.Id().IsEmpty() {
-		return EmptyNodeEthereumHash, nil
+		return h.emptyNodeHash, nil
 	}
 	// Get read access to the node (hashes may not be updated).
 	handle, err := source.getViewAccess(ref)
@@ -465,7 +722,7 @@ func (h ethHasher) getHash(ref *NodeReference, source NodeSource) (common.Hash,
 		return hash, nil
 	}
 
-	return common.Keccak256(data), nil
+	return h.hash.Sum(data), nil
 }
 
 // encodeToRlp computes the RLP encoding of the given node. If needed, additional nodes are
@@ -632,7 +889,12 @@ func encodeAccountToRlp(
 	items[0] = rlp.Uint64{Value: node.info.Nonce.ToUint64()}
 	items[1] = rlp.BigInt{Value: node.info.Balance.ToBigInt()}
 	if storageRoot.Id().IsEmpty() {
-		items[2] = rlp.Hash{Hash: &EmptyNodeEthereumHash}
+		emptyStorageHash := &EmptyNodeEthereumHash
+		if hash := source.getConfig().HashFunction; hash != nil {
+			custom := getEmptyNodeHash(hash)
+			emptyStorageHash = &custom
+		}
+		items[2] = rlp.Hash{Hash: emptyStorageHash}
 	} else {
 		items[2] = rlp.Hash{Hash: &node.storageHash}
 	}
@@ -680,7 +942,8 @@ func encodeValueToRlp(
 	// The first item is an encoded path fragment.
 	encodedPathPtr := rlpEncodingBufferPool.Get().(*[]byte)
 	encodedPath := *encodedPathPtr
-	items[0] = &rlp.String{Str: encodeKeyPath(node.key, int(node.pathLength), source, encodedPath)}
+	hashedKey := node.getHashedKey(source)
+	items[0] = &rlp.String{Str: encodePathSuffix(hashedKey, int(node.pathLength), encodedPath)}
 
 	// The second item is the value without leading zeros.
 	value := node.value[:]
@@ -702,13 +965,13 @@ func encodeValueToRlp(
 	return res, nil
 }
 
-func encodeKeyPath(key common.Key, numNibbles int, nodes NodeSource, target []byte) []byte {
-	path := nodes.hashKey(key)
-	return encodePartialPath(path[32-(numNibbles/2+numNibbles%2):], numNibbles, true, target)
+func encodeAddressPath(address common.Address, numNibbles int, nodes NodeSource, target []byte) []byte {
+	return encodePathSuffix(nodes.hashAddress(address), numNibbles, target)
 }
 
-func encodeAddressPath(address common.Address, numNibbles int, nodes NodeSource, target []byte) []byte {
-	path := nodes.hashAddress(address)
+// encodePathSuffix encodes the last numNibbles nibbles of the given hashed
+// path as the partial path of a leaf node.
+func encodePathSuffix(path common.Hash, numNibbles int, target []byte) []byte {
 	return encodePartialPath(path[32-(numNibbles/2+numNibbles%2):], numNibbles, true, target)
 }
 
@@ -889,11 +1152,15 @@ func getLowerBoundForEncodedSizeValue(node *ValueNode, limit int, nodes NodeSour
 }
 
 type nodeHashCollector struct {
-	hashes *NodeHashes
+	hashes   *NodeHashes
+	observer NodeHashObserver // optional, may be nil
 }
 
-func (n *nodeHashCollector) Add(path NodePath, hash common.Hash) {
+func (n *nodeHashCollector) Add(id NodeId, path NodePath, hash common.Hash) {
 	n.hashes.Add(path, hash)
+	if n.observer != nil {
+		n.observer(id, hash)
+	}
 }
 
 func (n *nodeHashCollector) GetHashes() *NodeHashes {
@@ -80,9 +80,9 @@ func (mr *MockhasherMockRecorder) isEmbedded(arg0, arg1 any) *gomock.Call {
 }
 
 // updateHashes mocks base method.
-func (m *Mockhasher) updateHashes(root *NodeReference, nodes NodeManager) (common.Hash, *NodeHashes, error) {
+func (m *Mockhasher) updateHashes(root *NodeReference, nodes NodeManager, observer NodeHashObserver) (common.Hash, *NodeHashes, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "updateHashes", root, nodes)
+	ret := m.ctrl.Call(m, "updateHashes", root, nodes, observer)
 	ret0, _ := ret[0].(common.Hash)
 	ret1, _ := ret[1].(*NodeHashes)
 	ret2, _ := ret[2].(error)
@@ -90,7 +90,7 @@ func (m *Mockhasher) updateHashes(root *NodeReference, nodes NodeManager) (commo
 }
 
 // updateHashes indicates an expected call of updateHashes.
-func (mr *MockhasherMockRecorder) updateHashes(root, nodes any) *gomock.Call {
+func (mr *MockhasherMockRecorder) updateHashes(root, nodes, observer any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "updateHashes", reflect.TypeOf((*Mockhasher)(nil).updateHashes), root, nodes)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "updateHashes", reflect.TypeOf((*Mockhasher)(nil).updateHashes), root, nodes, observer)
 }
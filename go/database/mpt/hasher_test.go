@@ -12,7 +12,9 @@ package mpt
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/Fantom-foundation/Carmen/go/common"
@@ -44,7 +46,7 @@ func TestHasher_ExtensionNode_GetHash_DirtyHashesAreIgnored(t *testing.T) {
 				nextHashDirty: true,
 			})
 
-			hasher := algorithm.createHasher()
+			hasher := algorithm.createHasher(nil)
 			_, err := hasher.getHash(&ref, ctxt)
 			if err != nil {
 				t.Fatalf("error computing hash: %v", err)
@@ -81,8 +83,8 @@ func TestHasher_ExtensionNode_UpdateHash_DirtyHashesAreRefreshed(t *testing.T) {
 				nextHashDirty: true,
 			})
 
-			hasher := algorithm.createHasher()
-			_, _, err := hasher.updateHashes(&ref, ctxt)
+			hasher := algorithm.createHasher(nil)
+			_, _, err := hasher.updateHashes(&ref, ctxt, nil)
 			if err != nil {
 				t.Fatalf("error computing hash: %v", err)
 			}
@@ -115,7 +117,7 @@ func TestHasher_BranchNode_GetHash_DirtyHashesAreIgnored(t *testing.T) {
 				dirtyChildHashes: []int{0x7, 0xd},
 			})
 
-			hasher := algorithm.createHasher()
+			hasher := algorithm.createHasher(nil)
 			_, err := hasher.getHash(&ref, ctxt)
 			if err != nil {
 				t.Fatalf("error computing hash: %v", err)
@@ -151,8 +153,8 @@ func TestHasher_BranchNode_UpdateHash_DirtyHashesAreRefreshed(t *testing.T) {
 
 			ctxt.EXPECT().hashAddress(gomock.Any()).MaxTimes(2)
 
-			hasher := algorithm.createHasher()
-			_, _, err := hasher.updateHashes(&ref, ctxt)
+			hasher := algorithm.createHasher(nil)
+			_, _, err := hasher.updateHashes(&ref, ctxt, nil)
 			if err != nil {
 				t.Fatalf("error computing hash: %v", err)
 			}
@@ -185,8 +187,8 @@ func TestHasher_BranchNode_UpdateHash_DirtyFlagsForEmptyChildrenAreClearedButNoU
 				dirtyChildHashes: []int{1, 2, 3}, // < all empty children
 			})
 
-			hasher := algorithm.createHasher()
-			_, _, err := hasher.updateHashes(&ref, ctxt)
+			hasher := algorithm.createHasher(nil)
+			_, _, err := hasher.updateHashes(&ref, ctxt, nil)
 			if err != nil {
 				t.Fatalf("error computing hash: %v", err)
 			}
@@ -217,7 +219,7 @@ func TestHasher_AccountNode_GetHash_DirtyHashesAreIgnored(t *testing.T) {
 
 			ctxt.EXPECT().hashAddress(gomock.Any()).MaxTimes(1)
 
-			hasher := algorithm.createHasher()
+			hasher := algorithm.createHasher(nil)
 			_, err := hasher.getHash(&ref, ctxt)
 			if err != nil {
 				t.Fatalf("error computing hash: %v", err)
@@ -249,8 +251,8 @@ func TestHasher_AccountNode_UpdateHash_DirtyHashesAreRefreshed(t *testing.T) {
 
 			ctxt.EXPECT().hashAddress(gomock.Any()).MaxTimes(1)
 
-			hasher := algorithm.createHasher()
-			_, _, err := hasher.updateHashes(&ref, ctxt)
+			hasher := algorithm.createHasher(nil)
+			_, _, err := hasher.updateHashes(&ref, ctxt, nil)
 			if err != nil {
 				t.Fatalf("error computing hash: %v", err)
 			}
@@ -370,51 +372,253 @@ func TestEthereumLikeHasher_BranchNode_KnownHash_EmbeddedNode(t *testing.T) {
 	}
 }
 
-func TestEthereumLikeHasher_BranchNode_RecomputesEmbeddedFlagsForHashInNodeMode(t *testing.T) {
+func TestEthereumLikeHasher_BranchNode_RecomputesEmbeddedFlagsOfCleanChildren(t *testing.T) {
+	for _, config := range []MptConfig{S5LiveConfig, S5ArchiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ctxt := newNodeContextWithConfig(t, ctrl, config)
+
+			// This test case reconstructs an issue encountered while computing
+			// hashes for archives which are not storing embedded flags on disk.
+			// In those cases, embedded flags in branch nodes have not been updated
+			// if the hashes of the child nodes have been valid. The same applies
+			// to clean nodes moved to a new parent in a LiveDB.
+
+			key1 := hexToKey("c76547ce3912f8c25a9943819c2992169865dfd500bed5213c8a92ceff5db5e3")
+			key2 := hexToKey("2968f9295ca3ab4960ae553a18f47567e56f2777ad762ee1d639421728926a37")
+
+			val1 := common.Value{}
+			val1[len(val1)-1] = 1
+
+			dirtyHash := hashStatusDirty
+			ref, branch := ctxt.Build(&Branch{
+				children: Children{
+					0x2: &Value{length: 55, key: key1, value: val1}, // the node and its hash are clean
+					0x4: &Value{length: 55, key: key2, value: val1}, // the node and its hash are clean
+				},
+				hashStatus:       &dirtyHash,
+				dirtyChildHashes: []int{0x2, 0x4}, // the branch's hashes are outdated
+			})
+
+			// The embedded mask should contain no 1 bits right now.
+			view := branch.GetViewHandle()
+			embeddedMask := int(view.Get().(*BranchNode).embeddedChildren)
+			view.Release()
+			if want, got := 0, embeddedMask; want != got {
+				t.Errorf("nested nodes not identified as embedded, wanted %016b, got %016b", want, got)
+			}
+
+			hasher := makeEthereumLikeHasher()
+			_, _, err := hasher.updateHashes(&ref, ctxt, nil)
+			if err != nil {
+				t.Fatalf("failed to compute hash for node: %v", err)
+			}
+
+			// The embedded mask should indicate both value nodes as embedded.
+			view = branch.GetViewHandle()
+			embeddedMask = int(view.Get().(*BranchNode).embeddedChildren)
+			view.Release()
+			if want, got := (1<<2)|(1<<4), embeddedMask; want != got {
+				t.Errorf("nested nodes not identified as embedded, wanted %016b, got %016b", want, got)
+			}
+		})
+	}
+}
+
+func TestEthereumLikeHasher_ExtensionNode_RecomputesEmbeddedFlagOfCleanNextNode(t *testing.T) {
+	for _, config := range []MptConfig{S5LiveConfig, S5ArchiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ctxt := newNodeContextWithConfig(t, ctrl, config)
+
+			// The next node is a clean branch small enough to be embedded.
+			ref, extension := ctxt.Build(&Extension{
+				path: []Nibble{1, 2, 3},
+				next: &Branch{
+					children: Children{
+						0x2: &Value{length: 1, key: common.Key{0x12}, value: common.Value{31: 1}},
+						0x4: &Value{length: 1, key: common.Key{0x14}, value: common.Value{31: 1}},
+					},
+					embeddedChildren: []bool{0x2: true, 0x4: true},
+				},
+				dirty:         true,
+				hashDirty:     true,
+				nextHashDirty: true, // the extension's hash of the next node is outdated
+			})
+
+			hasher := makeEthereumLikeHasher()
+			if _, _, err := hasher.updateHashes(&ref, ctxt, nil); err != nil {
+				t.Fatalf("failed to compute hash for node: %v", err)
+			}
+
+			view := extension.GetViewHandle()
+			defer view.Release()
+			if !view.Get().(*ExtensionNode).nextIsEmbedded {
+				t.Errorf("next node not identified as embedded")
+			}
+		})
+	}
+}
+
+func TestEthereumLikeHasher_CrossCheck_ValidCachedChildHashesAreAccepted(t *testing.T) {
+	for _, config := range []MptConfig{S5LiveConfig, S5ArchiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ctxt := newNodeContextWithConfig(t, ctrl, config)
+
+			ref, _ := ctxt.Build(&Branch{
+				children: Children{
+					0x2: &Account{address: common.Address{1}, pathLength: 63},
+					0x4: &Account{address: common.Address{2}, pathLength: 63, dirtyHash: true},
+				},
+				dirtyHash:        true,
+				dirtyChildHashes: []int{0x4},
+			})
+
+			hasher := makeEthereumLikeHasher()
+			enableCachedHashCrossChecks(hasher)
+			if _, _, err := hasher.updateHashes(&ref, ctxt, nil); err != nil {
+				t.Errorf("valid cached hashes should be accepted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestEthereumLikeHasher_CrossCheck_InvalidCachedChildHashIsDetected(t *testing.T) {
 	ctrl := gomock.NewController(t)
-	ctxt := newNodeContextWithConfig(t, ctrl, S5ArchiveConfig)
+	ctxt := newNodeContextWithConfig(t, ctrl, S5LiveConfig)
 
-	// This test case reconstructs an issue encountered while computing
-	// hashes for archives which are not storing embedded flags on disk.
-	// In those cases, embedded flags in branch nodes have not been updated
-	// if the hashes of the child nodes have been valid.
+	ref, _ := ctxt.Build(&Branch{
+		children: Children{
+			0x2: &Account{address: common.Address{1}, pathLength: 63},
+			0x4: &Account{address: common.Address{2}, pathLength: 63, dirtyHash: true},
+		},
+		childHashes:      ChildHashes{0x2: common.Hash{1}}, // < outdated
+		dirtyHash:        true,
+		dirtyChildHashes: []int{0x4},
+	})
 
-	key1 := hexToKey("c76547ce3912f8c25a9943819c2992169865dfd500bed5213c8a92ceff5db5e3")
-	key2 := hexToKey("2968f9295ca3ab4960ae553a18f47567e56f2777ad762ee1d639421728926a37")
+	hasher := makeEthereumLikeHasher()
+	enableCachedHashCrossChecks(hasher)
+	if _, _, err := hasher.updateHashes(&ref, ctxt, nil); !errors.Is(err, cachedHashMismatchErr) {
+		t.Errorf("outdated cached hash should be detected, got %v", err)
+	}
+}
 
-	val1 := common.Value{}
-	val1[len(val1)-1] = 1
+func TestEthereumLikeHasher_CrossCheck_InvalidEmbeddedFlagIsDetected(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ctxt := newNodeContextWithConfig(t, ctrl, S5LiveConfig)
 
-	dirtyHash := hashStatusDirty
-	ref, branch := ctxt.Build(&Branch{
+	ref, _ := ctxt.Build(&Branch{
 		children: Children{
-			0x2: &Value{length: 55, key: key1, value: val1}, // the node and its hash are clean
-			0x4: &Value{length: 55, key: key2, value: val1}, // the node and its hash are clean
+			0x2: &Account{address: common.Address{1}, pathLength: 63},
+			0x4: &Account{address: common.Address{2}, pathLength: 63, dirtyHash: true},
 		},
-		hashStatus:       &dirtyHash,
-		dirtyChildHashes: []int{0x2, 0x4}, // the branch's hashes are outdated
+		embeddedChildren: []bool{0x2: true}, // < accounts are never embedded
+		dirtyHash:        true,
+		dirtyChildHashes: []int{0x4},
 	})
 
-	// The embedded mask should contain no 1 bits right now.
-	view := branch.GetViewHandle()
-	embeddedMask := int(view.Get().(*BranchNode).embeddedChildren)
-	view.Release()
-	if want, got := 0, embeddedMask; want != got {
-		t.Errorf("nested nodes not identified as embedded, wanted %016b, got %016b", want, got)
+	hasher := makeEthereumLikeHasher()
+	enableCachedHashCrossChecks(hasher)
+	if _, _, err := hasher.updateHashes(&ref, ctxt, nil); !errors.Is(err, cachedHashMismatchErr) {
+		t.Errorf("invalid embedded flag should be detected, got %v", err)
 	}
+}
+
+func TestEthereumLikeHasher_LeafPathLengthCheck_LeavesAtTheirDepthAreAccepted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ctxt := newNodeContextWithConfig(t, ctrl, S5LiveConfig)
+
+	ref, _ := ctxt.Build(&Branch{
+		children: Children{
+			0x2: &Account{address: common.Address{1}, pathLength: 63, dirtyHash: true, storageHashDirty: true,
+				storage: &Extension{
+					path: []Nibble{1, 2},
+					next: &Branch{
+						children: Children{
+							0x3: &Value{key: common.Key{1}, value: common.Value{1}, length: 61, dirtyHash: true},
+							0x4: &Value{key: common.Key{2}, value: common.Value{1}, length: 61, dirtyHash: true},
+						},
+						dirtyHash:        true,
+						dirtyChildHashes: []int{0x3, 0x4},
+					},
+					hashDirty:     true,
+					nextHashDirty: true,
+				},
+			},
+			0x4: &Account{address: common.Address{2}, pathLength: 63, dirtyHash: true},
+		},
+		dirtyHash:        true,
+		dirtyChildHashes: []int{0x2, 0x4},
+	})
 
 	hasher := makeEthereumLikeHasher()
-	_, _, err := hasher.updateHashes(&ref, ctxt)
-	if err != nil {
-		t.Fatalf("failed to compute hash for node: %v", err)
+	enableLeafPathLengthChecks(hasher)
+	if _, _, err := hasher.updateHashes(&ref, ctxt, nil); err != nil {
+		t.Errorf("leaves located at their depth should be accepted, got %v", err)
+	}
+}
+
+func TestEthereumLikeHasher_LeafPathLengthCheck_LeafAtWrongDepthIsDetected(t *testing.T) {
+	tests := map[string]struct {
+		setup NodeDesc
+		want  string
+	}{
+		"account too deep": {&Branch{
+			children: Children{
+				0x2: &Account{address: common.Address{1}, pathLength: 64, dirtyHash: true},
+				0x4: &Account{address: common.Address{2}, pathLength: 63, dirtyHash: true},
+			},
+			dirtyHash:        true,
+			dirtyChildHashes: []int{0x2, 0x4},
+		}, "hashed at depth 1, expected path length 63, stored 64"},
+		"value below extension": {&Extension{
+			path: []Nibble{1, 2},
+			next: &Branch{
+				children: Children{
+					0x3: &Value{key: common.Key{1}, value: common.Value{1}, length: 61, dirtyHash: true},
+					0x4: &Value{key: common.Key{2}, value: common.Value{1}, length: 62, dirtyHash: true},
+				},
+				dirtyHash:        true,
+				dirtyChildHashes: []int{0x3, 0x4},
+			},
+			hashDirty:     true,
+			nextHashDirty: true,
+		}, "hashed at depth 3, expected path length 61, stored 62"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ctxt := newNodeContextWithConfig(t, ctrl, S5LiveConfig)
+			ref, _ := ctxt.Build(test.setup)
+
+			hasher := makeEthereumLikeHasher()
+			enableLeafPathLengthChecks(hasher)
+			_, _, err := hasher.updateHashes(&ref, ctxt, nil)
+			if !errors.Is(err, leafPathLengthMismatchErr) {
+				t.Fatalf("leaf at wrong depth should be detected, got %v", err)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error should report depth and path lengths, wanted %q, got %v", test.want, err)
+			}
+
+			// Without the check, the leaf is hashed using its stored path length.
+			if _, _, err := makeEthereumLikeHasher().updateHashes(&ref, ctxt, nil); err != nil {
+				t.Errorf("unchecked hashing should not fail, got %v", err)
+			}
+		})
 	}
+}
 
-	// The embedded mask should indicate both value nodes as embedded.
-	view = branch.GetViewHandle()
-	embeddedMask = int(view.Get().(*BranchNode).embeddedChildren)
-	view.Release()
-	if want, got := (1<<2)|(1<<4), embeddedMask; want != got {
-		t.Errorf("nested nodes not identified as embedded, wanted %016b, got %016b", want, got)
+func TestEthereumLikeHasher_LeafPathLengthCheck_IsEnabledByForestConfig(t *testing.T) {
+	forest, err := OpenInMemoryForest(t.TempDir(), S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024, CheckLeafPathLengths: true})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	defer forest.Close()
+	if !forest.hasher.(*ethHasher).checkLeafPathLengths {
+		t.Errorf("leaf path length checks should be enabled")
 	}
 }
 
@@ -626,3 +830,348 @@ func TestEthereumLikeHasher_EmbeddedNode_Hashes_As_Itself(t *testing.T) {
 		t.Errorf("unexpected hash: got: %v, wanted: %v", want, got)
 	}
 }
+
+// nodeAccessRecorder records the nodes accessed by a hasher.
+type nodeAccessRecorder struct {
+	*Forest
+	accessed []NodeId
+}
+
+func (r *nodeAccessRecorder) getViewAccess(ref *NodeReference) (shared.ViewHandle[Node], error) {
+	r.accessed = append(r.accessed, ref.Id())
+	return r.Forest.getViewAccess(ref)
+}
+
+func (r *nodeAccessRecorder) getHashAccess(ref *NodeReference) (shared.HashHandle[Node], error) {
+	r.accessed = append(r.accessed, ref.Id())
+	return r.Forest.getHashAccess(ref)
+}
+
+func TestEthereumLikeHasher_OnlyChildrenOfModifiedNodesAreAccessed(t *testing.T) {
+	for _, config := range []MptConfig{S5LiveConfig, S5ArchiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			mode := Mutable
+			if config.HashStorageLocation == HashStoredWithNode {
+				mode = Immutable
+			}
+			dir := t.TempDir()
+			hashed := map[NodeId]bool{}
+			forestConfig := ForestConfig{
+				Mode:          mode,
+				CacheCapacity: 1 << 16,
+				HashObserver:  func(id NodeId, _ common.Hash) { hashed[id] = true },
+			}
+			forest, err := OpenFileForest(dir, config, forestConfig)
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+
+			root := NewNodeReference(EmptyId())
+			for i := 0; i < 500; i++ {
+				addr := common.Address{byte(i), byte(i >> 8)}
+				if root, err = forest.SetAccountInfo(&root, addr, AccountInfo{Nonce: common.Nonce{1}}); err != nil {
+					t.Fatalf("failed to create account: %v", err)
+				}
+				for j := 0; j < 20; j++ {
+					if root, err = forest.SetValue(&root, addr, common.Key{byte(j)}, common.Value{31: byte(j + 1)}); err != nil {
+						t.Fatalf("failed to set value: %v", err)
+					}
+				}
+			}
+			if _, _, err := forest.updateHashesFor(&root); err != nil {
+				t.Fatalf("failed to update hashes: %v", err)
+			}
+			if mode == Immutable {
+				if err := forest.Freeze(&root); err != nil {
+					t.Fatalf("failed to freeze trie: %v", err)
+				}
+			}
+			if err := forest.Close(); err != nil {
+				t.Fatalf("failed to close forest: %v", err)
+			}
+
+			// After re-opening the forest, all nodes need to be loaded from disk.
+			forest, err = OpenFileForest(dir, config, forestConfig)
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+			defer forest.Close()
+
+			root = NewNodeReference(root.Id())
+			addr := common.Address{byte(42)}
+			if root, err = forest.SetValue(&root, addr, common.Key{1}, common.Value{31: 42}); err != nil {
+				t.Fatalf("failed to set value: %v", err)
+			}
+
+			hashed = map[NodeId]bool{}
+			recorder := &nodeAccessRecorder{Forest: forest}
+			if _, _, err := forest.hasher.updateHashes(&root, recorder, forestConfig.HashObserver); err != nil {
+				t.Fatalf("failed to update hashes: %v", err)
+			}
+
+			// Only modified nodes and their children may be accessed.
+			permitted := map[NodeId]bool{}
+			for id := range hashed {
+				permitted[id] = true
+				ref := NewNodeReference(id)
+				handle, err := forest.getViewAccess(&ref)
+				if err != nil {
+					t.Fatalf("failed to access node: %v", err)
+				}
+				switch node := handle.Get().(type) {
+				case *BranchNode:
+					for _, child := range node.children {
+						permitted[child.Id()] = true
+					}
+				case *ExtensionNode:
+					permitted[node.next.Id()] = true
+				case *AccountNode:
+					permitted[node.storage.Id()] = true
+				}
+				handle.Release()
+			}
+			for _, id := range recorder.accessed {
+				if !permitted[id] {
+					t.Errorf("unexpected access to node %v", id)
+				}
+			}
+		})
+	}
+}
+
+func TestEthereumLikeHasher_EmbeddedFlagsFollowValueSizesAcrossBoundary(t *testing.T) {
+	// Paths are not hashed to place the modified value node at the bottom of
+	// the storage trie, where its encoding is short enough to be embedded.
+	live := S5LiveConfig
+	live.UseHashedPaths = false
+	archive := S5ArchiveConfig
+	archive.UseHashedPaths = false
+
+	tests := map[string]struct {
+		config MptConfig
+		mode   StorageMode
+	}{
+		"live":           {live, Mutable},
+		"archive":        {archive, Immutable},
+		"archive_frozen": {archive, Immutable},
+	}
+
+	// The storage trie consists of an extension followed by a branch with two
+	// value nodes at positions 1 and 2. The value node at position 1 is
+	// embedded in the branch if its value has at most 27 bytes, the branch is
+	// embedded in the extension if this value has at most 6 bytes.
+	address := common.Address{1}
+	key1 := common.Key{31: 0x01}
+	key2 := common.Key{31: 0x02}
+	sizes := []int{1, 6, 7, 27, 28, 32, 27, 7, 6, 1, 32, 6, 28, 1}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			forest, err := OpenInMemoryForest(t.TempDir(), test.config, ForestConfig{Mode: test.mode, CacheCapacity: 1024})
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+			defer forest.Close()
+			enableCachedHashCrossChecks(forest.hasher)
+
+			root := NewNodeReference(EmptyId())
+			if root, err = forest.SetAccountInfo(&root, address, AccountInfo{Nonce: common.Nonce{1}}); err != nil {
+				t.Fatalf("failed to create account: %v", err)
+			}
+			if root, err = forest.SetValue(&root, address, key2, makeValueOfSize(1)); err != nil {
+				t.Fatalf("failed to set value: %v", err)
+			}
+
+			for _, size := range sizes {
+				if root, err = forest.SetValue(&root, address, key1, makeValueOfSize(size)); err != nil {
+					t.Fatalf("failed to set value: %v", err)
+				}
+				hash, _, err := forest.updateHashesFor(&root)
+				if err != nil {
+					t.Fatalf("failed to update hashes: %v", err)
+				}
+				if name == "archive_frozen" {
+					if err := forest.Freeze(&root); err != nil {
+						t.Fatalf("failed to freeze trie: %v", err)
+					}
+				}
+				if err := forest.Check(&root); err != nil {
+					t.Errorf("inconsistent trie after setting value of %d bytes: %v", size, err)
+				}
+
+				nextIsEmbedded, valueIsEmbedded := getBoundaryTestEmbeddedFlags(t, forest, &root)
+				if want, got := size <= 27, valueIsEmbedded; want != got {
+					t.Errorf("invalid embedded flag of value node with %d bytes, wanted %t, got %t", size, want, got)
+				}
+				if want, got := size <= 6, nextIsEmbedded; want != got {
+					t.Errorf("invalid embedded flag of branch node with value of %d bytes, wanted %t, got %t", size, want, got)
+				}
+
+				// The hash needs to match the hash of a trie built from scratch.
+				reference, err := OpenInMemoryForest(t.TempDir(), test.config, ForestConfig{Mode: Mutable, CacheCapacity: 1024})
+				if err != nil {
+					t.Fatalf("failed to open forest: %v", err)
+				}
+				ref := NewNodeReference(EmptyId())
+				if ref, err = reference.SetAccountInfo(&ref, address, AccountInfo{Nonce: common.Nonce{1}}); err != nil {
+					t.Fatalf("failed to create account: %v", err)
+				}
+				if ref, err = reference.SetValue(&ref, address, key1, makeValueOfSize(size)); err != nil {
+					t.Fatalf("failed to set value: %v", err)
+				}
+				if ref, err = reference.SetValue(&ref, address, key2, makeValueOfSize(1)); err != nil {
+					t.Fatalf("failed to set value: %v", err)
+				}
+				want, _, err := reference.updateHashesFor(&ref)
+				if err != nil {
+					t.Fatalf("failed to update hashes: %v", err)
+				}
+				if want != hash {
+					t.Errorf("unexpected hash after setting value of %d bytes, wanted %x, got %x", size, want, hash)
+				}
+				if err := reference.Close(); err != nil {
+					t.Fatalf("failed to close forest: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// makeValueOfSize creates a value with the given number of non-zero bytes.
+func makeValueOfSize(size int) common.Value {
+	res := common.Value{}
+	for i := len(res) - size; i < len(res); i++ {
+		res[i] = 0xFF
+	}
+	return res
+}
+
+// getBoundaryTestEmbeddedFlags fetches the embedded flag of the branch in the
+// storage trie of the single account in the given trie and the embedded flag
+// of the value node at position 1 in this branch.
+func getBoundaryTestEmbeddedFlags(t *testing.T, forest *Forest, root *NodeReference) (nextIsEmbedded bool, valueIsEmbedded bool) {
+	t.Helper()
+	account, err := forest.getViewAccess(root)
+	if err != nil {
+		t.Fatalf("failed to access account: %v", err)
+	}
+	defer account.Release()
+	extension, err := forest.getViewAccess(&account.Get().(*AccountNode).storage)
+	if err != nil {
+		t.Fatalf("failed to access extension: %v", err)
+	}
+	defer extension.Release()
+	next := extension.Get().(*ExtensionNode)
+	branch, err := forest.getViewAccess(&next.next)
+	if err != nil {
+		t.Fatalf("failed to access branch: %v", err)
+	}
+	defer branch.Release()
+	return next.nextIsEmbedded, branch.Get().(*BranchNode).isEmbedded(1)
+}
+
+func BenchmarkHasher_LargeStorageTrie(b *testing.B) {
+	// The number of slots exceeds the capacity of the key hash cache such
+	// that keys need to be re-hashed unless they are stored in value nodes.
+	const numSlots = 300_000
+	for _, storeHashedKeys := range []bool{false, true} {
+		b.Run(fmt.Sprintf("storeHashedKeys=%t", storeHashedKeys), func(b *testing.B) {
+			config := S5LiveConfig
+			config.StoreHashedKeysInValueNodes = storeHashedKeys
+			trie, err := OpenInMemoryLiveTrie(b.TempDir(), config, 2*numSlots)
+			if err != nil {
+				b.Fatalf("failed to open trie: %v", err)
+			}
+			defer trie.Close()
+
+			addr := common.Address{1}
+			if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+				b.Fatalf("failed to create account: %v", err)
+			}
+			update := func(round int) {
+				for i := 0; i < numSlots; i++ {
+					key := common.Key{byte(i), byte(i >> 8), byte(i >> 16)}
+					if err := trie.SetValue(addr, key, common.Value{byte(round), 31: 1}); err != nil {
+						b.Fatalf("failed to set value: %v", err)
+					}
+				}
+			}
+			update(0)
+			if _, _, err := trie.UpdateHashes(); err != nil {
+				b.Fatalf("failed to update hashes: %v", err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				update(i + 1)
+				b.StartTimer()
+				if _, _, err := trie.UpdateHashes(); err != nil {
+					b.Fatalf("failed to update hashes: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkHasher_SingleAccountUpdate(b *testing.B) {
+	const numAccounts = 10_000
+	for _, config := range allMptConfigs {
+		b.Run(config.Name, func(b *testing.B) {
+			mode := Mutable
+			if config.HashStorageLocation == HashStoredWithNode {
+				mode = Immutable
+			}
+			forest, err := OpenFileForest(b.TempDir(), config, ForestConfig{Mode: mode, CacheCapacity: 1024})
+			if err != nil {
+				b.Fatalf("failed to open forest: %v", err)
+			}
+			defer forest.Close()
+
+			root := NewNodeReference(EmptyId())
+			for i := 0; i < numAccounts; i++ {
+				addr := common.Address{byte(i), byte(i >> 8)}
+				if root, err = forest.SetAccountInfo(&root, addr, AccountInfo{Nonce: common.Nonce{1}}); err != nil {
+					b.Fatalf("failed to create account: %v", err)
+				}
+				for j := 0; j < 4; j++ {
+					if root, err = forest.SetValue(&root, addr, common.Key{byte(j)}, common.Value{31: byte(j + 1)}); err != nil {
+						b.Fatalf("failed to set value: %v", err)
+					}
+				}
+				if i%20 == 0 {
+					if _, _, err := forest.updateHashesFor(&root); err != nil {
+						b.Fatalf("failed to update hashes: %v", err)
+					}
+				}
+			}
+
+			recorder := &nodeAccessRecorder{Forest: forest}
+			update := func(i int) {
+				addr := common.Address{byte(i), byte(i >> 8)}
+				if root, err = forest.SetValue(&root, addr, common.Key{byte(i % 4)}, common.Value{31: byte(i)}); err != nil {
+					b.Fatalf("failed to set value: %v", err)
+				}
+				if _, _, err := forest.hasher.updateHashes(&root, recorder, nil); err != nil {
+					b.Fatalf("failed to update hashes: %v", err)
+				}
+				if mode == Immutable {
+					if err := forest.Freeze(&root); err != nil {
+						b.Fatalf("failed to freeze trie: %v", err)
+					}
+				}
+				if err := forest.Flush(); err != nil {
+					b.Fatalf("failed to flush forest: %v", err)
+				}
+			}
+			update(0)
+
+			recorder.accessed = recorder.accessed[:0]
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				update(i * 7919 % numAccounts)
+			}
+			b.ReportMetric(float64(len(recorder.accessed))/float64(b.N), "loads/block")
+		})
+	}
+}
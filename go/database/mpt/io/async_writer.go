@@ -0,0 +1,108 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package io
+
+import (
+	"io"
+	"sync"
+)
+
+// asyncWriterChunkSize is the number of bytes collected by an asyncWriter
+// before the collected data is handed over to the background writer.
+const asyncWriterChunkSize = 64 * 1024
+
+// asyncWriter is an io.Writer decoupling the producer of some data from the
+// actual write operations on the underlying writer. Data is collected in
+// chunks which are passed through a bounded queue to a background goroutine
+// writing them in order to the target writer. This way, the latency of the
+// target writer overlaps with the production of the data. Since there is a
+// single queue and a single consumer, the produced output is identical to
+// writing the data directly to the target writer.
+//
+// An asyncWriter is not thread safe. It must be closed to flush pending data
+// and to release the background goroutine.
+type asyncWriter struct {
+	chunks chan<- []byte
+	buffer []byte
+	done   <-chan struct{}
+
+	errMutex sync.Mutex
+	err      error // < the first error reported by the target writer
+}
+
+// newAsyncWriter creates a writer forwarding all data to the given output
+// with up to queueLength chunks of data waiting to be written.
+func newAsyncWriter(out io.Writer, queueLength int) *asyncWriter {
+	chunks := make(chan []byte, queueLength)
+	done := make(chan struct{})
+	res := &asyncWriter{
+		chunks: chunks,
+		buffer: make([]byte, 0, asyncWriterChunkSize),
+		done:   done,
+	}
+	go func() {
+		defer close(done)
+		failed := false
+		for chunk := range chunks {
+			// After a failure the remaining chunks are drained without
+			// being written to avoid blocking the producer.
+			if failed {
+				continue
+			}
+			if _, err := out.Write(chunk); err != nil {
+				res.setError(err)
+				failed = true
+			}
+		}
+	}()
+	return res
+}
+
+func (w *asyncWriter) Write(data []byte) (int, error) {
+	if err := w.getError(); err != nil {
+		return 0, err
+	}
+	w.buffer = append(w.buffer, data...)
+	if len(w.buffer) >= asyncWriterChunkSize {
+		w.chunks <- w.buffer
+		w.buffer = make([]byte, 0, asyncWriterChunkSize)
+	}
+	return len(data), nil
+}
+
+// Close flushes all pending data to the target writer and waits for the
+// background writer to finish. The first error encountered while writing
+// data to the target writer is returned.
+func (w *asyncWriter) Close() error {
+	if w.chunks == nil {
+		return w.getError()
+	}
+	if len(w.buffer) > 0 {
+		w.chunks <- w.buffer
+		w.buffer = nil
+	}
+	close(w.chunks)
+	w.chunks = nil
+	<-w.done
+	return w.getError()
+}
+
+func (w *asyncWriter) setError(err error) {
+	w.errMutex.Lock()
+	defer w.errMutex.Unlock()
+	w.err = err
+}
+
+func (w *asyncWriter) getError() error {
+	w.errMutex.Lock()
+	defer w.errMutex.Unlock()
+	return w.err
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package io
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestAsyncWriter_ForwardsDataInOrder(t *testing.T) {
+	var want bytes.Buffer
+	var got bytes.Buffer
+	writer := newAsyncWriter(&got, 2)
+	for i := 0; i < 3*asyncWriterChunkSize/100; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 100)
+		want.Write(data)
+		if n, err := writer.Write(data); err != nil || n != len(data) {
+			t.Fatalf("failed to write data, got %d, %v", n, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+	if !bytes.Equal(want.Bytes(), got.Bytes()) {
+		t.Errorf("forwarded data does not match written data")
+	}
+}
+
+func TestAsyncWriter_EmptyWriterProducesNoOutput(t *testing.T) {
+	var got bytes.Buffer
+	writer := newAsyncWriter(&got, 1)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+	if got.Len() != 0 {
+		t.Errorf("unexpected output: %x", got.Bytes())
+	}
+}
+
+func TestAsyncWriter_OutputErrorsAreReported(t *testing.T) {
+	injectedErr := errors.New("injected error")
+	writer := newAsyncWriter(failingWriter{injectedErr}, 1)
+
+	// Writes keep succeeding until the failure is observed.
+	data := make([]byte, asyncWriterChunkSize)
+	for i := 0; i < 10; i++ {
+		if _, err := writer.Write(data); err != nil {
+			if !errors.Is(err, injectedErr) {
+				t.Fatalf("unexpected error, wanted %v, got %v", injectedErr, err)
+			}
+			break
+		}
+	}
+	if err := writer.Close(); !errors.Is(err, injectedErr) {
+		t.Errorf("unexpected error, wanted %v, got %v", injectedErr, err)
+	}
+}
+
+func TestAsyncWriter_CloseCanBeCalledMultipleTimes(t *testing.T) {
+	var got bytes.Buffer
+	writer := newAsyncWriter(&got, 1)
+	if _, err := writer.Write([]byte{1, 2, 3}); err != nil {
+		t.Fatalf("failed to write data: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := writer.Close(); err != nil {
+			t.Fatalf("failed to close writer: %v", err)
+		}
+	}
+	if want, got := []byte{1, 2, 3}, got.Bytes(); !bytes.Equal(want, got) {
+		t.Errorf("unexpected output, wanted %x, got %x", want, got)
+	}
+}
+
+type failingWriter struct {
+	err error
+}
+
+func (w failingWriter) Write([]byte) (int, error) {
+	return 0, w.err
+}
@@ -46,9 +46,9 @@ func getMptInfo(dir string) (MptInfo, error) {
 	}
 
 	// Try to resolve the configuration.
-	config, found := mpt.GetConfigByName(meta.Configuration)
-	if !found {
-		return res, fmt.Errorf("unknown MPT configuration: %v", meta.Configuration)
+	config, err := mpt.ReadConfigFromDirectory(dir)
+	if err != nil {
+		return res, err
 	}
 
 	mode := mpt.Immutable
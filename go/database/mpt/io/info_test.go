@@ -64,3 +64,18 @@ func TestIO_CheckMptDirectoryAndGetInfo_Unknown_Config(t *testing.T) {
 		t.Errorf("getting directory info should fail")
 	}
 }
+
+func TestIO_CheckMptDirectoryAndGetInfo_CannotParseConfig(t *testing.T) {
+	dir := t.TempDir()
+	meta := "{\"Configuration\":\"S5-Live\",\"Mutable\":true}"
+	if err := os.WriteFile(path.Join(dir, "forest.json"), []byte(meta), 0644); err != nil {
+		t.Fatalf("cannot prepare for test: %s", err)
+	}
+	if err := os.WriteFile(path.Join(dir, "mpt_config.json"), []byte("Hello"), 0644); err != nil {
+		t.Fatalf("cannot prepare for test: %s", err)
+	}
+
+	if _, err := CheckMptDirectoryAndGetInfo(dir); err == nil {
+		t.Errorf("getting directory info should fail")
+	}
+}
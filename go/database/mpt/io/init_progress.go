@@ -0,0 +1,157 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package io
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// InitProgress summarizes the progress of an archive initialization.
+type InitProgress struct {
+	Position     uint64        // the number of bytes of the input stream processed so far
+	Accounts     uint64        // the number of accounts imported so far
+	Slots        uint64        // the number of storage slots imported so far
+	NodesWritten uint64        // the number of nodes written to disk in the current run
+	Elapsed      time.Duration // the time since the start of the current run
+	Percent      float64       // the completed share of the input in percent, only set for a SizedInput
+	ETA          time.Duration // the estimated time until the end of the input, only set for a SizedInput
+}
+
+// SizedInput is an input stream decoded from a raw input of known size, e.g.
+// a compressed file. The progress reported while initializing an archive
+// from a SizedInput includes the completed percentage and an estimate of the
+// remaining time, derived from the share of the raw input consumed so far.
+type SizedInput struct {
+	io.Reader                 // the decoded input stream
+	Raw       *CountingReader // the raw input the decoded stream is read from
+	Size      uint64          // the total size of the raw input
+}
+
+// estimate computes the completed percentage and the estimated remaining
+// time of an initialization running for the given time.
+func (in *SizedInput) estimate(elapsed time.Duration) (float64, time.Duration) {
+	fraction := 1.0
+	if read := in.Raw.Position(); in.Size > 0 && read < in.Size {
+		fraction = float64(read) / float64(in.Size)
+	}
+	if fraction == 0 {
+		return 0, 0
+	}
+	return fraction * 100, time.Duration(float64(elapsed) * (1 - fraction) / fraction)
+}
+
+// InitProgressCallback is a callback type for consumers of progress reports
+// of an archive initialization.
+type InitProgressCallback func(InitProgress)
+
+// importProgress is the progress of an import reached at a token boundary of
+// the input stream. It is retained in progress markers to resume interrupted
+// imports.
+//
+// Progress is recorded periodically while importing, right after flushing the
+// state, and when an import fails or gets cancelled. In all cases, the state
+// on disk is the one produced by the input up to the recorded position, which
+// is verified using the recorded hash when resuming.
+type importProgress struct {
+	Position uint64      // the number of bytes of the input stream applied to the state
+	Accounts uint64      // the number of accounts covered by the applied input
+	Slots    uint64      // the number of storage slots covered by the applied input
+	Hash     common.Hash // the state hash after applying the input up to Position
+}
+
+// initProgressMarker is the on-disk record of an interrupted archive
+// initialization.
+type initProgressMarker struct {
+	Block    uint64
+	Progress importProgress
+}
+
+const initProgressMarkerFile = "init-progress.json"
+
+func getInitProgressMarkerPath(directory string) string {
+	return directory + string(os.PathSeparator) + initProgressMarkerFile
+}
+
+// readInitProgressMarker reads the progress marker of an interrupted archive
+// initialization in the given directory. If there is no such marker, false is
+// returned.
+func readInitProgressMarker(directory string) (initProgressMarker, bool, error) {
+	data, err := os.ReadFile(getInitProgressMarkerPath(directory))
+	if errors.Is(err, os.ErrNotExist) {
+		return initProgressMarker{}, false, nil
+	}
+	if err != nil {
+		return initProgressMarker{}, false, err
+	}
+	var marker initProgressMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		return initProgressMarker{}, false, err
+	}
+	return marker, true, nil
+}
+
+// writeInitProgressMarker durably replaces the progress marker in the given
+// directory, such that a crash leaves either the old or the new marker.
+func writeInitProgressMarker(directory string, marker initProgressMarker) error {
+	data, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+	path := getInitProgressMarkerPath(directory)
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	err = errors.Join(err, file.Sync(), file.Close())
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func removeInitProgressMarker(directory string) error {
+	err := os.Remove(getInitProgressMarkerPath(directory))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// CountingReader is a reader wrapper keeping track of the number of bytes
+// consumed from the underlying reader.
+type CountingReader struct {
+	reader   io.Reader
+	position uint64
+}
+
+// NewCountingReader creates a reader counting the bytes read from the given
+// reader.
+func NewCountingReader(reader io.Reader) *CountingReader {
+	return &CountingReader{reader: reader}
+}
+
+func (r *CountingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.position += uint64(n)
+	return n, err
+}
+
+// Position returns the number of bytes read so far.
+func (r *CountingReader) Position() uint64 {
+	return r.position
+}
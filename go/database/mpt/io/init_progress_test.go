@@ -0,0 +1,373 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package io
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/common/interrupt"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+)
+
+func TestInitializeArchive_InterruptedInitializationCanBeResumed(t *testing.T) {
+	genesis, hash := exportExampleState(t)
+	const block = uint64(5)
+
+	// Run an uninterrupted initialization as a reference.
+	referenceDir := t.TempDir()
+	if err := InitializeArchive(referenceDir, bytes.NewBuffer(genesis), block); err != nil {
+		t.Fatalf("failed to initialize archive: %v", err)
+	}
+
+	for _, limit := range []int{len(genesis) / 4, len(genesis) / 2, 3 * len(genesis) / 4} {
+		dir := t.TempDir()
+
+		// Abort the initialization after the given number of bytes.
+		ctx, cancel := context.WithCancel(context.Background())
+		in := &cancellingReader{reader: bytes.NewBuffer(genesis), limit: limit, cancel: cancel}
+		err := InitializeArchiveWithProgress(ctx, dir, in, block, nil)
+		cancel()
+		if !errors.Is(err, interrupt.ErrCanceled) {
+			t.Fatalf("unexpected error: got %v, want %v", err, interrupt.ErrCanceled)
+		}
+		if _, found, err := readInitProgressMarker(dir); err != nil || !found {
+			t.Fatalf("missing progress marker, found %t, err %v", found, err)
+		}
+
+		// Resume the initialization from the beginning of the input.
+		var reports []InitProgress
+		callback := func(progress InitProgress) {
+			reports = append(reports, progress)
+		}
+		if err := InitializeArchiveWithProgress(context.Background(), dir, bytes.NewBuffer(genesis), block, callback); err != nil {
+			t.Fatalf("failed to resume initialization: %v", err)
+		}
+		if len(reports) == 0 {
+			t.Errorf("no progress reported")
+		} else if got, want := reports[len(reports)-1].Position, uint64(len(genesis)); got != want {
+			t.Errorf("unexpected final position, wanted %d, got %d", want, got)
+		}
+		if _, found, err := readInitProgressMarker(dir); err != nil || found {
+			t.Errorf("progress marker should be removed, found %t, err %v", found, err)
+		}
+
+		if err := mpt.VerifyArchiveTrie(dir, mpt.S5ArchiveConfig, nil); err != nil {
+			t.Fatalf("verification of resumed archive failed: %v", err)
+		}
+
+		archive, err := mpt.OpenArchiveTrie(dir, mpt.S5ArchiveConfig, 1024)
+		if err != nil {
+			t.Fatalf("failed to open resumed archive: %v", err)
+		}
+		if got, err := archive.GetHash(block); err != nil || got != hash {
+			t.Errorf("resumed archive has wrong hash, wanted %x, got %x, err %v", hash, got, err)
+		}
+		if err := archive.Close(); err != nil {
+			t.Fatalf("failed to close archive: %v", err)
+		}
+
+		// The logical content needs to be identical to the reference.
+		var want, got bytes.Buffer
+		if err := ExportArchive(context.Background(), referenceDir, &want); err != nil {
+			t.Fatalf("failed to export reference archive: %v", err)
+		}
+		if err := ExportArchive(context.Background(), dir, &got); err != nil {
+			t.Fatalf("failed to export resumed archive: %v", err)
+		}
+		if !bytes.Equal(want.Bytes(), got.Bytes()) {
+			t.Errorf("resumed archive differs from uninterrupted initialization")
+		}
+	}
+}
+
+func TestInitializeArchive_AbortedInitializationCanBeResumed(t *testing.T) {
+	genesis, hash := exportExampleState(t)
+	const block = uint64(5)
+
+	for _, limit := range []int{len(genesis) / 4, len(genesis) / 2, 3 * len(genesis) / 4} {
+		dir := t.TempDir()
+
+		// Abort the initialization by a failure of the input stream without
+		// cancelling the context.
+		in := &failingReader{reader: bytes.NewBuffer(genesis), limit: limit}
+		if err := InitializeArchive(dir, in, block); !errors.Is(err, errInjectedReadFailure) {
+			t.Fatalf("unexpected error: got %v, want %v", err, errInjectedReadFailure)
+		}
+		marker, found, err := readInitProgressMarker(dir)
+		if err != nil || !found {
+			t.Fatalf("missing progress marker, found %t, err %v", found, err)
+		}
+		if got := marker.Progress.Position; got == 0 || got > uint64(limit) {
+			t.Errorf("recorded progress should cover the applied input, got position %d, limit %d", got, limit)
+		}
+
+		// Resume the initialization from the beginning of the input.
+		if err := InitializeArchive(dir, bytes.NewBuffer(genesis), block); err != nil {
+			t.Fatalf("failed to resume initialization: %v", err)
+		}
+		if _, found, err := readInitProgressMarker(dir); err != nil || found {
+			t.Errorf("progress marker should be removed, found %t, err %v", found, err)
+		}
+
+		archive, err := mpt.OpenArchiveTrie(dir, mpt.S5ArchiveConfig, 1024)
+		if err != nil {
+			t.Fatalf("failed to open resumed archive: %v", err)
+		}
+		if got, err := archive.GetHash(block); err != nil || got != hash {
+			t.Errorf("resumed archive has wrong hash, wanted %x, got %x, err %v", hash, got, err)
+		}
+		if err := archive.Close(); err != nil {
+			t.Fatalf("failed to close archive: %v", err)
+		}
+	}
+}
+
+func TestInitializeArchive_CrashedInitializationCanBeResumed(t *testing.T) {
+	genesis, hash := exportExampleState(t)
+	const block = uint64(5)
+
+	defer func(period int) { checkpointPeriod = period }(checkpointPeriod)
+	checkpointPeriod = 3
+
+	// Stall the initialization after a periodic checkpoint while the state
+	// is still open and modified beyond the checkpoint.
+	dir := t.TempDir()
+	in := &blockingReader{
+		reader:  bytes.NewBuffer(genesis),
+		limit:   3 * len(genesis) / 4,
+		blocked: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- InitializeArchive(dir, in, block)
+	}()
+	<-in.blocked
+
+	marker, found, err := readInitProgressMarker(dir)
+	if err != nil || !found {
+		t.Fatalf("missing progress marker, found %t, err %v", found, err)
+	}
+	if marker.Progress.Position == 0 {
+		t.Fatalf("no periodic checkpoint recorded before the crash")
+	}
+
+	// A crash abandons the state without closing it, leaving the directory
+	// as it is right now behind.
+	crashed := copyAbandonedDirectory(t, dir)
+	close(in.release)
+	if err := <-done; !errors.Is(err, errInjectedReadFailure) {
+		t.Fatalf("unexpected error: got %v, want %v", err, errInjectedReadFailure)
+	}
+
+	if err := InitializeArchive(crashed, bytes.NewBuffer(genesis), block); err != nil {
+		t.Fatalf("failed to resume initialization: %v", err)
+	}
+	if _, found, err := readInitProgressMarker(crashed); err != nil || found {
+		t.Errorf("progress marker should be removed, found %t, err %v", found, err)
+	}
+
+	archive, err := mpt.OpenArchiveTrie(crashed, mpt.S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open resumed archive: %v", err)
+	}
+	if got, err := archive.GetHash(block); err != nil || got != hash {
+		t.Errorf("resumed archive has wrong hash, wanted %x, got %x, err %v", hash, got, err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+}
+
+func TestInitializeArchive_SizedInputsReportPercentAndETA(t *testing.T) {
+	genesis, _ := exportExampleState(t)
+	raw := NewCountingReader(bytes.NewBuffer(genesis))
+	in := &SizedInput{Reader: raw, Raw: raw, Size: uint64(len(genesis))}
+
+	var reports []InitProgress
+	callback := func(progress InitProgress) {
+		reports = append(reports, progress)
+	}
+	if err := InitializeArchiveWithProgress(context.Background(), t.TempDir(), in, 5, callback); err != nil {
+		t.Fatalf("failed to initialize archive: %v", err)
+	}
+	if len(reports) == 0 {
+		t.Fatalf("no progress reported")
+	}
+	if got := reports[len(reports)-1]; got.Percent != 100 || got.ETA != 0 {
+		t.Errorf("unexpected final report, wanted 100%% and no remaining time, got %.1f%% and %v", got.Percent, got.ETA)
+	}
+}
+
+func TestSizedInput_EstimatesAreDerivedFromConsumedShareOfRawInput(t *testing.T) {
+	raw := NewCountingReader(bytes.NewBuffer(make([]byte, 100)))
+	in := &SizedInput{Reader: raw, Raw: raw, Size: 100}
+
+	if percent, eta := in.estimate(time.Second); percent != 0 || eta != 0 {
+		t.Errorf("unexpected estimate before reading, got %.1f%% and %v", percent, eta)
+	}
+	if _, err := io.ReadFull(in, make([]byte, 25)); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if percent, eta := in.estimate(time.Second); percent != 25 || eta != 3*time.Second {
+		t.Errorf("unexpected estimate, wanted 25%% and 3s, got %.1f%% and %v", percent, eta)
+	}
+}
+
+func TestInitializeArchive_ResumeWithDifferentBlockFails(t *testing.T) {
+	genesis, _ := exportExampleState(t)
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	in := &cancellingReader{reader: bytes.NewBuffer(genesis), limit: len(genesis) / 2, cancel: cancel}
+	if err := InitializeArchiveWithProgress(ctx, dir, in, 5, nil); !errors.Is(err, interrupt.ErrCanceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cancel()
+
+	err := InitializeArchive(dir, bytes.NewBuffer(genesis), 6)
+	if err == nil || !strings.Contains(err.Error(), "cannot resume") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestInitializeArchive_ResumeWithDifferentInputFails(t *testing.T) {
+	genesis, _ := exportExampleState(t)
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	in := &cancellingReader{reader: bytes.NewBuffer(genesis), limit: len(genesis) / 2, cancel: cancel}
+	if err := InitializeArchiveWithProgress(ctx, dir, in, 5, nil); !errors.Is(err, interrupt.ErrCanceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cancel()
+
+	// Corrupt the recorded state hash to simulate a mismatch.
+	marker, _, err := readInitProgressMarker(dir)
+	if err != nil {
+		t.Fatalf("failed to read marker: %v", err)
+	}
+	marker.Progress.Hash[0]++
+	if err := writeInitProgressMarker(dir, marker); err != nil {
+		t.Fatalf("failed to write marker: %v", err)
+	}
+
+	err = InitializeArchive(dir, bytes.NewBuffer(genesis), 5)
+	if err == nil || !strings.Contains(err.Error(), "state hash does not match") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// cancellingReader is a reader cancelling a context after a given number of
+// bytes have been read.
+type cancellingReader struct {
+	reader io.Reader
+	limit  int
+	read   int
+	cancel func()
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += n
+	if r.read >= r.limit {
+		r.cancel()
+	}
+	return n, err
+}
+
+const errInjectedReadFailure = common.ConstError("injected read failure")
+
+// failingReader is a reader failing after a given number of bytes have been
+// read.
+type failingReader struct {
+	reader io.Reader
+	limit  int
+	read   int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.read >= r.limit {
+		return 0, errInjectedReadFailure
+	}
+	if len(p) > r.limit-r.read {
+		p = p[:r.limit-r.read]
+	}
+	n, err := r.reader.Read(p)
+	r.read += n
+	return n, err
+}
+
+// blockingReader is a reader blocking after a given number of bytes have been
+// read until it gets released, failing afterwards.
+type blockingReader struct {
+	reader  io.Reader
+	limit   int
+	read    int
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	if r.read >= r.limit {
+		close(r.blocked)
+		<-r.release
+		return 0, errInjectedReadFailure
+	}
+	if len(p) > r.limit-r.read {
+		p = p[:r.limit-r.read]
+	}
+	n, err := r.reader.Read(p)
+	r.read += n
+	return n, err
+}
+
+// copyAbandonedDirectory copies the given directory of an open state into a
+// new directory, like it would be left behind by a crashed process. The lock
+// file is not copied since the lock of a crashed process is released.
+func copyAbandonedDirectory(t *testing.T, directory string) string {
+	t.Helper()
+	target := t.TempDir()
+	err := filepath.WalkDir(directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return os.MkdirAll(filepath.Join(target, rel), 0700)
+		}
+		if entry.Name() == "~lock" {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(target, rel), data, 0600)
+	})
+	if err != nil {
+		t.Fatalf("failed to copy directory: %v", err)
+	}
+	return target
+}
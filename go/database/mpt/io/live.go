@@ -11,6 +11,7 @@
 package io
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"errors"
@@ -18,6 +19,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/Fantom-foundation/Carmen/go/common"
 	"github.com/Fantom-foundation/Carmen/go/common/interrupt"
@@ -53,11 +55,45 @@ const (
 	EthereumHash = HashType(0)
 )
 
+// ExportConfig summarizes options for exporting a LiveDB.
+type ExportConfig struct {
+	// WriteQueueLength is the number of encoded chunks of data that may be
+	// queued for being written to the output. If positive, the traversal of
+	// the LiveDB and the writing of the output are performed by separate
+	// goroutines, overlapping the latency of the output with the traversal.
+	// If zero, all data is written by the traversing goroutine. In both
+	// cases, the produced output is identical.
+	WriteQueueLength int
+
+	// ResumeFrom, if set, continues an interrupted export after the given
+	// account, which is the last account reported to the Checkpoint
+	// function of the interrupted export. The output does not contain the
+	// header, the state hash, and the codes, such that the decompressed
+	// output can be appended to the output of the interrupted export.
+	ResumeFrom *common.Address
+
+	// Checkpoint, if set, is called with the address of each exported account
+	// after the account and all of its slots have been passed to the output.
+	// Once the export returned, all data up to the last reported account has
+	// been written to the output.
+	Checkpoint func(common.Address)
+}
+
+// exportBatchSize is the maximum number of accounts or slots fetched from the
+// LiveDB at once during an export.
+const exportBatchSize = 1024
+
 // Export opens a LiveDB instance retained in the given directory and writes
 // its content to the given output writer. The result contains all the
 // information required by the Import function below to reconstruct the full
 // state of the LiveDB.
 func Export(ctx context.Context, directory string, out io.Writer) error {
+	return ExportWithConfig(ctx, directory, out, ExportConfig{})
+}
+
+// ExportWithConfig is a variant of Export allowing to customize the export
+// using the given configuration.
+func ExportWithConfig(ctx context.Context, directory string, out io.Writer, config ExportConfig) (err error) {
 	info, err := CheckMptDirectoryAndGetInfo(directory)
 	if err != nil {
 		return fmt.Errorf("error in input directory: %v", err)
@@ -73,6 +109,31 @@ func Export(ctx context.Context, directory string, out io.Writer) error {
 	}
 	defer db.Close()
 
+	if config.WriteQueueLength > 0 {
+		writer := newAsyncWriter(out, config.WriteQueueLength)
+		defer func() {
+			err = errors.Join(err, writer.Close())
+		}()
+		out = writer
+	}
+
+	if config.ResumeFrom == nil {
+		if err := writeExportHeader(db, out); err != nil {
+			return err
+		}
+	}
+
+	// Write out all accounts and values.
+	if err := exportAccounts(ctx, db, out, config.ResumeFrom, config.Checkpoint); err != nil {
+		return fmt.Errorf("failed exporting content: %w", err)
+	}
+
+	return nil
+}
+
+// writeExportHeader writes the format header, the state hash, and the codes
+// of the given LiveDB to the given output.
+func writeExportHeader(db *mpt.MptState, out io.Writer) error {
 	// Start with the magic number.
 	if _, err := out.Write(stateMagicNumber); err != nil {
 		return err
@@ -100,23 +161,158 @@ func Export(ctx context.Context, directory string, out io.Writer) error {
 	if err != nil {
 		return fmt.Errorf("failed to retrieve codes: %v", err)
 	}
-	if err := writeCodes(codes, out); err != nil {
+	return writeCodes(codes, out)
+}
+
+// exportAccounts writes all accounts following the given account, or all
+// accounts if it is nil, and their slots to the given output. Accounts are
+// fetched in batches using cursors, such that an export can be resumed after
+// any account without traversing the preceding part of the trie.
+func exportAccounts(
+	ctx context.Context,
+	db *mpt.MptState,
+	out io.Writer,
+	startAfter *common.Address,
+	checkpoint func(common.Address),
+) error {
+	cursor := startAfter
+	for {
+		accounts, next, err := db.WalkAccounts(cursor, exportBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, account := range accounts {
+			// outside call to interrupt
+			if interrupt.IsCancelled(ctx) {
+				return interrupt.ErrCanceled
+			}
+			if err := exportAccount(db, out, account); err != nil {
+				return err
+			}
+			if checkpoint != nil {
+				checkpoint(account.Address)
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// exportAccount writes the given account and all of its slots to the given
+// output.
+func exportAccount(db *mpt.MptState, out io.Writer, account mpt.AccountEntry) error {
+	addr := account.Address
+	info := account.Info
+	if _, err := out.Write([]byte{byte('A')}); err != nil {
+		return err
+	}
+	if _, err := out.Write(addr[:]); err != nil {
+		return err
+	}
+	if _, err := out.Write(info.Balance[:]); err != nil {
+		return err
+	}
+	if _, err := out.Write(info.Nonce[:]); err != nil {
+		return err
+	}
+	if _, err := out.Write(info.CodeHash[:]); err != nil {
 		return err
 	}
 
-	// Write out all accounts and values.
-	visitor := exportVisitor{out: out, ctx: ctx}
-	if err := db.Visit(&visitor); err != nil || visitor.err != nil {
-		return fmt.Errorf("failed exporting content: %w", errors.Join(err, visitor.err))
+	var cursor *common.Key
+	for {
+		slots, next, err := db.WalkSlots(addr, cursor, exportBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, slot := range slots {
+			if _, err := out.Write([]byte{byte('S')}); err != nil {
+				return err
+			}
+			if _, err := out.Write(slot.Key[:]); err != nil {
+				return err
+			}
+			if _, err := out.Write(slot.Value[:]); err != nil {
+				return err
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		cursor = next
 	}
+}
 
-	return nil
+// ErrDuplicateKey is returned by imports encountering an account listed more
+// than once in the input, unless duplicates are accepted by the import's
+// configuration. The returned error is a DuplicateKeyError.
+const ErrDuplicateKey = common.ConstError("duplicate key in input")
+
+// DuplicateKeyError reports the address of an account listed more than once
+// in the input of an import.
+type DuplicateKeyError struct {
+	Address common.Address
+}
+
+func (e DuplicateKeyError) Error() string {
+	return fmt.Sprintf("%v: account %x", ErrDuplicateKey, e.Address)
+}
+
+func (e DuplicateKeyError) Unwrap() error {
+	return ErrDuplicateKey
+}
+
+// DuplicatePolicy defines how imports handle accounts listed more than once.
+// Since exported states list accounts in a fixed order, duplicates are only
+// detected if they are adjacent in the input.
+type DuplicatePolicy byte
+
+const (
+	// RejectDuplicates fails imports encountering duplicates with an
+	// ErrDuplicateKey. This is the default.
+	RejectDuplicates DuplicatePolicy = iota
+	// DuplicatesLastWins imports the last entry of duplicated accounts,
+	// including its storage, ignoring all earlier entries.
+	DuplicatesLastWins
+)
+
+// ImportConfig summarizes options for importing a LiveDB.
+type ImportConfig struct {
+	// Duplicates defines the handling of accounts listed more than once.
+	Duplicates DuplicatePolicy
 }
 
 // ImportLiveDb creates a fresh StateDB in the given directory and fills it
 // with the content read from the given reader.
 func ImportLiveDb(directory string, in io.Reader) error {
-	_, _, err := runImport(directory, in, mpt.S5LiveConfig)
+	return ImportLiveDbWithConfig(directory, in, ImportConfig{})
+}
+
+// ImportLiveDbWithConfig is a variant of ImportLiveDb allowing to customize
+// the import using the given configuration.
+func ImportLiveDbWithConfig(directory string, in io.Reader, config ImportConfig) error {
+	_, _, err := runImport(directory, in, mpt.S5LiveConfig, config)
+	return err
+}
+
+// ImportLiveDbStreaming is a variant of ImportLiveDb for importing states
+// too large to be held in memory. Nodes are written to disk as soon as they
+// are complete, keeping only the nodes along the path to the most recently
+// imported entry in memory. This requires the input to list accounts and
+// storage slots in the order produced by Export.
+func ImportLiveDbStreaming(directory string, in io.Reader) error {
+	return ImportLiveDbStreamingWithConfig(directory, in, ImportConfig{})
+}
+
+// ImportLiveDbStreamingWithConfig is a variant of ImportLiveDbStreaming
+// allowing to customize the import using the given configuration.
+func ImportLiveDbStreamingWithConfig(directory string, in io.Reader, config ImportConfig) error {
+	if err := checkEmptyDirectory(directory); err != nil {
+		return err
+	}
+	_, _, err := runStreamingImport(directory, in, mpt.S5LiveConfig, config)
 	return err
 }
 
@@ -124,8 +320,68 @@ func ImportLiveDb(directory string, in io.Reader) error {
 // the state read from the input stream at the given block. All states before
 // the given block are empty.
 func InitializeArchive(directory string, in io.Reader, block uint64) (err error) {
+	return InitializeArchiveWithProgress(context.Background(), directory, in, block, nil)
+}
+
+// InitializeArchiveWithProgress is an extended version of InitializeArchive
+// supporting the interruption and resumption of the initialization process.
+// If the given context is cancelled, the partially imported state is flushed
+// and a progress marker is stored in the target directory before returning
+// interrupt.ErrCanceled. A later call on the same directory with the same
+// input and block resumes the initialization from the recorded position. If
+// a progress callback is provided, it is periodically informed about the
+// progress of the initialization. If the input is a SizedInput, the reports
+// include the completed percentage and the estimated remaining time.
+func InitializeArchiveWithProgress(
+	ctx context.Context,
+	directory string,
+	in io.Reader,
+	block uint64,
+	callback InitProgressCallback,
+) (err error) {
+	// Check whether there is an interrupted initialization to be resumed.
+	marker, resume, err := readInitProgressMarker(directory)
+	if err != nil {
+		return err
+	}
+	var start *importProgress
+	if resume {
+		if marker.Block != block {
+			return fmt.Errorf("cannot resume initialization of block %d, directory contains partial initialization of block %d", block, marker.Block)
+		}
+		start = &marker.Progress
+	} else if err := checkEmptyDirectory(directory); err != nil {
+		return err
+	}
+
+	checkpoint := func(progress importProgress) error {
+		return writeInitProgressMarker(directory, initProgressMarker{
+			Block:    block,
+			Progress: progress,
+		})
+	}
+
+	var report func(importProgress, uint64)
+	if callback != nil {
+		startTime := time.Now()
+		sized, _ := in.(*SizedInput)
+		report = func(progress importProgress, nodesWritten uint64) {
+			res := InitProgress{
+				Position:     progress.Position,
+				Accounts:     progress.Accounts,
+				Slots:        progress.Slots,
+				NodesWritten: nodesWritten,
+				Elapsed:      time.Since(startTime),
+			}
+			if sized != nil {
+				res.Percent, res.ETA = sized.estimate(res.Elapsed)
+			}
+			callback(res)
+		}
+	}
+
 	// The import creates a live-DB state that initializes the Archive.
-	root, hash, err := runImport(directory, in, mpt.S5ArchiveConfig)
+	root, hash, err := runResumableImport(ctx, directory, in, mpt.S5ArchiveConfig, ImportConfig{}, start, report, checkpoint)
 	if err != nil {
 		return err
 	}
@@ -156,37 +412,87 @@ func InitializeArchive(directory string, in io.Reader, block uint64) (err error)
 	if err := mpt.StoreRoots(directory+string(os.PathSeparator)+"roots.dat", roots); err != nil {
 		return err
 	}
-	return nil
+
+	// The initialization is complete, the progress marker is no longer needed.
+	return removeInitProgressMarker(directory)
 }
 
-func runImport(directory string, in io.Reader, config mpt.MptConfig) (root mpt.NodeId, hash common.Hash, err error) {
+func runImport(directory string, in io.Reader, config mpt.MptConfig, importConfig ImportConfig) (root mpt.NodeId, hash common.Hash, err error) {
 	// check that the destination directory is an empty directory
 	if err := checkEmptyDirectory(directory); err != nil {
 		return root, hash, err
 	}
+	return runResumableImport(context.Background(), directory, in, config, importConfig, nil, nil, nil)
+}
 
-	// Start by checking the magic number.
-	buffer := make([]byte, len(stateMagicNumber))
-	if _, err := io.ReadFull(in, buffer); err != nil {
+// runResumableImport imports the state encoded in the given input stream into
+// the given directory. If a start position is given, the directory is expected
+// to contain the state produced by an earlier, interrupted import of the same
+// input stream up to the given position. In this case, the state is recovered
+// if the earlier import crashed, its hash is validated against the recorded
+// progress and the import continues from there. If the import fails or the
+// context gets cancelled, the state is flushed and, if this was successful,
+// the progress reached at the start of the current entry is passed to the
+// checkpoint function. Additionally, the state is flushed and the checkpoint
+// function is called periodically, such that crashed imports can be resumed
+// as well.
+func runResumableImport(
+	ctx context.Context,
+	directory string,
+	input io.Reader,
+	config mpt.MptConfig,
+	importConfig ImportConfig,
+	start *importProgress,
+	report func(importProgress, uint64),
+	checkpoint func(importProgress) error,
+) (root mpt.NodeId, hash common.Hash, err error) {
+	in := NewCountingReader(input)
+	if err := readFormatHeader(in); err != nil {
 		return root, hash, err
-	} else if !bytes.Equal(buffer, stateMagicNumber) {
-		return root, hash, fmt.Errorf("invalid format, wrong magic number")
 	}
 
-	// Check the version number.
-	if _, err := io.ReadFull(in, buffer[0:1]); err != nil {
-		return root, hash, err
-	} else if buffer[0] != formatVersion {
-		return root, hash, fmt.Errorf("invalid format, unsupported version")
+	// An import that crashed leaves a dirty directory behind, which needs to
+	// be recovered before the import can be resumed.
+	if start != nil {
+		if err := mpt.RecoverFileLiveTrie(directory, config, nil); err != nil {
+			return root, hash, fmt.Errorf("unable to resume import, state of earlier import is corrupted, restart in an empty directory: %w", err)
+		}
 	}
 
-	// Create a state.
-	db, err := mpt.OpenGoFileState(directory, config, mpt.DefaultMptStateCapacity)
+	// Create a state. For resumable imports, the background flushing is
+	// disabled such that the state on disk remains at the last checkpoint
+	// until the next one is recorded. Since the cache is far larger than the
+	// number of nodes modified between checkpoints, no modified node gets
+	// evicted in between either.
+	forestConfig := mpt.ForestConfig{CacheCapacity: mpt.DefaultMptStateCapacity}
+	if checkpoint != nil {
+		forestConfig.BackgroundFlushPeriod = -1
+	}
+	db, err := mpt.OpenGoFileStateWithConfig(directory, config, forestConfig)
 	if err != nil {
 		return root, hash, fmt.Errorf("failed to create empty state: %v", err)
 	}
+
+	// The progress covers the consumed input, the boundary the input up to
+	// the start of the current entry. While resuming an import, all entries
+	// up to the start position are already present in the state and only
+	// need to be skipped.
+	var progress, boundary importProgress
+	applying := start == nil
 	defer func() {
-		err = errors.Join(err, db.Close())
+		// Failed imports record the progress reached at the start of the
+		// failing entry. Entries only set values, so re-applying a
+		// partially applied entry when resuming yields the same state.
+		record := err != nil && applying && checkpoint != nil
+		var hashErr error
+		if record {
+			boundary.Hash, hashErr = db.GetHash()
+		}
+		closeErr := db.Close()
+		if record && hashErr == nil && closeErr == nil {
+			closeErr = checkpoint(boundary)
+		}
+		err = errors.Join(err, closeErr)
 	}()
 
 	var (
@@ -198,7 +504,7 @@ func runImport(directory string, in io.Reader, config mpt.MptConfig) (root mpt.N
 	)
 
 	// Read the rest and build the state.
-	buffer = buffer[0:1]
+	buffer := make([]byte, 1)
 	codes := map[common.Hash][]byte{
 		common.Keccak256([]byte{}): {},
 	}
@@ -207,18 +513,57 @@ func runImport(directory string, in io.Reader, config mpt.MptConfig) (root mpt.N
 
 	hashFound := false
 	var stateHash common.Hash
+	var duplicates duplicateDetector
 	for {
-		// Update hashes periodically to avoid running out of memory
-		// for nodes with dirty hashes.
-		counter++
-		if (counter % 100_000) == 0 {
-			if _, err := db.GetHash(); err != nil {
-				return root, hash, fmt.Errorf("failed to update hashes: %v", err)
+		if !applying && in.position >= start.Position {
+			if in.position != start.Position {
+				return root, hash, fmt.Errorf("unable to resume import, recorded position %d does not match input structure", start.Position)
+			}
+			got, err := db.GetHash()
+			if err != nil {
+				return root, hash, err
+			}
+			if got != start.Hash {
+				return root, hash, fmt.Errorf("unable to resume import, state hash does not match recorded progress, wanted %x, got %x", start.Hash, got)
+			}
+			applying = true
+		}
+
+		if applying {
+			boundary = progress
+			boundary.Position = in.position
+
+			// Update hashes periodically to avoid running out of memory
+			// for nodes with dirty hashes.
+			counter++
+			if (counter % checkpointPeriod) == 0 {
+				if _, err := db.GetHash(); err != nil {
+					return root, hash, fmt.Errorf("failed to update hashes: %v", err)
+				}
+				if report != nil {
+					report(boundary, db.GetNumberOfWrittenNodes())
+				}
+			}
+
+			// Record the progress periodically, starting with the first
+			// entry such that any aborted import can be resumed.
+			if checkpoint != nil && (counter == 1 || (counter%checkpointPeriod) == 0) {
+				if err := recordProgress(db, boundary, checkpoint); err != nil {
+					return root, hash, fmt.Errorf("failed to record import progress: %w", err)
+				}
+			}
+
+			// outside call to interrupt
+			if interrupt.IsCancelled(ctx) {
+				return root, hash, interrupt.ErrCanceled
 			}
 		}
 
 		if _, err := io.ReadFull(in, buffer); err != nil {
 			if err == io.EOF {
+				if !applying {
+					return root, hash, fmt.Errorf("unable to resume import, input ends before recorded position %d", start.Position)
+				}
 				if !hashFound {
 					return root, hash, fmt.Errorf("file does not contain a compatible state hash")
 				}
@@ -230,36 +575,195 @@ func runImport(directory string, in io.Reader, config mpt.MptConfig) (root mpt.N
 				if stateHash != hash {
 					return root, hash, fmt.Errorf("failed to reproduce valid state, hashes do not match")
 				}
+				if report != nil {
+					progress.Position = in.position
+					report(progress, db.GetNumberOfWrittenNodes())
+				}
 				return db.GetRootId(), hash, nil
 			}
 			return root, hash, err
 		}
 		switch buffer[0] {
 		case 'A':
+			progress.Accounts++
 			if _, err := io.ReadFull(in, addr[:]); err != nil {
 				return root, hash, err
 			}
 			if _, err := io.ReadFull(in, balance[:]); err != nil {
 				return root, hash, err
 			}
-			if err := db.SetBalance(addr, balance); err != nil {
+			if _, err := io.ReadFull(in, nonce[:]); err != nil {
 				return root, hash, err
 			}
-			if _, err := io.ReadFull(in, nonce[:]); err != nil {
+			if _, err := io.ReadFull(in, hash[:]); err != nil {
+				return root, hash, err
+			}
+			code, found := codes[hash]
+			if !found {
+				return root, hash, fmt.Errorf("missing code with hash %x for account %x", hash[:], addr[:])
+			}
+			duplicate, err := duplicates.check(addr, importConfig.Duplicates)
+			if err != nil {
+				return root, hash, err
+			}
+			if !applying {
+				continue
+			}
+			// The last entry of a duplicated account replaces earlier ones.
+			if duplicate {
+				if err := db.DeleteAccount(addr); err != nil {
+					return root, hash, err
+				}
+			}
+			if err := db.SetBalance(addr, balance); err != nil {
 				return root, hash, err
 			}
 			if err := db.SetNonce(addr, nonce); err != nil {
 				return root, hash, err
 			}
+			if err := db.SetCode(addr, code); err != nil {
+				return root, hash, err
+			}
+
+		case 'S':
+			progress.Slots++
+			if _, err := io.ReadFull(in, key[:]); err != nil {
+				return root, hash, err
+			}
+			if _, err := io.ReadFull(in, value[:]); err != nil {
+				return root, hash, err
+			}
+			if !applying {
+				continue
+			}
+			if err := db.SetStorage(addr, key, value); err != nil {
+				return root, hash, err
+			}
+
+		case 'C':
+			code, err := readCode(in)
+			if err != nil {
+				return root, hash, err
+			}
+			codes[common.Keccak256(code)] = code
+		case 'H':
+			if _, err := io.ReadFull(in, buffer); err != nil {
+				return root, hash, err
+			}
+			hashType := HashType(buffer[0])
+			hash := common.Hash{}
 			if _, err := io.ReadFull(in, hash[:]); err != nil {
 				return root, hash, err
 			}
-			if code, found := codes[hash]; found {
-				if err := db.SetCode(addr, code); err != nil {
+			if hashType == EthereumHash {
+				stateHash = hash
+				hashFound = true
+			}
+		default:
+			return root, hash, fmt.Errorf("format error encountered, unexpected token type: %c", buffer[0])
+		}
+	}
+}
+
+// checkpointPeriod is the number of entries between periodic checkpoints of
+// resumable imports.
+var checkpointPeriod = 100_000
+
+// recordProgress flushes the given state and passes the given progress, the
+// state is exactly covering, to the checkpoint function.
+func recordProgress(db *mpt.MptState, progress importProgress, checkpoint func(importProgress) error) error {
+	hash, err := db.GetHash()
+	if err != nil {
+		return err
+	}
+	if err := db.Flush(); err != nil {
+		return err
+	}
+	progress.Hash = hash
+	return checkpoint(progress)
+}
+
+// runStreamingImport imports the state encoded in the given input stream into
+// the given directory using a mpt.StreamingStateBuilder. Other than for
+// runResumableImport, the hash of the state is only available once all
+// entries have been consumed.
+func runStreamingImport(directory string, input io.Reader, config mpt.MptConfig, importConfig ImportConfig) (root mpt.NodeId, hash common.Hash, err error) {
+	in := bufio.NewReader(input)
+	if err := readFormatHeader(in); err != nil {
+		return root, hash, err
+	}
+
+	builder, err := mpt.NewStreamingStateBuilder(directory, config)
+	if err != nil {
+		return root, hash, fmt.Errorf("failed to create empty state: %v", err)
+	}
+	defer func() {
+		err = errors.Join(err, builder.Close())
+	}()
+
+	var (
+		addr     common.Address
+		key      common.Key
+		value    common.Value
+		balance  common.Balance
+		nonce    common.Nonce
+		codeHash common.Hash
+	)
+
+	buffer := make([]byte, 1)
+	codes := map[common.Hash]bool{
+		common.Keccak256([]byte{}): true,
+	}
+
+	hashFound := false
+	var stateHash common.Hash
+	var duplicates duplicateDetector
+	for {
+		if _, err := io.ReadFull(in, buffer); err != nil {
+			if err == io.EOF {
+				if !hashFound {
+					return root, hash, fmt.Errorf("file does not contain a compatible state hash")
+				}
+				root, hash, err := builder.Finish()
+				if err != nil {
 					return root, hash, err
 				}
+				if stateHash != hash {
+					return root, hash, fmt.Errorf("failed to reproduce valid state, hashes do not match")
+				}
+				return root, hash, nil
+			}
+			return root, hash, err
+		}
+		switch buffer[0] {
+		case 'A':
+			if _, err := io.ReadFull(in, addr[:]); err != nil {
+				return root, hash, err
+			}
+			if _, err := io.ReadFull(in, balance[:]); err != nil {
+				return root, hash, err
+			}
+			if _, err := io.ReadFull(in, nonce[:]); err != nil {
+				return root, hash, err
+			}
+			if _, err := io.ReadFull(in, codeHash[:]); err != nil {
+				return root, hash, err
+			}
+			if !codes[codeHash] {
+				return root, hash, fmt.Errorf("missing code with hash %x for account %x", codeHash[:], addr[:])
+			}
+			duplicate, err := duplicates.check(addr, importConfig.Duplicates)
+			if err != nil {
+				return root, hash, err
+			}
+			info := mpt.AccountInfo{Nonce: nonce, Balance: balance, CodeHash: codeHash}
+			if duplicate {
+				err = builder.ReplaceAccount(addr, info)
 			} else {
-				return root, hash, fmt.Errorf("missing code with hash %x for account %x", hash[:], addr[:])
+				err = builder.AddAccount(addr, info)
+			}
+			if err != nil {
+				return root, hash, err
 			}
 
 		case 'S':
@@ -269,7 +773,7 @@ func runImport(directory string, in io.Reader, config mpt.MptConfig) (root mpt.N
 			if _, err := io.ReadFull(in, value[:]); err != nil {
 				return root, hash, err
 			}
-			if err := db.SetStorage(addr, key, value); err != nil {
+			if err := builder.AddStorage(key, value); err != nil {
 				return root, hash, err
 			}
 
@@ -278,7 +782,10 @@ func runImport(directory string, in io.Reader, config mpt.MptConfig) (root mpt.N
 			if err != nil {
 				return root, hash, err
 			}
-			codes[common.Keccak256(code)] = code
+			codes[common.Keccak256(code)] = true
+			if len(code) > 0 {
+				builder.AddCode(code)
+			}
 		case 'H':
 			if _, err := io.ReadFull(in, buffer); err != nil {
 				return root, hash, err
@@ -298,6 +805,46 @@ func runImport(directory string, in io.Reader, config mpt.MptConfig) (root mpt.N
 	}
 }
 
+// duplicateDetector detects accounts listed more than once in the input of
+// an import by comparing each account with the preceding one.
+type duplicateDetector struct {
+	last    common.Address
+	present bool
+}
+
+// check registers the given account and reports whether it duplicates the
+// preceding account. If so, an error is returned unless the given policy
+// accepts duplicates.
+func (d *duplicateDetector) check(addr common.Address, policy DuplicatePolicy) (bool, error) {
+	duplicate := d.present && d.last == addr
+	d.last = addr
+	d.present = true
+	if duplicate && policy != DuplicatesLastWins {
+		return false, DuplicateKeyError{Address: addr}
+	}
+	return duplicate, nil
+}
+
+// readFormatHeader consumes the magic number and the version number at the
+// beginning of an exported state and checks that they are supported.
+func readFormatHeader(in io.Reader) error {
+	// Start by checking the magic number.
+	buffer := make([]byte, len(stateMagicNumber))
+	if _, err := io.ReadFull(in, buffer); err != nil {
+		return err
+	} else if !bytes.Equal(buffer, stateMagicNumber) {
+		return fmt.Errorf("invalid format, wrong magic number")
+	}
+
+	// Check the version number.
+	if _, err := io.ReadFull(in, buffer[0:1]); err != nil {
+		return err
+	} else if buffer[0] != formatVersion {
+		return fmt.Errorf("invalid format, unsupported version")
+	}
+	return nil
+}
+
 // getReferencedCodes returns a map of codes referenced by accounts in the
 // given database. The map is indexed by the code hash.
 func getReferencedCodes(db *mpt.MptState) (map[common.Hash][]byte, error) {
@@ -316,63 +863,6 @@ func getReferencedCodes(db *mpt.MptState) (map[common.Hash][]byte, error) {
 	return codes, err
 }
 
-// exportVisitor is an internal utility used by the Export function to write
-// account and value node information to a given output writer.
-type exportVisitor struct {
-	out io.Writer
-	err error
-	ctx context.Context
-}
-
-func (e *exportVisitor) Visit(node mpt.Node, _ mpt.NodeInfo) mpt.VisitResponse {
-	// outside call to interrupt
-	if interrupt.IsCancelled(e.ctx) {
-		e.err = interrupt.ErrCanceled
-		return mpt.VisitResponseAbort
-	}
-	switch n := node.(type) {
-	case *mpt.AccountNode:
-		addr := n.Address()
-		info := n.Info()
-		if _, err := e.out.Write([]byte{byte('A')}); err != nil {
-			e.err = err
-			return mpt.VisitResponseAbort
-		}
-		if _, err := e.out.Write(addr[:]); err != nil {
-			e.err = err
-			return mpt.VisitResponseAbort
-		}
-		if _, err := e.out.Write(info.Balance[:]); err != nil {
-			e.err = err
-			return mpt.VisitResponseAbort
-		}
-		if _, err := e.out.Write(info.Nonce[:]); err != nil {
-			e.err = err
-			return mpt.VisitResponseAbort
-		}
-		if _, err := e.out.Write(info.CodeHash[:]); err != nil {
-			e.err = err
-			return mpt.VisitResponseAbort
-		}
-	case *mpt.ValueNode:
-		key := n.Key()
-		value := n.Value()
-		if _, err := e.out.Write([]byte{byte('S')}); err != nil {
-			e.err = err
-			return mpt.VisitResponseAbort
-		}
-		if _, err := e.out.Write(key[:]); err != nil {
-			e.err = err
-			return mpt.VisitResponseAbort
-		}
-		if _, err := e.out.Write(value[:]); err != nil {
-			e.err = err
-			return mpt.VisitResponseAbort
-		}
-	}
-	return mpt.VisitResponseContinue
-}
-
 func checkEmptyDirectory(directory string) error {
 	file, err := os.Open(directory)
 	if err != nil {
@@ -14,11 +14,17 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/common/interrupt"
 	"github.com/Fantom-foundation/Carmen/go/database/mpt"
 )
 
@@ -53,6 +59,127 @@ func TestIO_ExportAndImportAsLiveDb(t *testing.T) {
 	}
 }
 
+func TestIO_ExportAndStreamingImportAsLiveDb(t *testing.T) {
+	genesis, hash := exportExampleState(t)
+
+	targetDir := t.TempDir()
+	if err := ImportLiveDbStreaming(targetDir, bytes.NewBuffer(genesis)); err != nil {
+		t.Fatalf("failed to import DB: %v", err)
+	}
+
+	if err := mpt.VerifyFileLiveTrie(targetDir, mpt.S5LiveConfig, nil); err != nil {
+		t.Fatalf("verification of imported DB failed: %v", err)
+	}
+
+	db, err := mpt.OpenGoFileState(targetDir, mpt.S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open recovered DB: %v", err)
+	}
+	defer db.Close()
+
+	if code, err := db.GetCode(common.Address{1}); err != nil || string(code) != "some_code" {
+		t.Errorf("restored DB does not contain code of account 1, got %q, err %v", code, err)
+	}
+	if value, err := db.GetStorage(common.Address{2}, common.Key{2}); err != nil || value != (common.Value{2}) {
+		t.Errorf("restored DB does not contain storage of account 2, got %x, err %v", value, err)
+	}
+
+	if got, err := db.GetHash(); err != nil || got != hash {
+		t.Fatalf("restored DB failed to reproduce same hash\nwanted %x\n   got %x\n   err %v", hash, got, err)
+	}
+}
+
+func TestIO_StreamingImportProducesSameRootWithLessMemory(t *testing.T) {
+	sourceDir := t.TempDir()
+	db, err := mpt.OpenGoFileState(sourceDir, mpt.S5LiveConfig, 100_000)
+	if err != nil {
+		t.Fatalf("failed to create test DB: %v", err)
+	}
+	for i := 0; i < 2000; i++ {
+		addr := common.Address{byte(i), byte(i >> 8)}
+		if err := db.SetNonce(addr, common.ToNonce(uint64(i+1))); err != nil {
+			t.Fatalf("failed to set nonce: %v", err)
+		}
+		for j := 0; j < 10; j++ {
+			if err := db.SetStorage(addr, common.Key{byte(j)}, common.Value{byte(i), byte(j)}); err != nil {
+				t.Fatalf("failed to set storage: %v", err)
+			}
+		}
+		// Update hashes periodically to avoid evicting nodes with dirty hashes.
+		if i%100 == 0 {
+			if _, err := db.GetHash(); err != nil {
+				t.Fatalf("failed to update hashes: %v", err)
+			}
+		}
+	}
+	if _, err := db.GetHash(); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close DB: %v", err)
+	}
+	var buffer bytes.Buffer
+	if err := Export(context.Background(), sourceDir, &buffer); err != nil {
+		t.Fatalf("failed to export DB: %v", err)
+	}
+	genesis := buffer.Bytes()
+
+	var wantRoot, gotRoot common.Hash
+	fullPeak := measurePeakHeapUsage(func() {
+		_, wantRoot, err = runImport(t.TempDir(), bytes.NewReader(genesis), mpt.S5LiveConfig, ImportConfig{})
+	})
+	if err != nil {
+		t.Fatalf("failed to import DB: %v", err)
+	}
+	streamingPeak := measurePeakHeapUsage(func() {
+		_, gotRoot, err = runStreamingImport(t.TempDir(), bytes.NewReader(genesis), mpt.S5LiveConfig, ImportConfig{})
+	})
+	if err != nil {
+		t.Fatalf("failed to import DB using streaming: %v", err)
+	}
+
+	if wantRoot != gotRoot {
+		t.Errorf("streaming import produced different root hash\nwanted %x\n   got %x", wantRoot, gotRoot)
+	}
+	t.Logf("peak heap usage of full import: %d bytes, streaming import: %d bytes", fullPeak, streamingPeak)
+	if streamingPeak >= fullPeak {
+		t.Errorf("streaming import should use less memory, full import peak %d bytes, streaming import peak %d bytes", fullPeak, streamingPeak)
+	}
+}
+
+// measurePeakHeapUsage runs the given function and returns the maximum number
+// of bytes allocated on the heap observed while it was running.
+func measurePeakHeapUsage(run func()) uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	base := stats.HeapAlloc
+
+	var peak uint64
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > base && stats.HeapAlloc-base > peak {
+				peak = stats.HeapAlloc - base
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	run()
+	close(done)
+	wg.Wait()
+	return peak
+}
+
 func TestIO_ExportAndImportAsArchive(t *testing.T) {
 	genesis, hash := exportExampleState(t)
 
@@ -106,6 +233,119 @@ func TestIO_ExportedDataIsDeterministic(t *testing.T) {
 	}
 }
 
+func TestIO_ConcurrentExportProducesSameDataAsSequentialExport(t *testing.T) {
+	sourceDir := t.TempDir()
+	db, err := mpt.OpenGoFileState(sourceDir, mpt.S5LiveConfig, 100_000)
+	if err != nil {
+		t.Fatalf("failed to create test DB: %v", err)
+	}
+	// The state needs to be large enough to fill multiple write chunks.
+	for i := 0; i < 1000; i++ {
+		addr := common.Address{byte(i), byte(i >> 8)}
+		if err := db.SetNonce(addr, common.ToNonce(uint64(i+1))); err != nil {
+			t.Fatalf("failed to set nonce: %v", err)
+		}
+		for j := 0; j < 10; j++ {
+			if err := db.SetStorage(addr, common.Key{byte(j)}, common.Value{byte(i), byte(j)}); err != nil {
+				t.Fatalf("failed to set storage: %v", err)
+			}
+		}
+		// Update hashes periodically to avoid evicting nodes with dirty hashes.
+		if i%100 == 0 {
+			if _, err := db.GetHash(); err != nil {
+				t.Fatalf("failed to update hashes: %v", err)
+			}
+		}
+	}
+	if _, err := db.GetHash(); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close DB: %v", err)
+	}
+
+	var reference bytes.Buffer
+	if err := Export(context.Background(), sourceDir, &reference); err != nil {
+		t.Fatalf("failed to export DB: %v", err)
+	}
+	if reference.Len() <= 2*asyncWriterChunkSize {
+		t.Fatalf("test state is too small to cover multiple chunks, got %d bytes", reference.Len())
+	}
+
+	for _, queueLength := range []int{1, 2, 16} {
+		var buffer bytes.Buffer
+		config := ExportConfig{WriteQueueLength: queueLength}
+		if err := ExportWithConfig(context.Background(), sourceDir, &buffer, config); err != nil {
+			t.Fatalf("failed to export DB: %v", err)
+		}
+		if !bytes.Equal(reference.Bytes(), buffer.Bytes()) {
+			t.Errorf("concurrent export with queue length %d produced different output", queueLength)
+		}
+	}
+}
+
+func TestIO_ConcurrentExportReportsOutputErrors(t *testing.T) {
+	sourceDir := t.TempDir()
+	if err := createExampleLiveDB(t, sourceDir).Close(); err != nil {
+		t.Fatalf("failed to close DB: %v", err)
+	}
+
+	injectedErr := errors.New("injected error")
+	config := ExportConfig{WriteQueueLength: 4}
+	if err := ExportWithConfig(context.Background(), sourceDir, failingWriter{injectedErr}, config); !errors.Is(err, injectedErr) {
+		t.Errorf("unexpected error, wanted %v, got %v", injectedErr, err)
+	}
+}
+
+func TestIO_InterruptedExportCanBeResumed(t *testing.T) {
+	sourceDir := t.TempDir()
+	if err := createExampleLiveDB(t, sourceDir).Close(); err != nil {
+		t.Fatalf("failed to close DB: %v", err)
+	}
+
+	var reference bytes.Buffer
+	numAccounts := 0
+	config := ExportConfig{Checkpoint: func(common.Address) { numAccounts++ }}
+	if err := ExportWithConfig(context.Background(), sourceDir, &reference, config); err != nil {
+		t.Fatalf("failed to export DB: %v", err)
+	}
+
+	for interruptAfter := 1; interruptAfter < numAccounts; interruptAfter++ {
+		for _, queueLength := range []int{0, 4} {
+			t.Run(fmt.Sprintf("after=%d/queue=%d", interruptAfter, queueLength), func(t *testing.T) {
+				var buffer bytes.Buffer
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				var last *common.Address
+				remaining := interruptAfter
+				config := ExportConfig{
+					WriteQueueLength: queueLength,
+					Checkpoint: func(addr common.Address) {
+						last = &addr
+						if remaining--; remaining == 0 {
+							cancel()
+						}
+					},
+				}
+				if err := ExportWithConfig(ctx, sourceDir, &buffer, config); !errors.Is(err, interrupt.ErrCanceled) {
+					t.Fatalf("export should have been interrupted, got %v", err)
+				}
+				if last == nil {
+					t.Fatalf("no account reported as exported")
+				}
+
+				config = ExportConfig{WriteQueueLength: queueLength, ResumeFrom: last}
+				if err := ExportWithConfig(context.Background(), sourceDir, &buffer, config); err != nil {
+					t.Fatalf("failed to resume export: %v", err)
+				}
+				if !bytes.Equal(reference.Bytes(), buffer.Bytes()) {
+					t.Errorf("resumed export produced different output")
+				}
+			})
+		}
+	}
+}
+
 func TestIO_ExportedDataDoesNotContainExtraCodes(t *testing.T) {
 	reference, referenceHash := exportExampleState(t)
 
@@ -220,6 +460,92 @@ func exportExampleStateWithModification(t *testing.T, modify func(s *mpt.MptStat
 	return buffer.Bytes(), hash
 }
 
+func TestImport_DuplicateAccountsAreRejected(t *testing.T) {
+	genesis, _ := exportExampleState(t)
+	addr := common.Address{2}
+	genesis = insertDuplicateAccount(t, genesis, addr)
+
+	imports := map[string]func(string, io.Reader) error{
+		"regular":   ImportLiveDb,
+		"streaming": ImportLiveDbStreaming,
+	}
+	for name, runImport := range imports {
+		t.Run(name, func(t *testing.T) {
+			err := runImport(t.TempDir(), bytes.NewReader(genesis))
+			if !errors.Is(err, ErrDuplicateKey) {
+				t.Fatalf("import of duplicate account should fail with ErrDuplicateKey, got %v", err)
+			}
+			var duplicate DuplicateKeyError
+			if !errors.As(err, &duplicate) || duplicate.Address != addr {
+				t.Errorf("unexpected duplicate reported, wanted %x, got %v", addr, err)
+			}
+		})
+	}
+}
+
+func TestImport_LastEntryOfDuplicateAccountsWins(t *testing.T) {
+	genesis, hash := exportExampleState(t)
+	addr := common.Address{2}
+	genesis = insertDuplicateAccount(t, genesis, addr)
+
+	config := ImportConfig{Duplicates: DuplicatesLastWins}
+	imports := map[string]func(string, io.Reader, ImportConfig) error{
+		"regular":   ImportLiveDbWithConfig,
+		"streaming": ImportLiveDbStreamingWithConfig,
+	}
+	for name, runImport := range imports {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := runImport(dir, bytes.NewReader(genesis), config); err != nil {
+				t.Fatalf("failed to import DB: %v", err)
+			}
+			if err := mpt.VerifyFileLiveTrie(dir, mpt.S5LiveConfig, nil); err != nil {
+				t.Fatalf("verification of imported DB failed: %v", err)
+			}
+
+			db, err := mpt.OpenGoFileState(dir, mpt.S5LiveConfig, 1024)
+			if err != nil {
+				t.Fatalf("failed to open imported DB: %v", err)
+			}
+			defer db.Close()
+			if nonce, err := db.GetNonce(addr); err != nil || nonce != common.ToNonce(2) {
+				t.Errorf("unexpected nonce of duplicated account, wanted 2, got %v, err %v", nonce, err)
+			}
+			if value, err := db.GetStorage(addr, common.Key{9}); err != nil || value != (common.Value{}) {
+				t.Errorf("storage of overridden entry should be discarded, got %x, err %v", value, err)
+			}
+			if got, err := db.GetHash(); err != nil || got != hash {
+				t.Errorf("imported DB failed to reproduce same hash\nwanted %x\n   got %x\n   err %v", hash, got, err)
+			}
+		})
+	}
+}
+
+// insertDuplicateAccount inserts an entry for the given account with storage
+// into the given exported state, right before the account's original entry.
+func insertDuplicateAccount(t *testing.T, genesis []byte, addr common.Address) []byte {
+	t.Helper()
+	pos := bytes.Index(genesis, append([]byte{'A'}, addr[:]...))
+	if pos < 0 {
+		t.Fatalf("account %x not found in exported state", addr)
+	}
+	entry := append([]byte{'A'}, addr[:]...)
+	balance := common.Balance{99}
+	nonce := common.ToNonce(99)
+	codeHash := common.Keccak256([]byte{})
+	entry = append(entry, balance[:]...)
+	entry = append(entry, nonce[:]...)
+	entry = append(entry, codeHash[:]...)
+	key, value := common.Key{9}, common.Value{9}
+	entry = append(entry, 'S')
+	entry = append(entry, key[:]...)
+	entry = append(entry, value[:]...)
+
+	res := append([]byte{}, genesis[:pos]...)
+	res = append(res, entry...)
+	return append(res, genesis[pos:]...)
+}
+
 func TestImport_ImportIntoNonEmptyTargetDirectoryFails(t *testing.T) {
 	dir := t.TempDir()
 	if err := os.WriteFile(dir+string(os.PathSeparator)+"test.txt", nil, 0700); err != nil {
@@ -231,6 +557,17 @@ func TestImport_ImportIntoNonEmptyTargetDirectoryFails(t *testing.T) {
 	}
 }
 
+func TestImport_StreamingImportIntoNonEmptyTargetDirectoryFails(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+string(os.PathSeparator)+"test.txt", nil, 0700); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if err := ImportLiveDbStreaming(dir, nil); err == nil || !strings.Contains(err.Error(), "is not empty") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
 func TestInitializeArchive_ImportIntoNonEmptyTargetDirectoryFails(t *testing.T) {
 	dir := t.TempDir()
 	if err := os.WriteFile(dir+string(os.PathSeparator)+"test.txt", nil, 0700); err != nil {
@@ -0,0 +1,576 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// AccountEntry is an account produced by an account iterator.
+type AccountEntry struct {
+	Address common.Address
+	Info    AccountInfo
+}
+
+// SlotEntry is a storage slot produced by a storage iterator.
+type SlotEntry struct {
+	Key   common.Key
+	Value common.Value
+}
+
+// LeafIterator iterates over the leaves of a trie in the order of their paths
+// -- thus, for configurations using hashed paths, in the order of the hashes
+// of their addresses or keys. By default, nodes are loaded lazily when
+// advancing the iterator. If prefetching is enabled, leaves are loaded
+// asynchronously ahead of the consumer, overlapping the IO required for
+// loading nodes with the processing of the current leaf. The trie must not be
+// modified while being iterated. Iterators need to be closed to release
+// resources, in particular if the iteration is aborted early.
+//
+// A typical use looks like this:
+//
+//	iter, err := trie.NewAccountIterator(64)
+//	...
+//	defer iter.Close()
+//	for iter.Next() {
+//		entry := iter.Current()
+//		...
+//	}
+//	if err := iter.Err(); err != nil {
+//		...
+//	}
+type LeafIterator[T any] struct {
+	walker  *leafWalker[T]
+	current T
+	err     error
+	closed  bool
+
+	// Set only if prefetching is enabled.
+	prefetched <-chan leafResult[T] // leaves loaded ahead, in iteration order
+	done       chan struct{}        // closed to stop the prefetching goroutine
+}
+
+type leafResult[T any] struct {
+	leaf T
+	err  error
+}
+
+// newLeafIterator creates an iterator over the leaves located by the given
+// walker. If prefetch is positive, up to the given number of leaves are
+// loaded ahead of the consumer by a background goroutine.
+func newLeafIterator[T any](walker *leafWalker[T], prefetch int) *LeafIterator[T] {
+	res := &LeafIterator[T]{walker: walker}
+	if prefetch <= 0 {
+		return res
+	}
+	results := make(chan leafResult[T], prefetch)
+	done := make(chan struct{})
+	res.prefetched = results
+	res.done = done
+	go func() {
+		defer close(results)
+		for {
+			leaf, found, err := walker.next()
+			if !found && err == nil {
+				return
+			}
+			select {
+			case results <- leafResult[T]{leaf, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return res
+}
+
+// Next advances the iterator to the next leaf. It returns false if the end of
+// the trie got reached, an error occurred, or the iterator got closed.
+func (i *LeafIterator[T]) Next() bool {
+	if i.closed || i.err != nil {
+		return false
+	}
+	var leaf T
+	var found bool
+	var err error
+	if i.prefetched != nil {
+		var res leafResult[T]
+		res, found = <-i.prefetched
+		leaf, err = res.leaf, res.err
+	} else {
+		leaf, found, err = i.walker.next()
+	}
+	if err != nil {
+		i.err = err
+		return false
+	}
+	if found {
+		i.current = leaf
+	}
+	return found
+}
+
+// Current returns the leaf the iterator is positioned at.
+func (i *LeafIterator[T]) Current() T {
+	return i.current
+}
+
+// Err returns the error encountered during the iteration, if any.
+func (i *LeafIterator[T]) Err() error {
+	return i.err
+}
+
+// Close stops the iteration. After Close returns, the trie is no longer
+// accessed by the iterator. Closing an iterator multiple times is a no-op.
+func (i *LeafIterator[T]) Close() {
+	if i.closed {
+		return
+	}
+	i.closed = true
+	if i.prefetched == nil {
+		return
+	}
+	close(i.done)
+	// Wait for the prefetching goroutine to stop.
+	for range i.prefetched {
+	}
+}
+
+// leafWalker conducts a depth-first traversal of a trie, producing the
+// selected leaves one at a time. No node access is retained in between.
+type leafWalker[T any] struct {
+	source NodeSource
+	stack  []NodeReference // the nodes still to be visited, the next on top
+	leaf   func(Node) (T, bool)
+	stop   func(Node) bool // nodes not to descend into, nil to descend into all
+}
+
+// next produces the next leaf of the traversal, if there is any.
+func (w *leafWalker[T]) next() (T, bool, error) {
+	var empty T
+	for len(w.stack) > 0 {
+		ref := w.stack[len(w.stack)-1]
+		w.stack = w.stack[:len(w.stack)-1]
+		if ref.Id().IsEmpty() {
+			continue
+		}
+		handle, err := w.source.getViewAccess(&ref)
+		if err != nil {
+			return empty, false, err
+		}
+		node := handle.Get()
+		leaf, isLeaf := w.leaf(node)
+		if w.stop == nil || !w.stop(node) {
+			switch n := node.(type) {
+			case *BranchNode:
+				for i := len(n.children) - 1; i >= 0; i-- {
+					if !n.children[i].Id().IsEmpty() {
+						w.stack = append(w.stack, n.children[i])
+					}
+				}
+			case *ExtensionNode:
+				w.stack = append(w.stack, n.next)
+			case *AccountNode:
+				w.stack = append(w.stack, n.storage)
+			}
+		}
+		handle.Release()
+		if isLeaf {
+			return leaf, true, nil
+		}
+	}
+	return empty, false, nil
+}
+
+// newAccountIterator creates an iterator over the accounts of the trie rooted
+// by the given node.
+func newAccountIterator(source NodeSource, root *NodeReference, prefetch int) *LeafIterator[AccountEntry] {
+	return newLeafIterator(&leafWalker[AccountEntry]{
+		source: source,
+		stack:  []NodeReference{*root},
+		leaf: func(node Node) (AccountEntry, bool) {
+			if account, ok := node.(*AccountNode); ok {
+				return AccountEntry{Address: account.address, Info: account.info}, true
+			}
+			return AccountEntry{}, false
+		},
+		stop: func(node Node) bool {
+			_, isAccount := node.(*AccountNode)
+			return isAccount
+		},
+	}, prefetch)
+}
+
+// newStorageIterator creates an iterator over the slots of the storage trie
+// rooted by the given node.
+func newStorageIterator(source NodeSource, root *NodeReference, prefetch int) *LeafIterator[SlotEntry] {
+	return newLeafIterator(&leafWalker[SlotEntry]{
+		source: source,
+		stack:  []NodeReference{*root},
+		leaf: func(node Node) (SlotEntry, bool) {
+			if value, ok := node.(*ValueNode); ok {
+				return SlotEntry{Key: value.key, Value: value.value}, true
+			}
+			return SlotEntry{}, false
+		},
+	}, prefetch)
+}
+
+// AccountsWithStorage creates an iterator over the addresses of all accounts
+// of the trie rooted by the given node holding a non-empty storage, in the
+// order of their paths. The accounts are located in a single traversal of the
+// trie, without descending into storage tries. If prefetch is positive, up to
+// the given number of addresses are loaded ahead of the consumer. See
+// LeafIterator for details.
+func AccountsWithStorage(source NodeSource, root *NodeReference, prefetch int) *LeafIterator[common.Address] {
+	return newLeafIterator(&leafWalker[common.Address]{
+		source: source,
+		stack:  []NodeReference{*root},
+		leaf: func(node Node) (common.Address, bool) {
+			if account, ok := node.(*AccountNode); ok && !account.storage.Id().IsEmpty() {
+				return account.address, true
+			}
+			return common.Address{}, false
+		},
+		stop: func(node Node) bool {
+			_, isAccount := node.(*AccountNode)
+			return isAccount
+		},
+	}, prefetch)
+}
+
+// NewAccountIterator creates an iterator over all accounts of this trie. If
+// prefetch is positive, up to the given number of accounts are loaded ahead
+// of the consumer. See LeafIterator for details.
+func (s *LiveTrie) NewAccountIterator(prefetch int) (*LeafIterator[AccountEntry], error) {
+	source, ok := s.forest.(NodeSource)
+	if !ok {
+		return nil, fmt.Errorf("node access is not supported by %T", s.forest)
+	}
+	return newAccountIterator(source, &s.root, prefetch), nil
+}
+
+// AccountsWithStorage creates an iterator over the addresses of all accounts
+// of this trie holding a non-empty storage. See the package-level
+// AccountsWithStorage for details.
+func (s *LiveTrie) AccountsWithStorage(prefetch int) (*LeafIterator[common.Address], error) {
+	source, ok := s.forest.(NodeSource)
+	if !ok {
+		return nil, fmt.Errorf("node access is not supported by %T", s.forest)
+	}
+	return AccountsWithStorage(source, &s.root, prefetch), nil
+}
+
+// NewStorageIterator creates an iterator over all storage slots of the given
+// account in this trie. For non-existing accounts, the iteration is empty. If
+// prefetch is positive, up to the given number of slots are loaded ahead of
+// the consumer. See LeafIterator for details.
+func (s *LiveTrie) NewStorageIterator(addr common.Address, prefetch int) (*LeafIterator[SlotEntry], error) {
+	source, ok := s.forest.(NodeSource)
+	if !ok {
+		return nil, fmt.Errorf("node access is not supported by %T", s.forest)
+	}
+	storage, err := getStorageRoot(source, &s.root, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newStorageIterator(source, &storage, prefetch), nil
+}
+
+// seek positions the walker such that it produces the leaves of the trie
+// rooted by the given node located after the given path, in path order. The
+// given function identifies leaves and provides their full path. Instead of
+// traversing the part of the trie preceding the given path, only the nodes on
+// the path are visited, making the costs of seeking proportional to the depth
+// of the trie. The path does not need to lead to an existing leaf.
+func (w *leafWalker[T]) seek(root NodeReference, path []Nibble, leafPath func(Node) ([]Nibble, bool)) error {
+	w.stack = w.stack[:0]
+	ref := root
+	depth := 0
+	for !ref.Id().IsEmpty() {
+		handle, err := w.source.getViewAccess(&ref)
+		if err != nil {
+			return err
+		}
+		next := NewNodeReference(EmptyId())
+		node := handle.Get()
+		if full, isLeaf := leafPath(node); isLeaf {
+			if slices.Compare(full, path) > 0 {
+				w.stack = append(w.stack, ref)
+			}
+		} else {
+			switch n := node.(type) {
+			case *BranchNode:
+				// Children after the path are visited after the sub-trie
+				// containing the path, thus they are placed below it.
+				pos := -1
+				if depth < len(path) {
+					pos = int(path[depth])
+				}
+				for i := len(n.children) - 1; i > pos; i-- {
+					if !n.children[i].Id().IsEmpty() {
+						w.stack = append(w.stack, n.children[i])
+					}
+				}
+				if pos >= 0 {
+					next = n.children[pos]
+					depth++
+				}
+			case *ExtensionNode:
+				rest := []Nibble{}
+				if depth < len(path) {
+					rest = path[depth:]
+				}
+				switch res := comparePathPrefix(&n.path, rest); {
+				case res == 0:
+					next = n.next
+					depth += n.path.Length()
+				case res > 0:
+					w.stack = append(w.stack, n.next)
+				}
+			}
+		}
+		handle.Release()
+		ref = next
+	}
+	return nil
+}
+
+// comparePathPrefix compares the given path with the prefix of the given list
+// of nibbles of the same length. If the list is shorter than the path, the
+// list is considered to be smaller.
+func comparePathPrefix(path *Path, list []Nibble) int {
+	for i := 0; i < path.Length(); i++ {
+		if i >= len(list) {
+			return 1
+		}
+		if res := cmp.Compare(path.Get(i), list[i]); res != 0 {
+			return res
+		}
+	}
+	return 0
+}
+
+// walk produces up to limit leaves located after the given path, or from the
+// beginning of the trie if the path is nil. The second result is true if there
+// are more leaves after the produced leaves.
+func (w *leafWalker[T]) walk(root NodeReference, startAfter []Nibble, leafPath func(Node) ([]Nibble, bool), limit int) ([]T, bool, error) {
+	if limit <= 0 {
+		return nil, false, fmt.Errorf("invalid limit: %d", limit)
+	}
+	if startAfter == nil {
+		w.stack = append(w.stack[:0], root)
+	} else if err := w.seek(root, startAfter, leafPath); err != nil {
+		return nil, false, err
+	}
+	res := []T{}
+	for {
+		leaf, found, err := w.next()
+		if err != nil || !found {
+			return res, false, err
+		}
+		if len(res) == limit {
+			return res, true, nil
+		}
+		res = append(res, leaf)
+	}
+}
+
+// WalkAccounts returns up to limit accounts of the trie rooted by the given
+// node following the given account in path order -- thus, for configurations
+// using hashed paths, in the order of the hashes of the addresses. If
+// startAfter is nil, accounts are listed from the beginning of the trie. The
+// given account does not need to exist. If there are more accounts after the
+// listed accounts, a cursor is returned which can be used as startAfter
+// parameter to resume the listing. Otherwise, the returned cursor is nil.
+// Resuming a listing only visits the nodes on the path to the cursor before
+// listing further accounts, thus it does not depend on the number of accounts
+// listed before. The trie must not be modified in between resumed calls.
+func WalkAccounts(source NodeSource, root *NodeReference, startAfter *common.Address, limit int) ([]AccountEntry, *common.Address, error) {
+	walker := &leafWalker[AccountEntry]{
+		source: source,
+		leaf: func(node Node) (AccountEntry, bool) {
+			if account, ok := node.(*AccountNode); ok {
+				return AccountEntry{Address: account.address, Info: account.info}, true
+			}
+			return AccountEntry{}, false
+		},
+		stop: func(node Node) bool {
+			_, isAccount := node.(*AccountNode)
+			return isAccount
+		},
+	}
+	var start []Nibble
+	if startAfter != nil {
+		start = AddressToNibblePath(*startAfter, source)
+	}
+	res, more, err := walker.walk(*root, start, func(node Node) ([]Nibble, bool) {
+		if account, ok := node.(*AccountNode); ok {
+			return AddressToNibblePath(account.address, source), true
+		}
+		return nil, false
+	}, limit)
+	if err != nil || !more {
+		return res, nil, err
+	}
+	cursor := res[len(res)-1].Address
+	return res, &cursor, nil
+}
+
+// WalkSlots returns up to limit slots of the storage trie rooted by the given
+// node following the given key in path order. It is the storage counterpart
+// of WalkAccounts, see WalkAccounts for details.
+func WalkSlots(source NodeSource, storageRoot *NodeReference, startAfter *common.Key, limit int) ([]SlotEntry, *common.Key, error) {
+	walker := &leafWalker[SlotEntry]{
+		source: source,
+		leaf: func(node Node) (SlotEntry, bool) {
+			if value, ok := node.(*ValueNode); ok {
+				return SlotEntry{Key: value.key, Value: value.value}, true
+			}
+			return SlotEntry{}, false
+		},
+	}
+	var start []Nibble
+	if startAfter != nil {
+		start = KeyToNibblePath(*startAfter, source)
+	}
+	res, more, err := walker.walk(*storageRoot, start, func(node Node) ([]Nibble, bool) {
+		if value, ok := node.(*ValueNode); ok {
+			return KeyToNibblePath(value.key, source), true
+		}
+		return nil, false
+	}, limit)
+	if err != nil || !more {
+		return res, nil, err
+	}
+	cursor := res[len(res)-1].Key
+	return res, &cursor, nil
+}
+
+// WalkAccounts lists up to limit accounts of this trie following the given
+// account. See the package-level WalkAccounts for details.
+func (s *LiveTrie) WalkAccounts(startAfter *common.Address, limit int) ([]AccountEntry, *common.Address, error) {
+	source, ok := s.forest.(NodeSource)
+	if !ok {
+		return nil, nil, fmt.Errorf("node access is not supported by %T", s.forest)
+	}
+	return WalkAccounts(source, &s.root, startAfter, limit)
+}
+
+// WalkSlots lists up to limit slots of the given account in this trie
+// following the given key. For non-existing accounts, no slots are listed.
+// See the package-level WalkSlots for details.
+func (s *LiveTrie) WalkSlots(addr common.Address, startAfter *common.Key, limit int) ([]SlotEntry, *common.Key, error) {
+	source, ok := s.forest.(NodeSource)
+	if !ok {
+		return nil, nil, fmt.Errorf("node access is not supported by %T", s.forest)
+	}
+	storage, err := getStorageRoot(source, &s.root, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return WalkSlots(source, &storage, startAfter, limit)
+}
+
+// StorageVisitor iterates the storage slots of a single account in the order
+// of their paths, calling the given function for each slot. The iteration
+// stops at the first error returned by the function, which is then returned.
+type StorageVisitor func(visit func(SlotEntry) error) error
+
+// VisitAccountsWithStorage visits all accounts of the trie rooted by the
+// given node in the order of their paths. For each account, the given
+// function is called with the account's address and info and a visitor of
+// its storage. The storage is only loaded if the visitor is used, without
+// requiring a second lookup of the account. The storage visitor is only valid
+// during the call of the function it is passed to. The visit stops at the
+// first error returned by the function, which is then returned. The trie
+// must not be modified while being visited.
+func VisitAccountsWithStorage(
+	source NodeSource,
+	root *NodeReference,
+	visit func(common.Address, AccountInfo, StorageVisitor) error,
+) error {
+	type accountWithStorage struct {
+		entry   AccountEntry
+		storage NodeReference
+	}
+	walker := &leafWalker[accountWithStorage]{
+		source: source,
+		stack:  []NodeReference{*root},
+		leaf: func(node Node) (accountWithStorage, bool) {
+			if account, ok := node.(*AccountNode); ok {
+				return accountWithStorage{
+					entry:   AccountEntry{Address: account.address, Info: account.info},
+					storage: account.storage,
+				}, true
+			}
+			return accountWithStorage{}, false
+		},
+		stop: func(node Node) bool {
+			_, isAccount := node.(*AccountNode)
+			return isAccount
+		},
+	}
+	for {
+		account, found, err := walker.next()
+		if err != nil || !found {
+			return err
+		}
+		valid := true
+		storage := func(visit func(SlotEntry) error) error {
+			if !valid {
+				return fmt.Errorf("storage of account %x visited after its visit ended", account.entry.Address)
+			}
+			iter := newStorageIterator(source, &account.storage, 0)
+			defer iter.Close()
+			for iter.Next() {
+				if err := visit(iter.Current()); err != nil {
+					return err
+				}
+			}
+			return iter.Err()
+		}
+		err = visit(account.entry.Address, account.entry.Info, storage)
+		valid = false
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// VisitAccountsWithStorage visits all accounts of this trie together with
+// their storage. See the package-level VisitAccountsWithStorage for details.
+func (s *LiveTrie) VisitAccountsWithStorage(visit func(common.Address, AccountInfo, StorageVisitor) error) error {
+	source, ok := s.forest.(NodeSource)
+	if !ok {
+		return fmt.Errorf("node access is not supported by %T", s.forest)
+	}
+	return VisitAccountsWithStorage(source, &s.root, visit)
+}
+
+// WalkAccounts lists up to limit accounts of this state following the given
+// account. See the package-level WalkAccounts for details.
+func (s *MptState) WalkAccounts(startAfter *common.Address, limit int) ([]AccountEntry, *common.Address, error) {
+	return s.trie.WalkAccounts(startAfter, limit)
+}
+
+// WalkSlots lists up to limit slots of the given account in this state
+// following the given key. See the package-level WalkSlots for details.
+func (s *MptState) WalkSlots(addr common.Address, startAfter *common.Key, limit int) ([]SlotEntry, *common.Key, error) {
+	return s.trie.WalkSlots(addr, startAfter, limit)
+}
@@ -0,0 +1,655 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
+	"go.uber.org/mock/gomock"
+)
+
+func TestLeafIterator_AccountsAreProducedInPathOrder(t *testing.T) {
+	for _, config := range allMptConfigs {
+		for _, prefetch := range []int{0, 1, 16} {
+			t.Run(fmt.Sprintf("%s/prefetch=%d", config.Name, prefetch), func(t *testing.T) {
+				trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer trie.Close()
+				want := fillTrieForIteratorTest(t, trie, 100)
+
+				iter, err := trie.NewAccountIterator(prefetch)
+				if err != nil {
+					t.Fatalf("failed to create iterator: %v", err)
+				}
+				defer iter.Close()
+				got := []common.Address{}
+				for iter.Next() {
+					entry := iter.Current()
+					if entry.Info.Nonce != common.ToNonce(uint64(entry.Address[0])+1) {
+						t.Errorf("unexpected info of account %x: %v", entry.Address, entry.Info)
+					}
+					got = append(got, entry.Address)
+				}
+				if err := iter.Err(); err != nil {
+					t.Fatalf("failed to iterate: %v", err)
+				}
+
+				slices.SortFunc(want, func(a, b common.Address) int {
+					return slices.Compare(AddressToNibblePath(a, trie.forest.(NodeSource)), AddressToNibblePath(b, trie.forest.(NodeSource)))
+				})
+				if !slices.Equal(want, got) {
+					t.Errorf("unexpected accounts, wanted %x, got %x", want, got)
+				}
+			})
+		}
+	}
+}
+
+func TestLeafIterator_SlotsOfAccountAreProducedInPathOrder(t *testing.T) {
+	for _, config := range allMptConfigs {
+		for _, prefetch := range []int{0, 1, 16} {
+			t.Run(fmt.Sprintf("%s/prefetch=%d", config.Name, prefetch), func(t *testing.T) {
+				trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer trie.Close()
+				fillTrieForIteratorTest(t, trie, 10)
+
+				addr := common.Address{7, 7 * 7}
+				want := []common.Key{}
+				for i := 0; i < 50; i++ {
+					key := common.Key{byte(i), 1}
+					if err := trie.SetValue(addr, key, common.Value{byte(i + 1)}); err != nil {
+						t.Fatalf("failed to set value: %v", err)
+					}
+					want = append(want, key)
+				}
+
+				iter, err := trie.NewStorageIterator(addr, prefetch)
+				if err != nil {
+					t.Fatalf("failed to create iterator: %v", err)
+				}
+				defer iter.Close()
+				got := []common.Key{}
+				for iter.Next() {
+					entry := iter.Current()
+					if entry.Value != (common.Value{entry.Key[0] + 1}) {
+						t.Errorf("unexpected value of slot %x: %x", entry.Key, entry.Value)
+					}
+					got = append(got, entry.Key)
+				}
+				if err := iter.Err(); err != nil {
+					t.Fatalf("failed to iterate: %v", err)
+				}
+
+				slices.SortFunc(want, func(a, b common.Key) int {
+					return slices.Compare(KeyToNibblePath(a, trie.forest.(NodeSource)), KeyToNibblePath(b, trie.forest.(NodeSource)))
+				})
+				if !slices.Equal(want, got) {
+					t.Errorf("unexpected slots, wanted %x, got %x", want, got)
+				}
+			})
+		}
+	}
+}
+
+func TestLeafIterator_StorageOfMissingAccountIsEmpty(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	fillTrieForIteratorTest(t, trie, 10)
+
+	iter, err := trie.NewStorageIterator(common.Address{0xFF}, 4)
+	if err != nil {
+		t.Fatalf("failed to create iterator: %v", err)
+	}
+	defer iter.Close()
+	if iter.Next() {
+		t.Errorf("storage of missing account should be empty, got %v", iter.Current())
+	}
+}
+
+func TestLeafIterator_CanBeClosedEarly(t *testing.T) {
+	for _, prefetch := range []int{0, 1, 16} {
+		t.Run(fmt.Sprintf("prefetch=%d", prefetch), func(t *testing.T) {
+			trie, err := OpenFileLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer trie.Close()
+			fillTrieForIteratorTest(t, trie, 100)
+
+			iter, err := trie.NewAccountIterator(prefetch)
+			if err != nil {
+				t.Fatalf("failed to create iterator: %v", err)
+			}
+			if !iter.Next() {
+				t.Fatalf("iterator should produce an account, err %v", iter.Err())
+			}
+			iter.Close()
+			iter.Close()
+			if iter.Next() {
+				t.Errorf("closed iterator should not produce accounts")
+			}
+
+			// After closing the iterator, no handles are retained.
+			if _, _, err := trie.UpdateHashes(); err != nil {
+				t.Fatalf("failed to update hashes: %v", err)
+			}
+		})
+	}
+}
+
+func TestLeafIterator_ErrorsAreReported(t *testing.T) {
+	for _, prefetch := range []int{0, 1, 16} {
+		t.Run(fmt.Sprintf("prefetch=%d", prefetch), func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			source := NewMockNodeSource(ctrl)
+			injectedErr := errors.New("injected error")
+
+			branch := &BranchNode{}
+			branch.children[1] = NewNodeReference(AccountId(1))
+			branch.children[2] = NewNodeReference(AccountId(2))
+			account := &AccountNode{address: common.Address{1}}
+
+			gomock.InOrder(
+				source.EXPECT().getViewAccess(RefTo(BranchId(1))).Return(shared.MakeShared[Node](branch).GetViewHandle(), nil),
+				source.EXPECT().getViewAccess(RefTo(AccountId(1))).Return(shared.MakeShared[Node](account).GetViewHandle(), nil),
+				source.EXPECT().getViewAccess(RefTo(AccountId(2))).Return(shared.ViewHandle[Node]{}, injectedErr),
+			)
+
+			root := NewNodeReference(BranchId(1))
+			iter := newAccountIterator(source, &root, prefetch)
+			defer iter.Close()
+			if !iter.Next() || iter.Current().Address != account.address {
+				t.Fatalf("iterator should produce first account, err %v", iter.Err())
+			}
+			if iter.Next() {
+				t.Errorf("iteration should stop on error")
+			}
+			if !errors.Is(iter.Err(), injectedErr) {
+				t.Errorf("unexpected error, wanted %v, got %v", injectedErr, iter.Err())
+			}
+		})
+	}
+}
+
+func TestAccountsWithStorage_OnlyAccountsWithNonEmptyStorageAreProduced(t *testing.T) {
+	for _, config := range allMptConfigs {
+		for _, prefetch := range []int{0, 16} {
+			t.Run(fmt.Sprintf("%s/prefetch=%d", config.Name, prefetch), func(t *testing.T) {
+				trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer trie.Close()
+				accounts := fillTrieForIteratorTest(t, trie, 60)
+
+				// Every third account holds storage, yet accounts with an index
+				// divisible by 5 have their storage emptied again.
+				want := []common.Address{}
+				for i, addr := range accounts {
+					if i%3 != 0 {
+						continue
+					}
+					for j := 0; j < i%4+1; j++ {
+						if err := trie.SetValue(addr, common.Key{byte(j)}, common.Value{1}); err != nil {
+							t.Fatalf("failed to set value: %v", err)
+						}
+					}
+					if i%5 == 0 {
+						if err := trie.ClearStorage(addr); err != nil {
+							t.Fatalf("failed to clear storage: %v", err)
+						}
+						continue
+					}
+					want = append(want, addr)
+				}
+
+				iter, err := trie.AccountsWithStorage(prefetch)
+				if err != nil {
+					t.Fatalf("failed to create iterator: %v", err)
+				}
+				defer iter.Close()
+				got := []common.Address{}
+				for iter.Next() {
+					got = append(got, iter.Current())
+				}
+				if err := iter.Err(); err != nil {
+					t.Fatalf("failed to iterate: %v", err)
+				}
+
+				slices.SortFunc(want, func(a, b common.Address) int {
+					return slices.Compare(AddressToNibblePath(a, trie.forest.(NodeSource)), AddressToNibblePath(b, trie.forest.(NodeSource)))
+				})
+				if !slices.Equal(want, got) {
+					t.Errorf("unexpected accounts, wanted %x, got %x", want, got)
+				}
+			})
+		}
+	}
+}
+
+func TestVisitAccountsWithStorage_AllAccountsAndSlotsAreVisitedExactlyOnce(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer trie.Close()
+			addresses := fillTrieForIteratorTest(t, trie, 50)
+
+			type slot struct {
+				addr common.Address
+				key  common.Key
+			}
+			wantSlots := map[slot]common.Value{}
+			for i, addr := range addresses {
+				for j := 0; j < i%5; j++ {
+					key := common.Key{byte(j), byte(i)}
+					value := common.Value{byte(i), byte(j + 1)}
+					if err := trie.SetValue(addr, key, value); err != nil {
+						t.Fatalf("failed to set value: %v", err)
+					}
+					wantSlots[slot{addr, key}] = value
+				}
+			}
+
+			seenAccounts := map[common.Address]int{}
+			seenSlots := map[slot]int{}
+			err = trie.VisitAccountsWithStorage(func(addr common.Address, info AccountInfo, storage StorageVisitor) error {
+				seenAccounts[addr]++
+				if info.Nonce != common.ToNonce(uint64(addr[0])+1) {
+					t.Errorf("unexpected info of account %x: %v", addr, info)
+				}
+				return storage(func(entry SlotEntry) error {
+					seenSlots[slot{addr, entry.Key}]++
+					if want := wantSlots[slot{addr, entry.Key}]; want != entry.Value {
+						t.Errorf("unexpected value of slot %x/%x, wanted %x, got %x", addr, entry.Key, want, entry.Value)
+					}
+					return nil
+				})
+			})
+			if err != nil {
+				t.Fatalf("failed to visit accounts: %v", err)
+			}
+
+			if len(seenAccounts) != len(addresses) {
+				t.Errorf("unexpected number of accounts, wanted %d, got %d", len(addresses), len(seenAccounts))
+			}
+			for addr, count := range seenAccounts {
+				if count != 1 {
+					t.Errorf("account %x visited %d times", addr, count)
+				}
+			}
+			if len(seenSlots) != len(wantSlots) {
+				t.Errorf("unexpected number of slots, wanted %d, got %d", len(wantSlots), len(seenSlots))
+			}
+			for slot, count := range seenSlots {
+				if count != 1 {
+					t.Errorf("slot %x/%x visited %d times", slot.addr, slot.key, count)
+				}
+			}
+		})
+	}
+}
+
+func TestVisitAccountsWithStorage_StorageIsOnlyLoadedOnDemand(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	source := NewMockNodeSource(ctrl)
+
+	account := &AccountNode{address: common.Address{1}, storage: NewNodeReference(ValueId(1))}
+	value := &ValueNode{key: common.Key{2}, value: common.Value{3}}
+
+	// The storage is only loaded by the second visit.
+	source.EXPECT().getViewAccess(RefTo(AccountId(1))).DoAndReturn(func(*NodeReference) (shared.ViewHandle[Node], error) {
+		return shared.MakeShared[Node](account).GetViewHandle(), nil
+	}).Times(2)
+	source.EXPECT().getViewAccess(RefTo(ValueId(1))).Return(shared.MakeShared[Node](value).GetViewHandle(), nil)
+
+	root := NewNodeReference(AccountId(1))
+	err := VisitAccountsWithStorage(source, &root, func(common.Address, AccountInfo, StorageVisitor) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to visit accounts: %v", err)
+	}
+
+	slots := []SlotEntry{}
+	err = VisitAccountsWithStorage(source, &root, func(_ common.Address, _ AccountInfo, storage StorageVisitor) error {
+		return storage(func(entry SlotEntry) error {
+			slots = append(slots, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("failed to visit accounts: %v", err)
+	}
+	if want := []SlotEntry{{Key: value.key, Value: value.value}}; !slices.Equal(want, slots) {
+		t.Errorf("unexpected slots, wanted %v, got %v", want, slots)
+	}
+}
+
+func TestVisitAccountsWithStorage_ErrorsOfCallbacksStopTheVisit(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	fillTrieForIteratorTest(t, trie, 10)
+	if err := trie.SetValue(common.Address{1, 7}, common.Key{1}, common.Value{1}); err != nil {
+		t.Fatalf("failed to set value: %v", err)
+	}
+
+	injectedErr := errors.New("injected error")
+	numVisited := 0
+	err = trie.VisitAccountsWithStorage(func(common.Address, AccountInfo, StorageVisitor) error {
+		numVisited++
+		return injectedErr
+	})
+	if !errors.Is(err, injectedErr) || numVisited != 1 {
+		t.Errorf("visit should stop at first error, got %v after %d accounts", err, numVisited)
+	}
+
+	err = trie.VisitAccountsWithStorage(func(addr common.Address, _ AccountInfo, storage StorageVisitor) error {
+		return storage(func(SlotEntry) error {
+			return injectedErr
+		})
+	})
+	if !errors.Is(err, injectedErr) {
+		t.Errorf("unexpected error, wanted %v, got %v", injectedErr, err)
+	}
+}
+
+func TestVisitAccountsWithStorage_StorageVisitorIsInvalidAfterVisitOfAccount(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	fillTrieForIteratorTest(t, trie, 1)
+
+	var retained StorageVisitor
+	err = trie.VisitAccountsWithStorage(func(_ common.Address, _ AccountInfo, storage StorageVisitor) error {
+		retained = storage
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to visit accounts: %v", err)
+	}
+	if err := retained(func(SlotEntry) error { return nil }); err == nil {
+		t.Errorf("storage visitor should not be usable after the visit of its account")
+	}
+}
+
+func TestWalkAccounts_ResumedWalksListAllAccountsExactlyOnce(t *testing.T) {
+	for _, config := range allMptConfigs {
+		for _, limit := range []int{1, 3, 10, 200} {
+			t.Run(fmt.Sprintf("%s/limit=%d", config.Name, limit), func(t *testing.T) {
+				trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer trie.Close()
+				want := fillTrieForIteratorTest(t, trie, 100)
+				slices.SortFunc(want, func(a, b common.Address) int {
+					return slices.Compare(AddressToNibblePath(a, trie.forest.(NodeSource)), AddressToNibblePath(b, trie.forest.(NodeSource)))
+				})
+
+				got := []common.Address{}
+				var cursor *common.Address
+				for {
+					entries, next, err := trie.WalkAccounts(cursor, limit)
+					if err != nil {
+						t.Fatalf("failed to walk accounts: %v", err)
+					}
+					if len(entries) > limit {
+						t.Fatalf("too many accounts listed, limit %d, got %d", limit, len(entries))
+					}
+					for _, entry := range entries {
+						if entry.Info.Nonce != common.ToNonce(uint64(entry.Address[0])+1) {
+							t.Errorf("unexpected info of account %x: %v", entry.Address, entry.Info)
+						}
+						got = append(got, entry.Address)
+					}
+					if next == nil {
+						break
+					}
+					if len(entries) != limit {
+						t.Errorf("cursor returned for incomplete listing of %d accounts", len(entries))
+					}
+					cursor = next
+				}
+				if !slices.Equal(want, got) {
+					t.Errorf("unexpected accounts, wanted %x, got %x", want, got)
+				}
+			})
+		}
+	}
+}
+
+func TestWalkAccounts_CursorsMayBeLocatedAnywhereInTheTrie(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer trie.Close()
+			source := trie.forest.(NodeSource)
+			accounts := fillTrieForIteratorTest(t, trie, 50)
+
+			// Accounts sharing a long prefix are connected by an extension
+			// node in tries not using hashed paths.
+			for i := 0; i < 5; i++ {
+				addr := common.Address{0xaa, 0xbb, 0xcc, byte(i)}
+				if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+					t.Fatalf("failed to set account: %v", err)
+				}
+				accounts = append(accounts, addr)
+			}
+
+			// Cursors sharing prefixes with the accounts end up within the
+			// paths of extension and leaf nodes.
+			cursors := []common.Address{
+				{}, {0xff}, {3, 21, 1}, {3, 20}, {3, 22}, {3}, {4, 0, 0, 0, 1},
+				{0xaa}, {0xaa, 0xbb}, {0xaa, 0xbb, 0xcb, 0xff}, {0xaa, 0xbb, 0xcc}, {0xaa, 0xbb, 0xcd},
+			}
+			cursors = append(cursors, accounts...)
+			for _, cursor := range cursors {
+				want := []common.Address{}
+				for _, addr := range accounts {
+					if slices.Compare(AddressToNibblePath(addr, source), AddressToNibblePath(cursor, source)) > 0 {
+						want = append(want, addr)
+					}
+				}
+				slices.SortFunc(want, func(a, b common.Address) int {
+					return slices.Compare(AddressToNibblePath(a, source), AddressToNibblePath(b, source))
+				})
+
+				entries, next, err := trie.WalkAccounts(&cursor, len(accounts))
+				if err != nil {
+					t.Fatalf("failed to walk accounts: %v", err)
+				}
+				if next != nil {
+					t.Errorf("no cursor should be returned at the end of the trie, got %x", *next)
+				}
+				got := []common.Address{}
+				for _, entry := range entries {
+					got = append(got, entry.Address)
+				}
+				if !slices.Equal(want, got) {
+					t.Errorf("unexpected accounts after %x, wanted %x, got %x", cursor, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestWalkSlots_ResumedWalksListAllSlotsExactlyOnce(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer trie.Close()
+			source := trie.forest.(NodeSource)
+			fillTrieForIteratorTest(t, trie, 10)
+
+			addr := common.Address{7, 7 * 7}
+			want := []common.Key{}
+			for i := 0; i < 50; i++ {
+				key := common.Key{byte(i), 1}
+				if err := trie.SetValue(addr, key, common.Value{byte(i + 1)}); err != nil {
+					t.Fatalf("failed to set value: %v", err)
+				}
+				want = append(want, key)
+			}
+			slices.SortFunc(want, func(a, b common.Key) int {
+				return slices.Compare(KeyToNibblePath(a, source), KeyToNibblePath(b, source))
+			})
+
+			got := []common.Key{}
+			var cursor *common.Key
+			for {
+				entries, next, err := trie.WalkSlots(addr, cursor, 7)
+				if err != nil {
+					t.Fatalf("failed to walk slots: %v", err)
+				}
+				for _, entry := range entries {
+					if entry.Value != (common.Value{entry.Key[0] + 1}) {
+						t.Errorf("unexpected value of slot %x: %x", entry.Key, entry.Value)
+					}
+					got = append(got, entry.Key)
+				}
+				if next == nil {
+					break
+				}
+				cursor = next
+			}
+			if !slices.Equal(want, got) {
+				t.Errorf("unexpected slots, wanted %x, got %x", want, got)
+			}
+
+			// Cursors within extension paths skip the slots before them.
+			cursor = &common.Key{10}
+			entries, _, err := trie.WalkSlots(addr, cursor, len(want))
+			if err != nil {
+				t.Fatalf("failed to walk slots: %v", err)
+			}
+			for _, entry := range entries {
+				if slices.Compare(KeyToNibblePath(entry.Key, source), KeyToNibblePath(*cursor, source)) <= 0 {
+					t.Errorf("slot %x listed before cursor %x", entry.Key, *cursor)
+				}
+			}
+
+			// Missing accounts have no slots.
+			entries, next, err := trie.WalkSlots(common.Address{0xff}, nil, 10)
+			if err != nil || len(entries) != 0 || next != nil {
+				t.Errorf("unexpected slots of missing account: %v, %v, %v", entries, next, err)
+			}
+		})
+	}
+}
+
+func TestWalkAccounts_InvalidLimitsAreRejected(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	for _, limit := range []int{-1, 0} {
+		if _, _, err := trie.WalkAccounts(nil, limit); err == nil {
+			t.Errorf("limit %d should be rejected", limit)
+		}
+		if _, _, err := trie.WalkSlots(common.Address{}, nil, limit); err == nil {
+			t.Errorf("limit %d should be rejected", limit)
+		}
+	}
+}
+
+func BenchmarkLeafIterator_ScanOfFileTrie(b *testing.B) {
+	dir := b.TempDir()
+	trie, err := OpenFileLiveTrie(dir, S5LiveConfig, 100_000)
+	if err != nil {
+		b.Fatalf("failed to open trie: %v", err)
+	}
+	for i := 0; i < 50_000; i++ {
+		addr := common.Address{byte(i), byte(i >> 8), byte(i >> 16)}
+		if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(uint64(i + 1))}); err != nil {
+			b.Fatalf("failed to set account: %v", err)
+		}
+	}
+	if _, _, err := trie.UpdateHashes(); err != nil {
+		b.Fatalf("failed to update hashes: %v", err)
+	}
+	if err := trie.Close(); err != nil {
+		b.Fatalf("failed to close trie: %v", err)
+	}
+
+	for _, prefetch := range []int{0, 16, 256} {
+		b.Run(fmt.Sprintf("prefetch=%d", prefetch), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				// A small cache forces nodes to be loaded from disk.
+				trie, err := OpenFileLiveTrie(dir, S5LiveConfig, 1024)
+				if err != nil {
+					b.Fatalf("failed to open trie: %v", err)
+				}
+				b.StartTimer()
+				iter, err := trie.NewAccountIterator(prefetch)
+				if err != nil {
+					b.Fatalf("failed to create iterator: %v", err)
+				}
+				for iter.Next() {
+					// Simulate the processing of the account by the consumer.
+					addr := iter.Current().Address
+					common.Keccak256(addr[:])
+				}
+				iter.Close()
+				if err := iter.Err(); err != nil {
+					b.Fatalf("failed to iterate: %v", err)
+				}
+				b.StopTimer()
+				if err := trie.Close(); err != nil {
+					b.Fatalf("failed to close trie: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// fillTrieForIteratorTest creates the given number of accounts in the given
+// trie and returns their addresses.
+func fillTrieForIteratorTest(t *testing.T, trie *LiveTrie, numAccounts int) []common.Address {
+	t.Helper()
+	res := []common.Address{}
+	for i := 0; i < numAccounts; i++ {
+		addr := common.Address{byte(i), byte(i * 7)}
+		if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(uint64(i + 1))}); err != nil {
+			t.Fatalf("failed to set account: %v", err)
+		}
+		res = append(res, addr)
+	}
+	return res
+}
@@ -11,15 +11,23 @@
 package mpt
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"unsafe"
 
 	"github.com/Fantom-foundation/Carmen/go/common"
+	"golang.org/x/exp/maps"
 )
 
+// ErrInconsistentTrie is reported by all updates of a LiveTrie after an
+// update could only be partially applied, leaving the trie in a state not
+// matching any intended state.
+const ErrInconsistentTrie = common.ConstError("trie is in an inconsistent state")
+
 // LiveTrie retains a single trie encoding state information with destructible
 // updates. Thus, whenever updating some information, the previous state is
 // lost.
@@ -33,6 +41,27 @@ type LiveTrie struct {
 	root NodeReference
 	// The file name for storing trie metadata.
 	metadatafile string
+	// An optional recorder of applied updates, nil if disabled.
+	recorder *TraceRecorder
+	// An optional recorder of pre-states of updated accounts, nil if disabled.
+	witness *witnessRecorder
+	// An optional store checked for the presence of codes referenced by
+	// updated accounts, nil if disabled.
+	codes CodeStore
+	// A non-nil error if the trie got into an inconsistent state, in which
+	// case all further updates and flushes are refused.
+	inconsistency error
+	// The trie this trie is a fork of, sharing its forest, nil if this trie
+	// is not a fork.
+	origin *LiveTrie
+	// The ongoing batch update deferring the collapse of branch nodes, nil if
+	// there is none. Within such batches, updates are applied to the batch.
+	batch collapseDeferringBatch
+	// An optional filter of existing accounts short-cutting lookups of
+	// missing accounts, nil if disabled. It is persisted in the given file
+	// when the trie gets flushed.
+	accountFilter     *accountFilter
+	accountFilterFile string
 }
 
 // OpenInMemoryLiveTrie loads trie information from the given directory and
@@ -44,7 +73,23 @@ func OpenInMemoryLiveTrie(directory string, config MptConfig, cacheCapacity int)
 	if err != nil {
 		return nil, err
 	}
-	return makeTrie(directory, forest)
+	trie, err := makeTrie(directory, forest)
+	if err != nil {
+		return nil, errors.Join(err, forest.Close())
+	}
+	return trie, nil
+}
+
+// OpenVolatileLiveTrie creates an empty LiveTrie retaining all information in
+// memory without being backed by any directory. Flush and Close do not persist
+// any data. This is intended for tests and light workloads.
+func OpenVolatileLiveTrie(config MptConfig, cacheCapacity int) (*LiveTrie, error) {
+	forestConfig := ForestConfig{Mode: Mutable, CacheCapacity: cacheCapacity}
+	forest, err := OpenVolatileForest(config, forestConfig)
+	if err != nil {
+		return nil, err
+	}
+	return makeTrie("", forest)
 }
 
 // OpenInMemoryLiveTrie loads trie information from the given directory and
@@ -52,12 +97,38 @@ func OpenInMemoryLiveTrie(directory string, config MptConfig, cacheCapacity int)
 // memory, backed by a file-based storage automatically kept in sync. If the
 // directory is empty, an empty trie is created.
 func OpenFileLiveTrie(directory string, config MptConfig, cacheCapacity int) (*LiveTrie, error) {
-	forestConfig := ForestConfig{Mode: Mutable, CacheCapacity: cacheCapacity}
+	return openFileLiveTrie(directory, config, ForestConfig{CacheCapacity: cacheCapacity})
+}
+
+// OpenFileLiveTrieWithConfig is a variant of OpenFileLiveTrie enabling the
+// customization of the underlying forest. The forest is always opened in
+// Mutable mode.
+func OpenFileLiveTrieWithConfig(directory string, config MptConfig, forestConfig ForestConfig) (*LiveTrie, error) {
+	return openFileLiveTrie(directory, config, forestConfig)
+}
+
+// openFileLiveTrie is a variant of OpenFileLiveTrie using the given forest
+// configuration. The storage mode of the configuration is ignored.
+func openFileLiveTrie(directory string, config MptConfig, forestConfig ForestConfig) (*LiveTrie, error) {
+	forestConfig.Mode = Mutable
 	forest, err := OpenFileForest(directory, config, forestConfig)
 	if err != nil {
 		return nil, err
 	}
-	return makeTrie(directory, forest)
+	return makeTrieWithConfig(directory, forest, forestConfig)
+}
+
+// OpenLiveTrieWithBackend is a variant of OpenFileLiveTrieWithConfig keeping
+// the nodes of the trie in the stocks of the given backend. The metadata of
+// the trie is still stored in the given directory. The forest is always
+// opened in Mutable mode.
+func OpenLiveTrieWithBackend(directory string, backend StockFactory, config MptConfig, forestConfig ForestConfig) (*LiveTrie, error) {
+	forestConfig.Mode = Mutable
+	forest, err := OpenForestWithBackend(directory, backend, config, forestConfig)
+	if err != nil {
+		return nil, err
+	}
+	return makeTrieWithConfig(directory, forest, forestConfig)
 }
 
 // VerifyFileLiveTrie validates a file-based live trie stored in the given
@@ -77,6 +148,30 @@ func VerifyFileLiveTrie(directory string, config MptConfig, observer Verificatio
 	}}, observer)
 }
 
+// RecoverFileLiveTrie recovers a file-based live trie stored in the given
+// directory after the process accessing it terminated without closing it.
+// The dirty mark left behind by the process is only removed if the content
+// of the directory passes the verification of VerifyFileLiveTrie. The stale
+// lock of the terminated process is taken over. Directories not marked as
+// dirty are not modified.
+func RecoverFileLiveTrie(directory string, config MptConfig, observer VerificationObserver) error {
+	lock, err := LockDirectory(directory)
+	if err != nil {
+		return err
+	}
+	dirty, err := isDirty(directory)
+	if err == nil && dirty {
+		err = markClean(directory)
+	}
+	if err := errors.Join(err, lock.Release()); err != nil || !dirty {
+		return err
+	}
+	if err := VerifyFileLiveTrie(directory, config, observer); err != nil {
+		return errors.Join(err, markDirty(directory))
+	}
+	return nil
+}
+
 func makeTrie(
 	directory string,
 	forest *Forest,
@@ -84,6 +179,13 @@ func makeTrie(
 	if err := forest.CheckErrors(); err != nil {
 		return nil, fmt.Errorf("unable to open corrupted forest: %w", err)
 	}
+	// Tries not backed by a directory have no metadata file.
+	if directory == "" {
+		return &LiveTrie{
+			root:   NewNodeReference(EmptyId()),
+			forest: forest,
+		}, nil
+	}
 	// Parse metadata file.
 	metadatafile := directory + "/meta.json"
 	metadata, _, err := readMetadata(metadatafile)
@@ -97,6 +199,65 @@ func makeTrie(
 	}, nil
 }
 
+// makeTrieWithConfig is a variant of makeTrie enabling the LiveTrie specific
+// features of the given forest configuration.
+func makeTrieWithConfig(directory string, forest *Forest, forestConfig ForestConfig) (*LiveTrie, error) {
+	trie, err := makeTrie(directory, forest)
+	if err != nil {
+		return nil, errors.Join(err, forest.Close())
+	}
+	if forestConfig.AccountFilter {
+		if err := trie.openAccountFilter(directory); err != nil {
+			return nil, errors.Join(err, forest.Close())
+		}
+	}
+	return trie, nil
+}
+
+// openAccountFilter restores the account filter persisted in the given
+// directory or, if it is missing or outdated, builds it by visiting all
+// accounts of this trie.
+func (s *LiveTrie) openAccountFilter(directory string) error {
+	metadata, _, err := readMetadata(s.metadatafile)
+	if err != nil {
+		return err
+	}
+	filename := directory + "/" + accountFilterFile
+	filter, err := readAccountFilter(filename, metadata.RootHash)
+	if err != nil {
+		return err
+	}
+	if filter == nil {
+		if filter, err = s.buildAccountFilter(); err != nil {
+			return err
+		}
+	}
+	s.accountFilter = filter
+	s.accountFilterFile = filename
+	return nil
+}
+
+// buildAccountFilter creates an account filter covering all accounts of this
+// trie. The filter is sized using the number of account IDs in use, which is
+// an upper bound of the number of accounts.
+func (s *LiveTrie) buildAccountFilter() (*accountFilter, error) {
+	source, ok := s.forest.(NodeSource)
+	if !ok {
+		return nil, fmt.Errorf("node access is not supported by %T", s.forest)
+	}
+	usage, err := getIdSpaceUsage(s.forest)
+	if err != nil {
+		return nil, err
+	}
+	return buildAccountFilter(source, &s.root, usage.Used.Accounts)
+}
+
+// mayContainAccount returns false if the given account is known to be missing
+// in this trie without looking it up.
+func (s *LiveTrie) mayContainAccount(addr common.Address) bool {
+	return s.accountFilter == nil || s.accountFilter.mayContain(addr)
+}
+
 // getTrieView creates a live trie based on an existing Forest instance.
 func getTrieView(root NodeReference, forest Database) *LiveTrie {
 	return &LiveTrie{
@@ -105,43 +266,336 @@ func getTrieView(root NodeReference, forest Database) *LiveTrie {
 	}
 }
 
+// HasAccount returns true if the given account exists in this trie.
+func (s *LiveTrie) HasAccount(addr common.Address) (bool, error) {
+	if !s.mayContainAccount(addr) {
+		return false, nil
+	}
+	return s.forest.HasAccount(&s.root, addr)
+}
+
 // HasEmptyStorage returns true if account has empty storage.
 func (s *LiveTrie) HasEmptyStorage(addr common.Address) (bool, error) {
+	if !s.mayContainAccount(addr) {
+		return true, nil
+	}
 	return s.forest.HasEmptyStorage(&s.root, addr)
 }
 
 func (s *LiveTrie) GetAccountInfo(addr common.Address) (AccountInfo, bool, error) {
+	if !s.mayContainAccount(addr) {
+		return AccountInfo{}, false, nil
+	}
 	return s.forest.GetAccountInfo(&s.root, addr)
 }
 
 func (s *LiveTrie) SetAccountInfo(addr common.Address, info AccountInfo) error {
-	newRoot, err := s.forest.SetAccountInfo(&s.root, addr, info)
+	if s.inconsistency != nil {
+		return s.inconsistency
+	}
+	if s.codes != nil {
+		if err := checkCodeReference(s.codes, addr, info.CodeHash); err != nil {
+			return err
+		}
+	}
+	if s.witness != nil {
+		if err := s.witness.recordAccountUpdate(s, addr, info); err != nil {
+			return err
+		}
+	}
+	newRoot, err := s.getUpdateTarget().SetAccountInfo(&s.root, addr, info)
 	if err != nil {
 		return err
 	}
 	s.root = newRoot
+	s.updateAccountFilter(addr, info)
+	if s.recorder != nil {
+		s.recorder.setAccountInfo(addr, info)
+	}
 	return nil
 }
 
+// updateAccountFilter records the update of the given account in the account
+// filter, if enabled. Accounts are recorded before their first lookup may
+// reach the trie, thus no existing account is missed by the filter.
+func (s *LiveTrie) updateAccountFilter(addr common.Address, info AccountInfo) {
+	if s.accountFilter == nil {
+		return
+	}
+	if info.IsEmpty() {
+		s.accountFilter.markDeleted()
+	} else {
+		s.accountFilter.add(addr)
+	}
+}
+
 func (s *LiveTrie) GetValue(addr common.Address, key common.Key) (common.Value, error) {
+	if !s.mayContainAccount(addr) {
+		return common.Value{}, nil
+	}
 	return s.forest.GetValue(&s.root, addr, key)
 }
 
+// GetSlotHandle returns a handle providing repeated O(1) read access to the
+// given storage slot until the handle gets invalidated. See SlotHandle for
+// details on invalidation.
+func (s *LiveTrie) GetSlotHandle(addr common.Address, key common.Key) (SlotHandle, error) {
+	provider, ok := s.forest.(slotHandleProvider)
+	if !ok {
+		return SlotHandle{}, fmt.Errorf("slot handles are not supported by %T", s.forest)
+	}
+	return provider.getSlotHandle(&s.root, addr, key)
+}
+
+// GetAccountLeafRlp returns the RLP encoding of the leaf node of the given
+// account. See the GetAccountLeafRlp function for details.
+func (s *LiveTrie) GetAccountLeafRlp(addr common.Address) ([]byte, bool, error) {
+	source, ok := s.forest.(NodeSource)
+	if !ok {
+		return nil, false, fmt.Errorf("node access is not supported by %T", s.forest)
+	}
+	return GetAccountLeafRlp(source, &s.root, addr)
+}
+
+// GetIdSpaceUsage reports the utilization of the node ID space of the forest
+// maintaining this trie.
+func (s *LiveTrie) GetIdSpaceUsage() (IdSpaceUsage, error) {
+	return getIdSpaceUsage(s.forest)
+}
+
+// SetValue updates the value of the given storage slot. If the account does
+// not exist, the update is ignored and the trie remains unchanged.
 func (s *LiveTrie) SetValue(addr common.Address, key common.Key, value common.Value) error {
-	newRoot, err := s.forest.SetValue(&s.root, addr, key, value)
+	if s.inconsistency != nil {
+		return s.inconsistency
+	}
+	if s.witness != nil {
+		if err := s.witness.recordSlot(s, addr, key); err != nil {
+			return err
+		}
+	}
+	newRoot, err := s.getUpdateTarget().SetValue(&s.root, addr, key, value)
 	if err != nil {
 		return err
 	}
 	s.root = newRoot
+	if s.recorder != nil {
+		s.recorder.setValue(addr, key, value)
+	}
 	return nil
 }
 
+// SlotUpdate is a new value of a storage slot of an account.
+type SlotUpdate struct {
+	Key   common.Key
+	Value common.Value
+}
+
+// SetSlots updates multiple storage slots of the given account. Unlike for a
+// sequence of SetValue calls, the account is located only once and all updates
+// are applied to its storage trie, producing the same trie. If the account
+// does not exist, the updates are ignored. The result indicates whether any
+// slot was changed.
+func (s *LiveTrie) SetSlots(addr common.Address, updates []SlotUpdate) (bool, error) {
+	if s.inconsistency != nil {
+		return false, s.inconsistency
+	}
+	if s.witness != nil {
+		for _, update := range updates {
+			if err := s.witness.recordSlot(s, addr, update.Key); err != nil {
+				return false, err
+			}
+		}
+	}
+	newRoot, changed, err := s.getUpdateTarget().SetSlots(&s.root, addr, updates)
+	if err != nil {
+		return false, err
+	}
+	s.root = newRoot
+	if s.recorder != nil {
+		for _, update := range updates {
+			s.recorder.setValue(addr, update.Key, update.Value)
+		}
+	}
+	return changed, nil
+}
+
 func (s *LiveTrie) ClearStorage(addr common.Address) error {
-	newRoot, err := s.forest.ClearStorage(&s.root, addr)
+	if s.inconsistency != nil {
+		return s.inconsistency
+	}
+	if s.witness != nil {
+		if err := s.witness.recordStorage(s, addr); err != nil {
+			return err
+		}
+	}
+	newRoot, err := s.getUpdateTarget().ClearStorage(&s.root, addr)
 	if err != nil {
 		return err
 	}
 	s.root = newRoot
+	if s.recorder != nil {
+		s.recorder.clearStorage(addr)
+	}
+	return nil
+}
+
+// RecreateAccount replaces the given account by a freshly created account with
+// the given information, clearing the storage of an existing account. See
+// Forest.RecreateAccount for details. The returned flag indicates whether the
+// trie was modified.
+func (s *LiveTrie) RecreateAccount(addr common.Address, info AccountInfo) (bool, error) {
+	if s.inconsistency != nil {
+		return false, s.inconsistency
+	}
+	forest, ok := s.forest.(*Forest)
+	if !ok {
+		return false, accountRecreationUnsupportedErr
+	}
+	if s.codes != nil {
+		if err := checkCodeReference(s.codes, addr, info.CodeHash); err != nil {
+			return false, err
+		}
+	}
+	if s.witness != nil {
+		if err := s.witness.recordStorage(s, addr); err != nil {
+			return false, err
+		}
+		if err := s.witness.recordAccountUpdate(s, addr, info); err != nil {
+			return false, err
+		}
+	}
+	newRoot, changed, err := forest.RecreateAccount(&s.root, addr, info)
+	if err != nil {
+		return false, err
+	}
+	s.root = newRoot
+	s.updateAccountFilter(addr, info)
+	if s.recorder != nil && changed {
+		s.recorder.clearStorage(addr)
+		s.recorder.setAccountInfo(addr, info)
+	}
+	return changed, nil
+}
+
+const accountRecreationUnsupportedErr = common.ConstError("account recreation is only supported by forests")
+
+// ApplyDiff applies the given diff, as produced by GetDiff, to this trie and
+// verifies that the resulting root hash matches the expected root. Accounts
+// are updated in the order of their addresses and slots in the order of their
+// keys. Accounts marked to be reset are deleted, including their storage,
+// before any other changes are applied. The expected root is compared to the
+// hash produced by UpdateHashes using the hashing scheme of this trie.
+//
+// Updates are applied in-place and can not be rolled back. Thus, if the
+// application fails or the resulting hash does not match, the trie is marked
+// as inconsistent and all further updates and flushes are refused. In this
+// case the trie is to be discarded and not to be flushed to disk.
+func (s *LiveTrie) ApplyDiff(diff Diff, expectedRoot common.Hash) error {
+	if s.inconsistency != nil {
+		return s.inconsistency
+	}
+	if err := s.applyDiff(diff); err != nil {
+		s.inconsistency = fmt.Errorf("%w: failed to apply diff: %w", ErrInconsistentTrie, err)
+		return s.inconsistency
+	}
+	hash, hints, err := s.UpdateHashes()
+	if hints != nil {
+		hints.Release()
+	}
+	if err != nil {
+		s.inconsistency = fmt.Errorf("%w: failed to update hashes: %w", ErrInconsistentTrie, err)
+		return s.inconsistency
+	}
+	if hash != expectedRoot {
+		s.inconsistency = fmt.Errorf("%w: root hash after applying diff is %x, expected %x", ErrInconsistentTrie, hash, expectedRoot)
+		return s.inconsistency
+	}
+	return nil
+}
+
+func (s *LiveTrie) applyDiff(diff Diff) error {
+	addresses := maps.Keys(diff)
+	sort.Slice(addresses, func(i, j int) bool {
+		return bytes.Compare(addresses[i][:], addresses[j][:]) < 0
+	})
+	for _, address := range addresses {
+		change := diff[address]
+		info, _, err := s.GetAccountInfo(address)
+		if err != nil {
+			return err
+		}
+		if change.Reset {
+			// Deleting the account also deletes its storage.
+			if err := s.SetAccountInfo(address, AccountInfo{}); err != nil {
+				return err
+			}
+			info = AccountInfo{}
+		}
+		updated := info
+		if change.Balance != nil {
+			updated.Balance = *change.Balance
+		}
+		if change.Nonce != nil {
+			updated.Nonce = *change.Nonce
+		}
+		if change.Code != nil {
+			updated.CodeHash = *change.Code
+		}
+		if updated != info {
+			if err := s.SetAccountInfo(address, updated); err != nil {
+				return err
+			}
+		}
+
+		keys := maps.Keys(change.Storage)
+		sort.Slice(keys, func(i, j int) bool {
+			return bytes.Compare(keys[i][:], keys[j][:]) < 0
+		})
+		for _, key := range keys {
+			if err := s.SetValue(address, key, change.Storage[key]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetTraceRecorder registers a recorder to be informed about all successfully
+// applied updates of this trie, or disables recording if nil. Block boundaries
+// need to be signaled to the recorder by the owner of the trie.
+func (s *LiveTrie) SetTraceRecorder(recorder *TraceRecorder) {
+	s.recorder = recorder
+}
+
+// SetCodeStore registers a store to be checked for the presence of the code
+// referenced by each account updated in this trie, or disables the checks if
+// nil. Updates of accounts referencing missing codes fail with ErrMissingCode.
+func (s *LiveTrie) SetCodeStore(store CodeStore) {
+	s.codes = store
+}
+
+// SetWitnessRecording enables or disables the recording of the pre-state of
+// all accounts and slots updated in this trie. Recording is only supported for
+// tries using EthereumLikeHashing with the default hash function. Recorded
+// data is collected by the owner of the trie at the end of each block.
+func (s *LiveTrie) SetWitnessRecording(enabled bool) error {
+	if !enabled {
+		s.witness = nil
+		return nil
+	}
+	source, ok := s.forest.(NodeSource)
+	if !ok {
+		return fmt.Errorf("node access is not supported by %T", s.forest)
+	}
+	if config := source.getConfig(); config.Hashing.Name != EthereumLikeHashing.Name {
+		return fmt.Errorf("witness recording requires %s, got %s", EthereumLikeHashing.Name, config.Hashing.Name)
+	} else if config.HashFunction != nil {
+		return fmt.Errorf("witness recording requires the default hash function")
+	}
+	if s.witness == nil {
+		s.witness = newWitnessRecorder()
+	}
 	return nil
 }
 
@@ -153,11 +607,107 @@ func (s *LiveTrie) setHashes(hashes *NodeHashes) error {
 	return s.forest.setHashesFor(&s.root, hashes)
 }
 
+// ethereumRootCacheCapacity is the node cache capacity of the temporary trie
+// used for computing Ethereum root hashes of tries with other configurations.
+const ethereumRootCacheCapacity = 1 << 16
+
+// getEthereumRootHash computes the root hash Ethereum clients would compute
+// for the accounts and storage slots of this trie. For tries using Ethereum's
+// hashing scheme, this is the hash produced by UpdateHashes. For others, the
+// content of the trie is copied into a temporary trie using the S5 Live
+// configuration. This requires visiting the entire trie and may thus be
+// expensive for large tries.
+func (s *LiveTrie) getEthereumRootHash() (hash common.Hash, err error) {
+	source, ok := s.forest.(NodeSource)
+	if !ok {
+		return hash, fmt.Errorf("node access is not supported by %T", s.forest)
+	}
+	if config := source.getConfig(); config.UseHashedPaths && config.TrackSuffixLengthsInLeafNodes && config.Hashing.Name == EthereumLikeHashing.Name && config.HashFunction == nil {
+		hash, hints, err := s.UpdateHashes()
+		if hints != nil {
+			hints.Release()
+		}
+		return hash, err
+	}
+
+	directory, err := os.MkdirTemp("", "carmen-ethereum-root-")
+	if err != nil {
+		return hash, err
+	}
+	defer func() {
+		err = errors.Join(err, os.RemoveAll(directory))
+	}()
+	trie, err := OpenInMemoryLiveTrie(directory, S5LiveConfig, ethereumRootCacheCapacity)
+	if err != nil {
+		return hash, err
+	}
+	defer func() {
+		err = errors.Join(err, trie.Close())
+	}()
+
+	// Storage slots are visited right after the account they belong to.
+	var account common.Address
+	var copyErr error
+	err = s.VisitTrie(MakeVisitor(func(node Node, _ NodeInfo) VisitResponse {
+		switch n := node.(type) {
+		case *AccountNode:
+			account = n.address
+			copyErr = trie.SetAccountInfo(n.address, n.info)
+		case *ValueNode:
+			copyErr = trie.SetValue(account, n.key, n.value)
+		}
+		if copyErr != nil {
+			return VisitResponseAbort
+		}
+		return VisitResponseContinue
+	}))
+	if err := errors.Join(err, copyErr); err != nil {
+		return hash, err
+	}
+
+	hash, hints, err := trie.UpdateHashes()
+	if hints != nil {
+		hints.Release()
+	}
+	return hash, err
+}
+
+// VisitTrie visits all nodes of this trie depth-first, in the order
+// documented by Node.Visit.
 func (s *LiveTrie) VisitTrie(visitor NodeVisitor) error {
 	return s.forest.VisitTrie(&s.root, visitor)
 }
 
+// VisitToDepth visits the nodes of this trie up to the given depth, pruning
+// deeper nodes. The returned flag indicates whether any node was pruned. See
+// Forest.VisitToDepth for details.
+func (s *LiveTrie) VisitToDepth(maxDepth int, visitor NodeVisitor) (bool, error) {
+	limiter := &depthLimitingVisitor{nested: visitor, maxDepth: maxDepth}
+	err := s.forest.VisitTrie(&s.root, limiter)
+	return limiter.truncated, err
+}
+
+// SelfCheck re-computes the hashes of the given number of randomly sampled
+// nodes of this trie and compares them to the stored hashes. See
+// Forest.SelfCheck for details.
+func (s *LiveTrie) SelfCheck(sampleSize int) (SelfCheckReport, error) {
+	forest, ok := s.forest.(*Forest)
+	if !ok {
+		return SelfCheckReport{}, selfCheckUnsupportedErr
+	}
+	return forest.SelfCheck(&s.root, sampleSize)
+}
+
 func (s *LiveTrie) Flush() error {
+	if s.inconsistency != nil {
+		return s.inconsistency
+	}
+
+	// Forks are not persisted.
+	if s.origin != nil {
+		return nil
+	}
+
 	// Update hashes to eliminate dirty hashes before flushing.
 	hash, _, err := s.UpdateHashes()
 	if err != nil {
@@ -170,26 +720,137 @@ func (s *LiveTrie) Flush() error {
 		RootHash: hash,
 	})
 
-	if err == nil {
+	// Tries not backed by a directory have no metadata file.
+	if err == nil && len(s.metadatafile) > 0 {
 		if err := os.WriteFile(s.metadatafile, metadata, 0600); err != nil {
 			return err
 		}
 	}
 
-	return errors.Join(err, s.forest.Flush())
+	if err := errors.Join(err, s.forest.Flush()); err != nil {
+		return err
+	}
+	return s.flushAccountFilter(hash)
+}
+
+// flushAccountFilter persists the account filter of this trie with the given
+// root hash, if enabled. Filters whose false-positive rate has degraded due
+// to growth or deletions are rebuilt before.
+func (s *LiveTrie) flushAccountFilter(hash common.Hash) error {
+	if s.accountFilter == nil {
+		return nil
+	}
+	if s.accountFilter.needsRebuild() {
+		filter, err := s.buildAccountFilter()
+		if err != nil {
+			return err
+		}
+		s.accountFilter = filter
+	}
+	return writeAccountFilter(s.accountFilterFile, hash, s.accountFilter)
 }
 
 func (s *LiveTrie) Close() error {
+	if s.origin != nil {
+		return s.closeFork()
+	}
+	// Tries not backed by a directory have nothing to persist.
+	if len(s.metadatafile) == 0 {
+		if forest, ok := s.forest.(*Forest); ok {
+			return forest.closeWithoutFlush()
+		}
+	}
 	return errors.Join(
 		s.Flush(),
 		s.forest.Close(),
 	)
 }
 
+// Fork creates a writable copy of this trie which is fully independent of
+// this trie. To that end, the nodes of this trie are frozen and shared with
+// the fork, such that both tries create copies of shared nodes they modify.
+// Nodes are frozen lazily along the paths modified by either trie, so forking
+// does not visit the trie. Hashes of this trie are updated as part of the
+// operation.
+//
+// Forks are not persisted and need to be closed before this trie. They may
+// not be forked themselves, nor be closed concurrently with updates of this
+// trie. Nodes of this trie replaced while forks are open are released when
+// the last fork is closed.
+func (s *LiveTrie) Fork() (*LiveTrie, error) {
+	if s.inconsistency != nil {
+		return nil, s.inconsistency
+	}
+	if s.origin != nil {
+		return nil, fmt.Errorf("forks of tries can not be forked")
+	}
+	forest, ok := s.forest.(forkableDatabase)
+	if !ok {
+		return nil, fmt.Errorf("forking is not supported by %T", s.forest)
+	}
+	// Hashes of frozen nodes can not be updated anymore.
+	_, hints, err := s.UpdateHashes()
+	if hints != nil {
+		hints.Release()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := forest.openFork(&s.root); err != nil {
+		return nil, err
+	}
+	return &LiveTrie{
+		forest: s.forest,
+		root:   s.root,
+		origin: s,
+	}, nil
+}
+
+// closeFork discards this fork, releasing all nodes not shared with other
+// tries. The shared forest remains open.
+func (s *LiveTrie) closeFork() error {
+	root := s.root
+	s.root = NewNodeReference(EmptyId())
+	return s.forest.(forkableDatabase).closeFork(root, s.origin.root)
+}
+
+// HashAfterUpdate computes the root hash this trie would have after applying
+// the given update, without modifying this trie. The update is applied to a
+// copy-on-write overlay of the paths it touches, which is discarded
+// afterwards. No node IDs are allocated for nodes created by the update and
+// no nodes of this trie are modified or released. The computation must not
+// run concurrently with updates of this trie.
+func (s *LiveTrie) HashAfterUpdate(update common.Update) (common.Hash, error) {
+	forest, ok := s.forest.(*Forest)
+	if !ok {
+		return common.Hash{}, fmt.Errorf("hashing updates is not supported by %T", s.forest)
+	}
+	overlay := newHashOverlay(forest)
+	// The overlay is updated with the semantics of updates applied to states.
+	// Since overlays are not updated in batches, branches are collapsed and
+	// slots deleted immediately, producing the same trie.
+	state := &MptState{
+		trie: getTrieView(s.root, overlay),
+		code: map[common.Hash][]byte{},
+	}
+	update = sortUpdate(update)
+	if err := update.ApplyTo(state); err != nil {
+		return common.Hash{}, err
+	}
+	hash, hints, err := overlay.updateHashesFor(&state.trie.root)
+	if hints != nil {
+		hints.Release()
+	}
+	return hash, err
+}
+
 // GetMemoryFootprint provides sizes of individual components of the state in the memory
 func (s *LiveTrie) GetMemoryFootprint() *common.MemoryFootprint {
 	mf := common.NewMemoryFootprint(unsafe.Sizeof(*s))
 	mf.AddChild("forest", s.forest.GetMemoryFootprint())
+	if s.accountFilter != nil {
+		mf.AddChild("accountFilter", s.accountFilter.GetMemoryFootprint())
+	}
 	return mf
 }
 
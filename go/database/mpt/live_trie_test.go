@@ -11,6 +11,7 @@
 package mpt
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -25,19 +26,38 @@ import (
 	"github.com/Fantom-foundation/Carmen/go/common"
 )
 
+type liveTrieVariant struct {
+	name    string
+	factory func(directory string, config MptConfig, cacheCapacity int) (*LiveTrie, error)
+}
+
+var liveTrieVariants = []liveTrieVariant{
+	{"InMemory", OpenInMemoryLiveTrie},
+	{"FileBased", OpenFileLiveTrie},
+	{"Volatile", openVolatileLiveTrie},
+}
+
+// openVolatileLiveTrie adapts OpenVolatileLiveTrie to the factory signature
+// of live trie variants. The directory is ignored.
+func openVolatileLiveTrie(_ string, config MptConfig, cacheCapacity int) (*LiveTrie, error) {
+	return OpenVolatileLiveTrie(config, cacheCapacity)
+}
+
 func TestLiveTrie_EmptyTrieIsConsistent(t *testing.T) {
-	for _, config := range allMptConfigs {
-		t.Run(config.Name, func(t *testing.T) {
-			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
-			if err != nil {
-				t.Fatalf("failed to open trie: %v", err)
-			}
-			defer trie.Close()
+	for _, variant := range liveTrieVariants {
+		for _, config := range allMptConfigs {
+			t.Run(variant.name+"/"+config.Name, func(t *testing.T) {
+				trie, err := variant.factory(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer trie.Close()
 
-			if err := trie.Check(); err != nil {
-				t.Fatalf("empty try has consistency problems: %v", err)
-			}
-		})
+				if err := trie.Check(); err != nil {
+					t.Fatalf("empty try has consistency problems: %v", err)
+				}
+			})
+		}
 	}
 }
 
@@ -143,6 +163,20 @@ func TestLiveTrie_Cannot_MakeTrie_CorruptForest(t *testing.T) {
 	}
 }
 
+// closeTrieOnCleanup closes the given trie once the test is done. The forest
+// replaced by a mock to inject failures is restored before, such that the
+// resources of the trie are released.
+func closeTrieOnCleanup(t *testing.T, trie *LiveTrie) {
+	t.Helper()
+	forest := trie.forest
+	t.Cleanup(func() {
+		trie.forest = forest
+		if err := trie.Close(); err != nil {
+			t.Logf("failed to close trie: %v", err)
+		}
+	})
+}
+
 func TestLiveTrie_Fail_Read_Data(t *testing.T) {
 	for _, config := range allMptConfigs {
 		t.Run(config.Name, func(t *testing.T) {
@@ -152,6 +186,7 @@ func TestLiveTrie_Fail_Read_Data(t *testing.T) {
 			if err != nil {
 				t.Fatalf("cannot open trie: %s", err)
 			}
+			closeTrieOnCleanup(t, mpt)
 
 			// inject failing stock to trigger an error applying the update
 			var injectedErr = errors.New("injectedError")
@@ -197,6 +232,7 @@ func TestLiveTrie_Cannot_Flush_Metadata(t *testing.T) {
 			if err != nil {
 				t.Fatalf("opening trie should not fail: %s", err)
 			}
+			defer mpt.Close()
 
 			// corrupt meta
 			if err := os.Mkdir(filepath.Join(dir, "meta.json"), os.FileMode(0644)); err != nil {
@@ -219,6 +255,7 @@ func TestLiveTrie_Cannot_Flush_Hashes(t *testing.T) {
 			if err != nil {
 				t.Fatalf("opening trie should not fail: %s", err)
 			}
+			closeTrieOnCleanup(t, mpt)
 
 			// inject failing stock to trigger an error applying the update
 			var injectedErr = errors.New("injectedError")
@@ -235,286 +272,458 @@ func TestLiveTrie_Cannot_Flush_Hashes(t *testing.T) {
 }
 
 func TestLiveTrie_NonExistingAccountsHaveEmptyInfo(t *testing.T) {
-	for _, config := range allMptConfigs {
-		t.Run(config.Name, func(t *testing.T) {
-			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
-			if err != nil {
-				t.Fatalf("failed to open trie: %v", err)
-			}
-			defer trie.Close()
+	for _, variant := range liveTrieVariants {
+		for _, config := range allMptConfigs {
+			t.Run(variant.name+"/"+config.Name, func(t *testing.T) {
+				trie, err := variant.factory(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer trie.Close()
 
-			if err := trie.Check(); err != nil {
-				t.Fatalf("empty try has consistency problems: %v", err)
-			}
+				if err := trie.Check(); err != nil {
+					t.Fatalf("empty try has consistency problems: %v", err)
+				}
 
-			addr1 := common.Address{1}
-			if info, exists, err := trie.GetAccountInfo(addr1); err != nil || exists || info != (AccountInfo{}) {
-				t.Errorf("failed to get default account infor from empty state, got %v, exists %v, err: %v", info, exists, err)
-			}
-		})
+				addr1 := common.Address{1}
+				if info, exists, err := trie.GetAccountInfo(addr1); err != nil || exists || info != (AccountInfo{}) {
+					t.Errorf("failed to get default account infor from empty state, got %v, exists %v, err: %v", info, exists, err)
+				}
+			})
+		}
 	}
 }
 
 func TestLiveTrie_SetAndGetSingleAccountInformationWorks(t *testing.T) {
-	for _, config := range allMptConfigs {
-		t.Run(config.Name, func(t *testing.T) {
-			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
-			if err != nil {
-				t.Fatalf("failed to open trie: %v", err)
-			}
-			defer trie.Close()
+	for _, variant := range liveTrieVariants {
+		for _, config := range allMptConfigs {
+			t.Run(variant.name+"/"+config.Name, func(t *testing.T) {
+				trie, err := variant.factory(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer trie.Close()
 
-			if err := trie.Check(); err != nil {
-				t.Fatalf("empty try has consistency problems: %v", err)
-			}
+				if err := trie.Check(); err != nil {
+					t.Fatalf("empty try has consistency problems: %v", err)
+				}
 
-			addr := common.Address{1}
-			info := AccountInfo{
-				Nonce:    common.Nonce{1},
-				Balance:  common.Balance{2},
-				CodeHash: common.Hash{3},
-			}
+				addr := common.Address{1}
+				info := AccountInfo{
+					Nonce:    common.Nonce{1},
+					Balance:  common.Balance{2},
+					CodeHash: common.Hash{3},
+				}
 
-			if err := trie.SetAccountInfo(addr, info); err != nil {
-				t.Errorf("failed to set info of account: %v", err)
-			}
+				if err := trie.SetAccountInfo(addr, info); err != nil {
+					t.Errorf("failed to set info of account: %v", err)
+				}
 
-			if err := trie.Check(); err != nil {
-				trie.Dump()
-				t.Errorf("trie corrupted after insert: %v", err)
-			}
+				if err := trie.Check(); err != nil {
+					trie.Dump()
+					t.Errorf("trie corrupted after insert: %v", err)
+				}
 
-			if recovered, exists, err := trie.GetAccountInfo(addr); err != nil || !exists || recovered != info {
-				t.Errorf("failed to recover account information, wanted %v, got %v, exists %v, err %v", info, recovered, exists, err)
-			}
+				if recovered, exists, err := trie.GetAccountInfo(addr); err != nil || !exists || recovered != info {
+					t.Errorf("failed to recover account information, wanted %v, got %v, exists %v, err %v", info, recovered, exists, err)
+				}
 
-			if err := trie.Check(); err != nil {
-				trie.Dump()
-				t.Errorf("trie corrupted after read: %v", err)
-			}
-		})
+				if err := trie.Check(); err != nil {
+					trie.Dump()
+					t.Errorf("trie corrupted after read: %v", err)
+				}
+			})
+		}
 	}
 }
 
 func TestLiveTrie_SetAndGetMultipleAccountInformationWorks(t *testing.T) {
-	for _, config := range allMptConfigs {
-		t.Run(config.Name, func(t *testing.T) {
-			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
-			if err != nil {
-				t.Fatalf("failed to open trie: %v", err)
-			}
-			defer trie.Close()
+	for _, variant := range liveTrieVariants {
+		for _, config := range allMptConfigs {
+			t.Run(variant.name+"/"+config.Name, func(t *testing.T) {
+				trie, err := variant.factory(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer trie.Close()
 
-			if err := trie.Check(); err != nil {
-				t.Fatalf("empty try has consistency problems: %v", err)
-			}
+				if err := trie.Check(); err != nil {
+					t.Fatalf("empty try has consistency problems: %v", err)
+				}
 
-			addr1 := common.Address{1}
-			addr2 := common.Address{2}
-			addr3 := common.Address{0, 0, 0, 0, 0, 0, 3}
+				addr1 := common.Address{1}
+				addr2 := common.Address{2}
+				addr3 := common.Address{0, 0, 0, 0, 0, 0, 3}
 
-			if err := trie.SetAccountInfo(addr1, AccountInfo{Nonce: common.Nonce{1}}); err != nil {
-				t.Errorf("failed to set info of account: %v", err)
-			}
-			if err := trie.Check(); err != nil {
-				trie.Dump()
-				t.Errorf("trie corrupted after insert: %v", err)
-			}
+				if err := trie.SetAccountInfo(addr1, AccountInfo{Nonce: common.Nonce{1}}); err != nil {
+					t.Errorf("failed to set info of account: %v", err)
+				}
+				if err := trie.Check(); err != nil {
+					trie.Dump()
+					t.Errorf("trie corrupted after insert: %v", err)
+				}
 
-			if err := trie.SetAccountInfo(addr2, AccountInfo{Nonce: common.Nonce{2}}); err != nil {
-				t.Errorf("failed to set info of account: %v", err)
-			}
-			if err := trie.Check(); err != nil {
-				trie.Dump()
-				t.Errorf("trie corrupted after insert: %v", err)
-			}
+				if err := trie.SetAccountInfo(addr2, AccountInfo{Nonce: common.Nonce{2}}); err != nil {
+					t.Errorf("failed to set info of account: %v", err)
+				}
+				if err := trie.Check(); err != nil {
+					trie.Dump()
+					t.Errorf("trie corrupted after insert: %v", err)
+				}
 
-			if err := trie.SetAccountInfo(addr3, AccountInfo{Nonce: common.Nonce{3}}); err != nil {
-				t.Errorf("failed to set info of account: %v", err)
-			}
-			if err := trie.Check(); err != nil {
-				trie.Dump()
-				t.Errorf("trie corrupted after insert: %v", err)
-			}
-		})
+				if err := trie.SetAccountInfo(addr3, AccountInfo{Nonce: common.Nonce{3}}); err != nil {
+					t.Errorf("failed to set info of account: %v", err)
+				}
+				if err := trie.Check(); err != nil {
+					trie.Dump()
+					t.Errorf("trie corrupted after insert: %v", err)
+				}
+			})
+		}
 	}
 }
 
 func TestLiveTrie_NonExistingValueHasZeroValue(t *testing.T) {
-	for _, config := range allMptConfigs {
-		t.Run(config.Name, func(t *testing.T) {
-			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
-			if err != nil {
-				t.Fatalf("failed to open trie: %v", err)
-			}
-			defer trie.Close()
+	for _, variant := range liveTrieVariants {
+		for _, config := range allMptConfigs {
+			t.Run(variant.name+"/"+config.Name, func(t *testing.T) {
+				trie, err := variant.factory(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer trie.Close()
 
-			addr := common.Address{1}
-			key := common.Key{1}
+				addr := common.Address{1}
+				key := common.Key{1}
 
-			// If the account does not exist, the result should be empty.
-			if value, err := trie.GetValue(addr, key); value != (common.Value{}) || err != nil {
-				t.Errorf("expected value of non-existing account to be empty, got %v, err: %v", value, err)
-			}
+				// If the account does not exist, the result should be empty.
+				if value, err := trie.GetValue(addr, key); value != (common.Value{}) || err != nil {
+					t.Errorf("expected value of non-existing account to be empty, got %v, err: %v", value, err)
+				}
 
-			// Also, if the account exists, the result should be empty.
-			if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.Nonce{1}}); err != nil {
-				t.Fatalf("failed to create an account")
-			}
-			if value, err := trie.GetValue(addr, key); value != (common.Value{}) || err != nil {
-				t.Errorf("expected value of uninitialized slot to be empty, got %v, err: %v", value, err)
-			}
-		})
+				// Also, if the account exists, the result should be empty.
+				if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.Nonce{1}}); err != nil {
+					t.Fatalf("failed to create an account")
+				}
+				if value, err := trie.GetValue(addr, key); value != (common.Value{}) || err != nil {
+					t.Errorf("expected value of uninitialized slot to be empty, got %v, err: %v", value, err)
+				}
+			})
+		}
 	}
 }
 
 func TestLiveTrie_ValuesCanBeSetAndRetrieved(t *testing.T) {
-	for _, config := range allMptConfigs {
-		t.Run(config.Name, func(t *testing.T) {
-			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
-			if err != nil {
-				t.Fatalf("failed to open trie: %v", err)
-			}
-			defer trie.Close()
+	for _, variant := range liveTrieVariants {
+		for _, config := range allMptConfigs {
+			t.Run(variant.name+"/"+config.Name, func(t *testing.T) {
+				trie, err := variant.factory(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer trie.Close()
 
-			addr := common.Address{1}
-			key := common.Key{1}
-			value := common.Value{1}
+				addr := common.Address{1}
+				key := common.Key{1}
+				value := common.Value{1}
 
-			// If the account does not exist, the write has no effect.
-			if err := trie.SetValue(addr, key, value); err != nil {
-				t.Errorf("writing to non-existing account failed: %v", err)
-			}
-			if got, err := trie.GetValue(addr, key); got != (common.Value{}) || err != nil {
-				t.Errorf("wanted %v, got %v", common.Value{}, got)
-			}
+				// If the account does not exist, the write has no effect.
+				if err := trie.SetValue(addr, key, value); err != nil {
+					t.Errorf("writing to non-existing account failed: %v", err)
+				}
+				if got, err := trie.GetValue(addr, key); got != (common.Value{}) || err != nil {
+					t.Errorf("wanted %v, got %v", common.Value{}, got)
+				}
 
-			// Create the account.
-			if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.Nonce{1}}); err != nil {
-				t.Fatalf("failed to create account for test: %v", err)
-			}
-			if err := trie.SetValue(addr, key, value); err != nil {
-				t.Errorf("writing to existing account failed: %v", err)
-			}
-			if got, err := trie.GetValue(addr, key); value != got || err != nil {
-				t.Errorf("wanted %v, got %v", value, got)
-			}
-		})
+				// Create the account.
+				if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.Nonce{1}}); err != nil {
+					t.Fatalf("failed to create account for test: %v", err)
+				}
+				if err := trie.SetValue(addr, key, value); err != nil {
+					t.Errorf("writing to existing account failed: %v", err)
+				}
+				if got, err := trie.GetValue(addr, key); value != got || err != nil {
+					t.Errorf("wanted %v, got %v", value, got)
+				}
+			})
+		}
 	}
 }
 
 func TestLiveTrie_SameContentProducesSameHash(t *testing.T) {
+	for _, variant := range liveTrieVariants {
+		for _, config := range allMptConfigs {
+			t.Run(variant.name+"/"+config.Name, func(t *testing.T) {
+				trie1, err := variant.factory(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer trie1.Close()
+				trie2, err := variant.factory(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer trie2.Close()
+
+				hash1, _, err := trie1.UpdateHashes()
+				if err != nil {
+					t.Errorf("failed to fetch hash of empty trie: %v", err)
+				}
+				hash2, _, err := trie2.UpdateHashes()
+				if err != nil {
+					t.Errorf("failed to fetch hash of empty trie: %v", err)
+				}
+				if hash1 != hash2 {
+					t.Errorf("Expected empty tries to have same hash, got %v and %v", hash1, hash2)
+				}
+
+				info1 := AccountInfo{Nonce: common.ToNonce(1)}
+				info2 := AccountInfo{Nonce: common.ToNonce(2)}
+				trie1.SetAccountInfo(common.Address{1}, info1)
+				trie2.SetAccountInfo(common.Address{2}, info2)
+
+				hash1, _, err = trie1.UpdateHashes()
+				if err != nil {
+					t.Errorf("failed to fetch hash of non-empty trie: %v", err)
+				}
+				hash2, _, err = trie2.UpdateHashes()
+				if err != nil {
+					t.Errorf("failed to fetch hash of non-empty trie: %v", err)
+				}
+				if hash1 == hash2 {
+					t.Errorf("Expected different tries to have different hashes, got %v and %v", hash1, hash2)
+				}
+
+				// Update tries to contain same data.
+				trie1.SetAccountInfo(common.Address{2}, info2)
+				trie2.SetAccountInfo(common.Address{1}, info1)
+
+				hash1, _, err = trie1.UpdateHashes()
+				if err != nil {
+					t.Errorf("failed to fetch hash of non-empty trie: %v", err)
+				}
+				hash2, _, err = trie2.UpdateHashes()
+				if err != nil {
+					t.Errorf("failed to fetch hash of non-empty trie: %v", err)
+				}
+				if hash1 != hash2 {
+					t.Errorf("Expected equal tries to have same hashes, got %v and %v", hash1, hash2)
+				}
+			})
+		}
+	}
+}
+
+func TestLiveTrie_SetSlotsProducesSameTrieAsSequentialUpdates(t *testing.T) {
 	for _, config := range allMptConfigs {
 		t.Run(config.Name, func(t *testing.T) {
-			trie1, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+			r := rand.New(rand.NewSource(42))
+			addresses := []common.Address{{1}, {2}, {3}}
+			batched, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
 			if err != nil {
 				t.Fatalf("failed to open trie: %v", err)
 			}
-			trie2, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+			defer batched.Close()
+			sequential, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
 			if err != nil {
 				t.Fatalf("failed to open trie: %v", err)
 			}
-
-			hash1, _, err := trie1.UpdateHashes()
-			if err != nil {
-				t.Errorf("failed to fetch hash of empty trie: %v", err)
-			}
-			hash2, _, err := trie2.UpdateHashes()
-			if err != nil {
-				t.Errorf("failed to fetch hash of empty trie: %v", err)
-			}
-			if hash1 != hash2 {
-				t.Errorf("Expected empty tries to have same hash, got %v and %v", hash1, hash2)
+			defer sequential.Close()
+			for _, trie := range []*LiveTrie{batched, sequential} {
+				for _, addr := range addresses[:2] { // the last account does not exist
+					if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+						t.Fatalf("failed to create account: %v", err)
+					}
+				}
 			}
 
-			info1 := AccountInfo{Nonce: common.ToNonce(1)}
-			info2 := AccountInfo{Nonce: common.ToNonce(2)}
-			trie1.SetAccountInfo(common.Address{1}, info1)
-			trie2.SetAccountInfo(common.Address{2}, info2)
+			for round := 0; round < 10; round++ {
+				for _, addr := range addresses {
+					// Updates include overwrites and deletions of slots.
+					updates := make([]SlotUpdate, 20)
+					for i := range updates {
+						updates[i].Key = common.Key{byte(r.Intn(30))}
+						if r.Intn(4) > 0 {
+							updates[i].Value = common.Value{byte(r.Intn(256)), 1}
+						}
+					}
+					if _, err := batched.SetSlots(addr, updates); err != nil {
+						t.Fatalf("failed to set slots: %v", err)
+					}
+					for _, update := range updates {
+						if err := sequential.SetValue(addr, update.Key, update.Value); err != nil {
+							t.Fatalf("failed to set value: %v", err)
+						}
+					}
+				}
 
-			hash1, _, err = trie1.UpdateHashes()
-			if err != nil {
-				t.Errorf("failed to fetch hash of non-empty trie: %v", err)
-			}
-			hash2, _, err = trie2.UpdateHashes()
-			if err != nil {
-				t.Errorf("failed to fetch hash of non-empty trie: %v", err)
-			}
-			if hash1 == hash2 {
-				t.Errorf("Expected different tries to have different hashes, got %v and %v", hash1, hash2)
+				want, _, err := sequential.UpdateHashes()
+				if err != nil {
+					t.Fatalf("failed to get hash: %v", err)
+				}
+				got, _, err := batched.UpdateHashes()
+				if err != nil {
+					t.Fatalf("failed to get hash: %v", err)
+				}
+				if want != got {
+					t.Fatalf("batched updates produced different hash in round %d, wanted %x, got %x", round, want, got)
+				}
+				if err := batched.Check(); err != nil {
+					t.Fatalf("batched updates produced inconsistent trie: %v", err)
+				}
 			}
+		})
+	}
+}
 
-			// Update tries to contain same data.
-			trie1.SetAccountInfo(common.Address{2}, info2)
-			trie2.SetAccountInfo(common.Address{1}, info1)
+func TestLiveTrie_SetSlotsReportsChanges(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	addr := common.Address{1}
+	updates := []SlotUpdate{{Key: common.Key{1}, Value: common.Value{1}}, {Key: common.Key{2}, Value: common.Value{2}}}
 
-			hash1, _, err = trie1.UpdateHashes()
-			if err != nil {
-				t.Errorf("failed to fetch hash of non-empty trie: %v", err)
-			}
-			hash2, _, err = trie2.UpdateHashes()
-			if err != nil {
-				t.Errorf("failed to fetch hash of non-empty trie: %v", err)
-			}
-			if hash1 != hash2 {
-				t.Errorf("Expected equal tries to have same hashes, got %v and %v", hash1, hash2)
-			}
-		})
+	if changed, err := trie.SetSlots(addr, updates); err != nil || changed {
+		t.Errorf("slots of missing account should not be changed, got %t, %v", changed, err)
+	}
+	if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+	if changed, err := trie.SetSlots(addr, updates); err != nil || !changed {
+		t.Errorf("slots should be changed, got %t, %v", changed, err)
+	}
+	if changed, err := trie.SetSlots(addr, updates); err != nil || changed {
+		t.Errorf("setting the same values should not change slots, got %t, %v", changed, err)
+	}
+	for _, update := range updates {
+		if value, err := trie.GetValue(addr, update.Key); err != nil || value != update.Value {
+			t.Errorf("unexpected value of slot %x, wanted %x, got %x, %v", update.Key, update.Value, value, err)
+		}
 	}
 }
 
 func TestLiveTrie_ChangeInTrieSubstructureUpdatesHash(t *testing.T) {
-	for _, config := range allMptConfigs {
-		t.Run(config.Name, func(t *testing.T) {
-			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
-			if err != nil {
-				t.Fatalf("failed to open trie: %v", err)
-			}
+	for _, variant := range liveTrieVariants {
+		for _, config := range allMptConfigs {
+			t.Run(variant.name+"/"+config.Name, func(t *testing.T) {
+				trie, err := variant.factory(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer trie.Close()
 
-			info1 := AccountInfo{Nonce: common.ToNonce(1)}
-			info2 := AccountInfo{Nonce: common.ToNonce(2)}
-			trie.SetAccountInfo(common.Address{1}, info1)
-			trie.SetAccountInfo(common.Address{2}, info2)
+				info1 := AccountInfo{Nonce: common.ToNonce(1)}
+				info2 := AccountInfo{Nonce: common.ToNonce(2)}
+				trie.SetAccountInfo(common.Address{1}, info1)
+				trie.SetAccountInfo(common.Address{2}, info2)
 
-			hash1, _, err := trie.UpdateHashes()
-			if err != nil {
-				t.Errorf("failed to fetch hash of empty trie: %v", err)
-			}
+				hash1, _, err := trie.UpdateHashes()
+				if err != nil {
+					t.Errorf("failed to fetch hash of empty trie: %v", err)
+				}
 
-			// The next update does not change anything in the root node, but the hash should
-			// still be updated.
-			trie.SetAccountInfo(common.Address{1}, info2)
+				// The next update does not change anything in the root node, but the hash should
+				// still be updated.
+				trie.SetAccountInfo(common.Address{1}, info2)
 
-			hash2, _, err := trie.UpdateHashes()
-			if err != nil {
-				t.Errorf("failed to fetch hash of empty trie: %v", err)
-			}
-			if hash1 == hash2 {
-				t.Errorf("Nested modification should have caused a change in hashes, got %v and %v", hash1, hash2)
-			}
-		})
+				hash2, _, err := trie.UpdateHashes()
+				if err != nil {
+					t.Errorf("failed to fetch hash of empty trie: %v", err)
+				}
+				if hash1 == hash2 {
+					t.Errorf("Nested modification should have caused a change in hashes, got %v and %v", hash1, hash2)
+				}
+			})
+		}
 	}
 }
 
 func TestLiveTrie_InsertLotsOfData(t *testing.T) {
-	for _, config := range allMptConfigs {
-		config := config
-		t.Run(config.Name, func(t *testing.T) {
-			t.Parallel()
-			const N = 30
+	for _, variant := range liveTrieVariants {
+		for _, config := range allMptConfigs {
+			variant, config := variant, config
+			t.Run(variant.name+"/"+config.Name, func(t *testing.T) {
+				t.Parallel()
+				const N = 30
+
+				trie, err := variant.factory(t.TempDir(), config, 1024*1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer trie.Close()
 
-			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024*1024)
-			if err != nil {
-				t.Fatalf("failed to open trie: %v", err)
-			}
-			defer trie.Close()
+				address := getTestAddresses(N)
+				keys := getTestKeys(N)
+
+				// Fill the tree.
+				for i, addr := range address {
+					if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(uint64(i) + 1)}); err != nil {
+						t.Fatalf("failed to insert account: %v", err)
+					}
+					if err := trie.Check(); err != nil {
+						trie.Dump()
+						t.Fatalf("trie inconsistent after account insert:\n%v", err)
+					}
+
+					for i, key := range keys {
+						if err := trie.SetValue(addr, key, common.Value{byte(i)}); err != nil {
+							t.Fatalf("failed to insert value: %v", err)
+						}
+						if err := trie.Check(); err != nil {
+							trie.Dump()
+							t.Fatalf("trie inconsistent after value insert:\n%v", err)
+						}
+					}
+				}
+
+				// Check its content.
+				for i, addr := range address {
+					if info, _, err := trie.GetAccountInfo(addr); int(info.Nonce.ToUint64()) != i+1 || err != nil {
+						t.Fatalf("wrong value, wanted %v, got %v, err %v", i+1, int(info.Nonce.ToUint64()), err)
+					}
+					for i, key := range keys {
+						if value, err := trie.GetValue(addr, key); value[0] != byte(i) || err != nil {
+							t.Fatalf("wrong value, wanted %v, got %v, err %v", byte(i), value[0], err)
+						}
+					}
+				}
+
+				// Delete all accounts.
+				for _, addr := range address {
+					if err := trie.SetAccountInfo(addr, AccountInfo{}); err != nil {
+						t.Fatalf("failed to delete account: %v", err)
+					}
+					if err := trie.Check(); err != nil {
+						trie.Dump()
+						t.Fatalf("trie inconsistent after account deletion:\n%v\nDeleted account: %v", err, addr)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestLiveTrie_InsertLotsOfValues(t *testing.T) {
+	for _, variant := range liveTrieVariants {
+		for _, config := range allMptConfigs {
+			variant, config := variant, config
+			t.Run(variant.name+"/"+config.Name, func(t *testing.T) {
+				t.Parallel()
+				const N = 500
+
+				trie, err := variant.factory(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer trie.Close()
 
-			address := getTestAddresses(N)
-			keys := getTestKeys(N)
+				addr := common.Address{}
+				keys := getTestKeys(N)
 
-			// Fill the tree.
-			for i, addr := range address {
-				if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(uint64(i) + 1)}); err != nil {
+				// Fill a single account.
+				if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
 					t.Fatalf("failed to insert account: %v", err)
 				}
 				if err := trie.Check(); err != nil {
@@ -531,87 +740,26 @@ func TestLiveTrie_InsertLotsOfData(t *testing.T) {
 						t.Fatalf("trie inconsistent after value insert:\n%v", err)
 					}
 				}
-			}
 
-			// Check its content.
-			for i, addr := range address {
-				if info, _, err := trie.GetAccountInfo(addr); int(info.Nonce.ToUint64()) != i+1 || err != nil {
-					t.Fatalf("wrong value, wanted %v, got %v, err %v", i+1, int(info.Nonce.ToUint64()), err)
-				}
+				// Check its content.
 				for i, key := range keys {
 					if value, err := trie.GetValue(addr, key); value[0] != byte(i) || err != nil {
 						t.Fatalf("wrong value, wanted %v, got %v, err %v", byte(i), value[0], err)
 					}
 				}
-			}
 
-			// Delete all accounts.
-			for _, addr := range address {
-				if err := trie.SetAccountInfo(addr, AccountInfo{}); err != nil {
-					t.Fatalf("failed to delete account: %v", err)
-				}
-				if err := trie.Check(); err != nil {
-					trie.Dump()
-					t.Fatalf("trie inconsistent after account deletion:\n%v\nDeleted account: %v", err, addr)
+				// Delete all values.
+				for _, key := range keys {
+					if err := trie.SetValue(addr, key, common.Value{}); err != nil {
+						t.Fatalf("failed to delete value: %v", err)
+					}
+					if err := trie.Check(); err != nil {
+						trie.Dump()
+						t.Fatalf("trie inconsistent after value deletion:\n%v\nDeleted value: %v", err, key)
+					}
 				}
-			}
-		})
-	}
-}
-
-func TestLiveTrie_InsertLotsOfValues(t *testing.T) {
-	for _, config := range allMptConfigs {
-		config := config
-		t.Run(config.Name, func(t *testing.T) {
-			t.Parallel()
-			const N = 500
-
-			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
-			if err != nil {
-				t.Fatalf("failed to open trie: %v", err)
-			}
-			defer trie.Close()
-
-			addr := common.Address{}
-			keys := getTestKeys(N)
-
-			// Fill a single account.
-			if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
-				t.Fatalf("failed to insert account: %v", err)
-			}
-			if err := trie.Check(); err != nil {
-				trie.Dump()
-				t.Fatalf("trie inconsistent after account insert:\n%v", err)
-			}
-
-			for i, key := range keys {
-				if err := trie.SetValue(addr, key, common.Value{byte(i)}); err != nil {
-					t.Fatalf("failed to insert value: %v", err)
-				}
-				if err := trie.Check(); err != nil {
-					trie.Dump()
-					t.Fatalf("trie inconsistent after value insert:\n%v", err)
-				}
-			}
-
-			// Check its content.
-			for i, key := range keys {
-				if value, err := trie.GetValue(addr, key); value[0] != byte(i) || err != nil {
-					t.Fatalf("wrong value, wanted %v, got %v, err %v", byte(i), value[0], err)
-				}
-			}
-
-			// Delete all values.
-			for _, key := range keys {
-				if err := trie.SetValue(addr, key, common.Value{}); err != nil {
-					t.Fatalf("failed to delete value: %v", err)
-				}
-				if err := trie.Check(); err != nil {
-					trie.Dump()
-					t.Fatalf("trie inconsistent after value deletion:\n%v\nDeleted value: %v", err, key)
-				}
-			}
-		})
+			})
+		}
 	}
 }
 
@@ -648,101 +796,103 @@ func getTestKeys(number int) []common.Key {
 }
 
 func TestLiveTrie_DeleteLargeAccount(t *testing.T) {
-	for _, config := range allMptConfigs {
-		config := config
-		t.Run(config.Name, func(t *testing.T) {
-			t.Parallel()
-			const N = 200000
-
-			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024*1024)
-			if err != nil {
-				t.Fatalf("failed to open trie: %v", err)
-			}
+	for _, variant := range liveTrieVariants {
+		for _, config := range allMptConfigs {
+			variant, config := variant, config
+			t.Run(variant.name+"/"+config.Name, func(t *testing.T) {
+				t.Parallel()
+				const N = 200000
+
+				trie, err := variant.factory(t.TempDir(), config, 1024*1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
 
-			// Create a single account with a large storage.
-			addr := common.Address{1, 2, 3}
-			if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.Nonce{1}}); err != nil {
-				t.Fatalf("failed to create account: %v", err)
-			}
-			for i := 0; i < N; i++ {
-				if err := trie.SetValue(addr, common.Key{byte(i), byte(i >> 8), byte(i >> 16)}, common.Value{1}); err != nil {
-					t.Fatalf("failed to insert value: %v", err)
+				// Create a single account with a large storage.
+				addr := common.Address{1, 2, 3}
+				if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.Nonce{1}}); err != nil {
+					t.Fatalf("failed to create account: %v", err)
 				}
-				if i%100 == 0 {
-					if _, _, err := trie.UpdateHashes(); err != nil {
-						t.Fatalf("failed to update hashes: %v", err)
+				for i := 0; i < N; i++ {
+					if err := trie.SetValue(addr, common.Key{byte(i), byte(i >> 8), byte(i >> 16)}, common.Value{1}); err != nil {
+						t.Fatalf("failed to insert value: %v", err)
+					}
+					if i%100 == 0 {
+						if _, _, err := trie.UpdateHashes(); err != nil {
+							t.Fatalf("failed to update hashes: %v", err)
+						}
 					}
 				}
-			}
 
-			if _, _, err := trie.UpdateHashes(); err != nil {
-				t.Fatalf("failed to update hashes: %v", err)
-			}
+				if _, _, err := trie.UpdateHashes(); err != nil {
+					t.Fatalf("failed to update hashes: %v", err)
+				}
 
-			// There should be N value nodes now.
-			ids, err := trie.forest.(*Forest).values.GetIds()
-			if err != nil {
-				t.Fatalf("failed to get list of value IDs: %v", err)
-			}
-			if want, got := N, getSize(ids); want != got {
-				t.Errorf("unexpected number of values, wanted %d, got %d", want, got)
-			}
+				// There should be N value nodes now.
+				ids, err := trie.forest.(*Forest).values.GetIds()
+				if err != nil {
+					t.Fatalf("failed to get list of value IDs: %v", err)
+				}
+				if want, got := N, getSize(ids); want != got {
+					t.Errorf("unexpected number of values, wanted %d, got %d", want, got)
+				}
 
-			// Deleting the account storage should be fast (not blocking until the entire storage tree is released).
-			start := time.Now()
-			if err := trie.ClearStorage(addr); err != nil {
-				t.Errorf("failed to clear storage: %v", err)
-			}
-			// If done wrong, the delete takes > 1 second.
-			if duration, limit := time.Since(start), 50*time.Millisecond; duration > limit {
-				t.Errorf("delete took too long: %v, limit %v", duration, limit)
-			}
+				// Deleting the account storage should be fast (not blocking until the entire storage tree is released).
+				start := time.Now()
+				if err := trie.ClearStorage(addr); err != nil {
+					t.Errorf("failed to clear storage: %v", err)
+				}
+				// If done wrong, the delete takes > 1 second.
+				if duration, limit := time.Since(start), 50*time.Millisecond; duration > limit {
+					t.Errorf("delete took too long: %v, limit %v", duration, limit)
+				}
 
-			if _, _, err := trie.UpdateHashes(); err != nil {
-				t.Fatalf("failed to update hashes: %v", err)
-			}
+				if _, _, err := trie.UpdateHashes(); err != nil {
+					t.Fatalf("failed to update hashes: %v", err)
+				}
 
-			if err := trie.Flush(); err != nil {
-				t.Fatalf("failed to flush trie: %v", err)
-			}
+				if err := trie.Flush(); err != nil {
+					t.Fatalf("failed to flush trie: %v", err)
+				}
 
-			// check the number of stored nodes to make sure everything but the account got released
-			ids, err = trie.forest.(*Forest).accounts.GetIds()
-			if err != nil {
-				t.Fatalf("failed to get list of account IDs: %v", err)
-			}
-			if want, got := 1, getSize(ids); want != got {
-				t.Errorf("unexpected number of accounts, wanted %d, got %d", want, got)
-			}
+				// check the number of stored nodes to make sure everything but the account got released
+				ids, err = trie.forest.(*Forest).accounts.GetIds()
+				if err != nil {
+					t.Fatalf("failed to get list of account IDs: %v", err)
+				}
+				if want, got := 1, getSize(ids); want != got {
+					t.Errorf("unexpected number of accounts, wanted %d, got %d", want, got)
+				}
 
-			ids, err = trie.forest.(*Forest).branches.GetIds()
-			if err != nil {
-				t.Fatalf("failed to get list of branch IDs: %v", err)
-			}
-			if want, got := 0, getSize(ids); want != got {
-				t.Errorf("unexpected number of branches, wanted %d, got %d", want, got)
-			}
+				ids, err = trie.forest.(*Forest).branches.GetIds()
+				if err != nil {
+					t.Fatalf("failed to get list of branch IDs: %v", err)
+				}
+				if want, got := 0, getSize(ids); want != got {
+					t.Errorf("unexpected number of branches, wanted %d, got %d", want, got)
+				}
 
-			ids, err = trie.forest.(*Forest).extensions.GetIds()
-			if err != nil {
-				t.Fatalf("failed to get list of extension IDs: %v", err)
-			}
-			if want, got := 0, getSize(ids); want != got {
-				t.Errorf("unexpected number of extensions, wanted %d, got %d", want, got)
-			}
+				ids, err = trie.forest.(*Forest).extensions.GetIds()
+				if err != nil {
+					t.Fatalf("failed to get list of extension IDs: %v", err)
+				}
+				if want, got := 0, getSize(ids); want != got {
+					t.Errorf("unexpected number of extensions, wanted %d, got %d", want, got)
+				}
 
-			ids, err = trie.forest.(*Forest).values.GetIds()
-			if err != nil {
-				t.Fatalf("failed to get list of value IDs: %v", err)
-			}
-			if want, got := 0, getSize(ids); want != got {
-				t.Errorf("unexpected number of values, wanted %d, got %d", want, got)
-			}
+				ids, err = trie.forest.(*Forest).values.GetIds()
+				if err != nil {
+					t.Fatalf("failed to get list of value IDs: %v", err)
+				}
+				if want, got := 0, getSize(ids); want != got {
+					t.Errorf("unexpected number of values, wanted %d, got %d", want, got)
+				}
 
-			if err := trie.Close(); err != nil {
-				t.Fatalf("failed to close trie: %v", err)
-			}
-		})
+				if err := trie.Close(); err != nil {
+					t.Fatalf("failed to close trie: %v", err)
+				}
+			})
+		}
 	}
 }
 
@@ -893,6 +1043,30 @@ func TestLiveTrie_VerificationOfLiveTrieWithCorruptedFileFails(t *testing.T) {
 	}
 }
 
+func TestLiveTrie_HasAccount(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			addr := common.Address{0x1}
+			ctrl := gomock.NewController(t)
+			db := NewMockDatabase(ctrl)
+			db.EXPECT().HasAccount(gomock.Any(), addr).Return(true, nil)
+
+			mpt, err := OpenFileLiveTrie(dir, config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open live trie: %v", err)
+			}
+			closeTrieOnCleanup(t, mpt)
+			mpt.forest = db
+
+			if exists, err := mpt.HasAccount(addr); err != nil || !exists {
+				t.Errorf("unexpected result, wanted true, got %v, err %v", exists, err)
+			}
+		})
+	}
+}
+
 func TestLiveTrie_HasEmptyStorage(t *testing.T) {
 	for _, config := range allMptConfigs {
 		t.Run(config.Name, func(t *testing.T) {
@@ -907,6 +1081,7 @@ func TestLiveTrie_HasEmptyStorage(t *testing.T) {
 			if err != nil {
 				t.Fatalf("failed to open live trie: %v", err)
 			}
+			closeTrieOnCleanup(t, mpt)
 			mpt.forest = db
 
 			mpt.HasEmptyStorage(addr)
@@ -980,3 +1155,587 @@ func BenchmarkValueInsertionInFileTrie(b *testing.B) {
 		})
 	}
 }
+
+func TestLiveTrie_VolatileTrieCanBeFlushedAndClosed(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			trie, err := OpenVolatileLiveTrie(config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			addr := common.Address{1}
+			info := AccountInfo{Nonce: common.ToNonce(1)}
+			if err := trie.SetAccountInfo(addr, info); err != nil {
+				t.Fatalf("failed to set account: %v", err)
+			}
+			if err := trie.Flush(); err != nil {
+				t.Errorf("failed to flush trie: %v", err)
+			}
+			if got, exists, err := trie.GetAccountInfo(addr); err != nil || !exists || got != info {
+				t.Errorf("unexpected account after flush, wanted %v, got %v, exists %t, err %v", info, got, exists, err)
+			}
+			if err := trie.Check(); err != nil {
+				t.Errorf("inconsistent trie after flush: %v", err)
+			}
+			if err := trie.Close(); err != nil {
+				t.Errorf("failed to close trie: %v", err)
+			}
+		})
+	}
+}
+
+func TestLiveTrie_VolatileTrieMatchesFileBasedTrie(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			volatile, err := OpenVolatileLiveTrie(config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer volatile.Close()
+			fileBased, err := OpenFileLiveTrie(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer fileBased.Close()
+
+			r := rand.New(rand.NewSource(42))
+			for i := 0; i < 1000; i++ {
+				addr := common.Address{byte(r.Intn(20))}
+				key := common.Key{byte(r.Intn(10))}
+				for _, trie := range []*LiveTrie{volatile, fileBased} {
+					var err error
+					switch i % 4 {
+					case 0:
+						err = trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(uint64(i))})
+					case 1:
+						err = trie.SetAccountInfo(addr, AccountInfo{})
+					default:
+						err = trie.SetValue(addr, key, common.Value{byte(i)})
+					}
+					if err != nil {
+						t.Fatalf("failed to apply update %d: %v", i, err)
+					}
+				}
+				if i%100 != 0 {
+					continue
+				}
+				want, _, err := fileBased.UpdateHashes()
+				if err != nil {
+					t.Fatalf("failed to hash trie: %v", err)
+				}
+				got, _, err := volatile.UpdateHashes()
+				if err != nil {
+					t.Fatalf("failed to hash trie: %v", err)
+				}
+				if want != got {
+					t.Fatalf("hashes differ after update %d, file-based %x, volatile %x", i, want, got)
+				}
+			}
+			if err := volatile.Check(); err != nil {
+				t.Errorf("inconsistent volatile trie: %v", err)
+			}
+		})
+	}
+}
+
+func TestLiveTrie_ExtensionNodesCanBeDisabled(t *testing.T) {
+	s4NoExtensions := S4LiveConfig
+	s4NoExtensions.Name = "S4-Live-NoExtensions"
+	s4NoExtensions.DisableExtensionNodes = true
+
+	pairs := [][2]MptConfig{
+		{S4LiveConfig, s4NoExtensions},
+		{S5LiveConfig, S5LiveNoExtensionsConfig},
+	}
+	for _, pair := range pairs {
+		t.Run(pair[1].Name, func(t *testing.T) {
+			r := rand.New(rand.NewSource(42))
+			withExtensions := fillTrieForExtensionTest(t, pair[0], r)
+			withoutExtensions := fillTrieForExtensionTest(t, pair[1], r)
+			reordered := fillTrieForExtensionTest(t, pair[1], r)
+
+			if got := countExtensionNodes(t, withoutExtensions); got != 0 {
+				t.Errorf("trie should not contain extension nodes, found %d", got)
+			}
+			if got := countExtensionNodes(t, withExtensions); got == 0 {
+				t.Errorf("reference trie should contain extension nodes")
+			}
+
+			want, _, err := withoutExtensions.UpdateHashes()
+			if err != nil {
+				t.Fatalf("failed to get hash: %v", err)
+			}
+			got, _, err := reordered.UpdateHashes()
+			if err != nil {
+				t.Fatalf("failed to get hash: %v", err)
+			}
+			if want != got {
+				t.Errorf("insertion order should not affect hash, wanted %x, got %x", want, got)
+			}
+			reference, _, err := withExtensions.UpdateHashes()
+			if err != nil {
+				t.Fatalf("failed to get hash: %v", err)
+			}
+			if reference == want {
+				t.Errorf("disabling extension nodes should change the hash")
+			}
+			for _, trie := range []*LiveTrie{withExtensions, withoutExtensions, reordered} {
+				if err := trie.Check(); err != nil {
+					t.Errorf("inconsistent trie: %v", err)
+				}
+			}
+
+			// Deleting all accounts in random order needs to restore an empty trie.
+			for _, trie := range []*LiveTrie{withExtensions, withoutExtensions} {
+				for i, addr := range shuffledExtensionTestAddresses(r) {
+					if err := trie.SetAccountInfo(addr, AccountInfo{}); err != nil {
+						t.Fatalf("failed to delete account: %v", err)
+					}
+					if i%8 != 0 {
+						continue
+					}
+					if _, _, err := trie.UpdateHashes(); err != nil {
+						t.Fatalf("failed to update hashes: %v", err)
+					}
+					if err := trie.Check(); err != nil {
+						t.Fatalf("inconsistent trie after deleting %d accounts: %v", i+1, err)
+					}
+				}
+				if !trie.root.Id().IsEmpty() {
+					t.Errorf("trie should be empty after deleting all accounts, got root %v", trie.root.Id())
+				}
+			}
+		})
+	}
+}
+
+func TestLiveTrie_HashedKeysCanBeStoredInValueNodes(t *testing.T) {
+	for _, reference := range []MptConfig{S5LiveConfig, S5ArchiveConfig} {
+		t.Run(reference.Name, func(t *testing.T) {
+			config := reference
+			config.StoreHashedKeysInValueNodes = true
+
+			fill := func(trie *LiveTrie) common.Hash {
+				t.Helper()
+				for i := 0; i < 10; i++ {
+					addr := common.Address{byte(i)}
+					if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+						t.Fatalf("failed to set account: %v", err)
+					}
+					for j := 0; j < 20; j++ {
+						if err := trie.SetValue(addr, common.Key{byte(j)}, common.Value{byte(i + j + 1)}); err != nil {
+							t.Fatalf("failed to set value: %v", err)
+						}
+					}
+				}
+				hash, _, err := trie.UpdateHashes()
+				if err != nil {
+					t.Fatalf("failed to update hashes: %v", err)
+				}
+				return hash
+			}
+			countValuesWithHashedKeys := func(trie *LiveTrie) (int, int) {
+				t.Helper()
+				total, withHashedKey := 0, 0
+				err := trie.VisitTrie(MakeVisitor(func(node Node, _ NodeInfo) VisitResponse {
+					if value, ok := node.(*ValueNode); ok {
+						total++
+						if value.hashedKeyKnown {
+							withHashedKey++
+						}
+					}
+					return VisitResponseContinue
+				}))
+				if err != nil {
+					t.Fatalf("failed to visit trie: %v", err)
+				}
+				return total, withHashedKey
+			}
+
+			referenceTrie, err := OpenInMemoryLiveTrie(t.TempDir(), reference, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer referenceTrie.Close()
+			want := fill(referenceTrie)
+
+			dir := t.TempDir()
+			trie, err := OpenFileLiveTrie(dir, config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			if got := fill(trie); want != got {
+				t.Errorf("storing hashed keys should not affect the hash, wanted %x, got %x", want, got)
+			}
+			if total, withHashedKey := countValuesWithHashedKeys(trie); total != 200 || withHashedKey != total {
+				t.Errorf("hashed keys should be retained by all %d value nodes, got %d", total, withHashedKey)
+			}
+			if err := trie.Close(); err != nil {
+				t.Fatalf("failed to close trie: %v", err)
+			}
+
+			if err := VerifyFileLiveTrie(dir, config, NilVerificationObserver{}); err != nil {
+				t.Errorf("verification failed: %v", err)
+			}
+			trie, err = OpenFileLiveTrie(dir, config, 1024)
+			if err != nil {
+				t.Fatalf("failed to reopen trie: %v", err)
+			}
+			defer trie.Close()
+			if total, withHashedKey := countValuesWithHashedKeys(trie); total != 200 || withHashedKey != total {
+				t.Errorf("hashed keys should be loaded for all %d value nodes, got %d", total, withHashedKey)
+			}
+			if err := trie.Check(); err != nil {
+				t.Errorf("inconsistent trie: %v", err)
+			}
+			if got, _, err := trie.UpdateHashes(); err != nil || want != got {
+				t.Errorf("unexpected hash after reopening, wanted %x, got %x, err %v", want, got, err)
+			}
+		})
+	}
+}
+
+func TestLiveTrie_HashedKeysInValueNodesRequireHashedPaths(t *testing.T) {
+	config := S4LiveConfig
+	config.StoreHashedKeysInValueNodes = true
+	if _, err := OpenFileLiveTrie(t.TempDir(), config, 1024); err == nil {
+		t.Errorf("storing hashed keys should not be supported without hashed paths")
+	}
+}
+
+// shuffledExtensionTestAddresses lists the accounts used for testing the
+// extension node configurations in random order. The addresses and keys are
+// chosen to share long common prefixes if paths are not hashed.
+func shuffledExtensionTestAddresses(r *rand.Rand) []common.Address {
+	addresses := []common.Address{}
+	for i := 0; i < 16; i++ {
+		addresses = append(addresses, common.Address{byte(i), 19: 1}, common.Address{0xAB, 0xCD, byte(i)})
+	}
+	r.Shuffle(len(addresses), func(i, j int) {
+		addresses[i], addresses[j] = addresses[j], addresses[i]
+	})
+	return addresses
+}
+
+func fillTrieForExtensionTest(t *testing.T, config MptConfig, r *rand.Rand) *LiveTrie {
+	t.Helper()
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 10_000)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	t.Cleanup(func() { trie.Close() })
+
+	for _, addr := range shuffledExtensionTestAddresses(r) {
+		if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+			t.Fatalf("failed to set account: %v", err)
+		}
+		for j := 0; j < 32; j++ {
+			for _, key := range []common.Key{{byte(j), 30: addr[0], 31: addr[2]}, {0x12, 0x34, 0x56, byte(j % 4)}} {
+				if err := trie.SetValue(addr, key, common.Value{byte(j + 1)}); err != nil {
+					t.Fatalf("failed to set value: %v", err)
+				}
+			}
+		}
+	}
+	return trie
+}
+
+func countExtensionNodes(t *testing.T, trie *LiveTrie) int {
+	t.Helper()
+	count := 0
+	err := trie.VisitTrie(MakeVisitor(func(node Node, _ NodeInfo) VisitResponse {
+		if _, ok := node.(*ExtensionNode); ok {
+			count++
+		}
+		return VisitResponseContinue
+	}))
+	if err != nil {
+		t.Fatalf("failed to visit trie: %v", err)
+	}
+	return count
+}
+
+func TestLiveTrie_ApplyDiff_SyncsTrieToStateOfArchive(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			archive, err := OpenArchiveTrie(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open archive: %v", err)
+			}
+			defer archive.Close()
+
+			addr1 := common.Address{1}
+			addr2 := common.Address{2}
+			addr3 := common.Address{3}
+			updates := []common.Update{
+				{
+					CreatedAccounts: []common.Address{addr1, addr2},
+					Balances:        []common.BalanceUpdate{{Account: addr1, Balance: common.Balance{1}}},
+					Nonces:          []common.NonceUpdate{{Account: addr2, Nonce: common.Nonce{2}}},
+					Slots: []common.SlotUpdate{
+						{Account: addr1, Key: common.Key{1}, Value: common.Value{1}},
+						{Account: addr2, Key: common.Key{2}, Value: common.Value{2}},
+					},
+				},
+				{
+					CreatedAccounts: []common.Address{addr3},
+					Nonces:          []common.NonceUpdate{{Account: addr3, Nonce: common.Nonce{3}}},
+					Codes:           []common.CodeUpdate{{Account: addr3, Code: []byte{1, 2, 3}}},
+					Slots: []common.SlotUpdate{
+						{Account: addr1, Key: common.Key{1}, Value: common.Value{}},
+						{Account: addr1, Key: common.Key{3}, Value: common.Value{3}},
+					},
+				},
+				{
+					DeletedAccounts: []common.Address{addr2},
+					Balances:        []common.BalanceUpdate{{Account: addr1, Balance: common.Balance{4}}},
+				},
+				{
+					// addr2 is re-created with empty storage.
+					CreatedAccounts: []common.Address{addr2},
+					Nonces:          []common.NonceUpdate{{Account: addr2, Nonce: common.Nonce{5}}},
+					Slots:           []common.SlotUpdate{{Account: addr2, Key: common.Key{5}, Value: common.Value{5}}},
+				},
+			}
+			for i, update := range updates {
+				if err := archive.Add(uint64(i), update, nil); err != nil {
+					t.Fatalf("failed to add block %d: %v", i, err)
+				}
+			}
+
+			// Sync a trie block by block and another one directly to the last block.
+			stepwise, err := OpenVolatileLiveTrie(config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer stepwise.Close()
+			direct, err := OpenVolatileLiveTrie(config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer direct.Close()
+
+			apply := func(trie *LiveTrie, from, to uint64) {
+				t.Helper()
+				var diff Diff
+				if from == to {
+					diff, err = archive.GetDiffForBlock(to)
+				} else {
+					diff, err = archive.GetDiff(from, to)
+				}
+				if err != nil {
+					t.Fatalf("failed to get diff: %v", err)
+				}
+				// Transport the diff through its serialized form.
+				var buffer bytes.Buffer
+				if err := diff.Write(&buffer); err != nil {
+					t.Fatalf("failed to serialize diff: %v", err)
+				}
+				diff, err = ReadDiff(&buffer)
+				if err != nil {
+					t.Fatalf("failed to parse diff: %v", err)
+				}
+				want, err := archive.GetHash(to)
+				if err != nil {
+					t.Fatalf("failed to get hash of block %d: %v", to, err)
+				}
+				if err := trie.ApplyDiff(diff, want); err != nil {
+					t.Fatalf("failed to apply diff from %d to %d: %v", from, to, err)
+				}
+				if err := trie.Check(); err != nil {
+					t.Fatalf("inconsistent trie after applying diff: %v", err)
+				}
+			}
+
+			apply(stepwise, 0, 0)
+			apply(direct, 0, 0)
+			for i := 1; i < len(updates); i++ {
+				apply(stepwise, uint64(i-1), uint64(i))
+			}
+			apply(direct, 0, uint64(len(updates)-1))
+
+			for _, trie := range []*LiveTrie{stepwise, direct} {
+				if value, err := trie.GetValue(addr1, common.Key{1}); err != nil || value != (common.Value{}) {
+					t.Errorf("unexpected value of cleared slot, got %v, err %v", value, err)
+				}
+				if value, err := trie.GetValue(addr2, common.Key{2}); err != nil || value != (common.Value{}) {
+					t.Errorf("storage of re-created account not cleared, got %v, err %v", value, err)
+				}
+				if value, err := trie.GetValue(addr2, common.Key{5}); err != nil || value != (common.Value{5}) {
+					t.Errorf("unexpected value of slot, got %v, err %v", value, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLiveTrie_ApplyDiff_HashMismatchMarksTrieAsInconsistent(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			trie, err := OpenVolatileLiveTrie(config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer trie.Close()
+
+			diff := Diff{common.Address{1}: &AccountDiff{Nonce: &common.Nonce{1}}}
+			err = trie.ApplyDiff(diff, common.Hash{})
+			if !errors.Is(err, ErrInconsistentTrie) {
+				t.Fatalf("hash mismatch not detected, got %v", err)
+			}
+
+			if err := trie.SetAccountInfo(common.Address{2}, AccountInfo{Nonce: common.Nonce{2}}); !errors.Is(err, ErrInconsistentTrie) {
+				t.Errorf("update of inconsistent trie not refused, got %v", err)
+			}
+			if err := trie.SetValue(common.Address{1}, common.Key{1}, common.Value{1}); !errors.Is(err, ErrInconsistentTrie) {
+				t.Errorf("update of inconsistent trie not refused, got %v", err)
+			}
+			if err := trie.ClearStorage(common.Address{1}); !errors.Is(err, ErrInconsistentTrie) {
+				t.Errorf("update of inconsistent trie not refused, got %v", err)
+			}
+			if err := trie.ApplyDiff(Diff{}, common.Hash{}); !errors.Is(err, ErrInconsistentTrie) {
+				t.Errorf("update of inconsistent trie not refused, got %v", err)
+			}
+			if err := trie.Flush(); !errors.Is(err, ErrInconsistentTrie) {
+				t.Errorf("flush of inconsistent trie not refused, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLiveTrie_ApplyDiff_MatchingHashKeepsTrieUsable(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			source, err := OpenVolatileLiveTrie(config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer source.Close()
+			target, err := OpenVolatileLiveTrie(config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer target.Close()
+
+			if err := source.SetAccountInfo(common.Address{1}, AccountInfo{Nonce: common.Nonce{1}}); err != nil {
+				t.Fatalf("failed to update account: %v", err)
+			}
+			if err := source.SetValue(common.Address{1}, common.Key{2}, common.Value{3}); err != nil {
+				t.Fatalf("failed to update slot: %v", err)
+			}
+			want, hints, err := source.UpdateHashes()
+			if err != nil {
+				t.Fatalf("failed to compute hash: %v", err)
+			}
+			if hints != nil {
+				hints.Release()
+			}
+
+			diff := Diff{common.Address{1}: &AccountDiff{
+				Nonce:   &common.Nonce{1},
+				Storage: map[common.Key]common.Value{{2}: {3}},
+			}}
+			if err := target.ApplyDiff(diff, want); err != nil {
+				t.Fatalf("failed to apply diff: %v", err)
+			}
+			if err := target.SetAccountInfo(common.Address{2}, AccountInfo{Nonce: common.Nonce{2}}); err != nil {
+				t.Errorf("failed to update trie after applying diff: %v", err)
+			}
+			if err := target.Flush(); err != nil {
+				t.Errorf("failed to flush trie after applying diff: %v", err)
+			}
+		})
+	}
+}
+
+func TestLiveTrie_RecreateAccount_ProducesTrieOfFreshlyCreatedAccount(t *testing.T) {
+	addr := common.Address{1}
+	other := common.Address{2}
+	oldInfo := AccountInfo{Nonce: common.ToNonce(1), Balance: common.Balance{1}}
+	newInfo := AccountInfo{Nonce: common.ToNonce(2)}
+
+	tests := map[string]struct {
+		slots   int          // the number of slots of the account before recreating it
+		before  *AccountInfo // the information of the account before recreating it, nil if missing
+		info    AccountInfo  // the information of the recreated account
+		changed bool
+	}{
+		"with storage":                   {slots: 3, before: &oldInfo, info: newInfo, changed: true},
+		"with storage and same info":     {slots: 3, before: &oldInfo, info: oldInfo, changed: true},
+		"with storage and empty info":    {slots: 3, before: &oldInfo, info: AccountInfo{}, changed: true},
+		"without storage":                {before: &oldInfo, info: newInfo, changed: true},
+		"without storage and same info":  {before: &oldInfo, info: oldInfo, changed: false},
+		"missing account":                {info: newInfo, changed: true},
+		"missing account and empty info": {info: AccountInfo{}, changed: false},
+	}
+
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		for name, test := range tests {
+			t.Run(fmt.Sprintf("%s/%s", config.Name, name), func(t *testing.T) {
+				open := func() *LiveTrie {
+					trie, err := OpenVolatileLiveTrie(config, 1024)
+					if err != nil {
+						t.Fatalf("failed to open trie: %v", err)
+					}
+					if err := trie.SetAccountInfo(other, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+						t.Fatalf("failed to create account: %v", err)
+					}
+					if err := trie.SetValue(other, common.Key{1}, common.Value{1}); err != nil {
+						t.Fatalf("failed to set slot: %v", err)
+					}
+					return trie
+				}
+
+				trie := open()
+				defer trie.Close()
+				if test.before != nil {
+					if err := trie.SetAccountInfo(addr, *test.before); err != nil {
+						t.Fatalf("failed to create account: %v", err)
+					}
+					for i := 0; i < test.slots; i++ {
+						if err := trie.SetValue(addr, common.Key{byte(i)}, common.Value{1}); err != nil {
+							t.Fatalf("failed to set slot: %v", err)
+						}
+					}
+				}
+				changed, err := trie.RecreateAccount(addr, test.info)
+				if err != nil {
+					t.Fatalf("failed to recreate account: %v", err)
+				}
+				if changed != test.changed {
+					t.Errorf("unexpected change flag, wanted %t, got %t", test.changed, changed)
+				}
+				got, _, err := trie.UpdateHashes()
+				if err != nil {
+					t.Fatalf("failed to hash trie: %v", err)
+				}
+
+				// The reference trie contains a freshly created account.
+				reference := open()
+				defer reference.Close()
+				if err := reference.SetAccountInfo(addr, test.info); err != nil {
+					t.Fatalf("failed to create account: %v", err)
+				}
+				want, _, err := reference.UpdateHashes()
+				if err != nil {
+					t.Fatalf("failed to hash trie: %v", err)
+				}
+				if want != got {
+					t.Errorf("unexpected hash of trie, wanted %x, got %x", want, got)
+				}
+
+				for i := 0; i < test.slots; i++ {
+					if value, err := trie.GetValue(addr, common.Key{byte(i)}); err != nil || value != (common.Value{}) {
+						t.Errorf("slot %d should be cleared, got %v, %v", i, value, err)
+					}
+				}
+				if value, err := trie.GetValue(other, common.Key{1}); err != nil || value != (common.Value{1}) {
+					t.Errorf("storage of other account should be retained, got %v, %v", value, err)
+				}
+				if err := trie.Check(); err != nil {
+					t.Errorf("trie is inconsistent: %v", err)
+				}
+			})
+		}
+	}
+}
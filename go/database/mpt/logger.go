@@ -0,0 +1,108 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// LogLevel classifies the messages reported to a Logger.
+type LogLevel int
+
+const (
+	LogDebug   LogLevel = iota // frequent events, e.g. committed blocks or evicted nodes
+	LogInfo                    // infrequent lifecycle events, e.g. opening or closing a forest
+	LogWarning                 // unexpected conditions not affecting the consistency of the data
+	LogError                   // failed operations
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarning:
+		return "warning"
+	case LogError:
+		return "error"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// Logger receives messages on internal events of forests, states, and
+// archives, enabling embedding applications to route them to their logging
+// infrastructure. It is set through the ForestConfig; if nil, events are
+// not reported. Implementations need to be thread safe.
+type Logger interface {
+	// Log reports a message of the given level. The message is accompanied
+	// by a list of alternating keys and values describing the event, where
+	// keys are strings.
+	Log(level LogLevel, msg string, keysAndValues ...any)
+}
+
+// logWarning reports a warning to the given logger or, for compatibility
+// with the time before loggers could be configured, to the standard logger
+// if no logger is given.
+func logWarning(logger Logger, msg string, keysAndValues ...any) {
+	if logger != nil {
+		logger.Log(LogWarning, msg, keysAndValues...)
+		return
+	}
+	var builder strings.Builder
+	builder.WriteString(msg)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fmt.Fprintf(&builder, " %v=%v", keysAndValues[i], keysAndValues[i+1])
+	}
+	log.Print(builder.String())
+}
+
+// logging is implemented by databases providing their configured logger.
+type logging interface {
+	getLogger() Logger
+}
+
+// getLogger obtains the logger configured for the given database, nil if
+// there is none.
+func getLogger(db Database) Logger {
+	if l, ok := db.(logging); ok {
+		return l.getLogger()
+	}
+	return nil
+}
+
+// NewLoggingVerificationObserver creates a VerificationObserver forwarding
+// the progress of verifications to the given logger.
+func NewLoggingVerificationObserver(logger Logger) VerificationObserver {
+	return loggingVerificationObserver{logger}
+}
+
+type loggingVerificationObserver struct {
+	logger Logger
+}
+
+func (o loggingVerificationObserver) StartVerification() {
+	o.logger.Log(LogInfo, "verification started")
+}
+
+func (o loggingVerificationObserver) Progress(msg string) {
+	o.logger.Log(LogInfo, msg)
+}
+
+func (o loggingVerificationObserver) EndVerification(res error) {
+	if res != nil {
+		o.logger.Log(LogError, "verification failed", "error", res)
+		return
+	}
+	o.logger.Log(LogInfo, "verification succeeded")
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+type logEntry struct {
+	level         LogLevel
+	msg           string
+	keysAndValues []any
+}
+
+// get returns the value recorded for the given key, nil if not present.
+func (e logEntry) get(key string) any {
+	for i := 0; i+1 < len(e.keysAndValues); i += 2 {
+		if e.keysAndValues[i] == key {
+			return e.keysAndValues[i+1]
+		}
+	}
+	return nil
+}
+
+type recordingLogger struct {
+	mutex   sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) Log(level LogLevel, msg string, keysAndValues ...any) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, logEntry{level, msg, keysAndValues})
+}
+
+func (l *recordingLogger) find(msg string) []logEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var res []logEntry
+	for _, entry := range l.entries {
+		if entry.msg == msg {
+			res = append(res, entry)
+		}
+	}
+	return res
+}
+
+func TestLogger_EventsOfOpenCommitCloseCycleAreReported(t *testing.T) {
+	logger := &recordingLogger{}
+	state, err := OpenGoFileStateWithConfig(t.TempDir(), S5LiveConfig, ForestConfig{CacheCapacity: 1024, Logger: logger})
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	for block := uint64(0); block < 3; block++ {
+		update := common.Update{}
+		update.AppendCreateAccount(common.Address{byte(block)})
+		update.AppendNonceUpdate(common.Address{byte(block)}, common.ToNonce(1))
+		if _, err := state.Apply(block, update); err != nil {
+			t.Fatalf("failed to apply block %d: %v", block, err)
+		}
+	}
+	hash, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+
+	// Closing the state flushes the forest multiple times, so repeated
+	// events are only listed once.
+	want := []string{"opened forest", "committed block", "flushed forest", "closed forest"}
+	var got []string
+	for _, entry := range logger.entries {
+		if len(got) == 0 || got[len(got)-1] != entry.msg {
+			got = append(got, entry.msg)
+		}
+	}
+	if strings.Join(want, ",") != strings.Join(got, ",") {
+		t.Errorf("unexpected events, wanted %v, got %v", want, got)
+	}
+
+	if opened := logger.find("opened forest"); len(opened) != 1 || opened[0].level != LogInfo || opened[0].get("mode") != Mutable {
+		t.Errorf("unexpected open event: %v", opened)
+	}
+	commits := logger.find("committed block")
+	if len(commits) != 3 {
+		t.Errorf("unexpected number of commit events, wanted 3, got %d", len(commits))
+	}
+	for i, entry := range commits {
+		if entry.level != LogDebug || entry.get("block") != uint64(i) {
+			t.Errorf("unexpected commit event: %v", entry)
+		}
+	}
+	if len(commits) > 0 && commits[len(commits)-1].get("hash") != hash {
+		t.Errorf("unexpected hash of last commit, wanted %v, got %v", hash, commits[len(commits)-1].get("hash"))
+	}
+}
+
+func TestLogger_EvictionsAndReleasesAreReported(t *testing.T) {
+	logger := &recordingLogger{}
+	forest, err := OpenInMemoryForest(t.TempDir(), S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 64, Logger: logger})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	defer forest.Close()
+
+	root := NewNodeReference(EmptyId())
+	addr := common.Address{1}
+	root, err = forest.SetAccountInfo(&root, addr, AccountInfo{Nonce: common.ToNonce(1)})
+	if err != nil {
+		t.Fatalf("failed to set account: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		root, err = forest.SetValue(&root, addr, common.Key{byte(i)}, common.Value{1})
+		if err != nil {
+			t.Fatalf("failed to set value: %v", err)
+		}
+		if _, _, err := forest.updateHashesFor(&root); err != nil {
+			t.Fatalf("failed to update hashes: %v", err)
+		}
+	}
+	if len(logger.find("evicted modified node")) == 0 {
+		t.Errorf("no evictions reported")
+	}
+
+	// Deleting the account releases its storage trie in the background.
+	root, err = forest.SetAccountInfo(&root, addr, AccountInfo{})
+	if err != nil {
+		t.Fatalf("failed to delete account: %v", err)
+	}
+	if err := forest.Flush(); err != nil {
+		t.Fatalf("failed to flush forest: %v", err)
+	}
+	released := logger.find("released trie")
+	if len(released) != 1 || released[0].get("nodes") == 0 {
+		t.Errorf("unexpected release events: %v", released)
+	}
+}
+
+func TestLogger_VerificationProgressIsReported(t *testing.T) {
+	logger := &recordingLogger{}
+	observer := NewLoggingVerificationObserver(logger)
+	observer.StartVerification()
+	observer.Progress("checking nodes")
+	observer.EndVerification(nil)
+	observer.EndVerification(errors.New("injected error"))
+
+	want := []logEntry{
+		{LogInfo, "verification started", nil},
+		{LogInfo, "checking nodes", nil},
+		{LogInfo, "verification succeeded", nil},
+		{LogError, "verification failed", nil},
+	}
+	if len(want) != len(logger.entries) {
+		t.Fatalf("unexpected events, wanted %v, got %v", want, logger.entries)
+	}
+	for i := range want {
+		if want[i].level != logger.entries[i].level || want[i].msg != logger.entries[i].msg {
+			t.Errorf("unexpected event, wanted %v, got %v", want[i], logger.entries[i])
+		}
+	}
+}
+
+func TestLogger_WarningsAreLoggedToStandardLoggerIfNoLoggerIsConfigured(t *testing.T) {
+	buffer := bytes.Buffer{}
+	original := log.Writer()
+	log.SetOutput(&buffer)
+	defer log.SetOutput(original)
+
+	logWarning(nil, "something happened", "key", 12)
+	if got := buffer.String(); !strings.Contains(got, "something happened key=12") {
+		t.Errorf("unexpected log output: %s", got)
+	}
+
+	logger := &recordingLogger{}
+	logWarning(logger, "something happened")
+	if len(logger.entries) != 1 || logger.entries[0].level != LogWarning {
+		t.Errorf("unexpected events: %v", logger.entries)
+	}
+}
+
+func TestLogLevel_String(t *testing.T) {
+	tests := map[LogLevel]string{
+		LogDebug:     "debug",
+		LogInfo:      "info",
+		LogWarning:   "warning",
+		LogError:     "error",
+		LogLevel(10): "LogLevel(10)",
+	}
+	for level, want := range tests {
+		if got := level.String(); want != got {
+			t.Errorf("unexpected string, wanted %s, got %s", want, got)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/common/interrupt"
+)
+
+// numMigrationChunks is the number of chunks the account trie of a migrated
+// LiveDB is split into. Chunks are formed by the first nibble of the path of
+// accounts in the source trie, which, for configurations not using hashed
+// paths, is the first nibble of the account addresses.
+const numMigrationChunks = 16
+
+// migrationProgressFileName is the name of the file in the target directory
+// of a migration tracking the progress of an incomplete migration.
+const migrationProgressFileName = "migration.json"
+
+// migrationHashUpdateInterval is the number of accounts migrated between
+// updates of the hashes of the target trie, limiting the number of nodes with
+// dirty hashes retained in memory.
+const migrationHashUpdateInterval = 100_000
+
+// migrationCacheCapacity is the number of nodes cached by the target state of
+// a migration. It is a variable to enable tests to use smaller caches.
+var migrationCacheCapacity = DefaultMptStateCapacity
+
+// MigrationProgress summarizes the progress of a migration of a LiveDB.
+type MigrationProgress struct {
+	Chunk     int         // the number of completed chunks
+	NumChunks int         // the total number of chunks
+	Accounts  uint64      // the number of accounts migrated so far
+	Slots     uint64      // the number of storage slots migrated so far
+	Hash      common.Hash // the hash of the target state after the completed chunks
+}
+
+// migrationProgress is the helper type to read and write the progress of a
+// migration from/to the disk.
+type migrationProgress struct {
+	NextChunk int
+	Accounts  uint64
+	Slots     uint64
+	Hash      common.Hash
+}
+
+// MigrateDirectory copies the logical content -- accounts, storage slots, and
+// codes -- of the LiveDB in the source directory using the from configuration
+// into a new LiveDB in the target directory using the to configuration. This
+// allows to convert existing databases to another schema, e.g. from S4 to S5,
+// without re-syncing them. The source directory is only read. See
+// MigrateDirectoryWithContext for details.
+func MigrateDirectory(srcDir, dstDir string, from, to MptConfig) error {
+	_, err := MigrateDirectoryWithContext(context.Background(), srcDir, dstDir, from, to, nil)
+	return err
+}
+
+// MigrateDirectoryWithContext is a variant of MigrateDirectory that may be
+// interrupted through the given context and reports its progress to the
+// given callback, if not nil, after each completed chunk. The migration is
+// conducted in chunks of accounts sharing the first nibble of their path in
+// the source trie. After each chunk, the target state is flushed and the
+// progress is recorded in the target directory, such that a migration that
+// got interrupted or failed continues with the next pending chunk when being
+// restarted with the same directories. Otherwise, the target directory must
+// be empty or not exist. At the end, the numbers of accounts and slots in
+// the target are checked against the migrated ones, and the hash of the new
+// state is returned. If interrupted, interrupt.ErrCanceled is returned.
+func MigrateDirectoryWithContext(
+	ctx context.Context,
+	srcDir, dstDir string,
+	from, to MptConfig,
+	report func(MigrationProgress),
+) (hash common.Hash, err error) {
+	same, err := isSameDirectory(srcDir, dstDir)
+	if err != nil {
+		return hash, err
+	}
+	if same {
+		return hash, fmt.Errorf("source and target of migration must be different directories")
+	}
+	meta, exists, err := readMetadata(filepath.Join(srcDir, "meta.json"))
+	if err != nil {
+		return hash, err
+	}
+	if !exists {
+		return hash, fmt.Errorf("no LiveDB found in %s", srcDir)
+	}
+	codes, err := readCodes(filepath.Join(srcDir, "codes.dat"))
+	if err != nil {
+		return hash, err
+	}
+
+	progressFile := filepath.Join(dstDir, migrationProgressFileName)
+	progress, resumed, err := readMigrationProgress(progressFile)
+	if err != nil {
+		return hash, err
+	}
+	if !resumed {
+		if err := checkMigrationTarget(dstDir); err != nil {
+			return hash, err
+		}
+	}
+
+	source, err := openVerificationNodeSource(srcDir, from)
+	if err != nil {
+		return hash, fmt.Errorf("failed to open source of migration: %w", err)
+	}
+	defer func() {
+		err = errors.Join(err, source.Close())
+	}()
+
+	target, err := OpenGoFileState(dstDir, to, migrationCacheCapacity)
+	if err != nil {
+		return hash, fmt.Errorf("failed to open target of migration: %w", err)
+	}
+	if resumed {
+		got, err := target.GetHash()
+		if err != nil {
+			return hash, errors.Join(err, target.Close())
+		}
+		if got != progress.Hash {
+			return hash, errors.Join(
+				fmt.Errorf("unable to resume migration, target hash does not match recorded progress, wanted %x, got %x", progress.Hash, got),
+				target.Close(),
+			)
+		}
+	}
+
+	root := NewNodeReference(meta.RootNode)
+	migrated := 0
+	for chunk := progress.NextChunk; chunk < numMigrationChunks; chunk++ {
+		if interrupt.IsCancelled(ctx) {
+			return hash, errors.Join(interrupt.ErrCanceled, target.Close())
+		}
+		err := forEachAccountInChunk(source, &root, 0, Nibble(chunk), func(account *AccountNode) error {
+			if err := migrateAccount(source, target, codes, account, &progress); err != nil {
+				return err
+			}
+			migrated++
+			if migrated%migrationHashUpdateInterval == 0 {
+				_, err := target.GetHash()
+				return err
+			}
+			return nil
+		})
+		if err == nil {
+			progress.Hash, err = target.GetHash()
+		}
+		if err == nil {
+			err = target.Flush()
+		}
+		if err != nil {
+			return hash, errors.Join(fmt.Errorf("failed to migrate chunk %d: %w", chunk, err), target.Close())
+		}
+		progress.NextChunk = chunk + 1
+		if err := writeMigrationProgress(progressFile, progress); err != nil {
+			return hash, errors.Join(err, target.Close())
+		}
+		if report != nil {
+			report(MigrationProgress{
+				Chunk:     progress.NextChunk,
+				NumChunks: numMigrationChunks,
+				Accounts:  progress.Accounts,
+				Slots:     progress.Slots,
+				Hash:      progress.Hash,
+			})
+		}
+	}
+
+	hash, err = target.GetHash()
+	if err := errors.Join(err, target.Close()); err != nil {
+		return hash, err
+	}
+	if err := checkMigratedCounts(dstDir, to, progress); err != nil {
+		return hash, err
+	}
+	if err := os.Remove(progressFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return hash, err
+	}
+	return hash, nil
+}
+
+// migrateAccount adds the given account, its storage, and its code to the
+// target state and records it in the given progress.
+func migrateAccount(source NodeSource, target *MptState, codes map[common.Hash][]byte, account *AccountNode, progress *migrationProgress) error {
+	info := account.info
+	if info.CodeHash != (common.Hash{}) && info.CodeHash != emptyCodeHash {
+		code, found := codes[info.CodeHash]
+		if !found {
+			return fmt.Errorf("%w: code %x of account %x", ErrMissingCode, info.CodeHash, account.address)
+		}
+		target.codeMutex.Lock()
+		target.code[info.CodeHash] = code
+		target.codeDirty = true
+		target.codeMutex.Unlock()
+	}
+	if err := target.trie.SetAccountInfo(account.address, info); err != nil {
+		return err
+	}
+	progress.Accounts++
+	return forEachValue(source, &account.storage, func(value *ValueNode) error {
+		progress.Slots++
+		return target.trie.SetValue(account.address, value.key, value.value)
+	})
+}
+
+// checkMigratedCounts checks that the numbers of accounts and slots in the
+// LiveDB in the given directory match the numbers recorded in the progress
+// of a migration.
+func checkMigratedCounts(directory string, config MptConfig, progress migrationProgress) (err error) {
+	meta, _, err := readMetadata(filepath.Join(directory, "meta.json"))
+	if err != nil {
+		return err
+	}
+	source, err := openVerificationNodeSource(directory, config)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, source.Close())
+	}()
+
+	var accounts, slots uint64
+	root := NewNodeReference(meta.RootNode)
+	for chunk := 0; chunk < numMigrationChunks; chunk++ {
+		err := forEachAccountInChunk(source, &root, 0, Nibble(chunk), func(account *AccountNode) error {
+			accounts++
+			return forEachValue(source, &account.storage, func(*ValueNode) error {
+				slots++
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if accounts != progress.Accounts || slots != progress.Slots {
+		return fmt.Errorf("migrated state is incomplete, wanted %d accounts and %d slots, got %d accounts and %d slots", progress.Accounts, progress.Slots, accounts, slots)
+	}
+	return nil
+}
+
+// forEachValue calls the given function for each value node in the trie
+// rooted by the given node.
+func forEachValue(source NodeSource, ref *NodeReference, visit func(*ValueNode) error) error {
+	if ref.Id().IsEmpty() {
+		return nil
+	}
+	handle, err := source.getViewAccess(ref)
+	if err != nil {
+		return err
+	}
+	defer handle.Release()
+	switch node := handle.Get().(type) {
+	case *BranchNode:
+		for i := range node.children {
+			if err := forEachValue(source, &node.children[i], visit); err != nil {
+				return err
+			}
+		}
+	case *ExtensionNode:
+		return forEachValue(source, &node.next, visit)
+	case *ValueNode:
+		return visit(node)
+	}
+	return nil
+}
+
+// checkMigrationTarget checks that the given target directory of a migration
+// does not exist or is empty.
+func checkMigrationTarget(directory string) error {
+	entries, err := os.ReadDir(directory)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("target directory %s of migration is not empty", directory)
+	}
+	return nil
+}
+
+// isSameDirectory checks whether the given paths refer to the same directory.
+func isSameDirectory(a, b string) (bool, error) {
+	absA, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	absB, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	return absA == absB, nil
+}
+
+// readMigrationProgress parses the content of the given progress file. If
+// the file does not exist, the progress of a fresh migration is returned and
+// the flag indicating a resumed migration is false.
+func readMigrationProgress(filename string) (migrationProgress, bool, error) {
+	res := migrationProgress{}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return res, false, nil
+	}
+	if err != nil {
+		return res, false, err
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return res, false, err
+	}
+	if res.NextChunk < 0 || res.NextChunk > numMigrationChunks {
+		return res, false, fmt.Errorf("invalid migration progress, next chunk %d out of range", res.NextChunk)
+	}
+	return res, true, nil
+}
+
+// writeMigrationProgress stores the given progress in the given file.
+func writeMigrationProgress(filename string, progress migrationProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0600)
+}
@@ -0,0 +1,315 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/common/interrupt"
+)
+
+func TestMigrateDirectory_S4ToS5PreservesAllValues(t *testing.T) {
+	useSmallMigrationCache(t)
+	src := t.TempDir()
+	createMigrationFixture(t, src, S4LiveConfig)
+	before := readDirectoryContent(t, src)
+
+	dst := filepath.Join(t.TempDir(), "target")
+	if err := MigrateDirectory(src, dst, S4LiveConfig, S5LiveConfig); err != nil {
+		t.Fatalf("failed to migrate directory: %v", err)
+	}
+
+	if after := readDirectoryContent(t, src); !equalDirectoryContent(before, after) {
+		t.Errorf("source directory got modified by migration")
+	}
+	if _, err := os.Stat(filepath.Join(dst, migrationProgressFileName)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("progress file should be removed after completed migration, got %v", err)
+	}
+
+	state, err := OpenGoFileState(dst, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open migrated state: %v", err)
+	}
+	defer state.Close()
+	checkMigrationFixture(t, state)
+
+	// The result must be identical to a state built directly with S5.
+	reference := t.TempDir()
+	createMigrationFixture(t, reference, S5LiveConfig)
+	referenceState, err := OpenGoFileState(reference, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open reference state: %v", err)
+	}
+	defer referenceState.Close()
+	want, err := referenceState.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash of reference state: %v", err)
+	}
+	got, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash of migrated state: %v", err)
+	}
+	if want != got {
+		t.Errorf("unexpected hash of migrated state, wanted %x, got %x", want, got)
+	}
+}
+
+func TestMigrateDirectory_NarrowToWideNodeReferencesPreservesAllValues(t *testing.T) {
+	useSmallMigrationCache(t)
+	src := t.TempDir()
+	createMigrationFixture(t, src, S5LiveConfig)
+	source, err := OpenGoFileState(src, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open source state: %v", err)
+	}
+	want, err := source.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash of source state: %v", err)
+	}
+	if err := source.Close(); err != nil {
+		t.Fatalf("failed to close source state: %v", err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "target")
+	if err := MigrateDirectory(src, dst, S5LiveConfig, S5LiveWideReferencesConfig); err != nil {
+		t.Fatalf("failed to migrate directory: %v", err)
+	}
+
+	state, err := OpenGoFileState(dst, S5LiveWideReferencesConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open migrated state: %v", err)
+	}
+	defer state.Close()
+	checkMigrationFixture(t, state)
+	got, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash of migrated state: %v", err)
+	}
+	if want != got {
+		t.Errorf("width of node references should not affect hash, wanted %x, got %x", want, got)
+	}
+}
+
+func TestMigrateDirectory_InterruptedMigrationCanBeResumed(t *testing.T) {
+	useSmallMigrationCache(t)
+	src := t.TempDir()
+	createMigrationFixture(t, src, S4LiveConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dst := t.TempDir()
+	chunks := 0
+	_, err := MigrateDirectoryWithContext(ctx, src, dst, S4LiveConfig, S5LiveConfig, func(progress MigrationProgress) {
+		chunks = progress.Chunk
+		if progress.Chunk == 5 {
+			cancel()
+		}
+	})
+	if !errors.Is(err, interrupt.ErrCanceled) {
+		t.Fatalf("migration should have been interrupted, got %v", err)
+	}
+	if chunks != 5 {
+		t.Fatalf("unexpected number of completed chunks, wanted 5, got %d", chunks)
+	}
+
+	var last MigrationProgress
+	hash, err := MigrateDirectoryWithContext(context.Background(), src, dst, S4LiveConfig, S5LiveConfig, func(progress MigrationProgress) {
+		if last.Chunk == 0 && progress.Chunk != 6 {
+			t.Errorf("resumed migration should continue with chunk 6, got %d", progress.Chunk)
+		}
+		last = progress
+	})
+	if err != nil {
+		t.Fatalf("failed to resume migration: %v", err)
+	}
+	if last.Chunk != last.NumChunks || last.Accounts != migrationFixtureAccounts || last.Hash != hash {
+		t.Errorf("unexpected final progress: %+v", last)
+	}
+
+	state, err := OpenGoFileState(dst, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open migrated state: %v", err)
+	}
+	defer state.Close()
+	checkMigrationFixture(t, state)
+	if got, err := state.GetHash(); err != nil || got != hash {
+		t.Errorf("unexpected hash of migrated state, wanted %x, got %x, err %v", hash, got, err)
+	}
+}
+
+func TestMigrateDirectory_ResumingModifiedTargetFails(t *testing.T) {
+	useSmallMigrationCache(t)
+	src := t.TempDir()
+	createMigrationFixture(t, src, S4LiveConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dst := t.TempDir()
+	_, err := MigrateDirectoryWithContext(ctx, src, dst, S4LiveConfig, S5LiveConfig, func(MigrationProgress) {
+		cancel()
+	})
+	if !errors.Is(err, interrupt.ErrCanceled) {
+		t.Fatalf("migration should have been interrupted, got %v", err)
+	}
+
+	state, err := OpenGoFileState(dst, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open target state: %v", err)
+	}
+	if err := state.SetNonce(common.Address{0xFF}, common.ToNonce(1)); err != nil {
+		t.Fatalf("failed to modify target state: %v", err)
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close target state: %v", err)
+	}
+
+	if err := MigrateDirectory(src, dst, S4LiveConfig, S5LiveConfig); err == nil {
+		t.Errorf("resuming migration into modified target should fail")
+	}
+}
+
+func TestMigrateDirectory_InvalidDirectoriesAreRejected(t *testing.T) {
+	useSmallMigrationCache(t)
+	src := t.TempDir()
+	createMigrationFixture(t, src, S4LiveConfig)
+
+	nonEmpty := t.TempDir()
+	if err := os.WriteFile(filepath.Join(nonEmpty, "file"), []byte{1}, 0600); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	tests := map[string]struct {
+		src, dst string
+	}{
+		"same directory":       {src: src, dst: src},
+		"non-empty target":     {src: src, dst: nonEmpty},
+		"source without state": {src: t.TempDir(), dst: t.TempDir()},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := MigrateDirectory(test.src, test.dst, S4LiveConfig, S5LiveConfig); err == nil {
+				t.Errorf("migration should fail")
+			}
+		})
+	}
+}
+
+// useSmallMigrationCache reduces the cache of the target of migrations for
+// the duration of the given test, since the default capacity would allocate
+// gigabytes of memory for the small fixtures of the tests.
+func useSmallMigrationCache(t *testing.T) {
+	t.Helper()
+	capacity := migrationCacheCapacity
+	migrationCacheCapacity = 1024
+	t.Cleanup(func() {
+		migrationCacheCapacity = capacity
+	})
+}
+
+const migrationFixtureAccounts = 50
+
+// createMigrationFixture creates a LiveDB with accounts, slots, and codes in
+// the given directory.
+func createMigrationFixture(t *testing.T, directory string, config MptConfig) {
+	t.Helper()
+	state, err := OpenGoFileState(directory, config, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	for i := 0; i < migrationFixtureAccounts; i++ {
+		addr := common.Address{byte(i * 5), byte(i)}
+		if err := state.SetNonce(addr, common.ToNonce(uint64(i+1))); err != nil {
+			t.Fatalf("failed to set nonce: %v", err)
+		}
+		if err := state.SetBalance(addr, common.Balance{byte(i), 1}); err != nil {
+			t.Fatalf("failed to set balance: %v", err)
+		}
+		if i%3 == 0 {
+			if err := state.SetCode(addr, []byte{byte(i), 1, 2}); err != nil {
+				t.Fatalf("failed to set code: %v", err)
+			}
+		}
+		for j := 0; j < i%7; j++ {
+			if err := state.SetStorage(addr, common.Key{byte(j), byte(i)}, common.Value{byte(i + j + 1)}); err != nil {
+				t.Fatalf("failed to set storage: %v", err)
+			}
+		}
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+}
+
+// checkMigrationFixture checks that the given state contains the content
+// created by createMigrationFixture.
+func checkMigrationFixture(t *testing.T, state *MptState) {
+	t.Helper()
+	for i := 0; i < migrationFixtureAccounts; i++ {
+		addr := common.Address{byte(i * 5), byte(i)}
+		if nonce, err := state.GetNonce(addr); err != nil || nonce != common.ToNonce(uint64(i+1)) {
+			t.Errorf("unexpected nonce of account %x: %v, err %v", addr, nonce, err)
+		}
+		if balance, err := state.GetBalance(addr); err != nil || balance != (common.Balance{byte(i), 1}) {
+			t.Errorf("unexpected balance of account %x: %v, err %v", addr, balance, err)
+		}
+		wantCode := []byte{}
+		if i%3 == 0 {
+			wantCode = []byte{byte(i), 1, 2}
+		}
+		if code, err := state.GetCode(addr); err != nil || !bytes.Equal(code, wantCode) {
+			t.Errorf("unexpected code of account %x: %x, err %v", addr, code, err)
+		}
+		for j := 0; j < 7; j++ {
+			want := common.Value{}
+			if j < i%7 {
+				want = common.Value{byte(i + j + 1)}
+			}
+			if got, err := state.GetStorage(addr, common.Key{byte(j), byte(i)}); err != nil || got != want {
+				t.Errorf("unexpected value of slot %d of account %x: %x, err %v", j, addr, got, err)
+			}
+		}
+	}
+}
+
+func readDirectoryContent(t *testing.T, directory string) map[string][]byte {
+	t.Helper()
+	res := map[string][]byte{}
+	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		res[path] = data
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to read directory content: %v", err)
+	}
+	return res
+}
+
+func equalDirectoryContent(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, data := range a {
+		if other, found := b[path]; !found || !bytes.Equal(data, other) {
+			return false
+		}
+	}
+	return true
+}
@@ -10,7 +10,11 @@
 
 package mpt
 
-import "github.com/Fantom-foundation/Carmen/go/common"
+import (
+	"sync"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
 
 // Nibble is a 4-bit signed integer in the range 0-F. It is a single letter
 // used to navigate in the MPT structure.
@@ -35,35 +39,66 @@ func (n Nibble) String() string {
 // AddressToNibblePath converts the given path into a slice of Nibbles. Optionally, the
 // path is hashed before being converted. The path is hashed when hashing is enabled in configuration.
 func AddressToNibblePath(address common.Address, source NodeSource) []Nibble {
-	var path []byte
-	if source != nil && source.getConfig().UseHashedPaths {
-		hash := source.hashAddress(address)
-		path = hash[:]
-	} else {
-		path = address[:]
-	}
-
-	res := make([]Nibble, len(path)*2)
-	parseNibbles(res, path)
-	return res
+	return new(nibblePathBuffer).setAddress(address, source)
 }
 
 // KeyToNibblePath converts the given path into a slice of Nibbles. Optionally, the
 // path is hashed before being converted. The path is hashed when hashing is enabled in configuration.
 func KeyToNibblePath(key common.Key, source NodeSource) []Nibble {
-	var path []byte
+	return new(nibblePathBuffer).setKey(key, source)
+}
+
+// maxNibblePathLength is the length of the longest paths converted from
+// addresses and keys, which are hashed paths of 32 bytes.
+const maxNibblePathLength = 2 * len(common.Hash{})
+
+// nibblePathBuffer is a fixed-size buffer for the Nibbles of a path converted
+// from an address or a key. Reusing buffers avoids allocating a new slice for
+// each conversion in hot paths like lookups and updates.
+type nibblePathBuffer [maxNibblePathLength]Nibble
+
+// setAddress writes the path of the given address into this buffer, like
+// AddressToNibblePath, and returns the slice of the buffer covering it. The
+// slice is only valid until the buffer is reused or released.
+func (b *nibblePathBuffer) setAddress(address common.Address, source NodeSource) []Nibble {
+	if source != nil && source.getConfig().UseHashedPaths {
+		hash := source.hashAddress(address)
+		return b.set(hash[:])
+	}
+	return b.set(address[:])
+}
+
+// setKey is the counterpart of setAddress for keys, like KeyToNibblePath.
+func (b *nibblePathBuffer) setKey(key common.Key, source NodeSource) []Nibble {
 	if source != nil && source.getConfig().UseHashedPaths {
 		hash := source.hashKey(key)
-		path = hash[:]
-	} else {
-		path = key[:]
+		return b.set(hash[:])
 	}
+	return b.set(key[:])
+}
 
-	res := make([]Nibble, len(path)*2)
+func (b *nibblePathBuffer) set(path []byte) []Nibble {
+	res := b[: len(path)*2 : len(path)*2]
 	parseNibbles(res, path)
 	return res
 }
 
+// Paths passed to nodes escape to the heap since nodes are accessed through
+// interfaces, which is why buffers for those paths are pooled.
+var nibblePathBufferPool = sync.Pool{New: func() any {
+	return new(nibblePathBuffer)
+}}
+
+// getNibblePathBuffer obtains a buffer from the pool, which has to be
+// returned using release once the paths written into it are no longer used.
+func getNibblePathBuffer() *nibblePathBuffer {
+	return nibblePathBufferPool.Get().(*nibblePathBuffer)
+}
+
+func (b *nibblePathBuffer) release() {
+	nibblePathBufferPool.Put(b)
+}
+
 // addressToHashedNibbles converts the given path into a slice of Nibbles.
 // It always hashes the path before converting it.
 func addressToHashedNibbles(address common.Address) []Nibble {
@@ -169,3 +169,89 @@ func hashAndConvertToNibbles(src []byte) []Nibble {
 	}
 	return res
 }
+
+func TestNibbles_PathBufferConversionMatchesExpectedPaths(t *testing.T) {
+	address := common.Address{0x12, 0x34, 0xAB}
+	key := common.Key{0xCD, 0xEF, 0x01}
+	plainAddress := make([]Nibble, 2*len(address))
+	parseNibbles(plainAddress, address[:])
+	plainKey := make([]Nibble, 2*len(key))
+	parseNibbles(plainKey, key[:])
+
+	tests := map[string]struct {
+		config       MptConfig
+		address, key []Nibble
+		useNilSource bool
+	}{
+		"nil source":  {config: S4LiveConfig, address: plainAddress, key: plainKey, useNilSource: true},
+		"plain paths": {config: S4LiveConfig, address: plainAddress, key: plainKey},
+		"hashed paths": {
+			config:  S5LiveConfig,
+			address: hashAndConvertToNibbles(address[:]),
+			key:     hashAndConvertToNibbles(key[:]),
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			forest, err := OpenVolatileForest(test.config, ForestConfig{Mode: Mutable, CacheCapacity: 1024})
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+			defer forest.Close()
+			var source NodeSource = forest
+			if test.useNilSource {
+				source = nil
+			}
+
+			if got, want := AddressToNibblePath(address, source), test.address; !slices.Equal(got, want) {
+				t.Errorf("invalid address path, got %v, wanted %v", got, want)
+			}
+			if got, want := KeyToNibblePath(key, source), test.key; !slices.Equal(got, want) {
+				t.Errorf("invalid key path, got %v, wanted %v", got, want)
+			}
+
+			// Buffers can be reused for paths of different lengths.
+			buffer := getNibblePathBuffer()
+			defer buffer.release()
+			for i := 0; i < 2; i++ {
+				path := buffer.setKey(key, source)
+				if !slices.Equal(path, test.key) || cap(path) != len(path) {
+					t.Errorf("invalid key path, got %v, wanted %v", path, test.key)
+				}
+				path = buffer.setAddress(address, source)
+				if !slices.Equal(path, test.address) || cap(path) != len(path) {
+					t.Errorf("invalid address path, got %v, wanted %v", path, test.address)
+				}
+			}
+		})
+	}
+}
+
+func TestNibbles_PathBufferCanBeSlicedAtAllDepths(t *testing.T) {
+	address := common.Address{0x12, 0x34, 0x56, 0x78, 0x9A, 0xBC, 0xDE, 0xF0}
+	want := AddressToNibblePath(address, nil)
+
+	var buffer nibblePathBuffer
+	path := buffer.setAddress(address, nil)
+	for depth := 0; depth <= len(path); depth++ {
+		remaining := path[depth:]
+		if !slices.Equal(remaining, want[depth:]) {
+			t.Fatalf("invalid path at depth %d, got %v, wanted %v", depth, remaining, want[depth:])
+		}
+		for length := 0; depth+length <= len(path) && length <= 16; length++ {
+			extension := CreatePathFromNibbles(want[depth : depth+length])
+			if !extension.IsPrefixOf(remaining) {
+				t.Errorf("extension %v should be a prefix of %v", &extension, remaining)
+			}
+			if got := extension.GetCommonPrefixLength(remaining); got != length {
+				t.Errorf("invalid common prefix length of %v and %v, got %d, wanted %d", &extension, remaining, got, length)
+			}
+		}
+		if depth < len(path) {
+			mismatch := SingleStepPath((remaining[0] + 1) % 16)
+			if mismatch.IsPrefixOf(remaining) {
+				t.Errorf("extension %v should not be a prefix of %v", &mismatch, remaining)
+			}
+		}
+	}
+}
@@ -79,9 +79,29 @@ type NodeCache interface {
 	// as the least recently used and thus next to be evicted when the cache becomes full.
 	Release(r *NodeReference)
 
+	// ReleaseAll is equivalent to calling Release for each of the given
+	// references, yet implementations may process the entire list under a
+	// single lock acquisition.
+	ReleaseAll(refs []NodeReference)
+
+	// Pin excludes the referenced node from being evicted until it is
+	// un-pinned or released. Pinned nodes still occupy the capacity of the
+	// cache. To retain room for other nodes, at most half of the capacity
+	// may be pinned. The result is false if the node is not present in the
+	// cache or if this limit is reached.
+	Pin(r *NodeReference) bool
+
+	// Unpin makes the referenced node subject to eviction again. Nodes not
+	// present in the cache or not pinned are ignored.
+	Unpin(r *NodeReference)
+
 	// ForEach iterates through all elements in this cache.
 	ForEach(func(NodeId, *shared.Shared[Node]))
 
+	// GetMostRecentlyUsed returns the IDs of up to limit nodes retained in
+	// this cache, starting with the most recently used node.
+	GetMostRecentlyUsed(limit int) []NodeId
+
 	// MemoryFootprintProvider is embedded to require implementations to
 	// produces a summary of the overall memory usage of this cache, including
 	// the size of all owned node instances.
@@ -89,7 +109,7 @@ type NodeCache interface {
 }
 
 // nodeCache implements the NodeCache interface using a fixed capacity cache
-// of nodes and an LRU policy for evicting nodes.
+// of nodes and an exchangeable policy for evicting nodes, LRU by default.
 //
 // Internally, this implementation maintains a list of node-owners, each
 // equipped with a tag to indicate mutations. Node references retain the
@@ -100,8 +120,8 @@ type nodeCache struct {
 	owners     []nodeOwner              // fixed length list of all owned nodes
 	index      map[NodeId]ownerPosition // an index on the owned nodes
 	tagCounter uint64                   // a counter to generate fresh tags
-	head       ownerPosition            // head of the LRU list of owners
-	tail       ownerPosition            // tail of the LRU list of owners
+	policy     EvictionPolicy           // decides the order in which owners are recycled
+	pinned     int                      // the number of pinned owners
 	mutex      sync.Mutex               // for everything except the owner list
 }
 
@@ -109,13 +129,27 @@ func NewNodeCache(capacity int) NodeCache {
 	return newNodeCache(capacity)
 }
 
+// NewNodeCacheWithEvictionPolicy creates a node cache using the eviction
+// policy produced by the given factory. If nil, LRU is used.
+func NewNodeCacheWithEvictionPolicy(capacity int, policy EvictionPolicyFactory) NodeCache {
+	return newNodeCacheWithEvictionPolicy(capacity, policy)
+}
+
 func newNodeCache(capacity int) *nodeCache {
+	return newNodeCacheWithEvictionPolicy(capacity, nil)
+}
+
+func newNodeCacheWithEvictionPolicy(capacity int, policy EvictionPolicyFactory) *nodeCache {
 	if capacity < 1 {
 		capacity = 1
 	}
+	if policy == nil {
+		policy = NewLruEvictionPolicy
+	}
 	return &nodeCache{
 		owners: make([]nodeOwner, capacity),
 		index:  make(map[NodeId]ownerPosition, capacity),
+		policy: policy(capacity),
 	}
 }
 
@@ -149,7 +183,8 @@ func (c *nodeCache) Get(r *NodeReference) (*shared.Shared[Node], bool) {
 		owner := &c.owners[pos]
 		res := owner.Node()
 		// Check that the tag is still correct and the fetched result is valid.
-		if owner.tag.Load() == tag {
+		// Tag 0 marks unused owners and is never assigned to any node.
+		if tag != 0 && owner.tag.Load() == tag {
 			return res, true
 		}
 		// If the tag has changed the position is out-dated and the true owner
@@ -183,11 +218,10 @@ func (c *nodeCache) GetOrSet(
 	var target *nodeOwner
 	if len(c.index) >= len(c.owners) {
 		// an element needs to be evicted
-		pos = c.tail
+		pos = c.pickVictim()
 
 		target = &c.owners[pos]
 		delete(c.index, target.Id())
-		c.tail = target.prev
 
 		// remember the evicted node
 		evictedId = target.Id()
@@ -206,10 +240,7 @@ func (c *nodeCache) GetOrSet(
 	target.id.Store(uint64(ref.Id()))
 	target.node.Store(node)
 
-	// Move new owner to head of the LRU list.
-	target.next = c.head
-	c.owners[c.head].prev = pos
-	c.head = pos
+	c.policy.OnInsert(uint32(pos))
 
 	c.index[ref.Id()] = pos
 	c.mutex.Unlock()
@@ -218,10 +249,51 @@ func (c *nodeCache) GetOrSet(
 	return node, false, evictedId, evictedNode, evicted
 }
 
+// maxDirtyVictimRejections is the number of dirty nodes proposed by the
+// eviction policy which are rejected while looking for another victim. Nodes
+// are considered dirty here if they were modified since their hash was last
+// computed, since those can not be written to disk yet. If no other node is
+// found, a dirty node is evicted. Pinned nodes are never evicted.
+const maxDirtyVictimRejections = 8
+
+// pickVictim obtains the position of the owner to be evicted next from the
+// eviction policy. The cache mutex must be held.
+func (c *nodeCache) pickVictim() ownerPosition {
+	rejections := 0
+	for {
+		pos := c.policy.PickVictim()
+		owner := &c.owners[pos]
+		if owner.pinned {
+			c.policy.OnAccess(pos)
+			continue
+		}
+		if rejections < maxDirtyVictimRejections && isDirtyNode(owner.Node()) {
+			rejections++
+			c.policy.OnAccess(pos)
+			continue
+		}
+		return ownerPosition(pos)
+	}
+}
+
+// isDirtyNode checks whether the given node has been modified since its hash
+// was last computed. Nodes locked for modification are considered dirty.
+func isDirtyNode(node *shared.Shared[Node]) bool {
+	if node == nil {
+		return false
+	}
+	handle, ok := node.TryGetViewHandle()
+	if !ok {
+		return true
+	}
+	defer handle.Release()
+	_, dirtyHash := handle.Get().GetHash()
+	return dirtyHash && handle.Get().IsDirty()
+}
+
 func (c *nodeCache) Touch(r *NodeReference) {
-	// During a touch we need to update the double-linked list
-	// formed by owners such that the referenced node is at the
-	// head position.
+	// During a touch the eviction policy is informed about the use of the
+	// owner of the referenced node.
 	pos := ownerPosition(atomic.LoadUint32(&r.pos))
 	if uint32(pos) >= uint32(len(c.owners)) {
 		// In this reference does not point to a valid owner; the
@@ -229,29 +301,14 @@ func (c *nodeCache) Touch(r *NodeReference) {
 		// thus the operation can stop here.
 		return
 	}
-	target := &c.owners[pos]
 	c.mutex.Lock()
-	if c.head == pos {
-		c.mutex.Unlock()
-		return
-	}
-	if c.tail == pos {
-		c.tail = target.prev
-	} else {
-		c.owners[target.next].prev = target.prev
-	}
-	c.owners[target.prev].next = target.next
-
-	c.owners[c.head].prev = pos
-	target.next = c.head
-	c.head = pos
+	c.policy.OnAccess(uint32(pos))
 	c.mutex.Unlock()
 }
 
 func (c *nodeCache) Release(r *NodeReference) {
-	// During a release we need to update the double-linked list
-	// formed by owners such that the referenced node is at the
-	// tail position.
+	// During a release the eviction policy is informed that the referenced
+	// node is to be evicted next.
 	pos := ownerPosition(atomic.LoadUint32(&r.pos))
 	if uint32(pos) >= uint32(len(c.owners)) {
 		// This reference does not point to a valid owner; the
@@ -259,23 +316,64 @@ func (c *nodeCache) Release(r *NodeReference) {
 		// thus the operation can stop here.
 		return
 	}
+	c.mutex.Lock()
+	c.release(pos)
+	c.mutex.Unlock()
+}
+
+func (c *nodeCache) ReleaseAll(refs []NodeReference) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i := range refs {
+		pos := ownerPosition(atomic.LoadUint32(&refs[i].pos))
+		if uint32(pos) < uint32(len(c.owners)) {
+			c.release(pos)
+		}
+	}
+}
+
+// release marks the owner at the given position to be evicted next. Since
+// released nodes are not expected to be reused, pinned owners are un-pinned.
+// The cache mutex must be held.
+func (c *nodeCache) release(pos ownerPosition) {
 	target := &c.owners[pos]
+	if target.pinned {
+		target.pinned = false
+		c.pinned--
+	}
+	c.policy.OnRelease(uint32(pos))
+}
+
+func (c *nodeCache) Pin(r *NodeReference) bool {
 	c.mutex.Lock()
-	if c.tail == pos {
-		c.mutex.Unlock()
-		return
+	defer c.mutex.Unlock()
+	pos, found := c.index[r.Id()]
+	if !found {
+		return false
 	}
-	if c.head == pos {
-		c.head = target.next
-	} else {
-		c.owners[target.prev].next = target.next
+	target := &c.owners[pos]
+	if target.pinned {
+		return true
 	}
-	c.owners[target.next].prev = target.prev
+	if c.pinned >= len(c.owners)/2 {
+		return false
+	}
+	target.pinned = true
+	c.pinned++
+	return true
+}
 
-	c.owners[c.tail].next = pos
-	target.prev = c.tail
-	c.tail = pos
-	c.mutex.Unlock()
+func (c *nodeCache) Unpin(r *NodeReference) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	pos, found := c.index[r.Id()]
+	if !found {
+		return
+	}
+	if target := &c.owners[pos]; target.pinned {
+		target.pinned = false
+		c.pinned--
+	}
 }
 
 func (c *nodeCache) ForEach(consume func(NodeId, *shared.Shared[Node])) {
@@ -335,28 +433,212 @@ func (c *nodeCache) GetMemoryFootprint() *common.MemoryFootprint {
 	return mf
 }
 
-func (c *nodeCache) getIdsInReverseEvictionOrder() []NodeId {
+func (c *nodeCache) GetMostRecentlyUsed(limit int) []NodeId {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	res := make([]NodeId, 0, len(c.owners))
-	for cur := c.head; cur != c.tail; cur = c.owners[cur].next {
-		res = append(res, c.owners[cur].Id())
+	if limit > len(c.index) {
+		limit = len(c.index)
+	}
+	if limit <= 0 {
+		return nil
 	}
-	if c.owners[c.tail].tag.Load() > 0 {
-		res = append(res, c.owners[c.tail].Id())
+	res := make([]NodeId, 0, limit)
+	for _, pos := range c.policy.GetMostRecentlyUsed(limit) {
+		res = append(res, c.owners[pos].Id())
 	}
 	return res
 }
 
-// nodeOwner is a single entry of the node cache. It servers two roles:
-// - provide synchronized access to an owned node
-// - be an element of a LRU list to manage eviction order
+func (c *nodeCache) getIdsInReverseEvictionOrder() []NodeId {
+	return c.GetMostRecentlyUsed(len(c.owners))
+}
+
+// NodeCacheShares defines the relative shares of a node cache's capacity
+// reserved for individual node types. Empty nodes are accounted for as
+// values. If all shares are zero, node types are not distinguished.
+type NodeCacheShares struct {
+	Accounts   int
+	Branches   int
+	Extensions int
+	Values     int
+}
+
+// IsEnabled returns true if the shares define a type-aware cache partition.
+func (s NodeCacheShares) IsEnabled() bool {
+	return s.Accounts > 0 || s.Branches > 0 || s.Extensions > 0 || s.Values > 0
+}
+
+// getCapacities splits the given total capacity according to the shares.
+// Each node type is assigned a capacity of at least 1.
+func (s NodeCacheShares) getCapacities(capacity int) [numNodeCachePartitions]int {
+	shares := [numNodeCachePartitions]int{s.Accounts, s.Branches, s.Extensions, s.Values}
+	total := 0
+	for _, share := range shares {
+		if share > 0 {
+			total += share
+		}
+	}
+	res := [numNodeCachePartitions]int{}
+	for i, share := range shares {
+		res[i] = 1
+		if share > 0 {
+			if part := int(int64(capacity) * int64(share) / int64(total)); part > 1 {
+				res[i] = part
+			}
+		}
+	}
+	return res
+}
+
+const (
+	accountPartition = iota
+	branchPartition
+	extensionPartition
+	valuePartition
+	numNodeCachePartitions
+)
+
+// NewTypeAwareNodeCache creates a node cache splitting the given capacity
+// among node types according to the given shares. Each node type is
+// retained in its own LRU cache such that, for instance, a large number of
+// accessed value nodes cannot evict frequently used account nodes.
+func NewTypeAwareNodeCache(capacity int, shares NodeCacheShares) NodeCache {
+	return newTypeAwareNodeCache(capacity, shares, nil)
+}
+
+// NewTypeAwareNodeCacheWithEvictionPolicy is a variant of NewTypeAwareNodeCache
+// using the eviction policy produced by the given factory in each partition.
+// If nil, LRU is used.
+func NewTypeAwareNodeCacheWithEvictionPolicy(capacity int, shares NodeCacheShares, policy EvictionPolicyFactory) NodeCache {
+	return newTypeAwareNodeCache(capacity, shares, policy)
+}
+
+func newTypeAwareNodeCache(capacity int, shares NodeCacheShares, policy EvictionPolicyFactory) *typeAwareNodeCache {
+	res := &typeAwareNodeCache{}
+	for i, capacity := range shares.getCapacities(capacity) {
+		res.partitions[i] = newNodeCacheWithEvictionPolicy(capacity, policy)
+	}
+	return res
+}
+
+// typeAwareNodeCache implements the NodeCache interface by a fixed set of
+// nodeCache instances, one for each node type. Since the type of a node is
+// encoded in its ID, the partition owning a node referenced by a
+// NodeReference never changes. Thus, the position information cached in
+// references is always interpreted by the same partition.
+type typeAwareNodeCache struct {
+	partitions [numNodeCachePartitions]*nodeCache
+}
+
+func (c *typeAwareNodeCache) getPartition(id NodeId) *nodeCache {
+	return c.partitions[getNodeCachePartition(id)]
+}
+
+func getNodeCachePartition(id NodeId) int {
+	switch {
+	case id.IsAccount():
+		return accountPartition
+	case id.IsBranch():
+		return branchPartition
+	case id.IsExtension():
+		return extensionPartition
+	default:
+		return valuePartition
+	}
+}
+
+func (c *typeAwareNodeCache) Get(r *NodeReference) (*shared.Shared[Node], bool) {
+	return c.getPartition(r.Id()).Get(r)
+}
+
+func (c *typeAwareNodeCache) GetOrSet(
+	ref *NodeReference,
+	node *shared.Shared[Node],
+) (
+	current *shared.Shared[Node],
+	present bool,
+	evictedId NodeId,
+	evictedNode *shared.Shared[Node],
+	evicted bool,
+) {
+	return c.getPartition(ref.Id()).GetOrSet(ref, node)
+}
+
+func (c *typeAwareNodeCache) Touch(r *NodeReference) {
+	c.getPartition(r.Id()).Touch(r)
+}
+
+func (c *typeAwareNodeCache) Release(r *NodeReference) {
+	c.getPartition(r.Id()).Release(r)
+}
+
+func (c *typeAwareNodeCache) ReleaseAll(refs []NodeReference) {
+	var groups [numNodeCachePartitions][]NodeReference
+	for _, ref := range refs {
+		partition := getNodeCachePartition(ref.Id())
+		groups[partition] = append(groups[partition], ref)
+	}
+	for i, group := range groups {
+		if len(group) > 0 {
+			c.partitions[i].ReleaseAll(group)
+		}
+	}
+}
+
+func (c *typeAwareNodeCache) Pin(r *NodeReference) bool {
+	return c.getPartition(r.Id()).Pin(r)
+}
+
+func (c *typeAwareNodeCache) Unpin(r *NodeReference) {
+	c.getPartition(r.Id()).Unpin(r)
+}
+
+func (c *typeAwareNodeCache) ForEach(consume func(NodeId, *shared.Shared[Node])) {
+	for _, partition := range c.partitions {
+		partition.ForEach(consume)
+	}
+}
+
+// GetMostRecentlyUsed interleaves the most recently used nodes of all
+// partitions since the usage of nodes in different partitions is not ordered.
+func (c *typeAwareNodeCache) GetMostRecentlyUsed(limit int) []NodeId {
+	var lists [numNodeCachePartitions][]NodeId
+	for i, partition := range c.partitions {
+		lists[i] = partition.GetMostRecentlyUsed(limit)
+	}
+	res := make([]NodeId, 0, limit)
+	for i := 0; len(res) < limit; i++ {
+		added := false
+		for _, list := range lists {
+			if i < len(list) && len(res) < limit {
+				res = append(res, list[i])
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	return res
+}
+
+func (c *typeAwareNodeCache) GetMemoryFootprint() *common.MemoryFootprint {
+	mf := common.NewMemoryFootprint(unsafe.Sizeof(*c))
+	mf.AddChild("accounts", c.partitions[accountPartition].GetMemoryFootprint())
+	mf.AddChild("branches", c.partitions[branchPartition].GetMemoryFootprint())
+	mf.AddChild("extensions", c.partitions[extensionPartition].GetMemoryFootprint())
+	mf.AddChild("values", c.partitions[valuePartition].GetMemoryFootprint())
+	return mf
+}
+
+// nodeOwner is a single entry of the node cache, providing synchronized
+// access to an owned node. The eviction order is managed by the cache's
+// eviction policy.
 type nodeOwner struct {
-	tag  atomic.Uint64                       // a tag vor versioning the owned node
-	id   atomic.Uint64                       // the ID of the owned node (protected by seq lock, but atomic for race detection check)
-	node atomic.Pointer[shared.Shared[Node]] // the owned node (protected by seq lock, but atomic for race detection check)
-	prev ownerPosition                       // predecessor in the LRU list
-	next ownerPosition                       // successor in the LRU list
+	tag    atomic.Uint64                       // a tag vor versioning the owned node
+	id     atomic.Uint64                       // the ID of the owned node (protected by seq lock, but atomic for race detection check)
+	node   atomic.Pointer[shared.Shared[Node]] // the owned node (protected by seq lock, but atomic for race detection check)
+	pinned bool                                // whether the owner is excluded from eviction (protected by the cache mutex)
 }
 
 func (o *nodeOwner) Id() NodeId {
@@ -0,0 +1,213 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+)
+
+// A node cache manifest lists the IDs of the nodes retained in the node cache
+// of a forest when it got closed. When re-opening the forest, those nodes are
+// loaded into the cache in the background to avoid a cold start dominated by
+// random reads of upper-level nodes. Manifests are a pure optimization, if
+// they are missing or corrupted, the warm-up is skipped.
+//
+// The format of a manifest file is:
+//
+//	[<magic>, <version>, <count>, <node id>*, <checksum>]
+//
+// where magic is a 4-byte marker, version and count are 4-byte integers,
+// each node ID is encoded using 8 bytes, and the checksum is a CRC32 checksum
+// of the node IDs. IDs are ordered starting with the most recently used node.
+const (
+	nodeCacheManifestFile    = "node-cache.dat"
+	nodeCacheManifestMagic   = "CNCM"
+	nodeCacheManifestVersion = 1
+)
+
+// writeNodeCacheManifest writes a manifest listing the given IDs to the given file.
+func writeNodeCacheManifest(filename string, ids []NodeId) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	return errors.Join(
+		writeNodeCacheManifestTo(ids, writer),
+		writer.Flush(),
+		file.Close())
+}
+
+func writeNodeCacheManifestTo(ids []NodeId, writer io.Writer) error {
+	var header [12]byte
+	copy(header[0:4], nodeCacheManifestMagic)
+	binary.BigEndian.PutUint32(header[4:8], nodeCacheManifestVersion)
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(ids)))
+	if _, err := writer.Write(header[:]); err != nil {
+		return err
+	}
+	checksum := crc32.NewIEEE()
+	var buffer [8]byte
+	for _, id := range ids {
+		binary.BigEndian.PutUint64(buffer[:], uint64(id))
+		checksum.Write(buffer[:])
+		if _, err := writer.Write(buffer[:]); err != nil {
+			return err
+		}
+	}
+	binary.BigEndian.PutUint32(buffer[0:4], checksum.Sum32())
+	_, err := writer.Write(buffer[0:4])
+	return err
+}
+
+// readNodeCacheManifest parses the manifest stored in the given file and
+// returns up to limit of the listed IDs. If the file does not exist, an
+// empty list is returned. An error is reported for corrupted manifests.
+func readNodeCacheManifest(filename string, limit int) ([]NodeId, error) {
+	file, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readNodeCacheManifestFrom(bufio.NewReader(file), limit)
+}
+
+func readNodeCacheManifestFrom(reader io.Reader, limit int) ([]NodeId, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read manifest header: %w", err)
+	}
+	if got := string(header[0:4]); got != nodeCacheManifestMagic {
+		return nil, fmt.Errorf("invalid manifest marker %q", got)
+	}
+	if got := binary.BigEndian.Uint32(header[4:8]); got != nodeCacheManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", got)
+	}
+	count := int(binary.BigEndian.Uint32(header[8:12]))
+
+	// All IDs need to be read to verify the checksum.
+	if limit > count {
+		limit = count
+	}
+	checksum := crc32.NewIEEE()
+	ids := make([]NodeId, 0, limit)
+	var buffer [8]byte
+	for i := 0; i < count; i++ {
+		if _, err := io.ReadFull(reader, buffer[:]); err != nil {
+			return nil, fmt.Errorf("failed to read node ID: %w", err)
+		}
+		checksum.Write(buffer[:])
+		if len(ids) < limit {
+			ids = append(ids, NodeId(binary.BigEndian.Uint64(buffer[:])))
+		}
+	}
+	if _, err := io.ReadFull(reader, buffer[0:4]); err != nil {
+		return nil, fmt.Errorf("failed to read checksum: %w", err)
+	}
+	if want, got := checksum.Sum32(), binary.BigEndian.Uint32(buffer[0:4]); want != got {
+		return nil, fmt.Errorf("invalid manifest checksum, wanted %x, got %x", want, got)
+	}
+	if _, err := reader.Read(buffer[:]); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data at the end of the manifest")
+	}
+	return ids, nil
+}
+
+// cacheWarmer loads the nodes listed by a node cache manifest into the node
+// cache of a forest in the background.
+type cacheWarmer struct {
+	stop chan struct{} // closed to abort the warm-up
+	done chan struct{} // closed when the warm-up is complete or aborted
+}
+
+// startCacheWarmer starts loading the nodes of the given list, ordered
+// starting with the most recently used node, into the cache of the given
+// forest. IDs of nodes which are no longer present in the forest are skipped.
+func startCacheWarmer(forest *Forest, ids []NodeId) *cacheWarmer {
+	res := &cacheWarmer{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(res.done)
+		res.warmUp(forest, ids)
+	}()
+	return res
+}
+
+func (w *cacheWarmer) warmUp(forest *Forest, ids []NodeId) {
+	accounts, err := forest.accounts.GetIds()
+	if err != nil {
+		return
+	}
+	branches, err := forest.branches.GetIds()
+	if err != nil {
+		return
+	}
+	extensions, err := forest.extensions.GetIds()
+	if err != nil {
+		return
+	}
+	values, err := forest.values.GetIds()
+	if err != nil {
+		return
+	}
+	contains := func(id NodeId) bool {
+		var ids stock.IndexSet[uint64]
+		switch {
+		case id.IsAccount():
+			ids = accounts
+		case id.IsBranch():
+			ids = branches
+		case id.IsExtension():
+			ids = extensions
+		case id.IsValue():
+			ids = values
+		default:
+			return id.IsEmpty()
+		}
+		return ids.Contains(id.Index())
+	}
+
+	// Nodes are loaded starting with the least recently used one such that
+	// the order of the nodes in the cache's LRU list is restored.
+	for i := len(ids) - 1; i >= 0; i-- {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+		if !contains(ids[i]) {
+			continue
+		}
+		ref := NewNodeReference(ids[i])
+		if _, err := forest.getSharedNode(&ref); err != nil {
+			return
+		}
+	}
+}
+
+// Stop aborts the warm-up and waits for its termination.
+func (w *cacheWarmer) Stop() {
+	close(w.stop)
+	<-w.done
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestNodeCacheManifest_WrittenIdsCanBeRead(t *testing.T) {
+	file := filepath.Join(t.TempDir(), nodeCacheManifestFile)
+	ids := []NodeId{BranchId(12), AccountId(3), ExtensionId(7), ValueId(1)}
+	if err := writeNodeCacheManifest(file, ids); err != nil {
+		t.Fatalf("failed to write manifest: %v", err)
+	}
+
+	got, err := readNodeCacheManifest(file, 10)
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	if !slices.Equal(ids, got) {
+		t.Errorf("unexpected IDs, wanted %v, got %v", ids, got)
+	}
+
+	got, err = readNodeCacheManifest(file, 2)
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	if !slices.Equal(ids[:2], got) {
+		t.Errorf("unexpected IDs, wanted %v, got %v", ids[:2], got)
+	}
+}
+
+func TestNodeCacheManifest_MissingFileProducesEmptyList(t *testing.T) {
+	ids, err := readNodeCacheManifest(filepath.Join(t.TempDir(), nodeCacheManifestFile), 10)
+	if err != nil {
+		t.Fatalf("missing manifest should not be an error, got %v", err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("unexpected IDs: %v", ids)
+	}
+}
+
+func TestNodeCacheManifest_CorruptedManifestsAreDetected(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := writeNodeCacheManifestTo([]NodeId{BranchId(1), ValueId(2)}, &buffer); err != nil {
+		t.Fatalf("failed to encode manifest: %v", err)
+	}
+	valid := buffer.Bytes()
+
+	modify := func(modify func([]byte) []byte) []byte {
+		return modify(bytes.Clone(valid))
+	}
+	tests := map[string][]byte{
+		"empty":          {},
+		"truncated":      valid[:len(valid)-1],
+		"wrong marker":   modify(func(data []byte) []byte { data[0]++; return data }),
+		"wrong version":  modify(func(data []byte) []byte { data[7]++; return data }),
+		"wrong count":    modify(func(data []byte) []byte { data[11]--; return data }),
+		"modified id":    modify(func(data []byte) []byte { data[15]++; return data }),
+		"trailing bytes": append(bytes.Clone(valid), 0),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := readNodeCacheManifestFrom(bytes.NewReader(data), 10); err == nil {
+				t.Errorf("corrupted manifest should not be accepted")
+			}
+		})
+	}
+}
+
+func TestForest_NodeCacheManifestIsWrittenOnClose(t *testing.T) {
+	directory := t.TempDir()
+	forestConfig := ForestConfig{Mode: Mutable, CacheCapacity: 1024, CacheManifestSize: 10}
+	forest, err := OpenFileForest(directory, S5LiveConfig, forestConfig)
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	root := NewNodeReference(EmptyId())
+	for i := 0; i < 100; i++ {
+		root, err = forest.SetAccountInfo(&root, common.Address{byte(i)}, AccountInfo{Nonce: common.ToNonce(1)})
+		if err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+	}
+	if _, _, err := forest.updateHashesFor(&root); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+	want := forest.nodeCache.GetMostRecentlyUsed(10)
+	if err := forest.Close(); err != nil {
+		t.Fatalf("failed to close forest: %v", err)
+	}
+
+	got, err := readNodeCacheManifest(filepath.Join(directory, nodeCacheManifestFile), 100)
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	if !slices.Equal(want, got) {
+		t.Errorf("unexpected IDs in manifest, wanted %v, got %v", want, got)
+	}
+}
+
+func TestForest_NodeCacheManifestReducesNodeLoadsAfterRestart(t *testing.T) {
+	const numAccounts = 1000
+	directory := t.TempDir()
+	forestConfig := ForestConfig{Mode: Mutable, CacheCapacity: 1 << 14, CacheManifestSize: 1 << 14}
+
+	forest, err := OpenFileForest(directory, S5LiveConfig, forestConfig)
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	root := NewNodeReference(EmptyId())
+	for i := 0; i < numAccounts; i++ {
+		root, err = forest.SetAccountInfo(&root, common.Address{byte(i), byte(i >> 8)}, AccountInfo{Nonce: common.ToNonce(1)})
+		if err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+	}
+	if _, _, err := forest.updateHashesFor(&root); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+	if err := forest.Close(); err != nil {
+		t.Fatalf("failed to close forest: %v", err)
+	}
+
+	// The manifest is consumed when re-opening the forest, so a copy is
+	// needed to re-open the forest with and without it.
+	manifest, err := os.ReadFile(filepath.Join(directory, nodeCacheManifestFile))
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+
+	countLoads := func(withManifest bool) int64 {
+		config := forestConfig
+		if withManifest {
+			if err := os.WriteFile(filepath.Join(directory, nodeCacheManifestFile), manifest, 0600); err != nil {
+				t.Fatalf("failed to restore manifest: %v", err)
+			}
+		} else {
+			config.CacheManifestSize = 0
+		}
+		forest, err := OpenFileForest(directory, S5LiveConfig, config)
+		if err != nil {
+			t.Fatalf("failed to open forest: %v", err)
+		}
+		defer func() {
+			if err := forest.Close(); err != nil {
+				t.Fatalf("failed to close forest: %v", err)
+			}
+		}()
+		if withManifest == (forest.cacheWarmer == nil) {
+			t.Fatalf("unexpected state of cache warm-up, expected running %t", withManifest)
+		}
+		if forest.cacheWarmer != nil {
+			<-forest.cacheWarmer.done
+		}
+
+		accounts := &loadCountingStock[AccountNode]{Stock: forest.accounts}
+		branches := &loadCountingStock[BranchNode]{Stock: forest.branches}
+		forest.accounts, forest.branches = accounts, branches
+		for i := 0; i < numAccounts; i++ {
+			if _, _, err := forest.GetAccountInfo(&root, common.Address{byte(i), byte(i >> 8)}); err != nil {
+				t.Fatalf("failed to read account: %v", err)
+			}
+		}
+		return accounts.loads.Load() + branches.loads.Load()
+	}
+
+	cold := countLoads(false)
+	warm := countLoads(true)
+	if cold == 0 {
+		t.Errorf("reading from a cold cache should load nodes")
+	}
+	if warm != 0 {
+		t.Errorf("reading from a warm cache should not load nodes, got %d loads, %d without manifest", warm, cold)
+	}
+}
+
+func TestForest_NodeCacheWarmUpSkipsReleasedNodes(t *testing.T) {
+	directory := t.TempDir()
+	forestConfig := ForestConfig{Mode: Mutable, CacheCapacity: 1024, CacheManifestSize: 1024}
+	forest, err := OpenFileForest(directory, S5LiveConfig, forestConfig)
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	root := NewNodeReference(EmptyId())
+	for i := 0; i < 10; i++ {
+		root, err = forest.SetAccountInfo(&root, common.Address{byte(i)}, AccountInfo{Nonce: common.ToNonce(1)})
+		if err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+	}
+	if _, _, err := forest.updateHashesFor(&root); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+	if err := forest.Close(); err != nil {
+		t.Fatalf("failed to close forest: %v", err)
+	}
+
+	// Add IDs of nodes not present in the forest to the manifest.
+	file := filepath.Join(directory, nodeCacheManifestFile)
+	ids, err := readNodeCacheManifest(file, 1024)
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	stale := []NodeId{AccountId(1000), BranchId(1000), ExtensionId(1000), ValueId(1000)}
+	if err := writeNodeCacheManifest(file, append(stale, ids...)); err != nil {
+		t.Fatalf("failed to write manifest: %v", err)
+	}
+
+	forest, err = OpenFileForest(directory, S5LiveConfig, forestConfig)
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	<-forest.cacheWarmer.done
+	for _, id := range stale {
+		ref := NewNodeReference(id)
+		if _, found := forest.nodeCache.Get(&ref); found {
+			t.Errorf("stale node %v should not be loaded", id)
+		}
+	}
+	for _, id := range ids {
+		ref := NewNodeReference(id)
+		if _, found := forest.nodeCache.Get(&ref); !found {
+			t.Errorf("node %v should be loaded", id)
+		}
+	}
+	if err := forest.Close(); err != nil {
+		t.Fatalf("failed to close forest: %v", err)
+	}
+}
+
+func TestForest_CorruptedNodeCacheManifestIsIgnored(t *testing.T) {
+	directory := t.TempDir()
+	file := filepath.Join(directory, nodeCacheManifestFile)
+	if err := os.WriteFile(file, []byte("corrupted"), 0600); err != nil {
+		t.Fatalf("failed to write manifest: %v", err)
+	}
+
+	forest, err := OpenFileForest(directory, S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024, CacheManifestSize: 1024})
+	if err != nil {
+		t.Fatalf("corrupted manifest should not prevent opening the forest: %v", err)
+	}
+	if forest.cacheWarmer != nil {
+		t.Errorf("no warm-up should be started for a corrupted manifest")
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("corrupted manifest should be removed, got %v", err)
+	}
+	if err := forest.Close(); err != nil {
+		t.Fatalf("failed to close forest: %v", err)
+	}
+}
+
+// loadCountingStock counts the number of nodes loaded from a stock.
+type loadCountingStock[V any] struct {
+	stock.Stock[uint64, V]
+	loads atomic.Int64
+}
+
+func (s *loadCountingStock[V]) Get(index uint64) (V, error) {
+	s.loads.Add(1)
+	return s.Stock.Get(index)
+}
@@ -90,6 +90,20 @@ func (mr *MockNodeCacheMockRecorder) GetMemoryFootprint() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMemoryFootprint", reflect.TypeOf((*MockNodeCache)(nil).GetMemoryFootprint))
 }
 
+// GetMostRecentlyUsed mocks base method.
+func (m *MockNodeCache) GetMostRecentlyUsed(limit int) []NodeId {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMostRecentlyUsed", limit)
+	ret0, _ := ret[0].([]NodeId)
+	return ret0
+}
+
+// GetMostRecentlyUsed indicates an expected call of GetMostRecentlyUsed.
+func (mr *MockNodeCacheMockRecorder) GetMostRecentlyUsed(limit any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMostRecentlyUsed", reflect.TypeOf((*MockNodeCache)(nil).GetMostRecentlyUsed), limit)
+}
+
 // GetOrSet mocks base method.
 func (m *MockNodeCache) GetOrSet(arg0 *NodeReference, arg1 *shared.Shared[Node]) (*shared.Shared[Node], bool, NodeId, *shared.Shared[Node], bool) {
 	m.ctrl.T.Helper()
@@ -108,6 +122,20 @@ func (mr *MockNodeCacheMockRecorder) GetOrSet(arg0, arg1 any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrSet", reflect.TypeOf((*MockNodeCache)(nil).GetOrSet), arg0, arg1)
 }
 
+// Pin mocks base method.
+func (m *MockNodeCache) Pin(r *NodeReference) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Pin", r)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// Pin indicates an expected call of Pin.
+func (mr *MockNodeCacheMockRecorder) Pin(r any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Pin", reflect.TypeOf((*MockNodeCache)(nil).Pin), r)
+}
+
 // Release mocks base method.
 func (m *MockNodeCache) Release(r *NodeReference) {
 	m.ctrl.T.Helper()
@@ -120,6 +148,18 @@ func (mr *MockNodeCacheMockRecorder) Release(r any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Release", reflect.TypeOf((*MockNodeCache)(nil).Release), r)
 }
 
+// ReleaseAll mocks base method.
+func (m *MockNodeCache) ReleaseAll(refs []NodeReference) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "ReleaseAll", refs)
+}
+
+// ReleaseAll indicates an expected call of ReleaseAll.
+func (mr *MockNodeCacheMockRecorder) ReleaseAll(refs any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseAll", reflect.TypeOf((*MockNodeCache)(nil).ReleaseAll), refs)
+}
+
 // Touch mocks base method.
 func (m *MockNodeCache) Touch(r *NodeReference) {
 	m.ctrl.T.Helper()
@@ -131,3 +171,15 @@ func (mr *MockNodeCacheMockRecorder) Touch(r any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Touch", reflect.TypeOf((*MockNodeCache)(nil).Touch), r)
 }
+
+// Unpin mocks base method.
+func (m *MockNodeCache) Unpin(r *NodeReference) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Unpin", r)
+}
+
+// Unpin indicates an expected call of Unpin.
+func (mr *MockNodeCacheMockRecorder) Unpin(r any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unpin", reflect.TypeOf((*MockNodeCache)(nil).Unpin), r)
+}
@@ -249,6 +249,33 @@ func TestNodeCache_Release_NoChange(t *testing.T) {
 	}
 }
 
+func TestNodeCache_ReleaseAllChangesOrder(t *testing.T) {
+	cache := NewNodeCache(4).(*nodeCache)
+
+	refs := []NodeReference{}
+	for i := 1; i <= 4; i++ {
+		ref := NewNodeReference(ValueId(uint64(i)))
+		cache.GetOrSet(&ref, nil)
+		refs = append(refs, ref)
+	}
+
+	if want, got := "[V-4 V-3 V-2 V-1]", fmt.Sprintf("%v", cache.getIdsInReverseEvictionOrder()); want != got {
+		t.Errorf("unexpected eviction order, wanted %s, got %s", want, got)
+	}
+
+	cache.ReleaseAll([]NodeReference{refs[3], refs[1], NewNodeReference(ValueId(5))})
+
+	if want, got := "[V-3 V-1 V-4 V-2]", fmt.Sprintf("%v", cache.getIdsInReverseEvictionOrder()); want != got {
+		t.Errorf("unexpected eviction order, wanted %s, got %s", want, got)
+	}
+
+	cache.ReleaseAll(nil)
+
+	if want, got := "[V-3 V-1 V-4 V-2]", fmt.Sprintf("%v", cache.getIdsInReverseEvictionOrder()); want != got {
+		t.Errorf("unexpected eviction order, wanted %s, got %s", want, got)
+	}
+}
+
 func TestNodeCache_ReleaseAndTouch_ChangesOrder(t *testing.T) {
 	cache := NewNodeCache(3).(*nodeCache)
 
@@ -340,34 +367,25 @@ func TestNodeCache_StressTestLruList(t *testing.T) {
 }
 
 func getForwardLruList(c *nodeCache) ([]NodeId, error) {
-	res := make([]NodeId, 0, len(c.owners))
-	seen := map[ownerPosition]struct{}{}
-	for cur := c.head; cur != c.tail; cur = c.owners[cur].next {
-		if _, contains := seen[cur]; contains {
-			return nil, fmt.Errorf("detected loop in LRU list after %v followed by %v", res, c.owners[cur].Id())
-		}
-		seen[cur] = struct{}{}
-		res = append(res, c.owners[cur].Id())
-	}
-	if c.owners[c.tail].tag.Load() > 0 {
-		res = append(res, c.owners[c.tail].Id())
-	}
-	return res, nil
+	policy := c.policy.(*lruEvictionPolicy)
+	return getLruList(c, policy.list.head, policy.links.next)
 }
 
 func getBackwardLruList(c *nodeCache) ([]NodeId, error) {
+	policy := c.policy.(*lruEvictionPolicy)
+	return getLruList(c, policy.list.tail, policy.links.prev)
+}
+
+func getLruList(c *nodeCache, start uint32, links []uint32) ([]NodeId, error) {
 	res := make([]NodeId, 0, len(c.owners))
-	seen := map[ownerPosition]struct{}{}
-	for cur := c.tail; cur != c.head; cur = c.owners[cur].prev {
+	seen := map[uint32]struct{}{}
+	for cur := start; cur != noSlot; cur = links[cur] {
 		if _, contains := seen[cur]; contains {
 			return nil, fmt.Errorf("detected loop in LRU list after %v followed by %v", res, c.owners[cur].Id())
 		}
 		seen[cur] = struct{}{}
 		res = append(res, c.owners[cur].Id())
 	}
-	if c.owners[c.head].tag.Load() > 0 {
-		res = append(res, c.owners[c.head].Id())
-	}
 	return res, nil
 }
 
@@ -425,3 +443,279 @@ func TestNodeCache_GetAndSetThreadSafety(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestNodeCacheShares_CapacityIsSplitAccordingToShares(t *testing.T) {
+	tests := []struct {
+		shares NodeCacheShares
+		want   [numNodeCachePartitions]int
+	}{
+		{NodeCacheShares{Accounts: 1, Branches: 1, Extensions: 1, Values: 1}, [numNodeCachePartitions]int{25, 25, 25, 25}},
+		{NodeCacheShares{Accounts: 4, Branches: 3, Extensions: 1, Values: 2}, [numNodeCachePartitions]int{40, 30, 10, 20}},
+		{NodeCacheShares{Accounts: 1}, [numNodeCachePartitions]int{100, 1, 1, 1}},
+	}
+	for _, test := range tests {
+		if got := test.shares.getCapacities(100); got != test.want {
+			t.Errorf("unexpected capacities for %v, wanted %v, got %v", test.shares, test.want, got)
+		}
+	}
+}
+
+func TestNodeCacheShares_ZeroSharesAreDisabled(t *testing.T) {
+	if (NodeCacheShares{}).IsEnabled() {
+		t.Errorf("zero shares should not be enabled")
+	}
+	if !(NodeCacheShares{Values: 1}).IsEnabled() {
+		t.Errorf("non-zero shares should be enabled")
+	}
+}
+
+func TestTypeAwareNodeCache_ValuesAreEvictedBeforeAccounts(t *testing.T) {
+	const Capacity = 100
+	cache := newTypeAwareNodeCache(Capacity, NodeCacheShares{Accounts: 4, Branches: 4, Extensions: 1, Values: 1}, nil)
+
+	accounts := make([]NodeReference, 0, 40)
+	for i := 0; i < cap(accounts); i++ {
+		ref := NewNodeReference(AccountId(uint64(i)))
+		if _, _, _, _, evicted := cache.GetOrSet(&ref, shared.MakeShared[Node](&AccountNode{})); evicted {
+			t.Fatalf("no account should be evicted while filling the cache")
+		}
+		accounts = append(accounts, ref)
+	}
+
+	// Values are accessed more recently than all accounts but exceed the
+	// capacity reserved for values. Thus, only values are evicted.
+	evictedValues := 0
+	for i := 0; i < Capacity; i++ {
+		ref := NewNodeReference(ValueId(uint64(i)))
+		_, _, evictedId, _, evicted := cache.GetOrSet(&ref, shared.MakeShared[Node](&ValueNode{}))
+		if !evicted {
+			continue
+		}
+		if !evictedId.IsValue() {
+			t.Fatalf("unexpected eviction of %v", evictedId)
+		}
+		evictedValues++
+	}
+	if want := Capacity - 10; evictedValues != want {
+		t.Errorf("unexpected number of evicted values, wanted %d, got %d", want, evictedValues)
+	}
+
+	for _, ref := range accounts {
+		if _, found := cache.Get(&ref); !found {
+			t.Errorf("account %v should be retained", ref.Id())
+		}
+	}
+	for i := 0; i < Capacity; i++ {
+		ref := NewNodeReference(ValueId(uint64(i)))
+		if _, found := cache.Get(&ref); found != (i >= Capacity-10) {
+			t.Errorf("unexpected presence of value %d in cache, wanted %t, got %t", i, i >= Capacity-10, found)
+		}
+	}
+}
+
+func TestTypeAwareNodeCache_ForEachEnumeratesAllPartitions(t *testing.T) {
+	cache := newTypeAwareNodeCache(10, NodeCacheShares{Accounts: 1, Branches: 1, Extensions: 1, Values: 1}, nil)
+	want := map[NodeId]*shared.Shared[Node]{
+		AccountId(1):   shared.MakeShared[Node](&AccountNode{}),
+		BranchId(1):    shared.MakeShared[Node](&BranchNode{}),
+		ExtensionId(1): shared.MakeShared[Node](&ExtensionNode{}),
+		ValueId(1):     shared.MakeShared[Node](&ValueNode{}),
+		EmptyId():      shared.MakeShared[Node](EmptyNode{}),
+	}
+	for id, node := range want {
+		ref := NewNodeReference(id)
+		cache.GetOrSet(&ref, node)
+	}
+	got := map[NodeId]*shared.Shared[Node]{}
+	cache.ForEach(func(id NodeId, node *shared.Shared[Node]) {
+		got[id] = node
+	})
+	if !maps.Equal(want, got) {
+		t.Errorf("invalid content, wanted %v, got %v", want, got)
+	}
+}
+
+func TestNodeCache_ZeroReferenceIsNotResolvedToUnusedOwner(t *testing.T) {
+	cache := newNodeCache(10)
+	ref := NodeReference{}
+	if node, found := cache.Get(&ref); found {
+		t.Errorf("empty cache should not contain any element, found %v", node)
+	}
+}
+
+func TestTypeAwareNodeCache_ReleaseAllReleasesNodesInAllPartitions(t *testing.T) {
+	cache := newTypeAwareNodeCache(8, NodeCacheShares{Accounts: 1, Branches: 1, Extensions: 1, Values: 1}, nil)
+	for i := 0; i < 2; i++ {
+		account := NewNodeReference(AccountId(uint64(i)))
+		cache.GetOrSet(&account, shared.MakeShared[Node](&AccountNode{}))
+		value := NewNodeReference(ValueId(uint64(i)))
+		cache.GetOrSet(&value, shared.MakeShared[Node](&ValueNode{}))
+	}
+
+	account := NewNodeReference(AccountId(1))
+	value := NewNodeReference(ValueId(1))
+	cache.Get(&account)
+	cache.Get(&value)
+	cache.ReleaseAll([]NodeReference{account, value})
+
+	// Released nodes are evicted first in their respective partitions.
+	account = NewNodeReference(AccountId(2))
+	if _, _, evictedId, _, _ := cache.GetOrSet(&account, shared.MakeShared[Node](&AccountNode{})); evictedId != AccountId(1) {
+		t.Errorf("unexpected evicted account, wanted %v, got %v", AccountId(1), evictedId)
+	}
+	value = NewNodeReference(ValueId(2))
+	if _, _, evictedId, _, _ := cache.GetOrSet(&value, shared.MakeShared[Node](&ValueNode{})); evictedId != ValueId(1) {
+		t.Errorf("unexpected evicted value, wanted %v, got %v", ValueId(1), evictedId)
+	}
+}
+
+func TestNodeCache_PinnedNodesAreNotEvicted(t *testing.T) {
+	const Capacity = 10
+	cache := NewNodeCache(Capacity)
+
+	pinned := []NodeReference{}
+	for i := 0; i < Capacity; i++ {
+		ref := NewNodeReference(ValueId(uint64(i)))
+		cache.GetOrSet(&ref, shared.MakeShared[Node](&ValueNode{}))
+		if i%3 == 0 {
+			if !cache.Pin(&ref) {
+				t.Fatalf("failed to pin node %v", ref.Id())
+			}
+			pinned = append(pinned, ref)
+		}
+	}
+
+	for i := Capacity; i < 10*Capacity; i++ {
+		ref := NewNodeReference(ValueId(uint64(i)))
+		_, _, evictedId, _, evicted := cache.GetOrSet(&ref, shared.MakeShared[Node](&ValueNode{}))
+		if !evicted {
+			t.Fatalf("a node should be evicted when inserting into a full cache")
+		}
+		for _, cur := range pinned {
+			if cur.Id() == evictedId {
+				t.Fatalf("pinned node %v got evicted", evictedId)
+			}
+		}
+	}
+
+	for _, ref := range pinned {
+		if _, found := cache.Get(&ref); !found {
+			t.Errorf("pinned node %v should be retained", ref.Id())
+		}
+	}
+}
+
+func TestNodeCache_UnpinnedNodesCanBeEvicted(t *testing.T) {
+	cache := NewNodeCache(2)
+
+	ref1 := NewNodeReference(ValueId(1))
+	ref2 := NewNodeReference(ValueId(2))
+	ref3 := NewNodeReference(ValueId(3))
+	cache.GetOrSet(&ref1, nil)
+	cache.GetOrSet(&ref2, nil)
+	if !cache.Pin(&ref1) {
+		t.Fatalf("failed to pin node")
+	}
+	cache.Unpin(&ref1)
+
+	if _, _, evictedId, _, evicted := cache.GetOrSet(&ref3, nil); !evicted || evictedId != ref1.Id() {
+		t.Errorf("unexpected eviction, wanted %v, got %v, evicted %t", ref1.Id(), evictedId, evicted)
+	}
+}
+
+func TestNodeCache_AtMostHalfOfTheCapacityCanBePinned(t *testing.T) {
+	cache := NewNodeCache(10)
+	for i := 0; i < 10; i++ {
+		ref := NewNodeReference(ValueId(uint64(i)))
+		cache.GetOrSet(&ref, nil)
+		if want, got := i < 5, cache.Pin(&ref); want != got {
+			t.Errorf("unexpected result of pinning node %d, wanted %t, got %t", i, want, got)
+		}
+	}
+}
+
+func TestNodeCache_NodesNotInCacheCanNotBePinned(t *testing.T) {
+	cache := NewNodeCache(10)
+	ref := NewNodeReference(ValueId(1))
+	if cache.Pin(&ref) {
+		t.Errorf("missing node should not be pinned")
+	}
+}
+
+func TestNodeCache_ReleaseUnpinsNodes(t *testing.T) {
+	cache := NewNodeCache(2).(*nodeCache)
+
+	ref1 := NewNodeReference(ValueId(1))
+	ref2 := NewNodeReference(ValueId(2))
+	ref3 := NewNodeReference(ValueId(3))
+	cache.GetOrSet(&ref1, nil)
+	cache.GetOrSet(&ref2, nil)
+	if !cache.Pin(&ref1) {
+		t.Fatalf("failed to pin node")
+	}
+	cache.Release(&ref1)
+	if cache.pinned != 0 {
+		t.Errorf("released node should be un-pinned, got %d pinned nodes", cache.pinned)
+	}
+
+	if _, _, evictedId, _, evicted := cache.GetOrSet(&ref3, nil); !evicted || evictedId != ref1.Id() {
+		t.Errorf("unexpected eviction, wanted %v, got %v, evicted %t", ref1.Id(), evictedId, evicted)
+	}
+}
+
+func TestTypeAwareNodeCache_PinningIsForwardedToPartitions(t *testing.T) {
+	cache := newTypeAwareNodeCache(100, NodeCacheShares{Accounts: 1, Branches: 1, Extensions: 1, Values: 1}, nil)
+
+	ref := NewNodeReference(AccountId(1))
+	cache.GetOrSet(&ref, nil)
+	if !cache.Pin(&ref) {
+		t.Fatalf("failed to pin node")
+	}
+	if want, got := 1, cache.partitions[accountPartition].pinned; want != got {
+		t.Errorf("unexpected number of pinned accounts, wanted %d, got %d", want, got)
+	}
+	cache.Unpin(&ref)
+	if want, got := 0, cache.partitions[accountPartition].pinned; want != got {
+		t.Errorf("unexpected number of pinned accounts, wanted %d, got %d", want, got)
+	}
+}
+
+func TestNodeCache_GetMostRecentlyUsed_ListsNodesInRecencyOrder(t *testing.T) {
+	cache := NewNodeCache(3)
+	if want, got := "[]", fmt.Sprintf("%v", cache.GetMostRecentlyUsed(10)); want != got {
+		t.Errorf("unexpected list of nodes, wanted %s, got %s", want, got)
+	}
+
+	refs := []NodeReference{}
+	for i := 1; i <= 4; i++ {
+		refs = append(refs, NewNodeReference(ValueId(uint64(i))))
+		cache.GetOrSet(&refs[i-1], nil)
+	}
+	cache.Touch(&refs[1])
+
+	if want, got := "[V-2 V-4 V-3]", fmt.Sprintf("%v", cache.GetMostRecentlyUsed(10)); want != got {
+		t.Errorf("unexpected list of nodes, wanted %s, got %s", want, got)
+	}
+	if want, got := "[V-2 V-4]", fmt.Sprintf("%v", cache.GetMostRecentlyUsed(2)); want != got {
+		t.Errorf("unexpected list of nodes, wanted %s, got %s", want, got)
+	}
+	if want, got := "[]", fmt.Sprintf("%v", cache.GetMostRecentlyUsed(0)); want != got {
+		t.Errorf("unexpected list of nodes, wanted %s, got %s", want, got)
+	}
+}
+
+func TestTypeAwareNodeCache_GetMostRecentlyUsed_InterleavesPartitions(t *testing.T) {
+	cache := NewTypeAwareNodeCache(100, NodeCacheShares{Accounts: 1, Branches: 1, Extensions: 1, Values: 1})
+
+	for _, id := range []NodeId{AccountId(1), AccountId(2), BranchId(1), ValueId(1), ValueId(2), ValueId(3)} {
+		ref := NewNodeReference(id)
+		cache.GetOrSet(&ref, nil)
+	}
+
+	if want, got := "[A-2 B-1 V-3 A-1 V-2 V-1]", fmt.Sprintf("%v", cache.GetMostRecentlyUsed(10)); want != got {
+		t.Errorf("unexpected list of nodes, wanted %s, got %s", want, got)
+	}
+	if want, got := "[A-2 B-1 V-3 A-1]", fmt.Sprintf("%v", cache.GetMostRecentlyUsed(4)); want != got {
+		t.Errorf("unexpected list of nodes, wanted %s, got %s", want, got)
+	}
+}
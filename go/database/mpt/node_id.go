@@ -135,3 +135,99 @@ func (NodeIdEncoder) Load(src []byte, id *NodeId) {
 	copy(buffer[2:], src)
 	*id = NodeId(binary.BigEndian.Uint64(buffer[:]))
 }
+
+// WideNodeIdEncoder encodes node IDs using the full 8 bytes, for forests
+// exceeding the ID space covered by the NodeIdEncoder.
+type WideNodeIdEncoder struct{}
+
+func (WideNodeIdEncoder) GetEncodedSize() int {
+	return 8
+}
+
+func (WideNodeIdEncoder) Store(dst []byte, id *NodeId) {
+	binary.BigEndian.PutUint64(dst, uint64(*id))
+}
+
+func (WideNodeIdEncoder) Load(src []byte, id *NodeId) {
+	*id = NodeId(binary.BigEndian.Uint64(src))
+}
+
+// nodeIdEncoder is the common interface of NodeIdEncoder and WideNodeIdEncoder.
+type nodeIdEncoder interface {
+	GetEncodedSize() int
+	Store(dst []byte, id *NodeId)
+	Load(src []byte, id *NodeId)
+}
+
+// getNodeIdEncoder returns the encoder of node references used by forests
+// of the given configuration.
+func getNodeIdEncoder(config MptConfig) nodeIdEncoder {
+	if config.UseWideNodeReferences {
+		return WideNodeIdEncoder{}
+	}
+	return NodeIdEncoder{}
+}
+
+// ----------------------------------------------------------------------------
+//                               NodeId Capacity
+// ----------------------------------------------------------------------------
+
+// NodeIdCounts lists a number of node IDs for each type of node.
+type NodeIdCounts struct {
+	Accounts   uint64
+	Branches   uint64
+	Extensions uint64
+	Values     uint64
+}
+
+// getIdSpaceCapacity computes the capacity of node references encoded using
+// the given number of bytes, which must be between 1 and 8. A node index is
+// covered if the resulting node ID is representable by the given number of
+// bytes.
+func getIdSpaceCapacity(width int) NodeIdCounts {
+	bits := uint(width * 8)
+	return NodeIdCounts{
+		Accounts:   1 << (bits - 3),
+		Branches:   1<<(bits-1) - 1, // the index 0 is represented by ID 2
+		Extensions: 1 << (bits - 3),
+		Values:     1 << (bits - 2),
+	}
+}
+
+// IdSpaceUsage describes the utilization of the node ID space of a forest.
+type IdSpaceUsage struct {
+	Used     NodeIdCounts // the number of allocated IDs, including released IDs which may be reused
+	Capacity NodeIdCounts // the number of IDs fitting into node references
+}
+
+// Headroom returns the number of IDs of each type that can be allocated
+// before the ID space is exhausted, not counting reusable released IDs.
+func (u IdSpaceUsage) Headroom() NodeIdCounts {
+	headroom := func(used, capacity uint64) uint64 {
+		if used >= capacity {
+			return 0
+		}
+		return capacity - used
+	}
+	return NodeIdCounts{
+		Accounts:   headroom(u.Used.Accounts, u.Capacity.Accounts),
+		Branches:   headroom(u.Used.Branches, u.Capacity.Branches),
+		Extensions: headroom(u.Used.Extensions, u.Capacity.Extensions),
+		Values:     headroom(u.Used.Values, u.Capacity.Values),
+	}
+}
+
+// idSpaceUsageProvider is implemented by databases reporting their node ID
+// space usage.
+type idSpaceUsageProvider interface {
+	GetIdSpaceUsage() (IdSpaceUsage, error)
+}
+
+// getIdSpaceUsage obtains the ID space usage of the given database.
+func getIdSpaceUsage(db any) (IdSpaceUsage, error) {
+	provider, ok := db.(idSpaceUsageProvider)
+	if !ok {
+		return IdSpaceUsage{}, fmt.Errorf("ID space usage is not supported by %T", db)
+	}
+	return provider.GetIdSpaceUsage()
+}
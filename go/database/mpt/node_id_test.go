@@ -11,6 +11,7 @@
 package mpt
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -156,3 +157,77 @@ func TestNodeID_EncodingAndDecodingPowerOfTwos(t *testing.T) {
 		}
 	}
 }
+
+func TestNodeID_WideEncodingAndDecodingPowerOfTwos(t *testing.T) {
+	var buffer [8]byte
+	encoder := WideNodeIdEncoder{}
+	for i := 0; i < 8*8; i++ {
+		id := NodeId(uint64(1) << i)
+		encoder.Store(buffer[:], &id)
+		restored := NodeId(12345)
+		if encoder.Load(buffer[:], &restored); restored != id {
+			t.Fatalf("failed to decode id %v: got %v", id, restored)
+		}
+	}
+}
+
+func TestIdSpaceCapacity_BoundaryIdsAreCoveredByEncoders(t *testing.T) {
+	types := map[string]struct {
+		id       func(uint64) NodeId
+		is       func(NodeId) bool
+		capacity func(NodeIdCounts) uint64
+	}{
+		"account":   {AccountId, NodeId.IsAccount, func(c NodeIdCounts) uint64 { return c.Accounts }},
+		"branch":    {BranchId, NodeId.IsBranch, func(c NodeIdCounts) uint64 { return c.Branches }},
+		"extension": {ExtensionId, NodeId.IsExtension, func(c NodeIdCounts) uint64 { return c.Extensions }},
+		"value":     {ValueId, NodeId.IsValue, func(c NodeIdCounts) uint64 { return c.Values }},
+	}
+	for _, encoder := range []nodeIdEncoder{NodeIdEncoder{}, WideNodeIdEncoder{}} {
+		width := encoder.GetEncodedSize()
+		capacity := getIdSpaceCapacity(width)
+		for name, nodeType := range types {
+			t.Run(fmt.Sprintf("%s/%d", name, width), func(t *testing.T) {
+				buffer := make([]byte, width)
+				last := nodeType.capacity(capacity) - 1
+
+				// The last index within the capacity survives the encoding.
+				id := nodeType.id(last)
+				restored := NodeId(12345)
+				encoder.Store(buffer, &id)
+				if encoder.Load(buffer, &restored); restored != id || !nodeType.is(restored) || restored.Index() != last {
+					t.Errorf("failed to encode last index %d, got %v", last, restored)
+				}
+
+				// The first index beyond the capacity does not.
+				id = nodeType.id(last + 1)
+				encoder.Store(buffer, &id)
+				if encoder.Load(buffer, &restored); nodeType.is(restored) && restored.Index() == last+1 {
+					t.Errorf("index %d beyond capacity should not be encodable", last+1)
+				}
+			})
+		}
+	}
+}
+
+func TestIdSpaceCapacity_CapacityOfNarrowAndWideReferences(t *testing.T) {
+	tests := map[int]NodeIdCounts{
+		6: {Accounts: 1 << 45, Branches: 1<<47 - 1, Extensions: 1 << 45, Values: 1 << 46},
+		8: {Accounts: 1 << 61, Branches: 1<<63 - 1, Extensions: 1 << 61, Values: 1 << 62},
+	}
+	for width, want := range tests {
+		if got := getIdSpaceCapacity(width); got != want {
+			t.Errorf("unexpected capacity for width %d, wanted %v, got %v", width, want, got)
+		}
+	}
+}
+
+func TestIdSpaceUsage_HeadroomIsRemainingCapacity(t *testing.T) {
+	usage := IdSpaceUsage{
+		Used:     NodeIdCounts{Accounts: 1, Branches: 10, Extensions: 20, Values: 30},
+		Capacity: NodeIdCounts{Accounts: 5, Branches: 10, Extensions: 25, Values: 20},
+	}
+	want := NodeIdCounts{Accounts: 4, Branches: 0, Extensions: 5, Values: 0}
+	if got := usage.Headroom(); got != want {
+		t.Errorf("unexpected headroom, wanted %v, got %v", want, got)
+	}
+}
@@ -16,11 +16,16 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
 	"github.com/Fantom-foundation/Carmen/go/common"
 	"github.com/Fantom-foundation/Carmen/go/common/tribool"
 	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
 	"io"
+	"reflect"
 	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // This file defines the interface and implementation of all node types in a
@@ -159,10 +164,20 @@ type Node interface {
 	//                instance, the node's hash needs to be updated
 	//  - err     ... if resolving, creating, or releasing nodes failed at some
 	//                point during the update.
+	// If the addressed account does not exist, no account is created and the
+	// trie is not modified. In this case, (thisId, false, nil) is returned,
+	// independently of the type of this node and the value to be set.
 	// This function is only supported for nodes in the MPT located between
 	// the root node and an AccountNode.
 	SetSlot(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], address common.Address, path []Nibble, key common.Key, value common.Value) (newRoot NodeReference, changed bool, err error)
 
+	// SetSlots is a variant of SetSlot updating multiple slots of an account.
+	// The account is located only once and all updates are applied to its
+	// storage trie in the given order, producing the same trie as a sequence
+	// of SetSlot calls. For parameter information and return values see
+	// SetSlot().
+	SetSlots(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], address common.Address, path []Nibble, updates []SlotUpdate) (newRoot NodeReference, changed bool, err error)
+
 	// ClearStorage deletes the entire storage associated to an account. For
 	// parameter information and return values see SetValue().
 	ClearStorage(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], address common.Address, path []Nibble) (newRoot NodeReference, changed bool, err error)
@@ -190,7 +205,9 @@ type Node interface {
 	IsFrozen() bool
 
 	// Freeze freezes this node and the entire sub-tree induced by it. After
-	// freezing the node it can no longer be modified or released.
+	// freezing the node it can no longer be modified or released. Sub-trees
+	// are frozen before the nodes rooting them, such that a node marked as
+	// frozen never has non-frozen descendants.
 	Freeze(manager NodeManager, this shared.WriteHandle[Node]) error
 
 	// MarkFrozen marks the current node as frozen, without freezing the
@@ -211,7 +228,16 @@ type Node interface {
 	// set. Visiting aborts if the visitor returns or prune sub-tree as
 	// requested by the visitor. The function returns whether the visiting
 	// process has been aborted and/or an error occurred.
+	// Nodes are visited depth-first in pre-order: each node is visited before
+	// its descendants, the children of branch nodes are visited in ascending
+	// nibble order (0..15), and account nodes are visited before the nodes of
+	// their storage tries. Tools like exports and diffs depend on this order.
 	Visit(source NodeSource, thisRef *NodeReference, depth int, visitor NodeVisitor) (abort bool, err error)
+
+	// visit implements Visit for a node reached at the given position of a
+	// visit. The position is reported to the visitor through the NodeInfo of
+	// this node and extended for the visits of its children.
+	visit(source NodeSource, thisRef *NodeReference, position visitPosition, visitor NodeVisitor) (abort bool, err error)
 }
 
 // NodeSource is an interface for any object capable of resolving NodeIds into
@@ -241,7 +267,12 @@ type NodeManager interface {
 	createValue() (NodeReference, shared.WriteHandle[Node], error)
 
 	release(*NodeReference) error
+	releaseBatch([]NodeReference) error
 	releaseTrieAsynchronous(NodeReference)
+
+	// trackDirtyNode informs the manager about the referenced node becoming
+	// dirty, or clean if false is passed, by a modification or release.
+	trackDirtyNode(ref *NodeReference, dirty bool)
 }
 
 // ----------------------------------------------------------------------------
@@ -255,7 +286,8 @@ type NodeManager interface {
 // The function returns an error if the path cannot be iterated due to error propagated from the node source.
 // Nodes provided via the visitor are made available with the view privilege.
 func VisitPathToStorage(source NodeSource, storageRoot *NodeReference, key common.Key, visitor NodeVisitor) (bool, error) {
-	path := KeyToNibblePath(key, source)
+	var buffer nibblePathBuffer
+	path := buffer.setKey(key, source)
 	return visitPathTo(source, storageRoot, path, nil, &key, visitor)
 }
 
@@ -266,7 +298,8 @@ func VisitPathToStorage(source NodeSource, storageRoot *NodeReference, key commo
 // The function returns an error if the path cannot be iterated due to error propagated from the node source.
 // Nodes provided via the visitor are made available with the view privilege.
 func VisitPathToAccount(source NodeSource, root *NodeReference, address common.Address, visitor NodeVisitor) (bool, error) {
-	path := AddressToNibblePath(address, source)
+	var buffer nibblePathBuffer
+	path := buffer.setAddress(address, source)
 	return visitPathTo(source, root, path, &address, nil, visitor)
 }
 
@@ -344,125 +377,359 @@ func visitPathTo(source NodeSource, root *NodeReference, path []Nibble, address
 // CheckForest evaluates invariants throughout all nodes reachable from the
 // given list of roots. Executed checks include node-specific checks like the
 // minimum number of child nodes of a BranchNode, the correct placement of
-// nodes within the forest, and the absence of zero values. The function also
+// nodes within the forest, the absence of zero values, and the absence of
+// dirty frozen nodes, which are modifications of nodes shared by archived
+// tries. The function also
 // checks the proper sharing of nodes in multiple tries rooted by different
 // nodes. A reuse is only valid if the node's position within the respective
 // tries is compatible -- thus, the node is reachable through the same
-// navigation path.
+// navigation path. All detected errors are reported, sorted by their
+// messages. Sub-tries of nodes failing their checks are skipped.
 func CheckForest(source NodeSource, roots []*NodeReference) error {
-	// The check algorithm is based on an iterative depth-first traversal
-	// where information on encountered nodes is cached to avoid multiple
-	// evaluations.
-	workList := []NodeId{}
-	contexts := map[NodeId]nodeCheckContext{}
-	for _, ref := range roots {
-		workList = append(workList, ref.Id())
-		contexts[ref.Id()] = nodeCheckContext{
-			root:           ref.Id(),
-			hasSeenAccount: false,
-			path:           nil,
-		}
-	}
-
-	// scheduleNode verifies that the given node is reached consistently
-	// with earlier encounters or schedules the node for future checks
-	// if this is the first time a path to this node was discovered.
-	scheduleNode := func(ref *NodeReference, root NodeId, accountSeen bool, path []Nibble) error {
-		context := nodeCheckContext{
-			root:           root,
-			hasSeenAccount: accountSeen,
-			path:           path,
-		}
-		previous, found := contexts[ref.Id()]
-		if found {
-			if !context.isCompatible(&previous) {
-				return fmt.Errorf(
-					"invalid reuse of node %v: reachable from %v through %v and from %v through %v",
-					ref.Id(), previous.root, previous.path, context.root, context.path,
-				)
+	return CheckForestInParallel(source, roots, 1)
+}
+
+// CheckForestInParallel is a variant of CheckForest distributing the checks
+// among the given number of workers, a single one if the number is not
+// positive. Each worker traverses the sub-tries assigned to it depth-first
+// and hands off sub-tries to other workers whenever those run out of work.
+// The contexts of encountered nodes are shared by all workers, such that
+// each node is checked once and reuses are validated across sub-tries. Thus,
+// besides the node contexts also maintained by a sequential check, the memory
+// overhead is proportional to the number of workers.
+//
+// The reported errors are the same as for a sequential check, except for
+// invalid reuses of nodes. Which of the conflicting navigation paths gets
+// discovered first, and is thus used for checking the reused sub-trie,
+// depends on the scheduling of the workers.
+func CheckForestInParallel(source NodeSource, roots []*NodeReference, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+	checker := &forestChecker{
+		source: source,
+		queue:  make(chan nodeCheckTask, workers),
+	}
+	if l, ok := source.(logging); ok {
+		checker.logger = l.getLogger()
+	}
+	if partial, ok := source.(partiallyFrozen); ok {
+		if accounts, isPartial := partial.getArchivedAccounts(); isPartial {
+			checker.paths = newArchivedPaths(source, accounts)
+		}
+	}
+	for i := range checker.shards {
+		checker.shards[i].contexts = map[NodeId]nodeCheckContext{}
+	}
+
+	var done sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			source := checker.newNodeCheckSource()
+			for task := range checker.queue {
+				checker.checkSubTrie(source, task)
+				checker.pending.Done()
 			}
-			return nil
-		} else {
-			contexts[ref.Id()] = context
+		}()
+	}
+
+	// An extra pending task is held while feeding the roots to the workers
+	// to prevent the queue from being considered drained prematurely.
+	checker.pending.Add(1)
+	for _, ref := range roots {
+		task := nodeCheckTask{id: ref.Id(), context: nodeCheckContext{root: ref.Id()}}
+		if checker.register(task) {
+			checker.pending.Add(1)
+			checker.queue <- task
 		}
-		workList = append(workList, ref.Id())
-		return nil
 	}
+	checker.pending.Done()
+	checker.pending.Wait()
+	close(checker.queue)
+	done.Wait()
 
-	count := 0
+	errs := checker.errors
+	slices.SortFunc(errs, func(a, b error) int {
+		return strings.Compare(a.Error(), b.Error())
+	})
+	return errors.Join(errs...)
+}
+
+// ErrNodeTooDeep is reported for branch and extension nodes consuming more
+// nibbles than remain on the navigated path, which is only possible in
+// corrupted tries.
+const ErrNodeTooDeep = common.ConstError("node too deep")
+
+// checkRemainingPath produces an error if a node of the given kind consuming
+// the given number of nibbles is reached with fewer nibbles remaining.
+func checkRemainingPath(kind string, consumed, remaining int) error {
+	if consumed > remaining {
+		return fmt.Errorf("%w: %s node consuming %d nibbles reached with %d remaining nibbles", ErrNodeTooDeep, kind, consumed, remaining)
+	}
+	return nil
+}
+
+// checkNodeDepth verifies that the given branch or extension node reached
+// through the given context does not consume more nibbles than remain.
+func checkNodeDepth(config MptConfig, node Node, context *nodeCheckContext) error {
+	remaining := getMaxPathLength(config, context.hasSeenAccount) - len(context.path)
+	switch n := node.(type) {
+	case *BranchNode:
+		return checkRemainingPath("branch", 1, remaining)
+	case *ExtensionNode:
+		return checkRemainingPath("extension", n.path.Length(), remaining)
+	}
+	return nil
+}
+
+// getMaxPathLength returns the number of nibbles of the paths leading to the
+// accounts of state tries or the values of storage tries of the given
+// configuration.
+func getMaxPathLength(config MptConfig, storage bool) int {
+	if storage || config.UseHashedPaths {
+		return 64
+	}
+	return 40
+}
+
+// numNodeCheckContextShards is the number of independently locked partitions
+// of the node contexts maintained by a forest check.
+const numNodeCheckContextShards = 64
+
+// forestChecker is the shared state of the workers of a forest check.
+type forestChecker struct {
+	source  NodeSource
+	logger  Logger             // receives progress reports, nil if none
+	paths   *archivedPaths     // the paths required to be frozen in partially frozen forests, nil otherwise
+	queue   chan nodeCheckTask // sub-tries to be checked by the next idle worker
+	pending sync.WaitGroup     // the number of sub-tries queued or being checked
+	shards  [numNodeCheckContextShards]struct {
+		mutex    sync.Mutex
+		contexts map[NodeId]nodeCheckContext
+	}
+	numContexts atomic.Int64
+	numChecked  atomic.Int64
+	errors      []error
+	errorsMutex sync.Mutex
+}
+
+// nodeCheckTask is the check of a node reached through the given context.
+type nodeCheckTask struct {
+	id      NodeId
+	context nodeCheckContext
+	frozen  bool // set if the node is required to be frozen in a partially frozen forest
+}
+
+// register records the context the node of the given task got reached
+// through. True is returned if the node is encountered for the first time
+// and needs to be checked. Otherwise, the context is verified to be
+// consistent with the earlier encounter.
+func (c *forestChecker) register(task nodeCheckTask) bool {
+	shard := &c.shards[(uint64(task.id)*0x9E3779B97F4A7C15)>>58]
+	shard.mutex.Lock()
+	previous, found := shard.contexts[task.id]
+	if !found {
+		shard.contexts[task.id] = task.context
+	}
+	shard.mutex.Unlock()
+
+	if !found {
+		c.numContexts.Add(1)
+		return true
+	}
+	if !task.context.isCompatible(&previous) {
+		c.addError(fmt.Errorf(
+			"invalid reuse of node %v: reachable from %v through %v and from %v through %v",
+			task.id, previous.root, previous.path, task.context.root, task.context.path,
+		))
+	}
+	return false
+}
+
+func (c *forestChecker) addError(err error) {
+	c.errorsMutex.Lock()
+	defer c.errorsMutex.Unlock()
+	c.errors = append(c.errors, err)
+}
+
+// newNodeCheckSource creates the source handed to the checks of individual
+// nodes by a single worker.
+func (c *forestChecker) newNodeCheckSource() *nodeCheckSource {
+	config := c.source.getConfig()
+	return &nodeCheckSource{
+		NodeSource: c.source,
+		hasher:     config.Hashing.createHasher(config.HashFunction),
+	}
+}
+
+// checkSubTrie checks all nodes of the sub-trie rooted by the node of the
+// given task not checked by other workers. Sub-tries of child nodes are handed
+// off to other workers if there is room in the queue.
+func (c *forestChecker) checkSubTrie(source *nodeCheckSource, task nodeCheckTask) {
+	workList := []nodeCheckTask{task}
 	for len(workList) > 0 {
-		curId := workList[len(workList)-1]
+		cur := workList[len(workList)-1]
 		workList = workList[:len(workList)-1]
 
-		// TODO [cleanup]: replace this by an observer
-		count++
-		if count%100000 == 0 {
-			fmt.Printf("Checking %v (%d), |ws| = %d, |contexts| = %d\n", curId, count, len(workList), len(contexts))
+		count := c.numChecked.Add(1)
+		if count%100000 == 0 && c.logger != nil {
+			c.logger.Log(LogDebug, "checking forest", "node", cur.id, "checked", count, "worklist", len(workList), "contexts", c.numContexts.Load())
 		}
 
-		context := contexts[curId]
-		curNodeRef := NewNodeReference(curId)
-		handle, err := source.getViewAccess(&curNodeRef)
-		if err != nil {
-			return err
+		for _, child := range c.checkNode(source, cur) {
+			if len(workList) > 0 {
+				c.pending.Add(1)
+				select {
+				case c.queue <- child:
+					continue
+				default:
+					c.pending.Done()
+				}
+			}
+			workList = append(workList, child)
 		}
-		node := handle.Get()
-		err = node.Check(source, &curNodeRef, context.path)
-		if err != nil {
-			handle.Release()
-			return err
+	}
+}
+
+// checkNode checks the node of the given task and returns the tasks for
+// checking child nodes encountered for the first time.
+func (c *forestChecker) checkNode(source *nodeCheckSource, task nodeCheckTask) []nodeCheckTask {
+	context := task.context
+	ref := NewNodeReference(task.id)
+	handle, err := c.source.getViewAccess(&ref)
+	if err != nil {
+		c.addError(err)
+		return nil
+	}
+	defer handle.Release()
+	node := handle.Get()
+
+	// In partially frozen forests, the checks of individual nodes tolerate
+	// non-frozen children of frozen nodes. However, the nodes on the paths to
+	// archived accounts and in the storage tries of those are frozen together
+	// with their parents, which is verified here.
+	if task.frozen && !node.IsFrozen() {
+		c.addError(fmt.Errorf("node %v reached through %v retains an archived account and must be frozen like its parent", task.id, context.path))
+	}
+
+	if err := node.Check(source, &ref, context.path); err != nil {
+		c.addError(err)
+		return nil
+	}
+
+	// Branch and extension nodes must not consume more nibbles than remain on
+	// the path to the leaves of the trie. Sub-tries of nodes that are too deep
+	// are skipped, since they can not be reached by descents.
+	if err := checkNodeDepth(c.source.getConfig(), node, &context); err != nil {
+		c.addError(fmt.Errorf("node %v - %w", task.id, err))
+		return nil
+	}
+
+	// Frozen nodes, in particular those of archived tries, are hashed when
+	// being frozen and must not be modified afterwards. A dirty hash reveals
+	// an in-place modification.
+	if node.IsFrozen() {
+		if n, ok := node.(interface{ getHashStatus() hashStatus }); ok && n.getHashStatus() == hashStatusDirty {
+			c.addError(fmt.Errorf("frozen node %v is marked dirty", task.id))
 		}
+	}
 
-		// schedule child nodes to be checked
-		switch cur := node.(type) {
-		case EmptyNode:
-			// terminal node without children
-		case *AccountNode:
-			storage := cur.storage
-			if !storage.id.IsEmpty() {
-				err = scheduleNode(&storage, context.root, true, nil)
-			}
-		case *BranchNode:
-			for i := 0; i < 16; i++ {
-				child := cur.children[i]
-				if !child.id.IsEmpty() {
-					path := make([]Nibble, len(context.path)+1)
-					copy(path, context.path)
-					path[len(context.path)] = Nibble(i)
-					if err = scheduleNode(&child, context.root, context.hasSeenAccount, path); err != nil {
-						break
-					}
-				}
-			}
-		case *ExtensionNode:
-			next := cur.next
-			if !next.id.IsEmpty() {
-				path := make([]Nibble, len(context.path), len(context.path)+cur.path.Length())
+	var res []nodeCheckTask
+	schedule := func(ref *NodeReference, accountSeen bool, path []Nibble, archivedStorage bool) {
+		child := nodeCheckTask{
+			id: ref.Id(),
+			context: nodeCheckContext{
+				root:            context.root,
+				hasSeenAccount:  accountSeen,
+				archivedStorage: archivedStorage,
+				path:            path,
+			},
+		}
+		if c.paths != nil && node.IsFrozen() {
+			child.frozen = archivedStorage || (!accountSeen && c.paths.isOnPath(path))
+		}
+		if c.register(child) {
+			res = append(res, child)
+		}
+	}
+
+	switch cur := node.(type) {
+	case EmptyNode:
+		// terminal node without children
+	case *AccountNode:
+		storage := cur.storage
+		if !storage.id.IsEmpty() {
+			schedule(&storage, true, nil, c.paths != nil && c.paths.isArchived(cur.address))
+		}
+	case *BranchNode:
+		for i := 0; i < 16; i++ {
+			child := cur.children[i]
+			if !child.id.IsEmpty() {
+				path := make([]Nibble, len(context.path)+1)
 				copy(path, context.path)
-				for i := 0; i < cur.path.Length(); i++ {
-					path = append(path, cur.path.Get(i))
-				}
-				err = scheduleNode(&next, context.root, context.hasSeenAccount, path)
+				path[len(context.path)] = Nibble(i)
+				schedule(&child, context.hasSeenAccount, path, context.archivedStorage)
 			}
-		case *ValueNode:
-			// terminal node without children
-			if !context.hasSeenAccount {
-				err = fmt.Errorf("value node %v is reachable without passing an account", curNodeRef.Id())
+		}
+	case *ExtensionNode:
+		next := cur.next
+		if !next.id.IsEmpty() {
+			path := make([]Nibble, len(context.path), len(context.path)+cur.path.Length())
+			copy(path, context.path)
+			for i := 0; i < cur.path.Length(); i++ {
+				path = append(path, cur.path.Get(i))
 			}
+			schedule(&next, context.hasSeenAccount, path, context.archivedStorage)
 		}
-
-		handle.Release()
-		if err != nil {
-			return err
+	case *ValueNode:
+		// terminal node without children
+		if !context.hasSeenAccount {
+			c.addError(fmt.Errorf("value node %v is reachable without passing an account", task.id))
 		}
 	}
-	return nil
+	return res
+}
+
+// nodeCheckSource is the source handed to the checks of individual nodes by
+// a worker of a forest check. It provides the hasher used for verifying
+// embedded flags, such that each worker creates a single hasher instead of
+// one per checked child.
+type nodeCheckSource struct {
+	NodeSource
+	hasher hasher
+}
+
+func (s *nodeCheckSource) getArchivedAccounts() ([]common.Address, bool) {
+	if partial, ok := s.NodeSource.(partiallyFrozen); ok {
+		return partial.getArchivedAccounts()
+	}
+	return nil, false
+}
+
+func (s *nodeCheckSource) hasOpenForks() bool {
+	if forked, ok := s.NodeSource.(lazilyFrozen); ok {
+		return forked.hasOpenForks()
+	}
+	return false
+}
+
+// getCheckHasher returns the hasher to be used for checking the nodes of the
+// given source, creating a new one if the source does not provide any.
+func getCheckHasher(source NodeSource) hasher {
+	if s, ok := source.(*nodeCheckSource); ok {
+		return s.hasher
+	}
+	config := source.getConfig()
+	return config.Hashing.createHasher(config.HashFunction)
 }
 
 type nodeCheckContext struct {
-	root           NodeId
-	path           []Nibble
-	hasSeenAccount bool
+	root            NodeId
+	path            []Nibble
+	hasSeenAccount  bool
+	archivedStorage bool // set for nodes of the storage tries of archived accounts in partially frozen forests
 }
 
 func (c *nodeCheckContext) isCompatible(other *nodeCheckContext) bool {
@@ -475,6 +742,7 @@ type nodeBase struct {
 	hashStatus hashStatus  // indicating whether this node's hash is valid
 	clean      bool        // by default nodes are dirty (clean == false)
 	frozen     bool        // a flag marking the node as immutable (default: mutable)
+	generation uint32      // the version of this node's content, updated on every modification
 }
 
 type hashStatus byte
@@ -533,15 +801,49 @@ func (n *nodeBase) MarkClean() {
 	n.clean = true
 }
 
-func (n *nodeBase) markDirty() {
+// markDirty marks this node, referenced by the given reference, as modified.
+// If the node has been clean, the given manager is informed about it such that
+// it can keep track of the dirty nodes.
+func (n *nodeBase) markDirty(manager NodeManager, thisRef *NodeReference) {
+	if n.clean {
+		manager.trackDirtyNode(thisRef, true)
+	}
+	n.setDirty()
+}
+
+func (n *nodeBase) setDirty() {
 	n.clean = false
 	n.hashStatus = hashStatusDirty
+	n.generation++
 }
 
-func (n *nodeBase) Release() {
+// Release marks this node, referenced by the given reference, as released.
+// If the node has been dirty, the given manager is informed about it.
+func (n *nodeBase) Release(manager NodeManager, thisRef *NodeReference) {
 	// The node is disconnected from the disk version and thus clean.
+	if !n.clean {
+		manager.trackDirtyNode(thisRef, false)
+	}
 	n.clean = true
 	n.hashStatus = hashStatusClean
+	n.generation++
+}
+
+// markCopyDirty marks a node created by a manager and then overwritten by a
+// copy of another node as dirty. New nodes are dirty when being created, while
+// the copy retains the dirty state of its origin, which is thus reset without
+// informing the manager.
+func (n *nodeBase) markCopyDirty() {
+	n.setDirty()
+}
+
+// getGeneration returns the version of this node's content. The generation
+// changes whenever the node is modified or released. Generations are only
+// unique for a single node instance, which is sufficient since nodes loaded
+// into the node cache are always wrapped in fresh shared instances. The
+// generation is kept small such that nodeBase stays within 8-byte alignment.
+func (n *nodeBase) getGeneration() uint32 {
+	return n.generation
 }
 
 func (n *nodeBase) check(thisRef *NodeReference) error {
@@ -586,7 +888,7 @@ func (e EmptyNode) SetAccount(manager NodeManager, thisRef *NodeReference, this
 	}
 	defer handle.Release()
 	res := handle.Get().(*AccountNode)
-	res.markDirty()
+	res.markDirty(manager, &ref)
 	res.address = address
 	res.info = info
 	res.pathLength = byte(len(path))
@@ -605,8 +907,11 @@ func (e EmptyNode) SetValue(manager NodeManager, thisRef *NodeReference, this sh
 	res := handle.Get().(*ValueNode)
 	res.key = key
 	res.value = value
-	res.markDirty()
+	res.markDirty(manager, &ref)
 	res.pathLength = byte(len(path))
+	if observer, ok := manager.(valueInsertionObserver); ok {
+		observer.valueInserted(2*len(key) - len(path))
+	}
 	return ref, true, nil
 }
 
@@ -618,6 +923,11 @@ func (e EmptyNode) SetSlot(manager NodeManager, thisRef *NodeReference, this sha
 	return *thisRef, false, nil
 }
 
+func (e EmptyNode) SetSlots(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], address common.Address, path []Nibble, updates []SlotUpdate) (NodeReference, bool, error) {
+	// Like for SetSlot, the account does not exist and is not created.
+	return *thisRef, false, nil
+}
+
 func (e EmptyNode) ClearStorage(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], address common.Address, path []Nibble) (newRoot NodeReference, changed bool, err error) {
 	return *thisRef, false, nil
 }
@@ -663,8 +973,12 @@ func (EmptyNode) Dump(out io.Writer, _ NodeSource, thisRef *NodeReference, inden
 	return nil
 }
 
-func (EmptyNode) Visit(_ NodeSource, ref *NodeReference, depth int, visitor NodeVisitor) (bool, error) {
-	return visitor.Visit(EmptyNode{}, NodeInfo{Id: ref.Id(), Depth: &depth}) == VisitResponseAbort, nil
+func (n EmptyNode) Visit(source NodeSource, thisRef *NodeReference, depth int, visitor NodeVisitor) (bool, error) {
+	return n.visit(source, thisRef, visitPosition{depth: depth}, visitor)
+}
+
+func (EmptyNode) visit(_ NodeSource, ref *NodeReference, position visitPosition, visitor NodeVisitor) (bool, error) {
+	return visitor.Visit(EmptyNode{}, position.getInfo(ref.Id())) == VisitResponseAbort, nil
 }
 
 // ----------------------------------------------------------------------------
@@ -681,12 +995,20 @@ type BranchNode struct {
 	dirtyHashes      uint16            // a bit mask marking hashes as dirty; 0 .. clean, 1 .. dirty
 	embeddedChildren uint16            // a bit mask marking children as embedded; 0 .. not, 1 .. embedded
 	frozenChildren   uint16            // a bit mask marking frozen children; not persisted
+	// leafCount is the number of leaf nodes in the sub-trie rooted by this
+	// node, only valid if leafCountKnown is set. It is only maintained if
+	// the `TrackSubtreeLeafCounts` option of the `MptConfig` is enabled.
+	leafCount      uint64
+	leafCountKnown bool
 }
 
 func (n *BranchNode) getNextNodeInBranch(
 	source NodeSource,
 	path []Nibble,
 ) (shared.ReadHandle[Node], []Nibble, error) {
+	if err := checkRemainingPath("branch", 1, len(path)); err != nil {
+		return shared.ReadHandle[Node]{}, nil, err
+	}
 	next := &n.children[path[0]]
 	node, err := source.getReadAccess(next)
 	if err != nil {
@@ -729,22 +1051,55 @@ func (n *BranchNode) setNextNode(
 	path []Nibble,
 	createSubTree func(*NodeReference, shared.WriteHandle[Node], []Nibble) (NodeReference, bool, error),
 ) (NodeReference, bool, error) {
+	if err := checkRemainingPath("branch", 1, len(path)); err != nil {
+		return NodeReference{}, false, err
+	}
+
 	// Forward call to child node.
 	child := &n.children[path[0]]
 	node, err := manager.getWriteAccess(child)
 	if err != nil {
 		return NodeReference{}, false, err
 	}
+
+	// If tracked and known, the leaf count of this node is updated by the
+	// difference of the leaf counts of the modified child.
+	countLeaves := manager.getConfig().TrackSubtreeLeafCounts
+	leavesKnown := countLeaves && n.leafCountKnown
+	var leavesBefore, leavesAfter uint64
+	if leavesKnown {
+		leavesBefore, leavesKnown, err = getLeafCount(manager, node.Get())
+		if err != nil {
+			node.Release()
+			return NodeReference{}, false, err
+		}
+	}
+
 	newRoot, hasChanged, err := createSubTree(child, node, path[1:])
+	if err == nil && leavesKnown && newRoot.Id() == child.Id() {
+		leavesAfter, leavesKnown, err = getLeafCount(manager, node.Get())
+	}
 	node.Release()
 	if err != nil {
 		return NodeReference{}, false, err
 	}
+	if leavesKnown && newRoot.Id() != child.Id() {
+		leavesAfter, leavesKnown, err = getLeafCountOf(manager, &newRoot)
+		if err != nil {
+			return NodeReference{}, false, err
+		}
+	}
 
-	if newRoot.Id() == child.Id() {
+	// Children modified in-place can only be recorded in-place if this node
+	// is not frozen. Frozen nodes may only have non-frozen children in
+	// partially frozen tries, in which case a clone needs to be modified.
+	if newRoot.Id() == child.Id() && !(hasChanged && n.IsFrozen()) {
 		if hasChanged {
-			n.markDirty()
+			n.markDirty(manager, thisRef)
 			n.markChildHashDirty(byte(path[0]))
+			if countLeaves {
+				n.updateLeafCount(leavesBefore, leavesAfter, leavesKnown)
+			}
 		}
 		return *thisRef, hasChanged, nil
 	}
@@ -759,7 +1114,7 @@ func (n *BranchNode) setNextNode(
 		defer handle.Release()
 		newNode := handle.Get().(*BranchNode)
 		*newNode = *n
-		newNode.markDirty()
+		newNode.markCopyDirty()
 		newNode.markMutable()
 		n = newNode
 		thisRef = &newRef
@@ -772,98 +1127,167 @@ func (n *BranchNode) setNextNode(
 	n.setChildFrozen(byte(path[0]), false)
 
 	// If a branch got removed, check that there are enough children left.
-	if !wasEmpty && newRoot.Id().IsEmpty() {
+	// Without extension nodes, branches with a single branch child are
+	// retained, which need to be collapsed if this child gets replaced.
+	removed := !wasEmpty && newRoot.Id().IsEmpty()
+	if removed {
 		n.markChildHashClean(byte(path[0]))
-		count := 0
-		var remainingPos Nibble
-		var remaining NodeReference
-		for i, cur := range n.children {
-			if !cur.Id().IsEmpty() {
-				count++
-				if count > 1 {
-					break
-				}
-				remainingPos = Nibble(i)
-				remaining = cur
+	}
+	if countLeaves {
+		n.updateLeafCount(leavesBefore, leavesAfter, leavesKnown)
+	}
+	if removed || !newRoot.Id().IsBranch() {
+		if n.getNumChildren() < 2 && (removed || manager.getConfig().DisableExtensionNodes) {
+			// During batch updates, the collapse may be deferred to the end of
+			// the batch, avoiding repeated restructuring of this part of the trie.
+			if deferral, ok := manager.(branchCollapseDeferral); ok && deferral.tryDeferBranchCollapse() {
+				n.markDirty(manager, thisRef)
+				return *thisRef, !isClone, nil
 			}
+			newRoot, err := n.collapse(manager, thisRef, byte(len(path)))
+			return newRoot, !isClone, err
 		}
-		if count < 2 {
-			newRoot := remaining
-			// This branch became obsolete and needs to be removed.
-			if remaining.Id().IsExtension() {
-				// The present extension can be extended.
-				extension, err := manager.getWriteAccess(&remaining)
-				if err != nil {
-					return NodeReference{}, false, err
-				}
-				defer extension.Release()
-				extensionNode := extension.Get().(*ExtensionNode)
-
-				// If the extension is frozen, we need to modify a copy.
-				if extensionNode.IsFrozen() {
-					copyId, handle, err := manager.createExtension()
-					if err != nil {
-						return NodeReference{}, false, err
-					}
-					defer handle.Release()
-					copy := handle.Get().(*ExtensionNode)
-					*copy = *extensionNode
-					copy.markMutable()
-					extensionNode = copy
-					remaining = copyId
-					newRoot = copyId
-				}
+	}
 
-				extensionNode.path.Prepend(remainingPos)
-				extensionNode.markDirty()
-			} else if remaining.Id().IsBranch() {
-				// An extension needs to replace this branch.
-				extensionRef, handle, err := manager.createExtension()
-				if err != nil {
-					return NodeReference{}, false, err
-				}
-				defer handle.Release()
-				extension := handle.Get().(*ExtensionNode)
-				extension.path = SingleStepPath(remainingPos)
-				extension.next = remaining
-				extension.nextHashDirty = n.isChildHashDirty(byte(remainingPos))
-				if !extension.nextHashDirty {
-					extension.nextIsEmbedded = n.isEmbedded(byte(remainingPos))
-					extension.nextHash = n.hashes[byte(remainingPos)]
-				}
-				extension.markDirty()
-				newRoot = extensionRef
-			} else if manager.getConfig().TrackSuffixLengthsInLeafNodes {
-				// If suffix lengths need to be tracked, leaf nodes require an update.
-				if remaining.Id().IsAccount() {
-					handle, err := manager.getWriteAccess(&remaining)
-					if err != nil {
-						return NodeReference{}, false, err
-					}
-					newRoot, _, err = handle.Get().(*AccountNode).setPathLength(manager, &remaining, handle, byte(len(path)))
-					handle.Release()
-					if err != nil {
-						return NodeReference{}, false, err
-					}
-				} else if remaining.Id().IsValue() {
-					handle, err := manager.getWriteAccess(&remaining)
-					if err != nil {
-						return NodeReference{}, false, err
-					}
-					newRoot, _, err = handle.Get().(*ValueNode).setPathLength(manager, &remaining, handle, byte(len(path)))
-					handle.Release()
-					if err != nil {
-						return NodeReference{}, false, err
-					}
-				}
-			}
-			n.nodeBase.Release()
-			return newRoot, !isClone, manager.release(thisRef)
+	n.markDirty(manager, thisRef)
+	return *thisRef, !isClone, err
+}
+
+// getNumChildren returns the number of non-empty children of this branch.
+func (n *BranchNode) getNumChildren() int {
+	count := 0
+	for _, cur := range n.children {
+		if !cur.Id().IsEmpty() {
+			count++
 		}
 	}
+	return count
+}
 
-	n.markDirty()
-	return *thisRef, !isClone, err
+// updateLeafCount updates the number of leaves in the sub-trie rooted by this
+// node after the number of leaves in one of its children changed from before
+// to after. If any of those counts is not known, the count of this node gets
+// unknown as well. Thus, unknown counts propagate towards the root, instead of
+// being computed by visiting sub-tries, until they are established by an
+// explicit backfill of the leaf counts of a trie.
+func (n *BranchNode) updateLeafCount(before, after uint64, known bool) {
+	if n.leafCountKnown && known {
+		n.leafCount = n.leafCount - before + after
+		return
+	}
+	n.leafCount, n.leafCountKnown = 0, false
+}
+
+func (n *BranchNode) setLeafCount(count uint64) {
+	n.leafCount = count
+	n.leafCountKnown = true
+}
+
+// getLeafCount returns the number of leaf nodes in the sub-trie rooted by
+// the given node and whether this number is known. Leaf nodes are the account
+// nodes of the account trie and the value nodes of storage tries. Leaf counts
+// of branch nodes not known are reported as such, without visiting sub-tries.
+func getLeafCount(source NodeSource, node Node) (uint64, bool, error) {
+	switch n := node.(type) {
+	case *AccountNode, *ValueNode:
+		return 1, true, nil
+	case *BranchNode:
+		return n.leafCount, n.leafCountKnown, nil
+	case *ExtensionNode:
+		return getLeafCountOf(source, &n.next)
+	}
+	return 0, true, nil
+}
+
+// getLeafCountOf is a variant of getLeafCount for referenced nodes.
+func getLeafCountOf(source NodeSource, ref *NodeReference) (uint64, bool, error) {
+	if ref.Id().IsEmpty() {
+		return 0, true, nil
+	}
+	handle, err := source.getViewAccess(ref)
+	if err != nil {
+		return 0, false, err
+	}
+	defer handle.Release()
+	return getLeafCount(source, handle.Get())
+}
+
+// collapse removes this branch node, which is required to have less than two
+// children, from the trie. The remaining child, if any, is merged into the
+// position of this branch, which is at the given number of nibbles from the
+// end of the path. The new root of the sub-trie is returned. If extension
+// nodes are disabled, a branch with a single branch child is retained.
+func (n *BranchNode) collapse(manager NodeManager, thisRef *NodeReference, pathLength byte) (NodeReference, error) {
+	var remainingPos Nibble
+	remaining := NewNodeReference(EmptyId())
+	for i, cur := range n.children {
+		if !cur.Id().IsEmpty() {
+			remainingPos = Nibble(i)
+			remaining = cur
+			break
+		}
+	}
+
+	if remaining.Id().IsBranch() && manager.getConfig().DisableExtensionNodes {
+		n.markDirty(manager, thisRef)
+		return *thisRef, nil
+	}
+
+	newRoot := remaining
+	if remaining.Id().IsExtension() {
+		// The present extension can be extended.
+		extension, err := manager.getWriteAccess(&remaining)
+		if err != nil {
+			return NodeReference{}, err
+		}
+		defer extension.Release()
+		extensionNode := extension.Get().(*ExtensionNode)
+		extensionRef := remaining
+
+		// If the extension is frozen, we need to modify a copy.
+		if extensionNode.IsFrozen() {
+			copyId, handle, err := manager.createExtension()
+			if err != nil {
+				return NodeReference{}, err
+			}
+			defer handle.Release()
+			copy := handle.Get().(*ExtensionNode)
+			*copy = *extensionNode
+			copy.markCopyDirty()
+			copy.markMutable()
+			extensionNode = copy
+			extensionRef = copyId
+			newRoot = copyId
+		}
+
+		extensionNode.path.Prepend(remainingPos)
+		extensionNode.markDirty(manager, &extensionRef)
+	} else if remaining.Id().IsBranch() {
+		// An extension needs to replace this branch.
+		extensionRef, handle, err := manager.createExtension()
+		if err != nil {
+			return NodeReference{}, err
+		}
+		defer handle.Release()
+		extension := handle.Get().(*ExtensionNode)
+		extension.path = SingleStepPath(remainingPos)
+		extension.next = remaining
+		extension.nextHashDirty = n.isChildHashDirty(byte(remainingPos))
+		if !extension.nextHashDirty {
+			extension.nextIsEmbedded = n.isEmbedded(byte(remainingPos))
+			extension.nextHash = n.hashes[byte(remainingPos)]
+		}
+		extension.markDirty(manager, &extensionRef)
+		newRoot = extensionRef
+	} else if manager.getConfig().TrackSuffixLengthsInLeafNodes {
+		var err error
+		newRoot, err = setLeafPathLength(manager, remaining, pathLength)
+		if err != nil {
+			return NodeReference{}, err
+		}
+	}
+	n.nodeBase.Release(manager, thisRef)
+	return newRoot, manager.release(thisRef)
 }
 
 func (n *BranchNode) SetAccount(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], address common.Address, path []Nibble, info AccountInfo) (NodeReference, bool, error) {
@@ -890,6 +1314,14 @@ func (n *BranchNode) SetSlot(manager NodeManager, thisRef *NodeReference, this s
 	)
 }
 
+func (n *BranchNode) SetSlots(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], address common.Address, path []Nibble, updates []SlotUpdate) (NodeReference, bool, error) {
+	return n.setNextNode(manager, thisRef, this, path,
+		func(next *NodeReference, node shared.WriteHandle[Node], path []Nibble) (NodeReference, bool, error) {
+			return node.Get().SetSlots(manager, next, node, address, path, updates)
+		},
+	)
+}
+
 func (n *BranchNode) ClearStorage(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], address common.Address, path []Nibble) (newRoot NodeReference, changed bool, err error) {
 	return n.setNextNode(manager, thisRef, this, path,
 		func(next *NodeReference, node shared.WriteHandle[Node], path []Nibble) (NodeReference, bool, error) {
@@ -902,7 +1334,7 @@ func (n *BranchNode) Release(manager NodeManager, thisRef *NodeReference, this s
 	if n.IsFrozen() {
 		return nil
 	}
-	n.nodeBase.Release()
+	n.nodeBase.Release(manager, thisRef)
 	for _, cur := range n.children {
 		if !cur.Id().IsEmpty() {
 			handle, err := manager.getWriteAccess(&cur)
@@ -928,7 +1360,6 @@ func (n *BranchNode) Freeze(manager NodeManager, this shared.WriteHandle[Node])
 	if n.IsFrozen() {
 		return nil
 	}
-	n.nodeBase.MarkFrozen()
 	for i := 0; i < len(n.children); i++ {
 		if n.children[i].Id().IsEmpty() || n.isChildFrozen(byte(i)) {
 			continue
@@ -944,15 +1375,22 @@ func (n *BranchNode) Freeze(manager NodeManager, this shared.WriteHandle[Node])
 		}
 		n.setChildFrozen(byte(i), true)
 	}
+	// The node itself is only marked frozen after all of its children.
+	n.nodeBase.MarkFrozen()
 	return nil
 }
 
 func (n *BranchNode) Check(source NodeSource, thisRef *NodeReference, _ []Nibble) error {
 	// Checked invariants:
-	//  - must have 2+ children
+	//  - must have 2+ children, or a single branch child if extensions are disabled
 	//  - non-dirty hashes for child nodes are valid
+	//  - non-dirty embedded flags match the encoded size of child nodes
 	//  - mask of frozen children is consistent
+	//  - a known leaf count matches the leaves of all children (if tracked)
 	numChildren := 0
+	leafCount := uint64(0)
+	checkLeafCount := n.leafCountKnown && source.getConfig().TrackSubtreeLeafCounts
+	var lastChild NodeId
 	var errs []error
 
 	if err := n.nodeBase.check(thisRef); err != nil {
@@ -964,11 +1402,13 @@ func (n *BranchNode) Check(source NodeSource, thisRef *NodeReference, _ []Nibble
 		errs = append(errs, fmt.Errorf("node %v is has clean hash but child hashes are dirty: %016b", thisRef.Id(), n.dirtyHashes))
 	}
 
+	hasher := getCheckHasher(source)
 	for i, child := range n.children {
 		if child.Id().IsEmpty() {
 			continue
 		}
 		numChildren++
+		lastChild = child.Id()
 		if !n.isChildHashDirty(byte(i)) && !n.isEmbedded(byte(i)) {
 			want, err := source.getHashFor(&child)
 			if err != nil {
@@ -982,6 +1422,24 @@ func (n *BranchNode) Check(source NodeSource, thisRef *NodeReference, _ []Nibble
 			return err
 		}
 
+		// rule: a clean embedded flag matches the encoded size of the child
+		if !n.isChildHashDirty(byte(i)) {
+			if err := checkEmbeddedFlag(hasher, source, handle.Get(), n.isEmbedded(byte(i))); err != nil {
+				errs = append(errs, fmt.Errorf("in node %v the embedded flag for child 0x%X is invalid: %w", thisRef.Id(), i, err))
+			}
+		}
+
+		// rule: known leaf counts imply known leaf counts of all children
+		if checkLeafCount {
+			leaves, known, err := getLeafCount(source, handle.Get())
+			if err != nil {
+				errs = append(errs, err)
+			} else if !known {
+				errs = append(errs, fmt.Errorf("node %v has a known leaf count, yet the leaf count of child 0x%X is unknown", thisRef.Id(), i))
+			}
+			leafCount += leaves
+		}
+
 		childIsFrozen := handle.Get().IsFrozen()
 		handle.Release()
 
@@ -990,17 +1448,38 @@ func (n *BranchNode) Check(source NodeSource, thisRef *NodeReference, _ []Nibble
 			errs = append(errs, fmt.Errorf("in node %v the frozen flag for child 0x%X is invalid, flag: %t, actual: %t", thisRef.Id(), i, flag, childIsFrozen))
 		}
 
-		// rule: if this node is frozen, all children must be frozen
-		if n.IsFrozen() && !childIsFrozen {
+		// rule: if this node is frozen, all children must be frozen, unless
+		// the trie is only partially frozen
+		if n.IsFrozen() && !childIsFrozen && !allowsNonFrozenDescendants(source) {
 			errs = append(errs, fmt.Errorf("the frozen node %v must not have a non-frozen child at position 0x%X", thisRef.Id(), i))
 		}
 	}
-	if numChildren < 2 {
+	// rule: without extension nodes, a single child is allowed if it is a branch
+	if numChildren < 2 && !(numChildren == 1 && lastChild.IsBranch() && source.getConfig().DisableExtensionNodes) {
 		errs = append(errs, fmt.Errorf("node %v has an insufficient number of child nodes: %d", thisRef.Id(), numChildren))
 	}
+	// rule: the leaf count is the sum of the leaves of all children
+	if checkLeafCount && leafCount != n.leafCount {
+		errs = append(errs, fmt.Errorf("node %v has an invalid leaf count, wanted %d, got %d", thisRef.Id(), leafCount, n.leafCount))
+	}
 	return errors.Join(errs...)
 }
 
+// checkEmbeddedFlag verifies that the given embedded flag stored in a parent
+// node matches the current encoded size of the given child node. Nodes are
+// embedded in their parents if their RLP encoding is less than 32 bytes,
+// which may change whenever the content of the child changes.
+func checkEmbeddedFlag(hasher hasher, source NodeSource, child Node, flag bool) error {
+	embedded, err := hasher.isEmbedded(child, source)
+	if err != nil {
+		return err
+	}
+	if flag != embedded {
+		return fmt.Errorf("flag: %t, actual: %t", flag, embedded)
+	}
+	return nil
+}
+
 func (n *BranchNode) Dump(out io.Writer, source NodeSource, thisRef *NodeReference, indent string) error {
 	errs := []error{}
 	fmt.Fprintf(out, "%sBranch (ID: %v, dirty: %t, frozen: %t, Dirty: %016b, Embedded: %016b, Frozen: %016b, Hash: %v, hashState: %v):\n", indent, thisRef.Id(), n.IsDirty(), n.IsFrozen(), n.dirtyHashes, n.embeddedChildren, n.frozenChildren, formatHashForDump(n.hash), n.getHashStatus())
@@ -1022,21 +1501,27 @@ func (n *BranchNode) Dump(out io.Writer, source NodeSource, thisRef *NodeReferen
 }
 
 func (b *BranchNode) Visit(source NodeSource, thisRef *NodeReference, depth int, visitor NodeVisitor) (bool, error) {
-	switch visitor.Visit(b, NodeInfo{Id: thisRef.Id(), Depth: &depth}) {
+	return b.visit(source, thisRef, visitPosition{depth: depth}, visitor)
+}
+
+func (b *BranchNode) visit(source NodeSource, thisRef *NodeReference, position visitPosition, visitor NodeVisitor) (bool, error) {
+	switch visitor.Visit(b, position.getInfo(thisRef.Id())) {
 	case VisitResponseAbort:
 		return true, nil
 	case VisitResponsePrune:
 		return false, nil
 	case VisitResponseContinue: /* keep going */
 	}
-	for _, child := range b.children {
+	// Children are visited in ascending nibble order, as guaranteed by Visit.
+	for i, child := range b.children {
 		if child.Id().IsEmpty() {
 			continue
 		}
 
 		if handle, err := source.getViewAccess(&child); err == nil {
 			defer handle.Release()
-			if abort, err := handle.Get().Visit(source, &child, depth+1, visitor); abort || err != nil {
+			childPosition := position.getChildPosition(thisRef.Id(), Nibble(i))
+			if abort, err := handle.Get().visit(source, &child, childPosition, visitor); abort || err != nil {
 				return abort, err
 			}
 		} else {
@@ -1106,6 +1591,9 @@ func (n *ExtensionNode) getNextNodeInExtension(
 	source NodeSource,
 	path []Nibble,
 ) (shared.ReadHandle[Node], []Nibble, error) {
+	if err := checkRemainingPath("extension", n.path.Length(), len(path)); err != nil {
+		return shared.ReadHandle[Node]{}, nil, err
+	}
 	if !n.path.IsPrefixOf(path) {
 		shared := shared.MakeShared[Node](EmptyNode{})
 		return shared.GetReadHandle(), nil, nil
@@ -1151,6 +1639,10 @@ func (n *ExtensionNode) setNextNode(
 	valueIsEmpty bool,
 	createSubTree func(*NodeReference, shared.WriteHandle[Node], []Nibble) (NodeReference, bool, error),
 ) (NodeReference, bool, error) {
+	if err := checkRemainingPath("extension", n.path.Length(), len(path)); err != nil {
+		return NodeReference{}, false, err
+	}
+
 	// Check whether the updates targets the node referenced by this extension.
 	if n.path.IsPrefixOf(path) {
 		handle, err := manager.getWriteAccess(&n.next)
@@ -1165,9 +1657,13 @@ func (n *ExtensionNode) setNextNode(
 
 		// The modified sub-trie is either a branch, extension, account, or
 		// value node. It can not be empty, since a single modification cannot
-		// convert a branch node into an empty node.
+		// convert a branch node into an empty node. Branches emptied during
+		// batch updates with deferred collapses are retained until the end of
+		// the batch.
 
-		if newRoot != n.next {
+		// Frozen nodes with a next node modified in-place, as it may happen in
+		// partially frozen tries, need to be cloned as well.
+		if newRoot != n.next || (hasChanged && n.IsFrozen()) {
 
 			// If frozen, modify a clone.
 			isClone := false
@@ -1179,69 +1675,23 @@ func (n *ExtensionNode) setNextNode(
 				defer handle.Release()
 				newNode := handle.Get().(*ExtensionNode)
 				*newNode = *n
-				newNode.markDirty()
+				newNode.markCopyDirty()
 				newNode.markMutable()
 				thisRef, n = &newRef, newNode
 				isClone = true
 			}
 
-			// The referenced sub-tree has changed, so the hash needs to be updated.
-			n.nextHashDirty = true
-
-			if newRoot.Id().IsExtension() {
-				// If the new next is an extension, merge it into this extension.
-				handle, err := manager.getWriteAccess(&newRoot)
-				if err != nil {
-					return NodeReference{}, false, err
-				}
-				defer handle.Release()
-				extension := handle.Get().(*ExtensionNode)
-				n.path.AppendAll(&extension.path)
-				n.next = extension.next
-				n.nextHashDirty = extension.nextHashDirty
-				if !extension.nextHashDirty {
-					n.nextHash = extension.nextHash
-					n.nextIsEmbedded = extension.nextIsEmbedded
-				}
-				n.markDirty()
-				extension.nodeBase.Release()
-				if err := manager.release(&newRoot); err != nil {
-					return NodeReference{}, false, err
-				}
-			} else if newRoot.Id().IsBranch() {
-				n.next = newRoot
-				n.nextHashDirty = true
-				n.markDirty()
-			} else {
-				// If the next node is anything but a branch or extension, remove this extension.
-				n.nodeBase.Release()
-				if err := manager.release(thisRef); err != nil {
-					return NodeReference{}, false, err
-				}
-
-				// Grow path length of next nodes if tracking of length is enabled.
-				if manager.getConfig().TrackSuffixLengthsInLeafNodes {
-					root, err := manager.getWriteAccess(&newRoot)
-					if err != nil {
-						return NodeReference{}, false, err
-					}
-					if newRoot.Id().IsAccount() {
-						newRoot, _, err = root.Get().(*AccountNode).setPathLength(manager, &newRoot, root, byte(len(path)))
-					} else if newRoot.Id().IsValue() {
-						newRoot, _, err = root.Get().(*ValueNode).setPathLength(manager, &newRoot, root, byte(len(path)))
-					} else {
-						panic(fmt.Sprintf("unsupported new next node type: %v", newRoot))
-					}
-					root.Release()
-					if err != nil {
-						return NodeReference{}, false, err
-					}
-				}
-
-				return newRoot, !isClone, nil
+			root, retained, err := n.replaceNext(manager, thisRef, newRoot, byte(len(path)))
+			if err != nil {
+				return NodeReference{}, false, err
+			}
+			if !retained {
+				return root, !isClone, nil
 			}
+			// This node got modified, unless a clone got created.
+			hasChanged = !isClone
 		} else if hasChanged {
-			n.markDirty()
+			n.markDirty(manager, thisRef)
 			n.nextHashDirty = true
 		}
 		return *thisRef, hasChanged, err
@@ -1262,7 +1712,7 @@ func (n *ExtensionNode) setNextNode(
 		defer handle.Release()
 		newNode := handle.Get().(*ExtensionNode)
 		*newNode = *n
-		newNode.markDirty()
+		newNode.markCopyDirty()
 		newNode.markMutable()
 		thisRef, n = &newRef, newNode
 		isClone = true
@@ -1273,6 +1723,19 @@ func (n *ExtensionNode) setNextNode(
 	//  - a branch node
 	//  - an optional extension connecting to the previous next node
 
+	// The leaf count of the new branch needs to be obtained before this node
+	// is restructured, since this node may become a child of the branch or
+	// be redirected to it, and can thus not be used to reach the next node.
+	countLeaves := manager.getConfig().TrackSubtreeLeafCounts
+	var leaves uint64
+	if countLeaves {
+		var err error
+		leaves, countLeaves, err = getLeafCountOf(manager, &n.next)
+		if err != nil {
+			return NodeReference{}, false, err
+		}
+	}
+
 	// Create the branch node that will be needed in any case.
 	branchRef, branchHandle, err := manager.createBranch()
 	if err != nil {
@@ -1292,7 +1755,7 @@ func (n *ExtensionNode) setNextNode(
 		branch.children[n.path.Get(commonPrefixLength)] = *thisRef
 		branch.markChildHashDirty(byte(n.path.Get(commonPrefixLength)))
 		n.path.ShiftLeft(commonPrefixLength + 1)
-		n.markDirty()
+		n.markDirty(manager, thisRef)
 		thisNodeWasReused = true
 	} else {
 		pos := byte(n.path.Get(commonPrefixLength))
@@ -1326,10 +1789,15 @@ func (n *ExtensionNode) setNextNode(
 		extension.path = CreatePathFromNibbles(path[0:commonPrefixLength])
 		extension.next = branchRef
 		extension.nextHashDirty = true
-		extension.markDirty()
+		extension.markDirty(manager, &extensionRef)
 		newRoot = extensionRef
 	}
 
+	// The new branch covers the sub-trie of the previous next node.
+	if countLeaves {
+		branch.setLeafCount(leaves)
+	}
+
 	// Continue insertion of new account at new branch level.
 	_, _, err = createSubTree(&branchRef, branchHandle, path[commonPrefixLength:])
 	if err != nil {
@@ -1338,13 +1806,69 @@ func (n *ExtensionNode) setNextNode(
 
 	// If this node was not needed any more, we can discard it.
 	if !thisNodeWasReused {
-		n.nodeBase.Release()
+		n.nodeBase.Release(manager, thisRef)
 		return newRoot, false, manager.release(thisRef)
 	}
 
 	return newRoot, !isClone, nil
 }
 
+// replaceNext updates the node referenced by this extension to the given
+// node, which is at the given number of nibbles from the end of the path. If
+// the new next node is an extension, it is merged into this node. If it is
+// neither a branch nor an extension, this extension is removed from the
+// trie. The resulting root of the sub-trie is returned, together with a flag
+// indicating whether this extension was retained.
+func (n *ExtensionNode) replaceNext(manager NodeManager, thisRef *NodeReference, next NodeReference, pathLength byte) (NodeReference, bool, error) {
+	// The referenced sub-tree has changed, so the hash needs to be updated.
+	n.nextHashDirty = true
+
+	if next.Id().IsExtension() {
+		// If the new next is an extension, merge it into this extension.
+		handle, err := manager.getWriteAccess(&next)
+		if err != nil {
+			return NodeReference{}, false, err
+		}
+		defer handle.Release()
+		extension := handle.Get().(*ExtensionNode)
+		n.path.AppendAll(&extension.path)
+		n.next = extension.next
+		n.nextHashDirty = extension.nextHashDirty
+		if !extension.nextHashDirty {
+			n.nextHash = extension.nextHash
+			n.nextIsEmbedded = extension.nextIsEmbedded
+		}
+		n.markDirty(manager, thisRef)
+		extension.nodeBase.Release(manager, &next)
+		if err := manager.release(&next); err != nil {
+			return NodeReference{}, false, err
+		}
+		return *thisRef, true, nil
+	}
+
+	if next.Id().IsBranch() {
+		n.next = next
+		n.markDirty(manager, thisRef)
+		return *thisRef, true, nil
+	}
+
+	// If the next node is anything but a branch or extension, remove this extension.
+	n.nodeBase.Release(manager, thisRef)
+	if err := manager.release(thisRef); err != nil {
+		return NodeReference{}, false, err
+	}
+
+	// Grow path length of next nodes if tracking of length is enabled.
+	if manager.getConfig().TrackSuffixLengthsInLeafNodes {
+		var err error
+		next, err = setLeafPathLength(manager, next, pathLength)
+		if err != nil {
+			return NodeReference{}, false, err
+		}
+	}
+	return next, false, nil
+}
+
 func (n *ExtensionNode) SetAccount(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], address common.Address, path []Nibble, info AccountInfo) (NodeReference, bool, error) {
 	return n.setNextNode(manager, thisRef, path, info.IsEmpty(),
 		func(next *NodeReference, node shared.WriteHandle[Node], path []Nibble) (NodeReference, bool, error) {
@@ -1369,6 +1893,14 @@ func (n *ExtensionNode) SetSlot(manager NodeManager, thisRef *NodeReference, thi
 	)
 }
 
+func (n *ExtensionNode) SetSlots(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], address common.Address, path []Nibble, updates []SlotUpdate) (NodeReference, bool, error) {
+	return n.setNextNode(manager, thisRef, path, true,
+		func(next *NodeReference, node shared.WriteHandle[Node], path []Nibble) (NodeReference, bool, error) {
+			return node.Get().SetSlots(manager, next, node, address, path, updates)
+		},
+	)
+}
+
 func (n *ExtensionNode) ClearStorage(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], address common.Address, path []Nibble) (newRoot NodeReference, hasChanged bool, err error) {
 	return n.setNextNode(manager, thisRef, path, true,
 		func(next *NodeReference, node shared.WriteHandle[Node], path []Nibble) (NodeReference, bool, error) {
@@ -1381,7 +1913,7 @@ func (n *ExtensionNode) Release(manager NodeManager, thisRef *NodeReference, thi
 	if n.IsFrozen() {
 		return nil
 	}
-	n.nodeBase.Release()
+	n.nodeBase.Release(manager, thisRef)
 	handle, err := manager.getWriteAccess(&n.next)
 	if err != nil {
 		return err
@@ -1398,20 +1930,26 @@ func (n *ExtensionNode) Freeze(manager NodeManager, this shared.WriteHandle[Node
 	if n.IsFrozen() {
 		return nil
 	}
-	n.MarkFrozen()
 	handle, err := manager.getWriteAccess(&n.next)
 	if err != nil {
 		return err
 	}
-	defer handle.Release()
-	return handle.Get().Freeze(manager, handle)
+	err = handle.Get().Freeze(manager, handle)
+	handle.Release()
+	if err != nil {
+		return err
+	}
+	n.MarkFrozen()
+	return nil
 }
 
 func (n *ExtensionNode) Check(source NodeSource, thisRef *NodeReference, _ []Nibble) error {
 	// Checked invariants:
+	//  - extensions are enabled by the configuration
 	//  - extension path have a length > 0
 	//  - extension can only be followed by a branch
 	//  - hash of sub-tree is either dirty or correct
+	//  - embedded flag is either dirty or matches the encoded size of the next node
 	//  - frozen flags are consistent
 	var errs []error
 
@@ -1424,6 +1962,9 @@ func (n *ExtensionNode) Check(source NodeSource, thisRef *NodeReference, _ []Nib
 		errs = append(errs, fmt.Errorf("node %v is marked to have a clean hash but next hash is dirty", thisRef.Id()))
 	}
 
+	if source.getConfig().DisableExtensionNodes {
+		errs = append(errs, fmt.Errorf("node %v - extension nodes are disabled by the configuration", thisRef.Id()))
+	}
 	if n.path.Length() <= 0 {
 		errs = append(errs, fmt.Errorf("node %v - extension path must not be empty", thisRef.Id()))
 	}
@@ -1444,9 +1985,14 @@ func (n *ExtensionNode) Check(source NodeSource, thisRef *NodeReference, _ []Nib
 		if err != nil {
 			errs = append(errs, err)
 		} else {
+			if !n.nextHashDirty {
+				if err := checkEmbeddedFlag(getCheckHasher(source), source, handle.Get(), n.nextIsEmbedded); err != nil {
+					errs = append(errs, fmt.Errorf("node %v - embedded flag of next node is invalid: %w", thisRef.Id(), err))
+				}
+			}
 			nextIsFrozen := handle.Get().IsFrozen()
 			handle.Release()
-			if n.IsFrozen() && !nextIsFrozen {
+			if n.IsFrozen() && !nextIsFrozen && !allowsNonFrozenDescendants(source) {
 				errs = append(errs, fmt.Errorf("the frozen node %v must have a frozen next", thisRef.Id()))
 			}
 		}
@@ -1471,7 +2017,11 @@ func (n *ExtensionNode) Dump(out io.Writer, source NodeSource, thisRef *NodeRefe
 }
 
 func (n *ExtensionNode) Visit(source NodeSource, thisRef *NodeReference, depth int, visitor NodeVisitor) (bool, error) {
-	response := visitor.Visit(n, NodeInfo{Id: thisRef.Id(), Depth: &depth})
+	return n.visit(source, thisRef, visitPosition{depth: depth}, visitor)
+}
+
+func (n *ExtensionNode) visit(source NodeSource, thisRef *NodeReference, position visitPosition, visitor NodeVisitor) (bool, error) {
+	response := visitor.Visit(n, position.getInfo(thisRef.Id()))
 	switch response {
 	case VisitResponseAbort:
 		return true, nil
@@ -1480,7 +2030,7 @@ func (n *ExtensionNode) Visit(source NodeSource, thisRef *NodeReference, depth i
 	}
 	if handle, err := source.getViewAccess(&n.next); err == nil {
 		defer handle.Release()
-		return handle.Get().Visit(source, &n.next, depth+1, visitor)
+		return handle.Get().visit(source, &n.next, position.getNextPosition(thisRef.Id(), &n.path), visitor)
 	} else {
 		return false, err
 	}
@@ -1532,7 +2082,9 @@ func (n *AccountNode) GetSlot(source NodeSource, address common.Address, path []
 	if n.address != address {
 		return common.Value{}, false, nil
 	}
-	subPath := KeyToNibblePath(key, source)
+	buffer := getNibblePathBuffer()
+	defer buffer.release()
+	subPath := buffer.setKey(key, source)
 	root, err := source.getReadAccess(&n.storage)
 	if err != nil {
 		return common.Value{}, false, err
@@ -1556,7 +2108,7 @@ func (n *AccountNode) SetAccount(manager NodeManager, thisRef *NodeReference, th
 				manager.releaseTrieAsynchronous(n.storage)
 			}
 			// Release this account node and remove it from the trie.
-			n.nodeBase.Release()
+			n.nodeBase.Release(manager, thisRef)
 			return NewNodeReference(EmptyId()), false, manager.release(thisRef)
 		}
 
@@ -1570,14 +2122,14 @@ func (n *AccountNode) SetAccount(manager NodeManager, thisRef *NodeReference, th
 			defer handle.Release()
 			newNode := handle.Get().(*AccountNode)
 			*newNode = *n
-			newNode.markDirty()
+			newNode.markCopyDirty()
 			newNode.markMutable()
 			newNode.info = info
 			return newRef, false, nil
 		}
 
 		n.info = info
-		n.markDirty()
+		n.markDirty(manager, thisRef)
 		return *thisRef, true, nil
 	}
 
@@ -1595,9 +2147,11 @@ func (n *AccountNode) SetAccount(manager NodeManager, thisRef *NodeReference, th
 	sibling := handle.Get().(*AccountNode)
 	sibling.address = address
 	sibling.info = info
-	sibling.markDirty()
+	sibling.markDirty(manager, &siblingRef)
 
-	thisPath := AddressToNibblePath(n.address, manager)
+	buffer := getNibblePathBuffer()
+	defer buffer.release()
+	thisPath := buffer.setAddress(n.address, manager)
 	newRoot, err := splitLeafNode(manager, thisRef, thisPath[:], n, this, path, &siblingRef, sibling, handle)
 	return newRoot, !n.IsFrozen() && manager.getConfig().TrackSuffixLengthsInLeafNodes, err
 }
@@ -1634,7 +2188,24 @@ func splitLeafNode(
 	// Check whether there is a common prefix.
 	partialPath := thisPath[len(thisPath)-len(siblingPath):]
 	commonPrefixLength := GetCommonPrefixLength(partialPath, siblingPath)
-	if commonPrefixLength > 0 {
+	if commonPrefixLength > 0 && manager.getConfig().DisableExtensionNodes {
+		// The common prefix is covered by a chain of single-child branches.
+		for i := commonPrefixLength - 1; i >= 0; i-- {
+			ref, handle, err := manager.createBranch()
+			if err != nil {
+				return NodeReference{}, err
+			}
+			link := handle.Get().(*BranchNode)
+			link.children[siblingPath[i]] = newRoot
+			link.markChildHashDirty(byte(siblingPath[i]))
+			if manager.getConfig().TrackSubtreeLeafCounts {
+				link.setLeafCount(2)
+			}
+			link.markDirty(manager, &ref)
+			handle.Release()
+			newRoot = ref
+		}
+	} else if commonPrefixLength > 0 {
 		extensionRef, handle, err := manager.createExtension()
 		if err != nil {
 			return NodeReference{}, err
@@ -1646,7 +2217,7 @@ func splitLeafNode(
 		extension.path = CreatePathFromNibbles(siblingPath[0:commonPrefixLength])
 		extension.next = branchRef
 		extension.nextHashDirty = true
-		extension.markDirty()
+		extension.markDirty(manager, &extensionRef)
 	}
 
 	// If enabled, keep track of the suffix length of leaf values.
@@ -1668,7 +2239,10 @@ func splitLeafNode(
 	branch.children[partialPath[commonPrefixLength]] = *thisRef
 	branch.children[siblingPath[commonPrefixLength]] = *siblingRef
 	branch.markChildHashDirty(byte(siblingPath[commonPrefixLength]))
-	branch.markDirty()
+	if manager.getConfig().TrackSubtreeLeafCounts {
+		branch.setLeafCount(2)
+	}
+	branch.markDirty(manager, &branchRef)
 
 	// Update hash if present.
 	if hash, dirty := this.GetHash(); thisModified || dirty {
@@ -1695,6 +2269,10 @@ func (n *AccountNode) SetValue(manager NodeManager, thisRef *NodeReference, this
 }
 
 func (n *AccountNode) SetSlot(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], address common.Address, path []Nibble, key common.Key, value common.Value) (NodeReference, bool, error) {
+	return n.SetSlots(manager, thisRef, this, address, path, []SlotUpdate{{Key: key, Value: value}})
+}
+
+func (n *AccountNode) SetSlots(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], address common.Address, path []Nibble, updates []SlotUpdate) (NodeReference, bool, error) {
 	// If this is not the correct account, the real account does not exist
 	// and the insert can be skipped. The insertion of a slot value shall
 	// not create an account.
@@ -1702,18 +2280,21 @@ func (n *AccountNode) SetSlot(manager NodeManager, thisRef *NodeReference, this
 		return *thisRef, false, nil
 	}
 
-	// Continue from here with a value insertion.
-	handle, err := manager.getWriteAccess(&n.storage)
-	if err != nil {
-		return NodeReference{}, false, err
+	// Updates exceeding the depth limit are refused before any modification.
+	if limit := manager.getConfig().MaxStorageDepth; limit > 0 {
+		if err := checkStorageDepth(manager, &n.storage, address, updates, limit); err != nil {
+			return NodeReference{}, false, err
+		}
 	}
-	defer handle.Release()
-	subPath := KeyToNibblePath(key, manager)
-	root, hasChanged, err := handle.Get().SetValue(manager, &n.storage, handle, key, subPath[:], value)
+
+	// Continue from here with value insertions into the storage trie.
+	root, hasChanged, err := n.setValues(manager, updates)
 	if err != nil {
 		return NodeReference{}, false, err
 	}
-	if root != n.storage {
+	// Frozen nodes with a storage modified in-place, as it may happen in
+	// partially frozen tries, need to be cloned as well.
+	if root != n.storage || (hasChanged && n.IsFrozen()) {
 		// If this node is frozen, we need to write the result in
 		// a new account node.
 		if n.IsFrozen() {
@@ -1724,7 +2305,7 @@ func (n *AccountNode) SetSlot(manager NodeManager, thisRef *NodeReference, this
 			defer newHandle.Release()
 			newNode := newHandle.Get().(*AccountNode)
 			*newNode = *n
-			newNode.markDirty()
+			newNode.markCopyDirty()
 			newNode.markMutable()
 			newNode.storage = root
 			newNode.storageHashDirty = true
@@ -1732,15 +2313,38 @@ func (n *AccountNode) SetSlot(manager NodeManager, thisRef *NodeReference, this
 		}
 		n.storage = root
 		n.storageHashDirty = true
-		n.markDirty()
+		n.markDirty(manager, thisRef)
 		hasChanged = true
 	} else if hasChanged {
 		n.storageHashDirty = true
-		n.markDirty()
+		n.markDirty(manager, thisRef)
 	}
 	return *thisRef, hasChanged, nil
 }
 
+// setValues applies the given updates to the storage trie of this account and
+// returns the resulting root of the storage trie. The storage of this node is
+// not modified.
+func (n *AccountNode) setValues(manager NodeManager, updates []SlotUpdate) (NodeReference, bool, error) {
+	root, hasChanged := n.storage, false
+	buffer := getNibblePathBuffer()
+	defer buffer.release()
+	for _, update := range updates {
+		handle, err := manager.getWriteAccess(&root)
+		if err != nil {
+			return NodeReference{}, false, err
+		}
+		subPath := buffer.setKey(update.Key, manager)
+		newRoot, changed, err := handle.Get().SetValue(manager, &root, handle, update.Key, subPath[:], update.Value)
+		handle.Release()
+		if err != nil {
+			return NodeReference{}, false, err
+		}
+		root, hasChanged = newRoot, hasChanged || changed
+	}
+	return root, hasChanged, nil
+}
+
 func (n *AccountNode) ClearStorage(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], address common.Address, path []Nibble) (newRoot NodeReference, changed bool, err error) {
 	if n.address != address || n.storage.Id().IsEmpty() {
 		return *thisRef, false, nil
@@ -1756,7 +2360,7 @@ func (n *AccountNode) ClearStorage(manager NodeManager, thisRef *NodeReference,
 		defer newHandle.Release()
 		newNode := newHandle.Get().(*AccountNode)
 		*newNode = *n
-		newNode.markDirty()
+		newNode.markCopyDirty()
 		newNode.markMutable()
 		newNode.storage = NewNodeReference(EmptyId())
 		newNode.storageHashDirty = true
@@ -1768,7 +2372,7 @@ func (n *AccountNode) ClearStorage(manager NodeManager, thisRef *NodeReference,
 	}
 
 	n.storage = NewNodeReference(EmptyId())
-	n.markDirty()
+	n.markDirty(manager, thisRef)
 	n.storageHashDirty = true
 	return *thisRef, true, err
 }
@@ -1777,7 +2381,7 @@ func (n *AccountNode) Release(manager NodeManager, thisRef *NodeReference, this
 	if n.IsFrozen() {
 		return nil
 	}
-	n.nodeBase.Release()
+	n.nodeBase.Release(manager, thisRef)
 	if !n.storage.Id().IsEmpty() {
 		rootHandle, err := manager.getWriteAccess(&n.storage)
 		if err != nil {
@@ -1804,14 +2408,14 @@ func (n *AccountNode) setPathLength(manager NodeManager, thisRef *NodeReference,
 		defer newHandle.Release()
 		newNode := newHandle.Get().(*AccountNode)
 		*newNode = *n
-		newNode.markDirty()
+		newNode.markCopyDirty()
 		newNode.markMutable()
 		newNode.pathLength = length
 		return newRef, false, nil
 	}
 
 	n.pathLength = length
-	n.markDirty()
+	n.markDirty(manager, thisRef)
 	return *thisRef, true, nil
 }
 
@@ -1819,13 +2423,17 @@ func (n *AccountNode) Freeze(manager NodeManager, this shared.WriteHandle[Node])
 	if n.IsFrozen() {
 		return nil
 	}
-	n.MarkFrozen()
 	handle, err := manager.getWriteAccess(&n.storage)
 	if err != nil {
 		return err
 	}
-	defer handle.Release()
-	return handle.Get().Freeze(manager, handle)
+	err = handle.Get().Freeze(manager, handle)
+	handle.Release()
+	if err != nil {
+		return err
+	}
+	n.MarkFrozen()
+	return nil
 }
 
 func (n *AccountNode) Check(source NodeSource, thisRef *NodeReference, path []Nibble) error {
@@ -1845,7 +2453,8 @@ func (n *AccountNode) Check(source NodeSource, thisRef *NodeReference, path []Ni
 		errs = append(errs, fmt.Errorf("node %v is marked to have a clean hash but storage hash is dirty", thisRef.Id()))
 	}
 
-	fullPath := AddressToNibblePath(n.address, source)
+	var buffer nibblePathBuffer
+	fullPath := buffer.setAddress(n.address, source)
 	if !IsPrefixOf(path, fullPath[:]) {
 		errs = append(errs, fmt.Errorf("node %v - account node %v located in wrong branch: %v", thisRef.Id(), n.address, path))
 	}
@@ -1855,12 +2464,9 @@ func (n *AccountNode) Check(source NodeSource, thisRef *NodeReference, path []Ni
 	}
 
 	if source.getConfig().TrackSuffixLengthsInLeafNodes {
-		maxPathLength := 40
-		if source.getConfig().UseHashedPaths {
-			maxPathLength = 64
-		}
+		maxPathLength := getMaxPathLength(source.getConfig(), false)
 		if got, want := n.pathLength, byte(maxPathLength-len(path)); got != want {
-			errs = append(errs, fmt.Errorf("node %v - invalid path length, wanted %d, got %d", thisRef.Id(), want, got))
+			errs = append(errs, fmt.Errorf("node %v - invalid path length at depth %d, expected %d, stored %d", thisRef.Id(), len(path), want, got))
 		}
 	}
 
@@ -1871,7 +2477,7 @@ func (n *AccountNode) Check(source NodeSource, thisRef *NodeReference, path []Ni
 		} else {
 			storageIsFrozen := handle.Get().IsFrozen()
 			handle.Release()
-			if n.IsFrozen() && !storageIsFrozen {
+			if n.IsFrozen() && !storageIsFrozen && !allowsNonFrozenDescendants(source) {
 				errs = append(errs, fmt.Errorf("the frozen node %v must not have a non-frozen storage", thisRef.Id()))
 			}
 		}
@@ -1899,7 +2505,11 @@ func (n *AccountNode) Dump(out io.Writer, source NodeSource, thisRef *NodeRefere
 }
 
 func (n *AccountNode) Visit(source NodeSource, thisRef *NodeReference, depth int, visitor NodeVisitor) (bool, error) {
-	response := visitor.Visit(n, NodeInfo{Id: thisRef.Id(), Depth: &depth})
+	return n.visit(source, thisRef, visitPosition{depth: depth}, visitor)
+}
+
+func (n *AccountNode) visit(source NodeSource, thisRef *NodeReference, position visitPosition, visitor NodeVisitor) (bool, error) {
+	response := visitor.Visit(n, position.getInfo(thisRef.Id()))
 	switch response {
 	case VisitResponseAbort:
 		return true, nil
@@ -1911,7 +2521,7 @@ func (n *AccountNode) Visit(source NodeSource, thisRef *NodeReference, depth int
 	}
 	if node, err := source.getViewAccess(&n.storage); err == nil {
 		defer node.Release()
-		return node.Get().Visit(source, &n.storage, depth+1, visitor)
+		return node.Get().visit(source, &n.storage, position.getStoragePosition(thisRef.Id()), visitor)
 	} else {
 		return false, err
 	}
@@ -1932,6 +2542,12 @@ type ValueNode struct {
 	// by the navigation path to this node. It is only maintained if the
 	// `TrackSuffixLengthsInLeafNodes` of the `MptConfig` is enabled.
 	pathLength byte
+	// hashedKey is the hash of the key, only valid if hashedKeyKnown is set.
+	// It is only retained if `StoreHashedKeysInValueNodes` of the
+	// `MptConfig` is enabled. Like the node hash, it is hash data of the
+	// node, which may be updated while holding hash access.
+	hashedKey      common.Hash
+	hashedKeyKnown bool
 }
 
 func (n *ValueNode) Key() common.Key {
@@ -1942,6 +2558,24 @@ func (n *ValueNode) Value() common.Value {
 	return n.value
 }
 
+// getHashedKey returns the hash of the key of this node, using the retained
+// hash if it is known.
+func (n *ValueNode) getHashedKey(source NodeSource) common.Hash {
+	if n.hashedKeyKnown {
+		return n.hashedKey
+	}
+	return source.hashKey(n.key)
+}
+
+// retainHashedKey makes sure the hash of the key of this node is known. It
+// requires hash access to the node.
+func (n *ValueNode) retainHashedKey(source NodeSource) {
+	if !n.hashedKeyKnown {
+		n.hashedKey = source.hashKey(n.key)
+		n.hashedKeyKnown = true
+	}
+}
+
 func (n *ValueNode) GetAccount(NodeSource, common.Address, []Nibble) (AccountInfo, bool, error) {
 	return AccountInfo{}, false, fmt.Errorf("invalid request: account query should not reach values")
 }
@@ -1964,18 +2598,27 @@ func (n *ValueNode) SetAccount(NodeManager, *NodeReference, shared.WriteHandle[N
 func (n *ValueNode) SetValue(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], key common.Key, path []Nibble, value common.Value) (NodeReference, bool, error) {
 	// Check whether this is the correct value node.
 	if n.key == key {
-		if value == n.value {
-			return *thisRef, false, nil
-		}
 		if value == (common.Value{}) {
+			// Retain the node as a tombstone if the deletion is deferred.
+			if deferral, ok := manager.(slotDeletionDeferral); ok && !n.IsFrozen() && deferral.tryDeferSlotDeletion() {
+				if value == n.value {
+					return *thisRef, false, nil
+				}
+				n.value = value
+				n.markDirty(manager, thisRef)
+				return *thisRef, true, nil
+			}
 			if !n.IsFrozen() {
-				n.nodeBase.Release()
+				n.nodeBase.Release(manager, thisRef)
 				if err := manager.release(thisRef); err != nil {
 					return NodeReference{}, false, err
 				}
 			}
 			return NewNodeReference(EmptyId()), !n.IsFrozen(), nil
 		}
+		if value == n.value {
+			return *thisRef, false, nil
+		}
 		if n.IsFrozen() {
 			newRef, newHandle, err := manager.createValue()
 			if err != nil {
@@ -1985,12 +2628,12 @@ func (n *ValueNode) SetValue(manager NodeManager, thisRef *NodeReference, this s
 			newNode := newHandle.Get().(*ValueNode)
 			newNode.key = n.key
 			newNode.value = value
-			newNode.markDirty()
+			newNode.markDirty(manager, &newRef)
 			newNode.pathLength = n.pathLength
 			return newRef, false, nil
 		}
 		n.value = value
-		n.markDirty()
+		n.markDirty(manager, thisRef)
 		return *thisRef, true, nil
 	}
 
@@ -2008,9 +2651,17 @@ func (n *ValueNode) SetValue(manager NodeManager, thisRef *NodeReference, this s
 	sibling := siblingHandle.Get().(*ValueNode)
 	sibling.key = key
 	sibling.value = value
-	sibling.markDirty()
+	sibling.markDirty(manager, &siblingRef)
 
-	thisPath := KeyToNibblePath(n.key, manager)
+	buffer := getNibblePathBuffer()
+	defer buffer.release()
+	thisPath := buffer.setKey(n.key, manager)
+	if observer, ok := manager.(valueInsertionObserver); ok {
+		// The new value is placed below a branch node at the end of the
+		// path shared with this value.
+		depth := len(thisPath) - len(path)
+		observer.valueInserted(depth + getCommonPrefixLength(path, thisPath[depth:]) + 1)
+	}
 	newRootId, err := splitLeafNode(manager, thisRef, thisPath[:], n, this, path, &siblingRef, sibling, siblingHandle)
 	return newRootId, false, err
 }
@@ -2019,6 +2670,10 @@ func (n *ValueNode) SetSlot(NodeManager, *NodeReference, shared.WriteHandle[Node
 	return NodeReference{}, false, fmt.Errorf("invalid request: slot update should not reach values")
 }
 
+func (n *ValueNode) SetSlots(NodeManager, *NodeReference, shared.WriteHandle[Node], common.Address, []Nibble, []SlotUpdate) (NodeReference, bool, error) {
+	return NodeReference{}, false, fmt.Errorf("invalid request: slot update should not reach values")
+}
+
 func (n *ValueNode) ClearStorage(NodeManager, *NodeReference, shared.WriteHandle[Node], common.Address, []Nibble) (NodeReference, bool, error) {
 	return NodeReference{}, false, fmt.Errorf("invalid request: clear storage should not reach values")
 }
@@ -2027,7 +2682,7 @@ func (n *ValueNode) Release(manager NodeManager, thisRef *NodeReference, this sh
 	if n.IsFrozen() {
 		return nil
 	}
-	n.nodeBase.Release()
+	n.nodeBase.Release(manager, thisRef)
 	return manager.release(thisRef)
 }
 
@@ -2044,16 +2699,36 @@ func (n *ValueNode) setPathLength(manager NodeManager, thisRef *NodeReference, t
 		newNode := newHandle.Get().(*ValueNode)
 		newNode.key = n.key
 		newNode.value = n.value
-		newNode.markDirty()
+		newNode.markDirty(manager, &newRef)
 		newNode.pathLength = length
 		return newRef, false, nil
 	}
 
 	n.pathLength = length
-	n.markDirty()
+	n.markDirty(manager, thisRef)
 	return *thisRef, true, nil
 }
 
+// setLeafPathLength updates the path length of the given account or value
+// node. The reference of the updated node is returned, which differs from
+// the given one if the node is frozen. Other nodes are not modified.
+func setLeafPathLength(manager NodeManager, ref NodeReference, length byte) (NodeReference, error) {
+	if !ref.Id().IsAccount() && !ref.Id().IsValue() {
+		return ref, nil
+	}
+	handle, err := manager.getWriteAccess(&ref)
+	if err != nil {
+		return NodeReference{}, err
+	}
+	defer handle.Release()
+	if ref.Id().IsAccount() {
+		ref, _, err = handle.Get().(*AccountNode).setPathLength(manager, &ref, handle, length)
+	} else {
+		ref, _, err = handle.Get().(*ValueNode).setPathLength(manager, &ref, handle, length)
+	}
+	return ref, err
+}
+
 func (n *ValueNode) Freeze(NodeManager, shared.WriteHandle[Node]) error {
 	n.MarkFrozen()
 	return nil
@@ -2064,13 +2739,16 @@ func (n *ValueNode) Check(source NodeSource, thisRef *NodeReference, path []Nibb
 	//  - value must not be empty
 	//  - values are in the right position of the trie
 	//  - the path length is correct (if enabled to be tracked)
+	//  - the retained hash of the key is correct (if present)
 	var errs []error
 
 	if err := n.nodeBase.check(thisRef); err != nil {
 		errs = append(errs, err)
 	}
 
-	fullPath := KeyToNibblePath(n.key, source)
+	buffer := getNibblePathBuffer()
+	defer buffer.release()
+	fullPath := buffer.setKey(n.key, source)
 	if !IsPrefixOf(path, fullPath[:]) {
 		errs = append(errs, fmt.Errorf("node %v - value node %v [%v] located in wrong branch: %v", thisRef.Id(), n.key, fullPath, path))
 	}
@@ -2080,8 +2758,14 @@ func (n *ValueNode) Check(source NodeSource, thisRef *NodeReference, path []Nibb
 	}
 
 	if source.getConfig().TrackSuffixLengthsInLeafNodes {
-		if got, want := n.pathLength, byte(64-len(path)); got != want {
-			errs = append(errs, fmt.Errorf("node %v - invalid path length, wanted %d, got %d", thisRef.Id(), want, got))
+		if got, want := n.pathLength, byte(getMaxPathLength(source.getConfig(), true)-len(path)); got != want {
+			errs = append(errs, fmt.Errorf("node %v - invalid path length at depth %d, expected %d, stored %d", thisRef.Id(), len(path), want, got))
+		}
+	}
+
+	if n.hashedKeyKnown {
+		if want, got := common.Keccak256ForKey(n.key), n.hashedKey; want != got {
+			errs = append(errs, fmt.Errorf("node %v - invalid hashed key, wanted %v, got %v", thisRef.Id(), want, got))
 		}
 	}
 
@@ -2098,7 +2782,11 @@ func formatHashForDump(hash common.Hash) string {
 }
 
 func (n *ValueNode) Visit(source NodeSource, thisRef *NodeReference, depth int, visitor NodeVisitor) (bool, error) {
-	return visitor.Visit(n, NodeInfo{Id: thisRef.Id(), Depth: &depth}) == VisitResponseAbort, nil
+	return n.visit(source, thisRef, visitPosition{depth: depth}, visitor)
+}
+
+func (n *ValueNode) visit(_ NodeSource, thisRef *NodeReference, position visitPosition, visitor NodeVisitor) (bool, error) {
+	return visitor.Visit(n, position.getInfo(thisRef.Id())) == VisitResponseAbort, nil
 }
 
 // ----------------------------------------------------------------------------
@@ -2197,6 +2885,80 @@ func (BranchNodeEncoderWithChildHashes) Load(src []byte, node *BranchNode) error
 	return nil
 }
 
+// unknownLeafCount is the encoding of leaf counts of branch nodes not known
+// at the time they were stored.
+const unknownLeafCount = ^uint64(0)
+
+// BranchNodeWithLeafCountEncoderWithNodeHash extends the encoding of
+// BranchNodeEncoderWithNodeHash by the number of leaves in the sub-trie
+// rooted by branch nodes.
+type BranchNodeWithLeafCountEncoderWithNodeHash struct{}
+
+func (BranchNodeWithLeafCountEncoderWithNodeHash) GetEncodedSize() int {
+	return BranchNodeEncoderWithNodeHash{}.GetEncodedSize() + 8
+}
+
+func (BranchNodeWithLeafCountEncoderWithNodeHash) Store(dst []byte, node *BranchNode) error {
+	size := BranchNodeEncoderWithNodeHash{}.GetEncodedSize()
+	if err := (BranchNodeEncoderWithNodeHash{}).Store(dst[:size], node); err != nil {
+		return err
+	}
+	storeLeafCount(dst[size:], node)
+	return nil
+}
+
+func (BranchNodeWithLeafCountEncoderWithNodeHash) Load(src []byte, node *BranchNode) error {
+	size := BranchNodeEncoderWithNodeHash{}.GetEncodedSize()
+	if err := (BranchNodeEncoderWithNodeHash{}).Load(src[:size], node); err != nil {
+		return err
+	}
+	loadLeafCount(src[size:], node)
+	return nil
+}
+
+// BranchNodeWithLeafCountEncoderWithChildHashes extends the encoding of
+// BranchNodeEncoderWithChildHashes by the number of leaves in the sub-trie
+// rooted by branch nodes.
+type BranchNodeWithLeafCountEncoderWithChildHashes struct{}
+
+func (BranchNodeWithLeafCountEncoderWithChildHashes) GetEncodedSize() int {
+	return BranchNodeEncoderWithChildHashes{}.GetEncodedSize() + 8
+}
+
+func (BranchNodeWithLeafCountEncoderWithChildHashes) Store(dst []byte, node *BranchNode) error {
+	size := BranchNodeEncoderWithChildHashes{}.GetEncodedSize()
+	if err := (BranchNodeEncoderWithChildHashes{}).Store(dst[:size], node); err != nil {
+		return err
+	}
+	storeLeafCount(dst[size:], node)
+	return nil
+}
+
+func (BranchNodeWithLeafCountEncoderWithChildHashes) Load(src []byte, node *BranchNode) error {
+	size := BranchNodeEncoderWithChildHashes{}.GetEncodedSize()
+	if err := (BranchNodeEncoderWithChildHashes{}).Load(src[:size], node); err != nil {
+		return err
+	}
+	loadLeafCount(src[size:], node)
+	return nil
+}
+
+func storeLeafCount(dst []byte, node *BranchNode) {
+	count := node.leafCount
+	if !node.leafCountKnown {
+		count = unknownLeafCount
+	}
+	binary.BigEndian.PutUint64(dst, count)
+}
+
+func loadLeafCount(src []byte, node *BranchNode) {
+	if count := binary.BigEndian.Uint64(src); count != unknownLeafCount {
+		node.setLeafCount(count)
+	} else {
+		node.leafCount, node.leafCountKnown = 0, false
+	}
+}
+
 type ExtensionNodeEncoderWithNodeHash struct{}
 
 func (ExtensionNodeEncoderWithNodeHash) GetEncodedSize() int {
@@ -2502,3 +3264,157 @@ func (ValueNodeWithPathLengthEncoderWithNodeHash) Load(src []byte, node *ValueNo
 	node.pathLength = src[len(src)-1]
 	return nil
 }
+
+// ValueNodeWithPathLengthAndHashedKeyEncoderWithoutNodeHash extends the
+// encoding of ValueNodeWithPathLengthEncoderWithoutNodeHash by the hash of
+// the key of value nodes. Hashes not known yet are computed when storing nodes.
+type ValueNodeWithPathLengthAndHashedKeyEncoderWithoutNodeHash struct{}
+
+func (ValueNodeWithPathLengthAndHashedKeyEncoderWithoutNodeHash) GetEncodedSize() int {
+	return ValueNodeWithPathLengthEncoderWithoutNodeHash{}.GetEncodedSize() + common.HashSize
+}
+
+func (ValueNodeWithPathLengthAndHashedKeyEncoderWithoutNodeHash) Store(dst []byte, node *ValueNode) error {
+	size := ValueNodeWithPathLengthEncoderWithoutNodeHash{}.GetEncodedSize()
+	ValueNodeWithPathLengthEncoderWithoutNodeHash{}.Store(dst[:size], node)
+	storeHashedKey(dst[size:], node)
+	return nil
+}
+
+func (ValueNodeWithPathLengthAndHashedKeyEncoderWithoutNodeHash) Load(src []byte, node *ValueNode) error {
+	size := ValueNodeWithPathLengthEncoderWithoutNodeHash{}.GetEncodedSize()
+	ValueNodeWithPathLengthEncoderWithoutNodeHash{}.Load(src[:size], node)
+	loadHashedKey(src[size:], node)
+	return nil
+}
+
+// ValueNodeWithPathLengthAndHashedKeyEncoderWithNodeHash extends the encoding
+// of ValueNodeWithPathLengthEncoderWithNodeHash by the hash of the key of
+// value nodes. Hashes not known yet are computed when storing nodes.
+type ValueNodeWithPathLengthAndHashedKeyEncoderWithNodeHash struct{}
+
+func (ValueNodeWithPathLengthAndHashedKeyEncoderWithNodeHash) GetEncodedSize() int {
+	return ValueNodeWithPathLengthEncoderWithNodeHash{}.GetEncodedSize() + common.HashSize
+}
+
+func (ValueNodeWithPathLengthAndHashedKeyEncoderWithNodeHash) Store(dst []byte, node *ValueNode) error {
+	size := ValueNodeWithPathLengthEncoderWithNodeHash{}.GetEncodedSize()
+	ValueNodeWithPathLengthEncoderWithNodeHash{}.Store(dst[:size], node)
+	storeHashedKey(dst[size:], node)
+	return nil
+}
+
+func (ValueNodeWithPathLengthAndHashedKeyEncoderWithNodeHash) Load(src []byte, node *ValueNode) error {
+	size := ValueNodeWithPathLengthEncoderWithNodeHash{}.GetEncodedSize()
+	ValueNodeWithPathLengthEncoderWithNodeHash{}.Load(src[:size], node)
+	loadHashedKey(src[size:], node)
+	return nil
+}
+
+func storeHashedKey(dst []byte, node *ValueNode) {
+	// The node is not modified since stores only require view access.
+	hash := node.hashedKey
+	if !node.hashedKeyKnown {
+		hash = common.Keccak256ForKey(node.key)
+	}
+	copy(dst, hash[:])
+}
+
+func loadHashedKey(src []byte, node *ValueNode) {
+	copy(node.hashedKey[:], src)
+	node.hashedKeyKnown = true
+}
+
+// wideReferenceEncoder extends the encoding of a nested node encoder by the
+// two most significant bytes of the IDs of the referenced nodes, which are
+// not covered by the 6-byte NodeIdEncoder used by the nested encoders. It is
+// used by configurations using wide node references.
+type wideReferenceEncoder[N any] struct {
+	nested        stock.ValueEncoder[N]
+	numReferences int
+	reference     func(node *N, i int) *NodeReference // the i-th reference of a node
+	// loaded, if not nil, is called after a node has been loaded to update
+	// properties derived from the references by the nested encoder.
+	loaded func(*N)
+}
+
+// lowNodeIdMask covers the bits of node IDs encoded by the NodeIdEncoder.
+const lowNodeIdMask = NodeId(1)<<48 - 1
+
+func (e wideReferenceEncoder[N]) GetEncodedSize() int {
+	return e.nested.GetEncodedSize() + 2*e.numReferences
+}
+
+func (e wideReferenceEncoder[N]) Store(dst []byte, node *N) error {
+	size := e.nested.GetEncodedSize()
+	if err := e.nested.Store(dst[:size], node); err != nil {
+		return err
+	}
+	for i := 0; i < e.numReferences; i++ {
+		binary.BigEndian.PutUint16(dst[size+2*i:], uint16(e.reference(node, i).Id()>>48))
+	}
+	return nil
+}
+
+func (e wideReferenceEncoder[N]) Load(src []byte, node *N) error {
+	size := e.nested.GetEncodedSize()
+	if err := e.nested.Load(src[:size], node); err != nil {
+		return err
+	}
+	for i := 0; i < e.numReferences; i++ {
+		if high := binary.BigEndian.Uint16(src[size+2*i:]); high != 0 {
+			ref := e.reference(node, i)
+			*ref = NewNodeReference(ref.Id() | NodeId(high)<<48)
+		}
+	}
+	if e.loaded != nil {
+		e.loaded(node)
+	}
+	return nil
+}
+
+func (e wideReferenceEncoder[N]) encoderName() string {
+	return fmt.Sprintf("WideReferences[%s]", reflect.TypeOf(e.nested).Name())
+}
+
+func makeWideReferenceAccountEncoder(nested stock.ValueEncoder[AccountNode]) stock.ValueEncoder[AccountNode] {
+	return wideReferenceEncoder[AccountNode]{
+		nested:        nested,
+		numReferences: 1,
+		reference: func(node *AccountNode, _ int) *NodeReference {
+			return &node.storage
+		},
+	}
+}
+
+func makeWideReferenceBranchEncoder(nested stock.ValueEncoder[BranchNode]) stock.ValueEncoder[BranchNode] {
+	return wideReferenceEncoder[BranchNode]{
+		nested:        nested,
+		numReferences: 16,
+		reference: func(node *BranchNode, i int) *NodeReference {
+			return &node.children[i]
+		},
+		loaded: func(node *BranchNode) {
+			// Encoders storing the hash with the node mark the hashes of all
+			// non-empty children dirty, missing those with a truncated ID of 0.
+			if node.hashStatus != hashStatusClean {
+				return
+			}
+			for i, child := range node.children {
+				if id := child.Id(); !id.IsEmpty() && id&lowNodeIdMask == 0 {
+					node.markChildHashDirty(byte(i))
+				}
+			}
+		},
+	}
+}
+
+func makeWideReferenceExtensionEncoder(nested stock.ValueEncoder[ExtensionNode]) stock.ValueEncoder[ExtensionNode] {
+	return wideReferenceEncoder[ExtensionNode]{
+		nested:        nested,
+		numReferences: 1,
+		reference: func(node *ExtensionNode, _ int) *NodeReference {
+			return &node.next
+		},
+	}
+}
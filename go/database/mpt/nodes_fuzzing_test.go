@@ -0,0 +1,802 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
+	"github.com/Fantom-foundation/Carmen/go/fuzzing"
+)
+
+// FuzzNodes_RandomOps performs random operations directly on the nodes of a trie.
+// The fuzzer input is interpreted as a sequence of account, slot, and storage
+// updates interleaved with the freezing of the trie and the forking of new
+// versions of the trie from frozen versions. All operations are applied to a
+// trie of each MPT configuration and to a map-based reference model.
+// After each step, the touched account and slot are compared with the model
+// and the structure of the trie is checked. At checkpoints, the root hashes
+// of all trie versions are compared to the hashes of tries built from scratch.
+// If a campaign fails, the list of applied operations is logged.
+func FuzzNodes_RandomOps(f *testing.F) {
+	fuzzNodesRandomOps(f)
+}
+
+// nodeOpType is an operation type applied to the nodes of a trie.
+type nodeOpType byte
+
+const (
+	nodeSetAccount nodeOpType = iota
+	nodeDeleteAccount
+	nodeSetSlot
+	nodeDeleteSlot
+	nodeClearStorage
+	nodeFreeze
+	nodeClone
+	nodeCheckpoint
+)
+
+// nodeFuzzingPayload is the payload of operations on nodes. The address and
+// key are mapped to full addresses and keys by nodeFuzzingAddress and
+// nodeFuzzingKey. The value is the nonce of set accounts, the value of set
+// slots, or the selector of the version to clone.
+type nodeFuzzingPayload struct {
+	address byte
+	key     byte
+	value   byte
+}
+
+func fuzzNodesRandomOps(f *testing.F) {
+	opSetAccount := func(_ nodeOpType, p nodeFuzzingPayload, t fuzzing.TestingT, c *nodeFuzzingContext) {
+		c.record(fmt.Sprintf("SetAccount(%#02x, nonce=%d)", p.address, p.value))
+		c.model.setAccount(p.address, p.value)
+		c.forEachTrie(t, func(trie *nodeFuzzingTrie) error {
+			return trie.setAccount(nodeFuzzingAddress(p.address), AccountInfo{Nonce: common.ToNonce(uint64(p.value))})
+		})
+		c.check(t, p)
+	}
+
+	opDeleteAccount := func(_ nodeOpType, p nodeFuzzingPayload, t fuzzing.TestingT, c *nodeFuzzingContext) {
+		c.record(fmt.Sprintf("DeleteAccount(%#02x)", p.address))
+		c.model.setAccount(p.address, 0)
+		c.forEachTrie(t, func(trie *nodeFuzzingTrie) error {
+			return trie.setAccount(nodeFuzzingAddress(p.address), AccountInfo{})
+		})
+		c.check(t, p)
+	}
+
+	opSetSlot := func(_ nodeOpType, p nodeFuzzingPayload, t fuzzing.TestingT, c *nodeFuzzingContext) {
+		c.record(fmt.Sprintf("SetSlot(%#02x, %#02x, value=%d)", p.address, p.key, p.value))
+		c.model.setSlot(p.address, p.key, p.value)
+		c.forEachTrie(t, func(trie *nodeFuzzingTrie) error {
+			return trie.setSlot(nodeFuzzingAddress(p.address), nodeFuzzingKey(p.key), common.Value{p.value})
+		})
+		c.check(t, p)
+	}
+
+	opDeleteSlot := func(_ nodeOpType, p nodeFuzzingPayload, t fuzzing.TestingT, c *nodeFuzzingContext) {
+		c.record(fmt.Sprintf("DeleteSlot(%#02x, %#02x)", p.address, p.key))
+		c.model.setSlot(p.address, p.key, 0)
+		c.forEachTrie(t, func(trie *nodeFuzzingTrie) error {
+			return trie.setSlot(nodeFuzzingAddress(p.address), nodeFuzzingKey(p.key), common.Value{})
+		})
+		c.check(t, p)
+	}
+
+	opClearStorage := func(_ nodeOpType, p nodeFuzzingPayload, t fuzzing.TestingT, c *nodeFuzzingContext) {
+		c.record(fmt.Sprintf("ClearStorage(%#02x)", p.address))
+		c.model.clearStorage(p.address)
+		c.forEachTrie(t, func(trie *nodeFuzzingTrie) error {
+			return trie.clearStorage(nodeFuzzingAddress(p.address))
+		})
+		c.check(t, p)
+	}
+
+	opFreeze := func(_ nodeOpType, t fuzzing.TestingT, c *nodeFuzzingContext) {
+		c.record(fmt.Sprintf("Freeze() -> version %d", len(c.versions)))
+		c.versions = append(c.versions, c.model.clone())
+		c.forEachTrie(t, func(trie *nodeFuzzingTrie) error {
+			return trie.freeze()
+		})
+		c.check(t, nodeFuzzingPayload{})
+	}
+
+	opClone := func(_ nodeOpType, p nodeFuzzingPayload, t fuzzing.TestingT, c *nodeFuzzingContext) {
+		if len(c.versions) == 0 {
+			c.record("Clone() -> no frozen version, skipped")
+			return
+		}
+		version := int(p.value) % len(c.versions)
+		c.record(fmt.Sprintf("Clone(version %d)", version))
+		c.model = c.versions[version].clone()
+		c.forEachTrie(t, func(trie *nodeFuzzingTrie) error {
+			return trie.cloneVersion(version)
+		})
+		c.check(t, nodeFuzzingPayload{})
+	}
+
+	opCheckpoint := func(_ nodeOpType, t fuzzing.TestingT, c *nodeFuzzingContext) {
+		c.record("Checkpoint()")
+		c.checkpoint(t)
+	}
+
+	serialiseAddress := func(p nodeFuzzingPayload) []byte {
+		return []byte{p.address}
+	}
+	serialiseAddressValue := func(p nodeFuzzingPayload) []byte {
+		return []byte{p.address, p.value}
+	}
+	serialiseAddressKey := func(p nodeFuzzingPayload) []byte {
+		return []byte{p.address, p.key}
+	}
+	serialiseAll := func(p nodeFuzzingPayload) []byte {
+		return []byte{p.address, p.key, p.value}
+	}
+	serialiseValue := func(p nodeFuzzingPayload) []byte {
+		return []byte{p.value}
+	}
+
+	deserialiseAddress := func(b *[]byte) nodeFuzzingPayload {
+		return nodeFuzzingPayload{address: readNodeFuzzingByte(b)}
+	}
+	deserialiseAddressValue := func(b *[]byte) nodeFuzzingPayload {
+		address := readNodeFuzzingByte(b)
+		return nodeFuzzingPayload{address: address, value: readNodeFuzzingByte(b)}
+	}
+	deserialiseAddressKey := func(b *[]byte) nodeFuzzingPayload {
+		address := readNodeFuzzingByte(b)
+		return nodeFuzzingPayload{address: address, key: readNodeFuzzingByte(b)}
+	}
+	deserialiseAll := func(b *[]byte) nodeFuzzingPayload {
+		address := readNodeFuzzingByte(b)
+		key := readNodeFuzzingByte(b)
+		return nodeFuzzingPayload{address: address, key: key, value: readNodeFuzzingByte(b)}
+	}
+	deserialiseValue := func(b *[]byte) nodeFuzzingPayload {
+		return nodeFuzzingPayload{value: readNodeFuzzingByte(b)}
+	}
+
+	registry := fuzzing.NewRegistry[nodeOpType, nodeFuzzingContext]()
+	fuzzing.RegisterDataOp(registry, nodeSetAccount, serialiseAddressValue, deserialiseAddressValue, opSetAccount)
+	fuzzing.RegisterDataOp(registry, nodeDeleteAccount, serialiseAddress, deserialiseAddress, opDeleteAccount)
+	fuzzing.RegisterDataOp(registry, nodeSetSlot, serialiseAll, deserialiseAll, opSetSlot)
+	fuzzing.RegisterDataOp(registry, nodeDeleteSlot, serialiseAddressKey, deserialiseAddressKey, opDeleteSlot)
+	fuzzing.RegisterDataOp(registry, nodeClearStorage, serialiseAddress, deserialiseAddress, opClearStorage)
+	fuzzing.RegisterNoDataOp(registry, nodeFreeze, opFreeze)
+	fuzzing.RegisterDataOp(registry, nodeClone, serialiseValue, deserialiseValue, opClone)
+	fuzzing.RegisterNoDataOp(registry, nodeCheckpoint, opCheckpoint)
+
+	fuzzing.Fuzz[nodeFuzzingContext](f, &nodeFuzzingCampaign{registry: registry})
+}
+
+// readNodeFuzzingByte consumes the next byte of the input, or returns zero if
+// the input is exhausted.
+func readNodeFuzzingByte(b *[]byte) byte {
+	if len(*b) == 0 {
+		return 0
+	}
+	res := (*b)[0]
+	*b = (*b)[1:]
+	return res
+}
+
+// nodeFuzzingAddress maps a byte to an address. Addresses of bytes sharing the
+// upper nibble share all but the last nibble of their path if paths are not
+// hashed, which leads to long extension nodes being split and collapsed.
+func nodeFuzzingAddress(a byte) common.Address {
+	var res common.Address
+	res[0] = a & 0xF0
+	res[len(res)-1] = a & 0x0F
+	return res
+}
+
+// nodeFuzzingKey maps a byte to a key following the scheme of nodeFuzzingAddress.
+func nodeFuzzingKey(k byte) common.Key {
+	var res common.Key
+	res[0] = k & 0xF0
+	res[len(res)-1] = k & 0x0F
+	return res
+}
+
+// nodeFuzzingCampaign seeds the fuzzer with sequences of operations
+// reproducing the transitions covered by the unit tests of the nodes.
+type nodeFuzzingCampaign struct {
+	registry fuzzing.OpsFactoryRegistry[nodeOpType, nodeFuzzingContext]
+}
+
+func (c *nodeFuzzingCampaign) Init() []fuzzing.OperationSequence[nodeFuzzingContext] {
+	setAccount := func(address, nonce byte) fuzzing.Operation[nodeFuzzingContext] {
+		return c.registry.CreateDataOp(nodeSetAccount, nodeFuzzingPayload{address: address, value: nonce})
+	}
+	deleteAccount := func(address byte) fuzzing.Operation[nodeFuzzingContext] {
+		return c.registry.CreateDataOp(nodeDeleteAccount, nodeFuzzingPayload{address: address})
+	}
+	setSlot := func(address, key, value byte) fuzzing.Operation[nodeFuzzingContext] {
+		return c.registry.CreateDataOp(nodeSetSlot, nodeFuzzingPayload{address: address, key: key, value: value})
+	}
+	deleteSlot := func(address, key byte) fuzzing.Operation[nodeFuzzingContext] {
+		return c.registry.CreateDataOp(nodeDeleteSlot, nodeFuzzingPayload{address: address, key: key})
+	}
+	clearStorage := func(address byte) fuzzing.Operation[nodeFuzzingContext] {
+		return c.registry.CreateDataOp(nodeClearStorage, nodeFuzzingPayload{address: address})
+	}
+	freeze := c.registry.CreateNoDataOp(nodeFreeze)
+	cloneVersion := func(version byte) fuzzing.Operation[nodeFuzzingContext] {
+		return c.registry.CreateDataOp(nodeClone, nodeFuzzingPayload{value: version})
+	}
+	checkpoint := c.registry.CreateNoDataOp(nodeCheckpoint)
+
+	return []fuzzing.OperationSequence[nodeFuzzingContext]{
+		// A branch with two accounts collapses into a single account.
+		{setAccount(0x10, 1), setAccount(0x20, 1), checkpoint, deleteAccount(0x20), checkpoint},
+		// Accounts are added to and removed from an extension.
+		{setAccount(0x11, 1), setAccount(0x12, 2), checkpoint, setAccount(0x13, 3), setAccount(0x21, 4), checkpoint,
+			deleteAccount(0x12), deleteAccount(0x13), checkpoint, deleteAccount(0x11), checkpoint},
+		// Extensions collapse below frozen parents.
+		{setAccount(0x11, 1), setAccount(0x12, 1), setAccount(0x21, 1), freeze, deleteAccount(0x12), checkpoint,
+			deleteAccount(0x21), checkpoint, cloneVersion(0), setAccount(0x11, 2), checkpoint},
+		// Storage tries are modified, cleared, and released.
+		{setAccount(0x01, 1), setSlot(0x01, 0x10, 1), setSlot(0x01, 0x11, 2), setSlot(0x01, 0x21, 3), deleteSlot(0x01, 0x11), checkpoint,
+			freeze, clearStorage(0x01), setSlot(0x01, 0x11, 4), checkpoint, deleteAccount(0x01), checkpoint, cloneVersion(0), checkpoint},
+		// Slots of missing accounts are ignored.
+		{setSlot(0x05, 0x01, 1), clearStorage(0x05), checkpoint, setAccount(0x05, 1), setSlot(0x05, 0x01, 1), checkpoint},
+		// An extension split off a frozen extension is modified after hashing.
+		{setAccount(0x11, 1), setAccount(0x12, 1), setAccount(0x13, 1), freeze, setAccount(0x30, 1), checkpoint,
+			deleteAccount(0x11), checkpoint},
+		// Accounts with storage are updated in multiple versions.
+		{setAccount(0x31, 1), setAccount(0x32, 1), setSlot(0x31, 0x01, 1), setSlot(0x32, 0x01, 1), freeze,
+			setAccount(0x31, 2), setSlot(0x32, 0x02, 2), freeze, deleteAccount(0x32), cloneVersion(0), clearStorage(0x31), freeze,
+			cloneVersion(1), deleteSlot(0x32, 0x01), checkpoint},
+	}
+}
+
+func (c *nodeFuzzingCampaign) CreateContext(t fuzzing.TestingT) *nodeFuzzingContext {
+	context := &nodeFuzzingContext{model: nodeFuzzingModel{}}
+	for _, config := range allMptConfigs {
+		context.tries = append(context.tries, newNodeFuzzingTrie(config))
+	}
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("applied operations:\n\t%s", strings.Join(context.operations, "\n\t"))
+		}
+	})
+	return context
+}
+
+func (c *nodeFuzzingCampaign) Deserialize(rawData []byte) []fuzzing.Operation[nodeFuzzingContext] {
+	return c.registry.ReadAllOps(rawData)
+}
+
+func (c *nodeFuzzingCampaign) Cleanup(t fuzzing.TestingT, context *nodeFuzzingContext) {
+	context.record("Checkpoint() -> final")
+	context.checkpoint(t)
+}
+
+// nodeFuzzingContext holds the tries of all configurations and the reference
+// model of their content.
+type nodeFuzzingContext struct {
+	tries      []*nodeFuzzingTrie
+	model      nodeFuzzingModel
+	versions   []nodeFuzzingModel // < the content of frozen versions
+	operations []string           // < a readable list of applied operations
+}
+
+func (c *nodeFuzzingContext) record(operation string) {
+	c.operations = append(c.operations, operation)
+}
+
+func (c *nodeFuzzingContext) forEachTrie(t fuzzing.TestingT, op func(*nodeFuzzingTrie) error) {
+	for _, trie := range c.tries {
+		if err := op(trie); err != nil {
+			t.Fatalf("%s: unexpected error: %v", trie.manager.config.Name, err)
+		}
+	}
+}
+
+// check compares the account and slot addressed by the given payload with the
+// reference model and verifies the structure of all tries.
+func (c *nodeFuzzingContext) check(t fuzzing.TestingT, p nodeFuzzingPayload) {
+	account, exists := c.model[p.address]
+	for _, trie := range c.tries {
+		name := trie.manager.config.Name
+		info, found, err := trie.getAccount(nodeFuzzingAddress(p.address))
+		if err != nil {
+			t.Fatalf("%s: failed to get account: %v", name, err)
+		}
+		if found != exists || info.Nonce != common.ToNonce(uint64(account.nonce)) {
+			t.Fatalf("%s: unexpected account %#02x, wanted %t/%d, got %t/%v", name, p.address, exists, account.nonce, found, info.Nonce)
+		}
+		value, err := trie.getSlot(nodeFuzzingAddress(p.address), nodeFuzzingKey(p.key))
+		if err != nil {
+			t.Fatalf("%s: failed to get slot: %v", name, err)
+		}
+		if want := (common.Value{account.slots[p.key]}); value != want {
+			t.Fatalf("%s: unexpected value of slot %#02x/%#02x, wanted %v, got %v", name, p.address, p.key, want, value)
+		}
+		if err := trie.check(); err != nil {
+			t.Fatalf("%s: invalid trie structure: %v", name, err)
+		}
+	}
+}
+
+// checkpoint compares the full content and the root hashes of the current and
+// all frozen versions of the tries with the reference model. Furthermore, it
+// verifies that no released nodes are leaked.
+func (c *nodeFuzzingContext) checkpoint(t fuzzing.TestingT) {
+	for _, trie := range c.tries {
+		name := trie.manager.config.Name
+		if err := trie.check(); err != nil {
+			t.Fatalf("%s: invalid trie structure: %v", name, err)
+		}
+
+		check := func(version string, root *NodeReference, model nodeFuzzingModel, got common.Hash) {
+			if err := model.checkContent(trie.manager, root); err != nil {
+				t.Fatalf("%s: invalid content of %s: %v", name, version, err)
+			}
+			want, err := model.getHash(trie.manager.config)
+			if err != nil {
+				t.Fatalf("%s: failed to compute reference hash: %v", name, err)
+			}
+			if want != got {
+				t.Fatalf("%s: unexpected hash of %s, wanted %x, got %x", name, version, want, got)
+			}
+		}
+
+		hash, _, err := trie.manager.hasher.updateHashes(&trie.root, trie.manager, nil)
+		if err != nil {
+			t.Fatalf("%s: failed to update hashes: %v", name, err)
+		}
+		check("current version", &trie.root, c.model, hash)
+
+		for i, version := range trie.versions {
+			hash, err := trie.manager.hasher.getHash(&version.root, trie.manager)
+			if err != nil {
+				t.Fatalf("%s: failed to get hash of version %d: %v", name, i, err)
+			}
+			if hash != version.hash {
+				t.Fatalf("%s: hash of frozen version %d changed from %x to %x", name, i, version.hash, hash)
+			}
+			check(fmt.Sprintf("version %d", i), &version.root, c.versions[i], hash)
+		}
+
+		reachable, err := countReachableNodes(trie.manager, trie.getRoots())
+		if err != nil {
+			t.Fatalf("%s: failed to count reachable nodes: %v", name, err)
+		}
+		if got := len(trie.manager.nodes); got != reachable {
+			t.Fatalf("%s: %d nodes leaked, %d reachable, %d allocated", name, got-reachable, reachable, got)
+		}
+	}
+}
+
+// nodeFuzzingModel is the reference model of the content of a trie.
+type nodeFuzzingModel map[byte]nodeFuzzingAccount
+
+type nodeFuzzingAccount struct {
+	nonce byte
+	slots map[byte]byte
+}
+
+func (m nodeFuzzingModel) setAccount(address, nonce byte) {
+	if nonce == 0 {
+		delete(m, address)
+		return
+	}
+	account, exists := m[address]
+	if !exists {
+		account.slots = map[byte]byte{}
+	}
+	account.nonce = nonce
+	m[address] = account
+}
+
+func (m nodeFuzzingModel) setSlot(address, key, value byte) {
+	account, exists := m[address]
+	if !exists {
+		return
+	}
+	if value == 0 {
+		delete(account.slots, key)
+	} else {
+		account.slots[key] = value
+	}
+}
+
+func (m nodeFuzzingModel) clearStorage(address byte) {
+	if account, exists := m[address]; exists {
+		account.slots = map[byte]byte{}
+		m[address] = account
+	}
+}
+
+func (m nodeFuzzingModel) clone() nodeFuzzingModel {
+	res := make(nodeFuzzingModel, len(m))
+	for address, account := range m {
+		slots := make(map[byte]byte, len(account.slots))
+		for key, value := range account.slots {
+			slots[key] = value
+		}
+		res[address] = nodeFuzzingAccount{nonce: account.nonce, slots: slots}
+	}
+	return res
+}
+
+// checkContent verifies that all accounts and slots of the model are present
+// in the trie rooted by the given node. Additional content of the trie is
+// detected by comparing hashes.
+func (m nodeFuzzingModel) checkContent(manager *fuzzingNodeManager, root *NodeReference) error {
+	trie := &nodeFuzzingTrie{manager: manager, root: *root}
+	for address, account := range m {
+		info, found, err := trie.getAccount(nodeFuzzingAddress(address))
+		if err != nil {
+			return err
+		}
+		if !found || info.Nonce != common.ToNonce(uint64(account.nonce)) {
+			return fmt.Errorf("unexpected account %#02x, wanted nonce %d, got %t/%v", address, account.nonce, found, info.Nonce)
+		}
+		for key, value := range account.slots {
+			got, err := trie.getSlot(nodeFuzzingAddress(address), nodeFuzzingKey(key))
+			if err != nil {
+				return err
+			}
+			if want := (common.Value{value}); got != want {
+				return fmt.Errorf("unexpected value of slot %#02x/%#02x, wanted %v, got %v", address, key, want, got)
+			}
+		}
+	}
+	return nil
+}
+
+// getHash computes the hash of a trie of the given configuration built from
+// scratch containing the content of this model.
+func (m nodeFuzzingModel) getHash(config MptConfig) (common.Hash, error) {
+	trie := newNodeFuzzingTrie(config)
+	for address := 0; address < 256; address++ {
+		account, exists := m[byte(address)]
+		if !exists {
+			continue
+		}
+		info := AccountInfo{Nonce: common.ToNonce(uint64(account.nonce))}
+		if err := trie.setAccount(nodeFuzzingAddress(byte(address)), info); err != nil {
+			return common.Hash{}, err
+		}
+		for key := 0; key < 256; key++ {
+			if value, exists := account.slots[byte(key)]; exists {
+				if err := trie.setSlot(nodeFuzzingAddress(byte(address)), nodeFuzzingKey(byte(key)), common.Value{value}); err != nil {
+					return common.Hash{}, err
+				}
+			}
+		}
+	}
+	hash, _, err := trie.manager.hasher.updateHashes(&trie.root, trie.manager, nil)
+	return hash, err
+}
+
+// nodeFuzzingTrie is a trie operated on by directly calling the operations of
+// its nodes. Besides the current version, the trie retains frozen versions.
+type nodeFuzzingTrie struct {
+	manager  *fuzzingNodeManager
+	root     NodeReference
+	versions []nodeFuzzingVersion
+}
+
+type nodeFuzzingVersion struct {
+	root NodeReference
+	hash common.Hash
+}
+
+func newNodeFuzzingTrie(config MptConfig) *nodeFuzzingTrie {
+	return &nodeFuzzingTrie{
+		manager: newFuzzingNodeManager(config),
+		root:    NewNodeReference(EmptyId()),
+	}
+}
+
+func (c *nodeFuzzingTrie) getRoots() []*NodeReference {
+	res := []*NodeReference{&c.root}
+	for i := range c.versions {
+		res = append(res, &c.versions[i].root)
+	}
+	return res
+}
+
+// check verifies the structure of each version of the trie. Versions are
+// checked individually since, without tracking suffix lengths, frozen leaf
+// nodes may be legitimately shared by versions at different depths.
+func (c *nodeFuzzingTrie) check() error {
+	for _, root := range c.getRoots() {
+		if err := CheckForest(c.manager, []*NodeReference{root}); err != nil {
+			return fmt.Errorf("invalid trie rooted by %v: %w", root.Id(), err)
+		}
+	}
+	return nil
+}
+
+func (c *nodeFuzzingTrie) getAccount(address common.Address) (AccountInfo, bool, error) {
+	handle, err := c.manager.getReadAccess(&c.root)
+	if err != nil {
+		return AccountInfo{}, false, err
+	}
+	defer handle.Release()
+	path := AddressToNibblePath(address, c.manager)
+	return handle.Get().GetAccount(c.manager, address, path[:])
+}
+
+func (c *nodeFuzzingTrie) getSlot(address common.Address, key common.Key) (common.Value, error) {
+	handle, err := c.manager.getReadAccess(&c.root)
+	if err != nil {
+		return common.Value{}, err
+	}
+	defer handle.Release()
+	path := AddressToNibblePath(address, c.manager)
+	value, _, err := handle.Get().GetSlot(c.manager, address, path[:], key)
+	return value, err
+}
+
+func (c *nodeFuzzingTrie) setAccount(address common.Address, info AccountInfo) error {
+	path := AddressToNibblePath(address, c.manager)
+	return c.update(func(node Node, handle shared.WriteHandle[Node]) (NodeReference, bool, error) {
+		return node.SetAccount(c.manager, &c.root, handle, address, path[:], info)
+	})
+}
+
+func (c *nodeFuzzingTrie) setSlot(address common.Address, key common.Key, value common.Value) error {
+	path := AddressToNibblePath(address, c.manager)
+	return c.update(func(node Node, handle shared.WriteHandle[Node]) (NodeReference, bool, error) {
+		return node.SetSlot(c.manager, &c.root, handle, address, path[:], key, value)
+	})
+}
+
+func (c *nodeFuzzingTrie) clearStorage(address common.Address) error {
+	path := AddressToNibblePath(address, c.manager)
+	return c.update(func(node Node, handle shared.WriteHandle[Node]) (NodeReference, bool, error) {
+		return node.ClearStorage(c.manager, &c.root, handle, address, path[:])
+	})
+}
+
+func (c *nodeFuzzingTrie) update(op func(Node, shared.WriteHandle[Node]) (NodeReference, bool, error)) error {
+	handle, err := c.manager.getWriteAccess(&c.root)
+	if err != nil {
+		return err
+	}
+	newRoot, _, err := op(handle.Get(), handle)
+	handle.Release()
+	if err != nil {
+		return err
+	}
+	c.root = newRoot
+	return c.manager.checkErrors()
+}
+
+// freeze updates the hashes of the current version of the trie and freezes
+// it, like archives do at the end of each block.
+func (c *nodeFuzzingTrie) freeze() error {
+	hash, _, err := c.manager.hasher.updateHashes(&c.root, c.manager, nil)
+	if err != nil {
+		return err
+	}
+	handle, err := c.manager.getWriteAccess(&c.root)
+	if err != nil {
+		return err
+	}
+	err = handle.Get().Freeze(c.manager, handle)
+	handle.Release()
+	if err != nil {
+		return err
+	}
+	c.versions = append(c.versions, nodeFuzzingVersion{root: c.root, hash: hash})
+	return nil
+}
+
+// cloneVersion releases the current version of the trie and continues with a
+// new version derived from the given frozen version.
+func (c *nodeFuzzingTrie) cloneVersion(version int) error {
+	if _, err := releaseSubTrie(c.manager, &c.root, 0); err != nil {
+		return err
+	}
+	c.root = c.versions[version].root
+	return c.manager.checkErrors()
+}
+
+// countReachableNodes counts the distinct non-empty nodes reachable from the
+// given roots.
+func countReachableNodes(source NodeSource, roots []*NodeReference) (int, error) {
+	seen := map[NodeId]struct{}{}
+	workList := []NodeReference{}
+	for _, root := range roots {
+		workList = append(workList, *root)
+	}
+	for len(workList) > 0 {
+		cur := workList[len(workList)-1]
+		workList = workList[:len(workList)-1]
+		if _, found := seen[cur.Id()]; found || cur.Id().IsEmpty() {
+			continue
+		}
+		seen[cur.Id()] = struct{}{}
+
+		handle, err := source.getViewAccess(&cur)
+		if err != nil {
+			return 0, err
+		}
+		switch node := handle.Get().(type) {
+		case *AccountNode:
+			workList = append(workList, node.storage)
+		case *BranchNode:
+			workList = append(workList, node.children[:]...)
+		case *ExtensionNode:
+			workList = append(workList, node.next)
+		}
+		handle.Release()
+	}
+	return len(seen), nil
+}
+
+// fuzzingNodeManager is a deterministic NodeManager retaining all nodes in
+// memory. Unlike the Forest, it has no caches, buffers, or background workers,
+// making it fast enough for fuzzing. Tries are released synchronously and
+// accesses to released or locked nodes are reported as errors.
+type fuzzingNodeManager struct {
+	config    MptConfig
+	hasher    hasher
+	nodes     map[NodeId]*shared.Shared[Node]
+	lastIndex uint64
+	errors    []error // < issues encountered while releasing tries
+}
+
+func newFuzzingNodeManager(config MptConfig) *fuzzingNodeManager {
+	hasher := config.Hashing.createHasher(config.HashFunction)
+	enableCachedHashCrossChecks(hasher)
+	return &fuzzingNodeManager{
+		config: config,
+		hasher: hasher,
+		nodes:  map[NodeId]*shared.Shared[Node]{},
+	}
+}
+
+func (m *fuzzingNodeManager) checkErrors() error {
+	return errors.Join(m.errors...)
+}
+
+func (m *fuzzingNodeManager) getConfig() MptConfig {
+	return m.config
+}
+
+func (m *fuzzingNodeManager) getShared(ref *NodeReference) (*shared.Shared[Node], error) {
+	id := ref.Id()
+	if id.IsEmpty() {
+		return shared.MakeShared[Node](EmptyNode{}), nil
+	}
+	res, found := m.nodes[id]
+	if !found {
+		return nil, fmt.Errorf("access to unknown node %v", id)
+	}
+	return res, nil
+}
+
+func getFuzzingAccess[H any](m *fuzzingNodeManager, ref *NodeReference, get func(*shared.Shared[Node]) (H, bool)) (H, error) {
+	var res H
+	node, err := m.getShared(ref)
+	if err != nil {
+		return res, err
+	}
+	res, success := get(node)
+	if !success {
+		return res, fmt.Errorf("node %v is locked", ref.Id())
+	}
+	return res, nil
+}
+
+func (m *fuzzingNodeManager) getReadAccess(ref *NodeReference) (shared.ReadHandle[Node], error) {
+	return getFuzzingAccess(m, ref, (*shared.Shared[Node]).TryGetReadHandle)
+}
+
+func (m *fuzzingNodeManager) getViewAccess(ref *NodeReference) (shared.ViewHandle[Node], error) {
+	return getFuzzingAccess(m, ref, (*shared.Shared[Node]).TryGetViewHandle)
+}
+
+func (m *fuzzingNodeManager) getHashAccess(ref *NodeReference) (shared.HashHandle[Node], error) {
+	return getFuzzingAccess(m, ref, (*shared.Shared[Node]).TryGetHashHandle)
+}
+
+func (m *fuzzingNodeManager) getWriteAccess(ref *NodeReference) (shared.WriteHandle[Node], error) {
+	return getFuzzingAccess(m, ref, (*shared.Shared[Node]).TryGetWriteHandle)
+}
+
+func (m *fuzzingNodeManager) getHashFor(ref *NodeReference) (common.Hash, error) {
+	return m.hasher.getHash(ref, m)
+}
+
+func (m *fuzzingNodeManager) hashKey(key common.Key) common.Hash {
+	return common.Keccak256(key[:])
+}
+
+func (m *fuzzingNodeManager) hashAddress(address common.Address) common.Hash {
+	return common.Keccak256(address[:])
+}
+
+func (m *fuzzingNodeManager) create(id NodeId, node Node) (NodeReference, shared.WriteHandle[Node], error) {
+	instance := shared.MakeShared(node)
+	m.nodes[id] = instance
+	return NewNodeReference(id), instance.GetWriteHandle(), nil
+}
+
+func (m *fuzzingNodeManager) createAccount() (NodeReference, shared.WriteHandle[Node], error) {
+	m.lastIndex++
+	return m.create(AccountId(m.lastIndex), new(AccountNode))
+}
+
+func (m *fuzzingNodeManager) createBranch() (NodeReference, shared.WriteHandle[Node], error) {
+	m.lastIndex++
+	return m.create(BranchId(m.lastIndex), new(BranchNode))
+}
+
+func (m *fuzzingNodeManager) createExtension() (NodeReference, shared.WriteHandle[Node], error) {
+	m.lastIndex++
+	return m.create(ExtensionId(m.lastIndex), new(ExtensionNode))
+}
+
+func (m *fuzzingNodeManager) createValue() (NodeReference, shared.WriteHandle[Node], error) {
+	m.lastIndex++
+	return m.create(ValueId(m.lastIndex), new(ValueNode))
+}
+
+func (m *fuzzingNodeManager) release(ref *NodeReference) error {
+	id := ref.Id()
+	if _, found := m.nodes[id]; !found {
+		return fmt.Errorf("release of unknown node %v", id)
+	}
+	delete(m.nodes, id)
+	return nil
+}
+
+func (m *fuzzingNodeManager) releaseBatch(refs []NodeReference) error {
+	var errs []error
+	for i := range refs {
+		errs = append(errs, m.release(&refs[i]))
+	}
+	return errors.Join(errs...)
+}
+
+func (m *fuzzingNodeManager) releaseTrieAsynchronous(ref NodeReference) {
+	if _, err := releaseSubTrie(m, &ref, 0); err != nil {
+		m.errors = append(m.errors, err)
+	}
+}
+
+func (m *fuzzingNodeManager) trackDirtyNode(*NodeReference, bool) {}
+
+func TestFuzzingNodeManager_AccessToReleasedNodesIsDetected(t *testing.T) {
+	manager := newFuzzingNodeManager(S5LiveConfig)
+	ref, handle, _ := manager.createValue()
+	handle.Release()
+	if err := manager.release(&ref); err != nil {
+		t.Fatalf("failed to release node: %v", err)
+	}
+	if _, err := manager.getReadAccess(&ref); err == nil {
+		t.Errorf("accessing a released node should fail")
+	}
+	if err := manager.release(&ref); err == nil {
+		t.Errorf("releasing a node twice should fail")
+	}
+}
+
+func TestFuzzingNodeManager_AccessToLockedNodesIsDetected(t *testing.T) {
+	manager := newFuzzingNodeManager(S5LiveConfig)
+	ref, handle, _ := manager.createBranch()
+	defer handle.Release()
+	if _, err := manager.getReadAccess(&ref); err == nil {
+		t.Errorf("accessing a locked node should fail")
+	}
+}
@@ -281,6 +281,22 @@ func (mr *MockNodeMockRecorder) SetSlot(manager, thisRef, this, address, path, k
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetSlot", reflect.TypeOf((*MockNode)(nil).SetSlot), manager, thisRef, this, address, path, key, value)
 }
 
+// SetSlots mocks base method.
+func (m *MockNode) SetSlots(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], address common.Address, path []Nibble, updates []SlotUpdate) (NodeReference, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetSlots", manager, thisRef, this, address, path, updates)
+	ret0, _ := ret[0].(NodeReference)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// SetSlots indicates an expected call of SetSlots.
+func (mr *MockNodeMockRecorder) SetSlots(manager, thisRef, this, address, path, updates any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetSlots", reflect.TypeOf((*MockNode)(nil).SetSlots), manager, thisRef, this, address, path, updates)
+}
+
 // SetValue mocks base method.
 func (m *MockNode) SetValue(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], key common.Key, path []Nibble, value common.Value) (NodeReference, bool, error) {
 	m.ctrl.T.Helper()
@@ -312,6 +328,21 @@ func (mr *MockNodeMockRecorder) Visit(source, thisRef, depth, visitor any) *gomo
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Visit", reflect.TypeOf((*MockNode)(nil).Visit), source, thisRef, depth, visitor)
 }
 
+// visit mocks base method.
+func (m *MockNode) visit(source NodeSource, thisRef *NodeReference, position visitPosition, visitor NodeVisitor) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "visit", source, thisRef, position, visitor)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// visit indicates an expected call of visit.
+func (mr *MockNodeMockRecorder) visit(source, thisRef, position, visitor any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "visit", reflect.TypeOf((*MockNode)(nil).visit), source, thisRef, position, visitor)
+}
+
 // MockNodeSource is a mock of NodeSource interface.
 type MockNodeSource struct {
 	ctrl     *gomock.Controller
@@ -640,6 +671,20 @@ func (mr *MockNodeManagerMockRecorder) release(arg0 any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "release", reflect.TypeOf((*MockNodeManager)(nil).release), arg0)
 }
 
+// releaseBatch mocks base method.
+func (m *MockNodeManager) releaseBatch(arg0 []NodeReference) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "releaseBatch", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// releaseBatch indicates an expected call of releaseBatch.
+func (mr *MockNodeManagerMockRecorder) releaseBatch(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "releaseBatch", reflect.TypeOf((*MockNodeManager)(nil).releaseBatch), arg0)
+}
+
 // releaseTrieAsynchronous mocks base method.
 func (m *MockNodeManager) releaseTrieAsynchronous(arg0 NodeReference) {
 	m.ctrl.T.Helper()
@@ -652,6 +697,18 @@ func (mr *MockNodeManagerMockRecorder) releaseTrieAsynchronous(arg0 any) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "releaseTrieAsynchronous", reflect.TypeOf((*MockNodeManager)(nil).releaseTrieAsynchronous), arg0)
 }
 
+// trackDirtyNode mocks base method.
+func (m *MockNodeManager) trackDirtyNode(ref *NodeReference, dirty bool) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "trackDirtyNode", ref, dirty)
+}
+
+// trackDirtyNode indicates an expected call of trackDirtyNode.
+func (mr *MockNodeManagerMockRecorder) trackDirtyNode(ref, dirty any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "trackDirtyNode", reflect.TypeOf((*MockNodeManager)(nil).trackDirtyNode), ref, dirty)
+}
+
 // MockleafNode is a mock of leafNode interface.
 type MockleafNode struct {
 	ctrl     *gomock.Controller
@@ -906,6 +963,22 @@ func (mr *MockleafNodeMockRecorder) SetSlot(manager, thisRef, this, address, pat
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetSlot", reflect.TypeOf((*MockleafNode)(nil).SetSlot), manager, thisRef, this, address, path, key, value)
 }
 
+// SetSlots mocks base method.
+func (m *MockleafNode) SetSlots(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], address common.Address, path []Nibble, updates []SlotUpdate) (NodeReference, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetSlots", manager, thisRef, this, address, path, updates)
+	ret0, _ := ret[0].(NodeReference)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// SetSlots indicates an expected call of SetSlots.
+func (mr *MockleafNodeMockRecorder) SetSlots(manager, thisRef, this, address, path, updates any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetSlots", reflect.TypeOf((*MockleafNode)(nil).SetSlots), manager, thisRef, this, address, path, updates)
+}
+
 // SetValue mocks base method.
 func (m *MockleafNode) SetValue(manager NodeManager, thisRef *NodeReference, this shared.WriteHandle[Node], key common.Key, path []Nibble, value common.Value) (NodeReference, bool, error) {
 	m.ctrl.T.Helper()
@@ -952,3 +1025,18 @@ func (mr *MockleafNodeMockRecorder) setPathLength(manager, thisRef, this, length
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "setPathLength", reflect.TypeOf((*MockleafNode)(nil).setPathLength), manager, thisRef, this, length)
 }
+
+// visit mocks base method.
+func (m *MockleafNode) visit(source NodeSource, thisRef *NodeReference, position visitPosition, visitor NodeVisitor) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "visit", source, thisRef, position, visitor)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// visit indicates an expected call of visit.
+func (mr *MockleafNodeMockRecorder) visit(source, thisRef, position, visitor any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "visit", reflect.TypeOf((*MockleafNode)(nil).visit), source, thisRef, position, visitor)
+}
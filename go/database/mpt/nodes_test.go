@@ -18,8 +18,11 @@ import (
 	"reflect"
 	"slices"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"unsafe"
 
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
 	"github.com/Fantom-foundation/Carmen/go/common"
 	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
 	gomock "go.uber.org/mock/gomock"
@@ -1079,8 +1082,11 @@ func TestBranchNode_VisitContinue(t *testing.T) {
 	handle := node.GetWriteHandle()
 	defer handle.Release()
 
-	node1.EXPECT().Visit(gomock.Any(), gomock.Any(), 3, visitor).Return(false, nil)
-	node2.EXPECT().Visit(gomock.Any(), gomock.Any(), 3, visitor).Return(false, nil)
+	index1, index8 := Nibble(1), Nibble(8)
+	position1 := visitPosition{depth: 3, parent: ref.Id(), index: &index1, path: []Nibble{1}}
+	position8 := visitPosition{depth: 3, parent: ref.Id(), index: &index8, path: []Nibble{8}}
+	node1.EXPECT().visit(gomock.Any(), gomock.Any(), position1, visitor).Return(false, nil)
+	node2.EXPECT().visit(gomock.Any(), gomock.Any(), position8, visitor).Return(false, nil)
 
 	depth2 := 2
 	visitor.EXPECT().Visit(handle.Get(), NodeInfo{Id: ref.Id(), Depth: &depth2}).Return(VisitResponseContinue)
@@ -1154,8 +1160,11 @@ func TestBranchNode_VisitAbortByChild(t *testing.T) {
 	handle := node.GetWriteHandle()
 	defer handle.Release()
 
-	node1.EXPECT().Visit(gomock.Any(), gomock.Any(), 3, visitor).Return(false, nil)
-	node2.EXPECT().Visit(gomock.Any(), gomock.Any(), 3, visitor).Return(true, nil) // = aborted
+	index1, index8 := Nibble(1), Nibble(8)
+	position1 := visitPosition{depth: 3, parent: ref.Id(), index: &index1, path: []Nibble{1}}
+	position8 := visitPosition{depth: 3, parent: ref.Id(), index: &index8, path: []Nibble{8}}
+	node1.EXPECT().visit(gomock.Any(), gomock.Any(), position1, visitor).Return(false, nil)
+	node2.EXPECT().visit(gomock.Any(), gomock.Any(), position8, visitor).Return(true, nil) // = aborted
 
 	depth2 := 2
 	visitor.EXPECT().Visit(handle.Get(), NodeInfo{Id: ref.Id(), Depth: &depth2}).Return(VisitResponseContinue)
@@ -1249,6 +1258,91 @@ func TestBranchNode_CheckDetectsIssues(t *testing.T) {
 	}
 }
 
+func TestBranchNode_CheckAcceptsSingleBranchChildOnlyWithoutExtensionNodes(t *testing.T) {
+	noExtensions := S4LiveConfig
+	noExtensions.DisableExtensionNodes = true
+	branch := &Branch{children: Children{1: &Value{}, 2: &Value{}}}
+	tests := map[string]struct {
+		config MptConfig
+		setup  NodeDesc
+		ok     bool
+	}{
+		"single branch child with extensions":    {S4LiveConfig, &Branch{children: Children{1: branch}}, false},
+		"single branch child without extensions": {noExtensions, &Branch{children: Children{1: branch}}, true},
+		"single value child without extensions":  {noExtensions, &Branch{children: Children{1: &Value{}}}, false},
+		"no children without extensions":         {noExtensions, &Branch{}, false},
+		"two children without extensions":        {noExtensions, &Branch{children: Children{1: branch, 2: &Value{}}}, true},
+		"extension without extensions":           {noExtensions, &Extension{path: []Nibble{1, 2, 3}, next: branch}, false},
+		"extension with extensions":              {S4LiveConfig, &Extension{path: []Nibble{1, 2, 3}, next: branch}, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ctxt := newNodeContextWithConfig(t, ctrl, test.config)
+			ref, node := ctxt.Build(test.setup)
+			handle := node.GetViewHandle()
+			defer handle.Release()
+
+			err := handle.Get().Check(ctxt, &ref, nil)
+			if test.ok && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !test.ok && err == nil {
+				t.Errorf("expected an error but check passed")
+			}
+		})
+	}
+}
+
+func TestBranchNode_CheckDetectsInvalidEmbeddedFlags(t *testing.T) {
+	small := common.Value{31: 1}       // < value nodes are embedded
+	large := common.Value{0: 1, 31: 1} // < value nodes are not embedded
+	tests := map[string]struct {
+		setup NodeDesc
+		ok    bool
+	}{
+		"embedded children": {&Branch{
+			children:         Children{1: &Value{length: 1, value: small}, 2: &Value{length: 1, value: small}},
+			embeddedChildren: []bool{1: true, 2: true},
+		}, true},
+		"non-embedded children": {&Branch{
+			children: Children{1: &Value{length: 1, value: large}, 2: &Value{length: 1, value: large}},
+		}, true},
+		"missing embedded flag": {&Branch{
+			children:         Children{1: &Value{length: 1, value: small}, 2: &Value{length: 1, value: small}},
+			embeddedChildren: []bool{1: true},
+		}, false},
+		"invalid embedded flag": {&Branch{
+			children:         Children{1: &Value{length: 1, value: large}, 2: &Value{length: 1, value: large}},
+			embeddedChildren: []bool{1: true},
+		}, false},
+		"dirty embedded flags are ignored": {&Branch{
+			children:         Children{1: &Value{length: 1, value: small}, 2: &Value{length: 1, value: large}},
+			embeddedChildren: []bool{2: true},
+			dirty:            true,
+			dirtyHash:        true,
+			dirtyChildHashes: []int{1, 2},
+		}, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ctxt := newNodeContextWithConfig(t, ctrl, S5LiveConfig)
+			ref, node := ctxt.Build(test.setup)
+			handle := node.GetViewHandle()
+			defer handle.Release()
+
+			err := handle.Get().Check(ctxt, &ref, nil)
+			if test.ok && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !test.ok && err == nil {
+				t.Errorf("expected an error but check passed")
+			}
+		})
+	}
+}
+
 // ----------------------------------------------------------------------------
 //                              Extension Node
 // ----------------------------------------------------------------------------
@@ -1293,6 +1387,52 @@ func TestExtensionNode_GetAccount(t *testing.T) {
 	}
 }
 
+func TestExtensionNode_DescentsReportNodesConsumingMoreNibblesThanRemain(t *testing.T) {
+	address := common.Address{0x12, 0x34}
+	info := AccountInfo{Nonce: common.Nonce{1}}
+	tests := map[string]NodeDesc{
+		"over-long extension": &Extension{
+			path: append(addressToNibbles(address), 1), // exceeds the address length
+			next: &Branch{children: Children{
+				1: &Account{address: address, info: info},
+				2: &Account{address: common.Address{0x56}, info: info},
+			}},
+		},
+		"branch after exhausting extension": &Extension{
+			path: addressToNibbles(address), // leaves no nibble for the branch
+			next: &Branch{children: Children{
+				1: &Account{address: address, info: info},
+				2: &Account{address: common.Address{0x56}, info: info},
+			}},
+		},
+	}
+
+	for name, trie := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ctxt := newNiceNodeContext(t, ctrl)
+			ref, node := ctxt.Build(trie)
+
+			path := addressToNibbles(address)
+			read := node.GetReadHandle()
+			if _, _, err := read.Get().GetAccount(ctxt, address, path); !errors.Is(err, ErrNodeTooDeep) {
+				t.Errorf("lookup should fail with %v, got %v", ErrNodeTooDeep, err)
+			}
+			read.Release()
+
+			write := node.GetWriteHandle()
+			if _, _, err := write.Get().SetAccount(ctxt, &ref, write, address, path, AccountInfo{Nonce: common.Nonce{2}}); !errors.Is(err, ErrNodeTooDeep) {
+				t.Errorf("update should fail with %v, got %v", ErrNodeTooDeep, err)
+			}
+			write.Release()
+
+			if err := CheckForest(ctxt, []*NodeReference{&ref}); !errors.Is(err, ErrNodeTooDeep) {
+				t.Errorf("check should fail with %v, got %v", ErrNodeTooDeep, err)
+			}
+		})
+	}
+}
+
 func TestExtensionNode_SetAccount_ExistingLeaf_UnchangedInfo(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	ctxt := newNodeContext(t, ctrl)
@@ -1454,6 +1594,56 @@ func TestExtensionNode_Frozen_SetAccount_ExistingLeaf_ChangedInfo(t *testing.T)
 	ctxt.ExpectEqualTries(t, after, newRoot)
 }
 
+func TestExtensionNode_SetAccount_ClonedNextNode_ReportsChange(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ctxt := newNodeContext(t, ctrl)
+	info1 := AccountInfo{Nonce: common.Nonce{1}}
+	info2 := AccountInfo{Nonce: common.Nonce{2}}
+
+	// Only the branch below the extension is frozen, as it is the case after
+	// splitting a frozen extension.
+	ref, node := ctxt.Build(
+		&Extension{
+			path: []Nibble{1, 2, 3},
+			next: &Tag{"B", &Branch{children: Children{
+				5: &Account{address: common.Address{0x12, 0x35}, info: info1},
+				8: &Account{address: common.Address{0x12, 0x38}, info: info2},
+			}}},
+		},
+	)
+	branch, _ := ctxt.Get("B")
+	ctxt.Freeze(branch)
+	ctxt.Check(t, ref)
+
+	after, _ := ctxt.Build(
+		&Extension{
+			path: []Nibble{1, 2, 3},
+			next: &Branch{children: Children{
+				5: &Account{address: common.Address{0x12, 0x35}, info: info2, dirty: true, dirtyHash: true},
+				8: &Account{address: common.Address{0x12, 0x38}, info: info2, frozen: true},
+			}, dirtyChildHashes: []int{5}, frozenChildren: []int{8}, dirty: true, dirtyHash: true},
+			dirty:         true,
+			hashDirty:     true,
+			nextHashDirty: true,
+		},
+	)
+	ctxt.Check(t, after)
+
+	// The frozen account and branch are cloned, the extension is modified.
+	ctxt.ExpectCreateAccount()
+	ctxt.ExpectCreateBranch()
+
+	trg := common.Address{0x12, 0x35}
+	path := addressToNibbles(trg)
+	handle := node.GetWriteHandle()
+	newRoot, changed, err := handle.Get().SetAccount(ctxt, &ref, handle, trg, path[:], info2)
+	handle.Release()
+	if newRoot != ref || !changed || err != nil {
+		t.Fatalf("update should return (%v,%v), got (%v,%v), err %v", ref, true, newRoot, changed, err)
+	}
+	ctxt.ExpectEqualTries(t, after, newRoot)
+}
+
 func TestExtensionNode_SetAccount_NewAccount_PartialExtensionCovered(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	ctxt := newNodeContext(t, ctrl)
@@ -2336,7 +2526,7 @@ func TestExtensionNode_VisitContinue(t *testing.T) {
 	handle := node.GetWriteHandle()
 	defer handle.Release()
 
-	next.EXPECT().Visit(gomock.Any(), gomock.Any(), 3, visitor).Return(false, nil)
+	next.EXPECT().visit(gomock.Any(), gomock.Any(), visitPosition{depth: 3, parent: ref.Id(), path: []Nibble{1, 2, 3}}, visitor).Return(false, nil)
 
 	depth2 := 2
 	visitor.EXPECT().Visit(handle.Get(), NodeInfo{Id: ref.Id(), Depth: &depth2}).Return(VisitResponseContinue)
@@ -2407,7 +2597,7 @@ func TestExtensionNode_VisitAbortByChild(t *testing.T) {
 	handle := node.GetWriteHandle()
 	defer handle.Release()
 
-	next.EXPECT().Visit(gomock.Any(), gomock.Any(), 3, visitor).Return(true, nil) // = abort
+	next.EXPECT().visit(gomock.Any(), gomock.Any(), visitPosition{depth: 3, parent: ref.Id(), path: []Nibble{1, 2, 3}}, visitor).Return(true, nil) // = abort
 
 	depth2 := 2
 	visitor.EXPECT().Visit(handle.Get(), NodeInfo{Id: ref.Id(), Depth: &depth2}).Return(VisitResponseContinue)
@@ -2454,6 +2644,51 @@ func TestExtensionNode_CheckDetectsIssues(t *testing.T) {
 	}
 }
 
+func TestExtensionNode_CheckDetectsInvalidEmbeddedFlag(t *testing.T) {
+	small := common.Value{31: 1}       // < the next branch is embedded
+	large := common.Value{0: 1, 31: 1} // < the next branch is not embedded
+	makeBranch := func(value common.Value, embedded bool) NodeDesc {
+		return &Branch{
+			children:         Children{1: &Value{length: 1, value: value}, 2: &Value{length: 1, value: value}},
+			embeddedChildren: []bool{1: embedded, 2: embedded},
+		}
+	}
+	tests := map[string]struct {
+		setup NodeDesc
+		ok    bool
+	}{
+		"embedded next":         {&Extension{path: []Nibble{1, 2, 3}, next: makeBranch(small, true), nextEmbedded: true}, true},
+		"non-embedded next":     {&Extension{path: []Nibble{1, 2, 3}, next: makeBranch(large, false)}, true},
+		"missing embedded flag": {&Extension{path: []Nibble{1, 2, 3}, next: makeBranch(small, true)}, false},
+		"invalid embedded flag": {&Extension{path: []Nibble{1, 2, 3}, next: makeBranch(large, false), nextEmbedded: true}, false},
+		"dirty embedded flag is ignored": {&Extension{
+			path:          []Nibble{1, 2, 3},
+			next:          makeBranch(large, false),
+			nextEmbedded:  true,
+			dirty:         true,
+			hashDirty:     true,
+			nextHashDirty: true,
+		}, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ctxt := newNodeContextWithConfig(t, ctrl, S5LiveConfig)
+			ref, node := ctxt.Build(test.setup)
+			handle := node.GetViewHandle()
+			defer handle.Release()
+
+			err := handle.Get().Check(ctxt, &ref, nil)
+			if test.ok && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !test.ok && err == nil {
+				t.Errorf("expected an error but check passed")
+			}
+		})
+	}
+}
+
 // ----------------------------------------------------------------------------
 //                               Account Node
 // ----------------------------------------------------------------------------
@@ -3534,7 +3769,7 @@ func TestAccountNode_VisitContinue(t *testing.T) {
 	handle := node.GetWriteHandle()
 	defer handle.Release()
 
-	storage.EXPECT().Visit(gomock.Any(), gomock.Any(), 3, visitor).Return(false, nil)
+	storage.EXPECT().visit(gomock.Any(), gomock.Any(), visitPosition{depth: 3, parent: ref.Id()}, visitor).Return(false, nil)
 
 	depth2 := 2
 	visitor.EXPECT().Visit(handle.Get(), NodeInfo{Id: ref.Id(), Depth: &depth2}).Return(VisitResponseContinue)
@@ -3605,7 +3840,7 @@ func TestAccountNode_VisitAbortByChild(t *testing.T) {
 	handle := node.GetWriteHandle()
 	defer handle.Release()
 
-	storage.EXPECT().Visit(gomock.Any(), gomock.Any(), 3, visitor).Return(true, nil)
+	storage.EXPECT().visit(gomock.Any(), gomock.Any(), visitPosition{depth: 3, parent: ref.Id()}, visitor).Return(true, nil)
 
 	depth2 := 2
 	visitor.EXPECT().Visit(handle.Get(), NodeInfo{Id: ref.Id(), Depth: &depth2}).Return(VisitResponseContinue)
@@ -4458,10 +4693,140 @@ func TestValueNode_CheckDetectsIssues(t *testing.T) {
 	}
 }
 
+func TestValueNode_CheckDetectsInvalidHashedKeys(t *testing.T) {
+	tests := map[string]struct {
+		known bool
+		hash  common.Hash
+		ok    bool
+	}{
+		"unknown":  {false, common.Hash{}, true},
+		"correct":  {true, common.Keccak256ForKey(common.Key{0x12, 0x34}), true},
+		"mismatch": {true, common.Hash{1, 2, 3}, false},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			config := MptConfig{
+				Hashing:                       EthereumLikeHashing,
+				TrackSuffixLengthsInLeafNodes: true,
+			}
+			ctxt := newNodeContextWithConfig(t, ctrl, config)
+			ref, node := ctxt.Build(&Value{
+				key:    common.Key{0x12, 0x34},
+				value:  common.Value{1},
+				length: 61,
+			})
+			handle := node.GetWriteHandle()
+			defer handle.Release()
+			value := handle.Get().(*ValueNode)
+			value.hashedKey = test.hash
+			value.hashedKeyKnown = test.known
+
+			err := value.Check(ctxt, &ref, []Nibble{1, 2, 3})
+			if test.ok && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !test.ok && (err == nil || !strings.Contains(err.Error(), "invalid hashed key")) {
+				t.Errorf("expected hashed key mismatch to be reported, got %v", err)
+			}
+		})
+	}
+}
+
 // ----------------------------------------------------------------------------
 //                             CheckForest
 // ----------------------------------------------------------------------------
 
+func TestNodes_SetSlot_NonExistingAccount_IsNoOp(t *testing.T) {
+	info := AccountInfo{Nonce: common.Nonce{1}}
+	tests := map[string]func() NodeDesc{
+		"empty": func() NodeDesc {
+			return Empty{}
+		},
+		"account": func() NodeDesc {
+			return &Account{address: common.Address{0x13}, info: info}
+		},
+		"account_with_storage": func() NodeDesc {
+			return &Account{address: common.Address{0x13}, info: info,
+				storage: &Value{key: common.Key{1}, value: common.Value{1}},
+			}
+		},
+		"branch_without_child": func() NodeDesc {
+			return &Branch{children: Children{
+				2: &Account{address: common.Address{0x21}, info: info},
+				3: &Account{address: common.Address{0x31}, info: info},
+			}}
+		},
+		"branch_with_other_account": func() NodeDesc {
+			return &Branch{children: Children{
+				1: &Account{address: common.Address{0x13}, info: info},
+				2: &Account{address: common.Address{0x21}, info: info},
+			}}
+		},
+		"extension_partial_path": func() NodeDesc {
+			return &Extension{
+				path: []Nibble{1, 2, 3},
+				next: &Branch{children: Children{
+					1: &Account{address: common.Address{0x12, 0x31}, info: info},
+					2: &Account{address: common.Address{0x12, 0x32}, info: info},
+				}},
+			}
+		},
+		"extension_full_path": func() NodeDesc {
+			return &Extension{
+				path: []Nibble{1, 2},
+				next: &Branch{children: Children{
+					1: &Account{address: common.Address{0x12, 0x10}, info: info},
+					2: &Account{address: common.Address{0x12, 0x20}, info: info},
+				}},
+			}
+		},
+	}
+
+	for name, desc := range tests {
+		for _, frozen := range []bool{false, true} {
+			for _, value := range []common.Value{{}, {1}} {
+				t.Run(fmt.Sprintf("%s/frozen=%t/value=%x", name, frozen, value[0]), func(t *testing.T) {
+					ctrl := gomock.NewController(t)
+					ctxt := newNodeContext(t, ctrl)
+
+					ref, node := ctxt.Build(desc())
+					if frozen {
+						ctxt.Freeze(ref)
+					}
+					after, _ := ctxt.Clone(ref)
+					ctxt.Check(t, ref)
+
+					hashBefore, err := ctxt.getHashFor(&ref)
+					if err != nil {
+						t.Fatalf("failed to compute hash: %v", err)
+					}
+
+					addr := common.Address{0x12}
+					path := addressToNibbles(addr)
+					handle := node.GetWriteHandle()
+					newRoot, changed, err := handle.Get().SetSlot(ctxt, &ref, handle, addr, path[:], common.Key{1}, value)
+					handle.Release()
+					if newRoot != ref || changed || err != nil {
+						t.Fatalf("update should return (%v,%v), got (%v,%v), err %v", ref, false, newRoot, changed, err)
+					}
+
+					ctxt.Check(t, ref)
+					ctxt.ExpectEqualTries(t, after, ref)
+
+					hashAfter, err := ctxt.getHashFor(&ref)
+					if err != nil {
+						t.Fatalf("failed to compute hash: %v", err)
+					}
+					if hashBefore != hashAfter {
+						t.Errorf("hash of trie changed, wanted %x, got %x", hashBefore, hashAfter)
+					}
+				})
+			}
+		}
+	}
+}
+
 func TestCheckForest_DetectsIssuesInTrees(t *testing.T) {
 	tests := map[string]struct {
 		tree NodeDesc
@@ -4503,6 +4868,69 @@ func TestCheckForest_DetectsIssuesInTrees(t *testing.T) {
 	}
 }
 
+func TestCheckForest_DetectsNodesConsumingMoreNibblesThanRemain(t *testing.T) {
+	key := common.Key{0x12}
+	account := func(address common.Address) NodeDesc {
+		return &Account{address: address, info: AccountInfo{Nonce: common.Nonce{1}}}
+	}
+	value := func(key common.Key) NodeDesc {
+		return &Value{key: key, value: common.Value{1}}
+	}
+	tests := map[string]struct {
+		tree NodeDesc
+		ok   bool
+	}{
+		"extension reaching last nibble of address": {&Extension{
+			path: addressToNibbles(common.Address{0x12})[:39],
+			next: &Branch{children: Children{
+				0: account(common.Address{0x12}),
+				1: account(common.Address{0x12, 19: 0x01}),
+			}},
+		}, true},
+		"extension exhausting address": {&Extension{
+			path: addressToNibbles(common.Address{0x12}),
+			next: &Branch{children: Children{
+				0: account(common.Address{0x12}),
+				1: account(common.Address{0x12, 19: 0x01}),
+			}},
+		}, false},
+		"extension exceeding address": {&Extension{
+			path: append(addressToNibbles(common.Address{0x12}), 0),
+			next: &Branch{children: Children{
+				0: account(common.Address{0x12}),
+				1: account(common.Address{0x12, 19: 0x01}),
+			}},
+		}, false},
+		"extension exhausting key in storage": {&Account{
+			address: common.Address{0x12},
+			info:    AccountInfo{Nonce: common.Nonce{1}},
+			storage: &Extension{
+				path: keyToNibbles(key),
+				next: &Branch{children: Children{
+					0: value(key),
+					1: value(common.Key{0x12, 31: 0x01}),
+				}},
+			},
+		}, false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ctxt := newNodeContext(t, ctrl)
+			ref, _ := ctxt.Build(test.tree)
+
+			err := CheckForest(ctxt, []*NodeReference{&ref})
+			if test.ok && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !test.ok && !errors.Is(err, ErrNodeTooDeep) {
+				t.Errorf("expected nodes to be reported too deep, got %v", err)
+			}
+		})
+	}
+}
+
 func TestCheckForest_AcceptsValidReUse(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	ctxt := newNodeContext(t, ctrl)
@@ -4551,6 +4979,171 @@ func TestCheckForest_DetectsInvalidReUse(t *testing.T) {
 	}
 }
 
+func TestCheckForest_AllErrorsAreReported(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ctxt := newNodeContext(t, ctrl)
+	ref, _ := ctxt.Build(&Branch{children: Children{
+		1: &Account{address: common.Address{0x12}, info: AccountInfo{}}, // empty info
+		4: &Account{address: common.Address{0x45}, info: AccountInfo{}}, // empty info
+		8: &Value{key: common.Key{0x82}, value: common.Value{1}},        // no account
+	}})
+
+	err := CheckForest(ctxt, []*NodeReference{&ref})
+	if err == nil {
+		t.Fatalf("expected errors but check passed")
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != 3 {
+		t.Errorf("expected 3 errors, got %v", err)
+	}
+	if !slices.IsSorted(lines) {
+		t.Errorf("errors are not sorted: %v", err)
+	}
+}
+
+func TestCheckForestInParallel_ReportsSameErrorsAsSequentialCheck(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ctxt := newNodeContext(t, ctrl)
+
+	children := Children{}
+	for i := 0; i < 16; i++ {
+		grandChildren := Children{}
+		for j := 0; j < 16; j++ {
+			info := AccountInfo{Nonce: common.Nonce{1}}
+			if (i+j)%7 == 0 {
+				info = AccountInfo{} // empty info
+			}
+			grandChildren[Nibble(j)] = &Account{address: common.Address{byte(i<<4 | j)}, info: info}
+		}
+		children[Nibble(i)] = &Branch{children: grandChildren}
+	}
+	ref, _ := ctxt.Build(&Branch{children: children})
+
+	want := CheckForest(ctxt, []*NodeReference{&ref})
+	if want == nil {
+		t.Fatalf("expected errors but check passed")
+	}
+	for _, workers := range []int{0, 1, 2, 4, 8} {
+		got := CheckForestInParallel(ctxt, []*NodeReference{&ref}, workers)
+		if got == nil || want.Error() != got.Error() {
+			t.Errorf("unexpected result with %d workers, wanted %v, got %v", workers, want, got)
+		}
+	}
+}
+
+func TestCheckForestInParallel_SharedNodesAreCheckedOnce(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ctxt := newNodeContext(t, ctrl)
+
+	node := NewMockNode(ctrl)
+	node.EXPECT().IsFrozen().AnyTimes().Return(false)
+	node.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()) // shared node is only checked once
+	refMock, _ := ctxt.Build(&Mock{node})
+
+	roots := []*NodeReference{}
+	for i := 0; i < 16; i++ {
+		ref, shared := ctxt.Build(&Branch{children: Children{
+			1: &Account{address: common.Address{0x10 + byte(i)}, info: AccountInfo{Nonce: common.Nonce{1}}},
+		}})
+		handle := shared.GetWriteHandle()
+		handle.Get().(*BranchNode).children[4] = refMock
+		handle.Release()
+		roots = append(roots, &ref)
+	}
+
+	if err := CheckForestInParallel(ctxt, roots, 4); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckForestInParallel_HashersAreCreatedOncePerWorker(t *testing.T) {
+	created := atomic.Int32{}
+	config := S5ArchiveConfig
+	config.Hashing = hashAlgorithm{
+		Name: "counting",
+		createHasher: func(hash HashFunction) hasher {
+			created.Add(1)
+			return makeEthereumLikeHasherWith(hash)
+		},
+	}
+	const workers = 4
+	archive, err := OpenArchiveTrieWithConfig(t.TempDir(), config, ForestConfig{
+		CacheCapacity: 1 << 16,
+		CheckWorkers:  workers,
+	})
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+	addCheckBenchmarkBlocks(t, archive, 5, 20)
+
+	created.Store(0)
+	if err := archive.Check(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got := created.Load(); got > workers {
+		t.Errorf("unexpected number of created hashers, wanted at most %d, got %d", workers, got)
+	}
+}
+
+func TestCheckForestInParallel_ArchiveCanBeChecked(t *testing.T) {
+	archive, err := OpenArchiveTrieWithConfig(t.TempDir(), S5ArchiveConfig, ForestConfig{
+		CacheCapacity: 1 << 16,
+		CheckWorkers:  4,
+	})
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+	addCheckBenchmarkBlocks(t, archive, 20, 20)
+	if err := archive.Check(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// addCheckBenchmarkBlocks adds the given number of blocks to the archive,
+// each updating the given number of accounts and slots.
+func addCheckBenchmarkBlocks(t testing.TB, archive *ArchiveTrie, blocks, updates int) {
+	t.Helper()
+	for block := 0; block < blocks; block++ {
+		update := common.Update{}
+		for i := 0; i < updates; i++ {
+			addr := common.Address{byte(i), byte(i >> 8)}
+			if block == 0 {
+				update.AppendCreateAccount(addr)
+			}
+			update.AppendNonceUpdate(addr, common.ToNonce(uint64(block+1)))
+			update.AppendSlotUpdate(addr, common.Key{byte(block), byte(i)}, common.Value{1})
+		}
+		if err := archive.Add(uint64(block), update, nil); err != nil {
+			t.Fatalf("failed to add block %d: %v", block, err)
+		}
+	}
+}
+
+func BenchmarkCheckForestInParallel(b *testing.B) {
+	archive, err := OpenArchiveTrie(b.TempDir(), S5ArchiveConfig, 1<<20)
+	if err != nil {
+		b.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+	addCheckBenchmarkBlocks(b, archive, 50, 500)
+
+	roots := make([]*NodeReference, archive.roots.length())
+	for i := range roots {
+		roots[i] = &archive.roots.roots[i].NodeRef
+	}
+	for _, workers := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := CheckForestInParallel(archive.nodeSource, roots, workers); err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
+
 // ----------------------------------------------------------------------------
 //                              HashStatus
 // ----------------------------------------------------------------------------
@@ -4680,6 +5273,52 @@ func TestBranchNodeEncoderWithChildHashes(t *testing.T) {
 	}
 }
 
+func TestBranchNodeWithLeafCountEncoders_StoreLeafCounts(t *testing.T) {
+	encoders := map[string]stock.ValueEncoder[BranchNode]{
+		"withChildHashes": BranchNodeWithLeafCountEncoderWithChildHashes{},
+		"withNodeHash":    BranchNodeWithLeafCountEncoderWithNodeHash{},
+	}
+	for name, encoder := range encoders {
+		for _, known := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/known=%t", name, known), func(t *testing.T) {
+				node := BranchNode{
+					nodeBase: nodeBase{
+						hash:       common.Hash{1, 2, 3},
+						hashStatus: hashStatusClean,
+					},
+					children: [16]NodeReference{
+						NewNodeReference(ValueId(1)),
+						NewNodeReference(ValueId(2)),
+					},
+					hashes: [16]common.Hash{{1}, {2}},
+				}
+				if known {
+					node.setLeafCount(12)
+				}
+				buffer := make([]byte, encoder.GetEncodedSize())
+				if err := encoder.Store(buffer, &node); err != nil {
+					t.Fatalf("failed to store node: %v", err)
+				}
+				recovered := BranchNode{}
+				if err := encoder.Load(buffer, &recovered); err != nil {
+					t.Fatalf("failed to load node: %v", err)
+				}
+				if want, got := node.leafCountKnown, recovered.leafCountKnown; want != got {
+					t.Errorf("unexpected leaf count state, wanted %t, got %t", want, got)
+				}
+				if want, got := node.leafCount, recovered.leafCount; want != got {
+					t.Errorf("unexpected leaf count, wanted %d, got %d", want, got)
+				}
+				for i := range node.children {
+					if want, got := node.children[i].Id(), recovered.children[i].Id(); want != got {
+						t.Errorf("unexpected child %d, wanted %v, got %v", i, want, got)
+					}
+				}
+			})
+		}
+	}
+}
+
 func TestBranchNodeEncoderWithNodeHash(t *testing.T) {
 	node := BranchNode{
 		nodeBase: nodeBase{
@@ -4835,6 +5474,60 @@ func TestValueNodeWithPathLengthEncoderWithNodeHash(t *testing.T) {
 	}
 }
 
+func TestValueNodeWithPathLengthAndHashedKeyEncoders_StoreHashedKeys(t *testing.T) {
+	encoders := map[string]stock.ValueEncoder[ValueNode]{
+		"withoutNodeHash": ValueNodeWithPathLengthAndHashedKeyEncoderWithoutNodeHash{},
+		"withNodeHash":    ValueNodeWithPathLengthAndHashedKeyEncoderWithNodeHash{},
+	}
+	for name, encoder := range encoders {
+		t.Run(name, func(t *testing.T) {
+			node := ValueNode{
+				nodeBase: nodeBase{
+					hash:       common.Hash{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31},
+					hashStatus: hashStatusClean,
+				},
+				key:        common.Key{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32},
+				value:      common.Value{2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33},
+				pathLength: 12,
+			}
+			buffer := make([]byte, encoder.GetEncodedSize())
+
+			// Unknown hashed keys are computed while storing the node.
+			if err := encoder.Store(buffer, &node); err != nil {
+				t.Fatalf("failed to store node: %v", err)
+			}
+			if node.hashedKeyKnown {
+				t.Errorf("storing a node should not modify it")
+			}
+			recovered := ValueNode{}
+			if err := encoder.Load(buffer, &recovered); err != nil {
+				t.Fatalf("failed to load node: %v", err)
+			}
+			if name == "withoutNodeHash" {
+				node.hash = common.Hash{}
+				node.hashStatus = hashStatusUnknown
+			}
+			node.hashedKey = common.Keccak256ForKey(node.key)
+			node.hashedKeyKnown = true
+			if !reflect.DeepEqual(node, recovered) {
+				t.Errorf("encoding/decoding failed, wanted %v, got %v", node, recovered)
+			}
+
+			// Known hashed keys are stored as they are.
+			node.hashedKey = common.Hash{1, 2, 3}
+			if err := encoder.Store(buffer, &node); err != nil {
+				t.Fatalf("failed to store node: %v", err)
+			}
+			if err := encoder.Load(buffer, &recovered); err != nil {
+				t.Fatalf("failed to load node: %v", err)
+			}
+			if !reflect.DeepEqual(node, recovered) {
+				t.Errorf("encoding/decoding failed, wanted %v, got %v", node, recovered)
+			}
+		})
+	}
+}
+
 // ----------------------------------------------------------------------------
 //                               Transitions
 // ----------------------------------------------------------------------------
@@ -6502,13 +7195,13 @@ func markModifiedAsDirty(t *testing.T, ctxt *nodeContext, before, after NodeRefe
 		if !isReused(n) {
 			switch n := n.(type) {
 			case (*AccountNode):
-				n.markDirty()
+				n.setDirty()
 			case (*BranchNode):
-				n.markDirty()
+				n.setDirty()
 			case (*ExtensionNode):
-				n.markDirty()
+				n.setDirty()
 			case (*ValueNode):
-				n.markDirty()
+				n.setDirty()
 			}
 		}
 		// Also update the dirty child-hash markers in the nodes.
@@ -7974,6 +8667,7 @@ func newNodeContextWithConfig(t *testing.T, ctrl *gomock.Controller, config MptC
 	res.EXPECT().getConfig().AnyTimes().Return(config)
 	res.EXPECT().hashAddress(gomock.Any()).AnyTimes().DoAndReturn(common.Keccak256ForAddress)
 	res.EXPECT().hashKey(gomock.Any()).AnyTimes().DoAndReturn(common.Keccak256ForKey)
+	res.EXPECT().trackDirtyNode(gomock.Any(), gomock.Any()).AnyTimes()
 	res.EXPECT().getHashFor(gomock.Any()).AnyTimes().DoAndReturn(func(ref *NodeReference) (common.Hash, error) {
 		// Mock nodes have a constant hash of zero.
 		handle, err := res.getViewAccess(ref)
@@ -7985,7 +8679,7 @@ func newNodeContextWithConfig(t *testing.T, ctrl *gomock.Controller, config MptC
 			return common.Hash{}, nil
 		}
 		// All others are hashed according to the configuration.
-		hasher := config.Hashing.createHasher()
+		hasher := config.Hashing.createHasher(config.HashFunction)
 		return hasher.getHash(ref, res)
 	})
 
@@ -8093,6 +8787,12 @@ func (c *nodeContext) Build(desc NodeDesc) (NodeReference, *shared.Shared[Node])
 
 	if !wantsHashDirty {
 		hash, _ := c.getHashFor(&ref)
+		// Like the hasher, assign a zero hash to embedded nodes.
+		view := node.GetViewHandle()
+		if embedded, _ := c.config.Hashing.createHasher(c.config.HashFunction).isEmbedded(view.Get(), c); embedded {
+			hash = common.Hash{}
+		}
+		view.Release()
 		write := node.GetWriteHandle()
 		write.Get().SetHash(hash)
 		write.Release()
@@ -8567,3 +9267,122 @@ func (m refTo) Matches(value any) bool {
 func (m refTo) String() string {
 	return fmt.Sprintf("reference to %v", m.id)
 }
+
+func TestWideReferenceEncoders_PreserveReferencesBeyondNarrowRange(t *testing.T) {
+	config := S5ArchiveWideReferencesConfig
+	accountEncoder, branchEncoder, extensionEncoder, _ := getEncoder(config)
+
+	account := AccountNode{
+		address:    common.Address{1},
+		info:       AccountInfo{Nonce: common.ToNonce(1)},
+		storage:    NewNodeReference(BranchId(1<<50 + 7)),
+		pathLength: 3,
+	}
+	buffer := make([]byte, accountEncoder.GetEncodedSize())
+	if err := accountEncoder.Store(buffer, &account); err != nil {
+		t.Fatalf("failed to store account: %v", err)
+	}
+	recoveredAccount := AccountNode{}
+	if err := accountEncoder.Load(buffer, &recoveredAccount); err != nil {
+		t.Fatalf("failed to load account: %v", err)
+	}
+	if want, got := account.storage.Id(), recoveredAccount.storage.Id(); want != got {
+		t.Errorf("unexpected storage reference, wanted %v, got %v", want, got)
+	}
+
+	branch := BranchNode{
+		nodeBase: nodeBase{hashStatus: hashStatusClean},
+	}
+	branch.children[1] = NewNodeReference(ValueId(1<<60 + 5))
+	branch.children[2] = NewNodeReference(BranchId(1<<47 - 1))
+	branch.children[3] = NewNodeReference(AccountId(12))
+	buffer = make([]byte, branchEncoder.GetEncodedSize())
+	if err := branchEncoder.Store(buffer, &branch); err != nil {
+		t.Fatalf("failed to store branch: %v", err)
+	}
+	recoveredBranch := BranchNode{}
+	if err := branchEncoder.Load(buffer, &recoveredBranch); err != nil {
+		t.Fatalf("failed to load branch: %v", err)
+	}
+	for i, child := range branch.children {
+		if want, got := child.Id(), recoveredBranch.children[i].Id(); want != got {
+			t.Errorf("unexpected child %d, wanted %v, got %v", i, want, got)
+		}
+	}
+	// The low 48 bits of the ID of child 2 are zero, yet its hash must be
+	// considered dirty like the hashes of all other non-empty children.
+	if want, got := uint16(0b1110), recoveredBranch.dirtyHashes; want != got {
+		t.Errorf("unexpected dirty child hashes, wanted %016b, got %016b", want, got)
+	}
+
+	extension := ExtensionNode{
+		path: CreatePathFromNibbles([]Nibble{1, 2}),
+		next: NewNodeReference(BranchId(1<<55 + 3)),
+	}
+	buffer = make([]byte, extensionEncoder.GetEncodedSize())
+	if err := extensionEncoder.Store(buffer, &extension); err != nil {
+		t.Fatalf("failed to store extension: %v", err)
+	}
+	recoveredExtension := ExtensionNode{}
+	if err := extensionEncoder.Load(buffer, &recoveredExtension); err != nil {
+		t.Fatalf("failed to load extension: %v", err)
+	}
+	if want, got := extension.next.Id(), recoveredExtension.next.Id(); want != got {
+		t.Errorf("unexpected next reference, wanted %v, got %v", want, got)
+	}
+}
+
+func TestWideReferenceEncoders_ExtendNarrowEncodersByTwoBytesPerReference(t *testing.T) {
+	for _, config := range []MptConfig{S5LiveWideReferencesConfig, S5ArchiveWideReferencesConfig} {
+		narrow := config
+		narrow.UseWideNodeReferences = false
+		accounts, branches, extensions, values := getEncoder(config)
+		narrowAccounts, narrowBranches, narrowExtensions, narrowValues := getEncoder(narrow)
+		if want, got := narrowAccounts.GetEncodedSize()+2, accounts.GetEncodedSize(); want != got {
+			t.Errorf("%s: unexpected account size, wanted %d, got %d", config.Name, want, got)
+		}
+		if want, got := narrowBranches.GetEncodedSize()+32, branches.GetEncodedSize(); want != got {
+			t.Errorf("%s: unexpected branch size, wanted %d, got %d", config.Name, want, got)
+		}
+		if want, got := narrowExtensions.GetEncodedSize()+2, extensions.GetEncodedSize(); want != got {
+			t.Errorf("%s: unexpected extension size, wanted %d, got %d", config.Name, want, got)
+		}
+		if want, got := narrowValues.GetEncodedSize(), values.GetEncodedSize(); want != got {
+			t.Errorf("%s: unexpected value size, wanted %d, got %d", config.Name, want, got)
+		}
+	}
+}
+
+func TestNodeBase_GenerationIsUpdatedByModifications(t *testing.T) {
+	node := &nodeBase{}
+	generation := node.getGeneration()
+	node.MarkClean()
+	ref := NewNodeReference(ValueId(1))
+	ctrl := gomock.NewController(t)
+	manager := NewMockNodeManager(ctrl)
+	manager.EXPECT().trackDirtyNode(&ref, true)
+	manager.EXPECT().trackDirtyNode(&ref, false)
+
+	node.markDirty(manager, &ref)
+	if got := node.getGeneration(); got == generation {
+		t.Errorf("generation not updated by markDirty, got %d", got)
+	}
+	generation = node.getGeneration()
+	node.Release(manager, &ref)
+	if got := node.getGeneration(); got == generation {
+		t.Errorf("generation not updated by Release, got %d", got)
+	}
+}
+
+func TestNodeBase_GenerationFitsIntoAlignedNodeBase(t *testing.T) {
+	type nodeBaseWithoutGeneration struct {
+		hash       common.Hash
+		hashStatus hashStatus
+		clean      bool
+		frozen     bool
+	}
+	aligned := (unsafe.Sizeof(nodeBaseWithoutGeneration{}) + 7) / 8 * 8
+	if got, want := unsafe.Sizeof(nodeBase{}), aligned; got != want {
+		t.Errorf("unexpected size of node base, wanted %d, got %d", want, got)
+	}
+}
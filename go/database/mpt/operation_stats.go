@@ -0,0 +1,281 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
+)
+
+// maxTrackedNodeVisits is the largest number of node visits per operation
+// distinguished by operation statistics. Operations visiting more nodes are
+// accounted to this number.
+const maxTrackedNodeVisits = 128
+
+// NodeVisitHistogram is a histogram on the number of node visits of
+// operations. The i-th element is the number of operations with i visits.
+type NodeVisitHistogram []uint64
+
+// Count returns the number of operations covered by this histogram.
+func (h NodeVisitHistogram) Count() uint64 {
+	res := uint64(0)
+	for _, count := range h {
+		res += count
+	}
+	return res
+}
+
+// Mean returns the average number of visits per operation, 0 if empty.
+func (h NodeVisitHistogram) Mean() float64 {
+	count, sum := uint64(0), uint64(0)
+	for visits, c := range h {
+		count += c
+		sum += uint64(visits) * c
+	}
+	if count == 0 {
+		return 0
+	}
+	return float64(sum) / float64(count)
+}
+
+// Percentile returns the smallest number of visits not exceeded by the given
+// percentage of operations, where p is in the range [0,100]. For an empty
+// histogram, 0 is returned.
+func (h NodeVisitHistogram) Percentile(p float64) int {
+	count := h.Count()
+	if count == 0 {
+		return 0
+	}
+	// The rank of the operation determining the percentile, at least 1.
+	rank := uint64(math.Ceil(p / 100 * float64(count)))
+	if rank == 0 {
+		rank = 1
+	}
+	seen := uint64(0)
+	for visits, c := range h {
+		seen += c
+		if seen >= rank {
+			return visits
+		}
+	}
+	return len(h) - 1
+}
+
+// OperationStats summarizes the node visits of all operations of one kind.
+// Each visit either finds the node in the node cache or loads it from the
+// disk. Nodes recovered from the write buffer are accounted as disk reads.
+type OperationStats struct {
+	Visits    NodeVisitHistogram // the total number of nodes visited per operation
+	CacheHits NodeVisitHistogram // the number of visited nodes found in the node cache per operation
+	DiskReads NodeVisitHistogram // the number of visited nodes missing in the node cache per operation
+}
+
+func (s OperationStats) String() string {
+	return fmt.Sprintf(
+		"%d ops, visits avg %.2f p99 %d, cache hits avg %.2f p99 %d, disk reads avg %.2f p99 %d",
+		s.Visits.Count(),
+		s.Visits.Mean(), s.Visits.Percentile(99),
+		s.CacheHits.Mean(), s.CacheHits.Percentile(99),
+		s.DiskReads.Mean(), s.DiskReads.Percentile(99),
+	)
+}
+
+// OperationStatsReport summarizes the node visits of the lookups and updates
+// conducted on a forest since metrics got enabled or last reset. Node visits
+// are only covered if metrics are enabled, timings only if timings are
+// enabled.
+type OperationStatsReport struct {
+	GetAccountInfo OperationStats
+	GetValue       OperationStats
+	SetAccountInfo OperationStats
+	SetValue       OperationStats
+	Timings        OperationTimings
+}
+
+func (r OperationStatsReport) String() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "GetAccountInfo: %v\n", r.GetAccountInfo)
+	fmt.Fprintf(&builder, "GetValue:       %v\n", r.GetValue)
+	fmt.Fprintf(&builder, "SetAccountInfo: %v\n", r.SetAccountInfo)
+	fmt.Fprintf(&builder, "SetValue:       %v\n", r.SetValue)
+	timings := r.Timings
+	if timings.Descent.Count() > 0 || timings.Hashing.Count() > 0 {
+		fmt.Fprintf(&builder, "Descent:        %v\n", timings.Descent)
+		fmt.Fprintf(&builder, "Hashing:        %v\n", timings.Hashing)
+		fmt.Fprintf(&builder, "Encoding:       %v\n", timings.Encoding)
+		fmt.Fprintf(&builder, "StockReads:     %v\n", timings.StockReads)
+		fmt.Fprintf(&builder, "StockWrites:    %v\n", timings.StockWrites)
+	}
+	return builder.String()
+}
+
+// operationStatsProvider is implemented by Database instances supporting
+// the collection of per-operation node visit metrics.
+type operationStatsProvider interface {
+	// GetOperationStats returns the statistics collected since metrics got
+	// enabled or last reset.
+	GetOperationStats() (OperationStatsReport, error)
+	// ResetOperationStats discards all statistics collected so far.
+	ResetOperationStats() error
+}
+
+const operationMetricsDisabledErr = common.ConstError("operation metrics and timings are not enabled")
+
+// operationKind enumerates the operations covered by operation statistics.
+type operationKind int
+
+const (
+	getAccountInfoOperation operationKind = iota
+	getValueOperation
+	setAccountInfoOperation
+	setValueOperation
+	numOperationKinds
+)
+
+// operationStatsCollector aggregates the node visits of operations into
+// histograms. Counters are updated atomically, such that concurrent
+// operations do not contend on a lock.
+type operationStatsCollector struct {
+	visits    [numOperationKinds][maxTrackedNodeVisits + 1]atomic.Uint64
+	cacheHits [numOperationKinds][maxTrackedNodeVisits + 1]atomic.Uint64
+	diskReads [numOperationKinds][maxTrackedNodeVisits + 1]atomic.Uint64
+}
+
+// record accounts the node visits counted by the given counter to the given
+// kind of operation.
+func (c *operationStatsCollector) record(op operationKind, counter *nodeVisitCounter) {
+	c.visits[op][toHistogramBucket(counter.visits)].Add(1)
+	c.cacheHits[op][toHistogramBucket(counter.visits-counter.diskReads)].Add(1)
+	c.diskReads[op][toHistogramBucket(counter.diskReads)].Add(1)
+}
+
+func toHistogramBucket(visits int) int {
+	if visits > maxTrackedNodeVisits {
+		return maxTrackedNodeVisits
+	}
+	return visits
+}
+
+// getStats produces a snapshot of the collected histograms. Operations
+// recorded concurrently may be only partially covered by the snapshot.
+func (c *operationStatsCollector) getStats() OperationStatsReport {
+	get := func(op operationKind) OperationStats {
+		return OperationStats{
+			Visits:    snapshotHistogram(&c.visits[op]),
+			CacheHits: snapshotHistogram(&c.cacheHits[op]),
+			DiskReads: snapshotHistogram(&c.diskReads[op]),
+		}
+	}
+	return OperationStatsReport{
+		GetAccountInfo: get(getAccountInfoOperation),
+		GetValue:       get(getValueOperation),
+		SetAccountInfo: get(setAccountInfoOperation),
+		SetValue:       get(setValueOperation),
+	}
+}
+
+// reset discards all collected statistics.
+func (c *operationStatsCollector) reset() {
+	for op := range c.visits {
+		for i := range c.visits[op] {
+			c.visits[op][i].Store(0)
+			c.cacheHits[op][i].Store(0)
+			c.diskReads[op][i].Store(0)
+		}
+	}
+}
+
+func snapshotHistogram(counters *[maxTrackedNodeVisits + 1]atomic.Uint64) NodeVisitHistogram {
+	// Trailing zeros are trimmed to keep the snapshot compact.
+	length := 0
+	for i := range counters {
+		if counters[i].Load() > 0 {
+			length = i + 1
+		}
+	}
+	res := make(NodeVisitHistogram, length)
+	for i := range res {
+		res[i] = counters[i].Load()
+	}
+	return res
+}
+
+// nodeVisitCounter is a NodeManager counting the nodes accessed through it
+// and the number of those accesses that missed the node cache. It is used as
+// a per-call accumulator for the node visits of a single operation.
+type nodeVisitCounter struct {
+	*Forest
+	visits    int
+	diskReads int
+}
+
+// visit records an access to the given node.
+func (c *nodeVisitCounter) visit(ref *NodeReference) {
+	c.visits++
+	if _, found := c.Forest.nodeCache.Get(ref); !found {
+		c.diskReads++
+	}
+}
+
+func (c *nodeVisitCounter) getReadAccess(ref *NodeReference) (shared.ReadHandle[Node], error) {
+	c.visit(ref)
+	return c.Forest.getReadAccess(ref)
+}
+
+func (c *nodeVisitCounter) getViewAccess(ref *NodeReference) (shared.ViewHandle[Node], error) {
+	c.visit(ref)
+	return c.Forest.getViewAccess(ref)
+}
+
+func (c *nodeVisitCounter) getHashAccess(ref *NodeReference) (shared.HashHandle[Node], error) {
+	c.visit(ref)
+	return c.Forest.getHashAccess(ref)
+}
+
+func (c *nodeVisitCounter) getWriteAccess(ref *NodeReference) (shared.WriteHandle[Node], error) {
+	c.visit(ref)
+	return c.Forest.getWriteAccess(ref)
+}
+
+// GetOperationStats returns histograms on the number of nodes visited by
+// lookups and updates and on the durations of their phases since metrics got
+// enabled or last reset. An error is returned if neither metrics nor timings
+// are enabled for this forest.
+func (s *Forest) GetOperationStats() (OperationStatsReport, error) {
+	if s.operationStats == nil && s.timer == nil {
+		return OperationStatsReport{}, operationMetricsDisabledErr
+	}
+	res := OperationStatsReport{}
+	if s.operationStats != nil {
+		res = s.operationStats.getStats()
+	}
+	res.Timings = s.timer.getTimings()
+	return res, nil
+}
+
+// ResetOperationStats discards all statistics on node visits and timings
+// collected so far. An error is returned if neither metrics nor timings are
+// enabled for this forest.
+func (s *Forest) ResetOperationStats() error {
+	if s.operationStats == nil && s.timer == nil {
+		return operationMetricsDisabledErr
+	}
+	if s.operationStats != nil {
+		s.operationStats.reset()
+	}
+	s.timer.reset()
+	return nil
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestNodeVisitHistogram_MeanAndPercentiles(t *testing.T) {
+	tests := map[string]struct {
+		histogram NodeVisitHistogram
+		mean      float64
+		p50, p99  int
+	}{
+		"empty":          {histogram: nil, mean: 0, p50: 0, p99: 0},
+		"single bucket":  {histogram: NodeVisitHistogram{0, 0, 4}, mean: 2, p50: 2, p99: 2},
+		"two buckets":    {histogram: NodeVisitHistogram{0, 1, 0, 1}, mean: 2, p50: 1, p99: 3},
+		"long tail":      {histogram: NodeVisitHistogram{0, 99, 0, 0, 1}, mean: 1.03, p50: 1, p99: 1},
+		"only zero hits": {histogram: NodeVisitHistogram{3}, mean: 0, p50: 0, p99: 0},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := test.histogram.Mean(); got != test.mean {
+				t.Errorf("unexpected mean, wanted %v, got %v", test.mean, got)
+			}
+			if got := test.histogram.Percentile(50); got != test.p50 {
+				t.Errorf("unexpected p50, wanted %d, got %d", test.p50, got)
+			}
+			if got := test.histogram.Percentile(99); got != test.p99 {
+				t.Errorf("unexpected p99, wanted %d, got %d", test.p99, got)
+			}
+		})
+	}
+}
+
+func TestOperationStats_VisitsOfOperationsOnSmallTrieAreCountedExactly(t *testing.T) {
+	forest, err := OpenInMemoryForest(t.TempDir(), S4LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024, MetricsEnabled: true})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	defer forest.Close()
+
+	// Without hashed paths, the accounts end up in a branch node at the root.
+	addr1 := common.Address{0x10}
+	addr2 := common.Address{0x20}
+	root := NewNodeReference(EmptyId())
+	for _, addr := range []common.Address{addr1, addr2} {
+		if root, err = forest.SetAccountInfo(&root, addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+			t.Fatalf("failed to set account: %v", err)
+		}
+	}
+	if err := forest.ResetOperationStats(); err != nil {
+		t.Fatalf("failed to reset stats: %v", err)
+	}
+
+	// branch -> account
+	if _, _, err := forest.GetAccountInfo(&root, addr1); err != nil {
+		t.Fatalf("failed to get account: %v", err)
+	}
+	// branch -> empty
+	if _, _, err := forest.GetAccountInfo(&root, common.Address{0x30}); err != nil {
+		t.Fatalf("failed to get account: %v", err)
+	}
+	// branch -> account
+	if root, err = forest.SetAccountInfo(&root, addr2, AccountInfo{Nonce: common.ToNonce(2)}); err != nil {
+		t.Fatalf("failed to set account: %v", err)
+	}
+	// branch -> account -> empty storage
+	if root, err = forest.SetValue(&root, addr1, common.Key{1}, common.Value{1}); err != nil {
+		t.Fatalf("failed to set value: %v", err)
+	}
+	// branch -> account -> value
+	if _, err := forest.GetValue(&root, addr1, common.Key{1}); err != nil {
+		t.Fatalf("failed to get value: %v", err)
+	}
+	// branch -> account -> value
+	if _, err := forest.GetValue(&root, addr1, common.Key{2}); err != nil {
+		t.Fatalf("failed to get value: %v", err)
+	}
+
+	stats, err := forest.GetOperationStats()
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	tests := map[string]struct {
+		stats OperationStats
+		want  NodeVisitHistogram
+	}{
+		"GetAccountInfo": {stats.GetAccountInfo, NodeVisitHistogram{0, 0, 2}},
+		"SetAccountInfo": {stats.SetAccountInfo, NodeVisitHistogram{0, 0, 1}},
+		"GetValue":       {stats.GetValue, NodeVisitHistogram{0, 0, 0, 2}},
+		"SetValue":       {stats.SetValue, NodeVisitHistogram{0, 0, 0, 1}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if !slices.Equal(test.stats.Visits, test.want) {
+				t.Errorf("unexpected visits, wanted %v, got %v", test.want, test.stats.Visits)
+			}
+			// All nodes are retained in the cache.
+			if !slices.Equal(test.stats.CacheHits, test.want) {
+				t.Errorf("unexpected cache hits, wanted %v, got %v", test.want, test.stats.CacheHits)
+			}
+			if want := (NodeVisitHistogram{test.want.Count()}); !slices.Equal(test.stats.DiskReads, want) {
+				t.Errorf("unexpected disk reads, wanted %v, got %v", want, test.stats.DiskReads)
+			}
+		})
+	}
+
+	if _, _, err := forest.updateHashesFor(&root); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+}
+
+func TestOperationStats_DiskReadsAndCacheHitsAreDistinguished(t *testing.T) {
+	dir := t.TempDir()
+	forestConfig := ForestConfig{Mode: Mutable, CacheCapacity: 1024, MetricsEnabled: true}
+	forest, err := OpenFileForest(dir, S4LiveConfig, forestConfig)
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	addr := common.Address{0x10}
+	root := NewNodeReference(EmptyId())
+	for _, cur := range []common.Address{addr, {0x20}} {
+		if root, err = forest.SetAccountInfo(&root, cur, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+			t.Fatalf("failed to set account: %v", err)
+		}
+	}
+	if _, _, err := forest.updateHashesFor(&root); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+	if err := forest.Close(); err != nil {
+		t.Fatalf("failed to close forest: %v", err)
+	}
+
+	forest, err = OpenFileForest(dir, S4LiveConfig, forestConfig)
+	if err != nil {
+		t.Fatalf("failed to re-open forest: %v", err)
+	}
+	defer forest.Close()
+	root = NewNodeReference(root.Id())
+
+	// The first lookup loads the branch and the account from the disk, the
+	// second finds them in the cache.
+	for i := 0; i < 2; i++ {
+		if info, _, err := forest.GetAccountInfo(&root, addr); err != nil || info.Nonce != common.ToNonce(1) {
+			t.Fatalf("unexpected account info: %v, err %v", info, err)
+		}
+	}
+	stats, err := forest.GetOperationStats()
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	if want, got := (NodeVisitHistogram{0, 0, 2}), stats.GetAccountInfo.Visits; !slices.Equal(want, got) {
+		t.Errorf("unexpected visits, wanted %v, got %v", want, got)
+	}
+	if want, got := (NodeVisitHistogram{1, 0, 1}), stats.GetAccountInfo.CacheHits; !slices.Equal(want, got) {
+		t.Errorf("unexpected cache hits, wanted %v, got %v", want, got)
+	}
+	if want, got := (NodeVisitHistogram{1, 0, 1}), stats.GetAccountInfo.DiskReads; !slices.Equal(want, got) {
+		t.Errorf("unexpected disk reads, wanted %v, got %v", want, got)
+	}
+}
+
+func TestOperationStats_CanBeReset(t *testing.T) {
+	state, err := OpenGoFileStateWithConfig(t.TempDir(), S5LiveConfig, ForestConfig{CacheCapacity: 1024, MetricsEnabled: true})
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+
+	if err := state.SetNonce(common.Address{1}, common.ToNonce(1)); err != nil {
+		t.Fatalf("failed to set nonce: %v", err)
+	}
+	stats, err := state.GetOperationStats()
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	if stats.GetAccountInfo.Visits.Count() == 0 || stats.SetAccountInfo.Visits.Count() == 0 {
+		t.Errorf("operations should be recorded, got %v", stats)
+	}
+
+	if err := state.ResetOperationStats(); err != nil {
+		t.Fatalf("failed to reset stats: %v", err)
+	}
+	stats, err = state.GetOperationStats()
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	if want := (OperationStatsReport{}); stats.String() != want.String() {
+		t.Errorf("stats should be empty after reset, got %v", stats)
+	}
+}
+
+func TestOperationStats_DisabledMetricsAreReported(t *testing.T) {
+	state, err := OpenGoFileState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+
+	if _, err := state.GetOperationStats(); !errors.Is(err, operationMetricsDisabledErr) {
+		t.Errorf("unexpected error, wanted %v, got %v", operationMetricsDisabledErr, err)
+	}
+	if err := state.ResetOperationStats(); !errors.Is(err, operationMetricsDisabledErr) {
+		t.Errorf("unexpected error, wanted %v, got %v", operationMetricsDisabledErr, err)
+	}
+}
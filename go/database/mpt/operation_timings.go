@@ -0,0 +1,172 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+	"math/bits"
+	"sync/atomic"
+	"time"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+)
+
+// numDurationBuckets is the number of buckets of duration histograms. The
+// last bucket covers all durations of at least 2^46 ns, which is ~19 hours.
+const numDurationBuckets = 48
+
+// DurationHistogram is a histogram on the durations of timed phases. The
+// 0-th element is the number of phases taking less than 1ns, the i-th element
+// for i > 0 the number of phases taking [2^(i-1),2^i) nanoseconds.
+type DurationHistogram []uint64
+
+// Count returns the number of timed phases covered by this histogram.
+func (h DurationHistogram) Count() uint64 {
+	res := uint64(0)
+	for _, count := range h {
+		res += count
+	}
+	return res
+}
+
+// Percentile returns the upper bound of the bucket containing the duration
+// not exceeded by the given percentage of phases, where p is in the range
+// [0,100]. For an empty histogram, 0 is returned.
+func (h DurationHistogram) Percentile(p float64) time.Duration {
+	bucket := NodeVisitHistogram(h).Percentile(p)
+	if h.Count() == 0 {
+		return 0
+	}
+	return time.Duration(uint64(1) << bucket)
+}
+
+func (h DurationHistogram) String() string {
+	return fmt.Sprintf("%d samples, p50 <%v p99 <%v", h.Count(), h.Percentile(50), h.Percentile(99))
+}
+
+// OperationTimings summarizes the time spent in the phases of operations on
+// a forest. Stock reads and writes include the time required for decoding
+// and encoding nodes, which is additionally reported as Encoding.
+type OperationTimings struct {
+	Descent     DurationHistogram // the time of lookups and updates descending into tries
+	Hashing     DurationHistogram // the time of hashing tries
+	Encoding    DurationHistogram // the time of encoding and decoding individual nodes
+	StockReads  DurationHistogram // the time of loading individual nodes from stocks
+	StockWrites DurationHistogram // the time of writing individual nodes to stocks
+}
+
+// timedPhase enumerates the phases covered by operation timings.
+type timedPhase int
+
+const (
+	descentPhase timedPhase = iota
+	hashingPhase
+	encodingPhase
+	stockReadPhase
+	stockWritePhase
+	numTimedPhases
+)
+
+// operationTimer aggregates the durations of timed phases into histograms.
+// All methods may be called on a nil timer, in which case nothing is timed,
+// keeping the costs of disabled timings to a nil check.
+type operationTimer struct {
+	durations [numTimedPhases][numDurationBuckets]atomic.Uint64
+}
+
+// start returns the start time of a phase to be passed to stop, or the zero
+// time if the timer is disabled.
+func (t *operationTimer) start() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// stop accounts the time passed since the given start to the given phase.
+func (t *operationTimer) stop(phase timedPhase, start time.Time) {
+	if t == nil {
+		return
+	}
+	bucket := bits.Len64(uint64(time.Since(start)))
+	if bucket >= numDurationBuckets {
+		bucket = numDurationBuckets - 1
+	}
+	t.durations[phase][bucket].Add(1)
+}
+
+// getTimings produces a snapshot of the collected histograms, empty if the
+// timer is disabled.
+func (t *operationTimer) getTimings() OperationTimings {
+	if t == nil {
+		return OperationTimings{}
+	}
+	get := func(phase timedPhase) DurationHistogram {
+		counters := &t.durations[phase]
+		// Trailing zeros are trimmed to keep the snapshot compact.
+		length := 0
+		for i := range counters {
+			if counters[i].Load() > 0 {
+				length = i + 1
+			}
+		}
+		res := make(DurationHistogram, length)
+		for i := range res {
+			res[i] = counters[i].Load()
+		}
+		return res
+	}
+	return OperationTimings{
+		Descent:     get(descentPhase),
+		Hashing:     get(hashingPhase),
+		Encoding:    get(encodingPhase),
+		StockReads:  get(stockReadPhase),
+		StockWrites: get(stockWritePhase),
+	}
+}
+
+// reset discards all collected durations.
+func (t *operationTimer) reset() {
+	if t == nil {
+		return
+	}
+	for phase := range t.durations {
+		for i := range t.durations[phase] {
+			t.durations[phase][i].Store(0)
+		}
+	}
+}
+
+// timedEncoder is a stock.ValueEncoder timing the encoding and decoding of
+// values performed by a nested encoder.
+type timedEncoder[V any] struct {
+	stock.ValueEncoder[V]
+	timer *operationTimer
+}
+
+// timeEncoder wraps the given encoder such that its encoding and decoding is
+// timed by the given timer, if enabled.
+func timeEncoder[V any](encoder stock.ValueEncoder[V], timer *operationTimer) stock.ValueEncoder[V] {
+	if timer == nil {
+		return encoder
+	}
+	return timedEncoder[V]{encoder, timer}
+}
+
+func (e timedEncoder[V]) Store(dst []byte, value *V) error {
+	defer e.timer.stop(encodingPhase, e.timer.start())
+	return e.ValueEncoder.Store(dst, value)
+}
+
+func (e timedEncoder[V]) Load(src []byte, value *V) error {
+	defer e.timer.stop(encodingPhase, e.timer.start())
+	return e.ValueEncoder.Load(src, value)
+}
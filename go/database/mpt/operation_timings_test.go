@@ -0,0 +1,115 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestDurationHistogram_PercentilesReportBucketUpperBounds(t *testing.T) {
+	tests := map[string]struct {
+		histogram DurationHistogram
+		p50, p99  time.Duration
+	}{
+		"empty":         {histogram: nil, p50: 0, p99: 0},
+		"below 1ns":     {histogram: DurationHistogram{3}, p50: 1, p99: 1},
+		"single bucket": {histogram: DurationHistogram{0, 0, 4}, p50: 4, p99: 4},
+		"long tail":     {histogram: DurationHistogram{0, 99, 0, 0, 1}, p50: 2, p99: 2},
+		"two buckets":   {histogram: DurationHistogram{0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, p50: 2, p99: 2048},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := test.histogram.Percentile(50); got != test.p50 {
+				t.Errorf("unexpected p50, wanted %v, got %v", test.p50, got)
+			}
+			if got := test.histogram.Percentile(99); got != test.p99 {
+				t.Errorf("unexpected p99, wanted %v, got %v", test.p99, got)
+			}
+		})
+	}
+}
+
+func TestOperationTimer_DisabledTimerIgnoresAllCalls(t *testing.T) {
+	var timer *operationTimer
+	if got := timer.start(); !got.IsZero() {
+		t.Errorf("disabled timer should not read the clock, got %v", got)
+	}
+	timer.stop(descentPhase, time.Now())
+	timer.reset()
+	if got := timer.getTimings(); got.Descent.Count() != 0 {
+		t.Errorf("disabled timer should not report timings, got %v", got)
+	}
+}
+
+func TestOperationTimings_EnabledTimingsRecordAllPhases(t *testing.T) {
+	state, err := OpenGoFileStateWithConfig(t.TempDir(), S5LiveConfig, ForestConfig{CacheCapacity: 32, TimingsEnabled: true})
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+
+	// The small cache makes nodes get evicted and reloaded from the stocks.
+	for i := 0; i < 100; i++ {
+		addr := common.Address{byte(i)}
+		if err := state.SetNonce(addr, common.ToNonce(1)); err != nil {
+			t.Fatalf("failed to set nonce: %v", err)
+		}
+		if err := state.SetStorage(addr, common.Key{1}, common.Value{1}); err != nil {
+			t.Fatalf("failed to set storage: %v", err)
+		}
+	}
+	if _, _, err := state.UpdateHashes(); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := state.GetNonce(common.Address{byte(i)}); err != nil {
+			t.Fatalf("failed to get nonce: %v", err)
+		}
+	}
+	if err := state.Flush(); err != nil {
+		t.Fatalf("failed to flush state: %v", err)
+	}
+
+	stats, err := state.GetOperationStats()
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	timings := stats.Timings
+	phases := map[string]DurationHistogram{
+		"descent":      timings.Descent,
+		"hashing":      timings.Hashing,
+		"encoding":     timings.Encoding,
+		"stock reads":  timings.StockReads,
+		"stock writes": timings.StockWrites,
+	}
+	for name, histogram := range phases {
+		if histogram.Count() == 0 {
+			t.Errorf("no samples recorded for %s", name)
+		}
+	}
+	if stats.GetAccountInfo.Visits.Count() != 0 {
+		t.Errorf("node visits should only be recorded if metrics are enabled, got %v", stats.GetAccountInfo)
+	}
+
+	if err := state.ResetOperationStats(); err != nil {
+		t.Fatalf("failed to reset stats: %v", err)
+	}
+	stats, err = state.GetOperationStats()
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	if got := stats.Timings.Descent.Count(); got != 0 {
+		t.Errorf("timings should be empty after reset, got %d samples", got)
+	}
+}
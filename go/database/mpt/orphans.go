@@ -0,0 +1,223 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+)
+
+// FindOrphans lists the IDs of all nodes allocated in the stocks of this
+// forest which are not reachable from any of the given roots. Such orphans
+// may be left behind by crashes, e.g. if nodes were allocated for an update
+// that never got committed. Since tries of different blocks of an archive
+// share nodes, the roots of all tries retained by the forest need to be
+// provided. Otherwise, nodes of omitted tries are reported as orphans.
+//
+// Reachable nodes are tracked in memory, so this is a costly operation
+// intended for maintenance. The forest must not be modified concurrently.
+func (s *Forest) FindOrphans(roots []*NodeReference) ([]NodeId, error) {
+	if err := s.CheckErrors(); err != nil {
+		return nil, err
+	}
+
+	// Tries pending in the release queue are not reachable any more but
+	// still allocated. Their release needs to be completed first.
+	s.releaseQueue <- EmptyId() // signals a sync request
+	<-s.releaseSync
+	if err := s.collectReleaseWorkerErrors(); err != nil {
+		return nil, err
+	}
+
+	reachable, err := s.markReachableNodes(roots)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, err := s.accounts.GetIds()
+	if err != nil {
+		return nil, err
+	}
+	branches, err := s.branches.GetIds()
+	if err != nil {
+		return nil, err
+	}
+	extensions, err := s.extensions.GetIds()
+	if err != nil {
+		return nil, err
+	}
+	values, err := s.values.GetIds()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []NodeId
+	res = appendOrphans(res, accounts, AccountId, reachable)
+	res = appendOrphans(res, branches, BranchId, reachable)
+	res = appendOrphans(res, extensions, ExtensionId, reachable)
+	res = appendOrphans(res, values, ValueId, reachable)
+	return res, nil
+}
+
+// ReclaimOrphans frees all nodes reported by FindOrphans for the given roots
+// and returns the number of freed nodes. Orphans retained by the node cache
+// or the write buffer are discarded without being written, such that their
+// IDs can safely be reused. The same restrictions as for FindOrphans apply;
+// in particular, providing an incomplete list of roots leads to the loss of
+// the nodes of the omitted tries.
+func (s *Forest) ReclaimOrphans(roots []*NodeReference) (int, error) {
+	orphans, err := s.FindOrphans(roots)
+	if err != nil || len(orphans) == 0 {
+		return 0, err
+	}
+
+	refs := make([]NodeReference, 0, len(orphans))
+	s.nodeTransferMutex.Lock()
+	for _, id := range orphans {
+		ref := NewNodeReference(id)
+		if node, found := s.nodeCache.Get(&ref); found {
+			handle := node.GetWriteHandle()
+			handle.Get().MarkClean()
+			handle.Release()
+		}
+		s.writeBuffer.Cancel(id)
+		refs = append(refs, ref)
+	}
+	s.nodeTransferMutex.Unlock()
+
+	if err := s.releaseBatch(refs); err != nil {
+		err = fmt.Errorf("failed to reclaim orphaned nodes: %w", err)
+		s.errors = append(s.errors, err)
+		return 0, err
+	}
+	return len(refs), nil
+}
+
+// markReachableNodes collects the IDs of all nodes reachable from the given
+// roots. Sub-tries shared by multiple roots are only traversed once.
+func (s *Forest) markReachableNodes(roots []*NodeReference) (map[NodeId]struct{}, error) {
+	reachable := map[NodeId]struct{}{}
+	stack := make([]NodeReference, 0, 64)
+	for _, root := range roots {
+		stack = append(stack, *root)
+	}
+	for len(stack) > 0 {
+		ref := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if ref.Id().IsEmpty() {
+			continue
+		}
+		if _, found := reachable[ref.Id()]; found {
+			continue
+		}
+		reachable[ref.Id()] = struct{}{}
+
+		handle, err := s.getViewAccess(&ref)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load node %v: %w", ref.Id(), err)
+		}
+		stack = appendChildren(stack, handle.Get())
+		handle.Release()
+	}
+	return reachable, nil
+}
+
+// appendChildren appends the references to the non-empty children of the
+// given node, frozen or not, to the given list.
+func appendChildren(res []NodeReference, node Node) []NodeReference {
+	switch n := node.(type) {
+	case *BranchNode:
+		for _, child := range n.children {
+			if !child.Id().IsEmpty() {
+				res = append(res, child)
+			}
+		}
+	case *ExtensionNode:
+		res = append(res, n.next)
+	case *AccountNode:
+		if !n.storage.Id().IsEmpty() {
+			res = append(res, n.storage)
+		}
+	}
+	return res
+}
+
+// appendOrphans appends the IDs of the given set not contained in the set of
+// reachable nodes to the given list.
+func appendOrphans(
+	res []NodeId,
+	ids stock.IndexSet[uint64],
+	toId func(uint64) NodeId,
+	reachable map[NodeId]struct{},
+) []NodeId {
+	for i := ids.GetLowerBound(); i < ids.GetUpperBound(); i++ {
+		if !ids.Contains(i) {
+			continue
+		}
+		id := toId(i)
+		if _, found := reachable[id]; !found {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// FindOrphans lists the IDs of nodes of the archive's forest not reachable
+// from the trie of any block or the head state. See Forest.FindOrphans for
+// details. Partial archives, not retaining the full tries of past blocks,
+// are not supported.
+func (a *ArchiveTrie) FindOrphans() ([]NodeId, error) {
+	a.addMutex.Lock()
+	defer a.addMutex.Unlock()
+	forest, roots, err := a.getOrphanSearchScope()
+	if err != nil {
+		return nil, err
+	}
+	return forest.FindOrphans(roots)
+}
+
+// ReclaimOrphans frees the nodes reported by FindOrphans and returns their
+// number. Blocks may not be added concurrently.
+func (a *ArchiveTrie) ReclaimOrphans() (int, error) {
+	a.addMutex.Lock()
+	defer a.addMutex.Unlock()
+	forest, roots, err := a.getOrphanSearchScope()
+	if err != nil {
+		return 0, err
+	}
+	return forest.ReclaimOrphans(roots)
+}
+
+// getOrphanSearchScope obtains the forest of this archive and the roots of
+// all tries retained by it. The add mutex must be held.
+func (a *ArchiveTrie) getOrphanSearchScope() (*Forest, []*NodeReference, error) {
+	if err := a.CheckErrors(); err != nil {
+		return nil, nil, err
+	}
+	if a.filter != nil {
+		return nil, nil, errors.New("orphan detection is not supported by partial archives")
+	}
+	forest, ok := a.forest.(*Forest)
+	if !ok {
+		return nil, nil, fmt.Errorf("orphan detection is not supported by %T", a.forest)
+	}
+
+	head := a.head.Root()
+	roots := []*NodeReference{&head}
+	a.rootsMutex.Lock()
+	for i := 0; i < a.roots.length(); i++ {
+		roots = append(roots, &a.roots.roots[i].NodeRef)
+	}
+	a.rootsMutex.Unlock()
+	return forest, roots, nil
+}
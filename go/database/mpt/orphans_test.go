@@ -0,0 +1,248 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestForest_FindOrphans_DetectsAndReclaimsOrphanedNodes(t *testing.T) {
+	for _, variant := range fileAndMemVariants {
+		t.Run(variant.name, func(t *testing.T) {
+			forest, err := variant.factory(t.TempDir(), S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024})
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+			defer forest.Close()
+
+			root := NewNodeReference(EmptyId())
+			for i := 0; i < 10; i++ {
+				addr := common.Address{byte(i)}
+				root, err = forest.SetAccountInfo(&root, addr, AccountInfo{Nonce: common.ToNonce(1)})
+				if err != nil {
+					t.Fatalf("failed to set account: %v", err)
+				}
+				root, err = forest.SetValue(&root, addr, common.Key{byte(i)}, common.Value{1})
+				if err != nil {
+					t.Fatalf("failed to set value: %v", err)
+				}
+			}
+			if _, _, err := forest.updateHashesFor(&root); err != nil {
+				t.Fatalf("failed to update hashes: %v", err)
+			}
+
+			orphans, err := forest.FindOrphans([]*NodeReference{&root})
+			if err != nil {
+				t.Fatalf("failed to find orphans: %v", err)
+			}
+			if len(orphans) != 0 {
+				t.Fatalf("unexpected orphans: %v", orphans)
+			}
+
+			// A node only present on disk, as if left behind by a crash.
+			index, err := forest.values.New()
+			if err != nil {
+				t.Fatalf("failed to allocate node: %v", err)
+			}
+			if err := forest.values.Set(index, ValueNode{}); err != nil {
+				t.Fatalf("failed to store node: %v", err)
+			}
+			// A modified node only present in the node cache.
+			ref, handle, err := forest.createBranch()
+			if err != nil {
+				t.Fatalf("failed to create node: %v", err)
+			}
+			handle.Release()
+
+			want := []NodeId{ref.Id(), ValueId(index)}
+			orphans, err = forest.FindOrphans([]*NodeReference{&root})
+			if err != nil {
+				t.Fatalf("failed to find orphans: %v", err)
+			}
+			if !slices.Equal(want, orphans) {
+				t.Errorf("unexpected orphans, wanted %v, got %v", want, orphans)
+			}
+
+			reclaimed, err := forest.ReclaimOrphans([]*NodeReference{&root})
+			if err != nil {
+				t.Fatalf("failed to reclaim orphans: %v", err)
+			}
+			if reclaimed != len(want) {
+				t.Errorf("unexpected number of reclaimed nodes, wanted %d, got %d", len(want), reclaimed)
+			}
+			orphans, err = forest.FindOrphans([]*NodeReference{&root})
+			if err != nil {
+				t.Fatalf("failed to find orphans: %v", err)
+			}
+			if len(orphans) != 0 {
+				t.Errorf("orphans were not reclaimed: %v", orphans)
+			}
+
+			// The reclaimed modified node must not be written, which would fail
+			// due to its outdated hash, and the trie must not be affected.
+			if err := forest.Flush(); err != nil {
+				t.Fatalf("failed to flush forest: %v", err)
+			}
+			if err := forest.Check(&root); err != nil {
+				t.Errorf("trie is corrupted after reclaiming orphans: %v", err)
+			}
+		})
+	}
+}
+
+func TestForest_FindOrphans_NodesOfAllGivenRootsAreReachable(t *testing.T) {
+	forest, err := OpenInMemoryForest(t.TempDir(), S5ArchiveConfig, ForestConfig{Mode: Immutable, CacheCapacity: 1024})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	defer forest.Close()
+
+	// Two frozen tries sharing all but the nodes on the path to the second account.
+	first := NewNodeReference(EmptyId())
+	first, err = forest.SetAccountInfo(&first, common.Address{1}, AccountInfo{Nonce: common.ToNonce(1)})
+	if err != nil {
+		t.Fatalf("failed to set account: %v", err)
+	}
+	if _, _, err := forest.updateHashesFor(&first); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+	if err := forest.Freeze(&first); err != nil {
+		t.Fatalf("failed to freeze trie: %v", err)
+	}
+	second, err := forest.SetAccountInfo(&first, common.Address{2}, AccountInfo{Nonce: common.ToNonce(1)})
+	if err != nil {
+		t.Fatalf("failed to set account: %v", err)
+	}
+	if _, _, err := forest.updateHashesFor(&second); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+
+	orphans, err := forest.FindOrphans([]*NodeReference{&first, &second})
+	if err != nil {
+		t.Fatalf("failed to find orphans: %v", err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("unexpected orphans: %v", orphans)
+	}
+
+	// Nodes exclusive to an omitted trie are reported.
+	orphans, err = forest.FindOrphans([]*NodeReference{&first})
+	if err != nil {
+		t.Fatalf("failed to find orphans: %v", err)
+	}
+	if len(orphans) == 0 || !slices.Contains(orphans, second.Id()) {
+		t.Errorf("nodes of omitted trie should be reported, got %v", orphans)
+	}
+	if slices.Contains(orphans, first.Id()) {
+		t.Errorf("nodes of given trie should not be reported, got %v", orphans)
+	}
+}
+
+func TestArchiveTrie_ReclaimOrphans_KeepsNodesSharedByBlocks(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := OpenArchiveTrie(dir, S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+
+	const numBlocks = 5
+	for block := uint64(0); block < numBlocks; block++ {
+		update := common.Update{}
+		addr := common.Address{byte(block)}
+		update.AppendCreateAccount(addr)
+		update.AppendNonceUpdate(addr, common.ToNonce(block+1))
+		update.AppendSlotUpdate(addr, common.Key{1}, common.Value{byte(block + 1)})
+		if err := archive.Add(block, update, nil); err != nil {
+			t.Fatalf("failed to add block %d: %v", block, err)
+		}
+	}
+
+	orphans, err := archive.FindOrphans()
+	if err != nil {
+		t.Fatalf("failed to find orphans: %v", err)
+	}
+	if len(orphans) != 0 {
+		t.Fatalf("unexpected orphans: %v", orphans)
+	}
+
+	// Deliberately orphan a node by allocating it without linking it.
+	forest := archive.forest.(*Forest)
+	index, err := forest.accounts.New()
+	if err != nil {
+		t.Fatalf("failed to allocate node: %v", err)
+	}
+	if err := forest.accounts.Set(index, AccountNode{}); err != nil {
+		t.Fatalf("failed to store node: %v", err)
+	}
+
+	orphans, err = archive.FindOrphans()
+	if err != nil {
+		t.Fatalf("failed to find orphans: %v", err)
+	}
+	if want := []NodeId{AccountId(index)}; !slices.Equal(want, orphans) {
+		t.Errorf("unexpected orphans, wanted %v, got %v", want, orphans)
+	}
+	reclaimed, err := archive.ReclaimOrphans()
+	if err != nil {
+		t.Fatalf("failed to reclaim orphans: %v", err)
+	}
+	if reclaimed != 1 {
+		t.Errorf("unexpected number of reclaimed nodes, wanted 1, got %d", reclaimed)
+	}
+
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+	archive, err = OpenArchiveTrie(dir, S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to reopen archive: %v", err)
+	}
+	defer archive.Close()
+	if err := archive.Check(); err != nil {
+		t.Errorf("archive is corrupted after reclaiming orphans: %v", err)
+	}
+	for block := uint64(0); block < numBlocks; block++ {
+		for i := uint64(0); i <= block; i++ {
+			nonce, err := archive.GetNonce(block, common.Address{byte(i)})
+			if err != nil {
+				t.Fatalf("failed to get nonce: %v", err)
+			}
+			if want := common.ToNonce(i + 1); want != nonce {
+				t.Errorf("unexpected nonce of account %d in block %d, wanted %v, got %v", i, block, want, nonce)
+			}
+		}
+	}
+	orphans, err = archive.FindOrphans()
+	if err != nil {
+		t.Fatalf("failed to find orphans: %v", err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("unexpected orphans after reclaiming: %v", orphans)
+	}
+}
+
+func TestArchiveTrie_FindOrphans_IsNotSupportedByPartialArchives(t *testing.T) {
+	filter := func(account common.Address) bool { return account[0] == 1 }
+	archive, err := OpenPartialArchiveTrie(t.TempDir(), S5ArchiveConfig, ForestConfig{CacheCapacity: 128}, filter)
+	if err != nil {
+		t.Fatalf("failed to open partial archive: %v", err)
+	}
+	defer archive.Close()
+	if _, err := archive.FindOrphans(); err == nil {
+		t.Errorf("orphan detection should not be supported by partial archives")
+	}
+	if _, err := archive.ReclaimOrphans(); err == nil {
+		t.Errorf("orphan reclamation should not be supported by partial archives")
+	}
+}
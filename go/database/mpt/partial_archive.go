@@ -0,0 +1,379 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"unsafe"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// A partial archive retains the history of a selected set of accounts only.
+// Like a full archive, it maintains a single trie which is updated block by
+// block and retains the root of each block. However, instead of freezing the
+// entire trie after each block, only the nodes on the paths to the selected
+// accounts and the storage tries of those accounts are frozen. All other
+// nodes keep being updated in-place and released when no longer needed by
+// the head of the archive.
+//
+// Guarantees:
+//  - the head state, its hashes, and the hashes of all past blocks are
+//    identical to the ones of a full archive,
+//  - queries for selected accounts produce the same results as a full archive
+//    for all blocks, including blocks in which the accounts did not exist,
+//  - queries for accounts not accepted by the filter fail with ErrNotArchived,
+//  - operations covering the entire trie of past blocks, like diffs and the
+//    verification of archive directories, fail with ErrNotArchived, while
+//    consistency checks are limited to the trie of the head.
+//
+// Since a filter may be an arbitrary predicate, the set of selected accounts
+// can not be enumerated upfront. Instead, each account accepted by the filter
+// is registered when being touched by a block for the first time. Accounts
+// can only exist in blocks after their registration, so queries for earlier
+// blocks are answered without consulting the trie. The registered accounts
+// are persisted in the archive's directory, which also marks the archive as
+// partial. The filter itself is not persisted, and the same filter has to be
+// provided whenever the archive is opened.
+//
+// Note that nodes written to disk are implicitly frozen when being reloaded.
+// Thus, parts of the history of accounts not accepted by the filter may be
+// retained if nodes are evicted from the node cache before being modified.
+
+// ErrNotArchived is returned by partial archives for queries on accounts or
+// data not retained by the archive.
+const ErrNotArchived = common.ConstError("data is not retained by the partial archive")
+
+// AccountFilter decides whether the history of an account is to be retained
+// by a partial archive.
+type AccountFilter func(common.Address) bool
+
+// NewAccountListFilter creates a filter accepting exactly the given accounts.
+func NewAccountListFilter(accounts ...common.Address) AccountFilter {
+	set := make(map[common.Address]struct{}, len(accounts))
+	for _, account := range accounts {
+		set[account] = struct{}{}
+	}
+	return func(account common.Address) bool {
+		_, found := set[account]
+		return found
+	}
+}
+
+// OpenPartialArchiveTrie opens a partial archive in the given directory,
+// retaining the history of the accounts accepted by the given filter only.
+// If the directory is empty, a new partial archive is created. Full archives
+// can not be opened as partial archives and vice versa. The forest is always
+// opened in Immutable mode.
+func OpenPartialArchiveTrie(directory string, config MptConfig, forestConfig ForestConfig, filter AccountFilter) (*ArchiveTrie, error) {
+	if filter == nil {
+		return nil, fmt.Errorf("partial archives require an account filter")
+	}
+	return openArchiveTrie(directory, config, forestConfig, filter)
+}
+
+// accountPathFreezing is an optional interface of databases supporting the
+// freezing of the paths to individual accounts, as needed by partial archives.
+type accountPathFreezing interface {
+	freezeAccountPaths(root *NodeReference, accounts []common.Address) error
+}
+
+// partiallyFrozen is an optional interface of node sources in which frozen
+// nodes may have non-frozen descendants, as it is the case for the forest of
+// a partial archive. Only the nodes on the paths to the archived accounts and
+// the storage tries of those accounts are required to be frozen, all other
+// sub-tries are deliberately left unfrozen.
+type partiallyFrozen interface {
+	// getArchivedAccounts returns the accounts whose paths are frozen and
+	// true if the source is partially frozen, false otherwise.
+	getArchivedAccounts() ([]common.Address, bool)
+}
+
+func (f *Forest) getArchivedAccounts() ([]common.Address, bool) {
+	if f.archivedAccounts == nil {
+		return nil, false
+	}
+	return f.archivedAccounts(), true
+}
+
+// lazilyFrozen is an optional interface of node sources in which the nodes
+// shared with forks of tries are frozen lazily, such that frozen nodes may
+// have non-frozen children while forks are open.
+type lazilyFrozen interface {
+	hasOpenForks() bool
+}
+
+// allowsNonFrozenDescendants determines whether frozen nodes provided by the
+// given source may have non-frozen children.
+func allowsNonFrozenDescendants(source NodeSource) bool {
+	if forked, ok := source.(lazilyFrozen); ok && forked.hasOpenForks() {
+		return true
+	}
+	if partial, ok := source.(partiallyFrozen); ok {
+		_, res := partial.getArchivedAccounts()
+		return res
+	}
+	return false
+}
+
+// archivedPaths are the paths to the archived accounts of a partially frozen
+// forest, determining the nodes required to be frozen if their parents are.
+type archivedPaths struct {
+	accounts map[common.Address]struct{}
+	paths    [][]Nibble // sorted, such that paths sharing a prefix are adjacent
+}
+
+func newArchivedPaths(source NodeSource, accounts []common.Address) *archivedPaths {
+	res := &archivedPaths{
+		accounts: make(map[common.Address]struct{}, len(accounts)),
+		paths:    make([][]Nibble, 0, len(accounts)),
+	}
+	for _, account := range accounts {
+		res.accounts[account] = struct{}{}
+		res.paths = append(res.paths, AddressToNibblePath(account, source))
+	}
+	slices.SortFunc(res.paths, slices.Compare[[]Nibble])
+	return res
+}
+
+// isArchived determines whether the given account is archived, and thus its
+// storage trie is frozen entirely.
+func (p *archivedPaths) isArchived(account common.Address) bool {
+	_, found := p.accounts[account]
+	return found
+}
+
+// isOnPath determines whether the node reached through the given path of a
+// state trie is on the path to an archived account.
+func (p *archivedPaths) isOnPath(path []Nibble) bool {
+	// The first path not less than the given one is the first path having the
+	// given one as a prefix, if there is any.
+	i, _ := slices.BinarySearchFunc(p.paths, path, slices.Compare[[]Nibble])
+	return i < len(p.paths) && len(p.paths[i]) >= len(path) && slices.Equal(p.paths[i][:len(path)], path)
+}
+
+// archiveFilter tracks the accounts retained by a partial archive.
+type archiveFilter struct {
+	accept    AccountFilter
+	accounts  map[common.Address]uint64 // the block each account got registered in
+	order     []common.Address          // the registered accounts in registration order
+	numInFile int                       // the number of accounts already written to the file
+	filename  string
+	mutex     sync.Mutex
+}
+
+// archivedAccountsFile is the name of the file listing the accounts
+// registered in a partial archive.
+const archivedAccountsFile = "archived_accounts.dat"
+
+// isPartialArchive checks whether the given directory contains a partial
+// archive.
+func isPartialArchive(directory string) (bool, error) {
+	_, err := os.Stat(directory + "/" + archivedAccountsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// loadArchiveFilter loads the accounts registered in the partial archive in
+// the given directory. If the file is missing, an empty list is created.
+func loadArchiveFilter(directory string, accept AccountFilter) (*archiveFilter, error) {
+	filename := directory + "/" + archivedAccountsFile
+	res := &archiveFilter{
+		accept:   accept,
+		accounts: map[common.Address]uint64{},
+		filename: filename,
+	}
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return res, res.store()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var buffer [len(common.Address{}) + 8]byte
+	for {
+		if _, err := io.ReadFull(reader, buffer[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("invalid archived accounts file format: %v", err)
+		}
+		account := common.Address(buffer[:len(common.Address{})])
+		res.accounts[account] = binary.BigEndian.Uint64(buffer[len(common.Address{}):])
+		res.order = append(res.order, account)
+	}
+	res.numInFile = len(res.order)
+	return res, nil
+}
+
+// register registers all accounts touched by the given update of the given
+// block which are accepted by the filter and have not been registered before.
+func (f *archiveFilter) register(block uint64, update *common.Update) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	add := func(account common.Address) {
+		if _, found := f.accounts[account]; found || !f.accept(account) {
+			return
+		}
+		f.accounts[account] = block
+		f.order = append(f.order, account)
+	}
+	for _, account := range update.DeletedAccounts {
+		add(account)
+	}
+	for _, account := range update.CreatedAccounts {
+		add(account)
+	}
+	for _, change := range update.Balances {
+		add(change.Account)
+	}
+	for _, change := range update.Nonces {
+		add(change.Account)
+	}
+	for _, change := range update.Codes {
+		add(change.Account)
+	}
+	for _, change := range update.Slots {
+		add(change.Account)
+	}
+}
+
+// getRegisteredAccounts returns all accounts registered so far.
+func (f *archiveFilter) getRegisteredAccounts() []common.Address {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.order[:len(f.order):len(f.order)]
+}
+
+// restrict adapts the given view on the trie of the given block for querying
+// the given account. If the account is not retained by the archive,
+// ErrNotArchived is returned. If the account has not been registered at the
+// given block, it did not exist and an empty trie is returned.
+func (f *archiveFilter) restrict(view *LiveTrie, block uint64, account common.Address) (*LiveTrie, error) {
+	if !f.accept(account) {
+		return nil, fmt.Errorf("%w: history of account %v", ErrNotArchived, account)
+	}
+	f.mutex.Lock()
+	registered, found := f.accounts[account]
+	f.mutex.Unlock()
+	if !found || registered > block {
+		return getTrieView(emptyNodeReference, view.forest), nil
+	}
+	return view, nil
+}
+
+func (f *archiveFilter) GetMemoryFootprint() *common.MemoryFootprint {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	size := uintptr(len(f.accounts)) * (unsafe.Sizeof(common.Address{}) + unsafe.Sizeof(uint64(0)))
+	size += uintptr(cap(f.order)) * unsafe.Sizeof(common.Address{})
+	return common.NewMemoryFootprint(unsafe.Sizeof(*f) + size)
+}
+
+// store appends all accounts registered since the last call to the file.
+func (f *archiveFilter) store() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	toBeWritten := f.order[f.numInFile:]
+	file, err := os.OpenFile(f.filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	var buffer [len(common.Address{}) + 8]byte
+	for _, account := range toBeWritten {
+		copy(buffer[:], account[:])
+		binary.BigEndian.PutUint64(buffer[len(common.Address{}):], f.accounts[account])
+		if _, err := writer.Write(buffer[:]); err != nil {
+			return errors.Join(err, file.Close())
+		}
+	}
+	res := errors.Join(writer.Flush(), file.Close())
+	if res == nil {
+		f.numInFile = len(f.order)
+	}
+	return res
+}
+
+// freezeAccountPaths freezes the nodes on the paths to the given accounts in
+// the trie rooted by the given node, as well as the storage tries of those
+// accounts. Other nodes remain unfrozen.
+func (f *Forest) freezeAccountPaths(root *NodeReference, accounts []common.Address) error {
+	if f.storageMode != Immutable {
+		return fmt.Errorf("node-freezing only supported in archive mode")
+	}
+	var buffer nibblePathBuffer
+	for _, account := range accounts {
+		path := buffer.setAddress(account, f)
+		if err := freezePathTo(f, root, path, account); err != nil {
+			err = fmt.Errorf("error while freezing path to account %v in trie rooted by %v: %w", account, root.Id(), err)
+			f.errors = append(f.errors, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// freezePathTo freezes all nodes on the given path, ending at the given
+// account, without freezing the nodes' other descendants. If the account is
+// reached, its storage trie is frozen as well. If the account does not exist,
+// the node the path ends at is frozen, such that the absence of the account is
+// retained.
+func freezePathTo(manager NodeManager, ref *NodeReference, path []Nibble, account common.Address) error {
+	if ref.Id().IsEmpty() {
+		return nil
+	}
+	handle, err := manager.getWriteAccess(ref)
+	if err != nil {
+		return err
+	}
+	defer handle.Release()
+	switch node := handle.Get().(type) {
+	case *BranchNode:
+		node.nodeBase.MarkFrozen()
+		if len(path) == 0 {
+			return nil
+		}
+		if err := freezePathTo(manager, &node.children[path[0]], path[1:], account); err != nil {
+			return err
+		}
+		if !node.children[path[0]].Id().IsEmpty() {
+			node.setChildFrozen(byte(path[0]), true)
+		}
+	case *ExtensionNode:
+		node.nodeBase.MarkFrozen()
+		if node.path.IsPrefixOf(path) {
+			return freezePathTo(manager, &node.next, path[node.path.Length():], account)
+		}
+	case *AccountNode:
+		node.nodeBase.MarkFrozen()
+		if node.address == account && !node.storage.Id().IsEmpty() {
+			storage, err := manager.getWriteAccess(&node.storage)
+			if err != nil {
+				return err
+			}
+			defer storage.Release()
+			return storage.Get().Freeze(manager, storage)
+		}
+	}
+	return nil
+}
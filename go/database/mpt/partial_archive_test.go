@@ -0,0 +1,356 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestPartialArchive_ArchivedAccountsAreQueryableAcrossBlocks(t *testing.T) {
+	// Accounts of getRandomUpdateWithDeletions starting with 1 are archived.
+	filter := func(account common.Address) bool { return account[0] == 1 }
+	const numBlocks = 100
+
+	for _, config := range []MptConfig{S4ArchiveConfig, S5ArchiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			full, err := OpenArchiveTrie(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open archive: %v", err)
+			}
+			defer full.Close()
+			// A small cache makes sure that nodes are reloaded from disk.
+			dir := t.TempDir()
+			partial, err := OpenPartialArchiveTrie(dir, config, ForestConfig{CacheCapacity: 128}, filter)
+			if err != nil {
+				t.Fatalf("failed to open partial archive: %v", err)
+			}
+
+			r := rand.New(rand.NewSource(42))
+			for block := uint64(0); block < numBlocks; block++ {
+				update := getRandomUpdateWithDeletions(r)
+				if err := full.Add(block, update, nil); err != nil {
+					t.Fatalf("failed to add block to archive: %v", err)
+				}
+				if err := partial.Add(block, update, nil); err != nil {
+					t.Fatalf("failed to add block to partial archive: %v", err)
+				}
+				if block == numBlocks/2 {
+					if err := partial.Close(); err != nil {
+						t.Fatalf("failed to close partial archive: %v", err)
+					}
+					partial, err = OpenPartialArchiveTrie(dir, config, ForestConfig{CacheCapacity: 128}, filter)
+					if err != nil {
+						t.Fatalf("failed to reopen partial archive: %v", err)
+					}
+				}
+			}
+			defer partial.Close()
+
+			if err := partial.Check(); err != nil {
+				t.Errorf("inconsistent partial archive: %v", err)
+			}
+			for block := uint64(0); block < numBlocks; block++ {
+				want, err := full.GetHash(block)
+				if err != nil {
+					t.Fatalf("failed to get hash: %v", err)
+				}
+				got, err := partial.GetHash(block)
+				if err != nil {
+					t.Fatalf("failed to get hash: %v", err)
+				}
+				if want != got {
+					t.Errorf("unexpected hash of block %d, wanted %x, got %x", block, want, got)
+				}
+				for i := byte(0); i < 3; i++ {
+					for j := byte(0); j < 3; j++ {
+						account := common.Address{1, j << 4, i}
+						comparePartialArchiveAccount(t, full, partial, block, account, config)
+					}
+				}
+			}
+		})
+	}
+}
+
+// comparePartialArchiveAccount checks that the partial archive reports the
+// same state of the given account at the given block as the full archive.
+func comparePartialArchiveAccount(t *testing.T, full, partial *ArchiveTrie, block uint64, account common.Address, config MptConfig) {
+	t.Helper()
+	wantExists, err := full.Exists(block, account)
+	if err != nil {
+		t.Fatalf("failed to check existence: %v", err)
+	}
+	gotExists, err := partial.Exists(block, account)
+	if err != nil {
+		t.Fatalf("failed to check existence: %v", err)
+	}
+	if wantExists != gotExists {
+		t.Errorf("unexpected existence of %v at block %d, wanted %t, got %t", account, block, wantExists, gotExists)
+	}
+	wantBalance, err := full.GetBalance(block, account)
+	if err != nil {
+		t.Fatalf("failed to get balance: %v", err)
+	}
+	gotBalance, err := partial.GetBalance(block, account)
+	if err != nil {
+		t.Fatalf("failed to get balance: %v", err)
+	}
+	if wantBalance != gotBalance {
+		t.Errorf("unexpected balance of %v at block %d, wanted %v, got %v", account, block, wantBalance, gotBalance)
+	}
+	wantNonce, err := full.GetNonce(block, account)
+	if err != nil {
+		t.Fatalf("failed to get nonce: %v", err)
+	}
+	gotNonce, err := partial.GetNonce(block, account)
+	if err != nil {
+		t.Fatalf("failed to get nonce: %v", err)
+	}
+	if wantNonce != gotNonce {
+		t.Errorf("unexpected nonce of %v at block %d, wanted %v, got %v", account, block, wantNonce, gotNonce)
+	}
+	for i := byte(0); i < 3; i++ {
+		for j := byte(0); j < 3; j++ {
+			key := common.Key{i, j << 4}
+			want, err := full.GetStorage(block, account, key)
+			if err != nil {
+				t.Fatalf("failed to get storage: %v", err)
+			}
+			got, err := partial.GetStorage(block, account, key)
+			if err != nil {
+				t.Fatalf("failed to get storage: %v", err)
+			}
+			if want != got {
+				t.Errorf("unexpected value of %v/%v at block %d, wanted %v, got %v", account, key, block, want, got)
+			}
+		}
+	}
+	if config.Hashing.Name == EthereumLikeHashing.Name {
+		want, wantFound, err := full.GetAccountLeafRlp(block, account)
+		if err != nil {
+			t.Fatalf("failed to get account leaf: %v", err)
+		}
+		got, gotFound, err := partial.GetAccountLeafRlp(block, account)
+		if err != nil {
+			t.Fatalf("failed to get account leaf: %v", err)
+		}
+		if wantFound != gotFound || !bytes.Equal(want, got) {
+			t.Errorf("unexpected leaf of %v at block %d, wanted %x, got %x", account, block, want, got)
+		}
+	}
+}
+
+func TestPartialArchive_QueriesOfNonArchivedAccountsFailCleanly(t *testing.T) {
+	archived := common.Address{1}
+	other := common.Address{2}
+	archive, err := OpenPartialArchiveTrie(t.TempDir(), S5ArchiveConfig, ForestConfig{CacheCapacity: 1024}, NewAccountListFilter(archived))
+	if err != nil {
+		t.Fatalf("failed to open partial archive: %v", err)
+	}
+	defer archive.Close()
+
+	update := common.Update{
+		CreatedAccounts: []common.Address{archived, other},
+		Nonces: []common.NonceUpdate{
+			{Account: archived, Nonce: common.ToNonce(1)},
+			{Account: other, Nonce: common.ToNonce(2)},
+		},
+		Slots: []common.SlotUpdate{{Account: other, Key: common.Key{1}, Value: common.Value{1}}},
+	}
+	if err := archive.Add(0, update, nil); err != nil {
+		t.Fatalf("failed to add block: %v", err)
+	}
+
+	queries := map[string]func() error{
+		"Exists":     func() error { _, err := archive.Exists(0, other); return err },
+		"GetBalance": func() error { _, err := archive.GetBalance(0, other); return err },
+		"GetNonce":   func() error { _, err := archive.GetNonce(0, other); return err },
+		"GetCode":    func() error { _, err := archive.GetCode(0, other); return err },
+		"GetStorage": func() error { _, err := archive.GetStorage(0, other, common.Key{1}); return err },
+		"GetAccountLeafRlp": func() error {
+			_, _, err := archive.GetAccountLeafRlp(0, other)
+			return err
+		},
+		"DiffStorage":     func() error { _, err := archive.DiffStorage(0, archived, other); return err },
+		"GetDiff":         func() error { _, err := archive.GetDiff(0, 0); return err },
+		"GetDiffForBlock": func() error { _, err := archive.GetDiffForBlock(0); return err },
+	}
+	for name, query := range queries {
+		if err := query(); !errors.Is(err, ErrNotArchived) {
+			t.Errorf("%s: unexpected error, wanted %v, got %v", name, ErrNotArchived, err)
+		}
+	}
+	if err := archive.CheckErrors(); err != nil {
+		t.Errorf("failed queries should not corrupt the archive: %v", err)
+	}
+
+	nonce, err := archive.GetNonce(0, archived)
+	if err != nil {
+		t.Fatalf("failed to get nonce: %v", err)
+	}
+	if want, got := common.ToNonce(1), nonce; want != got {
+		t.Errorf("unexpected nonce, wanted %v, got %v", want, got)
+	}
+}
+
+func TestPartialArchive_NonFrozenStorageOfArchivedAccountsIsReported(t *testing.T) {
+	archived := common.Address{1}
+	other := common.Address{2}
+	archive, err := OpenPartialArchiveTrie(t.TempDir(), S5ArchiveConfig, ForestConfig{CacheCapacity: 1024}, NewAccountListFilter(archived))
+	if err != nil {
+		t.Fatalf("failed to open partial archive: %v", err)
+	}
+	defer archive.Close()
+
+	update := common.Update{
+		CreatedAccounts: []common.Address{archived, other},
+		Nonces: []common.NonceUpdate{
+			{Account: archived, Nonce: common.ToNonce(1)},
+			{Account: other, Nonce: common.ToNonce(2)},
+		},
+		Slots: []common.SlotUpdate{
+			{Account: archived, Key: common.Key{1}, Value: common.Value{1}},
+			{Account: other, Key: common.Key{1}, Value: common.Value{1}},
+		},
+	}
+	if err := archive.Add(0, update, nil); err != nil {
+		t.Fatalf("failed to add block: %v", err)
+	}
+
+	// The sub-trie of the other account is deliberately left unfrozen.
+	if err := archive.Check(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The storage trie of the archived account must not be unfrozen.
+	root := archive.roots.roots[0].NodeRef
+	forest := archive.forest.(*Forest)
+	var storage NodeReference
+	_, err = VisitPathToAccount(forest, &root, archived, MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+		if account, ok := node.(*AccountNode); ok {
+			storage = account.storage
+		}
+		return VisitResponseContinue
+	}))
+	if err != nil {
+		t.Fatalf("failed to locate account: %v", err)
+	}
+	handle, err := forest.getWriteAccess(&storage)
+	if err != nil {
+		t.Fatalf("failed to access storage: %v", err)
+	}
+	if !handle.Get().IsFrozen() {
+		t.Fatalf("the storage of the archived account should be frozen")
+	}
+	handle.Get().(*ValueNode).frozen = false
+	handle.Release()
+
+	if err := archive.Check(); err == nil || !strings.Contains(err.Error(), "must be frozen") {
+		t.Errorf("non-frozen storage of an archived account should be reported, got %v", err)
+	}
+}
+
+func TestArchivedPaths_PrefixesOfPathsToArchivedAccountsAreOnPath(t *testing.T) {
+	paths := newArchivedPaths(nil, []common.Address{{0x12, 0x34}, {0x12, 0x56}, {0xAB}})
+	tests := map[string]struct {
+		path []Nibble
+		want bool
+	}{
+		"root":           {nil, true},
+		"shared prefix":  {[]Nibble{1, 2}, true},
+		"first account":  {[]Nibble{1, 2, 3, 4}, true},
+		"second account": {[]Nibble{1, 2, 5}, true},
+		"third account":  {[]Nibble{0xA, 0xB, 0}, true},
+		"between":        {[]Nibble{1, 2, 4}, false},
+		"before all":     {[]Nibble{0}, false},
+		"after all":      {[]Nibble{0xB}, false},
+	}
+	for name, test := range tests {
+		if got := paths.isOnPath(test.path); got != test.want {
+			t.Errorf("%s: unexpected result for %v, wanted %t, got %t", name, test.path, test.want, got)
+		}
+	}
+	if !paths.isArchived(common.Address{0xAB}) || paths.isArchived(common.Address{0x12}) {
+		t.Errorf("unexpected archived accounts")
+	}
+}
+
+func TestPartialArchive_AccountsAreReportedAsMissingBeforeBeingTouched(t *testing.T) {
+	account := common.Address{1}
+	archive, err := OpenPartialArchiveTrie(t.TempDir(), S5ArchiveConfig, ForestConfig{CacheCapacity: 1024}, NewAccountListFilter(account))
+	if err != nil {
+		t.Fatalf("failed to open partial archive: %v", err)
+	}
+	defer archive.Close()
+
+	other := common.Update{CreatedAccounts: []common.Address{{2}}, Nonces: []common.NonceUpdate{{Account: common.Address{2}, Nonce: common.ToNonce(1)}}}
+	if err := archive.Add(0, other, nil); err != nil {
+		t.Fatalf("failed to add block: %v", err)
+	}
+	created := common.Update{CreatedAccounts: []common.Address{account}, Nonces: []common.NonceUpdate{{Account: account, Nonce: common.ToNonce(1)}}}
+	if err := archive.Add(2, created, nil); err != nil {
+		t.Fatalf("failed to add block: %v", err)
+	}
+
+	for block, want := range []bool{false, false, true} {
+		exists, err := archive.Exists(uint64(block), account)
+		if err != nil {
+			t.Fatalf("failed to check existence: %v", err)
+		}
+		if exists != want {
+			t.Errorf("unexpected existence at block %d, wanted %t, got %t", block, want, exists)
+		}
+	}
+}
+
+func TestPartialArchive_FullAndPartialArchivesCanNotBeMixed(t *testing.T) {
+	filter := NewAccountListFilter(common.Address{1})
+	update := common.Update{CreatedAccounts: []common.Address{{1}}, Nonces: []common.NonceUpdate{{Account: common.Address{1}, Nonce: common.ToNonce(1)}}}
+
+	fullDir := t.TempDir()
+	full, err := OpenArchiveTrie(fullDir, S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	if err := full.Add(0, update, nil); err != nil {
+		t.Fatalf("failed to add block: %v", err)
+	}
+	if err := full.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+	if _, err := OpenPartialArchiveTrie(fullDir, S5ArchiveConfig, ForestConfig{CacheCapacity: 1024}, filter); err == nil {
+		t.Errorf("full archive should not be opened as partial archive")
+	}
+
+	partialDir := t.TempDir()
+	partial, err := OpenPartialArchiveTrie(partialDir, S5ArchiveConfig, ForestConfig{CacheCapacity: 1024}, filter)
+	if err != nil {
+		t.Fatalf("failed to open partial archive: %v", err)
+	}
+	if err := partial.Add(0, update, nil); err != nil {
+		t.Fatalf("failed to add block: %v", err)
+	}
+	if err := partial.Close(); err != nil {
+		t.Fatalf("failed to close partial archive: %v", err)
+	}
+	if _, err := OpenArchiveTrie(partialDir, S5ArchiveConfig, 1024); err == nil {
+		t.Errorf("partial archive should not be opened as full archive")
+	}
+	if err := VerifyArchiveTrie(partialDir, S5ArchiveConfig, nil); !errors.Is(err, ErrNotArchived) {
+		t.Errorf("unexpected verification result, wanted %v, got %v", ErrNotArchived, err)
+	}
+}
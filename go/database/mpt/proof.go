@@ -82,6 +82,31 @@ func (p WitnessProof) Add(other WitnessProof) {
 	}
 }
 
+// proofConflictErr is returned when merging witness proofs containing
+// different nodes for the same hash.
+const proofConflictErr = common.ConstError("conflicting nodes in witness proofs")
+
+// Merge merges the input witness proof into the current witness proof. Unlike
+// Add, nodes of the input proof are verified before being merged. If a node
+// of the input proof does not match its hash or differs from the node stored
+// in this proof for the same hash, an error is returned and this proof is not
+// modified. Witness proofs are partial tries, such that the merged proof can
+// be used for proving any property proven by either of the two proofs. It is
+// intended for combining proofs covering different addresses, e.g. obtained
+// from different sources.
+func (p WitnessProof) Merge(other WitnessProof) error {
+	for hash, node := range other.proofDb {
+		if got := common.Keccak256(node); got != hash {
+			return fmt.Errorf("%w: node %x does not match its hash, got %x", proofConflictErr, hash, got)
+		}
+		if existing, found := p.proofDb[hash]; found && !rlpEncodedNodeEquals(existing, node) {
+			return fmt.Errorf("%w: node %x has content 0x%x and 0x%x", proofConflictErr, hash, existing, node)
+		}
+	}
+	p.Add(other)
+	return nil
+}
+
 // Extract extracts a sub-proof for a given account and selected storage locations from this proof.
 // It returns a copy that contains only the data necessary for proving the given address and storage keys.
 // The resulting proof covers proofs for the intersection of the requested properties (account information and slots)
@@ -266,6 +291,122 @@ func MergeProofs(others ...WitnessProof) WitnessProof {
 	return res
 }
 
+// VerifyEthereumProof verifies the information of the given account and the
+// values of the given storage slots in the state with the given root hash
+// using a list of RLP encoded nodes of a standard Ethereum proof, e.g. the
+// account proof and the storage proofs reported by eth_getProof. Each node
+// is decoded using DecodeEthereumNode. If the proof shows that the account
+// does not exist, empty information and zero values are returned. An error
+// is returned if a node can not be decoded, or if the proof is not complete
+// for the account or any of the slots.
+func VerifyEthereumProof(rootHash common.Hash, address common.Address, keys []common.Key, proofNodes [][]byte) (AccountInfo, []common.Value, error) {
+	proof, err := makeEthereumWitnessProof(proofNodes)
+	if err != nil {
+		return AccountInfo{}, nil, err
+	}
+
+	info, complete, err := proof.GetAccountInfo(rootHash, address)
+	if err != nil {
+		return AccountInfo{}, nil, err
+	}
+	if !complete {
+		return AccountInfo{}, nil, fmt.Errorf("proof of account %v is incomplete", address)
+	}
+
+	values := make([]common.Value, len(keys))
+	for i, key := range keys {
+		value, complete, err := proof.GetState(rootHash, address, key)
+		if err != nil {
+			return AccountInfo{}, nil, err
+		}
+		if !complete {
+			return AccountInfo{}, nil, fmt.Errorf("proof of slot %v of account %v is incomplete", key, address)
+		}
+		values[i] = value
+	}
+	return info, values, nil
+}
+
+// VerifyAccount verifies the information of the given account in the state
+// with the given root hash using a list of RLP encoded nodes of a standard
+// Ethereum proof, as accepted by VerifyEthereumProof. It returns the proven
+// information and whether the proof shows the inclusion of the account. If
+// not, the proof shows the exclusion of the account and empty information is
+// returned. An error is returned if a node can not be decoded, or if the proof
+// is not complete.
+func VerifyAccount(rootHash common.Hash, address common.Address, proofNodes [][]byte) (AccountInfo, bool, error) {
+	proof, err := makeEthereumWitnessProof(proofNodes)
+	if err != nil {
+		return AccountInfo{}, false, err
+	}
+	visitor := &proofCollectingVisitor{}
+	found, complete, err := visitWitnessPathTo(proof.proofDb, rootHash, addressToHashedNibbles(address), visitor)
+	if err != nil {
+		return AccountInfo{}, false, err
+	}
+	if !complete {
+		return AccountInfo{}, false, fmt.Errorf("proof of account %v is incomplete", address)
+	}
+	if !found {
+		return AccountInfo{}, false, nil
+	}
+	return visitor.visitedAccount.Info(), true, nil
+}
+
+// VerifyValue verifies the value of the given storage slot in the state with
+// the given root hash using a list of RLP encoded nodes of a standard
+// Ethereum proof. The nodes need to cover the path to the account as well as
+// the path to the slot in the account's storage trie, e.g. the account proof
+// and the storage proof reported by eth_getProof. It returns the proven value
+// and whether the proof shows the inclusion of the slot. If not, the proof
+// shows that the slot, or the entire account, does not exist and a zero value
+// is returned. An error is returned if a node can not be decoded, or if the
+// proof is not complete.
+func VerifyValue(rootHash common.Hash, address common.Address, key common.Key, proofNodes [][]byte) (common.Value, bool, error) {
+	proof, err := makeEthereumWitnessProof(proofNodes)
+	if err != nil {
+		return common.Value{}, false, err
+	}
+	visitor := &proofCollectingVisitor{}
+	found, complete, err := visitWitnessPathTo(proof.proofDb, rootHash, addressToHashedNibbles(address), visitor)
+	if err != nil {
+		return common.Value{}, false, err
+	}
+	if !complete {
+		return common.Value{}, false, fmt.Errorf("proof of account %v is incomplete", address)
+	}
+	if !found {
+		return common.Value{}, false, nil
+	}
+
+	storageRoot := visitor.visitedAccount.storageHash
+	found, complete, err = visitWitnessPathTo(proof.proofDb, storageRoot, keyToHashedPathNibbles(key), visitor)
+	if err != nil {
+		return common.Value{}, false, err
+	}
+	if !complete {
+		return common.Value{}, false, fmt.Errorf("proof of slot %v of account %v is incomplete", key, address)
+	}
+	if !found {
+		return common.Value{}, false, nil
+	}
+	return visitor.visitedValue.value, true, nil
+}
+
+// makeEthereumWitnessProof creates a witness proof from the given RLP encoded
+// nodes of a standard Ethereum proof. Each node is decoded using
+// DecodeEthereumNode to reject malformed nodes.
+func makeEthereumWitnessProof(proofNodes [][]byte) (WitnessProof, error) {
+	proof := WitnessProof{proofDb{}}
+	for i, node := range proofNodes {
+		if _, err := DecodeEthereumNode(node); err != nil {
+			return WitnessProof{}, fmt.Errorf("failed to decode proof node %d: %w", i, err)
+		}
+		proof.proofDb[common.Keccak256(node)] = node
+	}
+	return proof, nil
+}
+
 // witnessAccountFieldGetter extracts an account field from the witness proof for the input root hash and the address.
 // Which particular field to extract is given by the callback function.
 // This method returns true, if the inputs could be proven. In this case, the first return parameter gives
@@ -20,6 +20,7 @@ import (
 	"go.uber.org/mock/gomock"
 	"golang.org/x/exp/maps"
 	"reflect"
+	"slices"
 	"testing"
 )
 
@@ -380,6 +381,145 @@ func TestWitnessProof_Extract_and_Merge_Proofs(t *testing.T) {
 	})
 }
 
+func TestWitnessProof_Merge_MergedProofCoversPropertiesOfBothInputs(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+
+	address1 := common.Address{1}
+	address2 := common.Address{2}
+	key1 := common.Key{1}
+	key2 := common.Key{2}
+	for i, address := range []common.Address{address1, address2} {
+		if err := trie.SetAccountInfo(address, AccountInfo{Nonce: common.ToNonce(uint64(i + 1))}); err != nil {
+			t.Fatalf("failed to set account: %v", err)
+		}
+		for j, key := range []common.Key{key1, key2} {
+			if err := trie.SetValue(address, key, common.Value{byte(i + 1), byte(j + 1)}); err != nil {
+				t.Fatalf("failed to set value: %v", err)
+			}
+		}
+	}
+	root, hints, err := trie.UpdateHashes()
+	if err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+	hints.Release()
+
+	createProof := func(address common.Address, keys ...common.Key) WitnessProof {
+		t.Helper()
+		proof, err := CreateWitnessProof(trie.forest.(NodeSource), &trie.root, address, keys...)
+		if err != nil {
+			t.Fatalf("failed to create proof: %v", err)
+		}
+		return proof
+	}
+
+	type slot struct {
+		address common.Address
+		key     common.Key
+	}
+	tests := map[string]struct {
+		first, second WitnessProof
+		slots         []slot
+	}{
+		"disjoint addresses": {
+			first:  createProof(address1, key1),
+			second: createProof(address2, key2),
+			slots:  []slot{{address1, key1}, {address2, key2}},
+		},
+		"overlapping paths": {
+			first:  createProof(address1, key1),
+			second: createProof(address1, key2),
+			slots:  []slot{{address1, key1}, {address1, key2}},
+		},
+		"identical proofs": {
+			first:  createProof(address2, key1),
+			second: createProof(address2, key1),
+			slots:  []slot{{address2, key1}},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			merged := MergeProofs(test.first)
+			if err := merged.Merge(test.second); err != nil {
+				t.Fatalf("failed to merge proofs: %v", err)
+			}
+			if want, got := MergeProofs(test.first, test.second), merged; !want.Equals(got) {
+				t.Errorf("unexpected merged proof: got %v, want %v", got, want)
+			}
+			if !merged.IsValid() {
+				t.Errorf("merged proof is not valid")
+			}
+
+			for _, slot := range test.slots {
+				info, complete, err := merged.GetAccountInfo(root, slot.address)
+				if err != nil || !complete {
+					t.Fatalf("account %v not covered by merged proof, err %v", slot.address, err)
+				}
+				want, _, err := trie.GetAccountInfo(slot.address)
+				if err != nil {
+					t.Fatalf("failed to get account: %v", err)
+				}
+				if info != want {
+					t.Errorf("unexpected account info for %v, wanted %v, got %v", slot.address, want, info)
+				}
+
+				value, complete, err := merged.GetState(root, slot.address, slot.key)
+				if err != nil || !complete {
+					t.Fatalf("slot %v/%v not covered by merged proof, err %v", slot.address, slot.key, err)
+				}
+				if want, err := trie.GetValue(slot.address, slot.key); err != nil || want != value {
+					t.Errorf("unexpected value for %v/%v, wanted %v, got %v, err %v", slot.address, slot.key, want, value, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWitnessProof_Merge_ConflictsAreDetected(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ctxt := newNodeContextWithConfig(t, ctrl, S5LiveConfig)
+
+	address := common.Address{0xAB, 0xCD, 0xEF}
+	root, node := ctxt.Build(&Extension{
+		path: AddressToNibblePath(address, ctxt)[0:30],
+		next: &Account{address: address, pathLength: 10, info: AccountInfo{Nonce: common.Nonce{0x01}}},
+	})
+	proof := createReferenceProof(t, ctxt, &root, node)
+
+	corrupted := []byte{0xAA, 0xBB, 0xCC, 0xDD}
+	tests := map[string]func(proofDb){
+		"differing content": func(db proofDb) {
+			for hash := range db {
+				db[hash] = corrupted
+				return
+			}
+		},
+		"content not matching hash": func(db proofDb) {
+			db[common.Hash{1}] = corrupted
+		},
+	}
+
+	for name, corrupt := range tests {
+		t.Run(name, func(t *testing.T) {
+			other := WitnessProof{maps.Clone(proof.proofDb)}
+			corrupt(other.proofDb)
+
+			merged := WitnessProof{maps.Clone(proof.proofDb)}
+			if err := merged.Merge(other); !errors.Is(err, proofConflictErr) {
+				t.Errorf("conflict not detected, got %v", err)
+			}
+			if !merged.Equals(proof) {
+				t.Errorf("proof should not be modified by failed merge")
+			}
+		})
+	}
+}
+
 func TestWitnessProof_Extract_Various_NodeTypes_NotFoundProofs(t *testing.T) {
 	ctrl := gomock.NewController(t)
 
@@ -1004,3 +1144,196 @@ func createReferenceProof(t *testing.T, ctxt *nodeContext, root *NodeReference,
 	}
 	return WitnessProof{proof}
 }
+
+func TestVerifyEthereumProof_VerifiesProofsOfOwnProofGenerator(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	for i := 0; i < 50; i++ {
+		addr := common.Address{byte(i)}
+		if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(uint64(i + 1)), CodeHash: emptyCodeHash}); err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+		for j := 0; j < i%10; j++ {
+			if err := trie.SetValue(addr, common.Key{byte(j)}, common.Value{31: byte(i + j + 1)}); err != nil {
+				t.Fatalf("failed to set value: %v", err)
+			}
+		}
+	}
+	root, _, err := trie.UpdateHashes()
+	if err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+
+	forest := trie.forest.(*Forest)
+	keys := []common.Key{{0}, {3}, {8}, {200}}
+	for i := 0; i < 60; i++ {
+		addr := common.Address{byte(i)}
+
+		// The account proof is taken from the witness proof, the storage
+		// proofs from the account bundle.
+		witness, err := CreateWitnessProof(forest, &trie.root, addr)
+		if err != nil {
+			t.Fatalf("failed to create witness proof: %v", err)
+		}
+		wantInfo, storageHash, storageProofs, err := trie.GetAccountBundle(addr, keys)
+		if err != nil {
+			t.Fatalf("failed to get account bundle: %v", err)
+		}
+		var nodes [][]byte
+		for _, node := range witness.proofDb {
+			nodes = append(nodes, node)
+		}
+		for _, proof := range storageProofs {
+			nodes = append(nodes, proof.Proof...)
+		}
+
+		for _, data := range nodes {
+			node, err := DecodeEthereumNode(data)
+			if err != nil {
+				t.Fatalf("failed to decode proof node %x: %v", data, err)
+			}
+			if account, ok := node.(*AccountNode); ok && account.info == wantInfo && account.storageHash != storageHash {
+				t.Errorf("unexpected storage hash of account %v, wanted %x, got %x", addr, storageHash, account.storageHash)
+			}
+		}
+
+		gotInfo, gotValues, err := VerifyEthereumProof(root, addr, keys, nodes)
+		if err != nil {
+			t.Fatalf("failed to verify proof of account %v: %v", addr, err)
+		}
+		if gotInfo != wantInfo {
+			t.Errorf("unexpected information of account %v, wanted %v, got %v", addr, wantInfo, gotInfo)
+		}
+		for j, key := range keys {
+			if gotValues[j] != storageProofs[j].Value {
+				t.Errorf("unexpected value of %v/%v, wanted %v, got %v", addr, key, storageProofs[j].Value, gotValues[j])
+			}
+		}
+	}
+}
+
+func TestVerifyEthereumProof_IncompleteOrCorruptedProofsAreDetected(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	for i := 0; i < 20; i++ {
+		if err := trie.SetAccountInfo(common.Address{byte(i)}, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+	}
+	if err := trie.SetValue(common.Address{1}, common.Key{1}, common.Value{1}); err != nil {
+		t.Fatalf("failed to set value: %v", err)
+	}
+	root, _, err := trie.UpdateHashes()
+	if err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+	witness, err := CreateWitnessProof(trie.forest.(*Forest), &trie.root, common.Address{1}, common.Key{1})
+	if err != nil {
+		t.Fatalf("failed to create witness proof: %v", err)
+	}
+	rootNode := witness.proofDb[root]
+	var others [][]byte
+	for hash, node := range witness.proofDb {
+		if hash != root {
+			others = append(others, node)
+		}
+	}
+	accountProof, _ := witness.Extract(root, common.Address{1})
+	var accountNodes [][]byte
+	for _, node := range accountProof.proofDb {
+		accountNodes = append(accountNodes, node)
+	}
+	corrupted := slices.Clone(rootNode)
+	corrupted[len(corrupted)-1]++
+
+	tests := map[string]struct {
+		root  common.Hash
+		keys  []common.Key
+		nodes [][]byte
+	}{
+		"missing root":       {root, nil, others},
+		"wrong root":         {common.Hash{1}, nil, append(others, rootNode)},
+		"missing slot proof": {root, []common.Key{{1}}, accountNodes},
+		"corrupted node":     {root, nil, append(others, corrupted)},
+		"malformed node":     {root, nil, append(others, rootNode, []byte{0xc2, 0x80})},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := VerifyEthereumProof(test.root, common.Address{1}, test.keys, test.nodes); err == nil {
+				t.Errorf("verification should fail")
+			}
+		})
+	}
+
+	if _, values, err := VerifyEthereumProof(root, common.Address{1}, []common.Key{{1}}, append(others, rootNode)); err != nil || values[0] != (common.Value{1}) {
+		t.Errorf("failed to verify complete proof, got %v, %v", values, err)
+	}
+}
+
+func TestVerifyAccountAndValue_DistinguishInclusionAndExclusion(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	for i := 0; i < 20; i++ {
+		if err := trie.SetAccountInfo(common.Address{byte(i)}, AccountInfo{Nonce: common.ToNonce(uint64(i + 1))}); err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if err := trie.SetValue(common.Address{1}, common.Key{byte(i)}, common.Value{byte(i + 1)}); err != nil {
+			t.Fatalf("failed to set value: %v", err)
+		}
+	}
+	root, _, err := trie.UpdateHashes()
+	if err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+	getNodes := func(address common.Address, keys ...common.Key) [][]byte {
+		witness, err := CreateWitnessProof(trie.forest.(*Forest), &trie.root, address, keys...)
+		if err != nil {
+			t.Fatalf("failed to create witness proof: %v", err)
+		}
+		var res [][]byte
+		for _, node := range witness.proofDb {
+			res = append(res, node)
+		}
+		return res
+	}
+
+	info, found, err := VerifyAccount(root, common.Address{1}, getNodes(common.Address{1}))
+	if err != nil || !found || info.Nonce != common.ToNonce(2) {
+		t.Errorf("failed to verify inclusion of account, got %v, %t, %v", info, found, err)
+	}
+	info, found, err = VerifyAccount(root, common.Address{100}, getNodes(common.Address{100}))
+	if err != nil || found || info != (AccountInfo{}) {
+		t.Errorf("failed to verify exclusion of account, got %v, %t, %v", info, found, err)
+	}
+
+	value, found, err := VerifyValue(root, common.Address{1}, common.Key{3}, getNodes(common.Address{1}, common.Key{3}))
+	if err != nil || !found || value != (common.Value{4}) {
+		t.Errorf("failed to verify inclusion of slot, got %v, %t, %v", value, found, err)
+	}
+	value, found, err = VerifyValue(root, common.Address{1}, common.Key{10}, getNodes(common.Address{1}, common.Key{10}))
+	if err != nil || found || value != (common.Value{}) {
+		t.Errorf("failed to verify exclusion of slot, got %v, %t, %v", value, found, err)
+	}
+	value, found, err = VerifyValue(root, common.Address{100}, common.Key{3}, getNodes(common.Address{100}))
+	if err != nil || found || value != (common.Value{}) {
+		t.Errorf("failed to verify exclusion of slot of missing account, got %v, %t, %v", value, found, err)
+	}
+
+	if _, _, err := VerifyAccount(common.Hash{1}, common.Address{1}, getNodes(common.Address{1})); err == nil {
+		t.Errorf("verification against wrong root should fail")
+	}
+	if _, _, err := VerifyValue(root, common.Address{1}, common.Key{3}, getNodes(common.Address{1})); err == nil {
+		t.Errorf("verification of slot without storage proof should fail")
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/common/interrupt"
+)
+
+// numPruneChunks is the number of chunks the account trie is split into
+// when pruning empty accounts. Chunks are formed by the first nibble of the
+// path of accounts in the trie.
+const numPruneChunks = 16
+
+// pruneProgressFileName is the name of the file in the directory of a
+// LiveTrie tracking the progress of an incomplete pruning sweep.
+const pruneProgressFileName = "prune.json"
+
+// pruneProgress is the helper type to read and write the progress of a
+// pruning sweep from/to the disk.
+type pruneProgress struct {
+	NextChunk int
+}
+
+// PruneEmptyAccounts removes all accounts from this trie that are empty
+// according to EIP-161 -- thus, having a zero nonce, a zero balance, and no
+// code -- and that have an empty storage. Such accounts may be present in
+// states imported from old chains. Parent nodes are restructured as for any
+// other account deletion and hashes are recomputed once at the end. The
+// number of accounts removed by this call is returned.
+func (s *LiveTrie) PruneEmptyAccounts() (removed int, err error) {
+	return s.PruneEmptyAccountsWithContext(context.Background())
+}
+
+// PruneEmptyAccountsWithContext is a variant of PruneEmptyAccounts that may
+// be interrupted through the given context. The sweep is conducted in chunks
+// of accounts sharing the first nibble of their path. For tries backed by a
+// directory, the progress is persisted after each chunk, such that a sweep
+// that got interrupted or failed continues with the next pending chunk when
+// being restarted after the trie has been flushed and re-opened. If
+// interrupted, interrupt.ErrCanceled is returned.
+func (s *LiveTrie) PruneEmptyAccountsWithContext(ctx context.Context) (removed int, err error) {
+	source, ok := s.forest.(NodeSource)
+	if !ok {
+		return 0, fmt.Errorf("node access is not supported by %T", s.forest)
+	}
+
+	progressFile := ""
+	if len(s.metadatafile) > 0 {
+		progressFile = filepath.Join(filepath.Dir(s.metadatafile), pruneProgressFileName)
+	}
+	progress, err := readPruneProgress(progressFile)
+	if err != nil {
+		return 0, err
+	}
+
+	for chunk := progress.NextChunk; chunk < numPruneChunks; chunk++ {
+		if interrupt.IsCancelled(ctx) {
+			return removed, interrupt.ErrCanceled
+		}
+		var accounts []common.Address
+		if err := collectEmptyAccounts(source, &s.root, 0, Nibble(chunk), &accounts); err != nil {
+			return removed, err
+		}
+		for _, address := range accounts {
+			if err := s.SetAccountInfo(address, AccountInfo{}); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+		if err := writePruneProgress(progressFile, pruneProgress{NextChunk: chunk + 1}); err != nil {
+			return removed, err
+		}
+	}
+
+	_, hints, err := s.UpdateHashes()
+	if hints != nil {
+		hints.Release()
+	}
+	if err != nil {
+		return removed, err
+	}
+	if len(progressFile) > 0 {
+		if err := os.Remove(progressFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// collectEmptyAccounts collects the addresses of all accounts that are empty
+// according to EIP-161 and have an empty storage in the trie rooted by the
+// given node. The depth is the number of path nibbles consumed by the parents
+// of the given node. Only accounts with a path starting with the given chunk
+// nibble are collected.
+func collectEmptyAccounts(source NodeSource, ref *NodeReference, depth int, chunk Nibble, res *[]common.Address) error {
+	return forEachAccountInChunk(source, ref, depth, chunk, func(node *AccountNode) error {
+		if isEip161Empty(node.info) && node.storage.Id().IsEmpty() {
+			*res = append(*res, node.address)
+		}
+		return nil
+	})
+}
+
+// forEachAccountInChunk calls the given function for each account in the
+// trie rooted by the given node with a path starting with the given chunk
+// nibble. The depth is the number of path nibbles consumed by the parents
+// of the given node.
+func forEachAccountInChunk(source NodeSource, ref *NodeReference, depth int, chunk Nibble, visit func(*AccountNode) error) error {
+	if ref.Id().IsEmpty() {
+		return nil
+	}
+	handle, err := source.getViewAccess(ref)
+	if err != nil {
+		return err
+	}
+	defer handle.Release()
+	switch node := handle.Get().(type) {
+	case *BranchNode:
+		if depth == 0 {
+			return forEachAccountInChunk(source, &node.children[chunk], depth+1, chunk, visit)
+		}
+		for i := range node.children {
+			if err := forEachAccountInChunk(source, &node.children[i], depth+1, chunk, visit); err != nil {
+				return err
+			}
+		}
+	case *ExtensionNode:
+		if depth == 0 && node.path.Get(0) != chunk {
+			return nil
+		}
+		return forEachAccountInChunk(source, &node.next, depth+node.path.Length(), chunk, visit)
+	case *AccountNode:
+		if depth == 0 {
+			var buffer nibblePathBuffer
+			if buffer.setAddress(node.address, source)[0] != chunk {
+				return nil
+			}
+		}
+		return visit(node)
+	}
+	return nil
+}
+
+// isEip161Empty checks whether the given account is empty as defined by
+// EIP-161, thus having a zero nonce, a zero balance, and no code.
+func isEip161Empty(info AccountInfo) bool {
+	return info.Nonce == common.Nonce{} &&
+		info.Balance == common.Balance{} &&
+		(info.CodeHash == emptyCodeHash || info.CodeHash == common.Hash{})
+}
+
+// readPruneProgress parses the content of the given progress file if it
+// exists or returns the progress of a fresh sweep otherwise.
+func readPruneProgress(filename string) (pruneProgress, error) {
+	res := pruneProgress{}
+	if len(filename) == 0 {
+		return res, nil
+	}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return res, nil
+	}
+	if err != nil {
+		return res, err
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return res, err
+	}
+	if res.NextChunk < 0 || res.NextChunk > numPruneChunks {
+		return res, fmt.Errorf("invalid pruning progress, next chunk %d out of range", res.NextChunk)
+	}
+	return res, nil
+}
+
+// writePruneProgress stores the given progress in the given file, if the
+// file name is not empty.
+func writePruneProgress(filename string, progress pruneProgress) error {
+	if len(filename) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0600)
+}
@@ -0,0 +1,276 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/common/interrupt"
+)
+
+func TestLiveTrie_PruneEmptyAccounts_RemovesOnlyEmptyAccountsWithoutStorage(t *testing.T) {
+	for _, config := range allMptConfigs {
+		for _, numAccounts := range []int{0, 1, 2, 10, 100} {
+			t.Run(fmt.Sprintf("%s/accounts=%d", config.Name, numAccounts), func(t *testing.T) {
+				trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer trie.Close()
+				want, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open trie: %v", err)
+				}
+				defer want.Close()
+
+				// The reference trie receives all accounts except the empty ones.
+				empty := addPruneTestAccounts(t, trie, numAccounts, true)
+				addPruneTestAccounts(t, want, numAccounts, false)
+
+				removed, err := trie.PruneEmptyAccounts()
+				if err != nil {
+					t.Fatalf("failed to prune empty accounts: %v", err)
+				}
+				if want, got := len(empty), removed; want != got {
+					t.Errorf("unexpected number of removed accounts, wanted %d, got %d", want, got)
+				}
+				for _, address := range empty {
+					if _, exists, err := trie.GetAccountInfo(address); err != nil || exists {
+						t.Errorf("empty account %v was not removed, err %v", address, err)
+					}
+				}
+
+				if err := trie.Check(); err != nil {
+					t.Errorf("inconsistent trie after pruning: %v", err)
+				}
+				wantHash, _, err := want.UpdateHashes()
+				if err != nil {
+					t.Fatalf("failed to get hash: %v", err)
+				}
+				gotHash, _, err := trie.UpdateHashes()
+				if err != nil {
+					t.Fatalf("failed to get hash: %v", err)
+				}
+				if wantHash != gotHash {
+					t.Errorf("unexpected hash after pruning, wanted %x, got %x", wantHash, gotHash)
+				}
+
+				// A second sweep finds nothing to remove.
+				removed, err = trie.PruneEmptyAccounts()
+				if err != nil || removed != 0 {
+					t.Errorf("unexpected result of second sweep, removed %d, err %v", removed, err)
+				}
+			})
+		}
+	}
+}
+
+func TestLiveTrie_PruneEmptyAccounts_ResumesFromPersistedProgress(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			trie, err := OpenFileLiveTrie(dir, config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer trie.Close()
+			empty := addPruneTestAccounts(t, trie, 200, true)
+
+			// Simulate a sweep that got interrupted after half of the chunks.
+			progressFile := filepath.Join(dir, pruneProgressFileName)
+			if err := writePruneProgress(progressFile, pruneProgress{NextChunk: numPruneChunks / 2}); err != nil {
+				t.Fatalf("failed to write progress: %v", err)
+			}
+
+			removed, err := trie.PruneEmptyAccounts()
+			if err != nil {
+				t.Fatalf("failed to prune empty accounts: %v", err)
+			}
+
+			wantRemoved := 0
+			for _, address := range empty {
+				pending := AddressToNibblePath(address, trie.forest.(NodeSource))[0] >= numPruneChunks/2
+				if pending {
+					wantRemoved++
+				}
+				if _, exists, err := trie.GetAccountInfo(address); err != nil || exists == pending {
+					t.Errorf("unexpected presence of account %v, wanted %t, got %t, err %v", address, !pending, exists, err)
+				}
+			}
+			if wantRemoved == 0 || wantRemoved == len(empty) {
+				t.Fatalf("test accounts should cover processed and pending chunks")
+			}
+			if want, got := wantRemoved, removed; want != got {
+				t.Errorf("unexpected number of removed accounts, wanted %d, got %d", want, got)
+			}
+			if _, err := os.Stat(progressFile); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("progress file should be removed after completed sweep, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLiveTrie_PruneEmptyAccounts_CanBeInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	trie, err := OpenFileLiveTrie(dir, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	empty := addPruneTestAccounts(t, trie, 20, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	removed, err := trie.PruneEmptyAccountsWithContext(ctx)
+	if !errors.Is(err, interrupt.ErrCanceled) {
+		t.Errorf("unexpected error, wanted %v, got %v", interrupt.ErrCanceled, err)
+	}
+	if removed != 0 {
+		t.Errorf("no accounts should be removed, got %d", removed)
+	}
+	for _, address := range empty {
+		if _, exists, err := trie.GetAccountInfo(address); err != nil || !exists {
+			t.Errorf("account %v should not be removed, err %v", address, err)
+		}
+	}
+
+	progress, err := readPruneProgress(filepath.Join(dir, pruneProgressFileName))
+	if err != nil {
+		t.Fatalf("failed to read progress: %v", err)
+	}
+	if progress.NextChunk != 0 {
+		t.Errorf("unexpected progress, wanted chunk 0, got %d", progress.NextChunk)
+	}
+}
+
+func TestLiveTrie_PruneEmptyAccounts_InvalidProgressIsDetected(t *testing.T) {
+	tests := map[string]string{
+		"not json":     "not json",
+		"negative":     `{"NextChunk":-1}`,
+		"out of range": `{"NextChunk":17}`,
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			trie, err := OpenFileLiveTrie(dir, S5LiveConfig, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer trie.Close()
+			if err := os.WriteFile(filepath.Join(dir, pruneProgressFileName), []byte(content), 0600); err != nil {
+				t.Fatalf("failed to write progress: %v", err)
+			}
+			if _, err := trie.PruneEmptyAccounts(); err == nil {
+				t.Errorf("invalid progress should be detected")
+			}
+		})
+	}
+}
+
+func TestMptState_PruneEmptyAccounts_ResultIsPersisted(t *testing.T) {
+	dir := t.TempDir()
+	state, err := OpenGoFileState(dir, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	empty := addPruneTestAccounts(t, state.trie, 20, true)
+	removed, err := state.PruneEmptyAccounts()
+	if err != nil || removed != len(empty) {
+		t.Fatalf("unexpected result of pruning, removed %d, err %v", removed, err)
+	}
+	want, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+
+	state, err = OpenGoFileState(dir, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to re-open state: %v", err)
+	}
+	defer state.Close()
+	got, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+	if want != got {
+		t.Errorf("unexpected hash after re-opening, wanted %x, got %x", want, got)
+	}
+	for _, address := range empty {
+		if exists, err := state.Exists(address); err != nil || exists {
+			t.Errorf("empty account %v was not removed, err %v", address, err)
+		}
+	}
+}
+
+func TestIsEip161Empty(t *testing.T) {
+	tests := []struct {
+		info  AccountInfo
+		empty bool
+	}{
+		{AccountInfo{}, true},
+		{AccountInfo{CodeHash: emptyCodeHash}, true},
+		{AccountInfo{Nonce: common.ToNonce(1), CodeHash: emptyCodeHash}, false},
+		{AccountInfo{Balance: common.Balance{31: 1}, CodeHash: emptyCodeHash}, false},
+		{AccountInfo{CodeHash: common.Hash{1}}, false},
+	}
+	for _, test := range tests {
+		if want, got := test.empty, isEip161Empty(test.info); want != got {
+			t.Errorf("unexpected result for %v, wanted %t, got %t", test.info, want, got)
+		}
+	}
+}
+
+// addPruneTestAccounts adds a mix of accounts to the given trie. Every fifth
+// account is empty according to EIP-161 and lacks storage, other accounts
+// are non-empty or have storage. Empty accounts are only added if requested,
+// and their addresses are returned.
+func addPruneTestAccounts(t *testing.T, trie *LiveTrie, numAccounts int, withEmpty bool) []common.Address {
+	t.Helper()
+	var empty []common.Address
+	for i := 0; i < numAccounts; i++ {
+		address := common.Address{byte(i), byte(i >> 8), 0x12}
+		info := AccountInfo{CodeHash: emptyCodeHash}
+		withStorage := false
+		switch i % 5 {
+		case 0:
+			if !withEmpty {
+				continue
+			}
+			empty = append(empty, address)
+		case 1:
+			withStorage = true
+		case 2:
+			info.Nonce = common.ToNonce(uint64(i))
+		case 3:
+			info.Balance = common.Balance{31: byte(i)}
+		case 4:
+			info.CodeHash = common.Hash{byte(i)}
+		}
+		if err := trie.SetAccountInfo(address, info); err != nil {
+			t.Fatalf("failed to add account: %v", err)
+		}
+		if withStorage {
+			if err := trie.SetValue(address, common.Key{byte(i)}, common.Value{1}); err != nil {
+				t.Fatalf("failed to set storage: %v", err)
+			}
+		}
+	}
+	return empty
+}
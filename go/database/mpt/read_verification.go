@@ -0,0 +1,253 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
+)
+
+const hashMismatchErr = common.ConstError("stored hash does not match the content of the node")
+
+// maxExpectedHashes limits the number of child hashes retained by a
+// readHashVerifier. If exceeded, all retained hashes are dropped.
+const maxExpectedHashes = 1 << 20
+
+// readHashVerifier implements the opportunistic verification of node hashes
+// enabled by ForestConfig.VerifyHashesOnRead. Whenever a clean node is loaded
+// from disk, its hash is re-computed and compared to the stored hash.
+//
+// If hashes are stored with nodes, the stored hash of a loaded node is known
+// right away. However, hashes of child nodes are not stored in their parents.
+// To avoid loading entire sub-tries, nodes are thus only checked if all their
+// children are retained in memory.
+//
+// If hashes are stored with parents, the hashes of the children of a loaded
+// node are recorded and compared to the hash of the respective child once it
+// is loaded. Children already in memory at that point are not checked.
+type readHashVerifier struct {
+	mutex    sync.Mutex
+	expected map[NodeId]common.Hash // < child hashes recorded when loading parent nodes
+}
+
+func newReadHashVerifier() *readHashVerifier {
+	return &readHashVerifier{
+		expected: map[NodeId]common.Hash{},
+	}
+}
+
+// forget drops the hash recorded for the given node. It needs to be called
+// whenever a node enters the node cache without being loaded from disk, since
+// in those cases the recorded hash may be out-dated.
+func (v *readHashVerifier) forget(id NodeId) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	delete(v.expected, id)
+}
+
+// verify checks the hash of the given node just loaded from disk.
+func (v *readHashVerifier) verify(forest *Forest, id NodeId, instance *shared.Shared[Node]) error {
+	if forest.config.HashStorageLocation == HashStoredWithNode {
+		return v.verifyHashStoredWithNode(forest, id, instance)
+	}
+	return v.verifyHashStoredWithParent(forest, id, instance)
+}
+
+func (v *readHashVerifier) verifyHashStoredWithParent(forest *Forest, id NodeId, instance *shared.Shared[Node]) error {
+	v.mutex.Lock()
+	want, found := v.expected[id]
+	delete(v.expected, id)
+	v.mutex.Unlock()
+
+	// Collect the hashes of children not retained in memory.
+	view := instance.GetViewHandle()
+	node := view.Get()
+	if node.IsDirty() {
+		// The node got modified concurrently, so its content can no longer
+		// be checked against the disk version.
+		view.Release()
+		return nil
+	}
+	children := map[NodeId]common.Hash{}
+	switch n := node.(type) {
+	case *AccountNode:
+		if !n.storage.Id().IsEmpty() {
+			children[n.storage.Id()] = n.storageHash
+		}
+	case *BranchNode:
+		for i, child := range n.children {
+			if !child.Id().IsEmpty() && !n.isEmbedded(byte(i)) {
+				children[child.Id()] = n.hashes[i]
+			}
+		}
+	case *ExtensionNode:
+		if !n.nextIsEmbedded {
+			children[n.next.Id()] = n.nextHash
+		}
+	}
+	view.Release()
+
+	v.mutex.Lock()
+	if len(v.expected)+len(children) > maxExpectedHashes {
+		v.expected = map[NodeId]common.Hash{}
+	}
+	for child, hash := range children {
+		ref := NewNodeReference(child)
+		if _, cached := forest.nodeCache.Get(&ref); !cached {
+			v.expected[child] = hash
+		}
+	}
+	v.mutex.Unlock()
+
+	if !found {
+		return nil
+	}
+	ref := NewNodeReference(id)
+	got, err := forest.hasher.getHash(&ref, forest)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("%w: node %v, stored in parent %x, computed %x", hashMismatchErr, id, want, got)
+	}
+	return nil
+}
+
+func (v *readHashVerifier) verifyHashStoredWithNode(forest *Forest, id NodeId, instance *shared.Shared[Node]) error {
+	view := instance.GetViewHandle()
+	node := view.Get()
+	want, dirty := node.GetHash()
+	if node.IsDirty() || dirty {
+		view.Release()
+		return nil
+	}
+
+	// Create a copy of the node with the hashes of its children filled in.
+	filled, children, fillIn, supported := copyNodeForRehashing(node)
+	view.Release()
+	if !supported {
+		return nil
+	}
+
+	for i, child := range children {
+		hash, embedded, available, err := getCachedHash(forest, child)
+		if err != nil || !available {
+			return err
+		}
+		fillIn(i, hash, embedded)
+	}
+
+	// Hashes of embedded nodes are not stored.
+	source := nodeOverrideSource{forest, id, shared.MakeShared(filled)}
+	if embedded, err := forest.hasher.isEmbedded(filled, source); err != nil || embedded {
+		return err
+	}
+	ref := NewNodeReference(id)
+	got, err := forest.hasher.getHash(&ref, source)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("%w: node %v, stored %x, computed %x", hashMismatchErr, id, want, got)
+	}
+	return nil
+}
+
+// copyNodeForRehashing creates a copy of the given node into which the hashes
+// of its children can be filled in using the returned function. The index
+// passed to this function refers to the position in the returned list of
+// children. This is required for re-computing the hash of nodes if hashes are
+// stored with nodes, since hashes of children are then not stored in their
+// parents. Other node types, e.g. empty nodes, are reported as unsupported.
+func copyNodeForRehashing(node Node) (Node, []NodeReference, func(i int, hash common.Hash, embedded bool), bool) {
+	switch n := node.(type) {
+	case *AccountNode:
+		account := *n
+		var children []NodeReference
+		if !account.storage.Id().IsEmpty() {
+			children = append(children, account.storage)
+		}
+		account.storageHashDirty = false
+		return &account, children, func(_ int, hash common.Hash, _ bool) {
+			account.storageHash = hash
+		}, true
+	case *BranchNode:
+		branch := *n
+		var children []NodeReference
+		positions := make([]byte, 0, len(branch.children))
+		for j, child := range branch.children {
+			if !child.Id().IsEmpty() {
+				children = append(children, child)
+				positions = append(positions, byte(j))
+			}
+		}
+		branch.clearChildHashDirtyFlags()
+		return &branch, children, func(i int, hash common.Hash, embedded bool) {
+			branch.hashes[positions[i]] = hash
+			branch.setEmbedded(positions[i], embedded)
+		}, true
+	case *ExtensionNode:
+		extension := *n
+		extension.nextHashDirty = false
+		return &extension, []NodeReference{extension.next}, func(_ int, hash common.Hash, embedded bool) {
+			extension.nextHash = hash
+			extension.nextIsEmbedded = embedded
+		}, true
+	case *ValueNode:
+		value := *n
+		return &value, nil, nil, true
+	}
+	return nil, nil, nil, false
+}
+
+// getCachedHash fetches the hash of the referenced node if the node is
+// retained in the node cache and its hash is up-to-date.
+func getCachedHash(forest *Forest, ref NodeReference) (hash common.Hash, embedded bool, available bool, err error) {
+	instance, found := forest.nodeCache.Get(&ref)
+	if !found {
+		return common.Hash{}, false, false, nil
+	}
+	view := instance.GetViewHandle()
+	defer view.Release()
+	node := view.Get()
+	hash, dirty := node.GetHash()
+	if dirty {
+		return common.Hash{}, false, false, nil
+	}
+	embedded, err = forest.hasher.isEmbedded(node, forest)
+	return hash, embedded, err == nil, err
+}
+
+func (v *readHashVerifier) getMemoryFootprint() *common.MemoryFootprint {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	entrySize := unsafe.Sizeof(NodeId(0)) + unsafe.Sizeof(common.Hash{})
+	return common.NewMemoryFootprint(uintptr(len(v.expected)) * entrySize)
+}
+
+// nodeOverrideSource is a NodeSource resolving a single node ID to a custom
+// node while all other nodes are resolved by the wrapped source.
+type nodeOverrideSource struct {
+	NodeSource
+	id   NodeId
+	node *shared.Shared[Node]
+}
+
+func (s nodeOverrideSource) getViewAccess(ref *NodeReference) (shared.ViewHandle[Node], error) {
+	if ref.Id() == s.id {
+		return s.node.GetViewHandle(), nil
+	}
+	return s.NodeSource.getViewAccess(ref)
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+	"github.com/Fantom-foundation/Carmen/go/backend/stock/file"
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// openReadVerificationTestForest opens the forest filled by
+// fillStorageVerificationTestDirectory and returns it with its latest root.
+func openReadVerificationTestForest(t *testing.T, dir string, config MptConfig, verify bool) (*Forest, NodeReference) {
+	t.Helper()
+	forestConfig := ForestConfig{Mode: Mutable, CacheCapacity: 1024, VerifyHashesOnRead: verify}
+	var root NodeReference
+	if config.HashStorageLocation == HashStoredWithParent {
+		metadata, _, err := readMetadata(dir + "/meta.json")
+		if err != nil {
+			t.Fatalf("failed to read metadata: %v", err)
+		}
+		root = NewNodeReference(metadata.RootNode)
+	} else {
+		forestConfig.Mode = Immutable
+		roots, err := loadRoots(dir+"/roots.dat", NodeIdEncoder{})
+		if err != nil {
+			t.Fatalf("failed to load roots: %v", err)
+		}
+		root = roots.get(uint64(roots.length() - 1)).NodeRef
+	}
+	forest, err := OpenFileForest(dir, config, forestConfig)
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	return forest, root
+}
+
+// readAllTestSlots reads all slots written by fillStorageVerificationTestDirectory
+// and returns the first error encountered.
+func readAllTestSlots(forest *Forest, root *NodeReference) error {
+	for block := 0; block < 2; block++ {
+		for _, slot := range getStorageVerificationTestUpdate(block).Slots {
+			if _, err := forest.GetValue(root, slot.Account, slot.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func modifyAllNodes[N any](t *testing.T, directory string, encoder stock.ValueEncoder[N], modify func(n *N)) {
+	t.Helper()
+	nodes, err := file.OpenStock[uint64](encoder, directory)
+	if err != nil {
+		t.Fatalf("failed to open stock: %v", err)
+	}
+	ids, err := nodes.GetIds()
+	if err != nil {
+		t.Fatalf("failed to get ids: %v", err)
+	}
+	for i := ids.GetLowerBound(); i < ids.GetUpperBound(); i++ {
+		if !ids.Contains(i) {
+			continue
+		}
+		node, err := nodes.Get(i)
+		if err != nil {
+			t.Fatalf("failed to load node: %v", err)
+		}
+		modify(&node)
+		if err := nodes.Set(i, node); err != nil {
+			t.Fatalf("failed to update node: %v", err)
+		}
+	}
+	if err := nodes.Close(); err != nil {
+		t.Fatalf("failed to close stock: %v", err)
+	}
+}
+
+// corruptStoredHashes modifies hashes stored on disk without modifying the
+// content of the nodes they are describing.
+func corruptStoredHashes(t *testing.T, dir string, config MptConfig) {
+	t.Helper()
+	accountEncoder, _, _, valueEncoder := getEncoder(config)
+	if config.HashStorageLocation == HashStoredWithParent {
+		modifyAllNodes(t, dir+"/accounts", accountEncoder, func(node *AccountNode) {
+			node.storageHash[0]++
+		})
+	} else {
+		modifyAllNodes(t, dir+"/values", valueEncoder, func(node *ValueNode) {
+			node.hash[0]++
+		})
+	}
+}
+
+func TestReadVerification_ValidHashesAreAccepted(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			fillStorageVerificationTestDirectory(t, dir, config)
+
+			forest, root := openReadVerificationTestForest(t, dir, config, true)
+			if err := readAllTestSlots(forest, &root); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if err := forest.Close(); err != nil {
+				t.Errorf("failed to close forest: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadVerification_CorruptedHashIsDetected(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			fillStorageVerificationTestDirectory(t, dir, config)
+			corruptStoredHashes(t, dir, config)
+
+			forest, root := openReadVerificationTestForest(t, dir, config, true)
+			defer forest.Close()
+			if err := readAllTestSlots(forest, &root); !errors.Is(err, hashMismatchErr) {
+				t.Errorf("corrupted hash should be detected, got %v", err)
+			}
+			if err := forest.CheckErrors(); !errors.Is(err, hashMismatchErr) {
+				t.Errorf("detected error should be recorded, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReadVerification_IsDisabledByDefault(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			fillStorageVerificationTestDirectory(t, dir, config)
+			corruptStoredHashes(t, dir, config)
+
+			forest, root := openReadVerificationTestForest(t, dir, config, false)
+			if err := readAllTestSlots(forest, &root); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if err := forest.Close(); err != nil {
+				t.Errorf("failed to close forest: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadVerification_ForgottenHashesAreDropped(t *testing.T) {
+	verifier := newReadHashVerifier()
+	verifier.expected[ValueId(1)] = common.Hash{1}
+	verifier.forget(ValueId(1))
+	if _, found := verifier.expected[ValueId(1)]; found {
+		t.Errorf("forgotten hash should be removed")
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import "errors"
+
+// releaseBatcher is a NodeManager collecting the nodes released through it
+// into batches which are forwarded to the releaseBatch function of the
+// wrapped manager. It is used for releasing entire sub-tries, where releasing
+// nodes one-by-one would cause a lock acquisition per node.
+type releaseBatcher struct {
+	NodeManager
+	batchSize int
+	batch     []NodeReference
+	released  int // the number of nodes released through this batcher
+}
+
+func newReleaseBatcher(manager NodeManager, batchSize int) *releaseBatcher {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &releaseBatcher{
+		NodeManager: manager,
+		batchSize:   batchSize,
+		batch:       make([]NodeReference, 0, batchSize),
+	}
+}
+
+func (b *releaseBatcher) release(ref *NodeReference) error {
+	b.released++
+	b.batch = append(b.batch, *ref)
+	if len(b.batch) < b.batchSize {
+		return nil
+	}
+	return b.flush()
+}
+
+// flush releases all nodes collected so far.
+func (b *releaseBatcher) flush() error {
+	if len(b.batch) == 0 {
+		return nil
+	}
+	err := b.NodeManager.releaseBatch(b.batch)
+	b.batch = b.batch[:0]
+	return err
+}
+
+// releaseSubTrie releases all non-frozen nodes of the sub-trie rooted by the
+// given node, releasing nodes in batches of the given size. The number of
+// released nodes is returned.
+func releaseSubTrie(manager NodeManager, ref *NodeReference, batchSize int) (int, error) {
+	handle, err := manager.getWriteAccess(ref)
+	if err != nil {
+		return 0, err
+	}
+	batcher := newReleaseBatcher(manager, batchSize)
+	err = handle.Get().Release(batcher, ref, handle)
+	handle.Release()
+	// Nodes collected before an error occurred are already marked released
+	// and thus need to be released regardless.
+	return batcher.released, errors.Join(err, batcher.flush())
+}
@@ -0,0 +1,494 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"go.uber.org/mock/gomock"
+)
+
+// buildReleaseTestTrie builds a trie covering all node types and returns
+// its root and the labels of all its nodes.
+func buildReleaseTestTrie(ctxt *nodeContext) (NodeReference, []string) {
+	ref, _ := ctxt.Build(&Tag{"R", &Branch{children: Children{
+		1: &Tag{"A", &Account{address: common.Address{1}, storage: &Tag{"S", &Branch{children: Children{
+			2: &Tag{"V1", &Value{key: common.Key{2}, value: common.Value{1}}},
+			5: &Tag{"V2", &Value{key: common.Key{5}, value: common.Value{1}}},
+		}}}}},
+		4: &Tag{"B", &Account{address: common.Address{4}}},
+		8: &Tag{"E", &Extension{path: []Nibble{1, 2}, next: &Tag{"C", &Branch{children: Children{
+			3: &Tag{"D", &Account{address: common.Address{8, 0x12, 0x30}}},
+			7: &Tag{"F", &Account{address: common.Address{8, 0x12, 0x70}}},
+		}}}}},
+	}}})
+	return ref, []string{"R", "A", "S", "V1", "V2", "B", "E", "C", "D", "F"}
+}
+
+func TestReleaseSubTrie_AllNodesAreReleasedExactlyOnce(t *testing.T) {
+	for _, batchSize := range []int{0, 1, 2, 3, 1024} {
+		t.Run(fmt.Sprintf("batchSize=%d", batchSize), func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ctxt := newNodeContext(t, ctrl)
+			ref, labels := buildReleaseTestTrie(ctxt)
+
+			limit := batchSize
+			if limit < 1 {
+				limit = 1
+			}
+			released := map[NodeId]int{}
+			ctxt.EXPECT().releaseBatch(gomock.Any()).MinTimes(1).DoAndReturn(func(refs []NodeReference) error {
+				if len(refs) == 0 || len(refs) > limit {
+					t.Errorf("invalid batch size %d", len(refs))
+				}
+				for _, ref := range refs {
+					released[ref.Id()]++
+				}
+				return nil
+			})
+
+			if _, err := releaseSubTrie(ctxt, &ref, batchSize); err != nil {
+				t.Fatalf("failed to release sub-trie: %v", err)
+			}
+
+			if want, got := len(labels), len(released); want != got {
+				t.Errorf("unexpected number of released nodes, wanted %d, got %d", want, got)
+			}
+			for _, label := range labels {
+				ref, _ := ctxt.Get(label)
+				if got := released[ref.Id()]; got != 1 {
+					t.Errorf("node %s should be released exactly once, got %d", label, got)
+				}
+			}
+		})
+	}
+}
+
+func TestReleaseSubTrie_FrozenNodesAreNotReleased(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ctxt := newNodeContext(t, ctrl)
+
+	ref, _ := ctxt.Build(&Branch{children: Children{
+		1: &Tag{"A", &Account{address: common.Address{1}}},
+		4: &Tag{"B", &Account{address: common.Address{4}, frozen: true}},
+	}})
+	accountA, _ := ctxt.Get("A")
+
+	ctxt.EXPECT().releaseBatch(gomock.Any()).DoAndReturn(func(refs []NodeReference) error {
+		if len(refs) != 2 || refs[0].Id() != accountA.Id() || refs[1].Id() != ref.Id() {
+			t.Errorf("unexpected released nodes: %v", refs)
+		}
+		return nil
+	})
+
+	if _, err := releaseSubTrie(ctxt, &ref, 1024); err != nil {
+		t.Fatalf("failed to release sub-trie: %v", err)
+	}
+}
+
+func TestReleaseSubTrie_ReleaseErrorsArePropagated(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ctxt := newNodeContext(t, ctrl)
+	ref, _ := buildReleaseTestTrie(ctxt)
+
+	injectedErr := errors.New("injected error")
+	ctxt.EXPECT().releaseBatch(gomock.Any()).Return(injectedErr)
+
+	if _, err := releaseSubTrie(ctxt, &ref, 2); !errors.Is(err, injectedErr) {
+		t.Errorf("unexpected error, wanted %v, got %v", injectedErr, err)
+	}
+}
+
+func TestReleaseSubTrie_CollectedNodesAreReleasedOnError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ctxt := newNodeContext(t, ctrl)
+
+	injectedErr := errors.New("injected error")
+	failing := NewMockNode(ctrl)
+	failing.EXPECT().Release(gomock.Any(), gomock.Any(), gomock.Any()).Return(injectedErr)
+
+	ref, _ := ctxt.Build(&Branch{children: Children{
+		1: &Tag{"A", &Account{address: common.Address{1}}},
+		4: &Mock{failing},
+	}})
+	accountA, _ := ctxt.Get("A")
+
+	ctxt.EXPECT().releaseBatch(gomock.Any()).DoAndReturn(func(refs []NodeReference) error {
+		if len(refs) != 1 || refs[0].Id() != accountA.Id() {
+			t.Errorf("unexpected released nodes: %v", refs)
+		}
+		return nil
+	})
+
+	if _, err := releaseSubTrie(ctxt, &ref, 1024); !errors.Is(err, injectedErr) {
+		t.Errorf("unexpected error, wanted %v, got %v", injectedErr, err)
+	}
+}
+
+func TestForest_releaseBatch_NodesAreDeletedInSortedOrder(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	branches := stock.NewMockStock[uint64, BranchNode](ctrl)
+	extensions := stock.NewMockStock[uint64, ExtensionNode](ctrl)
+	accounts := stock.NewMockStock[uint64, AccountNode](ctrl)
+	values := stock.NewMockStock[uint64, ValueNode](ctrl)
+
+	forest, err := makeForest(S5LiveConfig, t.TempDir(), branches, extensions, accounts, values, ForestConfig{})
+	if err != nil {
+		t.Fatalf("failed to create test forest: %v", err)
+	}
+	closeMockedOnCleanup(t, forest, branches, extensions, accounts, values)
+
+	gomock.InOrder(
+		values.EXPECT().Delete(uint64(1)),
+		values.EXPECT().Delete(uint64(2)),
+		values.EXPECT().Delete(uint64(3)),
+	)
+	accounts.EXPECT().Delete(uint64(7))
+	branches.EXPECT().Delete(uint64(4))
+	extensions.EXPECT().Delete(uint64(5))
+
+	refs := []NodeReference{
+		NewNodeReference(ValueId(3)),
+		NewNodeReference(AccountId(7)),
+		NewNodeReference(ValueId(1)),
+		NewNodeReference(BranchId(4)),
+		NewNodeReference(ExtensionId(5)),
+		NewNodeReference(ValueId(2)),
+	}
+	if err := forest.releaseBatch(refs); err != nil {
+		t.Errorf("failed to release batch: %v", err)
+	}
+}
+
+func TestForest_releaseBatch_EmptyIdCannotBeReleased(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	branches := stock.NewMockStock[uint64, BranchNode](ctrl)
+	extensions := stock.NewMockStock[uint64, ExtensionNode](ctrl)
+	accounts := stock.NewMockStock[uint64, AccountNode](ctrl)
+	values := stock.NewMockStock[uint64, ValueNode](ctrl)
+
+	forest, err := makeForest(S5LiveConfig, t.TempDir(), branches, extensions, accounts, values, ForestConfig{})
+	if err != nil {
+		t.Fatalf("failed to create test forest: %v", err)
+	}
+	closeMockedOnCleanup(t, forest, branches, extensions, accounts, values)
+
+	refs := []NodeReference{NewNodeReference(ValueId(1)), NewNodeReference(EmptyId())}
+	if err := forest.releaseBatch(refs); err == nil {
+		t.Errorf("releasing the empty node should fail")
+	}
+}
+
+func TestForest_releaseBatch_StockErrorsArePropagated(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	branches := stock.NewMockStock[uint64, BranchNode](ctrl)
+	extensions := stock.NewMockStock[uint64, ExtensionNode](ctrl)
+	accounts := stock.NewMockStock[uint64, AccountNode](ctrl)
+	values := stock.NewMockStock[uint64, ValueNode](ctrl)
+
+	forest, err := makeForest(S5LiveConfig, t.TempDir(), branches, extensions, accounts, values, ForestConfig{})
+	if err != nil {
+		t.Fatalf("failed to create test forest: %v", err)
+	}
+	closeMockedOnCleanup(t, forest, branches, extensions, accounts, values)
+
+	injectedErr := errors.New("injected error")
+	accounts.EXPECT().Delete(uint64(1)).Return(injectedErr)
+	values.EXPECT().Delete(uint64(1))
+
+	refs := []NodeReference{NewNodeReference(AccountId(1)), NewNodeReference(ValueId(1))}
+	if err := forest.releaseBatch(refs); !errors.Is(err, injectedErr) {
+		t.Errorf("unexpected error, wanted %v, got %v", injectedErr, err)
+	}
+}
+
+func BenchmarkForest_ReleaseLargeTrie(b *testing.B) {
+	// About 1M nodes, most of them values and branches of a storage trie.
+	const numSlots = 940_000
+	for _, batchSize := range []int{1, 1024} {
+		b.Run(fmt.Sprintf("batchSize=%d", batchSize), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				forest, err := OpenInMemoryForest(b.TempDir(), S5LiveConfig, ForestConfig{
+					Mode:             Mutable,
+					CacheCapacity:    1 << 21,
+					ReleaseBatchSize: batchSize,
+				})
+				if err != nil {
+					b.Fatalf("failed to open forest: %v", err)
+				}
+				addr := common.Address{1}
+				root := NewNodeReference(EmptyId())
+				root, err = forest.SetAccountInfo(&root, addr, AccountInfo{Nonce: common.ToNonce(1)})
+				if err != nil {
+					b.Fatalf("failed to create account: %v", err)
+				}
+				for j := 0; j < numSlots; j++ {
+					key := common.Key{byte(j), byte(j >> 8), byte(j >> 16)}
+					root, err = forest.SetValue(&root, addr, key, common.Value{1})
+					if err != nil {
+						b.Fatalf("failed to set value: %v", err)
+					}
+				}
+				b.StartTimer()
+
+				if err := forest.releaseTrie(root); err != nil {
+					b.Fatalf("failed to release trie: %v", err)
+				}
+
+				b.StopTimer()
+				if err := forest.Close(); err != nil {
+					b.Fatalf("failed to close forest: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestForest_ReleaseWorkers_AllNodesOfDeletedStoragesAreFreed(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			forest, err := OpenInMemoryForest(t.TempDir(), S5LiveConfig, ForestConfig{
+				Mode:             Mutable,
+				CacheCapacity:    1 << 12,
+				ReleaseBatchSize: 16,
+				ReleaseWorkers:   workers,
+				ReleaseQueueSize: 2,
+			})
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+			defer forest.Close()
+
+			const numAccounts = 32
+			root := NewNodeReference(EmptyId())
+			for i := 0; i < numAccounts; i++ {
+				addr := common.Address{byte(i)}
+				root, err = forest.SetAccountInfo(&root, addr, AccountInfo{Nonce: common.ToNonce(1)})
+				if err != nil {
+					t.Fatalf("failed to create account: %v", err)
+				}
+				for j := 0; j < 100; j++ {
+					root, err = forest.SetValue(&root, addr, common.Key{byte(j)}, common.Value{1})
+					if err != nil {
+						t.Fatalf("failed to set value: %v", err)
+					}
+				}
+			}
+
+			// Deleting the accounts releases their storage in the background.
+			for i := 0; i < numAccounts; i++ {
+				root, err = forest.SetAccountInfo(&root, common.Address{byte(i)}, AccountInfo{})
+				if err != nil {
+					t.Fatalf("failed to delete account: %v", err)
+				}
+			}
+			if err := forest.Flush(); err != nil {
+				t.Fatalf("failed to flush forest: %v", err)
+			}
+
+			for name, stock := range map[string]interface {
+				GetIds() (stock.IndexSet[uint64], error)
+			}{"values": forest.values, "branches": forest.branches} {
+				ids, err := stock.GetIds()
+				if err != nil {
+					t.Fatalf("failed to get ids: %v", err)
+				}
+				for i := ids.GetLowerBound(); i < ids.GetUpperBound(); i++ {
+					if ids.Contains(i) {
+						t.Errorf("%s node %d should have been released", name, i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestForest_ReleaseQueue_SoftLimitsBoundPendingTries(t *testing.T) {
+	const limit = 2
+	tests := map[string]ForestConfig{
+		"tries": {ReleaseSoftLimit: limit},
+		"nodes": {ReleaseNodeSoftLimit: limit},
+	}
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			config.Mode = Mutable
+			config.CacheCapacity = 1 << 16
+			config.ReleaseBatchSize = 16
+			forest, err := OpenInMemoryForest(t.TempDir(), S5LiveConfig, config)
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+			defer forest.Close()
+
+			const numAccounts = 2000
+			const numSlots = 8
+			root := NewNodeReference(EmptyId())
+			for i := 0; i < numAccounts; i++ {
+				addr := common.Address{byte(i), byte(i >> 8)}
+				root, err = forest.SetAccountInfo(&root, addr, AccountInfo{Nonce: common.ToNonce(1)})
+				if err != nil {
+					t.Fatalf("failed to create account: %v", err)
+				}
+				for j := 0; j < numSlots; j++ {
+					root, err = forest.SetValue(&root, addr, common.Key{byte(j)}, common.Value{1})
+					if err != nil {
+						t.Fatalf("failed to set value: %v", err)
+					}
+				}
+			}
+
+			// Blocking the release of the first deleted storage keeps the
+			// background worker busy, forcing subsequent releases to be
+			// processed synchronously once the soft limit is reached.
+			blocker, err := getStorageRoot(forest, &root, common.Address{})
+			if err != nil {
+				t.Fatalf("failed to get storage root: %v", err)
+			}
+			handle, err := forest.getReadAccess(&blocker)
+			if err != nil {
+				t.Fatalf("failed to get access to storage root: %v", err)
+			}
+
+			for i := 0; i < numAccounts; i++ {
+				root, err = forest.SetAccountInfo(&root, common.Address{byte(i), byte(i >> 8)}, AccountInfo{})
+				if err != nil {
+					t.Fatalf("failed to delete account: %v", err)
+				}
+				if stats := forest.GetReleaseQueueStats(); stats.PendingTries > limit {
+					t.Fatalf("too many pending tries, limit %d, got %d", limit, stats.PendingTries)
+				}
+			}
+			handle.Release()
+
+			if err := forest.Flush(); err != nil {
+				t.Fatalf("failed to flush forest: %v", err)
+			}
+			stats := forest.GetReleaseQueueStats()
+			if stats.PendingTries != 0 {
+				t.Errorf("all tries should be released, pending %d", stats.PendingTries)
+			}
+			if stats.ReleasedTries != numAccounts {
+				t.Errorf("unexpected number of released tries, wanted %d, got %d", numAccounts, stats.ReleasedTries)
+			}
+			if stats.SynchronousReleases < numAccounts-limit {
+				t.Errorf("expected at least %d synchronous releases, got %d", numAccounts-limit, stats.SynchronousReleases)
+			}
+
+			for name, stock := range map[string]interface {
+				GetIds() (stock.IndexSet[uint64], error)
+			}{"values": forest.values, "branches": forest.branches} {
+				ids, err := stock.GetIds()
+				if err != nil {
+					t.Fatalf("failed to get ids: %v", err)
+				}
+				for i := ids.GetLowerBound(); i < ids.GetUpperBound(); i++ {
+					if ids.Contains(i) {
+						t.Fatalf("%s node %d should have been released", name, i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestForest_ReleaseQueue_StatsEstimatePendingNodesBySizeOfReleasedTries(t *testing.T) {
+	forest, err := OpenInMemoryForest(t.TempDir(), S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	defer forest.Close()
+
+	if want, got := (ReleaseQueueStats{}), forest.GetReleaseQueueStats(); want != got {
+		t.Errorf("unexpected stats of fresh forest, wanted %v, got %v", want, got)
+	}
+
+	forest.releasePending.Store(3)
+	if got := forest.GetReleaseQueueStats().EstimatedPendingNodes; got != 3 {
+		t.Errorf("tries should be assumed to be single nodes before any release, wanted 3, got %d", got)
+	}
+	forest.releasedTries.Store(2)
+	forest.releasedNodes.Store(20)
+	if got := forest.GetReleaseQueueStats().EstimatedPendingNodes; got != 30 {
+		t.Errorf("unexpected estimate, wanted 30, got %d", got)
+	}
+	forest.releasePending.Store(0)
+}
+
+func TestForest_ReleaseQueue_CloseSkipsPendingTriesAfterDrainTimeout(t *testing.T) {
+	forest, err := OpenInMemoryForest(t.TempDir(), S5LiveConfig, ForestConfig{
+		Mode:                Mutable,
+		CacheCapacity:       1024,
+		ReleaseDrainTimeout: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+
+	const numAccounts = 5
+	root := NewNodeReference(EmptyId())
+	for i := 0; i < numAccounts; i++ {
+		addr := common.Address{byte(i)}
+		root, err = forest.SetAccountInfo(&root, addr, AccountInfo{Nonce: common.ToNonce(1)})
+		if err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+		root, err = forest.SetValue(&root, addr, common.Key{1}, common.Value{1})
+		if err != nil {
+			t.Fatalf("failed to set value: %v", err)
+		}
+	}
+
+	// The release of the first storage is blocked until the drain times out.
+	blocker, err := getStorageRoot(forest, &root, common.Address{})
+	if err != nil {
+		t.Fatalf("failed to get storage root: %v", err)
+	}
+	handle, err := forest.getReadAccess(&blocker)
+	if err != nil {
+		t.Fatalf("failed to get access to storage root: %v", err)
+	}
+	go func() {
+		<-forest.releaseAbort
+		handle.Release()
+	}()
+
+	for i := 0; i < numAccounts; i++ {
+		root, err = forest.SetAccountInfo(&root, common.Address{byte(i)}, AccountInfo{})
+		if err != nil {
+			t.Fatalf("failed to delete account: %v", err)
+		}
+	}
+	if _, _, err := forest.updateHashesFor(&root); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+
+	if err := forest.Close(); err != nil {
+		t.Fatalf("failed to close forest: %v", err)
+	}
+	stats := forest.GetReleaseQueueStats()
+	if stats.PendingTries != 0 {
+		t.Errorf("no tries should be pending after close, got %d", stats.PendingTries)
+	}
+	// The blocked trie is only released if the worker picked it up before the
+	// drain timed out, which depends on the scheduling of the worker.
+	if stats.ReleasedTries > 1 {
+		t.Errorf("at most the blocked trie should have been released, got %d", stats.ReleasedTries)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"math/big"
+	"os"
 	"strings"
 	"testing"
 
@@ -31,6 +32,7 @@ func TestS5RootHash_EmptyTrie(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to open empty state: %v", err)
 	}
+	defer state.Close()
 	hash, err := state.GetHash()
 	if err != nil {
 		t.Fatalf("failed to get hash for empty state: %v", err)
@@ -47,6 +49,7 @@ func TestS5RootHash_SingleAccount(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to open empty state: %v", err)
 	}
+	defer state.Close()
 	balance, _ := common.ToBalance(big.NewInt(12))
 	state.SetNonce(common.Address{1}, common.ToNonce(10))
 	state.SetBalance(common.Address{1}, balance)
@@ -67,6 +70,7 @@ func TestS5RootHash_SingleAccountWithSingleValue(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to open empty state: %v", err)
 	}
+	defer state.Close()
 	balance, _ := common.ToBalance(big.NewInt(12))
 	state.SetNonce(common.Address{1}, common.ToNonce(10))
 	state.SetBalance(common.Address{1}, balance)
@@ -88,6 +92,7 @@ func TestS5RootHash_TwoAccounts(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to open empty state: %v", err)
 	}
+	defer state.Close()
 	balance, _ := common.ToBalance(big.NewInt(12))
 	state.SetNonce(common.Address{1}, common.ToNonce(10))
 	state.SetBalance(common.Address{2}, balance)
@@ -108,6 +113,7 @@ func TestS5RootHash_TwoAccountsWithValues(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to open empty state: %v", err)
 	}
+	defer state.Close()
 	balance, _ := common.ToBalance(big.NewInt(12))
 	state.SetNonce(common.Address{1}, common.ToNonce(10))
 	state.trie.SetValue(common.Address{1}, common.Key{1}, common.Value{0, 0, 1})
@@ -140,6 +146,7 @@ func TestS5RootHash_TwoAccountsWithExtensionNodeWithEvenLength(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to open empty state: %v", err)
 	}
+	defer state.Close()
 	balance, _ := common.ToBalance(big.NewInt(12))
 	state.SetNonce(addr1, common.ToNonce(10))
 	state.SetBalance(addr2, balance)
@@ -167,6 +174,7 @@ func TestS5RootHash_TwoAccountsWithExtensionNodeWithOddLength(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to open empty state: %v", err)
 	}
+	defer state.Close()
 	balance, _ := common.ToBalance(big.NewInt(12))
 	state.SetNonce(addr1, common.ToNonce(10))
 	state.SetBalance(addr2, balance)
@@ -410,3 +418,76 @@ func hexToKey(s string) common.Key {
 	hex.Decode(key[:], []byte(s))
 	return key
 }
+
+func TestState_GetStateRootEthereum_MatchesGethRootForAllConfigs(t *testing.T) {
+	t.Parallel()
+	for _, config := range allMptConfigs {
+		config := config
+		t.Run(config.Name, func(t *testing.T) {
+			t.Parallel()
+			state, err := OpenGoMemoryState(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open empty state: %v", err)
+			}
+			defer state.Close()
+
+			// The empty state has the hash of the empty trie.
+			hash, err := state.GetStateRootEthereum()
+			if err != nil {
+				t.Fatalf("failed to get Ethereum root: %v", err)
+			}
+			want := "56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421"
+			if got := fmt.Sprintf("%x", hash); want != got {
+				t.Errorf("invalid hash of empty state\nexpected %v\n     got %v", want, got)
+			}
+
+			// The same state as in TestS5RootHash_TwoAccountsWithValues.
+			balance, _ := common.ToBalance(big.NewInt(12))
+			state.SetNonce(common.Address{1}, common.ToNonce(10))
+			state.trie.SetValue(common.Address{1}, common.Key{1}, common.Value{0, 0, 1})
+			state.trie.SetValue(common.Address{1}, common.Key{2}, common.Value{2})
+
+			state.SetBalance(common.Address{2}, balance)
+			state.trie.SetValue(common.Address{2}, common.Key{1}, common.Value{0, 0, 1})
+			state.trie.SetValue(common.Address{2}, common.Key{2}, common.Value{2})
+
+			hash, err = state.GetStateRootEthereum()
+			if err != nil {
+				t.Fatalf("failed to get Ethereum root: %v", err)
+			}
+			want = "78a69b87179abb4bd16a4a4a565330ef531d8c3bb7258565d0cea2393e2c8adb"
+			if got := fmt.Sprintf("%x", hash); want != got {
+				t.Errorf("invalid hash\nexpected %v\n     got %v", want, got)
+			}
+
+			// The conversion does not modify the state.
+			if err := state.trie.Check(); err != nil {
+				t.Errorf("inconsistent state after computing Ethereum root: %v", err)
+			}
+			if nonce, err := state.GetNonce(common.Address{1}); err != nil || nonce != common.ToNonce(10) {
+				t.Errorf("unexpected nonce after computing Ethereum root: %v, err %v", nonce, err)
+			}
+		})
+	}
+}
+
+func TestState_GetStateRootEthereum_TemporaryTrieIsRemoved(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	state, err := OpenGoMemoryState(t.TempDir(), S4LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open empty state: %v", err)
+	}
+	defer state.Close()
+	state.SetNonce(common.Address{1}, common.ToNonce(10))
+	if _, err := state.GetStateRootEthereum(); err != nil {
+		t.Fatalf("failed to get Ethereum root: %v", err)
+	}
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatalf("failed to list directory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("temporary trie was not removed: %v", entries)
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"unsafe"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// rootIndexFile is the file the reverse index of the roots of an archive is
+// stored in, next to the roots.dat file it is derived from.
+const rootIndexFile = "roots.idx"
+
+// rootIndexEntrySize is the size of the entries of the index file, each
+// consisting of the hash of a run and the number of its first block.
+const rootIndexEntrySize = len(common.Hash{}) + 8
+
+// rootIndex is a reverse index of the roots of an archive, mapping root
+// hashes to the blocks of which they are the state. Since consecutive blocks
+// not modifying the state share a hash, blocks are grouped in runs of
+// consecutive blocks with the same hash. Thus, the index grows with the number
+// of blocks modifying the state rather than the number of blocks.
+//
+// The index is persisted in an append-only file listing the hash and first
+// block of each run. The length of the last run is derived from the number of
+// roots of the archive. Since the index is derived from the roots, an index
+// file not consistent with the roots, e.g. due to a crash between writing
+// the roots and the index, is rebuilt when being loaded.
+type rootIndex struct {
+	runs          []rootRun             // the runs of blocks sharing a hash, ordered by block
+	byHash        map[common.Hash][]int // the positions of the runs of each hash in runs
+	numBlocks     uint64                // the number of indexed blocks
+	filename      string                // the file storing the index
+	numRunsInFile int                   // the number of runs already written to the file
+}
+
+// rootRun is a sequence of consecutive blocks sharing the same root hash.
+type rootRun struct {
+	hash  common.Hash
+	first uint64 // the first block of the run
+}
+
+// append adds the next block with the given hash to the index.
+func (i *rootIndex) append(hash common.Hash) {
+	block := i.numBlocks
+	i.numBlocks++
+	if len(i.runs) > 0 && i.runs[len(i.runs)-1].hash == hash {
+		return
+	}
+	if i.byHash == nil {
+		i.byHash = map[common.Hash][]int{}
+	}
+	i.byHash[hash] = append(i.byHash[hash], len(i.runs))
+	i.runs = append(i.runs, rootRun{hash: hash, first: block})
+}
+
+// getBlocks returns the blocks with the given hash in ascending order.
+func (i *rootIndex) getBlocks(hash common.Hash) []uint64 {
+	var res []uint64
+	for _, pos := range i.byHash[hash] {
+		end := i.numBlocks
+		if pos+1 < len(i.runs) {
+			end = i.runs[pos+1].first
+		}
+		for block := i.runs[pos].first; block < end; block++ {
+			res = append(res, block)
+		}
+	}
+	return res
+}
+
+// isConsistentWith checks whether the index covers exactly the given roots.
+func (i *rootIndex) isConsistentWith(roots []Root) bool {
+	if i.numBlocks != uint64(len(roots)) {
+		return false
+	}
+	for pos, run := range i.runs {
+		end := i.numBlocks
+		if pos+1 < len(i.runs) {
+			end = i.runs[pos+1].first
+		}
+		if run.first >= end || (pos == 0 && run.first != 0) {
+			return false
+		}
+		if pos > 0 && i.runs[pos-1].hash == run.hash {
+			return false
+		}
+		for block := run.first; block < end; block++ {
+			if roots[block].Hash != run.hash {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (i *rootIndex) GetMemoryFootprint() *common.MemoryFootprint {
+	size := uintptr(len(i.runs)) * (unsafe.Sizeof(rootRun{}) + unsafe.Sizeof(common.Hash{}) + unsafe.Sizeof(int(0)))
+	return common.NewMemoryFootprint(size)
+}
+
+// buildRootIndex creates an index of the given roots.
+func buildRootIndex(filename string, roots []Root) *rootIndex {
+	res := &rootIndex{filename: filename}
+	for _, root := range roots {
+		res.append(root.Hash)
+	}
+	return res
+}
+
+// loadRootIndex loads the index of the given roots from the given file. If
+// the file is missing or not consistent with the roots, the index is rebuilt
+// and the file is replaced.
+func loadRootIndex(filename string, roots []Root) (*rootIndex, error) {
+	index, err := readRootIndex(filename, uint64(len(roots)))
+	if err != nil {
+		return nil, err
+	}
+	if index != nil && index.isConsistentWith(roots) {
+		return index, nil
+	}
+	if index != nil {
+		log.Printf("root index in %s is not consistent with the roots of the archive, rebuilding it", filename)
+	}
+	index = buildRootIndex(filename, roots)
+	if err := index.rewrite(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// readRootIndex reads the index stored in the given file, covering the given
+// number of blocks. If the file is missing or its size is invalid, nil is
+// returned and the index needs to be rebuilt.
+func readRootIndex(filename string, numBlocks uint64) (*rootIndex, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%rootIndexEntrySize != 0 {
+		return nil, nil
+	}
+	numRuns := len(data) / rootIndexEntrySize
+	res := &rootIndex{
+		runs:          make([]rootRun, numRuns),
+		byHash:        make(map[common.Hash][]int, numRuns),
+		numBlocks:     numBlocks,
+		filename:      filename,
+		numRunsInFile: numRuns,
+	}
+	for pos := range res.runs {
+		entry := data[pos*rootIndexEntrySize:]
+		run := &res.runs[pos]
+		copy(run.hash[:], entry)
+		run.first = binary.BigEndian.Uint64(entry[len(run.hash):])
+		res.byHash[run.hash] = append(res.byHash[run.hash], pos)
+	}
+	return res, nil
+}
+
+// store appends the runs not yet written to the index file.
+func (i *rootIndex) store() error {
+	if i.numRunsInFile == len(i.runs) {
+		return nil
+	}
+	f, err := os.OpenFile(i.filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(f)
+	res := errors.Join(
+		storeRootRunsTo(writer, i.runs[i.numRunsInFile:]),
+		writer.Flush(),
+		f.Close(),
+	)
+	if res == nil {
+		i.numRunsInFile = len(i.runs)
+	}
+	return res
+}
+
+// rewrite replaces the index file by the full index. The file is replaced
+// atomically, such that an interrupted rewrite does not corrupt it.
+func (i *rootIndex) rewrite() error {
+	tmp := i.filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(f)
+	if err := errors.Join(
+		storeRootRunsTo(writer, i.runs),
+		writer.Flush(),
+		f.Close(),
+	); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, i.filename); err != nil {
+		return err
+	}
+	i.numRunsInFile = len(i.runs)
+	return nil
+}
+
+func storeRootRunsTo(writer io.Writer, runs []rootRun) error {
+	// Simple file format: [<state-hash><first-block>]*
+	var buffer [rootIndexEntrySize]byte
+	for _, run := range runs {
+		copy(buffer[:], run.hash[:])
+		binary.BigEndian.PutUint64(buffer[len(run.hash):], run.first)
+		if _, err := writer.Write(buffer[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RebuildRootIndex rebuilds the index of root hashes of the archive stored
+// in the given directory, which is used for looking up blocks by their root
+// hash. Archives maintain the index while adding blocks and rebuild it when
+// being opened if it is missing, so this is only needed for creating the
+// index of existing archives ahead of time. The number of indexed blocks and
+// the number of runs of blocks sharing a hash are returned.
+func RebuildRootIndex(directory string, config MptConfig) (blocks, runs int, err error) {
+	lock, err := LockDirectory(directory)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		err = errors.Join(err, lock.Release())
+	}()
+	if _, err := os.Stat(directory + "/roots.dat"); err != nil {
+		return 0, 0, fmt.Errorf("directory %s does not contain an archive: %w", directory, err)
+	}
+	roots, err := loadRoots(directory+"/roots.dat", getNodeIdEncoder(config))
+	if err != nil {
+		return 0, 0, err
+	}
+	index := buildRootIndex(directory+"/"+rootIndexFile, roots.roots)
+	if err := index.rewrite(); err != nil {
+		return 0, 0, err
+	}
+	return len(roots.roots), len(index.runs), nil
+}
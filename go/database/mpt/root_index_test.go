@@ -0,0 +1,183 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestRootIndex_BlocksSharingHashesAreGroupedInRuns(t *testing.T) {
+	index := &rootIndex{}
+	for _, hash := range []common.Hash{{1}, {1}, {2}, {1}, {1}, {1}, {3}} {
+		index.append(hash)
+	}
+	if want, got := 4, len(index.runs); want != got {
+		t.Errorf("unexpected number of runs, wanted %d, got %d", want, got)
+	}
+	tests := map[common.Hash][]uint64{
+		{1}: {0, 1, 3, 4, 5},
+		{2}: {2},
+		{3}: {6},
+		{4}: nil,
+	}
+	for hash, want := range tests {
+		if got := index.getBlocks(hash); !slices.Equal(want, got) {
+			t.Errorf("unexpected blocks of hash %x, wanted %v, got %v", hash, want, got)
+		}
+	}
+}
+
+func TestRootIndex_InconsistentIndexFilesAreRebuilt(t *testing.T) {
+	roots := []Root{{Hash: common.Hash{1}}, {Hash: common.Hash{1}}, {Hash: common.Hash{2}}}
+	valid := buildRootIndex("", roots)
+
+	tests := map[string]func(filename string) error{
+		"missing": func(filename string) error {
+			return os.Remove(filename)
+		},
+		"truncated": func(filename string) error {
+			return os.Truncate(filename, int64(rootIndexEntrySize+3))
+		},
+		"lagging behind roots": func(filename string) error {
+			return os.Truncate(filename, int64(rootIndexEntrySize))
+		},
+		"ahead of roots": func(filename string) error {
+			index := buildRootIndex(filename, append(slices.Clone(roots), Root{Hash: common.Hash{3}}))
+			return index.rewrite()
+		},
+		"wrong hash": func(filename string) error {
+			index := buildRootIndex(filename, []Root{{Hash: common.Hash{1}}, {Hash: common.Hash{1}}, {Hash: common.Hash{3}}})
+			return index.rewrite()
+		},
+	}
+
+	for name, corrupt := range tests {
+		t.Run(name, func(t *testing.T) {
+			filename := t.TempDir() + "/" + rootIndexFile
+			index := buildRootIndex(filename, roots)
+			if err := index.rewrite(); err != nil {
+				t.Fatalf("failed to write index: %v", err)
+			}
+			if err := corrupt(filename); err != nil {
+				t.Fatalf("failed to corrupt index: %v", err)
+			}
+			index, err := loadRootIndex(filename, roots)
+			if err != nil {
+				t.Fatalf("failed to load index: %v", err)
+			}
+			if !slices.Equal(valid.runs, index.runs) || index.numBlocks != valid.numBlocks {
+				t.Errorf("index should be rebuilt, wanted %v, got %v", valid.runs, index.runs)
+			}
+
+			// The rebuilt index is persisted.
+			restored, err := readRootIndex(filename, uint64(len(roots)))
+			if err != nil || restored == nil || !restored.isConsistentWith(roots) {
+				t.Errorf("rebuilt index should be persisted, got %v, %v", restored, err)
+			}
+		})
+	}
+}
+
+func TestArchiveTrie_BlocksCanBeLookedUpByRootHash(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := OpenArchiveTrie(dir, S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	addr := common.Address{1}
+	updates := map[uint64]common.Update{
+		0: {CreatedAccounts: []common.Address{addr}, Nonces: []common.NonceUpdate{{Account: addr, Nonce: common.ToNonce(1)}}},
+		1: {}, // shares the root of block 0
+		2: {Nonces: []common.NonceUpdate{{Account: addr, Nonce: common.ToNonce(2)}}},
+		5: {Nonces: []common.NonceUpdate{{Account: addr, Nonce: common.ToNonce(1)}}}, // skips blocks 3 and 4, reverts to the state of block 0
+	}
+	for _, block := range []uint64{0, 1, 2, 5} {
+		if err := archive.Add(block, updates[block], nil); err != nil {
+			t.Fatalf("failed to add block %d: %v", block, err)
+		}
+	}
+
+	want := map[common.Hash][]uint64{}
+	for block := uint64(0); block <= 5; block++ {
+		hash, err := archive.GetHash(block)
+		if err != nil {
+			t.Fatalf("failed to get hash of block %d: %v", block, err)
+		}
+		want[hash] = append(want[hash], block)
+	}
+	if len(want) != 2 {
+		t.Fatalf("unexpected number of distinct root hashes, wanted 2, got %d", len(want))
+	}
+
+	check := func(t *testing.T, archive *ArchiveTrie) {
+		t.Helper()
+		for hash, blocks := range want {
+			got, err := archive.GetBlockByRoot(hash)
+			if err != nil {
+				t.Fatalf("failed to get blocks by root: %v", err)
+			}
+			if !slices.Equal(blocks, got) {
+				t.Errorf("unexpected blocks of root %x, wanted %v, got %v", hash, blocks, got)
+			}
+		}
+		if got, err := archive.GetBlockByRoot(common.Hash{1, 2, 3}); err != nil || len(got) != 0 {
+			t.Errorf("unexpected blocks of unknown root, got %v, %v", got, err)
+		}
+	}
+	check(t, archive)
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+
+	// The index is restored on reopening, and rebuilt if it is missing.
+	for _, remove := range []bool{false, true} {
+		if remove {
+			if err := os.Remove(dir + "/" + rootIndexFile); err != nil {
+				t.Fatalf("failed to remove index: %v", err)
+			}
+		}
+		archive, err = OpenArchiveTrie(dir, S5ArchiveConfig, 1024)
+		if err != nil {
+			t.Fatalf("failed to reopen archive: %v", err)
+		}
+		check(t, archive)
+		if err := archive.Close(); err != nil {
+			t.Fatalf("failed to close archive: %v", err)
+		}
+	}
+}
+
+func TestRebuildRootIndex_CreatesIndexOfExistingArchive(t *testing.T) {
+	dir := t.TempDir()
+	roots := []Root{{Hash: common.Hash{1}}, {Hash: common.Hash{1}}, {Hash: common.Hash{2}}}
+	if err := StoreRoots(dir+"/roots.dat", roots); err != nil {
+		t.Fatalf("failed to store roots: %v", err)
+	}
+	blocks, runs, err := RebuildRootIndex(dir, S5ArchiveConfig)
+	if err != nil {
+		t.Fatalf("failed to rebuild index: %v", err)
+	}
+	if blocks != 3 || runs != 2 {
+		t.Errorf("unexpected size of index, wanted 3 blocks in 2 runs, got %d blocks in %d runs", blocks, runs)
+	}
+	index, err := readRootIndex(dir+"/"+rootIndexFile, uint64(len(roots)))
+	if err != nil || index == nil || !index.isConsistentWith(roots) {
+		t.Errorf("index should be persisted, got %v, %v", index, err)
+	}
+
+	if _, _, err := RebuildRootIndex(t.TempDir(), S5ArchiveConfig); err == nil {
+		t.Errorf("rebuilding the index of a directory without an archive should fail")
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"sync"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// RootUpdate is the notification sent to subscribers of root updates
+// whenever the state root of a block has been committed.
+type RootUpdate struct {
+	Block uint64      // the block that got committed
+	Hash  common.Hash // the state root hash after the block
+}
+
+// rootNotifier distributes root updates to subscribers. Updates are delivered
+// through buffered channels without blocking the committing thread. If the
+// buffer of a subscriber is full, its oldest update is dropped in favor of
+// the new one. Thus, slow consumers observe gaps in the sequence of blocks,
+// but always receive the latest root. The zero value is ready to use.
+type rootNotifier struct {
+	mutex       sync.Mutex
+	subscribers map[chan RootUpdate]struct{}
+	closed      bool
+}
+
+// subscribe registers a new subscriber receiving updates through a channel
+// with the given buffer size, which is at least 1. The returned function
+// terminates the subscription by closing the channel; it may be called
+// multiple times. If the notifier is already closed, a closed channel is
+// returned.
+func (n *rootNotifier) subscribe(buffer int) (<-chan RootUpdate, func()) {
+	if buffer < 1 {
+		buffer = 1 // dropping the oldest update requires a buffer
+	}
+	channel := make(chan RootUpdate, buffer)
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.closed {
+		close(channel)
+		return channel, func() {}
+	}
+	if n.subscribers == nil {
+		n.subscribers = map[chan RootUpdate]struct{}{}
+	}
+	n.subscribers[channel] = struct{}{}
+	return channel, func() {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		if _, found := n.subscribers[channel]; found {
+			delete(n.subscribers, channel)
+			close(channel)
+		}
+	}
+}
+
+// notify sends the given update to all subscribers. It never blocks on
+// subscribers not consuming their updates.
+func (n *rootNotifier) notify(update RootUpdate) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for channel := range n.subscribers {
+		for sent := false; !sent; {
+			select {
+			case channel <- update:
+				sent = true
+			default:
+				// The buffer is full, the oldest update is dropped. Since
+				// consumers only remove elements, the next send succeeds.
+				select {
+				case <-channel:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// close terminates all subscriptions by closing their channels. Subsequent
+// subscriptions receive closed channels.
+func (n *rootNotifier) close() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for channel := range n.subscribers {
+		close(channel)
+	}
+	n.subscribers = nil
+	n.closed = true
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestRootNotifier_AllSubscribersReceiveUpdates(t *testing.T) {
+	notifier := rootNotifier{}
+	first, _ := notifier.subscribe(10)
+	second, _ := notifier.subscribe(10)
+	for i := uint64(0); i < 5; i++ {
+		notifier.notify(RootUpdate{Block: i, Hash: common.Hash{byte(i)}})
+	}
+	for _, channel := range []<-chan RootUpdate{first, second} {
+		for i := uint64(0); i < 5; i++ {
+			if want, got := (RootUpdate{Block: i, Hash: common.Hash{byte(i)}}), <-channel; want != got {
+				t.Errorf("unexpected update, wanted %v, got %v", want, got)
+			}
+		}
+	}
+}
+
+func TestRootNotifier_OldestUpdatesOfSlowConsumersAreDropped(t *testing.T) {
+	notifier := rootNotifier{}
+	channel, _ := notifier.subscribe(3)
+	for i := uint64(0); i < 10; i++ {
+		notifier.notify(RootUpdate{Block: i})
+	}
+	for _, want := range []uint64{7, 8, 9} {
+		if got := (<-channel).Block; want != got {
+			t.Errorf("unexpected block, wanted %d, got %d", want, got)
+		}
+	}
+	if len(channel) != 0 {
+		t.Errorf("unexpected pending updates: %d", len(channel))
+	}
+}
+
+func TestRootNotifier_NonPositiveBufferSizesAreRaisedToOne(t *testing.T) {
+	notifier := rootNotifier{}
+	channel, _ := notifier.subscribe(0)
+	notifier.notify(RootUpdate{Block: 1})
+	notifier.notify(RootUpdate{Block: 2})
+	if got := (<-channel).Block; got != 2 {
+		t.Errorf("unexpected block, wanted 2, got %d", got)
+	}
+}
+
+func TestRootNotifier_UnsubscribeClosesChannel(t *testing.T) {
+	notifier := rootNotifier{}
+	channel, unsubscribe := notifier.subscribe(1)
+	other, _ := notifier.subscribe(1)
+	unsubscribe()
+	unsubscribe() // a second call has no effect
+	notifier.notify(RootUpdate{Block: 1})
+	if _, open := <-channel; open {
+		t.Errorf("channel should be closed")
+	}
+	if got := (<-other).Block; got != 1 {
+		t.Errorf("remaining subscriber should receive updates, got block %d", got)
+	}
+}
+
+func TestRootNotifier_UnsubscribeDuringDelivery(t *testing.T) {
+	notifier := rootNotifier{}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := uint64(0); ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				notifier.notify(RootUpdate{Block: i})
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		channel, unsubscribe := notifier.subscribe(2)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range channel {
+			}
+		}()
+		unsubscribe()
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestRootNotifier_CloseTerminatesAllSubscriptions(t *testing.T) {
+	notifier := rootNotifier{}
+	first, _ := notifier.subscribe(1)
+	second, unsubscribe := notifier.subscribe(1)
+	notifier.close()
+	unsubscribe() // must not close the channel a second time
+	for _, channel := range []<-chan RootUpdate{first, second} {
+		if _, open := <-channel; open {
+			t.Errorf("channel should be closed")
+		}
+	}
+	late, _ := notifier.subscribe(1)
+	if _, open := <-late; open {
+		t.Errorf("subscriptions after close should be closed")
+	}
+}
+
+func TestMptState_SubscribeRootUpdates_ReportsCommittedRoots(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	first, _ := state.SubscribeRootUpdates(10)
+	second, _ := state.SubscribeRootUpdates(10)
+	for block := uint64(0); block < 5; block++ {
+		update := common.Update{}
+		update.AppendCreateAccount(common.Address{byte(block)})
+		update.AppendNonceUpdate(common.Address{byte(block)}, common.ToNonce(1))
+		if _, err := state.Apply(block, update); err != nil {
+			t.Fatalf("failed to apply block %d: %v", block, err)
+		}
+		hash, err := state.GetHash()
+		if err != nil {
+			t.Fatalf("failed to get hash: %v", err)
+		}
+		want := RootUpdate{Block: block, Hash: hash}
+		for _, channel := range []<-chan RootUpdate{first, second} {
+			if got := <-channel; want != got {
+				t.Errorf("unexpected update, wanted %v, got %v", want, got)
+			}
+		}
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+	for _, channel := range []<-chan RootUpdate{first, second} {
+		if _, open := <-channel; open {
+			t.Errorf("subscriptions should be terminated by close")
+		}
+	}
+}
+
+func TestArchiveTrie_SubscribeRootUpdates_ReportsAddedBlocks(t *testing.T) {
+	archive, err := OpenArchiveTrie(t.TempDir(), S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	first, _ := archive.SubscribeRootUpdates(10)
+	second, unsubscribe := archive.SubscribeRootUpdates(10)
+	for _, block := range []uint64{0, 1, 4} {
+		update := common.Update{}
+		update.AppendCreateAccount(common.Address{byte(block)})
+		update.AppendNonceUpdate(common.Address{byte(block)}, common.ToNonce(1))
+		if err := archive.Add(block, update, nil); err != nil {
+			t.Fatalf("failed to add block %d: %v", block, err)
+		}
+		hash, err := archive.GetHash(block)
+		if err != nil {
+			t.Fatalf("failed to get hash: %v", err)
+		}
+		want := RootUpdate{Block: block, Hash: hash}
+		if got := <-first; want != got {
+			t.Errorf("unexpected update, wanted %v, got %v", want, got)
+		}
+		if block < 4 {
+			if got := <-second; want != got {
+				t.Errorf("unexpected update, wanted %v, got %v", want, got)
+			}
+		}
+		if block == 1 {
+			unsubscribe()
+		}
+	}
+	if _, open := <-second; open {
+		t.Errorf("unsubscribed channel should not receive updates")
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+	if _, open := <-first; open {
+		t.Errorf("subscriptions should be terminated by close")
+	}
+}
+
+func TestMptState_SubscribeRootUpdates_NoGoroutinesAreLeaked(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		channel, unsubscribe := state.SubscribeRootUpdates(1)
+		if i%2 == 0 {
+			defer unsubscribe()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range channel {
+			}
+		}()
+	}
+	for block := uint64(0); block < 10; block++ {
+		update := common.Update{}
+		update.AppendCreateAccount(common.Address{byte(block)})
+		if _, err := state.Apply(block, update); err != nil {
+			t.Fatalf("failed to apply block %d: %v", block, err)
+		}
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+	wg.Wait()
+
+	// Background workers of the state terminate asynchronously.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutines leaked, before %d, after %d", before, after)
+	}
+}
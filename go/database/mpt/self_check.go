@@ -0,0 +1,211 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
+)
+
+// selfCheckDescendProbability is the probability of a sampling walk to
+// descend to a child of the current node instead of selecting the current
+// node. Since the number of nodes grows with the depth of tries, sampling
+// is thereby weighted toward the lower levels of tries.
+const selfCheckDescendProbability = 0.75
+
+const selfCheckUnsupportedErr = common.ConstError("self-checks are only supported by forests")
+
+// SelfCheckReport summarizes the result of a self-check re-computing the
+// hashes of a random sample of nodes and comparing them to the stored hashes.
+type SelfCheckReport struct {
+	Checked    int                 // the number of nodes with re-computed hashes
+	Skipped    int                 // the number of sampled nodes skipped since their stored hashes are dirty or not stored
+	Mismatches []SelfCheckMismatch // the nodes with stored hashes not matching their content
+}
+
+// SelfCheckMismatch describes a node whose stored hash does not match the
+// hash re-computed from its content, indicating a corruption of the node or
+// of the node storing the hash.
+type SelfCheckMismatch struct {
+	Id       NodeId
+	Stored   common.Hash
+	Computed common.Hash
+}
+
+// Failed returns true if any hash mismatch got detected.
+func (r *SelfCheckReport) Failed() bool {
+	return len(r.Mismatches) > 0
+}
+
+func (r *SelfCheckReport) String() string {
+	res := fmt.Sprintf("checked %d nodes, skipped %d nodes, found %d mismatches", r.Checked, r.Skipped, len(r.Mismatches))
+	for _, mismatch := range r.Mismatches {
+		res += fmt.Sprintf("\n\tnode %v: stored %x, computed %x", mismatch.Id, mismatch.Stored, mismatch.Computed)
+	}
+	return res
+}
+
+// SelfCheck is a light-weight integrity check intended to detect silent
+// corruptions of stored nodes at runtime without conducting a full
+// verification. It samples the given number of random nodes reachable from
+// the given root, re-computes their hashes from their content, and compares
+// the results to the hashes stored for the sampled nodes. The root itself
+// is never sampled.
+//
+// Nodes are selected by random walks descending to uniformly chosen child
+// nodes, independently of whether those are retained in the node cache.
+// Thus, nodes not in the cache are loaded from the disk. Sampled nodes with
+// dirty hashes are skipped. The check must not be run concurrently with
+// updates of the trie.
+func (s *Forest) SelfCheck(rootRef *NodeReference, sampleSize int) (SelfCheckReport, error) {
+	report := SelfCheckReport{}
+	for i := 0; i < sampleSize; i++ {
+		if err := s.selfCheckSample(rootRef, &report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// selfCheckChild is a node reachable from a parent node together with the
+// hash of the child stored in the parent.
+type selfCheckChild struct {
+	ref   NodeReference
+	hash  common.Hash
+	clean bool // < true if the hash stored in the parent is up-to-date and not embedded
+}
+
+// selfCheckSample samples and checks a single node reachable from the given
+// root, recording the result in the given report.
+func (s *Forest) selfCheckSample(rootRef *NodeReference, report *SelfCheckReport) error {
+	var sampled *selfCheckChild
+	current := *rootRef
+	for {
+		handle, err := s.getViewAccess(&current)
+		if err != nil {
+			return err
+		}
+		children := getSelfCheckChildren(handle.Get())
+		handle.Release()
+		if len(children) == 0 || (sampled != nil && rand.Float64() >= selfCheckDescendProbability) {
+			break
+		}
+		sampled = &children[rand.Intn(len(children))]
+		current = sampled.ref
+	}
+	if sampled == nil {
+		return nil // < the root has no children
+	}
+
+	var want, got common.Hash
+	var checkable bool
+	var err error
+	if s.config.HashStorageLocation == HashStoredWithNode {
+		want, got, checkable, err = s.rehashNodeWithStoredHash(sampled.ref)
+	} else if sampled.clean {
+		want, checkable = sampled.hash, true
+		got, err = s.hasher.getHash(&sampled.ref, s)
+	}
+	if err != nil {
+		return err
+	}
+	if !checkable {
+		report.Skipped++
+		return nil
+	}
+	report.Checked++
+	if got != want {
+		report.Mismatches = append(report.Mismatches, SelfCheckMismatch{
+			Id:       sampled.ref.Id(),
+			Stored:   want,
+			Computed: got,
+		})
+	}
+	return nil
+}
+
+// rehashNodeWithStoredHash re-computes the hash of the referenced node if
+// hashes are stored with nodes. Since the hashes of child nodes are then not
+// stored in the parent, they are obtained from the child nodes. Nodes with
+// dirty hashes, dirty child hashes, or embedded nodes, whose hashes are not
+// stored, are reported as not checkable.
+func (s *Forest) rehashNodeWithStoredHash(ref NodeReference) (stored, computed common.Hash, checkable bool, err error) {
+	handle, err := s.getViewAccess(&ref)
+	if err != nil {
+		return stored, computed, false, err
+	}
+	node := handle.Get()
+	stored, dirty := node.GetHash()
+	filled, children, fillIn, supported := copyNodeForRehashing(node)
+	handle.Release()
+	if dirty || !supported {
+		return stored, computed, false, nil
+	}
+
+	for i, child := range children {
+		handle, err := s.getViewAccess(&child)
+		if err != nil {
+			return stored, computed, false, err
+		}
+		hash, dirty := handle.Get().GetHash()
+		embedded, err := s.hasher.isEmbedded(handle.Get(), s)
+		handle.Release()
+		if err != nil || dirty {
+			return stored, computed, false, err
+		}
+		fillIn(i, hash, embedded)
+	}
+
+	source := nodeOverrideSource{s, ref.Id(), shared.MakeShared(filled)}
+	if embedded, err := s.hasher.isEmbedded(filled, source); err != nil || embedded {
+		return stored, computed, false, err
+	}
+	computed, err = s.hasher.getHash(&ref, source)
+	return stored, computed, err == nil, err
+}
+
+// getSelfCheckChildren lists the non-empty children of the given node with
+// the hashes stored for them in the given node.
+func getSelfCheckChildren(node Node) []selfCheckChild {
+	switch n := node.(type) {
+	case *BranchNode:
+		res := make([]selfCheckChild, 0, len(n.children))
+		for i, child := range n.children {
+			if !child.Id().IsEmpty() {
+				res = append(res, selfCheckChild{
+					ref:   child,
+					hash:  n.hashes[i],
+					clean: !n.isChildHashDirty(byte(i)) && !n.isEmbedded(byte(i)),
+				})
+			}
+		}
+		return res
+	case *ExtensionNode:
+		return []selfCheckChild{{
+			ref:   n.next,
+			hash:  n.nextHash,
+			clean: !n.nextHashDirty && !n.nextIsEmbedded,
+		}}
+	case *AccountNode:
+		if n.storage.Id().IsEmpty() {
+			return nil
+		}
+		return []selfCheckChild{{
+			ref:   n.storage,
+			hash:  n.storageHash,
+			clean: !n.storageHashDirty,
+		}}
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestSelfCheck_ConsistentStatePasses(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			state, err := OpenGoMemoryState(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer state.Close()
+			fillStateForSelfCheck(t, state)
+
+			report, err := state.SelfCheck(100)
+			if err != nil {
+				t.Fatalf("failed to run self-check: %v", err)
+			}
+			if report.Failed() || report.Checked == 0 || report.Checked+report.Skipped != 100 {
+				t.Errorf("unexpected report: %v", &report)
+			}
+		})
+	}
+}
+
+func TestSelfCheck_NodesWithDirtyHashesAreSkipped(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	if err := state.SetNonce(common.Address{1}, common.ToNonce(1)); err != nil {
+		t.Fatalf("failed to set nonce: %v", err)
+	}
+	if err := state.SetNonce(common.Address{2}, common.ToNonce(1)); err != nil {
+		t.Fatalf("failed to set nonce: %v", err)
+	}
+
+	report, err := state.SelfCheck(10)
+	if err != nil {
+		t.Fatalf("failed to run self-check: %v", err)
+	}
+	if report.Failed() || report.Checked != 0 || report.Skipped != 10 {
+		t.Errorf("unexpected report: %v", &report)
+	}
+}
+
+func TestSelfCheck_EmptyStatePasses(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+
+	report, err := state.SelfCheck(10)
+	if err != nil {
+		t.Fatalf("failed to run self-check: %v", err)
+	}
+	if report.Failed() || report.Checked != 0 || report.Skipped != 0 {
+		t.Errorf("unexpected report: %v", &report)
+	}
+}
+
+func TestSelfCheck_CorruptedHashesOnDiskAreDetected(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			state, err := OpenGoFileState(dir, config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			fillStateForSelfCheck(t, state)
+			corrupted := corruptHashOfChildOfRoot(t, state)
+			if err := state.Close(); err != nil {
+				t.Fatalf("failed to close state: %v", err)
+			}
+
+			// After re-opening the state, all nodes need to be loaded from disk.
+			state, err = OpenGoFileState(dir, config, 1024)
+			if err != nil {
+				t.Fatalf("failed to re-open state: %v", err)
+			}
+			defer state.Close()
+
+			report, err := state.SelfCheck(2000)
+			if err != nil {
+				t.Fatalf("failed to run self-check: %v", err)
+			}
+			if !report.Failed() {
+				t.Fatalf("corruption should be detected, got %v", &report)
+			}
+			for _, mismatch := range report.Mismatches {
+				if mismatch.Id != corrupted {
+					t.Errorf("unexpected mismatch of node %v, corrupted node is %v", mismatch.Id, corrupted)
+				}
+			}
+		})
+	}
+}
+
+func TestSelfCheck_ScheduledChecksAlertOnFailures(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	fillStateForSelfCheck(t, state)
+
+	alerts := []uint64{}
+	state.SetSelfCheckSchedule(2, 2000, func(block uint64, report SelfCheckReport, err error) {
+		if err != nil || !report.Failed() {
+			t.Errorf("unexpected alert for block %d, report %v, err %v", block, &report, err)
+		}
+		alerts = append(alerts, block)
+	})
+
+	if _, err := state.Apply(1, common.Update{}); err != nil {
+		t.Fatalf("failed to apply block: %v", err)
+	}
+	if _, err := state.Apply(2, common.Update{}); err != nil {
+		t.Fatalf("failed to apply block: %v", err)
+	}
+	if len(alerts) != 0 {
+		t.Fatalf("consistent state should not cause alerts, got %v", alerts)
+	}
+
+	corruptHashOfChildOfRoot(t, state)
+	for block := uint64(3); block <= 5; block++ {
+		if _, err := state.Apply(block, common.Update{}); err != nil {
+			t.Fatalf("failed to apply block: %v", err)
+		}
+	}
+	if want, got := []uint64{4}, alerts; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("unexpected alerts, wanted %v, got %v", want, got)
+	}
+
+	state.SetSelfCheckSchedule(0, 2000, nil)
+	if _, err := state.Apply(6, common.Update{}); err != nil {
+		t.Fatalf("failed to apply block: %v", err)
+	}
+	if len(alerts) != 1 {
+		t.Errorf("disabled checks should not cause alerts, got %v", alerts)
+	}
+}
+
+func TestSelfCheck_ArchivesSampleTriesOfAllBlocks(t *testing.T) {
+	for _, config := range []MptConfig{S4ArchiveConfig, S5ArchiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			archive, err := OpenArchiveTrie(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open archive: %v", err)
+			}
+			defer archive.Close()
+
+			report, err := archive.SelfCheck(10)
+			if err != nil || report.Checked != 0 {
+				t.Errorf("unexpected result for empty archive: %v, err %v", &report, err)
+			}
+
+			for block := uint64(0); block < 10; block++ {
+				update := common.Update{}
+				for i := 0; i < 4; i++ {
+					addr := common.Address{byte(block), byte(i)}
+					update.AppendCreateAccount(addr)
+					update.AppendNonceUpdate(addr, common.ToNonce(1))
+					update.AppendSlotUpdate(addr, common.Key{byte(i)}, common.Value{1})
+				}
+				if err := archive.Add(block, update, nil); err != nil {
+					t.Fatalf("failed to add block: %v", err)
+				}
+			}
+
+			report, err = archive.SelfCheck(100)
+			if err != nil {
+				t.Fatalf("failed to run self-check: %v", err)
+			}
+			if report.Failed() || report.Checked == 0 {
+				t.Errorf("unexpected report: %v", &report)
+			}
+		})
+	}
+}
+
+func TestSelfCheck_UnsupportedDatabasesAreReported(t *testing.T) {
+	trie := &LiveTrie{forest: nil}
+	if _, err := trie.SelfCheck(10); !errors.Is(err, selfCheckUnsupportedErr) {
+		t.Errorf("unexpected error, wanted %v, got %v", selfCheckUnsupportedErr, err)
+	}
+}
+
+func fillStateForSelfCheck(t *testing.T, state *MptState) {
+	t.Helper()
+	for i := 0; i < 64; i++ {
+		addr := common.Address{byte(i)}
+		if err := state.SetNonce(addr, common.ToNonce(1)); err != nil {
+			t.Fatalf("failed to set nonce: %v", err)
+		}
+		for j := 0; j < i%4; j++ {
+			if err := state.SetStorage(addr, common.Key{byte(j)}, common.Value{byte(i)}); err != nil {
+				t.Fatalf("failed to set storage: %v", err)
+			}
+		}
+	}
+	if _, err := state.GetHash(); err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+}
+
+// corruptHashOfChildOfRoot modifies the hash stored for the first child of
+// the root node of the given state, which needs to be a branch node. The ID
+// of the child is returned.
+func corruptHashOfChildOfRoot(t *testing.T, state *MptState) NodeId {
+	t.Helper()
+	forest := state.trie.forest.(*Forest)
+	handle, err := forest.getWriteAccess(&state.trie.root)
+	if err != nil {
+		t.Fatalf("failed to access root: %v", err)
+	}
+	defer handle.Release()
+	root, ok := handle.Get().(*BranchNode)
+	if !ok {
+		t.Fatalf("root is not a branch node")
+	}
+	for i, child := range root.children {
+		if child.Id().IsEmpty() {
+			continue
+		}
+		if forest.config.HashStorageLocation == HashStoredWithParent {
+			root.hashes[i][0]++
+			root.markDirty(forest, &state.trie.root)
+			return child.Id()
+		}
+		childHandle, err := forest.getWriteAccess(&child)
+		if err != nil {
+			t.Fatalf("failed to access child: %v", err)
+		}
+		node := childHandle.Get()
+		hash, _ := node.GetHash()
+		hash[0]++
+		node.(interface {
+			markDirty(NodeManager, *NodeReference)
+		}).markDirty(forest, &child) // < the node needs to be written to disk
+		node.SetHash(hash)
+		childHandle.Release()
+		return child.Id()
+	}
+	t.Fatalf("root has no children")
+	return NodeId(0)
+}
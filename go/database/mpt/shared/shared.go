@@ -13,6 +13,7 @@ package shared
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 )
 
 // The shared package provides generic utility classes for synchronizing access
@@ -45,6 +46,7 @@ type Shared[T any] struct {
 	value        T
 	contentMutex sync.RWMutex
 	hashMutex    sync.RWMutex
+	numHandles   atomic.Int32 // the number of active handles, for diagnostics
 }
 
 // MakeShared creates a new shared object and initializes it with the given value.
@@ -65,6 +67,7 @@ func MakeShared[T any](value T) *Shared[T] {
 func (p *Shared[T]) TryGetReadHandle() (ReadHandle[T], bool) {
 	succ := p.contentMutex.TryRLock()
 	if succ {
+		p.numHandles.Add(1)
 		return ReadHandle[T]{handle[T]{p}}, true
 	}
 	return ReadHandle[T]{}, false
@@ -78,6 +81,7 @@ func (p *Shared[T]) TryGetReadHandle() (ReadHandle[T], bool) {
 // must be released once access is no longer needed.
 func (p *Shared[T]) GetReadHandle() ReadHandle[T] {
 	p.contentMutex.RLock()
+	p.numHandles.Add(1)
 	return ReadHandle[T]{handle[T]{p}}
 }
 
@@ -98,6 +102,7 @@ func (p *Shared[T]) TryGetViewHandle() (ViewHandle[T], bool) {
 		p.contentMutex.RUnlock()
 		return ViewHandle[T]{}, false
 	}
+	p.numHandles.Add(1)
 	return ViewHandle[T]{handle[T]{p}}, true
 }
 
@@ -110,6 +115,7 @@ func (p *Shared[T]) TryGetViewHandle() (ViewHandle[T], bool) {
 func (p *Shared[T]) GetViewHandle() ViewHandle[T] {
 	p.contentMutex.RLock()
 	p.hashMutex.RLock()
+	p.numHandles.Add(1)
 	return ViewHandle[T]{handle[T]{p}}
 }
 
@@ -130,6 +136,7 @@ func (p *Shared[T]) TryGetHashHandle() (HashHandle[T], bool) {
 		p.contentMutex.RUnlock()
 		return HashHandle[T]{}, false
 	}
+	p.numHandles.Add(1)
 	return HashHandle[T]{handle[T]{p}}, true
 }
 
@@ -143,6 +150,7 @@ func (p *Shared[T]) TryGetHashHandle() (HashHandle[T], bool) {
 func (p *Shared[T]) GetHashHandle() HashHandle[T] {
 	p.contentMutex.RLock()
 	p.hashMutex.Lock()
+	p.numHandles.Add(1)
 	return HashHandle[T]{handle[T]{p}}
 }
 
@@ -154,7 +162,8 @@ func (p *Shared[T]) GetHashHandle() HashHandle[T] {
 func (p *Shared[T]) TryGetWriteHandle() (WriteHandle[T], bool) {
 	succ := p.contentMutex.TryLock()
 	if succ {
-		return WriteHandle[T]{handle[T]{p}}, true
+		p.numHandles.Add(1)
+		return WriteHandle[T]{handle: handle[T]{p}}, true
 	}
 	return WriteHandle[T]{}, false
 }
@@ -166,7 +175,15 @@ func (p *Shared[T]) TryGetWriteHandle() (WriteHandle[T], bool) {
 // must be released once access is no longer needed.
 func (p *Shared[T]) GetWriteHandle() WriteHandle[T] {
 	p.contentMutex.Lock()
-	return WriteHandle[T]{handle[T]{p}}
+	p.numHandles.Add(1)
+	return WriteHandle[T]{handle: handle[T]{p}}
+}
+
+// NumHandles returns the number of currently active handles on the shared
+// value. It is intended for diagnostics, e.g. to detect handles that are never
+// released, and may be outdated by the time it is returned.
+func (p *Shared[T]) NumHandles() int {
+	return int(p.numHandles.Load())
 }
 
 type handle[T any] struct {
@@ -199,6 +216,7 @@ type ReadHandle[T any] struct {
 // instances to avoid dead-lock situations. After the handle has been released,
 // the handle becomes invalid.
 func (h *ReadHandle[T]) Release() {
+	h.shared.numHandles.Add(-1)
 	h.shared.contentMutex.RUnlock()
 	h.shared = nil
 }
@@ -222,6 +240,7 @@ type ViewHandle[T any] struct {
 // instances to avoid dead-lock situations. After the handle has been released,
 // the handle becomes invalid.
 func (h *ViewHandle[T]) Release() {
+	h.shared.numHandles.Add(-1)
 	h.shared.contentMutex.RUnlock()
 	h.shared.hashMutex.RUnlock()
 	h.shared = nil
@@ -247,6 +266,7 @@ type HashHandle[T any] struct {
 // instances to avoid dead-lock situations. After the handle has been released,
 // the handle becomes invalid.
 func (h *HashHandle[T]) Release() {
+	h.shared.numHandles.Add(-1)
 	h.shared.contentMutex.RUnlock()
 	h.shared.hashMutex.Unlock()
 	h.shared = nil
@@ -262,6 +282,7 @@ func (h *HashHandle[T]) String() string {
 // or TryGetWriteHandle() functions.
 type WriteHandle[T any] struct {
 	handle[T]
+	onRelease func(T) // an optional hook called before write access is abandoned
 }
 
 // Ref returns a pointer to the shared value. Must only be called on valid handles.
@@ -274,6 +295,15 @@ func (h *WriteHandle[T]) Set(value T) {
 	h.shared.value = value
 }
 
+// WithReleaseHook returns a copy of this handle calling the given function
+// with the shared value when write access is released, while access is still
+// held. It may be used for inspecting modifications performed through the
+// handle. Only the returned handle triggers the hook when being released.
+func (h WriteHandle[T]) WithReleaseHook(hook func(T)) WriteHandle[T] {
+	h.onRelease = hook
+	return h
+}
+
 // AsReadHandle obtains a view on this write handle proving read access to the
 // shared value. Write access is preserved and must still be released. The
 // resulting read access handle must not be released.
@@ -299,10 +329,27 @@ func (h *WriteHandle[T]) AsViewHandle() ViewHandle[T] {
 // instances to avoid dead-lock situations. After the handle has been released,
 // the handle becomes invalid.
 func (h *WriteHandle[T]) Release() {
+	if h.onRelease != nil {
+		h.releaseWithHook()
+		return
+	}
+	h.shared.numHandles.Add(-1)
 	h.shared.contentMutex.Unlock()
 	h.shared = nil
 }
 
+// releaseWithHook releases write access after calling the release hook. Access
+// is released even if the hook panics.
+func (h *WriteHandle[T]) releaseWithHook() {
+	shared, hook := h.shared, h.onRelease
+	h.shared, h.onRelease = nil, nil
+	defer func() {
+		shared.numHandles.Add(-1)
+		shared.contentMutex.Unlock()
+	}()
+	hook(shared.value)
+}
+
 func (h *WriteHandle[T]) String() string {
 	return fmt.Sprintf("WriteHandle(%p)", h.shared)
 }
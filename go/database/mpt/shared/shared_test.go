@@ -11,6 +11,7 @@
 package shared
 
 import (
+	"slices"
 	"sync"
 	"testing"
 )
@@ -248,6 +249,71 @@ func TestShared_WriteIsInvalidatesByRelease(t *testing.T) {
 	}
 }
 
+func TestShared_ReleaseHookObservesValueOnRelease(t *testing.T) {
+	shared := MakeShared(10)
+
+	var observed []int
+	write := shared.GetWriteHandle().WithReleaseHook(func(value int) {
+		observed = append(observed, value)
+	})
+	write.Set(12)
+	if len(observed) != 0 {
+		t.Errorf("hook should not be called before release, got %v", observed)
+	}
+	write.Release()
+	if want, got := []int{12}, observed; !slices.Equal(want, got) {
+		t.Errorf("unexpected observed values, wanted %v, got %v", want, got)
+	}
+
+	// Handles obtained later are not affected by the hook.
+	write = shared.GetWriteHandle()
+	write.Set(14)
+	write.Release()
+	if want, got := []int{12}, observed; !slices.Equal(want, got) {
+		t.Errorf("unexpected observed values, wanted %v, got %v", want, got)
+	}
+}
+
+func TestShared_NumHandlesTracksActiveHandles(t *testing.T) {
+	shared := MakeShared(10)
+	if got, want := shared.NumHandles(), 0; got != want {
+		t.Errorf("unexpected number of handles, wanted %d, got %d", want, got)
+	}
+
+	read1 := shared.GetReadHandle()
+	read2, _ := shared.TryGetReadHandle()
+	hash, _ := shared.TryGetHashHandle()
+	if got, want := shared.NumHandles(), 3; got != want {
+		t.Errorf("unexpected number of handles, wanted %d, got %d", want, got)
+	}
+	if _, succ := shared.TryGetViewHandle(); succ {
+		t.Fatalf("view access should be blocked by hash access")
+	}
+	if got, want := shared.NumHandles(), 3; got != want {
+		t.Errorf("failed acquisitions should not be counted, wanted %d, got %d", want, got)
+	}
+	read1.Release()
+	read2.Release()
+	hash.Release()
+
+	view := shared.GetViewHandle()
+	if got, want := shared.NumHandles(), 1; got != want {
+		t.Errorf("unexpected number of handles, wanted %d, got %d", want, got)
+	}
+	view.Release()
+
+	write := shared.GetWriteHandle()
+	_ = write.AsViewHandle()
+	if got, want := shared.NumHandles(), 1; got != want {
+		t.Errorf("derived handles should not be counted, wanted %d, got %d", want, got)
+	}
+	write.Release()
+
+	if got, want := shared.NumHandles(), 0; got != want {
+		t.Errorf("unexpected number of handles, wanted %d, got %d", want, got)
+	}
+}
+
 func TestShared_ConcurrentRead(t *testing.T) {
 	shared := MakeShared(10)
 	var wg sync.WaitGroup
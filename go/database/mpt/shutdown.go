@@ -0,0 +1,81 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"context"
+)
+
+// CloseWithContext is a variant of Close bounding the time spent waiting for
+// the forest to be closed by the given context. If the context is done before
+// the forest is closed, tries pending to be released are skipped, the error of
+// the context is returned, and closing the forest continues in the background.
+// The forest is then in the state of an interrupted shutdown, which, if the
+// process terminates before closing finished, is equivalent to a crash; see
+// DurabilityMode for the recovery of directories in this state.
+func (s *Forest) CloseWithContext(ctx context.Context) error {
+	return closeWithContext(ctx, s.Close, s.abortPendingReleases)
+}
+
+// CloseWithContext is a variant of Close bounding the time spent waiting for
+// the trie to be flushed and closed by the given context. See
+// Forest.CloseWithContext for details.
+func (s *LiveTrie) CloseWithContext(ctx context.Context) error {
+	return closeWithContext(ctx, s.Close, func() {
+		abortPendingReleases(s.forest)
+	})
+}
+
+// CloseWithContext is a variant of Close bounding the time spent waiting for
+// the state to be flushed and closed by the given context. If the context is
+// done first, the directory remains locked and marked as dirty until closing
+// finished in the background. See Forest.CloseWithContext for details.
+func (s *MptState) CloseWithContext(ctx context.Context) error {
+	return closeWithContext(ctx, s.Close, func() {
+		abortPendingReleases(s.trie.forest)
+	})
+}
+
+// CloseWithContext is a variant of Close bounding the time spent waiting for
+// the archive to be flushed and closed by the given context. See
+// Forest.CloseWithContext for details.
+func (a *ArchiveTrie) CloseWithContext(ctx context.Context) error {
+	return closeWithContext(ctx, a.Close, func() {
+		abortPendingReleases(a.forest)
+	})
+}
+
+// closeWithContext runs the given close operation and waits for it to finish
+// or for the given context to be done, whichever happens first. In the latter
+// case, the given abort function is called to skip work not required for the
+// integrity of the closed structure, the close operation continues in the
+// background, and the error of the context is returned.
+func closeWithContext(ctx context.Context, close func() error, abort func()) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- close()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		abort()
+		return ctx.Err()
+	}
+}
+
+// abortPendingReleases makes the release workers of the given database skip
+// tries pending to be released, if supported by the database.
+func abortPendingReleases(db Database) {
+	if forest, ok := db.(*Forest); ok {
+		forest.abortPendingReleases()
+	}
+}
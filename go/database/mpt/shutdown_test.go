@@ -0,0 +1,127 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestCloseWithContext_StateIsClosedWithinDeadline(t *testing.T) {
+	dir := t.TempDir()
+	state, err := OpenGoFileState(dir, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	want := addShutdownTestLoad(t, state, 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := state.CloseWithContext(ctx); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+
+	state, err = OpenGoFileState(dir, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to reopen state: %v", err)
+	}
+	defer state.Close()
+	if got, err := state.GetHash(); err != nil || got != want {
+		t.Errorf("unexpected hash after reopening, wanted %x, got %x, err %v", want, got, err)
+	}
+}
+
+func TestCloseWithContext_ExceededDeadlineIsReportedAndStateIsRecoverable(t *testing.T) {
+	dir := t.TempDir()
+	state, err := OpenGoFileStateWithConfig(dir, S5LiveConfig, ForestConfig{CacheCapacity: 100_000})
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	addShutdownTestLoad(t, state, 5_000)
+
+	// Deleted accounts queue their storage tries for being released.
+	for i, addr := range getTestAddresses(5_000) {
+		if i%10 != 0 {
+			continue
+		}
+		if err := state.DeleteAccount(addr); err != nil {
+			t.Fatalf("failed to delete account: %v", err)
+		}
+	}
+	want, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	if err := state.CloseWithContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("closing with exceeded deadline should fail, got %v", err)
+	}
+
+	// The directory is locked until closing finished in the background.
+	deadline := time.Now().Add(time.Minute)
+	for {
+		state, err = OpenGoFileState(dir, S5LiveConfig, 1024)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("failed to reopen state: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer state.Close()
+	if got, err := state.GetHash(); err != nil || got != want {
+		t.Errorf("unexpected hash after reopening, wanted %x, got %x, err %v", want, got, err)
+	}
+	if err := state.trie.Check(); err != nil {
+		t.Errorf("reopened state is inconsistent: %v", err)
+	}
+}
+
+func TestCloseWithContext_ForestIsClosedOnce(t *testing.T) {
+	forest, err := OpenFileForest(t.TempDir(), S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	if err := forest.CloseWithContext(context.Background()); err != nil {
+		t.Fatalf("failed to close forest: %v", err)
+	}
+	if err := forest.CloseWithContext(context.Background()); !errors.Is(err, forestClosedErr) {
+		t.Errorf("closing forest twice should fail, got %v", err)
+	}
+}
+
+// addShutdownTestLoad adds the given number of accounts with storage to the
+// given state and returns the resulting hash.
+func addShutdownTestLoad(t *testing.T, state *MptState, numAccounts int) common.Hash {
+	t.Helper()
+	for i, addr := range getTestAddresses(numAccounts) {
+		if err := state.SetNonce(addr, common.ToNonce(1)); err != nil {
+			t.Fatalf("failed to set nonce: %v", err)
+		}
+		for j := 0; j < 5; j++ {
+			if err := state.SetStorage(addr, common.Key{byte(j), byte(i)}, common.Value{1}); err != nil {
+				t.Fatalf("failed to set storage: %v", err)
+			}
+		}
+	}
+	hash, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+	return hash
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"math/rand"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// slotCountSamples is the number of random walks conducted for estimating
+// the number of slots in storage tries if leaf counts are not tracked.
+const slotCountSamples = 32
+
+// defaultClearedSlotCountLimit is the default maximum number of slots counted
+// by LiveTrie.ClearStorageWithCount if leaf counts are not tracked.
+const defaultClearedSlotCountLimit = 10_000
+
+const slotCountUnsupportedErr = common.ConstError("slot count estimation is only supported by forests")
+
+// EstimateSlotCount returns the number of storage slots of the given account
+// in the trie rooted by the given node. If leaf counts are tracked by this
+// forest (see MptConfig.TrackSubtreeLeafCounts) and known for the storage
+// trie, the exact count is obtained from the root of the storage trie and
+// true is returned. Otherwise, the
+// count is estimated by a bounded number of random walks from the root of
+// the storage trie to its leaves, and false is returned unless the storage
+// trie is trivial. Non-existing accounts have no slots.
+func (s *Forest) EstimateSlotCount(rootRef *NodeReference, addr common.Address) (uint64, bool, error) {
+	_, storage, exists, err := s.getAccountState(rootRef, addr)
+	if err != nil || !exists {
+		return 0, true, err
+	}
+	if s.config.TrackSubtreeLeafCounts {
+		count, known, err := getLeafCountOf(s, &storage)
+		if err != nil || known {
+			return count, true, err
+		}
+	}
+	return estimateLeafCount(s, storage, slotCountSamples)
+}
+
+// CountSlots returns the number of storage slots of the given account in the
+// trie rooted by the given node. If leaf counts are tracked by this forest
+// and known for the storage trie, the exact count is obtained from the root
+// of the storage trie. Otherwise,
+// the slots are counted by traversing the storage trie, stopping once the
+// given limit is exceeded. In this case, the returned count is a lower bound
+// and false is returned. Non-existing accounts have no slots.
+func (s *Forest) CountSlots(rootRef *NodeReference, addr common.Address, limit int) (uint64, bool, error) {
+	_, storage, exists, err := s.getAccountState(rootRef, addr)
+	if err != nil || !exists {
+		return 0, true, err
+	}
+	if s.config.TrackSubtreeLeafCounts {
+		count, known, err := getLeafCountOf(s, &storage)
+		if err != nil || known {
+			return count, true, err
+		}
+	}
+	if storage.Id().IsEmpty() {
+		return 0, true, nil
+	}
+	count := uint64(0)
+	exact := true
+	v := MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+		if _, ok := node.(*ValueNode); ok {
+			count++
+			if count > uint64(limit) {
+				exact = false
+				return VisitResponseAbort
+			}
+		}
+		return VisitResponseContinue
+	})
+	if err := s.VisitTrie(&storage, v); err != nil {
+		return 0, false, err
+	}
+	return count, exact, nil
+}
+
+// estimateLeafCount estimates the number of leaves in the trie rooted by the
+// given node using the given number of random walks descending to uniformly
+// chosen children. Each walk contributes the product of the numbers of
+// children of the visited branch nodes, which is an unbiased estimate of the
+// number of leaves. If the result is exact, true is returned.
+func estimateLeafCount(source NodeSource, root NodeReference, samples int) (uint64, bool, error) {
+	if root.Id().IsEmpty() {
+		return 0, true, nil
+	}
+	if !root.Id().IsBranch() && !root.Id().IsExtension() {
+		return 1, true, nil
+	}
+	sum := uint64(0)
+	for i := 0; i < samples; i++ {
+		estimate := uint64(1)
+		current := root
+		for !current.Id().IsEmpty() {
+			handle, err := source.getViewAccess(&current)
+			if err != nil {
+				return 0, false, err
+			}
+			next := NewNodeReference(EmptyId())
+			switch node := handle.Get().(type) {
+			case *BranchNode:
+				children := make([]NodeReference, 0, len(node.children))
+				for _, child := range node.children {
+					if !child.Id().IsEmpty() {
+						children = append(children, child)
+					}
+				}
+				if len(children) > 0 {
+					estimate *= uint64(len(children))
+					next = children[rand.Intn(len(children))]
+				}
+			case *ExtensionNode:
+				next = node.next
+			}
+			handle.Release()
+			current = next
+		}
+		sum += estimate
+	}
+	return sum / uint64(samples), false, nil
+}
+
+// EstimateSlotCount returns the number of storage slots of the given account.
+// See Forest.EstimateSlotCount for details.
+func (s *LiveTrie) EstimateSlotCount(addr common.Address) (uint64, bool, error) {
+	forest, ok := s.forest.(*Forest)
+	if !ok {
+		return 0, false, slotCountUnsupportedErr
+	}
+	return forest.EstimateSlotCount(&s.root, addr)
+}
+
+// ClearStorageWithCount is a variant of ClearStorage reporting the number of
+// cleared slots. Since the storage trie is released in the background, the
+// slots are counted before clearing it, see Forest.CountSlots for details.
+// If leaf counts are not tracked, at most ForestConfig.ClearedSlotCountLimit
+// slots are counted; beyond that, the count is a lower bound and false is
+// returned.
+func (s *LiveTrie) ClearStorageWithCount(addr common.Address) (uint64, bool, error) {
+	forest, ok := s.forest.(*Forest)
+	if !ok {
+		return 0, false, slotCountUnsupportedErr
+	}
+	if s.inconsistency != nil {
+		return 0, false, s.inconsistency
+	}
+	count, exact, err := forest.CountSlots(&s.root, addr, forest.clearedSlotCountLimit)
+	if err != nil {
+		return 0, false, err
+	}
+	if err := s.ClearStorage(addr); err != nil {
+		return 0, false, err
+	}
+	return count, exact, nil
+}
+
+// EstimateSlotCount returns the number of storage slots of the given account.
+// See Forest.EstimateSlotCount for details.
+func (s *MptState) EstimateSlotCount(address common.Address) (uint64, bool, error) {
+	return s.trie.EstimateSlotCount(address)
+}
@@ -0,0 +1,490 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func withLeafCounts(config MptConfig) MptConfig {
+	config.TrackSubtreeLeafCounts = true
+	return config
+}
+
+func TestEstimateSlotCount_CountsAreExactIfTracked(t *testing.T) {
+	configs := []MptConfig{S4LiveConfig, S5LiveConfig, S5LiveNoExtensionsConfig}
+	for _, config := range configs {
+		t.Run(config.Name, func(t *testing.T) {
+			config := withLeafCounts(config)
+			dir := t.TempDir()
+			trie, err := OpenFileLiveTrie(dir, config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+
+			r := rand.New(rand.NewSource(42))
+			addresses := []common.Address{{1}, {2}, {3}}
+			slots := map[common.Address]map[common.Key]bool{}
+			for _, addr := range addresses {
+				if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+					t.Fatalf("failed to create account: %v", err)
+				}
+				slots[addr] = map[common.Key]bool{}
+			}
+
+			check := func(trie *LiveTrie) {
+				t.Helper()
+				for _, addr := range addresses {
+					count, exact, err := trie.EstimateSlotCount(addr)
+					if err != nil {
+						t.Fatalf("failed to get slot count: %v", err)
+					}
+					if !exact {
+						t.Errorf("slot count should be exact")
+					}
+					if want, got := uint64(len(slots[addr])), count; want != got {
+						t.Errorf("unexpected slot count of %v, wanted %d, got %d", addr, want, got)
+					}
+				}
+				if err := trie.Check(); err != nil {
+					t.Errorf("check failed: %v", err)
+				}
+			}
+
+			for round := 0; round < 5; round++ {
+				for i := 0; i < 200; i++ {
+					addr := addresses[r.Intn(len(addresses))]
+					key := common.Key{byte(r.Intn(4)), byte(r.Intn(256))}
+					value := common.Value{1}
+					if r.Intn(3) == 0 {
+						value = common.Value{}
+					}
+					if err := trie.SetValue(addr, key, value); err != nil {
+						t.Fatalf("failed to set value: %v", err)
+					}
+					if value == (common.Value{}) {
+						delete(slots[addr], key)
+					} else {
+						slots[addr][key] = true
+					}
+				}
+				if _, _, err := trie.UpdateHashes(); err != nil {
+					t.Fatalf("failed to update hashes: %v", err)
+				}
+				check(trie)
+			}
+
+			// Clearing the storage removes all slots.
+			if err := trie.ClearStorage(addresses[0]); err != nil {
+				t.Fatalf("failed to clear storage: %v", err)
+			}
+			slots[addresses[0]] = map[common.Key]bool{}
+			check(trie)
+
+			// Leaf counts are persisted.
+			if err := trie.Close(); err != nil {
+				t.Fatalf("failed to close trie: %v", err)
+			}
+			trie, err = OpenFileLiveTrie(dir, config, 1024)
+			if err != nil {
+				t.Fatalf("failed to reopen trie: %v", err)
+			}
+			defer trie.Close()
+			check(trie)
+		})
+	}
+}
+
+func TestEstimateSlotCount_AccountsAreCountedByRootOfAccountTrie(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), withLeafCounts(S5LiveConfig), 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	for i := 0; i < 100; i++ {
+		if err := trie.SetAccountInfo(common.Address{byte(i)}, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := trie.SetAccountInfo(common.Address{byte(i)}, AccountInfo{}); err != nil {
+			t.Fatalf("failed to delete account: %v", err)
+		}
+	}
+	count, known, err := getLeafCountOf(trie.forest.(*Forest), &trie.root)
+	if err != nil || !known {
+		t.Fatalf("failed to get leaf count, known %t, err %v", known, err)
+	}
+	if want, got := uint64(90), count; want != got {
+		t.Errorf("unexpected number of accounts, wanted %d, got %d", want, got)
+	}
+	if err := trie.Check(); err != nil {
+		t.Errorf("check failed: %v", err)
+	}
+}
+
+func TestEstimateSlotCount_NonExistingAccountHasNoSlots(t *testing.T) {
+	for _, config := range []MptConfig{S5LiveConfig, withLeafCounts(S5LiveConfig)} {
+		trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+		if err != nil {
+			t.Fatalf("failed to open trie: %v", err)
+		}
+		count, exact, err := trie.EstimateSlotCount(common.Address{1})
+		if err != nil || count != 0 || !exact {
+			t.Errorf("unexpected result for non-existing account: %d, %t, %v", count, exact, err)
+		}
+		if err := trie.Close(); err != nil {
+			t.Fatalf("failed to close trie: %v", err)
+		}
+	}
+}
+
+func TestEstimateSlotCount_SlotsAreEstimatedIfNotTracked(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 100_000)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	addr := common.Address{1}
+	if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+
+	// Tries with up to one slot are counted exactly.
+	for i := 0; i < 2; i++ {
+		count, exact, err := trie.EstimateSlotCount(addr)
+		if err != nil || count != uint64(i) || !exact {
+			t.Errorf("unexpected result for %d slots: %d, %t, %v", i, count, exact, err)
+		}
+		if err := trie.SetValue(addr, common.Key{byte(i)}, common.Value{1}); err != nil {
+			t.Fatalf("failed to set value: %v", err)
+		}
+	}
+
+	const numSlots = 2000
+	for i := 0; i < numSlots; i++ {
+		if err := trie.SetValue(addr, common.Key{byte(i), byte(i >> 8)}, common.Value{1}); err != nil {
+			t.Fatalf("failed to set value: %v", err)
+		}
+	}
+	count, exact, err := trie.EstimateSlotCount(addr)
+	if err != nil {
+		t.Fatalf("failed to estimate slot count: %v", err)
+	}
+	if exact {
+		t.Errorf("estimated slot count should not be reported as exact")
+	}
+	if count < numSlots/2 || count > numSlots*2 {
+		t.Errorf("estimated slot count %d is too far off from %d", count, numSlots)
+	}
+}
+
+func TestEstimateSlotCount_UnknownLeafCountsAreEstimated(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), withLeafCounts(S5LiveConfig), 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	addr := common.Address{1}
+	if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := trie.SetValue(addr, common.Key{byte(i)}, common.Value{1}); err != nil {
+			t.Fatalf("failed to set value: %v", err)
+		}
+	}
+
+	// Forget all leaf counts, as for nodes created without tracking them.
+	forest := trie.forest.(*Forest)
+	forgetLeafCounts(t, forest, &trie.root)
+
+	if _, exact, err := trie.EstimateSlotCount(addr); err != nil || exact {
+		t.Errorf("unknown leaf counts should be estimated, exact %t, err %v", exact, err)
+	}
+
+	// Updates do not establish the leaf counts of modified nodes.
+	if err := trie.SetValue(addr, common.Key{200}, common.Value{1}); err != nil {
+		t.Fatalf("failed to set value: %v", err)
+	}
+	if _, exact, err := trie.EstimateSlotCount(addr); err != nil || exact {
+		t.Errorf("unknown leaf counts should be estimated, exact %t, err %v", exact, err)
+	}
+	if err := trie.Check(); err != nil {
+		t.Errorf("check failed: %v", err)
+	}
+}
+
+func TestEstimateSlotCount_UnknownLeafCountsArePropagatedTowardsTheRoot(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), withLeafCounts(S5LiveConfig), 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	for i := 0; i < 100; i++ {
+		if err := trie.SetAccountInfo(common.Address{byte(i)}, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+	}
+
+	// Forget the leaf count of the deepest branch node on the path to an
+	// account, leaving all other counts known.
+	forest := trie.forest.(*Forest)
+	addr := common.Address{1}
+	var deepest NodeReference
+	_, err = VisitPathToAccount(forest, &trie.root, addr, MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+		if _, ok := node.(*BranchNode); ok {
+			deepest = NewNodeReference(info.Id)
+		}
+		return VisitResponseContinue
+	}))
+	if err != nil || deepest.Id().IsEmpty() {
+		t.Fatalf("failed to locate branch node on path, err %v", err)
+	}
+	handle, err := forest.getWriteAccess(&deepest)
+	if err != nil {
+		t.Fatalf("failed to access node: %v", err)
+	}
+	branch := handle.Get().(*BranchNode)
+	branch.leafCount, branch.leafCountKnown = 0, false
+	handle.Release()
+
+	if _, known, err := getLeafCountOf(forest, &trie.root); err != nil || !known {
+		t.Fatalf("leaf count of root should be known, known %t, err %v", known, err)
+	}
+
+	// Modifying the account marks all counts on its path as unknown.
+	if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(2)}); err != nil {
+		t.Fatalf("failed to update account: %v", err)
+	}
+	if _, known, err := getLeafCountOf(forest, &trie.root); err != nil || known {
+		t.Errorf("leaf count of root should be unknown, known %t, err %v", known, err)
+	}
+	if err := trie.Check(); err != nil {
+		t.Errorf("check failed: %v", err)
+	}
+}
+
+func TestEstimateSlotCount_CountsAreMaintainedByArchive(t *testing.T) {
+	archive, err := OpenArchiveTrie(t.TempDir(), withLeafCounts(S5ArchiveConfig), 1024)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+
+	addr := common.Address{1}
+	for block := uint64(0); block < 5; block++ {
+		update := common.Update{}
+		if block == 0 {
+			update.AppendCreateAccount(addr)
+			update.AppendNonceUpdate(addr, common.ToNonce(1))
+		}
+		for i := 0; i < 10; i++ {
+			update.AppendSlotUpdate(addr, common.Key{byte(block), byte(i)}, common.Value{1})
+		}
+		if block > 0 {
+			update.AppendSlotUpdate(addr, common.Key{byte(block - 1), 0}, common.Value{})
+		}
+		if err := archive.Add(block, update, nil); err != nil {
+			t.Fatalf("failed to add block %d: %v", block, err)
+		}
+	}
+
+	for block := uint64(0); block < 5; block++ {
+		view, err := archive.getView(block)
+		if err != nil {
+			t.Fatalf("failed to get view of block %d: %v", block, err)
+		}
+		count, exact, err := view.EstimateSlotCount(addr)
+		if want := 9*block + 10; err != nil || count != want || !exact {
+			t.Errorf("unexpected slot count in block %d, wanted %d, got %d, %t, %v", block, want, count, exact, err)
+		}
+	}
+	if err := archive.Check(); err != nil {
+		t.Errorf("check failed: %v", err)
+	}
+}
+
+func TestEstimateSlotCount_StreamingBuilderProducesLeafCounts(t *testing.T) {
+	dir := t.TempDir()
+	config := withLeafCounts(S5LiveConfig)
+	builder, err := NewStreamingStateBuilder(dir, config)
+	if err != nil {
+		t.Fatalf("failed to create builder: %v", err)
+	}
+	reference, err := OpenGoMemoryState(t.TempDir(), config, 1024)
+	if err != nil {
+		t.Fatalf("failed to open reference state: %v", err)
+	}
+	defer reference.Close()
+	addr := common.Address{1}
+	if err := reference.SetNonce(addr, common.ToNonce(1)); err != nil {
+		t.Fatalf("failed to set nonce: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := reference.SetStorage(addr, common.Key{byte(i)}, common.Value{1}); err != nil {
+			t.Fatalf("failed to set storage: %v", err)
+		}
+	}
+	if err := addTrieContentToBuilder(reference, builder); err != nil {
+		t.Fatalf("failed to add content to builder: %v", err)
+	}
+	if _, _, err := builder.Finish(); err != nil {
+		t.Fatalf("failed to finish state: %v", err)
+	}
+
+	state, err := OpenGoFileState(dir, config, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	count, exact, err := state.EstimateSlotCount(addr)
+	if err != nil || count != 50 || !exact {
+		t.Errorf("unexpected result: %d, %t, %v", count, exact, err)
+	}
+	if err := state.trie.Check(); err != nil {
+		t.Errorf("check failed: %v", err)
+	}
+}
+
+func TestBranchNode_CheckDetectsInvalidLeafCounts(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), withLeafCounts(S5LiveConfig), 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	for i := 0; i < 10; i++ {
+		if err := trie.SetAccountInfo(common.Address{byte(i)}, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+	}
+	if _, _, err := trie.UpdateHashes(); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+	if err := trie.Check(); err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+
+	forest := trie.forest.(*Forest)
+	handle, err := forest.getWriteAccess(&trie.root)
+	if err != nil {
+		t.Fatalf("failed to access root: %v", err)
+	}
+	handle.Get().(*BranchNode).leafCount++
+	handle.Release()
+
+	if err := trie.Check(); err == nil || !strings.Contains(err.Error(), "invalid leaf count") {
+		t.Errorf("invalid leaf count should be detected, got %v", err)
+	}
+}
+
+// forgetLeafCounts marks the leaf counts of all branch nodes in the given
+// trie as unknown.
+func forgetLeafCounts(t *testing.T, forest *Forest, root *NodeReference) {
+	t.Helper()
+	var branches []NodeReference
+	err := forest.VisitTrie(root, MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+		if _, ok := node.(*BranchNode); ok {
+			branches = append(branches, NewNodeReference(info.Id))
+		}
+		return VisitResponseContinue
+	}))
+	if err != nil {
+		t.Fatalf("failed to visit trie: %v", err)
+	}
+	for _, ref := range branches {
+		handle, err := forest.getWriteAccess(&ref)
+		if err != nil {
+			t.Fatalf("failed to access node: %v", err)
+		}
+		branch := handle.Get().(*BranchNode)
+		branch.leafCount, branch.leafCountKnown = 0, false
+		handle.Release()
+	}
+}
+
+func TestClearStorageWithCount_ReportsNumberOfClearedSlots(t *testing.T) {
+	tests := map[string]struct {
+		slots int
+		limit int
+		count uint64
+		exact bool
+	}{
+		"empty":       {slots: 0, count: 0, exact: true},
+		"single slot": {slots: 1, count: 1, exact: true},
+		"deep":        {slots: 5000, count: 5000, exact: true},
+		"deep beyond limit": {
+			slots: 5000, limit: 1000, count: 1001, exact: false,
+		},
+	}
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		for _, tracked := range []bool{false, true} {
+			config := config
+			if tracked {
+				config = withLeafCounts(config)
+			}
+			for name, test := range tests {
+				t.Run(fmt.Sprintf("%s/tracked=%t/%s", config.Name, tracked, name), func(t *testing.T) {
+					trie, err := OpenFileLiveTrieWithConfig(t.TempDir(), config, ForestConfig{
+						CacheCapacity:         1 << 14, // large enough to avoid evicting nodes with dirty hashes
+						ClearedSlotCountLimit: test.limit,
+					})
+					if err != nil {
+						t.Fatalf("failed to open trie: %v", err)
+					}
+					defer trie.Close()
+
+					addr := common.Address{1}
+					if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+						t.Fatalf("failed to create account: %v", err)
+					}
+					for i := 0; i < test.slots; i++ {
+						key := common.Key{}
+						binary.BigEndian.PutUint32(key[:], uint32(i))
+						if err := trie.SetValue(addr, key, common.Value{1}); err != nil {
+							t.Fatalf("failed to set slot: %v", err)
+						}
+					}
+
+					count, exact, err := trie.ClearStorageWithCount(addr)
+					if err != nil {
+						t.Fatalf("failed to clear storage: %v", err)
+					}
+					// Tracked leaf counts are always exact.
+					wantCount, wantExact := test.count, test.exact
+					if tracked {
+						wantCount, wantExact = uint64(test.slots), true
+					}
+					if count != wantCount || exact != wantExact {
+						t.Errorf("unexpected count of cleared slots, wanted %d (exact %t), got %d (exact %t)", wantCount, wantExact, count, exact)
+					}
+					if count, exact, err := trie.EstimateSlotCount(addr); err != nil || count != 0 || !exact {
+						t.Errorf("storage should be cleared, got %d slots, %t, %v", count, exact, err)
+					}
+					if _, found, err := trie.GetAccountInfo(addr); err != nil || !found {
+						t.Errorf("account should be retained, got %t, %v", found, err)
+					}
+
+					count, exact, err = trie.ClearStorageWithCount(common.Address{2})
+					if err != nil || count != 0 || !exact {
+						t.Errorf("non-existing account should have no slots, got %d, %t, %v", count, exact, err)
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
+)
+
+const slotHandleInvalidErr = common.ConstError("slot handle has been invalidated")
+
+// SlotHandle provides repeated O(1) read access to a single storage slot of
+// a live trie. Instead of walking the trie for each lookup, the handle
+// retains references to the account node owning the slot and, if the slot
+// is set, to the value node holding its value.
+//
+// A handle is invalidated by any modification of the referenced nodes, by
+// their release, and by their eviction from the node cache. In particular,
+// since every update of a storage trie modifies the owning account node,
+// any update of the account's storage invalidates the handle. Invalid handles
+// need to be replaced by a new handle obtained from the trie.
+//
+// For slots of non-existing accounts, the handle retains the deepest branch
+// or extension node on the path to the account instead, which is modified
+// whenever the account is created. If there is no such node, in particular if
+// the trie is empty, the handle is invalid from the start.
+type SlotHandle struct {
+	forest  *Forest
+	account nodeVersion // the account owning the slot or the node proving its absence, nil instance if there is none
+	value   nodeVersion // the value node of the slot, nil instance if the slot is not set
+}
+
+// nodeVersion identifies a specific version of a node retained in the node
+// cache of a forest.
+type nodeVersion struct {
+	ref        NodeReference
+	instance   *shared.Shared[Node]
+	generation uint32
+}
+
+// Invalid returns true if this handle can no longer be used for reading the
+// value of the referenced slot.
+func (h *SlotHandle) Invalid() bool {
+	if h.forest == nil || h.account.instance == nil {
+		return true
+	}
+	account, ok := h.forest.getCurrentView(&h.account)
+	if !ok {
+		return true
+	}
+	defer account.Release()
+	if h.value.instance == nil {
+		return false
+	}
+	value, ok := h.forest.getCurrentView(&h.value)
+	if ok {
+		value.Release()
+	}
+	return !ok
+}
+
+// Get returns the value of the referenced slot. If the handle has been
+// invalidated, an error is returned.
+func (h *SlotHandle) Get() (common.Value, error) {
+	if h.forest == nil || h.account.instance == nil {
+		return common.Value{}, slotHandleInvalidErr
+	}
+	// Holding view access to the account node prevents concurrent updates
+	// of the account's storage while the value is read.
+	account, ok := h.forest.getCurrentView(&h.account)
+	if !ok {
+		return common.Value{}, slotHandleInvalidErr
+	}
+	defer account.Release()
+	if h.value.instance == nil {
+		return common.Value{}, nil
+	}
+	value, ok := h.forest.getCurrentView(&h.value)
+	if !ok {
+		return common.Value{}, slotHandleInvalidErr
+	}
+	defer value.Release()
+	return value.Get().(*ValueNode).value, nil
+}
+
+// slotHandleProvider is implemented by Database instances supporting the
+// creation of slot handles.
+type slotHandleProvider interface {
+	getSlotHandle(rootRef *NodeReference, addr common.Address, key common.Key) (SlotHandle, error)
+}
+
+func (s *Forest) getSlotHandle(rootRef *NodeReference, addr common.Address, key common.Key) (SlotHandle, error) {
+	res, err := s.locateSlot(rootRef, addr, key)
+	if err != nil {
+		err = fmt.Errorf("failed to get handle for slot %v/%v: %w", addr, key, err)
+		s.errors = append(s.errors, err)
+		return SlotHandle{}, err
+	}
+	return res, nil
+}
+
+// locateSlot creates a handle for the given slot. The version of the account
+// node is captured before its storage is searched for the value node. Thus,
+// if the account gets modified concurrently, the resulting handle is invalid
+// but never inconsistent.
+func (s *Forest) locateSlot(rootRef *NodeReference, addr common.Address, key common.Key) (SlotHandle, error) {
+	res := SlotHandle{forest: s}
+
+	var accountId, innerId NodeId
+	var innerGeneration uint32
+	found, err := VisitPathToAccount(s, rootRef, addr, MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+		switch n := node.(type) {
+		case *AccountNode:
+			if n.address == addr {
+				accountId = info.Id
+			}
+		case *BranchNode, *ExtensionNode:
+			innerId = info.Id
+			innerGeneration = getNodeGeneration(node)
+		}
+		return VisitResponseContinue
+	}))
+	if err != nil {
+		return res, err
+	}
+	if !found {
+		// The account gets created below the deepest inner node on its path,
+		// which is modified by the creation. If the node got modified since
+		// it was visited, the handle remains invalid.
+		if innerId.IsEmpty() {
+			return res, nil
+		}
+		res.account, err = s.getNodeVersion(innerId, func(node Node) bool {
+			return getNodeGeneration(node) == innerGeneration
+		})
+		return res, err
+	}
+
+	var storage NodeReference
+	res.account, err = s.getNodeVersion(accountId, func(node Node) bool {
+		account, ok := node.(*AccountNode)
+		if ok {
+			storage = account.storage
+		}
+		return ok && account.address == addr
+	})
+	if err != nil || res.account.instance == nil {
+		return res, err
+	}
+
+	var valueId NodeId
+	found, err = VisitPathToStorage(s, &storage, key, MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+		if value, ok := node.(*ValueNode); ok && value.key == key {
+			valueId = info.Id
+		}
+		return VisitResponseContinue
+	}))
+	if err != nil || !found {
+		return res, err
+	}
+
+	res.value, err = s.getNodeVersion(valueId, func(node Node) bool {
+		value, ok := node.(*ValueNode)
+		return ok && value.key == key
+	})
+	return res, err
+}
+
+// getNodeVersion captures the current version of the node with the given ID.
+// If the node is not accepted by the given filter, an empty version is
+// returned.
+func (s *Forest) getNodeVersion(id NodeId, accept func(Node) bool) (nodeVersion, error) {
+	res := nodeVersion{ref: NewNodeReference(id)}
+	instance, err := s.getSharedNode(&res.ref)
+	if err != nil {
+		return nodeVersion{}, err
+	}
+	view := instance.GetViewHandle()
+	defer view.Release()
+	node := view.Get()
+	if !accept(node) {
+		return nodeVersion{}, nil
+	}
+	res.instance = instance
+	res.generation = getNodeGeneration(node)
+	return res, nil
+}
+
+// getCurrentView obtains view access to the node of the given version. If
+// the node is no longer retained in the node cache or has been modified
+// since the version was captured, false is returned.
+func (s *Forest) getCurrentView(version *nodeVersion) (shared.ViewHandle[Node], bool) {
+	instance, found := s.nodeCache.Get(&version.ref)
+	if !found || instance != version.instance {
+		return shared.ViewHandle[Node]{}, false
+	}
+	view := instance.GetViewHandle()
+	if getNodeGeneration(view.Get()) != version.generation {
+		view.Release()
+		return shared.ViewHandle[Node]{}, false
+	}
+	return view, true
+}
+
+func getNodeGeneration(node Node) uint32 {
+	if n, ok := node.(interface{ getGeneration() uint32 }); ok {
+		return n.getGeneration()
+	}
+	return 0
+}
@@ -0,0 +1,298 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func openSlotHandleTestTrie(t *testing.T, config MptConfig, cacheCapacity int) *LiveTrie {
+	t.Helper()
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, cacheCapacity)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := trie.Close(); err != nil {
+			t.Errorf("failed to close trie: %v", err)
+		}
+	})
+	for i := 0; i < 2; i++ {
+		addr := common.Address{byte(i)}
+		if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+		for j := 0; j < 10; j++ {
+			if err := trie.SetValue(addr, common.Key{byte(j)}, common.Value{byte(i), byte(j)}); err != nil {
+				t.Fatalf("failed to set value: %v", err)
+			}
+		}
+	}
+	return trie
+}
+
+func getSlotHandle(t *testing.T, trie *LiveTrie, addr common.Address, key common.Key) SlotHandle {
+	t.Helper()
+	handle, err := trie.GetSlotHandle(addr, key)
+	if err != nil {
+		t.Fatalf("failed to get slot handle: %v", err)
+	}
+	return handle
+}
+
+func checkSlotHandleValue(t *testing.T, handle *SlotHandle, want common.Value) {
+	t.Helper()
+	if handle.Invalid() {
+		t.Fatalf("handle should be valid")
+	}
+	got, err := handle.Get()
+	if err != nil {
+		t.Fatalf("failed to read value: %v", err)
+	}
+	if got != want {
+		t.Errorf("unexpected value, wanted %v, got %v", want, got)
+	}
+}
+
+func checkSlotHandleIsInvalid(t *testing.T, handle *SlotHandle) {
+	t.Helper()
+	if !handle.Invalid() {
+		t.Errorf("handle should be invalid")
+	}
+	if _, err := handle.Get(); !errors.Is(err, slotHandleInvalidErr) {
+		t.Errorf("reading invalid handle should fail, got %v", err)
+	}
+}
+
+func TestSlotHandle_ValuesCanBeReadRepeatedly(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			trie := openSlotHandleTestTrie(t, config, 1024)
+
+			handle := getSlotHandle(t, trie, common.Address{1}, common.Key{2})
+			for i := 0; i < 10; i++ {
+				checkSlotHandleValue(t, &handle, common.Value{1, 2})
+			}
+
+			// Reads of other slots and accounts do not invalidate handles.
+			if _, err := trie.GetValue(common.Address{0}, common.Key{2}); err != nil {
+				t.Fatalf("failed to read value: %v", err)
+			}
+			checkSlotHandleValue(t, &handle, common.Value{1, 2})
+		})
+	}
+}
+
+func TestSlotHandle_HandlesOfAbsentSlotsProduceZeroValues(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			trie := openSlotHandleTestTrie(t, config, 1024)
+
+			handle := getSlotHandle(t, trie, common.Address{1}, common.Key{20})
+			checkSlotHandleValue(t, &handle, common.Value{})
+
+			// Setting the slot invalidates the handle.
+			if err := trie.SetValue(common.Address{1}, common.Key{20}, common.Value{1}); err != nil {
+				t.Fatalf("failed to set value: %v", err)
+			}
+			checkSlotHandleIsInvalid(t, &handle)
+
+			handle = getSlotHandle(t, trie, common.Address{1}, common.Key{20})
+			checkSlotHandleValue(t, &handle, common.Value{1})
+		})
+	}
+}
+
+func TestSlotHandle_HandlesOfMissingAccountsProduceZeroValues(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			trie := openSlotHandleTestTrie(t, config, 1024)
+			for i := 2; i < 20; i++ {
+				addr := common.Address{byte(i)}
+				handle := getSlotHandle(t, trie, addr, common.Key{1})
+				checkSlotHandleValue(t, &handle, common.Value{})
+
+				// Creating the account invalidates the handle.
+				if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+					t.Fatalf("failed to create account: %v", err)
+				}
+				checkSlotHandleIsInvalid(t, &handle)
+
+				handle = getSlotHandle(t, trie, addr, common.Key{1})
+				checkSlotHandleValue(t, &handle, common.Value{})
+			}
+		})
+	}
+}
+
+func TestSlotHandle_HandlesWithoutRetainedNodesAreInvalid(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer trie.Close()
+
+			// In an empty trie, there is no node proving the account's absence.
+			handle := getSlotHandle(t, trie, common.Address{1}, common.Key{1})
+			checkSlotHandleIsInvalid(t, &handle)
+
+			var zero SlotHandle
+			checkSlotHandleIsInvalid(t, &zero)
+		})
+	}
+}
+
+func TestSlotHandle_SetValueInvalidatesHandle(t *testing.T) {
+	tests := map[string]struct {
+		key   common.Key
+		value common.Value
+	}{
+		"update":      {common.Key{2}, common.Value{2}},
+		"delete":      {common.Key{2}, common.Value{}},
+		"other slot":  {common.Key{3}, common.Value{2}},
+		"new slot":    {common.Key{30}, common.Value{2}},
+		"same value":  {common.Key{2}, common.Value{1, 2}},
+		"zero absent": {common.Key{30}, common.Value{}},
+	}
+	for _, config := range allMptConfigs {
+		for name, test := range tests {
+			t.Run(config.Name+"/"+name, func(t *testing.T) {
+				trie := openSlotHandleTestTrie(t, config, 1024)
+				addr := common.Address{1}
+
+				handle := getSlotHandle(t, trie, addr, common.Key{2})
+				if err := trie.SetValue(addr, test.key, test.value); err != nil {
+					t.Fatalf("failed to set value: %v", err)
+				}
+
+				want, err := trie.GetValue(addr, common.Key{2})
+				if err != nil {
+					t.Fatalf("failed to read value: %v", err)
+				}
+				if !handle.Invalid() {
+					// Handles may only survive updates not changing the storage.
+					checkSlotHandleValue(t, &handle, want)
+					if name != "same value" && name != "zero absent" {
+						t.Errorf("handle should be invalidated by update")
+					}
+					return
+				}
+				checkSlotHandleIsInvalid(t, &handle)
+				handle = getSlotHandle(t, trie, addr, common.Key{2})
+				checkSlotHandleValue(t, &handle, want)
+			})
+		}
+	}
+}
+
+func TestSlotHandle_UpdatesOfOtherAccountsDoNotInvalidateHandle(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			trie := openSlotHandleTestTrie(t, config, 1024)
+
+			handle := getSlotHandle(t, trie, common.Address{1}, common.Key{2})
+			if err := trie.SetValue(common.Address{0}, common.Key{2}, common.Value{3}); err != nil {
+				t.Fatalf("failed to set value: %v", err)
+			}
+			if err := trie.ClearStorage(common.Address{0}); err != nil {
+				t.Fatalf("failed to clear storage: %v", err)
+			}
+			checkSlotHandleValue(t, &handle, common.Value{1, 2})
+		})
+	}
+}
+
+func TestSlotHandle_ClearStorageInvalidatesHandle(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			trie := openSlotHandleTestTrie(t, config, 1024)
+			addr := common.Address{1}
+
+			present := getSlotHandle(t, trie, addr, common.Key{2})
+			absent := getSlotHandle(t, trie, addr, common.Key{20})
+			if err := trie.ClearStorage(addr); err != nil {
+				t.Fatalf("failed to clear storage: %v", err)
+			}
+			checkSlotHandleIsInvalid(t, &present)
+			checkSlotHandleIsInvalid(t, &absent)
+
+			handle := getSlotHandle(t, trie, addr, common.Key{2})
+			checkSlotHandleValue(t, &handle, common.Value{})
+		})
+	}
+}
+
+func TestSlotHandle_AccountDeletionInvalidatesHandle(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			trie := openSlotHandleTestTrie(t, config, 1024)
+			addr := common.Address{1}
+
+			present := getSlotHandle(t, trie, addr, common.Key{2})
+			absent := getSlotHandle(t, trie, addr, common.Key{20})
+			if err := trie.SetAccountInfo(addr, AccountInfo{}); err != nil {
+				t.Fatalf("failed to delete account: %v", err)
+			}
+			checkSlotHandleIsInvalid(t, &present)
+			checkSlotHandleIsInvalid(t, &absent)
+
+			// Re-creating the account, potentially re-using the released
+			// nodes, does not re-validate the handles.
+			if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+				t.Fatalf("failed to create account: %v", err)
+			}
+			if err := trie.SetValue(addr, common.Key{2}, common.Value{1, 2}); err != nil {
+				t.Fatalf("failed to set value: %v", err)
+			}
+			checkSlotHandleIsInvalid(t, &present)
+			checkSlotHandleIsInvalid(t, &absent)
+		})
+	}
+}
+
+func TestSlotHandle_CacheEvictionInvalidatesHandle(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			const cacheCapacity = 128
+			trie := openSlotHandleTestTrie(t, config, cacheCapacity)
+			addr := common.Address{1}
+
+			handle := getSlotHandle(t, trie, addr, common.Key{2})
+			checkSlotHandleValue(t, &handle, common.Value{1, 2})
+
+			// Fill the cache with nodes of other accounts.
+			for i := 0; i < 2*cacheCapacity; i++ {
+				other := common.Address{2, byte(i), byte(i >> 8)}
+				if err := trie.SetAccountInfo(other, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+					t.Fatalf("failed to create account: %v", err)
+				}
+			}
+			checkSlotHandleIsInvalid(t, &handle)
+
+			// Nodes reinstated from the write buffer are unmodified and may
+			// re-validate the handle, reloaded nodes do not.
+			if _, err := trie.GetValue(addr, common.Key{2}); err != nil {
+				t.Fatalf("failed to read value: %v", err)
+			}
+			if !handle.Invalid() {
+				checkSlotHandleValue(t, &handle, common.Value{1, 2})
+			}
+
+			handle = getSlotHandle(t, trie, addr, common.Key{2})
+			checkSlotHandleValue(t, &handle, common.Value{1, 2})
+		})
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// Deleting a slot releases its value node and may collapse the branch node
+// it was attached to. If the slot is set again within the same block, the
+// value node and the branch are re-created. To avoid this churn, deletions of
+// slots may be deferred to the end of a batch update. Within the batch, the
+// value nodes of deleted slots are retained as tombstones holding a zero
+// value, which are re-used if the slot is set again. At the end of the batch,
+// slots still being zero are deleted, producing the same trie as if they
+// had been deleted immediately. Tombstones are only visible to reads within
+// the batch, e.g. storage tries consisting of tombstones are not empty.
+
+// slotDeletionDeferral is an optional interface of node managers supporting
+// the deferral of slot deletions to the end of batch updates.
+type slotDeletionDeferral interface {
+	// tryDeferSlotDeletion is called by value nodes to be deleted. If true is
+	// returned, the node is to be retained as a tombstone and deleted at the
+	// end of the ongoing batch update. If false is returned, the node needs
+	// to be deleted immediately.
+	tryDeferSlotDeletion() bool
+}
+
+// slotDeletionDeferring is an optional interface of databases supporting
+// batch updates deferring the deletion of slots.
+type slotDeletionDeferring interface {
+	// beginDeferredSlotDeletion starts a batch update. It returns false if
+	// deferring deletions is not enabled, in which case no batch is started.
+	beginDeferredSlotDeletion() bool
+	// endDeferredSlotDeletion ends a batch update started by
+	// beginDeferredSlotDeletion, deleting all slots of the trie with the
+	// given root which have been deleted within the batch and not set again.
+	// The new root of the trie is returned.
+	endDeferredSlotDeletion(rootRef *NodeReference) (NodeReference, error)
+}
+
+// slotTombstone identifies a slot deleted within an ongoing batch update.
+type slotTombstone struct {
+	address common.Address
+	key     common.Key
+}
+
+func (s *Forest) tryDeferSlotDeletion() bool {
+	return s.deletionDeferred.Load()
+}
+
+func (s *Forest) beginDeferredSlotDeletion() bool {
+	if !s.deferSlotDeletion {
+		return false
+	}
+	s.deletionDeferred.Store(true)
+	return true
+}
+
+// recordSlotDeletion records the deletion of the given slot if deletions are
+// deferred by an ongoing batch update.
+func (s *Forest) recordSlotDeletion(address common.Address, key common.Key) {
+	if !s.deletionDeferred.Load() {
+		return
+	}
+	s.tombstonesMutex.Lock()
+	s.tombstones = append(s.tombstones, slotTombstone{address, key})
+	s.tombstonesMutex.Unlock()
+}
+
+func (s *Forest) endDeferredSlotDeletion(rootRef *NodeReference) (NodeReference, error) {
+	s.deletionDeferred.Store(false)
+	s.tombstonesMutex.Lock()
+	tombstones := s.tombstones
+	s.tombstones = nil
+	s.tombstonesMutex.Unlock()
+
+	root := *rootRef
+	for _, tombstone := range tombstones {
+		// Slots set again after being deleted are retained. Deleting slots
+		// not present, e.g. deleted repeatedly, has no effect.
+		value, err := s.GetValue(&root, tombstone.address, tombstone.key)
+		if err != nil {
+			return root, err
+		}
+		if value != (common.Value{}) {
+			continue
+		}
+		root, err = s.SetValue(&root, tombstone.address, tombstone.key, common.Value{})
+		if err != nil {
+			err = fmt.Errorf("failed to delete slot: %w", err)
+			s.errors = append(s.errors, err)
+			return root, err
+		}
+	}
+	return root, nil
+}
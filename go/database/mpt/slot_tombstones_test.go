@@ -0,0 +1,251 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
+)
+
+func TestSlotTombstones_ProduceSameTrieAsImmediateDeletion(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig, S5LiveNoExtensionsConfig} {
+		for _, collapse := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/collapse=%t", config.Name, collapse), func(t *testing.T) {
+				eager, err := OpenGoFileStateWithConfig(t.TempDir(), config, ForestConfig{CacheCapacity: 1024})
+				if err != nil {
+					t.Fatalf("failed to open state: %v", err)
+				}
+				defer eager.Close()
+				deferred, err := OpenGoFileStateWithConfig(t.TempDir(), config, ForestConfig{CacheCapacity: 1024, DeferSlotDeletion: true, DeferBranchCollapse: collapse})
+				if err != nil {
+					t.Fatalf("failed to open state: %v", err)
+				}
+				defer deferred.Close()
+
+				addresses := []common.Address{{1}, {1, 0x10}, {2}}
+				r := rand.New(rand.NewSource(42))
+				for block := uint64(0); block < 100; block++ {
+					// Slots are deleted and re-set repeatedly within blocks.
+					type op struct {
+						addr  common.Address
+						key   common.Key
+						value common.Value
+					}
+					ops := []op{}
+					for i := 0; i < r.Intn(32); i++ {
+						ops = append(ops, op{
+							addr:  addresses[r.Intn(len(addresses))],
+							key:   common.Key{byte(r.Intn(3)), byte(r.Intn(3) << 4)},
+							value: common.Value{byte(r.Intn(3))},
+						})
+					}
+					for _, state := range []*MptState{eager, deferred} {
+						err := state.trie.runBatch(func() error {
+							for _, addr := range addresses {
+								if err := state.SetNonce(addr, common.ToNonce(1)); err != nil {
+									return err
+								}
+							}
+							for _, op := range ops {
+								if err := state.SetStorage(op.addr, op.key, op.value); err != nil {
+									return err
+								}
+							}
+							return nil
+						})
+						if err != nil {
+							t.Fatalf("failed to run batch: %v", err)
+						}
+					}
+
+					if err := deferred.trie.Check(); err != nil {
+						t.Fatalf("invalid trie after block %d: %v", block, err)
+					}
+					want, err := eager.GetHash()
+					if err != nil {
+						t.Fatalf("failed to get hash: %v", err)
+					}
+					got, err := deferred.GetHash()
+					if err != nil {
+						t.Fatalf("failed to get hash: %v", err)
+					}
+					if want != got {
+						t.Fatalf("unexpected hash after block %d, wanted %x, got %x", block, want, got)
+					}
+					if want, got := getTrieShape(t, eager), getTrieShape(t, deferred); !slices.Equal(want, got) {
+						t.Fatalf("unexpected trie structure after block %d, wanted %v, got %v", block, want, got)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestSlotTombstones_ReSetSlotsReuseExistingNodes(t *testing.T) {
+	for _, deferred := range []bool{false, true} {
+		forest, err := OpenVolatileForest(S5LiveConfig, ForestConfig{Mode: Mutable, CacheCapacity: 1024, DeferSlotDeletion: deferred})
+		if err != nil {
+			t.Fatalf("failed to open forest: %v", err)
+		}
+		defer forest.Close()
+
+		addr := common.Address{1}
+		key1 := common.Key{1}
+		key2 := common.Key{2}
+		root := NewNodeReference(EmptyId())
+		root, err = forest.SetAccountInfo(&root, addr, AccountInfo{Nonce: common.ToNonce(1)})
+		if err != nil {
+			t.Fatalf("failed to set account: %v", err)
+		}
+		for _, key := range []common.Key{key1, key2} {
+			root, err = forest.SetValue(&root, addr, key, common.Value{1})
+			if err != nil {
+				t.Fatalf("failed to set value: %v", err)
+			}
+		}
+
+		started := forest.beginDeferredSlotDeletion()
+		if started != deferred {
+			t.Fatalf("unexpected start of batch, wanted %t, got %t", deferred, started)
+		}
+		counter := &nodeLifecycleCounter{Forest: forest}
+		for _, value := range []common.Value{{}, {2}} {
+			root, err = forest.setValue(counter, &root, addr, key1, value)
+			if err != nil {
+				t.Fatalf("failed to set value: %v", err)
+			}
+		}
+		if started {
+			root, err = forest.endDeferredSlotDeletion(&root)
+			if err != nil {
+				t.Fatalf("failed to end batch: %v", err)
+			}
+		}
+
+		if deferred && (counter.created != 0 || counter.released != 0) {
+			t.Errorf("re-set slot should reuse existing nodes, got %d created and %d released nodes", counter.created, counter.released)
+		}
+		if !deferred && (counter.created == 0 || counter.released == 0) {
+			t.Errorf("re-set slot should be restructured without deferral, got %d created and %d released nodes", counter.created, counter.released)
+		}
+		if value, err := forest.GetValue(&root, addr, key1); err != nil || value != (common.Value{2}) {
+			t.Errorf("unexpected value, wanted %v, got %v, err %v", common.Value{2}, value, err)
+		}
+		if _, _, err := forest.updateHashesFor(&root); err != nil {
+			t.Fatalf("failed to update hashes: %v", err)
+		}
+		if err := forest.Check(&root); err != nil {
+			t.Errorf("invalid trie: %v", err)
+		}
+	}
+}
+
+func TestSlotTombstones_SlotsLeftDeletedAreRemovedAtEndOfBatch(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			forest, err := OpenVolatileForest(config, ForestConfig{Mode: Mutable, CacheCapacity: 1024, DeferSlotDeletion: true})
+			if err != nil {
+				t.Fatalf("failed to open forest: %v", err)
+			}
+			trie := &LiveTrie{forest: forest}
+			defer trie.Close()
+
+			addr := common.Address{1}
+			if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+				t.Fatalf("failed to set account: %v", err)
+			}
+			if err := trie.SetValue(addr, common.Key{1}, common.Value{1}); err != nil {
+				t.Fatalf("failed to set value: %v", err)
+			}
+
+			err = trie.runBatch(func() error {
+				if err := trie.SetValue(addr, common.Key{1}, common.Value{}); err != nil {
+					return err
+				}
+				if !hasStorage(t, trie, addr) {
+					t.Errorf("deleted slot should be retained within batch")
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("failed to run batch: %v", err)
+			}
+
+			if hasStorage(t, trie, addr) {
+				t.Errorf("deleted slot should be removed at end of batch")
+			}
+			if err := trie.Check(); err != nil {
+				t.Errorf("invalid trie after batch: %v", err)
+			}
+		})
+	}
+}
+
+// hasStorage checks whether the account with the given address in the given
+// trie has a non-empty storage trie.
+func hasStorage(t *testing.T, trie *LiveTrie, addr common.Address) bool {
+	t.Helper()
+	res := false
+	err := trie.VisitTrie(MakeVisitor(func(node Node, _ NodeInfo) VisitResponse {
+		if account, ok := node.(*AccountNode); ok && account.address == addr {
+			res = !account.storage.Id().IsEmpty()
+			return VisitResponseAbort
+		}
+		return VisitResponseContinue
+	}))
+	if err != nil {
+		t.Fatalf("failed to visit trie: %v", err)
+	}
+	return res
+}
+
+// nodeLifecycleCounter is a NodeManager counting the nodes created and
+// released through it.
+type nodeLifecycleCounter struct {
+	*Forest
+	created  int
+	released int
+}
+
+func (c *nodeLifecycleCounter) createAccount() (NodeReference, shared.WriteHandle[Node], error) {
+	c.created++
+	return c.Forest.createAccount()
+}
+
+func (c *nodeLifecycleCounter) createBranch() (NodeReference, shared.WriteHandle[Node], error) {
+	c.created++
+	return c.Forest.createBranch()
+}
+
+func (c *nodeLifecycleCounter) createExtension() (NodeReference, shared.WriteHandle[Node], error) {
+	c.created++
+	return c.Forest.createExtension()
+}
+
+func (c *nodeLifecycleCounter) createValue() (NodeReference, shared.WriteHandle[Node], error) {
+	c.created++
+	return c.Forest.createValue()
+}
+
+func (c *nodeLifecycleCounter) release(ref *NodeReference) error {
+	c.released++
+	return c.Forest.release(ref)
+}
+
+func (c *nodeLifecycleCounter) releaseBatch(refs []NodeReference) error {
+	c.released += len(refs)
+	return c.Forest.releaseBatch(refs)
+}
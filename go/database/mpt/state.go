@@ -12,6 +12,8 @@ package mpt
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -19,6 +21,7 @@ import (
 	"io"
 	"maps"
 	"os"
+	"slices"
 	"sync"
 	"unsafe"
 
@@ -60,18 +63,30 @@ type Database interface {
 	GetValue(rootRef *NodeReference, addr common.Address, key common.Key) (common.Value, error)
 
 	// SetValue sets storage slot for input root, account address, and storage key.
+	// If the account does not exist, the update is ignored and the input root is
+	// returned unchanged without an error.
 	SetValue(rootRef *NodeReference, addr common.Address, key common.Key, value common.Value) (NodeReference, error)
 
+	// SetSlots updates multiple storage slots of the given account, locating
+	// the account only once. The result is the same as for a sequence of
+	// SetValue calls. The returned flag indicates whether any slot changed.
+	SetSlots(rootRef *NodeReference, addr common.Address, updates []SlotUpdate) (NodeReference, bool, error)
+
 	// ClearStorage removes all storage slots for the input address and the root.
 	ClearStorage(rootRef *NodeReference, addr common.Address) (NodeReference, error)
 
+	// HasAccount returns true if the account exists under the input root. Unlike
+	// GetAccountInfo, the account information is not retrieved.
+	HasAccount(rootRef *NodeReference, addr common.Address) (bool, error)
+
 	// HasEmptyStorage returns true if account has empty storage.
 	HasEmptyStorage(rootRef *NodeReference, addr common.Address) (bool, error)
 
 	// Freeze seals current trie, preventing further updates to it.
 	Freeze(ref *NodeReference) error
 
-	// VisitTrie allows for travertines the whole trie under the input root
+	// VisitTrie allows for travertines the whole trie under the input root.
+	// Nodes are visited in the deterministic order documented by Node.Visit.
 	VisitTrie(rootRef *NodeReference, visitor NodeVisitor) error
 
 	// Dump provides a debug print of the whole trie under the input root
@@ -144,6 +159,19 @@ type MptState struct {
 	codeMutex sync.Mutex
 	codefile  string
 	hasher    hash.Hash
+	syncer    commitSyncer      // decides when applied blocks are synced to disk
+	journal   *updateJournal    // records applied blocks for being replayed after a crash, nil if disabled
+	witness   *BlockWitnessData // witness data of the last committed block, nil if not recorded
+	selfCheck selfCheckSchedule // periodic self-checks run when committing blocks, disabled by default
+	updates   rootNotifier      // subscribers informed about committed state roots
+}
+
+// selfCheckSchedule defines the self-checks run by an MptState when
+// committing blocks.
+type selfCheckSchedule struct {
+	interval   uint64
+	sampleSize int
+	alert      func(block uint64, report SelfCheckReport, err error)
 }
 
 // The capacity of an MPT's node cache must be at least as large as the maximum
@@ -209,15 +237,107 @@ func OpenGoMemoryState(directory string, config MptConfig, cacheCapacity int) (*
 }
 
 func OpenGoFileState(directory string, config MptConfig, cacheCapacity int) (*MptState, error) {
+	return OpenGoFileStateWithConfig(directory, config, ForestConfig{CacheCapacity: cacheCapacity})
+}
+
+// OpenGoFileStateWithConfig is a variant of OpenGoFileState enabling the
+// customization of the underlying forest, e.g. to enable the tracking of
+// storage trie weights or to select a durability mode. The forest is always
+// opened in Mutable mode.
+func OpenGoFileStateWithConfig(directory string, config MptConfig, forestConfig ForestConfig) (*MptState, error) {
 	lock, err := openStateDirectory(directory)
 	if err != nil {
 		return nil, err
 	}
-	trie, err := OpenFileLiveTrie(directory, config, cacheCapacity)
+	trie, err := openFileLiveTrie(directory, config, forestConfig)
 	if err != nil {
 		return nil, err
 	}
-	return newMptState(directory, lock, trie)
+	state, err := newMptState(directory, lock, trie)
+	if err != nil {
+		return nil, err
+	}
+	state.syncer = makeCommitSyncer(forestConfig)
+	if forestConfig.UpdateJournal {
+		if err := state.openUpdateJournal(forestConfig.UpdateJournalSizeLimit); err != nil {
+			return nil, errors.Join(err, trie.Close(), lock.Release())
+		}
+	}
+	return state, nil
+}
+
+// openUpdateJournal opens the update journal in the directory of this state
+// and rolls the state forward by replaying the blocks recorded in it. This
+// requires the state persisted on disk to be intact, i.e. to be the state of
+// the last synced block; see DurabilityMode for the conditions under which
+// this is the case after a crash. Replayed blocks are synced before the
+// journal is truncated. If the replay fails, the directory remains dirty.
+func (s *MptState) openUpdateJournal(limit int64) error {
+	journal, blocks, err := openUpdateJournal(s.directory+"/"+updateJournalFile, limit)
+	if err != nil {
+		return err
+	}
+	if err := s.replayJournaledBlocks(blocks); err != nil {
+		return errors.Join(err, journal.Close())
+	}
+	s.journal = journal
+	if len(blocks) == 0 {
+		// Drops incomplete records left behind by a crash.
+		err = journal.reset()
+	} else {
+		err = s.Flush()
+	}
+	if err != nil {
+		s.journal = nil
+		return errors.Join(err, journal.Close())
+	}
+	return nil
+}
+
+// replayJournaledBlocks applies the given blocks recorded in an update
+// journal to this state, skipping blocks already covered by the state, and
+// verifies the resulting root hashes against the recorded ones.
+func (s *MptState) replayJournaledBlocks(blocks []journaledBlock) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+	hash, err := s.GetHash()
+	if err != nil {
+		return err
+	}
+	// If the process got terminated after syncing the state but before
+	// truncating the journal, the journal starts with blocks already covered
+	// by the persisted state. Since equal hashes imply equal states, the
+	// replay can start after the last block resulting in the persisted state.
+	start := 0
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if blocks[i].committed && blocks[i].hash == hash {
+			start = i + 1
+			break
+		}
+	}
+	for _, block := range blocks[start:] {
+		err := s.trie.runBatch(func() error {
+			return block.update.ApplyTo(s)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to replay block %d: %w", block.block, err)
+		}
+		got, hints, err := s.commit(block.block)
+		if hints != nil {
+			hints.Release()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to replay block %d: %w", block.block, err)
+		}
+		if block.committed && got != block.hash {
+			return fmt.Errorf("replay of block %d resulted in hash %x, recorded hash is %x", block.block, got, block.hash)
+		}
+	}
+	if logger := getLogger(s.trie.forest); logger != nil {
+		logger.Log(LogInfo, "replayed update journal", "blocks", len(blocks)-start, "directory", s.directory)
+	}
+	return nil
 }
 
 func (s *MptState) CreateAccount(address common.Address) (err error) {
@@ -236,11 +356,7 @@ func (s *MptState) CreateAccount(address common.Address) (err error) {
 }
 
 func (s *MptState) Exists(address common.Address) (bool, error) {
-	_, exists, err := s.trie.GetAccountInfo(address)
-	if err != nil {
-		return false, err
-	}
-	return exists, nil
+	return s.trie.HasAccount(address)
 }
 
 func (s *MptState) DeleteAccount(address common.Address) error {
@@ -358,6 +474,27 @@ func (s *MptState) SetCode(address common.Address, code []byte) (err error) {
 	return s.trie.SetAccountInfo(address, info)
 }
 
+// HasCode returns true if the code with the given hash is present in this
+// state. Together with SetCodeReferenceChecks, this makes the state the
+// CodeStore of its own trie.
+func (s *MptState) HasCode(hash common.Hash) (bool, error) {
+	s.codeMutex.Lock()
+	defer s.codeMutex.Unlock()
+	_, found := s.code[hash]
+	return found, nil
+}
+
+// SetCodeReferenceChecks enables or disables checking that codes referenced
+// by updated accounts are present in this state. If enabled, account updates
+// referencing missing codes fail with ErrMissingCode.
+func (s *MptState) SetCodeReferenceChecks(enabled bool) {
+	if enabled {
+		s.trie.SetCodeStore(s)
+	} else {
+		s.trie.SetCodeStore(nil)
+	}
+}
+
 func (s *MptState) GetCodeHash(address common.Address) (hash common.Hash, err error) {
 	info, exists, err := s.trie.GetAccountInfo(address)
 	if !exists || err != nil {
@@ -378,14 +515,224 @@ func (s *MptState) GetHash() (hash common.Hash, err error) {
 	return hash, err
 }
 
+// GetStateRootEthereum computes the state root hash Ethereum clients like
+// geth would compute for the accounts and storage slots of this state,
+// independently of the hashing scheme used by this state's configuration.
+// For S5 configurations, the result equals the result of GetHash. For other
+// configurations, the state is converted to Ethereum's hashing scheme, which
+// requires visiting the entire state and is thus expensive for large states.
+func (s *MptState) GetStateRootEthereum() (common.Hash, error) {
+	return s.trie.getEthereumRootHash()
+}
+
+// Apply applies the given update to this state and commits the block. If
+// enabled by the ForestConfig, branch nodes emptied by deletions are only
+// collapsed once all changes of the update have been applied. Also, if
+// enabled, the update is recorded in the update journal before it is applied.
+// The changes of the update are applied in order of their addresses and keys,
+// such that the same sequence of blocks produces byte-identical directories,
+// as detailed in update_order.go.
 func (s *MptState) Apply(block uint64, update common.Update) (archiveUpdateHints common.Releaser, err error) {
-	if err := update.ApplyTo(s); err != nil {
+	update = sortUpdate(update)
+	if s.journal != nil {
+		if err := s.journal.appendUpdate(block, &update); err != nil {
+			return nil, fmt.Errorf("failed to journal update of block %d: %w", block, err)
+		}
+	}
+	err = s.trie.runBatch(func() error {
+		return update.ApplyTo(s)
+	})
+	if err != nil {
 		return nil, err
 	}
-	_, hints, err := s.trie.UpdateHashes()
+	_, hints, err := s.commit(block)
 	return hints, err
 }
 
+// ReplayTraceBlock applies the operations of a block recorded in a trace to
+// this state and returns the resulting state hash. Other than the updates
+// processed by Apply, trace blocks do not carry contract codes.
+func (s *MptState) ReplayTraceBlock(block *TraceBlock) (common.Hash, error) {
+	err := s.trie.runBatch(func() error {
+		return block.applyTo(s.trie)
+	})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	hash, hints, err := s.commit(block.Block)
+	if hints != nil {
+		hints.Release()
+	}
+	return hash, err
+}
+
+// SubscribeRootUpdates registers a subscriber informed about the state root
+// of each block committed through Apply or ReplayTraceBlock. Updates are
+// delivered through the returned channel, buffering up to the given number
+// of updates. Committing blocks is never blocked by slow consumers; if the
+// buffer is full, the oldest pending update is dropped. The returned function
+// ends the subscription and closes the channel. Closing the state ends all
+// subscriptions.
+func (s *MptState) SubscribeRootUpdates(buffer int) (<-chan RootUpdate, func()) {
+	return s.updates.subscribe(buffer)
+}
+
+// SetTraceRecorder registers a recorder to be informed about all updates
+// applied to this state, or disables recording if nil. Each block applied
+// through Apply or ReplayTraceBlock is recorded as a block of the trace.
+func (s *MptState) SetTraceRecorder(recorder *TraceRecorder) {
+	s.trie.SetTraceRecorder(recorder)
+}
+
+// SetWitnessRecording enables or disables the recording of witness data for
+// blocks applied to this state. If enabled, the pre-state of all accounts and
+// slots touched by a block is collected and can be obtained through
+// GetBlockWitnessData once the block has been committed.
+func (s *MptState) SetWitnessRecording(enabled bool) error {
+	s.witness = nil
+	return s.trie.SetWitnessRecording(enabled)
+}
+
+// GetBlockWitnessData returns the witness data recorded for the last block
+// committed by Apply or ReplayTraceBlock, or nil if recording is disabled.
+func (s *MptState) GetBlockWitnessData() *BlockWitnessData {
+	return s.witness
+}
+
+// PruneEmptyAccounts removes accounts that are empty according to EIP-161
+// and have no storage from this state. See LiveTrie.PruneEmptyAccounts.
+func (s *MptState) PruneEmptyAccounts() (removed int, err error) {
+	return s.trie.PruneEmptyAccounts()
+}
+
+// PruneEmptyAccountsWithContext is an interruptible variant of
+// PruneEmptyAccounts. See LiveTrie.PruneEmptyAccountsWithContext.
+func (s *MptState) PruneEmptyAccountsWithContext(ctx context.Context) (removed int, err error) {
+	return s.trie.PruneEmptyAccountsWithContext(ctx)
+}
+
+// commit completes the given block after all its updates have been applied.
+func (s *MptState) commit(block uint64) (common.Hash, *NodeHashes, error) {
+	if tracking, ok := s.trie.forest.(storageWeightTracking); ok {
+		tracking.commitStorageWeights(block)
+	}
+	if s.trie.witness != nil {
+		s.witness = s.trie.witness.endBlock(block)
+	}
+	hash, hints, err := s.trie.UpdateHashes()
+	if err != nil {
+		return hash, hints, err
+	}
+	if s.selfCheck.interval > 0 && block%s.selfCheck.interval == 0 {
+		s.runScheduledSelfCheck(block)
+	}
+	if s.trie.recorder != nil {
+		if err := s.trie.recorder.EndBlock(block, hash); err != nil {
+			return hash, hints, err
+		}
+	}
+	s.updates.notify(RootUpdate{Block: block, Hash: hash})
+	if logger := getLogger(s.trie.forest); logger != nil {
+		logger.Log(LogDebug, "committed block", "block", block, "hash", hash)
+	}
+	syncDue := s.syncer.isSyncDue()
+	if s.journal != nil {
+		if err := s.journal.appendRoot(block, hash); err != nil {
+			return hash, hints, err
+		}
+		syncDue = syncDue || s.journal.isFull()
+	}
+	if syncDue {
+		err = s.Flush()
+	}
+	return hash, hints, err
+}
+
+// SelfCheck re-computes the hashes of the given number of randomly sampled
+// nodes of this state and compares them to the stored hashes. See
+// Forest.SelfCheck for details.
+func (s *MptState) SelfCheck(sampleSize int) (SelfCheckReport, error) {
+	return s.trie.SelfCheck(sampleSize)
+}
+
+// SetSelfCheckSchedule enables self-checks of the given sample size run
+// whenever a block with a number divisible by the given interval is
+// committed. If a check fails or detects hash mismatches, the given alert
+// function is called. Committing the block is not affected by the outcome
+// of the check. An interval of zero disables the checks.
+func (s *MptState) SetSelfCheckSchedule(interval uint64, sampleSize int, alert func(block uint64, report SelfCheckReport, err error)) {
+	s.selfCheck = selfCheckSchedule{
+		interval:   interval,
+		sampleSize: sampleSize,
+		alert:      alert,
+	}
+}
+
+func (s *MptState) runScheduledSelfCheck(block uint64) {
+	report, err := s.SelfCheck(s.selfCheck.sampleSize)
+	if (err != nil || report.Failed()) && s.selfCheck.alert != nil {
+		s.selfCheck.alert(block, report, err)
+	}
+}
+
+// GetHeaviestStorageTries returns the weights of up to k accounts with the
+// heaviest storage tries, ordered by decreasing weight. Weights are persisted
+// when the state is flushed. An error is returned if the tracking of storage
+// weights is not enabled for this state.
+func (s *MptState) GetHeaviestStorageTries(k int) ([]StorageTrieWeight, error) {
+	if tracking, ok := s.trie.forest.(storageWeightTracking); ok {
+		return tracking.GetHeaviestStorageTries(k)
+	}
+	return nil, storageWeightTrackingDisabledErr
+}
+
+// GetOperationStats returns histograms on the number of nodes visited by
+// lookups and updates of accounts and storage slots and on the durations of
+// their phases since the state got opened or the statistics got last reset.
+// An error is returned if neither metrics nor timings are enabled for this
+// state.
+func (s *MptState) GetOperationStats() (OperationStatsReport, error) {
+	if provider, ok := s.trie.forest.(operationStatsProvider); ok {
+		return provider.GetOperationStats()
+	}
+	return OperationStatsReport{}, operationMetricsDisabledErr
+}
+
+// ResetOperationStats discards all statistics on node visits and timings
+// collected so far. An error is returned if neither metrics nor timings are
+// enabled for this state.
+func (s *MptState) ResetOperationStats() error {
+	if provider, ok := s.trie.forest.(operationStatsProvider); ok {
+		return provider.ResetOperationStats()
+	}
+	return operationMetricsDisabledErr
+}
+
+// writtenNodesCounter is implemented by databases counting the nodes they
+// write to disk.
+type writtenNodesCounter interface {
+	GetNumberOfWrittenNodes() uint64
+}
+
+// GetNumberOfWrittenNodes returns the number of nodes written to disk since
+// this state got opened, zero if the underlying database does not count them.
+func (s *MptState) GetNumberOfWrittenNodes() uint64 {
+	if counter, ok := s.trie.forest.(writtenNodesCounter); ok {
+		return counter.GetNumberOfWrittenNodes()
+	}
+	return 0
+}
+
+// GetReleaseQueueStats provides statistics on the tries of deleted accounts
+// and cleared storages waiting to be released in the background. Zero stats
+// are returned if the underlying database does not release tries this way.
+func (s *MptState) GetReleaseQueueStats() ReleaseQueueStats {
+	if forest, ok := s.trie.forest.(*Forest); ok {
+		return forest.GetReleaseQueueStats()
+	}
+	return ReleaseQueueStats{}
+}
+
 func (s *MptState) Visit(visitor NodeVisitor) error {
 	return s.trie.VisitTrie(visitor)
 }
@@ -399,6 +746,11 @@ func (s *MptState) GetCodes() (map[common.Hash][]byte, error) {
 
 // Flush codes and state trie
 func (s *MptState) Flush() error {
+	// Forks are not persisted.
+	if s.trie.origin != nil {
+		return nil
+	}
+
 	// flush codes
 	var err error
 	s.codeMutex.Lock()
@@ -409,11 +761,36 @@ func (s *MptState) Flush() error {
 		}
 	}
 	s.codeMutex.Unlock()
-	return errors.Join(
+	err = errors.Join(
 		s.trie.forest.CheckErrors(),
 		err,
 		s.trie.Flush(),
 	)
+
+	// Journaled blocks are covered by the synced state.
+	if err == nil && s.journal != nil {
+		err = s.journal.reset()
+	}
+	return err
+}
+
+// Commit establishes a durability boundary for all updates applied so far.
+// It computes the root hash of the current state, flushes all dirty nodes
+// through the write buffer into the node stocks, persists codes and the root
+// of the state, and returns the committed root hash. If the process crashes
+// afterwards, the directory can be recovered as described for DurabilityMode,
+// yielding the returned root hash. Forks are not persisted, so committing
+// them only computes their root hash.
+func (s *MptState) Commit() (common.Hash, error) {
+	hash, err := s.GetHash()
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if err := s.Flush(); err != nil {
+		return common.Hash{}, err
+	}
+	s.syncer.markSynced()
+	return hash, nil
 }
 
 func (s *MptState) Close() error {
@@ -421,6 +798,11 @@ func (s *MptState) Close() error {
 }
 
 func (s *MptState) closeWithError(externalError error) error {
+	s.updates.close()
+	// Forks own no directory and are discarded when being closed.
+	if s.trie.origin != nil {
+		return errors.Join(externalError, s.trie.Close())
+	}
 	// Only if the state can be successfully closed, the directory is to
 	// be marked as clean. Otherwise, the dirty flag needs to be retained.
 	err := errors.Join(
@@ -428,6 +810,9 @@ func (s *MptState) closeWithError(externalError error) error {
 		s.Flush(),
 		s.trie.Close(),
 	)
+	if s.journal != nil {
+		err = errors.Join(err, s.journal.Close())
+	}
 	if err == nil {
 		err = markClean(s.directory)
 	}
@@ -437,6 +822,25 @@ func (s *MptState) closeWithError(externalError error) error {
 	)
 }
 
+// Fork creates a writable copy of this state which is fully independent of
+// this state, e.g. for speculatively applying updates. Nodes are shared
+// copy-on-write, see LiveTrie.Fork for details. Forks are not persisted.
+// Closing a fork discards it, and all forks need to be closed before this
+// state is closed.
+func (s *MptState) Fork() (LiveState, error) {
+	trie, err := s.trie.Fork()
+	if err != nil {
+		return nil, err
+	}
+	s.codeMutex.Lock()
+	code := maps.Clone(s.code)
+	s.codeMutex.Unlock()
+	return &MptState{
+		trie: trie,
+		code: code,
+	}, nil
+}
+
 func (s *MptState) GetSnapshotableComponents() []backend.Snapshotable {
 	//panic("not implemented")
 	return nil
@@ -530,7 +934,17 @@ func writeCodes(codes map[common.Hash][]byte, filename string) (err error) {
 
 func writeCodesTo(codes map[common.Hash][]byte, writer io.Writer) (err error) {
 	// The format is simple: [<key>, <length>, <code>]*
-	for key, code := range codes {
+	// Codes are written in the order of their hashes to produce the same file
+	// for the same set of codes.
+	keys := make([]common.Hash, 0, len(codes))
+	for key := range codes {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b common.Hash) int {
+		return bytes.Compare(a[:], b[:])
+	})
+	for _, key := range keys {
+		code := codes[key]
 		if _, err := writer.Write(key[:]); err != nil {
 			return err
 		}
@@ -206,6 +206,21 @@ func (mr *MockDatabaseMockRecorder) GetValue(rootRef, addr, key any) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetValue", reflect.TypeOf((*MockDatabase)(nil).GetValue), rootRef, addr, key)
 }
 
+// HasAccount mocks base method.
+func (m *MockDatabase) HasAccount(rootRef *NodeReference, addr common.Address) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HasAccount", rootRef, addr)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// HasAccount indicates an expected call of HasAccount.
+func (mr *MockDatabaseMockRecorder) HasAccount(rootRef, addr any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HasAccount", reflect.TypeOf((*MockDatabase)(nil).HasAccount), rootRef, addr)
+}
+
 // HasEmptyStorage mocks base method.
 func (m *MockDatabase) HasEmptyStorage(rootRef *NodeReference, addr common.Address) (bool, error) {
 	m.ctrl.T.Helper()
@@ -236,6 +251,22 @@ func (mr *MockDatabaseMockRecorder) SetAccountInfo(rootRef, addr, info any) *gom
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetAccountInfo", reflect.TypeOf((*MockDatabase)(nil).SetAccountInfo), rootRef, addr, info)
 }
 
+// SetSlots mocks base method.
+func (m *MockDatabase) SetSlots(rootRef *NodeReference, addr common.Address, updates []SlotUpdate) (NodeReference, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetSlots", rootRef, addr, updates)
+	ret0, _ := ret[0].(NodeReference)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// SetSlots indicates an expected call of SetSlots.
+func (mr *MockDatabaseMockRecorder) SetSlots(rootRef, addr, updates any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetSlots", reflect.TypeOf((*MockDatabase)(nil).SetSlots), rootRef, addr, updates)
+}
+
 // SetValue mocks base method.
 func (m *MockDatabase) SetValue(rootRef *NodeReference, addr common.Address, key common.Key, value common.Value) (NodeReference, error) {
 	m.ctrl.T.Helper()
@@ -55,7 +55,7 @@ func TestState_CanOnlyBeOpenedOnce(t *testing.T) {
 				}
 				if _, err := openB(dir); err == nil {
 					t.Fatalf("state should not be accessible by more than one instance")
-				} else if !strings.Contains(err.Error(), "failed to acquire file lock") {
+				} else if !strings.Contains(err.Error(), fmt.Sprintf("directory is locked for read-write access by process %d", os.Getpid())) {
 					t.Errorf("missing hint of locking issue in error: %v", err)
 				}
 				if err := state.Close(); err != nil {
@@ -245,7 +245,8 @@ func TestState_OpenGoMemoryState_CannotWrite(t *testing.T) {
 			if err := os.MkdirAll(dir, os.FileMode(0555)); err != nil {
 				t.Fatalf("cannot create dir: %s", err)
 			}
-			if _, err := open(dir); err == nil {
+			if state, err := open(dir); err == nil {
+				state.Close()
 				t.Errorf("opening a state should fail")
 			}
 		})
@@ -267,6 +268,20 @@ func TestState_OpenGoMemoryState_Corrupted_Meta(t *testing.T) {
 	}
 }
 
+// closeStateOnCleanup closes the given state once the test is done. The forest
+// replaced by a mock to inject failures is restored before, such that the
+// resources of the state are released.
+func closeStateOnCleanup(t *testing.T, state *MptState) {
+	t.Helper()
+	forest := state.trie.forest
+	t.Cleanup(func() {
+		state.trie.forest = forest
+		if err := state.Close(); err != nil {
+			t.Logf("failed to close state: %v", err)
+		}
+	})
+}
+
 func TestState_StateModifications_Failing(t *testing.T) {
 	for name, open := range mptStateFactories {
 		t.Run(name, func(t *testing.T) {
@@ -276,6 +291,7 @@ func TestState_StateModifications_Failing(t *testing.T) {
 			if err != nil {
 				t.Fatalf("cannot open state: %s", err)
 			}
+			closeStateOnCleanup(t, state)
 
 			// inject failing stock to trigger an error applying the update
 			var injectedErr = errors.New("injectedError")
@@ -283,6 +299,7 @@ func TestState_StateModifications_Failing(t *testing.T) {
 			db := NewMockDatabase(ctrl)
 			db.EXPECT().updateHashesFor(gomock.Any()).Return(common.Hash{}, nil, injectedErr).AnyTimes()
 			db.EXPECT().GetAccountInfo(gomock.Any(), gomock.Any()).Return(AccountInfo{}, false, injectedErr).AnyTimes()
+			db.EXPECT().HasAccount(gomock.Any(), gomock.Any()).Return(false, injectedErr).AnyTimes()
 			db.EXPECT().SetAccountInfo(gomock.Any(), gomock.Any(), gomock.Any()).Return(NodeReference{}, injectedErr).AnyTimes()
 			db.EXPECT().GetValue(gomock.Any(), gomock.Any(), gomock.Any()).Return(common.Value{}, injectedErr).AnyTimes()
 			db.EXPECT().SetValue(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(NodeReference{}, injectedErr).AnyTimes()
@@ -351,6 +368,7 @@ func TestState_HasEmptyStorage(t *testing.T) {
 				if err != nil {
 					t.Fatalf("cannot open state: %s", err)
 				}
+				closeStateOnCleanup(t, state)
 
 				addr := common.Address{0x1}
 				ctrl := gomock.NewController(t)
@@ -373,6 +391,7 @@ func TestState_StateModificationsWithoutErrorHaveExpectedEffects(t *testing.T) {
 			if err != nil {
 				t.Fatalf("cannot open state: %s", err)
 			}
+			defer state.Close()
 
 			balance := common.Balance{1}
 			if err := state.SetBalance(common.Address{1}, balance); err != nil {
@@ -479,6 +498,7 @@ func TestMptState_GetRootId(t *testing.T) {
 			if err != nil {
 				t.Fatalf("cannot open state: %s", err)
 			}
+			defer state.Close()
 
 			if got, want := state.GetRootId(), EmptyId(); got != want {
 				t.Errorf("values do not match: got %v != want %v", got, want)
@@ -497,6 +517,7 @@ func TestState_GetCodes(t *testing.T) {
 			if err != nil {
 				t.Fatalf("cannot open state: %s", err)
 			}
+			defer state.Close()
 
 			const size = 1000
 			for i := 1; i < size; i++ {
@@ -542,6 +563,8 @@ func TestState_ForestErrorIsReportedInFlushAndClose(t *testing.T) {
 	db.EXPECT().Flush().AnyTimes()
 	db.EXPECT().Close().AnyTimes()
 	db.EXPECT().CheckErrors().Return(injectedError).Times(2)
+	forest := state.trie.forest
+	defer forest.Close()
 	state.trie.forest = db
 
 	if want, got := injectedError, state.Flush(); !errors.Is(got, want) {
@@ -558,6 +581,7 @@ func TestState_Flush_WriteDirtyCodesOnly(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to open test state: %v", err)
 	}
+	defer state.Close()
 	if err := state.SetCode(common.Address{}, []byte{0x12}); err != nil {
 		t.Errorf("SetCode failed: %v", err)
 	}
@@ -0,0 +1,95 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+	"github.com/Fantom-foundation/Carmen/go/backend/stock/file"
+	"github.com/Fantom-foundation/Carmen/go/backend/stock/memory"
+)
+
+// StockFactory is the backend providing the stocks retaining the nodes of a
+// forest, one stock per node type. Nodes are encoded into fixed-size records
+// using the encoders passed to the factory, which are determined by the MPT
+// configuration of the forest. Implementations may store those records
+// anywhere, e.g. on local disk or in remote object storage.
+//
+// Stocks produced by a factory have to satisfy the following contracts
+// beyond those of the stock.Stock interface:
+//
+//   - Concurrency: the forest serializes all accesses to each stock, thus
+//     stocks do not have to be thread safe. However, stocks of different
+//     node types are accessed concurrently and must not share unsynchronized
+//     state.
+//   - ID allocation: New returns IDs distinct from all IDs alive in the
+//     stock. IDs of deleted nodes may be reused. IDs exceeding the capacity
+//     of the node references of the MPT configuration are refused by the
+//     forest with stock.ErrIdSpaceExhausted, so IDs should be allocated
+//     densely starting at zero.
+//   - Errors: any error returned by a stock is considered fatal and marks the
+//     forest as corrupted, unless it is a read error retried according to
+//     the ReadRetryPolicy of the forest. Stocks must not return partially
+//     decoded nodes; encoder errors have to be reported as such.
+//   - Durability: nodes set before a successful Flush or Close have to be
+//     retained when re-opening the stocks in the same directory. GetIds has
+//     to list all IDs alive in the stock, as it is used by verifications.
+//
+// The directory passed to the factory is a dedicated sub-directory of the
+// forest's directory, which backends not storing data locally may use as a
+// key for their content or ignore.
+type StockFactory interface {
+	OpenBranches(directory string, encoder stock.ValueEncoder[BranchNode]) (stock.Stock[uint64, BranchNode], error)
+	OpenExtensions(directory string, encoder stock.ValueEncoder[ExtensionNode]) (stock.Stock[uint64, ExtensionNode], error)
+	OpenAccounts(directory string, encoder stock.ValueEncoder[AccountNode]) (stock.Stock[uint64, AccountNode], error)
+	OpenValues(directory string, encoder stock.ValueEncoder[ValueNode]) (stock.Stock[uint64, ValueNode], error)
+}
+
+// FileStockFactory is the default StockFactory, keeping nodes in files on
+// local disk with a fixed-size cache of nodes being retained in memory by
+// the forest.
+type FileStockFactory struct{}
+
+func (FileStockFactory) OpenBranches(directory string, encoder stock.ValueEncoder[BranchNode]) (stock.Stock[uint64, BranchNode], error) {
+	return file.OpenStock[uint64, BranchNode](encoder, directory)
+}
+
+func (FileStockFactory) OpenExtensions(directory string, encoder stock.ValueEncoder[ExtensionNode]) (stock.Stock[uint64, ExtensionNode], error) {
+	return file.OpenStock[uint64, ExtensionNode](encoder, directory)
+}
+
+func (FileStockFactory) OpenAccounts(directory string, encoder stock.ValueEncoder[AccountNode]) (stock.Stock[uint64, AccountNode], error) {
+	return file.OpenStock[uint64, AccountNode](encoder, directory)
+}
+
+func (FileStockFactory) OpenValues(directory string, encoder stock.ValueEncoder[ValueNode]) (stock.Stock[uint64, ValueNode], error) {
+	return file.OpenStock[uint64, ValueNode](encoder, directory)
+}
+
+// InMemoryStockFactory is a StockFactory retaining all nodes in memory. The
+// nodes are loaded from the directory when being opened and written back
+// when being flushed or closed.
+type InMemoryStockFactory struct{}
+
+func (InMemoryStockFactory) OpenBranches(directory string, encoder stock.ValueEncoder[BranchNode]) (stock.Stock[uint64, BranchNode], error) {
+	return memory.OpenStock[uint64, BranchNode](encoder, directory)
+}
+
+func (InMemoryStockFactory) OpenExtensions(directory string, encoder stock.ValueEncoder[ExtensionNode]) (stock.Stock[uint64, ExtensionNode], error) {
+	return memory.OpenStock[uint64, ExtensionNode](encoder, directory)
+}
+
+func (InMemoryStockFactory) OpenAccounts(directory string, encoder stock.ValueEncoder[AccountNode]) (stock.Stock[uint64, AccountNode], error) {
+	return memory.OpenStock[uint64, AccountNode](encoder, directory)
+}
+
+func (InMemoryStockFactory) OpenValues(directory string, encoder stock.ValueEncoder[ValueNode]) (stock.Stock[uint64, ValueNode], error) {
+	return memory.OpenStock[uint64, ValueNode](encoder, directory)
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestFileStockFactory_SatisfiesStockFactoryContracts(t *testing.T) {
+	RunStockFactoryTests(t, FileStockFactory{})
+}
+
+func TestInMemoryStockFactory_SatisfiesStockFactoryContracts(t *testing.T) {
+	RunStockFactoryTests(t, InMemoryStockFactory{})
+}
+
+func TestOpenLiveTrieWithBackend_NodesAreKeptInStocksOfBackend(t *testing.T) {
+	backend := &countingStockFactory{StockFactory: InMemoryStockFactory{}}
+	trie, err := OpenLiveTrieWithBackend(t.TempDir(), backend, S5LiveConfig, ForestConfig{CacheCapacity: 1024})
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	if want, got := 4, backend.opened; want != got {
+		t.Errorf("unexpected number of opened stocks, wanted %d, got %d", want, got)
+	}
+	if err := trie.SetAccountInfo(common.Address{1}, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+		t.Fatalf("failed to set account: %v", err)
+	}
+	if err := trie.Flush(); err != nil {
+		t.Fatalf("failed to flush trie: %v", err)
+	}
+	defer trie.Close()
+	if backend.accounts == nil {
+		t.Fatalf("accounts stock not opened")
+	}
+	ids, err := backend.accounts.GetIds()
+	if err != nil {
+		t.Fatalf("failed to get ids: %v", err)
+	}
+	if ids.GetLowerBound() >= ids.GetUpperBound() {
+		t.Errorf("account should be stored in stock of backend")
+	}
+}
+
+func TestOpenLiveTrieWithBackend_FailingBackendClosesOpenedStocks(t *testing.T) {
+	injectedErr := errors.New("injected error")
+	backend := &countingStockFactory{StockFactory: InMemoryStockFactory{}, accountsErr: injectedErr}
+	if _, err := OpenLiveTrieWithBackend(t.TempDir(), backend, S5LiveConfig, ForestConfig{CacheCapacity: 1024}); !errors.Is(err, injectedErr) {
+		t.Errorf("opening trie should fail with injected error, got %v", err)
+	}
+	if want, got := 2, backend.opened; want != got {
+		t.Errorf("unexpected number of opened stocks, wanted %d, got %d", want, got)
+	}
+}
+
+// countingStockFactory wraps a StockFactory counting the number of opened
+// stocks and retaining the stock of accounts.
+type countingStockFactory struct {
+	StockFactory
+	opened      int
+	accounts    stock.Stock[uint64, AccountNode]
+	accountsErr error
+}
+
+func (f *countingStockFactory) OpenBranches(directory string, encoder stock.ValueEncoder[BranchNode]) (stock.Stock[uint64, BranchNode], error) {
+	f.opened++
+	return f.StockFactory.OpenBranches(directory, encoder)
+}
+
+func (f *countingStockFactory) OpenExtensions(directory string, encoder stock.ValueEncoder[ExtensionNode]) (stock.Stock[uint64, ExtensionNode], error) {
+	f.opened++
+	return f.StockFactory.OpenExtensions(directory, encoder)
+}
+
+func (f *countingStockFactory) OpenAccounts(directory string, encoder stock.ValueEncoder[AccountNode]) (stock.Stock[uint64, AccountNode], error) {
+	if f.accountsErr != nil {
+		return nil, f.accountsErr
+	}
+	f.opened++
+	res, err := f.StockFactory.OpenAccounts(directory, encoder)
+	f.accounts = res
+	return res, err
+}
+
+func (f *countingStockFactory) OpenValues(directory string, encoder stock.ValueEncoder[ValueNode]) (stock.Stock[uint64, ValueNode], error) {
+	f.opened++
+	return f.StockFactory.OpenValues(directory, encoder)
+}
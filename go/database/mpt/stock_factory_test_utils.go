@@ -0,0 +1,220 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// RunStockFactoryTests runs a set of black-box tests against the given
+// StockFactory, covering the contracts documented by the StockFactory
+// interface. It is intended to be used by the tests of custom backends.
+func RunStockFactoryTests(t *testing.T, factory StockFactory) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig, S5ArchiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			accounts, branches, extensions, values := getEncoder(config)
+			t.Run("Branches", func(t *testing.T) {
+				runNodeStockTests(t, factory.OpenBranches, branches, func(i int) BranchNode {
+					var node BranchNode
+					node.children[i%16] = NewNodeReference(AccountId(uint64(i)))
+					node.children[(i+1)%16] = NewNodeReference(ValueId(uint64(i)))
+					return node
+				})
+			})
+			t.Run("Extensions", func(t *testing.T) {
+				runNodeStockTests(t, factory.OpenExtensions, extensions, func(i int) ExtensionNode {
+					return ExtensionNode{
+						path: CreatePathFromNibbles([]Nibble{Nibble(i % 16), 1, 2}),
+						next: NewNodeReference(BranchId(uint64(i))),
+					}
+				})
+			})
+			t.Run("Accounts", func(t *testing.T) {
+				runNodeStockTests(t, factory.OpenAccounts, accounts, func(i int) AccountNode {
+					return AccountNode{
+						address: common.Address{byte(i), byte(i >> 8)},
+						info:    AccountInfo{Nonce: common.ToNonce(uint64(i))},
+						storage: NewNodeReference(ValueId(uint64(i))),
+					}
+				})
+			})
+			t.Run("Values", func(t *testing.T) {
+				runNodeStockTests(t, factory.OpenValues, values, func(i int) ValueNode {
+					return ValueNode{
+						key:   common.Key{byte(i), byte(i >> 8)},
+						value: common.Value{byte(i + 1)},
+					}
+				})
+			})
+		})
+	}
+	t.Run("LiveTrie", func(t *testing.T) {
+		testStockFactoryBackedLiveTrie(t, factory)
+	})
+}
+
+// runNodeStockTests checks the stocks opened by the given function for the
+// given node type. Nodes are compared by their encoding since encoders only
+// retain the parts of nodes relevant for the respective configuration.
+func runNodeStockTests[V any](
+	t *testing.T,
+	open func(string, stock.ValueEncoder[V]) (stock.Stock[uint64, V], error),
+	encoder stock.ValueEncoder[V],
+	createNode func(int) V,
+) {
+	encode := func(node V) []byte {
+		res := make([]byte, encoder.GetEncodedSize())
+		if err := encoder.Store(res, &node); err != nil {
+			t.Fatalf("failed to encode node: %v", err)
+		}
+		return res
+	}
+	check := func(stock stock.Stock[uint64, V], id uint64, want V) {
+		t.Helper()
+		got, err := stock.Get(id)
+		if err != nil {
+			t.Fatalf("failed to get node %d: %v", id, err)
+		}
+		if !bytes.Equal(encode(want), encode(got)) {
+			t.Errorf("unexpected node %d, wanted %v, got %v", id, want, got)
+		}
+	}
+
+	const numNodes = 100
+	directory := t.TempDir() + "/nodes"
+	nodes, err := open(directory, encoder)
+	if err != nil {
+		t.Fatalf("failed to open stock: %v", err)
+	}
+
+	ids := map[uint64]int{}
+	for i := 0; i < numNodes; i++ {
+		id, err := nodes.New()
+		if err != nil {
+			t.Fatalf("failed to allocate id: %v", err)
+		}
+		if _, found := ids[id]; found {
+			t.Fatalf("id %d allocated twice", id)
+		}
+		if id >= 2*numNodes {
+			t.Errorf("ids should be allocated densely, got %d after %d allocations", id, i)
+		}
+		ids[id] = i
+		if err := nodes.Set(id, createNode(i)); err != nil {
+			t.Fatalf("failed to set node %d: %v", id, err)
+		}
+	}
+	for id, i := range ids {
+		check(nodes, id, createNode(i))
+	}
+
+	// Deleted IDs are no longer listed and may be reused.
+	for id, i := range ids {
+		if i%2 == 0 {
+			if err := nodes.Delete(id); err != nil {
+				t.Fatalf("failed to delete node %d: %v", id, err)
+			}
+			delete(ids, id)
+		}
+	}
+	if err := nodes.Flush(); err != nil {
+		t.Fatalf("failed to flush stock: %v", err)
+	}
+	if err := nodes.Close(); err != nil {
+		t.Fatalf("failed to close stock: %v", err)
+	}
+
+	// The content is retained when re-opening the stock.
+	nodes, err = open(directory, encoder)
+	if err != nil {
+		t.Fatalf("failed to re-open stock: %v", err)
+	}
+	defer func() {
+		if err := nodes.Close(); err != nil {
+			t.Errorf("failed to close stock: %v", err)
+		}
+	}()
+	set, err := nodes.GetIds()
+	if err != nil {
+		t.Fatalf("failed to get ids: %v", err)
+	}
+	for id, i := range ids {
+		if !set.Contains(id) {
+			t.Errorf("id %d of live node is not listed", id)
+		}
+		check(nodes, id, createNode(i))
+	}
+	id, err := nodes.New()
+	if err != nil {
+		t.Fatalf("failed to allocate id: %v", err)
+	}
+	if _, found := ids[id]; found {
+		t.Errorf("id %d of live node allocated again", id)
+	}
+}
+
+// testStockFactoryBackedLiveTrie checks that a LiveTrie using the given
+// backend retains its content when being re-opened.
+func testStockFactoryBackedLiveTrie(t *testing.T, factory StockFactory) {
+	directory := t.TempDir()
+	config := ForestConfig{CacheCapacity: 1024}
+	trie, err := OpenLiveTrieWithBackend(directory, factory, S5LiveConfig, config)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		addr := common.Address{byte(i)}
+		if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(uint64(i + 1))}); err != nil {
+			t.Fatalf("failed to set account %v: %v", addr, err)
+		}
+		if err := trie.SetValue(addr, common.Key{byte(i)}, common.Value{byte(i + 1)}); err != nil {
+			t.Fatalf("failed to set value of account %v: %v", addr, err)
+		}
+	}
+	hash, _, err := trie.UpdateHashes()
+	if err != nil {
+		t.Fatalf("failed to hash trie: %v", err)
+	}
+	if err := trie.Close(); err != nil {
+		t.Fatalf("failed to close trie: %v", err)
+	}
+
+	trie, err = OpenLiveTrieWithBackend(directory, factory, S5LiveConfig, config)
+	if err != nil {
+		t.Fatalf("failed to re-open trie: %v", err)
+	}
+	defer func() {
+		if err := trie.Close(); err != nil {
+			t.Errorf("failed to close trie: %v", err)
+		}
+	}()
+	if got, _, err := trie.UpdateHashes(); err != nil || got != hash {
+		t.Errorf("unexpected hash after re-opening, wanted %x, got %x, err %v", hash, got, err)
+	}
+	for i := 0; i < 100; i++ {
+		addr := common.Address{byte(i)}
+		info, found, err := trie.GetAccountInfo(addr)
+		if err != nil || !found || info.Nonce != common.ToNonce(uint64(i+1)) {
+			t.Errorf("unexpected account %v: %v, %t, %v", addr, info, found, err)
+		}
+		value, err := trie.GetValue(addr, common.Key{byte(i)})
+		if err != nil || value != (common.Value{byte(i + 1)}) {
+			t.Errorf("unexpected value of account %v: %v, %v", addr, value, err)
+		}
+	}
+	if err := trie.Check(); err != nil {
+		t.Errorf("trie check failed: %v", err)
+	}
+}
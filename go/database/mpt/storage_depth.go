@@ -0,0 +1,136 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// ErrDepthLimitExceeded is reported by slot updates which would create nodes
+// in storage tries deeper than the MaxStorageDepth of the MptConfig. The
+// reported errors are of type *DepthLimitExceededError, naming the slot.
+const ErrDepthLimitExceeded = common.ConstError("storage depth limit exceeded")
+
+// DepthLimitExceededError is the error reported when refusing to insert a
+// slot since the resulting storage trie would exceed the depth limit.
+type DepthLimitExceededError struct {
+	Account common.Address // the account of the refused slot
+	Key     common.Key     // the key of the refused slot
+	Depth   int            // the depth of the deepest node the insert would create
+	Limit   int            // the configured maximum depth
+}
+
+func (e *DepthLimitExceededError) Error() string {
+	return fmt.Sprintf("%v: inserting slot %x of account %x requires depth %d, limit is %d", ErrDepthLimitExceeded, e.Key, e.Account, e.Depth, e.Limit)
+}
+
+func (e *DepthLimitExceededError) Unwrap() error {
+	return ErrDepthLimitExceeded
+}
+
+// checkStorageDepth verifies that applying the given updates to the storage
+// trie rooted by the given node does not create nodes deeper than the given
+// limit. Depths are measured in nibbles of the path from the root of the
+// storage trie, including the paths of extension nodes, such that the root
+// is at depth 0. Within a batch of updates, keys inserted by earlier updates
+// are taken into account, while deletions are not. Thus, the check is exact
+// for individual updates and conservative for batches.
+func checkStorageDepth(source NodeSource, storage *NodeReference, address common.Address, updates []SlotUpdate, limit int) error {
+	var pathBuffer, otherBuffer nibblePathBuffer
+
+	var inserted []common.Key
+	for _, update := range updates {
+		if update.Value == (common.Value{}) {
+			continue // deletions never create nodes
+		}
+		path := pathBuffer.setKey(update.Key, source)
+		depth, created, err := getInsertionDepth(source, storage, update.Key, path)
+		if err != nil {
+			return err
+		}
+		if !created || slices.Contains(inserted, update.Key) {
+			continue // updates of present slots do not create nodes
+		}
+		// Keys inserted by earlier updates of the batch may push the new value
+		// further down the trie.
+		for _, key := range inserted {
+			other := otherBuffer.setKey(key, source)
+			if d := getCommonPrefixLength(path, other) + 1; d > depth {
+				depth = d
+			}
+		}
+		if depth > limit {
+			return &DepthLimitExceededError{Account: address, Key: update.Key, Depth: depth, Limit: limit}
+		}
+		inserted = append(inserted, update.Key)
+	}
+	return nil
+}
+
+// getInsertionDepth determines the depth of the deepest node created when
+// inserting a value with the given key and path into the storage trie rooted
+// by the given node. If the key is already present, no nodes are created and
+// false is returned.
+func getInsertionDepth(source NodeSource, root *NodeReference, key common.Key, path []Nibble) (int, bool, error) {
+	var buffer nibblePathBuffer
+	ref, depth := *root, 0
+	for {
+		handle, err := source.getViewAccess(&ref)
+		if err != nil {
+			return 0, false, err
+		}
+		switch n := handle.Get().(type) {
+		case EmptyNode:
+			handle.Release()
+			return depth, true, nil
+		case *ExtensionNode:
+			common := n.path.GetCommonPrefixLength(path)
+			if common < n.path.Length() {
+				// The extension is split by a branch node holding the new value.
+				handle.Release()
+				return depth + common + 1, true, nil
+			}
+			ref, depth, path = n.next, depth+common, path[common:]
+			handle.Release()
+		case *BranchNode:
+			next := n.children[path[0]]
+			handle.Release()
+			if next.Id().IsEmpty() {
+				return depth + 1, true, nil
+			}
+			ref, depth, path = next, depth+1, path[1:]
+		case *ValueNode:
+			if n.key == key {
+				handle.Release()
+				return 0, false, nil
+			}
+			// The value is moved below a branch node at the end of the common path.
+			other := buffer.setKey(n.key, source)
+			handle.Release()
+			return depth + getCommonPrefixLength(path, other[depth:]) + 1, true, nil
+		default:
+			handle.Release()
+			return 0, false, fmt.Errorf("unexpected node type %T in storage trie", n)
+		}
+	}
+}
+
+// getCommonPrefixLength returns the length of the common prefix of the given paths.
+func getCommonPrefixLength(a, b []Nibble) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
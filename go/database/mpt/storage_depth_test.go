@@ -0,0 +1,291 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestStorageDepth_InsertsAreCheckedAgainstLimit(t *testing.T) {
+	// Without hashed paths, the keys below share a common prefix of 4 nibbles,
+	// placing them below an extension of length 4 and a branch at depth 4.
+	first := common.Key{0x12, 0x34, 0x50}
+	second := common.Key{0x12, 0x34, 0x60}
+	const depth = 5
+
+	for _, limit := range []int{depth - 1, depth, depth + 1} {
+		t.Run(fmt.Sprintf("limit=%d", limit), func(t *testing.T) {
+			config := S4LiveConfig
+			config.MaxStorageDepth = limit
+			trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer trie.Close()
+
+			addr := common.Address{1}
+			if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+				t.Fatalf("failed to create account: %v", err)
+			}
+			if err := trie.SetValue(addr, first, common.Value{1}); err != nil {
+				t.Fatalf("failed to set value: %v", err)
+			}
+			before, _, err := trie.UpdateHashes()
+			if err != nil {
+				t.Fatalf("failed to update hashes: %v", err)
+			}
+
+			err = trie.SetValue(addr, second, common.Value{2})
+			if limit >= depth {
+				if err != nil {
+					t.Fatalf("insert at depth %d should be accepted with limit %d: %v", depth, limit, err)
+				}
+				return
+			}
+
+			var depthErr *DepthLimitExceededError
+			if !errors.As(err, &depthErr) {
+				t.Fatalf("insert at depth %d should be refused with limit %d, got %v", depth, limit, err)
+			}
+			if !errors.Is(err, ErrDepthLimitExceeded) {
+				t.Errorf("unexpected error: %v", err)
+			}
+			want := DepthLimitExceededError{Account: addr, Key: second, Depth: depth, Limit: limit}
+			if *depthErr != want {
+				t.Errorf("unexpected error details, wanted %+v, got %+v", want, *depthErr)
+			}
+			after, _, err := trie.UpdateHashes()
+			if err != nil {
+				t.Fatalf("failed to update hashes: %v", err)
+			}
+			if before != after {
+				t.Errorf("refused insert modified the trie")
+			}
+			if value, err := trie.GetValue(addr, second); err != nil || value != (common.Value{}) {
+				t.Errorf("refused value should not be present, got %v, err %v", value, err)
+			}
+
+			// Updates of present slots and deletions are not affected.
+			if err := trie.SetValue(addr, first, common.Value{3}); err != nil {
+				t.Errorf("failed to update present value: %v", err)
+			}
+			if err := trie.SetValue(addr, second, common.Value{}); err != nil {
+				t.Errorf("failed to delete missing value: %v", err)
+			}
+			if err := trie.Check(); err != nil {
+				t.Errorf("trie is inconsistent: %v", err)
+			}
+		})
+	}
+}
+
+func TestStorageDepth_ZeroLimitDisablesCheck(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S4LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+
+	addr := common.Address{1}
+	if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+	// Keys differing only in the last nibble create the deepest possible trie.
+	for i := 0; i < 2; i++ {
+		if err := trie.SetValue(addr, common.Key{31: byte(i)}, common.Value{1}); err != nil {
+			t.Fatalf("failed to set value: %v", err)
+		}
+	}
+}
+
+func TestStorageDepth_BatchesAccountForEarlierInserts(t *testing.T) {
+	config := S4LiveConfig
+	config.MaxStorageDepth = 2
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+
+	addr := common.Address{1}
+	if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+	// Each key fits into the empty storage, but together they need depth 3.
+	updates := []SlotUpdate{
+		{Key: common.Key{0x12, 0x30}, Value: common.Value{1}},
+		{Key: common.Key{0x12, 0x40}, Value: common.Value{2}},
+	}
+	_, err = trie.SetSlots(addr, updates)
+	var depthErr *DepthLimitExceededError
+	if !errors.As(err, &depthErr) {
+		t.Fatalf("batch exceeding the limit should be refused, got %v", err)
+	}
+	if depthErr.Key != updates[1].Key || depthErr.Depth != 3 {
+		t.Errorf("unexpected error details: %+v", *depthErr)
+	}
+	for _, update := range updates {
+		if value, err := trie.GetValue(addr, update.Key); err != nil || value != (common.Value{}) {
+			t.Errorf("no value of refused batch should be present, got %v, err %v", value, err)
+		}
+	}
+
+	// Batches within the limit are accepted, including repeated keys.
+	updates = []SlotUpdate{
+		{Key: common.Key{0x12, 0x30}, Value: common.Value{1}},
+		{Key: common.Key{0x13}, Value: common.Value{2}},
+		{Key: common.Key{0x12, 0x30}, Value: common.Value{3}},
+	}
+	if _, err := trie.SetSlots(addr, updates); err != nil {
+		t.Fatalf("batch within the limit should be accepted: %v", err)
+	}
+}
+
+func TestStorageDepth_LimitIsExactForIndividualInserts(t *testing.T) {
+	const limit = 2
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig, S5LiveNoExtensionsConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			limited := config
+			limited.MaxStorageDepth = limit
+			trie, err := OpenInMemoryLiveTrie(t.TempDir(), limited, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer trie.Close()
+
+			// The reference trie without limit is used to check refused inserts.
+			reference, err := OpenInMemoryLiveTrie(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open trie: %v", err)
+			}
+			defer reference.Close()
+
+			addr := common.Address{1}
+			for _, trie := range []*LiveTrie{trie, reference} {
+				if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+					t.Fatalf("failed to create account: %v", err)
+				}
+			}
+
+			r := rand.New(rand.NewSource(42))
+			accepted, refused := 0, 0
+			for i := 0; i < 100; i++ {
+				var key common.Key
+				r.Read(key[:2])
+				if err := reference.SetValue(addr, key, common.Value{1}); err != nil {
+					t.Fatalf("failed to set value: %v", err)
+				}
+				err := trie.SetValue(addr, key, common.Value{1})
+				if err == nil {
+					accepted++
+					if depth := getMaxStorageDepth(t, trie); depth > limit {
+						t.Fatalf("accepted insert of %x resulted in depth %d", key, depth)
+					}
+					continue
+				}
+				if !errors.Is(err, ErrDepthLimitExceeded) {
+					t.Fatalf("failed to set value: %v", err)
+				}
+				refused++
+				if depth := getMaxStorageDepth(t, reference); depth <= limit {
+					t.Fatalf("refused insert of %x would have resulted in depth %d", key, depth)
+				}
+				if err := reference.SetValue(addr, key, common.Value{}); err != nil {
+					t.Fatalf("failed to delete value: %v", err)
+				}
+			}
+			if accepted == 0 || refused == 0 {
+				t.Errorf("test should cover accepted and refused inserts, got %d and %d", accepted, refused)
+			}
+			if err := trie.Check(); err != nil {
+				t.Errorf("trie is inconsistent: %v", err)
+			}
+		})
+	}
+}
+
+func TestStorageDepth_RefusedInsertsLeaveFrozenTriesUnmodified(t *testing.T) {
+	config := S4ArchiveConfig
+	config.MaxStorageDepth = 3
+	forest, err := OpenInMemoryForest(t.TempDir(), config, ForestConfig{Mode: Immutable, CacheCapacity: 1024})
+	if err != nil {
+		t.Fatalf("failed to open forest: %v", err)
+	}
+	defer forest.Close()
+
+	addr := common.Address{1}
+	root := NewNodeReference(EmptyId())
+	root, err = forest.SetAccountInfo(&root, addr, AccountInfo{Nonce: common.ToNonce(1)})
+	if err != nil {
+		t.Fatalf("failed to set account: %v", err)
+	}
+	root, err = forest.SetValue(&root, addr, common.Key{0x12, 0x30}, common.Value{1})
+	if err != nil {
+		t.Fatalf("failed to set value: %v", err)
+	}
+	hash, _, err := forest.updateHashesFor(&root)
+	if err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+	if err := forest.Freeze(&root); err != nil {
+		t.Fatalf("failed to freeze trie: %v", err)
+	}
+
+	// An insert requiring depth 4 is refused.
+	if _, err := forest.SetValue(&root, addr, common.Key{0x12, 0x34}, common.Value{2}); !errors.Is(err, ErrDepthLimitExceeded) {
+		t.Fatalf("insert exceeding the limit should be refused, got %v", err)
+	}
+	// An insert requiring depth 3 creates a modified copy.
+	modified, err := forest.SetValue(&root, addr, common.Key{0x12, 0x40}, common.Value{2})
+	if err != nil {
+		t.Fatalf("failed to set value: %v", err)
+	}
+	if modified == root {
+		t.Errorf("insert into frozen trie should create a new root")
+	}
+	if _, _, err := forest.updateHashesFor(&modified); err != nil {
+		t.Fatalf("failed to update hashes: %v", err)
+	}
+
+	if got, _, err := forest.updateHashesFor(&root); err != nil || got != hash {
+		t.Errorf("frozen trie was modified, wanted hash %x, got %x, err %v", hash, got, err)
+	}
+	for _, ref := range []*NodeReference{&root, &modified} {
+		if err := forest.Check(ref); err != nil {
+			t.Errorf("trie is inconsistent: %v", err)
+		}
+	}
+	if err := forest.Flush(); err != nil {
+		t.Errorf("refused inserts should not be recorded as forest failures: %v", err)
+	}
+}
+
+// getMaxStorageDepth returns the maximum depth of values in the storage tries
+// of the given trie.
+func getMaxStorageDepth(t *testing.T, trie *LiveTrie) int {
+	t.Helper()
+	res := 0
+	err := trie.VisitTrie(MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+		if _, ok := node.(*ValueNode); ok && len(info.Path) > res {
+			res = len(info.Path)
+		}
+		return VisitResponseContinue
+	}))
+	if err != nil {
+		t.Fatalf("failed to visit trie: %v", err)
+	}
+	return res
+}
@@ -0,0 +1,276 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// VerifyAccountStorage validates the storage trie of a single account in the
+// live or archive forest stored in the given directory. For archives, the
+// state of the last block is checked. See VerifyArchiveAccountStorage for
+// details on the performed checks.
+func VerifyAccountStorage(directory string, config MptConfig, addr common.Address, observer VerificationObserver) error {
+	metadata, exists, err := readMetadata(directory + "/meta.json")
+	if err != nil {
+		return err
+	}
+	if exists {
+		return verifyAccountStorage(directory, config, NewNodeReference(metadata.RootNode), addr, observer)
+	}
+	roots, err := loadRoots(directory+"/roots.dat", getNodeIdEncoder(config))
+	if err != nil {
+		return err
+	}
+	if roots.length() == 0 {
+		return fmt.Errorf("no live state or archive found in %s", directory)
+	}
+	return verifyAccountStorage(directory, config, roots.get(uint64(roots.length()-1)).NodeRef, addr, observer)
+}
+
+// VerifyArchiveAccountStorage validates the storage trie of a single account
+// at the given block of the archive stored in the given directory. Unlike a
+// full verification, only the nodes of the account's storage trie are read.
+// Checks include:
+//   - the account exists at the given block
+//   - all nodes of the storage trie can be read
+//   - structural invariants of branch, extension, and value nodes hold
+//   - the hashes of all nodes, re-computed from the leaves up, match the
+//     stored hashes, including the storage hash of the account
+//
+// The first detected violation is reported including the ID of the affected
+// node and its path within the storage trie.
+func VerifyArchiveAccountStorage(directory string, config MptConfig, block uint64, addr common.Address, observer VerificationObserver) error {
+	if _, err := os.Stat(directory + "/roots.dat"); err != nil {
+		return fmt.Errorf("no archive found in %s: %w", directory, err)
+	}
+	roots, err := loadRoots(directory+"/roots.dat", getNodeIdEncoder(config))
+	if err != nil {
+		return err
+	}
+	if block >= uint64(roots.length()) {
+		return fmt.Errorf("block %d not present in archive, highest block is %d", block, roots.length()-1)
+	}
+	return verifyAccountStorage(directory, config, roots.get(block).NodeRef, addr, observer)
+}
+
+func verifyAccountStorage(directory string, config MptConfig, root NodeReference, addr common.Address, observer VerificationObserver) (res error) {
+	if observer == nil {
+		observer = NilVerificationObserver{}
+	}
+
+	observer.StartVerification()
+	defer func() {
+		observer.EndVerification(res)
+	}()
+
+	observer.Progress("Obtaining read access to files ...")
+	source, err := openVerificationNodeSource(directory, config)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	observer.Progress(fmt.Sprintf("Locating account %x ...", addr))
+	var account *AccountNode
+	var accountId NodeId
+	_, err = VisitPathToAccount(source, &root, addr, MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+		if a, ok := node.(*AccountNode); ok && a.address == addr {
+			account = a
+			accountId = info.Id
+		}
+		return VisitResponseContinue
+	}))
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return fmt.Errorf("account %x not found", addr)
+	}
+
+	observer.Progress(fmt.Sprintf("Checking storage trie of account %x rooted by %v ...", addr, account.storage.Id()))
+	verifier := &storageVerifier{
+		source: source,
+		hasher: config.Hashing.createHasher(config.HashFunction),
+	}
+	hash, _, err := verifier.verify(account.storage, nil)
+	if err != nil {
+		return err
+	}
+
+	if config.HashStorageLocation == HashStoredWithParent {
+		// The storage hash of accounts without storage is not maintained.
+		if account.storage.Id().IsEmpty() {
+			return nil
+		}
+		if got := account.storageHash; got != hash {
+			return fmt.Errorf("inconsistent storage hash in account node %v, stored %v, computed %v", accountId, got, hash)
+		}
+		return nil
+	}
+
+	// If hashes are stored with nodes, the storage hash is covered by the
+	// hash of the account node.
+	account.storageHash = hash
+	account.storageHashDirty = false
+	want, err := verifier.hash(account)
+	if err != nil {
+		return err
+	}
+	if got, _ := account.GetHash(); got != want {
+		return fmt.Errorf("inconsistent hash for account node %v, stored %v, computed %v", accountId, got, want)
+	}
+	return nil
+}
+
+// storageVerifier re-computes the hashes of a storage trie while checking
+// structural invariants of the visited nodes.
+type storageVerifier struct {
+	source *verificationNodeSource
+	hasher hasher
+}
+
+// verify checks the sub-trie rooted by the given node located at the given
+// path in the storage trie. It returns the computed hash of the node and
+// whether the node is embedded in its parent.
+func (v *storageVerifier) verify(ref NodeReference, path []Nibble) (common.Hash, bool, error) {
+	id := ref.Id()
+	if !v.source.isValid(id) {
+		return common.Hash{}, false, fmt.Errorf("invalid reference to node %v at path %s", id, formatNibblePath(path))
+	}
+	handle, err := v.source.getReadAccess(&ref)
+	if err != nil {
+		return common.Hash{}, false, fmt.Errorf("failed to read node %v at path %s: %w", id, formatNibblePath(path), err)
+	}
+	node := handle.Get()
+	handle.Release()
+
+	hashWithParent := v.source.getConfig().HashStorageLocation == HashStoredWithParent
+	switch n := node.(type) {
+	case EmptyNode:
+		hash, err := v.hash(n)
+		return hash, false, err
+
+	case *BranchNode:
+		numChildren := 0
+		for i := range n.children {
+			child := n.children[i]
+			if child.Id().IsEmpty() {
+				continue
+			}
+			numChildren++
+			hash, embedded, err := v.verify(child, append(path, Nibble(i)))
+			if err != nil {
+				return common.Hash{}, false, err
+			}
+			if hashWithParent && !embedded && n.hashes[i] != hash {
+				return common.Hash{}, false, fmt.Errorf("inconsistent hash for node %v at path %s, stored %v, computed %v", child.Id(), formatNibblePath(append(path, Nibble(i))), n.hashes[i], hash)
+			}
+			n.hashes[i] = hash
+			n.setEmbedded(byte(i), embedded)
+		}
+		n.dirtyHashes = 0
+		if numChildren < 2 {
+			return common.Hash{}, false, fmt.Errorf("branch node %v at path %s has an insufficient number of child nodes: %d", id, formatNibblePath(path), numChildren)
+		}
+
+	case *ExtensionNode:
+		if n.path.Length() == 0 {
+			return common.Hash{}, false, fmt.Errorf("extension node %v at path %s has an empty path", id, formatNibblePath(path))
+		}
+		if !n.next.Id().IsBranch() {
+			return common.Hash{}, false, fmt.Errorf("extension node %v at path %s is not followed by a branch node but by %v", id, formatNibblePath(path), n.next.Id())
+		}
+		next := path
+		for i := 0; i < n.path.Length(); i++ {
+			next = append(next, n.path.Get(i))
+		}
+		hash, embedded, err := v.verify(n.next, next)
+		if err != nil {
+			return common.Hash{}, false, err
+		}
+		if hashWithParent && !embedded && n.nextHash != hash {
+			return common.Hash{}, false, fmt.Errorf("inconsistent hash for node %v at path %s, stored %v, computed %v", n.next.Id(), formatNibblePath(next), n.nextHash, hash)
+		}
+		n.nextHash = hash
+		n.nextHashDirty = false
+		n.nextIsEmbedded = embedded
+
+	case *ValueNode:
+		var buffer nibblePathBuffer
+		keyPath := buffer.setKey(n.key, v.source)
+		if len(path) > len(keyPath) || !isPrefixOf(path, keyPath) {
+			return common.Hash{}, false, fmt.Errorf("value node %v for key %x is located at invalid path %s", id, n.key, formatNibblePath(path))
+		}
+		if n.value == (common.Value{}) {
+			return common.Hash{}, false, fmt.Errorf("value node %v at path %s has a zero value", id, formatNibblePath(path))
+		}
+		if v.source.getConfig().TrackSuffixLengthsInLeafNodes {
+			if want, got := len(keyPath)-len(path), int(n.pathLength); want != got {
+				return common.Hash{}, false, fmt.Errorf("value node %v at path %s has invalid suffix length, wanted %d, got %d", id, formatNibblePath(path), want, got)
+			}
+		}
+
+	default:
+		return common.Hash{}, false, fmt.Errorf("unexpected node %v at path %s in storage trie", id, formatNibblePath(path))
+	}
+
+	hash, err := v.hash(node)
+	if err != nil {
+		return common.Hash{}, false, err
+	}
+	embedded, err := v.hasher.isEmbedded(node, v.source)
+	if err != nil {
+		return common.Hash{}, false, err
+	}
+	if !hashWithParent && !embedded {
+		if got, _ := node.GetHash(); got != hash {
+			return common.Hash{}, false, fmt.Errorf("inconsistent hash for node %v at path %s, stored %v, computed %v", id, formatNibblePath(path), got, hash)
+		}
+	}
+	return hash, embedded, nil
+}
+
+// hash computes the hash of the given node based on the child hashes stored
+// in the node.
+func (v *storageVerifier) hash(node Node) (common.Hash, error) {
+	overrideId := ValueId((^uint64(0)) >> 2)
+	if _, ok := node.(EmptyNode); ok {
+		overrideId = EmptyId()
+	}
+	v.source.setNodeOverride(overrideId, node)
+	defer v.source.clearOverride()
+	ref := NewNodeReference(overrideId)
+	return v.hasher.getHash(&ref, v.source)
+}
+
+func isPrefixOf(prefix, path []Nibble) bool {
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func formatNibblePath(path []Nibble) string {
+	var builder strings.Builder
+	builder.WriteRune('[')
+	for _, nibble := range path {
+		builder.WriteRune(nibble.Rune())
+	}
+	builder.WriteRune(']')
+	return builder.String()
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock/file"
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"go.uber.org/mock/gomock"
+)
+
+var (
+	storageTestAccount      = common.Address{1}
+	storageTestEmptyAccount = common.Address{2}
+	storageTestMissing      = common.Address{3}
+)
+
+func getStorageVerificationTestUpdate(block int) common.Update {
+	update := common.Update{}
+	if block == 0 {
+		update.CreatedAccounts = []common.Address{storageTestAccount, storageTestEmptyAccount}
+		update.Nonces = []common.NonceUpdate{
+			{Account: storageTestAccount, Nonce: common.ToNonce(1)},
+			{Account: storageTestEmptyAccount, Nonce: common.ToNonce(1)},
+		}
+	}
+	for i := 0; i < 50; i++ {
+		update.Slots = append(update.Slots, common.SlotUpdate{
+			Account: storageTestAccount,
+			Key:     common.Key{byte(i), byte(block)},
+			Value:   common.Value{byte(i), byte(block), 1},
+		})
+	}
+	return update
+}
+
+// fillStorageVerificationTestDirectory creates a live state or an archive with
+// two blocks in the given directory, depending on the configuration.
+func fillStorageVerificationTestDirectory(t *testing.T, dir string, config MptConfig) {
+	t.Helper()
+	if config.HashStorageLocation == HashStoredWithParent {
+		state, err := OpenGoFileState(dir, config, 1024)
+		if err != nil {
+			t.Fatalf("failed to open state: %v", err)
+		}
+		for block := 0; block < 2; block++ {
+			if _, err := state.Apply(uint64(block), getStorageVerificationTestUpdate(block)); err != nil {
+				t.Fatalf("failed to apply update: %v", err)
+			}
+		}
+		if err := state.Close(); err != nil {
+			t.Fatalf("failed to close state: %v", err)
+		}
+		return
+	}
+	archive, err := OpenArchiveTrie(dir, config, 1024)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	for block := 0; block < 2; block++ {
+		if err := archive.Add(uint64(block), getStorageVerificationTestUpdate(block), nil); err != nil {
+			t.Fatalf("failed to add block: %v", err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+}
+
+func TestVerifyAccountStorage_ValidStorageIsAccepted(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			fillStorageVerificationTestDirectory(t, dir, config)
+
+			for _, addr := range []common.Address{storageTestAccount, storageTestEmptyAccount} {
+				if err := VerifyAccountStorage(dir, config, addr, nil); err != nil {
+					t.Errorf("unexpected error for account %x: %v", addr, err)
+				}
+			}
+			if err := VerifyAccountStorage(dir, config, storageTestMissing, nil); err == nil || !strings.Contains(err.Error(), "not found") {
+				t.Errorf("missing account should be reported, got %v", err)
+			}
+
+			if config.HashStorageLocation == HashStoredWithParent {
+				return
+			}
+			for block := uint64(0); block < 2; block++ {
+				if err := VerifyArchiveAccountStorage(dir, config, block, storageTestAccount, nil); err != nil {
+					t.Errorf("unexpected error for block %d: %v", block, err)
+				}
+			}
+			if err := VerifyArchiveAccountStorage(dir, config, 2, storageTestAccount, nil); err == nil {
+				t.Errorf("verification of missing block should fail")
+			}
+		})
+	}
+}
+
+func TestVerifyAccountStorage_ModifiedValueIsDetected(t *testing.T) {
+	for _, config := range allMptConfigs {
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			fillStorageVerificationTestDirectory(t, dir, config)
+
+			_, _, _, encoder := getEncoder(config)
+			modifyNode(t, dir+"/values", encoder, func(node *ValueNode) {
+				node.value[12]++
+			})
+
+			err := VerifyAccountStorage(dir, config, storageTestAccount, nil)
+			if err == nil {
+				t.Fatalf("modified value should have been detected")
+			}
+			if !strings.Contains(err.Error(), "inconsistent hash for node V-") || !strings.Contains(err.Error(), "at path [") {
+				t.Errorf("error should name the modified node and its path, got %v", err)
+			}
+
+			// The storage of other accounts is not affected.
+			if err := VerifyAccountStorage(dir, config, storageTestEmptyAccount, nil); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyAccountStorage_ModifiedStorageHashIsDetected(t *testing.T) {
+	for _, config := range allMptConfigs {
+		if config.HashStorageLocation != HashStoredWithParent {
+			continue
+		}
+		t.Run(config.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			fillStorageVerificationTestDirectory(t, dir, config)
+
+			// Modify the storage hash of all accounts.
+			encoder, _, _, _ := getEncoder(config)
+			accounts, err := file.OpenStock[uint64](encoder, dir+"/accounts")
+			if err != nil {
+				t.Fatalf("failed to open stock: %v", err)
+			}
+			ids, err := accounts.GetIds()
+			if err != nil {
+				t.Fatalf("failed to get ids: %v", err)
+			}
+			for i := ids.GetLowerBound(); i < ids.GetUpperBound(); i++ {
+				if !ids.Contains(i) {
+					continue
+				}
+				node, err := accounts.Get(i)
+				if err != nil {
+					t.Fatalf("failed to load node: %v", err)
+				}
+				node.storageHash[0]++
+				if err := accounts.Set(i, node); err != nil {
+					t.Fatalf("failed to update node: %v", err)
+				}
+			}
+			if err := accounts.Close(); err != nil {
+				t.Fatalf("failed to close stock: %v", err)
+			}
+
+			errs := 0
+			for _, addr := range []common.Address{storageTestAccount, storageTestEmptyAccount} {
+				err := VerifyAccountStorage(dir, config, addr, nil)
+				if err != nil {
+					errs++
+					if !strings.Contains(err.Error(), "inconsistent storage hash in account node A-") {
+						t.Errorf("unexpected error: %v", err)
+					}
+				}
+			}
+			// Storage hashes of accounts without storage are ignored.
+			if errs != 1 {
+				t.Errorf("modified storage hash should be detected for exactly one account, got %d", errs)
+			}
+		})
+	}
+}
+
+func TestVerifyAccountStorage_ObserverIsInformed(t *testing.T) {
+	dir := t.TempDir()
+	fillStorageVerificationTestDirectory(t, dir, S5LiveConfig)
+
+	ctrl := gomock.NewController(t)
+	observer := NewMockVerificationObserver(ctrl)
+	gomock.InOrder(
+		observer.EXPECT().StartVerification(),
+		observer.EXPECT().Progress(gomock.Any()).MinTimes(1),
+		observer.EXPECT().EndVerification(nil),
+	)
+	if err := VerifyAccountStorage(dir, S5LiveConfig, storageTestAccount, observer); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
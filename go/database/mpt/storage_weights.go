@@ -0,0 +1,300 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"unsafe"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/shared"
+)
+
+// StorageTrieWeight summarizes the costs inflicted on the forest by updates
+// of the storage trie of a single account. Weights are accumulated over all
+// blocks processed while storage weight tracking was enabled.
+type StorageTrieWeight struct {
+	Address   common.Address
+	MaxDepth  int    // the maximum depth in nibbles of a value node inserted in the storage trie, the storage root is at depth 0
+	Nodes     uint64 // the total number of nodes created by updates of the storage trie
+	Slots     uint64 // the total number of value nodes created by updates of the storage trie
+	LastBlock uint64 // the last block in which nodes of the storage trie have been created
+}
+
+// storageWeightTracking is implemented by Database instances supporting the
+// accounting of storage trie weights.
+type storageWeightTracking interface {
+	// GetHeaviestStorageTries returns the weights of up to k accounts with
+	// the heaviest storage tries, ordered by decreasing weight.
+	GetHeaviestStorageTries(k int) ([]StorageTrieWeight, error)
+	// commitStorageWeights aggregates all weights recorded since the last
+	// commit into the summary, attributing them to the given block.
+	commitStorageWeights(block uint64)
+}
+
+const storageWeightTrackingDisabledErr = common.ConstError("storage weight tracking is not enabled")
+
+// storageWeightIndexSize is the maximum number of accounts retained in the
+// summary of storage weights, which bounds the k of GetHeaviestStorageTries.
+const storageWeightIndexSize = 1024
+
+// storageWeightTracker collects storage trie weights for individual accounts.
+// Observations are first aggregated per block and then merged into a summary
+// which is persisted in a file whenever the tracker is flushed. The summary
+// is an index of the heaviest storage tries, bounded to a fixed number of
+// accounts. Accounts dropped from the index lose their accumulated weight.
+type storageWeightTracker struct {
+	file     string
+	capacity int // < the maximum number of accounts in the summary
+	mutex    sync.Mutex
+	pending  map[common.Address]StorageTrieWeight // < weights recorded in the current block
+	summary  map[common.Address]StorageTrieWeight // < weights of the heaviest tries of all committed blocks
+	dirty    bool                                 // < true if the summary was modified since the last flush
+}
+
+// openStorageWeightTracker creates a tracker initialized by the summary
+// stored in the given file. If the file does not exist, an empty summary
+// is used.
+func openStorageWeightTracker(file string) (*storageWeightTracker, error) {
+	summary, err := readStorageWeights(file)
+	if err != nil {
+		return nil, err
+	}
+	res := &storageWeightTracker{
+		file:     file,
+		capacity: storageWeightIndexSize,
+		pending:  map[common.Address]StorageTrieWeight{},
+		summary:  summary,
+	}
+	res.trim()
+	return res, nil
+}
+
+// record registers the creation of the given number of nodes in the storage
+// trie of the given account. If a value node was created, depth is the depth
+// of the deepest new value node.
+func (t *storageWeightTracker) record(address common.Address, depth int, nodes, slots uint64) {
+	if nodes == 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	weight := t.pending[address]
+	weight.Address = address
+	if depth > weight.MaxDepth {
+		weight.MaxDepth = depth
+	}
+	weight.Nodes += nodes
+	weight.Slots += slots
+	t.pending[address] = weight
+}
+
+// commit merges the weights of the current block into the summary.
+func (t *storageWeightTracker) commit(block uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.pending) == 0 {
+		return
+	}
+	for address, update := range t.pending {
+		weight := t.summary[address]
+		weight.Address = address
+		if update.MaxDepth > weight.MaxDepth {
+			weight.MaxDepth = update.MaxDepth
+		}
+		weight.Nodes += update.Nodes
+		weight.Slots += update.Slots
+		weight.LastBlock = block
+		t.summary[address] = weight
+	}
+	t.pending = map[common.Address]StorageTrieWeight{}
+	t.trim()
+	t.dirty = true
+}
+
+// trim drops the lightest tries from the summary until it fits the capacity
+// of the tracker. The mutex needs to be held by the caller.
+func (t *storageWeightTracker) trim() {
+	if len(t.summary) <= t.capacity {
+		return
+	}
+	for _, weight := range getSortedWeights(t.summary)[t.capacity:] {
+		delete(t.summary, weight.Address)
+	}
+}
+
+// getHeaviest returns up to k committed weights in decreasing order. Tries
+// are primarily ranked by the number of created nodes, ties are broken by
+// the maximum depth and the address.
+func (t *storageWeightTracker) getHeaviest(k int) []StorageTrieWeight {
+	t.mutex.Lock()
+	res := getSortedWeights(t.summary)
+	t.mutex.Unlock()
+
+	if k < 0 {
+		k = 0
+	}
+	if k < len(res) {
+		res = res[:k]
+	}
+	return res
+}
+
+// getSortedWeights lists the given weights in decreasing order.
+func getSortedWeights(weights map[common.Address]StorageTrieWeight) []StorageTrieWeight {
+	res := make([]StorageTrieWeight, 0, len(weights))
+	for _, weight := range weights {
+		res = append(res, weight)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		a, b := &res[i], &res[j]
+		if a.Nodes != b.Nodes {
+			return a.Nodes > b.Nodes
+		}
+		if a.MaxDepth != b.MaxDepth {
+			return a.MaxDepth > b.MaxDepth
+		}
+		return bytes.Compare(a.Address[:], b.Address[:]) < 0
+	})
+	return res
+}
+
+// flush writes the summary to the tracker's file if it has been modified.
+func (t *storageWeightTracker) flush() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.dirty {
+		return nil
+	}
+	if err := writeStorageWeights(t.summary, t.file); err != nil {
+		return err
+	}
+	t.dirty = false
+	return nil
+}
+
+func (t *storageWeightTracker) getMemoryFootprint() *common.MemoryFootprint {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	entrySize := unsafe.Sizeof(common.Address{}) + unsafe.Sizeof(StorageTrieWeight{})
+	return common.NewMemoryFootprint(uintptr(len(t.pending)+len(t.summary)) * entrySize)
+}
+
+// storageWeightEncodingSize is the size of a single encoded summary entry.
+// The format is: [<address>, <max depth>, <nodes>, <slots>, <last block>]
+const storageWeightEncodingSize = len(common.Address{}) + 4 + 8 + 8 + 8
+
+// readStorageWeights parses the content of the given file if it exists or
+// returns an empty summary if there is no such file.
+func readStorageWeights(filename string) (map[common.Address]StorageTrieWeight, error) {
+	file, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[common.Address]StorageTrieWeight{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	res := map[common.Address]StorageTrieWeight{}
+	reader := bufio.NewReader(file)
+	var buffer [storageWeightEncodingSize]byte
+	for {
+		if _, err := io.ReadFull(reader, buffer[:]); err != nil {
+			if err == io.EOF {
+				return res, nil
+			}
+			return nil, err
+		}
+		var weight StorageTrieWeight
+		data := buffer[copy(weight.Address[:], buffer[:]):]
+		weight.MaxDepth = int(binary.BigEndian.Uint32(data[0:4]))
+		weight.Nodes = binary.BigEndian.Uint64(data[4:12])
+		weight.Slots = binary.BigEndian.Uint64(data[12:20])
+		weight.LastBlock = binary.BigEndian.Uint64(data[20:28])
+		res[weight.Address] = weight
+	}
+}
+
+// writeStorageWeights writes the given summary to the given file.
+func writeStorageWeights(weights map[common.Address]StorageTrieWeight, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	return errors.Join(
+		writeStorageWeightsTo(weights, writer),
+		writer.Flush(),
+		file.Close())
+}
+
+func writeStorageWeightsTo(weights map[common.Address]StorageTrieWeight, writer io.Writer) error {
+	var buffer [storageWeightEncodingSize]byte
+	for _, weight := range weights {
+		data := buffer[copy(buffer[:], weight.Address[:]):]
+		binary.BigEndian.PutUint32(data[0:4], uint32(weight.MaxDepth))
+		binary.BigEndian.PutUint64(data[4:12], weight.Nodes)
+		binary.BigEndian.PutUint64(data[12:20], weight.Slots)
+		binary.BigEndian.PutUint64(data[20:28], weight.LastBlock)
+		if _, err := writer.Write(buffer[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// valueInsertionObserver is an optional interface of node managers informed
+// about the insertion of values for new keys into storage tries.
+type valueInsertionObserver interface {
+	// valueInserted is called with the depth of the new value node, which
+	// is the number of nibbles of its path in the storage trie.
+	valueInserted(depth int)
+}
+
+// nodeCreationCounter is a NodeManager counting the number of nodes created
+// through it and observing the depth of inserted values. It is used to
+// determine the weight added to a storage trie by a single update.
+type nodeCreationCounter struct {
+	NodeManager
+	nodes    uint64
+	values   uint64
+	maxDepth int
+}
+
+func (c *nodeCreationCounter) valueInserted(depth int) {
+	if depth > c.maxDepth {
+		c.maxDepth = depth
+	}
+}
+
+func (c *nodeCreationCounter) createBranch() (NodeReference, shared.WriteHandle[Node], error) {
+	c.nodes++
+	return c.NodeManager.createBranch()
+}
+
+func (c *nodeCreationCounter) createExtension() (NodeReference, shared.WriteHandle[Node], error) {
+	c.nodes++
+	return c.NodeManager.createExtension()
+}
+
+func (c *nodeCreationCounter) createValue() (NodeReference, shared.WriteHandle[Node], error) {
+	c.nodes++
+	c.values++
+	return c.NodeManager.createValue()
+}
@@ -0,0 +1,251 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// getAdversarialKeys produces keys forming a degenerated storage trie if
+// paths are not hashed. Key i is zero except for its i-th nibble, such that
+// every key is split from the remaining keys by a dedicated branch node.
+func getAdversarialKeys(n int) []common.Key {
+	res := make([]common.Key, n)
+	for i := range res {
+		res[i][i/2] = 0x10 >> (4 * (i % 2))
+	}
+	return res
+}
+
+// getBenignKeys produces keys forming a flat storage trie if paths are not
+// hashed. All keys differ in their first nibble.
+func getBenignKeys(n int) []common.Key {
+	res := make([]common.Key, n)
+	for i := range res {
+		res[i][0] = byte(i) << 4
+		res[i][31] = 1
+	}
+	return res
+}
+
+func getSlotUpdates(address common.Address, keys []common.Key) []common.SlotUpdate {
+	res := make([]common.SlotUpdate, 0, len(keys))
+	for _, key := range keys {
+		res = append(res, common.SlotUpdate{Account: address, Key: key, Value: common.Value{1}})
+	}
+	return res
+}
+
+func TestStorageWeights_AdversarialKeysAreSurfaced(t *testing.T) {
+	benign := common.Address{1}
+	adversary := common.Address{2}
+
+	state, err := OpenGoFileStateWithConfig(t.TempDir(), S4LiveConfig, ForestConfig{CacheCapacity: 1024, TrackStorageWeights: true})
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+
+	update := common.Update{
+		CreatedAccounts: []common.Address{benign, adversary},
+		Nonces:          []common.NonceUpdate{{Account: benign, Nonce: common.ToNonce(1)}, {Account: adversary, Nonce: common.ToNonce(1)}},
+		Slots:           getSlotUpdates(benign, getBenignKeys(16)),
+	}
+	if _, err := state.Apply(1, update); err != nil {
+		t.Fatalf("failed to apply update: %v", err)
+	}
+	// The changes of a block are applied in order of their keys. To insert
+	// each adversarial key below the previous one, one key is added per block.
+	adversarialKeys := getAdversarialKeys(16)
+	for i, key := range adversarialKeys {
+		update := common.Update{Slots: getSlotUpdates(adversary, []common.Key{key})}
+		if _, err := state.Apply(uint64(2+i), update); err != nil {
+			t.Fatalf("failed to apply update: %v", err)
+		}
+	}
+
+	weights, err := state.GetHeaviestStorageTries(2)
+	if err != nil {
+		t.Fatalf("failed to get storage weights: %v", err)
+	}
+	if len(weights) != 2 {
+		t.Fatalf("unexpected number of weights, wanted 2, got %d", len(weights))
+	}
+	heaviest, other := weights[0], weights[1]
+	if heaviest.Address != adversary || other.Address != benign {
+		t.Fatalf("adversarial account was not surfaced as heaviest trie: %v", weights)
+	}
+	if got, want := heaviest.MaxDepth, 15; got != want {
+		t.Errorf("unexpected depth of adversarial trie, wanted %d, got %d", want, got)
+	}
+	if got, want := other.MaxDepth, 1; got != want {
+		t.Errorf("unexpected depth of benign trie, wanted %d, got %d", want, got)
+	}
+	if heaviest.Slots != 16 || other.Slots != 16 {
+		t.Errorf("unexpected number of slots, wanted 16, got %d and %d", heaviest.Slots, other.Slots)
+	}
+	if heaviest.Nodes <= other.Nodes {
+		t.Errorf("adversarial trie should have more nodes than benign trie, got %d and %d", heaviest.Nodes, other.Nodes)
+	}
+	if heaviest.LastBlock != uint64(1+len(adversarialKeys)) || other.LastBlock != 1 {
+		t.Errorf("unexpected last block, got %d and %d", heaviest.LastBlock, other.LastBlock)
+	}
+}
+
+func TestStorageWeights_WeightsAreAggregatedPerBlock(t *testing.T) {
+	address := common.Address{1}
+	keys := getAdversarialKeys(8)
+
+	state, err := OpenGoFileStateWithConfig(t.TempDir(), S4LiveConfig, ForestConfig{CacheCapacity: 1024, TrackStorageWeights: true})
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+
+	update := common.Update{
+		CreatedAccounts: []common.Address{address},
+		Nonces:          []common.NonceUpdate{{Account: address, Nonce: common.ToNonce(1)}},
+		Slots:           getSlotUpdates(address, keys[:4]),
+	}
+	if _, err := state.Apply(1, update); err != nil {
+		t.Fatalf("failed to apply update: %v", err)
+	}
+
+	// Updates of existing slots do not create nodes and are not recorded.
+	if _, err := state.Apply(2, common.Update{Slots: []common.SlotUpdate{{Account: address, Key: keys[0], Value: common.Value{2}}}}); err != nil {
+		t.Fatalf("failed to apply update: %v", err)
+	}
+
+	// Uncommitted updates are not visible.
+	if err := state.SetStorage(address, keys[4], common.Value{1}); err != nil {
+		t.Fatalf("failed to set storage: %v", err)
+	}
+	weights, err := state.GetHeaviestStorageTries(10)
+	if err != nil {
+		t.Fatalf("failed to get storage weights: %v", err)
+	}
+	if len(weights) != 1 || weights[0].Slots != 4 || weights[0].LastBlock != 1 {
+		t.Errorf("unexpected weights: %v", weights)
+	}
+
+	if _, err := state.Apply(3, common.Update{Slots: getSlotUpdates(address, keys[5:])}); err != nil {
+		t.Fatalf("failed to apply update: %v", err)
+	}
+	weights, err = state.GetHeaviestStorageTries(10)
+	if err != nil {
+		t.Fatalf("failed to get storage weights: %v", err)
+	}
+	if len(weights) != 1 || weights[0].Slots != 8 || weights[0].LastBlock != 3 || weights[0].MaxDepth != 7 {
+		t.Errorf("unexpected weights: %v", weights)
+	}
+}
+
+func TestStorageWeights_SummaryIsPersisted(t *testing.T) {
+	dir := t.TempDir()
+	config := ForestConfig{CacheCapacity: 1024, TrackStorageWeights: true}
+
+	state, err := OpenGoFileStateWithConfig(dir, S5LiveConfig, config)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		address := common.Address{byte(i)}
+		update := common.Update{
+			CreatedAccounts: []common.Address{address},
+			Nonces:          []common.NonceUpdate{{Account: address, Nonce: common.ToNonce(1)}},
+			Slots:           getSlotUpdates(address, getBenignKeys(i+1)),
+		}
+		if _, err := state.Apply(uint64(i), update); err != nil {
+			t.Fatalf("failed to apply update: %v", err)
+		}
+	}
+	want, err := state.GetHeaviestStorageTries(3)
+	if err != nil {
+		t.Fatalf("failed to get storage weights: %v", err)
+	}
+	if len(want) != 3 || want[0].Address != (common.Address{9}) {
+		t.Fatalf("unexpected weights: %v", want)
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+
+	state, err = OpenGoFileStateWithConfig(dir, S5LiveConfig, config)
+	if err != nil {
+		t.Fatalf("failed to reopen state: %v", err)
+	}
+	defer state.Close()
+	got, err := state.GetHeaviestStorageTries(3)
+	if err != nil {
+		t.Fatalf("failed to get storage weights: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("unexpected number of weights, wanted %d, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if want[i] != got[i] {
+			t.Errorf("unexpected weight at position %d, wanted %v, got %v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestStorageWeights_TrackingIsDisabledByDefault(t *testing.T) {
+	state, err := OpenGoFileState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	if _, err := state.GetHeaviestStorageTries(1); !errors.Is(err, storageWeightTrackingDisabledErr) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestStorageWeights_SummaryIsBoundedToHeaviestTries(t *testing.T) {
+	file := t.TempDir() + "/weights.dat"
+	tracker, err := openStorageWeightTracker(file)
+	if err != nil {
+		t.Fatalf("failed to open tracker: %v", err)
+	}
+	tracker.capacity = 2
+
+	for i := 1; i <= 3; i++ {
+		tracker.record(common.Address{byte(i)}, 1, uint64(i), 1)
+	}
+	tracker.commit(1)
+	if got, want := len(tracker.summary), 2; got != want {
+		t.Fatalf("unexpected size of summary, wanted %d, got %d", want, got)
+	}
+	if _, found := tracker.summary[common.Address{1}]; found {
+		t.Errorf("lightest trie should have been dropped")
+	}
+
+	// Tries becoming heavier than retained tries enter the summary.
+	tracker.record(common.Address{1}, 1, 10, 1)
+	tracker.commit(2)
+	weights := tracker.getHeaviest(10)
+	if len(weights) != 2 || weights[0].Address != (common.Address{1}) || weights[1].Address != (common.Address{3}) {
+		t.Errorf("unexpected weights: %v", weights)
+	}
+
+	if err := tracker.flush(); err != nil {
+		t.Fatalf("failed to flush tracker: %v", err)
+	}
+	restored, err := readStorageWeights(file)
+	if err != nil {
+		t.Fatalf("failed to read weights: %v", err)
+	}
+	if len(restored) != 2 {
+		t.Errorf("unexpected number of persisted weights, wanted 2, got %d", len(restored))
+	}
+}
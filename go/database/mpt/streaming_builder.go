@@ -0,0 +1,383 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// StreamingStateBuilder creates the trie of an empty MptState from a stream
+// of accounts and storage slots sorted in the order in which they would be
+// visited in the resulting trie -- the order produced by exporting a state.
+//
+// Unlike filling a state using its setters, which retains modified nodes in
+// the node cache until their hashes got updated, the builder writes each node
+// to its stock as soon as it is complete. Only the nodes along the path to the
+// most recently added leaf are kept in memory, in a stack bounded by the
+// length of paths. Node hashes are computed bottom-up while nodes are
+// completed. Thus, the memory usage is independent of the size of the state.
+//
+// The builder is restricted to configurations with hashed paths and Ethereum
+// like hashing, which are the configurations used for exporting states.
+type StreamingStateBuilder struct {
+	state    *MptState
+	accounts streamingTrieBuilder
+	storage  streamingTrieBuilder
+	finished bool
+}
+
+// NewStreamingStateBuilder opens the state in the given directory, which must
+// be empty, for being filled by the resulting builder. Finish or Close needs
+// to be called on the builder to release the state.
+func NewStreamingStateBuilder(directory string, config MptConfig) (*StreamingStateBuilder, error) {
+	if !config.UseHashedPaths || !config.TrackSuffixLengthsInLeafNodes || config.DisableExtensionNodes || config.Hashing.Name != EthereumLikeHashing.Name {
+		return nil, fmt.Errorf("streaming state builder does not support configuration %v", config.Name)
+	}
+	state, err := OpenGoFileStateWithConfig(directory, config, ForestConfig{CacheCapacity: MinMptStateCapacity})
+	if err != nil {
+		return nil, err
+	}
+	if !state.trie.root.Id().IsEmpty() {
+		return nil, errors.Join(
+			fmt.Errorf("streaming state builder requires an empty state"),
+			state.Close(),
+		)
+	}
+	forest, ok := state.trie.forest.(*Forest)
+	if !ok {
+		return nil, errors.Join(
+			fmt.Errorf("streaming state builder requires a forest, got %T", state.trie.forest),
+			state.Close(),
+		)
+	}
+	hash := config.HashFunction
+	if hash == nil {
+		hash = Keccak256
+	}
+	return &StreamingStateBuilder{
+		state:    state,
+		accounts: streamingTrieBuilder{forest: forest, hash: hash},
+		storage:  streamingTrieBuilder{forest: forest, hash: hash},
+	}, nil
+}
+
+// AddCode registers the given code in the state.
+func (b *StreamingStateBuilder) AddCode(code []byte) {
+	hash := common.Keccak256(code)
+	b.state.codeMutex.Lock()
+	b.state.code[hash] = code
+	b.state.codeDirty = true
+	b.state.codeMutex.Unlock()
+}
+
+// AddAccount adds an account to the state. Accounts must be added in the
+// order of their hashed addresses. Storage slots added after the account
+// belong to the account.
+func (b *StreamingStateBuilder) AddAccount(address common.Address, info AccountInfo) error {
+	if err := b.finishStorage(); err != nil {
+		return err
+	}
+	path := AddressToNibblePath(address, b.accounts.forest)
+	if err := b.accounts.add(path, &AccountNode{address: address, info: info}); err != nil {
+		return fmt.Errorf("failed to add account %x: %w", address, err)
+	}
+	return nil
+}
+
+// ReplaceAccount replaces the most recently added account, which must have
+// the given address, by an account with the given information. Storage slots
+// added for the replaced account are discarded.
+func (b *StreamingStateBuilder) ReplaceAccount(address common.Address, info AccountInfo) error {
+	account, ok := b.accounts.leaf.(*AccountNode)
+	if !ok || account.address != address {
+		return fmt.Errorf("account %x is not the most recently added account", address)
+	}
+	if err := b.finishStorage(); err != nil {
+		return err
+	}
+	if err := b.storage.release(account.storage); err != nil {
+		return fmt.Errorf("failed to release storage of replaced account %x: %w", address, err)
+	}
+	*account = AccountNode{address: address, info: info}
+	return nil
+}
+
+// AddStorage adds a storage slot to the most recently added account. Slots
+// of an account must be added in the order of their hashed keys. Slots with
+// a zero value are ignored since they are not present in the trie.
+func (b *StreamingStateBuilder) AddStorage(key common.Key, value common.Value) error {
+	if b.accounts.leaf == nil {
+		return fmt.Errorf("no account to add storage slot %x to", key)
+	}
+	if value == (common.Value{}) {
+		return nil
+	}
+	path := KeyToNibblePath(key, b.storage.forest)
+	if err := b.storage.add(path, &ValueNode{key: key, value: value}); err != nil {
+		return fmt.Errorf("failed to add storage slot %x: %w", key, err)
+	}
+	return nil
+}
+
+// Finish completes all remaining nodes, closes the state, and returns the
+// ID and the hash of the resulting root node.
+func (b *StreamingStateBuilder) Finish() (NodeId, common.Hash, error) {
+	root, err := b.finish()
+	if err != nil {
+		return NodeId(0), common.Hash{}, errors.Join(err, b.Close())
+	}
+	b.state.trie.root = NewNodeReference(root.id)
+	// Accounts added by the builder are not covered by the account filter.
+	if b.state.trie.accountFilter != nil {
+		if b.state.trie.accountFilter, err = b.state.trie.buildAccountFilter(); err != nil {
+			return NodeId(0), common.Hash{}, errors.Join(err, b.Close())
+		}
+	}
+	hash, err := b.state.GetHash()
+	if err != nil {
+		return NodeId(0), common.Hash{}, errors.Join(err, b.Close())
+	}
+	return root.id, hash, b.Close()
+}
+
+func (b *StreamingStateBuilder) finish() (streamingNode, error) {
+	if err := b.finishStorage(); err != nil {
+		return streamingNode{}, err
+	}
+	if b.accounts.leaf == nil {
+		return streamingNode{id: EmptyId(), hash: getEmptyNodeHash(b.accounts.hash)}, nil
+	}
+	return b.accounts.collapse(-1)
+}
+
+// finishStorage completes the storage trie of the most recently added
+// account and attaches it to the account.
+func (b *StreamingStateBuilder) finishStorage() error {
+	if b.storage.leaf == nil {
+		return nil
+	}
+	root, err := b.storage.collapse(-1)
+	if err != nil {
+		return err
+	}
+	account := b.accounts.leaf.(*AccountNode)
+	account.storage = NewNodeReference(root.id)
+	account.storageHash = root.hash
+	b.storage.reset()
+	return nil
+}
+
+// Close releases the underlying state. If called before Finish, the
+// state contains a partial trie not referenced by its root.
+func (b *StreamingStateBuilder) Close() error {
+	if b.finished {
+		return nil
+	}
+	b.finished = true
+	return b.state.Close()
+}
+
+// streamingTrieBuilder builds a single trie -- the account trie or the
+// storage trie of an account -- from leaves added in path order. It retains
+// the branch nodes along the path of the most recently added leaf, which
+// are the only nodes that may still get children. All other nodes are
+// complete and have been written to the stocks of the forest.
+type streamingTrieBuilder struct {
+	forest *Forest
+	hash   HashFunction     // the function hashing encoded nodes
+	frames []streamingFrame // open branch nodes, ordered by depth
+	path   []Nibble         // the path of the pending leaf
+	leaf   Node             // the most recently added leaf, nil if there is none
+	buffer []byte           // a buffer for encoding nodes
+}
+
+// streamingFrame is a branch node in the making, located at the given depth.
+type streamingFrame struct {
+	depth int
+	node  BranchNode
+}
+
+// streamingNode describes a complete node written to its stock.
+type streamingNode struct {
+	id     NodeId
+	hash   common.Hash // zero for embedded nodes, see isEmbeddedHash
+	leaves uint64      // the number of leaves in the sub-trie rooted by the node
+}
+
+func (b *streamingTrieBuilder) add(path []Nibble, leaf Node) error {
+	if b.leaf != nil {
+		prefix := 0
+		for prefix < len(path) && path[prefix] == b.path[prefix] {
+			prefix++
+		}
+		if prefix == len(path) || path[prefix] < b.path[prefix] {
+			return fmt.Errorf("paths not in ascending order")
+		}
+		if _, err := b.collapse(prefix); err != nil {
+			return err
+		}
+	}
+	b.path = path
+	b.leaf = leaf
+	return nil
+}
+
+// collapse completes the pending leaf and all open branch nodes deeper than
+// the given depth. The top-most of those is attached as a child to the branch
+// node at the given depth, which is created if needed. If the given depth is
+// negative, all nodes are completed and the root of the trie is returned.
+func (b *streamingTrieBuilder) collapse(depth int) (streamingNode, error) {
+	var pending *streamingFrame // nil if the leaf is pending
+	for {
+		if len(b.frames) == 0 || b.frames[len(b.frames)-1].depth < depth {
+			if depth < 0 {
+				return b.write(pending, 0)
+			}
+			b.frames = append(b.frames, streamingFrame{depth: depth})
+		}
+		top := &b.frames[len(b.frames)-1]
+		child, err := b.write(pending, top.depth+1)
+		if err != nil {
+			return streamingNode{}, err
+		}
+		pos := b.path[top.depth]
+		top.node.children[pos] = NewNodeReference(child.id)
+		top.node.hashes[pos] = child.hash
+		top.node.setEmbedded(byte(pos), isEmbeddedHash(child.hash))
+		top.node.setLeafCount(top.node.leafCount + child.leaves)
+		if top.depth == depth {
+			return streamingNode{}, nil
+		}
+		frame := *top
+		pending = &frame
+		b.frames = b.frames[:len(b.frames)-1]
+	}
+}
+
+// write completes the pending leaf, or the given branch node if not nil, such
+// that it is located at the given depth. Branch nodes located deeper are
+// prefixed by an extension node covering the remaining path.
+func (b *streamingTrieBuilder) write(branch *streamingFrame, depth int) (streamingNode, error) {
+	if branch == nil {
+		switch leaf := b.leaf.(type) {
+		case *AccountNode:
+			leaf.pathLength = byte(len(b.path) - depth)
+			if leaf.storage.Id().IsEmpty() {
+				leaf.storageHash = getEmptyNodeHash(b.hash)
+			}
+		case *ValueNode:
+			leaf.pathLength = byte(len(b.path) - depth)
+		}
+		res, err := b.writeNode(b.leaf)
+		res.leaves = 1
+		return res, err
+	}
+	next, err := b.writeNode(&branch.node)
+	next.leaves = branch.node.leafCount
+	if err != nil || branch.depth == depth {
+		return next, err
+	}
+	res, err := b.writeNode(&ExtensionNode{
+		path:           CreatePathFromNibbles(b.path[depth:branch.depth]),
+		next:           NewNodeReference(next.id),
+		nextHash:       next.hash,
+		nextIsEmbedded: isEmbeddedHash(next.hash),
+	})
+	res.leaves = next.leaves
+	return res, err
+}
+
+// writeNode computes the hash of the given node and writes it to a new slot
+// of the corresponding stock. All children of the node must be written before.
+func (b *streamingTrieBuilder) writeNode(node Node) (streamingNode, error) {
+	var id NodeId
+	var err error
+	var index uint64
+	switch node.(type) {
+	case *AccountNode:
+		index, err = b.forest.accounts.New()
+		id = AccountId(index)
+	case *BranchNode:
+		index, err = b.forest.branches.New()
+		id = BranchId(index)
+	case *ExtensionNode:
+		index, err = b.forest.extensions.New()
+		id = ExtensionId(index)
+	case *ValueNode:
+		index, err = b.forest.values.New()
+		id = ValueId(index)
+	default:
+		return streamingNode{}, fmt.Errorf("unsupported node type: %T", node)
+	}
+	if err != nil {
+		return streamingNode{}, err
+	}
+
+	b.buffer, err = encodeToRlp(node, b.forest, b.buffer[:0])
+	if err != nil {
+		return streamingNode{}, err
+	}
+	// Embedded nodes get a zero hash, as done by the ethHasher.
+	var hash common.Hash
+	if len(b.buffer) >= 32 {
+		hash = b.hash.Sum(b.buffer)
+	}
+	node.SetHash(hash)
+	node.MarkClean()
+
+	if err := b.forest.flushNode(id, node); err != nil {
+		return streamingNode{}, err
+	}
+	return streamingNode{id: id, hash: hash}, nil
+}
+
+// release releases all nodes of the trie with the given root written by this
+// builder. Since written nodes are not registered in the node cache of the
+// forest, nodes are read from and released in the stocks directly.
+func (b *streamingTrieBuilder) release(ref NodeReference) error {
+	id := ref.Id()
+	switch {
+	case id.IsEmpty():
+		return nil
+	case id.IsBranch():
+		node, err := b.forest.branches.Get(id.Index())
+		if err != nil {
+			return err
+		}
+		for _, child := range node.children {
+			if err := b.release(child); err != nil {
+				return err
+			}
+		}
+		return b.forest.branches.Delete(id.Index())
+	case id.IsExtension():
+		node, err := b.forest.extensions.Get(id.Index())
+		if err != nil {
+			return err
+		}
+		if err := b.release(node.next); err != nil {
+			return err
+		}
+		return b.forest.extensions.Delete(id.Index())
+	case id.IsValue():
+		return b.forest.values.Delete(id.Index())
+	}
+	return fmt.Errorf("unable to release node %v", id)
+}
+
+func (b *streamingTrieBuilder) reset() {
+	b.frames = b.frames[:0]
+	b.path = nil
+	b.leaf = nil
+}
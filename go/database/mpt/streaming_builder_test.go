@@ -0,0 +1,256 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestStreamingStateBuilder_ProducesSameTrieAsSetters(t *testing.T) {
+	tests := map[string]struct {
+		numAccounts int
+		numSlots    int
+	}{
+		"empty":            {0, 0},
+		"single account":   {1, 0},
+		"single slot":      {1, 1},
+		"few accounts":     {5, 3},
+		"many accounts":    {300, 0},
+		"many slots":       {3, 300},
+		"accounts & slots": {100, 20},
+	}
+	for _, config := range []MptConfig{S5LiveConfig, S5ArchiveConfig} {
+		for name, test := range tests {
+			t.Run(config.Name+"/"+name, func(t *testing.T) {
+				// The cache needs to hold all dirty nodes until hashes are updated.
+				reference, err := OpenGoMemoryState(t.TempDir(), config, 10_000)
+				if err != nil {
+					t.Fatalf("failed to open reference state: %v", err)
+				}
+				defer reference.Close()
+				for i := 0; i < test.numAccounts; i++ {
+					address := common.Address{byte(i), byte(i >> 8)}
+					if err := reference.SetNonce(address, common.ToNonce(uint64(i+1))); err != nil {
+						t.Fatalf("failed to set nonce: %v", err)
+					}
+					if i%3 == 0 {
+						if err := reference.SetCode(address, []byte{byte(i), 1, 2, 3}); err != nil {
+							t.Fatalf("failed to set code: %v", err)
+						}
+					}
+					for j := 0; j < test.numSlots; j++ {
+						if err := reference.SetStorage(address, common.Key{byte(j), byte(j >> 8)}, common.Value{byte(i), byte(j)}); err != nil {
+							t.Fatalf("failed to set storage: %v", err)
+						}
+					}
+				}
+				want, err := reference.GetHash()
+				if err != nil {
+					t.Fatalf("failed to get reference hash: %v", err)
+				}
+
+				directory := t.TempDir()
+				builder, err := NewStreamingStateBuilder(directory, config)
+				if err != nil {
+					t.Fatalf("failed to create builder: %v", err)
+				}
+				codes, err := reference.GetCodes()
+				if err != nil {
+					t.Fatalf("failed to get codes: %v", err)
+				}
+				for _, code := range codes {
+					builder.AddCode(code)
+				}
+				if err := addTrieContentToBuilder(reference, builder); err != nil {
+					t.Fatalf("failed to add content to builder: %v", err)
+				}
+				_, got, err := builder.Finish()
+				if err != nil {
+					t.Fatalf("failed to finish builder: %v", err)
+				}
+				if want != got {
+					t.Errorf("unexpected root hash, wanted %x, got %x", want, got)
+				}
+
+				if err := VerifyFileLiveTrie(directory, config, nil); err != nil {
+					t.Fatalf("verification of built trie failed: %v", err)
+				}
+
+				state, err := OpenGoFileState(directory, config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open built state: %v", err)
+				}
+				defer state.Close()
+				if got, err := state.GetHash(); err != nil || got != want {
+					t.Errorf("unexpected hash of re-opened state, wanted %x, got %x, err %v", want, got, err)
+				}
+				for i := 0; i < test.numAccounts; i++ {
+					address := common.Address{byte(i), byte(i >> 8)}
+					if i%3 == 0 {
+						if code, err := state.GetCode(address); err != nil || len(code) != 4 || code[0] != byte(i) {
+							t.Errorf("unexpected code of account %d: %x, err %v", i, code, err)
+						}
+					}
+					if test.numSlots > 0 {
+						if value, err := state.GetStorage(address, common.Key{}); err != nil || value != (common.Value{byte(i)}) {
+							t.Errorf("unexpected storage value of account %d: %x, err %v", i, value, err)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestStreamingStateBuilder_UnsortedAccountsAreRejected(t *testing.T) {
+	builder, err := NewStreamingStateBuilder(t.TempDir(), S5LiveConfig)
+	if err != nil {
+		t.Fatalf("failed to create builder: %v", err)
+	}
+	defer builder.Close()
+
+	// The order of accounts is defined by the hashes of their addresses.
+	first, second := common.Address{1}, common.Address{2}
+	if h1, h2 := common.Keccak256(first[:]), common.Keccak256(second[:]); bytes.Compare(h1[:], h2[:]) > 0 {
+		first, second = second, first
+	}
+	if err := builder.AddAccount(second, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+		t.Fatalf("failed to add account: %v", err)
+	}
+	if err := builder.AddAccount(first, AccountInfo{Nonce: common.ToNonce(1)}); err == nil {
+		t.Errorf("adding accounts out of order should fail")
+	}
+	if err := builder.AddAccount(second, AccountInfo{Nonce: common.ToNonce(1)}); err == nil {
+		t.Errorf("adding the same account twice should fail")
+	}
+}
+
+func TestStreamingStateBuilder_ReplacedAccountsDiscardTheirStorage(t *testing.T) {
+	addr1, addr2 := common.Address{1}, common.Address{2}
+	if h1, h2 := common.Keccak256(addr1[:]), common.Keccak256(addr2[:]); bytes.Compare(h1[:], h2[:]) > 0 {
+		addr1, addr2 = addr2, addr1
+	}
+	info := AccountInfo{Nonce: common.ToNonce(1), CodeHash: emptyCodeHash}
+
+	reference, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer reference.Close()
+	for _, addr := range []common.Address{addr1, addr2} {
+		if err := reference.SetNonce(addr, info.Nonce); err != nil {
+			t.Fatalf("failed to set nonce: %v", err)
+		}
+	}
+	if err := reference.SetStorage(addr1, common.Key{1}, common.Value{1}); err != nil {
+		t.Fatalf("failed to set storage: %v", err)
+	}
+	want, err := reference.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+
+	builder, err := NewStreamingStateBuilder(t.TempDir(), S5LiveConfig)
+	if err != nil {
+		t.Fatalf("failed to create builder: %v", err)
+	}
+	defer builder.Close()
+	if err := builder.AddAccount(addr1, AccountInfo{Nonce: common.ToNonce(2)}); err != nil {
+		t.Fatalf("failed to add account: %v", err)
+	}
+	// Slots are added in the order of their hashed keys.
+	keys := make([]common.Key, 20)
+	for i := range keys {
+		keys[i] = common.Key{byte(i)}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		hi, hj := common.Keccak256(keys[i][:]), common.Keccak256(keys[j][:])
+		return bytes.Compare(hi[:], hj[:]) < 0
+	})
+	for _, key := range keys {
+		if err := builder.AddStorage(key, common.Value{2}); err != nil {
+			t.Fatalf("failed to add storage: %v", err)
+		}
+	}
+	if err := builder.ReplaceAccount(addr2, info); err == nil {
+		t.Errorf("replacing an account other than the last one should fail")
+	}
+	if err := builder.ReplaceAccount(addr1, info); err != nil {
+		t.Fatalf("failed to replace account: %v", err)
+	}
+	if err := builder.AddStorage(common.Key{1}, common.Value{1}); err != nil {
+		t.Fatalf("failed to add storage: %v", err)
+	}
+	if err := builder.AddAccount(addr2, info); err != nil {
+		t.Fatalf("failed to add account: %v", err)
+	}
+
+	// Nodes of the discarded storage are released for being reused.
+	usage, err := builder.state.trie.GetIdSpaceUsage()
+	if err != nil {
+		t.Fatalf("failed to get ID space usage: %v", err)
+	}
+	if got, want := usage.Used.Values, uint64(len(keys)); got != want {
+		t.Errorf("unexpected number of allocated value IDs, wanted %d, got %d", want, got)
+	}
+	_, got, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("failed to finish state: %v", err)
+	}
+	if got != want {
+		t.Errorf("unexpected hash, wanted %x, got %x", want, got)
+	}
+}
+
+func TestStreamingStateBuilder_StorageWithoutAccountIsRejected(t *testing.T) {
+	builder, err := NewStreamingStateBuilder(t.TempDir(), S5LiveConfig)
+	if err != nil {
+		t.Fatalf("failed to create builder: %v", err)
+	}
+	defer builder.Close()
+	if err := builder.AddStorage(common.Key{1}, common.Value{1}); err == nil {
+		t.Errorf("adding storage without an account should fail")
+	}
+}
+
+func TestStreamingStateBuilder_UnsupportedConfigurationsAreRejected(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S4ArchiveConfig} {
+		if _, err := NewStreamingStateBuilder(t.TempDir(), config); err == nil {
+			t.Errorf("configuration %v should not be supported", config.Name)
+		}
+	}
+}
+
+// addTrieContentToBuilder adds the accounts and storage slots of the given
+// state to the given builder in the order in which they are visited.
+func addTrieContentToBuilder(state *MptState, builder *StreamingStateBuilder) error {
+	var err error
+	visitor := MakeVisitor(func(node Node, _ NodeInfo) VisitResponse {
+		switch n := node.(type) {
+		case *AccountNode:
+			err = builder.AddAccount(n.Address(), n.Info())
+		case *ValueNode:
+			err = builder.AddStorage(n.Key(), n.Value())
+		}
+		if err != nil {
+			return VisitResponseAbort
+		}
+		return VisitResponseContinue
+	})
+	if visitErr := state.Visit(visitor); visitErr != nil {
+		return visitErr
+	}
+	return err
+}
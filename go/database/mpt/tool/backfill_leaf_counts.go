@@ -0,0 +1,89 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Fantom-foundation/Carmen/go/common/interrupt"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+	mptIo "github.com/Fantom-foundation/Carmen/go/database/mpt/io"
+	"github.com/urfave/cli/v2"
+)
+
+var BackfillLeafCounts = cli.Command{
+	Action:    backfillLeafCounts,
+	Name:      "backfill-leaf-counts",
+	Usage:     "converts a LiveDB in-place to track the number of leaves of sub-tries, resuming an interrupted conversion if present",
+	ArgsUsage: "<director>",
+}
+
+func backfillLeafCounts(context *cli.Context) error {
+	if context.Args().Len() != 1 {
+		return fmt.Errorf("missing directory storing state")
+	}
+	dir := context.Args().Get(0)
+	ctx := interrupt.CancelOnInterrupt(context.Context)
+	return backfillLiveDbLeafCounts(ctx, os.Stdout, dir)
+}
+
+// backfillLiveDbLeafCounts converts the LiveDB in the given directory to a
+// configuration tracking the number of leaves in the sub-tries of branch
+// nodes. Since this changes the encoding of branch nodes, the content of
+// the LiveDB is migrated into a temporary directory, which then replaces
+// the original directory. Leaf counts are established while the migration
+// inserts accounts and slots. Converting a LiveDB already tracking leaf
+// counts has no effect. An interrupted run can be continued by running it
+// again with the same directory.
+func backfillLiveDbLeafCounts(ctx context.Context, out io.Writer, dir string) error {
+	dir = filepath.Clean(dir)
+	if err := completeSchemaUpgradeSwap(dir); err != nil {
+		return err
+	}
+
+	info, err := mptIo.CheckMptDirectoryAndGetInfo(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode != mpt.Mutable {
+		return fmt.Errorf("can only convert LiveDB instances, found %v in directory", info.Mode)
+	}
+	if info.Config.TrackSubtreeLeafCounts {
+		_, err := fmt.Fprintf(out, "LiveDB is tracking leaf counts\n")
+		return err
+	}
+
+	config := info.Config
+	config.TrackSubtreeLeafCounts = true
+	fmt.Fprintf(out, "Backfilling leaf counts of %s ...\n", dir)
+	hash, err := mpt.MigrateDirectoryWithContext(ctx, dir, dir+upgradeTargetSuffix, info.Config, config, func(progress mpt.MigrationProgress) {
+		fmt.Fprintf(out, "Migrated chunk %d/%d - accounts: %d, slots: %d\n", progress.Chunk, progress.NumChunks, progress.Accounts, progress.Slots)
+	})
+	if err != nil {
+		if errors.Is(err, interrupt.ErrCanceled) {
+			fmt.Fprintf(out, "Interrupted, run again to continue\n")
+		}
+		return err
+	}
+	if err := os.Rename(dir, dir+upgradeBackupSuffix); err != nil {
+		return err
+	}
+	if err := completeSchemaUpgradeSwap(dir); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "Leaf counts backfilled, state hash: %x\n", hash)
+	return err
+}
@@ -34,7 +34,7 @@ import (
 var Benchmark = cli.Command{
 	Action: benchmark,
 	Name:   "benchmark",
-	Usage:  "benchmarks MPT performance by filling data into a fresh instance",
+	Usage:  "benchmarks MPT performance by filling data into a fresh instance or by replaying a recorded trace",
 	Flags: []cli.Flag{
 		&archiveFlag,
 		&diagnosticsFlag,
@@ -46,6 +46,9 @@ var Benchmark = cli.Command{
 		&keepStateFlag,
 		&cpuProfileFlag,
 		&traceFlag,
+		&replayFlag,
+		&stateDirFlag,
+		&metricsFlag,
 	},
 }
 
@@ -97,6 +100,20 @@ var (
 		Usage: "sets the target file for traces to, disabled if empty",
 		Value: "",
 	}
+	replayFlag = cli.StringFlag{
+		Name:  "replay",
+		Usage: "replays the update trace recorded in the given file instead of running a synthetic benchmark",
+		Value: "",
+	}
+	stateDirFlag = cli.StringFlag{
+		Name:  "state-dir",
+		Usage: "the directory of an existing LiveDB to replay the trace on, a fresh LiveDB is used if empty",
+		Value: "",
+	}
+	metricsFlag = cli.BoolFlag{
+		Name:  "metrics",
+		Usage: "reports the number of nodes visited per lookup and update, only supported when replaying traces",
+	}
 )
 
 func benchmark(context *cli.Context) error {
@@ -119,6 +136,29 @@ func benchmark(context *cli.Context) error {
 	}
 
 	start := time.Now()
+	observer := func(msg string, args ...any) {
+		delta := uint64(time.Since(start).Round(time.Second).Seconds())
+		fmt.Printf("[t=%3d:%02d:%02d]: ", delta/3600, (delta/60)%60, delta%60)
+		fmt.Printf(msg+"\n", args...)
+	}
+
+	if traceFile := context.String(replayFlag.Name); len(traceFile) > 0 {
+		if context.Bool(archiveFlag.Name) {
+			return fmt.Errorf("replaying traces is not supported in archive mode")
+		}
+		return replay(replayParams{
+			traceFile:      traceFile,
+			stateDir:       context.String(stateDirFlag.Name),
+			tmpDir:         tmpDir,
+			keepState:      context.Bool(keepStateFlag.Name),
+			reportInterval: context.Int(reportIntervalFlag.Name),
+			metrics:        context.Bool(metricsFlag.Name),
+		}, observer)
+	}
+	if context.Bool(metricsFlag.Name) {
+		return fmt.Errorf("node visit metrics are only supported when replaying traces")
+	}
+
 	results, err := runBenchmark(
 		benchmarkParams{
 			archive:            context.Bool(archiveFlag.Name),
@@ -131,11 +171,7 @@ func benchmark(context *cli.Context) error {
 			traceFilePrefix:    context.String(traceFlag.Name),
 			reportInterval:     context.Int(reportIntervalFlag.Name),
 		},
-		func(msg string, args ...any) {
-			delta := uint64(time.Since(start).Round(time.Second).Seconds())
-			fmt.Printf("[t=%3d:%02d:%02d]: ", delta/3600, (delta/60)%60, delta%60)
-			fmt.Printf(msg+"\n", args...)
-		},
+		observer,
 	)
 	if err != nil {
 		return err
@@ -12,6 +12,7 @@ package main
 
 import (
 	"fmt"
+	"runtime"
 	"strings"
 
 	"github.com/Fantom-foundation/Carmen/go/database/mpt"
@@ -26,9 +27,16 @@ var Check = cli.Command{
 	ArgsUsage: "<director>",
 	Flags: []cli.Flag{
 		&cpuProfileFlag,
+		&checkWorkersFlag,
 	},
 }
 
+var checkWorkersFlag = cli.IntFlag{
+	Name:  "workers",
+	Usage: "the number of workers checking nodes concurrently",
+	Value: runtime.NumCPU(),
+}
+
 func check(context *cli.Context) error {
 	// parse the directory argument
 	if context.Args().Len() != 1 {
@@ -45,6 +53,7 @@ func check(context *cli.Context) error {
 	}
 
 	dir := context.Args().Get(0)
+	workers := context.Int(checkWorkersFlag.Name)
 
 	// try to obtain information of the contained MPT
 	info, err := io.CheckMptDirectoryAndGetInfo(dir)
@@ -54,10 +63,10 @@ func check(context *cli.Context) error {
 
 	if info.Mode == mpt.Immutable {
 		fmt.Printf("Checking archive in %s ...\n", dir)
-		err = checkArchive(dir, info)
+		err = checkArchive(dir, info, workers)
 	} else {
 		fmt.Printf("Checking live DB in %s ...\n", dir)
-		err = checkLiveDB(dir, info)
+		err = checkLiveDB(dir, info, workers)
 	}
 	if err == nil {
 		fmt.Printf("All checks passed!\n")
@@ -65,8 +74,11 @@ func check(context *cli.Context) error {
 	return err
 }
 
-func checkLiveDB(dir string, info io.MptInfo) error {
-	live, err := mpt.OpenFileLiveTrie(dir, info.Config, mpt.DefaultMptStateCapacity)
+func checkLiveDB(dir string, info io.MptInfo, workers int) error {
+	live, err := mpt.OpenFileLiveTrieWithConfig(dir, info.Config, mpt.ForestConfig{
+		CacheCapacity: mpt.DefaultMptStateCapacity,
+		CheckWorkers:  workers,
+	})
 	if err != nil {
 		return err
 	}
@@ -74,8 +86,11 @@ func checkLiveDB(dir string, info io.MptInfo) error {
 	return live.Check()
 }
 
-func checkArchive(dir string, info io.MptInfo) error {
-	archive, err := mpt.OpenArchiveTrie(dir, info.Config, mpt.DefaultMptStateCapacity)
+func checkArchive(dir string, info io.MptInfo, workers int) error {
+	archive, err := mpt.OpenArchiveTrieWithConfig(dir, info.Config, mpt.ForestConfig{
+		CacheCapacity: mpt.DefaultMptStateCapacity,
+		CheckWorkers:  workers,
+	})
 	if err != nil {
 		return err
 	}
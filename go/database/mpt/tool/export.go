@@ -20,6 +20,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Fantom-foundation/Carmen/go/common"
 	"github.com/Fantom-foundation/Carmen/go/common/interrupt"
 	"github.com/Fantom-foundation/Carmen/go/database/mpt"
 	"github.com/Fantom-foundation/Carmen/go/database/mpt/io"
@@ -33,10 +34,24 @@ var ExportCmd = cli.Command{
 	ArgsUsage: "<db director> <target-file>",
 	Flags: []cli.Flag{
 		&cpuProfileFlag,
+		&sharedFlag,
+		&exportWriteQueueFlag,
+		&exportResumeFromFlag,
 	},
 }
 
-func doExport(context *cli.Context) error {
+var exportWriteQueueFlag = cli.IntFlag{
+	Name:  "write-queue",
+	Usage: "the number of encoded chunks queued for being written concurrently to the traversal of a LiveDB, 0 to write sequentially",
+	Value: 16,
+}
+
+var exportResumeFromFlag = cli.StringFlag{
+	Name:  "resume-from",
+	Usage: "continues an interrupted export of a LiveDB after the given account by appending to the target file",
+}
+
+func doExport(context *cli.Context) (err error) {
 	if context.Args().Len() != 2 {
 		return fmt.Errorf("missing state directory and/or target file parameter")
 	}
@@ -58,15 +73,42 @@ func doExport(context *cli.Context) error {
 		return err
 	}
 
-	export := io.Export
-	if mptInfo.Mode == mpt.Immutable {
-		export = io.ExportArchive
+	lock, err := lockDirectoryForReading(context, dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, lock.Release())
+	}()
+
+	writeQueueLength := context.Int(exportWriteQueueFlag.Name)
+	if writeQueueLength < 0 {
+		return fmt.Errorf("invalid write queue length: %d", writeQueueLength)
+	}
+
+	var resumeFrom *common.Address
+	if context.IsSet(exportResumeFromFlag.Name) {
+		if mptInfo.Mode == mpt.Immutable {
+			return fmt.Errorf("resuming exports is only supported for LiveDB instances")
+		}
+		addr, err := parseAddress(context.String(exportResumeFromFlag.Name))
+		if err != nil {
+			return err
+		}
+		resumeFrom = &addr
 	}
 
 	start := time.Now()
 	logFromStart(start, "export started")
 
-	file, err := os.Create(trg)
+	// Resumed exports are appended to the output of the interrupted export as
+	// an additional gzip member, which readers decompress as a single stream.
+	var file *os.File
+	if resumeFrom == nil {
+		file, err = os.Create(trg)
+	} else {
+		file, err = os.OpenFile(trg, os.O_WRONLY|os.O_APPEND, 0)
+	}
 	if err != nil {
 		return err
 	}
@@ -75,12 +117,34 @@ func doExport(context *cli.Context) error {
 
 	ctx := interrupt.CancelOnInterrupt(context.Context)
 
+	var exportErr error
+	var lastExported *common.Address
+	if mptInfo.Mode == mpt.Immutable {
+		exportErr = io.ExportArchive(ctx, dir, out)
+	} else {
+		exportErr = io.ExportWithConfig(ctx, dir, out, io.ExportConfig{
+			WriteQueueLength: writeQueueLength,
+			ResumeFrom:       resumeFrom,
+			Checkpoint: func(addr common.Address) {
+				lastExported = &addr
+			},
+		})
+	}
+
 	if err = errors.Join(
-		export(ctx, dir, out),
+		exportErr,
 		out.Close(),
 		bufferedWriter.Flush(),
 		file.Close(),
 	); err != nil {
+		if errors.Is(exportErr, interrupt.ErrCanceled) {
+			if lastExported == nil {
+				lastExported = resumeFrom
+			}
+			if lastExported != nil {
+				log.Printf("export interrupted, resume using --%s 0x%x", exportResumeFromFlag.Name, lastExported[:])
+			}
+		}
 		return err
 	}
 	logFromStart(start, "export done")
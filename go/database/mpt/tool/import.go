@@ -31,9 +31,21 @@ var ImportLiveDbCmd = cli.Command{
 	ArgsUsage: "<source-file> <target director>",
 	Flags: []cli.Flag{
 		&cpuProfileFlag,
+		&streamingFlag,
+		&allowDuplicatesFlag,
 	},
 }
 
+var streamingFlag = cli.BoolFlag{
+	Name:  "streaming",
+	Usage: "writes nodes to disk while parsing the input to limit memory usage",
+}
+
+var allowDuplicatesFlag = cli.StringFlag{
+	Name:  "allow-duplicates",
+	Usage: "accepts accounts listed more than once in the input using the given policy, supported: last-wins",
+}
+
 var ImportArchiveCmd = cli.Command{
 	Action:    doArchiveImport,
 	Name:      "import-archive",
@@ -55,7 +67,23 @@ var ImportLiveAndArchiveCmd = cli.Command{
 }
 
 func doLiveDbImport(context *cli.Context) error {
-	return doImport(context, mptIo.ImportLiveDb)
+	var config mptIo.ImportConfig
+	switch policy := context.String(allowDuplicatesFlag.Name); policy {
+	case "":
+		config.Duplicates = mptIo.RejectDuplicates
+	case "last-wins":
+		config.Duplicates = mptIo.DuplicatesLastWins
+	default:
+		return fmt.Errorf("unsupported duplicate policy %q, supported: last-wins", policy)
+	}
+	if context.Bool(streamingFlag.Name) {
+		return doImport(context, func(directory string, in io.Reader) error {
+			return mptIo.ImportLiveDbStreamingWithConfig(directory, in, config)
+		})
+	}
+	return doImport(context, func(directory string, in io.Reader) error {
+		return mptIo.ImportLiveDbWithConfig(directory, in, config)
+	})
 }
 
 func doArchiveImport(context *cli.Context) error {
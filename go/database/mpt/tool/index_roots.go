@@ -0,0 +1,53 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+	mptIo "github.com/Fantom-foundation/Carmen/go/database/mpt/io"
+	"github.com/urfave/cli/v2"
+)
+
+var IndexRoots = cli.Command{
+	Action:    indexRoots,
+	Name:      "index-roots",
+	Usage:     "rebuilds the index for looking up blocks of an Archive by their root hash",
+	ArgsUsage: "<director>",
+}
+
+func indexRoots(context *cli.Context) error {
+	if context.Args().Len() != 1 {
+		return fmt.Errorf("missing directory storing state")
+	}
+	return indexArchiveRoots(os.Stdout, context.Args().Get(0))
+}
+
+// indexArchiveRoots rebuilds the index of root hashes of the Archive in the
+// given directory and prints the size of the index.
+func indexArchiveRoots(out io.Writer, dir string) error {
+	info, err := mptIo.CheckMptDirectoryAndGetInfo(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode != mpt.Immutable {
+		return fmt.Errorf("can only index Archive instances, found %v in directory", info.Mode)
+	}
+	blocks, runs, err := mpt.RebuildRootIndex(dir, info.Config)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "Indexed %d blocks with %d distinct states\n", blocks, runs)
+	return err
+}
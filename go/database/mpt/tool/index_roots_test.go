@@ -0,0 +1,73 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+)
+
+func TestIndexRoots_IndexesBlocksOfArchive(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := mpt.OpenArchiveTrie(dir, mpt.S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	update := common.Update{CreatedAccounts: []common.Address{{1}}, Nonces: []common.NonceUpdate{{Account: common.Address{1}, Nonce: common.ToNonce(1)}}}
+	if err := archive.Add(0, update, nil); err != nil {
+		t.Fatalf("failed to add block: %v", err)
+	}
+	if err := archive.Add(1, common.Update{}, nil); err != nil {
+		t.Fatalf("failed to add block: %v", err)
+	}
+	hash, err := archive.GetHash(1)
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := indexArchiveRoots(&out, dir); err != nil {
+		t.Fatalf("failed to index roots: %v", err)
+	}
+	if want, got := "Indexed 2 blocks with 1 distinct states\n", out.String(); want != got {
+		t.Errorf("unexpected output, wanted %q, got %q", want, got)
+	}
+
+	archive, err = mpt.OpenArchiveTrie(dir, mpt.S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+	if blocks, err := archive.GetBlockByRoot(hash); err != nil || !slices.Equal(blocks, []uint64{0, 1}) {
+		t.Errorf("unexpected blocks of root, wanted [0 1], got %v, %v", blocks, err)
+	}
+}
+
+func TestIndexRoots_LiveDbsAreRejected(t *testing.T) {
+	dir := t.TempDir()
+	state, err := mpt.OpenGoFileState(dir, mpt.S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+	if err := indexArchiveRoots(&bytes.Buffer{}, dir); err == nil {
+		t.Errorf("indexing LiveDBs should fail")
+	}
+}
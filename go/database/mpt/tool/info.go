@@ -11,7 +11,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/Fantom-foundation/Carmen/go/database/mpt"
 	"github.com/Fantom-foundation/Carmen/go/database/mpt/io"
@@ -24,6 +26,7 @@ var Info = cli.Command{
 	Usage:  "lists information about a Carmen MTP state repository",
 	Flags: []cli.Flag{
 		&statsFlag,
+		&sharedFlag,
 	},
 	ArgsUsage: "<director>",
 }
@@ -35,7 +38,7 @@ var (
 	}
 )
 
-func info(context *cli.Context) error {
+func info(context *cli.Context) (err error) {
 	// parse the directory argument
 	if context.Args().Len() != 1 {
 		return fmt.Errorf("missing directory storing state")
@@ -50,9 +53,18 @@ func info(context *cli.Context) error {
 		return err
 	}
 
+	lock, err := lockDirectoryForReading(context, dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, lock.Release())
+	}()
+
 	fmt.Printf("Directory contains an MPT State with the following properties:\n")
 	fmt.Printf("\tMPT Configuration: %v\n", mptInfo.Config.Name)
 	fmt.Printf("\tMode:              %v\n", mptInfo.Mode)
+	printVerificationStatus(mpt.GetVerificationStatus(dir))
 
 	// attempt to open the MPT
 	if mptInfo.Mode == mpt.Mutable {
@@ -63,6 +75,7 @@ func info(context *cli.Context) error {
 		} else {
 			fmt.Printf("\tCan be opened:     Yes\n")
 		}
+		printIdSpaceHeadroom(trie.GetIdSpaceUsage())
 
 		if withStats {
 			fmt.Printf("\nCollecting Node Statistics ...\n")
@@ -94,6 +107,7 @@ func info(context *cli.Context) error {
 		} else {
 			fmt.Printf("\tBlock height:      %d\n", height)
 		}
+		printIdSpaceHeadroom(archive.GetIdSpaceUsage())
 
 		if err := archive.Close(); err != nil {
 			return fmt.Errorf("error closing forest: %v", err)
@@ -113,3 +127,45 @@ func info(context *cli.Context) error {
 
 	return nil
 }
+
+// printIdSpaceHeadroom prints the number of node IDs of each type which can
+// be allocated before the ID space of the forest is exhausted.
+func printIdSpaceHeadroom(usage mpt.IdSpaceUsage, err error) {
+	if err != nil {
+		fmt.Printf("\tID space headroom: %v\n", err)
+		return
+	}
+	fmt.Printf("\tID space headroom:\n")
+	headroom := usage.Headroom()
+	print := func(name string, headroom, capacity uint64) {
+		fmt.Printf("\t\t%-11s %d of %d (%.2f%%)\n", name+":", headroom, capacity, 100*float64(headroom)/float64(capacity))
+	}
+	print("Accounts", headroom.Accounts, usage.Capacity.Accounts)
+	print("Branches", headroom.Branches, usage.Capacity.Branches)
+	print("Extensions", headroom.Extensions, usage.Capacity.Extensions)
+	print("Values", headroom.Values, usage.Capacity.Values)
+}
+
+// printVerificationStatus prints the last successful verification of the
+// directory and, prominently, whether corruption has been detected since.
+func printVerificationStatus(status mpt.VerificationStatus, err error) {
+	if err != nil {
+		fmt.Printf("\tLast verification: %v\n", err)
+		return
+	}
+	if status.IsTainted() {
+		fmt.Printf("\n\t!!! TAINTED: corruption detected at %v !!!\n", status.Taint.Time.Format(time.RFC3339))
+		fmt.Printf("\t!!! %s\n", status.Taint.Error)
+		fmt.Printf("\t!!! Run a full verification to clear this flag.\n\n")
+	}
+	record := status.LastVerification
+	if record == nil {
+		fmt.Printf("\tLast verification: never\n")
+		return
+	}
+	fmt.Printf("\tLast verification: passed at %v\n", record.Time.Format(time.RFC3339))
+	fmt.Printf("\t\tTool version: %s\n", record.ToolVersion)
+	fmt.Printf("\t\tRoot hash:    %x (%d roots)\n", record.RootHash, record.NumRoots)
+	counts := record.NodeCounts
+	fmt.Printf("\t\tNodes:        %d accounts, %d branches, %d extensions, %d values\n", counts.Accounts, counts.Branches, counts.Extensions, counts.Values)
+}
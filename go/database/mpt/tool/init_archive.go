@@ -15,9 +15,12 @@ import (
 	"compress/gzip"
 	"errors"
 	"fmt"
-	"io"
+	"log"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/Fantom-foundation/Carmen/go/common/interrupt"
 	mptIo "github.com/Fantom-foundation/Carmen/go/database/mpt/io"
 	"github.com/urfave/cli/v2"
 )
@@ -25,7 +28,7 @@ import (
 var InitArchive = cli.Command{
 	Action:    doArchiveInit,
 	Name:      "init-archive",
-	Usage:     "initializes an Archive instance from a file",
+	Usage:     "initializes an Archive instance from a file, resuming an interrupted initialization if present",
 	ArgsUsage: "<source-file> <archive target director>",
 	Flags: []cli.Flag{
 		&blockHeightFlag,
@@ -46,7 +49,8 @@ func doArchiveInit(context *cli.Context) error {
 	src := context.Args().Get(0)
 	dir := context.Args().Get(1)
 
-	if err := os.Mkdir(dir, 0700); err != nil {
+	// An existing directory may contain an interrupted initialization.
+	if err := os.MkdirAll(dir, 0700); err != nil {
 		return fmt.Errorf("error creating output directory: %v", err)
 	}
 
@@ -56,12 +60,34 @@ func doArchiveInit(context *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	var in io.Reader = bufio.NewReader(file)
-	if in, err = gzip.NewReader(in); err != nil {
-		return err
+	stat, err := file.Stat()
+	if err != nil {
+		return errors.Join(err, file.Close())
+	}
+	counter := mptIo.NewCountingReader(file)
+	decoded, err := gzip.NewReader(bufio.NewReader(counter))
+	if err != nil {
+		return errors.Join(err, file.Close())
+	}
+	in := &mptIo.SizedInput{Reader: decoded, Raw: counter, Size: uint64(stat.Size())}
+
+	ctx := interrupt.CancelOnInterrupt(context.Context)
+	err = mptIo.InitializeArchiveWithProgress(ctx, dir, in, height, printInitProgress)
+	if errors.Is(err, interrupt.ErrCanceled) {
+		log.Printf("initialization interrupted, re-run the command to resume")
 	}
 	return errors.Join(
-		mptIo.InitializeArchive(dir, in, height),
+		err,
 		file.Close(),
 	)
 }
+
+// printInitProgress prints a progress bar for the given progress report.
+func printInitProgress(progress mptIo.InitProgress) {
+	const width = 40
+	filled := int(progress.Percent / 100 * width)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	log.Printf("[%s] %5.1f%% - accounts: %d, slots: %d, nodes written: %d, elapsed: %v, ETA: %v\n",
+		bar, progress.Percent, progress.Accounts, progress.Slots, progress.NodesWritten,
+		progress.Elapsed.Round(time.Second), progress.ETA.Round(time.Second))
+}
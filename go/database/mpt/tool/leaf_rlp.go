@@ -0,0 +1,110 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+	mptIo "github.com/Fantom-foundation/Carmen/go/database/mpt/io"
+	"github.com/urfave/cli/v2"
+)
+
+var LeafRlp = cli.Command{
+	Action:    leafRlp,
+	Name:      "leaf-rlp",
+	Usage:     "prints the RLP encoding of the leaf node of an account as hashed by EthereumLikeHashing",
+	ArgsUsage: "<director> <address>",
+	Flags: []cli.Flag{
+		&targetBlockFlag,
+		&sharedFlag,
+	},
+}
+
+func leafRlp(context *cli.Context) error {
+	// parse the directory and address arguments
+	if context.Args().Len() != 2 {
+		return fmt.Errorf("missing directory storing state or account address")
+	}
+	dir := context.Args().Get(0)
+	addr, err := parseAddress(context.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	var block *uint64
+	if context.IsSet(targetBlockFlag.Name) {
+		value := context.Uint64(targetBlockFlag.Name)
+		block = &value
+	}
+	lock, err := lockDirectoryForReading(context, dir)
+	if err != nil {
+		return err
+	}
+	return errors.Join(
+		printAccountLeafRlp(os.Stdout, dir, addr, block),
+		lock.Release(),
+	)
+}
+
+// printAccountLeafRlp prints the hex encoded RLP of the leaf of the given
+// account. For archives, the given block is used, or the latest block if nil.
+func printAccountLeafRlp(out io.Writer, dir string, addr common.Address, block *uint64) error {
+	info, err := mptIo.CheckMptDirectoryAndGetInfo(dir)
+	if err != nil {
+		return err
+	}
+
+	var rlp []byte
+	var found bool
+	if info.Mode == mpt.Immutable {
+		archive, err := mpt.OpenArchiveTrie(dir, info.Config, mpt.DefaultMptStateCapacity)
+		if err != nil {
+			return fmt.Errorf("failed to open archive in %s: %w", dir, err)
+		}
+		if block == nil {
+			height, empty, err := archive.GetBlockHeight()
+			if err != nil {
+				return errors.Join(err, archive.Close())
+			}
+			if empty {
+				return errors.Join(fmt.Errorf("archive is empty"), archive.Close())
+			}
+			block = &height
+		}
+		rlp, found, err = archive.GetAccountLeafRlp(*block, addr)
+		if err := errors.Join(err, archive.Close()); err != nil {
+			return err
+		}
+	} else {
+		if block != nil {
+			return fmt.Errorf("the --%s flag is only supported for archives", targetBlockFlag.Name)
+		}
+		trie, err := mpt.OpenFileLiveTrie(dir, info.Config, mpt.DefaultMptStateCapacity)
+		if err != nil {
+			return fmt.Errorf("failed to open live trie in %s: %w", dir, err)
+		}
+		rlp, found, err = trie.GetAccountLeafRlp(addr)
+		if err := errors.Join(err, trie.Close()); err != nil {
+			return err
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("account %x not found", addr)
+	}
+	_, err = fmt.Fprintf(out, "%x\n", rlp)
+	return err
+}
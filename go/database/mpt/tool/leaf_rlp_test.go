@@ -0,0 +1,94 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+)
+
+// The RLP encoding of the leaf of account 0x01 with nonce 10, balance 12, and
+// slot 0x01 set to 0x02 as produced by Geth.
+const wantLeafRlp = "f86aa120f22bb46edf31af855938befaa870ed3d86a4ad93a9ecf7c63ceaa80daea9ac4db846f8440a0ca0c33452a49b253420076b3e5a56a97717351e52c267dc01a1d1a17c48dad0bdbba0c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470\n"
+
+func getLeafRlpTestUpdate() common.Update {
+	balance, _ := common.ToBalance(big.NewInt(12))
+	return common.Update{
+		CreatedAccounts: []common.Address{{1}},
+		Balances:        []common.BalanceUpdate{{Account: common.Address{1}, Balance: balance}},
+		Nonces:          []common.NonceUpdate{{Account: common.Address{1}, Nonce: common.ToNonce(10)}},
+		Slots:           []common.SlotUpdate{{Account: common.Address{1}, Key: common.Key{1}, Value: common.Value{2}}},
+	}
+}
+
+func TestLeafRlp_PrintsGethEncodingOfLiveDbAccount(t *testing.T) {
+	dir := t.TempDir()
+	state, err := mpt.OpenGoFileState(dir, mpt.S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	if _, err := state.Apply(0, getLeafRlpTestUpdate()); err != nil {
+		t.Fatalf("failed to apply update: %v", err)
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := printAccountLeafRlp(&out, dir, common.Address{1}, nil); err != nil {
+		t.Fatalf("failed to print leaf: %v", err)
+	}
+	if got := out.String(); got != wantLeafRlp {
+		t.Errorf("unexpected output\nwanted %s\n   got %s", wantLeafRlp, got)
+	}
+
+	if err := printAccountLeafRlp(&out, dir, common.Address{2}, nil); err == nil {
+		t.Errorf("printing leaf of missing account should fail")
+	}
+	block := uint64(0)
+	if err := printAccountLeafRlp(&out, dir, common.Address{1}, &block); err == nil {
+		t.Errorf("selecting a block should fail for live DBs")
+	}
+}
+
+func TestLeafRlp_PrintsGethEncodingOfArchiveAccount(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := mpt.OpenArchiveTrie(dir, mpt.S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	if err := archive.Add(0, common.Update{}, nil); err != nil {
+		t.Fatalf("failed to add block: %v", err)
+	}
+	if err := archive.Add(1, getLeafRlpTestUpdate(), nil); err != nil {
+		t.Fatalf("failed to add block: %v", err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := printAccountLeafRlp(&out, dir, common.Address{1}, nil); err != nil {
+		t.Fatalf("failed to print leaf: %v", err)
+	}
+	if got := out.String(); got != wantLeafRlp {
+		t.Errorf("unexpected output\nwanted %s\n   got %s", wantLeafRlp, got)
+	}
+
+	block := uint64(0)
+	if err := printAccountLeafRlp(&out, dir, common.Address{1}, &block); err == nil {
+		t.Errorf("printing leaf of account not present in block should fail")
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"os"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+	"github.com/urfave/cli/v2"
+)
+
+var sharedFlag = cli.BoolFlag{
+	Name:  "shared",
+	Usage: "reads the directory even if it is in use by a writer; results may be inconsistent since the writer may modify the directory concurrently",
+}
+
+// lockDirectoryForReading locks the given directory for the read-only access
+// of a command. Unless the --shared flag is set, the lock fails if a writer
+// is using the directory and prevents writers from opening it while being
+// held.
+func lockDirectoryForReading(context *cli.Context, dir string) (common.LockFile, error) {
+	// Locking implicitly creates missing directories, which is not desired
+	// for read-only accesses.
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	access := mpt.ReadOnlyAccess
+	if context.Bool(sharedFlag.Name) {
+		access = mpt.SharedReadOnlyAccess
+	}
+	return mpt.LockDirectoryWithAccess(dir, access)
+}
@@ -32,11 +32,20 @@ func main() {
 			&ImportLiveDbCmd,
 			&ImportArchiveCmd,
 			&ImportLiveAndArchiveCmd,
+			&IndexRoots,
 			&Info,
 			&InitArchive,
 			&Verify,
+			&VerifyProof,
 			&Benchmark,
+			&BackfillLeafCounts,
 			&Block,
+			&LeafRlp,
+			&Migrate,
+			&PruneEmpty,
+			&SelfCheck,
+			&Shape,
+			&UpgradeSchema,
 		},
 	}
 
@@ -0,0 +1,81 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Fantom-foundation/Carmen/go/common/interrupt"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+	mptIo "github.com/Fantom-foundation/Carmen/go/database/mpt/io"
+	"github.com/urfave/cli/v2"
+)
+
+var Migrate = cli.Command{
+	Action:    migrate,
+	Name:      "migrate",
+	Usage:     "copies the content of a LiveDB into a new LiveDB using another configuration, resuming an interrupted migration if present",
+	ArgsUsage: "<source director> <target director>",
+	Flags: []cli.Flag{
+		&targetConfigFlag,
+	},
+}
+
+var targetConfigFlag = cli.StringFlag{
+	Name:  "target-config",
+	Usage: "the name of the MPT configuration of the target LiveDB",
+	Value: mpt.S5LiveConfig.Name,
+}
+
+func migrate(context *cli.Context) error {
+	if context.Args().Len() != 2 {
+		return fmt.Errorf("missing source and/or target directory parameter")
+	}
+	src := context.Args().Get(0)
+	dst := context.Args().Get(1)
+	ctx := interrupt.CancelOnInterrupt(context.Context)
+	return migrateLiveDb(ctx, os.Stdout, src, dst, context.String(targetConfigFlag.Name))
+}
+
+// migrateLiveDb migrates the LiveDB in the source directory into the target
+// directory using the configuration of the given name, printing the progress
+// and the hash of the resulting state. An interrupted run can be continued
+// by running it again with the same directories.
+func migrateLiveDb(ctx context.Context, out io.Writer, src, dst, configName string) error {
+	info, err := mptIo.CheckMptDirectoryAndGetInfo(src)
+	if err != nil {
+		return err
+	}
+	if info.Mode != mpt.Mutable {
+		return fmt.Errorf("can only migrate LiveDB instances, found %v in directory", info.Mode)
+	}
+	config, found := mpt.GetConfigByName(configName)
+	if !found {
+		return fmt.Errorf("unknown MPT configuration: %s", configName)
+	}
+
+	fmt.Fprintf(out, "Migrating %s from %s to %s ...\n", src, info.Config.Name, config.Name)
+	hash, err := mpt.MigrateDirectoryWithContext(ctx, src, dst, info.Config, config, func(progress mpt.MigrationProgress) {
+		fmt.Fprintf(out, "Migrated chunk %d/%d - accounts: %d, slots: %d\n", progress.Chunk, progress.NumChunks, progress.Accounts, progress.Slots)
+	})
+	if err != nil {
+		if errors.Is(err, interrupt.ErrCanceled) {
+			fmt.Fprintf(out, "Interrupted, run again to continue\n")
+		}
+		return err
+	}
+	_, err = fmt.Fprintf(out, "Migration completed, state hash: %x\n", hash)
+	return err
+}
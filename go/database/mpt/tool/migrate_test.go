@@ -0,0 +1,80 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+)
+
+func TestMigrate_LiveDbIsConvertedToTargetConfig(t *testing.T) {
+	src := t.TempDir()
+	state, err := mpt.OpenGoFileState(src, mpt.S4LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	update := common.Update{}
+	for i := 0; i < 8; i++ {
+		addr := common.Address{byte(i)}
+		update.AppendCreateAccount(addr)
+		update.AppendNonceUpdate(addr, common.ToNonce(1))
+		update.AppendSlotUpdate(addr, common.Key{byte(i)}, common.Value{1})
+	}
+	if _, err := state.Apply(0, update); err != nil {
+		t.Fatalf("failed to apply update: %v", err)
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "target")
+	var out bytes.Buffer
+	if err := migrateLiveDb(context.Background(), &out, src, dst, mpt.S5LiveConfig.Name); err != nil {
+		t.Fatalf("failed to migrate LiveDB: %v", err)
+	}
+	for _, want := range []string{"Migrated chunk 16/16 - accounts: 8, slots: 8", "Migration completed"} {
+		if got := out.String(); !strings.Contains(got, want) {
+			t.Errorf("output should contain %q, got %q", want, got)
+		}
+	}
+
+	migrated, err := mpt.OpenGoFileState(dst, mpt.S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open migrated state: %v", err)
+	}
+	defer migrated.Close()
+	for i := 0; i < 8; i++ {
+		if value, err := migrated.GetStorage(common.Address{byte(i)}, common.Key{byte(i)}); err != nil || value != (common.Value{1}) {
+			t.Errorf("unexpected value of account %d: %v, err %v", i, value, err)
+		}
+	}
+}
+
+func TestMigrate_UnknownTargetConfigIsRejected(t *testing.T) {
+	src := t.TempDir()
+	state, err := mpt.OpenGoFileState(src, mpt.S4LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+	var out bytes.Buffer
+	if err := migrateLiveDb(context.Background(), &out, src, t.TempDir(), "unknown"); err == nil {
+		t.Errorf("unknown target configuration should be rejected")
+	}
+}
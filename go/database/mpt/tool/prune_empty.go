@@ -0,0 +1,67 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Fantom-foundation/Carmen/go/common/interrupt"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+	mptIo "github.com/Fantom-foundation/Carmen/go/database/mpt/io"
+	"github.com/urfave/cli/v2"
+)
+
+var PruneEmpty = cli.Command{
+	Action:    pruneEmpty,
+	Name:      "prune-empty",
+	Usage:     "removes accounts that are empty according to EIP-161 and have no storage from a LiveDB",
+	ArgsUsage: "<director>",
+}
+
+func pruneEmpty(context *cli.Context) error {
+	if context.Args().Len() != 1 {
+		return fmt.Errorf("missing directory storing state")
+	}
+	dir := context.Args().Get(0)
+	ctx := interrupt.CancelOnInterrupt(context.Context)
+	return pruneEmptyAccounts(ctx, os.Stdout, dir)
+}
+
+// pruneEmptyAccounts removes empty accounts from the LiveDB in the given
+// directory and prints the number of removed accounts. An interrupted run
+// can be continued by running it again on the same directory.
+func pruneEmptyAccounts(ctx context.Context, out io.Writer, dir string) error {
+	info, err := mptIo.CheckMptDirectoryAndGetInfo(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode != mpt.Mutable {
+		return fmt.Errorf("can only prune LiveDB instances, found %v in directory", info.Mode)
+	}
+
+	state, err := mpt.OpenGoFileState(dir, info.Config, mpt.DefaultMptStateCapacity)
+	if err != nil {
+		return fmt.Errorf("failed to open LiveDB in %s: %w", dir, err)
+	}
+	removed, err := state.PruneEmptyAccountsWithContext(ctx)
+	if err := errors.Join(err, state.Close()); err != nil {
+		if errors.Is(err, interrupt.ErrCanceled) {
+			fmt.Fprintf(out, "Interrupted after removing %d empty accounts, run again to continue\n", removed)
+		}
+		return err
+	}
+	_, err = fmt.Fprintf(out, "Removed %d empty accounts\n", removed)
+	return err
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/common/interrupt"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+)
+
+func TestPruneEmpty_RemovesEmptyAccountsFromLiveDb(t *testing.T) {
+	dir := t.TempDir()
+	state, err := mpt.OpenGoFileState(dir, mpt.S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	update := common.Update{
+		CreatedAccounts: []common.Address{{1}, {2}, {3}},
+		Nonces:          []common.NonceUpdate{{Account: common.Address{2}, Nonce: common.ToNonce(1)}},
+	}
+	if _, err := state.Apply(0, update); err != nil {
+		t.Fatalf("failed to apply update: %v", err)
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+
+	// An interrupted run does not remove anything.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var out bytes.Buffer
+	if err := pruneEmptyAccounts(ctx, &out, dir); !errors.Is(err, interrupt.ErrCanceled) {
+		t.Errorf("unexpected error, wanted %v, got %v", interrupt.ErrCanceled, err)
+	}
+	if want, got := "Interrupted after removing 0 empty accounts, run again to continue\n", out.String(); want != got {
+		t.Errorf("unexpected output, wanted %q, got %q", want, got)
+	}
+
+	out.Reset()
+	if err := pruneEmptyAccounts(context.Background(), &out, dir); err != nil {
+		t.Fatalf("failed to prune empty accounts: %v", err)
+	}
+	if want, got := "Removed 2 empty accounts\n", out.String(); want != got {
+		t.Errorf("unexpected output, wanted %q, got %q", want, got)
+	}
+
+	state, err = mpt.OpenGoFileState(dir, mpt.S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	for _, want := range []struct {
+		address common.Address
+		exists  bool
+	}{{common.Address{1}, false}, {common.Address{2}, true}, {common.Address{3}, false}} {
+		if exists, err := state.Exists(want.address); err != nil || exists != want.exists {
+			t.Errorf("unexpected existence of account %v, wanted %t, got %t, err %v", want.address, want.exists, exists, err)
+		}
+	}
+}
+
+func TestPruneEmpty_ArchivesAreRejected(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := mpt.OpenArchiveTrie(dir, mpt.S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+	if err := pruneEmptyAccounts(context.Background(), &bytes.Buffer{}, dir); err == nil {
+		t.Errorf("pruning archives should fail")
+	}
+}
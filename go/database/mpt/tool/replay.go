@@ -0,0 +1,188 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+	mptIo "github.com/Fantom-foundation/Carmen/go/database/mpt/io"
+)
+
+type replayParams struct {
+	traceFile      string // the file containing the trace to be replayed
+	stateDir       string // the directory of an existing LiveDB, a fresh one is created if empty
+	tmpDir         string // the directory to create a fresh LiveDB in
+	keepState      bool   // whether a fresh LiveDB should be retained after the run
+	reportInterval int    // the number of blocks between progress reports
+	metrics        bool   // whether to collect statistics on node visits per operation
+}
+
+type replayResult struct {
+	numBlocks     int
+	numOperations int64
+	replayTime    time.Duration
+	latencies     []time.Duration // the time spent on each block in order
+	hash          common.Hash     // the state hash after the last block
+
+	// Statistics on node visits per operation, nil if metrics are disabled.
+	operationStats *mpt.OperationStatsReport
+}
+
+// getLatencyPercentile returns the block latency below which the given
+// percentage of blocks has been replayed.
+func (r *replayResult) getLatencyPercentile(percent int) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(r.latencies))
+	copy(sorted, r.latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)-1)*percent/100]
+}
+
+func replay(params replayParams, observer func(string, ...any)) error {
+	result, err := runReplay(params, observer)
+	if err != nil {
+		return err
+	}
+	seconds := result.replayTime.Seconds()
+	fmt.Printf("Overall time: %v\n", result.replayTime)
+	fmt.Printf("Overall throughput: %.2f blocks/second, %.2f operations/second\n", float64(result.numBlocks)/seconds, float64(result.numOperations)/seconds)
+	fmt.Printf(
+		"Block latency: p50 %v, p90 %v, p99 %v, max %v\n",
+		result.getLatencyPercentile(50),
+		result.getLatencyPercentile(90),
+		result.getLatencyPercentile(99),
+		result.getLatencyPercentile(100),
+	)
+	fmt.Printf("Final state hash: %x (matches recorded hash)\n", result.hash)
+	if result.operationStats != nil {
+		fmt.Printf("Node visits per operation:\n%v", result.operationStats)
+	}
+	return nil
+}
+
+// runReplay applies the blocks of a trace recorded by a mpt.TraceRecorder to
+// a LiveDB, measuring the time required for each block. After each block, the
+// resulting state hash is compared to the hash recorded in the trace. Since
+// the replay is deterministic, any mismatch indicates that the trace does not
+// fit the initial state of the LiveDB or that the trace got corrupted.
+func runReplay(
+	params replayParams,
+	observer func(string, ...any),
+) (res replayResult, err error) {
+	file, err := os.Open(params.traceFile)
+	if err != nil {
+		return res, fmt.Errorf("failed to open trace file: %v", err)
+	}
+	defer file.Close()
+	trace, err := mpt.OpenTraceReader(file)
+	if err != nil {
+		return res, fmt.Errorf("failed to read trace file: %v", err)
+	}
+
+	path := params.stateDir
+	config := mpt.S5LiveConfig
+	if len(path) == 0 {
+		path = fmt.Sprintf(params.tmpDir+string(os.PathSeparator)+"state_%d", time.Now().Unix())
+		observer("Creating fresh LiveDB in %s ..", path)
+		if err := os.Mkdir(path, 0700); err != nil {
+			return res, fmt.Errorf("failed to create temporary state directory: %v", err)
+		}
+		if !params.keepState {
+			defer func() {
+				observer("Cleaning up state in %s ..", path)
+				if err := os.RemoveAll(path); err != nil {
+					observer("Cleanup failed: %v", err)
+				}
+			}()
+		}
+	} else {
+		info, err := mptIo.CheckMptDirectoryAndGetInfo(path)
+		if err != nil {
+			return res, err
+		}
+		if info.Mode != mpt.Mutable {
+			return res, fmt.Errorf("can only replay traces on LiveDB instances, found %v in directory", info.Mode)
+		}
+		config = info.Config
+		observer("Using existing LiveDB in %s ..", path)
+	}
+
+	state, err := mpt.OpenGoFileStateWithConfig(path, config, mpt.ForestConfig{
+		CacheCapacity:  mpt.DefaultMptStateCapacity,
+		MetricsEnabled: params.metrics,
+	})
+	if err != nil {
+		return res, err
+	}
+	defer func() {
+		err = errors.Join(err, state.Close())
+	}()
+
+	reportingInterval := params.reportInterval
+	if reportingInterval <= 0 {
+		reportingInterval = 1000
+	}
+
+	observer("Replaying trace %s ..", params.traceFile)
+	intervalTime := time.Duration(0)
+	for {
+		block, err := trace.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, fmt.Errorf("failed to read block from trace: %v", err)
+		}
+
+		start := time.Now()
+		hash, err := state.ReplayTraceBlock(block)
+		latency := time.Since(start)
+		if err != nil {
+			return res, fmt.Errorf("failed to replay block %d: %v", block.Block, err)
+		}
+		if hash != block.Hash {
+			return res, fmt.Errorf("hash mismatch after block %d, recorded %x, got %x", block.Block, block.Hash, hash)
+		}
+
+		res.numBlocks++
+		res.numOperations += int64(block.NumOperations())
+		res.replayTime += latency
+		res.latencies = append(res.latencies, latency)
+		res.hash = hash
+
+		intervalTime += latency
+		if res.numBlocks%reportingInterval == 0 {
+			observer(
+				"Reached block %d, average block latency %v",
+				block.Block, intervalTime/time.Duration(reportingInterval),
+			)
+			intervalTime = 0
+		}
+	}
+	observer("Finished replay of %d blocks with %d operations", res.numBlocks, res.numOperations)
+	if params.metrics {
+		stats, err := state.GetOperationStats()
+		if err != nil {
+			return res, err
+		}
+		res.operationStats = &stats
+	}
+	return res, nil
+}
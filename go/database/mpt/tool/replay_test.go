@@ -0,0 +1,192 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+)
+
+func TestReplay_ReplayingTraceIsDeterministic(t *testing.T) {
+	traceFile := filepath.Join(t.TempDir(), "trace.dat")
+	want := recordTestTrace(t, t.TempDir(), traceFile, 20)
+
+	for i := 0; i < 2; i++ {
+		result, err := runReplay(replayParams{
+			traceFile:      traceFile,
+			tmpDir:         t.TempDir(),
+			reportInterval: 5,
+		}, func(string, ...any) {})
+		if err != nil {
+			t.Fatalf("failed to replay trace: %v", err)
+		}
+		if want, got := 20, result.numBlocks; want != got {
+			t.Errorf("unexpected number of blocks, wanted %d, got %d", want, got)
+		}
+		if want, got := 20, len(result.latencies); want != got {
+			t.Errorf("unexpected number of latencies, wanted %d, got %d", want, got)
+		}
+		if want, got := int64(20*3*3), result.numOperations; want != got {
+			t.Errorf("unexpected number of operations, wanted %d, got %d", want, got)
+		}
+		if want != result.hash {
+			t.Errorf("unexpected final hash in run %d, wanted %x, got %x", i, want, result.hash)
+		}
+	}
+}
+
+func TestReplay_OperationStatsAreCollectedIfEnabled(t *testing.T) {
+	traceFile := filepath.Join(t.TempDir(), "trace.dat")
+	recordTestTrace(t, t.TempDir(), traceFile, 5)
+
+	for _, metrics := range []bool{false, true} {
+		result, err := runReplay(replayParams{
+			traceFile: traceFile,
+			tmpDir:    t.TempDir(),
+			metrics:   metrics,
+		}, func(string, ...any) {})
+		if err != nil {
+			t.Fatalf("failed to replay trace: %v", err)
+		}
+		if !metrics {
+			if result.operationStats != nil {
+				t.Errorf("operation stats should not be collected if disabled")
+			}
+			continue
+		}
+		if result.operationStats == nil {
+			t.Fatalf("operation stats should be collected if enabled")
+		}
+		if got := result.operationStats.SetValue.Visits.Count(); got != 5*3 {
+			t.Errorf("unexpected number of recorded value updates, wanted %d, got %d", 5*3, got)
+		}
+	}
+}
+
+func TestReplay_FreshStateIsRemovedUnlessKept(t *testing.T) {
+	traceFile := filepath.Join(t.TempDir(), "trace.dat")
+	recordTestTrace(t, t.TempDir(), traceFile, 2)
+
+	for _, keep := range []bool{false, true} {
+		dir := t.TempDir()
+		_, err := runReplay(replayParams{
+			traceFile: traceFile,
+			tmpDir:    dir,
+			keepState: keep,
+		}, func(string, ...any) {})
+		if err != nil {
+			t.Fatalf("failed to replay trace: %v", err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("failed to list directory: %v", err)
+		}
+		if want, got := keep, len(entries) > 0; want != got {
+			t.Errorf("unexpected presence of state with keep-state=%t: %v", keep, entries)
+		}
+	}
+}
+
+func TestReplay_HashMismatchesAreDetected(t *testing.T) {
+	stateDir := t.TempDir()
+	traceFile := filepath.Join(t.TempDir(), "trace.dat")
+	recordTestTrace(t, stateDir, traceFile, 5)
+
+	// The state the trace was recorded on already contains the updates of all
+	// blocks, so the hash after the first replayed block differs.
+	_, err := runReplay(replayParams{
+		traceFile: traceFile,
+		stateDir:  stateDir,
+	}, func(string, ...any) {})
+	if err == nil || !strings.Contains(err.Error(), "hash mismatch") {
+		t.Errorf("hash mismatch not detected, got %v", err)
+	}
+}
+
+func TestReplay_InvalidTraceFilesAreDetected(t *testing.T) {
+	dir := t.TempDir()
+	traceFile := filepath.Join(dir, "trace.dat")
+	if err := os.WriteFile(traceFile, []byte("not a trace"), 0600); err != nil {
+		t.Fatalf("failed to write trace file: %v", err)
+	}
+	params := replayParams{traceFile: traceFile, tmpDir: dir}
+	if _, err := runReplay(params, func(string, ...any) {}); err == nil {
+		t.Errorf("invalid trace file should be detected")
+	}
+	params.traceFile = filepath.Join(dir, "missing.dat")
+	if _, err := runReplay(params, func(string, ...any) {}); err == nil {
+		t.Errorf("missing trace file should be detected")
+	}
+}
+
+// recordTestTrace applies the given number of blocks to a fresh LiveDB in the
+// given directory while recording a trace into the given file. The final hash
+// of the LiveDB is returned.
+func recordTestTrace(t *testing.T, dir string, traceFile string, numBlocks int) common.Hash {
+	t.Helper()
+	file, err := os.Create(traceFile)
+	if err != nil {
+		t.Fatalf("failed to create trace file: %v", err)
+	}
+	recorder, err := mpt.NewTraceRecorder(file)
+	if err != nil {
+		t.Fatalf("failed to create recorder: %v", err)
+	}
+	state, err := mpt.OpenGoFileState(dir, mpt.S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	state.SetTraceRecorder(recorder)
+
+	for i := 0; i < numBlocks; i++ {
+		update := common.Update{}
+		for j := 0; j < 3; j++ {
+			addr := common.Address{byte(i), byte(j)}
+			update.CreatedAccounts = append(update.CreatedAccounts, addr)
+			update.Nonces = append(update.Nonces, common.NonceUpdate{Account: addr, Nonce: common.ToNonce(1)})
+			update.Slots = append(update.Slots, common.SlotUpdate{Account: addr, Key: common.Key{byte(j)}, Value: common.Value{1}})
+		}
+		if _, err := state.Apply(uint64(i), update); err != nil {
+			t.Fatalf("failed to apply block %d: %v", i, err)
+		}
+	}
+	hash, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+	if err := errors.Join(recorder.Flush(), file.Close(), state.Close()); err != nil {
+		t.Fatalf("failed to close trace or state: %v", err)
+	}
+	return hash
+}
+
+func TestReplayResult_GetLatencyPercentile(t *testing.T) {
+	result := replayResult{}
+	if want, got := time.Duration(0), result.getLatencyPercentile(50); want != got {
+		t.Errorf("unexpected percentile of empty result, wanted %v, got %v", want, got)
+	}
+	for i := 100; i > 0; i-- {
+		result.latencies = append(result.latencies, time.Duration(i))
+	}
+	tests := map[int]time.Duration{0: 1, 50: 50, 90: 90, 99: 99, 100: 100}
+	for percent, want := range tests {
+		if got := result.getLatencyPercentile(percent); want != got {
+			t.Errorf("unexpected %d-th percentile, wanted %v, got %v", percent, want, got)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+	mptIo "github.com/Fantom-foundation/Carmen/go/database/mpt/io"
+	"github.com/urfave/cli/v2"
+)
+
+var SelfCheck = cli.Command{
+	Action:    selfCheck,
+	Name:      "selfcheck",
+	Usage:     "re-computes the hashes of a random sample of nodes to detect corruptions without a full verification",
+	ArgsUsage: "<director>",
+	Flags: []cli.Flag{
+		&sampleSizeFlag,
+	},
+}
+
+var sampleSizeFlag = cli.IntFlag{
+	Name:  "samples",
+	Usage: "the number of nodes to be sampled",
+	Value: 1000,
+}
+
+func selfCheck(context *cli.Context) error {
+	if context.Args().Len() != 1 {
+		return fmt.Errorf("missing directory storing state")
+	}
+	dir := context.Args().Get(0)
+	return runSelfCheck(os.Stdout, dir, context.Int(sampleSizeFlag.Name))
+}
+
+// runSelfCheck runs a self-check of the given sample size on the LiveDB or
+// Archive in the given directory and prints the resulting report. An error
+// is returned if hash mismatches are detected.
+func runSelfCheck(out io.Writer, dir string, sampleSize int) error {
+	info, err := mptIo.CheckMptDirectoryAndGetInfo(dir)
+	if err != nil {
+		return err
+	}
+
+	var report mpt.SelfCheckReport
+	if info.Mode == mpt.Immutable {
+		archive, err := mpt.OpenArchiveTrie(dir, info.Config, mpt.DefaultMptStateCapacity)
+		if err != nil {
+			return fmt.Errorf("failed to open archive in %s: %w", dir, err)
+		}
+		report, err = archive.SelfCheck(sampleSize)
+		if err := errors.Join(err, archive.Close()); err != nil {
+			return err
+		}
+	} else {
+		trie, err := mpt.OpenFileLiveTrie(dir, info.Config, mpt.DefaultMptStateCapacity)
+		if err != nil {
+			return fmt.Errorf("failed to open live trie in %s: %w", dir, err)
+		}
+		report, err = trie.SelfCheck(sampleSize)
+		if err := errors.Join(err, trie.Close()); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprintln(out, report.String()); err != nil {
+		return err
+	}
+	if report.Failed() {
+		return fmt.Errorf("self-check detected %d hash mismatches", len(report.Mismatches))
+	}
+	return nil
+}
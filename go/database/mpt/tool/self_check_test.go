@@ -0,0 +1,64 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+)
+
+func TestSelfCheck_ConsistentLiveDbAndArchivePass(t *testing.T) {
+	dir := t.TempDir()
+	state, err := mpt.OpenGoFileState(dir, mpt.S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	archiveDir := t.TempDir()
+	archive, err := mpt.OpenArchiveTrie(archiveDir, mpt.S5ArchiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	for block := uint64(0); block < 4; block++ {
+		update := common.Update{}
+		for i := 0; i < 8; i++ {
+			addr := common.Address{byte(block), byte(i)}
+			update.AppendCreateAccount(addr)
+			update.AppendNonceUpdate(addr, common.ToNonce(1))
+			update.AppendSlotUpdate(addr, common.Key{byte(i)}, common.Value{1})
+		}
+		if _, err := state.Apply(block, update); err != nil {
+			t.Fatalf("failed to apply update: %v", err)
+		}
+		if err := archive.Add(block, update, nil); err != nil {
+			t.Fatalf("failed to add block: %v", err)
+		}
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+
+	for _, dir := range []string{dir, archiveDir} {
+		var out bytes.Buffer
+		if err := runSelfCheck(&out, dir, 100); err != nil {
+			t.Errorf("self-check should pass, got %v", err)
+		}
+		if got := out.String(); !strings.Contains(got, "found 0 mismatches") {
+			t.Errorf("unexpected output: %s", got)
+		}
+	}
+}
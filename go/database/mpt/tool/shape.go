@@ -0,0 +1,101 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+	mptIo "github.com/Fantom-foundation/Carmen/go/database/mpt/io"
+	"github.com/urfave/cli/v2"
+)
+
+var Shape = cli.Command{
+	Action:    shape,
+	Name:      "shape",
+	Usage:     "prints histograms of leaf depths and extension path lengths of a trie",
+	ArgsUsage: "<director>",
+	Flags: []cli.Flag{
+		&targetBlockFlag,
+		&sharedFlag,
+	},
+}
+
+func shape(context *cli.Context) error {
+	// parse the directory argument
+	if context.Args().Len() != 1 {
+		return fmt.Errorf("missing directory storing state")
+	}
+	dir := context.Args().Get(0)
+
+	var block *uint64
+	if context.IsSet(targetBlockFlag.Name) {
+		value := context.Uint64(targetBlockFlag.Name)
+		block = &value
+	}
+	lock, err := lockDirectoryForReading(context, dir)
+	if err != nil {
+		return err
+	}
+	return errors.Join(
+		printTrieShape(os.Stdout, dir, block),
+		lock.Release(),
+	)
+}
+
+// printTrieShape prints the shape histograms of the trie stored in the given
+// directory. For archives, the given block is used, or the latest block if nil.
+func printTrieShape(out io.Writer, dir string, block *uint64) error {
+	info, err := mptIo.CheckMptDirectoryAndGetInfo(dir)
+	if err != nil {
+		return err
+	}
+
+	var shape mpt.TrieShape
+	if info.Mode == mpt.Immutable {
+		archive, err := mpt.OpenArchiveTrie(dir, info.Config, mpt.DefaultMptStateCapacity)
+		if err != nil {
+			return fmt.Errorf("failed to open archive in %s: %w", dir, err)
+		}
+		if block == nil {
+			height, empty, err := archive.GetBlockHeight()
+			if err != nil {
+				return errors.Join(err, archive.Close())
+			}
+			if empty {
+				return errors.Join(fmt.Errorf("archive is empty"), archive.Close())
+			}
+			block = &height
+		}
+		shape, err = mpt.GetArchiveTrieShape(archive, *block)
+		if err := errors.Join(err, archive.Close()); err != nil {
+			return err
+		}
+	} else {
+		if block != nil {
+			return fmt.Errorf("the --%s flag is only supported for archives", targetBlockFlag.Name)
+		}
+		trie, err := mpt.OpenFileLiveTrie(dir, info.Config, mpt.DefaultMptStateCapacity)
+		if err != nil {
+			return fmt.Errorf("failed to open live trie in %s: %w", dir, err)
+		}
+		shape, err = mpt.GetTrieShape(trie)
+		if err := errors.Join(err, trie.Close()); err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprint(out, shape.String())
+	return err
+}
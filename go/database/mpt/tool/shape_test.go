@@ -0,0 +1,71 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+)
+
+func TestShape_PrintsHistogramsOfLiveDb(t *testing.T) {
+	dir := t.TempDir()
+	state, err := mpt.OpenGoFileState(dir, mpt.S4LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	update := common.Update{
+		CreatedAccounts: []common.Address{{0x00}, {0x10}},
+		Nonces: []common.NonceUpdate{
+			{Account: common.Address{0x00}, Nonce: common.ToNonce(1)},
+			{Account: common.Address{0x10}, Nonce: common.ToNonce(1)},
+		},
+		Slots: []common.SlotUpdate{
+			{Account: common.Address{0x00}, Key: common.Key{0x01}, Value: common.Value{1}},
+			{Account: common.Address{0x00}, Key: common.Key{0x02}, Value: common.Value{2}},
+		},
+	}
+	if _, err := state.Apply(0, update); err != nil {
+		t.Fatalf("failed to apply update: %v", err)
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := printTrieShape(&out, dir, nil); err != nil {
+		t.Fatalf("failed to print shape: %v", err)
+	}
+	want := strings.Join([]string{
+		"Account-Leaf-Depth Distribution:",
+		"0, 0",
+		"1, 2",
+		"Value-Leaf-Depth Distribution:",
+		"0, 0",
+		"1, 0",
+		"2, 2",
+		"Extension-Path-Length Distribution:",
+		"0, 0",
+		"1, 1",
+		"",
+	}, "\n")
+	if got := out.String(); got != want {
+		t.Errorf("unexpected output\nwanted\n%s\ngot\n%s", want, got)
+	}
+
+	block := uint64(0)
+	if err := printTrieShape(&out, dir, &block); err == nil {
+		t.Errorf("selecting a block should fail for live DBs")
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/Fantom-foundation/Carmen/go/common/interrupt"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+	mptIo "github.com/Fantom-foundation/Carmen/go/database/mpt/io"
+	"github.com/urfave/cli/v2"
+)
+
+var UpgradeSchema = cli.Command{
+	Action:    upgradeSchema,
+	Name:      "upgrade-schema",
+	Usage:     "upgrades a LiveDB in-place to a newer schema, resuming an interrupted upgrade if present",
+	ArgsUsage: "<director>",
+	Flags: []cli.Flag{
+		&targetSchemaFlag,
+	},
+}
+
+var targetSchemaFlag = cli.IntFlag{
+	Name:  "target-schema",
+	Usage: "the schema the LiveDB should be upgraded to",
+	Value: 5,
+}
+
+// liveDbSchema associates a schema with the configuration of its LiveDB.
+type liveDbSchema struct {
+	schema int
+	config mpt.MptConfig
+}
+
+// liveDbSchemas lists the supported schemas in ascending order.
+var liveDbSchemas = []liveDbSchema{
+	{4, mpt.S4LiveConfig},
+	{5, mpt.S5LiveConfig},
+}
+
+// Suffixes of temporary directories created next to the upgraded directory.
+const (
+	upgradeTargetSuffix = ".upgrade"
+	upgradeBackupSuffix = ".backup"
+)
+
+func upgradeSchema(context *cli.Context) error {
+	if context.Args().Len() != 1 {
+		return fmt.Errorf("missing directory storing state")
+	}
+	dir := context.Args().Get(0)
+	ctx := interrupt.CancelOnInterrupt(context.Context)
+	return upgradeLiveDbSchema(ctx, os.Stdout, dir, context.Int(targetSchemaFlag.Name))
+}
+
+// upgradeLiveDbSchema upgrades the LiveDB in the given directory step by step
+// to the given schema. Each step migrates the content of the LiveDB into a
+// temporary directory using the configuration of the next schema, which then
+// replaces the original directory. Since paths and hashing differ between
+// schemas, the root hash is recomputed. Upgrading a LiveDB already using the
+// target schema has no effect, downgrades are refused. An interrupted run can
+// be continued by running it again with the same directory.
+func upgradeLiveDbSchema(ctx context.Context, out io.Writer, dir string, target int) error {
+	dir = filepath.Clean(dir)
+	if err := completeSchemaUpgradeSwap(dir); err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(liveDbSchemas, func(s liveDbSchema) bool {
+		return s.schema == target
+	}) {
+		return fmt.Errorf("unsupported target schema %d", target)
+	}
+
+	for {
+		info, err := mptIo.CheckMptDirectoryAndGetInfo(dir)
+		if err != nil {
+			return err
+		}
+		if info.Mode != mpt.Mutable {
+			return fmt.Errorf("can only upgrade LiveDB instances, found %v in directory", info.Mode)
+		}
+		current := slices.IndexFunc(liveDbSchemas, func(s liveDbSchema) bool {
+			return s.config.Name == info.Config.Name
+		})
+		if current < 0 {
+			return fmt.Errorf("the configuration %s of the LiveDB is not associated to a schema", info.Config.Name)
+		}
+		schema := liveDbSchemas[current].schema
+		if schema > target {
+			return fmt.Errorf("can not downgrade LiveDB from schema %d to schema %d", schema, target)
+		}
+		if schema == target {
+			_, err := fmt.Fprintf(out, "LiveDB is using schema %d\n", schema)
+			return err
+		}
+
+		next := liveDbSchemas[current+1]
+		fmt.Fprintf(out, "Upgrading %s from schema %d to schema %d ...\n", dir, schema, next.schema)
+		hash, err := mpt.MigrateDirectoryWithContext(ctx, dir, dir+upgradeTargetSuffix, info.Config, next.config, func(progress mpt.MigrationProgress) {
+			fmt.Fprintf(out, "Migrated chunk %d/%d - accounts: %d, slots: %d\n", progress.Chunk, progress.NumChunks, progress.Accounts, progress.Slots)
+		})
+		if err != nil {
+			if errors.Is(err, interrupt.ErrCanceled) {
+				fmt.Fprintf(out, "Interrupted, run again to continue\n")
+			}
+			return err
+		}
+		if err := os.Rename(dir, dir+upgradeBackupSuffix); err != nil {
+			return err
+		}
+		if err := completeSchemaUpgradeSwap(dir); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Upgraded to schema %d, state hash: %x\n", next.schema, hash)
+	}
+}
+
+// completeSchemaUpgradeSwap finishes the replacement of the given directory
+// by its upgraded version if a previous upgrade got interrupted after moving
+// the original directory aside. Otherwise, this is a no-op.
+func completeSchemaUpgradeSwap(dir string) error {
+	backup := dir + upgradeBackupSuffix
+	if _, err := os.Stat(backup); errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("unable to complete upgrade, both %s and %s exist", dir, backup)
+	}
+	if err := os.Rename(dir+upgradeTargetSuffix, dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(backup)
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+)
+
+func createUpgradeTestLiveDb(t *testing.T, dir string, config mpt.MptConfig) common.Hash {
+	t.Helper()
+	state, err := mpt.OpenGoFileState(dir, config, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	update := common.Update{}
+	for i := 0; i < 8; i++ {
+		addr := common.Address{byte(i)}
+		update.AppendCreateAccount(addr)
+		update.AppendNonceUpdate(addr, common.ToNonce(1))
+		update.AppendSlotUpdate(addr, common.Key{byte(i)}, common.Value{1})
+	}
+	if _, err := state.Apply(0, update); err != nil {
+		t.Fatalf("failed to apply update: %v", err)
+	}
+	hash, err := state.GetHash()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+	return hash
+}
+
+func TestUpgradeSchema_LiveDbIsUpgradedInPlace(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "live")
+	createUpgradeTestLiveDb(t, dir, mpt.S4LiveConfig)
+	want := createUpgradeTestLiveDb(t, t.TempDir(), mpt.S5LiveConfig)
+
+	var out bytes.Buffer
+	if err := upgradeLiveDbSchema(context.Background(), &out, dir, 5); err != nil {
+		t.Fatalf("failed to upgrade LiveDB: %v", err)
+	}
+	for _, want := range []string{"from schema 4 to schema 5", "Upgraded to schema 5", "LiveDB is using schema 5"} {
+		if got := out.String(); !strings.Contains(got, want) {
+			t.Errorf("output should contain %q, got %q", want, got)
+		}
+	}
+	for _, suffix := range []string{upgradeTargetSuffix, upgradeBackupSuffix} {
+		if _, err := os.Stat(dir + suffix); !os.IsNotExist(err) {
+			t.Errorf("temporary directory %s should be removed, got %v", dir+suffix, err)
+		}
+	}
+
+	upgraded, err := mpt.OpenGoFileState(dir, mpt.S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open upgraded state: %v", err)
+	}
+	defer upgraded.Close()
+	if got, err := upgraded.GetHash(); err != nil || got != want {
+		t.Errorf("unexpected hash of upgraded state, wanted %x, got %x, err %v", want, got, err)
+	}
+	for i := 0; i < 8; i++ {
+		if value, err := upgraded.GetStorage(common.Address{byte(i)}, common.Key{byte(i)}); err != nil || value != (common.Value{1}) {
+			t.Errorf("unexpected value of account %d: %v, err %v", i, value, err)
+		}
+	}
+}
+
+func TestUpgradeSchema_UpgradeIsIdempotent(t *testing.T) {
+	dir := t.TempDir()
+	want := createUpgradeTestLiveDb(t, dir, mpt.S5LiveConfig)
+
+	for i := 0; i < 2; i++ {
+		var out bytes.Buffer
+		if err := upgradeLiveDbSchema(context.Background(), &out, dir, 5); err != nil {
+			t.Fatalf("failed to upgrade LiveDB: %v", err)
+		}
+		if got := out.String(); got != "LiveDB is using schema 5\n" {
+			t.Errorf("unexpected output: %q", got)
+		}
+	}
+
+	state, err := mpt.OpenGoFileState(dir, mpt.S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	if got, err := state.GetHash(); err != nil || got != want {
+		t.Errorf("state should not be modified, wanted %x, got %x, err %v", want, got, err)
+	}
+}
+
+func TestUpgradeSchema_DowngradeIsRefused(t *testing.T) {
+	dir := t.TempDir()
+	createUpgradeTestLiveDb(t, dir, mpt.S5LiveConfig)
+
+	var out bytes.Buffer
+	err := upgradeLiveDbSchema(context.Background(), &out, dir, 4)
+	if err == nil || !strings.Contains(err.Error(), "can not downgrade") {
+		t.Errorf("downgrade should be refused, got %v", err)
+	}
+}
+
+func TestUpgradeSchema_UnsupportedTargetSchemaIsRejected(t *testing.T) {
+	dir := t.TempDir()
+	createUpgradeTestLiveDb(t, dir, mpt.S4LiveConfig)
+
+	var out bytes.Buffer
+	if err := upgradeLiveDbSchema(context.Background(), &out, dir, 6); err == nil {
+		t.Errorf("unsupported target schema should be rejected")
+	}
+}
+
+func TestUpgradeSchema_InterruptedSwapIsCompleted(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "live")
+	createUpgradeTestLiveDb(t, dir, mpt.S4LiveConfig)
+	want := createUpgradeTestLiveDb(t, dir+upgradeTargetSuffix, mpt.S5LiveConfig)
+
+	// Simulate an upgrade interrupted after moving the original directory aside.
+	if err := os.Rename(dir, dir+upgradeBackupSuffix); err != nil {
+		t.Fatalf("failed to move directory: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := upgradeLiveDbSchema(context.Background(), &out, dir, 5); err != nil {
+		t.Fatalf("failed to upgrade LiveDB: %v", err)
+	}
+	if _, err := os.Stat(dir + upgradeBackupSuffix); !os.IsNotExist(err) {
+		t.Errorf("backup directory should be removed, got %v", err)
+	}
+
+	state, err := mpt.OpenGoFileState(dir, mpt.S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	if got, err := state.GetHash(); err != nil || got != want {
+		t.Errorf("unexpected hash, wanted %x, got %x, err %v", want, got, err)
+	}
+}
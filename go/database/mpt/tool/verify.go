@@ -11,10 +11,13 @@
 package main
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
+	"github.com/Fantom-foundation/Carmen/go/common"
 	"github.com/Fantom-foundation/Carmen/go/database/mpt"
 	"github.com/Fantom-foundation/Carmen/go/database/mpt/io"
 	"github.com/urfave/cli/v2"
@@ -27,10 +30,18 @@ var Verify = cli.Command{
 	ArgsUsage: "<director>",
 	Flags: []cli.Flag{
 		&cpuProfileFlag,
+		&verifyAddressFlag,
+		&targetBlockFlag,
+		&sharedFlag,
 	},
 }
 
-func verify(context *cli.Context) error {
+var verifyAddressFlag = cli.StringFlag{
+	Name:  "address",
+	Usage: "restricts the verification to the storage of the given account (hex encoded)",
+}
+
+func verify(context *cli.Context) (err error) {
 	// parse the directory argument
 	if context.Args().Len() != 1 {
 		return fmt.Errorf("missing directory storing state")
@@ -53,15 +64,55 @@ func verify(context *cli.Context) error {
 		return err
 	}
 
+	lock, err := lockDirectoryForReading(context, dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, lock.Release())
+	}()
+
 	// run forest verification
 	observer := &verificationObserver{}
 
+	if context.IsSet(verifyAddressFlag.Name) {
+		addr, err := parseAddress(context.String(verifyAddressFlag.Name))
+		if err != nil {
+			return err
+		}
+		if !context.IsSet(targetBlockFlag.Name) {
+			return mpt.VerifyAccountStorage(dir, info.Config, addr, observer)
+		}
+		if info.Mode != mpt.Immutable {
+			return fmt.Errorf("the --%s flag is only supported for archives", targetBlockFlag.Name)
+		}
+		block := context.Uint64(targetBlockFlag.Name)
+		return mpt.VerifyArchiveAccountStorage(dir, info.Config, block, addr, observer)
+	}
+	if context.IsSet(targetBlockFlag.Name) {
+		return fmt.Errorf("the --%s flag requires the --%s flag", targetBlockFlag.Name, verifyAddressFlag.Name)
+	}
+
 	if info.Mode == mpt.Immutable {
 		return mpt.VerifyArchiveTrie(dir, info.Config, observer)
 	}
 	return mpt.VerifyFileLiveTrie(dir, info.Config, observer)
 }
 
+// parseAddress parses a hex encoded account address with an optional 0x prefix.
+func parseAddress(str string) (common.Address, error) {
+	var addr common.Address
+	data, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(str), "0x"))
+	if err != nil {
+		return addr, fmt.Errorf("invalid address %q: %w", str, err)
+	}
+	if len(data) != len(addr) {
+		return addr, fmt.Errorf("invalid address %q: expected %d bytes, got %d", str, len(addr), len(data))
+	}
+	copy(addr[:], data)
+	return addr, nil
+}
+
 type verificationObserver struct {
 	start time.Time
 }
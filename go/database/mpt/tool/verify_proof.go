@@ -0,0 +1,148 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+	"github.com/urfave/cli/v2"
+)
+
+var VerifyProof = cli.Command{
+	Action:    verifyProof,
+	Name:      "verify-proof",
+	Usage:     "checks whether a proof is a valid inclusion or exclusion proof of an account or storage slot",
+	ArgsUsage: "<root-hash> <address> <proof-file>",
+	Description: "The proof file is a JSON file containing either a list of hex encoded RLP nodes, " +
+		"or an object in the format of the result of eth_getProof, whose account and storage proofs are used.",
+	Flags: []cli.Flag{
+		&proofKeyFlag,
+	},
+}
+
+var proofKeyFlag = cli.StringFlag{
+	Name:  "key",
+	Usage: "the hex encoded key of the storage slot to be verified instead of the account",
+}
+
+func verifyProof(context *cli.Context) error {
+	if context.Args().Len() != 3 {
+		return fmt.Errorf("missing root hash, account address, or proof file")
+	}
+	root, err := parseHash(context.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	addr, err := parseAddress(context.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	var key *common.Key
+	if context.IsSet(proofKeyFlag.Name) {
+		value, err := parseHash(context.String(proofKeyFlag.Name))
+		if err != nil {
+			return fmt.Errorf("invalid key: %w", err)
+		}
+		key = (*common.Key)(&value)
+	}
+	nodes, err := readProofNodes(context.Args().Get(2))
+	if err != nil {
+		return err
+	}
+	return verifyAndPrintProof(os.Stdout, root, addr, key, nodes)
+}
+
+// verifyAndPrintProof verifies the given proof nodes of the given account, or
+// of the given storage slot of the account if the key is not nil, against the
+// given root hash and prints whether it is an inclusion or exclusion proof.
+// An error is returned if the proof is invalid.
+func verifyAndPrintProof(out io.Writer, root common.Hash, addr common.Address, key *common.Key, nodes [][]byte) error {
+	if key == nil {
+		info, found, err := mpt.VerifyAccount(root, addr, nodes)
+		if err != nil {
+			return fmt.Errorf("invalid proof: %w", err)
+		}
+		if !found {
+			_, err = fmt.Fprintf(out, "valid exclusion proof of account %v\n", addr)
+			return err
+		}
+		_, err = fmt.Fprintf(out, "valid inclusion proof of account %v: nonce %d, balance %v, code hash %x\n",
+			addr, info.Nonce.ToUint64(), info.Balance.ToBigInt(), info.CodeHash)
+		return err
+	}
+
+	value, found, err := mpt.VerifyValue(root, addr, *key, nodes)
+	if err != nil {
+		return fmt.Errorf("invalid proof: %w", err)
+	}
+	if !found {
+		_, err = fmt.Fprintf(out, "valid exclusion proof of slot %x of account %v\n", (*key)[:], addr)
+		return err
+	}
+	_, err = fmt.Fprintf(out, "valid inclusion proof of slot %x of account %v: value %x\n", (*key)[:], addr, value)
+	return err
+}
+
+// readProofNodes parses the proof nodes listed in the given file. The file
+// contains either a JSON list of hex encoded nodes or a JSON object in the
+// format of the result of eth_getProof.
+func readProofNodes(filename string) ([][]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var encoded []string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		var result struct {
+			AccountProof []string `json:"accountProof"`
+			StorageProof []struct {
+				Proof []string `json:"proof"`
+			} `json:"storageProof"`
+		}
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("invalid proof file %s: %w", filename, err)
+		}
+		encoded = result.AccountProof
+		for _, proof := range result.StorageProof {
+			encoded = append(encoded, proof.Proof...)
+		}
+	}
+	nodes := make([][]byte, 0, len(encoded))
+	for _, str := range encoded {
+		node, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(str), "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid proof node %q: %w", str, err)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// parseHash parses a hex encoded 32-byte hash with an optional 0x prefix.
+func parseHash(str string) (common.Hash, error) {
+	var hash common.Hash
+	data, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(str), "0x"))
+	if err != nil {
+		return hash, fmt.Errorf("invalid hash %q: %w", str, err)
+	}
+	if len(data) != len(hash) {
+		return hash, fmt.Errorf("invalid hash %q: expected %d bytes, got %d", str, len(hash), len(data))
+	}
+	copy(hash[:], data)
+	return hash, nil
+}
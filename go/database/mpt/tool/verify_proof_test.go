@@ -0,0 +1,183 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt"
+)
+
+func TestVerifyProof_ValidProofsAreAccepted(t *testing.T) {
+	root, accountProof, storageProofs := getVerifyProofTestProof(t)
+	nodes := append(slices.Clone(accountProof), storageProofs[0]...)
+	nodes = append(nodes, storageProofs[1]...)
+
+	tests := map[string]struct {
+		addr common.Address
+		key  *common.Key
+		want string
+	}{
+		"account inclusion": {common.Address{1}, nil, "valid inclusion proof of account 01"},
+		"account exclusion": {common.Address{2}, nil, "valid exclusion proof of account 02"},
+		"slot inclusion":    {common.Address{1}, &common.Key{1}, "valid inclusion proof of slot 01"},
+		"slot exclusion":    {common.Address{1}, &common.Key{2}, "valid exclusion proof of slot 02"},
+		"slot of missing":   {common.Address{2}, &common.Key{1}, "valid exclusion proof of slot 01"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := verifyAndPrintProof(&out, root, test.addr, test.key, nodes); err != nil {
+				t.Fatalf("failed to verify proof: %v", err)
+			}
+			if got := out.String(); !strings.HasPrefix(got, test.want) {
+				t.Errorf("unexpected output, wanted %s, got %s", test.want, got)
+			}
+		})
+	}
+}
+
+func TestVerifyProof_TamperedProofsAreRejected(t *testing.T) {
+	root, accountProof, storageProofs := getVerifyProofTestProof(t)
+	tampered := slices.Clone(accountProof[0])
+	tampered[len(tampered)-1]++
+
+	tests := map[string]struct {
+		root  common.Hash
+		key   *common.Key
+		nodes [][]byte
+	}{
+		"wrong root":         {common.Hash{1}, nil, accountProof},
+		"tampered account":   {root, nil, [][]byte{tampered}},
+		"missing slot proof": {root, &common.Key{1}, accountProof},
+		"malformed node":     {root, nil, append(slices.Clone(accountProof), []byte{0xc2, 0x80})},
+		"tampered slot": {root, &common.Key{1}, append(slices.Clone(accountProof), func() []byte {
+			res := slices.Clone(storageProofs[0][0])
+			res[len(res)-1]++
+			return res
+		}())},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := verifyAndPrintProof(&out, test.root, common.Address{1}, test.key, test.nodes); err == nil {
+				t.Errorf("tampered proof should be rejected, got %s", out.String())
+			}
+		})
+	}
+}
+
+func TestVerifyProof_ProofsCanBeReadFromFiles(t *testing.T) {
+	_, accountProof, storageProofs := getVerifyProofTestProof(t)
+	toHex := func(nodes [][]byte) []string {
+		res := []string{}
+		for _, node := range nodes {
+			res = append(res, fmt.Sprintf("0x%x", node))
+		}
+		return res
+	}
+	type storageProof struct {
+		Proof []string `json:"proof"`
+	}
+
+	dir := t.TempDir()
+	list, err := json.Marshal(toHex(accountProof))
+	if err != nil {
+		t.Fatalf("failed to encode proof: %v", err)
+	}
+	result, err := json.Marshal(struct {
+		AccountProof []string       `json:"accountProof"`
+		StorageProof []storageProof `json:"storageProof"`
+	}{
+		AccountProof: toHex(accountProof),
+		StorageProof: []storageProof{{toHex(storageProofs[0])}},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode proof: %v", err)
+	}
+
+	tests := map[string]struct {
+		content []byte
+		want    [][]byte
+	}{
+		"node list":    {list, accountProof},
+		"eth_getProof": {result, append(slices.Clone(accountProof), storageProofs[0]...)},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(dir, "proof.json")
+			if err := os.WriteFile(filename, test.content, 0600); err != nil {
+				t.Fatalf("failed to write proof: %v", err)
+			}
+			nodes, err := readProofNodes(filename)
+			if err != nil {
+				t.Fatalf("failed to read proof: %v", err)
+			}
+			if !slices.EqualFunc(test.want, nodes, bytes.Equal) {
+				t.Errorf("unexpected nodes, wanted %x, got %x", test.want, nodes)
+			}
+		})
+	}
+
+	filename := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(filename, []byte(`["0xzz"]`), 0600); err != nil {
+		t.Fatalf("failed to write proof: %v", err)
+	}
+	if _, err := readProofNodes(filename); err == nil {
+		t.Errorf("reading invalid proof file should fail")
+	}
+}
+
+// getVerifyProofTestProof creates a LiveDB holding a single account with a
+// single storage slot and returns its root hash, the proof of the account,
+// and the proofs of slots 1 and 2 of the account. Since the trie contains a
+// single account, the account proof consists only of the account's leaf.
+func getVerifyProofTestProof(t *testing.T) (common.Hash, [][]byte, [][][]byte) {
+	t.Helper()
+	dir := t.TempDir()
+	state, err := mpt.OpenGoFileState(dir, mpt.S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	if _, err := state.Apply(0, getLeafRlpTestUpdate()); err != nil {
+		t.Fatalf("failed to apply update: %v", err)
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+
+	trie, err := mpt.OpenFileLiveTrie(dir, mpt.S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	root, _, err := trie.UpdateHashes()
+	if err != nil {
+		t.Fatalf("failed to get hash: %v", err)
+	}
+	leaf, found, err := trie.GetAccountLeafRlp(common.Address{1})
+	if err != nil || !found {
+		t.Fatalf("failed to get leaf of account: %t, %v", found, err)
+	}
+	_, _, proofs, err := trie.GetAccountBundle(common.Address{1}, []common.Key{{1}, {2}})
+	if err != nil {
+		t.Fatalf("failed to get account bundle: %v", err)
+	}
+	return root, [][]byte{leaf}, [][][]byte{proofs[0].Proof, proofs[1].Proof}
+}
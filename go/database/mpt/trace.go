@@ -0,0 +1,299 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// This file provides a recorder and a reader for traces of the updates
+// applied to a LiveTrie. Traces can be recorded during the regular operation
+// of a state and replayed later on, e.g. for benchmarking the MPT using
+// realistic access patterns.
+//
+// Format:
+//
+//  file  ::= <magic-number> <version> [<block>]*
+//  block ::= <block-number> <root-hash> <num-ops> [<op>]*
+//  op    ::= 'A' <address> <nonce> <balance> <code-hash>
+//          | 'D' <address>
+//          | 'S' <address> <key> <value>
+//          | 'C' <address>
+//
+// Block numbers and the number of operations are encoded as unsigned varints.
+// Nonces, balances, and values are encoded by a single length byte followed
+// by their big-endian representation stripped of leading zeros. Operations
+// update accounts ('A'), delete accounts ('D'), update storage slots ('S'),
+// and clear the storage of accounts ('C'). The root hash is the hash of the
+// trie after applying all operations of the block.
+
+var traceMagicNumber = []byte("Carmen-MPT-Trace")
+
+const traceFormatVersion = byte(1)
+
+const (
+	traceSetAccount    = byte('A')
+	traceDeleteAccount = byte('D')
+	traceSetSlot       = byte('S')
+	traceClearStorage  = byte('C')
+)
+
+// TraceRecorder collects the updates applied to a LiveTrie and writes them
+// block by block to an output stream. Recorders are thread safe.
+type TraceRecorder struct {
+	mutex  sync.Mutex
+	out    *bufio.Writer
+	ops    bytes.Buffer // encoded operations of the current block
+	numOps int          // number of operations of the current block
+}
+
+// NewTraceRecorder creates a recorder writing a trace to the given output.
+// The header of the trace is written immediately. Recorded data is buffered,
+// so Flush needs to be called to make sure all data reached the output.
+func NewTraceRecorder(out io.Writer) (*TraceRecorder, error) {
+	writer := bufio.NewWriter(out)
+	if _, err := writer.Write(traceMagicNumber); err != nil {
+		return nil, err
+	}
+	if err := writer.WriteByte(traceFormatVersion); err != nil {
+		return nil, err
+	}
+	return &TraceRecorder{out: writer}, nil
+}
+
+func (r *TraceRecorder) setAccountInfo(address common.Address, info AccountInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.numOps++
+	if info.IsEmpty() {
+		r.ops.WriteByte(traceDeleteAccount)
+		r.ops.Write(address[:])
+		return
+	}
+	r.ops.WriteByte(traceSetAccount)
+	r.ops.Write(address[:])
+	writeTrimmed(&r.ops, info.Nonce[:])
+	writeTrimmed(&r.ops, info.Balance[:])
+	r.ops.Write(info.CodeHash[:])
+}
+
+func (r *TraceRecorder) setValue(address common.Address, key common.Key, value common.Value) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.numOps++
+	r.ops.WriteByte(traceSetSlot)
+	r.ops.Write(address[:])
+	r.ops.Write(key[:])
+	writeTrimmed(&r.ops, value[:])
+}
+
+func (r *TraceRecorder) clearStorage(address common.Address) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.numOps++
+	r.ops.WriteByte(traceClearStorage)
+	r.ops.Write(address[:])
+}
+
+// EndBlock completes the current block by writing all operations recorded
+// since the last call to the output, together with the given block number and
+// the root hash of the trie after applying them.
+func (r *TraceRecorder) EndBlock(block uint64, hash common.Hash) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var buffer [binary.MaxVarintLen64]byte
+	_, err := r.out.Write(binary.AppendUvarint(buffer[:0], block))
+	if err == nil {
+		_, err = r.out.Write(hash[:])
+	}
+	if err == nil {
+		_, err = r.out.Write(binary.AppendUvarint(buffer[:0], uint64(r.numOps)))
+	}
+	if err == nil {
+		_, err = r.out.Write(r.ops.Bytes())
+	}
+	r.ops.Reset()
+	r.numOps = 0
+	return err
+}
+
+// Flush writes all buffered data of completed blocks to the output.
+func (r *TraceRecorder) Flush() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.out.Flush()
+}
+
+// writeTrimmed writes the given big-endian value without leading zeros,
+// preceded by its remaining length.
+func writeTrimmed(out *bytes.Buffer, value []byte) {
+	trimmed := bytes.TrimLeft(value, "\x00")
+	out.WriteByte(byte(len(trimmed)))
+	out.Write(trimmed)
+}
+
+// TraceBlock is the set of operations recorded for a single block.
+type TraceBlock struct {
+	Block uint64      // the number of the block
+	Hash  common.Hash // the root hash of the trie after applying the block
+	ops   []traceOp
+}
+
+type traceOp struct {
+	kind    byte
+	address common.Address
+	key     common.Key
+	value   common.Value
+	info    AccountInfo
+}
+
+// NumOperations returns the number of update operations in this block.
+func (b *TraceBlock) NumOperations() int {
+	return len(b.ops)
+}
+
+// applyTo applies the operations of this block in order to the given trie.
+func (b *TraceBlock) applyTo(trie *LiveTrie) error {
+	for _, op := range b.ops {
+		var err error
+		switch op.kind {
+		case traceSetAccount:
+			err = trie.SetAccountInfo(op.address, op.info)
+		case traceDeleteAccount:
+			err = trie.SetAccountInfo(op.address, AccountInfo{})
+		case traceSetSlot:
+			err = trie.SetValue(op.address, op.key, op.value)
+		case traceClearStorage:
+			err = trie.ClearStorage(op.address)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TraceReader parses traces produced by a TraceRecorder block by block.
+type TraceReader struct {
+	in *bufio.Reader
+}
+
+// OpenTraceReader creates a reader for the trace provided by the given input
+// and checks the trace's header.
+func OpenTraceReader(in io.Reader) (*TraceReader, error) {
+	reader := bufio.NewReader(in)
+	buffer := make([]byte, len(traceMagicNumber))
+	if _, err := io.ReadFull(reader, buffer); err != nil {
+		return nil, err
+	} else if !bytes.Equal(buffer, traceMagicNumber) {
+		return nil, fmt.Errorf("invalid format, wrong magic number")
+	}
+	if version, err := reader.ReadByte(); err != nil {
+		return nil, err
+	} else if version != traceFormatVersion {
+		return nil, fmt.Errorf("invalid format, unsupported version %d", version)
+	}
+	return &TraceReader{in: reader}, nil
+}
+
+// Next parses the next block of the trace. At the end of the trace, io.EOF is
+// returned. If the trace ends in the middle of a block, io.ErrUnexpectedEOF is
+// returned.
+func (r *TraceReader) Next() (*TraceBlock, error) {
+	block, err := binary.ReadUvarint(r.in)
+	if err != nil {
+		return nil, err
+	}
+	res := &TraceBlock{Block: block}
+	if err := r.read(res.Hash[:]); err != nil {
+		return nil, err
+	}
+	numOps, err := binary.ReadUvarint(r.in)
+	if err != nil {
+		return nil, noEof(err)
+	}
+	// The capacity is limited to avoid large allocations for corrupted inputs.
+	capacity := numOps
+	if capacity > 1<<16 {
+		capacity = 1 << 16
+	}
+	res.ops = make([]traceOp, 0, capacity)
+	for i := uint64(0); i < numOps; i++ {
+		op, err := r.readOp()
+		if err != nil {
+			return nil, err
+		}
+		res.ops = append(res.ops, op)
+	}
+	return res, nil
+}
+
+func (r *TraceReader) readOp() (traceOp, error) {
+	op := traceOp{}
+	kind, err := r.in.ReadByte()
+	if err != nil {
+		return op, noEof(err)
+	}
+	op.kind = kind
+	if err := r.read(op.address[:]); err != nil {
+		return op, err
+	}
+	switch kind {
+	case traceSetAccount:
+		if err := r.readTrimmed(op.info.Nonce[:]); err != nil {
+			return op, err
+		}
+		if err := r.readTrimmed(op.info.Balance[:]); err != nil {
+			return op, err
+		}
+		return op, r.read(op.info.CodeHash[:])
+	case traceSetSlot:
+		if err := r.read(op.key[:]); err != nil {
+			return op, err
+		}
+		return op, r.readTrimmed(op.value[:])
+	case traceDeleteAccount, traceClearStorage:
+		return op, nil
+	}
+	return op, fmt.Errorf("invalid format, unknown operation %q", kind)
+}
+
+func (r *TraceReader) read(dst []byte) error {
+	_, err := io.ReadFull(r.in, dst)
+	return noEof(err)
+}
+
+func (r *TraceReader) readTrimmed(dst []byte) error {
+	length, err := r.in.ReadByte()
+	if err != nil {
+		return noEof(err)
+	}
+	if int(length) > len(dst) {
+		return fmt.Errorf("invalid format, value of %d bytes exceeds size %d", length, len(dst))
+	}
+	return r.read(dst[len(dst)-int(length):])
+}
+
+// noEof converts io.EOF errors encountered within a block into unexpected EOF
+// errors to distinguish truncated traces from the regular end of a trace.
+func noEof(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestTrace_RecordedBlocksCanBeReadBack(t *testing.T) {
+	info := AccountInfo{
+		Nonce:    common.ToNonce(12),
+		Balance:  common.Balance{1, 2, 3},
+		CodeHash: common.Hash{4, 5, 6},
+	}
+	buffer := bytes.Buffer{}
+	recorder, err := NewTraceRecorder(&buffer)
+	if err != nil {
+		t.Fatalf("failed to create recorder: %v", err)
+	}
+	recorder.setAccountInfo(common.Address{1}, info)
+	recorder.setValue(common.Address{1}, common.Key{2}, common.Value{31: 3})
+	if err := recorder.EndBlock(5, common.Hash{5}); err != nil {
+		t.Fatalf("failed to end block: %v", err)
+	}
+	if err := recorder.EndBlock(6, common.Hash{6}); err != nil {
+		t.Fatalf("failed to end block: %v", err)
+	}
+	recorder.clearStorage(common.Address{1})
+	recorder.setAccountInfo(common.Address{2}, AccountInfo{})
+	if err := recorder.EndBlock(1<<40, common.Hash{7}); err != nil {
+		t.Fatalf("failed to end block: %v", err)
+	}
+	if err := recorder.Flush(); err != nil {
+		t.Fatalf("failed to flush recorder: %v", err)
+	}
+
+	want := []TraceBlock{
+		{Block: 5, Hash: common.Hash{5}, ops: []traceOp{
+			{kind: traceSetAccount, address: common.Address{1}, info: info},
+			{kind: traceSetSlot, address: common.Address{1}, key: common.Key{2}, value: common.Value{31: 3}},
+		}},
+		{Block: 6, Hash: common.Hash{6}, ops: []traceOp{}},
+		{Block: 1 << 40, Hash: common.Hash{7}, ops: []traceOp{
+			{kind: traceClearStorage, address: common.Address{1}},
+			{kind: traceDeleteAccount, address: common.Address{2}},
+		}},
+	}
+
+	reader, err := OpenTraceReader(&buffer)
+	if err != nil {
+		t.Fatalf("failed to open reader: %v", err)
+	}
+	for _, want := range want {
+		got, err := reader.Next()
+		if err != nil {
+			t.Fatalf("failed to read block: %v", err)
+		}
+		if !reflect.DeepEqual(want, *got) {
+			t.Errorf("unexpected block, wanted %v, got %v", want, *got)
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("expected end of trace, got %v", err)
+	}
+}
+
+func TestTrace_OpenTraceReader_DetectsInvalidHeaders(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":         {},
+		"short":         traceMagicNumber[:4],
+		"wrong magic":   append([]byte(strings.ToUpper(string(traceMagicNumber))), traceFormatVersion),
+		"no version":    traceMagicNumber,
+		"wrong version": append(bytes.Clone(traceMagicNumber), traceFormatVersion+1),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := OpenTraceReader(bytes.NewReader(data)); err == nil {
+				t.Errorf("invalid header should be detected")
+			}
+		})
+	}
+}
+
+func TestTrace_TruncatedTracesAreDetected(t *testing.T) {
+	buffer := bytes.Buffer{}
+	recorder, err := NewTraceRecorder(&buffer)
+	if err != nil {
+		t.Fatalf("failed to create recorder: %v", err)
+	}
+	recorder.setAccountInfo(common.Address{1}, AccountInfo{Nonce: common.ToNonce(1)})
+	recorder.setValue(common.Address{1}, common.Key{2}, common.Value{3})
+	if err := errors.Join(recorder.EndBlock(300, common.Hash{1}), recorder.Flush()); err != nil {
+		t.Fatalf("failed to record block: %v", err)
+	}
+	data := buffer.Bytes()
+
+	headerSize := len(traceMagicNumber) + 1
+	for i := headerSize + 1; i < len(data); i++ {
+		reader, err := OpenTraceReader(bytes.NewReader(data[:i]))
+		if err != nil {
+			t.Fatalf("failed to open reader: %v", err)
+		}
+		if _, err := reader.Next(); err != io.ErrUnexpectedEOF {
+			t.Errorf("truncation at %d of %d not detected, got %v", i, len(data), err)
+		}
+	}
+}
+
+func TestTrace_UnknownOperationsAreDetected(t *testing.T) {
+	buffer := bytes.Buffer{}
+	recorder, err := NewTraceRecorder(&buffer)
+	if err != nil {
+		t.Fatalf("failed to create recorder: %v", err)
+	}
+	recorder.clearStorage(common.Address{1})
+	if err := errors.Join(recorder.EndBlock(1, common.Hash{1}), recorder.Flush()); err != nil {
+		t.Fatalf("failed to record block: %v", err)
+	}
+	data := buffer.Bytes()
+	data[len(data)-common.AddressSize-1] = 'X'
+
+	reader, err := OpenTraceReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to open reader: %v", err)
+	}
+	if _, err := reader.Next(); err == nil || !strings.Contains(err.Error(), "unknown operation") {
+		t.Errorf("unknown operation not detected, got %v", err)
+	}
+}
+
+func TestTrace_ReplayReproducesRecordedStates(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			state, err := OpenGoMemoryState(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer state.Close()
+
+			buffer := bytes.Buffer{}
+			recorder, err := NewTraceRecorder(&buffer)
+			if err != nil {
+				t.Fatalf("failed to create recorder: %v", err)
+			}
+			state.SetTraceRecorder(recorder)
+
+			const numBlocks = 10
+			hashes := []common.Hash{}
+			for i := 0; i < numBlocks; i++ {
+				update := common.Update{}
+				for j := 0; j < 5; j++ {
+					addr := common.Address{byte(i + j)}
+					if j == 0 && i%3 == 2 {
+						update.DeletedAccounts = append(update.DeletedAccounts, addr)
+						continue
+					}
+					update.CreatedAccounts = append(update.CreatedAccounts, addr)
+					update.Nonces = append(update.Nonces, common.NonceUpdate{Account: addr, Nonce: common.ToNonce(uint64(i))})
+					update.Slots = append(update.Slots, common.SlotUpdate{Account: addr, Key: common.Key{byte(j)}, Value: common.Value{byte(i)}})
+				}
+				if _, err := state.Apply(uint64(i), update); err != nil {
+					t.Fatalf("failed to apply block %d: %v", i, err)
+				}
+				hash, err := state.GetHash()
+				if err != nil {
+					t.Fatalf("failed to get hash: %v", err)
+				}
+				hashes = append(hashes, hash)
+			}
+			if err := recorder.Flush(); err != nil {
+				t.Fatalf("failed to flush recorder: %v", err)
+			}
+
+			replayed, err := OpenGoMemoryState(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer replayed.Close()
+
+			reader, err := OpenTraceReader(&buffer)
+			if err != nil {
+				t.Fatalf("failed to open reader: %v", err)
+			}
+			for i := 0; i < numBlocks; i++ {
+				block, err := reader.Next()
+				if err != nil {
+					t.Fatalf("failed to read block %d: %v", i, err)
+				}
+				if want, got := uint64(i), block.Block; want != got {
+					t.Errorf("unexpected block number, wanted %d, got %d", want, got)
+				}
+				if want, got := hashes[i], block.Hash; want != got {
+					t.Errorf("unexpected recorded hash in block %d, wanted %x, got %x", i, want, got)
+				}
+				got, err := replayed.ReplayTraceBlock(block)
+				if err != nil {
+					t.Fatalf("failed to replay block %d: %v", i, err)
+				}
+				if want := hashes[i]; want != got {
+					t.Errorf("unexpected hash after replaying block %d, wanted %x, got %x", i, want, got)
+				}
+			}
+			if _, err := reader.Next(); err != io.EOF {
+				t.Errorf("expected end of trace, got %v", err)
+			}
+		})
+	}
+}
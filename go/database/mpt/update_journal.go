@@ -0,0 +1,215 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// An update journal records the updates of blocks applied to a LiveDB since
+// it was last synced to disk. The update of each block is appended to the
+// journal and synced before it is applied to the trie. Once the block is
+// committed, the resulting root hash is appended as well. After a crash, the
+// persisted state is rolled forward by replaying the journaled blocks, and
+// the recorded root hashes are used to verify the replayed blocks. Whenever
+// the state is synced, the journal is truncated.
+//
+// The journal file is a sequence of records of the format:
+//
+//	[<kind>, <block>, <length>, <payload>, <checksum>]
+//
+// where kind is a single byte distinguishing update and root records, block
+// is an 8-byte block number, length is the 4-byte length of the payload, and
+// the checksum is a CRC32 checksum of all preceding fields of the record.
+// The payload of update records is the encoded update, the payload of root
+// records is the root hash of the state after the block was committed.
+const (
+	updateJournalFile             = "journal.dat"
+	defaultUpdateJournalSizeLimit = 64 << 20 // 64 MiB
+	updateJournalRecordHeaderSize = 1 + 8 + 4
+	updateJournalChecksumSize     = 4
+
+	updateJournalUpdateRecord = byte(1)
+	updateJournalRootRecord   = byte(2)
+)
+
+// journaledBlock is a block recovered from an update journal.
+type journaledBlock struct {
+	block  uint64
+	update common.Update
+	hash   common.Hash
+	// committed is false for the last block of a journal if the process was
+	// terminated after journaling its update but before committing it. The
+	// resulting hash of such blocks is unknown and can not be verified.
+	committed bool
+}
+
+// updateJournal is the writer of an update journal file. It is not thread
+// safe, blocks are expected to be applied sequentially by its owner.
+type updateJournal struct {
+	file    *os.File
+	size    int64
+	limit   int64
+	pending bool   // true if the update of a block has been appended but not its root
+	block   uint64 // the block of the pending update
+}
+
+// openUpdateJournal opens the journal stored in the given file, creating it
+// if needed, and returns the blocks recorded by it. New records are appended
+// to the end of the file. A limit of zero selects the default size limit.
+func openUpdateJournal(filename string, limit int64) (*updateJournal, []journaledBlock, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+	blocks, err := parseUpdateJournal(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid update journal %s: %w", filename, err)
+	}
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	if limit <= 0 {
+		limit = defaultUpdateJournalSizeLimit
+	}
+	return &updateJournal{
+		file:  file,
+		size:  int64(len(data)),
+		limit: limit,
+	}, blocks, nil
+}
+
+// parseUpdateJournal decodes the blocks recorded in the given journal data.
+// A trailing record which is incomplete or has an invalid checksum is the
+// result of a crash while appending it and is ignored.
+func parseUpdateJournal(data []byte) ([]journaledBlock, error) {
+	var res []journaledBlock
+	for len(data) > 0 {
+		kind, block, payload, size, ok := decodeUpdateJournalRecord(data)
+		if !ok {
+			if size < len(data) {
+				return nil, fmt.Errorf("corrupted record following %d blocks", len(res))
+			}
+			break
+		}
+		data = data[size:]
+
+		switch kind {
+		case updateJournalUpdateRecord:
+			if len(res) > 0 && !res[len(res)-1].committed {
+				return nil, fmt.Errorf("missing root of block %d", res[len(res)-1].block)
+			}
+			update, err := common.UpdateFromBytes(payload)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode update of block %d: %w", block, err)
+			}
+			res = append(res, journaledBlock{block: block, update: update})
+		case updateJournalRootRecord:
+			if len(res) == 0 || res[len(res)-1].committed || res[len(res)-1].block != block {
+				return nil, fmt.Errorf("root of block %d without update", block)
+			}
+			if len(payload) != len(common.Hash{}) {
+				return nil, fmt.Errorf("invalid root hash length of block %d: %d", block, len(payload))
+			}
+			last := &res[len(res)-1]
+			copy(last.hash[:], payload)
+			last.committed = true
+		default:
+			return nil, fmt.Errorf("unknown record kind %d", kind)
+		}
+	}
+	return res, nil
+}
+
+// decodeUpdateJournalRecord decodes the record at the beginning of the given
+// data. It returns the fields of the record, the number of bytes covered by
+// the record, and whether the record is complete and valid. For incomplete
+// records, the returned size exceeds the length of the data.
+func decodeUpdateJournalRecord(data []byte) (kind byte, block uint64, payload []byte, size int, ok bool) {
+	if len(data) < updateJournalRecordHeaderSize {
+		return 0, 0, nil, updateJournalRecordHeaderSize, false
+	}
+	length := int(binary.BigEndian.Uint32(data[9:13]))
+	size = updateJournalRecordHeaderSize + length + updateJournalChecksumSize
+	if len(data) < size {
+		return 0, 0, nil, size, false
+	}
+	end := size - updateJournalChecksumSize
+	if crc32.ChecksumIEEE(data[:end]) != binary.BigEndian.Uint32(data[end:size]) {
+		return 0, 0, nil, size, false
+	}
+	return data[0], binary.BigEndian.Uint64(data[1:9]), data[updateJournalRecordHeaderSize:end], size, true
+}
+
+func encodeUpdateJournalRecord(kind byte, block uint64, payload []byte) []byte {
+	res := make([]byte, 0, updateJournalRecordHeaderSize+len(payload)+updateJournalChecksumSize)
+	res = append(res, kind)
+	res = binary.BigEndian.AppendUint64(res, block)
+	res = binary.BigEndian.AppendUint32(res, uint32(len(payload)))
+	res = append(res, payload...)
+	return binary.BigEndian.AppendUint32(res, crc32.ChecksumIEEE(res))
+}
+
+// appendUpdate records the update of the given block. The journal is synced
+// before returning, such that the update can be recovered after a crash.
+func (j *updateJournal) appendUpdate(block uint64, update *common.Update) error {
+	if err := j.append(encodeUpdateJournalRecord(updateJournalUpdateRecord, block, update.ToBytes())); err != nil {
+		return err
+	}
+	j.pending = true
+	j.block = block
+	return j.file.Sync()
+}
+
+// appendRoot records the root hash of the given block once it is committed.
+// Roots of blocks whose update has not been journaled are ignored. The record
+// is synced with the update of the next block.
+func (j *updateJournal) appendRoot(block uint64, hash common.Hash) error {
+	if !j.pending || j.block != block {
+		return nil
+	}
+	j.pending = false
+	return j.append(encodeUpdateJournalRecord(updateJournalRootRecord, block, hash[:]))
+}
+
+func (j *updateJournal) append(record []byte) error {
+	n, err := j.file.Write(record)
+	j.size += int64(n)
+	return err
+}
+
+// isFull reports whether the journal has reached its size limit, indicating
+// that the state should be synced such that the journal can be truncated.
+func (j *updateJournal) isFull() bool {
+	return j.size >= j.limit
+}
+
+// reset discards all records of the journal. It is to be called after the
+// state has been synced to disk.
+func (j *updateJournal) reset() error {
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	j.size = 0
+	j.pending = false
+	return j.file.Sync()
+}
+
+func (j *updateJournal) Close() error {
+	return j.file.Close()
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestUpdateJournal_JournaledBlocksCanBeRecovered(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), updateJournalFile)
+	journal, blocks, err := openUpdateJournal(filename, 0)
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	if len(blocks) != 0 {
+		t.Errorf("new journal should be empty, got %d blocks", len(blocks))
+	}
+	updates := []common.Update{
+		durabilityTestUpdate(1),
+		{Nonces: []common.NonceUpdate{{Account: common.Address{2}, Nonce: common.ToNonce(3)}}},
+		{Codes: []common.CodeUpdate{{Account: common.Address{3}, Code: []byte{1, 2, 3}}}},
+	}
+	for i := range updates {
+		block := uint64(10 + i)
+		if err := journal.appendUpdate(block, &updates[i]); err != nil {
+			t.Fatalf("failed to append update: %v", err)
+		}
+		// The last block is not committed.
+		if i < len(updates)-1 {
+			if err := journal.appendRoot(block, common.Hash{byte(i)}); err != nil {
+				t.Fatalf("failed to append root: %v", err)
+			}
+		}
+	}
+	if err := journal.Close(); err != nil {
+		t.Fatalf("failed to close journal: %v", err)
+	}
+
+	journal, blocks, err = openUpdateJournal(filename, 0)
+	if err != nil {
+		t.Fatalf("failed to re-open journal: %v", err)
+	}
+	defer journal.Close()
+	if want, got := len(updates), len(blocks); want != got {
+		t.Fatalf("unexpected number of blocks, wanted %d, got %d", want, got)
+	}
+	for i, block := range blocks {
+		if want, got := uint64(10+i), block.block; want != got {
+			t.Errorf("unexpected block number, wanted %d, got %d", want, got)
+		}
+		if want, got := updates[i].ToBytes(), block.update.ToBytes(); !bytes.Equal(want, got) {
+			t.Errorf("unexpected update of block %d, wanted %v, got %v", block.block, &updates[i], &block.update)
+		}
+		committed := i < len(updates)-1
+		if block.committed != committed {
+			t.Errorf("unexpected commit state of block %d, wanted %t, got %t", block.block, committed, block.committed)
+		}
+		if committed && block.hash != (common.Hash{byte(i)}) {
+			t.Errorf("unexpected hash of block %d: %x", block.block, block.hash)
+		}
+	}
+}
+
+func TestUpdateJournal_IncompleteTrailingRecordsAreIgnored(t *testing.T) {
+	update := durabilityTestUpdate(1)
+	data := encodeUpdateJournalRecord(updateJournalUpdateRecord, 1, update.ToBytes())
+	data = append(data, encodeUpdateJournalRecord(updateJournalRootRecord, 1, make([]byte, 32))...)
+	complete := len(data)
+	data = append(data, encodeUpdateJournalRecord(updateJournalUpdateRecord, 2, update.ToBytes())...)
+
+	for size := complete; size < len(data); size++ {
+		blocks, err := parseUpdateJournal(data[:size])
+		if err != nil {
+			t.Fatalf("failed to parse journal truncated to %d bytes: %v", size, err)
+		}
+		if len(blocks) != 1 || !blocks[0].committed {
+			t.Errorf("unexpected blocks recovered from journal truncated to %d bytes: %v", size, blocks)
+		}
+	}
+}
+
+func TestUpdateJournal_CorruptedRecordsAreDetected(t *testing.T) {
+	update := durabilityTestUpdate(1)
+	data := encodeUpdateJournalRecord(updateJournalUpdateRecord, 1, update.ToBytes())
+	data = append(data, encodeUpdateJournalRecord(updateJournalRootRecord, 1, make([]byte, 32))...)
+	for i := range data {
+		corrupted := bytes.Clone(data)
+		corrupted[i]++
+		if blocks, err := parseUpdateJournal(corrupted); err == nil && len(blocks) > 0 && blocks[0].committed {
+			t.Errorf("corruption of byte %d not detected", i)
+		}
+	}
+}
+
+func TestUpdateJournal_RecordsOutOfOrderAreDetected(t *testing.T) {
+	update := durabilityTestUpdate(1)
+	tests := map[string][]byte{
+		"root without update": encodeUpdateJournalRecord(updateJournalRootRecord, 1, make([]byte, 32)),
+		"missing root": append(
+			encodeUpdateJournalRecord(updateJournalUpdateRecord, 1, update.ToBytes()),
+			encodeUpdateJournalRecord(updateJournalUpdateRecord, 2, update.ToBytes())...,
+		),
+		"root of other block": append(
+			encodeUpdateJournalRecord(updateJournalUpdateRecord, 1, update.ToBytes()),
+			encodeUpdateJournalRecord(updateJournalRootRecord, 2, make([]byte, 32))...,
+		),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseUpdateJournal(data); err == nil {
+				t.Errorf("invalid journal should be detected")
+			}
+		})
+	}
+}
+
+func TestUpdateJournal_RootsOfBlocksNotJournaledAreIgnored(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), updateJournalFile)
+	journal, _, err := openUpdateJournal(filename, 0)
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	defer journal.Close()
+	if err := journal.appendRoot(1, common.Hash{1}); err != nil {
+		t.Fatalf("failed to append root: %v", err)
+	}
+	if info, err := os.Stat(filename); err != nil || info.Size() != 0 {
+		t.Errorf("root of block without update should not be recorded, got %v, err %v", info, err)
+	}
+}
+
+func TestUpdateJournal_ResetDiscardsAllRecords(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), updateJournalFile)
+	journal, _, err := openUpdateJournal(filename, 0)
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	update := durabilityTestUpdate(1)
+	if err := journal.appendUpdate(1, &update); err != nil {
+		t.Fatalf("failed to append update: %v", err)
+	}
+	if err := journal.reset(); err != nil {
+		t.Fatalf("failed to reset journal: %v", err)
+	}
+	if err := journal.appendUpdate(2, &update); err != nil {
+		t.Fatalf("failed to append update: %v", err)
+	}
+	if err := journal.Close(); err != nil {
+		t.Fatalf("failed to close journal: %v", err)
+	}
+
+	journal, blocks, err := openUpdateJournal(filename, 0)
+	if err != nil {
+		t.Fatalf("failed to re-open journal: %v", err)
+	}
+	defer journal.Close()
+	if len(blocks) != 1 || blocks[0].block != 2 {
+		t.Errorf("only blocks journaled after reset should be recovered, got %v", blocks)
+	}
+}
+
+func TestUpdateJournal_IsFullOnceSizeLimitIsReached(t *testing.T) {
+	update := durabilityTestUpdate(1)
+	size := int64(len(encodeUpdateJournalRecord(updateJournalUpdateRecord, 1, update.ToBytes())))
+	journal, _, err := openUpdateJournal(filepath.Join(t.TempDir(), updateJournalFile), 2*size)
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	defer journal.Close()
+	for i := 0; i < 2; i++ {
+		if journal.isFull() {
+			t.Fatalf("journal should not be full after %d updates", i)
+		}
+		if err := journal.appendUpdate(uint64(i), &update); err != nil {
+			t.Fatalf("failed to append update: %v", err)
+		}
+	}
+	if !journal.isFull() {
+		t.Errorf("journal should be full after reaching its limit")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"slices"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// Node IDs are allocated in the order nodes are created, which depends on the
+// order updates are applied. To make directories built from the same sequence
+// of blocks byte-identical, not only equal in their hashes, the changes of
+// each block are applied in a canonical order: accounts sorted by address and
+// slots sorted by address and key.
+//
+// Storage tries of deleted accounts are released in the background. Node IDs
+// freed by those releases are reused in an order depending on the timing of
+// the release workers. Byte-level reproducibility is thus only guaranteed for
+// block sequences not deleting accounts with non-empty storage.
+
+// sortUpdate returns the given update with its account changes sorted by
+// address and its slot changes sorted by address and key. The sort is stable,
+// such that repeated changes of the same account or slot retain their order.
+// Lists already in order, which is the common case, are not copied, making
+// the cost of a single linear scan per list negligible compared to the update
+// of the trie.
+func sortUpdate(update common.Update) common.Update {
+	update.DeletedAccounts = sortedStable(update.DeletedAccounts, (*common.Address).Compare)
+	update.CreatedAccounts = sortedStable(update.CreatedAccounts, (*common.Address).Compare)
+	update.Balances = sortedStable(update.Balances, func(a, b *common.BalanceUpdate) int {
+		return a.Account.Compare(&b.Account)
+	})
+	update.Nonces = sortedStable(update.Nonces, func(a, b *common.NonceUpdate) int {
+		return a.Account.Compare(&b.Account)
+	})
+	update.Codes = sortedStable(update.Codes, func(a, b *common.CodeUpdate) int {
+		return a.Account.Compare(&b.Account)
+	})
+	update.Slots = sortedStable(update.Slots, func(a, b *common.SlotUpdate) int {
+		if res := a.Account.Compare(&b.Account); res != 0 {
+			return res
+		}
+		return a.Key.Compare(&b.Key)
+	})
+	return update
+}
+
+// sortedStable returns the given list if it is sorted, or a sorted copy of it
+// otherwise. The given list is never modified since it is owned by the caller.
+func sortedStable[T any](list []T, compare func(a, b *T) int) []T {
+	sorted := true
+	for i := 1; i < len(list) && sorted; i++ {
+		sorted = compare(&list[i-1], &list[i]) <= 0
+	}
+	if sorted {
+		return list
+	}
+	// Sorting positions instead of elements avoids moving large elements
+	// around. Ties are broken by position to keep the sort stable.
+	order := make([]int, len(list))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		if res := compare(&list[a], &list[b]); res != 0 {
+			return res
+		}
+		return a - b
+	})
+	res := make([]T, len(list))
+	for i, pos := range order {
+		res[i] = list[pos]
+	}
+	return res
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+func TestSortUpdate_ChangesAreSortedWithoutModifyingInput(t *testing.T) {
+	update := common.Update{
+		DeletedAccounts: []common.Address{{3}, {1}, {2}},
+		CreatedAccounts: []common.Address{{2}, {1}},
+		Balances:        []common.BalanceUpdate{{Account: common.Address{2}}, {Account: common.Address{1}}},
+		Nonces:          []common.NonceUpdate{{Account: common.Address{2}}, {Account: common.Address{1}}},
+		Codes:           []common.CodeUpdate{{Account: common.Address{2}}, {Account: common.Address{1}}},
+		Slots: []common.SlotUpdate{
+			{Account: common.Address{2}, Key: common.Key{1}},
+			{Account: common.Address{1}, Key: common.Key{2}, Value: common.Value{1}},
+			{Account: common.Address{1}, Key: common.Key{1}},
+			{Account: common.Address{1}, Key: common.Key{2}, Value: common.Value{2}},
+		},
+	}
+	original := update.ToBytes()
+
+	sorted := sortUpdate(update)
+	if !bytes.Equal(original, update.ToBytes()) {
+		t.Errorf("input update was modified")
+	}
+	if err := sorted.Check(); err == nil {
+		t.Errorf("duplicated slot updates should be retained")
+	}
+	if want, got := []common.Address{{1}, {2}, {3}}, sorted.DeletedAccounts; !slices.Equal(want, got) {
+		t.Errorf("unexpected deleted accounts, wanted %v, got %v", want, got)
+	}
+	if want, got := []common.Address{{1}, {2}}, sorted.CreatedAccounts; !slices.Equal(want, got) {
+		t.Errorf("unexpected created accounts, wanted %v, got %v", want, got)
+	}
+	if sorted.Balances[0].Account != (common.Address{1}) || sorted.Nonces[0].Account != (common.Address{1}) || sorted.Codes[0].Account != (common.Address{1}) {
+		t.Errorf("account changes not sorted: %v", &sorted)
+	}
+	want := []common.SlotUpdate{
+		{Account: common.Address{1}, Key: common.Key{1}},
+		{Account: common.Address{1}, Key: common.Key{2}, Value: common.Value{1}},
+		{Account: common.Address{1}, Key: common.Key{2}, Value: common.Value{2}},
+		{Account: common.Address{2}, Key: common.Key{1}},
+	}
+	if !slices.Equal(want, sorted.Slots) {
+		t.Errorf("unexpected slot order, wanted %v, got %v", want, sorted.Slots)
+	}
+}
+
+func TestSortUpdate_SortedListsAreNotCopied(t *testing.T) {
+	update := durabilityTestUpdate(1)
+	sorted := sortUpdate(update)
+	if &update.CreatedAccounts[0] != &sorted.CreatedAccounts[0] || &update.Slots[0] != &sorted.Slots[0] {
+		t.Errorf("sorted lists should be used as they are")
+	}
+}
+
+func TestMptState_Apply_SameBlocksProduceByteIdenticalDirectories(t *testing.T) {
+	for _, config := range []MptConfig{S4LiveConfig, S5LiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			// The second directory receives the changes of each block in a
+			// different order, as produced by iterating maps.
+			dirs := []string{t.TempDir(), t.TempDir()}
+			for i, dir := range dirs {
+				state, err := OpenGoFileState(dir, config, 1024)
+				if err != nil {
+					t.Fatalf("failed to open state: %v", err)
+				}
+				for block := uint64(0); block < 10; block++ {
+					update := getUpdateOrderTestUpdate(block, int64(i))
+					if _, err := state.Apply(block, update); err != nil {
+						t.Fatalf("failed to apply block %d: %v", block, err)
+					}
+				}
+				if err := state.Close(); err != nil {
+					t.Fatalf("failed to close state: %v", err)
+				}
+			}
+
+			files := map[string][]byte{}
+			err := filepath.WalkDir(dirs[0], func(path string, entry os.DirEntry, err error) error {
+				if err != nil || entry.IsDir() {
+					return err
+				}
+				name, err := filepath.Rel(dirs[0], path)
+				if err != nil {
+					return err
+				}
+				files[name], err = os.ReadFile(path)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("failed to read directory: %v", err)
+			}
+			err = filepath.WalkDir(dirs[1], func(path string, entry os.DirEntry, err error) error {
+				if err != nil || entry.IsDir() {
+					return err
+				}
+				name, err := filepath.Rel(dirs[1], path)
+				if err != nil {
+					return err
+				}
+				want, found := files[name]
+				if !found {
+					t.Errorf("unexpected file %s", name)
+					return nil
+				}
+				delete(files, name)
+				got, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(want, got) {
+					t.Errorf("content of file %s differs", name)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("failed to read directory: %v", err)
+			}
+			for name := range files {
+				t.Errorf("missing file %s", name)
+			}
+		})
+	}
+}
+
+// getUpdateOrderTestUpdate creates the update of the given block with its
+// changes shuffled using the given seed. Updates of the same block only differ
+// in the order of their changes.
+func getUpdateOrderTestUpdate(block uint64, seed int64) common.Update {
+	update := common.Update{}
+	for i := 0; i < 20; i++ {
+		addr := common.Address{byte(block), byte(i)}
+		if block == 0 {
+			update.AppendCreateAccount(addr)
+			update.AppendCodeUpdate(addr, []byte{byte(i), 1, 2, 3})
+		}
+		update.AppendNonceUpdate(addr, common.ToNonce(block+1))
+		update.AppendBalanceUpdate(addr, common.Balance{byte(i + 1)})
+		for j := 0; j < 5; j++ {
+			update.AppendSlotUpdate(common.Address{0, byte(i)}, common.Key{byte(block), byte(j)}, common.Value{byte(block + 1)})
+		}
+	}
+	if seed != 0 {
+		random := rand.New(rand.NewSource(seed))
+		shuffle := func(n int, swap func(i, j int)) {
+			random.Shuffle(n, swap)
+		}
+		shuffle(len(update.CreatedAccounts), func(i, j int) {
+			update.CreatedAccounts[i], update.CreatedAccounts[j] = update.CreatedAccounts[j], update.CreatedAccounts[i]
+		})
+		shuffle(len(update.Codes), func(i, j int) { update.Codes[i], update.Codes[j] = update.Codes[j], update.Codes[i] })
+		shuffle(len(update.Nonces), func(i, j int) { update.Nonces[i], update.Nonces[j] = update.Nonces[j], update.Nonces[i] })
+		shuffle(len(update.Balances), func(i, j int) { update.Balances[i], update.Balances[j] = update.Balances[j], update.Balances[i] })
+		shuffle(len(update.Slots), func(i, j int) { update.Slots[i], update.Slots[j] = update.Slots[j], update.Slots[i] })
+	}
+	return update
+}
+
+// To run these benchmarks, use the following command:
+// go test ./database/mpt -run none -bench BenchmarkSortUpdate
+
+func BenchmarkSortUpdate(b *testing.B) {
+	for _, size := range []int{100, 10_000} {
+		update := common.Update{}
+		for i := 0; i < size; i++ {
+			addr := common.Address{byte(i >> 8), byte(i)}
+			update.AppendNonceUpdate(addr, common.ToNonce(1))
+			update.AppendSlotUpdate(addr, common.Key{1}, common.Value{1})
+		}
+		shuffled := update
+		shuffled.Nonces = slices.Clone(update.Nonces)
+		shuffled.Slots = slices.Clone(update.Slots)
+		random := rand.New(rand.NewSource(1))
+		random.Shuffle(size, func(i, j int) { shuffled.Nonces[i], shuffled.Nonces[j] = shuffled.Nonces[j], shuffled.Nonces[i] })
+		random.Shuffle(size, func(i, j int) { shuffled.Slots[i], shuffled.Slots[j] = shuffled.Slots[j], shuffled.Slots[i] })
+
+		for _, test := range []struct {
+			name   string
+			update common.Update
+		}{{"sorted", update}, {"shuffled", shuffled}} {
+			b.Run(fmt.Sprintf("%s/%d", test.name, size), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					sortUpdate(test.update)
+				}
+			})
+		}
+	}
+}
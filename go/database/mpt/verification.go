@@ -55,6 +55,9 @@ func (NilVerificationObserver) EndVerification(res error) {}
 //     - all byte-codes within the code file matches their hashed representation in accounts
 //  2. Non-fatal checks
 //     - there are no extra Code Hashes not referenced by any account
+//
+// If all checks pass, the verification is recorded in the directory and a
+// potential taint of the directory is cleared. See GetVerificationStatus.
 func VerifyMptState(directory string, config MptConfig, roots []Root, observer VerificationObserver) (res error) {
 	if observer == nil {
 		observer = NilVerificationObserver{}
@@ -65,6 +68,12 @@ func VerifyMptState(directory string, config MptConfig, roots []Root, observer V
 		observer.EndVerification(res)
 	}()
 
+	// Nodes are decoded using the encoders the directory was created with.
+	config, err := resolveNodeEncoders(directory, config)
+	if err != nil {
+		return err
+	}
+
 	// Open stock data structures for content verification.
 	observer.Progress("Obtaining read access to files ...")
 	source, err := openVerificationNodeSource(directory, config)
@@ -83,7 +92,7 @@ func VerifyMptState(directory string, config MptConfig, roots []Root, observer V
 		return err
 	}
 
-	return nil
+	return recordVerification(directory, roots, source)
 }
 
 // verifyFileForest runs list of validation checks on the forest stored in the given
@@ -91,6 +100,9 @@ func VerifyMptState(directory string, config MptConfig, roots []Root, observer V
 //   - all required files are present and can be read
 //   - all referenced nodes are present
 //   - all hashes are consistent
+//
+// If all checks pass, the verification is recorded in the directory and a
+// potential taint of the directory is cleared.
 func verifyFileForest(directory string, config MptConfig, roots []Root, observer VerificationObserver) (res error) {
 	if observer == nil {
 		observer = NilVerificationObserver{}
@@ -101,6 +113,12 @@ func verifyFileForest(directory string, config MptConfig, roots []Root, observer
 		observer.EndVerification(res)
 	}()
 
+	// Nodes are decoded using the encoders the directory was created with.
+	config, err := resolveNodeEncoders(directory, config)
+	if err != nil {
+		return err
+	}
+
 	// Open stock data structures for content verification.
 	observer.Progress("Obtaining read access to files ...")
 	source, err := openVerificationNodeSource(directory, config)
@@ -108,7 +126,10 @@ func verifyFileForest(directory string, config MptConfig, roots []Root, observer
 		return err
 	}
 	defer source.Close()
-	return verifyForest(directory, config, roots, source, observer)
+	if err := verifyForest(directory, config, roots, source, observer); err != nil {
+		return err
+	}
+	return recordVerification(directory, roots, source)
 }
 
 func verifyForest(directory string, config MptConfig, roots []Root, source *verificationNodeSource, observer VerificationObserver) (res error) {
@@ -177,7 +198,7 @@ func verifyForest(directory string, config MptConfig, roots []Root, source *veri
 
 	// -------------------- Further Passes: node hashes -----------------------
 
-	hasher := config.Hashing.createHasher()
+	hasher := config.Hashing.createHasher(config.HashFunction)
 	hash := func(node Node) (common.Hash, error) {
 		overrideId := ValueId((^uint64(0)) >> 2)
 		if _, ok := node.(EmptyNode); ok {
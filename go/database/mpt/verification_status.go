@@ -0,0 +1,180 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+const (
+	verificationRecordFileName = "verification.json"
+	taintRecordFileName        = "tainted.json"
+)
+
+// VerificationStatus summarizes the integrity information recorded in the
+// directory of an MPT.
+type VerificationStatus struct {
+	// The last successful full verification, nil if the directory has never
+	// been verified successfully.
+	LastVerification *VerificationRecord
+	// The first corruption detected at runtime since the last successful
+	// full verification, nil if no corruption has been detected.
+	Taint *TaintRecord
+}
+
+// IsTainted returns true if corruption has been detected in the directory
+// since it was last verified successfully.
+func (s *VerificationStatus) IsTainted() bool {
+	return s.Taint != nil
+}
+
+// VerificationRecord describes a successful full verification of a directory.
+type VerificationRecord struct {
+	Time        time.Time    // the time the verification completed
+	ToolVersion string       // the version of the binary performing the verification
+	RootHash    common.Hash  // the hash of the latest verified root
+	NumRoots    int          // the number of verified roots, 1 for LiveDBs
+	NodeCounts  NodeIdCounts // the number of nodes of each type present in the directory
+}
+
+// TaintRecord describes a corruption detected while operating on an MPT.
+type TaintRecord struct {
+	Time  time.Time // the time the corruption was detected
+	Error string    // the error reporting the corruption
+}
+
+// GetVerificationStatus reads the verification status recorded in the given
+// directory. Directories without any recorded information produce an empty
+// status.
+func GetVerificationStatus(directory string) (VerificationStatus, error) {
+	res := VerificationStatus{}
+	record := &VerificationRecord{}
+	found, err := readJsonRecord(filepath.Join(directory, verificationRecordFileName), record)
+	if err != nil {
+		return res, err
+	}
+	if found {
+		res.LastVerification = record
+	}
+	taint := &TaintRecord{}
+	found, err = readJsonRecord(filepath.Join(directory, taintRecordFileName), taint)
+	if err != nil {
+		return res, err
+	}
+	if found {
+		res.Taint = taint
+	}
+	return res, nil
+}
+
+// recordVerification records a successful full verification of the given
+// roots in the given directory and clears a potential taint of the directory.
+func recordVerification(directory string, roots []Root, source *verificationNodeSource) error {
+	record := VerificationRecord{
+		Time:        time.Now().UTC(),
+		ToolVersion: getToolVersion(),
+		NumRoots:    len(roots),
+		NodeCounts: NodeIdCounts{
+			Accounts:   countIds(source.accountIds),
+			Branches:   countIds(source.branchIds),
+			Extensions: countIds(source.extensionIds),
+			Values:     countIds(source.valueIds),
+		},
+	}
+	if len(roots) > 0 {
+		record.RootHash = roots[len(roots)-1].Hash
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(directory, verificationRecordFileName), data, 0600); err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(directory, taintRecordFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// markTainted records the given corruption in the given directory unless the
+// directory is already tainted, in which case the first corruption is kept.
+func markTainted(directory string, cause error) error {
+	data, err := json.Marshal(TaintRecord{
+		Time:  time.Now().UTC(),
+		Error: cause.Error(),
+	})
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(directory, taintRecordFileName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	return errors.Join(err, file.Sync(), file.Close())
+}
+
+// readJsonRecord parses the JSON encoded record stored in the given file into
+// the given record. The returned flag is false if the file does not exist.
+func readJsonRecord(filename string, record any) (bool, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, record); err != nil {
+		return false, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+	return true, nil
+}
+
+// countIds counts the number of IDs in the given set.
+func countIds(ids stock.IndexSet[uint64]) uint64 {
+	res := uint64(0)
+	for i := ids.GetLowerBound(); i < ids.GetUpperBound(); i++ {
+		if ids.Contains(i) {
+			res++
+		}
+	}
+	return res
+}
+
+// getToolVersion describes the version of the running binary based on its
+// build information.
+func getToolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	res := info.Main.Path + "@" + info.Main.Version
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			res += " (" + setting.Value + ")"
+		}
+	}
+	return res
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fantom-foundation/Carmen/go/backend/stock"
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"go.uber.org/mock/gomock"
+)
+
+func TestVerificationStatus_SuccessfulVerificationIsRecorded(t *testing.T) {
+	dir := t.TempDir()
+	status, err := GetVerificationStatus(dir)
+	if err != nil {
+		t.Fatalf("failed to get verification status: %v", err)
+	}
+	if status.LastVerification != nil || status.IsTainted() {
+		t.Errorf("fresh directory should have no status, got %+v", status)
+	}
+
+	trie, err := OpenFileLiveTrie(dir, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := trie.SetAccountInfo(common.Address{byte(i)}, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+	}
+	hash, _, err := trie.UpdateHashes()
+	if err != nil {
+		t.Fatalf("failed to hash trie: %v", err)
+	}
+	if err := trie.Close(); err != nil {
+		t.Fatalf("failed to close trie: %v", err)
+	}
+
+	before := time.Now()
+	if err := VerifyFileLiveTrie(dir, S5LiveConfig, nil); err != nil {
+		t.Fatalf("verification failed: %v", err)
+	}
+	status, err = GetVerificationStatus(dir)
+	if err != nil {
+		t.Fatalf("failed to get verification status: %v", err)
+	}
+	record := status.LastVerification
+	if record == nil {
+		t.Fatalf("verification should be recorded")
+	}
+	if record.Time.Before(before.Add(-time.Second)) || record.Time.After(time.Now()) {
+		t.Errorf("unexpected verification time %v", record.Time)
+	}
+	if record.ToolVersion == "" {
+		t.Errorf("tool version should be recorded")
+	}
+	if record.RootHash != hash || record.NumRoots != 1 {
+		t.Errorf("unexpected verified roots, wanted %x, got %d roots ending at %x", hash, record.NumRoots, record.RootHash)
+	}
+	if want, got := uint64(10), record.NodeCounts.Accounts; want != got {
+		t.Errorf("unexpected number of accounts, wanted %d, got %d", want, got)
+	}
+	if record.NodeCounts.Branches == 0 {
+		t.Errorf("branch nodes should be counted")
+	}
+}
+
+func TestVerificationStatus_TaintIsSetSurvivesReopenAndIsClearedByVerification(t *testing.T) {
+	dir := t.TempDir()
+	trie, err := OpenFileLiveTrie(dir, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	if err := trie.SetAccountInfo(common.Address{1}, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+
+	// Loading nodes from a corrupted stock taints the directory.
+	forest := trie.forest.(*Forest)
+	original := forest.accounts
+	ctrl := gomock.NewController(t)
+	accounts := stock.NewMockStock[uint64, AccountNode](ctrl)
+	accounts.EXPECT().Get(uint64(123)).Return(AccountNode{}, errors.New("checksum mismatch"))
+	accounts.EXPECT().Get(uint64(456)).Return(AccountNode{}, errors.New("other error"))
+	forest.accounts = accounts
+	for _, id := range []uint64{123, 456} {
+		ref := NewNodeReference(AccountId(id))
+		if _, _, err := forest.GetAccountInfo(&ref, common.Address{1}); err == nil {
+			t.Errorf("loading corrupted node should fail")
+		}
+	}
+	forest.accounts = original
+
+	checkTaint := func() {
+		t.Helper()
+		status, err := GetVerificationStatus(dir)
+		if err != nil {
+			t.Fatalf("failed to get verification status: %v", err)
+		}
+		if !status.IsTainted() {
+			t.Fatalf("directory should be tainted")
+		}
+		if got := status.Taint.Error; !strings.Contains(got, "checksum mismatch") {
+			t.Errorf("taint should report the first corruption, got %s", got)
+		}
+	}
+	checkTaint()
+	// Closing reports the errors recorded by the forest.
+	if err := trie.Close(); err == nil {
+		t.Errorf("closing corrupted trie should fail")
+	}
+
+	// The taint survives reopening the directory.
+	trie, err = OpenFileLiveTrie(dir, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to reopen trie: %v", err)
+	}
+	if !trie.forest.(*Forest).tainted.Load() {
+		t.Errorf("reopened forest should be aware of the taint")
+	}
+	if err := trie.Close(); err != nil {
+		t.Fatalf("failed to close trie: %v", err)
+	}
+	checkTaint()
+
+	// Only a successful verification clears the taint.
+	if err := VerifyFileLiveTrie(dir, S5LiveConfig, nil); err != nil {
+		t.Fatalf("verification failed: %v", err)
+	}
+	status, err := GetVerificationStatus(dir)
+	if err != nil {
+		t.Fatalf("failed to get verification status: %v", err)
+	}
+	if status.IsTainted() || status.LastVerification == nil {
+		t.Errorf("verification should clear the taint, got %+v", status)
+	}
+}
+
+func TestVerificationStatus_FailedVerificationKeepsTaint(t *testing.T) {
+	dir := t.TempDir()
+	trie, err := OpenFileLiveTrie(dir, S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	if err := trie.SetAccountInfo(common.Address{1}, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+	if err := trie.Close(); err != nil {
+		t.Fatalf("failed to close trie: %v", err)
+	}
+	if err := markTainted(dir, errors.New("injected")); err != nil {
+		t.Fatalf("failed to taint directory: %v", err)
+	}
+
+	// Verifying a different configuration fails.
+	if err := VerifyFileLiveTrie(dir, S4LiveConfig, nil); err == nil {
+		t.Fatalf("verification should fail")
+	}
+	status, err := GetVerificationStatus(dir)
+	if err != nil {
+		t.Fatalf("failed to get verification status: %v", err)
+	}
+	if !status.IsTainted() || status.LastVerification != nil {
+		t.Errorf("failed verification should not affect the status, got %+v", status)
+	}
+}
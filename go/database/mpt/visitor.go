@@ -41,6 +41,73 @@ type NodeInfo struct {
 	Id       NodeId          // the ID of the visited node
 	Depth    *int            // the nesting level of the visited node, only set for tree visits
 	Embedded tribool.Tribool // true if this node is embedded in another node, tracked in visitPathTo
+
+	// The following properties describe the position of the node in the trie
+	// and are only set for tree visits. The root of a visit has no parent. The
+	// path is only valid during the visit of the node and needs to be copied
+	// to be retained.
+	Parent     NodeId   // the ID of the node the visited node was reached through, the empty ID for the root of a visit
+	ChildIndex *Nibble  // the index of the visited node among the children of its parent, only set for children of branch nodes
+	Path       []Nibble // the path from the root of the visited trie to the node, restarting at the root of each storage trie
+}
+
+// visitPosition is the position of a node in a tree visit, which is tracked
+// by the nodes while descending the tree to fill in the NodeInfo of their
+// children. To avoid allocations for each node, paths share a common buffer.
+// Thus, visitors need to copy the path of a node for retaining it beyond the
+// visit of the node.
+type visitPosition struct {
+	depth  int
+	parent NodeId
+	index  *Nibble
+	path   []Nibble
+}
+
+// getInfo returns the NodeInfo of the node with the given ID at this position.
+func (p *visitPosition) getInfo(id NodeId) NodeInfo {
+	depth := p.depth
+	return NodeInfo{
+		Id:         id,
+		Depth:      &depth,
+		Parent:     p.parent,
+		ChildIndex: p.index,
+		Path:       p.path,
+	}
+}
+
+// getChildPosition returns the position of the child with the given index of
+// the branch node with the given ID at this position.
+func (p *visitPosition) getChildPosition(branch NodeId, index Nibble) visitPosition {
+	return visitPosition{
+		depth:  p.depth + 1,
+		parent: branch,
+		index:  &index,
+		path:   append(p.path, index),
+	}
+}
+
+// getNextPosition returns the position of the node following the extension
+// node with the given ID and path at this position.
+func (p *visitPosition) getNextPosition(extension NodeId, path *Path) visitPosition {
+	res := visitPosition{
+		depth:  p.depth + 1,
+		parent: extension,
+		path:   p.path,
+	}
+	for i := 0; i < path.Length(); i++ {
+		res.path = append(res.path, path.Get(i))
+	}
+	return res
+}
+
+// getStoragePosition returns the position of the root of the storage trie of
+// the account node with the given ID at this position.
+func (p *visitPosition) getStoragePosition(account NodeId) visitPosition {
+	return visitPosition{
+		depth:  p.depth + 1,
+		parent: account,
+		path:   p.path[len(p.path):], // empty, but sharing the buffer
+	}
 }
 
 type VisitResponse int
@@ -82,6 +149,41 @@ func (v *lambdaVisitor) Visit(n Node, i NodeInfo) VisitResponse {
 	return v.visit(n, i)
 }
 
+// ----------------------------------------------------------------------------
+//                          Depth-Limiting Visitor
+// ----------------------------------------------------------------------------
+
+// depthLimitingVisitor forwards visits of nodes up to a maximum depth to a
+// nested visitor and prunes the descendants of nodes at the maximum depth.
+// Depths are only known for tree visits, thus it can not be used for forests.
+type depthLimitingVisitor struct {
+	nested    NodeVisitor
+	maxDepth  int
+	truncated bool // set if any node with descendants was pruned
+}
+
+func (v *depthLimitingVisitor) Visit(n Node, i NodeInfo) VisitResponse {
+	response := v.nested.Visit(n, i)
+	if response != VisitResponseContinue || i.Depth == nil || *i.Depth < v.maxDepth {
+		return response
+	}
+	if hasChildren(n) {
+		v.truncated = true
+	}
+	return VisitResponsePrune
+}
+
+// hasChildren returns true if the given node has nodes below it in the trie.
+func hasChildren(n Node) bool {
+	switch node := n.(type) {
+	case *BranchNode, *ExtensionNode:
+		return true
+	case *AccountNode:
+		return !node.storage.Id().IsEmpty()
+	}
+	return false
+}
+
 // ----------------------------------------------------------------------------
 //                            Node Statistics
 // ----------------------------------------------------------------------------
@@ -179,3 +281,90 @@ func (c *nodeStatisticsCollector) registerDepth(info NodeInfo) {
 	}
 	c.stats.depths[*info.Depth]++
 }
+
+// ----------------------------------------------------------------------------
+//                              Trie Shape
+// ----------------------------------------------------------------------------
+
+// GetTrieShape computes histograms describing the shape of the given trie.
+func GetTrieShape(trie *LiveTrie) (TrieShape, error) {
+	collector := &trieShapeCollector{}
+	if err := trie.VisitTrie(collector); err != nil {
+		return TrieShape{}, err
+	}
+	return collector.shape, nil
+}
+
+// GetArchiveTrieShape computes histograms describing the shape of the trie
+// of the given block in the given archive.
+func GetArchiveTrieShape(archive *ArchiveTrie, block uint64) (TrieShape, error) {
+	collector := &trieShapeCollector{}
+	if err := archive.VisitTrie(block, collector); err != nil {
+		return TrieShape{}, err
+	}
+	return collector.shape, nil
+}
+
+// TrieShape summarizes the shape of a trie by histograms of the depths of
+// leaf nodes and the path lengths of extension nodes. Depths are measured in
+// nibbles covered by the nodes above a leaf. For values, the depth is
+// relative to the root of the storage trie they are contained in.
+type TrieShape struct {
+	accountDepths    []int
+	valueDepths      []int
+	extensionLengths []int
+}
+
+func (s *TrieShape) String() string {
+	builder := strings.Builder{}
+	writeHistogram := func(title string, histogram []int) {
+		builder.WriteString(title + ":\n")
+		for i, count := range histogram {
+			builder.WriteString(fmt.Sprintf("%d, %d\n", i, count))
+		}
+	}
+	writeHistogram("Account-Leaf-Depth Distribution", s.accountDepths)
+	writeHistogram("Value-Leaf-Depth Distribution", s.valueDepths)
+	writeHistogram("Extension-Path-Length Distribution", s.extensionLengths)
+	return builder.String()
+}
+
+type trieShapeCollector struct {
+	shape TrieShape
+	// The nibble depth of the next node at each nesting level, updated
+	// while descending the trie in depth-first order.
+	positions []int
+}
+
+func (c *trieShapeCollector) Visit(node Node, info NodeInfo) VisitResponse {
+	if info.Depth == nil {
+		return VisitResponseContinue
+	}
+	depth := *info.Depth
+	for len(c.positions) <= depth+1 {
+		c.positions = append(c.positions, 0)
+	}
+	position := c.positions[depth]
+	next := position
+	switch t := node.(type) {
+	case *AccountNode:
+		addToHistogram(&c.shape.accountDepths, position)
+		next = 0 // < the storage trie starts a new path
+	case *BranchNode:
+		next = position + 1
+	case *ExtensionNode:
+		addToHistogram(&c.shape.extensionLengths, t.path.Length())
+		next = position + t.path.Length()
+	case *ValueNode:
+		addToHistogram(&c.shape.valueDepths, position)
+	}
+	c.positions[depth+1] = next
+	return VisitResponseContinue
+}
+
+func addToHistogram(histogram *[]int, value int) {
+	for len(*histogram) <= value {
+		*histogram = append(*histogram, 0)
+	}
+	(*histogram)[value]++
+}
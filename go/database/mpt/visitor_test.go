@@ -11,9 +11,12 @@
 package mpt
 
 import (
+	"fmt"
+	"slices"
 	"testing"
 
 	"github.com/Fantom-foundation/Carmen/go/common"
+	"go.uber.org/mock/gomock"
 )
 
 func TestNodeStatistics_CollectTrieStatisticsWorks(t *testing.T) {
@@ -90,3 +93,304 @@ func TestNodeStatistics_CollectForestStatisticsWorks(t *testing.T) {
 		t.Errorf("invalid stats for archive: %v", &stats)
 	}
 }
+
+func TestTrieShape_HistogramsDescribeShapeOfTrie(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S4LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to create empty trie: %v", err)
+	}
+	defer trie.Close()
+
+	shape, err := GetTrieShape(trie)
+	if err != nil {
+		t.Fatalf("failed to collect shape of empty trie: %v", err)
+	}
+	if len(shape.accountDepths) != 0 || len(shape.valueDepths) != 0 || len(shape.extensionLengths) != 0 {
+		t.Errorf("invalid shape of empty trie: %v", &shape)
+	}
+
+	// The accounts 0x00.. and 0x1.. are split by the root branch, the
+	// accounts 0x10.. and 0x11.. by an additional branch. The keys of the
+	// values share a one-nibble prefix covered by an extension.
+	info := AccountInfo{Nonce: common.ToNonce(1)}
+	trie.SetAccountInfo(common.Address{0x00}, info)
+	trie.SetAccountInfo(common.Address{0x10}, info)
+	trie.SetAccountInfo(common.Address{0x11}, info)
+	trie.SetValue(common.Address{0x00}, common.Key{0x01}, common.Value{1})
+	trie.SetValue(common.Address{0x00}, common.Key{0x02}, common.Value{2})
+	trie.SetValue(common.Address{0x10}, common.Key{0x01}, common.Value{1})
+
+	shape, err = GetTrieShape(trie)
+	if err != nil {
+		t.Fatalf("failed to collect shape of trie: %v", err)
+	}
+	if want, got := []int{0, 1, 2}, shape.accountDepths; !slices.Equal(want, got) {
+		t.Errorf("unexpected account depths, wanted %v, got %v", want, got)
+	}
+	if want, got := []int{1, 0, 2}, shape.valueDepths; !slices.Equal(want, got) {
+		t.Errorf("unexpected value depths, wanted %v, got %v", want, got)
+	}
+	if want, got := []int{0, 1}, shape.extensionLengths; !slices.Equal(want, got) {
+		t.Errorf("unexpected extension lengths, wanted %v, got %v", want, got)
+	}
+}
+
+func TestVisitTrie_NodesAreVisitedDepthFirstInAscendingNibbleOrder(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S4LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to create empty trie: %v", err)
+	}
+	defer trie.Close()
+
+	// Accounts and slots are inserted out of order to make sure that the
+	// visiting order does not depend on the insertion order.
+	info := AccountInfo{Nonce: common.ToNonce(1)}
+	for _, addr := range []common.Address{{0x20}, {0x13}, {0x12}, {0x12, 0x34}} {
+		if err := trie.SetAccountInfo(addr, info); err != nil {
+			t.Fatalf("failed to set account info: %v", err)
+		}
+	}
+	for _, key := range []common.Key{{0xB0}, {0x0A}, {0x01}} {
+		if err := trie.SetValue(common.Address{0x13}, key, common.Value{1}); err != nil {
+			t.Fatalf("failed to set value: %v", err)
+		}
+	}
+
+	visited := []string{}
+	err = trie.VisitTrie(MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+		var label string
+		switch n := node.(type) {
+		case *BranchNode:
+			label = "Branch"
+		case *ExtensionNode:
+			label = fmt.Sprintf("Extension-%v", n.path)
+		case *AccountNode:
+			label = fmt.Sprintf("Account-%x", n.address[:2])
+		case *ValueNode:
+			label = fmt.Sprintf("Value-%x", n.key[:1])
+		default:
+			label = fmt.Sprintf("%T", node)
+		}
+		visited = append(visited, fmt.Sprintf("%d:%s", *info.Depth, label))
+		return VisitResponseContinue
+	}))
+	if err != nil {
+		t.Fatalf("failed to visit trie: %v", err)
+	}
+
+	want := []string{
+		"0:Branch", // root, split by the first nibble of addresses
+		"1:Branch", // accounts 0x12.. and 0x13..
+		"2:Branch", // accounts 0x1200.. and 0x1234..
+		"3:Account-1200",
+		"3:Account-1234",
+		"2:Account-1300", // accounts precede their storage
+		"3:Branch",       // storage root, split by the first nibble of keys
+		"4:Branch",       // keys 0x01.. and 0x0A..
+		"5:Value-01",
+		"5:Value-0a",
+		"4:Value-b0",
+		"1:Account-2000",
+	}
+	if !slices.Equal(want, visited) {
+		t.Errorf("unexpected visiting order\nwanted %v\n   got %v", want, visited)
+	}
+}
+
+func TestVisitToDepth_NodesBelowMaxDepthArePrunedAndReported(t *testing.T) {
+	trie, err := OpenVolatileLiveTrie(S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	for i := 0; i < 50; i++ {
+		addr := common.Address{byte(i)}
+		if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+		for j := 0; j < i%4; j++ {
+			if err := trie.SetValue(addr, common.Key{byte(j)}, common.Value{1}); err != nil {
+				t.Fatalf("failed to set slot: %v", err)
+			}
+		}
+	}
+
+	// Collect the nodes visited by a full visit.
+	type visit struct {
+		id    NodeId
+		depth int
+	}
+	record := func(visits *[]visit) NodeVisitor {
+		return MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+			*visits = append(*visits, visit{info.Id, *info.Depth})
+			return VisitResponseContinue
+		})
+	}
+	var all []visit
+	if err := trie.VisitTrie(record(&all)); err != nil {
+		t.Fatalf("failed to visit trie: %v", err)
+	}
+	maxDepth := 0
+	for _, v := range all {
+		if v.depth > maxDepth {
+			maxDepth = v.depth
+		}
+	}
+
+	for limit := 0; limit <= maxDepth+1; limit++ {
+		var got []visit
+		truncated, err := trie.VisitToDepth(limit, record(&got))
+		if err != nil {
+			t.Fatalf("failed to visit trie: %v", err)
+		}
+		want := slices.DeleteFunc(slices.Clone(all), func(v visit) bool {
+			return v.depth > limit
+		})
+		if !slices.Equal(want, got) {
+			t.Errorf("unexpected nodes visited with depth limit %d, wanted %v, got %v", limit, want, got)
+		}
+		if want := limit < maxDepth; want != truncated {
+			t.Errorf("unexpected truncation flag for depth limit %d, wanted %t, got %t", limit, want, truncated)
+		}
+	}
+}
+
+func TestVisitToDepth_LeavesAtMaxDepthAreNotReportedAsTruncation(t *testing.T) {
+	trie, err := OpenVolatileLiveTrie(S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	defer trie.Close()
+	if err := trie.SetAccountInfo(common.Address{1}, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+
+	visited := 0
+	truncated, err := trie.VisitToDepth(0, MakeVisitor(func(Node, NodeInfo) VisitResponse {
+		visited++
+		return VisitResponseContinue
+	}))
+	if err != nil {
+		t.Fatalf("failed to visit trie: %v", err)
+	}
+	if visited != 1 || truncated {
+		t.Errorf("account without storage should be visited without truncation, visited %d, truncated %t", visited, truncated)
+	}
+
+	if err := trie.SetValue(common.Address{1}, common.Key{1}, common.Value{1}); err != nil {
+		t.Fatalf("failed to set slot: %v", err)
+	}
+	truncated, err = trie.VisitToDepth(0, MakeVisitor(func(Node, NodeInfo) VisitResponse {
+		return VisitResponseContinue
+	}))
+	if err != nil || !truncated {
+		t.Errorf("storage of account should be pruned, got %t, %v", truncated, err)
+	}
+}
+
+func TestVisit_PositionsOfNodesAreReported(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ctxt := newNodeContext(t, ctrl)
+
+	ref, node := ctxt.Build(&Branch{children: Children{
+		1: &Extension{
+			path: []Nibble{2, 3},
+			next: &Branch{children: Children{
+				4: &Account{address: common.Address{1}, info: AccountInfo{Nonce: common.Nonce{1}},
+					storage: &Branch{children: Children{
+						5: &Value{key: common.Key{1}, value: common.Value{1}},
+						7: &Value{key: common.Key{2}, value: common.Value{2}},
+					}},
+				},
+				6: &Account{address: common.Address{2}, info: AccountInfo{Nonce: common.Nonce{1}}},
+			}},
+		},
+		9: &Account{address: common.Address{3}, info: AccountInfo{Nonce: common.Nonce{1}}},
+	}})
+
+	type position struct {
+		parent int // the position of the parent in the visit order, -1 for the root
+		index  int // the child index, -1 if not reached through a branch node
+		path   []Nibble
+	}
+	want := []position{
+		{-1, -1, nil},                // root branch
+		{0, 1, []Nibble{1}},          // extension
+		{1, -1, []Nibble{1, 2, 3}},   // branch below the extension
+		{2, 4, []Nibble{1, 2, 3, 4}}, // account 1
+		{3, -1, nil},                 // storage root, restarting the path
+		{4, 5, []Nibble{5}},          // value 1
+		{4, 7, []Nibble{7}},          // value 2
+		{2, 6, []Nibble{1, 2, 3, 6}}, // account 2
+		{0, 9, []Nibble{9}},          // account 3
+	}
+
+	var ids []NodeId
+	var got []position
+	visitor := MakeVisitor(func(_ Node, info NodeInfo) VisitResponse {
+		parent := slices.Index(ids, info.Parent)
+		if info.Parent.IsEmpty() {
+			parent = -1
+		}
+		index := -1
+		if info.ChildIndex != nil {
+			index = int(*info.ChildIndex)
+		}
+		ids = append(ids, info.Id)
+		got = append(got, position{parent, index, slices.Clone(info.Path)})
+		return VisitResponseContinue
+	})
+
+	handle := node.GetViewHandle()
+	defer handle.Release()
+	if abort, err := handle.Get().Visit(ctxt, &ref, 0, visitor); abort || err != nil {
+		t.Fatalf("unexpected result of visit, wanted (false,nil), got(%v,%v)", abort, err)
+	}
+
+	if len(want) != len(got) {
+		t.Fatalf("unexpected number of visited nodes, wanted %d, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if want[i].parent != got[i].parent || want[i].index != got[i].index || !slices.Equal(want[i].path, got[i].path) {
+			t.Errorf("unexpected position of node %d, wanted %v, got %v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestVisit_PathsOfLeafsArePrefixesOfTheirKeys(t *testing.T) {
+	trie, err := OpenInMemoryLiveTrie(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to create trie: %v", err)
+	}
+	defer trie.Close()
+	for i := 0; i < 10; i++ {
+		addr := common.Address{byte(i)}
+		if err := trie.SetAccountInfo(addr, AccountInfo{Nonce: common.ToNonce(1)}); err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+		for j := 0; j < 10; j++ {
+			if err := trie.SetValue(addr, common.Key{byte(j)}, common.Value{1}); err != nil {
+				t.Fatalf("failed to set value: %v", err)
+			}
+		}
+	}
+
+	err = trie.VisitTrie(MakeVisitor(func(node Node, info NodeInfo) VisitResponse {
+		var key []Nibble
+		switch n := node.(type) {
+		case *AccountNode:
+			key = addressToHashedNibbles(n.address)
+		case *ValueNode:
+			key = keyToHashedPathNibbles(n.key)
+		default:
+			return VisitResponseContinue
+		}
+		if len(info.Path) == 0 || !slices.Equal(info.Path, key[:len(info.Path)]) {
+			t.Errorf("path %v of node %v is not a prefix of its key %v", info.Path, info.Id, key)
+		}
+		return VisitResponseContinue
+	}))
+	if err != nil {
+		t.Fatalf("failed to visit trie: %v", err)
+	}
+}
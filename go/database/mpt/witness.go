@@ -0,0 +1,175 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"fmt"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/rlp"
+)
+
+// BlockWitnessData summarizes the pre-state of all accounts and storage slots
+// touched by a block, as needed by external builders of stateless-execution
+// witnesses.
+type BlockWitnessData struct {
+	// The number of the block the data was recorded for.
+	Block uint64
+	// The pre-state of all accounts touched by the block.
+	Accounts map[common.Address]*AccountWitnessData
+}
+
+// AccountWitnessData is the pre-state of a single account touched by a block.
+type AccountWitnessData struct {
+	// The RLP encoding of the account state as stored in the leaf of the
+	// account in Ethereum's state trie, nil if the account did not exist.
+	Rlp []byte
+	// The root hash of the account's storage trie before the block.
+	StorageRoot common.Hash
+	// The values of all storage slots touched by the block before the block.
+	Slots map[common.Key]common.Value
+}
+
+// witnessRecorder collects the pre-state of accounts and slots touched by a
+// LiveTrie. Pre-states are recorded at the first update of an account or slot
+// within a block, before the update is applied to the trie. Since slots may
+// be touched after the storage of their account got cleared, the full storage
+// of an account is recorded before clearing it.
+type witnessRecorder struct {
+	accounts map[common.Address]*AccountWitnessData
+	storages map[common.Address]map[common.Key]common.Value
+}
+
+func newWitnessRecorder() *witnessRecorder {
+	return &witnessRecorder{
+		accounts: map[common.Address]*AccountWitnessData{},
+		storages: map[common.Address]map[common.Key]common.Value{},
+	}
+}
+
+// recordAccount records the current state of the given account in the given
+// trie if it has not yet been recorded in the current block.
+func (r *witnessRecorder) recordAccount(trie *LiveTrie, address common.Address) (*AccountWitnessData, error) {
+	if data, found := r.accounts[address]; found {
+		return data, nil
+	}
+	source, ok := trie.forest.(NodeSource)
+	if !ok {
+		return nil, fmt.Errorf("node access is not supported by %T", trie.forest)
+	}
+	account, found, err := getAccountNode(source, &trie.root, address)
+	if err != nil {
+		return nil, err
+	}
+	data := &AccountWitnessData{
+		StorageRoot: EmptyNodeEthereumHash,
+		Slots:       map[common.Key]common.Value{},
+	}
+	if found {
+		if !account.storage.Id().IsEmpty() {
+			data.StorageRoot = account.storageHash
+		}
+		data.Rlp = rlp.Encode(rlp.List{Items: []rlp.Item{
+			rlp.Uint64{Value: account.info.Nonce.ToUint64()},
+			rlp.BigInt{Value: account.info.Balance.ToBigInt()},
+			rlp.Hash{Hash: &data.StorageRoot},
+			rlp.Hash{Hash: &account.info.CodeHash},
+		}})
+	}
+	r.accounts[address] = data
+	return data, nil
+}
+
+// recordAccountUpdate records the pre-state of the given account before its
+// information is updated to the given value. Since the deletion of an account
+// deletes its storage, the storage is recorded as well in this case.
+func (r *witnessRecorder) recordAccountUpdate(trie *LiveTrie, address common.Address, info AccountInfo) error {
+	if info.IsEmpty() {
+		return r.recordStorage(trie, address)
+	}
+	_, err := r.recordAccount(trie, address)
+	return err
+}
+
+// recordSlot records the current value of the given slot in the given trie,
+// as well as the state of its account, if they have not yet been recorded in
+// the current block.
+func (r *witnessRecorder) recordSlot(trie *LiveTrie, address common.Address, key common.Key) error {
+	data, err := r.recordAccount(trie, address)
+	if err != nil {
+		return err
+	}
+	if _, found := data.Slots[key]; found {
+		return nil
+	}
+	if storage, found := r.storages[address]; found {
+		data.Slots[key] = storage[key]
+		return nil
+	}
+	value, err := trie.GetValue(address, key)
+	if err != nil {
+		return err
+	}
+	data.Slots[key] = value
+	return nil
+}
+
+// recordStorage records the state of the given account and the values of all
+// of its storage slots in the given trie, if they have not yet been recorded
+// in the current block. It is to be called before the account's storage is
+// cleared or the account is deleted.
+func (r *witnessRecorder) recordStorage(trie *LiveTrie, address common.Address) error {
+	if _, err := r.recordAccount(trie, address); err != nil {
+		return err
+	}
+	if _, found := r.storages[address]; found {
+		return nil
+	}
+	source, ok := trie.forest.(NodeSource)
+	if !ok {
+		return fmt.Errorf("node access is not supported by %T", trie.forest)
+	}
+	// The storage may have been modified in the current block, so its hash
+	// may be outdated and only the reference to its root is obtained.
+	storageRoot := NewNodeReference(EmptyId())
+	_, err := VisitPathToAccount(source, &trie.root, address, MakeVisitor(func(node Node, _ NodeInfo) VisitResponse {
+		if n, ok := node.(*AccountNode); ok && n.address == address {
+			storageRoot = n.storage
+		}
+		return VisitResponseContinue
+	}))
+	if err != nil {
+		return err
+	}
+	storage := map[common.Key]common.Value{}
+	if !storageRoot.Id().IsEmpty() {
+		err := trie.forest.VisitTrie(&storageRoot, MakeVisitor(func(node Node, _ NodeInfo) VisitResponse {
+			if n, ok := node.(*ValueNode); ok {
+				storage[n.key] = n.value
+			}
+			return VisitResponseContinue
+		}))
+		if err != nil {
+			return err
+		}
+	}
+	r.storages[address] = storage
+	return nil
+}
+
+// endBlock returns the data recorded since the last call and resets the
+// recorder for the next block.
+func (r *witnessRecorder) endBlock(block uint64) *BlockWitnessData {
+	res := &BlockWitnessData{Block: block, Accounts: r.accounts}
+	r.accounts = map[common.Address]*AccountWitnessData{}
+	r.storages = map[common.Address]map[common.Key]common.Value{}
+	return res
+}
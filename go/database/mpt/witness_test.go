@@ -0,0 +1,243 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package mpt
+
+import (
+	"bytes"
+	"maps"
+	"math/rand"
+	"testing"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+	"github.com/Fantom-foundation/Carmen/go/database/mpt/rlp"
+)
+
+func TestWitnessRecording_PreStatesMatchSnapshotTakenBeforeBlock(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	if err := state.SetWitnessRecording(true); err != nil {
+		t.Fatalf("failed to enable witness recording: %v", err)
+	}
+
+	type slot struct {
+		addr common.Address
+		key  common.Key
+	}
+	r := rand.New(rand.NewSource(42))
+	for block := uint64(0); block < 50; block++ {
+		update := getRandomUpdateWithDeletions(r)
+
+		// Take a snapshot of all accounts and slots referenced by the update.
+		accounts := map[common.Address][]byte{}
+		for _, addr := range getAddressesOf(&update) {
+			leaf, found, err := state.trie.GetAccountLeafRlp(addr)
+			if err != nil {
+				t.Fatalf("failed to get account leaf: %v", err)
+			}
+			if found {
+				accounts[addr] = getAccountRlpOfLeaf(t, leaf)
+			}
+		}
+		slots := map[slot]common.Value{}
+		for _, change := range update.Slots {
+			value, err := state.GetStorage(change.Account, change.Key)
+			if err != nil {
+				t.Fatalf("failed to get storage: %v", err)
+			}
+			slots[slot{change.Account, change.Key}] = value
+		}
+
+		if _, err := state.Apply(block, update); err != nil {
+			t.Fatalf("failed to apply update: %v", err)
+		}
+		data := state.GetBlockWitnessData()
+		if data == nil || data.Block != block {
+			t.Fatalf("missing witness data for block %d, got %v", block, data)
+		}
+
+		for addr, got := range data.Accounts {
+			want, found := accounts[addr]
+			if !bytes.Equal(want, got.Rlp) || found != (got.Rlp != nil) {
+				t.Errorf("unexpected pre-state of account %v in block %d, wanted %x, got %x", addr, block, want, got.Rlp)
+			}
+			wantRoot := EmptyNodeEthereumHash
+			if found {
+				wantRoot = getStorageRootOfAccountRlp(t, want)
+			}
+			if got.StorageRoot != wantRoot {
+				t.Errorf("unexpected storage root of account %v in block %d, wanted %x, got %x", addr, block, wantRoot, got.StorageRoot)
+			}
+			for key, value := range got.Slots {
+				if want, found := slots[slot{addr, key}]; !found || want != value {
+					t.Errorf("unexpected pre-value of slot %v/%v in block %d, wanted %x, got %x", addr, key, block, want, value)
+				}
+			}
+		}
+		for slot, value := range slots {
+			account, found := data.Accounts[slot.addr]
+			if !found {
+				t.Fatalf("missing account %v of touched slot in block %d", slot.addr, block)
+			}
+			if got, found := account.Slots[slot.key]; !found || got != value {
+				t.Errorf("unexpected pre-value of slot %v/%v in block %d, wanted %x, got %x", slot.addr, slot.key, block, value, got)
+			}
+		}
+	}
+}
+
+func TestWitnessRecording_SlotsTouchedAfterClearingStorageReportPreValues(t *testing.T) {
+	for _, config := range []MptConfig{S5LiveConfig, S5ArchiveConfig} {
+		t.Run(config.Name, func(t *testing.T) {
+			state, err := OpenGoMemoryState(t.TempDir(), config, 1024)
+			if err != nil {
+				t.Fatalf("failed to open state: %v", err)
+			}
+			defer state.Close()
+			addr := common.Address{1}
+			update := common.Update{
+				CreatedAccounts: []common.Address{addr},
+				Nonces:          []common.NonceUpdate{{Account: addr, Nonce: common.ToNonce(1)}},
+				Slots: []common.SlotUpdate{
+					{Account: addr, Key: common.Key{1}, Value: common.Value{1}},
+					{Account: addr, Key: common.Key{2}, Value: common.Value{2}},
+				},
+			}
+			if _, err := state.Apply(0, update); err != nil {
+				t.Fatalf("failed to apply update: %v", err)
+			}
+			if err := state.SetWitnessRecording(true); err != nil {
+				t.Fatalf("failed to enable witness recording: %v", err)
+			}
+
+			// Modify a slot, clear the storage, and touch the other slot.
+			if err := state.SetStorage(addr, common.Key{1}, common.Value{3}); err != nil {
+				t.Fatalf("failed to set storage: %v", err)
+			}
+			if err := state.CreateAccount(addr); err != nil {
+				t.Fatalf("failed to re-create account: %v", err)
+			}
+			if err := state.SetStorage(addr, common.Key{2}, common.Value{4}); err != nil {
+				t.Fatalf("failed to set storage: %v", err)
+			}
+			if _, _, err := state.commit(1); err != nil {
+				t.Fatalf("failed to commit block: %v", err)
+			}
+
+			data := state.GetBlockWitnessData()
+			account, found := data.Accounts[addr]
+			if !found {
+				t.Fatalf("missing witness data of account")
+			}
+			want := map[common.Key]common.Value{{1}: {1}, {2}: {2}}
+			if !maps.Equal(want, account.Slots) {
+				t.Errorf("unexpected pre-values of slots, wanted %v, got %v", want, account.Slots)
+			}
+		})
+	}
+}
+
+func TestWitnessRecording_NoDataIsRecordedIfDisabled(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S5LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	if _, err := state.Apply(0, accountLeafRlpTestUpdate()); err != nil {
+		t.Fatalf("failed to apply update: %v", err)
+	}
+	if state.trie.witness != nil || state.GetBlockWitnessData() != nil {
+		t.Errorf("witness data should not be recorded if disabled")
+	}
+
+	if err := state.SetWitnessRecording(true); err != nil {
+		t.Fatalf("failed to enable witness recording: %v", err)
+	}
+	if _, err := state.Apply(1, accountLeafRlpTestUpdate()); err != nil {
+		t.Fatalf("failed to apply update: %v", err)
+	}
+	if state.GetBlockWitnessData() == nil {
+		t.Fatalf("missing witness data")
+	}
+	if err := state.SetWitnessRecording(false); err != nil {
+		t.Fatalf("failed to disable witness recording: %v", err)
+	}
+	if state.trie.witness != nil || state.GetBlockWitnessData() != nil {
+		t.Errorf("witness data should be dropped if disabled")
+	}
+}
+
+func TestWitnessRecording_RequiresEthereumLikeHashing(t *testing.T) {
+	state, err := OpenGoMemoryState(t.TempDir(), S4LiveConfig, 1024)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	defer state.Close()
+	if err := state.SetWitnessRecording(true); err == nil {
+		t.Errorf("witness recording should not be supported by %s", S4LiveConfig.Name)
+	}
+}
+
+// getAddressesOf lists all accounts referenced by the given update.
+func getAddressesOf(update *common.Update) []common.Address {
+	res := append([]common.Address{}, update.DeletedAccounts...)
+	res = append(res, update.CreatedAccounts...)
+	for _, change := range update.Balances {
+		res = append(res, change.Account)
+	}
+	for _, change := range update.Nonces {
+		res = append(res, change.Account)
+	}
+	for _, change := range update.Slots {
+		res = append(res, change.Account)
+	}
+	return res
+}
+
+// getAccountRlpOfLeaf extracts the encoded account state from the given RLP
+// encoded account leaf node.
+func getAccountRlpOfLeaf(t *testing.T, leaf []byte) []byte {
+	t.Helper()
+	item, err := rlp.Decode(leaf)
+	if err != nil {
+		t.Fatalf("failed to decode leaf: %v", err)
+	}
+	list, ok := item.(rlp.List)
+	if !ok || len(list.Items) != 2 {
+		t.Fatalf("invalid leaf encoding: %x", leaf)
+	}
+	value, ok := list.Items[1].(rlp.String)
+	if !ok {
+		t.Fatalf("invalid leaf encoding: %x", leaf)
+	}
+	return value.Str
+}
+
+// getStorageRootOfAccountRlp extracts the storage root from the given RLP
+// encoded account state.
+func getStorageRootOfAccountRlp(t *testing.T, account []byte) common.Hash {
+	t.Helper()
+	item, err := rlp.Decode(account)
+	if err != nil {
+		t.Fatalf("failed to decode account: %v", err)
+	}
+	list, ok := item.(rlp.List)
+	if !ok || len(list.Items) != 4 {
+		t.Fatalf("invalid account encoding: %x", account)
+	}
+	root, ok := list.Items[2].(rlp.String)
+	if !ok || len(root.Str) != len(common.Hash{}) {
+		t.Fatalf("invalid account encoding: %x", account)
+	}
+	return common.Hash(root.Str)
+}
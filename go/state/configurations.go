@@ -11,6 +11,7 @@
 package state
 
 import (
+	"errors"
 	"fmt"
 	"maps"
 
@@ -40,6 +41,11 @@ const UnsupportedConfiguration = common.ConstError("unsupported configuration")
 // given parameters a state can be constructed, the resulting state is returned. If
 // construction fails, an error is reported. If the requested configuration is not
 // supported, the error is an UnsupportedConfiguration error.
+//
+// The schema of the state is recorded in the state directory when it is first
+// opened. If the directory contains data of a different schema, the error is an
+// ErrSchemaMismatch error. Directories created before schemas were recorded are
+// assumed to be of the requested schema.
 func NewState(params Parameters) (State, error) {
 	config := Configuration{
 		Variant: params.Variant,
@@ -60,7 +66,22 @@ func NewState(params Parameters) (State, error) {
 	if !found {
 		return nil, fmt.Errorf("%w: no registered implementation for %v", UnsupportedConfiguration, config)
 	}
-	return factory(params)
+	if params.Directory == "" {
+		return factory(params)
+	}
+
+	recorded, err := checkSchemaHeader(params.Directory, config.Schema)
+	if err != nil {
+		return nil, err
+	}
+	state, err := factory(params)
+	if err != nil || recorded {
+		return state, err
+	}
+	if err := writeSchemaHeader(params.Directory, config.Schema); err != nil {
+		return nil, errors.Join(err, state.Close())
+	}
+	return state, nil
 }
 
 // ----------------------------------------------------------------------------
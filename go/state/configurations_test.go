@@ -12,9 +12,11 @@ package state_test
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/Fantom-foundation/Carmen/go/state"
@@ -75,6 +77,70 @@ func TestStateConfigs_AllSetupsCreateDataInCorrectDirectories(t *testing.T) {
 	}
 }
 
+func TestNewState_SchemaIsRecordedAndValidatedOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	params := state.Parameters{
+		Variant:   "go-file",
+		Schema:    5,
+		Archive:   state.NoArchive,
+		Directory: dir,
+	}
+	db, err := state.NewState(params)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "schema.json")); err != nil {
+		t.Errorf("schema header should be written on creation: %v", err)
+	}
+
+	// Re-opening the directory with the same schema is fine.
+	db, err = state.NewState(params)
+	if err != nil {
+		t.Fatalf("failed to re-open state: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close state: %v", err)
+	}
+
+	// Opening it with a different schema is rejected.
+	params.Schema = 4
+	_, err = state.NewState(params)
+	if !errors.Is(err, state.ErrSchemaMismatch) {
+		t.Fatalf("opening directory of another schema should fail with a schema mismatch, got %v", err)
+	}
+	want := fmt.Sprintf("directory %s contains data of schema 5, expected schema 4", dir)
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("error should name found and expected schema, wanted '%s', got '%v'", want, err)
+	}
+}
+
+func TestNewState_InvalidSchemaHeadersAreDetected(t *testing.T) {
+	headers := map[string]string{
+		"not json":            "abc",
+		"unsupported version": `{"Version":2,"Schema":5}`,
+	}
+	for name, header := range headers {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "schema.json"), []byte(header), 0600); err != nil {
+				t.Fatalf("failed to write header: %v", err)
+			}
+			_, err := state.NewState(state.Parameters{
+				Variant:   "go-file",
+				Schema:    5,
+				Archive:   state.NoArchive,
+				Directory: dir,
+			})
+			if err == nil {
+				t.Errorf("invalid schema header should be detected")
+			}
+		})
+	}
+}
+
 func isDirectory(t *testing.T, path string) bool {
 	t.Helper()
 	fileInfo, err := os.Stat(path)
@@ -0,0 +1,79 @@
+// Copyright (c) 2024 Fantom Foundation
+//
+// Use of this software is governed by the Business Source License included
+// in the LICENSE file and at fantom.foundation/bsl11.
+//
+// Change Date: 2028-4-16
+//
+// On the date above, in accordance with the Business Source License, use of
+// this software will be governed by the GNU Lesser General Public License v3.
+
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/Fantom-foundation/Carmen/go/common"
+)
+
+// ErrSchemaMismatch is the error returned when opening a state directory
+// containing data of a schema different from the requested one. Since the
+// on-disk layouts of schemas are incompatible, such directories can not be
+// opened.
+const ErrSchemaMismatch = common.ConstError("schema mismatch")
+
+// schemaHeaderFile is the name of the file in state directories recording
+// the schema of the contained data.
+const schemaHeaderFile = "schema.json"
+
+// schemaHeaderVersion is the version of the format of schema headers.
+const schemaHeaderVersion = 1
+
+// schemaHeader is the content of schema header files.
+type schemaHeader struct {
+	Version int
+	Schema  Schema
+}
+
+// checkSchemaHeader checks that the schema recorded in the given directory
+// matches the given schema. If there is no record, which is the case for new
+// directories and directories created before schemas were recorded, false is
+// returned. If the schemas differ, an ErrSchemaMismatch error is returned.
+func checkSchemaHeader(directory string, schema Schema) (bool, error) {
+	path := filepath.Join(directory, schemaHeaderFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var header schemaHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		return false, fmt.Errorf("invalid schema header %s: %w", path, err)
+	}
+	if header.Version != schemaHeaderVersion {
+		return false, fmt.Errorf("unsupported schema header version in %s, wanted %d, got %d", path, schemaHeaderVersion, header.Version)
+	}
+	if header.Schema != schema {
+		return false, fmt.Errorf("%w: directory %s contains data of schema %d, expected schema %d", ErrSchemaMismatch, directory, header.Schema, schema)
+	}
+	return true, nil
+}
+
+// writeSchemaHeader records the given schema in the given directory.
+func writeSchemaHeader(directory string, schema Schema) error {
+	data, err := json.Marshal(schemaHeader{
+		Version: schemaHeaderVersion,
+		Schema:  schema,
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(directory, schemaHeaderFile), data, 0600)
+}